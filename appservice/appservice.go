@@ -49,10 +49,11 @@ func SetupAppServiceAPIComponent(
 	transactionsCache *transactions.Cache,
 ) appserviceAPI.AppServiceQueryAPI {
 	// Create a connection to the appservice postgres DB
-	appserviceDB, err := storage.NewDatabase(string(base.Cfg.Database.AppService))
+	appserviceDB, err := storage.NewDatabase(string(base.Cfg.Database.AppService), base.Cfg.DbProperties(config.DatabaseAppService))
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to appservice db")
 	}
+	base.RegisterDatabaseHealthCheck("appservice db", appserviceDB)
 
 	// Wrap application services in a type that relates the application service and
 	// a sync.Cond object that can be used to notify workers when there are new
@@ -34,10 +34,15 @@ type Database struct {
 }
 
 // NewDatabase opens a new database
-func NewDatabase(dataSourceName string) (*Database, error) {
+func NewDatabase(dataSourceName string, dbProperties sqlutil.DbProperties) (*Database, error) {
 	var result Database
 	var err error
-	if result.db, err = sqlutil.Open(common.SQLiteDriverName(), dataSourceName); err != nil {
+	if result.db, err = sqlutil.Open(common.SQLiteDriverName(), dataSourceName, dbProperties); err != nil {
+		return nil, err
+	}
+	migrator := common.NewMigrator(result.db, "appservice")
+	migrator.AddMigrations(common.BaselineMigration)
+	if err = migrator.Up(context.Background()); err != nil {
 		return nil, err
 	}
 	if err = result.prepare(); err != nil {
@@ -46,6 +51,11 @@ func NewDatabase(dataSourceName string) (*Database, error) {
 	return &result, nil
 }
 
+// Ping checks that the database can be reached.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
 func (d *Database) prepare() error {
 	if err := d.events.prepare(d.db); err != nil {
 		return err
@@ -19,9 +19,10 @@ import (
 	"net/url"
 
 	"github.com/matrix-org/dendrite/appservice/storage/sqlite3"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 )
 
-func NewDatabase(dataSourceName string) (Database, error) {
+func NewDatabase(dataSourceName string, dbProperties sqlutil.DbProperties) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot use postgres implementation")
@@ -30,7 +31,7 @@ func NewDatabase(dataSourceName string) (Database, error) {
 	case "postgres":
 		return nil, fmt.Errorf("Cannot use postgres implementation")
 	case "file":
-		return sqlite3.NewDatabase(dataSourceName)
+		return sqlite3.NewDatabase(dataSourceName, dbProperties)
 	default:
 		return nil, fmt.Errorf("Cannot use postgres implementation")
 	}
@@ -3,4 +3,5 @@
 # Put installed packages into ./bin
 export GOBIN=$PWD/`dirname $0`/bin
 
-go install -v $PWD/`dirname $0`/cmd/...
\ No newline at end of file
+# sqlite_fts5 enables full text search for the SQLite databases
+go install -v -tags sqlite_fts5 $PWD/`dirname $0`/cmd/...
\ No newline at end of file
@@ -38,7 +38,8 @@ var tokenByteLength = 32
 
 // DeviceDatabase represents a device database.
 type DeviceDatabase interface {
-	// Look up the device matching the given access token.
+	// Look up the device matching the given access token. Returns
+	// authtypes.ErrDeviceSoftLoggedOut if the access token has expired.
 	GetDeviceByAccessToken(ctx context.Context, token string) (*authtypes.Device, error)
 }
 
@@ -103,8 +104,9 @@ func VerifyUserFromRequest(
 		if localpart != "" { // AS is masquerading as another user
 			// Verify that the user is registered
 			account, err := data.AccountDB.GetAccountByLocalpart(req.Context(), localpart)
-			// Verify that account exists & appServiceID matches
-			if err == nil && account.AppServiceID == appService.ID {
+			// Verify that account exists & appServiceID matches, and that the
+			// account hasn't been deactivated
+			if err == nil && account.AppServiceID == appService.ID && !account.Deactivated {
 				// Set the userID of dummy device
 				dev.UserID = userID
 				return &dev, nil
@@ -126,6 +128,9 @@ func VerifyUserFromRequest(
 	if devErr == nil {
 		return dev, verifyUserParameters(req)
 	}
+	if _, ok := devErr.JSON.(*jsonerror.UnknownTokenError); ok {
+		return nil, devErr
+	}
 
 	return nil, &util.JSONResponse{
 		Code: http.StatusUnauthorized,
@@ -164,6 +169,11 @@ func verifyAccessToken(req *http.Request, deviceDB DeviceDatabase) (device *auth
 				Code: http.StatusUnauthorized,
 				JSON: jsonerror.UnknownToken("Unknown token"),
 			}
+		} else if err == authtypes.ErrDeviceSoftLoggedOut {
+			resErr = &util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.SoftLoggedOut("The access token has expired"),
+			}
 		} else {
 			util.GetLogger(req.Context()).WithError(err).Error("deviceDB.GetDeviceByAccessToken failed")
 			jsonErr := jsonerror.InternalServerError()
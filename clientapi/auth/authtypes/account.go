@@ -25,6 +25,11 @@ type Account struct {
 	ServerName   gomatrixserverlib.ServerName
 	Profile      *Profile
 	AppServiceID string
+	// Whether the account has been deactivated, which means that it can't be
+	// logged in to any more.
+	Deactivated bool
+	// When the account was created, in milliseconds since the epoch.
+	CreatedTS int64
 	// TODO: Other flags like IsAdmin, IsGuest
 	// TODO: Devices
 	// TODO: Associations (e.g. with application services)
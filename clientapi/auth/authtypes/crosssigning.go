@@ -0,0 +1,51 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+// CrossSigningKeyPurpose is the usage of a cross-signing key.
+type CrossSigningKeyPurpose string
+
+// The purposes of the cross-signing keys of a user.
+const (
+	// The master key signs the other cross-signing keys of the user.
+	CrossSigningKeyPurposeMaster CrossSigningKeyPurpose = "master"
+	// The self-signing key signs the devices of the user.
+	CrossSigningKeyPurposeSelfSigning CrossSigningKeyPurpose = "self_signing"
+	// The user-signing key signs the master keys of other users.
+	CrossSigningKeyPurposeUserSigning CrossSigningKeyPurpose = "user_signing"
+)
+
+// CrossSigningKey is a cross-signing key of a user.
+// See https://github.com/matrix-org/matrix-doc/pull/1756
+type CrossSigningKey struct {
+	UserID string                   `json:"user_id"`
+	Usage  []CrossSigningKeyPurpose `json:"usage"`
+	// The public key, keyed by its key ID, e.g. "ed25519:<public key>".
+	Keys map[string]string `json:"keys"`
+	// The signatures of the key, keyed by user ID and then by key ID.
+	Signatures map[string]map[string]string `json:"signatures,omitempty"`
+}
+
+// CrossSigningSignature is a signature made by a key of one user of a key of
+// the same or another user.
+type CrossSigningSignature struct {
+	OriginUserID string
+	OriginKeyID  string
+	TargetUserID string
+	// The ID of the key which is signed. This is the device ID for device keys
+	// and the public key for cross-signing keys.
+	TargetKeyID string
+	Signature   string
+}
@@ -14,6 +14,13 @@
 
 package authtypes
 
+import "errors"
+
+// ErrDeviceSoftLoggedOut is returned when the access token of a device has
+// expired. The device still exists, so its owner can log in to it again (or
+// refresh its access token) without losing its encryption keys.
+var ErrDeviceSoftLoggedOut = errors.New("the access token of the device has expired")
+
 // Device represents a client's device (mobile, web, etc)
 type Device struct {
 	ID     string
@@ -25,6 +32,9 @@ type Device struct {
 	// Can be used as a secure substitution in places where data needs to be
 	// associated with access tokens.
 	SessionID int64
+	// Whether the device belongs to a guest account. Guests can only use some
+	// of the client APIs, in rooms which allow guest access.
+	IsGuest bool
 	// TODO: display name, last used timestamp, keys, etc
 	DisplayName string
 }
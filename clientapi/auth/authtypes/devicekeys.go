@@ -0,0 +1,37 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// OneTimeKey is a one-time key of a device. Each one-time key is handed out to
+// at most one other device, which uses it to set up an encrypted session.
+type OneTimeKey struct {
+	UserID   string
+	DeviceID string
+	// The ID of the key in the form <algorithm>:<key ID>.
+	KeyID string
+	// The JSON of the key, which is either the key itself or a signed object.
+	KeyJSON json.RawMessage
+}
+
+// Algorithm returns the algorithm of the key, which is the part of its ID
+// before the colon.
+func (k OneTimeKey) Algorithm() string {
+	return strings.SplitN(k.KeyID, ":", 2)[0]
+}
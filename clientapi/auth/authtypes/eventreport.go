@@ -0,0 +1,26 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+// EventReport represents a report made by a user about the content of an event.
+type EventReport struct {
+	ID         int64  `json:"id"`
+	RoomID     string `json:"room_id"`
+	EventID    string `json:"event_id"`
+	UserID     string `json:"user_id"`
+	Reason     string `json:"reason"`
+	Score      int64  `json:"score"`
+	ReceivedTS int64  `json:"received_ts"`
+}
@@ -0,0 +1,30 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+// InviteRejection is the rejection of an invite to a room which this server
+// isn't in, whose leave couldn't be sent to the servers of the inviters yet.
+type InviteRejection struct {
+	Localpart   string
+	RoomID      string
+	Reason      string
+	RoomVersion string
+	// The servers to send the leave through.
+	Servers []string
+	// How many times sending the leave has been tried again.
+	Attempts int
+	// When to try sending the leave again, in milliseconds since the epoch.
+	NextAttemptMS int64
+}
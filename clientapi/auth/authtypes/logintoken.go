@@ -0,0 +1,25 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+// LoginToken is a short-lived token which a client exchanges for an access
+// token with an m.login.token login, such as after a user has logged in with
+// single sign-on. Each token can only be used once.
+type LoginToken struct {
+	Token     string
+	Localpart string
+	// When the token expires, in milliseconds since the epoch.
+	ExpiresAtMS int64
+}
@@ -5,8 +5,12 @@ type LoginType string
 
 // The relevant login types implemented in Dendrite
 const (
+	LoginTypePassword           = "m.login.password"
 	LoginTypeDummy              = "m.login.dummy"
 	LoginTypeSharedSecret       = "org.matrix.login.shared_secret"
 	LoginTypeRecaptcha          = "m.login.recaptcha"
 	LoginTypeApplicationService = "m.login.application_service"
+	LoginTypeRegistrationToken  = "m.login.registration_token"
+	LoginTypeSSO                = "m.login.sso"
+	LoginTypeToken              = "m.login.token"
 )
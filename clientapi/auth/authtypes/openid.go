@@ -0,0 +1,26 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+// OpenIDToken is a token which lets a third party, such as an integration
+// server, find out which user a client belongs to by asking the homeserver
+// which issued it.
+// https://matrix.org/docs/spec/client_server/r0.6.0#openid
+type OpenIDToken struct {
+	Token     string
+	Localpart string
+	// When the token expires, in milliseconds since the epoch.
+	ExpiresAtMS int64
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+// Pusher represents a service that a user has registered to receive their
+// push notifications, as described by
+// https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-pushers
+type Pusher struct {
+	PushKey           string `json:"pushkey"`
+	Kind              string `json:"kind"`
+	AppID             string `json:"app_id"`
+	AppDisplayName    string `json:"app_display_name"`
+	DeviceDisplayName string `json:"device_display_name"`
+	ProfileTag        string `json:"profile_tag,omitempty"`
+	Language          string `json:"lang"`
+	// The pusher-specific data, which includes the URL of the push gateway
+	// for "http" pushers.
+	Data PusherData `json:"data"`
+	// The time the pusher was last updated, in milliseconds since the epoch.
+	PushKeyTS int64 `json:"-"`
+}
+
+// PusherData is the pusher-specific data of a pusher.
+type PusherData struct {
+	// The URL to send notifications to, for "http" pushers.
+	URL string `json:"url,omitempty"`
+	// The format to send notifications in. The only known format is
+	// "event_id_only", which omits everything but the event and room IDs.
+	Format string `json:"format,omitempty"`
+}
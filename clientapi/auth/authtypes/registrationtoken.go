@@ -0,0 +1,44 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+import "errors"
+
+// ErrRegistrationTokenUsedUp is returned when registering with a registration
+// token which has been used up or has expired since it was checked.
+var ErrRegistrationTokenUsedUp = errors.New("the registration token is no longer valid")
+
+// RegistrationToken is a token which an admin has created to let people
+// register on the server when registration requires a token.
+type RegistrationToken struct {
+	Token string
+	// How many registrations the token can be used for, or nil if it can be
+	// used for any number of them.
+	UsesAllowed *int64
+	// How many registrations the token has been used for.
+	Completed int64
+	// When the token expires, in milliseconds since the epoch, or nil if it
+	// doesn't expire.
+	ExpiryTime *int64
+}
+
+// Usable returns whether the token can still be used to register at the
+// given time, in milliseconds since the epoch.
+func (t *RegistrationToken) Usable(nowMS int64) bool {
+	if t.UsesAllowed != nil && t.Completed >= *t.UsesAllowed {
+		return false
+	}
+	return t.ExpiryTime == nil || nowMS < *t.ExpiryTime
+}
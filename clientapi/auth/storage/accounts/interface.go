@@ -26,6 +26,8 @@ import (
 type Database interface {
 	common.PartitionStorer
 	GetAccountByPassword(ctx context.Context, localpart, plaintextPassword string) (*authtypes.Account, error)
+	HasPassword(ctx context.Context, localpart string) (bool, error)
+	SetPassword(ctx context.Context, localpart, plaintextPassword string) error
 	GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error)
 	SetAvatarURL(ctx context.Context, localpart string, avatarURL string) error
 	SetDisplayName(ctx context.Context, localpart string, displayName string) error
@@ -47,6 +49,30 @@ type Database interface {
 	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
 	CheckAccountAvailability(ctx context.Context, localpart string) (bool, error)
 	GetAccountByLocalpart(ctx context.Context, localpart string) (*authtypes.Account, error)
+	GetAccounts(ctx context.Context, from, search string, limit int) ([]authtypes.Account, error)
+	DeactivateAccount(ctx context.Context, localpart string) error
+	CreateOpenIDToken(ctx context.Context, token *authtypes.OpenIDToken) error
+	GetOpenIDToken(ctx context.Context, token string) (*authtypes.OpenIDToken, error)
+	CreateRegistrationToken(ctx context.Context, token *authtypes.RegistrationToken) (bool, error)
+	GetRegistrationToken(ctx context.Context, token string) (*authtypes.RegistrationToken, error)
+	GetRegistrationTokens(ctx context.Context) ([]authtypes.RegistrationToken, error)
+	RemoveRegistrationToken(ctx context.Context, token string) (bool, error)
+	CreateAccountWithRegistrationToken(ctx context.Context, localpart, plaintextPassword, appserviceID, token string) (*authtypes.Account, error)
+	CreateLoginToken(ctx context.Context, token *authtypes.LoginToken) error
+	ClaimLoginToken(ctx context.Context, token string) (*authtypes.LoginToken, error)
+	GetLocalpartForSSOIdentity(ctx context.Context, issuer, subject string) (string, error)
+	SaveSSOIdentity(ctx context.Context, issuer, subject, localpart string) error
+	StoreInviteRejection(ctx context.Context, rejection *authtypes.InviteRejection) error
+	GetDueInviteRejections(ctx context.Context, nowMS int64) ([]authtypes.InviteRejection, error)
+	RemoveInviteRejection(ctx context.Context, localpart, roomID string) error
+	StoreEventReport(ctx context.Context, report *authtypes.EventReport) (int64, error)
+	GetEventReports(ctx context.Context) ([]authtypes.EventReport, error)
+	SetPusher(ctx context.Context, localpart string, pusher *authtypes.Pusher, exclusive bool) error
+	RemovePusher(ctx context.Context, localpart, appID, pushKey string) error
+	GetPushersByLocalpart(ctx context.Context, localpart string) ([]authtypes.Pusher, error)
+	IncrementNotificationCount(ctx context.Context, localpart, roomID string) error
+	ResetNotificationCount(ctx context.Context, localpart, roomID string) error
+	GetUnreadNotificationCount(ctx context.Context, localpart string) (int64, error)
 }
 
 // Err3PIDInUse is the error returned when trying to save an association involving
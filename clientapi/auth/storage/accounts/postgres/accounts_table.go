@@ -17,10 +17,12 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"strings"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/gomatrixserverlib"
 
 	log "github.com/sirupsen/logrus"
@@ -48,7 +50,14 @@ const insertAccountSQL = "" +
 	"INSERT INTO account_accounts(localpart, created_ts, password_hash, appservice_id) VALUES ($1, $2, $3, $4)"
 
 const selectAccountByLocalpartSQL = "" +
-	"SELECT localpart, appservice_id FROM account_accounts WHERE localpart = $1"
+	"SELECT localpart, created_ts, appservice_id FROM account_accounts WHERE localpart = $1"
+
+// Accounts are paginated by localpart, so that accounts created while paging
+// through them don't shift the pages.
+const selectAccountsSQL = "" +
+	"SELECT localpart, created_ts, appservice_id FROM account_accounts" +
+	" WHERE localpart > $1 AND localpart LIKE $2 ESCAPE '\\'" +
+	" ORDER BY localpart ASC LIMIT $3"
 
 const selectPasswordHashSQL = "" +
 	"SELECT password_hash FROM account_accounts WHERE localpart = $1"
@@ -56,13 +65,16 @@ const selectPasswordHashSQL = "" +
 const selectNewNumericLocalpartSQL = "" +
 	"SELECT nextval('numeric_username_seq')"
 
-// TODO: Update password
+const updatePasswordHashSQL = "" +
+	"UPDATE account_accounts SET password_hash = $1 WHERE localpart = $2"
 
 type accountsStatements struct {
 	insertAccountStmt             *sql.Stmt
 	selectAccountByLocalpartStmt  *sql.Stmt
 	selectPasswordHashStmt        *sql.Stmt
 	selectNewNumericLocalpartStmt *sql.Stmt
+	updatePasswordHashStmt        *sql.Stmt
+	selectAccountsStmt            *sql.Stmt
 	serverName                    gomatrixserverlib.ServerName
 }
 
@@ -83,6 +95,12 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 	if s.selectNewNumericLocalpartStmt, err = db.Prepare(selectNewNumericLocalpartSQL); err != nil {
 		return
 	}
+	if s.updatePasswordHashStmt, err = db.Prepare(updatePasswordHashSQL); err != nil {
+		return
+	}
+	if s.selectAccountsStmt, err = db.Prepare(selectAccountsSQL); err != nil {
+		return
+	}
 	s.serverName = server
 	return
 }
@@ -111,6 +129,7 @@ func (s *accountsStatements) insertAccount(
 		UserID:       userutil.MakeUserID(localpart, s.serverName),
 		ServerName:   s.serverName,
 		AppServiceID: appserviceID,
+		CreatedTS:    createdTimeMS,
 	}, nil
 }
 
@@ -121,6 +140,13 @@ func (s *accountsStatements) selectPasswordHash(
 	return
 }
 
+func (s *accountsStatements) updatePasswordHash(
+	ctx context.Context, localpart, hash string,
+) (err error) {
+	_, err = s.updatePasswordHashStmt.ExecContext(ctx, hash, localpart)
+	return
+}
+
 func (s *accountsStatements) selectAccountByLocalpart(
 	ctx context.Context, localpart string,
 ) (*authtypes.Account, error) {
@@ -128,7 +154,7 @@ func (s *accountsStatements) selectAccountByLocalpart(
 	var acc authtypes.Account
 
 	stmt := s.selectAccountByLocalpartStmt
-	err := stmt.QueryRowContext(ctx, localpart).Scan(&acc.Localpart, &appserviceIDPtr)
+	err := stmt.QueryRowContext(ctx, localpart).Scan(&acc.Localpart, &acc.CreatedTS, &appserviceIDPtr)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.WithError(err).Error("Unable to retrieve user from the db")
@@ -145,6 +171,37 @@ func (s *accountsStatements) selectAccountByLocalpart(
 	return &acc, nil
 }
 
+// likeEscaper escapes the characters which have a special meaning in LIKE
+// patterns, so that searches match them literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// selectAccounts returns up to limit accounts whose localparts come after the
+// given one and contain the search term, ordered by localpart.
+func (s *accountsStatements) selectAccounts(
+	ctx context.Context, from, search string, limit int,
+) (accounts []authtypes.Account, err error) {
+	pattern := "%" + likeEscaper.Replace(search) + "%"
+	rows, err := s.selectAccountsStmt.QueryContext(ctx, from, pattern, limit)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectAccounts: rows.close() failed")
+
+	accounts = []authtypes.Account{}
+	for rows.Next() {
+		var acc authtypes.Account
+		var appserviceIDPtr sql.NullString
+		if err = rows.Scan(&acc.Localpart, &acc.CreatedTS, &appserviceIDPtr); err != nil {
+			return
+		}
+		acc.AppServiceID = appserviceIDPtr.String
+		acc.UserID = userutil.MakeUserID(acc.Localpart, s.serverName)
+		acc.ServerName = s.serverName
+		accounts = append(accounts, acc)
+	}
+	return accounts, rows.Err()
+}
+
 func (s *accountsStatements) selectNewNumericLocalpart(
 	ctx context.Context, txn *sql.Tx,
 ) (id int64, err error) {
@@ -0,0 +1,103 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const eventReportsSchema = `
+-- Stores the reports which users have made about the content of events
+CREATE TABLE IF NOT EXISTS account_event_reports (
+	id BIGSERIAL PRIMARY KEY,
+	-- The room the reported event is in
+	room_id TEXT NOT NULL,
+	-- The ID of the reported event
+	event_id TEXT NOT NULL,
+	-- The Matrix user ID of the user who reported the event
+	user_id TEXT NOT NULL,
+	-- The reason given for the report
+	reason TEXT NOT NULL,
+	-- How offensive the event is, from -100 (most offensive) to 0 (inoffensive)
+	score BIGINT NOT NULL,
+	-- The time the report was received, in milliseconds since the epoch
+	received_ts BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS account_event_reports_room_id ON account_event_reports(room_id);
+`
+
+const insertEventReportSQL = "" +
+	"INSERT INTO account_event_reports (room_id, event_id, user_id, reason, score, received_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6) RETURNING id"
+
+const selectEventReportsSQL = "" +
+	"SELECT id, room_id, event_id, user_id, reason, score, received_ts FROM account_event_reports" +
+	" ORDER BY id DESC"
+
+type eventReportsStatements struct {
+	insertEventReportStmt  *sql.Stmt
+	selectEventReportsStmt *sql.Stmt
+}
+
+func (s *eventReportsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(eventReportsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertEventReportStmt, err = db.Prepare(insertEventReportSQL); err != nil {
+		return
+	}
+	if s.selectEventReportsStmt, err = db.Prepare(selectEventReportsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *eventReportsStatements) insertEventReport(
+	ctx context.Context, report *authtypes.EventReport,
+) (id int64, err error) {
+	err = s.insertEventReportStmt.QueryRowContext(
+		ctx, report.RoomID, report.EventID, report.UserID, report.Reason, report.Score, report.ReceivedTS,
+	).Scan(&id)
+	return
+}
+
+func (s *eventReportsStatements) selectEventReports(
+	ctx context.Context,
+) (reports []authtypes.EventReport, err error) {
+	rows, err := s.selectEventReportsStmt.QueryContext(ctx)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEventReports: rows.close() failed")
+
+	reports = []authtypes.EventReport{}
+	for rows.Next() {
+		var report authtypes.EventReport
+		if err = rows.Scan(
+			&report.ID, &report.RoomID, &report.EventID, &report.UserID,
+			&report.Reason, &report.Score, &report.ReceivedTS,
+		); err != nil {
+			return
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const inviteRejectionsSchema = `
+-- Stores the rejections of invites to rooms which this server isn't in, whose
+-- leaves still have to be sent to the servers of the inviters.
+CREATE TABLE IF NOT EXISTS account_invite_rejections (
+	-- The Matrix user ID localpart of the user who rejected the invite
+	localpart TEXT NOT NULL,
+	-- The room the user was invited to
+	room_id TEXT NOT NULL,
+	-- The reason the user gave for rejecting the invite
+	reason TEXT NOT NULL,
+	room_version TEXT NOT NULL,
+	-- The servers to send the leave through as a JSON array
+	servers TEXT NOT NULL,
+	-- How many times sending the leave has been tried again
+	attempts INTEGER NOT NULL,
+	-- When to try sending the leave again, in milliseconds since the epoch
+	next_attempt_ts BIGINT NOT NULL,
+
+	PRIMARY KEY(localpart, room_id)
+);
+`
+
+const upsertInviteRejectionSQL = "" +
+	"INSERT INTO account_invite_rejections (localpart, room_id, reason, room_version, servers, attempts, next_attempt_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7)" +
+	" ON CONFLICT (localpart, room_id) DO UPDATE SET reason = $3, room_version = $4," +
+	" servers = $5, attempts = $6, next_attempt_ts = $7"
+
+const selectDueInviteRejectionsSQL = "" +
+	"SELECT localpart, room_id, reason, room_version, servers, attempts, next_attempt_ts" +
+	" FROM account_invite_rejections WHERE next_attempt_ts <= $1"
+
+const deleteInviteRejectionSQL = "" +
+	"DELETE FROM account_invite_rejections WHERE localpart = $1 AND room_id = $2"
+
+type inviteRejectionsStatements struct {
+	upsertInviteRejectionStmt     *sql.Stmt
+	selectDueInviteRejectionsStmt *sql.Stmt
+	deleteInviteRejectionStmt     *sql.Stmt
+}
+
+func (s *inviteRejectionsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(inviteRejectionsSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertInviteRejectionStmt, err = db.Prepare(upsertInviteRejectionSQL); err != nil {
+		return
+	}
+	if s.selectDueInviteRejectionsStmt, err = db.Prepare(selectDueInviteRejectionsSQL); err != nil {
+		return
+	}
+	if s.deleteInviteRejectionStmt, err = db.Prepare(deleteInviteRejectionSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *inviteRejectionsStatements) upsertInviteRejection(
+	ctx context.Context, rejection *authtypes.InviteRejection,
+) error {
+	servers, err := json.Marshal(rejection.Servers)
+	if err != nil {
+		return err
+	}
+	_, err = s.upsertInviteRejectionStmt.ExecContext(
+		ctx, rejection.Localpart, rejection.RoomID, rejection.Reason, rejection.RoomVersion,
+		string(servers), rejection.Attempts, rejection.NextAttemptMS,
+	)
+	return err
+}
+
+func (s *inviteRejectionsStatements) selectDueInviteRejections(
+	ctx context.Context, nowMS int64,
+) (rejections []authtypes.InviteRejection, err error) {
+	rows, err := s.selectDueInviteRejectionsStmt.QueryContext(ctx, nowMS)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectDueInviteRejections: rows.close() failed")
+
+	for rows.Next() {
+		var rejection authtypes.InviteRejection
+		var servers string
+		if err = rows.Scan(
+			&rejection.Localpart, &rejection.RoomID, &rejection.Reason, &rejection.RoomVersion,
+			&servers, &rejection.Attempts, &rejection.NextAttemptMS,
+		); err != nil {
+			return
+		}
+		if err = json.Unmarshal([]byte(servers), &rejection.Servers); err != nil {
+			return
+		}
+		rejections = append(rejections, rejection)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *inviteRejectionsStatements) deleteInviteRejection(
+	ctx context.Context, localpart, roomID string,
+) (err error) {
+	_, err = s.deleteInviteRejectionStmt.ExecContext(ctx, localpart, roomID)
+	return
+}
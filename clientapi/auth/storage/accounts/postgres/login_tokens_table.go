@@ -0,0 +1,114 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+const loginTokensSchema = `
+-- Stores the login tokens which have been issued to local users, and have
+-- not been used yet.
+CREATE TABLE IF NOT EXISTS account_login_tokens (
+	-- The token which the client exchanges for an access token
+	token TEXT NOT NULL PRIMARY KEY,
+	-- The Matrix user ID localpart of the user the token was issued to
+	localpart TEXT NOT NULL,
+	-- When the token expires, in milliseconds since the epoch
+	expires_ts BIGINT NOT NULL
+);
+`
+
+const insertLoginTokenSQL = "" +
+	"INSERT INTO account_login_tokens (token, localpart, expires_ts) VALUES ($1, $2, $3)"
+
+const selectLoginTokenSQL = "" +
+	"SELECT localpart, expires_ts FROM account_login_tokens WHERE token = $1"
+
+const deleteLoginTokenSQL = "" +
+	"DELETE FROM account_login_tokens WHERE token = $1"
+
+const deleteExpiredLoginTokensSQL = "" +
+	"DELETE FROM account_login_tokens WHERE expires_ts < $1"
+
+type loginTokenStatements struct {
+	insertLoginTokenStmt         *sql.Stmt
+	selectLoginTokenStmt         *sql.Stmt
+	deleteLoginTokenStmt         *sql.Stmt
+	deleteExpiredLoginTokensStmt *sql.Stmt
+}
+
+func (s *loginTokenStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(loginTokensSchema)
+	if err != nil {
+		return
+	}
+	if s.insertLoginTokenStmt, err = db.Prepare(insertLoginTokenSQL); err != nil {
+		return
+	}
+	if s.selectLoginTokenStmt, err = db.Prepare(selectLoginTokenSQL); err != nil {
+		return
+	}
+	if s.deleteLoginTokenStmt, err = db.Prepare(deleteLoginTokenSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredLoginTokensStmt, err = db.Prepare(deleteExpiredLoginTokensSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *loginTokenStatements) insertLoginToken(
+	ctx context.Context, token *authtypes.LoginToken,
+) (err error) {
+	_, err = s.insertLoginTokenStmt.ExecContext(ctx, token.Token, token.Localpart, token.ExpiresAtMS)
+	return
+}
+
+func (s *loginTokenStatements) selectLoginToken(
+	ctx context.Context, token string,
+) (*authtypes.LoginToken, error) {
+	loginToken := authtypes.LoginToken{Token: token}
+	err := s.selectLoginTokenStmt.QueryRowContext(ctx, token).Scan(
+		&loginToken.Localpart, &loginToken.ExpiresAtMS,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &loginToken, nil
+}
+
+// deleteLoginToken deletes a login token, and returns false if there was no
+// such token to delete.
+func (s *loginTokenStatements) deleteLoginToken(
+	ctx context.Context, token string,
+) (bool, error) {
+	res, err := s.deleteLoginTokenStmt.ExecContext(ctx, token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *loginTokenStatements) deleteExpiredLoginTokens(
+	ctx context.Context, nowMS int64,
+) (err error) {
+	_, err = s.deleteExpiredLoginTokensStmt.ExecContext(ctx, nowMS)
+	return
+}
@@ -17,10 +17,14 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"strconv"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/pushrules"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -40,14 +44,28 @@ type Database struct {
 	accountDatas accountDataStatements
 	threepids    threepidStatements
 	filter       filterStatements
+	eventReports eventReportsStatements
+	pushers      pushersStatements
+	counts       notificationCountsStatements
+	deactivated  deactivatedStatements
+	openIDTokens openIDTokenStatements
+	regTokens    registrationTokenStatements
+	loginTokens  loginTokenStatements
+	ssoIDs       ssoIdentitiesStatements
+	rejections   inviteRejectionsStatements
 	serverName   gomatrixserverlib.ServerName
 }
 
 // NewDatabase creates a new accounts and profiles database
-func NewDatabase(dataSourceName string, serverName gomatrixserverlib.ServerName) (*Database, error) {
+func NewDatabase(dataSourceName string, dbProperties sqlutil.DbProperties, serverName gomatrixserverlib.ServerName) (*Database, error) {
 	var db *sql.DB
 	var err error
-	if db, err = sqlutil.Open("postgres", dataSourceName); err != nil {
+	if db, err = sqlutil.Open("postgres", dataSourceName, dbProperties); err != nil {
+		return nil, err
+	}
+	migrator := common.NewMigrator(db, "accounts")
+	migrator.AddMigrations(common.BaselineMigration)
+	if err = migrator.Up(context.Background()); err != nil {
 		return nil, err
 	}
 	partitions := common.PartitionOffsetStatements{}
@@ -78,7 +96,53 @@ func NewDatabase(dataSourceName string, serverName gomatrixserverlib.ServerName)
 	if err = f.prepare(db); err != nil {
 		return nil, err
 	}
-	return &Database{db, partitions, a, p, m, ac, t, f, serverName}, nil
+	er := eventReportsStatements{}
+	if err = er.prepare(db); err != nil {
+		return nil, err
+	}
+	ps := pushersStatements{}
+	if err = ps.prepare(db); err != nil {
+		return nil, err
+	}
+	nc := notificationCountsStatements{}
+	if err = nc.prepare(db); err != nil {
+		return nil, err
+	}
+	da := deactivatedStatements{}
+	if err = da.prepare(db); err != nil {
+		return nil, err
+	}
+	ot := openIDTokenStatements{}
+	if err = ot.prepare(db); err != nil {
+		return nil, err
+	}
+	rt := registrationTokenStatements{}
+	if err = rt.prepare(db); err != nil {
+		return nil, err
+	}
+	lt := loginTokenStatements{}
+	if err = lt.prepare(db); err != nil {
+		return nil, err
+	}
+	si := ssoIdentitiesStatements{}
+	if err = si.prepare(db); err != nil {
+		return nil, err
+	}
+	ir := inviteRejectionsStatements{}
+	if err = ir.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, partitions, a, p, m, ac, t, f, er, ps, nc, da, ot, rt, lt, si, ir, serverName}, nil
+}
+
+// Close closes the database connection.
+func (d *Database) Close() error {
+	return d.db.Close()
+}
+
+// Ping checks that the database can be reached.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
 }
 
 // GetAccountByPassword returns the account associated with the given localpart and password.
@@ -93,7 +157,29 @@ func (d *Database) GetAccountByPassword(
 	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintextPassword)); err != nil {
 		return nil, err
 	}
-	return d.accounts.selectAccountByLocalpart(ctx, localpart)
+	return d.selectAccountByLocalpart(ctx, localpart)
+}
+
+// HasPassword returns whether the account with the given localpart can log in
+// with a password. Guests and the users of application services don't have one.
+// Returns sql.ErrNoRows if no account exists which matches the given localpart.
+func (d *Database) HasPassword(ctx context.Context, localpart string) (bool, error) {
+	hash, err := d.accounts.selectPasswordHash(ctx, localpart)
+	if err != nil {
+		return false, err
+	}
+	return hash != "", nil
+}
+
+// SetPassword replaces the password of the account with the given localpart.
+func (d *Database) SetPassword(
+	ctx context.Context, localpart, plaintextPassword string,
+) error {
+	hash, err := hashPassword(plaintextPassword)
+	if err != nil {
+		return err
+	}
+	return d.accounts.updatePasswordHash(ctx, localpart, hash)
 }
 
 // GetProfileByLocalpart returns the profile associated with the given localpart.
@@ -169,15 +255,16 @@ func (d *Database) createAccount(
 		return nil, err
 	}
 
-	if err := d.accountDatas.insertAccountData(ctx, txn, localpart, "", "m.push_rules", `{
-		"global": {
-			"content": [],
-			"override": [],
-			"room": [],
-			"sender": [],
-			"underride": []
-		}
-	}`); err != nil {
+	// Every account starts off with the server-default push rules.
+	rules, err := pushrules.DefaultAccountRuleSets(userutil.MakeUserID(localpart, d.serverName))
+	if err != nil {
+		return nil, err
+	}
+	rulesJSON, err := json.Marshal(rules)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.accountDatas.insertAccountData(ctx, txn, localpart, "", "m.push_rules", string(rulesJSON)); err != nil {
 		return nil, err
 	}
 	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID)
@@ -429,5 +516,261 @@ func (d *Database) CheckAccountAvailability(ctx context.Context, localpart strin
 // Returns sql.ErrNoRows if no account exists which matches the given localpart.
 func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
 ) (*authtypes.Account, error) {
-	return d.accounts.selectAccountByLocalpart(ctx, localpart)
+	return d.selectAccountByLocalpart(ctx, localpart)
+}
+
+// selectAccountByLocalpart returns the account with the given localpart,
+// including whether it has been deactivated.
+func (d *Database) selectAccountByLocalpart(
+	ctx context.Context, localpart string,
+) (*authtypes.Account, error) {
+	acc, err := d.accounts.selectAccountByLocalpart(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	if acc.Deactivated, err = d.deactivated.selectIsDeactivated(ctx, localpart); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+// GetAccounts returns up to limit accounts whose localparts come after the
+// given one and contain the search term, ordered by localpart, including
+// whether each of them has been deactivated.
+func (d *Database) GetAccounts(
+	ctx context.Context, from, search string, limit int,
+) ([]authtypes.Account, error) {
+	accounts, err := d.accounts.selectAccounts(ctx, from, search, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range accounts {
+		if accounts[i].Deactivated, err = d.deactivated.selectIsDeactivated(ctx, accounts[i].Localpart); err != nil {
+			return nil, err
+		}
+	}
+	return accounts, nil
+}
+
+// DeactivateAccount marks the account with the given localpart as deactivated,
+// so that it can't be logged in to. The account itself is kept so that its
+// localpart can't be reused.
+func (d *Database) DeactivateAccount(ctx context.Context, localpart string) error {
+	return d.deactivated.insertDeactivated(ctx, localpart, int64(gomatrixserverlib.AsTimestamp(time.Now())))
+}
+
+// CreateOpenIDToken stores an OpenID token which has been issued to a user.
+// Tokens which have expired are deleted at the same time.
+func (d *Database) CreateOpenIDToken(
+	ctx context.Context, token *authtypes.OpenIDToken,
+) error {
+	nowMS := int64(gomatrixserverlib.AsTimestamp(time.Now()))
+	if err := d.openIDTokens.deleteExpiredOpenIDTokens(ctx, nowMS); err != nil {
+		return err
+	}
+	return d.openIDTokens.insertOpenIDToken(ctx, token)
+}
+
+// GetOpenIDToken returns the OpenID token with the given value, which may
+// have expired. Returns sql.ErrNoRows if no such token was issued.
+func (d *Database) GetOpenIDToken(
+	ctx context.Context, token string,
+) (*authtypes.OpenIDToken, error) {
+	return d.openIDTokens.selectOpenIDToken(ctx, token)
+}
+
+// CreateRegistrationToken stores a new registration token, and returns false
+// if there is already a token with the same value.
+func (d *Database) CreateRegistrationToken(
+	ctx context.Context, token *authtypes.RegistrationToken,
+) (bool, error) {
+	return d.regTokens.insertRegistrationToken(ctx, token)
+}
+
+// GetRegistrationToken returns the registration token with the given value,
+// which may have been used up or have expired. Returns sql.ErrNoRows if there
+// is no such token.
+func (d *Database) GetRegistrationToken(
+	ctx context.Context, token string,
+) (*authtypes.RegistrationToken, error) {
+	return d.regTokens.selectRegistrationToken(ctx, token)
+}
+
+// GetRegistrationTokens returns every registration token, ordered by value.
+func (d *Database) GetRegistrationTokens(ctx context.Context) ([]authtypes.RegistrationToken, error) {
+	return d.regTokens.selectRegistrationTokens(ctx)
+}
+
+// RemoveRegistrationToken deletes a registration token, and returns false if
+// there was no such token.
+func (d *Database) RemoveRegistrationToken(ctx context.Context, token string) (bool, error) {
+	return d.regTokens.deleteRegistrationToken(ctx, token)
+}
+
+// CreateAccountWithRegistrationToken makes a new account like CreateAccount,
+// and counts the registration against the given registration token in the
+// same transaction. Returns ErrRegistrationTokenUsedUp, and makes no account,
+// if the token can't be used any more.
+func (d *Database) CreateAccountWithRegistrationToken(
+	ctx context.Context, localpart, plaintextPassword, appserviceID, token string,
+) (acc *authtypes.Account, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID)
+		if err != nil || acc == nil {
+			return err
+		}
+		var used bool
+		used, err = d.regTokens.useRegistrationToken(ctx, txn, token, int64(gomatrixserverlib.AsTimestamp(time.Now())))
+		if err == nil && !used {
+			err = authtypes.ErrRegistrationTokenUsedUp
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// CreateLoginToken stores a login token which has been issued to a user.
+// Expired login tokens are deleted at the same time.
+func (d *Database) CreateLoginToken(
+	ctx context.Context, token *authtypes.LoginToken,
+) error {
+	nowMS := int64(gomatrixserverlib.AsTimestamp(time.Now()))
+	if err := d.loginTokens.deleteExpiredLoginTokens(ctx, nowMS); err != nil {
+		return err
+	}
+	return d.loginTokens.insertLoginToken(ctx, token)
+}
+
+// ClaimLoginToken deletes the login token with the given value and returns
+// it, so that it can't be used again. The token may have expired. Returns
+// sql.ErrNoRows if no such token was issued or it has already been claimed.
+func (d *Database) ClaimLoginToken(
+	ctx context.Context, token string,
+) (*authtypes.LoginToken, error) {
+	loginToken, err := d.loginTokens.selectLoginToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := d.loginTokens.deleteLoginToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !deleted {
+		return nil, sql.ErrNoRows
+	}
+	return loginToken, nil
+}
+
+// StoreInviteRejection stores the rejection of an invite whose leave still
+// has to be sent, replacing any stored for the same user and room.
+func (d *Database) StoreInviteRejection(
+	ctx context.Context, rejection *authtypes.InviteRejection,
+) error {
+	return d.rejections.upsertInviteRejection(ctx, rejection)
+}
+
+// GetDueInviteRejections returns the rejections of invites whose leaves
+// should be tried again by the given time, in milliseconds since the epoch.
+func (d *Database) GetDueInviteRejections(
+	ctx context.Context, nowMS int64,
+) ([]authtypes.InviteRejection, error) {
+	return d.rejections.selectDueInviteRejections(ctx, nowMS)
+}
+
+// RemoveInviteRejection removes the rejection of the invite of a user to a
+// room, once its leave has been sent or given up on.
+func (d *Database) RemoveInviteRejection(
+	ctx context.Context, localpart, roomID string,
+) error {
+	return d.rejections.deleteInviteRejection(ctx, localpart, roomID)
+}
+
+// GetLocalpartForSSOIdentity returns the localpart of the local user that the
+// user with the given subject at a single sign-on provider logs in as, or an
+// empty string if they haven't logged in before.
+func (d *Database) GetLocalpartForSSOIdentity(
+	ctx context.Context, issuer, subject string,
+) (string, error) {
+	return d.ssoIDs.selectLocalpartForSSOIdentity(ctx, issuer, subject)
+}
+
+// SaveSSOIdentity records that the user with the given subject at a single
+// sign-on provider logs in as the local user with the given localpart.
+func (d *Database) SaveSSOIdentity(
+	ctx context.Context, issuer, subject, localpart string,
+) error {
+	return d.ssoIDs.insertSSOIdentity(ctx, issuer, subject, localpart)
+}
+
+// StoreEventReport stores a report about the content of an event, and returns
+// the ID of the report.
+func (d *Database) StoreEventReport(
+	ctx context.Context, report *authtypes.EventReport,
+) (int64, error) {
+	return d.eventReports.insertEventReport(ctx, report)
+}
+
+// GetEventReports returns all of the reports about the content of events,
+// newest first.
+func (d *Database) GetEventReports(ctx context.Context) ([]authtypes.EventReport, error) {
+	return d.eventReports.selectEventReports(ctx)
+}
+
+// SetPusher creates or updates a pusher of the user with the given localpart.
+// If exclusive is true then every other user's pusher with the same app ID
+// and push key is removed, so that only this user receives notifications on
+// the device.
+func (d *Database) SetPusher(
+	ctx context.Context, localpart string, pusher *authtypes.Pusher, exclusive bool,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if exclusive {
+			if err := d.pushers.deletePushersByAppIDAndPushKey(ctx, txn, pusher.AppID, pusher.PushKey); err != nil {
+				return err
+			}
+		}
+		return d.pushers.upsertPusher(ctx, txn, localpart, pusher)
+	})
+}
+
+// RemovePusher removes the pusher with the given app ID and push key from the
+// user with the given localpart. Does nothing if there is no such pusher.
+func (d *Database) RemovePusher(
+	ctx context.Context, localpart, appID, pushKey string,
+) error {
+	return d.pushers.deletePusher(ctx, localpart, appID, pushKey)
+}
+
+// GetPushersByLocalpart returns the pushers of the user with the given localpart.
+func (d *Database) GetPushersByLocalpart(
+	ctx context.Context, localpart string,
+) ([]authtypes.Pusher, error) {
+	return d.pushers.selectPushersByLocalpart(ctx, localpart)
+}
+
+// IncrementNotificationCount records that the user with the given localpart
+// has been notified about another event in the given room.
+func (d *Database) IncrementNotificationCount(
+	ctx context.Context, localpart, roomID string,
+) error {
+	return d.counts.incrementNotificationCount(ctx, localpart, roomID)
+}
+
+// ResetNotificationCount marks every notification of the user with the given
+// localpart in the given room as read.
+func (d *Database) ResetNotificationCount(
+	ctx context.Context, localpart, roomID string,
+) error {
+	return d.counts.deleteNotificationCount(ctx, localpart, roomID)
+}
+
+// GetUnreadNotificationCount returns how many unread notifications the user
+// with the given localpart has across all of their rooms.
+func (d *Database) GetUnreadNotificationCount(
+	ctx context.Context, localpart string,
+) (int64, error) {
+	return d.counts.selectNotificationCountTotal(ctx, localpart)
 }
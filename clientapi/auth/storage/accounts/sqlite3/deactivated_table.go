@@ -0,0 +1,71 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+)
+
+const deactivatedSchema = `
+-- Stores the accounts which have been deactivated. Their rows are kept in
+-- account_accounts so that their localparts can't be registered again.
+CREATE TABLE IF NOT EXISTS account_deactivated (
+	-- The Matrix user ID localpart of the deactivated account
+	localpart TEXT NOT NULL PRIMARY KEY,
+	-- When the account was deactivated, in milliseconds since the epoch
+	deactivated_ts BIGINT NOT NULL
+);
+`
+
+const insertDeactivatedSQL = "" +
+	"INSERT INTO account_deactivated (localpart, deactivated_ts) VALUES ($1, $2)" +
+	" ON CONFLICT (localpart) DO NOTHING"
+
+const selectIsDeactivatedSQL = "" +
+	"SELECT EXISTS(SELECT 1 FROM account_deactivated WHERE localpart = $1)"
+
+type deactivatedStatements struct {
+	insertDeactivatedStmt   *sql.Stmt
+	selectIsDeactivatedStmt *sql.Stmt
+}
+
+func (s *deactivatedStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(deactivatedSchema)
+	if err != nil {
+		return
+	}
+	if s.insertDeactivatedStmt, err = db.Prepare(insertDeactivatedSQL); err != nil {
+		return
+	}
+	if s.selectIsDeactivatedStmt, err = db.Prepare(selectIsDeactivatedSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *deactivatedStatements) insertDeactivated(
+	ctx context.Context, localpart string, deactivatedTS int64,
+) (err error) {
+	_, err = s.insertDeactivatedStmt.ExecContext(ctx, localpart, deactivatedTS)
+	return
+}
+
+func (s *deactivatedStatements) selectIsDeactivated(
+	ctx context.Context, localpart string,
+) (deactivated bool, err error) {
+	err = s.selectIsDeactivatedStmt.QueryRowContext(ctx, localpart).Scan(&deactivated)
+	return
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+)
+
+const notificationCountsSchema = `
+-- Stores how many notifications each user has had in each room since they
+-- last sent an event into it or sent a read receipt in it
+CREATE TABLE IF NOT EXISTS account_notification_counts (
+	-- The Matrix user ID localpart of the user
+	localpart TEXT NOT NULL,
+	-- The room the notifications are about
+	room_id TEXT NOT NULL,
+	-- The number of unread notifications
+	notification_count BIGINT NOT NULL,
+
+	PRIMARY KEY(localpart, room_id)
+);
+`
+
+const incrementNotificationCountSQL = "" +
+	"INSERT INTO account_notification_counts (localpart, room_id, notification_count) VALUES ($1, $2, 1)" +
+	" ON CONFLICT (localpart, room_id) DO UPDATE SET notification_count = account_notification_counts.notification_count + 1"
+
+const deleteNotificationCountSQL = "" +
+	"DELETE FROM account_notification_counts WHERE localpart = $1 AND room_id = $2"
+
+const selectNotificationCountTotalSQL = "" +
+	"SELECT COALESCE(SUM(notification_count), 0) FROM account_notification_counts WHERE localpart = $1"
+
+type notificationCountsStatements struct {
+	incrementNotificationCountStmt   *sql.Stmt
+	deleteNotificationCountStmt      *sql.Stmt
+	selectNotificationCountTotalStmt *sql.Stmt
+}
+
+func (s *notificationCountsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(notificationCountsSchema)
+	if err != nil {
+		return
+	}
+	if s.incrementNotificationCountStmt, err = db.Prepare(incrementNotificationCountSQL); err != nil {
+		return
+	}
+	if s.deleteNotificationCountStmt, err = db.Prepare(deleteNotificationCountSQL); err != nil {
+		return
+	}
+	if s.selectNotificationCountTotalStmt, err = db.Prepare(selectNotificationCountTotalSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *notificationCountsStatements) incrementNotificationCount(
+	ctx context.Context, localpart, roomID string,
+) (err error) {
+	_, err = s.incrementNotificationCountStmt.ExecContext(ctx, localpart, roomID)
+	return
+}
+
+func (s *notificationCountsStatements) deleteNotificationCount(
+	ctx context.Context, localpart, roomID string,
+) (err error) {
+	_, err = s.deleteNotificationCountStmt.ExecContext(ctx, localpart, roomID)
+	return
+}
+
+func (s *notificationCountsStatements) selectNotificationCountTotal(
+	ctx context.Context, localpart string,
+) (total int64, err error) {
+	err = s.selectNotificationCountTotalStmt.QueryRowContext(ctx, localpart).Scan(&total)
+	return
+}
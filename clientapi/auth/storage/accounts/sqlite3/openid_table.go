@@ -0,0 +1,93 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+const openIDTokensSchema = `
+-- Stores the OpenID tokens which have been issued to local users.
+CREATE TABLE IF NOT EXISTS account_openid_tokens (
+	-- The token which third parties present to find out who the user is
+	token TEXT NOT NULL PRIMARY KEY,
+	-- The Matrix user ID localpart of the user the token was issued to
+	localpart TEXT NOT NULL,
+	-- When the token expires, in milliseconds since the epoch
+	expires_ts BIGINT NOT NULL
+);
+`
+
+const insertOpenIDTokenSQL = "" +
+	"INSERT INTO account_openid_tokens (token, localpart, expires_ts) VALUES ($1, $2, $3)"
+
+const selectOpenIDTokenSQL = "" +
+	"SELECT localpart, expires_ts FROM account_openid_tokens WHERE token = $1"
+
+const deleteExpiredOpenIDTokensSQL = "" +
+	"DELETE FROM account_openid_tokens WHERE expires_ts < $1"
+
+type openIDTokenStatements struct {
+	insertOpenIDTokenStmt         *sql.Stmt
+	selectOpenIDTokenStmt         *sql.Stmt
+	deleteExpiredOpenIDTokensStmt *sql.Stmt
+}
+
+func (s *openIDTokenStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(openIDTokensSchema)
+	if err != nil {
+		return
+	}
+	if s.insertOpenIDTokenStmt, err = db.Prepare(insertOpenIDTokenSQL); err != nil {
+		return
+	}
+	if s.selectOpenIDTokenStmt, err = db.Prepare(selectOpenIDTokenSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredOpenIDTokensStmt, err = db.Prepare(deleteExpiredOpenIDTokensSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *openIDTokenStatements) insertOpenIDToken(
+	ctx context.Context, token *authtypes.OpenIDToken,
+) (err error) {
+	_, err = s.insertOpenIDTokenStmt.ExecContext(ctx, token.Token, token.Localpart, token.ExpiresAtMS)
+	return
+}
+
+func (s *openIDTokenStatements) selectOpenIDToken(
+	ctx context.Context, token string,
+) (*authtypes.OpenIDToken, error) {
+	openIDToken := authtypes.OpenIDToken{Token: token}
+	err := s.selectOpenIDTokenStmt.QueryRowContext(ctx, token).Scan(
+		&openIDToken.Localpart, &openIDToken.ExpiresAtMS,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &openIDToken, nil
+}
+
+func (s *openIDTokenStatements) deleteExpiredOpenIDTokens(
+	ctx context.Context, nowMS int64,
+) (err error) {
+	_, err = s.deleteExpiredOpenIDTokensStmt.ExecContext(ctx, nowMS)
+	return
+}
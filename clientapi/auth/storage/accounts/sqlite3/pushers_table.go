@@ -0,0 +1,148 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const pushersSchema = `
+-- Stores the pushers that users have registered to receive push notifications
+CREATE TABLE IF NOT EXISTS account_pushers (
+	-- The Matrix user ID localpart of the user who registered the pusher
+	localpart TEXT NOT NULL,
+	-- The application the pusher belongs to
+	app_id TEXT NOT NULL,
+	-- The identifier of the device to push to, unique within the application
+	pushkey TEXT NOT NULL,
+	-- The kind of pusher, e.g. "http"
+	kind TEXT NOT NULL,
+	app_display_name TEXT NOT NULL,
+	device_display_name TEXT NOT NULL,
+	profile_tag TEXT NOT NULL,
+	lang TEXT NOT NULL,
+	-- The pusher-specific data as JSON, such as the URL of the push gateway
+	data TEXT NOT NULL,
+	-- The time the pusher was last updated, in milliseconds since the epoch
+	pushkey_ts BIGINT NOT NULL,
+
+	PRIMARY KEY(localpart, app_id, pushkey)
+);
+
+CREATE INDEX IF NOT EXISTS account_pushers_app_id_pushkey ON account_pushers(app_id, pushkey);
+`
+
+const upsertPusherSQL = "" +
+	"INSERT INTO account_pushers (localpart, app_id, pushkey, kind, app_display_name, device_display_name, profile_tag, lang, data, pushkey_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)" +
+	" ON CONFLICT (localpart, app_id, pushkey) DO UPDATE SET kind = $4, app_display_name = $5," +
+	" device_display_name = $6, profile_tag = $7, lang = $8, data = $9, pushkey_ts = $10"
+
+const deletePusherSQL = "" +
+	"DELETE FROM account_pushers WHERE localpart = $1 AND app_id = $2 AND pushkey = $3"
+
+const deletePushersByAppIDAndPushKeySQL = "" +
+	"DELETE FROM account_pushers WHERE app_id = $1 AND pushkey = $2"
+
+const selectPushersByLocalpartSQL = "" +
+	"SELECT app_id, pushkey, kind, app_display_name, device_display_name, profile_tag, lang, data, pushkey_ts" +
+	" FROM account_pushers WHERE localpart = $1"
+
+type pushersStatements struct {
+	upsertPusherStmt                   *sql.Stmt
+	deletePusherStmt                   *sql.Stmt
+	deletePushersByAppIDAndPushKeyStmt *sql.Stmt
+	selectPushersByLocalpartStmt       *sql.Stmt
+}
+
+func (s *pushersStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(pushersSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertPusherStmt, err = db.Prepare(upsertPusherSQL); err != nil {
+		return
+	}
+	if s.deletePusherStmt, err = db.Prepare(deletePusherSQL); err != nil {
+		return
+	}
+	if s.deletePushersByAppIDAndPushKeyStmt, err = db.Prepare(deletePushersByAppIDAndPushKeySQL); err != nil {
+		return
+	}
+	if s.selectPushersByLocalpartStmt, err = db.Prepare(selectPushersByLocalpartSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pushersStatements) upsertPusher(
+	ctx context.Context, txn *sql.Tx, localpart string, pusher *authtypes.Pusher,
+) error {
+	data, err := json.Marshal(pusher.Data)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Stmt(s.upsertPusherStmt).ExecContext(
+		ctx, localpart, pusher.AppID, pusher.PushKey, pusher.Kind, pusher.AppDisplayName,
+		pusher.DeviceDisplayName, pusher.ProfileTag, pusher.Language, string(data), pusher.PushKeyTS,
+	)
+	return err
+}
+
+func (s *pushersStatements) deletePusher(
+	ctx context.Context, localpart, appID, pushKey string,
+) (err error) {
+	_, err = s.deletePusherStmt.ExecContext(ctx, localpart, appID, pushKey)
+	return
+}
+
+func (s *pushersStatements) deletePushersByAppIDAndPushKey(
+	ctx context.Context, txn *sql.Tx, appID, pushKey string,
+) (err error) {
+	_, err = txn.Stmt(s.deletePushersByAppIDAndPushKeyStmt).ExecContext(ctx, appID, pushKey)
+	return
+}
+
+func (s *pushersStatements) selectPushersByLocalpart(
+	ctx context.Context, localpart string,
+) (pushers []authtypes.Pusher, err error) {
+	rows, err := s.selectPushersByLocalpartStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectPushersByLocalpart: rows.close() failed")
+
+	pushers = []authtypes.Pusher{}
+	for rows.Next() {
+		var pusher authtypes.Pusher
+		var data string
+		if err = rows.Scan(
+			&pusher.AppID, &pusher.PushKey, &pusher.Kind, &pusher.AppDisplayName,
+			&pusher.DeviceDisplayName, &pusher.ProfileTag, &pusher.Language, &data, &pusher.PushKeyTS,
+		); err != nil {
+			return
+		}
+		if err = json.Unmarshal([]byte(data), &pusher.Data); err != nil {
+			return
+		}
+		pushers = append(pushers, pusher)
+	}
+	return pushers, rows.Err()
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const registrationTokensSchema = `
+-- Stores the tokens which admins have created to let people register.
+CREATE TABLE IF NOT EXISTS account_registration_tokens (
+	-- The token which is given in the m.login.registration_token stage
+	token TEXT NOT NULL PRIMARY KEY,
+	-- How many registrations the token can be used for, or NULL if unlimited
+	uses_allowed BIGINT,
+	-- How many registrations the token has been used for
+	completed BIGINT NOT NULL DEFAULT 0,
+	-- When the token expires, in milliseconds since the epoch, or NULL if never
+	expiry_ts BIGINT
+);
+`
+
+const insertRegistrationTokenSQL = "" +
+	"INSERT INTO account_registration_tokens (token, uses_allowed, completed, expiry_ts) VALUES ($1, $2, 0, $3)" +
+	" ON CONFLICT (token) DO NOTHING"
+
+const selectRegistrationTokenSQL = "" +
+	"SELECT uses_allowed, completed, expiry_ts FROM account_registration_tokens WHERE token = $1"
+
+const selectRegistrationTokensSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_ts FROM account_registration_tokens ORDER BY token ASC"
+
+const deleteRegistrationTokenSQL = "" +
+	"DELETE FROM account_registration_tokens WHERE token = $1"
+
+// Only counts the use if the token hasn't been used up or expired, so that
+// concurrent registrations can't use a token more times than it allows.
+const useRegistrationTokenSQL = "" +
+	"UPDATE account_registration_tokens SET completed = completed + 1" +
+	" WHERE token = $1 AND (completed < uses_allowed OR uses_allowed IS NULL)" +
+	" AND (expiry_ts > $2 OR expiry_ts IS NULL)"
+
+type registrationTokenStatements struct {
+	insertRegistrationTokenStmt  *sql.Stmt
+	selectRegistrationTokenStmt  *sql.Stmt
+	selectRegistrationTokensStmt *sql.Stmt
+	deleteRegistrationTokenStmt  *sql.Stmt
+	useRegistrationTokenStmt     *sql.Stmt
+}
+
+func (s *registrationTokenStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(registrationTokensSchema)
+	if err != nil {
+		return
+	}
+	if s.insertRegistrationTokenStmt, err = db.Prepare(insertRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.selectRegistrationTokenStmt, err = db.Prepare(selectRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.selectRegistrationTokensStmt, err = db.Prepare(selectRegistrationTokensSQL); err != nil {
+		return
+	}
+	if s.deleteRegistrationTokenStmt, err = db.Prepare(deleteRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.useRegistrationTokenStmt, err = db.Prepare(useRegistrationTokenSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertRegistrationToken stores a new token, and returns false if there is
+// already a token with the same value.
+func (s *registrationTokenStatements) insertRegistrationToken(
+	ctx context.Context, token *authtypes.RegistrationToken,
+) (bool, error) {
+	res, err := s.insertRegistrationTokenStmt.ExecContext(ctx, token.Token, token.UsesAllowed, token.ExpiryTime)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	return inserted == 1, err
+}
+
+func (s *registrationTokenStatements) selectRegistrationToken(
+	ctx context.Context, token string,
+) (*authtypes.RegistrationToken, error) {
+	registrationToken := authtypes.RegistrationToken{Token: token}
+	var usesAllowed, expiryTime sql.NullInt64
+	err := s.selectRegistrationTokenStmt.QueryRowContext(ctx, token).Scan(
+		&usesAllowed, &registrationToken.Completed, &expiryTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+	registrationToken.UsesAllowed, registrationToken.ExpiryTime = nullInt64Ptr(usesAllowed), nullInt64Ptr(expiryTime)
+	return &registrationToken, nil
+}
+
+func (s *registrationTokenStatements) selectRegistrationTokens(
+	ctx context.Context,
+) ([]authtypes.RegistrationToken, error) {
+	rows, err := s.selectRegistrationTokensStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRegistrationTokens: rows.close() failed")
+
+	tokens := []authtypes.RegistrationToken{}
+	for rows.Next() {
+		var token authtypes.RegistrationToken
+		var usesAllowed, expiryTime sql.NullInt64
+		if err = rows.Scan(&token.Token, &usesAllowed, &token.Completed, &expiryTime); err != nil {
+			return nil, err
+		}
+		token.UsesAllowed, token.ExpiryTime = nullInt64Ptr(usesAllowed), nullInt64Ptr(expiryTime)
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// deleteRegistrationToken deletes a token, and returns false if there was no
+// such token.
+func (s *registrationTokenStatements) deleteRegistrationToken(
+	ctx context.Context, token string,
+) (bool, error) {
+	res, err := s.deleteRegistrationTokenStmt.ExecContext(ctx, token)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := res.RowsAffected()
+	return deleted == 1, err
+}
+
+// useRegistrationToken counts a registration with a token, and returns false
+// if the token has been used up, has expired or doesn't exist.
+func (s *registrationTokenStatements) useRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string, nowTS int64,
+) (bool, error) {
+	res, err := common.TxStmt(txn, s.useRegistrationTokenStmt).ExecContext(ctx, token, nowTS)
+	if err != nil {
+		return false, err
+	}
+	used, err := res.RowsAffected()
+	return used == 1, err
+}
+
+func nullInt64Ptr(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
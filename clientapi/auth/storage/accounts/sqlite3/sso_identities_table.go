@@ -0,0 +1,78 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+)
+
+const ssoIdentitiesSchema = `
+-- Stores which local users the users of single sign-on providers log in as.
+CREATE TABLE IF NOT EXISTS account_sso_identities (
+	-- The issuer of the provider which the user logged in with
+	issuer TEXT NOT NULL,
+	-- The ID of the user at the provider
+	subject TEXT NOT NULL,
+	-- The Matrix user ID localpart of the local user
+	localpart TEXT NOT NULL,
+	PRIMARY KEY (issuer, subject)
+);
+`
+
+const insertSSOIdentitySQL = "" +
+	"INSERT INTO account_sso_identities (issuer, subject, localpart) VALUES ($1, $2, $3)"
+
+const selectLocalpartForSSOIdentitySQL = "" +
+	"SELECT localpart FROM account_sso_identities WHERE issuer = $1 AND subject = $2"
+
+type ssoIdentitiesStatements struct {
+	insertSSOIdentityStmt             *sql.Stmt
+	selectLocalpartForSSOIdentityStmt *sql.Stmt
+}
+
+func (s *ssoIdentitiesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(ssoIdentitiesSchema)
+	if err != nil {
+		return
+	}
+	if s.insertSSOIdentityStmt, err = db.Prepare(insertSSOIdentitySQL); err != nil {
+		return
+	}
+	if s.selectLocalpartForSSOIdentityStmt, err = db.Prepare(selectLocalpartForSSOIdentitySQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *ssoIdentitiesStatements) insertSSOIdentity(
+	ctx context.Context, issuer, subject, localpart string,
+) (err error) {
+	_, err = s.insertSSOIdentityStmt.ExecContext(ctx, issuer, subject, localpart)
+	return
+}
+
+// selectLocalpartForSSOIdentity returns the localpart of the local user that
+// a user of a provider logs in as, or an empty string if they haven't logged
+// in before.
+func (s *ssoIdentitiesStatements) selectLocalpartForSSOIdentity(
+	ctx context.Context, issuer, subject string,
+) (localpart string, err error) {
+	err = s.selectLocalpartForSSOIdentityStmt.QueryRowContext(ctx, issuer, subject).Scan(&localpart)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
@@ -16,6 +16,7 @@ package devices
 
 import (
 	"context"
+	"encoding/json"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 )
@@ -25,8 +26,20 @@ type Database interface {
 	GetDeviceByID(ctx context.Context, localpart, deviceID string) (*authtypes.Device, error)
 	GetDevicesByLocalpart(ctx context.Context, localpart string) ([]authtypes.Device, error)
 	CreateDevice(ctx context.Context, localpart string, deviceID *string, accessToken string, displayName *string) (dev *authtypes.Device, returnErr error)
+	CreateRefreshToken(ctx context.Context, localpart, deviceID, accessToken, refreshToken string, expiresTS int64) error
+	RefreshAccessToken(ctx context.Context, refreshToken, newAccessToken, newRefreshToken string, expiresTS int64) (*authtypes.Device, error)
+	CreateGuestDevice(ctx context.Context, localpart string, accessToken string, displayName *string) (*authtypes.Device, error)
 	UpdateDevice(ctx context.Context, localpart, deviceID string, displayName *string) error
 	RemoveDevice(ctx context.Context, deviceID, localpart string) error
 	RemoveDevices(ctx context.Context, localpart string, devices []string) error
 	RemoveAllDevices(ctx context.Context, localpart string) error
+	StoreCrossSigningKeys(ctx context.Context, userID string, keys map[authtypes.CrossSigningKeyPurpose]authtypes.CrossSigningKey) error
+	CrossSigningKeysForUser(ctx context.Context, userID string) (map[authtypes.CrossSigningKeyPurpose]authtypes.CrossSigningKey, error)
+	StoreCrossSigningSignatures(ctx context.Context, sigs []authtypes.CrossSigningSignature) error
+	CrossSigningSignaturesForKey(ctx context.Context, targetUserID, targetKeyID string) ([]authtypes.CrossSigningSignature, error)
+	StoreDeviceKeys(ctx context.Context, userID, deviceID string, keyJSON json.RawMessage) error
+	DeviceKeysForUser(ctx context.Context, userID string) (map[string]json.RawMessage, error)
+	StoreOneTimeKeys(ctx context.Context, userID, deviceID string, keys []authtypes.OneTimeKey) (map[string]int, error)
+	OneTimeKeyCounts(ctx context.Context, userID, deviceID string) (map[string]int, error)
+	ClaimOneTimeKey(ctx context.Context, userID, deviceID, algorithm string) (*authtypes.OneTimeKey, error)
 }
@@ -0,0 +1,121 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const deviceKeysSchema = `
+-- Stores the identity keys which devices upload for end-to-end encryption.
+CREATE TABLE IF NOT EXISTS device_device_keys (
+    -- The Matrix user ID of the user who owns the device.
+    user_id TEXT NOT NULL,
+    -- The ID of the device.
+    device_id TEXT NOT NULL,
+    -- The JSON of the keys, as signed by the device.
+    key_json TEXT NOT NULL,
+    PRIMARY KEY (user_id, device_id)
+);
+`
+
+const upsertDeviceKeysSQL = "" +
+	"INSERT INTO device_device_keys (user_id, device_id, key_json)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT (user_id, device_id) DO UPDATE SET key_json = $3"
+
+const selectDeviceKeysForUserSQL = "" +
+	"SELECT device_id, key_json FROM device_device_keys WHERE user_id = $1"
+
+const deleteDeviceKeysSQL = "" +
+	"DELETE FROM device_device_keys WHERE user_id = $1 AND device_id = $2"
+
+const deleteDeviceKeysForUserSQL = "" +
+	"DELETE FROM device_device_keys WHERE user_id = $1"
+
+type deviceKeysStatements struct {
+	upsertDeviceKeysStmt        *sql.Stmt
+	selectDeviceKeysForUserStmt *sql.Stmt
+	deleteDeviceKeysStmt        *sql.Stmt
+	deleteDeviceKeysForUserStmt *sql.Stmt
+}
+
+func (s *deviceKeysStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(deviceKeysSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertDeviceKeysStmt, err = db.Prepare(upsertDeviceKeysSQL); err != nil {
+		return
+	}
+	if s.selectDeviceKeysForUserStmt, err = db.Prepare(selectDeviceKeysForUserSQL); err != nil {
+		return
+	}
+	if s.deleteDeviceKeysStmt, err = db.Prepare(deleteDeviceKeysSQL); err != nil {
+		return
+	}
+	if s.deleteDeviceKeysForUserStmt, err = db.Prepare(deleteDeviceKeysForUserSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *deviceKeysStatements) upsertDeviceKeys(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, keyJSON json.RawMessage,
+) error {
+	stmt := common.TxStmt(txn, s.upsertDeviceKeysStmt)
+	_, err := stmt.ExecContext(ctx, userID, deviceID, string(keyJSON))
+	return err
+}
+
+func (s *deviceKeysStatements) selectDeviceKeysForUser(
+	ctx context.Context, userID string,
+) (map[string]json.RawMessage, error) {
+	rows, err := s.selectDeviceKeysForUserStmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectDeviceKeysForUser: rows.close() failed")
+
+	keys := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var deviceID, keyJSON string
+		if err = rows.Scan(&deviceID, &keyJSON); err != nil {
+			return nil, err
+		}
+		keys[deviceID] = json.RawMessage(keyJSON)
+	}
+	return keys, rows.Err()
+}
+
+func (s *deviceKeysStatements) deleteDeviceKeys(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteDeviceKeysStmt)
+	_, err := stmt.ExecContext(ctx, userID, deviceID)
+	return err
+}
+
+func (s *deviceKeysStatements) deleteDeviceKeysForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteDeviceKeysForUserStmt)
+	_, err := stmt.ExecContext(ctx, userID)
+	return err
+}
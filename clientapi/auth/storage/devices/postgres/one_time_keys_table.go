@@ -0,0 +1,175 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const oneTimeKeysSchema = `
+-- Stores the one-time keys which devices upload for end-to-end encryption.
+-- A key is deleted when it is claimed, so that it is only handed out once.
+CREATE TABLE IF NOT EXISTS device_one_time_keys (
+    -- The Matrix user ID of the user who owns the device.
+    user_id TEXT NOT NULL,
+    -- The ID of the device.
+    device_id TEXT NOT NULL,
+    -- The algorithm of the key, e.g. signed_curve25519.
+    algorithm TEXT NOT NULL,
+    -- The ID of the key in the form <algorithm>:<key ID>.
+    key_id TEXT NOT NULL,
+    -- The JSON of the key.
+    key_json TEXT NOT NULL,
+    PRIMARY KEY (user_id, device_id, key_id)
+);
+`
+
+const insertOneTimeKeySQL = "" +
+	"INSERT INTO device_one_time_keys (user_id, device_id, algorithm, key_id, key_json)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectOneTimeKeyCountsSQL = "" +
+	"SELECT algorithm, COUNT(*) FROM device_one_time_keys" +
+	" WHERE user_id = $1 AND device_id = $2 GROUP BY algorithm"
+
+const selectOneTimeKeySQL = "" +
+	"SELECT key_id, key_json FROM device_one_time_keys" +
+	" WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 LIMIT 1"
+
+const deleteOneTimeKeySQL = "" +
+	"DELETE FROM device_one_time_keys WHERE user_id = $1 AND device_id = $2 AND key_id = $3"
+
+const deleteOneTimeKeysSQL = "" +
+	"DELETE FROM device_one_time_keys WHERE user_id = $1 AND device_id = $2"
+
+const deleteOneTimeKeysForUserSQL = "" +
+	"DELETE FROM device_one_time_keys WHERE user_id = $1"
+
+type oneTimeKeysStatements struct {
+	insertOneTimeKeyStmt         *sql.Stmt
+	selectOneTimeKeyCountsStmt   *sql.Stmt
+	selectOneTimeKeyStmt         *sql.Stmt
+	deleteOneTimeKeyStmt         *sql.Stmt
+	deleteOneTimeKeysStmt        *sql.Stmt
+	deleteOneTimeKeysForUserStmt *sql.Stmt
+}
+
+func (s *oneTimeKeysStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(oneTimeKeysSchema)
+	if err != nil {
+		return
+	}
+	if s.insertOneTimeKeyStmt, err = db.Prepare(insertOneTimeKeySQL); err != nil {
+		return
+	}
+	if s.selectOneTimeKeyCountsStmt, err = db.Prepare(selectOneTimeKeyCountsSQL); err != nil {
+		return
+	}
+	if s.selectOneTimeKeyStmt, err = db.Prepare(selectOneTimeKeySQL); err != nil {
+		return
+	}
+	if s.deleteOneTimeKeyStmt, err = db.Prepare(deleteOneTimeKeySQL); err != nil {
+		return
+	}
+	if s.deleteOneTimeKeysStmt, err = db.Prepare(deleteOneTimeKeysSQL); err != nil {
+		return
+	}
+	if s.deleteOneTimeKeysForUserStmt, err = db.Prepare(deleteOneTimeKeysForUserSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertOneTimeKey stores a one-time key. Keys which have already been
+// uploaded are left as they are.
+func (s *oneTimeKeysStatements) insertOneTimeKey(
+	ctx context.Context, txn *sql.Tx, key authtypes.OneTimeKey,
+) error {
+	stmt := common.TxStmt(txn, s.insertOneTimeKeyStmt)
+	_, err := stmt.ExecContext(ctx, key.UserID, key.DeviceID, key.Algorithm(), key.KeyID, string(key.KeyJSON))
+	return err
+}
+
+func (s *oneTimeKeysStatements) selectOneTimeKeyCounts(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) (map[string]int, error) {
+	stmt := common.TxStmt(txn, s.selectOneTimeKeyCountsStmt)
+	rows, err := stmt.QueryContext(ctx, userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectOneTimeKeyCounts: rows.close() failed")
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var algorithm string
+		var count int
+		if err = rows.Scan(&algorithm, &count); err != nil {
+			return nil, err
+		}
+		counts[algorithm] = count
+	}
+	return counts, rows.Err()
+}
+
+// selectOneTimeKey returns any one-time key of the device with the algorithm.
+// Returns sql.ErrNoRows if the device has no such keys.
+func (s *oneTimeKeysStatements) selectOneTimeKey(
+	ctx context.Context, userID, deviceID, algorithm string,
+) (*authtypes.OneTimeKey, error) {
+	key := authtypes.OneTimeKey{UserID: userID, DeviceID: deviceID}
+	var keyJSON string
+	err := s.selectOneTimeKeyStmt.QueryRowContext(ctx, userID, deviceID, algorithm).Scan(&key.KeyID, &keyJSON)
+	if err != nil {
+		return nil, err
+	}
+	key.KeyJSON = json.RawMessage(keyJSON)
+	return &key, nil
+}
+
+// deleteOneTimeKey deletes a one-time key, and returns whether it was there to
+// be deleted.
+func (s *oneTimeKeysStatements) deleteOneTimeKey(
+	ctx context.Context, key authtypes.OneTimeKey,
+) (bool, error) {
+	res, err := s.deleteOneTimeKeyStmt.ExecContext(ctx, key.UserID, key.DeviceID, key.KeyID)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := res.RowsAffected()
+	return deleted == 1, err
+}
+
+func (s *oneTimeKeysStatements) deleteOneTimeKeys(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteOneTimeKeysStmt)
+	_, err := stmt.ExecContext(ctx, userID, deviceID)
+	return err
+}
+
+func (s *oneTimeKeysStatements) deleteOneTimeKeysForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteOneTimeKeysForUserStmt)
+	_, err := stmt.ExecContext(ctx, userID)
+	return err
+}
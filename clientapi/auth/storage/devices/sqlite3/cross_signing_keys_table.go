@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const crossSigningKeysSchema = `
+-- Stores the cross-signing keys of users.
+CREATE TABLE IF NOT EXISTS device_cross_signing_keys (
+    -- The Matrix user ID of the user who owns the key.
+    user_id TEXT NOT NULL,
+    -- The purpose of the key: master, self_signing or user_signing.
+    key_type TEXT NOT NULL,
+    -- The JSON of the key, including the signatures it was uploaded with.
+    key_data TEXT NOT NULL,
+    PRIMARY KEY (user_id, key_type)
+);
+`
+
+const upsertCrossSigningKeySQL = "" +
+	"INSERT INTO device_cross_signing_keys (user_id, key_type, key_data)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT (user_id, key_type) DO UPDATE SET key_data = $3"
+
+const selectCrossSigningKeysForUserSQL = "" +
+	"SELECT key_type, key_data FROM device_cross_signing_keys WHERE user_id = $1"
+
+type crossSigningKeysStatements struct {
+	upsertCrossSigningKeyStmt         *sql.Stmt
+	selectCrossSigningKeysForUserStmt *sql.Stmt
+}
+
+func (s *crossSigningKeysStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(crossSigningKeysSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertCrossSigningKeyStmt, err = db.Prepare(upsertCrossSigningKeySQL); err != nil {
+		return
+	}
+	if s.selectCrossSigningKeysForUserStmt, err = db.Prepare(selectCrossSigningKeysForUserSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *crossSigningKeysStatements) upsertCrossSigningKey(
+	ctx context.Context, txn *sql.Tx, userID string,
+	purpose authtypes.CrossSigningKeyPurpose, key authtypes.CrossSigningKey,
+) error {
+	keyData, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	stmt := common.TxStmt(txn, s.upsertCrossSigningKeyStmt)
+	_, err = stmt.ExecContext(ctx, userID, purpose, string(keyData))
+	return err
+}
+
+func (s *crossSigningKeysStatements) selectCrossSigningKeysForUser(
+	ctx context.Context, userID string,
+) (map[authtypes.CrossSigningKeyPurpose]authtypes.CrossSigningKey, error) {
+	rows, err := s.selectCrossSigningKeysForUserStmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectCrossSigningKeysForUser: rows.close() failed")
+
+	keys := make(map[authtypes.CrossSigningKeyPurpose]authtypes.CrossSigningKey)
+	for rows.Next() {
+		var purpose authtypes.CrossSigningKeyPurpose
+		var keyData string
+		if err = rows.Scan(&purpose, &keyData); err != nil {
+			return nil, err
+		}
+		var key authtypes.CrossSigningKey
+		if err = json.Unmarshal([]byte(keyData), &key); err != nil {
+			return nil, err
+		}
+		keys[purpose] = key
+	}
+	return keys, rows.Err()
+}
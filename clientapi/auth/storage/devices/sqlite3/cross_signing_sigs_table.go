@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const crossSigningSigsSchema = `
+-- Stores the signatures which users made of their own or other users' keys
+-- after the keys were uploaded.
+CREATE TABLE IF NOT EXISTS device_cross_signing_sigs (
+    -- The Matrix user ID and key ID of the key which made the signature.
+    origin_user_id TEXT NOT NULL,
+    origin_key_id TEXT NOT NULL,
+    -- The Matrix user ID and key ID of the key which is signed. The key ID is
+    -- the device ID for device keys and the public key for cross-signing keys.
+    target_user_id TEXT NOT NULL,
+    target_key_id TEXT NOT NULL,
+    -- The unpadded base64 signature.
+    signature TEXT NOT NULL,
+    PRIMARY KEY (origin_user_id, origin_key_id, target_user_id, target_key_id)
+);
+`
+
+const upsertCrossSigningSigSQL = "" +
+	"INSERT INTO device_cross_signing_sigs (origin_user_id, origin_key_id, target_user_id, target_key_id, signature)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (origin_user_id, origin_key_id, target_user_id, target_key_id) DO UPDATE SET signature = $5"
+
+const selectCrossSigningSigsForTargetSQL = "" +
+	"SELECT origin_user_id, origin_key_id, signature FROM device_cross_signing_sigs" +
+	" WHERE target_user_id = $1 AND target_key_id = $2"
+
+type crossSigningSigsStatements struct {
+	upsertCrossSigningSigStmt           *sql.Stmt
+	selectCrossSigningSigsForTargetStmt *sql.Stmt
+}
+
+func (s *crossSigningSigsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(crossSigningSigsSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertCrossSigningSigStmt, err = db.Prepare(upsertCrossSigningSigSQL); err != nil {
+		return
+	}
+	if s.selectCrossSigningSigsForTargetStmt, err = db.Prepare(selectCrossSigningSigsForTargetSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *crossSigningSigsStatements) upsertCrossSigningSig(
+	ctx context.Context, txn *sql.Tx, sig authtypes.CrossSigningSignature,
+) error {
+	stmt := common.TxStmt(txn, s.upsertCrossSigningSigStmt)
+	_, err := stmt.ExecContext(
+		ctx, sig.OriginUserID, sig.OriginKeyID, sig.TargetUserID, sig.TargetKeyID, sig.Signature,
+	)
+	return err
+}
+
+func (s *crossSigningSigsStatements) selectCrossSigningSigsForTarget(
+	ctx context.Context, targetUserID, targetKeyID string,
+) ([]authtypes.CrossSigningSignature, error) {
+	rows, err := s.selectCrossSigningSigsForTargetStmt.QueryContext(ctx, targetUserID, targetKeyID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectCrossSigningSigsForTarget: rows.close() failed")
+
+	var sigs []authtypes.CrossSigningSignature
+	for rows.Next() {
+		sig := authtypes.CrossSigningSignature{
+			TargetUserID: targetUserID,
+			TargetKeyID:  targetKeyID,
+		}
+		if err = rows.Scan(&sig.OriginUserID, &sig.OriginKeyID, &sig.Signature); err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, rows.Err()
+}
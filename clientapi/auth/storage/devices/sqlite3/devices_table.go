@@ -42,6 +42,12 @@ CREATE TABLE IF NOT EXISTS device_devices (
 
 		UNIQUE (localpart, device_id)
 );
+
+-- Stores the localparts of guest accounts. All of the devices of a guest
+-- account are guest devices.
+CREATE TABLE IF NOT EXISTS device_guests (
+    localpart TEXT PRIMARY KEY
+);
 `
 
 const insertDeviceSQL = "" +
@@ -52,7 +58,9 @@ const selectDevicesCountSQL = "" +
 	"SELECT COUNT(access_token) FROM device_devices"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart FROM device_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart," +
+	" EXISTS(SELECT 1 FROM device_guests WHERE device_guests.localpart = device_devices.localpart)" +
+	" FROM device_devices WHERE access_token = $1"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name FROM device_devices WHERE localpart = $1 and device_id = $2"
@@ -63,9 +71,15 @@ const selectDevicesByLocalpartSQL = "" +
 const updateDeviceNameSQL = "" +
 	"UPDATE device_devices SET display_name = $1 WHERE localpart = $2 AND device_id = $3"
 
+const updateDeviceAccessTokenSQL = "" +
+	"UPDATE device_devices SET access_token = $1 WHERE localpart = $2 AND device_id = $3 AND access_token = $4"
+
 const deleteDeviceSQL = "" +
 	"DELETE FROM device_devices WHERE device_id = $1 AND localpart = $2"
 
+const insertGuestSQL = "" +
+	"INSERT INTO device_guests (localpart) VALUES ($1) ON CONFLICT DO NOTHING"
+
 const deleteDevicesByLocalpartSQL = "" +
 	"DELETE FROM device_devices WHERE localpart = $1"
 
@@ -80,8 +94,10 @@ type devicesStatements struct {
 	selectDeviceByIDStmt         *sql.Stmt
 	selectDevicesByLocalpartStmt *sql.Stmt
 	updateDeviceNameStmt         *sql.Stmt
+	updateDeviceAccessTokenStmt  *sql.Stmt
 	deleteDeviceStmt             *sql.Stmt
 	deleteDevicesByLocalpartStmt *sql.Stmt
+	insertGuestStmt              *sql.Stmt
 	serverName                   gomatrixserverlib.ServerName
 }
 
@@ -109,12 +125,18 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 	if s.updateDeviceNameStmt, err = db.Prepare(updateDeviceNameSQL); err != nil {
 		return
 	}
+	if s.updateDeviceAccessTokenStmt, err = db.Prepare(updateDeviceAccessTokenSQL); err != nil {
+		return
+	}
 	if s.deleteDeviceStmt, err = db.Prepare(deleteDeviceSQL); err != nil {
 		return
 	}
 	if s.deleteDevicesByLocalpartStmt, err = db.Prepare(deleteDevicesByLocalpartSQL); err != nil {
 		return
 	}
+	if s.insertGuestStmt, err = db.Prepare(insertGuestSQL); err != nil {
+		return
+	}
 	s.serverName = server
 	return
 }
@@ -156,7 +178,7 @@ func (s *devicesStatements) deleteDevice(
 func (s *devicesStatements) deleteDevices(
 	ctx context.Context, txn *sql.Tx, localpart string, devices []string,
 ) error {
-	orig := strings.Replace(deleteDevicesSQL, "($1)", common.QueryVariadic(len(devices)), 1)
+	orig := strings.Replace(deleteDevicesSQL, "($2)", common.QueryVariadicOffset(len(devices), 1), 1)
 	prep, err := s.db.Prepare(orig)
 	if err != nil {
 		return err
@@ -167,7 +189,6 @@ func (s *devicesStatements) deleteDevices(
 	for i, v := range devices {
 		params[i+1] = v
 	}
-	params = append(params, params...)
 	_, err = stmt.ExecContext(ctx, params...)
 	return err
 }
@@ -188,13 +209,33 @@ func (s *devicesStatements) updateDeviceName(
 	return err
 }
 
+// updateDeviceAccessToken replaces the access token of a device, if it still
+// has the given old access token. Returns sql.ErrNoRows if it doesn't.
+func (s *devicesStatements) updateDeviceAccessToken(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID, oldAccessToken, newAccessToken string,
+) error {
+	stmt := common.TxStmt(txn, s.updateDeviceAccessTokenStmt)
+	res, err := stmt.ExecContext(ctx, newAccessToken, localpart, deviceID, oldAccessToken)
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 func (s *devicesStatements) selectDeviceByToken(
 	ctx context.Context, accessToken string,
 ) (*authtypes.Device, error) {
 	var dev authtypes.Device
 	var localpart string
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.IsGuest)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		dev.AccessToken = accessToken
@@ -202,18 +243,28 @@ func (s *devicesStatements) selectDeviceByToken(
 	return &dev, err
 }
 
+// insertGuest marks the account with the given localpart as a guest account.
+func (s *devicesStatements) insertGuest(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	stmt := common.TxStmt(txn, s.insertGuestStmt)
+	_, err := stmt.ExecContext(ctx, localpart)
+	return err
+}
+
 // selectDeviceByID retrieves a device from the database with the given user
 // localpart and deviceID
 func (s *devicesStatements) selectDeviceByID(
 	ctx context.Context, localpart, deviceID string,
 ) (*authtypes.Device, error) {
 	var dev authtypes.Device
-	var created sql.NullInt64
+	var displayName sql.NullString
 	stmt := s.selectDeviceByIDStmt
-	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&created)
+	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&displayName)
 	if err == nil {
 		dev.ID = deviceID
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
+		dev.DisplayName = displayName.String
 	}
 	return &dev, err
 }
@@ -231,10 +282,13 @@ func (s *devicesStatements) selectDevicesByLocalpart(
 
 	for rows.Next() {
 		var dev authtypes.Device
-		err = rows.Scan(&dev.ID, &dev.DisplayName)
+		// Devices which were created without a display name have none.
+		var displayName sql.NullString
+		err = rows.Scan(&dev.ID, &displayName)
 		if err != nil {
 			return devices, err
 		}
+		dev.DisplayName = displayName.String
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		devices = append(devices, dev)
 	}
@@ -0,0 +1,141 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const refreshTokensSchema = `
+-- Stores the refresh tokens of devices which asked for one when they logged in.
+-- The access tokens of these devices expire, and are replaced when the refresh
+-- token is used.
+CREATE TABLE IF NOT EXISTS device_refresh_tokens (
+    refresh_token TEXT NOT NULL PRIMARY KEY,
+    -- The device which the refresh token was issued to. Each device has at
+    -- most one refresh token.
+    localpart TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    -- The access token which was issued along with the refresh token.
+    access_token TEXT NOT NULL,
+    -- When the access token expires, as a unix timestamp (ms resolution).
+    access_token_expires_ts BIGINT NOT NULL,
+    UNIQUE (localpart, device_id)
+);
+
+CREATE INDEX IF NOT EXISTS device_refresh_tokens_access_token_idx ON device_refresh_tokens(access_token);
+`
+
+const upsertRefreshTokenSQL = "" +
+	"INSERT INTO device_refresh_tokens (refresh_token, localpart, device_id, access_token, access_token_expires_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (localpart, device_id) DO UPDATE SET refresh_token = $1, access_token = $4, access_token_expires_ts = $5"
+
+const selectRefreshTokenSQL = "" +
+	"SELECT localpart, device_id, access_token FROM device_refresh_tokens WHERE refresh_token = $1"
+
+const selectAccessTokenExpirySQL = "" +
+	"SELECT access_token_expires_ts FROM device_refresh_tokens WHERE access_token = $1"
+
+const deleteRefreshTokenSQL = "" +
+	"DELETE FROM device_refresh_tokens WHERE localpart = $1 AND device_id = $2"
+
+const deleteRefreshTokensByLocalpartSQL = "" +
+	"DELETE FROM device_refresh_tokens WHERE localpart = $1"
+
+type refreshTokensStatements struct {
+	upsertRefreshTokenStmt             *sql.Stmt
+	selectRefreshTokenStmt             *sql.Stmt
+	selectAccessTokenExpiryStmt        *sql.Stmt
+	deleteRefreshTokenStmt             *sql.Stmt
+	deleteRefreshTokensByLocalpartStmt *sql.Stmt
+}
+
+func (s *refreshTokensStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(refreshTokensSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertRefreshTokenStmt, err = db.Prepare(upsertRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.selectRefreshTokenStmt, err = db.Prepare(selectRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.selectAccessTokenExpiryStmt, err = db.Prepare(selectAccessTokenExpirySQL); err != nil {
+		return
+	}
+	if s.deleteRefreshTokenStmt, err = db.Prepare(deleteRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.deleteRefreshTokensByLocalpartStmt, err = db.Prepare(deleteRefreshTokensByLocalpartSQL); err != nil {
+		return
+	}
+	return
+}
+
+// upsertRefreshToken replaces the refresh token of a device, along with the
+// access token it was issued with.
+func (s *refreshTokensStatements) upsertRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken, localpart, deviceID, accessToken string,
+	expiresTS int64,
+) error {
+	stmt := common.TxStmt(txn, s.upsertRefreshTokenStmt)
+	_, err := stmt.ExecContext(ctx, refreshToken, localpart, deviceID, accessToken, expiresTS)
+	return err
+}
+
+// selectRefreshToken returns the device which the refresh token was issued
+// to and the access token it was issued with. Returns sql.ErrNoRows if the
+// refresh token is unknown.
+func (s *refreshTokensStatements) selectRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken string,
+) (localpart, deviceID, accessToken string, err error) {
+	stmt := common.TxStmt(txn, s.selectRefreshTokenStmt)
+	err = stmt.QueryRowContext(ctx, refreshToken).Scan(&localpart, &deviceID, &accessToken)
+	return
+}
+
+// selectAccessTokenExpiry returns when the access token expires. Returns
+// sql.ErrNoRows if the access token was issued without a refresh token, in
+// which case it doesn't expire.
+func (s *refreshTokensStatements) selectAccessTokenExpiry(
+	ctx context.Context, accessToken string,
+) (expiresTS int64, err error) {
+	err = s.selectAccessTokenExpiryStmt.QueryRowContext(ctx, accessToken).Scan(&expiresTS)
+	return
+}
+
+// deleteRefreshToken deletes the refresh token of a device.
+func (s *refreshTokensStatements) deleteRefreshToken(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteRefreshTokenStmt)
+	_, err := stmt.ExecContext(ctx, localpart, deviceID)
+	return err
+}
+
+// deleteRefreshTokensByLocalpart deletes the refresh tokens of all of the
+// devices of a user.
+func (s *refreshTokensStatements) deleteRefreshTokensByLocalpart(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	stmt := common.TxStmt(txn, s.deleteRefreshTokensByLocalpartStmt)
+	_, err := stmt.ExecContext(ctx, localpart)
+	return err
+}
@@ -19,8 +19,11 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -33,30 +36,84 @@ var deviceIDByteLength = 6
 
 // Database represents a device database.
 type Database struct {
-	db      *sql.DB
-	devices devicesStatements
+	db               *sql.DB
+	devices          devicesStatements
+	crossSigningKeys crossSigningKeysStatements
+	crossSigningSigs crossSigningSigsStatements
+	deviceKeys       deviceKeysStatements
+	oneTimeKeys      oneTimeKeysStatements
+	refreshTokens    refreshTokensStatements
 }
 
 // NewDatabase creates a new device database
-func NewDatabase(dataSourceName string, serverName gomatrixserverlib.ServerName) (*Database, error) {
+func NewDatabase(dataSourceName string, dbProperties sqlutil.DbProperties, serverName gomatrixserverlib.ServerName) (*Database, error) {
 	var db *sql.DB
 	var err error
-	if db, err = sqlutil.Open(common.SQLiteDriverName(), dataSourceName); err != nil {
+	if db, err = sqlutil.Open(common.SQLiteDriverName(), dataSourceName, dbProperties); err != nil {
+		return nil, err
+	}
+	migrator := common.NewMigrator(db, "devices")
+	migrator.AddMigrations(common.BaselineMigration)
+	if err = migrator.Up(context.Background()); err != nil {
 		return nil, err
 	}
 	d := devicesStatements{}
 	if err = d.prepare(db, serverName); err != nil {
 		return nil, err
 	}
-	return &Database{db, d}, nil
+	k := crossSigningKeysStatements{}
+	if err = k.prepare(db); err != nil {
+		return nil, err
+	}
+	sigs := crossSigningSigsStatements{}
+	if err = sigs.prepare(db); err != nil {
+		return nil, err
+	}
+	dk := deviceKeysStatements{}
+	if err = dk.prepare(db); err != nil {
+		return nil, err
+	}
+	otk := oneTimeKeysStatements{}
+	if err = otk.prepare(db); err != nil {
+		return nil, err
+	}
+	rt := refreshTokensStatements{}
+	if err = rt.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, d, k, sigs, dk, otk, rt}, nil
+}
+
+// Close closes the database connection.
+func (d *Database) Close() error {
+	return d.db.Close()
+}
+
+// Ping checks that the database can be reached.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
 }
 
 // GetDeviceByAccessToken returns the device matching the given access token.
-// Returns sql.ErrNoRows if no matching device was found.
+// Returns sql.ErrNoRows if no matching device was found, and
+// authtypes.ErrDeviceSoftLoggedOut if the access token has expired.
 func (d *Database) GetDeviceByAccessToken(
 	ctx context.Context, token string,
 ) (*authtypes.Device, error) {
-	return d.devices.selectDeviceByToken(ctx, token)
+	dev, err := d.devices.selectDeviceByToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	expiresTS, err := d.refreshTokens.selectAccessTokenExpiry(ctx, token)
+	if err == sql.ErrNoRows {
+		return dev, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if expiresTS <= time.Now().UnixNano()/int64(time.Millisecond) {
+		return nil, authtypes.ErrDeviceSoftLoggedOut
+	}
+	return dev, nil
 }
 
 // GetDeviceByID returns the device matching the given ID.
@@ -118,6 +175,61 @@ func (d *Database) CreateDevice(
 	return
 }
 
+// CreateRefreshToken issues a refresh token to the device, replacing any
+// refresh token it had before. The access token of the device expires at the
+// given time (in ms since the epoch), after which it has to be refreshed.
+func (d *Database) CreateRefreshToken(
+	ctx context.Context, localpart, deviceID, accessToken, refreshToken string,
+	expiresTS int64,
+) error {
+	return d.refreshTokens.upsertRefreshToken(ctx, nil, refreshToken, localpart, deviceID, accessToken, expiresTS)
+}
+
+// RefreshAccessToken uses a refresh token to replace the access token of the
+// device it was issued to with a new one, which expires at the given time (in
+// ms since the epoch). The refresh token is replaced too, so that it can only
+// be used once. Returns sql.ErrNoRows if the refresh token is unknown, or if
+// the device has logged in again or been removed since it was issued.
+func (d *Database) RefreshAccessToken(
+	ctx context.Context, refreshToken, newAccessToken, newRefreshToken string,
+	expiresTS int64,
+) (*authtypes.Device, error) {
+	err := common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		localpart, deviceID, accessToken, err := d.refreshTokens.selectRefreshToken(ctx, txn, refreshToken)
+		if err != nil {
+			return err
+		}
+		if err = d.devices.updateDeviceAccessToken(ctx, txn, localpart, deviceID, accessToken, newAccessToken); err != nil {
+			return err
+		}
+		return d.refreshTokens.upsertRefreshToken(ctx, txn, newRefreshToken, localpart, deviceID, newAccessToken, expiresTS)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.devices.selectDeviceByToken(ctx, newAccessToken)
+}
+
+// CreateGuestDevice makes a new device for the guest account with the given
+// localpart, and marks the account as a guest account so that all of its
+// devices are guest devices.
+// Returns the device on success.
+func (d *Database) CreateGuestDevice(
+	ctx context.Context, localpart string, accessToken string, displayName *string,
+) (*authtypes.Device, error) {
+	// The account is marked first so that there is never a device for it
+	// which isn't a guest device.
+	if err := d.devices.insertGuest(ctx, nil, localpart); err != nil {
+		return nil, err
+	}
+	dev, err := d.CreateDevice(ctx, localpart, nil, accessToken, displayName)
+	if err != nil {
+		return nil, err
+	}
+	dev.IsGuest = true
+	return dev, nil
+}
+
 // generateDeviceID creates a new device id. Returns an error if failed to generate
 // random bytes.
 func generateDeviceID() (string, error) {
@@ -141,17 +253,21 @@ func (d *Database) UpdateDevice(
 }
 
 // RemoveDevice revokes a device by deleting the entry in the database
-// matching with the given device ID and user ID localpart.
+// matching with the given device ID and user ID localpart, along with the
+// encryption keys of the device.
 // If the device doesn't exist, it will not return an error
 // If something went wrong during the deletion, it will return the SQL error.
 func (d *Database) RemoveDevice(
 	ctx context.Context, deviceID, localpart string,
 ) error {
 	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
-		if err := d.devices.deleteDevice(ctx, txn, deviceID, localpart); err != sql.ErrNoRows {
+		if err := d.devices.deleteDevice(ctx, txn, deviceID, localpart); err != nil && err != sql.ErrNoRows {
 			return err
 		}
-		return nil
+		if err := d.refreshTokens.deleteRefreshToken(ctx, txn, localpart, deviceID); err != nil {
+			return err
+		}
+		return d.deleteDeviceKeys(ctx, txn, userutil.MakeUserID(localpart, d.devices.serverName), deviceID)
 	})
 }
 
@@ -163,9 +279,18 @@ func (d *Database) RemoveDevices(
 	ctx context.Context, localpart string, devices []string,
 ) error {
 	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
-		if err := d.devices.deleteDevices(ctx, txn, localpart, devices); err != sql.ErrNoRows {
+		if err := d.devices.deleteDevices(ctx, txn, localpart, devices); err != nil && err != sql.ErrNoRows {
 			return err
 		}
+		userID := userutil.MakeUserID(localpart, d.devices.serverName)
+		for _, deviceID := range devices {
+			if err := d.refreshTokens.deleteRefreshToken(ctx, txn, localpart, deviceID); err != nil {
+				return err
+			}
+			if err := d.deleteDeviceKeys(ctx, txn, userID, deviceID); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
@@ -177,9 +302,138 @@ func (d *Database) RemoveAllDevices(
 	ctx context.Context, localpart string,
 ) error {
 	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
-		if err := d.devices.deleteDevicesByLocalpart(ctx, txn, localpart); err != sql.ErrNoRows {
+		if err := d.devices.deleteDevicesByLocalpart(ctx, txn, localpart); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err := d.refreshTokens.deleteRefreshTokensByLocalpart(ctx, txn, localpart); err != nil {
 			return err
 		}
+		userID := userutil.MakeUserID(localpart, d.devices.serverName)
+		if err := d.deviceKeys.deleteDeviceKeysForUser(ctx, txn, userID); err != nil {
+			return err
+		}
+		return d.oneTimeKeys.deleteOneTimeKeysForUser(ctx, txn, userID)
+	})
+}
+
+// deleteDeviceKeys deletes the identity keys and one-time keys of a device.
+func (d *Database) deleteDeviceKeys(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) error {
+	if err := d.deviceKeys.deleteDeviceKeys(ctx, txn, userID, deviceID); err != nil {
+		return err
+	}
+	return d.oneTimeKeys.deleteOneTimeKeys(ctx, txn, userID, deviceID)
+}
+
+// StoreCrossSigningKeys replaces the cross-signing keys of the user which have
+// the given purposes.
+func (d *Database) StoreCrossSigningKeys(
+	ctx context.Context, userID string,
+	keys map[authtypes.CrossSigningKeyPurpose]authtypes.CrossSigningKey,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for purpose, key := range keys {
+			if err := d.crossSigningKeys.upsertCrossSigningKey(ctx, txn, userID, purpose, key); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
+
+// CrossSigningKeysForUser returns the cross-signing keys of the user keyed by
+// their purpose.
+func (d *Database) CrossSigningKeysForUser(
+	ctx context.Context, userID string,
+) (map[authtypes.CrossSigningKeyPurpose]authtypes.CrossSigningKey, error) {
+	return d.crossSigningKeys.selectCrossSigningKeysForUser(ctx, userID)
+}
+
+// StoreCrossSigningSignatures stores signatures of keys, replacing any earlier
+// signatures made by the same keys of the same keys.
+func (d *Database) StoreCrossSigningSignatures(
+	ctx context.Context, sigs []authtypes.CrossSigningSignature,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for _, sig := range sigs {
+			if err := d.crossSigningSigs.upsertCrossSigningSig(ctx, txn, sig); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CrossSigningSignaturesForKey returns the signatures which have been uploaded
+// for a key of a user.
+func (d *Database) CrossSigningSignaturesForKey(
+	ctx context.Context, targetUserID, targetKeyID string,
+) ([]authtypes.CrossSigningSignature, error) {
+	return d.crossSigningSigs.selectCrossSigningSigsForTarget(ctx, targetUserID, targetKeyID)
+}
+
+// StoreDeviceKeys replaces the identity keys of a device.
+func (d *Database) StoreDeviceKeys(
+	ctx context.Context, userID, deviceID string, keyJSON json.RawMessage,
+) error {
+	return d.deviceKeys.upsertDeviceKeys(ctx, nil, userID, deviceID, keyJSON)
+}
+
+// DeviceKeysForUser returns the identity keys of the devices of the user keyed
+// by device ID.
+func (d *Database) DeviceKeysForUser(
+	ctx context.Context, userID string,
+) (map[string]json.RawMessage, error) {
+	return d.deviceKeys.selectDeviceKeysForUser(ctx, userID)
+}
+
+// StoreOneTimeKeys stores one-time keys of a device and returns how many
+// unclaimed one-time keys the device has for each algorithm afterwards.
+func (d *Database) StoreOneTimeKeys(
+	ctx context.Context, userID, deviceID string, keys []authtypes.OneTimeKey,
+) (counts map[string]int, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for _, key := range keys {
+			if err = d.oneTimeKeys.insertOneTimeKey(ctx, txn, key); err != nil {
+				return err
+			}
+		}
+		counts, err = d.oneTimeKeys.selectOneTimeKeyCounts(ctx, txn, userID, deviceID)
+		return err
+	})
+	return
+}
+
+// OneTimeKeyCounts returns how many unclaimed one-time keys the device has for
+// each algorithm.
+func (d *Database) OneTimeKeyCounts(
+	ctx context.Context, userID, deviceID string,
+) (map[string]int, error) {
+	return d.oneTimeKeys.selectOneTimeKeyCounts(ctx, nil, userID, deviceID)
+}
+
+// ClaimOneTimeKey deletes a one-time key of the device with the algorithm and
+// returns it, so that it is never handed out twice. Returns nil if the device
+// has no such keys left.
+func (d *Database) ClaimOneTimeKey(
+	ctx context.Context, userID, deviceID, algorithm string,
+) (*authtypes.OneTimeKey, error) {
+	for {
+		key, err := d.oneTimeKeys.selectOneTimeKey(ctx, userID, deviceID, algorithm)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		// Only the claim which deletes the key gets it. If another claim got
+		// there first then we try again with another key.
+		deleted, err := d.oneTimeKeys.deleteOneTimeKey(ctx, *key)
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			return key, nil
+		}
+	}
+}
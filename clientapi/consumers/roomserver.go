@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/push"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -33,6 +34,7 @@ type OutputRoomEventConsumer struct {
 	roomServerConsumer *common.ContinualConsumer
 	db                 accounts.Database
 	query              api.RoomserverQueryAPI
+	notifier           *push.Notifier
 	serverName         string
 }
 
@@ -42,6 +44,7 @@ func NewOutputRoomEventConsumer(
 	kafkaConsumer sarama.Consumer,
 	store accounts.Database,
 	queryAPI api.RoomserverQueryAPI,
+	notifier *push.Notifier,
 ) *OutputRoomEventConsumer {
 
 	consumer := common.ContinualConsumer{
@@ -53,6 +56,7 @@ func NewOutputRoomEventConsumer(
 		roomServerConsumer: &consumer,
 		db:                 store,
 		query:              queryAPI,
+		notifier:           notifier,
 		serverName:         string(cfg.Matrix.ServerName),
 	}
 	consumer.ProcessMessage = s.onMessage
@@ -96,7 +100,18 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return err
 	}
 
-	return s.db.UpdateMemberships(context.TODO(), events, output.NewRoomEvent.RemovesStateEventIDs)
+	if err = s.db.UpdateMemberships(context.TODO(), events, output.NewRoomEvent.RemovesStateEventIDs); err != nil {
+		return err
+	}
+
+	// Push notifications are best effort, so failing to send them shouldn't
+	// hold up the rest of the stream.
+	if s.notifier != nil {
+		if err = s.notifier.OnNewEvent(context.TODO(), &ev.Event); err != nil {
+			log.WithError(err).WithField("event_id", ev.EventID()).Error("failed to send push notifications")
+		}
+	}
+	return nil
 }
 
 // lookupStateEvents looks up the state events that are added by a new event.
@@ -80,6 +80,12 @@ func InvalidArgumentValue(msg string) *MatrixError {
 	return &MatrixError{"M_INVALID_ARGUMENT_VALUE", msg}
 }
 
+// InvalidParam is an error when the client provides a parameter which is
+// well formed but can't be used, such as an ID of something which doesn't exist.
+func InvalidParam(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_PARAM", msg}
+}
+
 // MissingToken is an error when the client tries to access a resource which
 // requires authentication without supplying credentials.
 func MissingToken(msg string) *MatrixError {
@@ -92,6 +98,23 @@ func UnknownToken(msg string) *MatrixError {
 	return &MatrixError{"M_UNKNOWN_TOKEN", msg}
 }
 
+// UnknownTokenError is an unknown token error which also says whether the
+// device was soft logged out.
+type UnknownTokenError struct {
+	MatrixError
+	SoftLogout bool `json:"soft_logout"`
+}
+
+// SoftLoggedOut is an error when the client supplies the expired access token
+// of a device which still exists, so it can log in again without losing the
+// encryption keys of the device.
+func SoftLoggedOut(msg string) *UnknownTokenError {
+	return &UnknownTokenError{
+		MatrixError: MatrixError{"M_UNKNOWN_TOKEN", msg},
+		SoftLogout:  true,
+	}
+}
+
 // WeakPassword is an error which is returned when the client tries to register
 // using a weak password. http://matrix.org/docs/spec/client_server/r0.2.0.html#password-based
 func WeakPassword(msg string) *MatrixError {
@@ -110,6 +133,12 @@ func UserInUse(msg string) *MatrixError {
 	return &MatrixError{"M_USER_IN_USE", msg}
 }
 
+// UserDeactivated is an error returned when the client tries to log in to an
+// account which has been deactivated.
+func UserDeactivated(msg string) *MatrixError {
+	return &MatrixError{"M_USER_DEACTIVATED", msg}
+}
+
 // ASExclusive is an error returned when an application service tries to
 // register an username that is outside of its registered namespace, or if a
 // user attempts to register a username or room alias within an exclusive
@@ -130,6 +159,30 @@ func UnsupportedRoomVersion(msg string) *MatrixError {
 	return &MatrixError{"M_UNSUPPORTED_ROOM_VERSION", msg}
 }
 
+// TooLarge is an error when the client uploads content which is larger than
+// the server allows.
+func TooLarge(msg string) *MatrixError {
+	return &MatrixError{"M_TOO_LARGE", msg}
+}
+
+// InvalidSignature is an error which is returned when the client uploads a
+// key or signature which isn't signed by the key it claims to be.
+func InvalidSignature(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_SIGNATURE", msg}
+}
+
+// UnableToAuthoriseJoin is an error which is returned when a server is asked
+// to authorise a join to a restricted room but has no user who can.
+func UnableToAuthoriseJoin(msg string) *MatrixError {
+	return &MatrixError{"M_UNABLE_TO_AUTHORISE_JOIN", msg}
+}
+
+// BadAlias is an error which is returned when the client sets an alias of a
+// room which doesn't point to the room.
+func BadAlias(msg string) *MatrixError {
+	return &MatrixError{"M_BAD_ALIAS", msg}
+}
+
 // LimitExceededError is a rate-limiting error.
 type LimitExceededError struct {
 	MatrixError
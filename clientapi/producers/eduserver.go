@@ -14,6 +14,7 @@ package producers
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
 	"github.com/matrix-org/dendrite/eduserver/api"
@@ -52,3 +53,99 @@ func (p *EDUServerProducer) SendTyping(
 
 	return err
 }
+
+// SendReceipt sends a receipt event to EDU server
+func (p *EDUServerProducer) SendReceipt(
+	ctx context.Context, userID, roomID, eventID, receiptType string,
+) error {
+	requestData := api.InputReceiptEvent{
+		UserID:    userID,
+		RoomID:    roomID,
+		EventID:   eventID,
+		Type:      receiptType,
+		Timestamp: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+
+	var response api.InputReceiptEventResponse
+	return p.InputAPI.InputReceiptEvent(
+		ctx, &api.InputReceiptEventRequest{InputReceiptEvent: requestData}, &response,
+	)
+}
+
+// SendRemoteReceipt sends a receipt received from another server to EDU
+// server
+func (p *EDUServerProducer) SendRemoteReceipt(
+	ctx context.Context, userID, roomID, eventID, receiptType string,
+	timestamp gomatrixserverlib.Timestamp,
+) error {
+	requestData := api.InputReceiptEvent{
+		UserID:    userID,
+		RoomID:    roomID,
+		EventID:   eventID,
+		Type:      receiptType,
+		Timestamp: timestamp,
+	}
+
+	var response api.InputReceiptEventResponse
+	return p.InputAPI.InputReceiptEvent(
+		ctx, &api.InputReceiptEventRequest{InputReceiptEvent: requestData}, &response,
+	)
+}
+
+// SendPresence sends a presence update for a local user to EDU server
+func (p *EDUServerProducer) SendPresence(
+	ctx context.Context, userID, presence string, statusMsg *string,
+) error {
+	requestData := api.InputPresenceEvent{
+		UserID:    userID,
+		Presence:  presence,
+		StatusMsg: statusMsg,
+		Timestamp: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+
+	var response api.InputPresenceEventResponse
+	return p.InputAPI.InputPresenceEvent(
+		ctx, &api.InputPresenceEventRequest{InputPresenceEvent: requestData}, &response,
+	)
+}
+
+// SendRemotePresence sends a presence update received from another server
+// to EDU server
+func (p *EDUServerProducer) SendRemotePresence(
+	ctx context.Context, userID, presence string, statusMsg *string,
+	lastActiveTS gomatrixserverlib.Timestamp, currentlyActive bool,
+) error {
+	requestData := api.InputPresenceEvent{
+		UserID:          userID,
+		Presence:        presence,
+		StatusMsg:       statusMsg,
+		Timestamp:       lastActiveTS,
+		CurrentlyActive: currentlyActive,
+	}
+
+	var response api.InputPresenceEventResponse
+	return p.InputAPI.InputPresenceEvent(
+		ctx, &api.InputPresenceEventRequest{InputPresenceEvent: requestData}, &response,
+	)
+}
+
+// SendToDevice sends a message from a user to a device of another user to
+// EDU server. The device ID can be "*" to send the message to all of the
+// devices of the user.
+func (p *EDUServerProducer) SendToDevice(
+	ctx context.Context, sender, userID, deviceID, eventType string,
+	content json.RawMessage,
+) error {
+	requestData := api.InputSendToDeviceEvent{
+		UserID:   userID,
+		DeviceID: deviceID,
+		Sender:   sender,
+		Type:     eventType,
+		Content:  content,
+	}
+
+	var response api.InputSendToDeviceEventResponse
+	return p.InputAPI.InputSendToDeviceEvent(
+		ctx, &api.InputSendToDeviceEventRequest{InputSendToDeviceEvent: requestData}, &response,
+	)
+}
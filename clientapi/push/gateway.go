@@ -0,0 +1,201 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/pushrules"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/i2p"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// How long to wait for a push gateway to accept a notification. Gateways on
+// I2P take much longer to reach than others.
+const (
+	pushTimeout    = 30 * time.Second
+	i2pPushTimeout = 3 * time.Minute
+)
+
+var errI2PPushDisabled = errors.New("push gateways with .i2p URLs need I2P to be enabled")
+
+// notifyRequest is the body of POST /_matrix/push/v1/notify
+// https://matrix.org/docs/spec/push_gateway/r0.1.1#post-matrix-push-v1-notify
+type notifyRequest struct {
+	Notification notification `json:"notification"`
+}
+
+type notification struct {
+	EventID           string          `json:"event_id"`
+	RoomID            string          `json:"room_id"`
+	Type              string          `json:"type,omitempty"`
+	Sender            string          `json:"sender,omitempty"`
+	SenderDisplayName string          `json:"sender_display_name,omitempty"`
+	UserIsTarget      bool            `json:"user_is_target,omitempty"`
+	Priority          string          `json:"prio,omitempty"`
+	Content           json.RawMessage `json:"content,omitempty"`
+	Counts            counts          `json:"counts"`
+	Devices           []device        `json:"devices"`
+}
+
+type counts struct {
+	Unread int64 `json:"unread"`
+}
+
+type device struct {
+	AppID     string                             `json:"app_id"`
+	PushKey   string                             `json:"pushkey"`
+	PushKeyTS int64                              `json:"pushkey_ts,omitempty"`
+	Data      map[string]interface{}             `json:"data,omitempty"`
+	Tweaks    map[pushrules.TweakKey]interface{} `json:"tweaks,omitempty"`
+}
+
+type notifyResponse struct {
+	// The push keys which the gateway no longer accepts notifications for.
+	Rejected []string `json:"rejected"`
+}
+
+// newNotifyRequest builds the notification about an event for a pusher of
+// the given user. Pushers using the event_id_only format are only told the
+// IDs of the event and the room.
+func newNotifyRequest(
+	ev *gomatrixserverlib.Event, userID, senderDisplayName string, unread int64,
+	pusher authtypes.Pusher, tweaks map[pushrules.TweakKey]interface{},
+) *notifyRequest {
+	// The pusher data is passed on to the gateway, apart from its own URL.
+	var data map[string]interface{}
+	if pusher.Data.Format != "" {
+		data = map[string]interface{}{"format": pusher.Data.Format}
+	}
+	n := notification{
+		EventID: ev.EventID(),
+		RoomID:  ev.RoomID(),
+		Counts:  counts{Unread: unread},
+		Devices: []device{{
+			AppID:     pusher.AppID,
+			PushKey:   pusher.PushKey,
+			PushKeyTS: pusher.PushKeyTS,
+			Data:      data,
+			Tweaks:    tweaks,
+		}},
+	}
+	if pusher.Data.Format != EventIDOnlyFormat {
+		n.Type = ev.Type()
+		n.Sender = ev.Sender()
+		n.SenderDisplayName = senderDisplayName
+		n.UserIsTarget = ev.StateKeyEquals(userID)
+		n.Content = ev.Content()
+		// Notifications which the user can't hear or see can wait.
+		n.Priority = "low"
+		if tweaks[pushrules.HighlightTweak] == true || tweaks[pushrules.SoundTweak] != nil {
+			n.Priority = "high"
+		}
+	}
+	return &notifyRequest{Notification: n}
+}
+
+// postNotification sends a notification to a push gateway, and returns the
+// push keys that the gateway rejected.
+func postNotification(
+	ctx context.Context, client *http.Client, gatewayURL string, body *notifyRequest,
+) ([]string, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, gatewayURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("push gateway returned %d", res.StatusCode)
+	}
+	var notifyRes notifyResponse
+	if err = json.NewDecoder(res.Body).Decode(&notifyRes); err != nil {
+		return nil, err
+	}
+	return notifyRes.Rejected, nil
+}
+
+// timeoutFor returns how long to wait for the push gateway at a URL.
+func timeoutFor(gatewayURL string) time.Duration {
+	if u, err := url.Parse(gatewayURL); err == nil && i2p.IsI2PHost(u.Host) {
+		return i2pPushTimeout
+	}
+	return pushTimeout
+}
+
+// NewClient returns the HTTP client to send notifications to push gateways
+// with. Notifications to .i2p gateways are sent through the SAM bridge, and
+// can't be sent at all unless I2P is enabled.
+func NewClient(cfg *config.Dendrite) *http.Client {
+	return &http.Client{Transport: newGatewayTransport(cfg)}
+}
+
+// gatewayTransport sends requests to .i2p hosts through the SAM bridge, and
+// requests to other hosts directly.
+type gatewayTransport struct {
+	clearnet http.RoundTripper
+	// nil unless I2P is enabled
+	i2p http.RoundTripper
+}
+
+func newGatewayTransport(cfg *config.Dendrite) *gatewayTransport {
+	// Pushers are set by clients, so they mustn't be able to make the server
+	// send requests to its own network.
+	dialer := &net.Dialer{
+		Timeout: pushTimeout,
+		Control: common.RefusePrivateNetworks,
+	}
+	t := &gatewayTransport{clearnet: &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}}
+	if cfg.Matrix.I2P.Enabled {
+		t.i2p = &http.Transport{
+			DialContext: i2p.NewDialer(cfg.Matrix.I2P.SAMAddress).DialContext,
+		}
+	}
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *gatewayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if i2p.IsI2PHost(req.URL.Host) {
+		// Never look .i2p hosts up outside of I2P
+		if t.i2p == nil {
+			return nil, errI2PPushDisabled
+		}
+		return t.i2p.RoundTrip(req)
+	}
+	return t.clearnet.RoundTrip(req)
+}
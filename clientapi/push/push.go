@@ -0,0 +1,261 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package push sends notifications about new events to the push gateways of
+// local users, as decided by their push rules.
+// https://matrix.org/docs/spec/push_gateway/r0.1.1
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/pushrules"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PushRulesType is the type of the account data holding the push rules of a user.
+const PushRulesType = "m.push_rules"
+
+// EventIDOnlyFormat is the format of notifications which only include the
+// IDs of the event and the room, and the unread counts, so that the contents
+// of events aren't sent to the push gateway.
+const EventIDOnlyFormat = "event_id_only"
+
+// HTTPPusherKind is the kind of the pushers that send notifications to a
+// push gateway over HTTP.
+const HTTPPusherKind = "http"
+
+// Notifier notifies the local members of rooms about the events they receive,
+// according to their push rules.
+type Notifier struct {
+	db         accounts.Database
+	queryAPI   api.RoomserverQueryAPI
+	serverName gomatrixserverlib.ServerName
+	client     *http.Client
+}
+
+// NewNotifier creates a new Notifier. Notifications are sent with the given
+// HTTP client, whose transport should take care of .i2p push gateways.
+func NewNotifier(
+	db accounts.Database, queryAPI api.RoomserverQueryAPI,
+	serverName gomatrixserverlib.ServerName, client *http.Client,
+) *Notifier {
+	return &Notifier{
+		db:         db,
+		queryAPI:   queryAPI,
+		serverName: serverName,
+		client:     client,
+	}
+}
+
+// recipient is a local user who may be notified about an event.
+type recipient struct {
+	userID      string
+	localpart   string
+	displayName string
+}
+
+// OnNewEvent evaluates the push rules of the local users in the room of a new
+// event, and counts and sends a notification to each user that the rules say
+// to notify. Sending an event into a room marks the notifications of its sender
+// in the room as read.
+// The notifications are sent in the background, so they don't hold up the
+// processing of other events.
+func (n *Notifier) OnNewEvent(ctx context.Context, ev *gomatrixserverlib.Event) error {
+	if localpart, domain, err := gomatrixserverlib.SplitID('@', ev.Sender()); err == nil && domain == n.serverName {
+		if err = n.db.ResetNotificationCount(ctx, localpart, ev.RoomID()); err != nil {
+			return err
+		}
+	}
+
+	membersReq := api.QueryMembershipsForRoomRequest{
+		JoinedOnly: true,
+		RoomID:     ev.RoomID(),
+		Sender:     ev.Sender(),
+	}
+	var membersRes api.QueryMembershipsForRoomResponse
+	if err := n.queryAPI.QueryMembershipsForRoom(ctx, &membersReq, &membersRes); err != nil {
+		return err
+	}
+	evalCtx, err := n.evaluationContext(ctx, ev)
+	if err != nil {
+		return err
+	}
+	evalCtx.RoomMemberCount = len(membersRes.JoinEvents)
+
+	var senderDisplayName string
+	var recipients []recipient
+	for _, member := range membersRes.JoinEvents {
+		if member.StateKey == nil {
+			continue
+		}
+		var content gomatrixserverlib.MemberContent
+		_ = json.Unmarshal(member.Content, &content)
+		if *member.StateKey == ev.Sender() {
+			senderDisplayName = content.DisplayName
+			continue
+		}
+		localpart, domain, serr := gomatrixserverlib.SplitID('@', *member.StateKey)
+		if serr != nil || domain != n.serverName {
+			continue
+		}
+		recipients = append(recipients, recipient{*member.StateKey, localpart, content.DisplayName})
+	}
+	// Invited users aren't in the room yet but should still hear about their
+	// invites.
+	if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKey() != nil {
+		if membership, merr := ev.Membership(); merr == nil && membership == gomatrixserverlib.Invite {
+			localpart, domain, serr := gomatrixserverlib.SplitID('@', *ev.StateKey())
+			if serr == nil && domain == n.serverName {
+				recipients = append(recipients, recipient{*ev.StateKey(), localpart, ""})
+			}
+		}
+	}
+
+	for _, r := range recipients {
+		evalCtx.UserDisplayName = r.displayName
+		if err = n.notify(ctx, ev, r, senderDisplayName, evalCtx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evaluationContext returns what the push rules need to know about the power
+// levels of the room of an event.
+func (n *Notifier) evaluationContext(
+	ctx context.Context, ev *gomatrixserverlib.Event,
+) (pushrules.EvaluationContext, error) {
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: ev.RoomID(),
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""},
+		},
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := n.queryAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return pushrules.EvaluationContext{}, err
+	}
+	var levels gomatrixserverlib.PowerLevelContent
+	levels.Defaults()
+	var notifications struct {
+		Notifications map[string]int64 `json:"notifications"`
+	}
+	for _, state := range stateRes.StateEvents {
+		if content, err := gomatrixserverlib.NewPowerLevelContentFromEvent(state.Unwrap()); err == nil {
+			levels = content
+		}
+		_ = json.Unmarshal(state.Content(), &notifications)
+	}
+	return pushrules.EvaluationContext{
+		SenderPowerLevel:        levels.UserLevel(ev.Sender()),
+		NotificationPowerLevels: notifications.Notifications,
+	}, nil
+}
+
+// notify evaluates the push rules of a user against an event, and if they say
+// to notify the user then counts the notification and sends it to their pushers.
+func (n *Notifier) notify(
+	ctx context.Context, ev *gomatrixserverlib.Event, r recipient,
+	senderDisplayName string, evalCtx pushrules.EvaluationContext,
+) error {
+	rules, err := GetPushRules(ctx, n.db, r.localpart, r.userID)
+	if err != nil {
+		return err
+	}
+	rule, err := rules.Global.MatchEvent(ev, &evalCtx)
+	if err != nil {
+		return err
+	}
+	if rule == nil || !pushrules.ShouldNotify(rule.Actions) {
+		return nil
+	}
+
+	if err = n.db.IncrementNotificationCount(ctx, r.localpart, ev.RoomID()); err != nil {
+		return err
+	}
+	unread, err := n.db.GetUnreadNotificationCount(ctx, r.localpart)
+	if err != nil {
+		return err
+	}
+	pushers, err := n.db.GetPushersByLocalpart(ctx, r.localpart)
+	if err != nil {
+		return err
+	}
+
+	tweaks := pushrules.Tweaks(rule.Actions)
+	for _, pusher := range pushers {
+		if pusher.Kind != HTTPPusherKind {
+			continue
+		}
+		req := newNotifyRequest(ev, r.userID, senderDisplayName, unread, pusher, tweaks)
+		go n.send(r.localpart, pusher, req)
+	}
+	return nil
+}
+
+// GetPushRules returns the push rules of a local user. Accounts which don't
+// have any rules, such as those created before push rules were supported,
+// get the server-default rules.
+func GetPushRules(
+	ctx context.Context, db accounts.Database, localpart, userID string,
+) (*pushrules.AccountRuleSets, error) {
+	data, err := db.GetAccountDataByType(ctx, localpart, "", PushRulesType)
+	if err != nil {
+		return nil, err
+	}
+	var rules pushrules.AccountRuleSets
+	if data != nil {
+		if err = json.Unmarshal(data.Content, &rules); err != nil {
+			return nil, err
+		}
+	}
+	if rules.Global.IsEmpty() {
+		return pushrules.DefaultAccountRuleSets(userID)
+	}
+	return &rules, nil
+}
+
+// send sends a notification to the push gateway of a pusher, and removes the
+// pusher if the gateway rejects its push key.
+func (n *Notifier) send(localpart string, pusher authtypes.Pusher, req *notifyRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutFor(pusher.Data.URL))
+	defer cancel()
+	logger := log.WithFields(log.Fields{
+		"localpart": localpart,
+		"app_id":    pusher.AppID,
+		"event_id":  req.Notification.EventID,
+	})
+	rejected, err := postNotification(ctx, n.client, pusher.Data.URL, req)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to send push notification")
+		return
+	}
+	for _, pushKey := range rejected {
+		if pushKey != pusher.PushKey {
+			continue
+		}
+		logger.Info("Push gateway rejected push key, removing pusher")
+		if err = n.db.RemovePusher(ctx, localpart, pusher.AppID, pusher.PushKey); err != nil {
+			logger.WithError(err).Error("Failed to remove rejected pusher")
+		}
+	}
+}
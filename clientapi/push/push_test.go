@@ -0,0 +1,284 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testRoomID = "!push:localhost"
+
+// testMembers answers queries about a room with alice and bob in it.
+type testMembers struct {
+	api.RoomserverQueryAPI
+	t *testing.T
+}
+
+func (m testMembers) QueryMembershipsForRoom(
+	ctx context.Context,
+	request *api.QueryMembershipsForRoomRequest,
+	response *api.QueryMembershipsForRoomResponse,
+) error {
+	response.HasBeenInRoom = true
+	for userID, displayName := range map[string]string{"@alice:localhost": "Alice", "@bob:localhost": "Bobby"} {
+		stateKey := userID
+		content, err := json.Marshal(gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join, DisplayName: displayName})
+		if err != nil {
+			m.t.Fatal(err)
+		}
+		response.JoinEvents = append(response.JoinEvents, gomatrixserverlib.ClientEvent{
+			Type: gomatrixserverlib.MRoomMember, StateKey: &stateKey, Sender: userID, Content: content,
+		})
+	}
+	return nil
+}
+
+func (m testMembers) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	response.RoomExists = true
+	return nil
+}
+
+// pushTest is a notifier for the local users of a room, whose notifications
+// are sent to a mock push gateway.
+type pushTest struct {
+	t          *testing.T
+	db         accounts.Database
+	notifier   *Notifier
+	gateway    *httptest.Server
+	notified   chan notifyRequest
+	rejected   []string
+	privateKey ed25519.PrivateKey
+}
+
+func newPushTest(t *testing.T) (*pushTest, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := accounts.NewDatabase("file:"+filepath.Join(dir, "account.db"), nil, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, localpart := range []string{"alice", "bob"} {
+		if _, err = db.CreateAccount(context.Background(), localpart, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &pushTest{t: t, db: db, notified: make(chan notifyRequest, 10), privateKey: privateKey}
+	p.gateway = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body notifyRequest
+		if req.URL.Path != "/_matrix/push/v1/notify" || json.NewDecoder(req.Body).Decode(&body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(notifyResponse{Rejected: p.rejected})
+		p.notified <- body
+	}))
+	p.notifier = NewNotifier(db, testMembers{t: t}, "localhost", p.gateway.Client())
+	return p, func() {
+		p.gateway.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// addPusher registers a pusher for bob which uses the given format.
+func (p *pushTest) addPusher(format string) {
+	err := p.db.SetPusher(context.Background(), "bob", &authtypes.Pusher{
+		PushKey:   "bobs-phone",
+		Kind:      HTTPPusherKind,
+		AppID:     "org.example.app",
+		Data:      authtypes.PusherData{URL: p.gateway.URL + "/_matrix/push/v1/notify", Format: format},
+		PushKeyTS: 1000,
+	}, true)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// send passes a new message in the room to the notifier.
+func (p *pushTest) send(sender, body string) *gomatrixserverlib.Event {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     sender,
+		RoomID:     testRoomID,
+		Type:       "m.room.message",
+		PrevEvents: []gomatrixserverlib.EventReference{},
+		AuthEvents: []gomatrixserverlib.EventReference{},
+		Depth:      1,
+	}
+	if err := builder.SetContent(map[string]interface{}{"msgtype": "m.text", "body": body}); err != nil {
+		p.t.Fatal(err)
+	}
+	ev, err := builder.Build(time.Now(), "localhost", "ed25519:test", p.privateKey, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if err = p.notifier.OnNewEvent(context.Background(), &ev); err != nil {
+		p.t.Fatal(err)
+	}
+	return &ev
+}
+
+// next waits for the next notification received by the push gateway.
+func (p *pushTest) next() notification {
+	select {
+	case req := <-p.notified:
+		return req.Notification
+	case <-time.After(5 * time.Second):
+		p.t.Fatal("expected a notification to be sent to the push gateway")
+		return notification{}
+	}
+}
+
+func TestMentionSendsNotificationToPushGateway(t *testing.T) {
+	p, cleanup := newPushTest(t)
+	defer cleanup()
+	p.addPusher("")
+
+	ev := p.send("@alice:localhost", "hey @bob:localhost, look at this")
+	n := p.next()
+	if n.EventID != ev.EventID() || n.RoomID != testRoomID || n.Type != "m.room.message" ||
+		n.Sender != "@alice:localhost" || n.SenderDisplayName != "Alice" || n.Priority != "high" {
+		t.Errorf("expected a high priority notification about the message, got %+v", n)
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal(n.Content, &content); err != nil || content["body"] != "hey @bob:localhost, look at this" {
+		t.Errorf("expected the content of the message in the notification, got %s", string(n.Content))
+	}
+	if n.Counts.Unread != 1 {
+		t.Errorf("expected 1 unread notification, got %d", n.Counts.Unread)
+	}
+	if len(n.Devices) != 1 {
+		t.Fatalf("expected the notification to be sent to 1 device, got %d", len(n.Devices))
+	}
+	d := n.Devices[0]
+	if d.AppID != "org.example.app" || d.PushKey != "bobs-phone" || d.PushKeyTS != 1000 {
+		t.Errorf("expected the notification to be sent to the pusher of bob, got %+v", d)
+	}
+	if d.Tweaks["highlight"] != true || d.Tweaks["sound"] != "default" {
+		t.Errorf("expected the mention to be highlighted with a sound, got %v", d.Tweaks)
+	}
+
+	// Mentioning the display name of bob also highlights the message, and
+	// the notifications add up.
+	p.send("@alice:localhost", "Bobby: are you there?")
+	if n = p.next(); n.Counts.Unread != 2 || n.Devices[0].Tweaks["highlight"] != true {
+		t.Errorf("expected a second highlighted notification, got %+v", n)
+	}
+
+	// Sending a message marks the notifications of bob as read.
+	p.send("@bob:localhost", "yes")
+	if unread, err := p.db.GetUnreadNotificationCount(context.Background(), "bob"); err != nil || unread != 0 {
+		t.Errorf("expected no unread notifications after bob replied, got %d (%v)", unread, err)
+	}
+}
+
+func TestMessageWithoutMentionIsNotHighlighted(t *testing.T) {
+	p, cleanup := newPushTest(t)
+	defer cleanup()
+	p.addPusher("")
+
+	p.send("@alice:localhost", "the weather is nice")
+	n := p.next()
+	if n.Priority != "high" {
+		// The room only has two members, so messages play a sound.
+		t.Errorf("expected a high priority notification in a one to one room, got %q", n.Priority)
+	}
+	if tweaks := n.Devices[0].Tweaks; tweaks["highlight"] != false {
+		t.Errorf("expected the message not to be highlighted, got %v", tweaks)
+	}
+}
+
+func TestEventIDOnlyFormat(t *testing.T) {
+	p, cleanup := newPushTest(t)
+	defer cleanup()
+	p.addPusher(EventIDOnlyFormat)
+
+	ev := p.send("@alice:localhost", "hey @bob:localhost")
+	n := p.next()
+	if n.EventID != ev.EventID() || n.RoomID != testRoomID || n.Counts.Unread != 1 {
+		t.Errorf("expected the event and room IDs and the counts, got %+v", n)
+	}
+	if n.Type != "" || n.Sender != "" || n.SenderDisplayName != "" || n.Content != nil {
+		t.Errorf("expected nothing else about the event, got %+v", n)
+	}
+	if n.Devices[0].Data["format"] != EventIDOnlyFormat {
+		t.Errorf("expected the format to be passed to the gateway, got %v", n.Devices[0].Data)
+	}
+}
+
+func TestRejectedPushKeyRemovesPusher(t *testing.T) {
+	p, cleanup := newPushTest(t)
+	defer cleanup()
+	p.addPusher("")
+	p.rejected = []string{"bobs-phone"}
+
+	p.send("@alice:localhost", "hey @bob:localhost")
+	p.next()
+	// The pusher is removed after the gateway responds.
+	for i := 0; i < 50; i++ {
+		pushers, err := p.db.GetPushersByLocalpart(context.Background(), "bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pushers) == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("expected the rejected pusher to be removed")
+}
+
+func TestPushGatewaysOnPrivateNetworksAreRefused(t *testing.T) {
+	called := false
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	}))
+	defer gateway.Close()
+
+	client := NewClient(&config.Dendrite{})
+	res, err := client.Post(gateway.URL+"/_matrix/push/v1/notify", "application/json", strings.NewReader(`{}`))
+	if err == nil {
+		res.Body.Close() // nolint: errcheck
+		t.Fatal("expected the request to a gateway on the loopback network to fail")
+	}
+	if called {
+		t.Error("expected the gateway not to be reached")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DefaultAccountRuleSets returns the server-default push rules of the user
+// with the given ID, as described by
+// https://matrix.org/docs/spec/client_server/r0.6.0#predefined-rules
+func DefaultAccountRuleSets(userID string) (*AccountRuleSets, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	return &AccountRuleSets{Global: RuleSet{
+		Override: []*Rule{
+			{
+				RuleID:  ".m.rule.master",
+				Default: true,
+				Enabled: false,
+				Actions: []*Action{{Kind: DontNotifyAction}},
+			},
+			{
+				RuleID:     ".m.rule.suppress_notices",
+				Default:    true,
+				Enabled:    true,
+				Conditions: []*Condition{eventMatch("content.msgtype", "m.notice")},
+				Actions:    []*Action{{Kind: DontNotifyAction}},
+			},
+			{
+				RuleID:  ".m.rule.invite_for_me",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", gomatrixserverlib.MRoomMember),
+					eventMatch("content.membership", gomatrixserverlib.Invite),
+					eventMatch("state_key", userID),
+				},
+				Actions: []*Action{{Kind: NotifyAction}, sound("default"), highlight(false)},
+			},
+			{
+				RuleID:     ".m.rule.member_event",
+				Default:    true,
+				Enabled:    true,
+				Conditions: []*Condition{eventMatch("type", gomatrixserverlib.MRoomMember)},
+				Actions:    []*Action{{Kind: DontNotifyAction}},
+			},
+			{
+				RuleID:     ".m.rule.contains_display_name",
+				Default:    true,
+				Enabled:    true,
+				Conditions: []*Condition{{Kind: ContainsDisplayNameCondition}},
+				Actions:    []*Action{{Kind: NotifyAction}, sound("default"), highlight(true)},
+			},
+			{
+				RuleID:  ".m.rule.tombstone",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", "m.room.tombstone"),
+					eventMatch("state_key", ""),
+				},
+				Actions: []*Action{{Kind: NotifyAction}, highlight(true)},
+			},
+			{
+				RuleID:  ".m.rule.roomnotif",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("content.body", "@room"),
+					{Kind: SenderNotificationPermissionCondition, Key: "room"},
+				},
+				Actions: []*Action{{Kind: NotifyAction}, highlight(true)},
+			},
+		},
+		Content: []*Rule{
+			{
+				RuleID:  ".m.rule.contains_user_name",
+				Default: true,
+				Enabled: true,
+				Pattern: localpart,
+				Actions: []*Action{{Kind: NotifyAction}, sound("default"), highlight(true)},
+			},
+		},
+		Room:   []*Rule{},
+		Sender: []*Rule{},
+		Underride: []*Rule{
+			{
+				RuleID:     ".m.rule.call",
+				Default:    true,
+				Enabled:    true,
+				Conditions: []*Condition{eventMatch("type", "m.call.invite")},
+				Actions:    []*Action{{Kind: NotifyAction}, sound("ring"), highlight(false)},
+			},
+			{
+				RuleID:  ".m.rule.encrypted_room_one_to_one",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					{Kind: RoomMemberCountCondition, Is: "2"},
+					eventMatch("type", "m.room.encrypted"),
+				},
+				Actions: []*Action{{Kind: NotifyAction}, sound("default"), highlight(false)},
+			},
+			{
+				RuleID:  ".m.rule.room_one_to_one",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					{Kind: RoomMemberCountCondition, Is: "2"},
+					eventMatch("type", "m.room.message"),
+				},
+				Actions: []*Action{{Kind: NotifyAction}, sound("default"), highlight(false)},
+			},
+			{
+				RuleID:     ".m.rule.message",
+				Default:    true,
+				Enabled:    true,
+				Conditions: []*Condition{eventMatch("type", "m.room.message")},
+				Actions:    []*Action{{Kind: NotifyAction}, highlight(false)},
+			},
+			{
+				RuleID:     ".m.rule.encrypted",
+				Default:    true,
+				Enabled:    true,
+				Conditions: []*Condition{eventMatch("type", "m.room.encrypted")},
+				Actions:    []*Action{{Kind: NotifyAction}, highlight(false)},
+			},
+		},
+	}}, nil
+}
+
+func eventMatch(key, pattern string) *Condition {
+	return &Condition{Kind: EventMatchCondition, Key: key, Pattern: pattern}
+}
+
+func sound(value string) *Action {
+	return &Action{Kind: SetTweakAction, Tweak: SoundTweak, Value: value}
+}
+
+func highlight(value bool) *Action {
+	return &Action{Kind: SetTweakAction, Tweak: HighlightTweak, Value: value}
+}
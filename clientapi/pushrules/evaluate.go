@@ -0,0 +1,168 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// defaultRoomNotificationLevel is the power level needed to notify the whole
+// room with "@room", if the power levels of the room don't say otherwise.
+const defaultRoomNotificationLevel = 50
+
+// EvaluationContext is what the conditions of push rules need to know about
+// the room and the user being notified, other than the event itself.
+type EvaluationContext struct {
+	// The display name of the user being notified in the room, if they have one.
+	UserDisplayName string
+	// The number of users who are joined to the room.
+	RoomMemberCount int
+	// The power level of the sender of the event.
+	SenderPowerLevel int64
+	// The power level needed to send each kind of notification, from the
+	// "notifications" of the power levels of the room.
+	NotificationPowerLevels map[string]int64
+}
+
+// MatchEvent returns the first enabled rule which matches the event, or nil
+// if none of the rules match it.
+func (rs *RuleSet) MatchEvent(
+	event *gomatrixserverlib.Event, ctx *EvaluationContext,
+) (*Rule, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(event.JSON(), &fields); err != nil {
+		return nil, err
+	}
+	kinds := []struct {
+		rules      []*Rule
+		conditions func(rule *Rule) []*Condition
+	}{
+		{rs.Override, func(rule *Rule) []*Condition { return rule.Conditions }},
+		{rs.Content, func(rule *Rule) []*Condition {
+			return []*Condition{{Kind: EventMatchCondition, Key: "content.body", Pattern: rule.Pattern}}
+		}},
+		{rs.Room, func(rule *Rule) []*Condition {
+			return []*Condition{{Kind: EventMatchCondition, Key: "room_id", Pattern: rule.RuleID}}
+		}},
+		{rs.Sender, func(rule *Rule) []*Condition {
+			return []*Condition{{Kind: EventMatchCondition, Key: "sender", Pattern: rule.RuleID}}
+		}},
+		{rs.Underride, func(rule *Rule) []*Condition { return rule.Conditions }},
+	}
+	for _, kind := range kinds {
+		for _, rule := range kind.rules {
+			if rule.Enabled && conditionsMatch(kind.conditions(rule), fields, ctx) {
+				return rule, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// conditionsMatch returns whether every one of the conditions matches the
+// event with the given fields. Conditions of unknown kinds never match.
+func conditionsMatch(
+	conditions []*Condition, fields map[string]interface{}, ctx *EvaluationContext,
+) bool {
+	for _, cond := range conditions {
+		var matches bool
+		switch cond.Kind {
+		case EventMatchCondition:
+			value, ok := lookupField(fields, cond.Key).(string)
+			matches = ok && globMatches(cond.Pattern, value, cond.Key == "content.body")
+		case ContainsDisplayNameCondition:
+			body, ok := lookupField(fields, "content.body").(string)
+			matches = ok && ctx.UserDisplayName != "" &&
+				wordsRegexp(regexp.QuoteMeta(ctx.UserDisplayName)).MatchString(body)
+		case RoomMemberCountCondition:
+			matches = memberCountMatches(cond.Is, ctx.RoomMemberCount)
+		case SenderNotificationPermissionCondition:
+			level, ok := ctx.NotificationPowerLevels[cond.Key]
+			if !ok && cond.Key == "room" {
+				level, ok = defaultRoomNotificationLevel, true
+			}
+			matches = ok && ctx.SenderPowerLevel >= level
+		}
+		if !matches {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupField returns the value of the dot-separated field of an event, or nil
+// if the event doesn't have the field.
+func lookupField(fields map[string]interface{}, key string) interface{} {
+	var value interface{} = fields
+	for _, part := range strings.Split(key, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	return value
+}
+
+// globMatches returns whether a value matches a glob, which may contain the
+// wildcards * and ?, ignoring case. The glob must match the entire value,
+// unless words is true in which case it must match some words of the value.
+func globMatches(glob, value string, words bool) bool {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.Replace(pattern, `\*`, `.*?`, -1)
+	pattern = strings.Replace(pattern, `\?`, `.`, -1)
+	if words {
+		return wordsRegexp(pattern).MatchString(value)
+	}
+	return regexp.MustCompile(`(?is)^` + pattern + `$`).MatchString(value)
+}
+
+// wordsRegexp compiles a pattern which only matches at word boundaries.
+func wordsRegexp(pattern string) *regexp.Regexp {
+	return regexp.MustCompile(`(?is)(^|\W)` + pattern + `(\W|$)`)
+}
+
+// memberCountMatches returns whether the number of members in a room matches
+// a comparison such as "2", "==2", "<10" or ">=3".
+func memberCountMatches(is string, count int) bool {
+	op := "=="
+	for _, prefix := range []string{"==", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(is, prefix) {
+			op = prefix
+			break
+		}
+	}
+	want, err := strconv.Atoi(strings.TrimPrefix(is, op))
+	if err != nil {
+		return false
+	}
+	switch op {
+	case "<":
+		return count < want
+	case ">":
+		return count > want
+	case "<=":
+		return count <= want
+	case ">=":
+		return count >= want
+	default:
+		return count == want
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func testEvent(t *testing.T, sender, eventType string, stateKey *string, content interface{}) *gomatrixserverlib.Event {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     sender,
+		RoomID:     "!room:localhost",
+		Type:       eventType,
+		StateKey:   stateKey,
+		PrevEvents: []gomatrixserverlib.EventReference{},
+		AuthEvents: []gomatrixserverlib.EventReference{},
+		Depth:      1,
+	}
+	if err = builder.SetContent(content); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := builder.Build(time.Now(), "localhost", "ed25519:test", privateKey, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ev
+}
+
+func message(t *testing.T, msgtype, body string) *gomatrixserverlib.Event {
+	return testEvent(t, "@alice:localhost", "m.room.message", nil, map[string]string{"msgtype": msgtype, "body": body})
+}
+
+func TestDefaultRulesMatch(t *testing.T) {
+	rules, err := DefaultAccountRuleSets("@bob:localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := "@bob:localhost"
+	tests := []struct {
+		name   string
+		event  *gomatrixserverlib.Event
+		ctx    EvaluationContext
+		ruleID string
+	}{
+		{"user name", message(t, "m.text", "ping BOB!"), EvaluationContext{RoomMemberCount: 5}, ".m.rule.contains_user_name"},
+		{"user name inside a word", message(t, "m.text", "bobsleigh"), EvaluationContext{RoomMemberCount: 5}, ".m.rule.message"},
+		{"display name", message(t, "m.text", "thanks Bob Smith."), EvaluationContext{UserDisplayName: "Bob Smith", RoomMemberCount: 5}, ".m.rule.contains_display_name"},
+		{"notice", message(t, "m.notice", "bob"), EvaluationContext{}, ".m.rule.suppress_notices"},
+		{"one to one", message(t, "m.text", "hi"), EvaluationContext{RoomMemberCount: 2}, ".m.rule.room_one_to_one"},
+		{"room notification", message(t, "m.text", "@room lunch"), EvaluationContext{RoomMemberCount: 5, SenderPowerLevel: 50}, ".m.rule.roomnotif"},
+		{"room notification without power", message(t, "m.text", "@room lunch"), EvaluationContext{RoomMemberCount: 5}, ".m.rule.message"},
+		{
+			"room notification with custom power", message(t, "m.text", "@room lunch"),
+			EvaluationContext{RoomMemberCount: 5, NotificationPowerLevels: map[string]int64{"room": 0}}, ".m.rule.roomnotif",
+		},
+		{
+			"invite", testEvent(t, "@alice:localhost", gomatrixserverlib.MRoomMember, &bob, map[string]string{"membership": "invite"}),
+			EvaluationContext{}, ".m.rule.invite_for_me",
+		},
+		{
+			"other member event", testEvent(t, "@alice:localhost", gomatrixserverlib.MRoomMember, &bob, map[string]string{"membership": "ban"}),
+			EvaluationContext{}, ".m.rule.member_event",
+		},
+	}
+	for _, tt := range tests {
+		rule, err := rules.Global.MatchEvent(tt.event, &tt.ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule == nil || rule.RuleID != tt.ruleID {
+			t.Errorf("%s: expected rule %s to match, got %+v", tt.name, tt.ruleID, rule)
+		}
+	}
+}
+
+func TestRoomAndSenderRules(t *testing.T) {
+	rules := RuleSet{
+		Room:   []*Rule{{RuleID: "!other:localhost", Enabled: true, Actions: []*Action{{Kind: NotifyAction}}}},
+		Sender: []*Rule{{RuleID: "@alice:localhost", Enabled: true, Actions: []*Action{{Kind: DontNotifyAction}}}},
+	}
+	rule, err := rules.MatchEvent(message(t, "m.text", "hi"), &EvaluationContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule == nil || rule.RuleID != "@alice:localhost" || ShouldNotify(rule.Actions) {
+		t.Errorf("expected the sender rule to match, got %+v", rule)
+	}
+	rules.Sender[0].Enabled = false
+	if rule, err = rules.MatchEvent(message(t, "m.text", "hi"), &EvaluationContext{}); err != nil || rule != nil {
+		t.Errorf("expected disabled rules to be skipped, got %+v (%v)", rule, err)
+	}
+}
+
+func TestMemberCountMatches(t *testing.T) {
+	tests := []struct {
+		is      string
+		count   int
+		matches bool
+	}{
+		{"2", 2, true}, {"2", 3, false}, {"==3", 3, true}, {"<3", 2, true}, {"<3", 3, false},
+		{">=3", 3, true}, {">3", 3, false}, {"<=1", 1, true}, {"lots", 1, false},
+	}
+	for _, tt := range tests {
+		if got := memberCountMatches(tt.is, tt.count); got != tt.matches {
+			t.Errorf("memberCountMatches(%q, %d) = %v, expected %v", tt.is, tt.count, got, tt.matches)
+		}
+	}
+}
+
+func TestActionsJSON(t *testing.T) {
+	input := `["notify",{"set_tweak":"sound","value":"default"},{"set_tweak":"highlight"}]`
+	var actions []*Action
+	if err := json.Unmarshal([]byte(input), &actions); err != nil {
+		t.Fatal(err)
+	}
+	if tweaks := Tweaks(actions); !ShouldNotify(actions) || tweaks[SoundTweak] != "default" || tweaks[HighlightTweak] != true {
+		t.Errorf("expected to notify with a sound and a highlight, got %v", tweaks)
+	}
+	output, err := json.Marshal(actions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != input {
+		t.Errorf("expected the actions to be encoded as %s, got %s", input, string(output))
+	}
+}
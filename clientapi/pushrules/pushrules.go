@@ -0,0 +1,209 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushrules implements the push rules which decide whether, and how,
+// users are notified about the events in their rooms.
+// https://matrix.org/docs/spec/client_server/r0.6.0#push-rules
+package pushrules
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// AccountRuleSets is the content of the m.push_rules account data of a user.
+type AccountRuleSets struct {
+	Global RuleSet `json:"global"`
+}
+
+// RuleSet holds the push rules of a user by kind. Rules of each kind are
+// evaluated in order, and the kinds are evaluated in the order of the fields.
+type RuleSet struct {
+	Override  []*Rule `json:"override"`
+	Content   []*Rule `json:"content"`
+	Room      []*Rule `json:"room"`
+	Sender    []*Rule `json:"sender"`
+	Underride []*Rule `json:"underride"`
+}
+
+// IsEmpty returns whether the rule set doesn't include any rules.
+func (rs *RuleSet) IsEmpty() bool {
+	return len(rs.Override) == 0 && len(rs.Content) == 0 && len(rs.Room) == 0 &&
+		len(rs.Sender) == 0 && len(rs.Underride) == 0
+}
+
+// Rule is a push rule.
+type Rule struct {
+	RuleID  string    `json:"rule_id"`
+	Default bool      `json:"default"`
+	Enabled bool      `json:"enabled"`
+	Actions []*Action `json:"actions"`
+	// The conditions of override and underride rules.
+	Conditions []*Condition `json:"conditions,omitempty"`
+	// The glob that the body of a message must match, for content rules.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// ConditionKind is the kind of a push rule condition.
+type ConditionKind string
+
+const (
+	// EventMatchCondition matches a field of the event against a glob.
+	EventMatchCondition ConditionKind = "event_match"
+	// ContainsDisplayNameCondition matches events whose body contains the
+	// display name of the user in the room.
+	ContainsDisplayNameCondition ConditionKind = "contains_display_name"
+	// RoomMemberCountCondition compares the number of members in the room.
+	RoomMemberCountCondition ConditionKind = "room_member_count"
+	// SenderNotificationPermissionCondition matches events whose sender has
+	// the power to send a kind of notification, such as "@room".
+	SenderNotificationPermissionCondition ConditionKind = "sender_notification_permission"
+)
+
+// Condition is a condition of a push rule.
+type Condition struct {
+	Kind ConditionKind `json:"kind"`
+	// The dot-separated field of the event to match, for event_match, or the
+	// kind of notification, for sender_notification_permission.
+	Key string `json:"key,omitempty"`
+	// The glob to match the field against, for event_match.
+	Pattern string `json:"pattern,omitempty"`
+	// The comparison of the member count, e.g. ">=2", for room_member_count.
+	Is string `json:"is,omitempty"`
+}
+
+// ActionKind is the kind of a push rule action.
+type ActionKind string
+
+const (
+	// NotifyAction notifies the user about the event.
+	NotifyAction ActionKind = "notify"
+	// DontNotifyAction doesn't notify the user about the event.
+	DontNotifyAction ActionKind = "dont_notify"
+	// CoalesceAction notifies the user about the event, possibly together
+	// with other events.
+	CoalesceAction ActionKind = "coalesce"
+	// SetTweakAction sets an option of the notification.
+	SetTweakAction ActionKind = "set_tweak"
+)
+
+// TweakKey is the name of a notification option.
+type TweakKey string
+
+const (
+	// SoundTweak is the sound to play for the notification.
+	SoundTweak TweakKey = "sound"
+	// HighlightTweak is whether the event should be highlighted.
+	HighlightTweak TweakKey = "highlight"
+)
+
+// Action is an action of a push rule. Every kind of action but set_tweak is
+// encoded as a string in JSON.
+type Action struct {
+	Kind ActionKind
+	// The option to set and its value, for set_tweak.
+	Tweak TweakKey
+	Value interface{}
+}
+
+type tweakJSON struct {
+	SetTweak TweakKey    `json:"set_tweak"`
+	Value    interface{} `json:"value,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaller
+func (a Action) MarshalJSON() ([]byte, error) {
+	if a.Kind != SetTweakAction {
+		return json.Marshal(a.Kind)
+	}
+	return json.Marshal(tweakJSON{a.Tweak, a.Value})
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (a *Action) UnmarshalJSON(data []byte) error {
+	var kind ActionKind
+	if err := json.Unmarshal(data, &kind); err == nil {
+		*a = Action{Kind: kind}
+		return nil
+	}
+	var tweak tweakJSON
+	if err := json.Unmarshal(data, &tweak); err != nil {
+		return err
+	}
+	if tweak.SetTweak == "" {
+		return errors.New("pushrules: action is neither a string nor a tweak")
+	}
+	*a = Action{Kind: SetTweakAction, Tweak: tweak.SetTweak, Value: tweak.Value}
+	return nil
+}
+
+// Tweaks returns the options that the actions set for the notification.
+// Highlighting is switched on by a highlight tweak without a value.
+func Tweaks(actions []*Action) map[TweakKey]interface{} {
+	tweaks := map[TweakKey]interface{}{}
+	for _, action := range actions {
+		if action.Kind != SetTweakAction {
+			continue
+		}
+		if action.Value == nil && action.Tweak == HighlightTweak {
+			tweaks[action.Tweak] = true
+		} else {
+			tweaks[action.Tweak] = action.Value
+		}
+	}
+	return tweaks
+}
+
+// ShouldNotify returns whether the actions notify the user.
+func ShouldNotify(actions []*Action) bool {
+	for _, action := range actions {
+		if action.Kind == NotifyAction || action.Kind == CoalesceAction {
+			return true
+		}
+	}
+	return false
+}
+
+// Kind is the kind of a push rule, which decides when it is evaluated.
+type Kind string
+
+const (
+	// OverrideKind rules are evaluated before all others.
+	OverrideKind Kind = "override"
+	// ContentKind rules match the body of messages against a pattern.
+	ContentKind Kind = "content"
+	// RoomKind rules match every event in a room.
+	RoomKind Kind = "room"
+	// SenderKind rules match every event from a user.
+	SenderKind Kind = "sender"
+	// UnderrideKind rules are evaluated after all others.
+	UnderrideKind Kind = "underride"
+)
+
+// RulesOfKind returns the rules of the given kind, or nil if the kind is unknown.
+func (rs *RuleSet) RulesOfKind(kind Kind) *[]*Rule {
+	switch kind {
+	case OverrideKind:
+		return &rs.Override
+	case ContentKind:
+		return &rs.Content
+	case RoomKind:
+		return &rs.Room
+	case SenderKind:
+		return &rs.Sender
+	case UnderrideKind:
+		return &rs.Underride
+	}
+	return nil
+}
@@ -15,7 +15,10 @@
 package routing
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 
@@ -23,6 +26,8 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/push"
+	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/util"
@@ -61,10 +66,19 @@ func GetAccountData(
 	}
 }
 
+// serverManagedAccountDataTypes are the types of account data which clients
+// can only change through their own endpoints, which check the content.
+var serverManagedAccountDataTypes = map[string]bool{
+	fullyReadType:      true,
+	push.PushRulesType: true,
+}
+
 // SaveAccountData implements PUT /user/{userId}/[rooms/{roomId}/]account_data/{type}
+// The content must be a JSON object no larger than the configured limit.
 func SaveAccountData(
 	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
-	userID string, roomID string, dataType string, syncProducer *producers.SyncAPIProducer,
+	userID string, roomID string, dataType string, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer,
 ) util.JSONResponse {
 	if userID != device.UserID {
 		return util.JSONResponse{
@@ -79,6 +93,13 @@ func SaveAccountData(
 		return jsonerror.InternalServerError()
 	}
 
+	if serverManagedAccountDataTypes[dataType] {
+		return util.JSONResponse{
+			Code: http.StatusMethodNotAllowed,
+			JSON: jsonerror.BadJSON(fmt.Sprintf("Cannot set %s through this API", dataType)),
+		}
+	}
+
 	defer req.Body.Close() // nolint: errcheck
 
 	if req.Body == http.NoBody {
@@ -88,11 +109,20 @@ func SaveAccountData(
 		}
 	}
 
-	body, err := ioutil.ReadAll(req.Body)
+	// One more byte than is allowed is read to tell whether the content is
+	// too large.
+	maxSize := int64(cfg.Matrix.MaxAccountDataSizeBytes)
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSize+1))
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("ioutil.ReadAll failed")
 		return jsonerror.InternalServerError()
 	}
+	if int64(len(body)) > maxSize {
+		return util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: jsonerror.TooLarge(fmt.Sprintf("Account data can be at most %d bytes", maxSize)),
+		}
+	}
 
 	if !json.Valid(body) {
 		return util.JSONResponse{
@@ -100,6 +130,12 @@ func SaveAccountData(
 			JSON: jsonerror.BadJSON("Bad JSON content"),
 		}
 	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) == 0 || trimmed[0] != '{' {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Account data content must be a JSON object"),
+		}
+	}
 
 	if err := accountDB.SaveAccountData(
 		req.Context(), localpart, roomID, dataType, string(body),
@@ -0,0 +1,74 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/producers"
+)
+
+func (d *deactivateTest) saveAccountData(roomID, dataType, body string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/client/r0/user/@alice:localhost/account_data/"+dataType, strings.NewReader(body))
+	res := SaveAccountData(
+		req, d.accountDB, d.device, "@alice:localhost", roomID, dataType, d.room.cfg,
+		&producers.SyncAPIProducer{Producer: testSyncProducer{}},
+	)
+	return res.Code, res.JSON
+}
+
+func TestSaveAccountDataLimitsSize(t *testing.T) {
+	d, cleanup := newDeactivateTest(t)
+	defer cleanup()
+	d.room.cfg.Matrix.MaxAccountDataSizeBytes = 100
+
+	if code, res := d.saveAccountData("", "com.example.small", `{"a":"`+strings.Repeat("x", 50)+`"}`); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	code, res := d.saveAccountData("", "com.example.large", `{"a":"`+strings.Repeat("x", 100)+`"}`)
+	if code != http.StatusRequestEntityTooLarge || !strings.Contains(res.(error).Error(), "M_TOO_LARGE") {
+		t.Errorf("expected 413 M_TOO_LARGE, got %d: %v", code, res)
+	}
+	if data, err := d.accountDB.GetAccountDataByType(context.Background(), "alice", "", "com.example.large"); err != nil || data != nil {
+		t.Errorf("expected the large account data not to be saved, got %v, %v", data, err)
+	}
+
+	for _, body := range []string{`[1, 2]`, `"string"`, `{"a":`} {
+		if code, res = d.saveAccountData("", "com.example.bad", body); code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d: %v", body, code, res)
+		}
+	}
+}
+
+func TestSaveAccountDataRejectsServerManagedTypes(t *testing.T) {
+	d, cleanup := newDeactivateTest(t)
+	defer cleanup()
+	d.room.cfg.Matrix.MaxAccountDataSizeBytes = 100
+
+	code, res := d.saveAccountData(testRoomID, "m.fully_read", `{"event_id":"$event:localhost"}`)
+	if code != http.StatusMethodNotAllowed || !strings.Contains(res.(error).Error(), "M_BAD_JSON") {
+		t.Errorf("expected 405 M_BAD_JSON, got %d: %v", code, res)
+	}
+	if data, err := d.accountDB.GetAccountDataByType(context.Background(), "alice", testRoomID, "m.fully_read"); err != nil || data != nil {
+		t.Errorf("expected m.fully_read not to be saved, got %v, %v", data, err)
+	}
+	if code, res = d.saveAccountData("", "m.push_rules", `{}`); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for m.push_rules, got %d: %v", code, res)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type shutdownRoomRequest struct {
+	// Whether to delete the room from the roomserver and sync API.
+	Purge bool `json:"purge"`
+	// If set, a replacement room is created by this local user, and the
+	// users removed from the room are joined to it.
+	NewRoomUserID string `json:"new_room_user_id,omitempty"`
+	RoomName      string `json:"room_name,omitempty"`
+	Message       string `json:"message,omitempty"`
+}
+
+type shutdownRoomResponse struct {
+	KickedUsers []string `json:"kicked_users"`
+	NewRoomID   string   `json:"new_room_id,omitempty"`
+}
+
+const (
+	defaultShutdownRoomName = "Content Violation Notification"
+	defaultShutdownMessage  = "Sharing illegal content on this server is not permitted and rooms in violation will be blocked."
+)
+
+// ShutdownRoom implements POST /_dendrite/admin/v1/rooms/{roomID}/shutdown
+// It makes every local user leave the room and blocks the room, so that
+// nobody can join it again. Shutting down a room again only removes the
+// local users who are still in it, so the request can be retried.
+func ShutdownRoom(
+	req *http.Request, device *authtypes.Device, roomID string,
+	cfg *config.Dendrite, producer *producers.RoomserverProducer,
+	queryAPI api.RoomserverQueryAPI, accountDB accounts.Database,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	var r shutdownRoomRequest
+	if req.ContentLength != 0 {
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+	}
+	if r.NewRoomUserID != "" {
+		if _, resErr := adminLookupAccount(req, r.NewRoomUserID, cfg, accountDB); resErr != nil {
+			return *resErr
+		}
+	}
+
+	// The room is blocked before the users are removed from it, so that
+	// nobody can join it in the meantime.
+	if err := producer.InputAPI.ShutdownRoom(req.Context(), &api.ShutdownRoomRequest{RoomID: roomID}, &api.ShutdownRoomResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("producer.InputAPI.ShutdownRoom failed")
+		return jsonerror.InternalServerError()
+	}
+
+	members, err := localMembersOfRoom(req.Context(), roomID, cfg, queryAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("localMembersOfRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	res := shutdownRoomResponse{KickedUsers: []string{}}
+
+	// The replacement room is only created if there are users to move into it.
+	if r.NewRoomUserID != "" && len(members) > 0 {
+		var events []gomatrixserverlib.HeaderedEvent
+		res.NewRoomID, events, err = buildReplacementRoom(&r, members, cfg)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("buildReplacementRoom failed")
+			return jsonerror.InternalServerError()
+		}
+		if _, err = producer.SendEvents(req.Context(), events, cfg.Matrix.ServerName, nil); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	evTime := time.Now()
+	for _, userID := range members {
+		stateKey := userID
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   userID,
+			RoomID:   roomID,
+			Type:     gomatrixserverlib.MRoomMember,
+			StateKey: &stateKey,
+		}
+		if err = builder.SetContent(gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Leave}); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
+			return jsonerror.InternalServerError()
+		}
+		var queryRes api.QueryLatestEventsAndStateResponse
+		var event *gomatrixserverlib.Event
+		if event, err = common.BuildEvent(req.Context(), &builder, cfg, evTime, queryAPI, &queryRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("common.BuildEvent failed")
+			return jsonerror.InternalServerError()
+		}
+		if _, err = producer.SendEvents(
+			req.Context(), []gomatrixserverlib.HeaderedEvent{event.Headered(queryRes.RoomVersion)},
+			cfg.Matrix.ServerName, nil,
+		); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
+			return jsonerror.InternalServerError()
+		}
+		res.KickedUsers = append(res.KickedUsers, userID)
+	}
+
+	if r.Purge {
+		if err = producer.InputAPI.ShutdownRoom(req.Context(), &api.ShutdownRoomRequest{RoomID: roomID, Purge: true}, &api.ShutdownRoomResponse{}); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("producer.InputAPI.ShutdownRoom failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// localMembersOfRoom returns the local users who are joined to a room, in
+// order of user ID.
+func localMembersOfRoom(
+	ctx context.Context, roomID string, cfg *config.Dendrite, queryAPI api.RoomserverQueryAPI,
+) ([]string, error) {
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{RoomID: roomID}, &stateRes); err != nil {
+		return nil, err
+	}
+	var members []string
+	for _, ev := range stateRes.StateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+			continue
+		}
+		membership, err := ev.Membership()
+		if err != nil || membership != gomatrixserverlib.Join {
+			continue
+		}
+		_, domain, err := gomatrixserverlib.SplitID('@', *ev.StateKey())
+		if err == nil && domain == cfg.Matrix.ServerName {
+			members = append(members, *ev.StateKey())
+		}
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// buildReplacementRoom builds the events which create a room for the users
+// removed from a room which has been shut down. Only the user creating the
+// room may send messages into it.
+func buildReplacementRoom(
+	r *shutdownRoomRequest, members []string, cfg *config.Dendrite,
+) (string, []gomatrixserverlib.HeaderedEvent, error) {
+	name, message := r.RoomName, r.Message
+	if name == "" {
+		name = defaultShutdownRoomName
+	}
+	if message == "" {
+		message = defaultShutdownMessage
+	}
+
+	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
+	roomVersion := roomserverVersion.DefaultRoomVersion()
+	powerLevels := common.InitialPowerLevelsContent(r.NewRoomUserID)
+	powerLevels.EventsDefault = 100
+
+	b := newRoomEventsBuilder(roomID, cfg, time.Now(), roomVersion)
+	for _, e := range []fledglingEvent{
+		{"m.room.create", "", map[string]interface{}{"creator": r.NewRoomUserID, "room_version": roomVersion}},
+		{"m.room.member", r.NewRoomUserID, gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join}},
+		{"m.room.power_levels", "", powerLevels},
+		{"m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: gomatrixserverlib.Public}},
+		{"m.room.history_visibility", "", common.HistoryVisibilityContent{HistoryVisibility: historyVisibilityShared}},
+		{"m.room.name", "", common.NameContent{Name: name}},
+	} {
+		if err := b.add(r.NewRoomUserID, e); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := b.addEvent(r.NewRoomUserID, "m.room.message", nil, map[string]interface{}{
+		"msgtype": "m.text", "body": message,
+	}); err != nil {
+		return "", nil, err
+	}
+	for _, userID := range members {
+		if userID == r.NewRoomUserID {
+			continue
+		}
+		if err := b.add(userID, fledglingEvent{"m.room.member", userID, gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join}}); err != nil {
+			return "", nil, err
+		}
+	}
+	return roomID, b.events, nil
+}
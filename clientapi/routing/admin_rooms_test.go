@@ -0,0 +1,138 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func (r *testRoom) ShutdownRoom(
+	ctx context.Context,
+	request *api.ShutdownRoomRequest,
+	response *api.ShutdownRoomResponse,
+) error {
+	r.blocked = true
+	return nil
+}
+
+func (r *testRoom) QueryRoomBlocked(
+	ctx context.Context,
+	request *api.QueryRoomBlockedRequest,
+	response *api.QueryRoomBlockedResponse,
+) error {
+	response.Blocked = r.blocked
+	return nil
+}
+
+func (d *deactivateTest) shutdownRoom(userID, body string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/v1/rooms/"+testRoomID+"/shutdown", strings.NewReader(body))
+	res := ShutdownRoom(
+		req, &authtypes.Device{UserID: userID}, testRoomID, d.room.cfg,
+		producers.NewRoomserverProducer(d.room, d.room), d.room, d.accountDB,
+	)
+	return res.Code, res.JSON
+}
+
+// memberships returns the memberships of the member events sent into a room,
+// by user ID.
+func (r *testRoom) memberships(roomID string) map[string]string {
+	memberships := make(map[string]string)
+	for _, ev := range r.sent {
+		if ev.RoomID() != roomID || ev.Type() != gomatrixserverlib.MRoomMember {
+			continue
+		}
+		var content gomatrixserverlib.MemberContent
+		if err := json.Unmarshal(ev.Content(), &content); err != nil {
+			r.t.Fatal(err)
+		}
+		memberships[*ev.StateKey()] = content.Membership
+	}
+	return memberships
+}
+
+func TestShutdownRoomRemovesLocalMembers(t *testing.T) {
+	d, cleanup := newAdminUsersTest(t)
+	defer cleanup()
+	d.room.join("@bob:localhost")
+	d.room.join("@eve:remote.example.com")
+
+	code, body := d.shutdownRoom("@admin:localhost", `{"new_room_user_id": "@admin:localhost"}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	res := body.(shutdownRoomResponse)
+	if expected := []string{"@alice:localhost", "@bob:localhost"}; !reflect.DeepEqual(res.KickedUsers, expected) {
+		t.Errorf("expected %v to be removed, got %v", expected, res.KickedUsers)
+	}
+	expected := map[string]string{"@alice:localhost": gomatrixserverlib.Leave, "@bob:localhost": gomatrixserverlib.Leave}
+	if left := d.room.memberships(testRoomID); !reflect.DeepEqual(left, expected) {
+		t.Errorf("expected only the local members to leave, got %v", left)
+	}
+	if !d.room.blocked {
+		t.Errorf("expected the room to be blocked")
+	}
+
+	if res.NewRoomID == "" {
+		t.Fatalf("expected a replacement room to be created")
+	}
+	expected = map[string]string{"@admin:localhost": gomatrixserverlib.Join, "@alice:localhost": gomatrixserverlib.Join, "@bob:localhost": gomatrixserverlib.Join}
+	if joined := d.room.memberships(res.NewRoomID); !reflect.DeepEqual(joined, expected) {
+		t.Errorf("expected the removed users to join the replacement room, got %v", joined)
+	}
+}
+
+func TestShutdownRoomIsUnjoinable(t *testing.T) {
+	d, cleanup := newAdminUsersTest(t)
+	defer cleanup()
+	if code, body := d.shutdownRoom("@admin:localhost", `{"purge": true}`); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+
+	sent := len(d.room.sent)
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/join/"+testRoomID, strings.NewReader("{}"))
+	res := JoinRoomByIDOrAlias(
+		req, d.device, testRoomID, d.room.cfg, nil, producers.NewRoomserverProducer(d.room, d.room),
+		d.room, nil, gomatrixserverlib.KeyRing{}, d.accountDB,
+		&producers.SyncAPIProducer{Producer: testSyncProducer{}},
+	)
+	if res.Code != http.StatusForbidden {
+		t.Errorf("expected 403 when joining a room which has been shut down, got %d: %v", res.Code, res.JSON)
+	}
+	if len(d.room.sent) != sent {
+		t.Errorf("expected no join event to be sent")
+	}
+}
+
+func TestShutdownRoomForbiddenForNormalUsers(t *testing.T) {
+	d, cleanup := newAdminUsersTest(t)
+	defer cleanup()
+	if code, body := d.shutdownRoom(d.device.UserID, `{}`); code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d: %v", code, body)
+	}
+	if d.room.blocked || len(d.room.sent) != 0 {
+		t.Errorf("expected the room to be left alone")
+	}
+}
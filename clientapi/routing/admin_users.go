@@ -0,0 +1,206 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultAdminUsersLimit = 100
+	maxAdminUsersLimit     = 1000
+)
+
+type adminUserJSON struct {
+	UserID       string `json:"user_id"`
+	Admin        bool   `json:"admin"`
+	Deactivated  bool   `json:"deactivated"`
+	CreationTS   int64  `json:"creation_ts"`
+	AppServiceID string `json:"appservice_id,omitempty"`
+}
+
+type adminUsersResponse struct {
+	Users []adminUserJSON `json:"users"`
+	// The token to pass as from to get the next page, if there is one.
+	NextToken string `json:"next_token,omitempty"`
+}
+
+type adminDeviceJSON struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+type adminUserInfoResponse struct {
+	adminUserJSON
+	Devices []adminDeviceJSON `json:"devices"`
+}
+
+type adminUserRoomsResponse struct {
+	JoinedRooms []string `json:"joined_rooms"`
+	Total       int      `json:"total"`
+}
+
+func newAdminUserJSON(acc *authtypes.Account, cfg *config.Dendrite) adminUserJSON {
+	return adminUserJSON{
+		UserID:       acc.UserID,
+		Admin:        cfg.IsServerAdmin(acc.UserID),
+		Deactivated:  acc.Deactivated,
+		CreationTS:   acc.CreatedTS,
+		AppServiceID: acc.AppServiceID,
+	}
+}
+
+// ListUsers implements GET /_dendrite/admin/v1/users
+// The users are ordered by localpart. The page starts after the localpart
+// given as from, and the users can be filtered by a part of their localpart
+// given as name.
+func ListUsers(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite,
+	accountDB accounts.Database,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	query := req.URL.Query()
+	limit := defaultAdminUsersLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+	}
+	if limit > maxAdminUsersLimit {
+		limit = maxAdminUsersLimit
+	}
+
+	// One more account than is returned is fetched to tell whether there is
+	// another page.
+	accs, err := accountDB.GetAccounts(req.Context(), query.Get("from"), query.Get("name"), limit+1)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccounts failed")
+		return jsonerror.InternalServerError()
+	}
+	res := adminUsersResponse{Users: []adminUserJSON{}}
+	if len(accs) > limit {
+		accs = accs[:limit]
+		res.NextToken = accs[limit-1].Localpart
+	}
+	for i := range accs {
+		res.Users = append(res.Users, newAdminUserJSON(&accs[i], cfg))
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// GetUserInfo implements GET /_dendrite/admin/v1/users/{userID}
+func GetUserInfo(
+	req *http.Request, device *authtypes.Device, userID string,
+	cfg *config.Dendrite, accountDB accounts.Database, deviceDB devices.Database,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	acc, resErr := adminLookupAccount(req, userID, cfg, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	devs, err := deviceDB.GetDevicesByLocalpart(req.Context(), acc.Localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.GetDevicesByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	res := adminUserInfoResponse{adminUserJSON: newAdminUserJSON(acc, cfg), Devices: []adminDeviceJSON{}}
+	for _, dev := range devs {
+		res.Devices = append(res.Devices, adminDeviceJSON{DeviceID: dev.ID, DisplayName: dev.DisplayName})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// GetUserJoinedRooms implements GET /_dendrite/admin/v1/users/{userID}/joined_rooms
+func GetUserJoinedRooms(
+	req *http.Request, device *authtypes.Device, userID string,
+	cfg *config.Dendrite, accountDB accounts.Database,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	acc, resErr := adminLookupAccount(req, userID, cfg, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	roomIDs, err := accountDB.GetRoomIDsByLocalPart(req.Context(), acc.Localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRoomIDsByLocalPart failed")
+		return jsonerror.InternalServerError()
+	}
+	if roomIDs == nil {
+		roomIDs = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminUserRoomsResponse{JoinedRooms: roomIDs, Total: len(roomIDs)},
+	}
+}
+
+// adminLookupAccount returns the account of a local user, or an error
+// response if the user isn't local or doesn't exist.
+func adminLookupAccount(
+	req *http.Request, userID string, cfg *config.Dendrite, accountDB accounts.Database,
+) (*authtypes.Account, *util.JSONResponse) {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Can only look up local users"),
+		}
+	}
+	acc, err := accountDB.GetAccountByLocalpart(req.Context(), localpart)
+	if err == sql.ErrNoRows {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown user"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	return acc, nil
+}
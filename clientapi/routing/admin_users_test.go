@@ -0,0 +1,139 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+)
+
+// newAdminUsersTest sets up alice's test accounts, with @admin:localhost as a
+// server admin and a few more users to page through.
+func newAdminUsersTest(t *testing.T) (*deactivateTest, func()) {
+	d, cleanup := newDeactivateTest(t)
+	d.room.cfg.Matrix.AdminUsers = []string{"@admin:localhost"}
+	for _, localpart := range []string{"admin", "bob", "carol", "dave"} {
+		if _, err := d.accountDB.CreateAccount(context.Background(), localpart, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.accountDB.DeactivateAccount(context.Background(), "dave"); err != nil {
+		t.Fatal(err)
+	}
+	return d, cleanup
+}
+
+func (d *deactivateTest) listUsers(userID, query string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodGet, "/_dendrite/admin/v1/users?"+query, nil)
+	res := ListUsers(req, &authtypes.Device{UserID: userID}, d.room.cfg, d.accountDB)
+	return res.Code, res.JSON
+}
+
+func TestListUsersPaginates(t *testing.T) {
+	d, cleanup := newAdminUsersTest(t)
+	defer cleanup()
+
+	var userIDs []string
+	var pages int
+	for from := ""; ; pages++ {
+		code, body := d.listUsers("@admin:localhost", "limit=2&from="+from)
+		if code != http.StatusOK {
+			t.Fatalf("expected 200 OK, got %d: %v", code, body)
+		}
+		res := body.(adminUsersResponse)
+		for _, user := range res.Users {
+			userIDs = append(userIDs, user.UserID)
+			if user.Admin != (user.UserID == "@admin:localhost") || user.Deactivated != (user.UserID == "@dave:localhost") {
+				t.Errorf("unexpected admin or deactivated status for %s: %+v", user.UserID, user)
+			}
+			if user.CreationTS == 0 {
+				t.Errorf("expected a creation time for %s", user.UserID)
+			}
+		}
+		if res.NextToken == "" {
+			break
+		}
+		from = res.NextToken
+	}
+	expected := []string{"@admin:localhost", "@alice:localhost", "@bob:localhost", "@carol:localhost", "@dave:localhost"}
+	if !reflect.DeepEqual(userIDs, expected) || pages != 2 {
+		t.Errorf("expected %v over three pages, got %v over %d", expected, userIDs, pages+1)
+	}
+
+	code, body := d.listUsers("@admin:localhost", "name=ar")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	if users := body.(adminUsersResponse).Users; len(users) != 1 || users[0].UserID != "@carol:localhost" {
+		t.Errorf("expected only carol to match the name filter, got %v", users)
+	}
+}
+
+func TestAdminUserInfo(t *testing.T) {
+	d, cleanup := newAdminUsersTest(t)
+	defer cleanup()
+
+	req := httptest.NewRequest(http.MethodGet, "/_dendrite/admin/v1/users/@alice:localhost", nil)
+	res := GetUserInfo(req, &authtypes.Device{UserID: "@admin:localhost"}, "@alice:localhost", d.room.cfg, d.accountDB, d.deviceDB)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	if devs := res.JSON.(adminUserInfoResponse).Devices; len(devs) != 1 || devs[0].DeviceID != d.device.ID {
+		t.Errorf("expected the device of alice, got %v", devs)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/v1/users/@alice:localhost/joined_rooms", nil)
+	res = GetUserJoinedRooms(req, &authtypes.Device{UserID: "@admin:localhost"}, "@alice:localhost", d.room.cfg, d.accountDB)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	if rooms := res.JSON.(adminUserRoomsResponse).JoinedRooms; !reflect.DeepEqual(rooms, []string{testRoomID}) {
+		t.Errorf("expected alice to be in %s, got %v", testRoomID, rooms)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/v1/users/@nobody:localhost", nil)
+	if res = GetUserInfo(req, &authtypes.Device{UserID: "@admin:localhost"}, "@nobody:localhost", d.room.cfg, d.accountDB, d.deviceDB); res.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown user, got %d: %v", res.Code, res.JSON)
+	}
+}
+
+func TestAdminUsersForbiddenForNormalUsers(t *testing.T) {
+	d, cleanup := newAdminUsersTest(t)
+	defer cleanup()
+
+	expectForbidden := func(name string, code int, body interface{}) {
+		if code != http.StatusForbidden {
+			t.Errorf("expected 403 for %s, got %d: %v", name, code, body)
+		} else if errCode := body.(*jsonerror.MatrixError).ErrCode; errCode != "M_FORBIDDEN" {
+			t.Errorf("expected M_FORBIDDEN for %s, got %s", name, errCode)
+		}
+	}
+	code, body := d.listUsers(d.device.UserID, "")
+	expectForbidden("listing users", code, body)
+
+	req := httptest.NewRequest(http.MethodGet, "/_dendrite/admin/v1/users/@bob:localhost", nil)
+	res := GetUserInfo(req, d.device, "@bob:localhost", d.room.cfg, d.accountDB, d.deviceDB)
+	expectForbidden("user info", res.Code, res.JSON)
+
+	req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/v1/users/@bob:localhost/joined_rooms", nil)
+	res = GetUserJoinedRooms(req, d.device, "@bob:localhost", d.room.cfg, d.accountDB)
+	expectForbidden("joined rooms", res.Code, res.JSON)
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type roomAliasesResponse struct {
+	Aliases []string `json:"aliases"`
+}
+
+// GetAliases implements GET /rooms/{roomId}/aliases
+// It returns the local aliases of the room. They can only be listed by users
+// in the room, unless the room is world readable.
+func GetAliases(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID string,
+	cfg *config.Dendrite,
+	queryAPI api.RoomserverQueryAPI,
+	aliasAPI api.RoomserverAliasAPI,
+) util.JSONResponse {
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: device.UserID},
+			{EventType: "m.room.history_visibility", StateKey: ""},
+		},
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(req.Context(), &stateReq, &stateRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryLatestEventsAndState failed")
+		return jsonerror.InternalServerError()
+	}
+
+	visible := false
+	for _, ev := range stateRes.StateEvents {
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomMember:
+			membership, err := ev.Membership()
+			visible = visible || (err == nil && membership == gomatrixserverlib.Join)
+		case "m.room.history_visibility":
+			var content common.HistoryVisibilityContent
+			err := json.Unmarshal(ev.Content(), &content)
+			visible = visible || (err == nil && content.HistoryVisibility == "world_readable")
+		}
+	}
+	if !stateRes.RoomExists || !visible {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room."),
+		}
+	}
+
+	aliasesReq := api.GetAliasesForRoomIDRequest{RoomID: roomID}
+	var aliasesRes api.GetAliasesForRoomIDResponse
+	if err := aliasAPI.GetAliasesForRoomID(req.Context(), &aliasesReq, &aliasesRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.GetAliasesForRoomID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := roomAliasesResponse{Aliases: []string{}}
+	for _, alias := range aliasesRes.Aliases {
+		if _, domain, err := gomatrixserverlib.SplitID('#', alias); err == nil && domain == cfg.Matrix.ServerName {
+			res.Aliases = append(res.Aliases, alias)
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
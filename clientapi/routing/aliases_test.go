@@ -0,0 +1,74 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// testAliases answers alias queries for the test room.
+type testAliases struct {
+	api.RoomserverAliasAPI
+}
+
+func (a testAliases) GetAliasesForRoomID(
+	ctx context.Context,
+	request *api.GetAliasesForRoomIDRequest,
+	response *api.GetAliasesForRoomIDResponse,
+) error {
+	if request.RoomID == testRoomID {
+		response.Aliases = []string{"#old:localhost", "#old:remote.example.com", "#legacy:localhost"}
+	}
+	return nil
+}
+
+func getAliases(room *testRoom, userID string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/"+testRoomID+"/aliases", nil)
+	res := GetAliases(req, &authtypes.Device{UserID: userID}, testRoomID, room.cfg, room, testAliases{})
+	return res.Code, res.JSON
+}
+
+func TestGetAliasesListsLocalAliases(t *testing.T) {
+	room := newTestRoom(t)
+	code, res := getAliases(room, "@alice:localhost")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	expected := []string{"#old:localhost", "#legacy:localhost"}
+	if aliases := res.(roomAliasesResponse).Aliases; !reflect.DeepEqual(aliases, expected) {
+		t.Errorf("expected aliases %v, got %v", expected, aliases)
+	}
+}
+
+func TestGetAliasesRequiresMembership(t *testing.T) {
+	room := newTestRoom(t)
+	if code, res := getAliases(room, "@bob:localhost"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a user who isn't in the room, got %d: %v", code, res)
+	}
+
+	// Anyone can list the aliases of world readable rooms.
+	room.addState("@alice:localhost", "m.room.history_visibility", "", common.HistoryVisibilityContent{HistoryVisibility: "world_readable"})
+	if code, res := getAliases(room, "@bob:localhost"); code != http.StatusOK {
+		t.Errorf("expected 200 OK for a world readable room, got %d: %v", code, res)
+	}
+}
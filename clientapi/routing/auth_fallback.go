@@ -111,6 +111,12 @@ func AuthFallback(
 			http.StatusBadRequest,
 		)
 	}
+	if !sessions.hasSession(sessionID) {
+		return writeHTTPMessage(w, req,
+			"Unknown or expired session",
+			http.StatusBadRequest,
+		)
+	}
 
 	serveRecaptcha := func() {
 		data := map[string]string{
@@ -162,7 +168,7 @@ func AuthFallback(
 			}
 
 			// Success. Add recaptcha as a completed login flow
-			AddCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
+			sessions.addCompletedStage(sessionID, authtypes.LoginTypeRecaptcha)
 
 			serveSuccess()
 			return nil
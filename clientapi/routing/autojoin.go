@@ -0,0 +1,85 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// autoJoiner joins new users to the rooms in the auto_join_rooms config once
+// their account has been created.
+type autoJoiner struct {
+	cfg          *config.Dendrite
+	federation   *gomatrixserverlib.FederationClient
+	producer     *producers.RoomserverProducer
+	queryAPI     roomserverAPI.RoomserverQueryAPI
+	aliasAPI     roomserverAPI.RoomserverAliasAPI
+	keyRing      gomatrixserverlib.KeyRing
+	accountDB    accounts.Database
+	syncProducer *producers.SyncAPIProducer
+}
+
+// joinRooms joins the user to each of the auto_join_rooms in turn. Rooms
+// which can't be joined, such as ones which don't exist, are logged and
+// skipped, so that they don't stop the user from registering. A nil
+// autoJoiner joins no rooms.
+func (j *autoJoiner) joinRooms(req *http.Request, userID string) {
+	if j == nil || len(j.cfg.Matrix.AutoJoinRooms) == 0 {
+		return
+	}
+	logger := util.GetLogger(req.Context()).WithField("user_id", userID)
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		logger.WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return
+	}
+	profile, err := j.accountDB.GetProfileByLocalpart(req.Context(), localpart)
+	if err != nil {
+		logger.WithError(err).Error("accountDB.GetProfileByLocalpart failed")
+		return
+	}
+	for _, roomIDOrAlias := range j.cfg.Matrix.AutoJoinRooms {
+		content := map[string]interface{}{
+			"membership":  gomatrixserverlib.Join,
+			"displayname": profile.DisplayName,
+			"avatar_url":  profile.AvatarURL,
+		}
+		r := joinRoomReq{
+			req, time.Now(), content, &authtypes.Device{UserID: userID}, j.cfg, j.federation,
+			j.producer, j.queryAPI, j.aliasAPI, j.keyRing, j.accountDB, j.syncProducer, nil,
+		}
+		var res util.JSONResponse
+		if strings.HasPrefix(roomIDOrAlias, "#") {
+			res = r.joinRoomByAlias(roomIDOrAlias)
+		} else {
+			res = r.joinRoomByID(roomIDOrAlias)
+		}
+		if res.Code != http.StatusOK {
+			logger.WithField("room", roomIDOrAlias).WithField("code", res.Code).Warnf(
+				"Failed to join the new user to an auto-join room: %v", res.JSON,
+			)
+		}
+	}
+}
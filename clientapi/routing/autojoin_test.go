@@ -0,0 +1,77 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// useAutoJoin joins users who register or log in with SSO to the rooms in
+// the auto_join_rooms of the test config. All aliases are unknown.
+func (d *deactivateTest) useAutoJoin(roomIDOrAliases ...string) {
+	d.room.cfg.Matrix.AutoJoinRooms = roomIDOrAliases
+	d.autoJoin = &autoJoiner{
+		d.room.cfg, nil, producers.NewRoomserverProducer(d.room, d.room), d.room, testAliases{},
+		gomatrixserverlib.KeyRing{}, d.accountDB, &producers.SyncAPIProducer{Producer: testSyncProducer{}},
+	}
+}
+
+// newAutoJoinTest sets up registration with a dummy stage, where new users
+// are joined to an alias which doesn't exist and then to the test room.
+func newAutoJoinTest(t *testing.T) (*deactivateTest, func()) {
+	d, cleanup := newDeactivateTest(t)
+	d.useAutoJoin("#missing:localhost", testRoomID)
+	if err := d.room.cfg.Derive(); err != nil {
+		t.Fatal(err)
+	}
+	return d, cleanup
+}
+
+func TestRegisteredUsersAreAutoJoined(t *testing.T) {
+	d, cleanup := newAutoJoinTest(t)
+	defer cleanup()
+
+	code, body := d.register("bob", `{"type": "m.login.dummy"}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected registration to succeed despite the missing room, got %d: %v", code, body)
+	}
+	if membership := d.room.memberships(testRoomID)["@bob:localhost"]; membership != gomatrixserverlib.Join {
+		t.Errorf("expected bob to be joined to the test room, got %q", membership)
+	}
+	if len(d.room.sent) != 1 {
+		t.Errorf("expected only the join to the test room to be sent, got %d events", len(d.room.sent))
+	}
+}
+
+func TestSSOUsersAreOnlyAutoJoinedIfConfigured(t *testing.T) {
+	d, p, cleanup := newSSOTest(t)
+	defer cleanup()
+	d.useAutoJoin(testRoomID)
+
+	loginToken(t, d.ssoLogin(t, p, map[string]interface{}{"sub": "1234", "preferred_username": "bob"}))
+	if memberships := d.room.memberships(testRoomID); len(memberships) != 0 {
+		t.Errorf("expected nobody to be joined while SSO auto-joining is off, got %v", memberships)
+	}
+
+	d.room.cfg.Matrix.SSO.AutoJoinRooms = true
+	loginToken(t, d.ssoLogin(t, p, map[string]interface{}{"sub": "5678", "preferred_username": "carol"}))
+	if membership := d.room.memberships(testRoomID)["@carol:localhost"]; membership != gomatrixserverlib.Join {
+		t.Errorf("expected carol to be joined to the test room, got %q", membership)
+	}
+}
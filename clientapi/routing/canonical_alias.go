@@ -0,0 +1,99 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// checkCanonicalAlias returns an error response unless the alias and the
+// alternative aliases which the content of an m.room.canonical_alias event
+// sets are valid aliases which point to the room. Aliases on other servers are
+// looked up with a federation directory query.
+func checkCanonicalAlias(
+	req *http.Request, roomID string, content map[string]interface{},
+	cfg *config.Dendrite, federation *gomatrixserverlib.FederationClient,
+	aliasAPI api.RoomserverAliasAPI,
+) *util.JSONResponse {
+	var canonical common.CanonicalAliasContent
+	raw, err := json.Marshal(content)
+	if err == nil {
+		err = json.Unmarshal(raw, &canonical)
+	}
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("alias must be an alias and alt_aliases a list of aliases"),
+		}
+	}
+	aliases := canonical.AltAliases
+	if canonical.Alias != "" {
+		aliases = append([]string{canonical.Alias}, aliases...)
+	}
+
+	for _, alias := range aliases {
+		var domain gomatrixserverlib.ServerName
+		if _, domain, err = gomatrixserverlib.SplitID('#', alias); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam(fmt.Sprintf("%s isn't a valid alias", alias)),
+			}
+		}
+		var aliasRoomID string
+		if domain == cfg.Matrix.ServerName {
+			queryReq := api.GetRoomIDForAliasRequest{Alias: alias}
+			var queryRes api.GetRoomIDForAliasResponse
+			if err = aliasAPI.GetRoomIDForAlias(req.Context(), &queryReq, &queryRes); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.GetRoomIDForAlias failed")
+				resErr := jsonerror.InternalServerError()
+				return &resErr
+			}
+			aliasRoomID = queryRes.RoomID
+		} else {
+			if federation == nil || !cfg.IsFederationAllowed(domain) {
+				return &util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.BadAlias(fmt.Sprintf("%s can't be checked, as this server doesn't federate with %s", alias, domain)),
+				}
+			}
+			fedRes, fedErr := federation.LookupRoomAlias(req.Context(), domain, alias)
+			if x, ok := fedErr.(gomatrix.HTTPError); ok && x.Code == http.StatusNotFound {
+				fedRes.RoomID = ""
+			} else if fedErr != nil {
+				util.GetLogger(req.Context()).WithError(fedErr).Error("federation.LookupRoomAlias failed")
+				resErr := jsonerror.InternalServerError()
+				return &resErr
+			}
+			aliasRoomID = fedRes.RoomID
+		}
+		if aliasRoomID != roomID {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadAlias(fmt.Sprintf("%s doesn't point to the room", alias)),
+			}
+		}
+	}
+	return nil
+}
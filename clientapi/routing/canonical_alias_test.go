@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+)
+
+// remoteRoomAliases is the directory of remote.example.com, which the
+// federation client given to SendEvent looks remote aliases up in.
+var remoteRoomAliases = map[string]string{
+	"#old:remote.example.com":   testRoomID,
+	"#other:remote.example.com": "!other:remote.example.com",
+}
+
+func (r *testRoom) setCanonicalAlias(content common.CanonicalAliasContent) (int, interface{}) {
+	body, err := json.Marshal(content)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	stateKey := ""
+	federation := newTestFederationClient(r.cfg, &testFederationPeer{handler: func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/_matrix/federation/v1/query/directory" {
+			r.t.Errorf("unexpected request %s", req.URL)
+		}
+		roomID, ok := remoteRoomAliases[req.URL.Query().Get("room_alias")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Room alias not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"room_id": roomID, "servers": []string{"remote.example.com"},
+		})
+	}})
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/client/r0/rooms/"+testRoomID+"/state/m.room.canonical_alias/", strings.NewReader(string(body)))
+	res := SendEvent(
+		req, &authtypes.Device{UserID: "@alice:localhost"}, testRoomID, "m.room.canonical_alias", nil, &stateKey,
+		r.cfg, federation, r, testAliases{}, producers.NewRoomserverProducer(r, r), nil,
+	)
+	return res.Code, res.JSON
+}
+
+func TestSetCanonicalAliasOfRoom(t *testing.T) {
+	room := newTestRoom(t)
+	for _, content := range []common.CanonicalAliasContent{
+		{Alias: "#old:localhost"},
+		{Alias: "#old:localhost", AltAliases: []string{"#legacy:localhost", "#old:remote.example.com"}},
+		{},
+	} {
+		if code, res := room.setCanonicalAlias(content); code != http.StatusOK {
+			t.Errorf("expected 200 OK for %+v, got %d: %v", content, code, res)
+		}
+	}
+}
+
+func TestSetCanonicalAliasOfOtherRoomFails(t *testing.T) {
+	room := newTestRoom(t)
+	before := len(room.sent)
+	for name, content := range map[string]common.CanonicalAliasContent{
+		"an alias of another room":           {Alias: "#other:localhost"},
+		"an alias which doesn't exist":       {Alias: "#nonexistent:localhost"},
+		"an alternative alias":               {Alias: "#old:localhost", AltAliases: []string{"#other:localhost"}},
+		"a remote alias of another room":     {Alias: "#other:remote.example.com"},
+		"a remote alias which doesn't exist": {AltAliases: []string{"#nonexistent:remote.example.com"}},
+	} {
+		code, res := room.setCanonicalAlias(content)
+		if code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d: %v", name, code, res)
+		} else if errCode := res.(*jsonerror.MatrixError).ErrCode; errCode != "M_BAD_ALIAS" {
+			t.Errorf("expected M_BAD_ALIAS for %s, got %s", name, errCode)
+		}
+	}
+	if code, res := room.setCanonicalAlias(common.CanonicalAliasContent{Alias: "old"}); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid alias, got %d: %v", code, res)
+	}
+	if len(room.sent) != before {
+		t.Errorf("expected no canonical alias events to be sent, got %v", room.sent[before:])
+	}
+}
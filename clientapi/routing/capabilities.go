@@ -17,16 +17,22 @@ package routing
 import (
 	"net/http"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
-
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
-// SendMembership implements PUT /rooms/{roomID}/(join|kick|ban|unban|leave|invite)
-// by building a m.room.member event then sending it to the room server
+// GetCapabilities implements GET /capabilities
+// See: https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-capabilities
+// The room versions are those that the roomserver supports, so that clients
+// don't try to create rooms with versions it can't handle. Users can only
+// change their password if they log in with one.
 func GetCapabilities(
-	req *http.Request, queryAPI roomserverAPI.RoomserverQueryAPI,
+	req *http.Request, device *authtypes.Device,
+	queryAPI roomserverAPI.RoomserverQueryAPI, accountDB accounts.Database,
 ) util.JSONResponse {
 	roomVersionsQueryReq := roomserverAPI.QueryRoomVersionCapabilitiesRequest{}
 	roomVersionsQueryRes := roomserverAPI.QueryRoomVersionCapabilitiesResponse{}
@@ -39,10 +45,26 @@ func GetCapabilities(
 		return jsonerror.InternalServerError()
 	}
 
+	// Guests don't have a password to change.
+	canChangePassword := false
+	if !device.IsGuest {
+		localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			return jsonerror.InternalServerError()
+		}
+		if canChangePassword, err = accountDB.HasPassword(req.Context(), localpart); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.HasPassword failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	capabilities := map[string]interface{}{
+		"m.change_password": map[string]interface{}{"enabled": canChangePassword},
+		"m.room_versions":   roomVersionsQueryRes,
+	}
 	response := map[string]interface{}{
-		"capabilities": map[string]interface{}{
-			"m.room_versions": roomVersionsQueryRes,
-		},
+		"capabilities": capabilities,
 	}
 
 	return util.JSONResponse{
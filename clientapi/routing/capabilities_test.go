@@ -0,0 +1,107 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/roomserver/query"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type capabilitiesResponse struct {
+	Capabilities struct {
+		ChangePassword struct {
+			Enabled bool `json:"enabled"`
+		} `json:"m.change_password"`
+		RoomVersions struct {
+			Default   gomatrixserverlib.RoomVersion            `json:"default"`
+			Available map[gomatrixserverlib.RoomVersion]string `json:"available"`
+		} `json:"m.room_versions"`
+	} `json:"capabilities"`
+}
+
+func getCapabilities(t *testing.T, accountDB accounts.Database, device *authtypes.Device) capabilitiesResponse {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/capabilities", nil)
+	res := GetCapabilities(req, device, &query.RoomserverQueryAPI{}, accountDB)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	resJSON, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var capabilities capabilitiesResponse
+	if err = json.Unmarshal(resJSON, &capabilities); err != nil {
+		t.Fatal(err)
+	}
+	return capabilities
+}
+
+func TestCapabilitiesRoomVersions(t *testing.T) {
+	_, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+	versions := getCapabilities(t, accountDB, &authtypes.Device{UserID: "@alice:localhost"}).Capabilities.RoomVersions
+
+	if versions.Default != version.DefaultRoomVersion() {
+		t.Errorf("expected default room version %s, got %s", version.DefaultRoomVersion(), versions.Default)
+	}
+	if _, ok := versions.Available[versions.Default]; !ok {
+		t.Errorf("expected the default room version to be available, got %v", versions.Available)
+	}
+	supported := version.SupportedRoomVersions()
+	if len(versions.Available) != len(supported) {
+		t.Errorf("expected %d available room versions, got %v", len(supported), versions.Available)
+	}
+	for v, desc := range version.RoomVersions() {
+		stability, ok := versions.Available[v]
+		switch {
+		case !desc.Supported && ok:
+			t.Errorf("expected unsupported room version %s not to be available", v)
+		case desc.Supported && desc.Stable && stability != "stable":
+			t.Errorf("expected room version %s to be stable, got %q", v, stability)
+		case desc.Supported && !desc.Stable && stability != "unstable":
+			t.Errorf("expected room version %s to be unstable, got %q", v, stability)
+		}
+	}
+}
+
+func TestCapabilitiesChangePassword(t *testing.T) {
+	_, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+	if _, err := accountDB.CreateAccount(context.Background(), "bob", "hunter2", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		device *authtypes.Device
+		want   bool
+	}{
+		{&authtypes.Device{UserID: "@bob:localhost"}, true},
+		{&authtypes.Device{UserID: "@alice:localhost"}, false},
+		{&authtypes.Device{UserID: "@1:localhost", IsGuest: true}, false},
+	} {
+		if got := getCapabilities(t, accountDB, tt.device).Capabilities.ChangePassword.Enabled; got != tt.want {
+			t.Errorf("%s: expected m.change_password to be %v, got %v", tt.device.UserID, tt.want, got)
+		}
+	}
+}
@@ -32,6 +32,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
@@ -49,6 +50,7 @@ type createRoomRequest struct {
 	RoomAliasName   string                        `json:"room_alias_name"`
 	GuestCanJoin    bool                          `json:"guest_can_join"`
 	RoomVersion     gomatrixserverlib.RoomVersion `json:"room_version"`
+	IsDirect        bool                          `json:"is_direct"`
 }
 
 const (
@@ -126,6 +128,13 @@ type createRoomResponse struct {
 	RoomAlias string `json:"room_alias,omitempty"` // in synapse not spec
 }
 
+// inviteContent is the content of an invite, which says whether the room is a
+// direct chat with the user who sent the invite.
+type inviteContent struct {
+	gomatrixserverlib.MemberContent
+	IsDirect bool `json:"is_direct,omitempty"`
+}
+
 // fledglingEvent is a helper representation of an event used when creating many events in succession.
 type fledglingEvent struct {
 	Type     string      `json:"type"`
@@ -137,13 +146,13 @@ type fledglingEvent struct {
 func CreateRoom(
 	req *http.Request, device *authtypes.Device,
 	cfg *config.Dendrite, producer *producers.RoomserverProducer,
-	accountDB accounts.Database, aliasAPI roomserverAPI.RoomserverAliasAPI,
-	asAPI appserviceAPI.AppServiceQueryAPI,
+	accountDB accounts.Database, syncProducer *producers.SyncAPIProducer,
+	aliasAPI roomserverAPI.RoomserverAliasAPI, asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
 	// TODO (#267): Check room ID doesn't clash with an existing one, and we
 	//              probably shouldn't be using pseudo-random strings, maybe GUIDs?
 	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
-	return createRoom(req, device, cfg, roomID, producer, accountDB, aliasAPI, asAPI)
+	return createRoom(req, device, cfg, roomID, producer, accountDB, syncProducer, aliasAPI, asAPI)
 }
 
 // createRoom implements /createRoom
@@ -151,8 +160,8 @@ func CreateRoom(
 func createRoom(
 	req *http.Request, device *authtypes.Device,
 	cfg *config.Dendrite, roomID string, producer *producers.RoomserverProducer,
-	accountDB accounts.Database, aliasAPI roomserverAPI.RoomserverAliasAPI,
-	asAPI appserviceAPI.AppServiceQueryAPI,
+	accountDB accounts.Database, syncProducer *producers.SyncAPIProducer,
+	aliasAPI roomserverAPI.RoomserverAliasAPI, asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
 	logger := util.GetLogger(req.Context())
 	userID := device.UserID
@@ -237,8 +246,6 @@ func createRoom(
 		historyVisibility = historyVisibilityShared
 	}
 
-	var builtEvents []gomatrixserverlib.HeaderedEvent
-
 	// send events into the room in order of:
 	//  1- m.room.create
 	//  2- room creator join member
@@ -250,7 +257,7 @@ func createRoom(
 	//  8- other initial state items
 	//  9- m.room.name (opt)
 	//  10- m.room.topic (opt)
-	//  11- invite events (opt) - with is_direct flag if applicable TODO
+	//  11- invite events (opt) - with is_direct flag if applicable
 	//  12- 3pid invite events (opt) TODO
 	//  13- m.room.aliases event for HS (if alias specified) TODO
 	// This differs from Synapse slightly. Synapse would vary the ordering of 3-7
@@ -275,48 +282,28 @@ func createRoom(
 	if r.Topic != "" {
 		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.topic", "", common.TopicContent{Topic: r.Topic}})
 	}
-	// TODO: invite events
-	// TODO: 3pid invite events
-	// TODO: m.room.aliases
-
-	authEvents := gomatrixserverlib.NewAuthEvents(nil)
-	for i, e := range eventsToMake {
-		depth := i + 1 // depth starts at 1
-
-		builder := gomatrixserverlib.EventBuilder{
-			Sender:   userID,
-			RoomID:   roomID,
-			Type:     e.Type,
-			StateKey: &e.StateKey,
-			Depth:    int64(depth),
-		}
-		err = builder.SetContent(e.Content)
+	for _, invitee := range r.Invite {
+		inviteeProfile, err := loadProfile(req.Context(), invitee, cfg, accountDB, asAPI)
 		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
-			return jsonerror.InternalServerError()
-		}
-		if i > 0 {
-			builder.PrevEvents = []gomatrixserverlib.EventReference{builtEvents[i-1].EventReference()}
-		}
-		var ev *gomatrixserverlib.Event
-		ev, err = buildEvent(&builder, &authEvents, cfg, evTime, roomVersion)
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("buildEvent failed")
-			return jsonerror.InternalServerError()
-		}
-
-		if err = gomatrixserverlib.Allowed(*ev, &authEvents); err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.Allowed failed")
+			util.GetLogger(req.Context()).WithError(err).Error("loadProfile failed")
 			return jsonerror.InternalServerError()
 		}
+		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.member", invitee, inviteContent{
+			MemberContent: gomatrixserverlib.MemberContent{
+				Membership:  gomatrixserverlib.Invite,
+				DisplayName: inviteeProfile.DisplayName,
+				AvatarURL:   inviteeProfile.AvatarURL,
+			},
+			IsDirect: r.IsDirect,
+		}})
+	}
+	// TODO: 3pid invite events
+	// TODO: m.room.aliases
 
-		// Add the event to the list of auth events
-		builtEvents = append(builtEvents, (*ev).Headered(roomVersion))
-		err = authEvents.AddEvent(ev)
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("authEvents.AddEvent failed")
-			return jsonerror.InternalServerError()
-		}
+	builtEvents, err := buildRoomEvents(userID, roomID, eventsToMake, cfg, evTime, roomVersion)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("buildRoomEvents failed")
+		return jsonerror.InternalServerError()
 	}
 
 	// send events to the room server
@@ -351,6 +338,22 @@ func createRoom(
 		}
 	}
 
+	// The room is a direct chat between the creator and each of the users
+	// who were invited. The m.direct of remote users is up to their server.
+	if r.IsDirect {
+		for _, invitee := range r.Invite {
+			if err = addDirectChat(req.Context(), accountDB, syncProducer, userID, invitee, roomID); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("addDirectChat failed")
+			}
+			if _, domain, _ := gomatrixserverlib.SplitID('@', invitee); domain != cfg.Matrix.ServerName {
+				continue
+			}
+			if err = addDirectChat(req.Context(), accountDB, syncProducer, invitee, userID, roomID); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("addDirectChat failed")
+			}
+		}
+	}
+
 	response := createRoomResponse{
 		RoomID:    roomID,
 		RoomAlias: roomAlias,
@@ -362,6 +365,86 @@ func createRoom(
 	}
 }
 
+// buildRoomEvents builds the events which create a new room, in the order
+// given. Each event is authorised against the events before it.
+func buildRoomEvents(
+	userID, roomID string, eventsToMake []fledglingEvent,
+	cfg *config.Dendrite, evTime time.Time, roomVersion gomatrixserverlib.RoomVersion,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	b := newRoomEventsBuilder(roomID, cfg, evTime, roomVersion)
+	for _, e := range eventsToMake {
+		if err := b.add(userID, e); err != nil {
+			return nil, err
+		}
+	}
+	return b.events, nil
+}
+
+// roomEventsBuilder builds the events of a new room one after another, which
+// may be sent by different users.
+type roomEventsBuilder struct {
+	roomID      string
+	cfg         *config.Dendrite
+	evTime      time.Time
+	roomVersion gomatrixserverlib.RoomVersion
+	authEvents  gomatrixserverlib.AuthEvents
+	events      []gomatrixserverlib.HeaderedEvent
+}
+
+func newRoomEventsBuilder(
+	roomID string, cfg *config.Dendrite, evTime time.Time, roomVersion gomatrixserverlib.RoomVersion,
+) *roomEventsBuilder {
+	return &roomEventsBuilder{
+		roomID:      roomID,
+		cfg:         cfg,
+		evTime:      evTime,
+		roomVersion: roomserverVersion.BaseRoomVersion(roomVersion),
+		authEvents:  gomatrixserverlib.NewAuthEvents(nil),
+	}
+}
+
+// add builds the next state event of the room, which is authorised against
+// the events before it.
+func (b *roomEventsBuilder) add(sender string, e fledglingEvent) error {
+	return b.addEvent(sender, e.Type, &e.StateKey, e.Content)
+}
+
+// addEvent builds the next event of the room, which is a state event if the
+// state key isn't nil.
+func (b *roomEventsBuilder) addEvent(sender, eventType string, stateKey *string, content interface{}) error {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		RoomID:   b.roomID,
+		Type:     eventType,
+		StateKey: stateKey,
+		Depth:    int64(len(b.events) + 1), // depth starts at 1
+	}
+	if err := builder.SetContent(content); err != nil {
+		return fmt.Errorf("builder.SetContent: %w", err)
+	}
+	if len(b.events) > 0 {
+		builder.PrevEvents = []gomatrixserverlib.EventReference{b.events[len(b.events)-1].EventReference()}
+	}
+	ev, err := buildEvent(&builder, &b.authEvents, b.cfg, b.evTime, b.roomVersion)
+	if err != nil {
+		return fmt.Errorf("buildEvent: %w", err)
+	}
+
+	if err = auth.Allowed(*ev, &b.authEvents); err != nil {
+		return fmt.Errorf("auth.Allowed: %w", err)
+	}
+
+	// Add the event to the list of auth events
+	b.events = append(b.events, (*ev).Headered(b.roomVersion))
+	if stateKey == nil {
+		return nil
+	}
+	if err = b.authEvents.AddEvent(ev); err != nil {
+		return fmt.Errorf("authEvents.AddEvent: %w", err)
+	}
+	return nil
+}
+
 // buildEvent fills out auth_events for the builder then builds the event
 func buildEvent(
 	builder *gomatrixserverlib.EventBuilder,
@@ -370,7 +453,7 @@ func buildEvent(
 	evTime time.Time,
 	roomVersion gomatrixserverlib.RoomVersion,
 ) (*gomatrixserverlib.Event, error) {
-	eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(builder)
+	eventsNeeded, err := auth.StateNeededForEventBuilder(builder)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,139 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type deactivateRequest struct {
+	Auth *authDict `json:"auth"`
+}
+
+type deactivateResponse struct {
+	// Dendrite doesn't unbind third-party identifiers from identity servers.
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// DeactivateAccount implements POST /account/deactivate
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-account-deactivate
+// The user must confirm their password. Their account is then marked as
+// deactivated, they leave all of their rooms and all of their devices are
+// logged out. The localpart of the account can't be registered again.
+func DeactivateAccount(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite,
+	accountDB accounts.Database, deviceDB devices.Database,
+	queryAPI api.RoomserverQueryAPI, producer *producers.RoomserverProducer,
+	deviceListProducer *producers.DeviceListProducer,
+) util.JSONResponse {
+	var r deactivateRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	if resErr := passwordAuth(cfg, accountDB, localpart).verify(req, r.Auth); resErr != nil {
+		return *resErr
+	}
+
+	if err = accountDB.DeactivateAccount(req.Context(), localpart); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.DeactivateAccount failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = leaveAllRooms(req.Context(), device.UserID, localpart, cfg, accountDB, queryAPI, producer); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("leaveAllRooms failed")
+		return jsonerror.InternalServerError()
+	}
+	threepids, err := accountDB.GetThreePIDsForLocalpart(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetThreePIDsForLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	for _, threepid := range threepids {
+		if err = accountDB.RemoveThreePIDAssociation(req.Context(), threepid.Address, threepid.Medium); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDAssociation failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	// The devices are removed last, so that a request which fails part way
+	// through can be retried with the same access token.
+	if err = deviceDB.RemoveAllDevices(req.Context(), localpart); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveAllDevices failed")
+		return jsonerror.InternalServerError()
+	}
+	sendDeviceListUpdate(req, deviceListProducer, device.UserID)
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: deactivateResponse{IDServerUnbindResult: "no-support"},
+	}
+}
+
+// leaveAllRooms sends events for a local user to leave every room that they
+// are joined to.
+func leaveAllRooms(
+	ctx context.Context, userID, localpart string, cfg *config.Dendrite,
+	accountDB accounts.Database, queryAPI api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+) error {
+	roomIDs, err := accountDB.GetRoomIDsByLocalPart(ctx, localpart)
+	if err != nil {
+		return err
+	}
+	evTime := time.Now()
+	for _, roomID := range roomIDs {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   userID,
+			RoomID:   roomID,
+			Type:     gomatrixserverlib.MRoomMember,
+			StateKey: &userID,
+		}
+		if err = builder.SetContent(gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Leave}); err != nil {
+			return err
+		}
+		var queryRes api.QueryLatestEventsAndStateResponse
+		var event *gomatrixserverlib.Event
+		event, err = common.BuildEvent(ctx, &builder, cfg, evTime, queryAPI, &queryRes)
+		if err == common.ErrRoomNoExists {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if _, err = producer.SendEvents(
+			ctx, []gomatrixserverlib.HeaderedEvent{event.Headered(queryRes.RoomVersion)},
+			cfg.Matrix.ServerName, nil,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// deactivateTest is alice, who has a password and a device, in the test room.
+type deactivateTest struct {
+	room      *testRoom
+	accountDB accounts.Database
+	deviceDB  devices.Database
+	device    *authtypes.Device
+	// Joins users who register or log in with SSO to the auto_join_rooms,
+	// if it is set.
+	autoJoin *autoJoiner
+}
+
+func newDeactivateTest(t *testing.T) (*deactivateTest, func()) {
+	dir, err := ioutil.TempDir("", "deactivate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &deactivateTest{room: newTestRoom(t)}
+	if d.accountDB, err = accounts.NewDatabase("file:"+filepath.Join(dir, "account.db"), nil, "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if d.deviceDB, err = devices.NewDatabase("file:"+filepath.Join(dir, "device.db"), nil, "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = d.accountDB.CreateAccount(ctx, "alice", "correct horse", ""); err != nil {
+		t.Fatal(err)
+	}
+	if d.device, err = d.deviceDB.CreateDevice(ctx, "alice", nil, "alices-token", nil); err != nil {
+		t.Fatal(err)
+	}
+	// The account database learns about the rooms that alice is in from the
+	// events that the roomserver outputs.
+	if err = d.accountDB.UpdateMemberships(ctx, d.room.events[1:2], nil); err != nil {
+		t.Fatal(err)
+	}
+	return d, func() { _ = os.RemoveAll(dir) }
+}
+
+func (d *deactivateTest) deactivate(body string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/account/deactivate", strings.NewReader(body))
+	res := DeactivateAccount(
+		req, d.device, d.room.cfg, d.accountDB, d.deviceDB, d.room,
+		producers.NewRoomserverProducer(d.room, d.room), &producers.DeviceListProducer{Producer: testSyncProducer{}},
+	)
+	return res.Code, res.JSON
+}
+
+func TestDeactivateRequiresPassword(t *testing.T) {
+	d, cleanup := newDeactivateTest(t)
+	defer cleanup()
+
+	code, body := d.deactivate(`{}`)
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without auth, got %d: %v", code, body)
+	}
+	res := body.(userInteractiveResponse)
+	if len(res.Flows) != 1 || len(res.Flows[0].Stages) != 1 || res.Flows[0].Stages[0] != authtypes.LoginTypePassword || res.Session == "" {
+		t.Errorf("expected to be asked for a password, got %+v", res)
+	}
+
+	code, body = d.deactivate(`{"auth": {"type": "m.login.password", "session": "` + res.Session + `", "user": "alice", "password": "wrong"}}`)
+	if code != http.StatusUnauthorized || body.(userInteractiveResponse).MatrixError == nil {
+		t.Fatalf("expected 401 with an error for a wrong password, got %d: %v", code, body)
+	}
+	if _, err := d.deviceDB.GetDeviceByAccessToken(context.Background(), "alices-token"); err != nil {
+		t.Errorf("expected the device to be kept, got %v", err)
+	}
+	if len(d.room.sent) != 0 {
+		t.Errorf("expected no events to be sent, got %d", len(d.room.sent))
+	}
+}
+
+func TestDeactivateRevokesTokensAndLeavesRooms(t *testing.T) {
+	d, cleanup := newDeactivateTest(t)
+	defer cleanup()
+
+	code, body := d.deactivate(`{"auth": {"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "@alice:localhost"}, "password": "correct horse"}}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+
+	if _, err := d.deviceDB.GetDeviceByAccessToken(context.Background(), "alices-token"); err == nil {
+		t.Error("expected the access token to be revoked")
+	}
+	if len(d.room.sent) != 1 || !d.room.sent[0].StateKeyEquals("@alice:localhost") {
+		t.Fatalf("expected alice to leave the room, got %v", d.room.sent)
+	}
+	if membership, err := d.room.sent[0].Membership(); err != nil || membership != gomatrixserverlib.Leave {
+		t.Errorf("expected a leave event, got %q (%v)", membership, err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/login", strings.NewReader(
+		`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "alice"}, "password": "correct horse"}`,
+	))
+	res := Login(req, d.accountDB, d.deviceDB, nil, d.room.cfg, &producers.DeviceListProducer{Producer: testSyncProducer{}})
+	if res.Code != http.StatusForbidden || res.JSON.(*jsonerror.MatrixError).ErrCode != "M_USER_DEACTIVATED" {
+		t.Errorf("expected logging in to be forbidden, got %d: %v", res.Code, res.JSON)
+	}
+	if available, err := d.accountDB.CheckAccountAvailability(context.Background(), "alice"); err != nil || available {
+		t.Errorf("expected the username not to be reusable, got %v (%v)", available, err)
+	}
+}
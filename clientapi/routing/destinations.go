@@ -0,0 +1,79 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GetDestinations implements GET /_dendrite/admin/v1/federation/destinations
+// It lists how sending to each remote server is going, including whether the
+// server is being backed off from or blacklisted after failures.
+func GetDestinations(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite,
+	federationSender federationSenderAPI.FederationSenderQueryAPI,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	var res federationSenderAPI.QueryDestinationStatusesResponse
+	if err := federationSender.QueryDestinationStatuses(
+		req.Context(), &federationSenderAPI.QueryDestinationStatusesRequest{}, &res,
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("federationSender.QueryDestinationStatuses failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// ResetDestinationBackoff implements POST /_dendrite/admin/v1/federation/destinations/{serverName}/reset_backoff
+// It forgets the failures to send to a remote server so that it is tried
+// again straight away.
+func ResetDestinationBackoff(
+	req *http.Request, device *authtypes.Device, serverName gomatrixserverlib.ServerName,
+	cfg *config.Dendrite, federationSender federationSenderAPI.FederationSenderQueryAPI,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	var res federationSenderAPI.ResetDestinationBackoffResponse
+	if err := federationSender.ResetDestinationBackoff(
+		req.Context(), &federationSenderAPI.ResetDestinationBackoffRequest{ServerName: serverName}, &res,
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("federationSender.ResetDestinationBackoff failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.Known {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Nothing has been sent to this server"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
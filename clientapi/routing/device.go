@@ -16,19 +16,23 @@ package routing
 
 import (
 	"database/sql"
-	"encoding/json"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
 type deviceJSON struct {
-	DeviceID string `json:"device_id"`
-	UserID   string `json:"user_id"`
+	DeviceID    string `json:"device_id"`
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"display_name,omitempty"`
 }
 
 type devicesJSON struct {
@@ -39,8 +43,13 @@ type deviceUpdateJSON struct {
 	DisplayName *string `json:"display_name"`
 }
 
+type deviceDeleteJSON struct {
+	Auth *authDict `json:"auth"`
+}
+
 type devicesDeleteJSON struct {
-	Devices []string `json:"devices"`
+	Devices []string  `json:"devices"`
+	Auth    *authDict `json:"auth"`
 }
 
 // GetDeviceByID handles /devices/{deviceID}
@@ -69,8 +78,9 @@ func GetDeviceByID(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: deviceJSON{
-			DeviceID: dev.ID,
-			UserID:   dev.UserID,
+			DeviceID:    dev.ID,
+			UserID:      dev.UserID,
+			DisplayName: dev.DisplayName,
 		},
 	}
 }
@@ -93,12 +103,13 @@ func GetDevicesByLocalpart(
 		return jsonerror.InternalServerError()
 	}
 
-	res := devicesJSON{}
+	res := devicesJSON{Devices: []deviceJSON{}}
 
 	for _, dev := range deviceList {
 		res.Devices = append(res.Devices, deviceJSON{
-			DeviceID: dev.ID,
-			UserID:   dev.UserID,
+			DeviceID:    dev.ID,
+			UserID:      dev.UserID,
+			DisplayName: dev.DisplayName,
 		})
 	}
 
@@ -111,7 +122,7 @@ func GetDevicesByLocalpart(
 // UpdateDeviceByID handles PUT on /devices/{deviceID}
 func UpdateDeviceByID(
 	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
-	deviceID string,
+	deviceID string, deviceListProducer *producers.DeviceListProducer,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -138,19 +149,16 @@ func UpdateDeviceByID(
 		}
 	}
 
-	defer req.Body.Close() // nolint: errcheck
-
 	payload := deviceUpdateJSON{}
-
-	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("json.NewDecoder.Decode failed")
-		return jsonerror.InternalServerError()
+	if resErr := httputil.UnmarshalJSONRequest(req, &payload); resErr != nil {
+		return *resErr
 	}
 
 	if err := deviceDB.UpdateDevice(ctx, localpart, deviceID, payload.DisplayName); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.UpdateDevice failed")
 		return jsonerror.InternalServerError()
 	}
+	sendDeviceListUpdate(req, deviceListProducer, device.UserID)
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -159,9 +167,12 @@ func UpdateDeviceByID(
 }
 
 // DeleteDeviceById handles DELETE requests to /devices/{deviceId}
+// The user must confirm their password. Deleting a device logs it out, as its
+// access token is deleted with it.
 func DeleteDeviceById(
-	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
-	deviceID string,
+	req *http.Request, cfg *config.Dendrite, accountDB accounts.Database,
+	deviceDB devices.Database, device *authtypes.Device,
+	deviceID string, deviceListProducer *producers.DeviceListProducer,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -170,12 +181,23 @@ func DeleteDeviceById(
 	}
 	ctx := req.Context()
 
-	defer req.Body.Close() // nolint: errcheck
+	// The body is optional, as clients first make the request without any
+	// auth to find out which flows they can complete.
+	payload := deviceDeleteJSON{}
+	if req.ContentLength != 0 {
+		if resErr := httputil.UnmarshalJSONRequest(req, &payload); resErr != nil {
+			return *resErr
+		}
+	}
+	if resErr := passwordAuth(cfg, accountDB, localpart).verify(req, payload.Auth); resErr != nil {
+		return *resErr
+	}
 
 	if err := deviceDB.RemoveDevice(ctx, deviceID, localpart); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveDevice failed")
 		return jsonerror.InternalServerError()
 	}
+	sendDeviceListUpdate(req, deviceListProducer, device.UserID)
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -184,8 +206,11 @@ func DeleteDeviceById(
 }
 
 // DeleteDevices handles POST requests to /delete_devices
+// The user must confirm their password, as for deleting a single device.
 func DeleteDevices(
-	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
+	req *http.Request, cfg *config.Dendrite, accountDB accounts.Database,
+	deviceDB devices.Database, device *authtypes.Device,
+	deviceListProducer *producers.DeviceListProducer,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -195,21 +220,30 @@ func DeleteDevices(
 
 	ctx := req.Context()
 	payload := devicesDeleteJSON{}
-
-	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("json.NewDecoder.Decode failed")
-		return jsonerror.InternalServerError()
+	if resErr := httputil.UnmarshalJSONRequest(req, &payload); resErr != nil {
+		return *resErr
+	}
+	if resErr := passwordAuth(cfg, accountDB, localpart).verify(req, payload.Auth); resErr != nil {
+		return *resErr
 	}
-
-	defer req.Body.Close() // nolint: errcheck
 
 	if err := deviceDB.RemoveDevices(ctx, localpart, payload.Devices); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveDevices failed")
 		return jsonerror.InternalServerError()
 	}
+	sendDeviceListUpdate(req, deviceListProducer, device.UserID)
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
 	}
 }
+
+// sendDeviceListUpdate tells the sync API that the devices of the user changed,
+// so that the users sharing encrypted rooms with them can fetch their new keys.
+// The devices have already been changed, so failing to send it is only logged.
+func sendDeviceListUpdate(req *http.Request, deviceListProducer *producers.DeviceListProducer, userID string) {
+	if err := deviceListProducer.SendUpdate(userID); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceListProducer.SendUpdate failed")
+	}
+}
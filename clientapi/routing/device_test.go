@@ -0,0 +1,152 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/producers"
+
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// testDeviceListProducer records the users whose device lists were sent to
+// the sync API as having changed.
+type testDeviceListProducer struct {
+	sarama.SyncProducer
+	userIDs []string
+}
+
+func (p *testDeviceListProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	key, err := msg.Key.Encode()
+	p.userIDs = append(p.userIDs, string(key))
+	return 0, 0, err
+}
+
+// newDeviceTest sets up alice's test accounts, with a second device which
+// has a display name.
+func newDeviceTest(t *testing.T) (*deactivateTest, func()) {
+	d, cleanup := newDeactivateTest(t)
+	deviceID, displayName := "PHONE", "Alice's phone"
+	if _, err := d.deviceDB.CreateDevice(context.Background(), "alice", &deviceID, "alices-phone-token", &displayName); err != nil {
+		t.Fatal(err)
+	}
+	return d, cleanup
+}
+
+func TestListDevices(t *testing.T) {
+	d, cleanup := newDeviceTest(t)
+	defer cleanup()
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/devices", nil)
+	res := GetDevicesByLocalpart(req, d.deviceDB, d.device)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	names := make(map[string]string)
+	for _, dev := range res.JSON.(devicesJSON).Devices {
+		names[dev.DeviceID] = dev.DisplayName
+	}
+	if _, ok := names[d.device.ID]; !ok || len(names) != 2 || names["PHONE"] != "Alice's phone" {
+		t.Errorf("expected both devices of alice, got %v", names)
+	}
+}
+
+func TestUpdateDeviceDisplayName(t *testing.T) {
+	d, cleanup := newDeviceTest(t)
+	defer cleanup()
+
+	deviceList := &testDeviceListProducer{}
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/client/r0/devices/PHONE", strings.NewReader(`{"display_name":"Old phone"}`))
+	res := UpdateDeviceByID(req, d.deviceDB, d.device, "PHONE", &producers.DeviceListProducer{Producer: deviceList})
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/devices/PHONE", nil)
+	res = GetDeviceByID(req, d.deviceDB, d.device, "PHONE")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	if name := res.JSON.(deviceJSON).DisplayName; name != "Old phone" {
+		t.Errorf("expected the new display name to be saved, got %q", name)
+	}
+	if len(deviceList.userIDs) != 1 || deviceList.userIDs[0] != "@alice:localhost" {
+		t.Errorf("expected a device list change for alice, got %v", deviceList.userIDs)
+	}
+}
+
+func TestDeleteDeviceRequiresPasswordAndRevokesToken(t *testing.T) {
+	d, cleanup := newDeviceTest(t)
+	defer cleanup()
+
+	deviceList := &testDeviceListProducer{}
+	deleteDevice := func(body string) (int, interface{}) {
+		req := httptest.NewRequest(http.MethodDelete, "/_matrix/client/r0/devices/PHONE", strings.NewReader(body))
+		res := DeleteDeviceById(
+			req, d.room.cfg, d.accountDB, d.deviceDB, d.device, "PHONE",
+			&producers.DeviceListProducer{Producer: deviceList},
+		)
+		return res.Code, res.JSON
+	}
+
+	code, res := deleteDevice("")
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without auth, got %d: %v", code, res)
+	}
+	session := res.(userInteractiveResponse).Session
+	if code, res = deleteDevice(`{"auth":{"type":"m.login.password","session":"` + session + `","user":"alice","password":"wrong"}}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with the wrong password, got %d: %v", code, res)
+	}
+	if _, err := d.deviceDB.GetDeviceByAccessToken(context.Background(), "alices-phone-token"); err != nil {
+		t.Fatalf("expected the device to be kept until the password is confirmed: %v", err)
+	}
+
+	if code, res = deleteDevice(`{"auth":{"type":"m.login.password","session":"` + session + `","user":"alice","password":"correct horse"}}`); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	if _, err := d.deviceDB.GetDeviceByAccessToken(context.Background(), "alices-phone-token"); err == nil {
+		t.Error("expected the access token of the device to be revoked")
+	}
+	if len(deviceList.userIDs) != 1 || deviceList.userIDs[0] != "@alice:localhost" {
+		t.Errorf("expected a device list change for alice, got %v", deviceList.userIDs)
+	}
+}
+
+func TestDeleteDevicesInBulk(t *testing.T) {
+	d, cleanup := newDeviceTest(t)
+	defer cleanup()
+
+	deviceList := &testDeviceListProducer{}
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/delete_devices", strings.NewReader(
+		`{"devices":["PHONE","`+d.device.ID+`"],"auth":{"type":"m.login.password","user":"alice","password":"correct horse"}}`,
+	))
+	res := DeleteDevices(req, d.room.cfg, d.accountDB, d.deviceDB, d.device, &producers.DeviceListProducer{Producer: deviceList})
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	for _, token := range []string{"alices-token", "alices-phone-token"} {
+		if _, err := d.deviceDB.GetDeviceByAccessToken(context.Background(), token); err == nil {
+			t.Errorf("expected the access token %s to be revoked", token)
+		}
+	}
+	if len(deviceList.userIDs) != 1 {
+		t.Errorf("expected one device list change for alice, got %v", deviceList.userIDs)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The default time we wait for remote servers to hand out one-time keys.
+const defaultClaimKeysTimeout = 10 * time.Second
+
+type uploadKeysRequest struct {
+	DeviceKeys json.RawMessage `json:"device_keys"`
+	// The one-time keys keyed by <algorithm>:<key ID>.
+	OneTimeKeys map[string]json.RawMessage `json:"one_time_keys"`
+}
+
+type uploadKeysResponse struct {
+	OneTimeKeyCounts map[string]int `json:"one_time_key_counts"`
+}
+
+// uploadedDeviceKeys is the part of the identity keys of a device which we
+// check before storing them. The keys are stored as the device signed them.
+type uploadedDeviceKeys struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+}
+
+// UploadKeys implements POST /keys/upload
+// It stores the identity keys and the one-time keys of the device making the
+// request, and returns how many one-time keys the device has left.
+func UploadKeys(
+	req *http.Request, device *authtypes.Device, deviceDB devices.Database,
+	deviceListProducer *producers.DeviceListProducer,
+) util.JSONResponse {
+	var r uploadKeysRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	if len(r.DeviceKeys) > 0 && string(r.DeviceKeys) != "null" {
+		var keys uploadedDeviceKeys
+		if err := json.Unmarshal(r.DeviceKeys, &keys); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The device keys must be an object: " + err.Error()),
+			}
+		}
+		if keys.UserID != device.UserID || keys.DeviceID != device.ID {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("The device keys must belong to the device uploading them"),
+			}
+		}
+		if err := deviceDB.StoreDeviceKeys(req.Context(), device.UserID, device.ID, r.DeviceKeys); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("deviceDB.StoreDeviceKeys failed")
+			return jsonerror.InternalServerError()
+		}
+		sendDeviceListUpdate(req, deviceListProducer, device.UserID)
+	}
+
+	oneTimeKeys := make([]authtypes.OneTimeKey, 0, len(r.OneTimeKeys))
+	for keyID, keyJSON := range r.OneTimeKeys {
+		if parts := strings.SplitN(keyID, ":", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Invalid one-time key ID %q", keyID)),
+			}
+		}
+		oneTimeKeys = append(oneTimeKeys, authtypes.OneTimeKey{
+			UserID:   device.UserID,
+			DeviceID: device.ID,
+			KeyID:    keyID,
+			KeyJSON:  keyJSON,
+		})
+	}
+	counts, err := deviceDB.StoreOneTimeKeys(req.Context(), device.UserID, device.ID, oneTimeKeys)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.StoreOneTimeKeys failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: uploadKeysResponse{counts},
+	}
+}
+
+type claimKeysRequest struct {
+	// The time in milliseconds to wait for remote servers.
+	Timeout int64 `json:"timeout"`
+	// The algorithm of the key to claim, keyed by user ID and then device ID.
+	OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+}
+
+// claimedKeys are one-time keys keyed by user ID, then device ID and then
+// key ID.
+type claimedKeys map[string]map[string]map[string]json.RawMessage
+
+type claimKeysResponse struct {
+	Failures    map[string]interface{} `json:"failures"`
+	OneTimeKeys claimedKeys            `json:"one_time_keys"`
+}
+
+// ClaimKeys implements POST /keys/claim
+// It hands out one one-time key for each of the requested devices which still
+// has one. The keys of remote users are claimed from their servers.
+func ClaimKeys(
+	req *http.Request, cfg *config.Dendrite, deviceDB devices.Database,
+	federation *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	var r claimKeysRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	res := claimKeysResponse{
+		Failures:    map[string]interface{}{},
+		OneTimeKeys: claimedKeys{},
+	}
+	remote := map[gomatrixserverlib.ServerName]map[string]map[string]string{}
+	for userID, userDevices := range r.OneTimeKeys {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Invalid user ID %q", userID)),
+			}
+		}
+		if domain != cfg.Matrix.ServerName {
+			if remote[domain] == nil {
+				remote[domain] = map[string]map[string]string{}
+			}
+			remote[domain][userID] = userDevices
+			continue
+		}
+		if err = claimLocalKeys(req.Context(), deviceDB, userID, userDevices, res.OneTimeKeys); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("claimLocalKeys failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	timeout := defaultClaimKeysTimeout
+	if r.Timeout > 0 {
+		timeout = time.Duration(r.Timeout) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	for server, users := range remote {
+		if err := claimRemoteKeys(ctx, cfg, federation, server, users, res.OneTimeKeys); err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("server", server).Warn(
+				"Failed to claim one-time keys from a remote server",
+			)
+			res.Failures[string(server)] = jsonerror.Unknown(err.Error())
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// claimLocalKeys claims a one-time key with the given algorithm for each of
+// the devices of a local user and adds them to the claimed keys. Devices
+// without any such keys left are left out.
+func claimLocalKeys(
+	ctx context.Context, deviceDB devices.Database,
+	userID string, algorithms map[string]string, claimed claimedKeys,
+) error {
+	for deviceID, algorithm := range algorithms {
+		key, err := deviceDB.ClaimOneTimeKey(ctx, userID, deviceID, algorithm)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			continue
+		}
+		if claimed[userID] == nil {
+			claimed[userID] = map[string]map[string]json.RawMessage{}
+		}
+		claimed[userID][deviceID] = map[string]json.RawMessage{key.KeyID: key.KeyJSON}
+	}
+	return nil
+}
+
+// claimRemoteKeys claims one-time keys from a remote server over federation
+// and adds them to the claimed keys. gomatrixserverlib doesn't know about the
+// key APIs yet, so we can't use the FederationClient for this directly.
+func claimRemoteKeys(
+	ctx context.Context, cfg *config.Dendrite, federation *gomatrixserverlib.FederationClient,
+	server gomatrixserverlib.ServerName, users map[string]map[string]string, claimed claimedKeys,
+) error {
+	fedReq := gomatrixserverlib.NewFederationRequest(http.MethodPost, server, "/_matrix/federation/v1/user/keys/claim")
+	if err := fedReq.SetContent(map[string]interface{}{"one_time_keys": users}); err != nil {
+		return err
+	}
+	if err := fedReq.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return err
+	}
+	httpReq, err := fedReq.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	var res struct {
+		OneTimeKeys claimedKeys `json:"one_time_keys"`
+	}
+	if err = federation.DoRequestAndParseResponse(ctx, httpReq, &res); err != nil {
+		return err
+	}
+	// Only keep the keys of the users which the server is responsible for.
+	for userID, userDevices := range res.OneTimeKeys {
+		if _, ok := users[userID]; ok {
+			claimed[userID] = userDevices
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+var aliceDevice = &authtypes.Device{UserID: "@alice:localhost", ID: "ALICEDEVICE"}
+
+// uploadKeys uploads keys for alice's device and returns the response.
+func uploadKeys(t *testing.T, db devices.Database, content interface{}) (int, uploadKeysResponse) {
+	body, err := json.Marshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := UploadKeys(
+		httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body)), aliceDevice, db,
+		&producers.DeviceListProducer{Producer: testSyncProducer{}},
+	)
+	if res.Code != http.StatusOK {
+		return res.Code, uploadKeysResponse{}
+	}
+	return res.Code, res.JSON.(uploadKeysResponse)
+}
+
+// claimAliceKey claims a one-time key of alice's device as bob, and returns the
+// claimed keys of the device.
+func claimAliceKey(t *testing.T, db devices.Database) map[string]json.RawMessage {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	code, body := keysRequest(t, "@bob:localhost", map[string]interface{}{
+		"one_time_keys": map[string]map[string]string{
+			aliceDevice.UserID: {aliceDevice.ID: "signed_curve25519"},
+		},
+	}, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return ClaimKeys(req, cfg, db, nil)
+	})
+	if code != http.StatusOK {
+		t.Errorf("failed to claim a key: %d %s", code, body)
+		return nil
+	}
+	var res claimKeysResponse
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Error(err)
+		return nil
+	}
+	return res.OneTimeKeys[aliceDevice.UserID][aliceDevice.ID]
+}
+
+func TestOneTimeKeysUploadCountAndClaim(t *testing.T) {
+	db, cleanup := newKeysTestDB(t)
+	defer cleanup()
+
+	code, res := uploadKeys(t, db, map[string]interface{}{
+		"device_keys": map[string]interface{}{
+			"user_id":    aliceDevice.UserID,
+			"device_id":  aliceDevice.ID,
+			"algorithms": []string{"m.olm.v1.curve25519-aes-sha2"},
+			"keys":       map[string]string{"curve25519:ALICEDEVICE": "identity"},
+		},
+		"one_time_keys": map[string]interface{}{
+			"signed_curve25519:AAAAAA": map[string]string{"key": "first"},
+			"signed_curve25519:AAAAAB": map[string]string{"key": "second"},
+		},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("failed to upload the keys: %d", code)
+	}
+	if count := res.OneTimeKeyCounts["signed_curve25519"]; count != 2 {
+		t.Errorf("expected 2 one-time keys, got %v", res.OneTimeKeyCounts)
+	}
+	if deviceKeys := queryKeys(t, db, "@bob:localhost", aliceDevice.UserID).DeviceKeys[aliceDevice.UserID]; deviceKeys[aliceDevice.ID] == nil {
+		t.Errorf("expected the device keys of alice's device, got %v", deviceKeys)
+	}
+
+	first := claimAliceKey(t, db)
+	second := claimAliceKey(t, db)
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatalf("expected a key for each claim, got %v and %v", first, second)
+	}
+	for keyID := range first {
+		if _, ok := second[keyID]; ok {
+			t.Errorf("expected the key %s to only be claimed once", keyID)
+		}
+	}
+	if _, res = uploadKeys(t, db, map[string]interface{}{}); len(res.OneTimeKeyCounts) != 0 {
+		t.Errorf("expected no one-time keys to be left, got %v", res.OneTimeKeyCounts)
+	}
+	if keys := claimAliceKey(t, db); len(keys) != 0 {
+		t.Errorf("expected no key once they have all been claimed, got %v", keys)
+	}
+}
+
+func TestDeviceKeysMustBelongToTheDevice(t *testing.T) {
+	db, cleanup := newKeysTestDB(t)
+	defer cleanup()
+
+	code, _ := uploadKeys(t, db, map[string]interface{}{
+		"device_keys": map[string]interface{}{
+			"user_id":   aliceDevice.UserID,
+			"device_id": "OTHERDEVICE",
+		},
+	})
+	if code != http.StatusBadRequest {
+		t.Errorf("expected 400 for the keys of another device, got %d", code)
+	}
+}
+
+func TestConcurrentClaimsReturnDistinctKeys(t *testing.T) {
+	db, cleanup := newKeysTestDB(t)
+	defer cleanup()
+
+	const numKeys = 20
+	oneTimeKeys := map[string]interface{}{}
+	for i := 0; i < numKeys; i++ {
+		oneTimeKeys[fmt.Sprintf("signed_curve25519:%06d", i)] = map[string]string{"key": fmt.Sprint(i)}
+	}
+	if code, _ := uploadKeys(t, db, map[string]interface{}{"one_time_keys": oneTimeKeys}); code != http.StatusOK {
+		t.Fatalf("failed to upload the keys: %d", code)
+	}
+
+	var wg sync.WaitGroup
+	claimed := make(chan string, numKeys)
+	for i := 0; i < numKeys; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for keyID := range claimAliceKey(t, db) {
+				claimed <- keyID
+			}
+		}()
+	}
+	wg.Wait()
+	close(claimed)
+
+	seen := map[string]bool{}
+	for keyID := range claimed {
+		if seen[keyID] {
+			t.Errorf("expected the key %s to only be claimed once", keyID)
+		}
+		seen[keyID] = true
+	}
+	if len(seen) != numKeys {
+		t.Errorf("expected all %d keys to be claimed, got %d", numKeys, len(seen))
+	}
+}
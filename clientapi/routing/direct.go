@@ -0,0 +1,139 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// directChatsType is the type of the account data which lists the direct chats
+// of a user, as a map from the IDs of the other users to the IDs of the rooms.
+// https://matrix.org/docs/spec/client_server/r0.6.0#m-direct
+const directChatsType = "m.direct"
+
+// addDirectChat marks the room as a direct chat with the other user in the
+// m.direct account data of the local user.
+func addDirectChat(
+	ctx context.Context, accountDB accounts.Database, syncProducer *producers.SyncAPIProducer,
+	userID, otherUserID, roomID string,
+) error {
+	return updateDirectChats(ctx, accountDB, syncProducer, userID, func(direct map[string][]string) bool {
+		for _, id := range direct[otherUserID] {
+			if id == roomID {
+				return false
+			}
+		}
+		direct[otherUserID] = append(direct[otherUserID], roomID)
+		return true
+	})
+}
+
+// removeDirectChat removes the room from the m.direct account data of the
+// local user.
+func removeDirectChat(
+	ctx context.Context, accountDB accounts.Database, syncProducer *producers.SyncAPIProducer,
+	userID, roomID string,
+) error {
+	return updateDirectChats(ctx, accountDB, syncProducer, userID, func(direct map[string][]string) bool {
+		changed := false
+		for otherUserID, roomIDs := range direct {
+			kept := roomIDs[:0]
+			for _, id := range roomIDs {
+				if id != roomID {
+					kept = append(kept, id)
+				}
+			}
+			if len(kept) == len(roomIDs) {
+				continue
+			}
+			changed = true
+			if len(kept) == 0 {
+				delete(direct, otherUserID)
+			} else {
+				direct[otherUserID] = kept
+			}
+		}
+		return changed
+	})
+}
+
+// updateDirectChats changes the m.direct account data of the local user with
+// the given function, which returns whether it changed anything. The account
+// data is only saved, and the sync API told about it, if it changed.
+func updateDirectChats(
+	ctx context.Context, accountDB accounts.Database, syncProducer *producers.SyncAPIProducer,
+	userID string, update func(direct map[string][]string) bool,
+) error {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+	data, err := accountDB.GetAccountDataByType(ctx, localpart, "", directChatsType)
+	if err != nil {
+		return fmt.Errorf("accountDB.GetAccountDataByType: %w", err)
+	}
+	direct := make(map[string][]string)
+	if data != nil {
+		// Content which isn't a valid m.direct is replaced rather than
+		// stopping the room from being added.
+		_ = json.Unmarshal(data.Content, &direct)
+	}
+	if !update(direct) {
+		return nil
+	}
+	content, err := json.Marshal(direct)
+	if err != nil {
+		return err
+	}
+	if err = accountDB.SaveAccountData(ctx, localpart, "", directChatsType, string(content)); err != nil {
+		return fmt.Errorf("accountDB.SaveAccountData: %w", err)
+	}
+	return syncProducer.SendData(userID, "", directChatsType)
+}
+
+// directChatInviter returns the user who invited the user to the room as a
+// direct chat, or an empty string if the user hasn't been invited to the room
+// as a direct chat.
+func directChatInviter(
+	ctx context.Context, queryAPI api.RoomserverQueryAPI, roomID, userID string,
+) (string, error) {
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+		},
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return "", err
+	}
+	for _, ev := range stateRes.StateEvents {
+		var content inviteContent
+		if err := json.Unmarshal(ev.Content(), &content); err != nil {
+			continue
+		}
+		if content.Membership == gomatrixserverlib.Invite && content.IsDirect {
+			return ev.Sender(), nil
+		}
+	}
+	return "", nil
+}
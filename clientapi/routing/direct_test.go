@@ -0,0 +1,121 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func (r *testRoom) QueryRoomVersionForRoom(
+	ctx context.Context,
+	request *api.QueryRoomVersionForRoomRequest,
+	response *api.QueryRoomVersionForRoomResponse,
+) error {
+	response.RoomVersion = gomatrixserverlib.RoomVersionV3
+	return nil
+}
+
+// directChats returns the m.direct account data of a local user.
+func directChats(t *testing.T, accountDB accounts.Database, localpart string) map[string][]string {
+	data, err := accountDB.GetAccountDataByType(context.Background(), localpart, "", directChatsType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct := make(map[string][]string)
+	if data != nil {
+		if err = json.Unmarshal(data.Content, &direct); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return direct
+}
+
+func TestCreateDirectRoomUpdatesBothUsers(t *testing.T) {
+	rs, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+	if _, err := accountDB.CreateAccount(context.Background(), "bob", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(
+		http.MethodPost, "/_matrix/client/r0/createRoom",
+		strings.NewReader(`{"is_direct":true,"invite":["@bob:localhost"]}`),
+	)
+	res := CreateRoom(
+		req, &authtypes.Device{UserID: "@alice:localhost"}, rs.cfg, producers.NewRoomserverProducer(rs, rs),
+		accountDB, &producers.SyncAPIProducer{Producer: testSyncProducer{}}, nil, nil,
+	)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	roomID := res.JSON.(createRoomResponse).RoomID
+	if invite := rs.sentEvent(roomID, gomatrixserverlib.MRoomMember); invite["membership"] != gomatrixserverlib.Invite || invite["is_direct"] != true {
+		t.Errorf("expected bob to be invited to a direct chat, got %v", invite)
+	}
+
+	if direct := directChats(t, accountDB, "alice"); !reflect.DeepEqual(direct, map[string][]string{"@bob:localhost": {roomID}}) {
+		t.Errorf("expected the room in the m.direct of alice, got %v", direct)
+	}
+	if direct := directChats(t, accountDB, "bob"); !reflect.DeepEqual(direct, map[string][]string{"@alice:localhost": {roomID}}) {
+		t.Errorf("expected the room in the m.direct of bob, got %v", direct)
+	}
+}
+
+func TestDirectChatsFollowMembership(t *testing.T) {
+	rs, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+	if _, err := accountDB.CreateAccount(context.Background(), "bob", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	rs.addState("@alice:localhost", gomatrixserverlib.MRoomMember, "@bob:localhost", inviteContent{
+		MemberContent: gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Invite},
+		IsDirect:      true,
+	})
+
+	sendMembership := func(membership string) {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/rooms/"+testRoomID+"/"+membership, strings.NewReader("{}"))
+		res := SendMembership(
+			req, accountDB, &authtypes.Device{UserID: "@bob:localhost"}, testRoomID, membership, rs.cfg,
+			nil, rs, nil, producers.NewRoomserverProducer(rs, rs), &producers.SyncAPIProducer{Producer: testSyncProducer{}},
+		)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected 200 OK for %s, got %d: %v", membership, res.Code, res.JSON)
+		}
+	}
+
+	// Joining twice doesn't list the room twice.
+	sendMembership(gomatrixserverlib.Join)
+	sendMembership(gomatrixserverlib.Join)
+	if direct := directChats(t, accountDB, "bob"); !reflect.DeepEqual(direct, map[string][]string{"@alice:localhost": {testRoomID}}) {
+		t.Errorf("expected the room in the m.direct of bob after joining, got %v", direct)
+	}
+
+	sendMembership(gomatrixserverlib.Leave)
+	if direct := directChats(t, accountDB, "bob"); len(direct) != 0 {
+		t.Errorf("expected the room to be removed from the m.direct of bob after leaving, got %v", direct)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/common/config"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -74,10 +75,17 @@ func DirectoryRoom(
 		// But don't send the query to ourselves.
 		if domain != cfg.Matrix.ServerName {
 			fedRes, fedErr := federation.LookupRoomAlias(req.Context(), domain, roomAlias)
-			if fedErr != nil {
+			if x, ok := fedErr.(gomatrix.HTTPError); ok && x.Code == http.StatusNotFound {
+				return util.JSONResponse{
+					Code: http.StatusNotFound,
+					JSON: jsonerror.NotFound(
+						fmt.Sprintf("Room alias %s not found", roomAlias),
+					),
+				}
+			} else if fedErr != nil {
 				// TODO: Return 502 if the remote server errored.
 				// TODO: Return 504 if the remote server timed out.
-				util.GetLogger(req.Context()).WithError(err).Error("federation.LookupRoomAlias failed")
+				util.GetLogger(req.Context()).WithError(fedErr).Error("federation.LookupRoomAlias failed")
 				return jsonerror.InternalServerError()
 			}
 			res.RoomID = fedRes.RoomID
@@ -109,12 +117,14 @@ func DirectoryRoom(
 }
 
 // SetLocalAlias implements PUT /directory/room/{roomAlias}
-// TODO: Check if the user has the power level to set an alias
+// Users can only create aliases of rooms which they are in, unless they are
+// server admins, and only if the alias_creators allow them to.
 func SetLocalAlias(
 	req *http.Request,
 	device *authtypes.Device,
 	alias string,
 	cfg *config.Dendrite,
+	queryAPI roomserverAPI.RoomserverQueryAPI,
 	aliasAPI roomserverAPI.RoomserverAliasAPI,
 ) util.JSONResponse {
 	_, domain, err := gomatrixserverlib.SplitID('#', alias)
@@ -132,6 +142,13 @@ func SetLocalAlias(
 		}
 	}
 
+	if !cfg.IsAllowedToCreateAlias(device.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to create aliases"),
+		}
+	}
+
 	// Check that the alias does not fall within an exclusive namespace of an
 	// application service
 	// TODO: This code should eventually be refactored with:
@@ -161,6 +178,19 @@ func SetLocalAlias(
 		return *resErr
 	}
 
+	if !cfg.IsServerAdmin(device.UserID) {
+		joined, _, resErr := aliasPermissions(req, r.RoomID, device.UserID, queryAPI)
+		if resErr != nil {
+			return *resErr
+		}
+		if !joined {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You are not in the room"),
+			}
+		}
+	}
+
 	queryReq := roomserverAPI.SetRoomAliasRequest{
 		UserID: device.UserID,
 		RoomID: r.RoomID,
@@ -186,10 +216,15 @@ func SetLocalAlias(
 }
 
 // RemoveLocalAlias implements DELETE /directory/room/{roomAlias}
+// Aliases can be removed by the users who created them, by server admins and
+// by the users in the room whose power level lets them change its canonical
+// alias.
 func RemoveLocalAlias(
 	req *http.Request,
 	device *authtypes.Device,
 	alias string,
+	cfg *config.Dendrite,
+	queryAPI roomserverAPI.RoomserverQueryAPI,
 	aliasAPI roomserverAPI.RoomserverAliasAPI,
 ) util.JSONResponse {
 
@@ -209,11 +244,22 @@ func RemoveLocalAlias(
 		}
 	}
 
-	if creatorQueryRes.UserID != device.UserID {
-		// TODO: Still allow deletion if user is admin
-		return util.JSONResponse{
-			Code: http.StatusForbidden,
-			JSON: jsonerror.Forbidden("You do not have permission to delete this alias"),
+	if creatorQueryRes.UserID != device.UserID && !cfg.IsServerAdmin(device.UserID) {
+		roomQueryReq := roomserverAPI.GetRoomIDForAliasRequest{Alias: alias}
+		var roomQueryRes roomserverAPI.GetRoomIDForAliasResponse
+		if err := aliasAPI.GetRoomIDForAlias(req.Context(), &roomQueryReq, &roomQueryRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.GetRoomIDForAlias failed")
+			return jsonerror.InternalServerError()
+		}
+		_, powerful, resErr := aliasPermissions(req, roomQueryRes.RoomID, device.UserID, queryAPI)
+		if resErr != nil {
+			return *resErr
+		}
+		if !powerful {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You do not have permission to delete this alias"),
+			}
 		}
 	}
 
@@ -232,3 +278,38 @@ func RemoveLocalAlias(
 		JSON: struct{}{},
 	}
 }
+
+// aliasPermissions returns whether a user is joined to a room, and whether
+// their power level in it lets them change the canonical alias of the room.
+func aliasPermissions(
+	req *http.Request, roomID, userID string, queryAPI roomserverAPI.RoomserverQueryAPI,
+) (joined, powerful bool, resErr *util.JSONResponse) {
+	queryReq := roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+			{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""},
+		},
+	}
+	var queryRes roomserverAPI.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryLatestEventsAndState failed")
+		res := jsonerror.InternalServerError()
+		return false, false, &res
+	}
+	var levels gomatrixserverlib.PowerLevelContent
+	levels.Defaults()
+	for _, ev := range queryRes.StateEvents {
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomMember:
+			membership, _ := ev.Membership()
+			joined = membership == gomatrixserverlib.Join
+		case gomatrixserverlib.MRoomPowerLevels:
+			if content, err := gomatrixserverlib.NewPowerLevelContentFromEvent(ev.Unwrap()); err == nil {
+				levels = content
+			}
+		}
+	}
+	powerful = joined && levels.UserLevel(userID) >= levels.EventLevel("m.room.canonical_alias", true)
+	return joined, powerful, nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+func (a testAliases) GetRoomIDForAlias(
+	ctx context.Context,
+	request *api.GetRoomIDForAliasRequest,
+	response *api.GetRoomIDForAliasResponse,
+) error {
+	switch request.Alias {
+	case "#old:localhost", "#legacy:localhost":
+		response.RoomID = testRoomID
+	case "#other:localhost":
+		response.RoomID = "!other:localhost"
+	}
+	return nil
+}
+
+func TestUnknownRemoteAliasIsNotFound(t *testing.T) {
+	cfg := newTestRoom(t).cfg
+	peer := &testFederationPeer{handler: func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/federation/v1/query/directory" || r.URL.Query().Get("room_alias") != "#unknown:remote.example.com" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Room alias not found"}`))
+	}}
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/directory/room/%23unknown:remote.example.com", nil)
+	res := DirectoryRoom(req, "#unknown:remote.example.com", newTestFederationClient(cfg, peer), cfg, testAliases{}, nil)
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d: %v", res.Code, res.JSON)
+	}
+	if errCode := res.JSON.(*jsonerror.MatrixError).ErrCode; errCode != "M_NOT_FOUND" {
+		t.Errorf("expected M_NOT_FOUND, got %s", errCode)
+	}
+	if peer.requests != 1 {
+		t.Errorf("expected the remote server to be asked once, got %d requests", peer.requests)
+	}
+}
+
+// directoryTestAliases stores the aliases which are created and removed in
+// the directory tests, together with their creators.
+type directoryTestAliases struct {
+	api.RoomserverAliasAPI
+	roomIDs  map[string]string
+	creators map[string]string
+}
+
+func newDirectoryTestAliases() *directoryTestAliases {
+	return &directoryTestAliases{roomIDs: make(map[string]string), creators: make(map[string]string)}
+}
+
+func (a *directoryTestAliases) SetRoomAlias(
+	ctx context.Context,
+	request *api.SetRoomAliasRequest,
+	response *api.SetRoomAliasResponse,
+) error {
+	if _, response.AliasExists = a.roomIDs[request.Alias]; !response.AliasExists {
+		a.roomIDs[request.Alias] = request.RoomID
+		a.creators[request.Alias] = request.UserID
+	}
+	return nil
+}
+
+func (a *directoryTestAliases) GetRoomIDForAlias(
+	ctx context.Context,
+	request *api.GetRoomIDForAliasRequest,
+	response *api.GetRoomIDForAliasResponse,
+) error {
+	response.RoomID = a.roomIDs[request.Alias]
+	return nil
+}
+
+func (a *directoryTestAliases) GetCreatorIDForAlias(
+	ctx context.Context,
+	request *api.GetCreatorIDForAliasRequest,
+	response *api.GetCreatorIDForAliasResponse,
+) error {
+	response.UserID = a.creators[request.Alias]
+	return nil
+}
+
+func (a *directoryTestAliases) RemoveRoomAlias(
+	ctx context.Context,
+	request *api.RemoveRoomAliasRequest,
+	response *api.RemoveRoomAliasResponse,
+) error {
+	delete(a.roomIDs, request.Alias)
+	delete(a.creators, request.Alias)
+	return nil
+}
+
+func setLocalAlias(room *testRoom, aliases *directoryTestAliases, userID, alias string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/client/r0/directory/room/"+alias, strings.NewReader(`{"room_id":"`+testRoomID+`"}`))
+	res := SetLocalAlias(req, &authtypes.Device{UserID: userID}, alias, room.cfg, room, aliases)
+	return res.Code, res.JSON
+}
+
+func removeLocalAlias(room *testRoom, aliases *directoryTestAliases, userID, alias string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodDelete, "/_matrix/client/r0/directory/room/"+alias, nil)
+	res := RemoveLocalAlias(req, &authtypes.Device{UserID: userID}, alias, room.cfg, room, aliases)
+	return res.Code, res.JSON
+}
+
+func expectAliasForbidden(t *testing.T, name string, code int, res interface{}) {
+	if code != http.StatusForbidden {
+		t.Errorf("expected 403 for %s, got %d: %v", name, code, res)
+	} else if errCode := res.(*jsonerror.MatrixError).ErrCode; errCode != "M_FORBIDDEN" {
+		t.Errorf("expected M_FORBIDDEN for %s, got %s", name, errCode)
+	}
+}
+
+func TestRemoveAliasOfOtherUserFails(t *testing.T) {
+	room := newTestRoom(t)
+	room.cfg.Matrix.AdminUsers = []string{"@admin:localhost"}
+	room.join("@bob:localhost")
+	aliases := newDirectoryTestAliases()
+	for userID, alias := range map[string]string{
+		"@alice:localhost": "#alice:localhost",
+		"@bob:localhost":   "#bob:localhost",
+	} {
+		if code, res := setLocalAlias(room, aliases, userID, alias); code != http.StatusOK {
+			t.Fatalf("expected 200 OK for creating %s, got %d: %v", alias, code, res)
+		}
+	}
+
+	// Bob has no power in the room, so can only remove the alias he created.
+	code, res := removeLocalAlias(room, aliases, "@bob:localhost", "#alice:localhost")
+	expectAliasForbidden(t, "removing the alias of alice", code, res)
+	if aliases.roomIDs["#alice:localhost"] != testRoomID {
+		t.Errorf("expected the alias of alice to be kept, got %v", aliases.roomIDs)
+	}
+	if code, res = removeLocalAlias(room, aliases, "@bob:localhost", "#bob:localhost"); code != http.StatusOK {
+		t.Errorf("expected 200 OK for bob removing his alias, got %d: %v", code, res)
+	}
+
+	// Alice can change the canonical alias, and server admins can remove any
+	// alias.
+	if code, res = setLocalAlias(room, aliases, "@bob:localhost", "#bob:localhost"); code != http.StatusOK {
+		t.Fatalf("expected 200 OK for creating #bob:localhost again, got %d: %v", code, res)
+	}
+	if code, res = removeLocalAlias(room, aliases, "@alice:localhost", "#bob:localhost"); code != http.StatusOK {
+		t.Errorf("expected 200 OK for alice removing the alias of bob, got %d: %v", code, res)
+	}
+	if code, res = removeLocalAlias(room, aliases, "@admin:localhost", "#alice:localhost"); code != http.StatusOK {
+		t.Errorf("expected 200 OK for a server admin removing the alias of alice, got %d: %v", code, res)
+	}
+	if len(aliases.roomIDs) != 0 {
+		t.Errorf("expected all the aliases to be removed, got %v", aliases.roomIDs)
+	}
+}
+
+func TestSetAliasRequiresPermission(t *testing.T) {
+	room := newTestRoom(t)
+	room.join("@bob:localhost")
+	aliases := newDirectoryTestAliases()
+
+	code, res := setLocalAlias(room, aliases, "@carol:localhost", "#carol:localhost")
+	expectAliasForbidden(t, "a user who isn't in the room", code, res)
+
+	room.cfg.Matrix.AliasCreators = []string{"@alice:localhost"}
+	code, res = setLocalAlias(room, aliases, "@bob:localhost", "#bob:localhost")
+	expectAliasForbidden(t, "a user who isn't in the alias creators", code, res)
+	if code, res = setLocalAlias(room, aliases, "@alice:localhost", "#alice:localhost"); code != http.StatusOK {
+		t.Errorf("expected 200 OK for a user in the alias creators, got %d: %v", code, res)
+	}
+	if _, ok := aliases.roomIDs["#bob:localhost"]; ok || len(aliases.roomIDs) != 1 {
+		t.Errorf("expected only the alias of alice to be created, got %v", aliases.roomIDs)
+	}
+}
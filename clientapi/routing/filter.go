@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"database/sql"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
@@ -42,14 +43,14 @@ func GetFilter(
 	}
 
 	filter, err := accountDB.GetFilter(req.Context(), localpart, filterID)
-	if err != nil {
-		//TODO better error handling. This error message is *probably* right,
-		// but if there are obscure db errors, this will also be returned,
-		// even though it is not correct.
+	if err == sql.ErrNoRows {
 		return util.JSONResponse{
-			Code: http.StatusBadRequest,
+			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("No such filter"),
 		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetFilter failed")
+		return jsonerror.InternalServerError()
 	}
 
 	return util.JSONResponse{
@@ -0,0 +1,80 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var testGuest = &authtypes.Device{ID: "GUEST", UserID: "@guest:localhost", IsGuest: true}
+
+// QueryInvitesForUser finds no invites, as nobody is invited to the test room.
+func (r *testRoom) QueryInvitesForUser(
+	ctx context.Context,
+	request *api.QueryInvitesForUserRequest,
+	response *api.QueryInvitesForUserResponse,
+) error {
+	return nil
+}
+
+func (r *testRoom) guestJoin() (int, interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/join/"+testRoomID, strings.NewReader("{}"))
+	res := JoinRoomByIDOrAlias(
+		req, testGuest, testRoomID, r.cfg, nil, producers.NewRoomserverProducer(r, r),
+		r, nil, gomatrixserverlib.KeyRing{}, &knockTestAccounts{},
+		&producers.SyncAPIProducer{Producer: testSyncProducer{}},
+	)
+	return res.Code, res.JSON
+}
+
+func TestGuestCanJoinRoomWithGuestAccess(t *testing.T) {
+	room := newTestRoom(t)
+	room.addState("@alice:localhost", "m.room.guest_access", "", common.GuestAccessContent{GuestAccess: "can_join"})
+	room.addState("@alice:localhost", gomatrixserverlib.MRoomHistoryVisibility, "", common.HistoryVisibilityContent{HistoryVisibility: "world_readable"})
+
+	if code, res := room.guestJoin(); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	if member := room.sentEvent(testRoomID, gomatrixserverlib.MRoomMember); member["membership"] != gomatrixserverlib.Join {
+		t.Errorf("expected the guest to join the room, got %v", member)
+	}
+}
+
+func TestGuestRejectedFromPrivateRoom(t *testing.T) {
+	room := newTestRoom(t)
+	room.addState("@alice:localhost", gomatrixserverlib.MRoomJoinRules, "", gomatrixserverlib.JoinRuleContent{JoinRule: gomatrixserverlib.Invite})
+
+	code, res := room.guestJoin()
+	if code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d: %v", code, res)
+	}
+	if errCode := res.(*jsonerror.MatrixError).ErrCode; errCode != "M_GUEST_ACCESS_FORBIDDEN" {
+		t.Errorf("expected M_GUEST_ACCESS_FORBIDDEN, got %s", errCode)
+	}
+	if len(room.sent) != 0 {
+		t.Errorf("expected no events to be sent, got %d", len(room.sent))
+	}
+}
@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
@@ -29,6 +30,7 @@ import (
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -48,6 +50,7 @@ func JoinRoomByIDOrAlias(
 	aliasAPI roomserverAPI.RoomserverAliasAPI,
 	keyRing gomatrixserverlib.KeyRing,
 	accountDB accounts.Database,
+	syncProducer *producers.SyncAPIProducer,
 ) util.JSONResponse {
 	var content map[string]interface{} // must be a JSON object
 	if resErr := httputil.UnmarshalJSONRequest(req, &content); resErr != nil {
@@ -79,7 +82,8 @@ func JoinRoomByIDOrAlias(
 	content["avatar_url"] = profile.AvatarURL
 
 	r := joinRoomReq{
-		req, evTime, content, device.UserID, cfg, federation, producer, queryAPI, aliasAPI, keyRing,
+		req, evTime, content, device, cfg, federation, producer, queryAPI, aliasAPI, keyRing,
+		accountDB, syncProducer, serverNameHints(req),
 	}
 
 	if strings.HasPrefix(roomIDOrAlias, "!") {
@@ -101,13 +105,40 @@ type joinRoomReq struct {
 	req        *http.Request
 	evTime     time.Time
 	content    map[string]interface{}
-	userID     string
+	device     *authtypes.Device
 	cfg        *config.Dendrite
 	federation *gomatrixserverlib.FederationClient
 	producer   *producers.RoomserverProducer
 	queryAPI   roomserverAPI.RoomserverQueryAPI
 	aliasAPI   roomserverAPI.RoomserverAliasAPI
 	keyRing    gomatrixserverlib.KeyRing
+	// Used to mark the room as a direct chat if the invite said it was one.
+	accountDB    accounts.Database
+	syncProducer *producers.SyncAPIProducer
+	// The servers which the client suggested joining through.
+	viaServers []gomatrixserverlib.ServerName
+}
+
+// serverNameHints returns the servers which the client suggests joining or
+// knocking through, given as server_name or via query parameters. The hints
+// which aren't valid server names are skipped, and each server is only
+// returned once.
+func serverNameHints(req *http.Request) []gomatrixserverlib.ServerName {
+	query := req.URL.Query()
+	servers := []gomatrixserverlib.ServerName{}
+	seen := map[gomatrixserverlib.ServerName]bool{}
+	for _, hint := range append(query["server_name"], query["via"]...) {
+		serverName := gomatrixserverlib.ServerName(hint)
+		if _, _, valid := gomatrixserverlib.ParseAndValidateServerName(serverName); !valid {
+			util.GetLogger(req.Context()).WithField("server_name", hint).Warn("Ignoring invalid server name hint")
+			continue
+		}
+		if !seen[serverName] {
+			seen[serverName] = true
+			servers = append(servers, serverName)
+		}
+	}
+	return servers
 }
 
 // joinRoomByID joins a room by room ID
@@ -119,7 +150,7 @@ func (r joinRoomReq) joinRoomByID(roomID string) util.JSONResponse {
 	// remote server the invite came from in order to request a join event
 	// from that server.
 	queryReq := roomserverAPI.QueryInvitesForUserRequest{
-		RoomID: roomID, TargetUserID: r.userID,
+		RoomID: roomID, TargetUserID: r.device.UserID,
 	}
 	var queryRes roomserverAPI.QueryInvitesForUserResponse
 	if err := r.queryAPI.QueryInvitesForUser(r.req.Context(), &queryReq, &queryRes); err != nil {
@@ -127,35 +158,25 @@ func (r joinRoomReq) joinRoomByID(roomID string) util.JSONResponse {
 		return jsonerror.InternalServerError()
 	}
 
-	servers := []gomatrixserverlib.ServerName{}
-	seenInInviterIDs := map[gomatrixserverlib.ServerName]bool{}
+	// The servers suggested by the client are tried first, as they are the
+	// only ones we know of if there is no invite.
+	servers := append([]gomatrixserverlib.ServerName{}, r.viaServers...)
 	for _, userID := range queryRes.InviteSenderUserIDs {
 		_, domain, err := gomatrixserverlib.SplitID('@', userID)
 		if err != nil {
 			util.GetLogger(r.req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 			return jsonerror.InternalServerError()
 		}
-		if !seenInInviterIDs[domain] {
-			servers = append(servers, domain)
-			seenInInviterIDs[domain] = true
-		}
-	}
-
-	// Also add the domain extracted from the roomID as a last resort to join
-	// in case the client is erroneously trying to join by ID without an invite
-	// or all previous attempts at domains extracted from the inviter IDs fail
-	// Note: It's no guarantee we'll succeed because a room isn't bound to the domain in its ID
-	_, domain, err := gomatrixserverlib.SplitID('!', roomID)
-	if err != nil {
-		util.GetLogger(r.req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
-		return jsonerror.InternalServerError()
-	}
-	if domain != r.cfg.Matrix.ServerName && !seenInInviterIDs[domain] {
 		servers = append(servers, domain)
 	}
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Room ID must be in the form '!localpart:domain'"),
+		}
+	}
 
 	return r.joinRoomUsingServers(roomID, servers)
-
 }
 
 // joinRoomByAlias joins a room using a room alias.
@@ -191,6 +212,15 @@ func (r joinRoomReq) joinRoomByAlias(roomAlias string) util.JSONResponse {
 func (r joinRoomReq) joinRoomByRemoteAlias(
 	domain gomatrixserverlib.ServerName, roomAlias string,
 ) util.JSONResponse {
+	if r.cfg.Matrix.FederationDisabled {
+		return federationDisabledResponse()
+	}
+	if !r.cfg.IsFederationAllowed(domain) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(fmt.Sprintf("This server doesn't federate with %s", domain)),
+		}
+	}
 	resp, err := r.federation.LookupRoomAlias(r.req.Context(), domain, roomAlias)
 	if err != nil {
 		switch x := err.(type) {
@@ -206,7 +236,7 @@ func (r joinRoomReq) joinRoomByRemoteAlias(
 		return jsonerror.InternalServerError()
 	}
 
-	return r.joinRoomUsingServers(resp.RoomID, resp.Servers)
+	return r.joinRoomUsingServers(resp.RoomID, append(resp.Servers, r.viaServers...))
 }
 
 func (r joinRoomReq) writeToBuilder(eb *gomatrixserverlib.EventBuilder, roomID string) error {
@@ -222,8 +252,8 @@ func (r joinRoomReq) writeToBuilder(eb *gomatrixserverlib.EventBuilder, roomID s
 		return err
 	}
 
-	eb.Sender = r.userID
-	eb.StateKey = &r.userID
+	eb.Sender = r.device.UserID
+	eb.StateKey = &r.device.UserID
 	eb.RoomID = roomID
 	eb.Redacts = ""
 
@@ -233,8 +263,71 @@ func (r joinRoomReq) writeToBuilder(eb *gomatrixserverlib.EventBuilder, roomID s
 func (r joinRoomReq) joinRoomUsingServers(
 	roomID string, servers []gomatrixserverlib.ServerName,
 ) util.JSONResponse {
+	blockedReq := roomserverAPI.QueryRoomBlockedRequest{RoomID: roomID}
+	var blockedRes roomserverAPI.QueryRoomBlockedResponse
+	if err := r.queryAPI.QueryRoomBlocked(r.req.Context(), &blockedReq, &blockedRes); err != nil {
+		util.GetLogger(r.req.Context()).WithError(err).Error("r.queryAPI.QueryRoomBlocked failed")
+		return jsonerror.InternalServerError()
+	}
+	if blockedRes.Blocked {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This room has been shut down by the server admin"),
+		}
+	}
+
+	if resErr := common.CheckGuestCanJoin(r.req, r.device, roomID, r.queryAPI); resErr != nil {
+		return *resErr
+	}
+
+	// The invite has to be looked up before joining, as the join replaces it.
+	inviter, err := directChatInviter(r.req.Context(), r.queryAPI, roomID, r.device.UserID)
+	if err != nil {
+		util.GetLogger(r.req.Context()).WithError(err).Error("directChatInviter failed")
+	}
+
+	res := r.sendJoin(roomID, servers)
+	if res.Code == http.StatusOK && inviter != "" {
+		if err = addDirectChat(r.req.Context(), r.accountDB, r.syncProducer, r.device.UserID, inviter, roomID); err != nil {
+			util.GetLogger(r.req.Context()).WithError(err).Error("addDirectChat failed")
+		}
+	}
+	return res
+}
+
+// sendJoin joins the room, either locally if the room is known to the
+// roomserver or through one of the given servers otherwise.
+func (r joinRoomReq) sendJoin(
+	roomID string, servers []gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	// Joins to restricted rooms have to be authorised by a user who is in the
+	// room and can invite. If no user of this server can, then one of the
+	// other servers in the room may.
+	authoriser, err := common.AuthoriseRestrictedJoin(r.req.Context(), r.queryAPI, r.cfg.Matrix.ServerName, roomID, r.device.UserID)
+	switch err {
+	case nil:
+		if authoriser != "" {
+			r.content[auth.JoinAuthorisedViaUsersServer] = authoriser
+		}
+	case common.ErrNotInAllowedRoom:
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not joined to any of the rooms allowed to join this room"),
+		}
+	case common.ErrRestrictedJoinsNotAllowed:
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You must be invited to join this room, as its room version doesn't allow restricted joins"),
+		}
+	case common.ErrNoJoinAuthoriser:
+		return r.sendJoinUsingServers(roomID, servers)
+	default:
+		util.GetLogger(r.req.Context()).WithError(err).Error("common.AuthoriseRestrictedJoin failed")
+		return jsonerror.InternalServerError()
+	}
+
 	var eb gomatrixserverlib.EventBuilder
-	err := r.writeToBuilder(&eb, roomID)
+	err = r.writeToBuilder(&eb, roomID)
 	if err != nil {
 		util.GetLogger(r.req.Context()).WithError(err).Error("r.writeToBuilder failed")
 		return jsonerror.InternalServerError()
@@ -275,7 +368,19 @@ func (r joinRoomReq) joinRoomUsingServers(
 		util.GetLogger(r.req.Context()).WithError(err).Error("common.BuildEvent failed")
 		return jsonerror.InternalServerError()
 	}
+	return r.sendJoinUsingServers(roomID, servers)
+}
 
+// sendJoinUsingServers joins a room which this server isn't in through the
+// first of the candidate servers which lets the user join. The candidates are
+// the given servers followed by the other servers known to be in the room.
+func (r joinRoomReq) sendJoinUsingServers(
+	roomID string, servers []gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	if r.cfg.Matrix.FederationDisabled {
+		return federationDisabledResponse()
+	}
+	servers = r.joinCandidates(roomID, servers)
 	if len(servers) == 0 {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
@@ -321,6 +426,61 @@ func (r joinRoomReq) joinRoomUsingServers(
 	return jsonerror.InternalServerError()
 }
 
+// joinCandidates returns the servers to try to join a remote room through, in
+// order and without duplicates, this server or servers which this server
+// doesn't federate with. The given servers come first, then the servers of
+// the members that the roomserver knows to be joined, in case the user has
+// been in the room before, and then the domain of the room ID as a last
+// resort. A room isn't bound to the domain in its ID, so there's
+// no guarantee that this server is still in the room.
+func (r joinRoomReq) joinCandidates(
+	roomID string, servers []gomatrixserverlib.ServerName,
+) []gomatrixserverlib.ServerName {
+	seen := map[gomatrixserverlib.ServerName]bool{r.cfg.Matrix.ServerName: true}
+	candidates := []gomatrixserverlib.ServerName{}
+	add := func(server gomatrixserverlib.ServerName) {
+		if server != "" && !seen[server] {
+			seen[server] = true
+			if r.cfg.IsFederationAllowed(server) {
+				candidates = append(candidates, server)
+			}
+		}
+	}
+	for _, server := range servers {
+		add(server)
+	}
+
+	queryReq := roomserverAPI.QueryMembershipsForRoomRequest{
+		JoinedOnly: true, RoomID: roomID, Sender: r.device.UserID,
+	}
+	var queryRes roomserverAPI.QueryMembershipsForRoomResponse
+	if err := r.queryAPI.QueryMembershipsForRoom(r.req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(r.req.Context()).WithError(err).Warn("r.queryAPI.QueryMembershipsForRoom failed")
+	}
+	for _, ev := range queryRes.JoinEvents {
+		if ev.StateKey == nil {
+			continue
+		}
+		if _, domain, err := gomatrixserverlib.SplitID('@', *ev.StateKey); err == nil {
+			add(domain)
+		}
+	}
+
+	if _, domain, err := gomatrixserverlib.SplitID('!', roomID); err == nil {
+		add(domain)
+	}
+	return candidates
+}
+
+// federationDisabledResponse is the response to joins which would have to go
+// through other servers when federation is disabled.
+func federationDisabledResponse() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("Federation is disabled on this server, so rooms on other servers can't be joined"),
+	}
+}
+
 // joinRoomUsingServer tries to join a remote room using a given matrix server.
 // If there was a failure communicating with the server or the response from the
 // server was invalid this returns an error.
@@ -336,18 +496,30 @@ func (r joinRoomReq) joinRoomUsingServer(roomID string, server gomatrixserverlib
 	for version := range response.AvailableRoomVersions {
 		supportedVersions = append(supportedVersions, version)
 	}
-	respMakeJoin, err := r.federation.MakeJoin(r.req.Context(), server, roomID, r.userID, supportedVersions)
+	respMakeJoin, err := r.federation.MakeJoin(r.req.Context(), server, roomID, r.device.UserID, supportedVersions)
 	if err != nil {
 		// TODO: Check if the user was not allowed to join the room.
 		return nil, fmt.Errorf("r.federation.MakeJoin: %w", err)
 	}
 
 	// Set all the fields to be what they should be, this should be a no-op
-	// but it's possible that the remote server returned us something "odd"
+	// but it's possible that the remote server returned us something "odd".
+	// The user that the server chose to authorise a join to a restricted
+	// room is kept.
+	authoriser := auth.JoinAuthorisedVia(respMakeJoin.JoinEvent.Content)
 	err = r.writeToBuilder(&respMakeJoin.JoinEvent, roomID)
 	if err != nil {
 		return nil, fmt.Errorf("r.writeToBuilder: %w", err)
 	}
+	if authoriser != "" {
+		content := map[string]interface{}{auth.JoinAuthorisedViaUsersServer: authoriser}
+		for k, v := range r.content {
+			content[k] = v
+		}
+		if err = respMakeJoin.JoinEvent.SetContent(content); err != nil {
+			return nil, fmt.Errorf("respMakeJoin.JoinEvent.SetContent: %w", err)
+		}
+	}
 
 	if respMakeJoin.RoomVersion == "" {
 		respMakeJoin.RoomVersion = gomatrixserverlib.RoomVersionV1
@@ -402,7 +574,9 @@ func (r joinRoomReq) joinRoomUsingServer(roomID string, server gomatrixserverlib
 }
 
 // checkSendJoinResponse checks that all of the signatures are correct
-// and that the join is allowed by the supplied state.
+// and that the join is allowed by the supplied state. The checks are those
+// of gomatrixserverlib.RespSendJoin.Check, but with the auth rules which also
+// know about knocks and restricted rooms.
 func (r joinRoomReq) checkSendJoinResponse(
 	event gomatrixserverlib.Event,
 	server gomatrixserverlib.ServerName,
@@ -416,7 +590,7 @@ func (r joinRoomReq) checkSendJoinResponse(
 retryCheck:
 	// TODO: Can we expand Check here to return a list of missing auth
 	// events rather than failing one at a time?
-	if err := respSendJoin.Check(r.req.Context(), r.keyRing, event); err != nil {
+	if err := checkRespSendJoin(r.req.Context(), r.keyRing, respSendJoin, event); err != nil {
 		switch e := err.(type) {
 		case gomatrixserverlib.MissingAuthEventError:
 			// Check that we haven't already retried for this event, prevents
@@ -446,3 +620,78 @@ retryCheck:
 	}
 	return nil
 }
+
+// checkRespSendJoin checks that the events in the response to /send_join are
+// correctly signed and allowed by their auth events, and that the join event
+// is allowed by both its auth events and the state in the response.
+func checkRespSendJoin(
+	ctx context.Context, keyRing gomatrixserverlib.JSONVerifier,
+	respSendJoin gomatrixserverlib.RespSendJoin, joinEvent gomatrixserverlib.Event,
+) error {
+	var allEvents []gomatrixserverlib.Event
+	allEvents = append(allEvents, respSendJoin.AuthEvents...)
+	stateTuples := map[gomatrixserverlib.StateKeyTuple]bool{}
+	for _, event := range respSendJoin.StateEvents {
+		if event.StateKey() == nil {
+			return fmt.Errorf("state event %q does not have a state key", event.EventID())
+		}
+		tuple := gomatrixserverlib.StateKeyTuple{EventType: event.Type(), StateKey: *event.StateKey()}
+		if stateTuples[tuple] {
+			return fmt.Errorf("duplicate state key tuple (%q, %q)", event.Type(), *event.StateKey())
+		}
+		stateTuples[tuple] = true
+		allEvents = append(allEvents, event)
+	}
+
+	if err := gomatrixserverlib.VerifyAllEventSignatures(ctx, allEvents, keyRing); err != nil {
+		return err
+	}
+	for _, event := range allEvents {
+		if err := common.VerifyRestrictedJoinSignature(ctx, keyRing, event); err != nil {
+			return err
+		}
+	}
+
+	eventsByID := make(map[string]*gomatrixserverlib.Event, len(allEvents))
+	for i := range allEvents {
+		eventsByID[allEvents[i].EventID()] = &allEvents[i]
+	}
+	for _, event := range allEvents {
+		if err := allowedByAuthEvents(event, eventsByID); err != nil {
+			return err
+		}
+	}
+	if err := allowedByAuthEvents(joinEvent, eventsByID); err != nil {
+		return err
+	}
+
+	stateProvider := gomatrixserverlib.NewAuthEvents(nil)
+	for i := range respSendJoin.StateEvents {
+		if err := stateProvider.AddEvent(&respSendJoin.StateEvents[i]); err != nil {
+			return err
+		}
+	}
+	if err := auth.Allowed(joinEvent, &stateProvider); err != nil {
+		return fmt.Errorf("join event %q is not allowed by the supplied state: %w", joinEvent.EventID(), err)
+	}
+	return nil
+}
+
+// allowedByAuthEvents checks that the event is allowed by its auth events,
+// which are looked up by ID. It returns a gomatrixserverlib.MissingAuthEventError
+// if one of them is missing.
+func allowedByAuthEvents(
+	event gomatrixserverlib.Event, eventsByID map[string]*gomatrixserverlib.Event,
+) error {
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for _, authEventID := range event.AuthEventIDs() {
+		authEvent, ok := eventsByID[authEventID]
+		if !ok {
+			return gomatrixserverlib.MissingAuthEventError{AuthEventID: authEventID, ForEventID: event.EventID()}
+		}
+		if err := authEvents.AddEvent(authEvent); err != nil {
+			return err
+		}
+	}
+	return auth.Allowed(event, &authEvents)
+}
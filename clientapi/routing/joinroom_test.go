@@ -0,0 +1,299 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const remoteTestRoomID = "!room:remote.example.com"
+
+// remoteTestRoom is the test room, and doesn't know about any other rooms, so
+// that they have to be joined through other servers.
+type remoteTestRoom struct {
+	*testRoom
+}
+
+func (r *remoteTestRoom) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	if request.RoomID != testRoomID {
+		return nil
+	}
+	return r.testRoom.QueryLatestEventsAndState(ctx, request, response)
+}
+
+func (r *remoteTestRoom) QueryMembershipsForRoom(
+	ctx context.Context,
+	request *api.QueryMembershipsForRoomRequest,
+	response *api.QueryMembershipsForRoomResponse,
+) error {
+	return nil
+}
+
+func (r *remoteTestRoom) QueryRoomVersionCapabilities(
+	ctx context.Context,
+	request *api.QueryRoomVersionCapabilitiesRequest,
+	response *api.QueryRoomVersionCapabilitiesResponse,
+) error {
+	response.DefaultRoomVersion = gomatrixserverlib.RoomVersionV3
+	response.AvailableRoomVersions = map[gomatrixserverlib.RoomVersion]string{
+		gomatrixserverlib.RoomVersionV3: "stable",
+	}
+	return nil
+}
+
+// testKeyDatabase knows the signing key of gone.example.com.
+type testKeyDatabase struct {
+	key ed25519.PublicKey
+}
+
+func (db *testKeyDatabase) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult)
+	for req := range requests {
+		if req.ServerName == "gone.example.com" && req.KeyID == "ed25519:test" {
+			results[req] = gomatrixserverlib.PublicKeyLookupResult{
+				VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64String(db.key)},
+				ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+				ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+			}
+		}
+	}
+	return results, nil
+}
+
+func (db *testKeyDatabase) FetcherName() string { return "testKeyDatabase" }
+
+func (db *testKeyDatabase) StoreKeys(
+	ctx context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	return nil
+}
+
+// joinTestServers are the servers which #room:remote.example.com is said to
+// be on. The room was created by gone.example.com, which has left it, and is
+// on up.example.com, but down.example.com can't be reached.
+type joinTestServers struct {
+	t      *testing.T
+	events []gomatrixserverlib.Event
+	// The servers asked to make a join, in order.
+	tried []string
+	join  *gomatrixserverlib.Event
+}
+
+func newJoinTestServers(t *testing.T) (*joinTestServers, ed25519.PublicKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "gone.example.com"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = privateKey
+	events, err := buildRoomEvents("@bob:gone.example.com", "!room:gone.example.com", []fledglingEvent{
+		{"m.room.create", "", map[string]interface{}{"creator": "@bob:gone.example.com", "room_version": "3"}},
+		{"m.room.member", "@bob:gone.example.com", gomatrixserverlib.MemberContent{Membership: "join"}},
+		{"m.room.power_levels", "", common.InitialPowerLevelsContent("@bob:gone.example.com")},
+		{"m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: "public"}},
+	}, cfg, time.Now(), gomatrixserverlib.RoomVersionV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &joinTestServers{t: t, events: gomatrixserverlib.UnwrapEventHeaders(events)}, publicKey
+}
+
+func (s *joinTestServers) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body interface{}
+	switch {
+	case req.URL.Host == "remote.example.com" && req.URL.Path == "/_matrix/federation/v1/query/directory":
+		body = gomatrixserverlib.RespDirectory{
+			RoomID:  "!room:gone.example.com",
+			Servers: []gomatrixserverlib.ServerName{"down.example.com", "up.example.com"},
+		}
+	case strings.HasPrefix(req.URL.Path, "/_matrix/federation/v1/make_join/"):
+		s.tried = append(s.tried, req.URL.Host)
+		if req.URL.Host != "up.example.com" {
+			return nil, errors.New("connection refused")
+		}
+		last := s.events[len(s.events)-1]
+		body = map[string]interface{}{
+			"room_version": "3",
+			"event": map[string]interface{}{
+				"type": "m.room.member", "room_id": "!room:gone.example.com",
+				"sender": "@alice:localhost", "state_key": "@alice:localhost",
+				"content":     map[string]string{"membership": "join"},
+				"prev_events": []string{last.EventID()},
+				"auth_events": []string{s.events[0].EventID(), s.events[2].EventID(), s.events[3].EventID()},
+				"depth":       last.Depth() + 1,
+			},
+		}
+	case req.URL.Host == "up.example.com" && strings.HasPrefix(req.URL.Path, "/_matrix/federation/v2/send_join/"):
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(content, gomatrixserverlib.RoomVersionV3)
+		if err != nil {
+			return nil, err
+		}
+		s.join = &event
+		body = gomatrixserverlib.RespSendJoin{
+			RespState: gomatrixserverlib.RespState{StateEvents: s.events, AuthEvents: s.events},
+			Origin:    "up.example.com",
+		}
+	default:
+		s.t.Errorf("unexpected request %s %s", req.Method, req.URL)
+		body = struct{}{}
+	}
+	content, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBuffer(content)),
+		Request:    req,
+	}, nil
+}
+
+// joinThroughTestServers joins alice to a room or alias through the test
+// servers, with the given query parameters.
+func joinThroughTestServers(t *testing.T, d *deactivateTest, roomIDOrAlias, query string) (*joinTestServers, util.JSONResponse) {
+	room := &remoteTestRoom{d.room}
+	servers, publicKey := newJoinTestServers(t)
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", servers)
+	cfg := d.room.cfg
+	federation := gomatrixserverlib.NewFederationClientWithTransport(
+		cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, tr,
+	)
+	federation.Client = *gomatrixserverlib.NewClientWithTimeout(0, tr)
+
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/join/"+url.PathEscape(roomIDOrAlias)+"?"+query, strings.NewReader("{}"))
+	res := JoinRoomByIDOrAlias(
+		req, d.device, roomIDOrAlias, cfg, federation, producers.NewRoomserverProducer(room, room),
+		room, nil, gomatrixserverlib.KeyRing{KeyDatabase: &testKeyDatabase{publicKey}}, d.accountDB,
+		&producers.SyncAPIProducer{Producer: testSyncProducer{}},
+	)
+	return servers, res
+}
+
+func TestRemoteJoinFailsOverToNextServer(t *testing.T) {
+	d, cleanup := newDeactivateTest(t)
+	defer cleanup()
+	servers, res := joinThroughTestServers(t, d, "#room:remote.example.com", "")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	if expected := []string{"down.example.com", "up.example.com"}; !reflect.DeepEqual(servers.tried, expected) {
+		t.Errorf("expected joins to be made through %v, got %v", expected, servers.tried)
+	}
+	if servers.join == nil || servers.join.Sender() != "@alice:localhost" {
+		t.Fatal("expected alice's join to be sent to up.example.com")
+	}
+	if len(d.room.sent) == 0 || d.room.sent[len(d.room.sent)-1].EventID() != servers.join.EventID() {
+		t.Errorf("expected the join to be sent to the roomserver")
+	}
+}
+
+func TestRemoteJoinThroughServerNameHints(t *testing.T) {
+	d, cleanup := newDeactivateTest(t)
+	defer cleanup()
+	// The domain of the room ID isn't in the room any more, so the join can
+	// only go through the hints. The invalid and repeated hints are skipped.
+	query := url.Values{
+		"server_name": {"not a server name", "down.example.com"},
+		"via":         {"up.example.com", "down.example.com", ""},
+	}
+	servers, res := joinThroughTestServers(t, d, "!room:gone.example.com", query.Encode())
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	if expected := []string{"down.example.com", "up.example.com"}; !reflect.DeepEqual(servers.tried, expected) {
+		t.Errorf("expected joins to be made through %v, got %v", expected, servers.tried)
+	}
+}
+
+func TestRemoteJoinSkipsServersNotFederatedWith(t *testing.T) {
+	d, cleanup := newDeactivateTest(t)
+	defer cleanup()
+	d.room.cfg.Matrix.FederationBlocklist = []gomatrixserverlib.ServerName{"down.example.com"}
+	// The hints and the alias both point at down.example.com, which mustn't
+	// be sent a join.
+	query := url.Values{"server_name": {"down.example.com"}, "via": {"down.example.com"}}
+	servers, res := joinThroughTestServers(t, d, "#room:remote.example.com", query.Encode())
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	if expected := []string{"up.example.com"}; !reflect.DeepEqual(servers.tried, expected) {
+		t.Errorf("expected joins to be made through %v, got %v", expected, servers.tried)
+	}
+
+	d.room.cfg.Matrix.FederationAllowlist = []gomatrixserverlib.ServerName{"up.example.com"}
+	if _, res = joinThroughTestServers(t, d, "#room:remote.example.com", ""); res.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for an alias on a server not in the allowlist, got %d: %v", res.Code, res.JSON)
+	}
+}
+
+func TestRemoteJoinsFailWithFederationDisabled(t *testing.T) {
+	d, cleanup := newDeactivateTest(t)
+	defer cleanup()
+	d.room.cfg.Matrix.FederationDisabled = true
+	room := &remoteTestRoom{d.room}
+
+	// The federation client is nil, so the joins would fail differently if
+	// they tried to reach the other server.
+	for _, roomIDOrAlias := range []string{remoteTestRoomID, "#room:remote.example.com"} {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/join/"+roomIDOrAlias+"?server_name=remote.example.com", strings.NewReader("{}"))
+		res := JoinRoomByIDOrAlias(
+			req, d.device, roomIDOrAlias, d.room.cfg, nil, producers.NewRoomserverProducer(room, room),
+			room, nil, gomatrixserverlib.KeyRing{}, d.accountDB,
+			&producers.SyncAPIProducer{Producer: testSyncProducer{}},
+		)
+		if res.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d: %v", roomIDOrAlias, res.Code, res.JSON)
+		} else if errCode := res.JSON.(*jsonerror.MatrixError).ErrCode; errCode != "M_FORBIDDEN" {
+			t.Errorf("%s: expected M_FORBIDDEN, got %s", roomIDOrAlias, errCode)
+		}
+	}
+	if len(d.room.sent) != 0 {
+		t.Errorf("expected no events to be sent, got %d", len(d.room.sent))
+	}
+}
@@ -0,0 +1,533 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+type queryKeysRequest struct {
+	DeviceKeys map[string][]string `json:"device_keys"`
+}
+
+type queryKeysResponse struct {
+	Failures        map[string]interface{}               `json:"failures"`
+	DeviceKeys      map[string]map[string]interface{}    `json:"device_keys"`
+	MasterKeys      map[string]authtypes.CrossSigningKey `json:"master_keys"`
+	SelfSigningKeys map[string]authtypes.CrossSigningKey `json:"self_signing_keys"`
+	UserSigningKeys map[string]authtypes.CrossSigningKey `json:"user_signing_keys"`
+}
+
+// QueryKeys implements POST /keys/query
+func QueryKeys(
+	req *http.Request, device *authtypes.Device,
+	cfg *config.Dendrite, deviceDB devices.Database,
+) util.JSONResponse {
+	var r queryKeysRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	res := queryKeysResponse{
+		Failures:        map[string]interface{}{},
+		DeviceKeys:      map[string]map[string]interface{}{},
+		MasterKeys:      map[string]authtypes.CrossSigningKey{},
+		SelfSigningKeys: map[string]authtypes.CrossSigningKey{},
+		UserSigningKeys: map[string]authtypes.CrossSigningKey{},
+	}
+	for userID := range r.DeviceKeys {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Invalid user ID %q", userID)),
+			}
+		}
+		if domain != cfg.Matrix.ServerName {
+			// TODO: Query the keys of remote users over federation.
+			continue
+		}
+
+		deviceKeys, err := deviceDB.DeviceKeysForUser(req.Context(), userID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("deviceDB.DeviceKeysForUser failed")
+			return jsonerror.InternalServerError()
+		}
+		if deviceKeys, err = deviceKeysWithSignatures(req.Context(), deviceDB, userID, deviceKeys); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("deviceKeysWithSignatures failed")
+			return jsonerror.InternalServerError()
+		}
+		// An empty list of devices asks for the keys of all of the devices.
+		res.DeviceKeys[userID] = map[string]interface{}{}
+		for deviceID, keys := range deviceKeys {
+			if len(r.DeviceKeys[userID]) == 0 {
+				res.DeviceKeys[userID][deviceID] = keys
+			}
+		}
+		for _, deviceID := range r.DeviceKeys[userID] {
+			if keys, ok := deviceKeys[deviceID]; ok {
+				res.DeviceKeys[userID][deviceID] = keys
+			}
+		}
+
+		keys, err := crossSigningKeysWithSignatures(req.Context(), deviceDB, userID, device.UserID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("crossSigningKeysWithSignatures failed")
+			return jsonerror.InternalServerError()
+		}
+		if key, ok := keys[authtypes.CrossSigningKeyPurposeMaster]; ok {
+			res.MasterKeys[userID] = key
+		}
+		if key, ok := keys[authtypes.CrossSigningKeyPurposeSelfSigning]; ok {
+			res.SelfSigningKeys[userID] = key
+		}
+		// Users may only see their own user-signing key.
+		if key, ok := keys[authtypes.CrossSigningKeyPurposeUserSigning]; ok && userID == device.UserID {
+			res.UserSigningKeys[userID] = key
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// crossSigningKeysWithSignatures returns the cross-signing keys of the user
+// along with the signatures of their master key which were uploaded by them
+// or by the user making the request.
+func crossSigningKeysWithSignatures(
+	ctx context.Context, deviceDB devices.Database, userID, requestingUserID string,
+) (map[authtypes.CrossSigningKeyPurpose]authtypes.CrossSigningKey, error) {
+	keys, err := deviceDB.CrossSigningKeysForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, ok := keys[authtypes.CrossSigningKeyPurposeMaster]
+	if !ok {
+		return keys, nil
+	}
+	_, masterPublicKey, err := crossSigningPublicKey(masterKey, userID, authtypes.CrossSigningKeyPurposeMaster)
+	if err != nil {
+		return nil, err
+	}
+	sigs, err := deviceDB.CrossSigningSignaturesForKey(ctx, userID, masterPublicKey.Encode())
+	if err != nil {
+		return nil, err
+	}
+	for _, sig := range sigs {
+		if sig.OriginUserID != userID && sig.OriginUserID != requestingUserID {
+			continue
+		}
+		if masterKey.Signatures == nil {
+			masterKey.Signatures = map[string]map[string]string{}
+		}
+		if masterKey.Signatures[sig.OriginUserID] == nil {
+			masterKey.Signatures[sig.OriginUserID] = map[string]string{}
+		}
+		masterKey.Signatures[sig.OriginUserID][sig.OriginKeyID] = sig.Signature
+	}
+	keys[authtypes.CrossSigningKeyPurposeMaster] = masterKey
+	return keys, nil
+}
+
+// deviceKeysWithSignatures adds the signatures of the devices of the user
+// which were made with their self-signing key to the keys of the devices.
+func deviceKeysWithSignatures(
+	ctx context.Context, deviceDB devices.Database, userID string,
+	deviceKeys map[string]json.RawMessage,
+) (map[string]json.RawMessage, error) {
+	for deviceID, keyJSON := range deviceKeys {
+		sigs, err := deviceDB.CrossSigningSignaturesForKey(ctx, userID, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		if len(sigs) == 0 {
+			continue
+		}
+		var keys map[string]json.RawMessage
+		if err = json.Unmarshal(keyJSON, &keys); err != nil {
+			return nil, err
+		}
+		signatures := map[string]map[string]string{}
+		if sigsJSON, ok := keys["signatures"]; ok {
+			if err = json.Unmarshal(sigsJSON, &signatures); err != nil {
+				return nil, err
+			}
+		}
+		for _, sig := range sigs {
+			if sig.OriginUserID != userID {
+				continue
+			}
+			if signatures[userID] == nil {
+				signatures[userID] = map[string]string{}
+			}
+			signatures[userID][sig.OriginKeyID] = sig.Signature
+		}
+		if keys["signatures"], err = json.Marshal(signatures); err != nil {
+			return nil, err
+		}
+		if deviceKeys[deviceID], err = json.Marshal(keys); err != nil {
+			return nil, err
+		}
+	}
+	return deviceKeys, nil
+}
+
+type uploadCrossSigningKeysRequest struct {
+	MasterKey      *authtypes.CrossSigningKey `json:"master_key"`
+	SelfSigningKey *authtypes.CrossSigningKey `json:"self_signing_key"`
+	UserSigningKey *authtypes.CrossSigningKey `json:"user_signing_key"`
+	Auth           *authDict                  `json:"auth"`
+}
+
+// UploadCrossSigningKeys implements POST /keys/device_signing/upload
+// The user must confirm their password to replace keys which they have
+// uploaded before, so that a stolen access token can't replace them.
+func UploadCrossSigningKeys(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite,
+	accountDB accounts.Database, deviceDB devices.Database,
+	deviceListProducer *producers.DeviceListProducer,
+) util.JSONResponse {
+	var r uploadCrossSigningKeysRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	storedKeys, err := deviceDB.CrossSigningKeysForUser(req.Context(), device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.CrossSigningKeysForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	for purpose, key := range map[authtypes.CrossSigningKeyPurpose]*authtypes.CrossSigningKey{
+		authtypes.CrossSigningKeyPurposeMaster:      r.MasterKey,
+		authtypes.CrossSigningKeyPurposeSelfSigning: r.SelfSigningKey,
+		authtypes.CrossSigningKeyPurposeUserSigning: r.UserSigningKey,
+	} {
+		storedKey, ok := storedKeys[purpose]
+		if key == nil || !ok || reflect.DeepEqual(key.Keys, storedKey.Keys) {
+			continue
+		}
+		var localpart string
+		if localpart, _, err = gomatrixserverlib.SplitID('@', device.UserID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			return jsonerror.InternalServerError()
+		}
+		if resErr := passwordAuth(cfg, accountDB, localpart).verify(req, r.Auth); resErr != nil {
+			return *resErr
+		}
+		break
+	}
+
+	keys := map[authtypes.CrossSigningKeyPurpose]authtypes.CrossSigningKey{}
+	masterKey := r.MasterKey
+	if masterKey != nil {
+		keys[authtypes.CrossSigningKeyPurposeMaster] = *masterKey
+	} else if storedKey, ok := storedKeys[authtypes.CrossSigningKeyPurposeMaster]; ok {
+		// The other keys can be replaced without replacing the master key.
+		masterKey = &storedKey
+	}
+	if masterKey == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("A master key must be uploaded"),
+		}
+	}
+	masterKeyID, masterPublicKey, err := crossSigningPublicKey(*masterKey, device.UserID, authtypes.CrossSigningKeyPurposeMaster)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid master key: " + err.Error()),
+		}
+	}
+
+	// The self-signing and user-signing keys must be signed by the master key.
+	for purpose, key := range map[authtypes.CrossSigningKeyPurpose]*authtypes.CrossSigningKey{
+		authtypes.CrossSigningKeyPurposeSelfSigning: r.SelfSigningKey,
+		authtypes.CrossSigningKeyPurposeUserSigning: r.UserSigningKey,
+	} {
+		if key == nil {
+			continue
+		}
+		if _, _, err = crossSigningPublicKey(*key, device.UserID, purpose); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Invalid %s key: %s", purpose, err)),
+			}
+		}
+		signature := key.Signatures[device.UserID][masterKeyID]
+		if err = verifyCrossSigningSignature(*key, device.UserID, masterKeyID, masterPublicKey, signature); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidSignature(fmt.Sprintf("The %s key must be signed by the master key", purpose)),
+			}
+		}
+		keys[purpose] = *key
+	}
+
+	if err = deviceDB.StoreCrossSigningKeys(req.Context(), device.UserID, keys); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.StoreCrossSigningKeys failed")
+		return jsonerror.InternalServerError()
+	}
+	sendDeviceListUpdate(req, deviceListProducer, device.UserID)
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// UploadCrossSigningSignatures implements POST /keys/signatures/upload
+func UploadCrossSigningSignatures(
+	req *http.Request, device *authtypes.Device, deviceDB devices.Database,
+	deviceListProducer *producers.DeviceListProducer,
+) util.JSONResponse {
+	// The signed objects keyed by user ID and then by the ID of the signed key.
+	var r map[string]map[string]struct {
+		Signatures map[string]map[string]string `json:"signatures"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	ownKeys, err := deviceDB.CrossSigningKeysForUser(req.Context(), device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.CrossSigningKeysForUser failed")
+		return jsonerror.InternalServerError()
+	}
+
+	failures := map[string]map[string]*jsonerror.MatrixError{}
+	var sigs []authtypes.CrossSigningSignature
+	for targetUserID, targets := range r {
+		for targetKeyID, signed := range targets {
+			targetSigs, failure, err := verifyUploadedSignatures(
+				req.Context(), deviceDB, device.UserID, ownKeys,
+				targetUserID, targetKeyID, signed.Signatures[device.UserID],
+			)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("verifyUploadedSignatures failed")
+				return jsonerror.InternalServerError()
+			}
+			if failure != nil {
+				if failures[targetUserID] == nil {
+					failures[targetUserID] = map[string]*jsonerror.MatrixError{}
+				}
+				failures[targetUserID][targetKeyID] = failure
+				continue
+			}
+			sigs = append(sigs, targetSigs...)
+		}
+	}
+
+	if err = deviceDB.StoreCrossSigningSignatures(req.Context(), sigs); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.StoreCrossSigningSignatures failed")
+		return jsonerror.InternalServerError()
+	}
+	signedUsers := make(map[string]bool)
+	for _, sig := range sigs {
+		if !signedUsers[sig.TargetUserID] {
+			signedUsers[sig.TargetUserID] = true
+			sendDeviceListUpdate(req, deviceListProducer, sig.TargetUserID)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"failures": failures,
+		},
+	}
+}
+
+// verifyUploadedSignatures checks the signatures which a user uploaded for a
+// key. Users may sign their own devices with their self-signing key, and the
+// master keys of other users with their user-signing key. Returns a failure if
+// the key is unknown or a signature doesn't verify.
+func verifyUploadedSignatures(
+	ctx context.Context, deviceDB devices.Database,
+	userID string, ownKeys map[authtypes.CrossSigningKeyPurpose]authtypes.CrossSigningKey,
+	targetUserID, targetKeyID string, signatures map[string]string,
+) ([]authtypes.CrossSigningSignature, *jsonerror.MatrixError, error) {
+	if targetUserID == userID {
+		return verifyOwnDeviceSignatures(ctx, deviceDB, userID, ownKeys, targetKeyID, signatures)
+	}
+
+	targetKeys, err := deviceDB.CrossSigningKeysForUser(ctx, targetUserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	masterKey, ok := targetKeys[authtypes.CrossSigningKeyPurposeMaster]
+	if !ok {
+		return nil, jsonerror.NotFound("Unknown key"), nil
+	}
+	_, masterPublicKey, err := crossSigningPublicKey(masterKey, targetUserID, authtypes.CrossSigningKeyPurposeMaster)
+	if err != nil || masterPublicKey.Encode() != targetKeyID {
+		return nil, jsonerror.NotFound("Unknown key"), nil
+	}
+
+	userSigningKey, ok := ownKeys[authtypes.CrossSigningKeyPurposeUserSigning]
+	if !ok {
+		return nil, jsonerror.InvalidSignature("A user-signing key must be uploaded to sign other users"), nil
+	}
+	userSigningKeyID, userSigningPublicKey, err := crossSigningPublicKey(userSigningKey, userID, authtypes.CrossSigningKeyPurposeUserSigning)
+	if err != nil {
+		return nil, nil, err
+	}
+	signature, ok := signatures[userSigningKeyID]
+	if !ok {
+		return nil, jsonerror.InvalidSignature("The key must be signed by your user-signing key"), nil
+	}
+	if err = verifyCrossSigningSignature(masterKey, userID, userSigningKeyID, userSigningPublicKey, signature); err != nil {
+		return nil, jsonerror.InvalidSignature("Invalid signature: " + err.Error()), nil
+	}
+
+	return []authtypes.CrossSigningSignature{{
+		OriginUserID: userID,
+		OriginKeyID:  userSigningKeyID,
+		TargetUserID: targetUserID,
+		TargetKeyID:  targetKeyID,
+		Signature:    signature,
+	}}, nil, nil
+}
+
+// verifyOwnDeviceSignatures checks the signatures which a user uploaded for
+// one of their own devices, whose key ID is the device ID.
+func verifyOwnDeviceSignatures(
+	ctx context.Context, deviceDB devices.Database,
+	userID string, ownKeys map[authtypes.CrossSigningKeyPurpose]authtypes.CrossSigningKey,
+	deviceID string, signatures map[string]string,
+) ([]authtypes.CrossSigningSignature, *jsonerror.MatrixError, error) {
+	deviceKeys, err := deviceDB.DeviceKeysForUser(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyJSON, ok := deviceKeys[deviceID]
+	if !ok {
+		// TODO: Allow users to sign their master key with their devices.
+		return nil, jsonerror.NotFound("Unknown key"), nil
+	}
+
+	selfSigningKey, ok := ownKeys[authtypes.CrossSigningKeyPurposeSelfSigning]
+	if !ok {
+		return nil, jsonerror.InvalidSignature("A self-signing key must be uploaded to sign your devices"), nil
+	}
+	selfSigningKeyID, selfSigningPublicKey, err := crossSigningPublicKey(selfSigningKey, userID, authtypes.CrossSigningKeyPurposeSelfSigning)
+	if err != nil {
+		return nil, nil, err
+	}
+	signature, ok := signatures[selfSigningKeyID]
+	if !ok {
+		return nil, jsonerror.InvalidSignature("The device must be signed by your self-signing key"), nil
+	}
+	if err = verifyKeyJSONSignature(keyJSON, userID, selfSigningKeyID, selfSigningPublicKey, signature); err != nil {
+		return nil, jsonerror.InvalidSignature("Invalid signature: " + err.Error()), nil
+	}
+
+	return []authtypes.CrossSigningSignature{{
+		OriginUserID: userID,
+		OriginKeyID:  selfSigningKeyID,
+		TargetUserID: userID,
+		TargetKeyID:  deviceID,
+		Signature:    signature,
+	}}, nil, nil
+}
+
+// crossSigningPublicKey checks that a cross-signing key belongs to the user
+// and has the given purpose, and returns its key ID and public key.
+func crossSigningPublicKey(
+	key authtypes.CrossSigningKey, userID string, purpose authtypes.CrossSigningKeyPurpose,
+) (string, gomatrixserverlib.Base64String, error) {
+	if key.UserID != userID {
+		return "", nil, fmt.Errorf("the key must belong to %s", userID)
+	}
+	hasPurpose := false
+	for _, usage := range key.Usage {
+		if usage == purpose {
+			hasPurpose = true
+			break
+		}
+	}
+	if !hasPurpose {
+		return "", nil, fmt.Errorf("the key must have the usage %q", purpose)
+	}
+	if len(key.Keys) != 1 {
+		return "", nil, fmt.Errorf("the key must have exactly one public key")
+	}
+	for keyID, encoded := range key.Keys {
+		var publicKey gomatrixserverlib.Base64String
+		if err := publicKey.Decode(encoded); err != nil {
+			return "", nil, err
+		}
+		if keyID != "ed25519:"+encoded || len(publicKey) != ed25519.PublicKeySize {
+			return "", nil, fmt.Errorf("the key must be an ed25519 key with the ID ed25519:<public key>")
+		}
+		return keyID, publicKey, nil
+	}
+	return "", nil, nil
+}
+
+// verifyCrossSigningSignature checks that the signature is a valid signature
+// of the key by the signing key.
+func verifyCrossSigningSignature(
+	key authtypes.CrossSigningKey, signingUserID, signingKeyID string,
+	signingKey gomatrixserverlib.Base64String, signature string,
+) error {
+	key.Signatures = nil
+	keyJSON, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return verifyKeyJSONSignature(keyJSON, signingUserID, signingKeyID, signingKey, signature)
+}
+
+// verifyKeyJSONSignature checks that the signature is a valid signature of
+// the JSON of a key by the signing key, ignoring the other signatures of it.
+func verifyKeyJSONSignature(
+	keyJSON json.RawMessage, signingUserID, signingKeyID string,
+	signingKey gomatrixserverlib.Base64String, signature string,
+) error {
+	var key map[string]json.RawMessage
+	if err := json.Unmarshal(keyJSON, &key); err != nil {
+		return err
+	}
+	signaturesJSON, err := json.Marshal(map[string]map[string]string{
+		signingUserID: {signingKeyID: signature},
+	})
+	if err != nil {
+		return err
+	}
+	key["signatures"] = signaturesJSON
+	if keyJSON, err = json.Marshal(key); err != nil {
+		return err
+	}
+	return gomatrixserverlib.VerifyJSON(
+		signingUserID, gomatrixserverlib.KeyID(signingKeyID), ed25519.PublicKey(signingKey), keyJSON,
+	)
+}
@@ -0,0 +1,371 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newKeysTestDB(t *testing.T) (devices.Database, func()) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := devices.NewDatabase("file:"+filepath.Join(dir, "device.db"), nil, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, func() { os.RemoveAll(dir) } // nolint: errcheck
+}
+
+// crossSigningTestKey is a cross-signing key along with its private key.
+type crossSigningTestKey struct {
+	authtypes.CrossSigningKey
+	keyID      string
+	privateKey ed25519.PrivateKey
+}
+
+func newCrossSigningTestKey(t *testing.T, userID string, purpose authtypes.CrossSigningKeyPurpose) crossSigningTestKey {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := gomatrixserverlib.Base64String(publicKey).Encode()
+	return crossSigningTestKey{
+		CrossSigningKey: authtypes.CrossSigningKey{
+			UserID: userID,
+			Usage:  []authtypes.CrossSigningKeyPurpose{purpose},
+			Keys:   map[string]string{"ed25519:" + encoded: encoded},
+		},
+		keyID:      "ed25519:" + encoded,
+		privateKey: privateKey,
+	}
+}
+
+// sign returns the key signed by the signing key.
+func (signer crossSigningTestKey) sign(t *testing.T, key authtypes.CrossSigningKey) authtypes.CrossSigningKey {
+	keyJSON, err := json.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedJSON, err := gomatrixserverlib.SignJSON(
+		signer.UserID, gomatrixserverlib.KeyID(signer.keyID), signer.privateKey, keyJSON,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signed authtypes.CrossSigningKey
+	if err = json.Unmarshal(signedJSON, &signed); err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func keysRequest(
+	t *testing.T, userID string, content interface{},
+	handler func(*http.Request, *authtypes.Device) util.JSONResponse,
+) (int, []byte) {
+	body, err := json.Marshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := handler(
+		httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body)),
+		&authtypes.Device{UserID: userID},
+	)
+	resJSON, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Code, resJSON
+}
+
+// crossSigningTestUser uploads a master key and user-signing key for a user.
+func crossSigningTestUser(t *testing.T, db devices.Database, userID string) (master, userSigning crossSigningTestKey) {
+	master = newCrossSigningTestKey(t, userID, authtypes.CrossSigningKeyPurposeMaster)
+	userSigning = newCrossSigningTestKey(t, userID, authtypes.CrossSigningKeyPurposeUserSigning)
+	code, body := keysRequest(t, userID, map[string]interface{}{
+		"master_key":       master.CrossSigningKey,
+		"user_signing_key": master.sign(t, userSigning.CrossSigningKey),
+	}, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return UploadCrossSigningKeys(req, device, nil, nil, db, &producers.DeviceListProducer{Producer: testSyncProducer{}})
+	})
+	if code != http.StatusOK {
+		t.Fatalf("failed to upload the keys of %s: %d %s", userID, code, body)
+	}
+	return master, userSigning
+}
+
+func queryKeys(t *testing.T, db devices.Database, userID, queriedUserID string) queryKeysResponse {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	code, body := keysRequest(t, userID, map[string]interface{}{
+		"device_keys": map[string][]string{queriedUserID: {}},
+	}, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return QueryKeys(req, device, cfg, db)
+	})
+	if code != http.StatusOK {
+		t.Fatalf("failed to query the keys of %s: %d %s", queriedUserID, code, body)
+	}
+	var res queryKeysResponse
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestUploadedMasterKeyAppearsInKeysQuery(t *testing.T) {
+	db, cleanup := newKeysTestDB(t)
+	defer cleanup()
+
+	master, _ := crossSigningTestUser(t, db, "@alice:localhost")
+	selfSigning := newCrossSigningTestKey(t, "@alice:localhost", authtypes.CrossSigningKeyPurposeSelfSigning)
+	code, body := keysRequest(t, "@alice:localhost", map[string]interface{}{
+		"self_signing_key": master.sign(t, selfSigning.CrossSigningKey),
+	}, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return UploadCrossSigningKeys(req, device, nil, nil, db, &producers.DeviceListProducer{Producer: testSyncProducer{}})
+	})
+	if code != http.StatusOK {
+		t.Fatalf("failed to upload the self-signing key: %d %s", code, body)
+	}
+
+	res := queryKeys(t, db, "@bob:localhost", "@alice:localhost")
+	if got := res.MasterKeys["@alice:localhost"].Keys[master.keyID]; got != master.Keys[master.keyID] {
+		t.Errorf("expected the master key of alice, got %v", res.MasterKeys)
+	}
+	if got := res.SelfSigningKeys["@alice:localhost"].Keys[selfSigning.keyID]; got != selfSigning.Keys[selfSigning.keyID] {
+		t.Errorf("expected the self-signing key of alice, got %v", res.SelfSigningKeys)
+	}
+	if len(res.UserSigningKeys) != 0 {
+		t.Errorf("expected the user-signing key of alice to be hidden from bob, got %v", res.UserSigningKeys)
+	}
+
+	res = queryKeys(t, db, "@alice:localhost", "@alice:localhost")
+	if len(res.UserSigningKeys["@alice:localhost"].Keys) != 1 {
+		t.Errorf("expected alice to see their own user-signing key, got %v", res.UserSigningKeys)
+	}
+}
+
+func TestKeysMustBeSignedByTheMasterKey(t *testing.T) {
+	db, cleanup := newKeysTestDB(t)
+	defer cleanup()
+
+	master := newCrossSigningTestKey(t, "@alice:localhost", authtypes.CrossSigningKeyPurposeMaster)
+	other := newCrossSigningTestKey(t, "@alice:localhost", authtypes.CrossSigningKeyPurposeMaster)
+	selfSigning := newCrossSigningTestKey(t, "@alice:localhost", authtypes.CrossSigningKeyPurposeSelfSigning)
+	code, body := keysRequest(t, "@alice:localhost", map[string]interface{}{
+		"master_key":       master.CrossSigningKey,
+		"self_signing_key": other.sign(t, selfSigning.CrossSigningKey),
+	}, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return UploadCrossSigningKeys(req, device, nil, nil, db, &producers.DeviceListProducer{Producer: testSyncProducer{}})
+	})
+	if code != http.StatusBadRequest || !bytes.Contains(body, []byte("M_INVALID_SIGNATURE")) {
+		t.Errorf("expected 400 M_INVALID_SIGNATURE, got %d %s", code, body)
+	}
+	if res := queryKeys(t, db, "@alice:localhost", "@alice:localhost"); len(res.MasterKeys) != 0 {
+		t.Errorf("expected no keys to be stored, got %v", res.MasterKeys)
+	}
+}
+
+func TestSignaturesRoundTrip(t *testing.T) {
+	db, cleanup := newKeysTestDB(t)
+	defer cleanup()
+
+	aliceMaster, _ := crossSigningTestUser(t, db, "@alice:localhost")
+	_, bobUserSigning := crossSigningTestUser(t, db, "@bob:localhost")
+
+	signed := bobUserSigning.sign(t, aliceMaster.CrossSigningKey)
+	forged := aliceMaster.CrossSigningKey
+	forged.Signatures = map[string]map[string]string{
+		"@bob:localhost": {bobUserSigning.keyID: signed.Signatures["@bob:localhost"][bobUserSigning.keyID][1:] + "A"},
+	}
+	upload := func(key authtypes.CrossSigningKey) (int, []byte) {
+		publicKey := aliceMaster.Keys[aliceMaster.keyID]
+		return keysRequest(t, "@bob:localhost", map[string]interface{}{
+			"@alice:localhost": map[string]interface{}{publicKey: key},
+		}, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return UploadCrossSigningSignatures(req, device, db, &producers.DeviceListProducer{Producer: testSyncProducer{}})
+		})
+	}
+
+	code, body := upload(forged)
+	if code != http.StatusOK || !bytes.Contains(body, []byte("M_INVALID_SIGNATURE")) {
+		t.Errorf("expected the forged signature to be reported as a failure, got %d %s", code, body)
+	}
+	code, body = upload(signed)
+	if code != http.StatusOK || bytes.Contains(body, []byte("M_")) {
+		t.Fatalf("failed to upload the signature: %d %s", code, body)
+	}
+
+	res := queryKeys(t, db, "@bob:localhost", "@alice:localhost")
+	got := res.MasterKeys["@alice:localhost"].Signatures["@bob:localhost"][bobUserSigning.keyID]
+	if want := signed.Signatures["@bob:localhost"][bobUserSigning.keyID]; got != want {
+		t.Errorf("expected the signature %q of bob, got %q", want, got)
+	}
+
+	// The signature is only shown to alice and bob.
+	res = queryKeys(t, db, "@carol:localhost", "@alice:localhost")
+	if _, ok := res.MasterKeys["@alice:localhost"].Signatures["@bob:localhost"]; ok {
+		t.Error("expected the signature of bob to be hidden from carol")
+	}
+}
+
+func TestDevicesCanBeSignedWithTheSelfSigningKey(t *testing.T) {
+	db, cleanup := newKeysTestDB(t)
+	defer cleanup()
+
+	master, _ := crossSigningTestUser(t, db, aliceDevice.UserID)
+	selfSigning := newCrossSigningTestKey(t, aliceDevice.UserID, authtypes.CrossSigningKeyPurposeSelfSigning)
+	code, body := keysRequest(t, aliceDevice.UserID, map[string]interface{}{
+		"self_signing_key": master.sign(t, selfSigning.CrossSigningKey),
+	}, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return UploadCrossSigningKeys(req, device, nil, nil, db, &producers.DeviceListProducer{Producer: testSyncProducer{}})
+	})
+	if code != http.StatusOK {
+		t.Fatalf("failed to upload the self-signing key: %d %s", code, body)
+	}
+	deviceKeys := map[string]interface{}{
+		"user_id":    aliceDevice.UserID,
+		"device_id":  aliceDevice.ID,
+		"algorithms": []string{"m.olm.v1.curve25519-aes-sha2"},
+		"keys":       map[string]string{"ed25519:" + aliceDevice.ID: "devicekey"},
+	}
+	if code, _ = uploadKeys(t, db, map[string]interface{}{"device_keys": deviceKeys}); code != http.StatusOK {
+		t.Fatalf("failed to upload the device keys: %d", code)
+	}
+
+	deviceKeysJSON, err := json.Marshal(deviceKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedJSON, err := gomatrixserverlib.SignJSON(
+		aliceDevice.UserID, gomatrixserverlib.KeyID(selfSigning.keyID), selfSigning.privateKey, deviceKeysJSON,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signed struct {
+		Signatures map[string]map[string]string `json:"signatures"`
+	}
+	if err = json.Unmarshal(signedJSON, &signed); err != nil {
+		t.Fatal(err)
+	}
+	signature := signed.Signatures[aliceDevice.UserID][selfSigning.keyID]
+	upload := func(signature string) (int, []byte) {
+		return keysRequest(t, aliceDevice.UserID, map[string]interface{}{
+			aliceDevice.UserID: map[string]interface{}{aliceDevice.ID: map[string]interface{}{
+				"signatures": map[string]map[string]string{aliceDevice.UserID: {selfSigning.keyID: signature}},
+			}},
+		}, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return UploadCrossSigningSignatures(req, device, db, &producers.DeviceListProducer{Producer: testSyncProducer{}})
+		})
+	}
+
+	code, body = upload(signature[1:] + "A")
+	if code != http.StatusOK || !bytes.Contains(body, []byte("M_INVALID_SIGNATURE")) {
+		t.Errorf("expected the forged signature to be reported as a failure, got %d %s", code, body)
+	}
+	code, body = upload(signature)
+	if code != http.StatusOK || bytes.Contains(body, []byte("M_")) {
+		t.Fatalf("failed to upload the signature: %d %s", code, body)
+	}
+
+	res := queryKeys(t, db, "@bob:localhost", aliceDevice.UserID)
+	var got struct {
+		Signatures map[string]map[string]string `json:"signatures"`
+	}
+	gotJSON, err := json.Marshal(res.DeviceKeys[aliceDevice.UserID][aliceDevice.ID])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(gotJSON, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Signatures[aliceDevice.UserID][selfSigning.keyID] != signature {
+		t.Errorf("expected the device keys to be signed by the self-signing key, got %s", gotJSON)
+	}
+}
+
+func TestReplacingCrossSigningKeysNeedsPassword(t *testing.T) {
+	db, cleanup := newKeysTestDB(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "keys-accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	accountDB, err := accounts.NewDatabase("file:"+filepath.Join(dir, "account.db"), nil, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = accountDB.CreateAccount(context.Background(), "alice", "correct horse", ""); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	upload := func(content map[string]interface{}) (int, []byte) {
+		return keysRequest(t, "@alice:localhost", content, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return UploadCrossSigningKeys(req, device, cfg, accountDB, db, &producers.DeviceListProducer{Producer: testSyncProducer{}})
+		})
+	}
+
+	master, _ := crossSigningTestUser(t, db, "@alice:localhost")
+	// Uploading the same key again doesn't replace it.
+	if code, body := upload(map[string]interface{}{"master_key": master.CrossSigningKey}); code != http.StatusOK {
+		t.Errorf("expected 200 OK for uploading the same master key, got %d %s", code, body)
+	}
+
+	replacement := newCrossSigningTestKey(t, "@alice:localhost", authtypes.CrossSigningKeyPurposeMaster)
+	for name, auth := range map[string]interface{}{
+		"no auth":        nil,
+		"a bad password": map[string]string{"type": "m.login.password", "user": "@alice:localhost", "password": "wrong"},
+	} {
+		code, body := upload(map[string]interface{}{"master_key": replacement.CrossSigningKey, "auth": auth})
+		if code != http.StatusUnauthorized || !bytes.Contains(body, []byte(authtypes.LoginTypePassword)) {
+			t.Errorf("expected 401 with the password flow for %s, got %d %s", name, code, body)
+		}
+	}
+	if res := queryKeys(t, db, "@alice:localhost", "@alice:localhost"); res.MasterKeys["@alice:localhost"].Keys[master.keyID] == "" {
+		t.Fatalf("expected the master key to be kept, got %v", res.MasterKeys)
+	}
+
+	code, body := upload(map[string]interface{}{
+		"master_key": replacement.CrossSigningKey,
+		"auth":       map[string]string{"type": "m.login.password", "user": "@alice:localhost", "password": "correct horse"},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK with the password, got %d %s", code, body)
+	}
+	if res := queryKeys(t, db, "@alice:localhost", "@alice:localhost"); res.MasterKeys["@alice:localhost"].Keys[replacement.keyID] == "" {
+		t.Errorf("expected the master key to be replaced, got %v", res.MasterKeys)
+	}
+}
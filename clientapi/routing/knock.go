@@ -0,0 +1,350 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type knockRoomRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// KnockRoomByIDOrAlias implements the "/knock/{roomIDOrAlias}" API from MSC2403.
+// https://github.com/matrix-org/matrix-doc/pull/2403
+func KnockRoomByIDOrAlias(
+	req *http.Request,
+	device *authtypes.Device,
+	roomIDOrAlias string,
+	cfg *config.Dendrite,
+	federation *gomatrixserverlib.FederationClient,
+	producer *producers.RoomserverProducer,
+	queryAPI roomserverAPI.RoomserverQueryAPI,
+	aliasAPI roomserverAPI.RoomserverAliasAPI,
+	accountDB accounts.Database,
+) util.JSONResponse {
+	var body knockRoomRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+
+	evTime, err := httputil.ParseTSParam(req)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	profile, err := accountDB.GetProfileByLocalpart(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetProfileByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+
+	r := knockRoomReq{
+		req: req, evTime: evTime, userID: device.UserID, cfg: cfg,
+		federation: federation, producer: producer, queryAPI: queryAPI,
+		content: gomatrixserverlib.MemberContent{
+			Membership:  auth.Knock,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+			Reason:      body.Reason,
+		},
+	}
+
+	// The client can tell us which servers to knock through, as we may not
+	// know of any servers in the room.
+	servers := serverNameHints(req)
+
+	switch {
+	case strings.HasPrefix(roomIDOrAlias, "!"):
+		_, domain, err := gomatrixserverlib.SplitID('!', roomIDOrAlias)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("Room ID must be in the form '!localpart:domain'"),
+			}
+		}
+		if domain != cfg.Matrix.ServerName {
+			servers = append(servers, domain)
+		}
+		return r.knockRoomUsingServers(roomIDOrAlias, servers)
+	case strings.HasPrefix(roomIDOrAlias, "#"):
+		_, domain, err := gomatrixserverlib.SplitID('#', roomIDOrAlias)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("Room alias must be in the form '#localpart:domain'"),
+			}
+		}
+		if domain == cfg.Matrix.ServerName {
+			queryReq := roomserverAPI.GetRoomIDForAliasRequest{Alias: roomIDOrAlias}
+			var queryRes roomserverAPI.GetRoomIDForAliasResponse
+			if err = aliasAPI.GetRoomIDForAlias(req.Context(), &queryReq, &queryRes); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.GetRoomIDForAlias failed")
+				return jsonerror.InternalServerError()
+			}
+			if len(queryRes.RoomID) == 0 {
+				return util.JSONResponse{
+					Code: http.StatusNotFound,
+					JSON: jsonerror.NotFound("Room alias " + roomIDOrAlias + " not found."),
+				}
+			}
+			return r.knockRoomUsingServers(queryRes.RoomID, servers)
+		}
+		resp, err := federation.LookupRoomAlias(req.Context(), domain, roomIDOrAlias)
+		if err != nil {
+			if httpErr, ok := err.(gomatrix.HTTPError); ok && httpErr.Code == http.StatusNotFound {
+				return util.JSONResponse{
+					Code: http.StatusNotFound,
+					JSON: jsonerror.NotFound("Room alias not found"),
+				}
+			}
+			util.GetLogger(req.Context()).WithError(err).Error("federation.LookupRoomAlias failed")
+			return jsonerror.InternalServerError()
+		}
+		return r.knockRoomUsingServers(resp.RoomID, append(servers, resp.Servers...))
+	}
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.BadJSON(
+			fmt.Sprintf("Invalid first character '%s' for room ID or alias",
+				string([]rune(roomIDOrAlias)[0])), // Wrapping with []rune makes this call UTF-8 safe
+		),
+	}
+}
+
+type knockRoomReq struct {
+	req        *http.Request
+	evTime     time.Time
+	content    gomatrixserverlib.MemberContent
+	userID     string
+	cfg        *config.Dendrite
+	federation *gomatrixserverlib.FederationClient
+	producer   *producers.RoomserverProducer
+	queryAPI   roomserverAPI.RoomserverQueryAPI
+}
+
+func (r knockRoomReq) writeToBuilder(eb *gomatrixserverlib.EventBuilder, roomID string) error {
+	eb.Type = gomatrixserverlib.MRoomMember
+	if err := eb.SetContent(r.content); err != nil {
+		return err
+	}
+	if err := eb.SetUnsigned(struct{}{}); err != nil {
+		return err
+	}
+	eb.Sender = r.userID
+	eb.StateKey = &r.userID
+	eb.RoomID = roomID
+	eb.Redacts = ""
+	return nil
+}
+
+func (r knockRoomReq) knockRoomUsingServers(
+	roomID string, servers []gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	var eb gomatrixserverlib.EventBuilder
+	if err := r.writeToBuilder(&eb, roomID); err != nil {
+		util.GetLogger(r.req.Context()).WithError(err).Error("r.writeToBuilder failed")
+		return jsonerror.InternalServerError()
+	}
+
+	queryRes := roomserverAPI.QueryLatestEventsAndStateResponse{}
+	event, err := common.BuildEvent(r.req.Context(), &eb, r.cfg, r.evTime, r.queryAPI, &queryRes)
+	if err == nil {
+		// We were able to build the event, so the room is a local room.
+		stateEvents := make([]*gomatrixserverlib.Event, len(queryRes.StateEvents))
+		for i := range queryRes.StateEvents {
+			stateEvents[i] = &queryRes.StateEvents[i].Event
+		}
+		provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+		if err = auth.Allowed(*event, &provider); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(err.Error()),
+			}
+		}
+		if _, err = r.producer.SendEvents(
+			r.req.Context(),
+			[]gomatrixserverlib.HeaderedEvent{
+				(*event).Headered(queryRes.RoomVersion),
+			},
+			r.cfg.Matrix.ServerName,
+			nil,
+		); err != nil {
+			util.GetLogger(r.req.Context()).WithError(err).Error("r.producer.SendEvents failed")
+			return jsonerror.InternalServerError()
+		}
+		return knockRoomResponse(roomID)
+	}
+	if err != common.ErrRoomNoExists {
+		util.GetLogger(r.req.Context()).WithError(err).Error("common.BuildEvent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Otherwise the room is probably federated, so knock through one of the
+	// servers in the room.
+	if len(servers) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("No candidate servers found for room"),
+		}
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		var response *util.JSONResponse
+		response, lastErr = r.knockRoomUsingServer(roomID, server)
+		if lastErr != nil {
+			util.GetLogger(r.req.Context()).WithError(lastErr).WithField("server", server).Warn("Failed to knock on room using server")
+			if r.req.Context().Err() != nil {
+				// The request context has expired so don't bother trying any
+				// more servers.
+				break
+			}
+			continue
+		}
+		return *response
+	}
+
+	util.GetLogger(r.req.Context()).WithError(lastErr).Error("failed to knock through any server")
+	return jsonerror.InternalServerError()
+}
+
+// knockRoomUsingServer tries to knock on a remote room using a given matrix
+// server. If there was a failure communicating with the server or the response
+// from the server was invalid this returns an error.
+// Otherwise this returns a JSONResponse.
+func (r knockRoomReq) knockRoomUsingServer(
+	roomID string, server gomatrixserverlib.ServerName,
+) (*util.JSONResponse, error) {
+	var verReq roomserverAPI.QueryRoomVersionCapabilitiesRequest
+	var verRes roomserverAPI.QueryRoomVersionCapabilitiesResponse
+	if err := r.queryAPI.QueryRoomVersionCapabilities(r.req.Context(), &verReq, &verRes); err != nil {
+		return nil, err
+	}
+	// Whether the room allows knocking is decided by the version in its
+	// create event, which the remote server checks, so offer every version.
+	var vqs []string
+	for roomVersion := range verRes.AvailableRoomVersions {
+		vqs = append(vqs, "ver="+url.QueryEscape(string(roomVersion)))
+	}
+
+	var respMakeKnock gomatrixserverlib.RespMakeJoin
+	path := "/_matrix/federation/v1/make_knock/" +
+		url.PathEscape(roomID) + "/" + url.PathEscape(r.userID) + "?" + strings.Join(vqs, "&")
+	if err := r.federationRequest(http.MethodGet, server, path, nil, &respMakeKnock); err != nil {
+		if httpErr, ok := err.(gomatrix.HTTPError); ok && httpErr.Code == http.StatusForbidden {
+			return &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You are not allowed to knock on this room"),
+			}, nil
+		}
+		return nil, fmt.Errorf("make_knock: %w", err)
+	}
+
+	// Set all the fields to be what they should be, this should be a no-op
+	// but it's possible that the remote server returned us something "odd"
+	if err := r.writeToBuilder(&respMakeKnock.JoinEvent, roomID); err != nil {
+		return nil, fmt.Errorf("r.writeToBuilder: %w", err)
+	}
+	if _, ok := verRes.AvailableRoomVersions[respMakeKnock.RoomVersion]; !ok {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnsupportedRoomVersion(
+				fmt.Sprintf("Room version '%s' is not supported", respMakeKnock.RoomVersion),
+			),
+		}, nil
+	}
+
+	event, err := respMakeKnock.JoinEvent.Build(
+		r.evTime, r.cfg.Matrix.ServerName, r.cfg.Matrix.KeyID,
+		r.cfg.Matrix.PrivateKey, version.BaseRoomVersion(respMakeKnock.RoomVersion),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("respMakeKnock.JoinEvent.Build: %w", err)
+	}
+
+	// TODO: Store the knock and the stripped state of the room that comes
+	// back, so that the user can see the room they knocked on when syncing.
+	var respSendKnock struct {
+		KnockRoomState []gomatrixserverlib.InviteV2StrippedState `json:"knock_room_state"`
+	}
+	path = "/_matrix/federation/v1/send_knock/" +
+		url.PathEscape(roomID) + "/" + url.PathEscape(event.EventID())
+	if err = r.federationRequest(http.MethodPut, server, path, event, &respSendKnock); err != nil {
+		return nil, fmt.Errorf("send_knock: %w", err)
+	}
+
+	response := knockRoomResponse(roomID)
+	return &response, nil
+}
+
+// federationRequest signs and sends a federation request to a remote server.
+// gomatrixserverlib doesn't know about the knocking APIs yet, so we can't use
+// the FederationClient for these requests directly.
+func (r knockRoomReq) federationRequest(
+	method string, server gomatrixserverlib.ServerName, path string,
+	content, response interface{},
+) error {
+	fedReq := gomatrixserverlib.NewFederationRequest(method, server, path)
+	if content != nil {
+		if err := fedReq.SetContent(content); err != nil {
+			return err
+		}
+	}
+	if err := fedReq.Sign(r.cfg.Matrix.ServerName, r.cfg.Matrix.KeyID, r.cfg.Matrix.PrivateKey); err != nil {
+		return err
+	}
+	httpReq, err := fedReq.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	return r.federation.DoRequestAndParseResponse(r.req.Context(), httpReq, response)
+}
+
+func knockRoomResponse(roomID string) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			RoomID string `json:"room_id"`
+		}{roomID},
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// knockTestAccounts returns an empty profile for every user.
+type knockTestAccounts struct {
+	accounts.Database
+}
+
+func (d *knockTestAccounts) GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error) {
+	return &authtypes.Profile{Localpart: localpart}, nil
+}
+
+func knock(
+	t *testing.T, roomID string, cfg *config.Dendrite, federation *gomatrixserverlib.FederationClient,
+	queryAPI api.RoomserverQueryAPI, inputAPI api.RoomserverInputAPI,
+) (int, map[string]interface{}) {
+	req := httptest.NewRequest(
+		http.MethodPost, "/_matrix/client/r0/knock/"+roomID, bytes.NewBufferString(`{"reason":"Let me in"}`),
+	)
+	producer := producers.NewRoomserverProducer(inputAPI, queryAPI)
+	res := KnockRoomByIDOrAlias(
+		req, &authtypes.Device{UserID: "@carol:localhost"}, roomID, cfg, federation, producer,
+		queryAPI, nil, &knockTestAccounts{},
+	)
+	var body map[string]interface{}
+	resJSON, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(resJSON, &body); err != nil {
+		t.Fatal(err)
+	}
+	return res.Code, body
+}
+
+func TestKnockOnLocalRoom(t *testing.T) {
+	room := newTestRoomOfVersion(t, version.RoomVersionKnock)
+	room.addState("@alice:localhost", gomatrixserverlib.MRoomJoinRules, "", gomatrixserverlib.JoinRuleContent{JoinRule: "knock"})
+
+	code, body := knock(t, testRoomID, room.cfg, nil, room, room)
+	if code != http.StatusOK || body["room_id"] != testRoomID {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	member := room.sentEvent(testRoomID, gomatrixserverlib.MRoomMember)
+	if member["membership"] != "knock" || member["reason"] != "Let me in" {
+		t.Errorf("expected a knock to be sent, got %v", member)
+	}
+}
+
+func TestKnockOnLocalRoomNeedsRoomVersionWithKnocking(t *testing.T) {
+	room := newTestRoom(t)
+	room.addState("@alice:localhost", gomatrixserverlib.MRoomJoinRules, "", gomatrixserverlib.JoinRuleContent{JoinRule: "knock"})
+
+	code, body := knock(t, testRoomID, room.cfg, nil, room, room)
+	if code != http.StatusForbidden || !strings.Contains(fmt.Sprint(body["error"]), "doesn't allow knocking") {
+		t.Errorf("expected 403 for a room version without knocking, got %d: %v", code, body)
+	}
+	if len(room.sent) != 0 {
+		t.Errorf("expected no events to be sent, got %d", len(room.sent))
+	}
+}
+
+func TestKnockOnInviteOnlyRoomIsForbidden(t *testing.T) {
+	room := newTestRoom(t)
+	room.addState("@alice:localhost", gomatrixserverlib.MRoomJoinRules, "", gomatrixserverlib.JoinRuleContent{JoinRule: "invite"})
+
+	code, body := knock(t, testRoomID, room.cfg, nil, room, room)
+	if code != http.StatusForbidden || body["errcode"] != "M_FORBIDDEN" {
+		t.Errorf("expected 403 M_FORBIDDEN, got %d: %v", code, body)
+	}
+	if len(room.sent) != 0 {
+		t.Errorf("expected no events to be sent, got %d", len(room.sent))
+	}
+}
+
+// knockTestRemoteRoom is a roomserver which isn't in any room.
+type knockTestRemoteRoom struct {
+	api.RoomserverQueryAPI
+	api.RoomserverInputAPI
+}
+
+func (r *knockTestRemoteRoom) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	response.RoomExists = false
+	return nil
+}
+
+func (r *knockTestRemoteRoom) QueryRoomVersionCapabilities(
+	ctx context.Context,
+	request *api.QueryRoomVersionCapabilitiesRequest,
+	response *api.QueryRoomVersionCapabilitiesResponse,
+) error {
+	response.DefaultRoomVersion = gomatrixserverlib.RoomVersionV3
+	response.AvailableRoomVersions = map[gomatrixserverlib.RoomVersion]string{
+		gomatrixserverlib.RoomVersionV3: "stable",
+		version.RoomVersionKnock:        "unstable",
+	}
+	return nil
+}
+
+// knockTestServer is a remote server in a room which anyone can knock on,
+// whose version is the unstable knocking one.
+type knockTestServer struct {
+	t         *testing.T
+	knock     *gomatrixserverlib.Event
+	knockAuth string
+}
+
+func (s *knockTestServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body string
+	switch {
+	case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/_matrix/federation/v1/make_knock/"):
+		body = `{"room_version":"xyz.amorgan.knock","event":{
+			"type":"m.room.member","room_id":"!remote:example.org",
+			"sender":"@carol:localhost","state_key":"@carol:localhost",
+			"content":{"membership":"knock"},
+			"prev_events":["$prev"],"auth_events":["$create","$join_rules","$power_levels"],"depth":5
+		}}`
+	case req.Method == http.MethodPut && strings.HasPrefix(req.URL.Path, "/_matrix/federation/v1/send_knock/"):
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		// The events of the knocking version are those of version 4.
+		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(content, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			return nil, err
+		}
+		s.knock = &event
+		s.knockAuth = req.Header.Get("Authorization")
+		body = `{"knock_room_state":[]}`
+	default:
+		s.t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+		body = `{}`
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestKnockOnRemoteRoomOverFederation(t *testing.T) {
+	cfg := newTestRoom(t).cfg
+	server := &knockTestServer{t: t}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", server)
+	federation := gomatrixserverlib.NewFederationClientWithTransport(
+		cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, tr,
+	)
+	roomserver := &knockTestRemoteRoom{}
+
+	code, body := knock(t, "!remote:example.org", cfg, federation, roomserver, roomserver)
+	if code != http.StatusOK || body["room_id"] != "!remote:example.org" {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	if server.knock == nil {
+		t.Fatal("expected the knock to be sent to the remote server")
+	}
+	if membership, err := server.knock.Membership(); err != nil || membership != "knock" {
+		t.Errorf("expected a knock, got %q", membership)
+	}
+	if server.knock.Sender() != "@carol:localhost" || !server.knock.StateKeyEquals("@carol:localhost") {
+		t.Errorf("expected carol to knock, got %s", server.knock.JSON())
+	}
+	if !strings.Contains(server.knockAuth, `origin="localhost"`) {
+		t.Errorf("expected the request to be signed by localhost, got %q", server.knockAuth)
+	}
+}
@@ -15,20 +15,25 @@
 package routing
 
 import (
+	"database/sql"
+	"fmt"
 	"net/http"
 
 	"context"
 
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
 )
 
 type loginFlows struct {
@@ -46,12 +51,18 @@ type loginIdentifier struct {
 }
 
 type passwordRequest struct {
+	Type       string          `json:"type"`
 	Identifier loginIdentifier `json:"identifier"`
 	Password   string          `json:"password"`
+	// The login token of an m.login.token login.
+	Token string `json:"token"`
 	// Both DeviceID and InitialDisplayName can be omitted, or empty strings ("")
 	// Thus a pointer is needed to differentiate between the two
 	InitialDisplayName *string `json:"initial_device_display_name"`
 	DeviceID           *string `json:"device_id"`
+	// Whether the client wants a refresh token, so that its access token
+	// expires and has to be refreshed.
+	RefreshToken bool `json:"refresh_token"`
 }
 
 type loginResponse struct {
@@ -59,24 +70,38 @@ type loginResponse struct {
 	AccessToken string                       `json:"access_token"`
 	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
 	DeviceID    string                       `json:"device_id"`
+	// Only given if the client asked for a refresh token.
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
-func passwordLogin() loginFlows {
+func loginFlowsFor(cfg *config.Dendrite) loginFlows {
 	f := loginFlows{}
 	s := flow{"m.login.password", []string{"m.login.password"}}
 	f.Flows = append(f.Flows, s)
+	if len(cfg.Derived.ApplicationServices) != 0 {
+		as := flow{authtypes.LoginTypeApplicationService, []string{authtypes.LoginTypeApplicationService}}
+		f.Flows = append(f.Flows, as)
+	}
+	if cfg.Matrix.SSO.Enabled {
+		f.Flows = append(f.Flows,
+			flow{authtypes.LoginTypeSSO, []string{authtypes.LoginTypeSSO}},
+			flow{authtypes.LoginTypeToken, []string{authtypes.LoginTypeToken}},
+		)
+	}
 	return f
 }
 
 // Login implements GET and POST /login
 func Login(
 	req *http.Request, accountDB accounts.Database, deviceDB devices.Database,
-	cfg *config.Dendrite,
+	asAPI appserviceAPI.AppServiceQueryAPI, cfg *config.Dendrite,
+	deviceListProducer *producers.DeviceListProducer,
 ) util.JSONResponse {
 	if req.Method == http.MethodGet { // TODO: support other forms of login other than password, depending on config options
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: passwordLogin(),
+			JSON: loginFlowsFor(cfg),
 		}
 	} else if req.Method == http.MethodPost {
 		var r passwordRequest
@@ -85,8 +110,18 @@ func Login(
 		if resErr != nil {
 			return *resErr
 		}
-		switch r.Identifier.Type {
-		case "m.id.user":
+		switch {
+		case r.Type == authtypes.LoginTypeApplicationService:
+			acc, resErr = applicationServiceLogin(req, r, accountDB, asAPI, cfg)
+			if resErr != nil {
+				return *resErr
+			}
+		case r.Type == authtypes.LoginTypeToken:
+			acc, resErr = loginTokenLogin(req, r, accountDB)
+			if resErr != nil {
+				return *resErr
+			}
+		case r.Identifier.Type == "m.id.user":
 			if r.Identifier.User == "" {
 				return util.JSONResponse{
 					Code: http.StatusBadRequest,
@@ -120,6 +155,13 @@ func Login(
 			}
 		}
 
+		if acc.Deactivated {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.UserDeactivated("This account has been deactivated"),
+			}
+		}
+
 		token, err := auth.GenerateAccessToken()
 		if err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
@@ -133,15 +175,24 @@ func Login(
 				JSON: jsonerror.Unknown("failed to create device: " + err.Error()),
 			}
 		}
+		sendDeviceListUpdate(req, deviceListProducer, dev.UserID)
 
+		res := loginResponse{
+			UserID:      dev.UserID,
+			AccessToken: dev.AccessToken,
+			HomeServer:  cfg.Matrix.ServerName,
+			DeviceID:    dev.ID,
+		}
+		if lifetime := accessTokenLifetime(r.RefreshToken, cfg); lifetime != 0 {
+			res.RefreshToken, res.ExpiresInMS, err = issueRefreshToken(req.Context(), deviceDB, acc.Localpart, dev.ID, dev.AccessToken, lifetime)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("issueRefreshToken failed")
+				return jsonerror.InternalServerError()
+			}
+		}
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: loginResponse{
-				UserID:      dev.UserID,
-				AccessToken: dev.AccessToken,
-				HomeServer:  cfg.Matrix.ServerName,
-				DeviceID:    dev.ID,
-			},
+			JSON: res,
 		}
 	}
 	return util.JSONResponse{
@@ -150,6 +201,112 @@ func Login(
 	}
 }
 
+// applicationServiceLogin returns the account that an application service is
+// logging in as with an m.login.application_service login. The application
+// service is identified by its as_token, and can log in as any user within its
+// namespaces without a password. If the account doesn't exist yet then the
+// application service is asked whether the user exists, and the account is
+// created if so.
+func applicationServiceLogin(
+	req *http.Request, r passwordRequest, accountDB accounts.Database,
+	asAPI appserviceAPI.AppServiceQueryAPI, cfg *config.Dendrite,
+) (*authtypes.Account, *util.JSONResponse) {
+	accessToken, err := auth.ExtractAccessToken(req)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MissingToken(err.Error()),
+		}
+	}
+	if r.Identifier.Type != "m.id.user" || r.Identifier.User == "" {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("An 'm.id.user' identifier with a 'user' must be supplied."),
+		}
+	}
+	localpart, err := userutil.ParseUsernameParam(r.Identifier.User, &cfg.Matrix.ServerName)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidUsername(err.Error()),
+		}
+	}
+
+	userID := userutil.MakeUserID(localpart, cfg.Matrix.ServerName)
+	appservice, resErr := validateApplicationServiceLogin(cfg, userID, accessToken)
+	if resErr != nil {
+		return nil, resErr
+	}
+
+	util.GetLogger(req.Context()).WithFields(log.Fields{
+		"user":          userID,
+		"appservice_id": appservice.ID,
+	}).Info("Processing application service login request")
+
+	acc, err := accountDB.GetAccountByLocalpart(req.Context(), localpart)
+	if err == nil {
+		return acc, nil
+	}
+	if err != sql.ErrNoRows {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		jsonErr := jsonerror.InternalServerError()
+		return nil, &jsonErr
+	}
+
+	existsReq := appserviceAPI.UserIDExistsRequest{UserID: userID}
+	var existsRes appserviceAPI.UserIDExistsResponse
+	if err = asAPI.UserIDExists(req.Context(), &existsReq, &existsRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.UserIDExists failed")
+		jsonErr := jsonerror.InternalServerError()
+		return nil, &jsonErr
+	}
+	if !existsRes.UserIDExists {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The account does not exist"),
+		}
+	}
+	acc, err = accountDB.CreateAccount(req.Context(), localpart, "", appservice.ID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateAccount failed")
+		jsonErr := jsonerror.InternalServerError()
+		return nil, &jsonErr
+	}
+	return acc, nil
+}
+
+// validateApplicationServiceLogin returns the application service with the
+// given as_token, if the user ID is within its users namespaces.
+func validateApplicationServiceLogin(
+	cfg *config.Dendrite, userID, accessToken string,
+) (*config.ApplicationService, *util.JSONResponse) {
+	var matchedApplicationService *config.ApplicationService
+	for i, appservice := range cfg.Derived.ApplicationServices {
+		if appservice.ASToken == accessToken {
+			matchedApplicationService = &cfg.Derived.ApplicationServices[i]
+			break
+		}
+	}
+	if matchedApplicationService == nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.UnknownToken("Supplied access_token does not match any known application service"),
+		}
+	}
+
+	// The application service's sender is always within its namespace.
+	senderID := userutil.MakeUserID(matchedApplicationService.SenderLocalpart, cfg.Matrix.ServerName)
+	if userID != senderID && !UserIDIsWithinApplicationServiceNamespace(cfg, userID, matchedApplicationService) {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(fmt.Sprintf(
+				"User %s is not within the namespaces of application service %s", userID, matchedApplicationService.ID,
+			)),
+		}
+	}
+	return matchedApplicationService, nil
+}
+
 // getDevice returns a new or existing device
 func getDevice(
 	ctx context.Context,
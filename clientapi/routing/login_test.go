@@ -0,0 +1,70 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+func TestValidationOfApplicationServiceLogins(t *testing.T) {
+	regex := "@_irc_.*:localhost"
+	fakeConfig := config.Dendrite{}
+	fakeConfig.Matrix.ServerName = "localhost"
+	fakeConfig.Derived.ApplicationServices = []config.ApplicationService{{
+		ID:              "IRCBridge",
+		URL:             "null",
+		ASToken:         "1234",
+		HSToken:         "4321",
+		SenderLocalpart: "ircbot",
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"users": {{
+				Exclusive:    true,
+				Regex:        regex,
+				RegexpObject: regexp.MustCompile(regex),
+			}},
+		},
+	}}
+
+	tests := []struct {
+		userID      string
+		accessToken string
+		wantCode    int
+	}{
+		// In the namespace.
+		{"@_irc_alice:localhost", "1234", 0},
+		// The application service's own sender.
+		{"@ircbot:localhost", "1234", 0},
+		// Outside of the namespace.
+		{"@alice:localhost", "1234", http.StatusForbidden},
+		// Not a known application service.
+		{"@_irc_alice:localhost", "xxxx", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		appservice, resErr := validateApplicationServiceLogin(&fakeConfig, tt.userID, tt.accessToken)
+		if tt.wantCode == 0 {
+			if resErr != nil || appservice == nil || appservice.ID != "IRCBridge" {
+				t.Errorf("login as %s should have been allowed: %+v", tt.userID, resErr)
+			}
+			continue
+		}
+		if resErr == nil || resErr.Code != tt.wantCode {
+			t.Errorf("login as %s with token %s should have failed with %d, got %+v", tt.userID, tt.accessToken, tt.wantCode, resErr)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -27,6 +28,7 @@ import (
 // Logout handles POST /logout
 func Logout(
 	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
+	deviceListProducer *producers.DeviceListProducer,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -38,6 +40,7 @@ func Logout(
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveDevice failed")
 		return jsonerror.InternalServerError()
 	}
+	sendDeviceListUpdate(req, deviceListProducer, device.UserID)
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -48,6 +51,7 @@ func Logout(
 // LogoutAll handles POST /logout/all
 func LogoutAll(
 	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
+	deviceListProducer *producers.DeviceListProducer,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -59,6 +63,7 @@ func LogoutAll(
 		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveAllDevices failed")
 		return jsonerror.InternalServerError()
 	}
+	sendDeviceListUpdate(req, deviceListProducer, device.UserID)
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -43,9 +43,23 @@ var errMissingUserID = errors.New("'user_id' must be supplied")
 func SendMembership(
 	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
 	roomID string, membership string, cfg *config.Dendrite,
+	federation *gomatrixserverlib.FederationClient,
 	queryAPI roomserverAPI.RoomserverQueryAPI, asAPI appserviceAPI.AppServiceQueryAPI,
-	producer *producers.RoomserverProducer,
+	producer *producers.RoomserverProducer, syncProducer *producers.SyncAPIProducer,
 ) util.JSONResponse {
+	// Guests can only join rooms which let guests in, and leave rooms.
+	if device.IsGuest && membership != gomatrixserverlib.Join && membership != gomatrixserverlib.Leave {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.GuestAccessForbidden("Guests can only join and leave rooms"),
+		}
+	}
+	if membership == gomatrixserverlib.Join {
+		if resErr := common.CheckGuestCanJoin(req, device, roomID, queryAPI); resErr != nil {
+			return *resErr
+		}
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
 	if err := queryAPI.QueryRoomVersionForRoom(req.Context(), &verReq, &verRes); err != nil {
@@ -68,6 +82,14 @@ func SendMembership(
 		}
 	}
 
+	// Invites to rooms which this server isn't in can only be rejected
+	// through the servers which sent them.
+	if membership == gomatrixserverlib.Leave {
+		if res := rejectRemoteInvite(req, accountDB, device, roomID, body.Reason, cfg, federation, queryAPI, producer); res != nil {
+			return *res
+		}
+	}
+
 	inviteStored, jsonErrResp := checkAndProcessThreepid(
 		req, device, &body, cfg, queryAPI, accountDB, producer,
 		membership, roomID, evTime,
@@ -104,6 +126,14 @@ func SendMembership(
 		return jsonerror.InternalServerError()
 	}
 
+	// The invite has to be looked up before joining, as the join replaces it.
+	var inviter string
+	if membership == gomatrixserverlib.Join {
+		if inviter, err = directChatInviter(req.Context(), queryAPI, roomID, device.UserID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("directChatInviter failed")
+		}
+	}
+
 	if _, err := producer.SendEvents(
 		req.Context(),
 		[]gomatrixserverlib.HeaderedEvent{(*event).Headered(verRes.RoomVersion)},
@@ -114,6 +144,17 @@ func SendMembership(
 		return jsonerror.InternalServerError()
 	}
 
+	// Keep the m.direct of the user in line with the direct chats they are in.
+	if inviter != "" {
+		if err = addDirectChat(req.Context(), accountDB, syncProducer, device.UserID, inviter, roomID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("addDirectChat failed")
+		}
+	} else if membership == gomatrixserverlib.Leave && event.StateKeyEquals(device.UserID) {
+		if err = removeDirectChat(req.Context(), accountDB, syncProducer, device.UserID, roomID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("removeDirectChat failed")
+		}
+	}
+
 	var returnData interface{} = struct{}{}
 
 	// The join membership requires the room id to be sent in the response
@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
@@ -31,6 +32,15 @@ type getMembershipResponse struct {
 	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
 }
 
+type joinedMember struct {
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type getJoinedMembersResponse struct {
+	Joined map[string]joinedMember `json:"joined"`
+}
+
 type getJoinedRoomsResponse struct {
 	JoinedRooms []string `json:"joined_rooms"`
 }
@@ -65,6 +75,45 @@ func GetMemberships(
 	}
 }
 
+// GetJoinedMembers implements GET /rooms/{roomId}/joined_members
+// https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-rooms-roomid-joined-members
+// The members are taken from the current state of the room, which only users
+// who are joined to it may see.
+func GetJoinedMembers(
+	req *http.Request, device *authtypes.Device, roomID string,
+	queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	queryReq := api.QueryLatestEventsAndStateRequest{RoomID: roomID}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryLatestEventsAndState failed")
+		return jsonerror.InternalServerError()
+	}
+
+	joined := make(map[string]joinedMember)
+	for _, ev := range queryRes.StateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+			continue
+		}
+		var content gomatrixserverlib.MemberContent
+		if err := json.Unmarshal(ev.Content(), &content); err != nil || content.Membership != gomatrixserverlib.Join {
+			continue
+		}
+		joined[*ev.StateKey()] = joinedMember{DisplayName: content.DisplayName, AvatarURL: content.AvatarURL}
+	}
+	if _, ok := joined[device.UserID]; !ok {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room."),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: getJoinedMembersResponse{joined},
+	}
+}
+
 func GetJoinedRooms(
 	req *http.Request,
 	device *authtypes.Device,
@@ -0,0 +1,65 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func (r *testRoom) joinedMembers(userID string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/"+testRoomID+"/joined_members", nil)
+	res := GetJoinedMembers(req, &authtypes.Device{UserID: userID}, testRoomID, r)
+	return res.Code, res.JSON
+}
+
+func TestJoinedMembersOnlyListsJoinedUsers(t *testing.T) {
+	room := newTestRoom(t)
+	room.addState("@bob:localhost", gomatrixserverlib.MRoomMember, "@bob:localhost", gomatrixserverlib.MemberContent{
+		Membership: gomatrixserverlib.Join, AvatarURL: "mxc://localhost/bob",
+	})
+	room.join("@carol:localhost")
+	room.addState("@carol:localhost", gomatrixserverlib.MRoomMember, "@carol:localhost", gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Leave})
+
+	code, body := room.joinedMembers("@alice:localhost")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	want := map[string]joinedMember{
+		"@alice:localhost": {DisplayName: "Alice"},
+		"@bob:localhost":   {AvatarURL: "mxc://localhost/bob"},
+	}
+	if got := body.(getJoinedMembersResponse).Joined; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected joined members %v, got %v", want, got)
+	}
+}
+
+func TestJoinedMembersForbiddenForNonMembers(t *testing.T) {
+	room := newTestRoom(t)
+	room.join("@carol:localhost")
+	room.addState("@carol:localhost", gomatrixserverlib.MRoomMember, "@carol:localhost", gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Leave})
+
+	for _, userID := range []string{"@carol:localhost", "@dave:localhost"} {
+		code, body := room.joinedMembers(userID)
+		if code != http.StatusForbidden {
+			t.Errorf("expected 403 for %s, got %d: %v", userID, code, body)
+		}
+	}
+}
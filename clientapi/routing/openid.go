@@ -0,0 +1,84 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// openIDTokenLifetime is how long OpenID tokens can be used for once issued.
+const openIDTokenLifetime = time.Hour
+
+type openIDTokenResponse struct {
+	AccessToken      string                       `json:"access_token"`
+	TokenType        string                       `json:"token_type"`
+	MatrixServerName gomatrixserverlib.ServerName `json:"matrix_server_name"`
+	ExpiresIn        int64                        `json:"expires_in"`
+}
+
+// CreateOpenIDToken implements POST /user/{userID}/openid/request_token
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-user-userid-openid-request-token
+// The token can only be resolved to the user by asking this server for it
+// over federation, and only until it expires.
+func CreateOpenIDToken(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+	userID string, cfg *config.Dendrite,
+) util.JSONResponse {
+	if userID != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("userID does not match the current user"),
+		}
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	token, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	expiresAt := time.Now().Add(openIDTokenLifetime)
+	if err = accountDB.CreateOpenIDToken(req.Context(), &authtypes.OpenIDToken{
+		Token:       token,
+		Localpart:   localpart,
+		ExpiresAtMS: int64(gomatrixserverlib.AsTimestamp(expiresAt)),
+	}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateOpenIDToken failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: openIDTokenResponse{
+			AccessToken:      token,
+			TokenType:        "Bearer",
+			MatrixServerName: cfg.Matrix.ServerName,
+			ExpiresIn:        int64(openIDTokenLifetime / time.Second),
+		},
+	}
+}
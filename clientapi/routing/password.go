@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type newPasswordRequest struct {
+	Auth        *authDict `json:"auth"`
+	NewPassword string    `json:"new_password"`
+	// Whether the other devices of the user are logged out. Defaults to true.
+	LogoutDevices *bool `json:"logout_devices"`
+}
+
+// Password implements POST /account/password
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-account-password
+// The user must confirm their current password. Unless the request says
+// otherwise, all of their devices except the one making the request are then
+// logged out.
+func Password(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite,
+	accountDB accounts.Database, deviceDB devices.Database,
+	deviceListProducer *producers.DeviceListProducer,
+) util.JSONResponse {
+	var r newPasswordRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	// The new password is checked before the user authenticates, so that they
+	// don't have to authenticate again to fix a password which isn't allowed.
+	if r.NewPassword == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'new_password' is required"),
+		}
+	}
+	if resErr := validatePassword(cfg, r.NewPassword); resErr != nil {
+		return *resErr
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	if resErr := passwordAuth(cfg, accountDB, localpart).verify(req, r.Auth); resErr != nil {
+		return *resErr
+	}
+
+	if err = accountDB.SetPassword(req.Context(), localpart, r.NewPassword); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetPassword failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if r.LogoutDevices == nil || *r.LogoutDevices {
+		var userDevices []authtypes.Device
+		if userDevices, err = deviceDB.GetDevicesByLocalpart(req.Context(), localpart); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("deviceDB.GetDevicesByLocalpart failed")
+			return jsonerror.InternalServerError()
+		}
+		var deviceIDs []string
+		for _, userDevice := range userDevices {
+			if userDevice.ID != device.ID {
+				deviceIDs = append(deviceIDs, userDevice.ID)
+			}
+		}
+		if len(deviceIDs) > 0 {
+			if err = deviceDB.RemoveDevices(req.Context(), localpart, deviceIDs); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveDevices failed")
+				return jsonerror.InternalServerError()
+			}
+			sendDeviceListUpdate(req, deviceListProducer, device.UserID)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+)
+
+const alicesPasswordAuth = `"auth": {"type": "m.login.password", "user": "alice", "password": "correct horse"}`
+
+func (d *deactivateTest) changePassword(body string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/account/password", strings.NewReader(body))
+	res := Password(
+		req, d.device, d.room.cfg, d.accountDB, d.deviceDB,
+		&producers.DeviceListProducer{Producer: testSyncProducer{}},
+	)
+	return res.Code, res.JSON
+}
+
+// newPasswordTest is alice with a second device, on a server which requires
+// passwords to be at least 8 characters long.
+func newPasswordTest(t *testing.T) (*deactivateTest, func()) {
+	d, cleanup := newDeactivateTest(t)
+	d.room.cfg.Matrix.PasswordMinLength = 8
+	if _, err := d.deviceDB.CreateDevice(context.Background(), "alice", nil, "alices-other-token", nil); err != nil {
+		t.Fatal(err)
+	}
+	return d, cleanup
+}
+
+func TestChangePassword(t *testing.T) {
+	d, cleanup := newPasswordTest(t)
+	defer cleanup()
+
+	if code, body := d.changePassword(`{"new_password": "battery staple"}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without auth, got %d: %v", code, body)
+	}
+	code, body := d.changePassword(`{"new_password": "battery staple", "logout_devices": false, ` + alicesPasswordAuth + `}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+
+	ctx := context.Background()
+	if _, err := d.accountDB.GetAccountByPassword(ctx, "alice", "battery staple"); err != nil {
+		t.Errorf("expected the new password to be accepted, got %v", err)
+	}
+	if _, err := d.accountDB.GetAccountByPassword(ctx, "alice", "correct horse"); err == nil {
+		t.Error("expected the old password to be refused")
+	}
+	if _, err := d.deviceDB.GetDeviceByAccessToken(ctx, "alices-other-token"); err != nil {
+		t.Errorf("expected the other device to be kept, got %v", err)
+	}
+}
+
+func TestChangePasswordRejectsWeakPassword(t *testing.T) {
+	d, cleanup := newPasswordTest(t)
+	defer cleanup()
+
+	code, body := d.changePassword(`{"new_password": "short", ` + alicesPasswordAuth + `}`)
+	if code != http.StatusBadRequest || body.(*jsonerror.MatrixError).ErrCode != "M_WEAK_PASSWORD" {
+		t.Fatalf("expected 400 M_WEAK_PASSWORD, got %d: %v", code, body)
+	}
+	if _, err := d.accountDB.GetAccountByPassword(context.Background(), "alice", "correct horse"); err != nil {
+		t.Errorf("expected the password to be unchanged, got %v", err)
+	}
+}
+
+func TestChangePasswordLogsOutOtherDevices(t *testing.T) {
+	d, cleanup := newPasswordTest(t)
+	defer cleanup()
+
+	code, body := d.changePassword(`{"new_password": "battery staple", "logout_devices": true, ` + alicesPasswordAuth + `}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	ctx := context.Background()
+	if _, err := d.deviceDB.GetDeviceByAccessToken(ctx, "alices-other-token"); err == nil {
+		t.Error("expected the token of the other device to be revoked")
+	}
+	if _, err := d.deviceDB.GetDeviceByAccessToken(ctx, "alices-token"); err != nil {
+		t.Errorf("expected the device which changed the password to be kept, got %v", err)
+	}
+}
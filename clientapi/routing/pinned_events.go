@@ -0,0 +1,80 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
+)
+
+// checkPinnedEvents returns an error response unless every event which the
+// content of an m.room.pinned_events event pins is an event in the room which
+// hasn't been redacted, and there aren't more of them than the config allows.
+func checkPinnedEvents(
+	req *http.Request, roomID string, content map[string]interface{},
+	cfg *config.Dendrite, queryAPI api.RoomserverQueryAPI,
+) *util.JSONResponse {
+	var pinned common.PinnedEventsContent
+	raw, err := json.Marshal(content)
+	if err == nil {
+		err = json.Unmarshal(raw, &pinned)
+	}
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("pinned must be a list of event IDs"),
+		}
+	}
+	if limit := cfg.Matrix.MaxPinnedEvents; limit > 0 && len(pinned.Pinned) > limit {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam(fmt.Sprintf("At most %d events can be pinned", limit)),
+		}
+	}
+	if len(pinned.Pinned) == 0 {
+		return nil
+	}
+
+	eventsReq := api.QueryEventsByIDRequest{EventIDs: pinned.Pinned, CheckRedactions: true}
+	var eventsRes api.QueryEventsByIDResponse
+	if err = queryAPI.QueryEventsByID(req.Context(), &eventsReq, &eventsRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryEventsByID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	valid := make(map[string]bool, len(eventsRes.Events))
+	for _, ev := range eventsRes.Events {
+		valid[ev.EventID()] = ev.RoomID() == roomID
+	}
+	for _, eventID := range eventsRes.RedactedEventIDs {
+		valid[eventID] = false
+	}
+	for _, eventID := range pinned.Pinned {
+		if !valid[eventID] {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam(fmt.Sprintf("Event %s isn't an event in the room which can be pinned", eventID)),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+)
+
+func (r *testRoom) pin(eventIDs ...string) (int, interface{}) {
+	body, err := json.Marshal(map[string][]string{"pinned": eventIDs})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	stateKey := ""
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/client/r0/rooms/"+testRoomID+"/state/m.room.pinned_events/", strings.NewReader(string(body)))
+	res := SendEvent(
+		req, &authtypes.Device{UserID: "@alice:localhost"}, testRoomID, "m.room.pinned_events", nil, &stateKey,
+		r.cfg, nil, r, testAliases{}, producers.NewRoomserverProducer(r, r), nil,
+	)
+	return res.Code, res.JSON
+}
+
+func TestPinValidEvents(t *testing.T) {
+	room := newTestRoom(t)
+	first, second := room.addMessage("@alice:localhost", "first"), room.addMessage("@alice:localhost", "second")
+	if code, res := room.pin(first, second); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	if code, res := room.pin(); code != http.StatusOK {
+		t.Fatalf("expected unpinning everything to succeed, got %d: %v", code, res)
+	}
+
+	room.cfg.Matrix.MaxPinnedEvents = 1
+	if code, res := room.pin(first, second); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for pinning more events than allowed, got %d: %v", code, res)
+	}
+}
+
+func TestPinInvalidEventsFails(t *testing.T) {
+	room := newTestRoom(t)
+	room.cfg.Matrix.AdminUsers = []string{"@alice:localhost"}
+	message := room.addMessage("@alice:localhost", "hello")
+	if code, res := room.redactUserEvents("@alice:localhost", "@alice:localhost", 0); code != http.StatusOK {
+		t.Fatalf("expected 200 OK from redacting, got %d: %v", code, res)
+	}
+	before := len(room.sent)
+	for name, eventID := range map[string]string{
+		"a nonexistent event": "$nonexistent:localhost",
+		"a redacted event":    message,
+	} {
+		code, res := room.pin(eventID)
+		if code != http.StatusBadRequest {
+			t.Errorf("expected 400 for pinning %s, got %d: %v", name, code, res)
+		} else if errCode := res.(*jsonerror.MatrixError).ErrCode; errCode != "M_INVALID_PARAM" {
+			t.Errorf("expected M_INVALID_PARAM for pinning %s, got %s", name, errCode)
+		}
+	}
+	if len(room.sent) != before {
+		t.Errorf("expected no pinned events to be sent, got %v", room.sent[before:])
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type pinnedKeysResponse struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	// The keys first seen for the server, keyed by key ID.
+	Pinned map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String `json:"pinned"`
+	// The keys seen since which differ from the pinned keys, keyed by key ID.
+	Changed map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String `json:"changed"`
+}
+
+// GetPinnedKeys implements GET /_dendrite/admin/v1/federation/pinned_keys/{serverName}
+// It lists the signing keys which are pinned for an I2P server, and the keys
+// which were seen for it since and flagged because they differ from them.
+func GetPinnedKeys(
+	req *http.Request, device *authtypes.Device, serverName gomatrixserverlib.ServerName,
+	cfg *config.Dendrite, keyDB keydb.Database,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	pinned, changed, err := keyDB.PinnedKeys(req.Context(), serverName)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyDB.PinnedKeys failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(pinned) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("No keys are pinned for this server"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: pinnedKeysResponse{ServerName: serverName, Pinned: pinned, Changed: changed},
+	}
+}
+
+// RepinKeys implements POST /_dendrite/admin/v1/federation/pinned_keys/{serverName}/repin
+// It pins the keys which were flagged for an I2P server in place of the keys
+// they differ from, for when the server has really changed its keys.
+func RepinKeys(
+	req *http.Request, device *authtypes.Device, serverName gomatrixserverlib.ServerName,
+	cfg *config.Dendrite, keyDB keydb.Database,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	if err := keyDB.RepinKeys(req.Context(), serverName); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyDB.RepinKeys failed")
+		return jsonerror.InternalServerError()
+	}
+	return GetPinnedKeys(req, device, serverName, cfg, keyDB)
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/util"
+)
+
+type presenceContentJSON struct {
+	Presence  string  `json:"presence"`
+	StatusMsg *string `json:"status_msg"`
+}
+
+// SetPresence handles PUT /presence/{userID}/status
+// sends the presence update to the EDU server
+func SetPresence(
+	req *http.Request, device *authtypes.Device, userID string,
+	eduProducer *producers.EDUServerProducer,
+) util.JSONResponse {
+	if device.UserID != userID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot set another user's presence"),
+		}
+	}
+
+	var r presenceContentJSON
+	resErr := httputil.UnmarshalJSONRequest(req, &r)
+	if resErr != nil {
+		return *resErr
+	}
+	switch r.Presence {
+	case api.PresenceOnline, api.PresenceUnavailable, api.PresenceOffline:
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("presence must be one of online, unavailable or offline"),
+		}
+	}
+
+	if err := eduProducer.SendPresence(
+		req.Context(), userID, r.Presence, r.StatusMsg,
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("eduProducer.SendPresence failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -17,6 +17,7 @@ package routing
 import (
 	"context"
 	"net/http"
+	"sync"
 	"time"
 
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
@@ -34,6 +35,58 @@ import (
 	"github.com/matrix-org/util"
 )
 
+// remoteProfileLifetime is how long the profiles of remote users are cached
+// for, so that clients showing the same users over and over don't need a
+// round trip to the remote server each time.
+const remoteProfileLifetime = 5 * time.Minute
+
+// remoteProfiles caches the profiles of remote users.
+var remoteProfiles = newRemoteProfileCache()
+
+// remoteProfileCache keeps the profiles of remote users until they expire.
+// It shouldn't be passed by value because it contains a mutex.
+type remoteProfileCache struct {
+	sync.Mutex
+	profiles map[string]cachedProfile
+}
+
+type cachedProfile struct {
+	profile authtypes.Profile
+	expires time.Time
+}
+
+func newRemoteProfileCache() *remoteProfileCache {
+	return &remoteProfileCache{profiles: make(map[string]cachedProfile)}
+}
+
+// get returns the cached profile of a user, or nil if there is no such
+// profile or it has expired.
+func (c *remoteProfileCache) get(userID string) *authtypes.Profile {
+	c.Lock()
+	defer c.Unlock()
+
+	p, ok := c.profiles[userID]
+	if !ok || time.Now().After(p.expires) {
+		return nil
+	}
+	return &p.profile
+}
+
+// add caches the profile of a user. Profiles which have expired are
+// forgotten at the same time.
+func (c *remoteProfileCache) add(userID string, profile authtypes.Profile) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for id, p := range c.profiles {
+		if now.After(p.expires) {
+			delete(c.profiles, id)
+		}
+	}
+	c.profiles[userID] = cachedProfile{profile: profile, expires: now.Add(remoteProfileLifetime)}
+}
+
 // GetProfile implements GET /profile/{userID}
 func GetProfile(
 	req *http.Request, accountDB accounts.Database, cfg *config.Dendrite,
@@ -153,18 +206,9 @@ func SetAvatarURL(
 		AvatarURL:   r.AvatarURL,
 	}
 
-	events, err := buildMembershipEvents(
-		req.Context(), memberships, newProfile, userID, cfg, evTime, queryAPI,
+	updateMembershipProfiles(
+		req.Context(), memberships, newProfile, userID, cfg, evTime, queryAPI, rsProducer,
 	)
-	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("buildMembershipEvents failed")
-		return jsonerror.InternalServerError()
-	}
-
-	if _, err := rsProducer.SendEvents(req.Context(), events, cfg.Matrix.ServerName, nil); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("rsProducer.SendEvents failed")
-		return jsonerror.InternalServerError()
-	}
 
 	if err := producer.SendUpdate(userID, changedKey, oldProfile.AvatarURL, r.AvatarURL); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("producer.SendUpdate failed")
@@ -267,18 +311,9 @@ func SetDisplayName(
 		AvatarURL:   oldProfile.AvatarURL,
 	}
 
-	events, err := buildMembershipEvents(
-		req.Context(), memberships, newProfile, userID, cfg, evTime, queryAPI,
+	updateMembershipProfiles(
+		req.Context(), memberships, newProfile, userID, cfg, evTime, queryAPI, rsProducer,
 	)
-	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("buildMembershipEvents failed")
-		return jsonerror.InternalServerError()
-	}
-
-	if _, err := rsProducer.SendEvents(req.Context(), events, cfg.Matrix.ServerName, nil); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("rsProducer.SendEvents failed")
-		return jsonerror.InternalServerError()
-	}
 
 	if err := producer.SendUpdate(userID, changedKey, oldProfile.DisplayName, r.DisplayName); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("producer.SendUpdate failed")
@@ -292,7 +327,7 @@ func SetDisplayName(
 }
 
 // getProfile gets the full profile of a user by querying the database or a
-// remote homeserver.
+// remote homeserver. The profiles of remote users are cached for a while.
 // Returns an error when something goes wrong or specifically
 // common.ErrProfileNoExists when the profile doesn't exist.
 func getProfile(
@@ -307,6 +342,9 @@ func getProfile(
 	}
 
 	if domain != cfg.Matrix.ServerName {
+		if cached := remoteProfiles.get(userID); cached != nil {
+			return cached, nil
+		}
 		profile, fedErr := federation.LookupProfile(ctx, domain, userID, "")
 		if fedErr != nil {
 			if x, ok := fedErr.(gomatrix.HTTPError); ok {
@@ -318,11 +356,13 @@ func getProfile(
 			return nil, fedErr
 		}
 
-		return &authtypes.Profile{
+		remoteProfile := authtypes.Profile{
 			Localpart:   localpart,
 			DisplayName: profile.DisplayName,
 			AvatarURL:   profile.AvatarURL,
-		}, nil
+		}
+		remoteProfiles.add(userID, remoteProfile)
+		return &remoteProfile, nil
 	}
 
 	profile, err := appserviceAPI.RetrieveUserProfile(ctx, userID, asAPI, accountDB)
@@ -333,46 +373,64 @@ func getProfile(
 	return profile, nil
 }
 
-func buildMembershipEvents(
+// updateMembershipProfiles sends a membership event with the new profile of a
+// user into each of the rooms they are joined to. The rooms are updated one at
+// a time, so that a room whose event can't be built or sent doesn't stop the
+// others from being updated, and the profile change still succeeds.
+func updateMembershipProfiles(
 	ctx context.Context,
 	memberships []authtypes.Membership,
 	newProfile authtypes.Profile, userID string, cfg *config.Dendrite,
 	evTime time.Time, queryAPI api.RoomserverQueryAPI,
-) ([]gomatrixserverlib.HeaderedEvent, error) {
-	evs := []gomatrixserverlib.HeaderedEvent{}
-
+	rsProducer *producers.RoomserverProducer,
+) {
 	for _, membership := range memberships {
-		verReq := api.QueryRoomVersionForRoomRequest{RoomID: membership.RoomID}
-		verRes := api.QueryRoomVersionForRoomResponse{}
-		if err := queryAPI.QueryRoomVersionForRoom(ctx, &verReq, &verRes); err != nil {
-			return []gomatrixserverlib.HeaderedEvent{}, err
+		logger := util.GetLogger(ctx).WithField("room_id", membership.RoomID)
+		event, err := buildProfileMembershipEvent(ctx, membership.RoomID, newProfile, userID, cfg, evTime, queryAPI)
+		if err != nil {
+			logger.WithError(err).Error("Failed to build the membership event with the new profile")
+			continue
 		}
-
-		builder := gomatrixserverlib.EventBuilder{
-			Sender:   userID,
-			RoomID:   membership.RoomID,
-			Type:     "m.room.member",
-			StateKey: &userID,
+		if _, err = rsProducer.SendEvents(ctx, []gomatrixserverlib.HeaderedEvent{*event}, cfg.Matrix.ServerName, nil); err != nil {
+			logger.WithError(err).Error("Failed to send the membership event with the new profile")
 		}
+	}
+}
 
-		content := gomatrixserverlib.MemberContent{
-			Membership: gomatrixserverlib.Join,
-		}
+func buildProfileMembershipEvent(
+	ctx context.Context, roomID string,
+	newProfile authtypes.Profile, userID string, cfg *config.Dendrite,
+	evTime time.Time, queryAPI api.RoomserverQueryAPI,
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
+	verRes := api.QueryRoomVersionForRoomResponse{}
+	if err := queryAPI.QueryRoomVersionForRoom(ctx, &verReq, &verRes); err != nil {
+		return nil, err
+	}
 
-		content.DisplayName = newProfile.DisplayName
-		content.AvatarURL = newProfile.AvatarURL
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     "m.room.member",
+		StateKey: &userID,
+	}
 
-		if err := builder.SetContent(content); err != nil {
-			return nil, err
-		}
+	content := gomatrixserverlib.MemberContent{
+		Membership: gomatrixserverlib.Join,
+	}
 
-		event, err := common.BuildEvent(ctx, &builder, cfg, evTime, queryAPI, nil)
-		if err != nil {
-			return nil, err
-		}
+	content.DisplayName = newProfile.DisplayName
+	content.AvatarURL = newProfile.AvatarURL
+
+	if err := builder.SetContent(content); err != nil {
+		return nil, err
+	}
 
-		evs = append(evs, (*event).Headered(verRes.RoomVersion))
+	event, err := common.BuildEvent(ctx, &builder, cfg, evTime, queryAPI, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	return evs, nil
+	headered := (*event).Headered(verRes.RoomVersion)
+	return &headered, nil
 }
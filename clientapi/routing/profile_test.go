@@ -0,0 +1,182 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const otherRoomID = "!other:localhost"
+
+// failingRoom is a test room whose roomserver refuses events sent into one
+// of the rooms.
+type failingRoom struct {
+	*testRoom
+	failRoomID string
+}
+
+func (r *failingRoom) InputRoomEvents(
+	ctx context.Context,
+	request *api.InputRoomEventsRequest,
+	response *api.InputRoomEventsResponse,
+) error {
+	for _, ire := range request.InputRoomEvents {
+		if ire.Event.RoomID() == r.failRoomID {
+			return errors.New("failed to send the event")
+		}
+	}
+	return r.testRoom.InputRoomEvents(ctx, request, response)
+}
+
+// newProfileTest sets up alice's test accounts, with alice also joined to a
+// second room.
+func newProfileTest(t *testing.T) (*deactivateTest, func()) {
+	d, cleanup := newDeactivateTest(t)
+	events, err := buildRoomEvents("@alice:localhost", otherRoomID, []fledglingEvent{
+		{"m.room.create", "", map[string]interface{}{"creator": "@alice:localhost", "room_version": "3"}},
+		{"m.room.member", "@alice:localhost", gomatrixserverlib.MemberContent{Membership: "join"}},
+	}, d.room.cfg, time.Now(), gomatrixserverlib.RoomVersionV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.accountDB.UpdateMemberships(context.Background(), []gomatrixserverlib.Event{events[1].Unwrap()}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return d, cleanup
+}
+
+func (d *deactivateTest) setDisplayName(room api.RoomserverQueryAPI, inputAPI api.RoomserverInputAPI, name string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/client/r0/profile/@alice:localhost/displayname", strings.NewReader(`{"displayname":"`+name+`"}`))
+	res := SetDisplayName(
+		req, d.accountDB, d.device, d.device.UserID, &producers.UserUpdateProducer{Producer: testSyncProducer{}},
+		d.room.cfg, producers.NewRoomserverProducer(inputAPI, room), room,
+	)
+	return res.Code, res.JSON
+}
+
+// sentDisplayNames returns the display names of alice in the membership
+// events sent into each room.
+func (r *testRoom) sentDisplayNames() map[string]string {
+	names := make(map[string]string)
+	for _, ev := range r.sent {
+		if ev.Type() != gomatrixserverlib.MRoomMember || *ev.StateKey() != "@alice:localhost" {
+			continue
+		}
+		var content gomatrixserverlib.MemberContent
+		if err := json.Unmarshal(ev.Content(), &content); err != nil {
+			r.t.Fatal(err)
+		}
+		if content.Membership == gomatrixserverlib.Join {
+			names[ev.RoomID()] = content.DisplayName
+		}
+	}
+	return names
+}
+
+func TestSetDisplayNameUpdatesEveryJoinedRoom(t *testing.T) {
+	d, cleanup := newProfileTest(t)
+	defer cleanup()
+
+	if code, res := d.setDisplayName(d.room, d.room, "Alice Liddell"); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	names := d.room.sentDisplayNames()
+	if len(names) != 2 || names[testRoomID] != "Alice Liddell" || names[otherRoomID] != "Alice Liddell" {
+		t.Errorf("expected the new display name in both rooms, got %v", names)
+	}
+	profile, err := d.accountDB.GetProfileByLocalpart(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.DisplayName != "Alice Liddell" {
+		t.Errorf("expected the display name to be saved, got %q", profile.DisplayName)
+	}
+}
+
+func TestSetDisplayNameSurvivesFailingRoom(t *testing.T) {
+	d, cleanup := newProfileTest(t)
+	defer cleanup()
+
+	room := &failingRoom{testRoom: d.room, failRoomID: testRoomID}
+	if code, res := d.setDisplayName(room, room, "Alice Liddell"); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	names := d.room.sentDisplayNames()
+	if len(names) != 1 || names[otherRoomID] != "Alice Liddell" {
+		t.Errorf("expected the new display name in only the other room, got %v", names)
+	}
+}
+
+// testFederationPeer answers federation requests with a handler, counting
+// the requests it gets.
+type testFederationPeer struct {
+	handler  http.HandlerFunc
+	requests int32
+}
+
+func (p *testFederationPeer) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&p.requests, 1)
+	w := httptest.NewRecorder()
+	p.handler.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+func newTestFederationClient(cfg *config.Dendrite, peer *testFederationPeer) *gomatrixserverlib.FederationClient {
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", peer)
+	return gomatrixserverlib.NewFederationClientWithTransport(
+		cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, tr,
+	)
+}
+
+func TestRemoteProfileIsCached(t *testing.T) {
+	cfg := newTestRoom(t).cfg
+	peer := &testFederationPeer{handler: func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/federation/v1/query/profile" || r.URL.Query().Get("user_id") != "@bob:remote.example.com" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"displayname":"Bob","avatar_url":"mxc://remote.example.com/bob"}`))
+	}}
+	federation := newTestFederationClient(cfg, peer)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/profile/@bob:remote.example.com", nil)
+		res := GetProfile(req, nil, cfg, "@bob:remote.example.com", nil, federation)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+		}
+		if profile := res.JSON.(common.ProfileResponse); profile.DisplayName != "Bob" || profile.AvatarURL != "mxc://remote.example.com/bob" {
+			t.Errorf("expected the profile of bob, got %+v", profile)
+		}
+	}
+	if requests := atomic.LoadInt32(&peer.requests); requests != 1 {
+		t.Errorf("expected the second lookup to use the cache, got %d requests", requests)
+	}
+}
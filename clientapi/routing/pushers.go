@@ -0,0 +1,126 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/push"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// pushGatewayPath is the path that the URLs of push gateways must have.
+const pushGatewayPath = "/_matrix/push/v1/notify"
+
+type pushersResponse struct {
+	Pushers []authtypes.Pusher `json:"pushers"`
+}
+
+type setPusherRequest struct {
+	authtypes.Pusher
+	// Whether to keep the pushers of other users with the same app ID and
+	// push key, instead of replacing them.
+	Append bool `json:"append"`
+}
+
+// GetPushers implements GET /pushers
+// https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-pushers
+func GetPushers(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	pushers, err := accountDB.GetPushersByLocalpart(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetPushersByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: pushersResponse{Pushers: pushers},
+	}
+}
+
+// SetPusher implements POST /pushers/set
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-pushers-set
+// A pusher without a kind is removed. Only "http" pushers are supported.
+func SetPusher(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	var r setPusherRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.AppID == "" || r.PushKey == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("An app_id and a pushkey are required"),
+		}
+	}
+	if len(r.AppID) > 64 || len(r.PushKey) > 512 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("The app_id or the pushkey is too long"),
+		}
+	}
+
+	if r.Kind == "" {
+		if err = accountDB.RemovePusher(req.Context(), localpart, r.AppID, r.PushKey); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemovePusher failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+	if r.Kind != push.HTTPPusherKind {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Only http pushers are supported"),
+		}
+	}
+	if u, perr := url.Parse(r.Data.URL); perr != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Path != pushGatewayPath {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("The url of an http pusher must be an http(s) URL ending in " + pushGatewayPath),
+		}
+	}
+
+	r.PushKeyTS = int64(gomatrixserverlib.AsTimestamp(time.Now()))
+	if err = accountDB.SetPusher(req.Context(), localpart, &r.Pusher, !r.Append); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetPusher failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
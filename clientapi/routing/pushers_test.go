@@ -0,0 +1,99 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+)
+
+func setPusher(accountDB accounts.Database, userID, body string) int {
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/pushers/set", strings.NewReader(body))
+	return SetPusher(req, &authtypes.Device{UserID: userID}, accountDB).Code
+}
+
+func getPushers(t *testing.T, accountDB accounts.Database, userID string) []authtypes.Pusher {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/pushers", nil)
+	res := GetPushers(req, &authtypes.Device{UserID: userID}, accountDB)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	return res.JSON.(pushersResponse).Pushers
+}
+
+const testPusher = `{
+	"pushkey": "phone", "kind": "http", "app_id": "org.example.app",
+	"app_display_name": "Example", "device_display_name": "Phone", "lang": "en",
+	"data": {"url": "https://push.example.com/_matrix/push/v1/notify", "format": "event_id_only"}
+}`
+
+func TestSetPusher(t *testing.T) {
+	_, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+
+	if code := setPusher(accountDB, "@alice:localhost", testPusher); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", code)
+	}
+	pushers := getPushers(t, accountDB, "@alice:localhost")
+	if len(pushers) != 1 || pushers[0].PushKey != "phone" || pushers[0].AppDisplayName != "Example" ||
+		pushers[0].Data.URL != "https://push.example.com/_matrix/push/v1/notify" || pushers[0].Data.Format != "event_id_only" {
+		t.Fatalf("expected the pusher to be stored, got %+v", pushers)
+	}
+
+	// Registering the same device for another user takes it over, unless
+	// the pusher is appended.
+	if code := setPusher(accountDB, "@bob:localhost", testPusher); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", code)
+	}
+	if pushers = getPushers(t, accountDB, "@alice:localhost"); len(pushers) != 0 {
+		t.Errorf("expected the pusher of alice to be replaced, got %+v", pushers)
+	}
+	appended := strings.Replace(testPusher, `"pushkey"`, `"append": true, "pushkey"`, 1)
+	if code := setPusher(accountDB, "@alice:localhost", appended); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", code)
+	}
+	if pushers = getPushers(t, accountDB, "@bob:localhost"); len(pushers) != 1 {
+		t.Errorf("expected the pusher of bob to be kept, got %+v", pushers)
+	}
+
+	// A null kind removes the pusher.
+	if code := setPusher(accountDB, "@bob:localhost", `{"pushkey": "phone", "kind": null, "app_id": "org.example.app"}`); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", code)
+	}
+	if pushers = getPushers(t, accountDB, "@bob:localhost"); len(pushers) != 0 {
+		t.Errorf("expected the pusher of bob to be removed, got %+v", pushers)
+	}
+}
+
+func TestSetPusherValidatesURL(t *testing.T) {
+	_, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+
+	for _, body := range []string{
+		strings.Replace(testPusher, "https://push.example.com/_matrix/push/v1/notify", "https://push.example.com/", 1),
+		strings.Replace(testPusher, "https://", "ftp://", 1),
+		strings.Replace(testPusher, `"http"`, `"email"`, 1),
+		`{"kind": "http", "app_id": "org.example.app"}`,
+	} {
+		if code := setPusher(accountDB, "@alice:localhost", body); code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", body, code)
+		}
+	}
+}
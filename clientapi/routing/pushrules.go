@@ -0,0 +1,381 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/push"
+	"github.com/matrix-org/dendrite/clientapi/pushrules"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The only scope of push rules.
+const globalPushRulesScope = "global"
+
+type putPushRuleRequest struct {
+	Actions    []*pushrules.Action    `json:"actions"`
+	Conditions []*pushrules.Condition `json:"conditions"`
+	Pattern    string                 `json:"pattern"`
+}
+
+type pushRuleEnabledJSON struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type pushRuleActionsJSON struct {
+	Actions []*pushrules.Action `json:"actions"`
+}
+
+// userPushRules are the push rules of the user making a request.
+type userPushRules struct {
+	localpart string
+	rules     *pushrules.AccountRuleSets
+}
+
+// loadPushRules fetches the push rules of the user of a device.
+func loadPushRules(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database,
+) (*userPushRules, *util.JSONResponse) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	rules, err := push.GetPushRules(req.Context(), accountDB, localpart, device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("push.GetPushRules failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	return &userPushRules{localpart, rules}, nil
+}
+
+// save stores the push rules in the account data of the user, and tells the
+// sync API so that the changes reach the clients of the user.
+func (u *userPushRules) save(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database,
+	syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	content, err := json.Marshal(u.rules)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = accountDB.SaveAccountData(req.Context(), u.localpart, "", push.PushRulesType, string(content)); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveAccountData failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = syncProducer.SendData(device.UserID, "", push.PushRulesType); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// kindRules returns the rules of a kind in a scope, or an error response if
+// the scope or the kind is unknown.
+func (u *userPushRules) kindRules(scope, kind string) (*[]*pushrules.Rule, *util.JSONResponse) {
+	var rules *[]*pushrules.Rule
+	if scope == globalPushRulesScope {
+		rules = u.rules.Global.RulesOfKind(pushrules.Kind(kind))
+	}
+	if rules == nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Unknown push rule scope or kind"),
+		}
+	}
+	return rules, nil
+}
+
+// rule returns the index of a rule in the rules of a kind, or an error
+// response if there is no such rule.
+func (u *userPushRules) rule(scope, kind, ruleID string) (*[]*pushrules.Rule, int, *util.JSONResponse) {
+	rules, resErr := u.kindRules(scope, kind)
+	if resErr != nil {
+		return nil, 0, resErr
+	}
+	if i := ruleIndex(*rules, ruleID); i >= 0 {
+		return rules, i, nil
+	}
+	return nil, 0, &util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Push rule not found"),
+	}
+}
+
+func ruleIndex(rules []*pushrules.Rule, ruleID string) int {
+	for i, rule := range rules {
+		if rule.RuleID == ruleID {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetPushRules implements GET /pushrules/, /pushrules/{scope}/ and
+// /pushrules/{scope}/{kind}/, which return every push rule of the user, those
+// in a scope, and those of a kind.
+// https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-pushrules
+func GetPushRules(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database,
+	scope, kind string,
+) util.JSONResponse {
+	u, resErr := loadPushRules(req, device, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	var res interface{} = u.rules
+	if scope != "" {
+		if scope != globalPushRulesScope {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Unknown push rule scope"),
+			}
+		}
+		res = u.rules.Global
+	}
+	if kind != "" {
+		rules, resErr := u.kindRules(scope, kind)
+		if resErr != nil {
+			return *resErr
+		}
+		res = *rules
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// GetPushRuleByID implements GET /pushrules/{scope}/{kind}/{ruleId}
+func GetPushRuleByID(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database,
+	scope, kind, ruleID string,
+) util.JSONResponse {
+	u, resErr := loadPushRules(req, device, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, i, resErr := u.rule(scope, kind, ruleID)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: (*rules)[i],
+	}
+}
+
+// PutPushRuleByID implements PUT /pushrules/{scope}/{kind}/{ruleId}
+// It adds a rule of the user, or replaces the actions and conditions of one.
+// New rules are placed after the other rules of the user of the same kind,
+// unless the "before" or "after" query parameter names one of them.
+// https://matrix.org/docs/spec/client_server/r0.6.0#put-matrix-client-r0-pushrules-scope-kind-ruleid
+func PutPushRuleByID(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database,
+	scope, kind, ruleID string, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	var r putPushRuleRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Actions == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Push rules need actions"),
+		}
+	}
+	if strings.HasPrefix(ruleID, ".") || strings.ContainsAny(ruleID, `/\`) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Push rule IDs can't start with a dot or contain slashes"),
+		}
+	}
+	if pushrules.Kind(kind) == pushrules.ContentKind && r.Pattern == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Content push rules need a pattern"),
+		}
+	}
+
+	u, resErr := loadPushRules(req, device, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, resErr := u.kindRules(scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	rule := &pushrules.Rule{RuleID: ruleID, Enabled: true, Actions: r.Actions}
+	switch pushrules.Kind(kind) {
+	case pushrules.OverrideKind, pushrules.UnderrideKind:
+		rule.Conditions = r.Conditions
+		if rule.Conditions == nil {
+			rule.Conditions = []*pushrules.Condition{}
+		}
+	case pushrules.ContentKind:
+		rule.Pattern = r.Pattern
+	}
+
+	// Updated rules stay where they are unless asked to move.
+	i := ruleIndex(*rules, ruleID)
+	if i >= 0 {
+		*rules = append((*rules)[:i], (*rules)[i+1:]...)
+	} else {
+		i = len(*rules)
+		for j, other := range *rules {
+			// User rules are more important than server-default rules, which
+			// the master rule is the exception to.
+			if other.Default && other.RuleID != ".m.rule.master" {
+				i = j
+				break
+			}
+		}
+	}
+	query := req.URL.Query()
+	for offset, param := range []string{"before", "after"} {
+		relativeTo := query.Get(param)
+		if relativeTo == "" {
+			continue
+		}
+		j := ruleIndex(*rules, relativeTo)
+		if j < 0 {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("The rule to place the push rule " + param + " was not found"),
+			}
+		}
+		if (*rules)[j].Default {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Push rules can't be placed relative to server-default rules"),
+			}
+		}
+		i = j + offset
+	}
+	*rules = append((*rules)[:i], append([]*pushrules.Rule{rule}, (*rules)[i:]...)...)
+
+	return u.save(req, device, accountDB, syncProducer)
+}
+
+// DeletePushRuleByID implements DELETE /pushrules/{scope}/{kind}/{ruleId}
+// Server-default rules can't be deleted, only disabled.
+func DeletePushRuleByID(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database,
+	scope, kind, ruleID string, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	u, resErr := loadPushRules(req, device, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, i, resErr := u.rule(scope, kind, ruleID)
+	if resErr != nil {
+		return *resErr
+	}
+	if (*rules)[i].Default {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Server-default push rules can't be deleted"),
+		}
+	}
+	*rules = append((*rules)[:i], (*rules)[i+1:]...)
+	return u.save(req, device, accountDB, syncProducer)
+}
+
+// GetPushRuleAttr implements GET /pushrules/{scope}/{kind}/{ruleId}/{attr}
+// for the "enabled" and "actions" attributes.
+func GetPushRuleAttr(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database,
+	scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	u, resErr := loadPushRules(req, device, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, i, resErr := u.rule(scope, kind, ruleID)
+	if resErr != nil {
+		return *resErr
+	}
+	rule := (*rules)[i]
+	var res interface{} = pushRuleActionsJSON{rule.Actions}
+	if attr == "enabled" {
+		res = pushRuleEnabledJSON{&rule.Enabled}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// PutPushRuleAttr implements PUT /pushrules/{scope}/{kind}/{ruleId}/{attr}
+// which enables or disables a rule, or changes its actions. Server-default
+// rules can be changed this way too.
+func PutPushRuleAttr(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database,
+	scope, kind, ruleID, attr string, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	var enabled pushRuleEnabledJSON
+	var actions pushRuleActionsJSON
+	if attr == "enabled" {
+		if resErr := httputil.UnmarshalJSONRequest(req, &enabled); resErr != nil {
+			return *resErr
+		}
+		if enabled.Enabled == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Missing enabled"),
+			}
+		}
+	} else {
+		if resErr := httputil.UnmarshalJSONRequest(req, &actions); resErr != nil {
+			return *resErr
+		}
+		if actions.Actions == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Missing actions"),
+			}
+		}
+	}
+
+	u, resErr := loadPushRules(req, device, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, i, resErr := u.rule(scope, kind, ruleID)
+	if resErr != nil {
+		return *resErr
+	}
+	if attr == "enabled" {
+		(*rules)[i].Enabled = *enabled.Enabled
+	} else {
+		(*rules)[i].Actions = actions.Actions
+	}
+	return u.save(req, device, accountDB, syncProducer)
+}
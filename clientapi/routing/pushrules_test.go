@@ -0,0 +1,147 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/pushrules"
+)
+
+var alicesDevice = &authtypes.Device{UserID: "@alice:localhost"}
+
+// storedPushRules returns the push rules in the account data of alice.
+func storedPushRules(t *testing.T, accountDB accounts.Database) *pushrules.AccountRuleSets {
+	data, err := accountDB.GetAccountDataByType(context.Background(), "alice", "", "m.push_rules")
+	if err != nil || data == nil {
+		t.Fatalf("expected alice to have push rules, got %v", err)
+	}
+	var rules pushrules.AccountRuleSets
+	if err = json.Unmarshal(data.Content, &rules); err != nil {
+		t.Fatal(err)
+	}
+	return &rules
+}
+
+func ruleIDs(rules []*pushrules.Rule) []string {
+	ids := []string{}
+	for _, rule := range rules {
+		ids = append(ids, rule.RuleID)
+	}
+	return ids
+}
+
+func putPushRule(accountDB accounts.Database, path, body string) int {
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/client/r0/pushrules/global/"+path, strings.NewReader(body))
+	syncProducer := &producers.SyncAPIProducer{Producer: testSyncProducer{}}
+	parts := strings.SplitN(strings.SplitN(path, "?", 2)[0], "/", 3)
+	if len(parts) == 3 {
+		return PutPushRuleAttr(req, alicesDevice, accountDB, "global", parts[0], parts[1], parts[2], syncProducer).Code
+	}
+	return PutPushRuleByID(req, alicesDevice, accountDB, "global", parts[0], parts[1], syncProducer).Code
+}
+
+func TestNewAccountHasDefaultPushRules(t *testing.T) {
+	_, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+
+	rules := storedPushRules(t, accountDB)
+	if ids := ruleIDs(rules.Global.Override); len(ids) == 0 || ids[0] != ".m.rule.master" {
+		t.Errorf("expected the default override rules, got %v", ids)
+	}
+	if len(rules.Global.Content) != 1 || rules.Global.Content[0].Pattern != "alice" {
+		t.Errorf("expected a default rule matching the user name of alice, got %+v", rules.Global.Content)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/pushrules/global/underride/", nil)
+	res := GetPushRules(req, alicesDevice, accountDB, "global", "underride")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	if ids := ruleIDs(res.JSON.([]*pushrules.Rule)); len(ids) != 5 || ids[0] != ".m.rule.call" {
+		t.Errorf("expected the default underride rules, got %v", ids)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/pushrules/global/sideways/", nil)
+	if res = GetPushRules(req, alicesDevice, accountDB, "global", "sideways"); res.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown kind, got %d", res.Code)
+	}
+}
+
+func TestPushRuleChangesPersist(t *testing.T) {
+	_, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+
+	// User rules come before the server-default rules of the same kind.
+	if code := putPushRule(accountDB, "content/cats", `{"pattern": "cat*", "actions": ["notify"]}`); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", code)
+	}
+	if code := putPushRule(accountDB, "content/dogs?before=cats", `{"pattern": "dog*", "actions": ["dont_notify"]}`); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", code)
+	}
+	rules := storedPushRules(t, accountDB)
+	if ids := strings.Join(ruleIDs(rules.Global.Content), ","); ids != "dogs,cats,.m.rule.contains_user_name" {
+		t.Errorf("expected the rules to be in order, got %s", ids)
+	}
+	if cats := rules.Global.Content[1]; cats.Pattern != "cat*" || !cats.Enabled || cats.Default || !pushrules.ShouldNotify(cats.Actions) {
+		t.Errorf("expected the new rule to be stored, got %+v", cats)
+	}
+
+	// Server-default rules can be disabled and have their actions changed.
+	if code := putPushRule(accountDB, "underride/.m.rule.message/enabled", `{"enabled": false}`); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", code)
+	}
+	if code := putPushRule(accountDB, "override/.m.rule.tombstone/actions", `{"actions": ["dont_notify"]}`); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", code)
+	}
+	rules = storedPushRules(t, accountDB)
+	for _, rule := range rules.Global.Underride {
+		if rule.RuleID == ".m.rule.message" && rule.Enabled {
+			t.Error("expected .m.rule.message to be disabled")
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/pushrules/global/override/.m.rule.tombstone/actions", nil)
+	res := GetPushRuleAttr(req, alicesDevice, accountDB, "global", "override", ".m.rule.tombstone", "actions")
+	if actions := res.JSON.(pushRuleActionsJSON).Actions; len(actions) != 1 || actions[0].Kind != pushrules.DontNotifyAction {
+		t.Errorf("expected the actions of the tombstone rule to be replaced, got %v", actions)
+	}
+
+	// But they can't be deleted or replaced.
+	syncProducer := &producers.SyncAPIProducer{Producer: testSyncProducer{}}
+	req = httptest.NewRequest(http.MethodDelete, "/_matrix/client/r0/pushrules/global/underride/.m.rule.message", nil)
+	if res = DeletePushRuleByID(req, alicesDevice, accountDB, "global", "underride", ".m.rule.message", syncProducer); res.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 when deleting a server-default rule, got %d", res.Code)
+	}
+	if code := putPushRule(accountDB, "underride/.m.rule.message", `{"actions": ["notify"]}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 when replacing a server-default rule, got %d", code)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/_matrix/client/r0/pushrules/global/content/cats", nil)
+	if res = DeletePushRuleByID(req, alicesDevice, accountDB, "global", "content", "cats", syncProducer); res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/pushrules/global/content/cats", nil)
+	if res = GetPushRuleByID(req, alicesDevice, accountDB, "global", "content", "cats"); res.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a deleted rule, got %d", res.Code)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+// rateLimits limits how quickly users can send events with a token bucket for
+// each user. Guests have smaller buckets which refill more slowly.
+type rateLimits struct {
+	cfg     *config.Dendrite
+	now     func() time.Time
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	// When buckets which have been refilled were last removed.
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updated   time.Time
+	burst     float64
+	perSecond float64
+}
+
+func newRateLimits(cfg *config.Dendrite) *rateLimits {
+	return &rateLimits{
+		cfg:     cfg,
+		now:     time.Now,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// limit takes a token from the bucket of the user of the device, or returns
+// an M_LIMIT_EXCEEDED response if the bucket is empty.
+func (l *rateLimits) limit(device *authtypes.Device) *util.JSONResponse {
+	cfg := &l.cfg.RateLimiting
+	if !cfg.Enabled || device.ID == types.AppServiceDeviceID || common.CheckServerAdmin(device, l.cfg) == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[device.UserID]
+	if !ok {
+		bucket = &tokenBucket{burst: float64(cfg.BurstCount), perSecond: cfg.PerSecond}
+		if device.IsGuest {
+			bucket.burst, bucket.perSecond = float64(cfg.GuestBurstCount), cfg.GuestPerSecond
+		}
+		bucket.tokens, bucket.updated = bucket.burst, now
+		l.buckets[device.UserID] = bucket
+	}
+	bucket.refill(now)
+	if bucket.tokens < 1 {
+		retryAfter := time.Duration((1 - bucket.tokens) / bucket.perSecond * float64(time.Second))
+		return &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("Too many requests", int64(math.Ceil(retryAfter.Seconds()*1000))),
+		}
+	}
+	bucket.tokens--
+	return nil
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.updated).Seconds()*b.perSecond)
+	b.updated = now
+}
+
+// sweep removes the buckets which are full, as they are the same as the bucket
+// of a user who hasn't sent anything. It only runs once a minute.
+func (l *rateLimits) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for userID, bucket := range l.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(l.buckets, userID)
+		}
+	}
+}
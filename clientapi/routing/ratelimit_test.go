@@ -0,0 +1,111 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+func newTestRateLimits() (*rateLimits, *time.Time) {
+	cfg := &config.Dendrite{}
+	cfg.RateLimiting.Enabled = true
+	cfg.RateLimiting.BurstCount = 3
+	cfg.RateLimiting.PerSecond = 0.5
+	cfg.RateLimiting.GuestBurstCount = 1
+	cfg.RateLimiting.GuestPerSecond = 0.25
+	cfg.Matrix.AdminUsers = []string{"@admin:localhost"}
+	now := time.Unix(1587340800, 0)
+	l := newRateLimits(cfg)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+// sendBurst sends events as the device until one is rate limited, and returns
+// how many were allowed along with the response to the limited one.
+func sendBurst(l *rateLimits, device *authtypes.Device, max int) (int, *jsonerror.LimitExceededError) {
+	for i := 0; i < max; i++ {
+		if resErr := l.limit(device); resErr != nil {
+			if resErr.Code != http.StatusTooManyRequests {
+				return i, nil
+			}
+			return i, resErr.JSON.(*jsonerror.LimitExceededError)
+		}
+	}
+	return max, nil
+}
+
+func TestRateLimitBurstAndRefill(t *testing.T) {
+	l, now := newTestRateLimits()
+	alice := &authtypes.Device{ID: "DEVICE", UserID: "@alice:localhost"}
+
+	sent, limited := sendBurst(l, alice, 10)
+	if sent != 3 || limited == nil {
+		t.Fatalf("expected the fourth event of a burst to be limited, sent %d", sent)
+	}
+	if limited.ErrCode != "M_LIMIT_EXCEEDED" || limited.RetryAfterMS != 2000 {
+		t.Errorf("expected M_LIMIT_EXCEEDED with retry_after_ms 2000, got %s %d", limited.ErrCode, limited.RetryAfterMS)
+	}
+
+	// Other users have their own bucket.
+	if sent, _ = sendBurst(l, &authtypes.Device{ID: "DEVICE", UserID: "@bob:localhost"}, 10); sent != 3 {
+		t.Errorf("expected bob to have a full bucket, sent %d", sent)
+	}
+
+	// One token is added every two seconds, up to the burst count.
+	*now = now.Add(2 * time.Second)
+	if sent, _ = sendBurst(l, alice, 10); sent != 1 {
+		t.Errorf("expected one token to be added after 2s, sent %d", sent)
+	}
+	*now = now.Add(time.Hour)
+	if sent, _ = sendBurst(l, alice, 10); sent != 3 {
+		t.Errorf("expected the bucket to be refilled up to the burst count, sent %d", sent)
+	}
+}
+
+func TestRateLimitExemptions(t *testing.T) {
+	l, _ := newTestRateLimits()
+	for _, device := range []*authtypes.Device{
+		{ID: types.AppServiceDeviceID, UserID: "@bridge:localhost"},
+		{ID: "DEVICE", UserID: "@admin:localhost"},
+	} {
+		if sent, _ := sendBurst(l, device, 10); sent != 10 {
+			t.Errorf("expected %s not to be rate limited, sent %d", device.UserID, sent)
+		}
+	}
+}
+
+func TestRateLimitGuests(t *testing.T) {
+	l, now := newTestRateLimits()
+	guest := &authtypes.Device{ID: "DEVICE", UserID: "@guest:localhost", IsGuest: true}
+
+	sent, limited := sendBurst(l, guest, 10)
+	if sent != 1 || limited == nil {
+		t.Fatalf("expected guests to have their own burst count, sent %d", sent)
+	}
+	if limited.RetryAfterMS != 4000 {
+		t.Errorf("expected retry_after_ms 4000, got %d", limited.RetryAfterMS)
+	}
+	*now = now.Add(2 * time.Second)
+	if sent, _ = sendBurst(l, guest, 10); sent != 0 {
+		t.Errorf("expected guest buckets to refill more slowly, sent %d", sent)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
+)
+
+// fullyReadType is the type of the room account data which holds the
+// fully read marker of a user.
+// https://matrix.org/docs/spec/client_server/r0.6.0#fully-read-markers
+const fullyReadType = "m.fully_read"
+
+type readMarkersRequest struct {
+	FullyRead string `json:"m.fully_read"`
+	Read      string `json:"m.read"`
+}
+
+type fullyReadContent struct {
+	EventID string `json:"event_id"`
+}
+
+// SetReadMarkers implements POST /rooms/{roomId}/read_markers
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-rooms-roomid-read-markers
+// The fully read marker is saved in the room account data of the user, and
+// the read receipt is sent like any other.
+func SetReadMarkers(
+	req *http.Request, device *authtypes.Device, roomID string,
+	accountDB accounts.Database, queryAPI api.RoomserverQueryAPI,
+	eduProducer *producers.EDUServerProducer, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	var r readMarkersRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.FullyRead == "" && r.Read == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("At least one of m.fully_read and m.read must be supplied"),
+		}
+	}
+
+	localpart, err := userutil.ParseUsernameParam(device.UserID, nil)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userutil.ParseUsernameParam failed")
+		return jsonerror.InternalServerError()
+	}
+	_, err = accountDB.GetMembershipInRoomByLocalpart(req.Context(), localpart, roomID)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("User not in this room"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetMembershipInRoomByLocalPart failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var eventIDs []string
+	for _, eventID := range []string{r.FullyRead, r.Read} {
+		if eventID != "" {
+			eventIDs = append(eventIDs, eventID)
+		}
+	}
+	inRoom, err := eventsAreInRoom(req.Context(), queryAPI, roomID, eventIDs)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("eventsAreInRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if !inRoom {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("The markers must refer to events in this room"),
+		}
+	}
+
+	if r.FullyRead != "" {
+		var content []byte
+		if content, err = json.Marshal(fullyReadContent{EventID: r.FullyRead}); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+			return jsonerror.InternalServerError()
+		}
+		if err = accountDB.SaveAccountData(req.Context(), localpart, roomID, fullyReadType, string(content)); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveAccountData failed")
+			return jsonerror.InternalServerError()
+		}
+		if err = syncProducer.SendData(device.UserID, roomID, fullyReadType); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	if r.Read != "" {
+		if err = sendReadReceipt(req.Context(), device.UserID, localpart, roomID, r.Read, accountDB, queryAPI, eduProducer); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("sendReadReceipt failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// eventsAreInRoom returns whether the roomserver knows about all of the given
+// events, and they are all in the given room.
+func eventsAreInRoom(
+	ctx context.Context, queryAPI api.RoomserverQueryAPI, roomID string, eventIDs []string,
+) (bool, error) {
+	eventsReq := api.QueryEventsByIDRequest{EventIDs: eventIDs}
+	var eventsRes api.QueryEventsByIDResponse
+	if err := queryAPI.QueryEventsByID(ctx, &eventsReq, &eventsRes); err != nil {
+		return false, err
+	}
+	found := make(map[string]bool, len(eventsRes.Events))
+	for _, ev := range eventsRes.Events {
+		if ev.RoomID() != roomID {
+			return false, nil
+		}
+		found[ev.EventID()] = true
+	}
+	for _, eventID := range eventIDs {
+		if !found[eventID] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/eduserver/api"
+)
+
+// testEDUServer records the receipts which are sent to it.
+type testEDUServer struct {
+	api.EDUServerInputAPI
+	receipts []api.InputReceiptEvent
+}
+
+func (s *testEDUServer) InputReceiptEvent(
+	ctx context.Context,
+	request *api.InputReceiptEventRequest,
+	response *api.InputReceiptEventResponse,
+) error {
+	s.receipts = append(s.receipts, request.InputReceiptEvent)
+	return nil
+}
+
+func (d *deactivateTest) setReadMarkers(eduServer *testEDUServer, body string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/rooms/"+testRoomID+"/read_markers", strings.NewReader(body))
+	res := SetReadMarkers(
+		req, d.device, testRoomID, d.accountDB, d.room, producers.NewEDUServerProducer(eduServer),
+		&producers.SyncAPIProducer{Producer: testSyncProducer{}},
+	)
+	return res.Code, res.JSON
+}
+
+func TestSetReadMarkers(t *testing.T) {
+	d, cleanup := newDeactivateTest(t)
+	defer cleanup()
+	eduServer := &testEDUServer{}
+	fullyRead, read := d.room.events[5].EventID(), d.room.events[6].EventID()
+
+	body := `{"m.fully_read": "` + fullyRead + `", "m.read": "` + read + `"}`
+	if code, res := d.setReadMarkers(eduServer, body); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	data, err := d.accountDB.GetAccountDataByType(context.Background(), "alice", testRoomID, "m.fully_read")
+	if err != nil || data == nil {
+		t.Fatalf("expected the fully read marker to be saved, got %v, %v", data, err)
+	}
+	var content fullyReadContent
+	if err = json.Unmarshal(data.Content, &content); err != nil || content.EventID != fullyRead {
+		t.Errorf("expected the fully read marker to be at %s, got %s", fullyRead, data.Content)
+	}
+	if len(eduServer.receipts) != 1 {
+		t.Fatalf("expected one receipt to be sent, got %v", eduServer.receipts)
+	}
+	if r := eduServer.receipts[0]; r.UserID != "@alice:localhost" || r.RoomID != testRoomID || r.EventID != read || r.Type != "m.read" {
+		t.Errorf("unexpected receipt %+v", r)
+	}
+}
+
+func TestSetReadMarkersRequiresEventsInRoom(t *testing.T) {
+	d, cleanup := newDeactivateTest(t)
+	defer cleanup()
+	eduServer := &testEDUServer{}
+
+	body := `{"m.fully_read": "` + d.room.events[5].EventID() + `", "m.read": "$unknown:localhost"}`
+	if code, res := d.setReadMarkers(eduServer, body); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown event, got %d: %v", code, res)
+	}
+	if data, err := d.accountDB.GetAccountDataByType(context.Background(), "alice", testRoomID, "m.fully_read"); err != nil || data != nil {
+		t.Errorf("expected no fully read marker to be saved, got %v, %v", data, err)
+	}
+	if len(eduServer.receipts) != 0 {
+		t.Errorf("expected no receipts to be sent, got %v", eduServer.receipts)
+	}
+	if code, res := d.setReadMarkers(eduServer, `{}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without any markers, got %d: %v", code, res)
+	}
+}
+
+func TestOwnReceiptsDoNotResetNotifications(t *testing.T) {
+	d, cleanup := newDeactivateTest(t)
+	defer cleanup()
+	eduServer := &testEDUServer{}
+	d.room.join("@bob:localhost")
+	ownEvent, bobsEvent := d.room.events[6].EventID(), d.room.events[len(d.room.events)-1].EventID()
+	ctx := context.Background()
+	sendReceipt := func(eventID string) {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/rooms/"+testRoomID+"/receipt/m.read/"+eventID, nil)
+		res := SendReceipt(req, d.device, testRoomID, "m.read", eventID, d.accountDB, d.room, producers.NewEDUServerProducer(eduServer))
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+		}
+	}
+	unread := func() int64 {
+		count, err := d.accountDB.GetUnreadNotificationCount(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	if err := d.accountDB.IncrementNotificationCount(ctx, "alice", testRoomID); err != nil {
+		t.Fatal(err)
+	}
+
+	sendReceipt(ownEvent)
+	if count := unread(); count != 1 {
+		t.Errorf("expected a receipt for an own event to keep the notification, got %d unread", count)
+	}
+	sendReceipt(bobsEvent)
+	if count := unread(); count != 0 {
+		t.Errorf("expected a receipt for bob's event to read the notification, got %d unread", count)
+	}
+	// Both receipts are still sent on to the other users in the room.
+	if len(eduServer.receipts) != 2 || eduServer.receipts[0].EventID != ownEvent || eduServer.receipts[1].EventID != bobsEvent {
+		t.Errorf("expected receipts for %s and %s to be sent, got %+v", ownEvent, bobsEvent, eduServer.receipts)
+	}
+}
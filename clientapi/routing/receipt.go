@@ -0,0 +1,94 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
+)
+
+// SendReceipt handles POST /rooms/{roomID}/receipt/{receiptType}/{eventID}
+// sends the receipt to the EDU server, which batches it with other receipts
+// in the room before sending them to other servers.
+func SendReceipt(
+	req *http.Request, device *authtypes.Device, roomID, receiptType, eventID string,
+	accountDB accounts.Database, queryAPI api.RoomserverQueryAPI, eduProducer *producers.EDUServerProducer,
+) util.JSONResponse {
+	if receiptType != "m.read" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Receipt type must be m.read"),
+		}
+	}
+
+	localpart, err := userutil.ParseUsernameParam(device.UserID, nil)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userutil.ParseUsernameParam failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Verify that the user is a member of this room
+	_, err = accountDB.GetMembershipInRoomByLocalpart(req.Context(), localpart, roomID)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("User not in this room"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetMembershipInRoomByLocalPart failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if err = sendReadReceipt(req.Context(), device.UserID, localpart, roomID, eventID, accountDB, queryAPI, eduProducer); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sendReadReceipt failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// sendReadReceipt sends the read receipt of a local user to the EDU server,
+// and marks the notifications of the user in the room as read. A receipt for
+// one of the user's own events doesn't reset them, as sending the event has
+// already done so, and clients send one for each of their own events.
+func sendReadReceipt(
+	ctx context.Context, userID, localpart, roomID, eventID string,
+	accountDB accounts.Database, queryAPI api.RoomserverQueryAPI, eduProducer *producers.EDUServerProducer,
+) error {
+	if err := eduProducer.SendReceipt(ctx, userID, roomID, eventID, "m.read"); err != nil {
+		return err
+	}
+	eventsReq := api.QueryEventsByIDRequest{EventIDs: []string{eventID}}
+	var eventsRes api.QueryEventsByIDResponse
+	if err := queryAPI.QueryEventsByID(ctx, &eventsReq, &eventsRes); err != nil {
+		return err
+	}
+	if len(eventsRes.Events) == 1 && eventsRes.Events[0].Sender() == userID {
+		return nil
+	}
+	return accountDB.ResetNotificationCount(ctx, localpart, roomID)
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The number of events which RedactUserEvents redacts when the request doesn't
+// give a limit, and the largest limit it accepts.
+const (
+	defaultRedactUserEventsLimit = 100
+	maxRedactUserEventsLimit     = 1000
+)
+
+type redactUserEventsRequest struct {
+	Reason string `json:"reason,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// redactionContent is the content of the redactions sent by RedactUserEvents.
+type redactionContent struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+type redactUserEventsResponse struct {
+	// The IDs of the events which were redacted by this request.
+	Redacted []string `json:"redacted"`
+}
+
+// RedactUserEvents implements POST /_dendrite/admin/v1/rooms/{roomID}/redact/{userID}
+// It redacts up to limit of the events that the user has sent into the room
+// which haven't been redacted yet, so it should be repeated until nothing is
+// redacted. The redactions are sent by the requesting server admin, who must
+// also have the power to redact other users' events in the room.
+func RedactUserEvents(
+	req *http.Request, device *authtypes.Device, roomID, userID string,
+	cfg *config.Dendrite, producer *producers.RoomserverProducer,
+	queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	var r redactUserEventsRequest
+	if req.ContentLength != 0 {
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+	}
+	if r.Limit <= 0 {
+		r.Limit = defaultRedactUserEventsLimit
+	} else if r.Limit > maxRedactUserEventsLimit {
+		r.Limit = maxRedactUserEventsLimit
+	}
+
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: device.UserID},
+			{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""},
+		},
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(req.Context(), &stateReq, &stateRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryLatestEventsAndState failed")
+		return jsonerror.InternalServerError()
+	}
+	if !stateRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	}
+	if resErr := checkAllowedToRedact(device.UserID, userID, stateRes.StateEvents); resErr != nil {
+		return *resErr
+	}
+
+	eventsReq := api.QueryEventsBySenderRequest{RoomID: roomID, Sender: userID, Limit: r.Limit}
+	var eventsRes api.QueryEventsBySenderResponse
+	if err := queryAPI.QueryEventsBySender(req.Context(), &eventsReq, &eventsRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryEventsBySender failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := redactUserEventsResponse{Redacted: []string{}}
+	evTime := time.Now()
+	for _, ev := range eventsRes.Events {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:  device.UserID,
+			RoomID:  roomID,
+			Type:    gomatrixserverlib.MRoomRedaction,
+			Redacts: ev.EventID(),
+		}
+		if err := builder.SetContent(redactionContent{Reason: r.Reason}); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
+			return jsonerror.InternalServerError()
+		}
+		var queryRes api.QueryLatestEventsAndStateResponse
+		redaction, err := common.BuildEvent(req.Context(), &builder, cfg, evTime, queryAPI, &queryRes)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("common.BuildEvent failed")
+			return jsonerror.InternalServerError()
+		}
+		// The redactions are sent one at a time so that each of them follows
+		// the one before it in the room.
+		if _, err = producer.SendEvents(
+			req.Context(), []gomatrixserverlib.HeaderedEvent{redaction.Headered(queryRes.RoomVersion)},
+			cfg.Matrix.ServerName, nil,
+		); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
+			return jsonerror.InternalServerError()
+		}
+		res.Redacted = append(res.Redacted, ev.EventID())
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// checkAllowedToRedact returns an error response unless the sender is in the
+// room and may redact the events of the target user, given the member event
+// of the sender and the power levels of the room.
+func checkAllowedToRedact(
+	senderID, targetUserID string, stateEvents []gomatrixserverlib.HeaderedEvent,
+) *util.JSONResponse {
+	var membership string
+	var levels gomatrixserverlib.PowerLevelContent
+	levels.Defaults()
+	for _, ev := range stateEvents {
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomMember:
+			membership, _ = ev.Membership()
+		case gomatrixserverlib.MRoomPowerLevels:
+			if content, err := gomatrixserverlib.NewPowerLevelContentFromEvent(ev.Unwrap()); err == nil {
+				levels = content
+			}
+		}
+	}
+	if membership != gomatrixserverlib.Join {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not in the room"),
+		}
+	}
+	userLevel := levels.UserLevel(senderID)
+	if userLevel < levels.EventLevel(gomatrixserverlib.MRoomRedaction, false) ||
+		(senderID != targetUserID && userLevel < levels.Redact) {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You don't have permission to redact the events of this user"),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// addMessage adds a message to the room and returns its event ID.
+func (r *testRoom) addMessage(sender, body string) string {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender: sender,
+		RoomID: testRoomID,
+		Type:   "m.room.message",
+	}
+	if err := builder.SetContent(map[string]interface{}{"msgtype": "m.text", "body": body}); err != nil {
+		r.t.Fatal(err)
+	}
+	var res api.QueryLatestEventsAndStateResponse
+	ev, err := common.BuildEvent(context.Background(), &builder, r.cfg, time.Now(), r, &res)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.events = append(r.events, *ev)
+	return ev.EventID()
+}
+
+func (r *testRoom) QueryEventsBySender(
+	ctx context.Context,
+	request *api.QueryEventsBySenderRequest,
+	response *api.QueryEventsBySenderResponse,
+) error {
+	response.RoomExists = true
+	events := append([]gomatrixserverlib.Event{}, r.events...)
+	for _, ev := range r.sent {
+		events = append(events, ev.Unwrap())
+	}
+	redacted := make(map[string]bool)
+	for _, ev := range events {
+		if ev.Type() == gomatrixserverlib.MRoomRedaction {
+			redacted[ev.Redacts()] = true
+		}
+	}
+	for _, ev := range events {
+		if ev.Sender() != request.Sender || redacted[ev.EventID()] || len(response.Events) == request.Limit {
+			continue
+		}
+		if ev.Type() != gomatrixserverlib.MRoomRedaction && ev.Type() != gomatrixserverlib.MRoomCreate {
+			response.Events = append(response.Events, ev.Headered(gomatrixserverlib.RoomVersionV3))
+		}
+	}
+	return nil
+}
+
+// redactedEvents returns the IDs of the events redacted by the events sent
+// into the room.
+func (r *testRoom) redactedEvents() map[string]bool {
+	redacted := make(map[string]bool)
+	for _, ev := range r.sent {
+		if ev.Type() == gomatrixserverlib.MRoomRedaction {
+			redacted[ev.Redacts()] = true
+		}
+	}
+	return redacted
+}
+
+func (r *testRoom) redactUserEvents(senderID, userID string, limit int) (int, interface{}) {
+	body, err := json.Marshal(redactUserEventsRequest{Limit: limit})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/v1/rooms/"+testRoomID+"/redact/"+userID, bytes.NewReader(body))
+	producer := producers.NewRoomserverProducer(r, r)
+	res := RedactUserEvents(req, &authtypes.Device{UserID: senderID}, testRoomID, userID, r.cfg, producer, r)
+	return res.Code, res.JSON
+}
+
+func TestRedactUserEvents(t *testing.T) {
+	room := newTestRoom(t)
+	room.cfg.Matrix.AdminUsers = []string{"@alice:localhost"}
+	room.join("@mallory:localhost")
+	var mallorys, alices []string
+	for _, body := range []string{"spam", "more spam", "even more spam"} {
+		mallorys = append(mallorys, room.addMessage("@mallory:localhost", body))
+		alices = append(alices, room.addMessage("@alice:localhost", "not "+body))
+	}
+
+	code, body := room.redactUserEvents("@alice:localhost", "@mallory:localhost", 0)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	redacted := room.redactedEvents()
+	for _, eventID := range mallorys {
+		if !redacted[eventID] {
+			t.Errorf("expected message %s to be redacted", eventID)
+		}
+	}
+	for _, eventID := range alices {
+		if redacted[eventID] {
+			t.Errorf("expected message %s from another user not to be redacted", eventID)
+		}
+	}
+	for _, ev := range room.sent {
+		if ev.Type() != gomatrixserverlib.MRoomRedaction || ev.Sender() != "@alice:localhost" {
+			t.Errorf("expected only redactions from the moderator, got %s from %s", ev.Type(), ev.Sender())
+		}
+	}
+
+	// Events which have already been redacted are skipped.
+	sent := len(room.sent)
+	if code, body = room.redactUserEvents("@alice:localhost", "@mallory:localhost", 0); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	if len(room.sent) != sent || len(body.(redactUserEventsResponse).Redacted) != 0 {
+		t.Errorf("expected nothing to be redacted again, got %v", body)
+	}
+}
+
+func TestRedactUserEventsRespectsPowerLevels(t *testing.T) {
+	room := newTestRoom(t)
+	room.cfg.Matrix.AdminUsers = []string{"@mallory:localhost", "@bob:localhost"}
+	room.join("@mallory:localhost")
+	room.addMessage("@alice:localhost", "hello")
+
+	if code, body := room.redactUserEvents("@mallory:localhost", "@alice:localhost", 0); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a user without the power to redact, got %d: %v", code, body)
+	}
+	if code, body := room.redactUserEvents("@bob:localhost", "@alice:localhost", 0); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a user who isn't in the room, got %d: %v", code, body)
+	}
+	if len(room.sent) != 0 {
+		t.Errorf("expected no redactions to be sent, got %d", len(room.sent))
+	}
+
+	// Users can always redact their own events, which includes the event
+	// they joined the room with.
+	room.addMessage("@mallory:localhost", "oops")
+	if code, body := room.redactUserEvents("@mallory:localhost", "@mallory:localhost", 0); code != http.StatusOK || len(room.sent) != 2 {
+		t.Errorf("expected a user to be able to redact their own events, got %d: %v", code, body)
+	}
+}
+
+func TestRedactUserEventsNeedsServerAdmin(t *testing.T) {
+	room := newTestRoom(t)
+	room.join("@mallory:localhost")
+	room.addMessage("@mallory:localhost", "spam")
+
+	// The creator of the room may redact events in it, but isn't an admin.
+	if code, body := room.redactUserEvents("@alice:localhost", "@mallory:localhost", 0); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a user who isn't a server admin, got %d: %v", code, body)
+	}
+	if len(room.sent) != 0 {
+		t.Errorf("expected no redactions to be sent, got %d", len(room.sent))
+	}
+}
+
+func TestRedactUserEventsLimit(t *testing.T) {
+	room := newTestRoom(t)
+	room.cfg.Matrix.AdminUsers = []string{"@alice:localhost"}
+	room.join("@mallory:localhost")
+	for _, body := range []string{"spam", "more spam", "even more spam"} {
+		room.addMessage("@mallory:localhost", body)
+	}
+
+	// Mallory also sent the event they joined with.
+	for _, want := range []int{2, 2, 0} {
+		code, body := room.redactUserEvents("@alice:localhost", "@mallory:localhost", 2)
+		if code != http.StatusOK {
+			t.Fatalf("expected 200 OK, got %d: %v", code, body)
+		}
+		if got := len(body.(redactUserEventsResponse).Redacted); got != want {
+			t.Errorf("expected %d events to be redacted, got %d", want, got)
+		}
+	}
+}
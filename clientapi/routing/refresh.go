@@ -0,0 +1,116 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// https://github.com/matrix-org/matrix-doc/pull/2918
+type refreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresInMS  int64  `json:"expires_in_ms"`
+}
+
+// accessTokenLifetime returns how long the access token of a new device is
+// valid for. This is zero if the client didn't ask for a refresh token, as the
+// access token then never expires.
+func accessTokenLifetime(refreshToken bool, cfg *config.Dendrite) time.Duration {
+	if !refreshToken {
+		return 0
+	}
+	return cfg.Matrix.AccessTokenLifetime
+}
+
+// issueRefreshToken issues a refresh token to a device, so that its access
+// token expires after the lifetime. Returns the refresh token and how long the
+// access token is valid for in milliseconds.
+func issueRefreshToken(
+	ctx context.Context, deviceDB devices.Database,
+	localpart, deviceID, accessToken string, lifetime time.Duration,
+) (string, int64, error) {
+	refreshToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		return "", 0, err
+	}
+	expiresInMS := int64(lifetime / time.Millisecond)
+	expiresTS := time.Now().Add(lifetime).UnixNano() / int64(time.Millisecond)
+	if err = deviceDB.CreateRefreshToken(ctx, localpart, deviceID, accessToken, refreshToken, expiresTS); err != nil {
+		return "", 0, err
+	}
+	return refreshToken, expiresInMS, nil
+}
+
+// Refresh implements POST /_matrix/client/v1/refresh
+// The refresh token is used to replace the access token of the device it was
+// issued to, and is itself replaced so that it can only be used once.
+func Refresh(
+	req *http.Request, deviceDB devices.Database, cfg *config.Dendrite,
+) util.JSONResponse {
+	var r refreshRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.RefreshToken == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing refresh_token"),
+		}
+	}
+	accessToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	refreshToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	lifetime := cfg.Matrix.AccessTokenLifetime
+	expiresTS := time.Now().Add(lifetime).UnixNano() / int64(time.Millisecond)
+	if _, err = deviceDB.RefreshAccessToken(req.Context(), r.RefreshToken, accessToken, refreshToken, expiresTS); err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.UnknownToken("Unknown refresh token"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RefreshAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: refreshResponse{
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
+			ExpiresInMS:  int64(lifetime / time.Millisecond),
+		},
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+// refreshTest is alice, who has an account and a device logged in with the
+// access token alices-token.
+type refreshTest struct {
+	cfg       *config.Dendrite
+	accountDB accounts.Database
+	deviceDB  devices.Database
+	device    *authtypes.Device
+	dir       string
+}
+
+func newRefreshTest(t *testing.T) (*refreshTest, func()) {
+	dir, err := ioutil.TempDir("", "refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &refreshTest{cfg: &config.Dendrite{}, dir: dir}
+	d.cfg.Matrix.ServerName = "localhost"
+	if d.accountDB, err = accounts.NewDatabase("file:"+filepath.Join(dir, "account.db"), nil, "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if d.deviceDB, err = devices.NewDatabase("file:"+filepath.Join(dir, "device.db"), nil, "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = d.accountDB.CreateAccount(ctx, "alice", "correct horse", ""); err != nil {
+		t.Fatal(err)
+	}
+	if d.device, err = d.deviceDB.CreateDevice(ctx, "alice", nil, "alices-token", nil); err != nil {
+		t.Fatal(err)
+	}
+	return d, func() { _ = os.RemoveAll(dir) }
+}
+
+func (d *refreshTest) verifyToken(token string) *util.JSONResponse {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/account/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	_, resErr := auth.VerifyUserFromRequest(req, auth.Data{AccountDB: d.accountDB, DeviceDB: d.deviceDB})
+	return resErr
+}
+
+func (d *refreshTest) refresh(refreshToken string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/v1/refresh", strings.NewReader(
+		`{"refresh_token": "`+refreshToken+`"}`,
+	))
+	res := Refresh(req, d.deviceDB, d.cfg)
+	return res.Code, res.JSON
+}
+
+func TestExpiredAccessTokenIsSoftLoggedOut(t *testing.T) {
+	d, cleanup := newRefreshTest(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	expiredTS := time.Now().Add(-time.Minute).UnixNano() / int64(time.Millisecond)
+	if err := d.deviceDB.CreateRefreshToken(ctx, "alice", d.device.ID, "alices-token", "alices-refresh-token", expiredTS); err != nil {
+		t.Fatal(err)
+	}
+	resErr := d.verifyToken("alices-token")
+	if resErr == nil || resErr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an expired access token, got %v", resErr)
+	}
+	if e, ok := resErr.JSON.(*jsonerror.UnknownTokenError); !ok || e.ErrCode != "M_UNKNOWN_TOKEN" || !e.SoftLogout {
+		t.Errorf("expected M_UNKNOWN_TOKEN with soft_logout, got %v", resErr.JSON)
+	}
+	if _, err := d.deviceDB.GetDeviceByID(ctx, "alice", d.device.ID); err != nil {
+		t.Errorf("expected the device to be kept, got %v", err)
+	}
+
+	resErr = d.verifyToken("nobodys-token")
+	if resErr == nil || resErr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an unknown access token, got %v", resErr)
+	}
+	if e, ok := resErr.JSON.(*jsonerror.MatrixError); !ok || e.ErrCode != "M_UNKNOWN_TOKEN" {
+		t.Errorf("expected M_UNKNOWN_TOKEN without soft_logout, got %v", resErr.JSON)
+	}
+}
+
+func TestRefreshRotatesAccessToken(t *testing.T) {
+	d, cleanup := newRefreshTest(t)
+	defer cleanup()
+	d.cfg.Matrix.AccessTokenLifetime = time.Hour
+
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/login", strings.NewReader(
+		`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "alice"}, "password": "correct horse", "refresh_token": true}`,
+	))
+	res := Login(req, d.accountDB, d.deviceDB, nil, d.cfg, &producers.DeviceListProducer{Producer: testSyncProducer{}})
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	login := res.JSON.(loginResponse)
+	if login.RefreshToken == "" || login.ExpiresInMS != time.Hour.Milliseconds() {
+		t.Fatalf("expected a refresh token and an access token lasting an hour, got %+v", login)
+	}
+
+	code, body := d.refresh(login.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	refreshed := body.(refreshResponse)
+	if refreshed.AccessToken == login.AccessToken || refreshed.RefreshToken == login.RefreshToken {
+		t.Errorf("expected new tokens, got %+v", refreshed)
+	}
+	if resErr := d.verifyToken(refreshed.AccessToken); resErr != nil {
+		t.Errorf("expected the new access token to be valid, got %v", resErr.JSON)
+	}
+	if resErr := d.verifyToken(login.AccessToken); resErr == nil || resErr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the old access token to be invalid, got %v", resErr)
+	}
+
+	// Each refresh token can only be used once.
+	if code, body = d.refresh(login.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a used refresh token, got %d: %v", code, body)
+	}
+}
+
+// refreshTokens returns the devices which have refresh tokens.
+func (d *refreshTest) refreshTokens(t *testing.T) []string {
+	db, err := sql.Open(common.SQLiteDriverName(), "file:"+filepath.Join(d.dir, "device.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() // nolint: errcheck
+	rows, err := db.Query("SELECT device_id FROM device_refresh_tokens ORDER BY device_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close() // nolint: errcheck
+	deviceIDs := []string{}
+	for rows.Next() {
+		var deviceID string
+		if err = rows.Scan(&deviceID); err != nil {
+			t.Fatal(err)
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	return deviceIDs
+}
+
+func TestRemovingDeviceDeletesRefreshToken(t *testing.T) {
+	d, cleanup := newRefreshTest(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	expiresTS := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	if err := d.deviceDB.CreateRefreshToken(ctx, "alice", d.device.ID, "alices-token", "alices-refresh-token", expiresTS); err != nil {
+		t.Fatal(err)
+	}
+	other, err := d.deviceDB.CreateDevice(ctx, "alice", nil, "alices-other-token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.deviceDB.CreateRefreshToken(ctx, "alice", other.ID, "alices-other-token", "alices-other-refresh-token", expiresTS); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.deviceDB.RemoveDevice(ctx, d.device.ID, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.refreshTokens(t); len(got) != 1 || got[0] != other.ID {
+		t.Errorf("expected only the refresh token of %s to be left, got %v", other.ID, got)
+	}
+
+	if err = d.deviceDB.RemoveAllDevices(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.refreshTokens(t); len(got) != 0 {
+		t.Errorf("expected the refresh tokens of all devices to be deleted, got %v", got)
+	}
+}
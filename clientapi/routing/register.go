@@ -16,7 +16,6 @@
 package routing
 
 import (
-	"context"
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/json"
@@ -29,7 +28,6 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/common/config"
@@ -60,10 +58,8 @@ var (
 )
 
 const (
-	minPasswordLength = 8   // http://matrix.org/docs/spec/client_server/r0.2.0.html#password-based
 	maxPasswordLength = 512 // https://github.com/matrix-org/synapse/blob/v0.20.0/synapse/rest/client/v2_alpha/register.py#L161
 	maxUsernameLength = 254 // http://matrix.org/speculator/spec/HEAD/intro.html#user-identifiers TODO account for domain
-	sessionIDLength   = 24
 )
 
 func init() {
@@ -71,50 +67,7 @@ func init() {
 	prometheus.MustRegister(amtRegUsers)
 }
 
-// sessionsDict keeps track of completed auth stages for each session.
-// It shouldn't be passed by value because it contains a mutex.
-type sessionsDict struct {
-	sync.Mutex
-	sessions map[string][]authtypes.LoginType
-}
-
-// GetCompletedStages returns the completed stages for a session.
-func (d *sessionsDict) GetCompletedStages(sessionID string) []authtypes.LoginType {
-	d.Lock()
-	defer d.Unlock()
-
-	if completedStages, ok := d.sessions[sessionID]; ok {
-		return completedStages
-	}
-	// Ensure that a empty slice is returned and not nil. See #399.
-	return make([]authtypes.LoginType, 0)
-}
-
-func newSessionsDict() *sessionsDict {
-	return &sessionsDict{
-		sessions: make(map[string][]authtypes.LoginType),
-	}
-}
-
-// AddCompletedSessionStage records that a session has completed an auth stage.
-func AddCompletedSessionStage(sessionID string, stage authtypes.LoginType) {
-	sessions.Lock()
-	defer sessions.Unlock()
-
-	for _, completedStage := range sessions.sessions[sessionID] {
-		if completedStage == stage {
-			return
-		}
-	}
-	sessions.sessions[sessionID] = append(sessions.sessions[sessionID], stage)
-}
-
-var (
-	// TODO: Remove old sessions. Need to do so on a session-specific timeout.
-	// sessions stores the completed flow stages for all sessions. Referenced using their sessionID.
-	sessions           = newSessionsDict()
-	validUsernameRegex = regexp.MustCompile(`^[0-9a-z_\-./]+$`)
-)
+var validUsernameRegex = regexp.MustCompile(`^[0-9a-z_\-./]+$`)
 
 // registerRequest represents the submitted registration request.
 // It can be broken down into 2 sections: the auth dictionary and registration parameters.
@@ -138,29 +91,15 @@ type registerRequest struct {
 	// Prevent this user from logging in
 	InhibitLogin common.WeakBoolean `json:"inhibit_login"`
 
+	// Whether the client wants a refresh token, so that its access token
+	// expires and has to be refreshed.
+	RefreshToken bool `json:"refresh_token"`
+
 	// Application Services place Type in the root of their registration
 	// request, whereas clients place it in the authDict struct.
 	Type authtypes.LoginType `json:"type"`
 }
 
-type authDict struct {
-	Type    authtypes.LoginType         `json:"type"`
-	Session string                      `json:"session"`
-	Mac     gomatrixserverlib.HexString `json:"mac"`
-
-	// Recaptcha
-	Response string `json:"response"`
-	// TODO: Lots of custom keys depending on the type
-}
-
-// http://matrix.org/speculator/spec/HEAD/client_server/unstable.html#user-interactive-authentication-api
-type userInteractiveResponse struct {
-	Flows     []authtypes.Flow       `json:"flows"`
-	Completed []authtypes.LoginType  `json:"completed"`
-	Params    map[string]interface{} `json:"params"`
-	Session   string                 `json:"session"`
-}
-
 // legacyRegisterRequest represents the submitted registration request for v1 API.
 type legacyRegisterRequest struct {
 	Password string                      `json:"password"`
@@ -170,24 +109,15 @@ type legacyRegisterRequest struct {
 	Mac      gomatrixserverlib.HexString `json:"mac"`
 }
 
-// newUserInteractiveResponse will return a struct to be sent back to the client
-// during registration.
-func newUserInteractiveResponse(
-	sessionID string,
-	fs []authtypes.Flow,
-	params map[string]interface{},
-) userInteractiveResponse {
-	return userInteractiveResponse{
-		fs, sessions.GetCompletedStages(sessionID), params, sessionID,
-	}
-}
-
 // http://matrix.org/speculator/spec/HEAD/client_server/unstable.html#post-matrix-client-unstable-register
 type registerResponse struct {
 	UserID      string                       `json:"user_id"`
 	AccessToken string                       `json:"access_token,omitempty"`
 	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
 	DeviceID    string                       `json:"device_id,omitempty"`
+	// Only given if the client asked for a refresh token.
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 // recaptchaResponse represents the HTTP response from a Google Recaptcha server
@@ -236,18 +166,19 @@ func validateApplicationServiceUsername(username string) *util.JSONResponse {
 	return nil
 }
 
-// validatePassword returns an error response if the password is invalid
-func validatePassword(password string) *util.JSONResponse {
+// validatePassword returns an error response if the password is invalid, or
+// if it's shorter than the configured minimum length.
+func validatePassword(cfg *config.Dendrite, password string) *util.JSONResponse {
 	// https://github.com/matrix-org/synapse/blob/v0.20.0/synapse/rest/client/v2_alpha/register.py#L161
 	if len(password) > maxPasswordLength {
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.BadJSON(fmt.Sprintf("'password' >%d characters", maxPasswordLength)),
 		}
-	} else if len(password) > 0 && len(password) < minPasswordLength {
+	} else if len(password) > 0 && len(password) < cfg.Matrix.PasswordMinLength {
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.WeakPassword(fmt.Sprintf("password too weak: min %d chars", minPasswordLength)),
+			JSON: jsonerror.WeakPassword(fmt.Sprintf("password too weak: min %d chars", cfg.Matrix.PasswordMinLength)),
 		}
 	}
 	return nil
@@ -443,6 +374,7 @@ func Register(
 	accountDB accounts.Database,
 	deviceDB devices.Database,
 	cfg *config.Dendrite,
+	autoJoin *autoJoiner,
 ) util.JSONResponse {
 	var r registerRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
@@ -453,13 +385,6 @@ func Register(
 		return handleGuestRegistration(req, r, cfg, accountDB, deviceDB)
 	}
 
-	// Retrieve or generate the sessionID
-	sessionID := r.Auth.Session
-	if sessionID == "" {
-		// Generate a new, random session ID
-		sessionID = util.RandomString(sessionIDLength)
-	}
-
 	// Don't allow numeric usernames less than MAX_INT64.
 	if _, err := strconv.ParseInt(r.Username, 10, 64); err == nil {
 		return util.JSONResponse{
@@ -484,7 +409,7 @@ func Register(
 	if resErr = validateUsername(r.Username); resErr != nil {
 		return *resErr
 	}
-	if resErr = validatePassword(r.Password); resErr != nil {
+	if resErr = validatePassword(cfg, r.Password); resErr != nil {
 		return *resErr
 	}
 
@@ -506,7 +431,7 @@ func Register(
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	return handleRegistrationFlow(req, r, sessionID, cfg, accountDB, deviceDB)
+	return handleRegistrationFlow(req, r, cfg, accountDB, deviceDB, autoJoin)
 }
 
 func handleGuestRegistration(
@@ -536,7 +461,7 @@ func handleGuestRegistration(
 		}
 	}
 	//we don't allow guests to specify their own device_id
-	dev, err := deviceDB.CreateDevice(req.Context(), acc.Localpart, nil, token, r.InitialDisplayName)
+	dev, err := deviceDB.CreateGuestDevice(req.Context(), acc.Localpart, token, r.InitialDisplayName)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -556,14 +481,13 @@ func handleGuestRegistration(
 
 // handleRegistrationFlow will direct and complete registration flow stages
 // that the client has requested.
-// nolint: gocyclo
 func handleRegistrationFlow(
 	req *http.Request,
 	r registerRequest,
-	sessionID string,
 	cfg *config.Dendrite,
 	accountDB accounts.Database,
 	deviceDB devices.Database,
+	autoJoin *autoJoiner,
 ) util.JSONResponse {
 	// TODO: Shared secret registration (create new user scripts)
 	// TODO: Enable registration config flag
@@ -579,30 +503,6 @@ func handleRegistrationFlow(
 	}
 
 	switch r.Auth.Type {
-	case authtypes.LoginTypeRecaptcha:
-		// Check given captcha response
-		resErr := validateRecaptcha(cfg, r.Auth.Response, req.RemoteAddr)
-		if resErr != nil {
-			return *resErr
-		}
-
-		// Add Recaptcha to the list of completed registration stages
-		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
-
-	case authtypes.LoginTypeSharedSecret:
-		// Check shared secret against config
-		valid, err := isValidMacLogin(cfg, r.Username, r.Password, r.Admin, r.Auth.Mac)
-
-		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("isValidMacLogin failed")
-			return jsonerror.InternalServerError()
-		} else if !valid {
-			return util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
-		}
-
-		// Add SharedSecret to the list of completed registration stages
-		AddCompletedSessionStage(sessionID, authtypes.LoginTypeSharedSecret)
-
 	case "":
 		// Extract the access token from the request, if there's one to extract
 		// (which we can know by checking whether the error is nil or not).
@@ -627,24 +527,59 @@ func handleRegistrationFlow(
 		return handleApplicationServiceRegistration(
 			accessToken, err, req, r, cfg, accountDB, deviceDB,
 		)
-
-	case authtypes.LoginTypeDummy:
-		// there is nothing to do
-		// Add Dummy to the list of completed registration stages
-		AddCompletedSessionStage(sessionID, authtypes.LoginTypeDummy)
-
-	default:
-		return util.JSONResponse{
-			Code: http.StatusNotImplemented,
-			JSON: jsonerror.Unknown("unknown/unimplemented auth type"),
-		}
 	}
 
 	// Check if the user's registration flow has been completed successfully
 	// A response with current registration flow and remaining available methods
 	// will be returned if a flow has not been successfully completed yet
-	return checkAndCompleteFlow(sessions.GetCompletedStages(sessionID),
-		req, r, sessionID, cfg, accountDB, deviceDB)
+	// The registration token stage may have been completed earlier in the
+	// session, or by this request.
+	registrationToken := sessions.getRegistrationToken(r.Auth.Session)
+	if r.Auth.Type == authtypes.LoginTypeRegistrationToken {
+		registrationToken = r.Auth.Token
+	}
+	if resErr := registrationAuth(cfg, r, accountDB).verify(req, &r.Auth); resErr != nil {
+		return *resErr
+	}
+	if !cfg.Matrix.RegistrationRequiresToken {
+		registrationToken = ""
+	}
+	return completeRegistration(
+		req, accountDB, deviceDB, r.Username, r.Password, "", registrationToken,
+		r.InhibitLogin, r.InitialDisplayName, r.DeviceID, accessTokenLifetime(r.RefreshToken, cfg), autoJoin,
+	)
+}
+
+// registrationAuth returns the user-interactive auth of a registration
+// request. Its flows are derived from the config.
+func registrationAuth(cfg *config.Dendrite, r registerRequest, accountDB accounts.Database) *userInteractiveAuth {
+	stages := map[authtypes.LoginType]authStage{
+		authtypes.LoginTypeDummy: dummyStage,
+		authtypes.LoginTypeSharedSecret: func(req *http.Request, auth *authDict) *util.JSONResponse {
+			// Check shared secret against config
+			valid, err := isValidMacLogin(cfg, r.Username, r.Password, r.Admin, auth.Mac)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("isValidMacLogin failed")
+				resErr := jsonerror.InternalServerError()
+				return &resErr
+			} else if !valid {
+				resErr := util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
+				return &resErr
+			}
+			return nil
+		},
+	}
+	if cfg.Matrix.RecaptchaEnabled {
+		stages[authtypes.LoginTypeRecaptcha] = recaptchaStage(cfg)
+	}
+	if cfg.Matrix.RegistrationRequiresToken {
+		stages[authtypes.LoginTypeRegistrationToken] = registrationTokenStage(accountDB)
+	}
+	return &userInteractiveAuth{
+		flows:  cfg.Derived.Registration.Flows,
+		params: cfg.Derived.Registration.Params,
+		stages: stages,
+	}
 }
 
 // handleApplicationServiceRegistration handles the registration of an
@@ -686,49 +621,21 @@ func handleApplicationServiceRegistration(
 	// Don't need to worry about appending to registration stages as
 	// application service registration is entirely separate.
 	return completeRegistration(
-		req.Context(), accountDB, deviceDB, r.Username, "", appserviceID,
-		r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+		req, accountDB, deviceDB, r.Username, "", appserviceID, "",
+		r.InhibitLogin, r.InitialDisplayName, r.DeviceID, accessTokenLifetime(r.RefreshToken, cfg), nil,
 	)
 }
 
-// checkAndCompleteFlow checks if a given registration flow is completed given
-// a set of allowed flows. If so, registration is completed, otherwise a
-// response with
-func checkAndCompleteFlow(
-	flow []authtypes.LoginType,
-	req *http.Request,
-	r registerRequest,
-	sessionID string,
-	cfg *config.Dendrite,
-	accountDB accounts.Database,
-	deviceDB devices.Database,
-) util.JSONResponse {
-	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
-		// This flow was completed, registration can continue
-		return completeRegistration(
-			req.Context(), accountDB, deviceDB, r.Username, r.Password, "",
-			r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
-		)
-	}
-
-	// There are still more stages to complete.
-	// Return the flows and those that have been completed.
-	return util.JSONResponse{
-		Code: http.StatusUnauthorized,
-		JSON: newUserInteractiveResponse(sessionID,
-			cfg.Derived.Registration.Flows, cfg.Derived.Registration.Params),
-	}
-}
-
 // LegacyRegister process register requests from the legacy v1 API
 func LegacyRegister(
 	req *http.Request,
 	accountDB accounts.Database,
 	deviceDB devices.Database,
 	cfg *config.Dendrite,
+	autoJoin *autoJoiner,
 ) util.JSONResponse {
 	var r legacyRegisterRequest
-	resErr := parseAndValidateLegacyLogin(req, &r)
+	resErr := parseAndValidateLegacyLogin(req, cfg, &r)
 	if resErr != nil {
 		return *resErr
 	}
@@ -742,6 +649,10 @@ func LegacyRegister(
 	if cfg.Matrix.RegistrationDisabled && r.Type != authtypes.LoginTypeSharedSecret {
 		return util.MessageResponse(http.StatusForbidden, "Registration has been disabled")
 	}
+	// The legacy API has no way of giving a registration token.
+	if cfg.Matrix.RegistrationRequiresToken && r.Type != authtypes.LoginTypeSharedSecret {
+		return util.MessageResponse(http.StatusForbidden, "Registration requires a registration token")
+	}
 
 	switch r.Type {
 	case authtypes.LoginTypeSharedSecret:
@@ -759,10 +670,10 @@ func LegacyRegister(
 			return util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
 		}
 
-		return completeRegistration(req.Context(), accountDB, deviceDB, r.Username, r.Password, "", false, nil, nil)
+		return completeRegistration(req, accountDB, deviceDB, r.Username, r.Password, "", "", false, nil, nil, 0, autoJoin)
 	case authtypes.LoginTypeDummy:
 		// there is nothing to do
-		return completeRegistration(req.Context(), accountDB, deviceDB, r.Username, r.Password, "", false, nil, nil)
+		return completeRegistration(req, accountDB, deviceDB, r.Username, r.Password, "", "", false, nil, nil, 0, autoJoin)
 	default:
 		return util.JSONResponse{
 			Code: http.StatusNotImplemented,
@@ -773,7 +684,7 @@ func LegacyRegister(
 
 // parseAndValidateLegacyLogin parses the request into r and checks that the
 // request is valid (e.g. valid user names, etc)
-func parseAndValidateLegacyLogin(req *http.Request, r *legacyRegisterRequest) *util.JSONResponse {
+func parseAndValidateLegacyLogin(req *http.Request, cfg *config.Dendrite, r *legacyRegisterRequest) *util.JSONResponse {
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
 	if resErr != nil {
 		return resErr
@@ -785,7 +696,7 @@ func parseAndValidateLegacyLogin(req *http.Request, r *legacyRegisterRequest) *u
 	if resErr = validateUsername(r.Username); resErr != nil {
 		return resErr
 	}
-	if resErr = validatePassword(r.Password); resErr != nil {
+	if resErr = validatePassword(cfg, r.Password); resErr != nil {
 		return resErr
 	}
 
@@ -805,14 +716,20 @@ func parseAndValidateLegacyLogin(req *http.Request, r *legacyRegisterRequest) *u
 // We pass in each individual part of the request here instead of just passing a
 // registerRequest, as this function serves requests encoded as both
 // registerRequests and legacyRegisterRequests, which share some attributes but
-// not all
+// not all. Once the account has been created, the user is joined to the
+// auto_join_rooms by autoJoin, if it isn't nil. If accessTokenLifetime isn't
+// zero then the device is issued a refresh token, and its access token expires
+// after that long. If registrationToken isn't empty then the registration is
+// counted against it, and fails if the token has been used up.
 func completeRegistration(
-	ctx context.Context,
+	req *http.Request,
 	accountDB accounts.Database,
 	deviceDB devices.Database,
-	username, password, appserviceID string,
+	username, password, appserviceID, registrationToken string,
 	inhibitLogin common.WeakBoolean,
 	displayName, deviceID *string,
+	accessTokenLifetime time.Duration,
+	autoJoin *autoJoiner,
 ) util.JSONResponse {
 	if username == "" {
 		return util.JSONResponse{
@@ -828,8 +745,21 @@ func completeRegistration(
 		}
 	}
 
-	acc, err := accountDB.CreateAccount(ctx, username, password, appserviceID)
-	if err != nil {
+	var acc *authtypes.Account
+	var err error
+	if registrationToken != "" {
+		// The token may have been used up by someone else since the stage
+		// was completed, in which case no account is made.
+		acc, err = accountDB.CreateAccountWithRegistrationToken(req.Context(), username, password, appserviceID, registrationToken)
+	} else {
+		acc, err = accountDB.CreateAccount(req.Context(), username, password, appserviceID)
+	}
+	if err == authtypes.ErrRegistrationTokenUsedUp {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The registration token is no longer valid"),
+		}
+	} else if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
 			JSON: jsonerror.Unknown("failed to create account: " + err.Error()),
@@ -844,6 +774,8 @@ func completeRegistration(
 	// Increment prometheus counter for created users
 	amtRegUsers.Inc()
 
+	autoJoin.joinRooms(req, userutil.MakeUserID(username, acc.ServerName))
+
 	// Check whether inhibit_login option is set. If so, don't create an access
 	// token or a device for this user
 	if inhibitLogin {
@@ -864,7 +796,7 @@ func completeRegistration(
 		}
 	}
 
-	dev, err := deviceDB.CreateDevice(ctx, username, deviceID, token, displayName)
+	dev, err := deviceDB.CreateDevice(req.Context(), username, deviceID, token, displayName)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -872,14 +804,22 @@ func completeRegistration(
 		}
 	}
 
+	res := registerResponse{
+		UserID:      dev.UserID,
+		AccessToken: dev.AccessToken,
+		HomeServer:  acc.ServerName,
+		DeviceID:    dev.ID,
+	}
+	if accessTokenLifetime != 0 {
+		res.RefreshToken, res.ExpiresInMS, err = issueRefreshToken(req.Context(), deviceDB, username, dev.ID, dev.AccessToken, accessTokenLifetime)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("issueRefreshToken failed")
+			return jsonerror.InternalServerError()
+		}
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: registerResponse{
-			UserID:      dev.UserID,
-			AccessToken: dev.AccessToken,
-			HomeServer:  acc.ServerName,
-			DeviceID:    dev.ID,
-		},
+		JSON: res,
 	}
 }
 
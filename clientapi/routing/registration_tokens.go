@@ -0,0 +1,241 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultRegistrationTokenLength = 16
+	maxRegistrationTokenLength     = 64
+)
+
+// validRegistrationToken matches the tokens which can be created, which are
+// made of the characters allowed by MSC3231.
+var validRegistrationToken = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,64}$`)
+
+type registrationTokenJSON struct {
+	Token       string `json:"token"`
+	UsesAllowed *int64 `json:"uses_allowed"`
+	Completed   int64  `json:"completed"`
+	ExpiryTime  *int64 `json:"expiry_time"`
+}
+
+type createRegistrationTokenRequest struct {
+	// The token to create. A random token is generated if it is empty.
+	Token string `json:"token"`
+	// The length of the random token.
+	Length      int    `json:"length"`
+	UsesAllowed *int64 `json:"uses_allowed"`
+	ExpiryTime  *int64 `json:"expiry_time"`
+}
+
+type registrationTokensResponse struct {
+	RegistrationTokens []registrationTokenJSON `json:"registration_tokens"`
+}
+
+func newRegistrationTokenJSON(token *authtypes.RegistrationToken) registrationTokenJSON {
+	return registrationTokenJSON{
+		Token:       token.Token,
+		UsesAllowed: token.UsesAllowed,
+		Completed:   token.Completed,
+		ExpiryTime:  token.ExpiryTime,
+	}
+}
+
+// registrationTokenUsable returns whether a registration token exists and can
+// still be used to register.
+func registrationTokenUsable(ctx context.Context, accountDB accounts.Database, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	registrationToken, err := accountDB.GetRegistrationToken(ctx, token)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return registrationToken.Usable(int64(gomatrixserverlib.AsTimestamp(time.Now()))), nil
+}
+
+// CheckRegistrationTokenValidity implements GET /_matrix/client/v1/register/m.login.registration_token/validity
+// It lets clients check a registration token before asking for the rest of
+// the registration details.
+func CheckRegistrationTokenValidity(req *http.Request, accountDB accounts.Database) util.JSONResponse {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing token"),
+		}
+	}
+	valid, err := registrationTokenUsable(req.Context(), accountDB, token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("registrationTokenUsable failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Valid bool `json:"valid"`
+		}{valid},
+	}
+}
+
+// CreateRegistrationToken implements POST /_dendrite/admin/v1/registration_tokens/new
+func CreateRegistrationToken(
+	req *http.Request, device *authtypes.Device,
+	cfg *config.Dendrite, accountDB accounts.Database,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	var r createRegistrationTokenRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.UsesAllowed != nil && *r.UsesAllowed < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("uses_allowed must be a non-negative integer or null"),
+		}
+	}
+	if r.ExpiryTime != nil && *r.ExpiryTime <= int64(gomatrixserverlib.AsTimestamp(time.Now())) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("expiry_time must be in the future"),
+		}
+	}
+	if r.Token == "" {
+		if r.Length == 0 {
+			r.Length = defaultRegistrationTokenLength
+		}
+		if r.Length < 0 || r.Length > maxRegistrationTokenLength {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("length must be between 1 and 64"),
+			}
+		}
+		r.Token = util.RandomString(r.Length)
+	} else if !validRegistrationToken.MatchString(r.Token) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("token must be at most 64 characters from [A-Za-z0-9._~-]"),
+		}
+	}
+
+	token := authtypes.RegistrationToken{Token: r.Token, UsesAllowed: r.UsesAllowed, ExpiryTime: r.ExpiryTime}
+	created, err := accountDB.CreateRegistrationToken(req.Context(), &token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if !created {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("The registration token already exists"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: newRegistrationTokenJSON(&token),
+	}
+}
+
+// ListRegistrationTokens implements GET /_dendrite/admin/v1/registration_tokens
+func ListRegistrationTokens(
+	req *http.Request, device *authtypes.Device,
+	cfg *config.Dendrite, accountDB accounts.Database,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	tokens, err := accountDB.GetRegistrationTokens(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationTokens failed")
+		return jsonerror.InternalServerError()
+	}
+	res := registrationTokensResponse{RegistrationTokens: []registrationTokenJSON{}}
+	for i := range tokens {
+		res.RegistrationTokens = append(res.RegistrationTokens, newRegistrationTokenJSON(&tokens[i]))
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// GetRegistrationToken implements GET /_dendrite/admin/v1/registration_tokens/{token}
+func GetRegistrationToken(
+	req *http.Request, device *authtypes.Device, token string,
+	cfg *config.Dendrite, accountDB accounts.Database,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	registrationToken, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown registration token"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: newRegistrationTokenJSON(registrationToken),
+	}
+}
+
+// DeleteRegistrationToken implements DELETE /_dendrite/admin/v1/registration_tokens/{token}
+func DeleteRegistrationToken(
+	req *http.Request, device *authtypes.Device, token string,
+	cfg *config.Dendrite, accountDB accounts.Database,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	deleted, err := accountDB.RemoveRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if !deleted {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown registration token"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+)
+
+// newRegistrationTokenTest sets up a server which only lets people register
+// with a registration token, with @admin:localhost as a server admin.
+func newRegistrationTokenTest(t *testing.T) (*deactivateTest, func()) {
+	d, cleanup := newDeactivateTest(t)
+	d.room.cfg.Matrix.AdminUsers = []string{"@admin:localhost"}
+	d.room.cfg.Matrix.RegistrationRequiresToken = true
+	if err := d.room.cfg.Derive(); err != nil {
+		t.Fatal(err)
+	}
+	return d, cleanup
+}
+
+func (d *deactivateTest) createRegistrationToken(t *testing.T, body string) registrationTokenJSON {
+	req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/v1/registration_tokens/new", strings.NewReader(body))
+	res := CreateRegistrationToken(req, &authtypes.Device{UserID: "@admin:localhost"}, d.room.cfg, d.accountDB)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	return res.JSON.(registrationTokenJSON)
+}
+
+func (d *deactivateTest) register(username, auth string) (int, interface{}) {
+	body := `{"username": "` + username + `", "password": "correct horse battery", "auth": ` + auth + `}`
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/register", strings.NewReader(body))
+	res := Register(req, d.accountDB, d.deviceDB, d.room.cfg, d.autoJoin)
+	return res.Code, res.JSON
+}
+
+// registerWithToken completes the registration token stage and then the
+// dummy stage.
+func (d *deactivateTest) registerWithToken(username, token string) (int, interface{}) {
+	code, body := d.register(username, `{"type": "m.login.registration_token", "token": "`+token+`"}`)
+	if code != http.StatusUnauthorized {
+		return code, body
+	}
+	res := body.(userInteractiveResponse)
+	if res.MatrixError != nil {
+		return code, body
+	}
+	return d.register(username, `{"type": "m.login.dummy", "session": "`+res.Session+`"}`)
+}
+
+func (d *deactivateTest) accountExists(t *testing.T, localpart string) bool {
+	_, err := d.accountDB.GetAccountByLocalpart(context.Background(), localpart)
+	if err != nil && err != sql.ErrNoRows {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestRegistrationTokenAllowsRegistration(t *testing.T) {
+	d, cleanup := newRegistrationTokenTest(t)
+	defer cleanup()
+	token := d.createRegistrationToken(t, `{"uses_allowed": 2}`)
+	if len(token.Token) != defaultRegistrationTokenLength || token.Completed != 0 {
+		t.Fatalf("expected a new random token, got %+v", token)
+	}
+
+	if code, body := d.registerWithToken("bob", token.Token); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	if !d.accountExists(t, "bob") {
+		t.Errorf("expected bob to be registered")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/_dendrite/admin/v1/registration_tokens/"+token.Token, nil)
+	res := GetRegistrationToken(req, &authtypes.Device{UserID: "@admin:localhost"}, token.Token, d.room.cfg, d.accountDB)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	if completed := res.JSON.(registrationTokenJSON).Completed; completed != 1 {
+		t.Errorf("expected the token to have been used once, got %d", completed)
+	}
+}
+
+func TestUsedUpRegistrationTokenIsRejected(t *testing.T) {
+	d, cleanup := newRegistrationTokenTest(t)
+	defer cleanup()
+	token := d.createRegistrationToken(t, `{"token": "one-use", "uses_allowed": 1}`)
+
+	if code, body := d.registerWithToken("bob", token.Token); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	code, body := d.registerWithToken("carol", token.Token)
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a used up token, got %d: %v", code, body)
+	}
+	if res := body.(userInteractiveResponse); res.MatrixError == nil || res.ErrCode != "M_FORBIDDEN" {
+		t.Errorf("expected M_FORBIDDEN for a used up token, got %+v", res)
+	}
+	if d.accountExists(t, "carol") {
+		t.Errorf("expected carol not to be registered")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/v1/register/m.login.registration_token/validity?token=one-use", nil)
+	if res := CheckRegistrationTokenValidity(req, d.accountDB); res.Code != http.StatusOK || res.JSON.(struct {
+		Valid bool `json:"valid"`
+	}).Valid {
+		t.Errorf("expected the used up token not to be valid, got %d: %v", res.Code, res.JSON)
+	}
+}
+
+func TestRegistrationTokenIsOnlyUsedAsOftenAsAllowed(t *testing.T) {
+	d, cleanup := newRegistrationTokenTest(t)
+	defer cleanup()
+	token := d.createRegistrationToken(t, `{"token": "one-use", "uses_allowed": 1}`)
+
+	// Both complete the token stage before either has registered.
+	var sessions []string
+	for _, username := range []string{"bob", "carol"} {
+		code, body := d.register(username, `{"type": "m.login.registration_token", "token": "`+token.Token+`"}`)
+		if res, ok := body.(userInteractiveResponse); code != http.StatusUnauthorized || !ok || res.MatrixError != nil {
+			t.Fatalf("expected the token stage to be completed, got %d: %v", code, body)
+		}
+		sessions = append(sessions, body.(userInteractiveResponse).Session)
+	}
+
+	if code, body := d.register("bob", `{"type": "m.login.dummy", "session": "`+sessions[0]+`"}`); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	code, body := d.register("carol", `{"type": "m.login.dummy", "session": "`+sessions[1]+`"}`)
+	if code != http.StatusForbidden {
+		t.Fatalf("expected 403 once the token is used up, got %d: %v", code, body)
+	}
+	if d.accountExists(t, "carol") {
+		t.Errorf("expected carol not to be registered")
+	}
+}
+
+func TestRegistrationRequiresToken(t *testing.T) {
+	d, cleanup := newRegistrationTokenTest(t)
+	defer cleanup()
+
+	code, body := d.register("bob", `{"type": "m.login.dummy"}`)
+	if code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d: %v", code, body)
+	}
+	for _, flow := range body.(userInteractiveResponse).Flows {
+		if len(flow.Stages) == 0 || flow.Stages[0] != authtypes.LoginTypeRegistrationToken {
+			t.Errorf("expected every flow to start with the registration token stage, got %v", flow.Stages)
+		}
+	}
+	if code, body = d.registerWithToken("bob", "made-up"); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an unknown token, got %d: %v", code, body)
+	}
+	if d.accountExists(t, "bob") {
+		t.Errorf("expected bob not to be registered")
+	}
+}
+
+func TestRegistrationTokensForbiddenForNormalUsers(t *testing.T) {
+	d, cleanup := newRegistrationTokenTest(t)
+	defer cleanup()
+	req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/v1/registration_tokens/new", strings.NewReader(`{}`))
+	res := CreateRegistrationToken(req, d.device, d.room.cfg, d.accountDB)
+	if res.Code != http.StatusForbidden || res.JSON.(*jsonerror.MatrixError).ErrCode != "M_FORBIDDEN" {
+		t.Errorf("expected 403 M_FORBIDDEN, got %d: %v", res.Code, res.JSON)
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// rejectInviteRetries is how many more times a leave which couldn't be sent
+// when rejecting an invite is tried again by the InviteRejectionRetrier. The
+// first retry is after rejectInviteRetryInterval, which doubles after each
+// retry. The retrier looks for leaves to retry every rejectInviteRetryInterval.
+var (
+	rejectInviteRetries       = 5
+	rejectInviteRetryInterval = time.Minute
+)
+
+// rejectInviteReq is a rejection of the invite of a local user to a room
+// which this server isn't in.
+type rejectInviteReq struct {
+	userID      string
+	roomID      string
+	reason      string
+	roomVersion gomatrixserverlib.RoomVersion
+	cfg         *config.Dendrite
+	federation  *gomatrixserverlib.FederationClient
+	// The servers to send the leave through, which are those of the users
+	// who invited the user.
+	servers []gomatrixserverlib.ServerName
+}
+
+// rejectRemoteInvite rejects the invite of the user to a room which this
+// server isn't in, by sending the leave through the servers of the users who
+// invited them. The user is marked as having left whether or not the leave
+// could be sent, and if it couldn't the rejection is stored so that the
+// InviteRejectionRetrier tries again. Returns nil if the user isn't invited to
+// such a room, in which case the leave has to be sent to the room as usual.
+func rejectRemoteInvite(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, roomID, reason string,
+	cfg *config.Dendrite, federation *gomatrixserverlib.FederationClient,
+	queryAPI roomserverAPI.RoomserverQueryAPI, producer *producers.RoomserverProducer,
+) *util.JSONResponse {
+	ctx := req.Context()
+	var invitesRes roomserverAPI.QueryInvitesForUserResponse
+	if err := queryAPI.QueryInvitesForUser(ctx, &roomserverAPI.QueryInvitesForUserRequest{
+		RoomID: roomID, TargetUserID: device.UserID,
+	}, &invitesRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryInvitesForUser failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if len(invitesRes.InviteSenderUserIDs) == 0 {
+		return nil
+	}
+	var joinedRes roomserverAPI.QueryServerJoinedToRoomResponse
+	if err := queryAPI.QueryServerJoinedToRoom(ctx, &roomserverAPI.QueryServerJoinedToRoomRequest{
+		RoomID: roomID, ServerName: cfg.Matrix.ServerName,
+	}, &joinedRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryServerJoinedToRoom failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if joinedRes.IsInRoom {
+		return nil
+	}
+	var verRes roomserverAPI.QueryRoomVersionForRoomResponse
+	if err := queryAPI.QueryRoomVersionForRoom(ctx, &roomserverAPI.QueryRoomVersionForRoomRequest{
+		RoomID: roomID,
+	}, &verRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryRoomVersionForRoom failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	r := rejectInviteReq{
+		userID: device.UserID, roomID: roomID, reason: reason,
+		roomVersion: verRes.RoomVersion, cfg: cfg, federation: federation,
+	}
+	seen := map[gomatrixserverlib.ServerName]bool{cfg.Matrix.ServerName: true}
+	for _, userID := range invitesRes.InviteSenderUserIDs {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && !seen[domain] {
+			seen[domain] = true
+			r.servers = append(r.servers, domain)
+		}
+	}
+
+	var leaveEventID string
+	if !cfg.Matrix.FederationDisabled {
+		var err error
+		if leaveEventID, err = r.sendLeave(ctx); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Warn("Failed to send the rejection of an invite, retrying later")
+			if err = r.storeForRetry(ctx, accountDB); err != nil {
+				util.GetLogger(ctx).WithError(err).Error("Failed to store the rejection of an invite to retry")
+			}
+		}
+	}
+
+	if err := producer.InputAPI.RejectInvite(ctx, &roomserverAPI.RejectInviteRequest{
+		RoomID: roomID, UserID: device.UserID, LeaveEventID: leaveEventID,
+	}, &roomserverAPI.RejectInviteResponse{}); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("producer.InputAPI.RejectInvite failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return &util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// sendLeave sends the leave through the first of the servers which accepts
+// it, and returns the ID of the leave event.
+func (r rejectInviteReq) sendLeave(ctx context.Context) (string, error) {
+	if len(r.servers) == 0 {
+		return "", fmt.Errorf("no servers to send the leave through")
+	}
+	var lastErr error
+	for _, server := range r.servers {
+		var event gomatrixserverlib.Event
+		if event, lastErr = r.sendLeaveUsingServer(ctx, server); lastErr == nil {
+			return event.EventID(), nil
+		}
+		util.GetLogger(ctx).WithError(lastErr).WithField("server", server).Warn("Failed to send leave using server")
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return "", lastErr
+}
+
+func (r rejectInviteReq) sendLeaveUsingServer(
+	ctx context.Context, server gomatrixserverlib.ServerName,
+) (gomatrixserverlib.Event, error) {
+	respMakeLeave, err := r.federation.MakeLeave(ctx, server, r.roomID, r.userID)
+	if err != nil {
+		return gomatrixserverlib.Event{}, fmt.Errorf("r.federation.MakeLeave: %w", err)
+	}
+
+	// Set all the fields to be what they should be, in case the remote
+	// server returned us something "odd".
+	eb := respMakeLeave.LeaveEvent
+	eb.Type = gomatrixserverlib.MRoomMember
+	eb.Sender = r.userID
+	eb.StateKey = &r.userID
+	eb.RoomID = r.roomID
+	eb.Redacts = ""
+	if err = eb.SetContent(gomatrixserverlib.MemberContent{
+		Membership: gomatrixserverlib.Leave, Reason: r.reason,
+	}); err != nil {
+		return gomatrixserverlib.Event{}, fmt.Errorf("eb.SetContent: %w", err)
+	}
+	if err = eb.SetUnsigned(struct{}{}); err != nil {
+		return gomatrixserverlib.Event{}, fmt.Errorf("eb.SetUnsigned: %w", err)
+	}
+	event, err := eb.Build(
+		time.Now(), r.cfg.Matrix.ServerName, r.cfg.Matrix.KeyID,
+		r.cfg.Matrix.PrivateKey, r.roomVersion,
+	)
+	if err != nil {
+		return gomatrixserverlib.Event{}, fmt.Errorf("eb.Build: %w", err)
+	}
+
+	if err = common.SendLeave(ctx, r.federation, r.cfg, server, event); err != nil {
+		return gomatrixserverlib.Event{}, fmt.Errorf("common.SendLeave: %w", err)
+	}
+	return event, nil
+}
+
+// storeForRetry stores the rejection in the account database, so that the
+// InviteRejectionRetrier tries sending the leave again.
+func (r rejectInviteReq) storeForRetry(ctx context.Context, accountDB accounts.Database) error {
+	localpart, _, err := gomatrixserverlib.SplitID('@', r.userID)
+	if err != nil {
+		return err
+	}
+	rejection := authtypes.InviteRejection{
+		Localpart:     localpart,
+		RoomID:        r.roomID,
+		Reason:        r.reason,
+		RoomVersion:   string(r.roomVersion),
+		NextAttemptMS: int64(gomatrixserverlib.AsTimestamp(time.Now().Add(rejectInviteRetryInterval))),
+	}
+	for _, server := range r.servers {
+		rejection.Servers = append(rejection.Servers, string(server))
+	}
+	return accountDB.StoreInviteRejection(ctx, &rejection)
+}
+
+// InviteRejectionRetrier tries again to send the leaves which couldn't be
+// sent when users rejected invites to rooms which this server isn't in, as
+// the servers of the inviters are often unreachable for a while. The
+// rejections are kept in the account database, so that their leaves are
+// still sent after a restart.
+type InviteRejectionRetrier struct {
+	cfg        *config.Dendrite
+	federation *gomatrixserverlib.FederationClient
+	accountDB  accounts.Database
+}
+
+// NewInviteRejectionRetrier creates a new InviteRejectionRetrier.
+func NewInviteRejectionRetrier(
+	cfg *config.Dendrite, federation *gomatrixserverlib.FederationClient, accountDB accounts.Database,
+) *InviteRejectionRetrier {
+	return &InviteRejectionRetrier{cfg, federation, accountDB}
+}
+
+// Start starts retrying the leaves in the background.
+func (r *InviteRejectionRetrier) Start() {
+	go func() {
+		for {
+			time.Sleep(rejectInviteRetryInterval)
+			r.retryDue(context.Background())
+		}
+	}()
+}
+
+// retryDue tries sending the leaves which are due to be tried again.
+func (r *InviteRejectionRetrier) retryDue(ctx context.Context) {
+	now := time.Now()
+	rejections, err := r.accountDB.GetDueInviteRejections(ctx, int64(gomatrixserverlib.AsTimestamp(now)))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("r.accountDB.GetDueInviteRejections failed")
+		return
+	}
+	for i := range rejections {
+		r.retry(ctx, &rejections[i], now)
+	}
+}
+
+// retry tries sending the leave of a rejection again. The rejection is
+// removed if the leave is sent or it has been tried too often, and otherwise
+// is stored to be tried again after the next interval.
+func (r *InviteRejectionRetrier) retry(ctx context.Context, rejection *authtypes.InviteRejection, now time.Time) {
+	req := rejectInviteReq{
+		userID:      userutil.MakeUserID(rejection.Localpart, r.cfg.Matrix.ServerName),
+		roomID:      rejection.RoomID,
+		reason:      rejection.Reason,
+		roomVersion: gomatrixserverlib.RoomVersion(rejection.RoomVersion),
+		cfg:         r.cfg,
+		federation:  r.federation,
+	}
+	for _, server := range rejection.Servers {
+		req.servers = append(req.servers, gomatrixserverlib.ServerName(server))
+	}
+	logger := util.GetLogger(ctx).WithField("room_id", req.roomID).WithField("user_id", req.userID)
+
+	_, err := req.sendLeave(ctx)
+	switch {
+	case err == nil:
+		logger.Info("Sent the rejection of an invite after retrying")
+	case rejection.Attempts+1 >= rejectInviteRetries:
+		logger.WithError(err).Warn("Gave up sending the rejection of an invite")
+	default:
+		rejection.Attempts++
+		rejection.NextAttemptMS = int64(gomatrixserverlib.AsTimestamp(now.Add(rejectInviteRetryInterval << uint(rejection.Attempts))))
+		if err = r.accountDB.StoreInviteRejection(ctx, rejection); err != nil {
+			logger.WithError(err).Error("r.accountDB.StoreInviteRejection failed")
+		}
+		return
+	}
+	if err = r.accountDB.RemoveInviteRejection(ctx, rejection.Localpart, rejection.RoomID); err != nil {
+		logger.WithError(err).Error("r.accountDB.RemoveInviteRejection failed")
+	}
+}
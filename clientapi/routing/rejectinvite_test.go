@@ -0,0 +1,287 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+func (r *testRoom) RejectInvite(
+	ctx context.Context,
+	request *api.RejectInviteRequest,
+	response *api.RejectInviteResponse,
+) error {
+	return nil
+}
+
+// invitedTestRoom is a room on remote.example.com which bob invited alice to,
+// and which this server isn't in.
+type invitedTestRoom struct {
+	*testRoom
+	rejected []api.RejectInviteRequest
+}
+
+func (r *invitedTestRoom) QueryInvitesForUser(
+	ctx context.Context,
+	request *api.QueryInvitesForUserRequest,
+	response *api.QueryInvitesForUserResponse,
+) error {
+	if request.RoomID == remoteTestRoomID && request.TargetUserID == "@alice:localhost" {
+		response.InviteSenderUserIDs = []string{"@bob:remote.example.com"}
+	}
+	return nil
+}
+
+func (r *invitedTestRoom) QueryServerJoinedToRoom(
+	ctx context.Context,
+	request *api.QueryServerJoinedToRoomRequest,
+	response *api.QueryServerJoinedToRoomResponse,
+) error {
+	response.RoomExists = true
+	return nil
+}
+
+func (r *invitedTestRoom) QueryRoomVersionForRoom(
+	ctx context.Context,
+	request *api.QueryRoomVersionForRoomRequest,
+	response *api.QueryRoomVersionForRoomResponse,
+) error {
+	response.RoomVersion = gomatrixserverlib.RoomVersionV3
+	return nil
+}
+
+func (r *invitedTestRoom) RejectInvite(
+	ctx context.Context,
+	request *api.RejectInviteRequest,
+	response *api.RejectInviteResponse,
+) error {
+	r.rejected = append(r.rejected, *request)
+	return nil
+}
+
+// leaveTestServer is remote.example.com, which accepts leaves as long as it
+// is up.
+type leaveTestServer struct {
+	mutex  sync.Mutex
+	down   bool
+	leaves []gomatrixserverlib.Event
+}
+
+func (s *leaveTestServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.down || req.URL.Host != "remote.example.com" {
+		return nil, errors.New("connection refused")
+	}
+	var res interface{}
+	switch {
+	case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/_matrix/federation/v1/make_leave/"):
+		stateKey := "@alice:localhost"
+		res = gomatrixserverlib.RespMakeLeave{LeaveEvent: gomatrixserverlib.EventBuilder{
+			Type:       gomatrixserverlib.MRoomMember,
+			Sender:     stateKey,
+			StateKey:   &stateKey,
+			RoomID:     remoteTestRoomID,
+			Depth:      5,
+			PrevEvents: []string{"$prev"},
+			AuthEvents: []string{"$create", "$power_levels", "$invite"},
+			Content:    []byte(`{"membership":"leave"}`),
+		}}
+	case req.Method == http.MethodPut && strings.HasPrefix(req.URL.Path, "/_matrix/federation/v2/send_leave/"):
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON(body, false, gomatrixserverlib.RoomVersionV3)
+		if err != nil {
+			return nil, err
+		}
+		s.leaves = append(s.leaves, event)
+		res = struct{}{}
+	default:
+		return nil, errors.New("unexpected request to " + req.URL.String())
+	}
+	content, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBuffer(content)),
+		Request:    req,
+	}, nil
+}
+
+func (s *leaveTestServer) sentLeaves() []gomatrixserverlib.Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.leaves
+}
+
+// newLeaveTestFederation returns a federation client which talks to the
+// leave test server.
+func newLeaveTestFederation(room *invitedTestRoom, server *leaveTestServer) *gomatrixserverlib.FederationClient {
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", server)
+	cfg := room.cfg
+	federation := gomatrixserverlib.NewFederationClientWithTransport(
+		cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, tr,
+	)
+	federation.Client = *gomatrixserverlib.NewClientWithTimeout(0, tr)
+	return federation
+}
+
+// rejectInvite makes alice leave the remote room she was invited to.
+func rejectInvite(t *testing.T, room *invitedTestRoom, server *leaveTestServer, accountDB accounts.Database) util.JSONResponse {
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/rooms/"+remoteTestRoomID+"/leave", strings.NewReader(`{"reason":"no thanks"}`))
+	return SendMembership(
+		req, accountDB, &authtypes.Device{UserID: "@alice:localhost"}, remoteTestRoomID, gomatrixserverlib.Leave, room.cfg,
+		newLeaveTestFederation(room, server), room, nil, producers.NewRoomserverProducer(room, room), &producers.SyncAPIProducer{Producer: testSyncProducer{}},
+	)
+}
+
+func TestRejectRemoteInviteSendsLeave(t *testing.T) {
+	room := &invitedTestRoom{testRoom: newTestRoom(t)}
+	server := &leaveTestServer{}
+	if res := rejectInvite(t, room, server, nil); res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+
+	leaves := server.sentLeaves()
+	if len(leaves) != 1 {
+		t.Fatalf("expected one leave to be sent, got %d", len(leaves))
+	}
+	var content gomatrixserverlib.MemberContent
+	if err := json.Unmarshal(leaves[0].Content(), &content); err != nil {
+		t.Fatal(err)
+	}
+	if content.Membership != gomatrixserverlib.Leave || content.Reason != "no thanks" || leaves[0].Origin() != "localhost" {
+		t.Errorf("unexpected leave event: %s", leaves[0].JSON())
+	}
+	if len(room.rejected) != 1 || room.rejected[0].LeaveEventID != leaves[0].EventID() {
+		t.Errorf("expected the invite to be retired by %s, got %v", leaves[0].EventID(), room.rejected)
+	}
+	if len(room.sent) != 0 {
+		t.Errorf("expected no events to be sent to the roomserver, got %d", len(room.sent))
+	}
+}
+
+func TestRejectRemoteInviteWhileRemoteIsDown(t *testing.T) {
+	interval := rejectInviteRetryInterval
+	rejectInviteRetryInterval = 10 * time.Millisecond
+	defer func() { rejectInviteRetryInterval = interval }()
+
+	dir, err := ioutil.TempDir("", "rejectinvite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	accountDB, err := accounts.NewDatabase("file:"+filepath.Join(dir, "account.db"), nil, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	room := &invitedTestRoom{testRoom: newTestRoom(t)}
+	server := &leaveTestServer{down: true}
+	if res := rejectInvite(t, room, server, accountDB); res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	// The user has left locally, even though the leave couldn't be sent.
+	if len(room.rejected) != 1 || room.rejected[0].UserID != "@alice:localhost" || room.rejected[0].LeaveEventID != "" {
+		t.Fatalf("expected the invite to be retired without a leave event, got %v", room.rejected)
+	}
+
+	ctx := context.Background()
+	storedRejections := func() []authtypes.InviteRejection {
+		rejections, queryErr := accountDB.GetDueInviteRejections(ctx, int64(gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour))))
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		return rejections
+	}
+	if rejections := storedRejections(); len(rejections) != 1 || rejections[0].Localpart != "alice" || rejections[0].Reason != "no thanks" {
+		t.Fatalf("expected the rejection to be stored, got %+v", rejections)
+	}
+
+	// Trying again while the remote is still down backs off.
+	time.Sleep(2 * rejectInviteRetryInterval)
+	NewInviteRejectionRetrier(room.cfg, newLeaveTestFederation(room, server), accountDB).retryDue(ctx)
+	if rejections := storedRejections(); len(rejections) != 1 || rejections[0].Attempts != 1 {
+		t.Fatalf("expected the rejection to be kept for another attempt, got %+v", rejections)
+	}
+
+	// Once the remote is up again the leave is sent after all, even by a
+	// retrier which wasn't the one to try before, as after a restart.
+	server.mutex.Lock()
+	server.down = false
+	server.mutex.Unlock()
+	time.Sleep(3 * rejectInviteRetryInterval)
+	NewInviteRejectionRetrier(room.cfg, newLeaveTestFederation(room, server), accountDB).retryDue(ctx)
+	if leaves := server.sentLeaves(); len(leaves) != 1 {
+		t.Fatalf("expected the leave to be retried, got %d leaves", len(leaves))
+	}
+	if rejections := storedRejections(); len(rejections) != 0 {
+		t.Errorf("expected the rejection to be removed once sent, got %+v", rejections)
+	}
+}
+
+func TestRejectRemoteInviteGivesUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rejectinvite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	accountDB, err := accounts.NewDatabase("file:"+filepath.Join(dir, "account.db"), nil, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	room := &invitedTestRoom{testRoom: newTestRoom(t)}
+	ctx := context.Background()
+	if err = accountDB.StoreInviteRejection(ctx, &authtypes.InviteRejection{
+		Localpart: "alice", RoomID: remoteTestRoomID, RoomVersion: string(gomatrixserverlib.RoomVersionV3),
+		Servers: []string{"remote.example.com"}, Attempts: rejectInviteRetries - 1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	NewInviteRejectionRetrier(room.cfg, newLeaveTestFederation(room, &leaveTestServer{down: true}), accountDB).retryDue(ctx)
+	rejections, err := accountDB.GetDueInviteRejections(ctx, int64(gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejections) != 0 {
+		t.Errorf("expected the rejection to be given up on, got %+v", rejections)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type reportEventRequest struct {
+	Reason string `json:"reason"`
+	Score  *int64 `json:"score"`
+}
+
+type eventReportsResponse struct {
+	EventReports []authtypes.EventReport `json:"event_reports"`
+}
+
+// ReportEvent implements POST /rooms/{roomId}/report/{eventId}
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-rooms-roomid-report-eventid
+func ReportEvent(
+	req *http.Request, device *authtypes.Device, roomID, eventID string,
+	queryAPI api.RoomserverQueryAPI, accountDB accounts.Database,
+) util.JSONResponse {
+	var r reportEventRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Score == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("A score is required"),
+		}
+	}
+	if *r.Score < -100 || *r.Score > 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("The score must be between -100 and 0"),
+		}
+	}
+
+	visible, err := canSeeEvent(req.Context(), queryAPI, device.UserID, roomID, eventID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("canSeeEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	if !visible {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+		}
+	}
+
+	report := authtypes.EventReport{
+		RoomID:     roomID,
+		EventID:    eventID,
+		UserID:     device.UserID,
+		Reason:     r.Reason,
+		Score:      *r.Score,
+		ReceivedTS: int64(gomatrixserverlib.AsTimestamp(time.Now())),
+	}
+	if _, err = accountDB.StoreEventReport(req.Context(), &report); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.StoreEventReport failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// GetEventReports implements GET /_dendrite/admin/v1/event_reports
+// It lists the reports which users have made about events, newest first.
+func GetEventReports(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite,
+	accountDB accounts.Database,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	reports, err := accountDB.GetEventReports(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetEventReports failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: eventReportsResponse{reports},
+	}
+}
+
+// canSeeEvent returns whether the event exists in the room and the user was
+// joined to the room when it was sent, which is what GetEvent allows.
+func canSeeEvent(
+	ctx context.Context, queryAPI api.RoomserverQueryAPI, userID, roomID, eventID string,
+) (bool, error) {
+	eventsReq := api.QueryEventsByIDRequest{EventIDs: []string{eventID}}
+	var eventsRes api.QueryEventsByIDResponse
+	if err := queryAPI.QueryEventsByID(ctx, &eventsReq, &eventsRes); err != nil {
+		return false, err
+	}
+	if len(eventsRes.Events) == 0 || eventsRes.Events[0].RoomID() != roomID {
+		return false, nil
+	}
+
+	stateReq := api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: eventsRes.Events[0].PrevEventIDs(),
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{{
+			EventType: gomatrixserverlib.MRoomMember,
+			StateKey:  userID,
+		}},
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err := queryAPI.QueryStateAfterEvents(ctx, &stateReq, &stateRes); err != nil {
+		return false, err
+	}
+	if !stateRes.RoomExists || !stateRes.PrevEventsExist {
+		return false, nil
+	}
+	for _, ev := range stateRes.StateEvents {
+		if membership, err := ev.Membership(); err == nil && ev.StateKeyEquals(userID) && membership == gomatrixserverlib.Join {
+			return true, nil
+		}
+	}
+	return false, nil
+}
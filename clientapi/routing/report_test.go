@@ -0,0 +1,133 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func (r *testRoom) QueryEventsByID(
+	ctx context.Context,
+	request *api.QueryEventsByIDRequest,
+	response *api.QueryEventsByIDResponse,
+) error {
+	redacted := r.redactedEvents()
+	for _, ev := range r.events {
+		for _, eventID := range request.EventIDs {
+			if ev.EventID() == eventID {
+				response.Events = append(response.Events, ev.Headered(gomatrixserverlib.RoomVersionV3))
+				if request.CheckRedactions && redacted[eventID] {
+					response.RedactedEventIDs = append(response.RedactedEventIDs, eventID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (r *testRoom) QueryStateAfterEvents(
+	ctx context.Context,
+	request *api.QueryStateAfterEventsRequest,
+	response *api.QueryStateAfterEventsResponse,
+) error {
+	response.RoomExists = true
+	response.PrevEventsExist = true
+	state := make(map[gomatrixserverlib.StateKeyTuple]gomatrixserverlib.Event)
+	for _, ev := range r.events {
+		if ev.StateKey() != nil {
+			state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+		}
+		if len(request.PrevEventIDs) > 0 && ev.EventID() == request.PrevEventIDs[0] {
+			break
+		}
+	}
+	for _, tuple := range request.StateToFetch {
+		if ev, ok := state[tuple]; ok {
+			response.StateEvents = append(response.StateEvents, ev.Headered(gomatrixserverlib.RoomVersionV3))
+		}
+	}
+	return nil
+}
+
+func reportEvent(rs testNoticesRoomserver, accountDB accounts.Database, userID, eventID, body string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/rooms/"+testRoomID+"/report/"+eventID, strings.NewReader(body))
+	res := ReportEvent(req, &authtypes.Device{UserID: userID}, testRoomID, eventID, rs, accountDB)
+	return res.Code, res.JSON
+}
+
+func getEventReports(rs testNoticesRoomserver, accountDB accounts.Database, userID string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodGet, "/_dendrite/admin/v1/event_reports", nil)
+	res := GetEventReports(req, &authtypes.Device{UserID: userID}, rs.cfg, accountDB)
+	return res.Code, res.JSON
+}
+
+func TestReportEventIsListedForAdmins(t *testing.T) {
+	rs, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+	eventID := rs.addMessage("@alice:localhost", "something offensive")
+
+	if code, res := reportEvent(rs, accountDB, "@alice:localhost", eventID, `{"reason":"offensive","score":-50}`); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	if code, res := reportEvent(rs, accountDB, "@alice:localhost", eventID, `{"reason":"offensive","score":-101}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a score out of range, got %d: %v", code, res)
+	}
+
+	if code, res := getEventReports(rs, accountDB, "@alice:localhost"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a user who isn't a server admin, got %d: %v", code, res)
+	}
+	code, res := getEventReports(rs, accountDB, "@admin:localhost")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	reports := res.(eventReportsResponse).EventReports
+	if len(reports) != 1 {
+		t.Fatalf("expected one report, got %v", reports)
+	}
+	report := reports[0]
+	if report.RoomID != testRoomID || report.EventID != eventID || report.UserID != "@alice:localhost" ||
+		report.Reason != "offensive" || report.Score != -50 || report.ReceivedTS == 0 {
+		t.Errorf("expected the report to be stored as made, got %+v", report)
+	}
+}
+
+func TestReportEventRequiresVisibleEvent(t *testing.T) {
+	rs, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+	eventID := rs.addMessage("@alice:localhost", "hello")
+	rs.join("@mallory:localhost")
+
+	if code, res := reportEvent(rs, accountDB, "@bob:localhost", eventID, `{"reason":"spam","score":-100}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a user who isn't in the room, got %d: %v", code, res)
+	}
+	if code, res := reportEvent(rs, accountDB, "@mallory:localhost", eventID, `{"reason":"spam","score":-100}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an event sent before the user joined, got %d: %v", code, res)
+	}
+	if code, res := reportEvent(rs, accountDB, "@alice:localhost", "$unknown:localhost", `{"reason":"spam","score":-100}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown event, got %d: %v", code, res)
+	}
+	if _, res := getEventReports(rs, accountDB, "@admin:localhost"); len(res.(eventReportsResponse).EventReports) != 0 {
+		t.Errorf("expected no reports to be stored, got %v", res)
+	}
+}
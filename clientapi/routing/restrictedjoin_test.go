@@ -0,0 +1,159 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const restrictedTestSpaceID = "!space:localhost"
+
+// restrictedTestRooms is the test room restricted to the members of a space,
+// whose members are listed.
+type restrictedTestRooms struct {
+	*testRoom
+	spaceMembers map[string]bool
+}
+
+func newRestrictedTestRooms(
+	t *testing.T, roomVersion gomatrixserverlib.RoomVersion, spaceMembers ...string,
+) *restrictedTestRooms {
+	r := &restrictedTestRooms{testRoom: newTestRoomOfVersion(t, roomVersion), spaceMembers: make(map[string]bool)}
+	r.addState("@alice:localhost", gomatrixserverlib.MRoomJoinRules, "", auth.RestrictedJoinRuleContent{
+		JoinRule: auth.Restricted,
+		Allow:    []auth.JoinRuleAllowCondition{{Type: auth.MRoomMembership, RoomID: restrictedTestSpaceID}},
+	})
+	for _, userID := range spaceMembers {
+		r.spaceMembers[userID] = true
+	}
+	return r
+}
+
+func (r *restrictedTestRooms) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	if request.RoomID != restrictedTestSpaceID {
+		return r.testRoom.QueryLatestEventsAndState(ctx, request, response)
+	}
+	response.RoomExists = true
+	response.RoomVersion = gomatrixserverlib.RoomVersionV3
+	for _, tuple := range request.StateToFetch {
+		if tuple.EventType != gomatrixserverlib.MRoomMember || !r.spaceMembers[tuple.StateKey] {
+			continue
+		}
+		stateKey := tuple.StateKey
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   stateKey,
+			RoomID:   restrictedTestSpaceID,
+			Type:     gomatrixserverlib.MRoomMember,
+			StateKey: &stateKey,
+		}
+		if err := builder.SetContent(gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join}); err != nil {
+			return err
+		}
+		ev, err := builder.Build(time.Now(), "localhost", r.cfg.Matrix.KeyID, r.cfg.Matrix.PrivateKey, response.RoomVersion)
+		if err != nil {
+			return err
+		}
+		response.StateEvents = append(response.StateEvents, ev.Headered(response.RoomVersion))
+	}
+	return nil
+}
+
+func (r *restrictedTestRooms) joinAs(userID string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/join/"+testRoomID, strings.NewReader("{}"))
+	res := JoinRoomByIDOrAlias(
+		req, &authtypes.Device{UserID: userID}, testRoomID, r.cfg, nil, producers.NewRoomserverProducer(r, r),
+		r, nil, gomatrixserverlib.KeyRing{}, &knockTestAccounts{},
+		&producers.SyncAPIProducer{Producer: testSyncProducer{}},
+	)
+	return res.Code, res.JSON
+}
+
+func TestRestrictedJoinViaSpaceMembership(t *testing.T) {
+	rooms := newRestrictedTestRooms(t, version.RoomVersionRestricted, "@bob:localhost")
+	if code, res := rooms.joinAs("@bob:localhost"); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	if len(rooms.sent) != 1 {
+		t.Fatalf("expected the join to be sent, got %d events", len(rooms.sent))
+	}
+	join := rooms.sent[0].Unwrap()
+	if authoriser := auth.JoinAuthorisedVia(join.Content()); authoriser != "@alice:localhost" {
+		t.Errorf("expected the join to be authorised by alice, got %q", authoriser)
+	}
+
+	// The join is allowed by the auth rules, as the roomserver checks.
+	provider := gomatrixserverlib.NewAuthEvents(nil)
+	for i := range rooms.events {
+		if err := provider.AddEvent(&rooms.events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := auth.Allowed(join, &provider); err != nil {
+		t.Errorf("expected the join to be allowed, got %s", err)
+	}
+}
+
+// In room versions without restricted joins only invited users may join,
+// however they are allowed in.
+func TestRestrictedJoinNeedsRoomVersionWithRestrictedJoins(t *testing.T) {
+	rooms := newRestrictedTestRooms(t, gomatrixserverlib.RoomVersionV3, "@bob:localhost")
+	code, res := rooms.joinAs("@bob:localhost")
+	if code != http.StatusForbidden || !strings.Contains(res.(*jsonerror.MatrixError).Err, "restricted joins") {
+		t.Fatalf("expected 403 for a room version without restricted joins, got %d: %v", code, res)
+	}
+	if len(rooms.sent) != 0 {
+		t.Fatalf("expected no events to be sent, got %d", len(rooms.sent))
+	}
+
+	rooms.addState("@alice:localhost", gomatrixserverlib.MRoomMember, "@bob:localhost",
+		gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Invite})
+	if code, res = rooms.joinAs("@bob:localhost"); code != http.StatusOK {
+		t.Fatalf("expected 200 OK for an invited user, got %d: %v", code, res)
+	}
+	if len(rooms.sent) != 1 || auth.JoinAuthorisedVia(rooms.sent[0].Content()) != "" {
+		t.Errorf("expected the join to be sent without an authoriser, got %v", rooms.sent)
+	}
+}
+
+func TestRestrictedJoinRejectedWhenNotInSpace(t *testing.T) {
+	rooms := newRestrictedTestRooms(t, version.RoomVersionRestricted, "@carol:localhost")
+	code, res := rooms.joinAs("@bob:localhost")
+	if code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d: %v", code, res)
+	}
+	if errCode := res.(*jsonerror.MatrixError).ErrCode; errCode != "M_FORBIDDEN" {
+		t.Errorf("expected M_FORBIDDEN, got %s", errCode)
+	}
+	if len(rooms.sent) != 0 {
+		t.Errorf("expected no events to be sent, got %d", len(rooms.sent))
+	}
+}
@@ -18,22 +18,31 @@ import (
 	"encoding/json"
 	"net/http"
 
-	"github.com/sirupsen/logrus"
-
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
-	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
-// newTag creates and returns a new gomatrix.TagContent
-func newTag() gomatrix.TagContent {
-	return gomatrix.TagContent{
-		Tags: make(map[string]gomatrix.TagProperties),
+// tagContent is the content of the m.tag account data of a room.
+// https://matrix.org/docs/spec/client_server/r0.6.0#m-tag
+type tagContent struct {
+	Tags map[string]tagProperties `json:"tags"`
+}
+
+// tagProperties are the properties of a tag. The order is a pointer so that
+// an order of 0 isn't mistaken for a tag without an order.
+type tagProperties struct {
+	Order *float64 `json:"order,omitempty"`
+}
+
+// newTag creates and returns a new tagContent
+func newTag() tagContent {
+	return tagContent{
+		Tags: make(map[string]tagProperties),
 	}
 }
 
@@ -63,7 +72,7 @@ func GetTags(
 	if data == nil {
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: struct{}{},
+			JSON: newTag(),
 		}
 	}
 
@@ -93,10 +102,16 @@ func PutTag(
 		}
 	}
 
-	var properties gomatrix.TagProperties
+	var properties tagProperties
 	if reqErr := httputil.UnmarshalJSONRequest(req, &properties); reqErr != nil {
 		return *reqErr
 	}
+	if properties.Order != nil && (*properties.Order < 0 || *properties.Order > 1) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("order must be a number between 0 and 1"),
+		}
+	}
 
 	localpart, data, err := obtainSavedTags(req, userID, roomID, accountDB)
 	if err != nil {
@@ -104,28 +119,28 @@ func PutTag(
 		return jsonerror.InternalServerError()
 	}
 
-	var tagContent gomatrix.TagContent
+	tags := newTag()
 	if data != nil {
-		if err = json.Unmarshal(data.Content, &tagContent); err != nil {
+		if err = json.Unmarshal(data.Content, &tags); err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("json.Unmarshal failed")
 			return jsonerror.InternalServerError()
 		}
-	} else {
-		tagContent = newTag()
+		if tags.Tags == nil {
+			tags.Tags = make(map[string]tagProperties)
+		}
 	}
-	tagContent.Tags[tag] = properties
-	if err = saveTagData(req, localpart, roomID, accountDB, tagContent); err != nil {
+	tags.Tags[tag] = properties
+	if err = saveTagData(req, localpart, roomID, accountDB, tags); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("saveTagData failed")
 		return jsonerror.InternalServerError()
 	}
 
-	// Send data to syncProducer in order to inform clients of changes
-	// Run in a goroutine in order to prevent blocking the tag request response
-	go func() {
-		if err := syncProducer.SendData(userID, roomID, "m.tag"); err != nil {
-			logrus.WithError(err).Error("Failed to send m.tag account data update to syncapi")
-		}
-	}()
+	// Send data to syncProducer in order to inform clients of changes before
+	// responding, so that the tags are in the next sync of the client
+	if err = syncProducer.SendData(userID, roomID, "m.tag"); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+		return jsonerror.InternalServerError()
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -168,16 +183,16 @@ func DeleteTag(
 		}
 	}
 
-	var tagContent gomatrix.TagContent
-	err = json.Unmarshal(data.Content, &tagContent)
+	var tags tagContent
+	err = json.Unmarshal(data.Content, &tags)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("json.Unmarshal failed")
 		return jsonerror.InternalServerError()
 	}
 
 	// Check whether the tag to be deleted exists
-	if _, ok := tagContent.Tags[tag]; ok {
-		delete(tagContent.Tags, tag)
+	if _, ok := tags.Tags[tag]; ok {
+		delete(tags.Tags, tag)
 	} else {
 		// Spec only defines 200 responses for this endpoint so we don't return anything else.
 		return util.JSONResponse{
@@ -185,18 +200,17 @@ func DeleteTag(
 			JSON: struct{}{},
 		}
 	}
-	if err = saveTagData(req, localpart, roomID, accountDB, tagContent); err != nil {
+	if err = saveTagData(req, localpart, roomID, accountDB, tags); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("saveTagData failed")
 		return jsonerror.InternalServerError()
 	}
 
-	// Send data to syncProducer in order to inform clients of changes
-	// Run in a goroutine in order to prevent blocking the tag request response
-	go func() {
-		if err := syncProducer.SendData(userID, roomID, "m.tag"); err != nil {
-			logrus.WithError(err).Error("Failed to send m.tag account data update to syncapi")
-		}
-	}()
+	// Send data to syncProducer in order to inform clients of changes before
+	// responding, so that the tags are in the next sync of the client
+	if err = syncProducer.SendData(userID, roomID, "m.tag"); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+		return jsonerror.InternalServerError()
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -230,7 +244,7 @@ func saveTagData(
 	localpart string,
 	roomID string,
 	accountDB accounts.Database,
-	Tag gomatrix.TagContent,
+	Tag tagContent,
 ) error {
 	newTagData, err := json.Marshal(Tag)
 	if err != nil {
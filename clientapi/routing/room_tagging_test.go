@@ -0,0 +1,131 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+)
+
+const tagsPath = "/_matrix/client/r0/user/@alice:localhost/rooms/" + testRoomID + "/tags"
+
+// savedTags returns the tags of the test room in the account data of alice.
+func savedTags(t *testing.T, accountDB accounts.Database) map[string]tagProperties {
+	data, err := accountDB.GetAccountDataByType(context.Background(), "alice", testRoomID, "m.tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := newTag()
+	if data != nil {
+		if err = json.Unmarshal(data.Content, &tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tags.Tags
+}
+
+// listedTags returns the tags of the test room listed by the tags endpoint.
+func listedTags(t *testing.T, accountDB accounts.Database) map[string]tagProperties {
+	req := httptest.NewRequest(http.MethodGet, tagsPath, nil)
+	res := GetTags(req, accountDB, &authtypes.Device{UserID: "@alice:localhost"}, "@alice:localhost", testRoomID, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags tagContent
+	if err = json.Unmarshal(body, &tags); err != nil {
+		t.Fatal(err)
+	}
+	return tags.Tags
+}
+
+func putTag(accountDB accounts.Database, tag, body string) (int, interface{}) {
+	req := httptest.NewRequest(http.MethodPut, tagsPath+"/"+tag, strings.NewReader(body))
+	res := PutTag(
+		req, accountDB, &authtypes.Device{UserID: "@alice:localhost"}, "@alice:localhost", testRoomID, tag,
+		&producers.SyncAPIProducer{Producer: testSyncProducer{}},
+	)
+	return res.Code, res.JSON
+}
+
+func TestPutAndDeleteTags(t *testing.T) {
+	_, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+	if tags := listedTags(t, accountDB); tags == nil || len(tags) != 0 {
+		t.Errorf("expected no tags to be listed, got %v", tags)
+	}
+
+	if code, res := putTag(accountDB, "m.favourite", `{"order":0}`); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	if code, res := putTag(accountDB, "m.lowpriority", `{}`); code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	for name, tags := range map[string]map[string]tagProperties{
+		"account data": savedTags(t, accountDB),
+		"list":         listedTags(t, accountDB),
+	} {
+		if len(tags) != 2 {
+			t.Errorf("expected two tags in the %s, got %v", name, tags)
+		}
+		if order := tags["m.favourite"].Order; order == nil || *order != 0 {
+			t.Errorf("expected m.favourite to have an order of 0 in the %s, got %v", name, order)
+		}
+		if order := tags["m.lowpriority"].Order; order != nil {
+			t.Errorf("expected m.lowpriority to have no order in the %s, got %v", name, *order)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, tagsPath+"/m.favourite", nil)
+	res := DeleteTag(
+		req, accountDB, &authtypes.Device{UserID: "@alice:localhost"}, "@alice:localhost", testRoomID, "m.favourite",
+		&producers.SyncAPIProducer{Producer: testSyncProducer{}},
+	)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	for name, tags := range map[string]map[string]tagProperties{
+		"account data": savedTags(t, accountDB),
+		"list":         listedTags(t, accountDB),
+	} {
+		if _, ok := tags["m.favourite"]; ok || len(tags) != 1 {
+			t.Errorf("expected only m.lowpriority in the %s, got %v", name, tags)
+		}
+	}
+}
+
+func TestPutTagValidatesOrder(t *testing.T) {
+	_, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+	for _, body := range []string{`{"order":1.5}`, `{"order":-0.1}`, `{"order":"first"}`} {
+		if code, res := putTag(accountDB, "m.favourite", body); code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d: %v", body, code, res)
+		}
+	}
+	if tags := savedTags(t, accountDB); len(tags) != 0 {
+		t.Errorf("expected no tags to be saved, got %v", tags)
+	}
+}
@@ -15,7 +15,6 @@
 package routing
 
 import (
-	"encoding/json"
 	"net/http"
 	"strings"
 
@@ -25,10 +24,10 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
-	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/dendrite/common/transactions"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
@@ -39,6 +38,7 @@ import (
 const pathPrefixV1 = "/_matrix/client/api/v1"
 const pathPrefixR0 = "/_matrix/client/r0"
 const pathPrefixUnstable = "/_matrix/client/unstable"
+const pathPrefixClientV1 = "/_matrix/client/v1"
 
 // Setup registers HTTP handlers with the given ServeMux. It also supplies the given http.Client
 // to clients which need to make outbound HTTP requests.
@@ -56,8 +56,10 @@ func Setup(
 	deviceDB devices.Database,
 	federation *gomatrixserverlib.FederationClient,
 	keyRing gomatrixserverlib.KeyRing,
+	keyDB keydb.Database,
 	userUpdateProducer *producers.UserUpdateProducer,
 	syncProducer *producers.SyncAPIProducer,
+	deviceListProducer *producers.DeviceListProducer,
 	eduProducer *producers.EDUServerProducer,
 	transactionsCache *transactions.Cache,
 	federationSender federationSenderAPI.FederationSenderQueryAPI,
@@ -79,69 +81,210 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	apiMux.Handle("/.well-known/matrix/client", wellKnownClientHandler(cfg)).
+		Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
 	v1mux := apiMux.PathPrefix(pathPrefixV1).Subrouter()
 	unstableMux := apiMux.PathPrefix(pathPrefixUnstable).Subrouter()
+	clientV1Mux := apiMux.PathPrefix(pathPrefixClientV1).Subrouter()
+	adminMux := apiMux.PathPrefix(common.PathPrefixAdmin).Subrouter()
 
 	authData := auth.Data{
 		AccountDB:   accountDB,
 		DeviceDB:    deviceDB,
 		AppServices: cfg.Derived.ApplicationServices,
 	}
+	rateLimits := newRateLimits(cfg)
+	autoJoin := &autoJoiner{
+		cfg, federation, producer, queryAPI, aliasAPI, keyRing, accountDB, syncProducer,
+	}
+
+	adminMux.Handle("/send_server_notice",
+		common.MakeAuthAPI("send_server_notice", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return SendServerNotice(req, device, cfg, producer, queryAPI, accountDB, syncProducer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	adminMux.Handle("/rooms/{roomID}/redact/{userID}",
+		common.MakeAuthAPI("redact_user_events", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return RedactUserEvents(req, device, vars["roomID"], vars["userID"], cfg, producer, queryAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	adminMux.Handle("/rooms/{roomID}/shutdown",
+		common.MakeAuthAPI("shutdown_room", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ShutdownRoom(req, device, vars["roomID"], cfg, producer, queryAPI, accountDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	adminMux.Handle("/event_reports",
+		common.MakeAuthAPI("event_reports", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return GetEventReports(req, device, cfg, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	adminMux.Handle("/federation/destinations",
+		common.MakeAuthAPI("federation_destinations", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return GetDestinations(req, device, cfg, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	adminMux.Handle("/federation/destinations/{serverName}/reset_backoff",
+		common.MakeAuthAPI("reset_destination_backoff", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ResetDestinationBackoff(req, device, gomatrixserverlib.ServerName(vars["serverName"]), cfg, federationSender)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	adminMux.Handle("/federation/pinned_keys/{serverName}",
+		common.MakeAuthAPI("pinned_keys", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPinnedKeys(req, device, gomatrixserverlib.ServerName(vars["serverName"]), cfg, keyDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	adminMux.Handle("/federation/pinned_keys/{serverName}/repin",
+		common.MakeAuthAPI("repin_keys", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return RepinKeys(req, device, gomatrixserverlib.ServerName(vars["serverName"]), cfg, keyDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	adminMux.Handle("/users",
+		common.MakeAuthAPI("admin_list_users", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return ListUsers(req, device, cfg, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	adminMux.Handle("/users/{userID}",
+		common.MakeAuthAPI("admin_user_info", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetUserInfo(req, device, vars["userID"], cfg, accountDB, deviceDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	adminMux.Handle("/users/{userID}/joined_rooms",
+		common.MakeAuthAPI("admin_user_joined_rooms", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetUserJoinedRooms(req, device, vars["userID"], cfg, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	adminMux.Handle("/registration_tokens",
+		common.MakeAuthAPI("admin_list_registration_tokens", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return ListRegistrationTokens(req, device, cfg, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	adminMux.Handle("/registration_tokens/new",
+		common.MakeAuthAPI("admin_create_registration_token", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return CreateRegistrationToken(req, device, cfg, accountDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	adminMux.Handle("/registration_tokens/{token}",
+		common.MakeAuthAPI("admin_get_registration_token", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetRegistrationToken(req, device, vars["token"], cfg, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	adminMux.Handle("/registration_tokens/{token}",
+		common.MakeAuthAPI("admin_delete_registration_token", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeleteRegistrationToken(req, device, vars["token"], cfg, accountDB)
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
 
 	r0mux.Handle("/createRoom",
 		common.MakeAuthAPI("createRoom", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
-			return CreateRoom(req, device, cfg, producer, accountDB, aliasAPI, asAPI)
+			return CreateRoom(req, device, cfg, producer, accountDB, syncProducer, aliasAPI, asAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/join/{roomIDOrAlias}",
-		common.MakeAuthAPI(gomatrixserverlib.Join, authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI(gomatrixserverlib.Join, authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
 			return JoinRoomByIDOrAlias(
-				req, device, vars["roomIDOrAlias"], cfg, federation, producer, queryAPI, aliasAPI, keyRing, accountDB,
+				req, device, vars["roomIDOrAlias"], cfg, federation, producer, queryAPI, aliasAPI, keyRing, accountDB, syncProducer,
+			)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/knock/{roomIDOrAlias}",
+		common.MakeAuthAPI("knock", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return KnockRoomByIDOrAlias(
+				req, device, vars["roomIDOrAlias"], cfg, federation, producer, queryAPI, aliasAPI, accountDB,
 			)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/joined_rooms",
-		common.MakeAuthAPI("joined_rooms", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("joined_rooms", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			return GetJoinedRooms(req, device, accountDB)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/{membership:(?:join|kick|ban|unban|leave|invite)}",
-		common.MakeAuthAPI("membership", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("membership", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendMembership(req, accountDB, device, vars["roomID"], vars["membership"], cfg, queryAPI, asAPI, producer)
+			return SendMembership(req, accountDB, device, vars["roomID"], vars["membership"], cfg, federation, queryAPI, asAPI, producer, syncProducer)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}",
-		common.MakeAuthAPI("send_message", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("send_message", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, queryAPI, producer, nil)
+			if resErr := rateLimits.limit(device); resErr != nil {
+				return *resErr
+			}
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, federation, queryAPI, aliasAPI, producer, nil)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
-		common.MakeAuthAPI("send_message", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("send_message", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := rateLimits.limit(device); resErr != nil {
+				return *resErr
+			}
 			txnID := vars["txnID"]
 			return SendEvent(req, device, vars["roomID"], vars["eventType"], &txnID,
-				nil, cfg, queryAPI, producer, transactionsCache)
+				nil, cfg, federation, queryAPI, aliasAPI, producer, transactionsCache)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/event/{eventID}",
-		common.MakeAuthAPI("rooms_get_event", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("rooms_get_event", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -150,28 +293,66 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/state", common.MakeAuthAPI("room_state", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	r0mux.Handle("/rooms/{roomID}/report/{eventID}",
+		common.MakeAuthAPI("report_event", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ReportEvent(req, device, vars["roomID"], vars["eventID"], queryAPI, accountDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/aliases", common.MakeAuthAPI("room_aliases", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 		vars, err := common.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
-		return OnIncomingStateRequest(req.Context(), queryAPI, vars["roomID"])
+		return GetAliases(req, device, vars["roomID"], cfg, queryAPI, aliasAPI)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/state/{type}", common.MakeAuthAPI("room_state", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	clientV1Mux.Handle("/rooms/{roomID}/hierarchy", common.MakeAuthAPI("space_hierarchy", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 		vars, err := common.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
-		return OnIncomingStateTypeRequest(req.Context(), queryAPI, vars["roomID"], vars["type"], "")
+		return GetSpaceHierarchy(req, device, vars["roomID"], cfg, queryAPI, federation)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/state/{type}/{stateKey}", common.MakeAuthAPI("room_state", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	r0mux.Handle("/rooms/{roomID}/state", common.MakeGuestAuthAPI("room_state", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 		vars, err := common.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
-		return OnIncomingStateTypeRequest(req.Context(), queryAPI, vars["roomID"], vars["type"], vars["stateKey"])
+		leaveEventID, resErr := common.CheckCanReadRoom(req, device, vars["roomID"], queryAPI)
+		if resErr != nil {
+			return *resErr
+		}
+		return OnIncomingStateRequest(req.Context(), queryAPI, vars["roomID"], leaveEventID)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/state/{type}", common.MakeGuestAuthAPI("room_state", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := common.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		leaveEventID, resErr := common.CheckCanReadRoom(req, device, vars["roomID"], queryAPI)
+		if resErr != nil {
+			return *resErr
+		}
+		return OnIncomingStateTypeRequest(req.Context(), queryAPI, vars["roomID"], leaveEventID, vars["type"], "")
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/state/{type}/{stateKey}", common.MakeGuestAuthAPI("room_state", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := common.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		leaveEventID, resErr := common.CheckCanReadRoom(req, device, vars["roomID"], queryAPI)
+		if resErr != nil {
+			return *resErr
+		}
+		return OnIncomingStateTypeRequest(req.Context(), queryAPI, vars["roomID"], leaveEventID, vars["type"], vars["stateKey"])
 	})).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/state/{eventType:[^/]+/?}",
@@ -186,7 +367,7 @@ func Setup(
 			if strings.HasSuffix(eventType, "/") {
 				eventType = eventType[:len(eventType)-1]
 			}
-			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, queryAPI, producer, nil)
+			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, federation, queryAPI, aliasAPI, producer, nil)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -197,22 +378,26 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			stateKey := vars["stateKey"]
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, queryAPI, producer, nil)
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, federation, queryAPI, aliasAPI, producer, nil)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/register", common.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
-		return Register(req, accountDB, deviceDB, cfg)
+		return Register(req, accountDB, deviceDB, cfg, autoJoin)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	v1mux.Handle("/register", common.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
-		return LegacyRegister(req, accountDB, deviceDB, cfg)
+		return LegacyRegister(req, accountDB, deviceDB, cfg, autoJoin)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/register/available", common.MakeExternalAPI("registerAvailable", func(req *http.Request) util.JSONResponse {
 		return RegisterAvailable(req, cfg, accountDB)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
+	clientV1Mux.Handle("/register/m.login.registration_token/validity", common.MakeExternalAPI("registration_token_validity", func(req *http.Request) util.JSONResponse {
+		return CheckRegistrationTokenValidity(req, accountDB)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/directory/room/{roomAlias}",
 		common.MakeExternalAPI("directory_room", func(req *http.Request) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
@@ -229,7 +414,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SetLocalAlias(req, device, vars["roomAlias"], cfg, aliasAPI)
+			return SetLocalAlias(req, device, vars["roomAlias"], cfg, queryAPI, aliasAPI)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -239,24 +424,24 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return RemoveLocalAlias(req, device, vars["roomAlias"], aliasAPI)
+			return RemoveLocalAlias(req, device, vars["roomAlias"], cfg, queryAPI, aliasAPI)
 		}),
 	).Methods(http.MethodDelete, http.MethodOptions)
 
 	r0mux.Handle("/logout",
-		common.MakeAuthAPI("logout", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
-			return Logout(req, deviceDB, device)
+		common.MakeGuestAuthAPI("logout", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return Logout(req, deviceDB, device, deviceListProducer)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/logout/all",
-		common.MakeAuthAPI("logout", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
-			return LogoutAll(req, deviceDB, device)
+		common.MakeGuestAuthAPI("logout", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return LogoutAll(req, deviceDB, device, deviceListProducer)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/typing/{userID}",
-		common.MakeAuthAPI("rooms_typing", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("rooms_typing", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -265,20 +450,90 @@ func Setup(
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
+	r0mux.Handle("/sendToDevice/{eventType}/{txnID}",
+		common.MakeAuthAPI("send_to_device", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return SendToDevice(req, device, vars["eventType"], vars["txnID"], eduProducer, transactionsCache)
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/upgrade",
+		common.MakeAuthAPI("rooms_upgrade", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return UpgradeRoom(req, device, vars["roomID"], cfg, producer, queryAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/read_markers",
+		common.MakeGuestAuthAPI("rooms_read_markers", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return SetReadMarkers(req, device, vars["roomID"], accountDB, queryAPI, eduProducer, syncProducer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/receipt/{receiptType}/{eventID}",
+		common.MakeGuestAuthAPI("rooms_receipt", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return SendReceipt(req, device, vars["roomID"], vars["receiptType"], vars["eventID"], accountDB, queryAPI, eduProducer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/account/whoami",
-		common.MakeAuthAPI("whoami", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("whoami", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			return Whoami(req, device)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/account/deactivate",
+		common.MakeAuthAPI("deactivate", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return DeactivateAccount(req, device, cfg, accountDB, deviceDB, queryAPI, producer, deviceListProducer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/password",
+		common.MakeAuthAPI("password", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return Password(req, device, cfg, accountDB, deviceDB, deviceListProducer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	// Stub endpoints required by Riot
 
 	r0mux.Handle("/login",
 		common.MakeExternalAPI("login", func(req *http.Request) util.JSONResponse {
-			return Login(req, accountDB, deviceDB, cfg)
+			return Login(req, accountDB, deviceDB, asAPI, cfg, deviceListProducer)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	clientV1Mux.Handle("/refresh",
+		common.MakeExternalAPI("refresh", func(req *http.Request) util.JSONResponse {
+			return Refresh(req, deviceDB, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/login/sso/redirect",
+		common.MakeExternalAPI("login_sso_redirect", func(req *http.Request) util.JSONResponse {
+			return SSORedirect(req, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/login/sso/callback",
+		common.MakeExternalAPI("login_sso_callback", func(req *http.Request) util.JSONResponse {
+			return SSOCallback(req, cfg, accountDB, autoJoin)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/auth/{authType}/fallback/web",
 		common.MakeHTMLAPI("auth_fallback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
 			vars := mux.Vars(req)
@@ -286,27 +541,96 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/pushers",
+		common.MakeAuthAPI("get_pushers", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return GetPushers(req, device, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushers/set",
+		common.MakeAuthAPI("set_pusher", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return SetPusher(req, device, accountDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/pushrules/",
-		common.MakeExternalAPI("push_rules", func(req *http.Request) util.JSONResponse {
-			// TODO: Implement push rules API
-			res := json.RawMessage(`{
-					"global": {
-						"content": [],
-						"override": [],
-						"room": [],
-						"sender": [],
-						"underride": []
-					}
-				}`)
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: &res,
+		common.MakeAuthAPI("push_rules", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return GetPushRules(req, device, accountDB, "", "")
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/",
+		common.MakeAuthAPI("push_rules_scope", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRules(req, device, accountDB, vars["scope"], "")
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/",
+		common.MakeAuthAPI("push_rules_kind", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRules(req, device, accountDB, vars["scope"], vars["kind"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		common.MakeAuthAPI("get_push_rule", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRuleByID(req, device, accountDB, vars["scope"], vars["kind"], vars["ruleID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		common.MakeAuthAPI("put_push_rule", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutPushRuleByID(req, device, accountDB, vars["scope"], vars["kind"], vars["ruleID"], syncProducer)
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		common.MakeAuthAPI("delete_push_rule", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeletePushRuleByID(req, device, accountDB, vars["scope"], vars["kind"], vars["ruleID"], syncProducer)
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr:(?:enabled|actions)}",
+		common.MakeAuthAPI("get_push_rule_attr", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
 			}
+			return GetPushRuleAttr(req, device, accountDB, vars["scope"], vars["kind"], vars["ruleID"], vars["attr"])
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr:(?:enabled|actions)}",
+		common.MakeAuthAPI("put_push_rule_attr", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutPushRuleAttr(req, device, accountDB, vars["scope"], vars["kind"], vars["ruleID"], vars["attr"], syncProducer)
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
 	r0mux.Handle("/user/{userId}/filter",
-		common.MakeAuthAPI("put_filter", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("put_filter", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -316,7 +640,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/user/{userId}/filter/{filterId}",
-		common.MakeAuthAPI("get_filter", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("get_filter", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -353,6 +677,10 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			// Each change sends an event into every room the user is in.
+			if resErr := rateLimits.limit(device); resErr != nil {
+				return *resErr
+			}
 			return SetAvatarURL(req, accountDB, device, vars["userID"], userUpdateProducer, cfg, producer, queryAPI)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
@@ -370,11 +698,15 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/profile/{userID}/displayname",
-		common.MakeAuthAPI("profile_displayname", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("profile_displayname", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			// Each change sends an event into every room the user is in.
+			if resErr := rateLimits.limit(device); resErr != nil {
+				return *resErr
+			}
 			return SetDisplayName(req, accountDB, device, vars["userID"], userUpdateProducer, cfg, producer, queryAPI)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
@@ -405,14 +737,13 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	// Riot logs get flooded unless this is handled
 	r0mux.Handle("/presence/{userID}/status",
-		common.MakeExternalAPI("presence", func(req *http.Request) util.JSONResponse {
-			// TODO: Set presence (probably the responsibility of a presence server not clientapi)
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: struct{}{},
+		common.MakeAuthAPI("presence", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
 			}
+			return SetPresence(req, device, vars["userID"], eduProducer)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -432,38 +763,38 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/initialSync",
-		common.MakeExternalAPI("rooms_initial_sync", func(req *http.Request) util.JSONResponse {
-			// TODO: Allow people to peek into rooms.
-			return util.JSONResponse{
-				Code: http.StatusForbidden,
-				JSON: jsonerror.GuestAccessForbidden("Guest access not implemented"),
+	r0mux.Handle("/user/{userID}/openid/request_token",
+		common.MakeAuthAPI("openid_request_token", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
 			}
+			return CreateOpenIDToken(req, accountDB, device, vars["userID"], cfg)
 		}),
-	).Methods(http.MethodGet, http.MethodOptions)
+	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/user/{userID}/account_data/{type}",
-		common.MakeAuthAPI("user_account_data", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("user_account_data", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SaveAccountData(req, accountDB, device, vars["userID"], "", vars["type"], syncProducer)
+			return SaveAccountData(req, accountDB, device, vars["userID"], "", vars["type"], cfg, syncProducer)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/user/{userID}/rooms/{roomID}/account_data/{type}",
-		common.MakeAuthAPI("user_account_data", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("user_account_data", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SaveAccountData(req, accountDB, device, vars["userID"], vars["roomID"], vars["type"], syncProducer)
+			return SaveAccountData(req, accountDB, device, vars["userID"], vars["roomID"], vars["type"], cfg, syncProducer)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/user/{userID}/account_data/{type}",
-		common.MakeAuthAPI("user_account_data", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("user_account_data", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -473,7 +804,7 @@ func Setup(
 	).Methods(http.MethodGet)
 
 	r0mux.Handle("/user/{userID}/rooms/{roomID}/account_data/{type}",
-		common.MakeAuthAPI("user_account_data", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("user_account_data", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -483,7 +814,7 @@ func Setup(
 	).Methods(http.MethodGet)
 
 	r0mux.Handle("/rooms/{roomID}/members",
-		common.MakeAuthAPI("rooms_members", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("rooms_members", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -493,30 +824,23 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/joined_members",
-		common.MakeAuthAPI("rooms_members", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("rooms_joined_members", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetMemberships(req, device, vars["roomID"], true, cfg, queryAPI)
+			return GetJoinedMembers(req, device, vars["roomID"], queryAPI)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/read_markers",
-		common.MakeExternalAPI("rooms_read_markers", func(req *http.Request) util.JSONResponse {
-			// TODO: return the read_markers.
-			return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
-		}),
-	).Methods(http.MethodPost, http.MethodOptions)
-
 	r0mux.Handle("/devices",
-		common.MakeAuthAPI("get_devices", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("get_devices", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			return GetDevicesByLocalpart(req, deviceDB, device)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/devices/{deviceID}",
-		common.MakeAuthAPI("get_device", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("get_device", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -526,12 +850,12 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/devices/{deviceID}",
-		common.MakeAuthAPI("device_data", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeGuestAuthAPI("device_data", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return UpdateDeviceByID(req, deviceDB, device, vars["deviceID"])
+			return UpdateDeviceByID(req, deviceDB, device, vars["deviceID"], deviceListProducer)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -541,13 +865,43 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return DeleteDeviceById(req, deviceDB, device, vars["deviceID"])
+			return DeleteDeviceById(req, cfg, accountDB, deviceDB, device, vars["deviceID"], deviceListProducer)
 		}),
 	).Methods(http.MethodDelete, http.MethodOptions)
 
 	r0mux.Handle("/delete_devices",
 		common.MakeAuthAPI("delete_devices", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
-			return DeleteDevices(req, deviceDB, device)
+			return DeleteDevices(req, cfg, accountDB, deviceDB, device, deviceListProducer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/keys/query",
+		common.MakeGuestAuthAPI("query_keys", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return QueryKeys(req, device, cfg, deviceDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/keys/upload",
+		common.MakeGuestAuthAPI("upload_keys", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return UploadKeys(req, device, deviceDB, deviceListProducer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/keys/claim",
+		common.MakeGuestAuthAPI("claim_keys", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return ClaimKeys(req, cfg, deviceDB, federation)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/keys/device_signing/upload",
+		common.MakeAuthAPI("upload_cross_signing_keys", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return UploadCrossSigningKeys(req, device, cfg, accountDB, deviceDB, deviceListProducer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/keys/signatures/upload",
+		common.MakeAuthAPI("upload_cross_signing_signatures", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return UploadCrossSigningSignatures(req, device, deviceDB, deviceListProducer)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -601,8 +955,8 @@ func Setup(
 	).Methods(http.MethodDelete, http.MethodOptions)
 
 	r0mux.Handle("/capabilities",
-		common.MakeAuthAPI("capabilities", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
-			return GetCapabilities(req, queryAPI)
+		common.MakeGuestAuthAPI("capabilities", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return GetCapabilities(req, device, queryAPI, accountDB)
 		}),
 	).Methods(http.MethodGet)
 }
@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
@@ -25,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/common/transactions"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
@@ -45,7 +47,9 @@ func SendEvent(
 	device *authtypes.Device,
 	roomID, eventType string, txnID, stateKey *string,
 	cfg *config.Dendrite,
+	federation *gomatrixserverlib.FederationClient,
 	queryAPI api.RoomserverQueryAPI,
+	aliasAPI api.RoomserverAliasAPI,
 	producer *producers.RoomserverProducer,
 	txnCache *transactions.Cache,
 ) util.JSONResponse {
@@ -58,6 +62,17 @@ func SendEvent(
 		}
 	}
 
+	// Guests can only send messages, into rooms which let guests in.
+	if device.IsGuest && (eventType != "m.room.message" || stateKey != nil) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.GuestAccessForbidden("Guests can only send messages"),
+		}
+	}
+	if resErr := common.CheckGuestCanJoin(req, device, roomID, queryAPI); resErr != nil {
+		return *resErr
+	}
+
 	if txnID != nil {
 		// Try to fetch response from transactionsCache
 		if res, ok := txnCache.FetchTransaction(device.AccessToken, *txnID); ok {
@@ -65,7 +80,7 @@ func SendEvent(
 		}
 	}
 
-	e, resErr := generateSendEvent(req, device, roomID, eventType, stateKey, cfg, queryAPI)
+	e, resErr := generateSendEvent(req, device, roomID, eventType, stateKey, cfg, federation, queryAPI, aliasAPI)
 	if resErr != nil {
 		return *resErr
 	}
@@ -115,7 +130,9 @@ func generateSendEvent(
 	device *authtypes.Device,
 	roomID, eventType string, stateKey *string,
 	cfg *config.Dendrite,
+	federation *gomatrixserverlib.FederationClient,
 	queryAPI api.RoomserverQueryAPI,
+	aliasAPI api.RoomserverAliasAPI,
 ) (*gomatrixserverlib.Event, *util.JSONResponse) {
 	// parse the incoming http request
 	userID := device.UserID
@@ -133,6 +150,17 @@ func generateSendEvent(
 		}
 	}
 
+	if eventType == "m.room.pinned_events" && stateKey != nil && *stateKey == "" {
+		if resErr = checkPinnedEvents(req, roomID, r, cfg, queryAPI); resErr != nil {
+			return nil, resErr
+		}
+	}
+	if eventType == "m.room.canonical_alias" && stateKey != nil && *stateKey == "" {
+		if resErr = checkCanonicalAlias(req, roomID, r, cfg, federation, aliasAPI); resErr != nil {
+			return nil, resErr
+		}
+	}
+
 	// create the new event and set all the fields we can
 	builder := gomatrixserverlib.EventBuilder{
 		Sender:   userID,
@@ -154,6 +182,11 @@ func generateSendEvent(
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("Room does not exist"),
 		}
+	} else if errors.Is(err, common.ErrEventTooLarge) {
+		return nil, &util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: jsonerror.TooLarge(err.Error()),
+		}
 	} else if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("common.BuildEvent failed")
 		resErr := jsonerror.InternalServerError()
@@ -166,7 +199,7 @@ func generateSendEvent(
 		stateEvents[i] = &queryRes.StateEvents[i].Event
 	}
 	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
-	if err = gomatrixserverlib.Allowed(*e, &provider); err != nil {
+	if err = auth.Allowed(*e, &provider); err != nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusForbidden,
 			JSON: jsonerror.Forbidden(err.Error()), // TODO: Is this error string comprehensible to the client?
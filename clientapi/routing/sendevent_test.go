@@ -0,0 +1,64 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+)
+
+func (r *testRoom) sendMessage(body string) (int, interface{}) {
+	content, err := json.Marshal(map[string]string{"msgtype": "m.text", "body": body})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/rooms/"+testRoomID+"/send/m.room.message", strings.NewReader(string(content)))
+	res := SendEvent(
+		req, &authtypes.Device{UserID: "@alice:localhost"}, testRoomID, "m.room.message", nil, nil,
+		r.cfg, nil, r, testAliases{}, producers.NewRoomserverProducer(r, r), nil,
+	)
+	return res.Code, res.JSON
+}
+
+func TestSendOversizedEventIsTooLarge(t *testing.T) {
+	room := newTestRoom(t)
+	before := len(room.sent)
+	code, res := room.sendMessage(strings.Repeat("a", 70000))
+	if code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for an oversized event, got %d: %v", code, res)
+	}
+	if errCode := res.(*jsonerror.MatrixError).ErrCode; errCode != "M_TOO_LARGE" {
+		t.Errorf("expected M_TOO_LARGE, got %s", errCode)
+	}
+
+	// The configured limit can be lower than the spec's.
+	room.cfg.Matrix.EventLimits.MaxSizeBytes = 2048
+	if code, res = room.sendMessage(strings.Repeat("a", 2048)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for an event over the configured limit, got %d: %v", code, res)
+	}
+	if len(room.sent) != before {
+		t.Errorf("expected no events to be sent, got %v", room.sent[before:])
+	}
+	if code, res = room.sendMessage("hello"); code != http.StatusOK {
+		t.Errorf("expected 200 OK for a small event, got %d: %v", code, res)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/transactions"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type sendToDeviceRequest struct {
+	// The messages to send, keyed by user ID and then by device ID. The
+	// device ID can be "*" to send a message to all of the devices of a user.
+	Messages map[string]map[string]json.RawMessage `json:"messages"`
+}
+
+// SendToDevice implements PUT /sendToDevice/{eventType}/{txnID}
+// https://matrix.org/docs/spec/client_server/r0.6.0#put-matrix-client-r0-sendtodevice-eventtype-txnid
+// Each message is passed to the EDU server, which sends it on to the sync API
+// for local devices or to the server of the user for remote ones.
+func SendToDevice(
+	req *http.Request, device *authtypes.Device, eventType, txnID string,
+	eduProducer *producers.EDUServerProducer, txnCache *transactions.Cache,
+) util.JSONResponse {
+	if res, ok := txnCache.FetchTransaction(device.AccessToken, txnID); ok {
+		return *res
+	}
+
+	var r sendToDeviceRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	for userID, messages := range r.Messages {
+		if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid user ID " + userID),
+			}
+		}
+		for deviceID, content := range messages {
+			if err := eduProducer.SendToDevice(
+				req.Context(), device.UserID, userID, deviceID, eventType, content,
+			); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("eduProducer.SendToDevice failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+	}
+
+	res := util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+	txnCache.AddTransaction(device.AccessToken, txnID, &res)
+	return res
+}
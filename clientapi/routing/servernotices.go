@@ -0,0 +1,282 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// The tag and msgtype which clients use to show server notices specially.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#server-notices
+const serverNoticeTag = "m.server_notice"
+
+type sendServerNoticeRequest struct {
+	UserID  string                 `json:"user_id"`
+	Content map[string]interface{} `json:"content"`
+}
+
+// SendServerNotice implements POST /_dendrite/admin/v1/send_server_notice
+func SendServerNotice(
+	req *http.Request, device *authtypes.Device,
+	cfg *config.Dendrite, producer *producers.RoomserverProducer,
+	queryAPI api.RoomserverQueryAPI, accountDB accounts.Database,
+	syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	if !cfg.Matrix.ServerNotices.Enabled {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Server notices are not enabled"),
+		}
+	}
+
+	var r sendServerNoticeRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if body, ok := r.Content["body"].(string); !ok || body == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The content of a server notice must have a body"),
+		}
+	}
+	r.Content["msgtype"] = serverNoticeTag
+
+	localpart, domain, err := gomatrixserverlib.SplitID('@', r.UserID)
+	if err != nil || domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Server notices can only be sent to local users"),
+		}
+	}
+	profile, err := accountDB.GetProfileByLocalpart(req.Context(), localpart)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown user"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetProfileByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+
+	roomID, err := serverNoticesRoomForUser(req.Context(), r.UserID, cfg, queryAPI, accountDB)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("serverNoticesRoomForUser failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var events []gomatrixserverlib.HeaderedEvent
+	created := roomID == ""
+	if created {
+		roomID, events, err = createServerNoticesRoom(req.Context(), r.UserID, profile, r.Content, cfg, accountDB)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("createServerNoticesRoom failed")
+			return jsonerror.InternalServerError()
+		}
+	} else {
+		event, err := buildServerNotice(req.Context(), roomID, r.Content, cfg, queryAPI)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("buildServerNotice failed")
+			return jsonerror.InternalServerError()
+		}
+		events = []gomatrixserverlib.HeaderedEvent{*event}
+	}
+
+	if _, err = producer.SendEvents(req.Context(), events, cfg.Matrix.ServerName, nil); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// The room is only tagged once the user has joined it, so that a room
+	// which failed to be created isn't used for later notices.
+	if created {
+		tag := newTag()
+		tag.Tags[serverNoticeTag] = tagProperties{}
+		tagJSON, err := json.Marshal(tag)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+			return jsonerror.InternalServerError()
+		}
+		if err = accountDB.SaveAccountData(req.Context(), localpart, roomID, "m.tag", string(tagJSON)); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveAccountData failed")
+			return jsonerror.InternalServerError()
+		}
+		if err = syncProducer.SendData(r.UserID, roomID, "m.tag"); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	notice := events[len(events)-1]
+	util.GetLogger(req.Context()).WithFields(logrus.Fields{
+		"user_id":  r.UserID,
+		"room_id":  roomID,
+		"event_id": notice.EventID(),
+	}).Info("Sent server notice")
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: sendEventResponse{notice.EventID()},
+	}
+}
+
+// serverNoticesUserID returns the user ID of the user which sends the notices.
+func serverNoticesUserID(cfg *config.Dendrite) string {
+	return fmt.Sprintf("@%s:%s", cfg.Matrix.ServerNotices.LocalPart, cfg.Matrix.ServerName)
+}
+
+// serverNoticesRoomForUser returns the server notices room of a user, which is
+// the room tagged with m.server_notice that they are still in. Returns an empty
+// room ID if the user doesn't have a server notices room.
+func serverNoticesRoomForUser(
+	ctx context.Context, userID string,
+	cfg *config.Dendrite, queryAPI api.RoomserverQueryAPI, accountDB accounts.Database,
+) (string, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return "", err
+	}
+	_, rooms, err := accountDB.GetAccountData(ctx, localpart)
+	if err != nil {
+		return "", fmt.Errorf("accountDB.GetAccountData: %w", err)
+	}
+	for roomID, events := range rooms {
+		for _, ev := range events {
+			if ev.Type != "m.tag" {
+				continue
+			}
+			var tag tagContent
+			if err = json.Unmarshal(ev.Content, &tag); err != nil {
+				continue
+			}
+			if _, ok := tag.Tags[serverNoticeTag]; !ok {
+				continue
+			}
+			// The user may have left the room, or tagged a room of their own.
+			if isInRoom(ctx, queryAPI, roomID, userID) && isInRoom(ctx, queryAPI, roomID, serverNoticesUserID(cfg)) {
+				return roomID, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// isInRoom returns whether the user is currently joined to the room. Rooms
+// which the roomserver doesn't know about don't have any members.
+func isInRoom(ctx context.Context, queryAPI api.RoomserverQueryAPI, roomID, userID string) bool {
+	queryReq := api.QueryMembershipForUserRequest{RoomID: roomID, UserID: userID}
+	var queryRes api.QueryMembershipForUserResponse
+	if err := queryAPI.QueryMembershipForUser(ctx, &queryReq, &queryRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("queryAPI.QueryMembershipForUser failed")
+		return false
+	}
+	return queryRes.IsInRoom
+}
+
+// createServerNoticesRoom builds the events which create a server notices room
+// for a user, force them to join it and send the first notice into it. Only
+// the notices user may send events into the room.
+func createServerNoticesRoom(
+	ctx context.Context, userID string, profile *authtypes.Profile, content map[string]interface{},
+	cfg *config.Dendrite, accountDB accounts.Database,
+) (string, []gomatrixserverlib.HeaderedEvent, error) {
+	noticesUserID := serverNoticesUserID(cfg)
+	// The notices user needs an account so that it can't be registered by
+	// anyone else.
+	if _, err := accountDB.CreateAccount(ctx, cfg.Matrix.ServerNotices.LocalPart, "", ""); err != nil {
+		return "", nil, fmt.Errorf("accountDB.CreateAccount: %w", err)
+	}
+	if err := accountDB.SetDisplayName(ctx, cfg.Matrix.ServerNotices.LocalPart, cfg.Matrix.ServerNotices.DisplayName); err != nil {
+		return "", nil, fmt.Errorf("accountDB.SetDisplayName: %w", err)
+	}
+
+	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
+	roomVersion := roomserverVersion.DefaultRoomVersion()
+	powerLevels := common.InitialPowerLevelsContent(noticesUserID)
+	powerLevels.EventsDefault = 100
+
+	b := newRoomEventsBuilder(roomID, cfg, time.Now(), roomVersion)
+	for _, e := range []struct {
+		sender string
+		event  fledglingEvent
+	}{
+		{noticesUserID, fledglingEvent{"m.room.create", "", map[string]interface{}{
+			"creator": noticesUserID, "room_version": roomVersion,
+		}}},
+		{noticesUserID, fledglingEvent{"m.room.member", noticesUserID, gomatrixserverlib.MemberContent{
+			Membership: gomatrixserverlib.Join, DisplayName: cfg.Matrix.ServerNotices.DisplayName,
+		}}},
+		{noticesUserID, fledglingEvent{"m.room.power_levels", "", powerLevels}},
+		{noticesUserID, fledglingEvent{"m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: gomatrixserverlib.Invite}}},
+		{noticesUserID, fledglingEvent{"m.room.history_visibility", "", common.HistoryVisibilityContent{HistoryVisibility: historyVisibilityShared}}},
+		{noticesUserID, fledglingEvent{"m.room.name", "", common.NameContent{Name: cfg.Matrix.ServerNotices.RoomName}}},
+		{noticesUserID, fledglingEvent{"m.room.member", userID, gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Invite}}},
+		{userID, fledglingEvent{"m.room.member", userID, gomatrixserverlib.MemberContent{
+			Membership: gomatrixserverlib.Join, DisplayName: profile.DisplayName, AvatarURL: profile.AvatarURL,
+		}}},
+	} {
+		if err := b.add(e.sender, e.event); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := b.addEvent(noticesUserID, "m.room.message", nil, content); err != nil {
+		return "", nil, err
+	}
+	return roomID, b.events, nil
+}
+
+// buildServerNotice builds a notice which is sent into an existing server
+// notices room.
+func buildServerNotice(
+	ctx context.Context, roomID string, content map[string]interface{},
+	cfg *config.Dendrite, queryAPI api.RoomserverQueryAPI,
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender: serverNoticesUserID(cfg),
+		RoomID: roomID,
+		Type:   "m.room.message",
+	}
+	if err := builder.SetContent(content); err != nil {
+		return nil, fmt.Errorf("builder.SetContent: %w", err)
+	}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	event, err := common.BuildEvent(ctx, &builder, cfg, time.Now(), queryAPI, &queryRes)
+	if err != nil {
+		return nil, fmt.Errorf("common.BuildEvent: %w", err)
+	}
+	headered := event.Headered(queryRes.RoomVersion)
+	return &headered, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// testNoticesRoomserver answers membership queries from the events sent to it.
+type testNoticesRoomserver struct {
+	*testRoom
+}
+
+func (r testNoticesRoomserver) QueryMembershipForUser(
+	ctx context.Context,
+	request *api.QueryMembershipForUserRequest,
+	response *api.QueryMembershipForUserResponse,
+) error {
+	response.IsInRoom = false
+	for _, ev := range r.sent {
+		if ev.RoomID() != request.RoomID || ev.Type() != gomatrixserverlib.MRoomMember || *ev.StateKey() != request.UserID {
+			continue
+		}
+		membership, err := ev.Membership()
+		if err != nil {
+			return err
+		}
+		response.HasBeenInRoom = true
+		response.IsInRoom = membership == gomatrixserverlib.Join
+	}
+	return nil
+}
+
+// testSyncProducer discards the messages sent to the sync API.
+type testSyncProducer struct {
+	sarama.SyncProducer
+}
+
+func (p testSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	return 0, 0, nil
+}
+
+func sendServerNotice(
+	t *testing.T, rs testNoticesRoomserver, accountDB accounts.Database, adminID, userID, body string,
+) (int, map[string]interface{}) {
+	content, err := json.Marshal(map[string]interface{}{
+		"user_id": userID,
+		"content": map[string]interface{}{"msgtype": "m.text", "body": body},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/v1/send_server_notice", bytes.NewBuffer(content))
+	res := SendServerNotice(
+		req, &authtypes.Device{UserID: adminID}, rs.cfg, producers.NewRoomserverProducer(rs, rs), rs, accountDB,
+		&producers.SyncAPIProducer{Producer: testSyncProducer{}},
+	)
+	var resBody map[string]interface{}
+	resJSON, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(resJSON, &resBody); err != nil {
+		t.Fatal(err)
+	}
+	return res.Code, resBody
+}
+
+func newServerNoticesTest(t *testing.T) (testNoticesRoomserver, accounts.Database, func()) {
+	dir, err := ioutil.TempDir("", "notices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountDB, err := accounts.NewDatabase("file:"+filepath.Join(dir, "account.db"), nil, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = accountDB.CreateAccount(context.Background(), "alice", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := testNoticesRoomserver{newTestRoom(t)}
+	rs.cfg.Matrix.AdminUsers = []string{"@admin:localhost"}
+	rs.cfg.Matrix.ServerNotices.Enabled = true
+	rs.cfg.Matrix.ServerNotices.LocalPart = "notices"
+	rs.cfg.Matrix.ServerNotices.DisplayName = "Server Notices"
+	rs.cfg.Matrix.ServerNotices.RoomName = "Server Notices"
+	return rs, accountDB, func() { os.RemoveAll(dir) } // nolint: errcheck
+}
+
+func TestServerNoticeCreatesRoomAndDeliversMessage(t *testing.T) {
+	rs, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+
+	code, body := sendServerNotice(t, rs, accountDB, "@admin:localhost", "@alice:localhost", "Maintenance tonight")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	notice := rs.sent[len(rs.sent)-1]
+	if notice.EventID() != body["event_id"] || notice.Sender() != "@notices:localhost" {
+		t.Fatalf("expected the notice to be sent by the notices user, got %s from %s", notice.EventID(), notice.Sender())
+	}
+	roomID := notice.RoomID()
+	if message := rs.sentEvent(roomID, "m.room.message"); message["body"] != "Maintenance tonight" || message["msgtype"] != "m.server_notice" {
+		t.Errorf("expected the notice to be delivered as m.server_notice, got %v", message)
+	}
+	if name := rs.sentEvent(roomID, "m.room.name"); name["name"] != "Server Notices" {
+		t.Errorf("expected the room to be named, got %v", name)
+	}
+	if !isInRoom(context.Background(), rs, roomID, "@alice:localhost") {
+		t.Error("expected alice to be joined to the notices room")
+	}
+	tag, err := accountDB.GetAccountDataByType(context.Background(), "alice", roomID, "m.tag")
+	if err != nil || tag == nil || !bytes.Contains(tag.Content, []byte(`"m.server_notice"`)) {
+		t.Errorf("expected the room to be tagged with m.server_notice, got %v (%v)", tag, err)
+	}
+
+	// The second notice is sent into the same room.
+	sentBefore := len(rs.sent)
+	code, body = sendServerNotice(t, rs, accountDB, "@admin:localhost", "@alice:localhost", "Maintenance is over")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	if len(rs.sent) != sentBefore+1 || rs.sent[sentBefore].RoomID() != roomID {
+		t.Errorf("expected only the notice to be sent into %s, got %d events", roomID, len(rs.sent)-sentBefore)
+	}
+}
+
+func TestServerNoticesCanOnlyBeSentByAdmins(t *testing.T) {
+	rs, accountDB, cleanup := newServerNoticesTest(t)
+	defer cleanup()
+
+	code, body := sendServerNotice(t, rs, accountDB, "@alice:localhost", "@alice:localhost", "Hello")
+	if code != http.StatusForbidden || body["errcode"] != "M_FORBIDDEN" {
+		t.Errorf("expected 403 M_FORBIDDEN, got %d: %v", code, body)
+	}
+	if len(rs.sent) != 0 {
+		t.Errorf("expected no events to be sent, got %d", len(rs.sent))
+	}
+}
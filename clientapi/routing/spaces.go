@@ -0,0 +1,253 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultSpaceHierarchyLimit = 50
+	maxSpaceHierarchyLimit     = 100
+	// maxSpaceHierarchyDepth is how deep hierarchies are walked when the
+	// client doesn't ask for less.
+	maxSpaceHierarchyDepth = 50
+)
+
+type spaceHierarchyResponse struct {
+	Rooms     []common.SpaceRoom `json:"rooms"`
+	NextBatch string             `json:"next_batch,omitempty"`
+}
+
+// GetSpaceHierarchy implements GET /_matrix/client/v1/rooms/{roomID}/hierarchy
+// https://github.com/matrix-org/matrix-doc/pull/2946
+// The space and its children are walked breadth first, and remote servers
+// are asked about the rooms that this server isn't in. Each room is only
+// returned once, even if it's the child of several spaces. The pagination
+// token is the number of rooms which have already been returned.
+func GetSpaceHierarchy(
+	req *http.Request, device *authtypes.Device, roomID string,
+	cfg *config.Dendrite, queryAPI api.RoomserverQueryAPI,
+	federation *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	query := req.URL.Query()
+	limit, resErr := parseSpaceHierarchyParam(query.Get("limit"), "limit", defaultSpaceHierarchyLimit)
+	if resErr != nil {
+		return *resErr
+	}
+	if limit == 0 || limit > maxSpaceHierarchyLimit {
+		limit = maxSpaceHierarchyLimit
+	}
+	maxDepth, resErr := parseSpaceHierarchyParam(query.Get("max_depth"), "max_depth", maxSpaceHierarchyDepth)
+	if resErr != nil {
+		return *resErr
+	}
+	if maxDepth > maxSpaceHierarchyDepth {
+		maxDepth = maxSpaceHierarchyDepth
+	}
+	from, resErr := parseSpaceHierarchyParam(query.Get("from"), "from", 0)
+	if resErr != nil {
+		return *resErr
+	}
+
+	w := spaceWalker{
+		ctx:           req.Context(),
+		userID:        device.UserID,
+		suggestedOnly: query.Get("suggested_only") == "true",
+		maxDepth:      maxDepth,
+		cfg:           cfg,
+		queryAPI:      queryAPI,
+		federation:    federation,
+		remote:        make(map[string]*common.SpaceRoom),
+	}
+	// One more room than is returned is walked to tell whether there are
+	// any rooms after this batch.
+	rooms, err := w.walk(roomID, from+limit+1)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("w.walk failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(rooms) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You can't see this space"),
+		}
+	}
+
+	res := spaceHierarchyResponse{Rooms: []common.SpaceRoom{}}
+	if from < len(rooms) {
+		res.Rooms = rooms[from:]
+	}
+	if len(res.Rooms) > limit {
+		res.Rooms = res.Rooms[:limit]
+		res.NextBatch = strconv.Itoa(from + limit)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// parseSpaceHierarchyParam parses a query parameter which must be a
+// non-negative integer, returning the default if it isn't given.
+func parseSpaceHierarchyParam(value, name string, defaultValue int) (int, *util.JSONResponse) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(name + " must be a non-negative integer"),
+		}
+	}
+	return n, nil
+}
+
+// spaceWalker walks the hierarchy of a space for a local user.
+type spaceWalker struct {
+	ctx           context.Context
+	userID        string
+	suggestedOnly bool
+	maxDepth      int
+	cfg           *config.Dendrite
+	queryAPI      api.RoomserverQueryAPI
+	federation    *gomatrixserverlib.FederationClient
+	// The summaries that remote servers have returned for the children of
+	// their spaces, by room ID.
+	remote map[string]*common.SpaceRoom
+}
+
+type spaceWalkEntry struct {
+	roomID string
+	depth  int
+	via    []string
+}
+
+// walk returns up to the given number of rooms of the hierarchy, starting
+// with the space itself. No rooms are returned if the user can't see the space.
+func (w *spaceWalker) walk(roomID string, count int) ([]common.SpaceRoom, error) {
+	var rooms []common.SpaceRoom
+	visited := make(map[string]bool)
+	queue := []spaceWalkEntry{{roomID: roomID}}
+	for len(queue) > 0 && len(rooms) < count {
+		entry := queue[0]
+		queue = queue[1:]
+		if visited[entry.roomID] {
+			continue
+		}
+		visited[entry.roomID] = true
+
+		room, err := w.room(entry)
+		if err != nil {
+			return nil, err
+		}
+		if room == nil {
+			if entry.depth == 0 {
+				return nil, nil
+			}
+			continue
+		}
+		rooms = append(rooms, *room)
+		if entry.depth >= w.maxDepth {
+			continue
+		}
+
+		children := append([]common.SpaceChildState{}, room.ChildrenState...)
+		sortSpaceChildren(children)
+		for _, child := range children {
+			content, ok := child.ParsedContent()
+			if !ok || (w.suggestedOnly && !content.Suggested) {
+				continue
+			}
+			queue = append(queue, spaceWalkEntry{roomID: child.StateKey, depth: entry.depth + 1, via: content.Via})
+		}
+	}
+	return rooms, nil
+}
+
+// room returns the summary of a room in the hierarchy, or nil if the user
+// can't see it. Rooms which this server isn't in are looked up on the
+// servers that the parent space lists for them.
+func (w *spaceWalker) room(entry spaceWalkEntry) (*common.SpaceRoom, error) {
+	room, joined, err := common.LocalSpaceRoom(w.ctx, entry.roomID, w.queryAPI)
+	if err != nil {
+		return nil, err
+	}
+	if room != nil {
+		if room.IsPublic() {
+			return room, nil
+		}
+		for _, userID := range joined {
+			if userID == w.userID {
+				return room, nil
+			}
+		}
+		return nil, nil
+	}
+	if remoteRoom, ok := w.remote[entry.roomID]; ok {
+		return remoteRoom, nil
+	}
+
+	// The server which created the room is asked last, as it may have left.
+	servers := append([]string{}, entry.via...)
+	if _, domain, splitErr := gomatrixserverlib.SplitID('!', entry.roomID); splitErr == nil {
+		servers = append(servers, string(domain))
+	}
+	for _, server := range servers {
+		serverName := gomatrixserverlib.ServerName(server)
+		if serverName == w.cfg.Matrix.ServerName {
+			continue
+		}
+		var res *common.RespSpaceHierarchy
+		res, err = common.LookupSpaceHierarchy(w.ctx, w.federation, w.cfg, serverName, entry.roomID, w.suggestedOnly)
+		if err != nil {
+			util.GetLogger(w.ctx).WithError(err).WithField("server_name", serverName).Warn("common.LookupSpaceHierarchy failed")
+			continue
+		}
+		for i := range res.Children {
+			w.remote[res.Children[i].RoomID] = &res.Children[i]
+		}
+		return &res.Room, nil
+	}
+	return nil, nil
+}
+
+// sortSpaceChildren sorts the children of a space. Children with an order
+// come first, sorted by it, and the rest are sorted by their room IDs.
+func sortSpaceChildren(children []common.SpaceChildState) {
+	sort.SliceStable(children, func(i, j int) bool {
+		a, _ := children[i].ParsedContent()
+		b, _ := children[j].ParsedContent()
+		if (a.Order == "") != (b.Order == "") {
+			return a.Order != ""
+		}
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		return children[i].StateKey < children[j].StateKey
+	})
+}
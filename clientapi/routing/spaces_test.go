@@ -0,0 +1,143 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// testSpaces answers roomserver queries about the state of several local
+// rooms, which make up the hierarchy of a space.
+type testSpaces struct {
+	api.RoomserverQueryAPI
+	t     *testing.T
+	cfg   *config.Dendrite
+	state map[string][]gomatrixserverlib.HeaderedEvent
+}
+
+func newTestSpaces(t *testing.T) *testSpaces {
+	return &testSpaces{t: t, cfg: newTestRoom(t).cfg, state: make(map[string][]gomatrixserverlib.HeaderedEvent)}
+}
+
+// addRoom adds a public room created by alice, with a child event for each
+// of the given child room IDs. Children whose IDs are in suggested are
+// marked as suggested.
+func (s *testSpaces) addRoom(roomID string, children []string, suggested ...string) {
+	events := []fledglingEvent{
+		{"m.room.create", "", map[string]interface{}{"creator": "@alice:localhost", "room_version": "3"}},
+		{"m.room.member", "@alice:localhost", gomatrixserverlib.MemberContent{Membership: "join"}},
+		{"m.room.power_levels", "", common.InitialPowerLevelsContent("@alice:localhost")},
+		{"m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: "public"}},
+		{"m.room.name", "", common.NameContent{Name: roomID}},
+	}
+	for _, childID := range children {
+		content := common.SpaceChildContent{Via: []string{"localhost"}}
+		for _, suggestedID := range suggested {
+			content.Suggested = content.Suggested || suggestedID == childID
+		}
+		events = append(events, fledglingEvent{common.MSpaceChild, childID, content})
+	}
+	built, err := buildRoomEvents("@alice:localhost", roomID, events, s.cfg, time.Now(), gomatrixserverlib.RoomVersionV3)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.state[roomID] = built
+}
+
+func (s *testSpaces) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	response.StateEvents, response.RoomExists = s.state[request.RoomID]
+	response.RoomVersion = gomatrixserverlib.RoomVersionV3
+	return nil
+}
+
+// hierarchy requests the hierarchy of a space as bob, returning the IDs of
+// the rooms in it and the pagination token.
+func (s *testSpaces) hierarchy(roomID, query string) ([]string, string) {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/v1/rooms/"+roomID+"/hierarchy?"+query, nil)
+	res := GetSpaceHierarchy(req, &authtypes.Device{UserID: "@bob:localhost"}, roomID, s.cfg, s, nil)
+	if res.Code != http.StatusOK {
+		s.t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	body := res.JSON.(spaceHierarchyResponse)
+	roomIDs := []string{}
+	for _, room := range body.Rooms {
+		roomIDs = append(roomIDs, room.RoomID)
+	}
+	return roomIDs, body.NextBatch
+}
+
+// newTwoLevelSpace builds a space with two subspaces, each with two rooms.
+// The second room of the second subspace is also a child of the first.
+func newTwoLevelSpace(t *testing.T) *testSpaces {
+	s := newTestSpaces(t)
+	s.addRoom("!space:localhost", []string{"!sub1:localhost", "!sub2:localhost"}, "!sub1:localhost")
+	s.addRoom("!sub1:localhost", []string{"!a:localhost", "!d:localhost"}, "!a:localhost")
+	s.addRoom("!sub2:localhost", []string{"!c:localhost", "!d:localhost"})
+	for _, roomID := range []string{"!a:localhost", "!c:localhost", "!d:localhost"} {
+		s.addRoom(roomID, nil)
+	}
+	return s
+}
+
+func TestSpaceHierarchyWalksTwoLevels(t *testing.T) {
+	s := newTwoLevelSpace(t)
+	// Each room is only returned once, even though !d is in both subspaces.
+	expected := []string{"!space:localhost", "!sub1:localhost", "!sub2:localhost", "!a:localhost", "!d:localhost", "!c:localhost"}
+	if rooms, next := s.hierarchy("!space:localhost", ""); !reflect.DeepEqual(rooms, expected) || next != "" {
+		t.Errorf("expected rooms %v and no next batch, got %v and %q", expected, rooms, next)
+	}
+
+	rooms, next := s.hierarchy("!space:localhost", "limit=4")
+	if !reflect.DeepEqual(rooms, expected[:4]) || next == "" {
+		t.Fatalf("expected rooms %v and a next batch, got %v and %q", expected[:4], rooms, next)
+	}
+	if rooms, next = s.hierarchy("!space:localhost", "limit=4&from="+next); !reflect.DeepEqual(rooms, expected[4:]) || next != "" {
+		t.Errorf("expected rooms %v and no next batch, got %v and %q", expected[4:], rooms, next)
+	}
+}
+
+func TestSpaceHierarchySuggestedOnly(t *testing.T) {
+	s := newTwoLevelSpace(t)
+	expected := []string{"!space:localhost", "!sub1:localhost", "!a:localhost"}
+	if rooms, _ := s.hierarchy("!space:localhost", "suggested_only=true"); !reflect.DeepEqual(rooms, expected) {
+		t.Errorf("expected rooms %v, got %v", expected, rooms)
+	}
+}
+
+func TestSpaceHierarchyMaxDepth(t *testing.T) {
+	s := newTwoLevelSpace(t)
+	expected := []string{"!space:localhost", "!sub1:localhost", "!sub2:localhost"}
+	if rooms, _ := s.hierarchy("!space:localhost", "max_depth=1"); !reflect.DeepEqual(rooms, expected) {
+		t.Errorf("expected rooms %v, got %v", expected, rooms)
+	}
+	if rooms, _ := s.hierarchy("!space:localhost", "max_depth=0"); !reflect.DeepEqual(rooms, expected[:1]) {
+		t.Errorf("expected rooms %v, got %v", expected[:1], rooms)
+	}
+}
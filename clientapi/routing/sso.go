@@ -0,0 +1,455 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	ssoStateLength = 32
+	// ssoStateLifetime is how long a user has to log in with the provider
+	// after being sent to it.
+	ssoStateLifetime = 10 * time.Minute
+	// loginTokenLifetime is how long a client has to exchange a login token
+	// for an access token once it has been issued.
+	loginTokenLifetime = 2 * time.Minute
+	// ssoSessionCookie is the cookie which ties the state to the browser that
+	// was sent to the provider, so that the login can't be finished in a
+	// different one.
+	ssoSessionCookie = "dendrite_sso_session"
+)
+
+// ssoHTTPClient makes the requests to the provider.
+var ssoHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// ssoStates stores where to send each user who was sent to the provider once
+// they come back from it, referenced by the state passed through the provider.
+var ssoStates = newSSOStatesDict()
+
+// ssoStatesDict keeps track of the users who have been sent to the provider.
+// It shouldn't be passed by value because it contains a mutex.
+type ssoStatesDict struct {
+	sync.Mutex
+	states map[string]ssoState
+}
+
+type ssoState struct {
+	redirectURL *url.URL
+	session     string
+	expires     time.Time
+}
+
+func newSSOStatesDict() *ssoStatesDict {
+	return &ssoStatesDict{states: make(map[string]ssoState)}
+}
+
+// add remembers where to send a user back to and the session of their
+// browser, and returns the state to pass through the provider. States which
+// have expired are forgotten at the same time.
+func (d *ssoStatesDict) add(redirectURL *url.URL, session string) string {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	for state, s := range d.states {
+		if now.After(s.expires) {
+			delete(d.states, state)
+		}
+	}
+	state := util.RandomString(ssoStateLength)
+	d.states[state] = ssoState{redirectURL: redirectURL, session: session, expires: now.Add(ssoStateLifetime)}
+	return state
+}
+
+// claim forgets the given state and returns where to send the user back to,
+// or nil if there is no such state for the session or it has expired.
+func (d *ssoStatesDict) claim(state, session string) *url.URL {
+	d.Lock()
+	defer d.Unlock()
+
+	s, ok := d.states[state]
+	if !ok || session == "" || s.session != session {
+		return nil
+	}
+	delete(d.states, state)
+	if time.Now().After(s.expires) {
+		return nil
+	}
+	return s.redirectURL
+}
+
+// oidcProvider holds the endpoints of an OpenID Connect provider.
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// discoverOIDCProvider fetches the endpoints of the configured provider.
+func discoverOIDCProvider(req *http.Request, cfg *config.SSO) (*oidcProvider, error) {
+	discoveryURL := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	var provider oidcProvider
+	if err := ssoGetJSON(req, discoveryURL, "", &provider); err != nil {
+		return nil, err
+	}
+	if provider.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("provider has issuer %q, expected %q", provider.Issuer, cfg.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("provider %q is missing an endpoint", cfg.Issuer)
+	}
+	return &provider, nil
+}
+
+// ssoGetJSON fetches a JSON document from the provider, with the access
+// token as a bearer token if one is given.
+func ssoGetJSON(req *http.Request, target, accessToken string, result interface{}) error {
+	providerReq, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if accessToken != "" {
+		providerReq.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	return ssoDo(providerReq.WithContext(req.Context()), result)
+}
+
+func ssoDo(providerReq *http.Request, result interface{}) error {
+	providerReq.Header.Set("Accept", "application/json")
+	res, err := ssoHTTPClient.Do(providerReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %s", providerReq.Method, providerReq.URL, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// SSORedirect implements GET /login/sso/redirect
+// https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-login-sso-redirect
+// The user is sent to the provider to log in, and comes back to the callback
+// with the state which says where to send them afterwards.
+func SSORedirect(req *http.Request, cfg *config.Dendrite) util.JSONResponse {
+	if !cfg.Matrix.SSO.Enabled {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Single sign-on is not enabled on this server"),
+		}
+	}
+	redirectURL, err := url.Parse(req.URL.Query().Get("redirectUrl"))
+	if err != nil || !redirectURL.IsAbs() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("An absolute redirectUrl must be supplied"),
+		}
+	}
+	if !ssoClientAllowed(redirectURL, &cfg.Matrix.SSO) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("The redirectUrl isn't a client which this server lets users log in to"),
+		}
+	}
+	provider, err := discoverOIDCProvider(req, &cfg.Matrix.SSO)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("discoverOIDCProvider failed")
+		return jsonerror.InternalServerError()
+	}
+	authURL, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("url.Parse failed")
+		return jsonerror.InternalServerError()
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", cfg.Matrix.SSO.ClientID)
+	query.Set("redirect_uri", cfg.Matrix.SSO.CallbackURL)
+	query.Set("scope", strings.Join(cfg.Matrix.SSO.Scopes, " "))
+	session := util.RandomString(ssoStateLength)
+	query.Set("state", ssoStates.add(redirectURL, session))
+	authURL.RawQuery = query.Encode()
+	res := util.RedirectResponse(authURL.String())
+	res.Headers["Set-Cookie"] = ssoCookie(&cfg.Matrix.SSO, session, int(ssoStateLifetime/time.Second)).String()
+	return res
+}
+
+// ssoClientAllowed returns whether the redirectUrl is under one of the base
+// URLs of the clients which users may log in to.
+func ssoClientAllowed(redirectURL *url.URL, cfg *config.SSO) bool {
+	for _, clientURL := range cfg.ClientWhitelist {
+		allowed, err := url.Parse(clientURL)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(redirectURL.Scheme, allowed.Scheme) &&
+			strings.EqualFold(redirectURL.Host, allowed.Host) &&
+			redirectURL.User == nil &&
+			strings.HasPrefix(redirectURL.Path, allowed.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// ssoCookie returns the session cookie, which is only sent to the callback.
+// A negative maxAge removes the cookie.
+func ssoCookie(cfg *config.SSO, session string, maxAge int) *http.Cookie {
+	path := "/"
+	callbackURL, err := url.Parse(cfg.CallbackURL)
+	if err == nil && callbackURL.Path != "" {
+		path = callbackURL.Path
+	}
+	return &http.Cookie{
+		Name:     ssoSessionCookie,
+		Value:    session,
+		Path:     path,
+		MaxAge:   maxAge,
+		Secure:   err == nil && callbackURL.Scheme == "https",
+		HttpOnly: true,
+		// The provider sends the user back to the callback with a top level
+		// navigation, which lax cookies are sent with.
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// SSOCallback implements GET /login/sso/callback
+// The provider sends the user back here with a code, which is exchanged for
+// the claims about them. They are then sent back to the client with a login
+// token, which logs them in as the local user that they are mapped to. Users
+// logging in for the first time are given a new account, named after the
+// configured claim, and joined to the auto_join_rooms if the config says so.
+func SSOCallback(
+	req *http.Request, cfg *config.Dendrite, accountDB accounts.Database, autoJoin *autoJoiner,
+) util.JSONResponse {
+	if !cfg.Matrix.SSO.Enabled {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Single sign-on is not enabled on this server"),
+		}
+	}
+	query := req.URL.Query()
+	var session string
+	if cookie, err := req.Cookie(ssoSessionCookie); err == nil {
+		session = cookie.Value
+	}
+	redirectURL := ssoStates.claim(query.Get("state"), session)
+	if redirectURL == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Unknown or expired state, or the login was started in another browser, try logging in again"),
+		}
+	}
+	if providerErr := query.Get("error"); providerErr != "" {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The provider refused the login: " + providerErr),
+		}
+	}
+	code := query.Get("code")
+	if code == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("The provider didn't return a code"),
+		}
+	}
+
+	claims, err := fetchSSOClaims(req, &cfg.Matrix.SSO, code)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fetchSSOClaims failed")
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Unknown("Failed to log in with the provider"),
+		}
+	}
+	localpart, resErr := ssoLocalpart(req, cfg, accountDB, claims, autoJoin)
+	if resErr != nil {
+		return *resErr
+	}
+
+	token, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	expiresAt := time.Now().Add(loginTokenLifetime)
+	if err = accountDB.CreateLoginToken(req.Context(), &authtypes.LoginToken{
+		Token:       token,
+		Localpart:   localpart,
+		ExpiresAtMS: int64(gomatrixserverlib.AsTimestamp(expiresAt)),
+	}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateLoginToken failed")
+		return jsonerror.InternalServerError()
+	}
+
+	redirectQuery := redirectURL.Query()
+	redirectQuery.Set("loginToken", token)
+	redirectURL.RawQuery = redirectQuery.Encode()
+	res := util.RedirectResponse(redirectURL.String())
+	res.Headers["Set-Cookie"] = ssoCookie(&cfg.Matrix.SSO, "", -1).String()
+	return res
+}
+
+// fetchSSOClaims exchanges a code from the provider for an access token, and
+// then fetches the claims about the user with it.
+func fetchSSOClaims(req *http.Request, cfg *config.SSO, code string) (map[string]interface{}, error) {
+	provider, err := discoverOIDCProvider(req, cfg)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", cfg.CallbackURL)
+	tokenReq, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	var tokenRes struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err = ssoDo(tokenReq.WithContext(req.Context()), &tokenRes); err != nil {
+		return nil, err
+	}
+	if tokenRes.AccessToken == "" {
+		return nil, fmt.Errorf("provider didn't return an access token")
+	}
+	var claims map[string]interface{}
+	if err = ssoGetJSON(req, provider.UserinfoEndpoint, tokenRes.AccessToken, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// ssoLocalpart returns the localpart of the local user that the user of the
+// provider logs in as. If they haven't logged in before then an account is
+// created for them, unless its localpart is already taken.
+func ssoLocalpart(
+	req *http.Request, cfg *config.Dendrite, accountDB accounts.Database,
+	claims map[string]interface{}, autoJoin *autoJoiner,
+) (string, *util.JSONResponse) {
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return "", &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Unknown("The provider didn't identify the user"),
+		}
+	}
+	issuer := cfg.Matrix.SSO.Issuer
+	localpart, err := accountDB.GetLocalpartForSSOIdentity(req.Context(), issuer, subject)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForSSOIdentity failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	if localpart != "" {
+		return localpart, nil
+	}
+
+	claim, _ := claims[cfg.Matrix.SSO.LocalpartClaim].(string)
+	localpart = strings.ToLower(claim)
+	if resErr := validateUsername(localpart); resErr != nil {
+		return "", &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.InvalidUsername(fmt.Sprintf(
+				"The %s %q from the provider can't be used as a username", cfg.Matrix.SSO.LocalpartClaim, claim,
+			)),
+		}
+	}
+	// Logging in as an existing user who didn't come from the provider would
+	// let the provider take over their account.
+	taken := &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.UserInUse("The user ID " + userutil.MakeUserID(localpart, cfg.Matrix.ServerName) + " is already taken"),
+	}
+	available, err := accountDB.CheckAccountAvailability(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CheckAccountAvailability failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	} else if !available {
+		return "", taken
+	}
+	acc, err := accountDB.CreateAccount(req.Context(), localpart, "", "")
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateAccount failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	} else if acc == nil {
+		return "", taken
+	}
+	amtRegUsers.Inc()
+	if err = accountDB.SaveSSOIdentity(req.Context(), issuer, subject, localpart); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveSSOIdentity failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	if cfg.Matrix.SSO.AutoJoinRooms {
+		autoJoin.joinRooms(req, acc.UserID)
+	}
+	return localpart, nil
+}
+
+// loginTokenLogin returns the account that an m.login.token login logs in
+// as. The token can only be used once.
+func loginTokenLogin(
+	req *http.Request, r passwordRequest, accountDB accounts.Database,
+) (*authtypes.Account, *util.JSONResponse) {
+	token, err := accountDB.ClaimLoginToken(req.Context(), r.Token)
+	if err == sql.ErrNoRows {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The login token is invalid or has already been used"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.ClaimLoginToken failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	if int64(gomatrixserverlib.AsTimestamp(time.Now())) > token.ExpiresAtMS {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The login token has expired"),
+		}
+	}
+	acc, err := accountDB.GetAccountByLocalpart(req.Context(), token.Localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	return acc, nil
+}
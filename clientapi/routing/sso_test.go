@@ -0,0 +1,261 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/util"
+)
+
+// mockOIDCProvider is an OpenID Connect provider which logs in whoever is
+// set as its user, by handing out a code for them.
+type mockOIDCProvider struct {
+	*httptest.Server
+	t     *testing.T
+	mu    sync.Mutex
+	codes map[string]map[string]interface{}
+	user  map[string]interface{}
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	p := &mockOIDCProvider{t: t, codes: make(map[string]map[string]interface{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		p.writeJSON(w, oidcProvider{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			UserinfoEndpoint:      p.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		if id, secret, ok := req.BasicAuth(); !ok || id != "dendrite" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.PostFormValue("grant_type") != "authorization_code" || req.PostFormValue("redirect_uri") != "https://localhost/callback" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// The code is used as the access token, to find the user again.
+		p.writeJSON(w, map[string]string{"access_token": req.PostFormValue("code"), "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		p.mu.Lock()
+		claims, ok := p.codes[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")]
+		p.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		p.writeJSON(w, claims)
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *mockOIDCProvider) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		p.t.Error(err)
+	}
+}
+
+// authorize logs in as the user with the given claims at the authorization
+// URL that the user was redirected to, and returns the callback URL that the
+// provider then sends them to.
+func (p *mockOIDCProvider) authorize(authURL string, claims map[string]interface{}) string {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, p.URL+"/authorize?") || u.Query().Get("client_id") != "dendrite" {
+		p.t.Fatalf("unexpected authorization URL %s", authURL)
+	}
+	code := u.Query().Get("state") + "-code"
+	p.mu.Lock()
+	p.codes[code] = claims
+	p.mu.Unlock()
+	return "/_matrix/client/r0/login/sso/callback?" + url.Values{"state": {u.Query().Get("state")}, "code": {code}}.Encode()
+}
+
+func newSSOTest(t *testing.T) (*deactivateTest, *mockOIDCProvider, func()) {
+	d, cleanup := newDeactivateTest(t)
+	p := newMockOIDCProvider(t)
+	sso := &d.room.cfg.Matrix.SSO
+	sso.Enabled = true
+	sso.Issuer = p.URL
+	sso.ClientID = "dendrite"
+	sso.ClientSecret = "secret"
+	sso.CallbackURL = "https://localhost/callback"
+	sso.LocalpartClaim = "preferred_username"
+	sso.Scopes = []string{"openid", "profile"}
+	sso.ClientWhitelist = []string{"https://client.example/"}
+	return d, p, func() {
+		p.Close()
+		cleanup()
+	}
+}
+
+// ssoRedirect sends the user to the provider, and returns the URL that they
+// are sent to and the session cookie that their browser is given.
+func (d *deactivateTest) ssoRedirect(t *testing.T) (string, *http.Cookie) {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/login/sso/redirect?redirectUrl="+url.QueryEscape("https://client.example/done?x=1"), nil)
+	res := SSORedirect(req, d.room.cfg)
+	if res.Code != http.StatusFound {
+		t.Fatalf("expected a redirect to the provider, got %d: %v", res.Code, res.JSON)
+	}
+	cookies := (&http.Response{Header: http.Header{"Set-Cookie": {res.Headers["Set-Cookie"]}}}).Cookies()
+	if len(cookies) != 1 || cookies[0].Name != ssoSessionCookie || !cookies[0].HttpOnly || cookies[0].Path != "/callback" {
+		t.Fatalf("expected a session cookie for the callback, got %q", res.Headers["Set-Cookie"])
+	}
+	return res.Headers["Location"], cookies[0]
+}
+
+// ssoLogin goes through the whole single sign-on flow as the user with the
+// given claims, and returns the response to the callback.
+func (d *deactivateTest) ssoLogin(t *testing.T, p *mockOIDCProvider, claims map[string]interface{}) util.JSONResponse {
+	authURL, cookie := d.ssoRedirect(t)
+	req := httptest.NewRequest(http.MethodGet, p.authorize(authURL, claims), nil)
+	req.AddCookie(cookie)
+	return SSOCallback(req, d.room.cfg, d.accountDB, d.autoJoin)
+}
+
+// loginToken returns the login token that the callback redirected the user
+// back to the client with.
+func loginToken(t *testing.T, res util.JSONResponse) string {
+	if res.Code != http.StatusFound {
+		t.Fatalf("expected a redirect back to the client, got %d: %v", res.Code, res.JSON)
+	}
+	u, err := url.Parse(res.Headers["Location"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "client.example" || u.Query().Get("x") != "1" || u.Query().Get("loginToken") == "" {
+		t.Fatalf("unexpected redirect back to the client %s", u)
+	}
+	return u.Query().Get("loginToken")
+}
+
+func (d *deactivateTest) loginWithToken(token string) util.JSONResponse {
+	body := `{"type": "m.login.token", "token": "` + token + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/login", strings.NewReader(body))
+	return Login(req, d.accountDB, d.deviceDB, nil, d.room.cfg, &producers.DeviceListProducer{Producer: testSyncProducer{}})
+}
+
+func TestSSOCallbackProvisionsAndLogsIn(t *testing.T) {
+	d, p, cleanup := newSSOTest(t)
+	defer cleanup()
+	claims := map[string]interface{}{"sub": "1234", "preferred_username": "Bob"}
+
+	token := loginToken(t, d.ssoLogin(t, p, claims))
+	res := d.loginWithToken(token)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	if userID := res.JSON.(loginResponse).UserID; userID != "@bob:localhost" {
+		t.Errorf("expected to be logged in as @bob:localhost, got %s", userID)
+	}
+	if res = d.loginWithToken(token); res.Code != http.StatusForbidden {
+		t.Errorf("expected the login token to only be usable once, got %d: %v", res.Code, res.JSON)
+	}
+
+	// The user keeps logging in as the same account, even when the claim
+	// that it was named after changes.
+	claims["preferred_username"] = "robert"
+	res = d.loginWithToken(loginToken(t, d.ssoLogin(t, p, claims)))
+	if res.Code != http.StatusOK || res.JSON.(loginResponse).UserID != "@bob:localhost" {
+		t.Errorf("expected to be logged in as @bob:localhost again, got %d: %v", res.Code, res.JSON)
+	}
+}
+
+func TestSSOCallbackDoesNotTakeOverAccounts(t *testing.T) {
+	d, p, cleanup := newSSOTest(t)
+	defer cleanup()
+	res := d.ssoLogin(t, p, map[string]interface{}{"sub": "5678", "preferred_username": "alice"})
+	if res.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a taken username, got %d: %v", res.Code, res.JSON)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/login/sso/callback?state=made-up&code=1234", nil)
+	if res = SSOCallback(req, d.room.cfg, d.accountDB, nil); res.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown state, got %d: %v", res.Code, res.JSON)
+	}
+}
+
+func TestLoginFlowsIncludeSSO(t *testing.T) {
+	d, _, cleanup := newSSOTest(t)
+	defer cleanup()
+	var types []string
+	for _, f := range loginFlowsFor(d.room.cfg).Flows {
+		types = append(types, f.Type)
+	}
+	if strings.Join(types, ",") != "m.login.password,"+authtypes.LoginTypeSSO+","+authtypes.LoginTypeToken {
+		t.Errorf("unexpected login flows %v", types)
+	}
+}
+
+func TestSSORedirectOnlyToAllowedClients(t *testing.T) {
+	d, _, cleanup := newSSOTest(t)
+	defer cleanup()
+	for _, redirectURL := range []string{
+		"https://evil.example/done",
+		"https://client.example.evil.example/done",
+		"http://client.example/done",
+		"https://user@client.example/done",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/login/sso/redirect?redirectUrl="+url.QueryEscape(redirectURL), nil)
+		if res := SSORedirect(req, d.room.cfg); res.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d: %v", redirectURL, res.Code, res.JSON)
+		}
+	}
+}
+
+func TestSSOCallbackRequiresSessionCookie(t *testing.T) {
+	d, p, cleanup := newSSOTest(t)
+	defer cleanup()
+	claims := map[string]interface{}{"sub": "1234", "preferred_username": "bob"}
+
+	// A callback URL which is passed on to another browser doesn't log that
+	// browser in.
+	authURL, cookie := d.ssoRedirect(t)
+	callbackURL := p.authorize(authURL, claims)
+	for _, session := range []string{"", "other-session"} {
+		req := httptest.NewRequest(http.MethodGet, callbackURL, nil)
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: ssoSessionCookie, Value: session})
+		}
+		if res := SSOCallback(req, d.room.cfg, d.accountDB, d.autoJoin); res.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for the session %q, got %d: %v", session, res.Code, res.JSON)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, callbackURL, nil)
+	req.AddCookie(cookie)
+	res := SSOCallback(req, d.room.cfg, d.accountDB, d.autoJoin)
+	loginToken(t, res)
+	if !strings.Contains(res.Headers["Set-Cookie"], "Max-Age=0") {
+		t.Errorf("expected the session cookie to be removed, got %q", res.Headers["Set-Cookie"])
+	}
+}
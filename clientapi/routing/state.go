@@ -20,6 +20,7 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -37,23 +38,16 @@ type stateEventInStateResp struct {
 // request. It will fetch all the state events from the specified room and will
 // append the necessary keys to them if applicable before returning them.
 // Returns an error if something went wrong in the process.
-// TODO: Check if the user is in the room. If not, check if the room's history
-// is publicly visible. Current behaviour is returning an empty array if the
-// user cannot see the room's history.
-func OnIncomingStateRequest(ctx context.Context, queryAPI api.RoomserverQueryAPI, roomID string) util.JSONResponse {
-	// TODO(#287): Auth request and handle the case where the user has left (where
-	// we should return the state at the poin they left)
-	stateReq := api.QueryLatestEventsAndStateRequest{
-		RoomID: roomID,
-	}
-	stateRes := api.QueryLatestEventsAndStateResponse{}
-
-	if err := queryAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
-		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryLatestEventsAndState failed")
+// Whether the user may read the room is checked by the caller. Users who have
+// left the room get the state at the point they left, after leaveEventID.
+func OnIncomingStateRequest(ctx context.Context, queryAPI api.RoomserverQueryAPI, roomID, leaveEventID string) util.JSONResponse {
+	_, stateEvents, err := common.QueryRoomState(ctx, queryAPI, roomID, leaveEventID, nil)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("common.QueryRoomState failed")
 		return jsonerror.InternalServerError()
 	}
 
-	if len(stateRes.StateEvents) == 0 {
+	if len(stateEvents) == 0 {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("cannot find state"),
@@ -62,7 +56,7 @@ func OnIncomingStateRequest(ctx context.Context, queryAPI api.RoomserverQueryAPI
 
 	resp := []stateEventInStateResp{}
 	// Fill the prev_content and replaces_state keys if necessary
-	for _, event := range stateRes.StateEvents {
+	for _, event := range stateEvents {
 		stateEvent := stateEventInStateResp{
 			ClientEvent: gomatrixserverlib.HeaderedToClientEvents(
 				[]gomatrixserverlib.HeaderedEvent{event}, gomatrixserverlib.FormatAll,
@@ -97,33 +91,27 @@ func OnIncomingStateRequest(ctx context.Context, queryAPI api.RoomserverQueryAPI
 // OnIncomingStateTypeRequest is called when a client makes a
 // /rooms/{roomID}/state/{type}/{statekey} request. It will look in current
 // state to see if there is an event with that type and state key, if there
-// is then (by default) we return the content, otherwise a 404.
-func OnIncomingStateTypeRequest(ctx context.Context, queryAPI api.RoomserverQueryAPI, roomID string, evType, stateKey string) util.JSONResponse {
-	// TODO(#287): Auth request and handle the case where the user has left (where
-	// we should return the state at the poin they left)
+// is then (by default) we return the content, otherwise a 404. Users who have
+// left the room get the state at the point they left, after leaveEventID.
+func OnIncomingStateTypeRequest(ctx context.Context, queryAPI api.RoomserverQueryAPI, roomID, leaveEventID string, evType, stateKey string) util.JSONResponse {
 	util.GetLogger(ctx).WithFields(log.Fields{
 		"roomID":   roomID,
 		"evType":   evType,
 		"stateKey": stateKey,
 	}).Info("Fetching state")
 
-	stateReq := api.QueryLatestEventsAndStateRequest{
-		RoomID: roomID,
-		StateToFetch: []gomatrixserverlib.StateKeyTuple{
-			gomatrixserverlib.StateKeyTuple{
-				EventType: evType,
-				StateKey:  stateKey,
-			},
+	_, stateEvents, err := common.QueryRoomState(ctx, queryAPI, roomID, leaveEventID, []gomatrixserverlib.StateKeyTuple{
+		gomatrixserverlib.StateKeyTuple{
+			EventType: evType,
+			StateKey:  stateKey,
 		},
-	}
-	stateRes := api.QueryLatestEventsAndStateResponse{}
-
-	if err := queryAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
-		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryLatestEventsAndState failed")
+	})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("common.QueryRoomState failed")
 		return jsonerror.InternalServerError()
 	}
 
-	if len(stateRes.StateEvents) == 0 {
+	if len(stateEvents) == 0 {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("cannot find state"),
@@ -131,7 +119,7 @@ func OnIncomingStateTypeRequest(ctx context.Context, queryAPI api.RoomserverQuer
 	}
 
 	stateEvent := stateEventInStateResp{
-		ClientEvent: gomatrixserverlib.HeaderedToClientEvent(stateRes.StateEvents[0], gomatrixserverlib.FormatAll),
+		ClientEvent: gomatrixserverlib.HeaderedToClientEvent(stateEvents[0], gomatrixserverlib.FormatAll),
 	}
 
 	return util.JSONResponse{
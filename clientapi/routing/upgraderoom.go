@@ -0,0 +1,370 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
+	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-rooms-roomid-upgrade
+type upgradeRoomRequest struct {
+	NewVersion gomatrixserverlib.RoomVersion `json:"new_version"`
+}
+
+type upgradeRoomResponse struct {
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// transferableStateTypes are the types of state event which are copied from
+// the old room to the new one when a room is upgraded.
+var transferableStateTypes = []string{
+	gomatrixserverlib.MRoomJoinRules,
+	gomatrixserverlib.MRoomHistoryVisibility,
+	"m.room.guest_access",
+	gomatrixserverlib.MRoomName,
+	"m.room.topic",
+	"m.room.avatar",
+	"m.room.encryption",
+	"m.room.server_acl",
+	"m.room.related_groups",
+}
+
+// UpgradeRoom implements POST /rooms/{roomID}/upgrade
+// It creates a new room with the requested room version and the state of the
+// old room, then sends a tombstone pointing to the new room into the old room
+// and stops users who aren't moderators from talking in it.
+func UpgradeRoom(
+	req *http.Request, device *authtypes.Device, roomID string,
+	cfg *config.Dendrite, producer *producers.RoomserverProducer,
+	queryAPI roomserverAPI.RoomserverQueryAPI,
+) util.JSONResponse {
+	var r upgradeRoomRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if _, err := roomserverVersion.SupportedRoomVersion(r.NewVersion); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnsupportedRoomVersion(err.Error()),
+		}
+	}
+	evTime := time.Now()
+
+	// Fetch the current state of the old room.
+	var stateRes roomserverAPI.QueryLatestEventsAndStateResponse
+	err := queryAPI.QueryLatestEventsAndState(req.Context(), &roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+	}, &stateRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryLatestEventsAndState failed")
+		return jsonerror.InternalServerError()
+	}
+	if !stateRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	}
+	oldState := make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event)
+	stateEvents := make([]*gomatrixserverlib.Event, len(stateRes.StateEvents))
+	for i := range stateRes.StateEvents {
+		ev := &stateRes.StateEvents[i].Event
+		oldState[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+		stateEvents[i] = ev
+	}
+	oldMember := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: device.UserID}]
+	if membership, _ := memberEventMembership(oldMember); membership != gomatrixserverlib.Join {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not in the room"),
+		}
+	}
+	oldPowerLevels := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}]
+	if oldPowerLevels == nil {
+		util.GetLogger(req.Context()).Error("Room has no power levels")
+		return jsonerror.InternalServerError()
+	}
+
+	// TODO (#267): Check room ID doesn't clash with an existing one, and we
+	//              probably shouldn't be using pseudo-random strings, maybe GUIDs?
+	newRoomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
+
+	// Build the events for the old room first, so that the room is only
+	// upgraded if the user may send them.
+	tombstone, resErr := buildUpgradeEvent(req, device, roomID, "m.room.tombstone", map[string]interface{}{
+		"body":             "This room has been replaced",
+		"replacement_room": newRoomID,
+	}, cfg, evTime, queryAPI, stateEvents, nil)
+	if resErr != nil {
+		return *resErr
+	}
+	frozenPowerLevels, err := restrictedPowerLevelsContent(oldPowerLevels)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("restrictedPowerLevelsContent failed")
+		return jsonerror.InternalServerError()
+	}
+	headeredTombstone := tombstone.Headered(stateRes.RoomVersion)
+	freeze, resErr := buildUpgradeEvent(
+		req, device, roomID, gomatrixserverlib.MRoomPowerLevels, frozenPowerLevels,
+		cfg, evTime, queryAPI, stateEvents, &headeredTombstone,
+	)
+	if resErr != nil {
+		return *resErr
+	}
+
+	eventsToMake, err := upgradedRoomEvents(device.UserID, roomID, tombstone.EventID(), r.NewVersion, oldState)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("upgradedRoomEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	newRoomEvents, err := buildRoomEvents(device.UserID, newRoomID, eventsToMake, cfg, evTime, r.NewVersion)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("buildRoomEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if _, err = producer.SendEvents(req.Context(), newRoomEvents, cfg.Matrix.ServerName, nil); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	if _, err = producer.SendEvents(
+		req.Context(),
+		[]gomatrixserverlib.HeaderedEvent{
+			headeredTombstone,
+			freeze.Headered(stateRes.RoomVersion),
+		},
+		cfg.Matrix.ServerName, nil,
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: upgradeRoomResponse{ReplacementRoom: newRoomID},
+	}
+}
+
+// buildUpgradeEvent builds a state event in the old room, returning
+// M_FORBIDDEN if the user doesn't have the power to send it. If after is set
+// then the event follows on from it rather than from the latest events in the
+// room, as both are sent together.
+func buildUpgradeEvent(
+	req *http.Request, device *authtypes.Device, roomID, eventType string,
+	content interface{}, cfg *config.Dendrite, evTime time.Time,
+	queryAPI roomserverAPI.RoomserverQueryAPI, stateEvents []*gomatrixserverlib.Event,
+	after *gomatrixserverlib.HeaderedEvent,
+) (*gomatrixserverlib.Event, *util.JSONResponse) {
+	stateKey := ""
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   device.UserID,
+		RoomID:   roomID,
+		Type:     eventType,
+		StateKey: &stateKey,
+	}
+	if err := builder.SetContent(content); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	var ev *gomatrixserverlib.Event
+	var err error
+	if after == nil {
+		ev, err = common.BuildEvent(req.Context(), &builder, cfg, evTime, queryAPI, nil)
+	} else {
+		ev, err = buildEventAfter(&builder, after, cfg, evTime)
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to build the event")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = auth.Allowed(*ev, &provider); err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You don't have permission to upgrade the room, power level too low."),
+		}
+	}
+	return ev, nil
+}
+
+// buildEventAfter builds an event whose only prev event is the given event,
+// and which is authed by the same events. This is only correct if the given
+// event doesn't change the state needed to auth the new event.
+func buildEventAfter(
+	builder *gomatrixserverlib.EventBuilder, after *gomatrixserverlib.HeaderedEvent,
+	cfg *config.Dendrite, evTime time.Time,
+) (*gomatrixserverlib.Event, error) {
+	builder.PrevEvents = []gomatrixserverlib.EventReference{after.EventReference()}
+	builder.AuthEvents = after.AuthEvents()
+	builder.Depth = after.Depth() + 1
+	ev, err := builder.Build(
+		evTime, cfg.Matrix.ServerName, cfg.Matrix.KeyID,
+		cfg.Matrix.PrivateKey, after.RoomVersion,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = common.CheckEventLimits(&ev, &cfg.Matrix.EventLimits); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+// upgradedRoomEvents returns the events which create the new room, copying
+// the transferable state of the old room. If the user doesn't have the power
+// to send all of the copied state then they are given it while the room is
+// created, and the old power levels are restored afterwards.
+func upgradedRoomEvents(
+	userID, oldRoomID, tombstoneEventID string, newVersion gomatrixserverlib.RoomVersion,
+	oldState map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event,
+) ([]fledglingEvent, error) {
+	oldMember := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: userID}]
+	var memberContent gomatrixserverlib.MemberContent
+	if err := json.Unmarshal(oldMember.Content(), &memberContent); err != nil {
+		return nil, err
+	}
+	memberContent = gomatrixserverlib.MemberContent{
+		Membership:  gomatrixserverlib.Join,
+		DisplayName: memberContent.DisplayName,
+		AvatarURL:   memberContent.AvatarURL,
+	}
+
+	oldPowerLevels := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}]
+	var powerLevels map[string]interface{}
+	if err := json.Unmarshal(oldPowerLevels.Content(), &powerLevels); err != nil {
+		return nil, err
+	}
+	levels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(*oldPowerLevels)
+	if err != nil {
+		return nil, err
+	}
+
+	var stateToCopy []fledglingEvent
+	neededLevel := levels.EventLevel(gomatrixserverlib.MRoomPowerLevels, true)
+	for _, eventType := range transferableStateTypes {
+		ev := oldState[gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: ""}]
+		if ev == nil {
+			continue
+		}
+		stateToCopy = append(stateToCopy, fledglingEvent{eventType, "", json.RawMessage(ev.Content())})
+		if level := levels.EventLevel(eventType, true); level > neededLevel {
+			neededLevel = level
+		}
+	}
+
+	createContent := map[string]interface{}{
+		"creator":      userID,
+		"room_version": newVersion,
+		"predecessor": map[string]string{
+			"room_id":  oldRoomID,
+			"event_id": tombstoneEventID,
+		},
+	}
+	if oldCreate := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}]; oldCreate != nil {
+		var oldCreateContent gomatrixserverlib.CreateContent
+		if err = json.Unmarshal(oldCreate.Content(), &oldCreateContent); err != nil {
+			return nil, err
+		}
+		if oldCreateContent.Federate != nil {
+			createContent["m.federate"] = *oldCreateContent.Federate
+		}
+	}
+
+	initialPowerLevels := powerLevels
+	userLevel := levels.UserLevel(userID)
+	if userLevel < neededLevel {
+		initialPowerLevels = copyPowerLevelsWithUser(powerLevels, userID, neededLevel)
+	}
+
+	eventsToMake := []fledglingEvent{
+		{gomatrixserverlib.MRoomCreate, "", createContent},
+		{gomatrixserverlib.MRoomMember, userID, memberContent},
+		{gomatrixserverlib.MRoomPowerLevels, "", initialPowerLevels},
+	}
+	eventsToMake = append(eventsToMake, stateToCopy...)
+	if userLevel < neededLevel {
+		eventsToMake = append(eventsToMake, fledglingEvent{gomatrixserverlib.MRoomPowerLevels, "", powerLevels})
+	}
+	return eventsToMake, nil
+}
+
+// copyPowerLevelsWithUser returns a copy of the power levels content with the
+// power level of the given user replaced.
+func copyPowerLevelsWithUser(powerLevels map[string]interface{}, userID string, level int64) map[string]interface{} {
+	content := make(map[string]interface{}, len(powerLevels))
+	for k, v := range powerLevels {
+		content[k] = v
+	}
+	users := map[string]interface{}{}
+	if oldUsers, ok := powerLevels["users"].(map[string]interface{}); ok {
+		for k, v := range oldUsers {
+			users[k] = v
+		}
+	}
+	users[userID] = level
+	content["users"] = users
+	return content
+}
+
+// restrictedPowerLevelsContent returns the power levels content used to stop
+// users who aren't moderators from sending events or inviting users to a
+// room which has been upgraded.
+func restrictedPowerLevelsContent(powerLevels *gomatrixserverlib.Event) (map[string]interface{}, error) {
+	var content map[string]interface{}
+	if err := json.Unmarshal(powerLevels.Content(), &content); err != nil {
+		return nil, err
+	}
+	levels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(*powerLevels)
+	if err != nil {
+		return nil, err
+	}
+	restricted := levels.UsersDefault + 1
+	if restricted < 50 {
+		restricted = 50
+	}
+	if levels.EventsDefault < restricted {
+		content["events_default"] = restricted
+	}
+	if levels.Invite < restricted {
+		content["invite"] = restricted
+	}
+	return content, nil
+}
+
+// memberEventMembership returns the membership in a member event, or an empty
+// string if there isn't one.
+func memberEventMembership(ev *gomatrixserverlib.Event) (string, error) {
+	if ev == nil {
+		return "", nil
+	}
+	return ev.Membership()
+}
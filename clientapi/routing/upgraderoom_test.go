@@ -0,0 +1,244 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testRoomID = "!old:localhost"
+
+// testRoom answers roomserver queries about a room from the events
+// sent into it, and records the events sent into any room.
+type testRoom struct {
+	api.RoomserverQueryAPI
+	t      *testing.T
+	cfg    *config.Dendrite
+	events []gomatrixserverlib.Event
+	sent   []gomatrixserverlib.HeaderedEvent
+	// Set once the room has been shut down.
+	blocked bool
+}
+
+func newTestRoom(t *testing.T) *testRoom {
+	return newTestRoomOfVersion(t, gomatrixserverlib.RoomVersionV3)
+}
+
+// newTestRoomOfVersion returns a test room whose create event has the given
+// room version. Its events are those of version 3 whatever the version is.
+func newTestRoomOfVersion(t *testing.T, roomVersion gomatrixserverlib.RoomVersion) *testRoom {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = privateKey
+
+	room := &testRoom{t: t, cfg: cfg}
+	events, err := buildRoomEvents("@alice:localhost", testRoomID, []fledglingEvent{
+		{"m.room.create", "", map[string]interface{}{"creator": "@alice:localhost", "room_version": roomVersion}},
+		{"m.room.member", "@alice:localhost", gomatrixserverlib.MemberContent{Membership: "join", DisplayName: "Alice"}},
+		{"m.room.power_levels", "", common.InitialPowerLevelsContent("@alice:localhost")},
+		{"m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: "public"}},
+		{"m.room.history_visibility", "", common.HistoryVisibilityContent{HistoryVisibility: "shared"}},
+		{"m.room.name", "", common.NameContent{Name: "Old room"}},
+		{"m.room.topic", "", common.TopicContent{Topic: "Old topic"}},
+	}, cfg, time.Now(), gomatrixserverlib.RoomVersionV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range events {
+		room.events = append(room.events, ev.Unwrap())
+	}
+	return room
+}
+
+// join adds a user to the room.
+func (r *testRoom) join(userID string) {
+	r.addState(userID, gomatrixserverlib.MRoomMember, userID, gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join})
+}
+
+// addState adds a state event to the room.
+func (r *testRoom) addState(sender, eventType, stateKey string, content interface{}) {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		RoomID:   testRoomID,
+		Type:     eventType,
+		StateKey: &stateKey,
+	}
+	if err := builder.SetContent(content); err != nil {
+		r.t.Fatal(err)
+	}
+	var res api.QueryLatestEventsAndStateResponse
+	ev, err := common.BuildEvent(context.Background(), &builder, r.cfg, time.Now(), r, &res)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.events = append(r.events, *ev)
+}
+
+func (r *testRoom) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	last := r.events[len(r.events)-1]
+	response.RoomExists = true
+	response.RoomVersion = gomatrixserverlib.RoomVersionV3
+	response.LatestEvents = []gomatrixserverlib.EventReference{last.EventReference()}
+	response.Depth = last.Depth() + 1
+	response.StateEvents = nil
+	state := make(map[gomatrixserverlib.StateKeyTuple]gomatrixserverlib.Event)
+	for _, ev := range r.events {
+		if ev.StateKey() != nil {
+			state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+		}
+	}
+	for tuple, ev := range state {
+		wanted := len(request.StateToFetch) == 0
+		for _, t := range request.StateToFetch {
+			wanted = wanted || t == tuple
+		}
+		if wanted {
+			response.StateEvents = append(response.StateEvents, ev.Headered(response.RoomVersion))
+		}
+	}
+	return nil
+}
+
+func (r *testRoom) InputRoomEvents(
+	ctx context.Context,
+	request *api.InputRoomEventsRequest,
+	response *api.InputRoomEventsResponse,
+) error {
+	for _, ire := range request.InputRoomEvents {
+		r.sent = append(r.sent, ire.Event)
+	}
+	return nil
+}
+
+// sentEvent returns the content of the last event of the given type sent into
+// the given room.
+func (r *testRoom) sentEvent(roomID, eventType string) map[string]interface{} {
+	var content map[string]interface{}
+	for _, ev := range r.sent {
+		if ev.RoomID() == roomID && ev.Type() == eventType {
+			content = nil
+			if err := json.Unmarshal(ev.Content(), &content); err != nil {
+				r.t.Fatal(err)
+			}
+		}
+	}
+	return content
+}
+
+func (r *testRoom) upgrade(userID string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(
+		http.MethodPost, "/_matrix/client/r0/rooms/"+testRoomID+"/upgrade",
+		bytes.NewBufferString(`{"new_version":"4"}`),
+	)
+	producer := producers.NewRoomserverProducer(r, r)
+	res := UpgradeRoom(req, &authtypes.Device{UserID: userID}, testRoomID, r.cfg, producer, r)
+	var body map[string]interface{}
+	resJSON, err := json.Marshal(res.JSON)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if err = json.Unmarshal(resJSON, &body); err != nil {
+		r.t.Fatal(err)
+	}
+	return res.Code, body
+}
+
+func TestUpgradeRoomCopiesStateAndSendsTombstone(t *testing.T) {
+	room := newTestRoom(t)
+	code, body := room.upgrade("@alice:localhost")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, body)
+	}
+	newRoomID, _ := body["replacement_room"].(string)
+	if newRoomID == "" || newRoomID == testRoomID {
+		t.Fatalf("expected a new room, got %v", body)
+	}
+
+	tombstone := room.sentEvent(testRoomID, "m.room.tombstone")
+	if tombstone["replacement_room"] != newRoomID {
+		t.Errorf("expected the tombstone to reference %s, got %v", newRoomID, tombstone)
+	}
+	create := room.sentEvent(newRoomID, "m.room.create")
+	predecessor, _ := create["predecessor"].(map[string]interface{})
+	if create["room_version"] != "4" || predecessor["room_id"] != testRoomID {
+		t.Errorf("expected the new room to be version 4 and replace the old room, got %v", create)
+	}
+	if name := room.sentEvent(newRoomID, "m.room.name"); name["name"] != "Old room" {
+		t.Errorf("expected the name to be copied, got %v", name)
+	}
+	if topic := room.sentEvent(newRoomID, "m.room.topic"); topic["topic"] != "Old topic" {
+		t.Errorf("expected the topic to be copied, got %v", topic)
+	}
+	if joinRules := room.sentEvent(newRoomID, "m.room.join_rules"); joinRules["join_rule"] != "public" {
+		t.Errorf("expected the join rules to be copied, got %v", joinRules)
+	}
+	if member := room.sentEvent(newRoomID, "m.room.member"); member["displayname"] != "Alice" {
+		t.Errorf("expected alice to join the new room with the same profile, got %v", member)
+	}
+	frozen := room.sentEvent(testRoomID, "m.room.power_levels")
+	if frozen["events_default"] != float64(50) || frozen["invite"] != float64(50) {
+		t.Errorf("expected the old room to be restricted, got %v", frozen)
+	}
+
+	// The power levels follow on from the tombstone, rather than forking the
+	// room from the same prev events.
+	var tombstoneEv, frozenEv gomatrixserverlib.HeaderedEvent
+	for _, ev := range room.sent {
+		if ev.RoomID() == testRoomID && ev.Type() == "m.room.tombstone" {
+			tombstoneEv = ev
+		} else if ev.RoomID() == testRoomID && ev.Type() == gomatrixserverlib.MRoomPowerLevels {
+			frozenEv = ev
+		}
+	}
+	if prev := frozenEv.PrevEventIDs(); len(prev) != 1 || prev[0] != tombstoneEv.EventID() || frozenEv.Depth() != tombstoneEv.Depth()+1 {
+		t.Errorf("expected the power levels to follow the tombstone %s at depth %d, got %v at depth %d",
+			tombstoneEv.EventID(), tombstoneEv.Depth()+1, prev, frozenEv.Depth())
+	}
+}
+
+func TestUpgradeRoomWithoutPowerIsForbidden(t *testing.T) {
+	room := newTestRoom(t)
+	room.join("@bob:localhost")
+	code, body := room.upgrade("@bob:localhost")
+	if code != http.StatusForbidden || body["errcode"] != "M_FORBIDDEN" {
+		t.Errorf("expected 403 M_FORBIDDEN, got %d: %v", code, body)
+	}
+	if len(room.sent) != 0 {
+		t.Errorf("expected no events to be sent, got %d", len(room.sent))
+	}
+}
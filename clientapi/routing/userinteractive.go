@@ -0,0 +1,357 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	sessionIDLength = 24
+	// sessionLifetime is how long a session of user-interactive auth is kept
+	// for after a stage was last completed in it.
+	sessionLifetime = 30 * time.Minute
+)
+
+// sessions stores the completed flow stages for all sessions. Referenced using their sessionID.
+var sessions = newSessionsDict()
+
+// sessionsDict keeps track of completed auth stages for each session.
+// It shouldn't be passed by value because it contains a mutex.
+type sessionsDict struct {
+	sync.Mutex
+	sessions map[string]*authSession
+	lifetime time.Duration
+}
+
+type authSession struct {
+	completed []authtypes.LoginType
+	expires   time.Time
+	// The registration token which the session completed the
+	// m.login.registration_token stage with, if any.
+	registrationToken string
+}
+
+func newSessionsDict() *sessionsDict {
+	return &sessionsDict{
+		sessions: make(map[string]*authSession),
+		lifetime: sessionLifetime,
+	}
+}
+
+// startSession starts a new session and returns its ID. Sessions which have
+// expired are forgotten at the same time.
+func (d *sessionsDict) startSession() string {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	for sessionID, session := range d.sessions {
+		if now.After(session.expires) {
+			delete(d.sessions, sessionID)
+		}
+	}
+	sessionID := util.RandomString(sessionIDLength)
+	d.sessions[sessionID] = &authSession{
+		completed: []authtypes.LoginType{},
+		expires:   now.Add(d.lifetime),
+	}
+	return sessionID
+}
+
+// session returns the session with the given ID, or nil if there is no such
+// session or it has expired. The mutex must be held.
+func (d *sessionsDict) session(sessionID string) *authSession {
+	session, ok := d.sessions[sessionID]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(session.expires) {
+		delete(d.sessions, sessionID)
+		return nil
+	}
+	return session
+}
+
+// hasSession returns whether a session exists and hasn't expired.
+func (d *sessionsDict) hasSession(sessionID string) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.session(sessionID) != nil
+}
+
+// GetCompletedStages returns the completed stages for a session.
+func (d *sessionsDict) GetCompletedStages(sessionID string) []authtypes.LoginType {
+	d.Lock()
+	defer d.Unlock()
+
+	if session := d.session(sessionID); session != nil {
+		return session.completed
+	}
+	// Ensure that a empty slice is returned and not nil. See #399.
+	return make([]authtypes.LoginType, 0)
+}
+
+// addCompletedStage records that a session has completed an auth stage, which
+// keeps the session alive for another lifetime. It does nothing if there is
+// no such session.
+func (d *sessionsDict) addCompletedStage(sessionID string, stage authtypes.LoginType) {
+	d.Lock()
+	defer d.Unlock()
+
+	session := d.session(sessionID)
+	if session == nil {
+		return
+	}
+	session.expires = time.Now().Add(d.lifetime)
+	for _, completedStage := range session.completed {
+		if completedStage == stage {
+			return
+		}
+	}
+	session.completed = append(session.completed, stage)
+}
+
+// setRegistrationToken records the registration token which a session
+// completed the m.login.registration_token stage with.
+func (d *sessionsDict) setRegistrationToken(sessionID, token string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if session := d.session(sessionID); session != nil {
+		session.registrationToken = token
+	}
+}
+
+// getRegistrationToken returns the registration token which a session
+// completed the m.login.registration_token stage with, if any.
+func (d *sessionsDict) getRegistrationToken(sessionID string) string {
+	d.Lock()
+	defer d.Unlock()
+
+	if session := d.session(sessionID); session != nil {
+		return session.registrationToken
+	}
+	return ""
+}
+
+// removeSession forgets a session, so that it can't be used again.
+func (d *sessionsDict) removeSession(sessionID string) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.sessions, sessionID)
+}
+
+// authDict is the auth dict of a request which uses user-interactive auth.
+// Its keys depend on the type of the stage being completed.
+type authDict struct {
+	Type    authtypes.LoginType `json:"type"`
+	Session string              `json:"session"`
+
+	// Password
+	Identifier loginIdentifier `json:"identifier"`
+	// The user ID was in the root of the auth dict before identifiers.
+	User     string `json:"user"`
+	Password string `json:"password"`
+
+	// Recaptcha
+	Response string `json:"response"`
+
+	// SharedSecret
+	Mac gomatrixserverlib.HexString `json:"mac"`
+
+	// RegistrationToken
+	Token string `json:"token"`
+}
+
+// http://matrix.org/speculator/spec/HEAD/client_server/unstable.html#user-interactive-authentication-api
+type userInteractiveResponse struct {
+	Flows     []authtypes.Flow       `json:"flows"`
+	Completed []authtypes.LoginType  `json:"completed"`
+	Params    map[string]interface{} `json:"params"`
+	Session   string                 `json:"session"`
+	// The error of the last stage that the client failed, if any.
+	*jsonerror.MatrixError
+}
+
+// authStage checks whether an auth dict completes one stage of
+// user-interactive auth, returning nil if it does. A 401 response with a
+// MatrixError means that the client failed the stage and can try it again,
+// and any other response is returned to the client as it is.
+type authStage func(req *http.Request, auth *authDict) *util.JSONResponse
+
+// userInteractiveAuth is the user-interactive auth which a client has to
+// complete before one kind of request is carried out.
+// https://matrix.org/docs/spec/client_server/r0.6.0#user-interactive-authentication-api
+type userInteractiveAuth struct {
+	flows  []authtypes.Flow
+	params map[string]interface{}
+	// The stages which clients can complete, by type.
+	stages map[authtypes.LoginType]authStage
+}
+
+// verify completes the stage of the auth dict in its session, and returns
+// nil once the session has completed one of the flows. The session is then
+// removed so that it can't be used for another request. Otherwise the
+// response tells the client which flows and stages they can complete.
+func (u *userInteractiveAuth) verify(req *http.Request, auth *authDict) *util.JSONResponse {
+	if auth == nil {
+		auth = &authDict{}
+	}
+	sessionID := auth.Session
+	if sessionID == "" {
+		sessionID = sessions.startSession()
+		// Stages may need to store things in the session.
+		auth.Session = sessionID
+	} else if !sessions.hasSession(sessionID) {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Unknown or expired session"),
+		}
+	}
+	if auth.Type == "" {
+		return u.challenge(sessionID, nil)
+	}
+
+	stage, ok := u.stages[auth.Type]
+	if !ok {
+		return &util.JSONResponse{
+			Code: http.StatusNotImplemented,
+			JSON: jsonerror.Unknown("unknown/unimplemented auth type"),
+		}
+	}
+	if resErr := stage(req, auth); resErr != nil {
+		if matrixErr, ok := resErr.JSON.(*jsonerror.MatrixError); ok && resErr.Code == http.StatusUnauthorized {
+			return u.challenge(sessionID, matrixErr)
+		}
+		return resErr
+	}
+	sessions.addCompletedStage(sessionID, auth.Type)
+
+	if !checkFlowCompleted(sessions.GetCompletedStages(sessionID), u.flows) {
+		return u.challenge(sessionID, nil)
+	}
+	sessions.removeSession(sessionID)
+	return nil
+}
+
+// challenge returns the response which tells the client which stages they
+// have completed in the session and which flows they can complete.
+func (u *userInteractiveAuth) challenge(sessionID string, matrixErr *jsonerror.MatrixError) *util.JSONResponse {
+	params := u.params
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	return &util.JSONResponse{
+		Code: http.StatusUnauthorized,
+		JSON: userInteractiveResponse{
+			Flows:       u.flows,
+			Completed:   sessions.GetCompletedStages(sessionID),
+			Params:      params,
+			Session:     sessionID,
+			MatrixError: matrixErr,
+		},
+	}
+}
+
+// dummyStage completes the m.login.dummy stage, which has nothing to check.
+func dummyStage(req *http.Request, auth *authDict) *util.JSONResponse {
+	return nil
+}
+
+// recaptchaStage returns the m.login.recaptcha stage, which checks the
+// captcha response of the client with the captcha server.
+func recaptchaStage(cfg *config.Dendrite) authStage {
+	return func(req *http.Request, auth *authDict) *util.JSONResponse {
+		return validateRecaptcha(cfg, auth.Response, req.RemoteAddr)
+	}
+}
+
+// registrationTokenStage returns the m.login.registration_token stage, which
+// checks that the token was created by an admin and can still be used. The
+// token is used up once the registration has been completed.
+func registrationTokenStage(accountDB accounts.Database) authStage {
+	return func(req *http.Request, auth *authDict) *util.JSONResponse {
+		usable, err := registrationTokenUsable(req.Context(), accountDB, auth.Token)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("registrationTokenUsable failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+		if !usable {
+			return &util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.Forbidden("The registration token is invalid"),
+			}
+		}
+		sessions.setRegistrationToken(auth.Session, auth.Token)
+		return nil
+	}
+}
+
+// passwordStage returns the m.login.password stage, which checks the password
+// of the account with the given localpart. The client can only authenticate
+// as the user who is making the request.
+func passwordStage(
+	cfg *config.Dendrite, accountDB accounts.Database, localpart string,
+) authStage {
+	return func(req *http.Request, auth *authDict) *util.JSONResponse {
+		user := auth.Identifier.User
+		if user == "" {
+			user = auth.User
+		}
+		if user != "" {
+			authLocalpart, err := userutil.ParseUsernameParam(user, &cfg.Matrix.ServerName)
+			if err != nil || authLocalpart != localpart {
+				return &util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.Forbidden("You can only authenticate as yourself"),
+				}
+			}
+		}
+		if _, err := accountDB.GetAccountByPassword(req.Context(), localpart, auth.Password); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.Forbidden("The password is incorrect"),
+			}
+		}
+		return nil
+	}
+}
+
+// passwordAuth returns the user-interactive auth of requests which need the
+// user to confirm their password.
+func passwordAuth(
+	cfg *config.Dendrite, accountDB accounts.Database, localpart string,
+) *userInteractiveAuth {
+	return &userInteractiveAuth{
+		flows: []authtypes.Flow{{Stages: []authtypes.LoginType{authtypes.LoginTypePassword}}},
+		stages: map[authtypes.LoginType]authStage{
+			authtypes.LoginTypePassword: passwordStage(cfg, accountDB, localpart),
+		},
+	}
+}
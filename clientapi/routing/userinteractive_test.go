@@ -0,0 +1,130 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+// testAuth needs a dummy stage and a stage which only accepts the right
+// response to be completed.
+var testAuth = &userInteractiveAuth{
+	flows: []authtypes.Flow{{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy, "org.example.test"}}},
+	stages: map[authtypes.LoginType]authStage{
+		authtypes.LoginTypeDummy: dummyStage,
+		"org.example.test": func(req *http.Request, auth *authDict) *util.JSONResponse {
+			if auth.Response != "right" {
+				return &util.JSONResponse{Code: http.StatusUnauthorized, JSON: jsonerror.Forbidden("wrong response")}
+			}
+			return nil
+		},
+	},
+}
+
+func verifyTestAuth(t *testing.T, auth *authDict) *userInteractiveResponse {
+	resErr := testAuth.verify(httptest.NewRequest(http.MethodPost, "/", nil), auth)
+	if resErr == nil {
+		return nil
+	}
+	res, ok := resErr.JSON.(userInteractiveResponse)
+	if resErr.Code != http.StatusUnauthorized || !ok {
+		t.Fatalf("expected 401 with the flows, got %d: %v", resErr.Code, resErr.JSON)
+	}
+	return &res
+}
+
+func TestUserInteractiveAuthReturnsFlows(t *testing.T) {
+	res := verifyTestAuth(t, nil)
+	if res == nil || res.Session == "" || !reflect.DeepEqual(res.Flows, testAuth.flows) || len(res.Completed) != 0 {
+		t.Fatalf("expected the flows and a new session, got %+v", res)
+	}
+
+	res = verifyTestAuth(t, &authDict{Type: authtypes.LoginTypeDummy, Session: res.Session})
+	if res == nil || !reflect.DeepEqual(res.Completed, []authtypes.LoginType{authtypes.LoginTypeDummy}) {
+		t.Fatalf("expected the dummy stage to be completed, got %+v", res)
+	}
+	res = verifyTestAuth(t, &authDict{Type: "org.example.test", Session: res.Session, Response: "wrong"})
+	if res == nil || res.MatrixError == nil || len(res.Completed) != 1 {
+		t.Fatalf("expected the failed stage to be returned with an error, got %+v", res)
+	}
+}
+
+func TestUserInteractiveAuthCompletesFlow(t *testing.T) {
+	res := verifyTestAuth(t, &authDict{Type: authtypes.LoginTypeDummy})
+	if res == nil {
+		t.Fatal("expected the flow not to be completed by the dummy stage alone")
+	}
+	sessionID := res.Session
+	if res = verifyTestAuth(t, &authDict{Type: "org.example.test", Session: sessionID, Response: "right"}); res != nil {
+		t.Fatalf("expected the flow to be completed, got %+v", res)
+	}
+
+	// The session can't be used again once the flow is completed.
+	resErr := testAuth.verify(httptest.NewRequest(http.MethodPost, "/", nil), &authDict{Type: authtypes.LoginTypeDummy, Session: sessionID})
+	if resErr == nil || resErr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a completed session, got %v", resErr)
+	}
+}
+
+func TestSessionsExpire(t *testing.T) {
+	d := newSessionsDict()
+	d.lifetime = -time.Minute
+	sessionID := d.startSession()
+	if d.hasSession(sessionID) {
+		t.Error("expected the session to have expired")
+	}
+	d.addCompletedStage(sessionID, authtypes.LoginTypeDummy)
+	if len(d.GetCompletedStages(sessionID)) != 0 {
+		t.Error("expected no stages to be completed in an expired session")
+	}
+
+	d.lifetime = sessionLifetime
+	d.sessions[sessionID] = &authSession{}
+	d.startSession()
+	if _, ok := d.sessions[sessionID]; ok {
+		t.Error("expected expired sessions to be removed when a session is started")
+	}
+}
+
+func TestRegisterWithUserInteractiveAuth(t *testing.T) {
+	d, cleanup := newDeactivateTest(t)
+	defer cleanup()
+	if err := d.room.cfg.Derive(); err != nil {
+		t.Fatal(err)
+	}
+	register := func(body string) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/register", strings.NewReader(body))
+		return Register(req, d.accountDB, d.deviceDB, d.room.cfg, nil)
+	}
+
+	res := register(`{"username": "bob", "password": "battery staple"}`)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with the flows, got %d: %v", res.Code, res.JSON)
+	}
+	sessionID := res.JSON.(userInteractiveResponse).Session
+	res = register(`{"username": "bob", "password": "battery staple", "auth": {"type": "m.login.dummy", "session": "` + sessionID + `"}}`)
+	if res.Code != http.StatusOK || res.JSON.(registerResponse).UserID != "@bob:localhost" {
+		t.Fatalf("expected bob to be registered, got %d: %v", res.Code, res.JSON)
+	}
+}
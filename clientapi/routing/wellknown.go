@@ -0,0 +1,76 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/i2p"
+	"github.com/matrix-org/util"
+)
+
+type wellKnownBaseURL struct {
+	BaseURL string `json:"base_url"`
+}
+
+type wellKnownClientResponse struct {
+	Homeserver     wellKnownBaseURL  `json:"m.homeserver"`
+	IdentityServer *wellKnownBaseURL `json:"m.identity_server,omitempty"`
+}
+
+// wellKnownClientHandler serves /.well-known/matrix/client. It is wrapped in
+// CORS itself, as web clients fetch it from servers which they don't know are
+// matrix servers yet.
+func wellKnownClientHandler(cfg *config.Dendrite) http.Handler {
+	return common.WrapHandlerInCORS(common.MakeExternalAPI("well_known_client", func(req *http.Request) util.JSONResponse {
+		return WellKnownClient(req, cfg)
+	}), &cfg.CORS)
+}
+
+// WellKnownClient implements GET /.well-known/matrix/client
+// https://matrix.org/docs/spec/client_server/r0.6.0#get-well-known-matrix-client
+// Clients which reach this server over I2P are given its I2P address, as the
+// configured base URL is usually only reachable from the clearnet.
+func WellKnownClient(req *http.Request, cfg *config.Dendrite) util.JSONResponse {
+	wellKnown := &cfg.Matrix.WellKnownClient
+	baseURL := wellKnown.BaseURL
+	if i2p.IsB32Host(req.Host) {
+		baseURL = wellKnown.I2PBaseURL
+		if baseURL == "" {
+			scheme := "http"
+			if req.TLS != nil {
+				scheme = "https"
+			}
+			baseURL = scheme + "://" + req.Host
+		}
+	}
+	if baseURL == "" {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("No client well-known is configured on this server"),
+		}
+	}
+	res := wellKnownClientResponse{Homeserver: wellKnownBaseURL{BaseURL: baseURL}}
+	if wellKnown.IdentityServer != "" {
+		res.IdentityServer = &wellKnownBaseURL{BaseURL: wellKnown.IdentityServer}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testB32Host = "ukeu3k5oycgaauneqgtnvselmt4yemvoilkln7jpvamvfx7dnkdq.b32.i2p"
+
+// getWellKnownClient requests the client well-known through its handler from
+// the given host.
+func getWellKnownClient(t *testing.T, r *testRoom, host string) (*httptest.ResponseRecorder, wellKnownClientResponse) {
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/.well-known/matrix/client", nil)
+	req.Header.Set("Origin", "https://client.example")
+	rec := httptest.NewRecorder()
+	wellKnownClientHandler(r.cfg).ServeHTTP(rec, req)
+	var res wellKnownClientResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec, res
+}
+
+func TestWellKnownClientReturnsBaseURL(t *testing.T) {
+	r := newTestRoom(t)
+	if rec, _ := getWellKnownClient(t, r, "localhost"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a base URL, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	r.cfg.Matrix.WellKnownClient.BaseURL = "https://matrix.example.com"
+	rec, res := getWellKnownClient(t, r, "localhost")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if res.Homeserver.BaseURL != "https://matrix.example.com" || res.IdentityServer != nil {
+		t.Errorf("expected only the configured base URL, got %s", rec.Body.String())
+	}
+	if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("expected CORS to allow any origin, got %q", origin)
+	}
+
+	r.cfg.Matrix.WellKnownClient.IdentityServer = "https://id.example.com"
+	if _, res = getWellKnownClient(t, r, "localhost"); res.IdentityServer == nil || res.IdentityServer.BaseURL != "https://id.example.com" {
+		t.Errorf("expected the configured identity server, got %+v", res.IdentityServer)
+	}
+}
+
+func TestWellKnownClientOverI2P(t *testing.T) {
+	r := newTestRoom(t)
+	r.cfg.Matrix.WellKnownClient.BaseURL = "https://matrix.example.com"
+	rec, res := getWellKnownClient(t, r, testB32Host)
+	if rec.Code != http.StatusOK || res.Homeserver.BaseURL != "http://"+testB32Host {
+		t.Errorf("expected the .b32.i2p address, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	r.cfg.Matrix.WellKnownClient.I2PBaseURL = "http://matrix.i2p"
+	if _, res = getWellKnownClient(t, r, testB32Host); res.Homeserver.BaseURL != "http://matrix.i2p" {
+		t.Errorf("expected the configured I2P base URL, got %s", res.Homeserver.BaseURL)
+	}
+}
+
+func TestWellKnownClientPreflight(t *testing.T) {
+	req := httptest.NewRequest(http.MethodOptions, "/.well-known/matrix/client", nil)
+	req.Header.Set("Origin", "https://client.example")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rec := httptest.NewRecorder()
+	wellKnownClientHandler(newTestRoom(t).cfg).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 OK for a preflight request, got %d", rec.Code)
+	}
+	if methods := rec.Header().Get("Access-Control-Allow-Methods"); methods == "" {
+		t.Error("expected the allowed methods to be set")
+	}
+}
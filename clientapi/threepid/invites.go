@@ -348,6 +348,18 @@ func emit3PIDInviteEvent(
 		PublicKey:      res.PublicKey,
 		PublicKeys:     res.PublicKeys,
 	}
+	if len(content.PublicKeys) == 0 {
+		// Older identity servers only return a single key, but servers may
+		// only look for keys in "public_keys".
+		var publicKey gomatrixserverlib.Base64String
+		if err := publicKey.Decode(res.PublicKey); err != nil {
+			return err
+		}
+		content.PublicKeys = []gomatrixserverlib.PublicKey{{
+			PublicKey:      publicKey,
+			KeyValidityURL: validityURL,
+		}}
+	}
 
 	if err := builder.SetContent(content); err != nil {
 		return err
@@ -56,9 +56,8 @@ func createKeyDB(
 ) keydb.Database {
 	db, err := keydb.NewDatabase(
 		string(base.Base.Cfg.Database.ServerKey),
-		base.Base.Cfg.Matrix.ServerName,
-		base.Base.Cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey),
-		base.Base.Cfg.Matrix.KeyID,
+		base.Base.Cfg.DbProperties(config.DatabaseServerKey),
+		keydb.ServerKeys(base.Base.Cfg),
 	)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to keys db")
@@ -124,6 +123,10 @@ func main() {
 	cfg.Kafka.Topics.OutputRoomEvent = "roomserverOutput"
 	cfg.Kafka.Topics.OutputClientData = "clientapiOutput"
 	cfg.Kafka.Topics.OutputTypingEvent = "typingServerOutput"
+	cfg.Kafka.Topics.OutputReceiptEvent = "receiptServerOutput"
+	cfg.Kafka.Topics.OutputPresenceEvent = "presenceServerOutput"
+	cfg.Kafka.Topics.OutputSendToDeviceEvent = "sendToDeviceServerOutput"
+	cfg.Kafka.Topics.OutputDeviceListUpdate = "deviceListOutput"
 	cfg.Kafka.Topics.UserUpdates = "userUpdates"
 	cfg.Database.Account = config.DataSource(fmt.Sprintf("file:%s-account.db", *instanceName))
 	cfg.Database.Device = config.DataSource(fmt.Sprintf("file:%s-device.db", *instanceName))
@@ -132,6 +135,7 @@ func main() {
 	cfg.Database.RoomServer = config.DataSource(fmt.Sprintf("file:%s-roomserver.db", *instanceName))
 	cfg.Database.ServerKey = config.DataSource(fmt.Sprintf("file:%s-serverkey.db", *instanceName))
 	cfg.Database.FederationSender = config.DataSource(fmt.Sprintf("file:%s-federationsender.db", *instanceName))
+	cfg.Database.FederationAPI = config.DataSource(fmt.Sprintf("file:%s-federationapi.db", *instanceName))
 	cfg.Database.AppService = config.DataSource(fmt.Sprintf("file:%s-appservice.db", *instanceName))
 	cfg.Database.PublicRoomsAPI = config.DataSource(fmt.Sprintf("file:%s-publicroomsa.db", *instanceName))
 	cfg.Database.Naffka = config.DataSource(fmt.Sprintf("file:%s-naffka.db", *instanceName))
@@ -146,35 +150,36 @@ func main() {
 	deviceDB := base.Base.CreateDeviceDB()
 	keyDB := createKeyDB(base)
 	federation := createFederationClient(base)
-	keyRing := keydb.CreateKeyRing(federation.Client, keyDB, cfg.Matrix.KeyPerspectives)
+	keyRing := keydb.CreateKeyRing(federation.Client, keyDB, &cfg)
 
-	alias, input, query := roomserver.SetupRoomServerComponent(&base.Base)
-	eduInputAPI := eduserver.SetupEDUServerComponent(&base.Base, cache.New())
+	alias, input, query := roomserver.SetupRoomServerComponent(base.Base)
+	eduInputAPI := eduserver.SetupEDUServerComponent(base.Base, cache.New())
 	asQuery := appservice.SetupAppServiceAPIComponent(
-		&base.Base, accountDB, deviceDB, federation, alias, query, transactions.New(),
+		base.Base, accountDB, deviceDB, federation, alias, query, transactions.New(),
 	)
-	fedSenderAPI := federationsender.SetupFederationSenderComponent(&base.Base, federation, query)
+	fedSenderAPI := federationsender.SetupFederationSenderComponent(base.Base, federation, query)
 
 	clientapi.SetupClientAPIComponent(
-		&base.Base, deviceDB, accountDB,
-		federation, &keyRing, alias, input, query,
+		base.Base, deviceDB, accountDB,
+		federation, &keyRing, keyDB, alias, input, query,
 		eduInputAPI, asQuery, transactions.New(), fedSenderAPI,
 	)
 	eduProducer := producers.NewEDUServerProducer(eduInputAPI)
-	federationapi.SetupFederationAPIComponent(&base.Base, accountDB, deviceDB, federation, &keyRing, alias, input, query, asQuery, fedSenderAPI, eduProducer)
-	mediaapi.SetupMediaAPIComponent(&base.Base, deviceDB)
-	publicRoomsDB, err := storage.NewPublicRoomsServerDatabaseWithPubSub(string(base.Base.Cfg.Database.PublicRoomsAPI), base.LibP2PPubsub)
+	federationapi.SetupFederationAPIComponent(base.Base, accountDB, deviceDB, federation, &keyRing, keyDB, alias, input, query, asQuery, fedSenderAPI, eduProducer)
+	mediaapi.SetupMediaAPIComponent(base.Base, deviceDB)
+	publicRoomsDB, err := storage.NewPublicRoomsServerDatabaseWithPubSub(string(base.Base.Cfg.Database.PublicRoomsAPI), base.Base.Cfg.DbProperties(config.DatabasePublicRoomsAPI), base.LibP2PPubsub)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to public rooms db")
 	}
-	publicroomsapi.SetupPublicRoomsAPIComponent(&base.Base, deviceDB, publicRoomsDB, query, federation, nil) // Check this later
-	syncapi.SetupSyncAPIComponent(&base.Base, deviceDB, accountDB, query, federation, &cfg)
+	publicroomsapi.SetupPublicRoomsAPIComponent(base.Base, deviceDB, publicRoomsDB, query, federation, &keyRing, nil) // Check this later
+	syncapi.SetupSyncAPIComponent(base.Base, deviceDB, accountDB, query, eduInputAPI, federation, &keyRing, &cfg)
 
-	httpHandler := common.WrapHandlerInCORS(base.Base.APIMux)
+	httpHandler := common.WrapHandlerInCORS(base.Base.APIMux, &cfg.CORS)
 
 	// Set up the API endpoints we handle. /metrics is for prometheus, and is
 	// not wrapped by CORS, while everything else is
 	http.Handle("/metrics", promhttp.Handler())
+	base.Base.SetupHealthHTTP(http.DefaultServeMux)
 	http.Handle("/", httpHandler)
 
 	// Expose the matrix APIs directly rather than putting them under a /api path.
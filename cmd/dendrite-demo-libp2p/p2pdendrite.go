@@ -39,7 +39,7 @@ import (
 
 // P2PDendrite is a Peer-to-Peer variant of BaseDendrite.
 type P2PDendrite struct {
-	Base basecomponent.BaseDendrite
+	Base *basecomponent.BaseDendrite
 
 	// Store our libp2p object so that we can make outgoing connections from it
 	// later
@@ -100,7 +100,7 @@ func NewP2PDendrite(cfg *config.Dendrite, componentName string) *P2PDendrite {
 	cfg.Matrix.ServerName = gomatrixserverlib.ServerName(libp2p.ID().String())
 
 	return &P2PDendrite{
-		Base:          *baseDendrite,
+		Base:          baseDendrite,
 		LibP2P:        libp2p,
 		LibP2PContext: ctx,
 		LibP2PCancel:  cancel,
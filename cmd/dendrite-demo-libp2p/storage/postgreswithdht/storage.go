@@ -22,7 +22,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage/postgres"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
@@ -44,8 +46,8 @@ type PublicRoomsServerDatabase struct {
 }
 
 // NewPublicRoomsServerDatabase creates a new public rooms server database.
-func NewPublicRoomsServerDatabase(dataSourceName string, dht *dht.IpfsDHT) (*PublicRoomsServerDatabase, error) {
-	pg, err := postgres.NewPublicRoomsServerDatabase(dataSourceName)
+func NewPublicRoomsServerDatabase(dataSourceName string, dbProperties sqlutil.DbProperties, dht *dht.IpfsDHT) (*PublicRoomsServerDatabase, error) {
+	pg, err := postgres.NewPublicRoomsServerDatabase(dataSourceName, dbProperties)
 	if err != nil {
 		return nil, err
 	}
@@ -78,12 +80,12 @@ func (d *PublicRoomsServerDatabase) CountPublicRooms(ctx context.Context) (int64
 	return count + int64(len(d.foundRooms)), nil
 }
 
-func (d *PublicRoomsServerDatabase) GetPublicRooms(ctx context.Context, offset int64, limit int16, filter string) ([]gomatrixserverlib.PublicRoom, error) {
+func (d *PublicRoomsServerDatabase) GetPublicRooms(ctx context.Context, from *types.PublicRoomsPosition, backwards bool, limit int, filter string) ([]gomatrixserverlib.PublicRoom, error) {
 	realfilter := filter
 	if realfilter == "__local__" {
 		realfilter = ""
 	}
-	rooms, err := d.PublicRoomsServerDatabase.GetPublicRooms(ctx, offset, limit, realfilter)
+	rooms, err := d.PublicRoomsServerDatabase.GetPublicRooms(ctx, from, backwards, limit, realfilter)
 	if err != nil {
 		return []gomatrixserverlib.PublicRoom{}, err
 	}
@@ -126,7 +128,7 @@ func (d *PublicRoomsServerDatabase) Interval() {
 func (d *PublicRoomsServerDatabase) AdvertiseRoomsIntoDHT() error {
 	dbCtx, dbCancel := context.WithTimeout(context.Background(), 3*time.Second)
 	_ = dbCancel
-	ourRooms, err := d.GetPublicRooms(dbCtx, 0, 1024, "__local__")
+	ourRooms, err := d.GetPublicRooms(dbCtx, nil, false, 1024, "__local__")
 	if err != nil {
 		return err
 	}
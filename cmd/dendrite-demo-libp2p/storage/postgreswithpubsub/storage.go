@@ -22,7 +22,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage/postgres"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
@@ -47,8 +49,8 @@ type PublicRoomsServerDatabase struct {
 }
 
 // NewPublicRoomsServerDatabase creates a new public rooms server database.
-func NewPublicRoomsServerDatabase(dataSourceName string, pubsub *pubsub.PubSub) (*PublicRoomsServerDatabase, error) {
-	pg, err := postgres.NewPublicRoomsServerDatabase(dataSourceName)
+func NewPublicRoomsServerDatabase(dataSourceName string, dbProperties sqlutil.DbProperties, pubsub *pubsub.PubSub) (*PublicRoomsServerDatabase, error) {
+	pg, err := postgres.NewPublicRoomsServerDatabase(dataSourceName, dbProperties)
 	if err != nil {
 		return nil, err
 	}
@@ -85,10 +87,10 @@ func (d *PublicRoomsServerDatabase) CountPublicRooms(ctx context.Context) (int64
 	return int64(len(d.foundRooms)), nil
 }
 
-func (d *PublicRoomsServerDatabase) GetPublicRooms(ctx context.Context, offset int64, limit int16, filter string) ([]gomatrixserverlib.PublicRoom, error) {
+func (d *PublicRoomsServerDatabase) GetPublicRooms(ctx context.Context, from *types.PublicRoomsPosition, backwards bool, limit int, filter string) ([]gomatrixserverlib.PublicRoom, error) {
 	var rooms []gomatrixserverlib.PublicRoom
 	if filter == "__local__" {
-		if r, err := d.PublicRoomsServerDatabase.GetPublicRooms(ctx, offset, limit, ""); err == nil {
+		if r, err := d.PublicRoomsServerDatabase.GetPublicRooms(ctx, from, backwards, limit, ""); err == nil {
 			rooms = append(rooms, r...)
 		} else {
 			return []gomatrixserverlib.PublicRoom{}, err
@@ -138,7 +140,7 @@ func (d *PublicRoomsServerDatabase) Interval() {
 func (d *PublicRoomsServerDatabase) AdvertiseRooms() error {
 	dbCtx, dbCancel := context.WithTimeout(context.Background(), 3*time.Second)
 	_ = dbCancel
-	ourRooms, err := d.GetPublicRooms(dbCtx, 0, 1024, "__local__")
+	ourRooms, err := d.GetPublicRooms(dbCtx, nil, false, 1024, "__local__")
 	if err != nil {
 		return err
 	}
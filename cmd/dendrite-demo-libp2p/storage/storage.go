@@ -21,6 +21,7 @@ import (
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/matrix-org/dendrite/cmd/dendrite-demo-libp2p/storage/postgreswithdht"
 	"github.com/matrix-org/dendrite/cmd/dendrite-demo-libp2p/storage/postgreswithpubsub"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage/sqlite3"
 )
@@ -29,33 +30,33 @@ const schemePostgres = "postgres"
 const schemeFile = "file"
 
 // NewPublicRoomsServerDatabase opens a database connection.
-func NewPublicRoomsServerDatabaseWithDHT(dataSourceName string, dht *dht.IpfsDHT) (storage.Database, error) {
+func NewPublicRoomsServerDatabaseWithDHT(dataSourceName string, dbProperties sqlutil.DbProperties, dht *dht.IpfsDHT) (storage.Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
-		return postgreswithdht.NewPublicRoomsServerDatabase(dataSourceName, dht)
+		return postgreswithdht.NewPublicRoomsServerDatabase(dataSourceName, dbProperties, dht)
 	}
 	switch uri.Scheme {
 	case schemePostgres:
-		return postgreswithdht.NewPublicRoomsServerDatabase(dataSourceName, dht)
+		return postgreswithdht.NewPublicRoomsServerDatabase(dataSourceName, dbProperties, dht)
 	case schemeFile:
-		return sqlite3.NewPublicRoomsServerDatabase(dataSourceName)
+		return sqlite3.NewPublicRoomsServerDatabase(dataSourceName, dbProperties)
 	default:
-		return postgreswithdht.NewPublicRoomsServerDatabase(dataSourceName, dht)
+		return postgreswithdht.NewPublicRoomsServerDatabase(dataSourceName, dbProperties, dht)
 	}
 }
 
 // NewPublicRoomsServerDatabase opens a database connection.
-func NewPublicRoomsServerDatabaseWithPubSub(dataSourceName string, pubsub *pubsub.PubSub) (storage.Database, error) {
+func NewPublicRoomsServerDatabaseWithPubSub(dataSourceName string, dbProperties sqlutil.DbProperties, pubsub *pubsub.PubSub) (storage.Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
-		return postgreswithpubsub.NewPublicRoomsServerDatabase(dataSourceName, pubsub)
+		return postgreswithpubsub.NewPublicRoomsServerDatabase(dataSourceName, dbProperties, pubsub)
 	}
 	switch uri.Scheme {
 	case schemePostgres:
-		return postgreswithpubsub.NewPublicRoomsServerDatabase(dataSourceName, pubsub)
+		return postgreswithpubsub.NewPublicRoomsServerDatabase(dataSourceName, dbProperties, pubsub)
 	case schemeFile:
-		return sqlite3.NewPublicRoomsServerDatabase(dataSourceName)
+		return sqlite3.NewPublicRoomsServerDatabase(dataSourceName, dbProperties)
 	default:
-		return postgreswithpubsub.NewPublicRoomsServerDatabase(dataSourceName, pubsub)
+		return postgreswithpubsub.NewPublicRoomsServerDatabase(dataSourceName, dbProperties, pubsub)
 	}
 }
@@ -21,10 +21,16 @@ import (
 	"github.com/matrix-org/dendrite/eduserver"
 	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/dendrite/federationapi"
+	"github.com/sirupsen/logrus"
 )
 
 func main() {
 	cfg := basecomponent.ParseFlags()
+	// The federation API would answer other servers, which it mustn't when
+	// federation is disabled.
+	if cfg.Matrix.FederationDisabled {
+		logrus.Fatal("The federation API server can't run with matrix.federation_disabled set")
+	}
 	base := basecomponent.NewBaseDendrite(cfg, "FederationAPI")
 	defer base.Close() // nolint: errcheck
 
@@ -33,7 +39,7 @@ func main() {
 	keyDB := base.CreateKeyDB()
 	federation := base.CreateFederationClient()
 	federationSender := base.CreateHTTPFederationSenderAPIs()
-	keyRing := keydb.CreateKeyRing(federation.Client, keyDB, cfg.Matrix.KeyPerspectives)
+	keyRing := keydb.CreateKeyRing(federation.Client, keyDB, cfg)
 
 	alias, input, query := base.CreateHTTPRoomserverAPIs()
 	asQuery := base.CreateHTTPAppServiceAPIs()
@@ -41,7 +47,7 @@ func main() {
 	eduProducer := producers.NewEDUServerProducer(eduInputAPI)
 
 	federationapi.SetupFederationAPIComponent(
-		base, accountDB, deviceDB, federation, &keyRing,
+		base, accountDB, deviceDB, federation, &keyRing, keyDB,
 		alias, input, query, asQuery, federationSender, eduProducer,
 	)
 
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net/http"
 
@@ -23,6 +24,8 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/i2p"
 	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/dendrite/common/transactions"
 	"github.com/matrix-org/dendrite/eduserver"
@@ -34,6 +37,7 @@ import (
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/syncapi"
+	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/sirupsen/logrus"
@@ -44,6 +48,8 @@ var (
 	httpsBindAddr = flag.String("https-bind-address", ":8448", "The HTTPS listening port for the server")
 	certFile      = flag.String("tls-cert", "", "The PEM formatted X509 certificate to use for TLS")
 	keyFile       = flag.String("tls-key", "", "The PEM private key to use for TLS")
+	samAddr       = flag.String("sam-address", i2p.DefaultSAMAddress, "The address of the I2P SAM v3 bridge")
+	i2pKeysFile   = flag.String("i2p-keys", "", "The path to the I2P destination keys. If set, the server is also reachable over I2P")
 )
 
 func main() {
@@ -55,7 +61,7 @@ func main() {
 	deviceDB := base.CreateDeviceDB()
 	keyDB := base.CreateKeyDB()
 	federation := base.CreateFederationClient()
-	keyRing := keydb.CreateKeyRing(federation.Client, keyDB, cfg.Matrix.KeyPerspectives)
+	keyRing := keydb.CreateKeyRing(federation.Client, keyDB, cfg)
 
 	alias, input, query := roomserver.SetupRoomServerComponent(base)
 	eduInputAPI := eduserver.SetupEDUServerComponent(base, cache.New())
@@ -66,51 +72,109 @@ func main() {
 
 	clientapi.SetupClientAPIComponent(
 		base, deviceDB, accountDB,
-		federation, &keyRing, alias, input, query,
+		federation, &keyRing, keyDB, alias, input, query,
 		eduInputAPI, asQuery, transactions.New(), fedSenderAPI,
 	)
-	eduProducer := producers.NewEDUServerProducer(eduInputAPI)
-	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, alias, input, query, asQuery, fedSenderAPI, eduProducer)
+	// The federation sender still runs when federation is disabled, as the
+	// other components query it, but it doesn't send anything.
+	if !cfg.Matrix.FederationDisabled {
+		eduProducer := producers.NewEDUServerProducer(eduInputAPI)
+		federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, keyDB, alias, input, query, asQuery, fedSenderAPI, eduProducer)
+	}
 	mediaapi.SetupMediaAPIComponent(base, deviceDB)
-	publicRoomsDB, err := storage.NewPublicRoomsServerDatabase(string(base.Cfg.Database.PublicRoomsAPI))
+	publicRoomsDB, err := storage.NewPublicRoomsServerDatabase(string(base.Cfg.Database.PublicRoomsAPI), base.Cfg.DbProperties(config.DatabasePublicRoomsAPI))
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to public rooms db")
 	}
-	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, publicRoomsDB, query, federation, nil)
-	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, query, federation, cfg)
+	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, publicRoomsDB, query, federation, &keyRing, nil)
+	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, query, eduInputAPI, federation, &keyRing, cfg)
 
-	httpHandler := common.WrapHandlerInCORS(base.APIMux)
+	httpHandler := common.WrapHandlerInCORS(base.APIMux, &cfg.CORS)
 
 	// Set up the API endpoints we handle. /metrics is for prometheus, and is
 	// not wrapped by CORS, while everything else is
 	if cfg.Metrics.Enabled {
 		http.Handle("/metrics", common.WrapHandlerInBasicAuth(promhttp.Handler(), cfg.Metrics.BasicAuth))
 	}
+	base.SetupHealthHTTP(http.DefaultServeMux)
 	http.Handle("/", httpHandler)
 
 	// Expose the matrix APIs directly rather than putting them under a /api path.
 	go func() {
-		serv := http.Server{
+		serv := &http.Server{
 			Addr:         *httpBindAddr,
 			WriteTimeout: basecomponent.HTTPServerTimeout,
 		}
+		base.RegisterHTTPServer(serv)
 
 		logrus.Info("Listening on ", serv.Addr)
-		logrus.Fatal(serv.ListenAndServe())
+		if err := serv.ListenAndServe(); err != http.ErrServerClosed {
+			logrus.Fatal(err)
+		}
 	}()
 	// Handle HTTPS if certificate and key are provided
 	if *certFile != "" && *keyFile != "" {
 		go func() {
-			serv := http.Server{
+			serv := &http.Server{
 				Addr:         *httpsBindAddr,
 				WriteTimeout: basecomponent.HTTPServerTimeout,
 			}
+			base.RegisterHTTPServer(serv)
 
 			logrus.Info("Listening on ", serv.Addr)
-			logrus.Fatal(serv.ListenAndServeTLS(*certFile, *keyFile))
+			if err := serv.ListenAndServeTLS(*certFile, *keyFile); err != http.ErrServerClosed {
+				logrus.Fatal(err)
+			}
 		}()
 	}
+	// Handle I2P if a path to the destination keys is provided
+	if *i2pKeysFile != "" {
+		go serveI2P(base)
+	}
+
+	// Serve the APIs until we are told to stop, and then let the in-flight
+	// work finish before exiting.
+	base.WaitForShutdown()
+}
+
+// serveI2P serves the matrix APIs over a SAM v3 streaming session. The
+// destination keys are persisted at -i2p-keys so that the .b32.i2p address is
+// stable across restarts. TLS is only used if a certificate and key are given,
+// as the I2P transport is already end-to-end encrypted.
+func serveI2P(base *basecomponent.BaseDendrite) {
+	keys, err := i2p.LoadOrGenerateKeys(*samAddr, *i2pKeysFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to load I2P keys")
+	}
+	session, err := i2p.NewStreamSession(*samAddr, "dendrite-"+util.RandomString(8), keys)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create I2P session")
+	}
+	defer session.Close() // nolint: errcheck
+	listener, err := session.Listen()
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to listen on I2P session")
+	}
+	// The session only lasts as long as the bridge which it was created on.
+	base.RegisterHealthCheck("i2p session", func(ctx context.Context) error {
+		return i2p.CheckBridge(ctx, *samAddr)
+	})
 
-	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
-	select {}
+	serv := &http.Server{
+		WriteTimeout: basecomponent.HTTPServerTimeout,
+	}
+	base.RegisterHTTPServer(serv)
+
+	logrus.WithFields(logrus.Fields{
+		"sam_address": *samAddr,
+		"address":     session.Addr().String(),
+	}).Info("Listening on I2P")
+	if *certFile != "" && *keyFile != "" {
+		err = serv.ServeTLS(listener, *certFile, *keyFile)
+	} else {
+		err = serv.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		logrus.Fatal(err)
+	}
 }
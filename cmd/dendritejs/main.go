@@ -86,6 +86,7 @@ func main() {
 	cfg.Database.AppService = "file:dendritejs_appservice.db"
 	cfg.Database.Device = "file:dendritejs_device.db"
 	cfg.Database.FederationSender = "file:dendritejs_fedsender.db"
+	cfg.Database.FederationAPI = "file:dendritejs_fedapi.db"
 	cfg.Database.MediaAPI = "file:dendritejs_mediaapi.db"
 	cfg.Database.Naffka = "file:dendritejs_naffka.db"
 	cfg.Database.PublicRoomsAPI = "file:dendritejs_publicrooms.db"
@@ -94,6 +95,10 @@ func main() {
 	cfg.Database.SyncAPI = "file:dendritejs_syncapi.db"
 	cfg.Kafka.Topics.UserUpdates = "user_updates"
 	cfg.Kafka.Topics.OutputTypingEvent = "output_typing_event"
+	cfg.Kafka.Topics.OutputReceiptEvent = "output_receipt_event"
+	cfg.Kafka.Topics.OutputPresenceEvent = "output_presence_event"
+	cfg.Kafka.Topics.OutputSendToDeviceEvent = "output_send_to_device_event"
+	cfg.Kafka.Topics.OutputDeviceListUpdate = "output_device_list_update"
 	cfg.Kafka.Topics.OutputClientData = "output_client_data"
 	cfg.Kafka.Topics.OutputRoomEvent = "output_room_event"
 	cfg.Matrix.TrustedIDServers = []string{
@@ -132,20 +137,20 @@ func main() {
 
 	clientapi.SetupClientAPIComponent(
 		base, deviceDB, accountDB,
-		federation, &keyRing, alias, input, query,
+		federation, &keyRing, keyDB, alias, input, query,
 		eduInputAPI, asQuery, transactions.New(), fedSenderAPI,
 	)
 	eduProducer := producers.NewEDUServerProducer(eduInputAPI)
-	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, alias, input, query, asQuery, fedSenderAPI, eduProducer)
+	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, keyDB, alias, input, query, asQuery, fedSenderAPI, eduProducer)
 	mediaapi.SetupMediaAPIComponent(base, deviceDB)
-	publicRoomsDB, err := storage.NewPublicRoomsServerDatabase(string(base.Cfg.Database.PublicRoomsAPI))
+	publicRoomsDB, err := storage.NewPublicRoomsServerDatabase(string(base.Cfg.Database.PublicRoomsAPI), base.Cfg.DbProperties(config.DatabasePublicRoomsAPI))
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to public rooms db")
 	}
-	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, publicRoomsDB, query, federation, p2pPublicRoomProvider)
-	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, query, federation, cfg)
+	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, publicRoomsDB, query, federation, &keyRing, p2pPublicRoomProvider)
+	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, query, eduInputAPI, federation, &keyRing, cfg)
 
-	httpHandler := common.WrapHandlerInCORS(base.APIMux)
+	httpHandler := common.WrapHandlerInCORS(base.APIMux, &cfg.CORS)
 
 	http.Handle("/", httpHandler)
 
@@ -0,0 +1,39 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+// PathPrefixAdmin is the path prefix of the Dendrite admin endpoints.
+const PathPrefixAdmin = "/_dendrite/admin/v1"
+
+// CheckServerAdmin returns an error response unless the user of the device is
+// listed in the admin_users of the config.
+func CheckServerAdmin(device *authtypes.Device, cfg *config.Dendrite) *util.JSONResponse {
+	if cfg.IsServerAdmin(device.UserID) {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("You are not a server admin"),
+	}
+}
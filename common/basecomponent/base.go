@@ -15,14 +15,15 @@
 package basecomponent
 
 import (
+	"context"
 	"database/sql"
 	"io"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
-	"golang.org/x/crypto/ed25519"
-
+	"github.com/matrix-org/dendrite/common/i2p"
 	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -58,17 +59,34 @@ type BaseDendrite struct {
 	Cfg           *config.Dendrite
 	KafkaConsumer sarama.Consumer
 	KafkaProducer sarama.SyncProducer
+
+	// The shutdownMutex protects httpServers, shutdownHooks and closers.
+	shutdownMutex sync.Mutex
+	httpServers   []*http.Server
+	shutdownHooks []shutdownHook
+	closers       []namedCloser
+	shutdownOnce  sync.Once
+	shutdownErr   error
+
+	// The healthMutex protects healthChecks.
+	healthMutex  sync.Mutex
+	healthChecks []healthCheck
 }
 
 const HTTPServerTimeout = time.Minute * 5
 const HTTPClientTimeout = time.Second * 30
 
+// ShutdownTimeout is how long a shutdown may take before the remaining hooks
+// are cut short.
+const ShutdownTimeout = time.Second * 30
+
 // NewBaseDendrite creates a new instance to be used by a component.
 // The componentName is used for logging purposes, and should be a friendly name
 // of the compontent running, e.g. "SyncAPI"
 func NewBaseDendrite(cfg *config.Dendrite, componentName string) *BaseDendrite {
 	common.SetupStdLogging()
 	common.SetupHookLogging(cfg.Logging, componentName)
+	common.SetupRequestLogging(cfg)
 
 	closer, err := cfg.SetupTracing("Dendrite" + componentName)
 	if err != nil {
@@ -94,9 +112,12 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string) *BaseDendrite {
 	}
 }
 
-// Close implements io.Closer
+// Close implements io.Closer. It shuts the component down, if it hasn't been
+// already, allowing ShutdownTimeout for the shutdown hooks.
 func (b *BaseDendrite) Close() error {
-	return b.tracerCloser.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	return b.Shutdown(ctx)
 }
 
 // CreateHTTPAppServiceAPIs returns the QueryAPI for hitting the appservice
@@ -155,10 +176,14 @@ func (b *BaseDendrite) CreateHTTPFederationSenderAPIs() federationSenderAPI.Fede
 // CreateDeviceDB creates a new instance of the device database. Should only be
 // called once per component.
 func (b *BaseDendrite) CreateDeviceDB() devices.Database {
-	db, err := devices.NewDatabase(string(b.Cfg.Database.Device), b.Cfg.Matrix.ServerName)
+	db, err := devices.NewDatabase(string(b.Cfg.Database.Device), b.Cfg.DbProperties(config.DatabaseDevice), b.Cfg.Matrix.ServerName)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to devices db")
 	}
+	if c, ok := db.(io.Closer); ok {
+		b.CloseOnShutdown("devices db", c)
+	}
+	b.RegisterDatabaseHealthCheck("devices db", db)
 
 	return db
 }
@@ -166,10 +191,14 @@ func (b *BaseDendrite) CreateDeviceDB() devices.Database {
 // CreateAccountsDB creates a new instance of the accounts database. Should only
 // be called once per component.
 func (b *BaseDendrite) CreateAccountsDB() accounts.Database {
-	db, err := accounts.NewDatabase(string(b.Cfg.Database.Account), b.Cfg.Matrix.ServerName)
+	db, err := accounts.NewDatabase(string(b.Cfg.Database.Account), b.Cfg.DbProperties(config.DatabaseAccount), b.Cfg.Matrix.ServerName)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to accounts db")
 	}
+	if c, ok := db.(io.Closer); ok {
+		b.CloseOnShutdown("accounts db", c)
+	}
+	b.RegisterDatabaseHealthCheck("accounts db", db)
 
 	return db
 }
@@ -179,27 +208,49 @@ func (b *BaseDendrite) CreateAccountsDB() accounts.Database {
 func (b *BaseDendrite) CreateKeyDB() keydb.Database {
 	db, err := keydb.NewDatabase(
 		string(b.Cfg.Database.ServerKey),
-		b.Cfg.Matrix.ServerName,
-		b.Cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey),
-		b.Cfg.Matrix.KeyID,
+		b.Cfg.DbProperties(config.DatabaseServerKey),
+		keydb.ServerKeys(b.Cfg),
 	)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to keys db")
 	}
+	if c, ok := db.(io.Closer); ok {
+		b.CloseOnShutdown("keys db", c)
+	}
+	b.RegisterDatabaseHealthCheck("keys db", db)
 
 	return db
 }
 
 // CreateFederationClient creates a new federation client. Should only be called
-// once per component.
+// once per component. If I2P is enabled then requests to .i2p server names are
+// sent through the configured SAM bridge, otherwise server names are resolved
+// and dialled exactly as gomatrixserverlib would.
 func (b *BaseDendrite) CreateFederationClient() *gomatrixserverlib.FederationClient {
-	return gomatrixserverlib.NewFederationClient(
-		b.Cfg.Matrix.ServerName, b.Cfg.Matrix.KeyID, b.Cfg.Matrix.PrivateKey,
+	var tripper http.RoundTripper = common.NewFederationTripper()
+	if b.Cfg.Matrix.I2P.Enabled {
+		samAddr := b.Cfg.Matrix.I2P.SAMAddress
+		tripper = i2p.NewFederationTripper(i2p.NewDialer(samAddr))
+		b.RegisterHealthCheck("sam bridge", func(ctx context.Context) error {
+			return i2p.CheckBridge(ctx, samAddr)
+		})
+	}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", common.WrapTripperInFederationTimeouts(
+		tripper, &b.Cfg.Matrix.FederationTimeouts,
+	))
+	client := gomatrixserverlib.NewFederationClientWithTransport(
+		b.Cfg.Matrix.ServerName, b.Cfg.Matrix.KeyID, b.Cfg.Matrix.PrivateKey, tr,
 	)
+	// The transport applies the timeout for each destination, so the client
+	// mustn't cut requests short with a single timeout of its own.
+	client.Client = *gomatrixserverlib.NewClientWithTimeout(0, tr)
+	return client
 }
 
 // SetupAndServeHTTP sets up the HTTP server to serve endpoints registered on
-// ApiMux under /api/ and adds a prometheus handler under /metrics.
+// ApiMux under /api/ and adds a prometheus handler under /metrics. It blocks
+// until the component is shut down by SIGINT or SIGTERM.
 func (b *BaseDendrite) SetupAndServeHTTP(bindaddr string, listenaddr string) {
 	// If a separate bind address is defined, listen on that. Otherwise use
 	// the listen address
@@ -210,18 +261,22 @@ func (b *BaseDendrite) SetupAndServeHTTP(bindaddr string, listenaddr string) {
 		addr = listenaddr
 	}
 
-	serv := http.Server{
+	serv := &http.Server{
 		Addr:         addr,
 		WriteTimeout: HTTPServerTimeout,
 	}
+	b.RegisterHTTPServer(serv)
 
-	common.SetupHTTPAPI(http.DefaultServeMux, common.WrapHandlerInCORS(b.APIMux), b.Cfg)
+	common.SetupHTTPAPI(http.DefaultServeMux, common.WrapHandlerInCORS(b.APIMux, &b.Cfg.CORS), b.Cfg)
+	b.SetupHealthHTTP(http.DefaultServeMux)
 	logrus.Infof("Starting %s server on %s", b.componentName, serv.Addr)
 
-	err := serv.ListenAndServe()
-	if err != nil {
-		logrus.WithError(err).Fatal("failed to serve http")
-	}
+	go func() {
+		if err := serv.ListenAndServe(); err != http.ErrServerClosed {
+			logrus.WithError(err).Fatal("failed to serve http")
+		}
+	}()
+	b.WaitForShutdown()
 
 	logrus.Infof("Stopped %s server on %s", b.componentName, serv.Addr)
 }
@@ -249,7 +304,7 @@ func setupNaffka(cfg *config.Dendrite) (sarama.Consumer, sarama.SyncProducer) {
 
 	uri, err := url.Parse(string(cfg.Database.Naffka))
 	if err != nil || uri.Scheme == "file" {
-		db, err = sqlutil.Open(common.SQLiteDriverName(), string(cfg.Database.Naffka))
+		db, err = sqlutil.Open(common.SQLiteDriverName(), string(cfg.Database.Naffka), cfg.DbProperties(config.DatabaseNaffka))
 		if err != nil {
 			logrus.WithError(err).Panic("Failed to open naffka database")
 		}
@@ -259,7 +314,7 @@ func setupNaffka(cfg *config.Dendrite) (sarama.Consumer, sarama.SyncProducer) {
 			logrus.WithError(err).Panic("Failed to setup naffka database")
 		}
 	} else {
-		db, err = sqlutil.Open("postgres", string(cfg.Database.Naffka))
+		db, err = sqlutil.Open("postgres", string(cfg.Database.Naffka), cfg.DbProperties(config.DatabaseNaffka))
 		if err != nil {
 			logrus.WithError(err).Panic("Failed to open naffka database")
 		}
@@ -0,0 +1,133 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package basecomponent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HealthCheckTimeout is how long each health check may take before the thing
+// it checks is reported as down.
+const HealthCheckTimeout = 5 * time.Second
+
+// A HealthCheck checks that something the component depends on, such as a
+// database, can be reached. It returns an error if it can't.
+type HealthCheck func(ctx context.Context) error
+
+type healthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// pinger is implemented by the databases which can be health checked.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// RegisterHealthCheck registers a check to run when the health of the
+// component is asked for.
+func (b *BaseDendrite) RegisterHealthCheck(name string, check HealthCheck) {
+	b.healthMutex.Lock()
+	defer b.healthMutex.Unlock()
+	b.healthChecks = append(b.healthChecks, healthCheck{name, check})
+}
+
+// RegisterDatabaseHealthCheck registers a check that the database can be
+// reached, if the database supports being pinged.
+func (b *BaseDendrite) RegisterDatabaseHealthCheck(name string, db interface{}) {
+	if p, ok := db.(pinger); ok {
+		b.RegisterHealthCheck(name, p.Ping)
+	}
+}
+
+// DependencyStatus is the result of the health check of a dependency.
+type DependencyStatus struct {
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// CheckHealth runs the health checks at the same time, and returns whether
+// they all passed and the result of each.
+func (b *BaseDendrite) CheckHealth(ctx context.Context) (bool, map[string]DependencyStatus) {
+	b.healthMutex.Lock()
+	checks := append([]healthCheck(nil), b.healthChecks...)
+	b.healthMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+	defer cancel()
+	statuses := make([]DependencyStatus, len(checks))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = DependencyStatus{Healthy: true}
+			if err := checks[i].check(ctx); err != nil {
+				statuses[i] = DependencyStatus{Error: err.Error()}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	healthy := true
+	result := make(map[string]DependencyStatus, len(checks))
+	for i := range checks {
+		result[checks[i].name] = statuses[i]
+		if !statuses[i].Healthy {
+			healthy = false
+			logrus.WithField("dependency", checks[i].name).Warn("Health check failed: ", statuses[i].Error)
+		}
+	}
+	return healthy, result
+}
+
+type healthResponse struct {
+	Healthy      bool                        `json:"healthy"`
+	Dependencies map[string]DependencyStatus `json:"dependencies,omitempty"`
+}
+
+// SetupHealthHTTP registers the health check endpoints on the mux. Both run
+// all of the health checks registered by the component and respond with 503
+// Service Unavailable if any of them fail. /_dendrite/health only responds
+// with whether the component is healthy, and /_dendrite/ready also responds
+// with the status of each dependency.
+func (b *BaseDendrite) SetupHealthHTTP(servMux *http.ServeMux) {
+	servMux.HandleFunc("/_dendrite/health", b.healthHandler(false))
+	servMux.HandleFunc("/_dendrite/ready", b.healthHandler(true))
+}
+
+func (b *BaseDendrite) healthHandler(withDependencies bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		healthy, dependencies := b.CheckHealth(req.Context())
+		res := healthResponse{Healthy: healthy}
+		if withDependencies {
+			res.Dependencies = dependencies
+		}
+		code := http.StatusOK
+		if !healthy {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package basecomponent
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+)
+
+// ready asks for the readiness of the component.
+func ready(t *testing.T, b *BaseDendrite) (int, healthResponse) {
+	mux := http.NewServeMux()
+	b.SetupHealthHTTP(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_dendrite/ready", nil))
+	var res healthResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, res
+}
+
+func TestHealthChecksPingDatabases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dendrite-health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	db, err := devices.NewDatabase("file:"+filepath.Join(dir, "devices.db"), nil, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &BaseDendrite{componentName: "Test"}
+	b.RegisterDatabaseHealthCheck("devices db", db)
+
+	code, res := ready(t, b)
+	if code != http.StatusOK || !res.Healthy || !res.Dependencies["devices db"].Healthy {
+		t.Errorf("expected the component to be healthy, got %d: %+v", code, res)
+	}
+
+	// Pings fail once the database is closed.
+	if err = db.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	code, res = ready(t, b)
+	if status := res.Dependencies["devices db"]; code != http.StatusServiceUnavailable || res.Healthy || status.Healthy || status.Error == "" {
+		t.Errorf("expected the devices db to be reported as down, got %d: %+v", code, res)
+	}
+
+	mux := http.NewServeMux()
+	b.SetupHealthHTTP(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_dendrite/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /_dendrite/health to respond with 503, got %d", w.Code)
+	}
+}
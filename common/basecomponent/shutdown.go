@@ -0,0 +1,131 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package basecomponent
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A ShutdownHook is run when the component shuts down, such as to finish the
+// work which is in flight. It should return once ctx is done.
+type ShutdownHook func(ctx context.Context) error
+
+type shutdownHook struct {
+	name string
+	hook ShutdownHook
+}
+
+type namedCloser struct {
+	name   string
+	closer io.Closer
+}
+
+// RegisterShutdownHook registers a hook to run when the component shuts down.
+// The hooks are run one at a time, in the order they were registered in.
+func (b *BaseDendrite) RegisterShutdownHook(name string, hook ShutdownHook) {
+	b.shutdownMutex.Lock()
+	defer b.shutdownMutex.Unlock()
+	b.shutdownHooks = append(b.shutdownHooks, shutdownHook{name, hook})
+}
+
+// RegisterHTTPServer registers an HTTP server to stop when the component shuts
+// down. The servers stop accepting requests before the shutdown hooks are run,
+// and the requests which are being served are waited on.
+func (b *BaseDendrite) RegisterHTTPServer(serv *http.Server) {
+	b.shutdownMutex.Lock()
+	defer b.shutdownMutex.Unlock()
+	b.httpServers = append(b.httpServers, serv)
+}
+
+// CloseOnShutdown registers a database or other connection to close when the
+// component shuts down. They are closed after the shutdown hooks have run, as
+// the hooks may still use them.
+func (b *BaseDendrite) CloseOnShutdown(name string, closer io.Closer) {
+	b.shutdownMutex.Lock()
+	defer b.shutdownMutex.Unlock()
+	b.closers = append(b.closers, namedCloser{name, closer})
+}
+
+// WaitForShutdown blocks until the process is sent SIGINT or SIGTERM and then
+// shuts the component down, allowing ShutdownTimeout for it.
+func (b *BaseDendrite) WaitForShutdown() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	signal.Stop(sigs)
+	logrus.Infof("Shutting down %s after %s", b.componentName, sig)
+
+	if err := b.Close(); err != nil {
+		logrus.WithError(err).Errorf("Failed to shut down %s cleanly", b.componentName)
+	}
+}
+
+// Shutdown stops the HTTP servers, runs the shutdown hooks and then closes the
+// databases, the kafka connections and the tracer. Only the first call shuts
+// the component down, and later calls wait for it and return the same error.
+// The first error is returned, but the rest of the shutdown carries on after
+// it.
+func (b *BaseDendrite) Shutdown(ctx context.Context) error {
+	b.shutdownOnce.Do(func() {
+		b.shutdownErr = b.shutdown(ctx)
+	})
+	return b.shutdownErr
+}
+
+func (b *BaseDendrite) shutdown(ctx context.Context) error {
+	b.shutdownMutex.Lock()
+	servers := b.httpServers
+	hooks := b.shutdownHooks
+	closers := b.closers
+	b.shutdownMutex.Unlock()
+
+	var firstErr error
+	check := func(err error, msg, name string) {
+		if err == nil {
+			return
+		}
+		logrus.WithError(err).WithField("name", name).Error(msg)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, serv := range servers {
+		check(serv.Shutdown(ctx), "Failed to stop HTTP server", serv.Addr)
+	}
+	for _, h := range hooks {
+		check(h.hook(ctx), "Shutdown hook failed", h.name)
+	}
+	for _, c := range closers {
+		check(c.closer.Close(), "Failed to close on shutdown", c.name)
+	}
+	if b.KafkaProducer != nil {
+		check(b.KafkaProducer.Close(), "Failed to close on shutdown", "kafka producer")
+	}
+	if b.KafkaConsumer != nil {
+		check(b.KafkaConsumer.Close(), "Failed to close on shutdown", "kafka consumer")
+	}
+	if b.tracerCloser != nil {
+		check(b.tracerCloser.Close(), "Failed to close on shutdown", "tracer")
+	}
+	return firstErr
+}
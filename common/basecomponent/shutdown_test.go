@@ -0,0 +1,65 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package basecomponent
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testCloser struct {
+	name string
+	ran  *[]string
+}
+
+func (c testCloser) Close() error {
+	*c.ran = append(*c.ran, c.name)
+	return nil
+}
+
+func TestShutdownRunsHooksInOrder(t *testing.T) {
+	b := &BaseDendrite{componentName: "Test"}
+	var ran []string
+	hook := func(name string, err error) ShutdownHook {
+		return func(context.Context) error {
+			ran = append(ran, name)
+			return err
+		}
+	}
+	// The databases are registered first, as they are by the components, but
+	// are still closed after the hooks.
+	b.CloseOnShutdown("db", testCloser{"db", &ran})
+	b.RegisterShutdownHook("first", hook("first", nil))
+	failed := errors.New("second hook failed")
+	b.RegisterShutdownHook("second", hook("second", failed))
+	b.RegisterShutdownHook("third", hook("third", nil))
+
+	if err := b.Shutdown(context.Background()); err != failed {
+		t.Errorf("expected the error of the second hook, got %v", err)
+	}
+	if expected := []string{"first", "second", "third", "db"}; !reflect.DeepEqual(ran, expected) {
+		t.Errorf("expected the hooks to run as %v, got %v", expected, ran)
+	}
+
+	// Shutting down again doesn't run the hooks again.
+	if err := b.Close(); err != failed {
+		t.Errorf("expected the error of the first shutdown, got %v", err)
+	}
+	if len(ran) != 4 {
+		t.Errorf("expected the hooks to only run once, got %v", ran)
+	}
+}
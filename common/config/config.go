@@ -21,12 +21,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common/i2p"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ed25519"
@@ -62,6 +64,11 @@ type Dendrite struct {
 		// An arbitrary string used to uniquely identify the PrivateKey. Must start with the
 		// prefix "ed25519:".
 		KeyID gomatrixserverlib.KeyID `yaml:"-"`
+		// Further keys which this server signs or has signed requests and events
+		// with, listed from oldest to newest. The private_key above is treated as
+		// the oldest key. The newest key which hasn't expired is used to sign new
+		// requests and events, and is stored in PrivateKey and KeyID.
+		SigningKeys []SigningKey `yaml:"signing_keys"`
 		// List of paths to X509 certificates used by the external federation listeners.
 		// These are used to calculate the TLS fingerprints to publish for this server.
 		// Other matrix servers talking to this server will expect the x509 certificate
@@ -99,9 +106,70 @@ type Dendrite struct {
 		// If set disables new users from registering (except via shared
 		// secrets)
 		RegistrationDisabled bool `yaml:"registration_disabled"`
+		// If set, new users can only register with a registration token which
+		// a server admin has created.
+		RegistrationRequiresToken bool `yaml:"registration_requires_token"`
+		// The minimum length of the passwords which users can register with or
+		// change their password to. Defaults to 8.
+		PasswordMinLength int `yaml:"password_min_length"`
+		// The largest account data content which users can save, in bytes.
+		// Defaults to 64KiB.
+		MaxAccountDataSizeBytes FileSizeBytes `yaml:"max_account_data_size_bytes"`
+		// The most events which can be pinned in a room at once. Zero, the
+		// default, means there is no limit.
+		MaxPinnedEvents int `yaml:"max_pinned_events"`
 		// Perspective keyservers, to use as a backup when direct key fetch
 		// requests don't succeed
 		KeyPerspectives KeyPerspectives `yaml:"key_perspectives"`
+		// Configuration for federating with servers that have .i2p server names.
+		I2P struct {
+			// Whether requests to .i2p server names should be sent through a
+			// SAM bridge. Requests to other server names are unaffected.
+			Enabled bool `yaml:"enabled"`
+			// The address of the SAM v3 bridge. Defaults to 127.0.0.1:7656.
+			SAMAddress string `yaml:"sam_address"`
+			// Whether the signing keys first seen for each .i2p server are
+			// pinned, and what happens when different keys are seen for it
+			// later. One of "off", "warn" or "enforce". Defaults to "warn".
+			KeyPinning string `yaml:"key_pinning"`
+		} `yaml:"i2p"`
+		// How long to wait for remote servers to respond to outbound
+		// federation requests.
+		FederationTimeouts FederationTimeouts `yaml:"federation_timeouts"`
+		// Limits on the events which are accepted from clients and other
+		// servers.
+		EventLimits EventLimits `yaml:"event_limits"`
+		// Whether this server doesn't federate with any other servers, so that
+		// its users can only talk to each other.
+		FederationDisabled bool `yaml:"federation_disabled"`
+		// If not empty, the only servers which this server federates with.
+		FederationAllowlist []gomatrixserverlib.ServerName `yaml:"federation_allowlist"`
+		// Servers which this server never federates with, even if they are
+		// in the allowlist.
+		FederationBlocklist []gomatrixserverlib.ServerName `yaml:"federation_blocklist"`
+		// How long to collect read receipts in a room for before sending them
+		// to other servers together. Defaults to 200 milliseconds.
+		ReceiptBatchWindow time.Duration `yaml:"receipt_batch_window"`
+		// How long a local user can be idle for before they are marked as
+		// unavailable. Defaults to 5 minutes.
+		PresenceIdleTimeout time.Duration `yaml:"presence_idle_timeout"`
+		// How long the access tokens of devices which asked for a refresh token
+		// when they logged in stay valid for. Defaults to 1 hour.
+		AccessTokenLifetime time.Duration `yaml:"access_token_lifetime"`
+		// The user IDs of local users who may use the admin API.
+		AdminUsers []string `yaml:"admin_users"`
+		// If not empty, the only local users who may create room aliases,
+		// besides the admin users.
+		AliasCreators []string `yaml:"alias_creators"`
+		// Notices which admins can send to local users through the admin API.
+		ServerNotices ServerNotices `yaml:"server_notices"`
+		// An OpenID Connect provider which users can log in with.
+		SSO SSO `yaml:"sso"`
+		// The room aliases or IDs which users are joined to when they
+		// register. Rooms which can't be joined are skipped.
+		AutoJoinRooms []string `yaml:"auto_join_rooms"`
+		// What /.well-known/matrix/client tells clients about this server.
+		WellKnownClient WellKnownClient `yaml:"well_known_client"`
 	} `yaml:"matrix"`
 
 	// The configuration specific to the media repostitory.
@@ -120,8 +188,15 @@ type Dendrite struct {
 		MaxThumbnailGenerators int `yaml:"max_thumbnail_generators"`
 		// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 		ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+		// How long media is kept for after it was last used.
+		Retention MediaRetention `yaml:"retention"`
+		// Configuration for the previews of URLs that clients show in messages.
+		URLPreviews URLPreviews `yaml:"url_previews"`
 	} `yaml:"media"`
 
+	// The policy for cross-origin requests from web clients.
+	CORS CORS `yaml:"cors"`
+
 	// The configuration to use for Prometheus metrics
 	Metrics struct {
 		// Whether or not the metrics are enabled
@@ -152,6 +227,14 @@ type Dendrite struct {
 			OutputClientData Topic `yaml:"output_client_data"`
 			// Topic for eduserver/api.OutputTypingEvent events.
 			OutputTypingEvent Topic `yaml:"output_typing_event"`
+			// Topic for eduserver/api.OutputReceiptEvent events.
+			OutputReceiptEvent Topic `yaml:"output_receipt_event"`
+			// Topic for eduserver/api.OutputPresenceEvent events.
+			OutputPresenceEvent Topic `yaml:"output_presence_event"`
+			// Topic for eduserver/api.OutputSendToDeviceEvent events.
+			OutputSendToDeviceEvent Topic `yaml:"output_send_to_device_event"`
+			// Topic for sending device list updates from client API to sync API
+			OutputDeviceListUpdate Topic `yaml:"output_device_list_update"`
 			// Topic for user updates (profile, presence)
 			UserUpdates Topic `yaml:"user_updates"`
 		}
@@ -180,6 +263,10 @@ type Dendrite struct {
 		// The FederationSender database stores information used by the FederationSender
 		// It is only accessed by the FederationSender.
 		FederationSender DataSource `yaml:"federation_sender"`
+		// The FederationAPI database stores information used by the FederationAPI,
+		// such as the transactions which have been received from other servers.
+		// It is only accessed by the FederationAPI.
+		FederationAPI DataSource `yaml:"federation_api"`
 		// The AppServices database stores information used by the AppService component.
 		// It is only accessed by the AppService component.
 		AppService DataSource `yaml:"appservice"`
@@ -188,6 +275,13 @@ type Dendrite struct {
 		PublicRoomsAPI DataSource `yaml:"public_rooms_api"`
 		// The Naffka database is used internally by the naffka library, if used.
 		Naffka DataSource `yaml:"naffka,omitempty"`
+		// The settings of the connection pools of the postgres databases and
+		// of the connections to the SQLite databases.
+		ConnectionPool DatabaseOptions `yaml:"connection_pool"`
+		// The settings which override ConnectionPool for some of the
+		// databases, keyed by the names of the databases above. Only the
+		// settings given are overridden.
+		ConnectionPools map[DatabaseName]DatabaseOptions `yaml:"connection_pools"`
 	} `yaml:"database"`
 
 	// TURN Server Config
@@ -210,6 +304,9 @@ type Dendrite struct {
 		Password string `yaml:"turn_password"`
 	} `yaml:"turn"`
 
+	// Limits on how quickly local users can send events into rooms.
+	RateLimiting RateLimiting `yaml:"rate_limiting"`
+
 	// The internal addresses the components will listen on.
 	// These should not be exposed externally as they expose metrics and debugging APIs.
 	// Falls back to addresses listed in Listen if not specified
@@ -256,6 +353,21 @@ type Dendrite struct {
 	// The config for logging informations. Each hook will be added to logrus.
 	Logging []LogrusHook `yaml:"logging"`
 
+	// The config for logging the requests served by the client and federation
+	// APIs, and by the internal APIs between components.
+	RequestLogging struct {
+		// The level of the line logged when a request completes, one of debug,
+		// info, warn or error. Defaults to info.
+		Level string `yaml:"level"`
+		// Whether the request and response bodies are added to the line, up to
+		// MaxBodyBytes of each. Bodies hold access tokens and private messages,
+		// so this should only be enabled for debugging.
+		IncludeBodies bool `yaml:"include_bodies"`
+		// The maximum number of bytes of each body that are logged. Defaults to
+		// 4096.
+		MaxBodyBytes int `yaml:"max_body_bytes"`
+	} `yaml:"request_logging"`
+
 	// Any information derived from the configuration options for later use.
 	Derived struct {
 		Registration struct {
@@ -288,6 +400,27 @@ type Dendrite struct {
 	} `yaml:"-"`
 }
 
+// A SigningKey is a key which this server signs or has signed requests and
+// events with.
+type SigningKey struct {
+	// Path to the private key.
+	PrivateKeyPath Path `yaml:"private_key"`
+	// When the key stopped being used to sign events, or zero if it is still
+	// in use. Remote servers will still accept the events signed with the key
+	// before it expired.
+	ExpiredTS gomatrixserverlib.Timestamp `yaml:"expired_ts"`
+	// The private key. Loaded from PrivateKeyPath.
+	PrivateKey ed25519.PrivateKey `yaml:"-"`
+	// The ID of the key. Loaded from PrivateKeyPath.
+	KeyID gomatrixserverlib.KeyID `yaml:"-"`
+}
+
+// HasExpired returns true if the key is no longer used to sign events at
+// the given time.
+func (k SigningKey) HasExpired(at time.Time) bool {
+	return k.ExpiredTS != 0 && k.ExpiredTS <= gomatrixserverlib.AsTimestamp(at)
+}
+
 // KeyPerspectives are used to configure perspective key servers for
 // retrieving server keys.
 type KeyPerspectives []struct {
@@ -303,6 +436,335 @@ type KeyPerspectives []struct {
 	} `yaml:"keys"`
 }
 
+// RateLimiting configures the token buckets which limit how quickly each user
+// can send events. Every sent event takes a token from the user's bucket, and
+// the bucket is refilled at a constant rate. Application services and admins
+// aren't rate limited.
+type RateLimiting struct {
+	// Whether events sent by users are rate limited.
+	Enabled bool `yaml:"enabled"`
+	// How many events a user can send in a burst. Defaults to 10.
+	BurstCount int `yaml:"burst_count"`
+	// How many tokens are added to the bucket of a user each second. Defaults
+	// to 0.2, which allows one event every five seconds once the burst is used.
+	PerSecond float64 `yaml:"per_second"`
+	// The burst count for guests, who anyone can register. Defaults to 5.
+	GuestBurstCount int `yaml:"guest_burst_count"`
+	// The refill rate of the buckets of guests. Defaults to 0.1, which allows
+	// one event every ten seconds.
+	GuestPerSecond float64 `yaml:"guest_per_second"`
+}
+
+// MediaRetention configures how long media is kept for. Media is purged once
+// it hasn't been uploaded or downloaded for longer than its lifetime, unless an
+// admin has exempted it.
+type MediaRetention struct {
+	// How long media uploaded to this server is kept for. Zero, the default,
+	// keeps it forever.
+	LocalMediaLifetime time.Duration `yaml:"local_media_lifetime"`
+	// How long media cached from other servers is kept for. Zero, the default,
+	// keeps it forever.
+	RemoteMediaLifetime time.Duration `yaml:"remote_media_lifetime"`
+	// How often expired media is purged. Defaults to 1 hour.
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+}
+
+// Enabled returns whether any media expires.
+func (r *MediaRetention) Enabled() bool {
+	return r.LocalMediaLifetime > 0 || r.RemoteMediaLifetime > 0
+}
+
+// URLPreviews configures the previews of URLs. To preview a URL the server
+// fetches it on behalf of the client, so which hosts it may fetch from can be
+// restricted.
+type URLPreviews struct {
+	// Whether clients may ask for previews of URLs.
+	Enabled bool `yaml:"enabled"`
+	// If set, previews are only fetched from these hosts and their subdomains.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// Previews are never fetched from these hosts or their subdomains.
+	DeniedHosts []string `yaml:"denied_hosts"`
+	// The maximum size of the pages which are fetched. Larger pages are
+	// truncated. Defaults to 1MB.
+	MaxPageSizeBytes FileSizeBytes `yaml:"max_page_size_bytes"`
+	// The maximum size of the images in previews. Larger images are left out
+	// of the preview. Defaults to 10MB.
+	MaxImageSizeBytes FileSizeBytes `yaml:"max_image_size_bytes"`
+	// How long previews are cached for. Defaults to 10 minutes.
+	CacheLifetime time.Duration `yaml:"cache_lifetime"`
+}
+
+// AllowsHost returns whether previews may be fetched from the given host.
+func (p *URLPreviews) AllowsHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if len(p.AllowedHosts) > 0 && !matchesAnyHost(host, p.AllowedHosts) {
+		return false
+	}
+	return !matchesAnyHost(host, p.DeniedHosts)
+}
+
+// matchesAnyHost returns whether the host is one of the given hosts or a
+// subdomain of one of them.
+func matchesAnyHost(host string, hosts []string) bool {
+	for _, h := range hosts {
+		h = strings.ToLower(strings.TrimSuffix(h, "."))
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerNotices configures the user which sends server notices, and the rooms
+// that they are sent in. Each local user gets their own server notices room.
+type ServerNotices struct {
+	// Whether admins may send server notices.
+	Enabled bool `yaml:"enabled"`
+	// The localpart of the user which sends the notices. Defaults to "notices".
+	LocalPart string `yaml:"system_mxid_localpart"`
+	// The display name of the user which sends the notices. Defaults to
+	// "Server Notices".
+	DisplayName string `yaml:"system_mxid_display_name"`
+	// The name of the rooms the notices are sent in. Defaults to
+	// "Server Notices".
+	RoomName string `yaml:"room_name"`
+}
+
+// SSO configures logging in with an OpenID Connect provider. Users who log
+// in for the first time are given a new account, whose localpart is taken
+// from a claim about them.
+type SSO struct {
+	// Whether users may log in with the provider.
+	Enabled bool `yaml:"enabled"`
+	// The issuer of the provider, from which its endpoints are discovered.
+	Issuer string `yaml:"issuer"`
+	// The ID and secret of this server as a client of the provider.
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// The URL of /_matrix/client/r0/login/sso/callback on this server as the
+	// provider reaches it, which must be registered with the provider.
+	CallbackURL string `yaml:"callback_url"`
+	// The claim that the localparts of new accounts are taken from. Defaults
+	// to "preferred_username".
+	LocalpartClaim string `yaml:"localpart_claim"`
+	// The scopes to request. Defaults to "openid" and "profile".
+	Scopes []string `yaml:"scopes"`
+	// Whether users who are given a new account when they log in for the
+	// first time are joined to the auto_join_rooms, like users who register.
+	AutoJoinRooms bool `yaml:"auto_join_rooms"`
+	// The base URLs of the clients which users may log in to, as the login
+	// token is sent to the redirectUrl that the client asks for. A
+	// redirectUrl is allowed if it has the scheme and host of one of these
+	// and its path starts with the path of it.
+	ClientWhitelist []string `yaml:"client_whitelist"`
+}
+
+// WellKnownClient configures /.well-known/matrix/client, which clients use to
+// find the client API of a server from its server name.
+type WellKnownClient struct {
+	// The base URL of the client API, such as "https://matrix.example.com".
+	// If unset, the well-known is only served to clients using I2P.
+	BaseURL string `yaml:"base_url"`
+	// The base URL of the identity server which clients should use, if any.
+	IdentityServer string `yaml:"identity_server"`
+	// The base URL of the client API for clients which reach this server over
+	// I2P. Defaults to the .b32.i2p address which they connected to.
+	I2PBaseURL string `yaml:"i2p_base_url"`
+}
+
+// The values of matrix.i2p.key_pinning.
+const (
+	// KeyPinningOff doesn't pin the keys of .i2p servers.
+	KeyPinningOff = "off"
+	// KeyPinningWarn pins the keys first seen for .i2p servers, and logs a
+	// warning when different keys are seen for them.
+	KeyPinningWarn = "warn"
+	// KeyPinningEnforce also refuses keys which differ from the pinned keys.
+	KeyPinningEnforce = "enforce"
+)
+
+// MaxEventSizeBytes is the size limit of events in the spec, which includes
+// their signatures.
+// https://matrix.org/docs/spec/client_server/r0.6.0#size-limits
+const MaxEventSizeBytes = 65536
+
+// The most prev_events and auth_events which this server puts in its own
+// events, and the default limits on the events it accepts.
+const (
+	DefaultMaxPrevEvents = 20
+	DefaultMaxAuthEvents = 10
+)
+
+// EventLimits are the limits on the events which this server accepts. Events
+// from clients which break them are rejected, and so are events in
+// transactions from other servers.
+type EventLimits struct {
+	// The largest event JSON in bytes. This can't be more than the spec's limit
+	// of 65536 bytes, which is the default.
+	MaxSizeBytes FileSizeBytes `yaml:"max_size_bytes"`
+	// The most prev_events and auth_events which an event can reference.
+	// Default to DefaultMaxPrevEvents and DefaultMaxAuthEvents.
+	MaxPrevEvents int `yaml:"max_prev_events"`
+	MaxAuthEvents int `yaml:"max_auth_events"`
+}
+
+// FederationTimeouts configures the timeouts of outbound federation requests.
+// Servers on high-latency networks such as I2P can take much longer than
+// others to respond, so timeouts can be overridden by server name suffix.
+type FederationTimeouts struct {
+	// The timeout of requests to servers that don't match any override.
+	// Defaults to 30 seconds.
+	Default time.Duration `yaml:"default"`
+	// Timeouts for servers whose names end with a given suffix. If several
+	// suffixes match then the longest suffix is used. Unless overridden here,
+	// requests to ".i2p" servers time out after 3 minutes.
+	Overrides []FederationTimeoutOverride `yaml:"overrides"`
+}
+
+// DatabaseName is the name of a database in the database section of the
+// config.
+type DatabaseName string
+
+// The names of the databases.
+const (
+	DatabaseAccount          DatabaseName = "account"
+	DatabaseDevice           DatabaseName = "device"
+	DatabaseMediaAPI         DatabaseName = "media_api"
+	DatabaseServerKey        DatabaseName = "server_key"
+	DatabaseSyncAPI          DatabaseName = "sync_api"
+	DatabaseRoomServer       DatabaseName = "room_server"
+	DatabaseFederationSender DatabaseName = "federation_sender"
+	DatabaseFederationAPI    DatabaseName = "federation_api"
+	DatabaseAppService       DatabaseName = "appservice"
+	DatabasePublicRoomsAPI   DatabaseName = "public_rooms_api"
+	DatabaseNaffka           DatabaseName = "naffka"
+)
+
+var databaseNames = []DatabaseName{
+	DatabaseAccount, DatabaseDevice, DatabaseMediaAPI, DatabaseServerKey,
+	DatabaseSyncAPI, DatabaseRoomServer, DatabaseFederationSender,
+	DatabaseFederationAPI, DatabaseAppService, DatabasePublicRoomsAPI,
+	DatabaseNaffka,
+}
+
+// The default connection pool settings. Every component of a monolith opens
+// its own pool, so the open connections of all of the databases together are
+// kept below the 100 connections that postgres allows by default.
+const (
+	defaultMaxOpenConnections = 8
+	defaultMaxIdleConnections = 2
+	defaultConnectionLifetime = time.Hour
+	defaultJournalMode        = "wal"
+	defaultBusyTimeout        = 5 * time.Second
+)
+
+// The journal modes of an SQLite database.
+// https://www.sqlite.org/pragma.html#pragma_journal_mode
+var sqliteJournalModes = map[string]bool{
+	"delete": true, "truncate": true, "persist": true, "memory": true, "wal": true, "off": true,
+}
+
+// DatabaseOptions are the settings of the connection pool of a postgres
+// database, or of the connections to an SQLite database. It implements
+// sqlutil.DbProperties.
+type DatabaseOptions struct {
+	// The most connections which are open to the database at once.
+	MaxOpenConnections int `yaml:"max_open_conns"`
+	// The most idle connections which are kept open to be reused.
+	MaxIdleConnections int `yaml:"max_idle_conns"`
+	// How long a connection is reused for before it is closed.
+	ConnectionLifetime time.Duration `yaml:"conn_max_lifetime"`
+	// The journal mode of an SQLite database. Set this to "delete" to opt
+	// out of write-ahead logging, which lets the database be read while it
+	// is being written to.
+	JournalMode string `yaml:"sqlite_journal_mode"`
+	// How long a statement waits for an SQLite database to be unlocked
+	// before it fails with "database is locked".
+	BusyTimeout time.Duration `yaml:"sqlite_busy_timeout"`
+}
+
+// MaxOpenConns implements sqlutil.DbProperties
+func (o DatabaseOptions) MaxOpenConns() int {
+	return o.MaxOpenConnections
+}
+
+// MaxIdleConns implements sqlutil.DbProperties
+func (o DatabaseOptions) MaxIdleConns() int {
+	return o.MaxIdleConnections
+}
+
+// ConnMaxLifetime implements sqlutil.DbProperties
+func (o DatabaseOptions) ConnMaxLifetime() time.Duration {
+	return o.ConnectionLifetime
+}
+
+// SQLiteJournalMode implements sqlutil.DbProperties
+func (o DatabaseOptions) SQLiteJournalMode() string {
+	return o.JournalMode
+}
+
+// SQLiteBusyTimeout implements sqlutil.DbProperties
+func (o DatabaseOptions) SQLiteBusyTimeout() time.Duration {
+	return o.BusyTimeout
+}
+
+// DbProperties returns the connection pool settings of a database, which are
+// the settings in database.connection_pool with those given for the database
+// in database.connection_pools on top.
+func (config *Dendrite) DbProperties(name DatabaseName) DatabaseOptions {
+	opts := config.Database.ConnectionPool
+	override := config.Database.ConnectionPools[name]
+	if override.MaxOpenConnections != 0 {
+		opts.MaxOpenConnections = override.MaxOpenConnections
+	}
+	if override.MaxIdleConnections != 0 {
+		opts.MaxIdleConnections = override.MaxIdleConnections
+	}
+	if override.ConnectionLifetime != 0 {
+		opts.ConnectionLifetime = override.ConnectionLifetime
+	}
+	if override.JournalMode != "" {
+		opts.JournalMode = override.JournalMode
+	}
+	if override.BusyTimeout != 0 {
+		opts.BusyTimeout = override.BusyTimeout
+	}
+	return opts
+}
+
+// FederationTimeoutOverride is the timeout for servers with a name suffix.
+type FederationTimeoutOverride struct {
+	Suffix  string        `yaml:"suffix"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// For returns the timeout to use for requests to the given server.
+func (t *FederationTimeouts) For(serverName gomatrixserverlib.ServerName) time.Duration {
+	timeout, matched := t.Default, ""
+	name := strings.ToLower(string(serverName))
+	if host, _, valid := gomatrixserverlib.ParseAndValidateServerName(serverName); valid {
+		name = strings.ToLower(host)
+	}
+	for _, override := range t.Overrides {
+		suffix := strings.ToLower(override.Suffix)
+		if strings.HasSuffix(name, suffix) && len(suffix) > len(matched) {
+			timeout, matched = override.Timeout, suffix
+		}
+	}
+	return timeout
+}
+
+// Longest returns the longest of the configured timeouts.
+func (t *FederationTimeouts) Longest() time.Duration {
+	longest := t.Default
+	for _, override := range t.Overrides {
+		if override.Timeout > longest {
+			longest = override.Timeout
+		}
+	}
+	return longest
+}
+
 // A Path on the filesystem.
 type Path string
 
@@ -330,6 +792,39 @@ type ThumbnailSize struct {
 	ResizeMethod string `yaml:"method,omitempty"`
 }
 
+// CORS is a policy for cross-origin requests. The origins are matched
+// exactly, such as "https://app.example.com", and "*" allows any origin.
+type CORS struct {
+	// The origins which are allowed to make requests. Defaults to "*".
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// The methods which are allowed, returned to preflight requests.
+	AllowedMethods []string `yaml:"allowed_methods"`
+	// The request headers which are allowed, returned to preflight requests.
+	AllowedHeaders []string `yaml:"allowed_headers"`
+}
+
+// DefaultCORS is the permissive policy used unless another is configured.
+var DefaultCORS = CORS{
+	AllowedOrigins: []string{"*"},
+	AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+	AllowedHeaders: []string{"Origin", "X-Requested-With", "Content-Type", "Accept", "Authorization"},
+}
+
+// AllowsOrigin returns whether the policy allows requests from the origin.
+func (c *CORS) AllowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAnyOrigin returns whether the policy allows requests from any origin.
+func (c *CORS) AllowsAnyOrigin() bool {
+	return c.AllowsOrigin("*")
+}
+
 // LogrusHook represents a single logrus hook. At this point, only parsing and
 // verification of the proper values for type and level are done.
 // Validity/integrity checks on the parameters are done when configuring logrus.
@@ -404,15 +899,35 @@ func loadConfig(
 		return nil, err
 	}
 
-	privateKeyPath := absPath(basePath, config.Matrix.PrivateKeyPath)
-	privateKeyData, err := readFile(privateKeyPath)
-	if err != nil {
-		return nil, err
+	if config.Matrix.PrivateKeyPath != "" {
+		config.Matrix.SigningKeys = append(
+			[]SigningKey{{PrivateKeyPath: config.Matrix.PrivateKeyPath}},
+			config.Matrix.SigningKeys...,
+		)
+	}
+	keyIDs := map[gomatrixserverlib.KeyID]bool{}
+	for i := range config.Matrix.SigningKeys {
+		key := &config.Matrix.SigningKeys[i]
+		privateKeyPath := absPath(basePath, key.PrivateKeyPath)
+		var privateKeyData []byte
+		privateKeyData, err = readFile(privateKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		if key.KeyID, key.PrivateKey, err = readKeyPEM(privateKeyPath, privateKeyData); err != nil {
+			return nil, err
+		}
+		if keyIDs[key.KeyID] {
+			return nil, fmt.Errorf("duplicate signing key ID %q in %q", key.KeyID, privateKeyPath)
+		}
+		keyIDs[key.KeyID] = true
 	}
 
-	if config.Matrix.KeyID, config.Matrix.PrivateKey, err = readKeyPEM(privateKeyPath, privateKeyData); err != nil {
+	signingKey, err := newestSigningKey(config.Matrix.SigningKeys, time.Now())
+	if err != nil {
 		return nil, err
 	}
+	config.Matrix.KeyID, config.Matrix.PrivateKey = signingKey.KeyID, signingKey.PrivateKey
 
 	for _, certPath := range config.Matrix.FederationCertificatePaths {
 		absCertPath := absPath(basePath, certPath)
@@ -457,6 +972,12 @@ func (config *Dendrite) Derive() error {
 		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
 			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}})
 	}
+	if config.Matrix.RegistrationRequiresToken {
+		for i := range config.Derived.Registration.Flows {
+			flow := &config.Derived.Registration.Flows[i]
+			flow.Stages = append([]authtypes.LoginType{authtypes.LoginTypeRegistrationToken}, flow.Stages...)
+		}
+	}
 
 	// Load application service configuration files
 	if err := loadAppServices(config); err != nil {
@@ -476,14 +997,153 @@ func (config *Dendrite) SetDefaults() {
 		config.Matrix.TrustedIDServers = []string{}
 	}
 
+	if config.Matrix.I2P.SAMAddress == "" {
+		config.Matrix.I2P.SAMAddress = i2p.DefaultSAMAddress
+	}
+
+	if config.Matrix.I2P.KeyPinning == "" {
+		config.Matrix.I2P.KeyPinning = KeyPinningWarn
+	}
+
+	config.Matrix.FederationTimeouts.setDefaults()
+
+	if config.Database.ConnectionPool.MaxOpenConnections == 0 {
+		config.Database.ConnectionPool.MaxOpenConnections = defaultMaxOpenConnections
+	}
+	if config.Database.ConnectionPool.MaxIdleConnections == 0 {
+		config.Database.ConnectionPool.MaxIdleConnections = defaultMaxIdleConnections
+	}
+	if config.Database.ConnectionPool.ConnectionLifetime == 0 {
+		config.Database.ConnectionPool.ConnectionLifetime = defaultConnectionLifetime
+	}
+	if config.Database.ConnectionPool.JournalMode == "" {
+		config.Database.ConnectionPool.JournalMode = defaultJournalMode
+	}
+	if config.Database.ConnectionPool.BusyTimeout == 0 {
+		config.Database.ConnectionPool.BusyTimeout = defaultBusyTimeout
+	}
+
+	if config.Matrix.EventLimits.MaxSizeBytes == 0 {
+		config.Matrix.EventLimits.MaxSizeBytes = MaxEventSizeBytes
+	}
+	if config.Matrix.EventLimits.MaxPrevEvents == 0 {
+		config.Matrix.EventLimits.MaxPrevEvents = DefaultMaxPrevEvents
+	}
+	if config.Matrix.EventLimits.MaxAuthEvents == 0 {
+		config.Matrix.EventLimits.MaxAuthEvents = DefaultMaxAuthEvents
+	}
+
+	if config.Matrix.PasswordMinLength == 0 {
+		config.Matrix.PasswordMinLength = 8
+	}
+
+	if config.Matrix.MaxAccountDataSizeBytes == 0 {
+		config.Matrix.MaxAccountDataSizeBytes = 64 * 1024
+	}
+
+	if config.Matrix.ReceiptBatchWindow == 0 {
+		config.Matrix.ReceiptBatchWindow = 200 * time.Millisecond
+	}
+
+	if config.Matrix.PresenceIdleTimeout == 0 {
+		config.Matrix.PresenceIdleTimeout = 5 * time.Minute
+	}
+
+	if config.Matrix.AccessTokenLifetime == 0 {
+		config.Matrix.AccessTokenLifetime = time.Hour
+	}
+
+	if config.RateLimiting.BurstCount == 0 {
+		config.RateLimiting.BurstCount = 10
+	}
+	if config.RateLimiting.PerSecond == 0 {
+		config.RateLimiting.PerSecond = 0.2
+	}
+	if config.RateLimiting.GuestBurstCount == 0 {
+		config.RateLimiting.GuestBurstCount = 5
+	}
+	if config.RateLimiting.GuestPerSecond == 0 {
+		config.RateLimiting.GuestPerSecond = 0.1
+	}
+
+	if config.Matrix.ServerNotices.LocalPart == "" {
+		config.Matrix.ServerNotices.LocalPart = "notices"
+	}
+	if config.Matrix.ServerNotices.DisplayName == "" {
+		config.Matrix.ServerNotices.DisplayName = "Server Notices"
+	}
+	if config.Matrix.ServerNotices.RoomName == "" {
+		config.Matrix.ServerNotices.RoomName = "Server Notices"
+	}
+
+	if config.Matrix.SSO.LocalpartClaim == "" {
+		config.Matrix.SSO.LocalpartClaim = "preferred_username"
+	}
+	if len(config.Matrix.SSO.Scopes) == 0 {
+		config.Matrix.SSO.Scopes = []string{"openid", "profile"}
+	}
+
 	if config.Media.MaxThumbnailGenerators == 0 {
 		config.Media.MaxThumbnailGenerators = 10
 	}
 
+	if config.Media.Retention.SweepInterval == 0 {
+		config.Media.Retention.SweepInterval = time.Hour
+	}
+
+	if config.Media.URLPreviews.MaxPageSizeBytes == 0 {
+		config.Media.URLPreviews.MaxPageSizeBytes = 1024 * 1024
+	}
+
+	if config.Media.URLPreviews.MaxImageSizeBytes == 0 {
+		config.Media.URLPreviews.MaxImageSizeBytes = 10 * 1024 * 1024
+	}
+
+	if config.Media.URLPreviews.CacheLifetime == 0 {
+		config.Media.URLPreviews.CacheLifetime = 10 * time.Minute
+	}
+
 	if config.Media.MaxFileSizeBytes == nil {
 		defaultMaxFileSizeBytes := FileSizeBytes(10485760)
 		config.Media.MaxFileSizeBytes = &defaultMaxFileSizeBytes
 	}
+
+	if config.CORS.AllowedOrigins == nil {
+		config.CORS.AllowedOrigins = DefaultCORS.AllowedOrigins
+	}
+
+	if config.CORS.AllowedMethods == nil {
+		config.CORS.AllowedMethods = DefaultCORS.AllowedMethods
+	}
+
+	if config.CORS.AllowedHeaders == nil {
+		config.CORS.AllowedHeaders = DefaultCORS.AllowedHeaders
+	}
+
+	if config.RequestLogging.Level == "" {
+		config.RequestLogging.Level = "info"
+	}
+
+	if config.RequestLogging.MaxBodyBytes == 0 {
+		config.RequestLogging.MaxBodyBytes = 4096
+	}
+}
+
+// setDefaults sets the default timeout, and a longer timeout for I2P servers
+// if none was configured.
+func (t *FederationTimeouts) setDefaults() {
+	if t.Default == 0 {
+		t.Default = 30 * time.Second
+	}
+	for _, override := range t.Overrides {
+		if strings.EqualFold(override.Suffix, i2p.Suffix) {
+			return
+		}
+	}
+	t.Overrides = append(t.Overrides, FederationTimeoutOverride{
+		Suffix:  i2p.Suffix,
+		Timeout: 3 * time.Minute,
+	})
 }
 
 // Error returns a string detailing how many errors were contained within a
@@ -543,13 +1203,50 @@ func (config *Dendrite) checkTurn(configErrs *configErrors) {
 // checkMatrix verifies the parameters matrix.* are valid.
 func (config *Dendrite) checkMatrix(configErrs *configErrors) {
 	checkNotEmpty(configErrs, "matrix.server_name", string(config.Matrix.ServerName))
-	checkNotEmpty(configErrs, "matrix.private_key", string(config.Matrix.PrivateKeyPath))
+	if len(config.Matrix.SigningKeys) == 0 {
+		checkNotEmpty(configErrs, "matrix.private_key", string(config.Matrix.PrivateKeyPath))
+	}
+	for i, key := range config.Matrix.SigningKeys {
+		checkNotEmpty(configErrs, fmt.Sprintf("matrix.signing_keys[%d].private_key", i), string(key.PrivateKeyPath))
+	}
 	checkNotZero(configErrs, "matrix.federation_certificates", int64(len(config.Matrix.FederationCertificatePaths)))
 	if config.Matrix.RecaptchaEnabled {
 		checkNotEmpty(configErrs, "matrix.recaptcha_public_key", string(config.Matrix.RecaptchaPublicKey))
 		checkNotEmpty(configErrs, "matrix.recaptcha_private_key", string(config.Matrix.RecaptchaPrivateKey))
 		checkNotEmpty(configErrs, "matrix.recaptcha_siteverify_api", string(config.Matrix.RecaptchaSiteVerifyAPI))
 	}
+	if config.Matrix.SSO.Enabled {
+		checkNotEmpty(configErrs, "matrix.sso.issuer", config.Matrix.SSO.Issuer)
+		checkNotEmpty(configErrs, "matrix.sso.client_id", config.Matrix.SSO.ClientID)
+		checkNotEmpty(configErrs, "matrix.sso.callback_url", config.Matrix.SSO.CallbackURL)
+		checkNotZero(configErrs, "matrix.sso.client_whitelist", int64(len(config.Matrix.SSO.ClientWhitelist)))
+		for i, clientURL := range config.Matrix.SSO.ClientWhitelist {
+			if u, err := url.Parse(clientURL); err != nil || !u.IsAbs() {
+				configErrs.Add(fmt.Sprintf("invalid URL for config key %q: %s", fmt.Sprintf("matrix.sso.client_whitelist[%d]", i), clientURL))
+			}
+		}
+	}
+	for i, roomIDOrAlias := range config.Matrix.AutoJoinRooms {
+		if !strings.HasPrefix(roomIDOrAlias, "!") && !strings.HasPrefix(roomIDOrAlias, "#") {
+			configErrs.Add(fmt.Sprintf("invalid room ID or alias for config key %q: %s", fmt.Sprintf("matrix.auto_join_rooms[%d]", i), roomIDOrAlias))
+		}
+	}
+	switch config.Matrix.I2P.KeyPinning {
+	case KeyPinningOff, KeyPinningWarn, KeyPinningEnforce:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "matrix.i2p.key_pinning", config.Matrix.I2P.KeyPinning))
+	}
+	checkPositive(configErrs, "matrix.federation_timeouts.default", int64(config.Matrix.FederationTimeouts.Default))
+	checkPositive(configErrs, "matrix.event_limits.max_size_bytes", int64(config.Matrix.EventLimits.MaxSizeBytes))
+	if config.Matrix.EventLimits.MaxSizeBytes > MaxEventSizeBytes {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d is larger than the spec allows", "matrix.event_limits.max_size_bytes", config.Matrix.EventLimits.MaxSizeBytes))
+	}
+	checkPositive(configErrs, "matrix.event_limits.max_prev_events", int64(config.Matrix.EventLimits.MaxPrevEvents))
+	checkPositive(configErrs, "matrix.event_limits.max_auth_events", int64(config.Matrix.EventLimits.MaxAuthEvents))
+	for i, override := range config.Matrix.FederationTimeouts.Overrides {
+		checkNotEmpty(configErrs, fmt.Sprintf("matrix.federation_timeouts.overrides[%d].suffix", i), override.Suffix)
+		checkPositive(configErrs, fmt.Sprintf("matrix.federation_timeouts.overrides[%d].timeout", i), int64(override.Timeout))
+	}
 }
 
 // checkMedia verifies the parameters media.* are valid.
@@ -557,6 +1254,12 @@ func (config *Dendrite) checkMedia(configErrs *configErrors) {
 	checkNotEmpty(configErrs, "media.base_path", string(config.Media.BasePath))
 	checkPositive(configErrs, "media.max_file_size_bytes", int64(*config.Media.MaxFileSizeBytes))
 	checkPositive(configErrs, "media.max_thumbnail_generators", int64(config.Media.MaxThumbnailGenerators))
+	checkPositive(configErrs, "media.retention.local_media_lifetime", int64(config.Media.Retention.LocalMediaLifetime))
+	checkPositive(configErrs, "media.retention.remote_media_lifetime", int64(config.Media.Retention.RemoteMediaLifetime))
+	checkPositive(configErrs, "media.retention.sweep_interval", int64(config.Media.Retention.SweepInterval))
+	checkPositive(configErrs, "media.url_previews.max_page_size_bytes", int64(config.Media.URLPreviews.MaxPageSizeBytes))
+	checkPositive(configErrs, "media.url_previews.max_image_size_bytes", int64(config.Media.URLPreviews.MaxImageSizeBytes))
+	checkPositive(configErrs, "media.url_previews.cache_lifetime", int64(config.Media.URLPreviews.CacheLifetime))
 
 	for i, size := range config.Media.ThumbnailSizes {
 		checkPositive(configErrs, fmt.Sprintf("media.thumbnail_sizes[%d].width", i), int64(size.Width))
@@ -564,6 +1267,14 @@ func (config *Dendrite) checkMedia(configErrs *configErrors) {
 	}
 }
 
+// checkRateLimiting verifies the parameters rate_limiting.* are valid.
+func (config *Dendrite) checkRateLimiting(configErrs *configErrors) {
+	checkPositive(configErrs, "rate_limiting.burst_count", int64(config.RateLimiting.BurstCount))
+	if config.RateLimiting.PerSecond < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %v", "rate_limiting.per_second", config.RateLimiting.PerSecond))
+	}
+}
+
 // checkKafka verifies the parameters kafka.* and the related
 // database.naffka are valid.
 func (config *Dendrite) checkKafka(configErrs *configErrors, monolithic bool) {
@@ -582,6 +1293,10 @@ func (config *Dendrite) checkKafka(configErrs *configErrors, monolithic bool) {
 	checkNotEmpty(configErrs, "kafka.topics.output_room_event", string(config.Kafka.Topics.OutputRoomEvent))
 	checkNotEmpty(configErrs, "kafka.topics.output_client_data", string(config.Kafka.Topics.OutputClientData))
 	checkNotEmpty(configErrs, "kafka.topics.output_typing_event", string(config.Kafka.Topics.OutputTypingEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_receipt_event", string(config.Kafka.Topics.OutputReceiptEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_presence_event", string(config.Kafka.Topics.OutputPresenceEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_send_to_device_event", string(config.Kafka.Topics.OutputSendToDeviceEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_device_list_update", string(config.Kafka.Topics.OutputDeviceListUpdate))
 	checkNotEmpty(configErrs, "kafka.topics.user_updates", string(config.Kafka.Topics.UserUpdates))
 }
 
@@ -593,6 +1308,39 @@ func (config *Dendrite) checkDatabase(configErrs *configErrors) {
 	checkNotEmpty(configErrs, "database.media_api", string(config.Database.MediaAPI))
 	checkNotEmpty(configErrs, "database.sync_api", string(config.Database.SyncAPI))
 	checkNotEmpty(configErrs, "database.room_server", string(config.Database.RoomServer))
+
+	pool := config.Database.ConnectionPool
+	checkDatabaseOptions(configErrs, "database.connection_pool", pool, pool)
+	known := map[DatabaseName]bool{}
+	for _, name := range databaseNames {
+		known[name] = true
+	}
+	for name, opts := range config.Database.ConnectionPools {
+		key := fmt.Sprintf("database.connection_pools.%s", name)
+		if !known[name] {
+			configErrs.Add(fmt.Sprintf("unknown database %q in config key %q", name, "database.connection_pools"))
+			continue
+		}
+		checkDatabaseOptions(configErrs, key, opts, config.DbProperties(name))
+	}
+}
+
+// checkDatabaseOptions verifies the database settings given at key are valid, and that the effective settings they make don't keep more idle
+// connections than may be open.
+func checkDatabaseOptions(configErrs *configErrors, key string, opts, effective DatabaseOptions) {
+	checkPositive(configErrs, key+".max_open_conns", int64(opts.MaxOpenConnections))
+	checkPositive(configErrs, key+".max_idle_conns", int64(opts.MaxIdleConnections))
+	checkPositive(configErrs, key+".conn_max_lifetime", int64(opts.ConnectionLifetime))
+	checkPositive(configErrs, key+".sqlite_busy_timeout", int64(opts.BusyTimeout))
+	if opts.JournalMode != "" && !sqliteJournalModes[strings.ToLower(opts.JournalMode)] {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".sqlite_journal_mode", opts.JournalMode))
+	}
+	if effective.MaxIdleConnections > effective.MaxOpenConnections {
+		configErrs.Add(fmt.Sprintf(
+			"invalid value for config key %q: %d idle connections is more than the %d open connections",
+			key+".max_idle_conns", effective.MaxIdleConnections, effective.MaxOpenConnections,
+		))
+	}
 }
 
 // checkListen verifies the parameters listen.* are valid.
@@ -611,6 +1359,25 @@ func (config *Dendrite) checkLogging(configErrs *configErrors) {
 		checkNotEmpty(configErrs, "logging.type", string(logrusHook.Type))
 		checkNotEmpty(configErrs, "logging.level", string(logrusHook.Level))
 	}
+	switch config.RequestLogging.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "request_logging.level", config.RequestLogging.Level))
+	}
+	checkPositive(configErrs, "request_logging.max_body_bytes", int64(config.RequestLogging.MaxBodyBytes))
+}
+
+// checkCORS verifies the parameters cors.* are valid. The origins are
+// compared with the Origin header of requests, which has no path.
+func (config *Dendrite) checkCORS(configErrs *configErrors) {
+	for _, origin := range config.CORS.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "cors.allowed_origins", origin))
+		}
+	}
 }
 
 // check returns an error type containing all errors found within the config
@@ -628,9 +1395,11 @@ func (config *Dendrite) check(monolithic bool) error {
 	config.checkMatrix(&configErrs)
 	config.checkMedia(&configErrs)
 	config.checkTurn(&configErrs)
+	config.checkRateLimiting(&configErrs)
 	config.checkKafka(&configErrs, monolithic)
 	config.checkDatabase(&configErrs)
 	config.checkLogging(&configErrs)
+	config.checkCORS(&configErrs)
 
 	if !monolithic {
 		config.checkListen(&configErrs)
@@ -657,6 +1426,17 @@ func absPath(dir string, path Path) string {
 	return filepath.Join(dir, string(path))
 }
 
+// newestSigningKey returns the newest of the keys that hasn't expired at the
+// given time, which is the one used to sign new requests and events.
+func newestSigningKey(keys []SigningKey, at time.Time) (SigningKey, error) {
+	for i := len(keys) - 1; i >= 0; i-- {
+		if !keys[i].HasExpired(at) {
+			return keys[i], nil
+		}
+	}
+	return SigningKey{}, fmt.Errorf("all of the %d signing keys have expired", len(keys))
+}
+
 func readKeyPEM(path string, data []byte) (gomatrixserverlib.KeyID, ed25519.PrivateKey, error) {
 	for {
 		var keyBlock *pem.Block
@@ -698,6 +1478,55 @@ func fingerprintPEM(data []byte) *gomatrixserverlib.TLSFingerprint {
 	}
 }
 
+// IsServerAdmin returns whether the user is listed in the admin_users and so
+// may use the admin API.
+func (config *Dendrite) IsServerAdmin(userID string) bool {
+	for _, adminID := range config.Matrix.AdminUsers {
+		if adminID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAllowedToCreateAlias returns whether a local user may create room
+// aliases, which they may unless there is an alias_creators list that they
+// aren't in. Server admins may always create them.
+func (config *Dendrite) IsAllowedToCreateAlias(userID string) bool {
+	if len(config.Matrix.AliasCreators) == 0 || config.IsServerAdmin(userID) {
+		return true
+	}
+	for _, creatorID := range config.Matrix.AliasCreators {
+		if creatorID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFederationAllowed returns whether this server may federate with a server,
+// which it may unless federation is disabled, the server is in the
+// federation_blocklist or there is a federation_allowlist that it isn't in.
+func (config *Dendrite) IsFederationAllowed(serverName gomatrixserverlib.ServerName) bool {
+	if config.Matrix.FederationDisabled {
+		return false
+	}
+	for _, blocked := range config.Matrix.FederationBlocklist {
+		if blocked == serverName {
+			return false
+		}
+	}
+	if len(config.Matrix.FederationAllowlist) == 0 {
+		return true
+	}
+	for _, allowed := range config.Matrix.FederationAllowlist {
+		if allowed == serverName {
+			return true
+		}
+	}
+	return false
+}
+
 // AppServiceURL returns a HTTP URL for where the appservice component is listening.
 func (config *Dendrite) AppServiceURL() string {
 	// Hard code the appservice server to talk HTTP for now.
@@ -61,7 +61,13 @@ type AliasesContent struct {
 
 // CanonicalAliasContent is the event content for http://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-canonical-alias
 type CanonicalAliasContent struct {
-	Alias string `json:"alias"`
+	Alias      string   `json:"alias"`
+	AltAliases []string `json:"alt_aliases,omitempty"`
+}
+
+// PinnedEventsContent is the event content for https://matrix.org/docs/spec/client_server/r0.6.0#m-room-pinned-events
+type PinnedEventsContent struct {
+	Pinned []string `json:"pinned"`
 }
 
 // AvatarContent is the event content for http://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-avatar
@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// ErrEventTooLarge is wrapped by the errors for events which are larger than
+// the configured limit.
+var ErrEventTooLarge = errors.New("event is too large")
+
+// CheckEventLimits returns an error if the event breaks the configured limits
+// on events, or is missing its type. Limits which aren't set are taken to be
+// their defaults.
+func CheckEventLimits(event *gomatrixserverlib.Event, limits *config.EventLimits) error {
+	if limit := eventSizeLimit(limits); len(event.JSON()) > limit {
+		return fmt.Errorf("%w: %d bytes is more than %d", ErrEventTooLarge, len(event.JSON()), limit)
+	}
+	if event.Type() == "" {
+		return errors.New("event has no type")
+	}
+	maxPrevEvents, maxAuthEvents := limits.MaxPrevEvents, limits.MaxAuthEvents
+	if maxPrevEvents == 0 {
+		maxPrevEvents = config.DefaultMaxPrevEvents
+	}
+	if maxAuthEvents == 0 {
+		maxAuthEvents = config.DefaultMaxAuthEvents
+	}
+	if n := len(event.PrevEventIDs()); n > maxPrevEvents {
+		return fmt.Errorf("event has %d prev_events, more than %d", n, maxPrevEvents)
+	}
+	if n := len(event.AuthEventIDs()); n > maxAuthEvents {
+		return fmt.Errorf("event has %d auth_events, more than %d", n, maxAuthEvents)
+	}
+	if event.Depth() < 0 {
+		return fmt.Errorf("event has a negative depth of %d", event.Depth())
+	}
+	return nil
+}
+
+func eventSizeLimit(limits *config.EventLimits) int {
+	if limits.MaxSizeBytes == 0 {
+		return config.MaxEventSizeBytes
+	}
+	return int(limits.MaxSizeBytes)
+}
@@ -22,6 +22,7 @@ import (
 
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -35,6 +36,8 @@ var ErrRoomNoExists = errors.New("Room does not exist")
 // in case the function calling FillBuilder needs to use it.
 // Returns ErrRoomNoExists if the state of the room could not be retrieved because
 // the room doesn't exist
+// Returns an error wrapping ErrEventTooLarge if the event is larger than the
+// configured limit
 // Returns an error if something else went wrong
 func BuildEvent(
 	ctx context.Context,
@@ -45,6 +48,12 @@ func BuildEvent(
 		queryRes = &api.QueryLatestEventsAndStateResponse{}
 	}
 
+	// The content alone being too large is caught before building the event,
+	// as the builder refuses to build events larger than the spec allows.
+	if limit := eventSizeLimit(&cfg.Matrix.EventLimits); len(builder.Content) > limit {
+		return nil, fmt.Errorf("%w: the content is larger than %d bytes", ErrEventTooLarge, limit)
+	}
+
 	err := AddPrevEventsToEvent(ctx, builder, queryAPI, queryRes)
 	if err != nil {
 		// This can pass through a ErrRoomNoExists to the caller
@@ -58,6 +67,9 @@ func BuildEvent(
 	if err != nil {
 		return nil, err
 	}
+	if err = CheckEventLimits(&event, &cfg.Matrix.EventLimits); err != nil {
+		return nil, err
+	}
 
 	return &event, nil
 }
@@ -68,9 +80,9 @@ func AddPrevEventsToEvent(
 	builder *gomatrixserverlib.EventBuilder,
 	queryAPI api.RoomserverQueryAPI, queryRes *api.QueryLatestEventsAndStateResponse,
 ) error {
-	eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(builder)
+	eventsNeeded, err := auth.StateNeededForEventBuilder(builder)
 	if err != nil {
-		return fmt.Errorf("gomatrixserverlib.StateNeededForEventBuilder: %w", err)
+		return fmt.Errorf("auth.StateNeededForEventBuilder: %w", err)
 	}
 
 	if len(eventsNeeded.Tuples()) == 0 {
@@ -140,11 +152,11 @@ func truncateAuthAndPrevEvents(auth, prev []gomatrixserverlib.EventReference) (
 	truncAuth, truncPrev []gomatrixserverlib.EventReference,
 ) {
 	truncAuth, truncPrev = auth, prev
-	if len(truncAuth) > 10 {
-		truncAuth = truncAuth[:10]
+	if len(truncAuth) > config.DefaultMaxAuthEvents {
+		truncAuth = truncAuth[:config.DefaultMaxAuthEvents]
 	}
-	if len(truncPrev) > 20 {
-		truncPrev = truncPrev[:20]
+	if len(truncPrev) > config.DefaultMaxPrevEvents {
+		truncPrev = truncPrev[:config.DefaultMaxPrevEvents]
 	}
 	return
 }
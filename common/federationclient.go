@@ -0,0 +1,303 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// GetServerVersion asks a remote server which server software it runs. Older
+// servers don't implement the version endpoint, so a 404 from the server
+// returns a nil version rather than an error.
+func GetServerVersion(
+	ctx context.Context, client *gomatrixserverlib.FederationClient, serverName gomatrixserverlib.ServerName,
+) (*gomatrixserverlib.Version, error) {
+	version, err := client.GetVersion(ctx, serverName)
+	if httpErr, ok := err.(gomatrix.HTTPError); ok && httpErr.Code == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// GetEventAuth asks a remote server for the auth chain of an event. The events
+// of the auth chain can't be decoded without the room version, which is why
+// gomatrixserverlib's FederationClient can't make this request for us.
+func GetEventAuth(
+	ctx context.Context, client *gomatrixserverlib.FederationClient, cfg *config.Dendrite,
+	serverName gomatrixserverlib.ServerName, roomVersion gomatrixserverlib.RoomVersion,
+	roomID, eventID string,
+) ([]gomatrixserverlib.Event, error) {
+	path := "/_matrix/federation/v1/event_auth/" + url.PathEscape(roomID) + "/" + url.PathEscape(eventID)
+	req := gomatrixserverlib.NewFederationRequest(http.MethodGet, serverName, path)
+	if err := req.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return nil, err
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		AuthChain []json.RawMessage `json:"auth_chain"`
+	}
+	if err = client.DoRequestAndParseResponse(ctx, httpReq, &res); err != nil {
+		return nil, err
+	}
+	authChain := make([]gomatrixserverlib.Event, 0, len(res.AuthChain))
+	for _, eventJSON := range res.AuthChain {
+		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(eventJSON, roomVersion)
+		if err != nil {
+			return nil, err
+		}
+		authChain = append(authChain, event)
+	}
+	return authChain, nil
+}
+
+// MissingEventsRequest is the content of a request to
+// POST /_matrix/federation/v1/get_missing_events/{roomID}
+type MissingEventsRequest struct {
+	// The latest events that we already have.
+	EarliestEvents []string `json:"earliest_events"`
+	// The events which we are missing the prev_events of.
+	LatestEvents []string `json:"latest_events"`
+	// The most events to return.
+	Limit int `json:"limit"`
+	// The lowest depth of the events to return.
+	MinDepth int64 `json:"min_depth"`
+}
+
+// LookupMissingEvents asks a remote server for the events between the
+// earliest and latest events of the request. At most the limit of the request
+// is returned, even if the server sends more.
+func LookupMissingEvents(
+	ctx context.Context, client *gomatrixserverlib.FederationClient, cfg *config.Dendrite,
+	serverName gomatrixserverlib.ServerName, roomVersion gomatrixserverlib.RoomVersion,
+	roomID string, missing MissingEventsRequest,
+) ([]gomatrixserverlib.Event, error) {
+	path := "/_matrix/federation/v1/get_missing_events/" + url.PathEscape(roomID)
+	req := gomatrixserverlib.NewFederationRequest(http.MethodPost, serverName, path)
+	if err := req.SetContent(missing); err != nil {
+		return nil, err
+	}
+	if err := req.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return nil, err
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Events []json.RawMessage `json:"events"`
+	}
+	if err = client.DoRequestAndParseResponse(ctx, httpReq, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Events) > missing.Limit {
+		res.Events = res.Events[:missing.Limit]
+	}
+	events := make([]gomatrixserverlib.Event, 0, len(res.Events))
+	for _, eventJSON := range res.Events {
+		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(eventJSON, roomVersion)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// maxStateEventsByID is the most events which LookupStateByIDs fetches one at
+// a time. If more of the state is missing then it is fetched in one request
+// to /state instead, as each request can take a while over I2P.
+const maxStateEventsByID = 20
+
+// LookupStateByIDs asks a remote server for the state of a room at an event.
+// It asks for the IDs of the state and auth chain events first, and then only
+// fetches the events which the roomserver doesn't have. If that fails, or too
+// many of the events are missing, then the full state is asked for instead.
+func LookupStateByIDs(
+	ctx context.Context, client *gomatrixserverlib.FederationClient, query api.RoomserverQueryAPI,
+	serverName gomatrixserverlib.ServerName, roomVersion gomatrixserverlib.RoomVersion,
+	roomID, eventID string,
+) (*gomatrixserverlib.RespState, error) {
+	stateIDs, err := client.LookupStateIDs(ctx, serverName, roomID, eventID)
+	if err == nil {
+		var state *gomatrixserverlib.RespState
+		if state, err = lookupStateEvents(ctx, client, query, serverName, roomVersion, stateIDs); err == nil && state != nil {
+			return state, nil
+		}
+	}
+	state, err := client.LookupState(ctx, serverName, roomID, eventID, roomVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// lookupStateEvents fetches the events of the state IDs, from the roomserver
+// if it has them and from the remote server otherwise. It returns nil if too
+// many of them would have to be fetched from the remote server.
+func lookupStateEvents(
+	ctx context.Context, client *gomatrixserverlib.FederationClient, query api.RoomserverQueryAPI,
+	serverName gomatrixserverlib.ServerName, roomVersion gomatrixserverlib.RoomVersion,
+	stateIDs gomatrixserverlib.RespStateIDs,
+) (*gomatrixserverlib.RespState, error) {
+	eventIDs := append(append([]string{}, stateIDs.StateEventIDs...), stateIDs.AuthEventIDs...)
+	var eventsRes api.QueryEventsByIDResponse
+	if err := query.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{EventIDs: eventIDs}, &eventsRes); err != nil {
+		return nil, err
+	}
+	events := make(map[string]gomatrixserverlib.Event, len(eventIDs))
+	for _, ev := range eventsRes.Events {
+		events[ev.EventID()] = ev.Unwrap()
+	}
+	var missing []string
+	for _, id := range eventIDs {
+		if _, ok := events[id]; !ok {
+			missing = append(missing, id)
+			events[id] = gomatrixserverlib.Event{}
+		}
+	}
+	if len(missing) > maxStateEventsByID {
+		return nil, nil
+	}
+	for _, id := range missing {
+		txn, err := client.GetEvent(ctx, serverName, id)
+		if err != nil {
+			return nil, err
+		}
+		if len(txn.PDUs) != 1 {
+			return nil, fmt.Errorf("expected one event for %q, got %d", id, len(txn.PDUs))
+		}
+		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(txn.PDUs[0], roomVersion)
+		if err != nil {
+			return nil, err
+		}
+		if event.EventID() != id {
+			return nil, fmt.Errorf("expected event %q, got %q", id, event.EventID())
+		}
+		events[id] = event
+	}
+	state := &gomatrixserverlib.RespState{
+		StateEvents: make([]gomatrixserverlib.Event, 0, len(stateIDs.StateEventIDs)),
+		AuthEvents:  make([]gomatrixserverlib.Event, 0, len(stateIDs.AuthEventIDs)),
+	}
+	for _, id := range stateIDs.StateEventIDs {
+		state.StateEvents = append(state.StateEvents, events[id])
+	}
+	for _, id := range stateIDs.AuthEventIDs {
+		state.AuthEvents = append(state.AuthEvents, events[id])
+	}
+	return state, nil
+}
+
+// LookupSpaceHierarchy asks a remote server for the summary of a space and
+// of its children. gomatrixserverlib's FederationClient doesn't know about
+// spaces yet.
+func LookupSpaceHierarchy(
+	ctx context.Context, client *gomatrixserverlib.FederationClient, cfg *config.Dendrite,
+	serverName gomatrixserverlib.ServerName, roomID string, suggestedOnly bool,
+) (*RespSpaceHierarchy, error) {
+	path := "/_matrix/federation/v1/hierarchy/" + url.PathEscape(roomID)
+	if suggestedOnly {
+		path += "?suggested_only=true"
+	}
+	req := gomatrixserverlib.NewFederationRequest(http.MethodGet, serverName, path)
+	if err := req.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return nil, err
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return nil, err
+	}
+	var res RespSpaceHierarchy
+	if err = client.DoRequestAndParseResponse(ctx, httpReq, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// SendLeave sends a leave event made with make_leave through a remote server.
+// gomatrixserverlib's FederationClient fails to parse the response to the
+// request even when the server accepts the leave.
+func SendLeave(
+	ctx context.Context, client *gomatrixserverlib.FederationClient, cfg *config.Dendrite,
+	serverName gomatrixserverlib.ServerName, event gomatrixserverlib.Event,
+) error {
+	path := "/_matrix/federation/v2/send_leave/" + url.PathEscape(event.RoomID()) + "/" + url.PathEscape(event.EventID())
+	req := gomatrixserverlib.NewFederationRequest(http.MethodPut, serverName, path)
+	if err := req.SetContent(event); err != nil {
+		return err
+	}
+	if err := req.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return err
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	return client.DoRequestAndParseResponse(ctx, httpReq, &struct{}{})
+}
+
+// WrapTripperInFederationTimeouts wraps a round tripper for "matrix://" URLs
+// so that each request times out after the configured timeout for its
+// destination server. The timeout covers reading the response body, and an
+// earlier deadline on the request's context is left alone.
+func WrapTripperInFederationTimeouts(
+	tripper http.RoundTripper, timeouts *config.FederationTimeouts,
+) http.RoundTripper {
+	return &federationTimeoutTripper{tripper, timeouts}
+}
+
+type federationTimeoutTripper struct {
+	tripper  http.RoundTripper
+	timeouts *config.FederationTimeouts
+}
+
+func (t *federationTimeoutTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	timeout := t.timeouts.For(gomatrixserverlib.ServerName(r.URL.Host))
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	resp, err := t.tripper.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels a request's context once its response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
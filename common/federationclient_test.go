@@ -0,0 +1,214 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// testPeer answers federation requests with a handler.
+type testPeer struct {
+	handler http.Handler
+}
+
+func (p *testPeer) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	p.handler.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+func newTestFederationClient(t *testing.T, handler http.HandlerFunc) *gomatrixserverlib.FederationClient {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", &testPeer{handler})
+	client := gomatrixserverlib.NewFederationClientWithTransport(
+		"localhost", "ed25519:test", privateKey, tr,
+	)
+	client.Client = *gomatrixserverlib.NewClientWithTimeout(0, tr)
+	return client
+}
+
+func TestGetServerVersion(t *testing.T) {
+	client := newTestFederationClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/federation/v1/version" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"server":{"name":"Synapse","version":"1.12.4"}}`))
+	})
+	version, err := GetServerVersion(context.Background(), client, "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version == nil || version.Server.Name != "Synapse" || version.Server.Version != "1.12.4" {
+		t.Errorf("expected Synapse 1.12.4, got %+v", version)
+	}
+}
+
+func TestGetServerVersionNotImplemented(t *testing.T) {
+	client := newTestFederationClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`))
+	})
+	version, err := GetServerVersion(context.Background(), client, "remote")
+	if err != nil || version != nil {
+		t.Errorf("expected no version and no error, got %+v (%v)", version, err)
+	}
+
+	client = newTestFederationClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if _, err = GetServerVersion(context.Background(), client, "remote"); err == nil {
+		t.Error("expected an error when the server fails")
+	}
+}
+
+func TestGetEventAuth(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	_, cfg.Matrix.PrivateKey, _ = ed25519.GenerateKey(nil)
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   "@alice:remote",
+		RoomID:   "!room:remote",
+		Type:     gomatrixserverlib.MRoomCreate,
+		StateKey: new(string),
+		Content:  []byte(`{"creator":"@alice:remote"}`),
+	}
+	create, err := builder.Build(time.Now(), "remote", cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestFederationClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/federation/v1/event_auth/!room:remote/$event:remote" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(gomatrixserverlib.RespEventAuth{AuthEvents: []gomatrixserverlib.Event{create}})
+	})
+	authChain, err := GetEventAuth(
+		context.Background(), client, cfg, "remote", gomatrixserverlib.RoomVersionV1, "!room:remote", "$event:remote",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(authChain) != 1 || authChain[0].EventID() != create.EventID() {
+		t.Errorf("expected the create event in the auth chain, got %v", authChain)
+	}
+}
+
+// knownEvents answers roomserver queries for the events it has.
+type knownEvents struct {
+	api.RoomserverQueryAPI
+	events []gomatrixserverlib.Event
+}
+
+func (k *knownEvents) QueryEventsByID(
+	ctx context.Context, request *api.QueryEventsByIDRequest, response *api.QueryEventsByIDResponse,
+) error {
+	for _, ev := range k.events {
+		for _, eventID := range request.EventIDs {
+			if ev.EventID() == eventID {
+				response.Events = append(response.Events, ev.Headered(gomatrixserverlib.RoomVersionV1))
+			}
+		}
+	}
+	return nil
+}
+
+func TestLookupStateByIDsFetchesOnlyMissingEvents(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []gomatrixserverlib.Event
+	for _, stateKey := range []string{"", "@alice:remote"} {
+		stateKey := stateKey
+		eventType, content := gomatrixserverlib.MRoomCreate, `{"creator":"@alice:remote"}`
+		if stateKey != "" {
+			eventType, content = gomatrixserverlib.MRoomMember, `{"membership":"join"}`
+		}
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   "@alice:remote",
+			RoomID:   "!room:remote",
+			Type:     eventType,
+			StateKey: &stateKey,
+			Content:  []byte(content),
+		}
+		var ev gomatrixserverlib.Event
+		if ev, err = builder.Build(time.Now(), "remote", "ed25519:test", privateKey, gomatrixserverlib.RoomVersionV1); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	create, join := events[0], events[1]
+
+	var fetched []string
+	client := newTestFederationClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/_matrix/federation/v1/state_ids/!room:remote":
+			_ = json.NewEncoder(w).Encode(gomatrixserverlib.RespStateIDs{
+				StateEventIDs: []string{create.EventID(), join.EventID()},
+				AuthEventIDs:  []string{create.EventID()},
+			})
+		case strings.HasPrefix(r.URL.Path, "/_matrix/federation/v1/event/"):
+			eventID := strings.TrimPrefix(r.URL.Path, "/_matrix/federation/v1/event/")
+			fetched = append(fetched, eventID)
+			for _, ev := range events {
+				if ev.EventID() == eventID {
+					_ = json.NewEncoder(w).Encode(gomatrixserverlib.Transaction{PDUs: []json.RawMessage{ev.JSON()}})
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	state, err := LookupStateByIDs(
+		context.Background(), client, &knownEvents{events: []gomatrixserverlib.Event{create}},
+		"remote", gomatrixserverlib.RoomVersionV1, "!room:remote", "$event:remote",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 1 || fetched[0] != join.EventID() {
+		t.Errorf("expected only the join to be fetched, got %v", fetched)
+	}
+	if len(state.StateEvents) != 2 || state.StateEvents[0].EventID() != create.EventID() || state.StateEvents[1].EventID() != join.EventID() {
+		t.Errorf("expected the create and join events in the state, got %v", state.StateEvents)
+	}
+	if len(state.AuthEvents) != 1 || state.AuthEvents[0].EventID() != create.EventID() {
+		t.Errorf("expected the create event in the auth chain, got %v", state.AuthEvents)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// FederationTripper is an http.RoundTripper for "matrix://" URLs which
+// resolves server names as described in the server-server spec and sends
+// every request over HTTPS. It behaves like gomatrixserverlib's own round
+// tripper, which isn't exported, so that it can be wrapped with
+// WrapTripperInFederationTimeouts.
+type FederationTripper struct {
+	// transports maps a TLS server name to an HTTP transport.
+	transports      map[string]http.RoundTripper
+	transportsMutex sync.Mutex
+}
+
+// NewFederationTripper creates a new FederationTripper.
+func NewFederationTripper() *FederationTripper {
+	return &FederationTripper{
+		transports: make(map[string]http.RoundTripper),
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (f *FederationTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	serverName := gomatrixserverlib.ServerName(r.URL.Host)
+	resolutionResults, err := gomatrixserverlib.ResolveServer(serverName)
+	if err != nil {
+		return nil, err
+	}
+	if len(resolutionResults) == 0 {
+		return nil, fmt.Errorf("no address found for matrix host %v", serverName)
+	}
+
+	var resp *http.Response
+	for _, result := range resolutionResults {
+		req := r.Clone(r.Context())
+		req.Host = string(result.Host)
+		req.URL.Scheme = "https"
+		req.URL.Host = result.Destination
+		resp, err = f.getTransport(result.TLSServerName).RoundTrip(req)
+		if err == nil {
+			return resp, nil
+		}
+		util.GetLogger(r.Context()).Warnf("Error sending request to %s: %v",
+			req.URL.String(), err)
+	}
+
+	// just return the most recent error
+	return nil, err
+}
+
+// getTransport returns a transport using the given server name for SNI,
+// creating it if there isn't one for this server name yet.
+func (f *FederationTripper) getTransport(tlsServerName string) http.RoundTripper {
+	f.transportsMutex.Lock()
+	defer f.transportsMutex.Unlock()
+
+	transport, ok := f.transports[tlsServerName]
+	if !ok {
+		transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName: tlsServerName,
+				// TODO: Remove this when we enforce MSC1711.
+				InsecureSkipVerify: true,
+			},
+		}
+		f.transports[tlsServerName] = transport
+	}
+	return transport
+}
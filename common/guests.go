@@ -0,0 +1,144 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GuestCanJoinRoom returns whether the m.room.guest_access of a room lets
+// guests join it and send messages into it. Rooms which the roomserver doesn't
+// know about can't be joined by guests, as their guest access isn't known.
+func GuestCanJoinRoom(
+	ctx context.Context, roomID string, queryAPI api.RoomserverQueryAPI,
+) (bool, error) {
+	stateRes, err := guestAccessState(ctx, roomID, "", queryAPI)
+	if err != nil || !stateRes.RoomExists {
+		return false, err
+	}
+	for _, ev := range stateRes.StateEvents {
+		var content GuestAccessContent
+		if ev.Type() == "m.room.guest_access" && json.Unmarshal(ev.Content(), &content) == nil {
+			return content.GuestAccess == "can_join", nil
+		}
+	}
+	return false, nil
+}
+
+// GuestCanReadRoom returns whether a guest can read the events of a room.
+// Guests can read the rooms they are in and the rooms which are world readable.
+// https://matrix.org/docs/spec/client_server/r0.6.0#guest-access
+func GuestCanReadRoom(
+	ctx context.Context, userID, roomID string, queryAPI api.RoomserverQueryAPI,
+) (bool, error) {
+	stateRes, err := guestAccessState(ctx, roomID, userID, queryAPI)
+	if err != nil || !stateRes.RoomExists {
+		return false, err
+	}
+	for _, ev := range stateRes.StateEvents {
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomMember:
+			if membership, merr := ev.Membership(); merr == nil && membership == gomatrixserverlib.Join {
+				return true, nil
+			}
+		case gomatrixserverlib.MRoomHistoryVisibility:
+			var content HistoryVisibilityContent
+			if json.Unmarshal(ev.Content(), &content) == nil && content.HistoryVisibility == "world_readable" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// CheckGuestCanJoin returns an error response if the device belongs to a guest
+// and the room doesn't let guests join it.
+func CheckGuestCanJoin(
+	req *http.Request, device *authtypes.Device, roomID string,
+	queryAPI api.RoomserverQueryAPI,
+) *util.JSONResponse {
+	if !device.IsGuest {
+		return nil
+	}
+	allowed, err := GuestCanJoinRoom(req.Context(), roomID, queryAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("GuestCanJoinRoom failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !allowed {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.GuestAccessForbidden("Guests aren't allowed in this room"),
+		}
+	}
+	return nil
+}
+
+// CheckGuestCanRead returns an error response if the device belongs to a guest
+// who can't read the events of the room.
+func CheckGuestCanRead(
+	req *http.Request, device *authtypes.Device, roomID string,
+	queryAPI api.RoomserverQueryAPI,
+) *util.JSONResponse {
+	if !device.IsGuest {
+		return nil
+	}
+	allowed, err := GuestCanReadRoom(req.Context(), device.UserID, roomID, queryAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("GuestCanReadRoom failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !allowed {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.GuestAccessForbidden("Guests can only read rooms they are in or which are world readable"),
+		}
+	}
+	return nil
+}
+
+// guestAccessState fetches the current guest access and history visibility of
+// a room, and the membership of the user if one is given.
+func guestAccessState(
+	ctx context.Context, roomID, userID string, queryAPI api.RoomserverQueryAPI,
+) (*api.QueryLatestEventsAndStateResponse, error) {
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.guest_access", StateKey: ""},
+			{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+		},
+	}
+	if userID != "" {
+		stateReq.StateToFetch = append(stateReq.StateToFetch, gomatrixserverlib.StateKeyTuple{
+			EventType: gomatrixserverlib.MRoomMember, StateKey: userID,
+		})
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return nil, err
+	}
+	return &stateRes, nil
+}
@@ -36,6 +36,9 @@ func PostJSON(
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		req.Header.Set(RequestIDHeader, requestID)
+	}
 
 	res, err := httpClient.Do(req.WithContext(ctx))
 	if res != nil {
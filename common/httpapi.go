@@ -11,6 +11,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -29,19 +30,44 @@ type BasicAuth struct {
 }
 
 // MakeAuthAPI turns a util.JSONRequestHandler function into an http.Handler which authenticates the request.
+// Requests from guests are refused.
 func MakeAuthAPI(
 	metricsName string, data auth.Data,
 	f func(*http.Request, *authtypes.Device) util.JSONResponse,
+) http.Handler {
+	return makeAuthAPI(metricsName, data, false, f)
+}
+
+// MakeGuestAuthAPI is like MakeAuthAPI, but it lets guests make requests too.
+// It is used for the APIs which guests are allowed to use, see
+// https://matrix.org/docs/spec/client_server/r0.6.0#client-behaviour-14
+func MakeGuestAuthAPI(
+	metricsName string, data auth.Data,
+	f func(*http.Request, *authtypes.Device) util.JSONResponse,
+) http.Handler {
+	return makeAuthAPI(metricsName, data, true, f)
+}
+
+func makeAuthAPI(
+	metricsName string, data auth.Data, allowGuests bool,
+	f func(*http.Request, *authtypes.Device) util.JSONResponse,
 ) http.Handler {
 	h := func(req *http.Request) util.JSONResponse {
 		device, err := auth.VerifyUserFromRequest(req, data)
 		if err != nil {
 			return *err
 		}
+		if device.IsGuest && !allowGuests {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.GuestAccessForbidden("Guests can't use this API"),
+			}
+		}
 		// add the user ID to the logger
 		logger := util.GetLogger((req.Context()))
 		logger = logger.WithField("user_id", device.UserID)
 		req = req.WithContext(util.ContextWithLogger(req.Context(), logger))
+		setRequestUser(req.Context(), device.UserID)
 
 		return f(req, device)
 	}
@@ -57,7 +83,9 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 	if os.Getenv("DENDRITE_TRACE_HTTP") == "1" {
 		verbose = true
 	}
-	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
+	h := util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+		return f(withRequestIDLogger(req))
+	}))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
 		nextWriter := w
 		if verbose {
@@ -107,7 +135,7 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 
 	}
 
-	return http.HandlerFunc(withSpan)
+	return withRequestLogging(http.HandlerFunc(withSpan), false)
 }
 
 // MakeHTMLAPI adds Span metrics to the HTML Handler function
@@ -142,7 +170,9 @@ func MakeHTMLAPI(metricsName string, f func(http.ResponseWriter, *http.Request)
 // If we are passed a tracing context in the request headers then we use that
 // as the parent of any tracing spans we create.
 func MakeInternalAPI(metricsName string, f func(*http.Request) util.JSONResponse) http.Handler {
-	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
+	h := util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+		return f(withRequestIDLogger(req))
+	}))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
 		carrier := opentracing.HTTPHeadersCarrier(req.Header)
 		tracer := opentracing.GlobalTracer()
@@ -160,19 +190,31 @@ func MakeInternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 		h.ServeHTTP(w, req)
 	}
 
-	return http.HandlerFunc(withSpan)
+	return withRequestLogging(http.HandlerFunc(withSpan), true)
 }
 
 // MakeFedAPI makes an http.Handler that checks matrix federation authentication.
+// Requests from servers which this server doesn't federate with are refused
+// before their signatures are checked, so that their keys aren't fetched.
 func MakeFedAPI(
 	metricsName string,
-	serverName gomatrixserverlib.ServerName,
+	cfg *config.Dendrite,
 	keyRing gomatrixserverlib.KeyRing,
 	f func(*http.Request, *gomatrixserverlib.FederationRequest) util.JSONResponse,
 ) http.Handler {
 	h := func(req *http.Request) util.JSONResponse {
+		origin := requestOrigin(req)
+		// The origin is logged even if the request turns out not to be signed
+		// by it, as it helps to find out why requests are refused.
+		setRequestServer(req.Context(), origin)
+		if origin != "" && !cfg.IsFederationAllowed(origin) {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("This server does not federate with " + string(origin)),
+			}
+		}
 		fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
-			req, time.Now(), serverName, keyRing,
+			req, time.Now(), cfg.Matrix.ServerName, keyRing,
 		)
 		if fedReq == nil {
 			return errResp
@@ -182,6 +224,24 @@ func MakeFedAPI(
 	return MakeExternalAPI(metricsName, h)
 }
 
+// requestOrigin returns the origin claimed by the X-Matrix authorization of a
+// federation request, which hasn't been verified yet.
+func requestOrigin(req *http.Request) gomatrixserverlib.ServerName {
+	for _, authorization := range req.Header["Authorization"] {
+		parts := strings.SplitN(authorization, " ", 2)
+		if len(parts) != 2 || parts[0] != "X-Matrix" {
+			continue
+		}
+		for _, param := range strings.Split(parts[1], ",") {
+			pair := strings.SplitN(param, "=", 2)
+			if len(pair) == 2 && pair[0] == "origin" {
+				return gomatrixserverlib.ServerName(strings.Trim(pair[1], "\""))
+			}
+		}
+	}
+	return ""
+}
+
 // SetupHTTPAPI registers an HTTP API mux under /api and sets up a metrics
 // listener.
 func SetupHTTPAPI(servMux *http.ServeMux, apiMux http.Handler, cfg *config.Dendrite) {
@@ -213,13 +273,43 @@ func WrapHandlerInBasicAuth(h http.Handler, b BasicAuth) http.HandlerFunc {
 }
 
 // WrapHandlerInCORS adds CORS headers to all responses, including all error
-// responses.
-// Handles OPTIONS requests directly.
-func WrapHandlerInCORS(h http.Handler) http.HandlerFunc {
+// responses, following the policy. A nil policy allows any origin.
+// Handles preflight OPTIONS requests directly.
+func WrapHandlerInCORS(h http.Handler, cors *config.CORS) http.HandlerFunc {
+	// Any part of the policy which isn't set is permissive, as the config may
+	// not have had its defaults set.
+	policy := config.DefaultCORS
+	if cors != nil {
+		if len(cors.AllowedOrigins) > 0 {
+			policy.AllowedOrigins = cors.AllowedOrigins
+		}
+		if len(cors.AllowedMethods) > 0 {
+			policy.AllowedMethods = cors.AllowedMethods
+		}
+		if len(cors.AllowedHeaders) > 0 {
+			policy.AllowedHeaders = cors.AllowedHeaders
+		}
+	}
+	methods := strings.Join(policy.AllowedMethods, ", ")
+	headers := strings.Join(policy.AllowedHeaders, ", ")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
+		origin := r.Header.Get("Origin")
+		setHeaders := func(header http.Header) {
+			switch {
+			case policy.AllowsAnyOrigin():
+				header.Set("Access-Control-Allow-Origin", "*")
+			case origin != "" && policy.AllowsOrigin(origin):
+				header.Set("Access-Control-Allow-Origin", origin)
+				header.Set("Vary", "Origin")
+			default:
+				// Browsers refuse to share the response with other origins.
+				header.Del("Access-Control-Allow-Origin")
+				header.Set("Vary", "Origin")
+			}
+			header.Set("Access-Control-Allow-Methods", methods)
+			header.Set("Access-Control-Allow-Headers", headers)
+		}
+		setHeaders(w.Header())
 
 		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 			// Its easiest just to always return a 200 OK for everything. Whether
@@ -228,7 +318,32 @@ func WrapHandlerInCORS(h http.Handler) http.HandlerFunc {
 			// are perfectly happy with it.
 			w.WriteHeader(http.StatusOK)
 		} else {
-			h.ServeHTTP(w, r)
+			// util.MakeJSONAPI sets permissive CORS headers of its own, so the
+			// headers are set again just before the response is written.
+			h.ServeHTTP(&corsResponseWriter{ResponseWriter: w, setHeaders: setHeaders}, r)
 		}
 	})
 }
+
+// corsResponseWriter sets the CORS headers of a response just before its
+// status is written, replacing any set by the handler.
+type corsResponseWriter struct {
+	http.ResponseWriter
+	setHeaders  func(http.Header)
+	wroteHeader bool
+}
+
+func (w *corsResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.setHeaders(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *corsResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
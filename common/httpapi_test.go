@@ -4,6 +4,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
 )
 
 func TestWrapHandlerInBasicAuth(t *testing.T) {
@@ -93,3 +96,50 @@ func TestWrapHandlerInBasicAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestWrapHandlerInCORS(t *testing.T) {
+	h := MakeExternalAPI("test", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	})
+	cors := &config.CORS{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "OPTIONS"},
+	}
+	serve := func(method, origin string, preflight bool) http.Header {
+		req := httptest.NewRequest(method, "/_matrix/client/r0/test", nil)
+		req.Header.Set("Origin", origin)
+		if preflight {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		w := httptest.NewRecorder()
+		WrapHandlerInCORS(h, cors).ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 OK, got %d", w.Code)
+		}
+		return w.Header()
+	}
+
+	for _, preflight := range []bool{false, true} {
+		method := http.MethodGet
+		if preflight {
+			method = http.MethodOptions
+		}
+		header := serve(method, "https://app.example.com", preflight)
+		if got := header.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+			t.Errorf("expected the allowed origin to be reflected (preflight %v), got %q", preflight, got)
+		}
+		if got := header.Get("Access-Control-Allow-Methods"); got != "GET, OPTIONS" {
+			t.Errorf("expected the configured methods (preflight %v), got %q", preflight, got)
+		}
+		header = serve(method, "https://evil.example.com", preflight)
+		if got, ok := header["Access-Control-Allow-Origin"]; ok {
+			t.Errorf("expected no allowed origin for a disallowed origin (preflight %v), got %q", preflight, got)
+		}
+	}
+
+	// Without a policy any origin is allowed, as before.
+	cors = nil
+	if got := serve(http.MethodGet, "https://evil.example.com", false).Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("expected any origin to be allowed by default, got %q", got)
+	}
+}
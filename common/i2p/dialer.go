@@ -0,0 +1,287 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package i2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+// Lookup resolves an I2P hostname, either a .b32.i2p address or a name known
+// to the router's address book (e.g. one added through a jump service), to a
+// base64 destination.
+func (s *StreamSession) Lookup(ctx context.Context, name string) (string, error) {
+	conn, err := dialBridge(ctx, s.samAddr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close() // nolint: errcheck
+	reply, err := conn.command("NAMING LOOKUP NAME=%s", name)
+	if err != nil {
+		return "", err
+	}
+	if err = reply.err(); err != nil {
+		if !IsB32Host(name) {
+			return "", fmt.Errorf("i2p: %q is not in the address book: %w", name, err)
+		}
+		return "", err
+	}
+	return reply.Pairs["VALUE"], nil
+}
+
+// DialContext opens a stream from the session to the given I2P host. Any port
+// in addr is ignored. The network must be "tcp" or "i2p".
+func (s *StreamSession) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "i2p" {
+		return nil, fmt.Errorf("i2p: unsupported network %q", network)
+	}
+	host := strings.ToLower(stripPort(addr))
+	destination, err := s.Lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialBridge(ctx, s.samAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	reply, err := conn.command(
+		"STREAM CONNECT ID=%s DESTINATION=%s SILENT=false", s.id, destination,
+	)
+	if err == nil {
+		if err = reply.err(); err != nil && reply.Pairs["RESULT"] == "INVALID_ID" {
+			err = fmt.Errorf("%w: %s", errInvalidSession, err)
+		}
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("i2p: failed to connect to %s: %w", host, err)
+	}
+	_ = conn.SetDeadline(noDeadline)
+	return &Conn{
+		bridgeConn: conn,
+		localAddr:  s.Addr(),
+		remoteAddr: Addr(host),
+	}, nil
+}
+
+// The defaults for how many streams a Dialer opens to each host at once, and
+// for how long it keeps its session open while no streams are open. Building
+// the tunnels of a session takes a while, so it is kept for some time.
+const (
+	defaultMaxStreamsPerHost = 4
+	defaultIdleTimeout       = 10 * time.Minute
+)
+
+// errInvalidSession is returned when the bridge doesn't know the session that
+// a stream was opened from, which happens once the bridge has restarted.
+var errInvalidSession = errors.New("i2p: the SAM bridge doesn't know the session")
+
+// Dialer dials I2P hosts through a SAM session with a transient destination.
+// The session is only created on first use, so that a server which doesn't
+// talk to any I2P hosts never needs a SAM bridge to be running. All streams
+// are opened from the one session, which is closed once no streams have been
+// open for a while and is created again if the bridge forgets it, e.g. when
+// the bridge restarts.
+type Dialer struct {
+	samAddr string
+	// The most streams which are open to each host at once. Dialling the host
+	// again waits for one of them to be closed.
+	maxStreamsPerHost int
+	// How long the session is kept open for while no streams are open.
+	idleTimeout time.Duration
+
+	mu        sync.Mutex
+	session   *StreamSession
+	open      int
+	idleTimer *time.Timer
+	// streams holds a token for each stream which is open to a host.
+	streams map[string]chan struct{}
+}
+
+// NewDialer returns a Dialer that uses the SAM bridge at samAddr.
+func NewDialer(samAddr string) *Dialer {
+	return &Dialer{
+		samAddr:           samAddr,
+		maxStreamsPerHost: defaultMaxStreamsPerHost,
+		idleTimeout:       defaultIdleTimeout,
+		streams:           make(map[string]chan struct{}),
+	}
+}
+
+// DialContext implements the dial function of http.Transport.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	streams := d.hostStreams(strings.ToLower(stripPort(addr)))
+	select {
+	case streams <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		<-streams
+		return nil, err
+	}
+	d.streamOpened()
+	return &dialedConn{Conn: conn, release: func() {
+		<-streams
+		d.streamClosed()
+	}}, nil
+}
+
+// dial opens a stream from the session, creating the session again if the
+// bridge has forgotten it.
+func (d *Dialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	session, err := d.getSession()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := session.DialContext(ctx, network, addr)
+	if errors.Is(err, errInvalidSession) {
+		d.dropSession(session)
+		if session, err = d.getSession(); err != nil {
+			return nil, err
+		}
+		conn, err = session.DialContext(ctx, network, addr)
+	}
+	return conn, err
+}
+
+// hostStreams returns the tokens of the streams which are open to the host.
+func (d *Dialer) hostStreams(host string) chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	streams, ok := d.streams[host]
+	if !ok {
+		streams = make(chan struct{}, d.maxStreamsPerHost)
+		d.streams[host] = streams
+	}
+	return streams
+}
+
+// getSession returns the session, creating it if it doesn't exist yet.
+func (d *Dialer) getSession() (*StreamSession, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session != nil {
+		return d.session, nil
+	}
+	keys, err := GenerateKeys(d.samAddr)
+	if err != nil {
+		return nil, err
+	}
+	session, err := NewStreamSession(d.samAddr, "dendrite-client-"+util.RandomString(8), keys)
+	if err != nil {
+		return nil, err
+	}
+	d.session = session
+	go d.watchSession(session)
+	return session, nil
+}
+
+// watchSession drops the session once its control connection is closed, which
+// the bridge does when it shuts down, so that the next stream is opened from
+// a new session.
+func (d *Dialer) watchSession(session *StreamSession) {
+	_, _ = io.Copy(ioutil.Discard, session.control)
+	d.dropSession(session)
+}
+
+// dropSession closes the session, and forgets it if it is still the session
+// which streams are opened from.
+func (d *Dialer) dropSession(session *StreamSession) {
+	d.mu.Lock()
+	if d.session == session {
+		d.session = nil
+	}
+	d.mu.Unlock()
+	_ = session.Close()
+}
+
+func (d *Dialer) streamOpened() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.open++
+	if d.idleTimer != nil {
+		d.idleTimer.Stop()
+		d.idleTimer = nil
+	}
+}
+
+func (d *Dialer) streamClosed() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.open--
+	if d.open == 0 && d.session != nil {
+		d.idleTimer = time.AfterFunc(d.idleTimeout, d.closeIdleSession)
+	}
+}
+
+// closeIdleSession closes the session if no streams have been opened since
+// the last one was closed.
+func (d *Dialer) closeIdleSession() {
+	d.mu.Lock()
+	session := d.session
+	if d.open != 0 || session == nil {
+		d.mu.Unlock()
+		return
+	}
+	d.session = nil
+	d.idleTimer = nil
+	d.mu.Unlock()
+	_ = session.Close()
+}
+
+// Close closes the session, if one was created.
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.idleTimer != nil {
+		d.idleTimer.Stop()
+		d.idleTimer = nil
+	}
+	if d.session == nil {
+		return nil
+	}
+	err := d.session.Close()
+	d.session = nil
+	return err
+}
+
+// dialedConn is a stream opened by a Dialer, which tells the Dialer when it
+// is closed.
+type dialedConn struct {
+	net.Conn
+	closeOnce sync.Once
+	release   func()
+}
+
+// Close implements net.Conn.
+func (c *dialedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.release)
+	return err
+}
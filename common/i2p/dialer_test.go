@@ -0,0 +1,283 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package i2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBridge is a SAM bridge which connects every stream to target, and
+// hands every accepting connection to the test through accepts.
+type testBridge struct {
+	t        *testing.T
+	listener net.Listener
+	target   string
+	pub      string
+
+	mu        sync.Mutex
+	sessions  map[string]net.Conn
+	streams   []net.Conn
+	accepts   chan net.Conn
+	generated int
+	created   int
+	connects  int
+}
+
+func newTestBridge(t *testing.T, target string) *testBridge {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBridge{
+		t:        t,
+		listener: listener,
+		target:   target,
+		pub:      i2pBase64.EncodeToString(bytes.Repeat([]byte{1}, 387)),
+		sessions: make(map[string]net.Conn),
+		accepts:  make(chan net.Conn, 1),
+	}
+	go b.serve()
+	return b
+}
+
+func (b *testBridge) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *testBridge) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		fields := splitFields(strings.TrimSpace(line))
+		pairs := map[string]string{}
+		for _, field := range fields[2:] {
+			if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+				pairs[kv[0]] = kv[1]
+			}
+		}
+		switch fields[0] + " " + fields[1] {
+		case "HELLO VERSION":
+			fmt.Fprintf(conn, "HELLO REPLY RESULT=OK VERSION=3.1\n")
+		case "DEST GENERATE":
+			b.mu.Lock()
+			b.generated++
+			b.mu.Unlock()
+			fmt.Fprintf(conn, "DEST REPLY PUB=%s PRIV=%s\n", b.pub, b.pub)
+		case "NAMING LOOKUP":
+			// Names under unknown.i2p aren't in the address book.
+			if strings.HasSuffix(pairs["NAME"], "unknown.i2p") {
+				fmt.Fprintf(conn, "NAMING REPLY RESULT=KEY_NOT_FOUND NAME=%s\n", pairs["NAME"])
+				continue
+			}
+			fmt.Fprintf(conn, "NAMING REPLY RESULT=OK NAME=%s VALUE=%s\n", pairs["NAME"], b.pub)
+		case "SESSION CREATE":
+			b.mu.Lock()
+			b.sessions[pairs["ID"]] = conn
+			b.created++
+			b.mu.Unlock()
+			fmt.Fprintf(conn, "SESSION STATUS RESULT=OK DESTINATION=%s\n", b.pub)
+		case "STREAM CONNECT":
+			b.mu.Lock()
+			_, ok := b.sessions[pairs["ID"]]
+			if ok {
+				b.connects++
+				b.streams = append(b.streams, conn)
+			}
+			b.mu.Unlock()
+			if !ok {
+				fmt.Fprintf(conn, "STREAM STATUS RESULT=INVALID_ID\n")
+				_ = conn.Close()
+				return
+			}
+			fmt.Fprintf(conn, "STREAM STATUS RESULT=OK\n")
+			b.proxy(conn, r)
+			return
+		case "STREAM ACCEPT":
+			b.mu.Lock()
+			_, ok := b.sessions[pairs["ID"]]
+			b.mu.Unlock()
+			if !ok {
+				fmt.Fprintf(conn, "STREAM STATUS RESULT=INVALID_ID\n")
+				_ = conn.Close()
+				return
+			}
+			fmt.Fprintf(conn, "STREAM STATUS RESULT=OK\n")
+			b.accepts <- conn
+			return
+		default:
+			b.t.Errorf("unexpected SAM command %q", line)
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// proxy connects the stream to the target, reading what has been sent on the
+// stream through r.
+func (b *testBridge) proxy(conn net.Conn, r io.Reader) {
+	target, err := net.Dial("tcp", b.target)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go func() {
+		_, _ = io.Copy(target, r)
+		_ = target.Close()
+	}()
+	_, _ = io.Copy(conn, target)
+	_ = conn.Close()
+}
+
+// restart forgets every session and drops every connection to the bridge, as
+// a bridge which restarts does.
+func (b *testBridge) restart() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, conn := range b.sessions {
+		_ = conn.Close()
+		delete(b.sessions, id)
+	}
+	for _, conn := range b.streams {
+		_ = conn.Close()
+	}
+	b.streams = nil
+}
+
+func (b *testBridge) counts() (created, connects int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.created, b.connects
+}
+
+func newDialerTest(t *testing.T) (*testBridge, *Dialer, *http.Client, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	bridge := newTestBridge(t, server.Listener.Addr().String())
+	dialer := NewDialer(bridge.listener.Addr().String())
+	client := &http.Client{Transport: NewFederationTripper(dialer).i2p}
+	return bridge, dialer, client, func() {
+		_ = dialer.Close()
+		_ = bridge.listener.Close()
+		server.Close()
+	}
+}
+
+func get(t *testing.T, client *http.Client) {
+	resp, err := client.Get("http://example.b32.i2p/")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+func TestDialerReusesSessionAndStreams(t *testing.T) {
+	bridge, _, client, cleanup := newDialerTest(t)
+	defer cleanup()
+	for i := 0; i < 3; i++ {
+		get(t, client)
+	}
+	if created, connects := bridge.counts(); created != 1 || connects != 1 {
+		t.Errorf("expected one session and one stream for three requests, got %d sessions and %d streams", created, connects)
+	}
+}
+
+func TestDialerRecreatesDroppedSession(t *testing.T) {
+	bridge, _, client, cleanup := newDialerTest(t)
+	defer cleanup()
+	get(t, client)
+	bridge.restart()
+	get(t, client)
+	if created, _ := bridge.counts(); created != 2 {
+		t.Errorf("expected the session to be created again after the bridge restarted, got %d sessions", created)
+	}
+}
+
+func TestDialerLimitsStreamsPerHost(t *testing.T) {
+	_, dialer, _, cleanup := newDialerTest(t)
+	defer cleanup()
+	dialer.maxStreamsPerHost = 1
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "example.b32.i2p:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = dialer.DialContext(ctx, "tcp", "example.b32.i2p:80"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the second stream to wait for the first to close, got %v", err)
+	}
+	other, err := dialer.DialContext(context.Background(), "tcp", "other.b32.i2p:80")
+	if err != nil {
+		t.Fatalf("expected a stream to another host to be opened, got %v", err)
+	}
+	_ = other.Close()
+	_ = conn.Close()
+	if conn, err = dialer.DialContext(context.Background(), "tcp", "example.b32.i2p:80"); err != nil {
+		t.Fatalf("expected a stream to be opened once the first closed, got %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestDialerOnlyDialsTCP(t *testing.T) {
+	_, dialer, _, cleanup := newDialerTest(t)
+	defer cleanup()
+	if _, err := dialer.DialContext(context.Background(), "udp", "example.b32.i2p:80"); err == nil {
+		t.Fatalf("expected dialling over udp to fail")
+	}
+	conn, err := dialer.DialContext(context.Background(), "i2p", "example.b32.i2p:80")
+	if err != nil {
+		t.Fatalf("expected dialling over i2p to work, got %v", err)
+	}
+	if remote := conn.RemoteAddr().String(); remote != "example.b32.i2p" {
+		t.Errorf("expected the remote address to be the host without a port, got %q", remote)
+	}
+	_ = conn.Close()
+}
+
+func TestDialerNeedsNamesInTheAddressBook(t *testing.T) {
+	bridge, dialer, _, cleanup := newDialerTest(t)
+	defer cleanup()
+	_, err := dialer.DialContext(context.Background(), "tcp", "server.unknown.i2p:80")
+	if err == nil || !strings.Contains(err.Error(), "not in the address book") {
+		t.Fatalf("expected the name not to be in the address book, got %v", err)
+	}
+	if _, connects := bridge.counts(); connects != 0 {
+		t.Errorf("expected no stream to be opened, got %d", connects)
+	}
+}
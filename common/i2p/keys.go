@@ -0,0 +1,160 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package i2p
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// i2pBase64 is the modified base64 alphabet used by I2P, which replaces "+"
+// and "/" with "-" and "~".
+var i2pBase64 = base64.NewEncoding(
+	"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~",
+)
+
+// b32Encoding is the lowercase unpadded base32 used for .b32.i2p hostnames.
+var b32Encoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// Suffix is the top level domain of all I2P hostnames.
+const Suffix = ".i2p"
+
+// b32Suffix is the suffix of hostnames derived from a destination hash.
+const b32Suffix = ".b32.i2p"
+
+// Keys are the public and private halves of an I2P destination, both in the
+// I2P base64 encoding that the SAM bridge speaks.
+type Keys struct {
+	Public  string
+	Private string
+}
+
+// Addr returns the base32 address of the destination.
+func (k *Keys) Addr() Addr {
+	addr, err := Base32(k.Public)
+	if err != nil {
+		// The public key came from the SAM bridge or from a file we wrote
+		// ourselves, so it not decoding is a programming error.
+		panic(err)
+	}
+	return addr
+}
+
+// GenerateKeys asks the SAM bridge at samAddr to generate a new destination.
+func GenerateKeys(samAddr string) (*Keys, error) {
+	conn, err := dialBridge(context.Background(), samAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() // nolint: errcheck
+	reply, err := conn.command("DEST GENERATE SIGNATURE_TYPE=%s", signatureType)
+	if err != nil {
+		return nil, err
+	}
+	pub, priv := reply.Pairs["PUB"], reply.Pairs["PRIV"]
+	if pub == "" || priv == "" {
+		return nil, fmt.Errorf("i2p: SAM bridge did not return a destination")
+	}
+	return &Keys{Public: pub, Private: priv}, nil
+}
+
+// LoadOrGenerateKeys reads destination keys from path. If no file exists at
+// path then new keys are generated by the SAM bridge and written there, so
+// that the destination remains stable across restarts.
+func LoadOrGenerateKeys(samAddr, path string) (*Keys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return parseKeys(path, data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	keys, err := GenerateKeys(samAddr)
+	if err != nil {
+		return nil, err
+	}
+	data = []byte(keys.Public + "\n" + keys.Private + "\n")
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// parseKeys parses a keys file, which holds the public destination on the
+// first line and the private keys on the second.
+func parseKeys(path string, data []byte) (*Keys, error) {
+	lines := strings.Fields(string(data))
+	if len(lines) != 2 {
+		return nil, fmt.Errorf("i2p: malformed keys file %q", path)
+	}
+	keys := &Keys{Public: lines[0], Private: lines[1]}
+	if _, err := Base32(keys.Public); err != nil {
+		return nil, fmt.Errorf("i2p: malformed keys file %q: %w", path, err)
+	}
+	return keys, nil
+}
+
+// Base32 returns the base32 address of the given base64 public destination.
+func Base32(destination string) (Addr, error) {
+	raw, err := i2pBase64.DecodeString(destination)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(raw)
+	return Addr(b32Encoding.EncodeToString(hash[:]) + b32Suffix), nil
+}
+
+// Addr is the base32 hostname of an I2P destination, e.g.
+// "ukeu3k5oycgaauneqgtnvselmt4yemvoilkln7jpvamvfx7dnkdq.b32.i2p".
+// It implements net.Addr.
+type Addr string
+
+// Network implements net.Addr.
+func (a Addr) Network() string {
+	return "i2p"
+}
+
+// String implements net.Addr.
+func (a Addr) String() string {
+	return string(a)
+}
+
+// IsI2PHost returns true if the given host, which may include a port, is an
+// I2P hostname.
+func IsI2PHost(host string) bool {
+	host = strings.ToLower(stripPort(host))
+	return strings.HasSuffix(host, Suffix)
+}
+
+// IsB32Host returns true if the given host, which may include a port, is a
+// base32 I2P hostname that can be resolved without an address book.
+func IsB32Host(host string) bool {
+	host = strings.ToLower(stripPort(host))
+	return strings.HasSuffix(host, b32Suffix)
+}
+
+// stripPort removes a port, if any, from a host.
+func stripPort(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i != -1 && !strings.Contains(host[i:], "]") {
+		return host[:i]
+	}
+	return host
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package i2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// noDeadline clears a deadline set on a net.Conn.
+var noDeadline = time.Time{}
+
+// errListenerClosed is returned by Accept once the listener has been closed.
+var errListenerClosed = errors.New("i2p: listener closed")
+
+// Conn is a single I2P stream.
+type Conn struct {
+	*bridgeConn
+	localAddr  Addr
+	remoteAddr Addr
+}
+
+// LocalAddr implements net.Conn.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// RemoteAddr implements net.Conn.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// Listener accepts incoming streams to a session's destination.
+// It implements net.Listener so that it can be handed to http.Server.Serve.
+type Listener struct {
+	session *StreamSession
+	mu      sync.Mutex
+	pending *bridgeConn
+	closed  bool
+}
+
+// Listen returns a listener for incoming streams to the session.
+func (s *StreamSession) Listen() (*Listener, error) {
+	return &Listener{session: s}, nil
+}
+
+// Accept implements net.Listener. It blocks until a remote destination
+// connects to the session.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.accept()
+	if err == nil {
+		return conn, nil
+	}
+	if l.isClosed() {
+		return nil, errListenerClosed
+	}
+	// A failed STREAM ACCEPT is usually transient, e.g. the bridge dropping
+	// a stream before the remote address was sent. Returning a temporary
+	// error tells http.Server to back off and retry.
+	return nil, &temporaryError{err}
+}
+
+func (l *Listener) accept() (*Conn, error) {
+	conn, err := dialBridge(context.Background(), l.session.samAddr)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		_ = conn.Close()
+		return nil, errListenerClosed
+	}
+	l.pending = conn
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.pending = nil
+		l.mu.Unlock()
+	}()
+
+	reply, err := conn.command("STREAM ACCEPT ID=%s SILENT=false", l.session.id)
+	if err == nil {
+		err = reply.err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	// Once a remote destination connects, the bridge sends its base64
+	// destination (optionally followed by FROM_PORT and TO_PORT) on a line
+	// of its own before the stream data begins.
+	line, err := conn.readLine()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		_ = conn.Close()
+		return nil, fmt.Errorf("i2p: missing remote destination on accepted stream")
+	}
+	remote, err := Base32(fields[0])
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &Conn{
+		bridgeConn: conn,
+		localAddr:  l.session.Addr(),
+		remoteAddr: remote,
+	}, nil
+}
+
+func (l *Listener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// Close implements net.Listener. It aborts any Accept that is in progress but
+// does not close the underlying session.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.pending != nil {
+		return l.pending.Close()
+	}
+	return nil
+}
+
+// Addr implements net.Listener.
+func (l *Listener) Addr() net.Addr {
+	return l.session.Addr()
+}
+
+// temporaryError wraps an error so that it satisfies the Temporary() check
+// that http.Server uses to decide whether to keep accepting.
+type temporaryError struct {
+	error
+}
+
+func (e *temporaryError) Temporary() bool { return true }
+func (e *temporaryError) Timeout() bool   { return false }
@@ -0,0 +1,158 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package i2p
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newListenerTest(t *testing.T) (*testBridge, *StreamSession, *Listener, func()) {
+	bridge := newTestBridge(t, "")
+	samAddr := bridge.listener.Addr().String()
+	keys, err := GenerateKeys(samAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := NewStreamSession(samAddr, "dendrite-test", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := session.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bridge, session, listener, func() {
+		_ = listener.Close()
+		_ = session.Close()
+		_ = bridge.listener.Close()
+	}
+}
+
+// connect waits for the listener to accept on the bridge, then connects a
+// remote destination to it, returning the remote end of the stream.
+func (b *testBridge) connect(t *testing.T) net.Conn {
+	select {
+	case conn := <-b.accepts:
+		fmt.Fprintf(conn, "%s FROM_PORT=0 TO_PORT=0\n", b.pub)
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the listener to accept")
+		return nil
+	}
+}
+
+func TestListenerServesHTTP(t *testing.T) {
+	bridge, session, listener, cleanup := newListenerTest(t)
+	defer cleanup()
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(req.RemoteAddr))
+	})}
+	go server.Serve(listener) // nolint: errcheck
+	defer server.Close()      // nolint: errcheck
+
+	conn := bridge.connect(t)
+	defer conn.Close() // nolint: errcheck
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", session.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := Base32(bridge.pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != remote.String() {
+		t.Errorf("expected the remote address to be %s, got %s", remote, body)
+	}
+	if listener.Addr() != session.Addr() {
+		t.Errorf("expected the listener to be on %s, got %s", session.Addr(), listener.Addr())
+	}
+}
+
+func TestListenerCloseAbortsAccept(t *testing.T) {
+	bridge, _, listener, cleanup := newListenerTest(t)
+	defer cleanup()
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		accepted <- err
+	}()
+	// Wait for the accept to reach the bridge before closing.
+	conn := <-bridge.accepts
+	defer conn.Close() // nolint: errcheck
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-accepted:
+		if err != errListenerClosed {
+			t.Errorf("expected the accept to fail with %v, got %v", errListenerClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected closing the listener to abort the accept")
+	}
+}
+
+func TestKeysPersistAcrossRestarts(t *testing.T) {
+	bridge := newTestBridge(t, "")
+	defer bridge.listener.Close() // nolint: errcheck
+	dir, err := ioutil.TempDir("", "i2p-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "keys.dat")
+
+	keys, err := LoadOrGenerateKeys(bridge.listener.Addr().String(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrGenerateKeys(bridge.listener.Addr().String(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *loaded != *keys {
+		t.Errorf("expected the keys to be loaded from %s, got %+v", path, loaded)
+	}
+	if bridge.generated != 1 {
+		t.Errorf("expected keys to be generated once, got %d", bridge.generated)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the keys file to be private, got %v", info.Mode())
+	}
+
+	if err = ioutil.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadOrGenerateKeys(bridge.listener.Addr().String(), path); err == nil {
+		t.Errorf("expected a malformed keys file to be refused")
+	}
+}
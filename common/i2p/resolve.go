@@ -0,0 +1,269 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package i2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	// How long to cache a well-known response that has no usable
+	// Cache-Control header.
+	defaultWellKnownTTL = 24 * time.Hour
+	// The longest we will cache a well-known response for, regardless of
+	// what Cache-Control says.
+	maxWellKnownTTL = 48 * time.Hour
+	// How long to remember that a server has no well-known.
+	wellKnownErrorTTL = time.Hour
+	// How long to remember that the well-known of a server couldn't be
+	// fetched, because it or the network was down. This is short so that an
+	// outage of the SAM bridge or the DNS doesn't outlast itself.
+	wellKnownRetryTTL = 2 * time.Minute
+	// The most we will read of a well-known response.
+	maxWellKnownSize = 50 * 1024
+)
+
+// errNoWellKnown is returned when a server doesn't delegate with well-known.
+var errNoWellKnown = errors.New("no .well-known found")
+
+// ResolutionResult is the result of resolving a server name.
+type ResolutionResult struct {
+	// The host and port to send federation requests to. For I2P results
+	// this is the I2P hostname.
+	Destination string
+	// The value of the Host header.
+	Host gomatrixserverlib.ServerName
+	// The TLS server name to request a certificate for. Unused for I2P
+	// results.
+	TLSServerName string
+	// Whether the destination must be dialled over I2P.
+	I2P bool
+}
+
+// Resolver implements the server name resolution algorithm from
+// https://matrix.org/docs/spec/server_server/r0.1.3#resolving-server-names
+// extended to I2P server names. A .well-known on either network may delegate
+// to a server on the other. There is no SRV step for I2P server names.
+type Resolver struct {
+	// Used to fetch .well-known files from clearnet servers.
+	clearnet *http.Client
+	// Used to fetch .well-known files from I2P servers.
+	i2p *http.Client
+	// Used to look up SRV records for clearnet servers.
+	lookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	// Returns the current time.
+	now func() time.Time
+
+	cacheMutex sync.Mutex
+	cache      map[gomatrixserverlib.ServerName]wellKnownEntry
+}
+
+// wellKnownEntry is a cached .well-known lookup.
+type wellKnownEntry struct {
+	delegated gomatrixserverlib.ServerName
+	err       error
+	expires   time.Time
+}
+
+// NewResolver creates a resolver which fetches .well-known files from I2P
+// servers through the given transport.
+func NewResolver(i2pTransport http.RoundTripper) *Resolver {
+	return &Resolver{
+		clearnet:  &http.Client{Timeout: 30 * time.Second},
+		i2p:       &http.Client{Timeout: 2 * time.Minute, Transport: i2pTransport},
+		lookupSRV: net.DefaultResolver.LookupSRV,
+		now:       time.Now,
+		cache:     make(map[gomatrixserverlib.ServerName]wellKnownEntry),
+	}
+}
+
+// Resolve returns the places to send federation requests for serverName to,
+// in the order they should be tried.
+func (r *Resolver) Resolve(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]ResolutionResult, error) {
+	return r.resolve(ctx, serverName, true)
+}
+
+func (r *Resolver) resolve(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, checkWellKnown bool,
+) ([]ResolutionResult, error) {
+	host, port, valid := gomatrixserverlib.ParseAndValidateServerName(serverName)
+	if !valid {
+		return nil, fmt.Errorf("invalid server name %q", serverName)
+	}
+	isI2P := IsI2PHost(host)
+
+	// 1. If the hostname is an IP literal, or
+	// 2. if the hostname includes an explicit port, use it as is.
+	literal := strings.Trim(host, "[]")
+	if net.ParseIP(literal) != nil || port != -1 {
+		destination := string(serverName)
+		if port == -1 {
+			destination = net.JoinHostPort(literal, "8448")
+		}
+		return []ResolutionResult{{
+			Destination:   destination,
+			Host:          serverName,
+			TLSServerName: literal,
+			I2P:           isI2P,
+		}}, nil
+	}
+
+	// 3. Look up a .well-known file, which may delegate to a server on
+	// either network. We don't check .well-known on the delegated server.
+	if checkWellKnown {
+		delegated, err := r.lookupWellKnown(ctx, serverName)
+		if err == nil {
+			return r.resolve(ctx, delegated, false)
+		}
+	}
+
+	// There are no SRV records in I2P, so just talk to the destination.
+	if isI2P {
+		return []ResolutionResult{{
+			Destination: host,
+			Host:        serverName,
+			I2P:         true,
+		}}, nil
+	}
+
+	// 4. Look up a SRV record.
+	_, records, err := r.lookupSRV(ctx, "matrix", "tcp", host)
+	if err == nil && len(records) > 0 {
+		results := make([]ResolutionResult, 0, len(records))
+		for _, rec := range records {
+			target := strings.TrimSuffix(rec.Target, ".")
+			results = append(results, ResolutionResult{
+				Destination:   net.JoinHostPort(target, strconv.Itoa(int(rec.Port))),
+				Host:          serverName,
+				TLSServerName: host,
+				// A SRV record in the DNS may still point into I2P.
+				I2P: IsI2PHost(target),
+			})
+		}
+		return results, nil
+	}
+
+	// 5. Fall back to port 8448.
+	return []ResolutionResult{{
+		Destination:   net.JoinHostPort(host, "8448"),
+		Host:          serverName,
+		TLSServerName: host,
+	}}, nil
+}
+
+// lookupWellKnown returns the server that serverName delegates to, using a
+// cached response if there is one.
+func (r *Resolver) lookupWellKnown(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (gomatrixserverlib.ServerName, error) {
+	now := r.now()
+	r.cacheMutex.Lock()
+	entry, ok := r.cache[serverName]
+	r.cacheMutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.delegated, entry.err
+	}
+
+	delegated, ttl, err := r.fetchWellKnown(ctx, serverName)
+	if ttl > 0 {
+		r.cacheMutex.Lock()
+		r.cache[serverName] = wellKnownEntry{
+			delegated: delegated,
+			err:       err,
+			expires:   now.Add(ttl),
+		}
+		r.cacheMutex.Unlock()
+	}
+	return delegated, err
+}
+
+// fetchWellKnown requests the .well-known file of serverName, returning the
+// delegated server name and how long the response may be cached for. If there
+// is no usable well-known then the time is how long to remember that for,
+// which is short unless the server itself said that there is none.
+func (r *Resolver) fetchWellKnown(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (gomatrixserverlib.ServerName, time.Duration, error) {
+	client, scheme := r.clearnet, "https"
+	if IsI2PHost(string(serverName)) {
+		client, scheme = r.i2p, "http"
+	}
+	req, err := http.NewRequest(
+		http.MethodGet, scheme+"://"+string(serverName)+"/.well-known/matrix/server", nil,
+	)
+	if err != nil {
+		return "", wellKnownErrorTTL, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", wellKnownRetryTTL, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return "", wellKnownRetryTTL, fmt.Errorf("well-known request failed with status %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", wellKnownErrorTTL, errNoWellKnown
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxWellKnownSize))
+	if err != nil {
+		return "", wellKnownRetryTTL, err
+	}
+	var wellKnown gomatrixserverlib.WellKnownResult
+	if err = json.Unmarshal(body, &wellKnown); err != nil {
+		return "", wellKnownErrorTTL, err
+	}
+	if wellKnown.NewAddress == "" {
+		return "", wellKnownErrorTTL, errors.New("no m.server key found in well-known response")
+	}
+	return wellKnown.NewAddress, cacheTTL(resp.Header), nil
+}
+
+// cacheTTL returns how long a response with the given headers may be cached
+// for, according to its Cache-Control header.
+func cacheTTL(header http.Header) time.Duration {
+	ttl := defaultWellKnownTTL
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil && seconds >= 0 {
+				ttl = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	if ttl > maxWellKnownTTL {
+		ttl = maxWellKnownTTL
+	}
+	return ttl
+}
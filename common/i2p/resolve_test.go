@@ -0,0 +1,207 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package i2p
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// newTestTripper returns a FederationTripper whose clearnet requests all go
+// to wellKnownServer and whose I2P requests all go to i2pServer. The function
+// returned gives the addresses that were dialled over I2P.
+func newTestTripper(
+	t *testing.T, wellKnownServer, i2pServer *httptest.Server,
+) (*FederationTripper, func() []string) {
+	var dialled []string
+	var d net.Dialer
+	i2pTransport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialled = append(dialled, addr)
+			return d.DialContext(ctx, "tcp", i2pServer.Listener.Addr().String())
+		},
+	}
+	resolver := NewResolver(i2pTransport)
+	resolver.clearnet = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", wellKnownServer.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // nolint: gosec
+	}}
+	resolver.lookupSRV = func(context.Context, string, string, string) (string, []*net.SRV, error) {
+		t.Fatal("SRV records should not be looked up")
+		return "", nil, nil
+	}
+	return &FederationTripper{
+		i2p:        i2pTransport,
+		resolver:   resolver,
+		transports: make(map[string]http.RoundTripper),
+	}, func() []string { return dialled }
+}
+
+func TestClearnetDelegatesToI2P(t *testing.T) {
+	var wellKnownRequests int32
+	wellKnownServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&wellKnownRequests, 1)
+		if req.URL.Path != "/.well-known/matrix/server" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write([]byte(`{"m.server":"example.b32.i2p"}`))
+	}))
+	defer wellKnownServer.Close()
+
+	var gotHost string
+	i2pServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotHost = req.Host
+		_, _ = w.Write([]byte(`{"server":{"name":"Dendrite"}}`))
+	}))
+	defer i2pServer.Close()
+
+	tripper, dialled := newTestTripper(t, wellKnownServer, i2pServer)
+
+	results, err := tripper.resolver.Resolve(context.Background(), "example.org")
+	if err != nil {
+		t.Fatalf("Resolve failed: %s", err)
+	}
+	if len(results) != 1 || !results[0].I2P || results[0].Destination != "example.b32.i2p" {
+		t.Fatalf("expected a single I2P result for example.b32.i2p, got %+v", results)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "matrix://example.org/_matrix/federation/v1/version", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tripper.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %s", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", resp.StatusCode)
+	}
+	if got := dialled(); len(got) != 1 || got[0] != "example.b32.i2p:80" {
+		t.Fatalf("expected the request to be dialled over SAM to example.b32.i2p:80, dialled %v", got)
+	}
+	if gotHost != "example.b32.i2p" {
+		t.Errorf("expected Host header example.b32.i2p, got %q", gotHost)
+	}
+	if n := atomic.LoadInt32(&wellKnownRequests); n != 1 {
+		t.Errorf("expected the well-known to be fetched once and then cached, fetched %d times", n)
+	}
+}
+
+func TestI2PDelegatesToI2P(t *testing.T) {
+	var paths []string
+	i2pServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.Host+req.URL.Path)
+		if req.URL.Path == "/.well-known/matrix/server" {
+			_, _ = w.Write([]byte(`{"m.server":"matrix.b32.i2p"}`))
+		}
+	}))
+	defer i2pServer.Close()
+
+	tripper, _ := newTestTripper(t, nil, i2pServer)
+	results, err := tripper.resolver.Resolve(context.Background(), "example.i2p")
+	if err != nil {
+		t.Fatalf("Resolve failed: %s", err)
+	}
+	if len(results) != 1 || !results[0].I2P || results[0].Destination != "matrix.b32.i2p" {
+		t.Fatalf("expected a single I2P result for matrix.b32.i2p, got %+v", results)
+	}
+	if len(paths) != 1 || paths[0] != "example.i2p/.well-known/matrix/server" {
+		t.Fatalf("expected the well-known to be fetched over I2P, got %v", paths)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		want         time.Duration
+	}{
+		{"", defaultWellKnownTTL},
+		{"max-age=600", 10 * time.Minute},
+		{"public, max-age=60", time.Minute},
+		{"max-age=31536000", maxWellKnownTTL},
+		{"no-store", 0},
+		{"max-age=bogus", defaultWellKnownTTL},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		header.Set("Cache-Control", tt.cacheControl)
+		if got := cacheTTL(header); got != tt.want {
+			t.Errorf("cacheTTL(%q) = %s, want %s", tt.cacheControl, got, tt.want)
+		}
+	}
+}
+
+func TestExplicitPortSkipsWellKnown(t *testing.T) {
+	resolver := NewResolver(nil)
+	results, err := resolver.Resolve(context.Background(), gomatrixserverlib.ServerName("example.b32.i2p:8448"))
+	if err != nil {
+		t.Fatalf("Resolve failed: %s", err)
+	}
+	if len(results) != 1 || !results[0].I2P || results[0].Destination != "example.b32.i2p:8448" {
+		t.Fatalf("expected a single I2P result, got %+v", results)
+	}
+}
+
+func TestWellKnownFailuresAreCachedBriefly(t *testing.T) {
+	down := true
+	i2pServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer i2pServer.Close()
+	var d net.Dialer
+	resolver := NewResolver(&http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if down {
+				return nil, errors.New("the SAM bridge is down")
+			}
+			return d.DialContext(ctx, "tcp", i2pServer.Listener.Addr().String())
+		},
+	})
+	now := time.Now()
+	resolver.now = func() time.Time { return now }
+
+	// While the SAM bridge is down the failure is only remembered briefly.
+	if _, err := resolver.Resolve(context.Background(), "example.i2p"); err != nil {
+		t.Fatalf("Resolve failed: %s", err)
+	}
+	if expires := resolver.cache["example.i2p"].expires; !expires.Equal(now.Add(wellKnownRetryTTL)) {
+		t.Fatalf("expected the failure to be cached for %s, cached until %s", wellKnownRetryTTL, expires)
+	}
+
+	// Once it is up again the well-known is fetched again, and the server
+	// saying there is none is remembered for longer.
+	down = false
+	now = now.Add(wellKnownRetryTTL)
+	if _, err := resolver.Resolve(context.Background(), "example.i2p"); err != nil {
+		t.Fatalf("Resolve failed: %s", err)
+	}
+	if expires := resolver.cache["example.i2p"].expires; !expires.Equal(now.Add(wellKnownErrorTTL)) {
+		t.Errorf("expected the missing well-known to be cached for %s, cached until %s", wellKnownErrorTTL, expires)
+	}
+}
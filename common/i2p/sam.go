@@ -0,0 +1,248 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package i2p implements the small subset of the SAM v3 protocol that dendrite
+// needs in order to serve and federate over I2P streaming sessions.
+// See https://geti2p.net/en/docs/api/samv3 for the protocol specification.
+package i2p
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// DefaultSAMAddress is the address that SAM bridges listen on by default.
+const DefaultSAMAddress = "127.0.0.1:7656"
+
+// The lowest and highest SAM versions that we know how to speak.
+const (
+	samMinVersion = "3.0"
+	samMaxVersion = "3.1"
+)
+
+// signatureType is the destination signature type we ask the bridge to use
+// for newly generated keys. 7 is EdDSA-SHA512-Ed25519.
+const signatureType = "7"
+
+// bridgeConn is a connection to a SAM bridge that has completed the HELLO
+// handshake. Replies from the bridge are read through a buffered reader, so
+// anything that wants to read the connection after a command has been issued
+// must use bridgeConn.Read rather than the underlying net.Conn.
+type bridgeConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements io.Reader, draining any data already buffered while reading
+// SAM replies before reading from the underlying connection.
+func (c *bridgeConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// dialBridge opens a new connection to the SAM bridge at samAddr and performs
+// the HELLO version handshake on it.
+func dialBridge(ctx context.Context, samAddr string) (*bridgeConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", samAddr)
+	if err != nil {
+		return nil, err
+	}
+	c := &bridgeConn{Conn: conn, r: bufio.NewReader(conn)}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	reply, err := c.command("HELLO VERSION MIN=%s MAX=%s", samMinVersion, samMaxVersion)
+	if err == nil {
+		err = reply.err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("i2p: SAM handshake with %s failed: %w", samAddr, err)
+	}
+	_ = conn.SetDeadline(noDeadline)
+	return c, nil
+}
+
+// CheckBridge checks that the SAM bridge at samAddr is up, by opening a
+// connection to it and completing the HELLO handshake.
+func CheckBridge(ctx context.Context, samAddr string) error {
+	c, err := dialBridge(ctx, samAddr)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// command writes a single SAM command line to the bridge and reads its reply.
+func (c *bridgeConn) command(format string, args ...interface{}) (*reply, error) {
+	if _, err := fmt.Fprintf(c.Conn, format+"\n", args...); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply reads and parses a single reply line from the bridge.
+func (c *bridgeConn) readReply() (*reply, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	return parseReply(line)
+}
+
+// readLine reads a single newline-terminated line from the bridge.
+func (c *bridgeConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// reply is a parsed SAM reply line, e.g. "HELLO REPLY RESULT=OK VERSION=3.1".
+type reply struct {
+	Topic string
+	Type  string
+	Pairs map[string]string
+}
+
+// parseReply parses a line received from the SAM bridge.
+func parseReply(line string) (*reply, error) {
+	fields := splitFields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("i2p: malformed SAM reply %q", line)
+	}
+	r := &reply{
+		Topic: fields[0],
+		Type:  fields[1],
+		Pairs: make(map[string]string, len(fields)-2),
+	}
+	for _, field := range fields[2:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 {
+			r.Pairs[kv[0]] = strings.Trim(kv[1], `"`)
+		} else {
+			r.Pairs[kv[0]] = ""
+		}
+	}
+	return r, nil
+}
+
+// splitFields splits a SAM line on spaces, keeping double-quoted values,
+// such as MESSAGE="Some error", together.
+func splitFields(line string) []string {
+	var fields []string
+	var current strings.Builder
+	quoted := false
+	for _, ch := range line {
+		switch {
+		case ch == '"':
+			quoted = !quoted
+			current.WriteRune(ch)
+		case ch == ' ' && !quoted:
+			if current.Len() > 0 {
+				fields = append(fields, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(ch)
+		}
+	}
+	if current.Len() > 0 {
+		fields = append(fields, current.String())
+	}
+	return fields
+}
+
+// err returns an error if the reply does not indicate success.
+func (r *reply) err() error {
+	result := r.Pairs["RESULT"]
+	if result == "OK" {
+		return nil
+	}
+	if msg, ok := r.Pairs["MESSAGE"]; ok {
+		return fmt.Errorf("i2p: %s %s: %s: %s", r.Topic, r.Type, result, msg)
+	}
+	return fmt.Errorf("i2p: %s %s: %s", r.Topic, r.Type, result)
+}
+
+// StreamSession is a SAM v3 STREAM session. The session remains open for as
+// long as its control connection to the bridge is held open, and is used both
+// to accept incoming streams with Listen and to open outgoing ones with Dial.
+type StreamSession struct {
+	samAddr string
+	id      string
+	keys    *Keys
+	control *bridgeConn
+	closeMu sync.Mutex
+	closed  bool
+}
+
+// NewStreamSession creates a new STREAM session with the given ID on the SAM
+// bridge at samAddr, using keys as the session's destination. The ID must be
+// unique on the bridge.
+func NewStreamSession(samAddr, id string, keys *Keys) (*StreamSession, error) {
+	control, err := dialBridge(context.Background(), samAddr)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := control.command(
+		"SESSION CREATE STYLE=STREAM ID=%s DESTINATION=%s SIGNATURE_TYPE=%s",
+		id, keys.Private, signatureType,
+	)
+	if err == nil {
+		err = reply.err()
+	}
+	if err != nil {
+		_ = control.Close()
+		return nil, fmt.Errorf("i2p: failed to create session %q: %w", id, err)
+	}
+	return &StreamSession{
+		samAddr: samAddr,
+		id:      id,
+		keys:    keys,
+		control: control,
+	}, nil
+}
+
+// ID returns the SAM session ID.
+func (s *StreamSession) ID() string {
+	return s.id
+}
+
+// Keys returns the destination keys of the session.
+func (s *StreamSession) Keys() *Keys {
+	return s.keys
+}
+
+// Addr returns the base32 address of the session's destination.
+func (s *StreamSession) Addr() Addr {
+	return s.keys.Addr()
+}
+
+// Close tears down the session on the bridge. Any listeners or streams
+// created from the session will stop working.
+func (s *StreamSession) Close() error {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.control.Close()
+}
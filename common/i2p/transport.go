@@ -0,0 +1,152 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package i2p
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// FederationTripper is an http.RoundTripper for "matrix://" URLs. Server
+// names are resolved with a Resolver, so delegation works between I2P and
+// clearnet servers in either direction. Requests to I2P destinations are sent
+// as plain HTTP over SAM streams, see NewTransport, and all other requests are
+// sent over HTTPS.
+type FederationTripper struct {
+	i2p      http.RoundTripper
+	resolver *Resolver
+	// transports maps a TLS server name to an HTTP transport for clearnet
+	// servers.
+	transports      map[string]http.RoundTripper
+	transportsMutex sync.Mutex
+}
+
+// errI2PDisabled is returned when dialling I2P hosts without a Dialer.
+var errI2PDisabled = errors.New("i2p: federation over I2P is not enabled")
+
+// errNotHTTP is returned for requests to I2P hosts which aren't plain HTTP.
+var errNotHTTP = errors.New("i2p: only plain HTTP is supported to I2P hosts")
+
+// NewTransport returns an http.RoundTripper which sends requests to I2P hosts
+// over SAM streams opened with the given dialer. If the dialer is nil then
+// requests fail. Only plain HTTP is supported, on purpose: a stream is already
+// encrypted end-to-end and authenticated by the destination it was opened to,
+// which is what a .b32.i2p hostname is derived from, and I2P hosts can't get
+// certificates from a CA anyway. Requests with any other scheme, including
+// HTTPS, fail instead of trying TLS over the stream.
+func NewTransport(dialer *Dialer) http.RoundTripper {
+	transport := &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return nil, errI2PDisabled
+		},
+		// Opening a stream to a destination takes a few round trips through
+		// the I2P network, so streams are kept open to be reused for as many
+		// requests as possible.
+		MaxIdleConnsPerHost: defaultMaxStreamsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if dialer != nil {
+		transport.DialContext = dialer.DialContext
+	}
+	return httpOnlyTransport{transport}
+}
+
+// httpOnlyTransport refuses requests which aren't plain HTTP.
+type httpOnlyTransport struct {
+	*http.Transport
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t httpOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return nil, fmt.Errorf("%w, not %q", errNotHTTP, req.URL.Scheme)
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+// NewFederationTripper creates a FederationTripper that dials I2P hosts with
+// the given dialer. If the dialer is nil then requests to I2P hosts fail.
+func NewFederationTripper(dialer *Dialer) *FederationTripper {
+	i2pTransport := NewTransport(dialer)
+	return &FederationTripper{
+		i2p:        i2pTransport,
+		resolver:   NewResolver(i2pTransport),
+		transports: make(map[string]http.RoundTripper),
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (f *FederationTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	serverName := gomatrixserverlib.ServerName(r.URL.Host)
+	resolutionResults, err := f.resolver.Resolve(r.Context(), serverName)
+	if err != nil {
+		return nil, err
+	}
+	if len(resolutionResults) == 0 {
+		return nil, fmt.Errorf("no address found for matrix host %v", serverName)
+	}
+
+	var resp *http.Response
+	for _, result := range resolutionResults {
+		req := r.Clone(r.Context())
+		req.Host = string(result.Host)
+		if result.I2P {
+			req.URL.Scheme = "http"
+			req.URL.Host = stripPort(result.Destination)
+			resp, err = f.i2p.RoundTrip(req)
+		} else {
+			req.URL.Scheme = "https"
+			req.URL.Host = result.Destination
+			resp, err = f.getTransport(result.TLSServerName).RoundTrip(req)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		util.GetLogger(r.Context()).Warnf("Error sending request to %s: %v",
+			req.URL.String(), err)
+	}
+
+	// just return the most recent error
+	return nil, err
+}
+
+// getTransport returns a transport using the given server name for SNI,
+// creating it if there isn't one for this server name yet.
+func (f *FederationTripper) getTransport(tlsServerName string) http.RoundTripper {
+	f.transportsMutex.Lock()
+	defer f.transportsMutex.Unlock()
+
+	transport, ok := f.transports[tlsServerName]
+	if !ok {
+		transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName: tlsServerName,
+				// TODO: Remove this when we enforce MSC1711.
+				InsecureSkipVerify: true,
+			},
+		}
+		f.transports[tlsServerName] = transport
+	}
+	return transport
+}
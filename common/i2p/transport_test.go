@@ -0,0 +1,96 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package i2p
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// newTransportTest returns a client which sends "matrix://" URLs through a
+// FederationTripper, whose I2P streams are opened through a test SAM bridge
+// to a server which answers with the Host header of each request it gets.
+func newTransportTest(t *testing.T) (*http.Client, func() []string, func()) {
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		paths = append(paths, req.URL.Path)
+		mu.Unlock()
+		if req.URL.Path == "/.well-known/matrix/server" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(req.Host))
+	}))
+	bridge := newTestBridge(t, server.Listener.Addr().String())
+	dialer := NewDialer(bridge.listener.Addr().String())
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", NewFederationTripper(dialer))
+	requested := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...)
+	}
+	return &http.Client{Transport: tr}, requested, func() {
+		_ = dialer.Close()
+		_ = bridge.listener.Close()
+		server.Close()
+	}
+}
+
+func TestFederationTripperSendsI2PRequestsOverSAM(t *testing.T) {
+	client, requested, cleanup := newTransportTest(t)
+	defer cleanup()
+	resp, err := client.Get("matrix://example.b32.i2p/_matrix/federation/v1/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	host, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(host) != "example.b32.i2p" {
+		t.Errorf("expected 200 OK for host example.b32.i2p, got %d for host %q", resp.StatusCode, host)
+	}
+	// The .well-known file is looked for over I2P before the request is sent.
+	if paths := requested(); len(paths) != 2 || paths[1] != "/_matrix/federation/v1/version" {
+		t.Errorf("expected the .well-known file and then the request, got %v", paths)
+	}
+}
+
+func TestFederationTripperWithoutDialerRefusesI2P(t *testing.T) {
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", NewFederationTripper(nil))
+	client := &http.Client{Transport: tr}
+	_, err := client.Get("matrix://example.b32.i2p:8448/_matrix/federation/v1/version")
+	if !errors.Is(err, errI2PDisabled) {
+		t.Fatalf("expected requests to I2P servers to fail without a dialer, got %v", err)
+	}
+}
+
+func TestTransportRefusesHTTPS(t *testing.T) {
+	// The scheme is refused before anything is dialled.
+	client := &http.Client{Transport: NewTransport(nil)}
+	_, err := client.Get("https://example.b32.i2p/")
+	if !errors.Is(err, errNotHTTP) {
+		t.Fatalf("expected HTTPS requests to I2P hosts to be refused, got %v", err)
+	}
+}
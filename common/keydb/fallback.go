@@ -0,0 +1,193 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keydb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// How many times a key fetcher is asked for keys before moving on to the
+	// next one, if it fails every time.
+	keyFetchAttempts = 3
+	// How long to wait before asking a key fetcher again after it fails the
+	// first time. The wait doubles with each attempt.
+	keyFetchRetryInterval = time.Second
+	// How long the keys which no key fetcher returned aren't asked for again.
+	// It is short, as the servers they belong to may just be unreachable for
+	// a while, which is common over I2P.
+	missingKeyLifetime = time.Minute
+)
+
+// fallbackKeyFetcher asks the perspective servers for keys in turn, retrying
+// each of them with backoff if it fails, and then asks the servers which the
+// keys belong to directly for the keys which are still missing. The keys
+// which none of them returned aren't asked for again for a short while, so
+// that the events of a server which is down don't cause a request for each
+// of them.
+//
+// Keys whose validity period doesn't cover the time they were asked for are
+// passed on to the next key fetcher too, and the one valid for longest is
+// returned if none of them cover it. If a key can't be fetched at all then
+// the stale copy of it kept in the database is returned, if there is one.
+type fallbackKeyFetcher struct {
+	fetchers      []gomatrixserverlib.KeyFetcher
+	stale         *freshKeyDatabase
+	attempts      int
+	retryInterval time.Duration
+	missingFor    time.Duration
+	// The mutex protects missing, which has when each of the keys which
+	// weren't found may be asked for again.
+	mutex   sync.Mutex
+	missing map[gomatrixserverlib.PublicKeyLookupRequest]time.Time
+}
+
+func newFallbackKeyFetcher(fetchers ...gomatrixserverlib.KeyFetcher) *fallbackKeyFetcher {
+	return &fallbackKeyFetcher{
+		fetchers:      fetchers,
+		attempts:      keyFetchAttempts,
+		retryInterval: keyFetchRetryInterval,
+		missingFor:    missingKeyLifetime,
+		missing:       map[gomatrixserverlib.PublicKeyLookupRequest]time.Time{},
+	}
+}
+
+// FetcherName implements KeyFetcher
+func (f *fallbackKeyFetcher) FetcherName() string {
+	return "FallbackKeyFetcher"
+}
+
+// FetchKeys implements KeyFetcher
+func (f *fallbackKeyFetcher) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	remaining := f.notMissing(requests)
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	var lastErr error
+	failed := 0
+	for _, fetcher := range f.fetchers {
+		if len(remaining) == 0 {
+			break
+		}
+		fetched, err := f.fetchWithRetries(ctx, fetcher, remaining)
+		if err != nil {
+			lastErr = err
+			failed++
+			continue
+		}
+		for req, res := range fetched {
+			if prev, ok := results[req]; ok && prev.ValidUntilTS > res.ValidUntilTS {
+				continue
+			}
+			results[req] = res
+			if at, ok := remaining[req]; !ok || keyCovers(res, at) {
+				delete(remaining, req)
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		// The keys may well be found if they are asked for again.
+		return results, ctx.Err()
+	}
+	f.markMissing(remaining)
+	if f.stale != nil {
+		for req, res := range f.stale.staleKeys(requests) {
+			if _, ok := results[req]; !ok {
+				logrus.WithFields(logrus.Fields{
+					"server_name": req.ServerName,
+					"key_id":      req.KeyID,
+				}).Warn("Using a stale key which couldn't be fetched again")
+				results[req] = res
+			}
+		}
+	}
+	if failed == len(f.fetchers) && len(results) == 0 {
+		return nil, lastErr
+	}
+	return results, nil
+}
+
+// fetchWithRetries asks a key fetcher for keys until it answers, waiting
+// longer after each failure, or until it has failed f.attempts times.
+func (f *fallbackKeyFetcher) fetchWithRetries(
+	ctx context.Context, fetcher gomatrixserverlib.KeyFetcher,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	wait := f.retryInterval
+	for attempt := 1; ; attempt++ {
+		fetched, err := fetcher.FetchKeys(ctx, requests)
+		if err == nil {
+			return fetched, nil
+		}
+		logger := logrus.WithError(err).WithFields(logrus.Fields{
+			"fetcher": fetcher.FetcherName(),
+			"attempt": attempt,
+		})
+		if attempt >= f.attempts {
+			logger.Warn("Failed to fetch keys, trying the next key fetcher")
+			return nil, err
+		}
+		logger.Info("Failed to fetch keys, retrying")
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+// notMissing returns the requests for the keys which haven't been found
+// recently.
+func (f *fallbackKeyFetcher) notMissing(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	now := time.Now()
+	result := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(requests))
+	for req, ts := range requests {
+		if until, ok := f.missing[req]; ok && now.Before(until) {
+			continue
+		}
+		delete(f.missing, req)
+		result[req] = ts
+	}
+	return result
+}
+
+// markMissing records that the keys weren't found by any key fetcher.
+func (f *fallbackKeyFetcher) markMissing(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	now := time.Now()
+	for req, until := range f.missing {
+		if !now.Before(until) {
+			delete(f.missing, req)
+		}
+	}
+	until := now.Add(f.missingFor)
+	for req := range requests {
+		f.missing[req] = until
+	}
+}
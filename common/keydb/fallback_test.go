@@ -0,0 +1,190 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keydb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// scriptedKeyFetcher fails the first failures times it is asked for keys,
+// and then returns the keys of the servers in has, valid until validUntil if
+// it is set.
+type scriptedKeyFetcher struct {
+	name       string
+	failures   int
+	has        map[gomatrixserverlib.ServerName]bool
+	validUntil gomatrixserverlib.Timestamp
+	calls      int
+}
+
+func (f *scriptedKeyFetcher) FetcherName() string {
+	return f.name
+}
+
+func (f *scriptedKeyFetcher) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, errors.New(f.name + " is unavailable")
+	}
+	validUntil := f.validUntil
+	if validUntil == 0 {
+		validUntil = 1 << 50
+	}
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		if f.has[req.ServerName] {
+			results[req] = gomatrixserverlib.PublicKeyLookupResult{
+				VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64String(f.name)},
+				ValidUntilTS: validUntil,
+			}
+		}
+	}
+	return results, nil
+}
+
+func newTestFallbackKeyFetcher(fetchers ...gomatrixserverlib.KeyFetcher) *fallbackKeyFetcher {
+	f := newFallbackKeyFetcher(fetchers...)
+	f.retryInterval = time.Millisecond
+	return f
+}
+
+func keyRequests(serverNames ...gomatrixserverlib.ServerName) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp {
+	requests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for _, serverName := range serverNames {
+		requests[gomatrixserverlib.PublicKeyLookupRequest{ServerName: serverName, KeyID: "ed25519:auto"}] = 0
+	}
+	return requests
+}
+
+func fetchedFrom(
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+	serverName gomatrixserverlib.ServerName,
+) string {
+	return string(results[gomatrixserverlib.PublicKeyLookupRequest{ServerName: serverName, KeyID: "ed25519:auto"}].Key)
+}
+
+func TestFailingPerspectiveFallsBackToTheNext(t *testing.T) {
+	all := map[gomatrixserverlib.ServerName]bool{"a.example.com": true, "b.example.com": true}
+	primary := &scriptedKeyFetcher{name: "primary", failures: 100, has: all}
+	secondary := &scriptedKeyFetcher{name: "secondary", has: all}
+	direct := &scriptedKeyFetcher{name: "direct", has: all}
+	f := newTestFallbackKeyFetcher(primary, secondary, direct)
+
+	results, err := f.FetchKeys(context.Background(), keyRequests("a.example.com", "b.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if primary.calls != keyFetchAttempts {
+		t.Errorf("expected the primary perspective to be tried %d times, got %d", keyFetchAttempts, primary.calls)
+	}
+	if fetchedFrom(results, "a.example.com") != "secondary" || fetchedFrom(results, "b.example.com") != "secondary" {
+		t.Errorf("expected the keys to come from the secondary perspective, got %v", results)
+	}
+	if direct.calls != 0 {
+		t.Errorf("expected the servers not to be asked directly, got %d calls", direct.calls)
+	}
+}
+
+func TestPerspectiveIsRetriedAfterTransientFailure(t *testing.T) {
+	all := map[gomatrixserverlib.ServerName]bool{"a.example.com": true}
+	primary := &scriptedKeyFetcher{name: "primary", failures: 1, has: all}
+	secondary := &scriptedKeyFetcher{name: "secondary", has: all}
+	f := newTestFallbackKeyFetcher(primary, secondary)
+
+	results, err := f.FetchKeys(context.Background(), keyRequests("a.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := fetchedFrom(results, "a.example.com"); from != "primary" || secondary.calls != 0 {
+		t.Errorf("expected the key to come from the primary perspective when retried, got it from %q", from)
+	}
+}
+
+func TestMissingKeysFallBackToDirectFetch(t *testing.T) {
+	primary := &scriptedKeyFetcher{name: "primary", failures: 100}
+	// The secondary perspective can't reach the I2P server.
+	secondary := &scriptedKeyFetcher{name: "secondary", has: map[gomatrixserverlib.ServerName]bool{"a.example.com": true}}
+	direct := &scriptedKeyFetcher{name: "direct", has: map[gomatrixserverlib.ServerName]bool{"peer.b32.i2p": true}}
+	f := newTestFallbackKeyFetcher(primary, secondary, direct)
+
+	results, err := f.FetchKeys(context.Background(), keyRequests("a.example.com", "peer.b32.i2p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetchedFrom(results, "a.example.com") != "secondary" || fetchedFrom(results, "peer.b32.i2p") != "direct" {
+		t.Errorf("expected the I2P key to be fetched directly, got %v", results)
+	}
+}
+
+func TestMissingKeysAreNotAskedForAgainStraightAway(t *testing.T) {
+	direct := &scriptedKeyFetcher{name: "direct", failures: 100}
+	f := newTestFallbackKeyFetcher(direct)
+	for i := 0; i < 2; i++ {
+		if _, err := f.FetchKeys(context.Background(), keyRequests("down.example.com")); i == 0 && err == nil {
+			t.Error("expected an error when every key fetcher fails")
+		}
+	}
+	if direct.calls != keyFetchAttempts {
+		t.Errorf("expected the server to only be asked for the key the first time, got %d calls", direct.calls)
+	}
+
+	// Once the key has been missing for long enough it is asked for again.
+	for req := range f.missing {
+		f.missing[req] = time.Now()
+	}
+	if _, err := f.FetchKeys(context.Background(), keyRequests("down.example.com")); err == nil {
+		t.Error("expected an error when every key fetcher fails")
+	}
+	if direct.calls != keyFetchAttempts+keyFetchAttempts {
+		t.Errorf("expected the server to be asked again once the key stops being missing, got %d calls", direct.calls)
+	}
+}
+
+func TestStaleKeysFromPerspectivesFallBackToDirectFetch(t *testing.T) {
+	has := map[gomatrixserverlib.ServerName]bool{"a.example.com": true}
+	perspective := &scriptedKeyFetcher{name: "perspective", has: has, validUntil: 1000}
+	direct := &scriptedKeyFetcher{name: "direct", has: has}
+	f := newTestFallbackKeyFetcher(perspective, direct)
+
+	requests := keyRequests("a.example.com")
+	for req := range requests {
+		requests[req] = 2000
+	}
+	results, err := f.FetchKeys(context.Background(), requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := fetchedFrom(results, "a.example.com"); from != "direct" || direct.calls != 1 {
+		t.Errorf("expected the key not valid long enough to be fetched directly, got it from %q", from)
+	}
+
+	// If no key fetcher has a key which is valid long enough then the one
+	// valid for longest is returned.
+	direct.validUntil = 500
+	if results, err = f.FetchKeys(context.Background(), requests); err != nil {
+		t.Fatal(err)
+	}
+	if from := fetchedFrom(results, "a.example.com"); from != "perspective" {
+		t.Errorf("expected the key valid for longest, got it from %q", from)
+	}
+}
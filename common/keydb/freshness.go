@@ -0,0 +1,98 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keydb
+
+import (
+	"context"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// freshKeyDatabase hides the keys in the database whose validity period
+// doesn't cover the time they are needed for, so that the KeyRing fetches
+// them again rather than trusting them. The keys which were hidden are kept
+// as stale keys, to be used if they can't be fetched again, which lets the
+// rooms which don't check validity strictly still verify their events while
+// a server is unreachable.
+type freshKeyDatabase struct {
+	gomatrixserverlib.KeyDatabase
+	// The mutex protects stale, which has the keys hidden since they were
+	// last stored.
+	mutex sync.Mutex
+	stale map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+}
+
+func newFreshKeyDatabase(db gomatrixserverlib.KeyDatabase) *freshKeyDatabase {
+	return &freshKeyDatabase{
+		KeyDatabase: db,
+		stale:       map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{},
+	}
+}
+
+// keyCovers returns whether a key can be used for the signatures made at a
+// time without fetching it again. Keys which have expired can't become valid
+// again, so fetching them again wouldn't help.
+func keyCovers(key gomatrixserverlib.PublicKeyLookupResult, at gomatrixserverlib.Timestamp) bool {
+	return key.ExpiredTS != gomatrixserverlib.PublicKeyNotExpired || key.ValidUntilTS >= at
+}
+
+// FetchKeys implements KeyDatabase
+func (d *freshKeyDatabase) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results, err := d.KeyDatabase.FetchKeys(ctx, requests)
+	if err != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for req, res := range results {
+		if at, ok := requests[req]; ok && !keyCovers(res, at) {
+			d.stale[req] = res
+			delete(results, req)
+		}
+	}
+	return results, nil
+}
+
+// StoreKeys implements KeyDatabase
+func (d *freshKeyDatabase) StoreKeys(
+	ctx context.Context,
+	keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	d.mutex.Lock()
+	for req := range keys {
+		delete(d.stale, req)
+	}
+	d.mutex.Unlock()
+	return d.KeyDatabase.StoreKeys(ctx, keys)
+}
+
+// staleKeys returns the stale keys which were hidden for the requests.
+func (d *freshKeyDatabase) staleKeys(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		if res, ok := d.stale[req]; ok {
+			results[req] = res
+		}
+	}
+	return results
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package keydb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const testRemoteServer = gomatrixserverlib.ServerName("remote.example.com")
+
+// remoteKeyFetcher returns the current key of the remote server, valid for
+// another hour, along with a key which it used before.
+type remoteKeyFetcher struct {
+	publicKey ed25519.PublicKey
+	fail      bool
+	calls     int
+}
+
+func (f *remoteKeyFetcher) FetcherName() string {
+	return "remote"
+}
+
+func (f *remoteKeyFetcher) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	f.calls++
+	if f.fail {
+		return nil, errors.New("remote.example.com is unreachable")
+	}
+	return map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		{ServerName: testRemoteServer, KeyID: "ed25519:auto"}: {
+			VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64String(f.publicKey)},
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+		},
+		{ServerName: testRemoteServer, KeyID: "ed25519:old"}: {
+			VerifyKey: gomatrixserverlib.VerifyKey{Key: bytes.Repeat([]byte{2}, ed25519.PublicKeySize)},
+			ExpiredTS: gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour)),
+		},
+	}, nil
+}
+
+type freshnessTest struct {
+	db      Database
+	keyRing gomatrixserverlib.KeyRing
+	fetcher *remoteKeyFetcher
+	message []byte
+}
+
+// newFreshnessTest sets up a key ring whose database has the key of the
+// remote server, which stopped being valid an hour ago, and a message signed
+// by the remote server with it.
+func newFreshnessTest(t *testing.T) (*freshnessTest, func()) {
+	dir, err := ioutil.TempDir("", "keydb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDatabase("file:"+filepath.Join(dir, "keydb.db"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64String(publicKey)},
+		ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour)),
+	}
+	if err = db.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		{ServerName: testRemoteServer, KeyID: "ed25519:auto"}: stale,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	message, err := gomatrixserverlib.SignJSON(string(testRemoteServer), "ed25519:auto", privateKey, []byte(`{"content":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher := &remoteKeyFetcher{publicKey: publicKey}
+	freshDB := newFreshKeyDatabase(db)
+	fallback := newTestFallbackKeyFetcher(fetcher)
+	fallback.stale = freshDB
+	return &freshnessTest{
+		db:      db,
+		keyRing: gomatrixserverlib.KeyRing{KeyFetchers: []gomatrixserverlib.KeyFetcher{fallback}, KeyDatabase: freshDB},
+		fetcher: fetcher,
+		message: message,
+	}, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// verify verifies the message as if it was signed now, returning the error
+// of the verification.
+func (f *freshnessTest) verify(t *testing.T, strict bool) error {
+	results, err := f.keyRing.VerifyJSONs(context.Background(), []gomatrixserverlib.VerifyJSONRequest{{
+		ServerName:             testRemoteServer,
+		AtTS:                   gomatrixserverlib.AsTimestamp(time.Now()),
+		Message:                f.message,
+		StrictValidityChecking: strict,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results[0].Error
+}
+
+func TestExpiredKeyIsFetchedAgainBeforeVerifying(t *testing.T) {
+	f, cleanup := newFreshnessTest(t)
+	defer cleanup()
+
+	if err := f.verify(t, true); err != nil {
+		t.Fatalf("expected the message to verify with the key fetched again, got %v", err)
+	}
+	if f.fetcher.calls != 1 {
+		t.Errorf("expected the key to be fetched once, got %d fetches", f.fetcher.calls)
+	}
+	// Both keys of the server are stored, and the current one is fresh now.
+	stored, err := f.db.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		{ServerName: testRemoteServer, KeyID: "ed25519:auto"}: 0,
+		{ServerName: testRemoteServer, KeyID: "ed25519:old"}:  0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Errorf("expected both keys of the server to be stored, got %v", stored)
+	}
+	if key := stored[gomatrixserverlib.PublicKeyLookupRequest{ServerName: testRemoteServer, KeyID: "ed25519:auto"}]; !keyCovers(key, gomatrixserverlib.AsTimestamp(time.Now())) {
+		t.Errorf("expected the stored key to be valid now, got %+v", key)
+	}
+
+	if err = f.verify(t, true); err != nil {
+		t.Fatalf("expected the message to verify again, got %v", err)
+	}
+	if f.fetcher.calls != 1 {
+		t.Errorf("expected the stored key to be used, got %d fetches", f.fetcher.calls)
+	}
+}
+
+func TestStaleKeyIsUsedIfItCantBeFetchedAgain(t *testing.T) {
+	f, cleanup := newFreshnessTest(t)
+	defer cleanup()
+	f.fetcher.fail = true
+
+	if err := f.verify(t, false); err != nil {
+		t.Errorf("expected the stale key to verify the message without strict checks, got %v", err)
+	}
+	if err := f.verify(t, true); err == nil {
+		t.Errorf("expected the stale key not to verify the message with strict checks")
+	}
+	if f.fetcher.calls == 0 {
+		t.Errorf("expected the key to be fetched again")
+	}
+}
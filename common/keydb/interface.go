@@ -10,4 +10,10 @@ type Database interface {
 	FetcherName() string
 	FetchKeys(ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
 	StoreKeys(ctx context.Context, keyMap map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult) error
+	PinnedKeys(ctx context.Context, serverName gomatrixserverlib.ServerName) (pinned, changed map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String, err error)
+	PinKeys(ctx context.Context, serverName gomatrixserverlib.ServerName, keys map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String) error
+	FlagChangedKey(ctx context.Context, serverName gomatrixserverlib.ServerName, keyID gomatrixserverlib.KeyID, key gomatrixserverlib.Base64String) error
+	RepinKeys(ctx context.Context, serverName gomatrixserverlib.ServerName) error
+	StoreNotaryKeys(ctx context.Context, keys gomatrixserverlib.ServerKeys) error
+	NotaryKeys(ctx context.Context, serverName gomatrixserverlib.ServerName) (*gomatrixserverlib.ServerKeys, error)
 }
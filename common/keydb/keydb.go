@@ -19,30 +19,28 @@ package keydb
 import (
 	"net/url"
 
-	"golang.org/x/crypto/ed25519"
-
 	"github.com/matrix-org/dendrite/common/keydb/postgres"
 	"github.com/matrix-org/dendrite/common/keydb/sqlite3"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // NewDatabase opens a database connection.
 func NewDatabase(
 	dataSourceName string,
-	serverName gomatrixserverlib.ServerName,
-	serverKey ed25519.PublicKey,
-	serverKeyID gomatrixserverlib.KeyID,
+	dbProperties sqlutil.DbProperties,
+	serverKeys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
 ) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
-		return postgres.NewDatabase(dataSourceName, serverName, serverKey, serverKeyID)
+		return postgres.NewDatabase(dataSourceName, dbProperties, serverKeys)
 	}
 	switch uri.Scheme {
 	case "postgres":
-		return postgres.NewDatabase(dataSourceName, serverName, serverKey, serverKeyID)
+		return postgres.NewDatabase(dataSourceName, dbProperties, serverKeys)
 	case "file":
-		return sqlite3.NewDatabase(dataSourceName, serverName, serverKey, serverKeyID)
+		return sqlite3.NewDatabase(dataSourceName, dbProperties, serverKeys)
 	default:
-		return postgres.NewDatabase(dataSourceName, serverName, serverKey, serverKeyID)
+		return postgres.NewDatabase(dataSourceName, dbProperties, serverKeys)
 	}
 }
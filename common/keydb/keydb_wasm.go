@@ -18,18 +18,16 @@ import (
 	"fmt"
 	"net/url"
 
-	"golang.org/x/crypto/ed25519"
-
 	"github.com/matrix-org/dendrite/common/keydb/sqlite3"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // NewDatabase opens a database connection.
 func NewDatabase(
 	dataSourceName string,
-	serverName gomatrixserverlib.ServerName,
-	serverKey ed25519.PublicKey,
-	serverKeyID gomatrixserverlib.KeyID,
+	dbProperties sqlutil.DbProperties,
+	serverKeys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
 ) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
@@ -39,7 +37,7 @@ func NewDatabase(
 	case "postgres":
 		return nil, fmt.Errorf("Cannot use postgres implementation")
 	case "file":
-		return sqlite3.NewDatabase(dataSourceName, serverName, serverKey, serverKeyID)
+		return sqlite3.NewDatabase(dataSourceName, dbProperties, serverKeys)
 	default:
 		return nil, fmt.Errorf("Cannot use postgres implementation")
 	}
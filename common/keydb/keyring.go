@@ -26,24 +26,20 @@ import (
 // CreateKeyRing creates and configures a KeyRing object.
 //
 // It creates the necessary key fetchers and collects them into a KeyRing
-// backed by the given KeyDatabase.
+// backed by the given KeyDatabase. The perspective servers are asked for keys
+// first, in the order they are configured in, and the servers which the keys
+// belong to are asked directly for the keys which they didn't return. The
+// requests go through the given client, so those to .i2p servers are sent
+// over SAM. Unless matrix.i2p.key_pinning is off, the keys which the fetchers
+// return for .i2p servers are checked against the keys pinned for them.
+// Keys in the database which aren't valid anymore are fetched again.
 func CreateKeyRing(client gomatrixserverlib.Client,
-	keyDB gomatrixserverlib.KeyDatabase,
-	cfg config.KeyPerspectives) gomatrixserverlib.KeyRing {
-
-	fetchers := gomatrixserverlib.KeyRing{
-		KeyFetchers: []gomatrixserverlib.KeyFetcher{
-			&gomatrixserverlib.DirectKeyFetcher{
-				Client: client,
-			},
-		},
-		KeyDatabase: keyDB,
-	}
-
-	logrus.Info("Enabled direct key fetcher")
+	keyDB Database,
+	cfg *config.Dendrite) gomatrixserverlib.KeyRing {
 
+	var fetchers []gomatrixserverlib.KeyFetcher
 	var b64e = base64.StdEncoding.WithPadding(base64.NoPadding)
-	for _, ps := range cfg {
+	for _, ps := range cfg.Matrix.KeyPerspectives {
 		perspective := &gomatrixserverlib.PerspectiveKeyFetcher{
 			PerspectiveServerName: ps.ServerName,
 			PerspectiveServerKeys: map[gomatrixserverlib.KeyID]ed25519.PublicKey{},
@@ -62,7 +58,7 @@ func CreateKeyRing(client gomatrixserverlib.Client,
 			perspective.PerspectiveServerKeys[key.KeyID] = rawkey
 		}
 
-		fetchers.KeyFetchers = append(fetchers.KeyFetchers, perspective)
+		fetchers = append(fetchers, perspective)
 
 		logrus.WithFields(logrus.Fields{
 			"server_name":     ps.ServerName,
@@ -70,5 +66,28 @@ func CreateKeyRing(client gomatrixserverlib.Client,
 		}).Info("Enabled perspective key fetcher")
 	}
 
-	return fetchers
+	fetchers = append(fetchers, &gomatrixserverlib.DirectKeyFetcher{
+		Client: client,
+	})
+	logrus.Info("Enabled direct key fetcher")
+
+	if pinning := cfg.Matrix.I2P.KeyPinning; pinning != config.KeyPinningOff {
+		for i, fetcher := range fetchers {
+			fetchers[i] = &pinningKeyFetcher{
+				fetcher: fetcher,
+				client:  &client,
+				db:      keyDB,
+				enforce: pinning == config.KeyPinningEnforce,
+			}
+		}
+		logrus.WithField("key_pinning", pinning).Info("Enabled pinning of I2P server keys")
+	}
+
+	freshDB := newFreshKeyDatabase(keyDB)
+	fallback := newFallbackKeyFetcher(fetchers...)
+	fallback.stale = freshDB
+	return gomatrixserverlib.KeyRing{
+		KeyFetchers: []gomatrixserverlib.KeyFetcher{fallback},
+		KeyDatabase: freshDB,
+	}
 }
@@ -0,0 +1,170 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keydb
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/common/i2p"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+)
+
+// pinningKeyFetcher pins the keys first fetched for each .i2p server, which
+// have no DNS or certificate authority to vouch for them, and flags the keys
+// fetched later which differ from them. If enforce is set then those keys are
+// dropped from the results, so that they aren't trusted. New keys are asked
+// for from the server itself through the client, to check whether they are
+// signed by the pinned keys.
+type pinningKeyFetcher struct {
+	fetcher gomatrixserverlib.KeyFetcher
+	client  *gomatrixserverlib.Client
+	db      Database
+	enforce bool
+}
+
+// FetcherName implements KeyFetcher
+func (f *pinningKeyFetcher) FetcherName() string {
+	return f.fetcher.FetcherName()
+}
+
+// FetchKeys implements KeyFetcher
+func (f *pinningKeyFetcher) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results, err := f.fetcher.FetchKeys(ctx, requests)
+	if err != nil {
+		return nil, err
+	}
+	byServer := map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String{}
+	for req, res := range results {
+		if !i2p.IsI2PHost(string(req.ServerName)) {
+			continue
+		}
+		if byServer[req.ServerName] == nil {
+			byServer[req.ServerName] = map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String{}
+		}
+		byServer[req.ServerName][req.KeyID] = res.Key
+	}
+	for serverName, keys := range byServer {
+		serverName := serverName
+		var signedKeys func() (*gomatrixserverlib.ServerKeys, error)
+		if f.client != nil {
+			signedKeys = func() (*gomatrixserverlib.ServerKeys, error) {
+				signed, fetchErr := f.client.GetServerKeys(ctx, serverName)
+				return &signed, fetchErr
+			}
+		}
+		var changed []gomatrixserverlib.KeyID
+		if changed, err = CheckPinnedKeys(ctx, f.db, serverName, keys, signedKeys); err != nil {
+			return nil, err
+		}
+		for _, keyID := range changed {
+			logrus.WithFields(logrus.Fields{
+				"server_name": serverName,
+				"key_id":      keyID,
+				"fetcher":     f.fetcher.FetcherName(),
+				"refused":     f.enforce,
+			}).Warn("Fetched a key for an I2P server which differs from its pinned keys")
+			if f.enforce {
+				delete(results, gomatrixserverlib.PublicKeyLookupRequest{ServerName: serverName, KeyID: keyID})
+			}
+		}
+	}
+	return results, nil
+}
+
+// CheckPinnedKeys compares keys of a server with its pinned keys, and returns
+// the IDs of those which differ from them, which are flagged in the database.
+// If the server has no pinned keys yet then the keys are pinned instead. Keys
+// with new key IDs are accepted and pinned too if they are in the signed keys
+// of the server, and those are signed by one of its pinned keys, as when a
+// server adds a key while it still holds the old one. The signed keys are only
+// asked for if there are new keys.
+func CheckPinnedKeys(
+	ctx context.Context, db Database, serverName gomatrixserverlib.ServerName,
+	keys map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String,
+	signedKeys func() (*gomatrixserverlib.ServerKeys, error),
+) ([]gomatrixserverlib.KeyID, error) {
+	pinned, _, err := db.PinnedKeys(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	if len(pinned) == 0 {
+		return nil, db.PinKeys(ctx, serverName, keys)
+	}
+
+	var vouched map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String
+	for keyID := range keys {
+		if _, ok := pinned[keyID]; ok || signedKeys == nil {
+			continue
+		}
+		var signed *gomatrixserverlib.ServerKeys
+		if signed, err = signedKeys(); err != nil {
+			logrus.WithError(err).WithField("server_name", serverName).Warn("Failed to fetch the signed keys of a server to check its new keys")
+		} else {
+			vouched = vouchedKeys(serverName, pinned, signed)
+		}
+		break
+	}
+
+	var changed []gomatrixserverlib.KeyID
+	accepted := map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String{}
+	for keyID, key := range keys {
+		pinnedKey, isPinned := pinned[keyID]
+		if isPinned && pinnedKey.Encode() == key.Encode() {
+			continue
+		}
+		if vouchedKey, ok := vouched[keyID]; ok && !isPinned && vouchedKey.Encode() == key.Encode() {
+			accepted[keyID] = key
+			continue
+		}
+		if err = db.FlagChangedKey(ctx, serverName, keyID, key); err != nil {
+			return nil, err
+		}
+		changed = append(changed, keyID)
+	}
+	if len(accepted) > 0 {
+		if err = db.PinKeys(ctx, serverName, accepted); err != nil {
+			return nil, err
+		}
+	}
+	return changed, nil
+}
+
+// vouchedKeys returns the current keys in the signed keys of a server if they
+// are signed by one of its pinned keys, or nil if they aren't.
+func vouchedKeys(
+	serverName gomatrixserverlib.ServerName,
+	pinned map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String,
+	signed *gomatrixserverlib.ServerKeys,
+) map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String {
+	if signed.ServerName != serverName {
+		return nil
+	}
+	for keyID, key := range pinned {
+		if gomatrixserverlib.VerifyJSON(string(serverName), keyID, ed25519.PublicKey(key), signed.Raw) != nil {
+			continue
+		}
+		keys := map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String{}
+		for id, verifyKey := range signed.VerifyKeys {
+			keys[id] = verifyKey.Key
+		}
+		return keys
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package keydb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const testI2PServer = gomatrixserverlib.ServerName("ukeu3k5oycgaauneqgtnvselmt4yemvoilkln7jpvamvfx7dnkdq.b32.i2p")
+
+// testKeyFetcher returns the same key for every request.
+type testKeyFetcher struct {
+	key gomatrixserverlib.Base64String
+}
+
+func (f *testKeyFetcher) FetcherName() string {
+	return "test"
+}
+
+func (f *testKeyFetcher) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    gomatrixserverlib.VerifyKey{Key: f.key},
+			ValidUntilTS: 1 << 50,
+		}
+	}
+	return results, nil
+}
+
+func newPinningTest(t *testing.T, enforce bool) (*pinningKeyFetcher, *testKeyFetcher, func()) {
+	dir, err := ioutil.TempDir("", "keydb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDatabase("file:"+filepath.Join(dir, "keydb.db"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := &testKeyFetcher{key: bytes.Repeat([]byte{1}, 32)}
+	return &pinningKeyFetcher{fetcher: fetcher, db: db, enforce: enforce}, fetcher, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// fetch fetches ed25519:auto for the server, returning whether a key was
+// returned.
+func fetch(t *testing.T, f *pinningKeyFetcher, serverName gomatrixserverlib.ServerName) bool {
+	req := gomatrixserverlib.PublicKeyLookupRequest{ServerName: serverName, KeyID: "ed25519:auto"}
+	results, err := f.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{req: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok := results[req]
+	return ok
+}
+
+func TestChangedKeyForPinnedI2PServerIsFlagged(t *testing.T) {
+	for _, enforce := range []bool{false, true} {
+		f, fetcher, cleanup := newPinningTest(t, enforce)
+		if !fetch(t, f, testI2PServer) {
+			t.Fatalf("enforce %v: expected the first key seen to be trusted", enforce)
+		}
+		fetcher.key = bytes.Repeat([]byte{2}, 32)
+		if fetch(t, f, testI2PServer) == enforce {
+			t.Errorf("enforce %v: expected the changed key to be returned only without enforcement", enforce)
+		}
+		pinned, changed, err := f.db.PinnedKeys(context.Background(), testI2PServer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pinned["ed25519:auto"][0] != 1 || len(changed) != 1 || changed["ed25519:auto"][0] != 2 {
+			t.Errorf("enforce %v: expected the first key to be pinned and the second flagged, got %v and %v", enforce, pinned, changed)
+		}
+
+		// Servers which aren't I2P servers aren't pinned.
+		if !fetch(t, f, "example.com") {
+			t.Errorf("enforce %v: expected the key of example.com to be trusted", enforce)
+		}
+		if pinned, _, err = f.db.PinnedKeys(context.Background(), "example.com"); err != nil || len(pinned) != 0 {
+			t.Errorf("enforce %v: expected no keys to be pinned for example.com, got %v (%v)", enforce, pinned, err)
+		}
+		cleanup()
+	}
+}
+
+func TestRepinningClearsChangedKeys(t *testing.T) {
+	f, fetcher, cleanup := newPinningTest(t, true)
+	defer cleanup()
+	ctx := context.Background()
+	fetch(t, f, testI2PServer)
+	fetcher.key = bytes.Repeat([]byte{2}, 32)
+	if fetch(t, f, testI2PServer) {
+		t.Fatal("expected the changed key to be refused")
+	}
+
+	if err := f.db.RepinKeys(ctx, testI2PServer); err != nil {
+		t.Fatal(err)
+	}
+	pinned, changed, err := f.db.PinnedKeys(ctx, testI2PServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pinned) != 1 || pinned["ed25519:auto"][0] != 2 || len(changed) != 0 {
+		t.Errorf("expected the changed key to be pinned and nothing flagged, got %v and %v", pinned, changed)
+	}
+	if !fetch(t, f, testI2PServer) {
+		t.Error("expected the repinned key to be trusted")
+	}
+	if _, changed, err = f.db.PinnedKeys(ctx, testI2PServer); err != nil || len(changed) != 0 {
+		t.Errorf("expected nothing to be flagged after repinning, got %v (%v)", changed, err)
+	}
+}
+
+// signedKeysServer serves the keys of the I2P server, signed by signers.
+type signedKeysServer struct {
+	keys    map[gomatrixserverlib.KeyID]ed25519.PublicKey
+	signers map[gomatrixserverlib.KeyID]ed25519.PrivateKey
+}
+
+func (s *signedKeysServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != string(testI2PServer) || req.URL.Path != "/_matrix/key/v2/server" {
+		return nil, errors.New("unexpected request to " + req.URL.String())
+	}
+	fields := gomatrixserverlib.ServerKeyFields{
+		ServerName:   testI2PServer,
+		VerifyKeys:   map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{},
+		ValidUntilTS: 1 << 50,
+	}
+	for keyID, key := range s.keys {
+		fields.VerifyKeys[keyID] = gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64String(key)}
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	for keyID, privateKey := range s.signers {
+		if body, err = gomatrixserverlib.SignJSON(string(testI2PServer), keyID, privateKey, body); err != nil {
+			return nil, err
+		}
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBuffer(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestNewKeysSignedByPinnedKeyArePinned(t *testing.T) {
+	oldPublic, oldPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPublic, newPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	newReq := gomatrixserverlib.PublicKeyLookupRequest{ServerName: testI2PServer, KeyID: "ed25519:new"}
+	fetchNew := func(f *pinningKeyFetcher) bool {
+		results, fetchErr := f.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{newReq: 0})
+		if fetchErr != nil {
+			t.Fatal(fetchErr)
+		}
+		_, ok := results[newReq]
+		return ok
+	}
+
+	for _, signedByPinnedKey := range []bool{true, false} {
+		f, fetcher, cleanup := newPinningTest(t, true)
+		server := &signedKeysServer{
+			keys:    map[gomatrixserverlib.KeyID]ed25519.PublicKey{"ed25519:auto": oldPublic, "ed25519:new": newPublic},
+			signers: map[gomatrixserverlib.KeyID]ed25519.PrivateKey{"ed25519:new": newPrivate},
+		}
+		if signedByPinnedKey {
+			server.signers["ed25519:auto"] = oldPrivate
+		}
+		tr := &http.Transport{}
+		tr.RegisterProtocol("matrix", server)
+		f.client = gomatrixserverlib.NewClientWithTransport(tr)
+
+		fetcher.key = gomatrixserverlib.Base64String(oldPublic)
+		if !fetch(t, f, testI2PServer) {
+			t.Fatal("expected the first key seen to be trusted")
+		}
+		fetcher.key = gomatrixserverlib.Base64String(newPublic)
+		if fetchNew(f) != signedByPinnedKey {
+			t.Errorf("signed by pinned key %v: expected the new key to be trusted only if signed by the pinned key", signedByPinnedKey)
+		}
+		pinned, changed, dbErr := f.db.PinnedKeys(ctx, testI2PServer)
+		if dbErr != nil {
+			t.Fatal(dbErr)
+		}
+		_, isPinned := pinned["ed25519:new"]
+		_, isFlagged := changed["ed25519:new"]
+		if isPinned != signedByPinnedKey || isFlagged == signedByPinnedKey {
+			t.Errorf("signed by pinned key %v: expected the new key to be pinned only if signed by the pinned key, got %v and %v", signedByPinnedKey, pinned, changed)
+		}
+		cleanup()
+	}
+}
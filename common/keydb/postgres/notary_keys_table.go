@@ -0,0 +1,88 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const notaryKeysSchema = `
+-- The keys which other servers published, exactly as they were fetched, so
+-- that this server can serve them as a notary with the servers' signatures.
+CREATE TABLE IF NOT EXISTS keydb_notary_keys (
+	-- The name of the matrix server the keys are for.
+	server_name TEXT NOT NULL PRIMARY KEY,
+	-- When the keys stop being valid, as a millisecond timestamp.
+	valid_until_ts BIGINT NOT NULL,
+	-- The keys as the server signed them.
+	server_keys_json TEXT NOT NULL
+);
+`
+
+const upsertNotaryKeysSQL = "" +
+	"INSERT INTO keydb_notary_keys (server_name, valid_until_ts, server_keys_json) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (server_name) DO UPDATE SET valid_until_ts = $2, server_keys_json = $3"
+
+const selectNotaryKeysSQL = "" +
+	"SELECT server_keys_json FROM keydb_notary_keys WHERE server_name = $1"
+
+type notaryKeyStatements struct {
+	upsertNotaryKeysStmt *sql.Stmt
+	selectNotaryKeysStmt *sql.Stmt
+}
+
+func (s *notaryKeyStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(notaryKeysSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertNotaryKeysStmt, err = db.Prepare(upsertNotaryKeysSQL); err != nil {
+		return
+	}
+	if s.selectNotaryKeysStmt, err = db.Prepare(selectNotaryKeysSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *notaryKeyStatements) upsertNotaryKeys(
+	ctx context.Context, keys gomatrixserverlib.ServerKeys,
+) error {
+	_, err := s.upsertNotaryKeysStmt.ExecContext(
+		ctx, string(keys.ServerName), keys.ValidUntilTS, string(keys.Raw),
+	)
+	return err
+}
+
+func (s *notaryKeyStatements) selectNotaryKeys(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (*gomatrixserverlib.ServerKeys, error) {
+	var raw string
+	err := s.selectNotaryKeysStmt.QueryRowContext(ctx, string(serverName)).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var keys gomatrixserverlib.ServerKeys
+	if err = json.Unmarshal([]byte(raw), &keys); err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
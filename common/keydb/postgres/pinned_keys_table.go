@@ -0,0 +1,168 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const pinnedKeysSchema = `
+-- The signing keys which were first seen for servers whose keys are pinned,
+-- and the keys seen since which differ from them.
+CREATE TABLE IF NOT EXISTS keydb_pinned_keys (
+	-- The name of the matrix server the key is for.
+	server_name TEXT NOT NULL,
+	-- The ID of the server key.
+	server_key_id TEXT NOT NULL,
+	-- Whether the key is pinned. Otherwise it is the most recent key seen for
+	-- the key ID which differed from the pinned keys.
+	pinned BOOLEAN NOT NULL,
+	-- The base64-encoded public key.
+	server_key TEXT NOT NULL,
+	-- When the key was first seen, as a millisecond timestamp.
+	seen_ts BIGINT NOT NULL,
+	UNIQUE (server_name, server_key_id, pinned)
+);
+`
+
+const insertPinnedKeySQL = "" +
+	"INSERT INTO keydb_pinned_keys (server_name, server_key_id, pinned, server_key, seen_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (server_name, server_key_id, pinned) DO NOTHING"
+
+const upsertChangedKeySQL = "" +
+	"INSERT INTO keydb_pinned_keys (server_name, server_key_id, pinned, server_key, seen_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (server_name, server_key_id, pinned) DO UPDATE SET server_key = $4, seen_ts = $5"
+
+const selectPinnedKeysSQL = "" +
+	"SELECT server_key_id, pinned, server_key FROM keydb_pinned_keys WHERE server_name = $1"
+
+// The pinned keys which have changed are replaced by the changed keys.
+const deleteReplacedPinnedKeysSQL = "" +
+	"DELETE FROM keydb_pinned_keys WHERE server_name = $1 AND pinned = $2 AND server_key_id IN (" +
+	" SELECT server_key_id FROM keydb_pinned_keys WHERE server_name = $1 AND pinned = $3" +
+	")"
+
+const pinChangedKeysSQL = "" +
+	"UPDATE keydb_pinned_keys SET pinned = $1 WHERE server_name = $2"
+
+type pinnedKeyStatements struct {
+	db                           *sql.DB
+	insertPinnedKeyStmt          *sql.Stmt
+	upsertChangedKeyStmt         *sql.Stmt
+	selectPinnedKeysStmt         *sql.Stmt
+	deleteReplacedPinnedKeysStmt *sql.Stmt
+	pinChangedKeysStmt           *sql.Stmt
+}
+
+func (s *pinnedKeyStatements) prepare(db *sql.DB) (err error) {
+	s.db = db
+	_, err = db.Exec(pinnedKeysSchema)
+	if err != nil {
+		return
+	}
+	if s.insertPinnedKeyStmt, err = db.Prepare(insertPinnedKeySQL); err != nil {
+		return
+	}
+	if s.upsertChangedKeyStmt, err = db.Prepare(upsertChangedKeySQL); err != nil {
+		return
+	}
+	if s.selectPinnedKeysStmt, err = db.Prepare(selectPinnedKeysSQL); err != nil {
+		return
+	}
+	if s.deleteReplacedPinnedKeysStmt, err = db.Prepare(deleteReplacedPinnedKeysSQL); err != nil {
+		return
+	}
+	if s.pinChangedKeysStmt, err = db.Prepare(pinChangedKeysSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pinnedKeyStatements) insertPinnedKeys(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+	keys map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String,
+) error {
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	return common.WithTransaction(s.db, func(txn *sql.Tx) error {
+		stmt := common.TxStmt(txn, s.insertPinnedKeyStmt)
+		for keyID, key := range keys {
+			if _, err := stmt.ExecContext(ctx, string(serverName), string(keyID), true, key.Encode(), now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *pinnedKeyStatements) upsertChangedKey(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+	keyID gomatrixserverlib.KeyID, key gomatrixserverlib.Base64String,
+) error {
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	_, err := s.upsertChangedKeyStmt.ExecContext(ctx, string(serverName), string(keyID), false, key.Encode(), now)
+	return err
+}
+
+func (s *pinnedKeyStatements) selectPinnedKeys(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (pinned, changed map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String, err error) {
+	rows, err := s.selectPinnedKeysStmt.QueryContext(ctx, string(serverName))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectPinnedKeys: rows.close() failed")
+	pinned = map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String{}
+	changed = map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String{}
+	for rows.Next() {
+		var keyID, encoded string
+		var isPinned bool
+		if err = rows.Scan(&keyID, &isPinned, &encoded); err != nil {
+			return nil, nil, err
+		}
+		var key gomatrixserverlib.Base64String
+		if err = key.Decode(encoded); err != nil {
+			return nil, nil, err
+		}
+		if isPinned {
+			pinned[gomatrixserverlib.KeyID(keyID)] = key
+		} else {
+			changed[gomatrixserverlib.KeyID(keyID)] = key
+		}
+	}
+	return pinned, changed, rows.Err()
+}
+
+// pinChangedKeys replaces the pinned keys of the server with the keys which
+// were seen since and differed from them.
+func (s *pinnedKeyStatements) pinChangedKeys(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) error {
+	return common.WithTransaction(s.db, func(txn *sql.Tx) error {
+		stmt := common.TxStmt(txn, s.deleteReplacedPinnedKeysStmt)
+		if _, err := stmt.ExecContext(ctx, string(serverName), true, false); err != nil {
+			return err
+		}
+		stmt = common.TxStmt(txn, s.pinChangedKeysStmt)
+		_, err := stmt.ExecContext(ctx, true, string(serverName))
+		return err
+	})
+}
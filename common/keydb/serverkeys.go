@@ -0,0 +1,57 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keydb
+
+import (
+	"math"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// ServerKeys returns the public keys of every signing key of this server, so
+// that they can be stored in the key database and published to other servers.
+// Keys which have been rotated out keep their expiry time, so that they still
+// verify the requests and events that they signed before they expired.
+func ServerKeys(
+	cfg *config.Dendrite,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult {
+	signingKeys := cfg.Matrix.SigningKeys
+	if len(signingKeys) == 0 {
+		// The keys weren't loaded from a config file, so the only key is the
+		// one to sign with.
+		signingKeys = []config.SigningKey{{
+			KeyID:      cfg.Matrix.KeyID,
+			PrivateKey: cfg.Matrix.PrivateKey,
+		}}
+	}
+
+	keys := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(signingKeys))
+	for _, key := range signingKeys {
+		request := gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: cfg.Matrix.ServerName,
+			KeyID:      key.KeyID,
+		}
+		keys[request] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: gomatrixserverlib.Base64String(key.PrivateKey.Public().(ed25519.PublicKey)),
+			},
+			ValidUntilTS: math.MaxUint64 >> 1,
+			ExpiredTS:    key.ExpiredTS,
+		}
+	}
+	return keys
+}
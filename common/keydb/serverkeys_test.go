@@ -0,0 +1,103 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package keydb
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// rotatedKeysConfig returns the config of a server which signed events with
+// ed25519:old until an hour ago and signs them with ed25519:new now.
+func rotatedKeysConfig(now time.Time) *config.Dendrite {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.SigningKeys = []config.SigningKey{{
+		KeyID:      "ed25519:old",
+		PrivateKey: ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize)),
+		ExpiredTS:  gomatrixserverlib.AsTimestamp(now.Add(-time.Hour)),
+	}, {
+		KeyID:      "ed25519:new",
+		PrivateKey: ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize)),
+	}}
+	cfg.Matrix.KeyID = cfg.Matrix.SigningKeys[1].KeyID
+	cfg.Matrix.PrivateKey = cfg.Matrix.SigningKeys[1].PrivateKey
+	return cfg
+}
+
+func signedTestEvent(t *testing.T, at time.Time, key config.SigningKey) gomatrixserverlib.Event {
+	stateKey := ""
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   "@alice:localhost",
+		RoomID:   "!room:localhost",
+		Type:     "m.room.create",
+		StateKey: &stateKey,
+	}
+	if err := builder.SetContent(map[string]interface{}{"creator": "@alice:localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	event, err := builder.Build(at, "localhost", key.KeyID, key.PrivateKey, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestServerKeysVerifyEventsSignedWithRotatedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keydb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	now := time.Now()
+	cfg := rotatedKeysConfig(now)
+	db, err := NewDatabase("file:"+filepath.Join(dir, "keydb.db"), nil, ServerKeys(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyRing := gomatrixserverlib.KeyRing{KeyDatabase: db}
+	oldKey, newKey := cfg.Matrix.SigningKeys[0], cfg.Matrix.SigningKeys[1]
+
+	for _, tc := range []struct {
+		name    string
+		event   gomatrixserverlib.Event
+		wantErr bool
+	}{
+		{"old key before it expired", signedTestEvent(t, now.Add(-2*time.Hour), oldKey), false},
+		{"old key after it expired", signedTestEvent(t, now, oldKey), true},
+		{"new key", signedTestEvent(t, now, newKey), false},
+	} {
+		err := gomatrixserverlib.VerifyAllEventSignatures(
+			context.Background(), []gomatrixserverlib.Event{tc.event}, &keyRing,
+		)
+		if tc.wantErr && err == nil {
+			t.Errorf("%s: expected the signature to be rejected", tc.name)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("%s: expected the signature to verify, got %s", tc.name, err)
+		}
+	}
+}
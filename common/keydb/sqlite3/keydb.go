@@ -17,9 +17,7 @@ package sqlite3
 
 import (
 	"context"
-	"math"
-
-	"golang.org/x/crypto/ed25519"
+	"database/sql"
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -31,7 +29,10 @@ import (
 // A Database implements gomatrixserverlib.KeyDatabase and is used to store
 // the public keys for other matrix servers.
 type Database struct {
+	db         *sql.DB
 	statements serverKeyStatements
+	pinnedKeys pinnedKeyStatements
+	notaryKeys notaryKeyStatements
 }
 
 // NewDatabase prepares a new key database.
@@ -40,44 +41,50 @@ type Database struct {
 // Returns an error if there was a problem talking to the database.
 func NewDatabase(
 	dataSourceName string,
-	serverName gomatrixserverlib.ServerName,
-	serverKey ed25519.PublicKey,
-	serverKeyID gomatrixserverlib.KeyID,
+	dbProperties sqlutil.DbProperties,
+	serverKeys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
 ) (*Database, error) {
-	db, err := sqlutil.Open(common.SQLiteDriverName(), dataSourceName)
+	db, err := sqlutil.Open(common.SQLiteDriverName(), dataSourceName, dbProperties)
 	if err != nil {
 		return nil, err
 	}
-	d := &Database{}
+	migrator := common.NewMigrator(db, "serverkey")
+	migrator.AddMigrations(common.BaselineMigration)
+	if err = migrator.Up(context.Background()); err != nil {
+		return nil, err
+	}
+	d := &Database{db: db}
 	err = d.statements.prepare(db)
 	if err != nil {
 		return nil, err
 	}
-	// Store our own keys so that we don't end up making HTTP requests to find our
-	// own keys
-	index := gomatrixserverlib.PublicKeyLookupRequest{
-		ServerName: serverName,
-		KeyID:      serverKeyID,
+	err = d.pinnedKeys.prepare(db)
+	if err != nil {
+		return nil, err
 	}
-	value := gomatrixserverlib.PublicKeyLookupResult{
-		VerifyKey: gomatrixserverlib.VerifyKey{
-			Key: gomatrixserverlib.Base64String(serverKey),
-		},
-		ValidUntilTS: math.MaxUint64 >> 1,
-		ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+	err = d.notaryKeys.prepare(db)
+	if err != nil {
+		return nil, err
 	}
-	err = d.StoreKeys(
-		context.Background(),
-		map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
-			index: value,
-		},
-	)
+	// Store our own keys so that we don't end up making HTTP requests to find our
+	// own keys
+	err = d.StoreKeys(context.Background(), serverKeys)
 	if err != nil {
 		return nil, err
 	}
 	return d, nil
 }
 
+// Close closes the database connection.
+func (d *Database) Close() error {
+	return d.db.Close()
+}
+
+// Ping checks that the database can be reached.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
 // FetcherName implements KeyFetcher
 func (d Database) FetcherName() string {
 	return "KeyDatabase"
@@ -114,3 +121,53 @@ func (d *Database) StoreKeys(
 	}
 	return lastErr
 }
+
+// PinnedKeys returns the keys which are pinned for the server, and the keys
+// seen since which differed from them, keyed by key ID.
+func (d *Database) PinnedKeys(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (pinned, changed map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String, err error) {
+	return d.pinnedKeys.selectPinnedKeys(ctx, serverName)
+}
+
+// PinKeys pins keys of the server. Keys which are already pinned for the same
+// key IDs are kept.
+func (d *Database) PinKeys(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+	keys map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String,
+) error {
+	return d.pinnedKeys.insertPinnedKeys(ctx, serverName, keys)
+}
+
+// FlagChangedKey records a key of the server which differs from its pinned
+// keys, replacing any changed key recorded before for the same key ID.
+func (d *Database) FlagChangedKey(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+	keyID gomatrixserverlib.KeyID, key gomatrixserverlib.Base64String,
+) error {
+	return d.pinnedKeys.upsertChangedKey(ctx, serverName, keyID, key)
+}
+
+// RepinKeys pins the changed keys which were flagged for the server in place
+// of the keys they differed from.
+func (d *Database) RepinKeys(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) error {
+	return d.pinnedKeys.pinChangedKeys(ctx, serverName)
+}
+
+// StoreNotaryKeys stores the keys which a server published, replacing those
+// stored for it before, so that they can be served to other servers.
+func (d *Database) StoreNotaryKeys(
+	ctx context.Context, keys gomatrixserverlib.ServerKeys,
+) error {
+	return d.notaryKeys.upsertNotaryKeys(ctx, keys)
+}
+
+// NotaryKeys returns the keys stored for a server by StoreNotaryKeys, or nil
+// if there are none.
+func (d *Database) NotaryKeys(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (*gomatrixserverlib.ServerKeys, error) {
+	return d.notaryKeys.selectNotaryKeys(ctx, serverName)
+}
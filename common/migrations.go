@@ -0,0 +1,164 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+const schemaVersionsSchema = `
+-- The version of the schema of each component which stores its data in the
+-- database.
+CREATE TABLE IF NOT EXISTS schema_versions (
+    -- The name of the component, such as "roomserver".
+    component TEXT NOT NULL PRIMARY KEY,
+    -- The version of the last migration which was applied.
+    version BIGINT NOT NULL,
+    -- Whether a migration was started but didn't finish.
+    dirty BOOLEAN NOT NULL
+);
+`
+
+const selectSchemaVersionSQL = "" +
+	"SELECT version, dirty FROM schema_versions WHERE component = $1"
+
+const upsertSchemaVersionSQL = "" +
+	"INSERT INTO schema_versions (component, version, dirty) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (component) DO UPDATE SET version = $2, dirty = $3"
+
+// A Migration is a change to the schema of a database. The migration is run
+// in the same transaction as the update to the version of the schema.
+// Migrations are applied before the tables of a component are created, so on
+// a new database the tables a migration changes may not exist yet.
+type Migration struct {
+	// The version of the schema after the migration. The first migration
+	// of a component is version 1.
+	Version int64
+	// What the migration changes, which is logged when it runs.
+	Name string
+	Up   func(ctx context.Context, txn *sql.Tx) error
+}
+
+// BaselineMigration is the first migration of every component. It stands for
+// the schema which the tables of the component create for themselves, so it
+// changes nothing, but it puts databases which were created before there were
+// migrations at a known version for the later migrations to start from.
+var BaselineMigration = Migration{
+	Version: 1,
+	Name:    "Baseline schema",
+	Up:      func(context.Context, *sql.Tx) error { return nil },
+}
+
+// A Migrator applies the migrations of a component to its database. The
+// version of the schema of each component is stored in the database, so that
+// each migration is applied once.
+type Migrator struct {
+	db         *sql.DB
+	component  string
+	migrations []Migration
+}
+
+// NewMigrator makes a Migrator for the schema of a component in a database.
+func NewMigrator(db *sql.DB, component string) *Migrator {
+	return &Migrator{db: db, component: component}
+}
+
+// AddMigrations registers migrations of the schema of the component. They
+// may be added in any order, but the versions must be unique.
+func (m *Migrator) AddMigrations(migrations ...Migration) {
+	m.migrations = append(m.migrations, migrations...)
+}
+
+// Up applies the migrations which haven't been applied yet, in order. It
+// fails without applying any if a migration was interrupted, which leaves
+// the schema dirty, or if the schema is newer than the latest migration, as
+// it was then migrated by a newer version of dendrite.
+func (m *Migrator) Up(ctx context.Context) error {
+	migrations := append([]Migration(nil), m.migrations...)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	var latest int64
+	for _, migration := range migrations {
+		if migration.Version <= latest {
+			return fmt.Errorf("migrations of %s: invalid or duplicate version %d", m.component, migration.Version)
+		}
+		latest = migration.Version
+	}
+
+	if _, err := m.db.ExecContext(ctx, schemaVersionsSchema); err != nil {
+		return err
+	}
+	var version int64
+	var dirty bool
+	err := m.db.QueryRowContext(ctx, selectSchemaVersionSQL, m.component).Scan(&version, &dirty)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf(
+			"the schema of %s is dirty, as the migration after version %d didn't finish, and must be repaired by hand",
+			m.component, version,
+		)
+	}
+	if version > latest {
+		return fmt.Errorf(
+			"the schema of %s is at version %d, which is newer than the latest version %d known to this version of dendrite",
+			m.component, version, latest,
+		)
+	}
+	if err == sql.ErrNoRows {
+		if _, err = m.db.ExecContext(ctx, upsertSchemaVersionSQL, m.component, version, false); err != nil {
+			return err
+		}
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+		if err = m.apply(ctx, version, migration); err != nil {
+			return fmt.Errorf("migration %d of %s (%s): %w", migration.Version, m.component, migration.Name, err)
+		}
+		version = migration.Version
+	}
+	return nil
+}
+
+// apply runs a migration after the schema is at version. The schema is marked
+// as dirty while the migration runs, which is only left that way if dendrite
+// stops before the migration finishes or is rolled back.
+func (m *Migrator) apply(ctx context.Context, version int64, migration Migration) error {
+	if _, err := m.db.ExecContext(ctx, upsertSchemaVersionSQL, m.component, version, true); err != nil {
+		return err
+	}
+	err := WithTransaction(m.db, func(txn *sql.Tx) error {
+		if err := migration.Up(ctx, txn); err != nil {
+			return err
+		}
+		_, err := txn.ExecContext(ctx, upsertSchemaVersionSQL, m.component, migration.Version, false)
+		return err
+	})
+	if err != nil {
+		// The transaction was rolled back, so the schema is still clean.
+		if _, cleanErr := m.db.ExecContext(ctx, upsertSchemaVersionSQL, m.component, version, false); cleanErr != nil {
+			return cleanErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func newMigrationsTestDB(t *testing.T) (*sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlutil.Open("sqlite3", "file:"+filepath.Join(dir, "test.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()        // nolint: errcheck
+		os.RemoveAll(dir) // nolint: errcheck
+	}
+}
+
+// addColumnMigration adds a column to the test table, counting the times it
+// is applied.
+func addColumnMigration(version int64, column string, applied *int) Migration {
+	return Migration{
+		Version: version,
+		Name:    "Add " + column,
+		Up: func(ctx context.Context, txn *sql.Tx) error {
+			*applied++
+			_, err := txn.ExecContext(ctx, "ALTER TABLE test ADD COLUMN "+column+" TEXT")
+			return err
+		},
+	}
+}
+
+func TestMigrationsAreOnlyAppliedOnce(t *testing.T) {
+	db, cleanup := newMigrationsTestDB(t)
+	defer cleanup()
+	if _, err := db.Exec("CREATE TABLE test (id TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+
+	var applied int
+	for i := 0; i < 2; i++ {
+		m := NewMigrator(db, "test")
+		// The migrations are applied in order even if added out of order.
+		m.AddMigrations(addColumnMigration(2, "b", &applied), addColumnMigration(1, "a", &applied))
+		if err := m.Up(context.Background()); err != nil {
+			t.Fatalf("run %d: %s", i+1, err)
+		}
+	}
+	if applied != 2 {
+		t.Errorf("expected the two migrations to be applied once each, got %d", applied)
+	}
+	if _, err := db.Exec("INSERT INTO test (id, a, b) VALUES ('1', 'a', 'b')"); err != nil {
+		t.Errorf("expected the columns to be added: %s", err)
+	}
+
+	// Another component in the same database has its own version.
+	other := NewMigrator(db, "other")
+	other.AddMigrations(Migration{Version: 1, Name: "Nothing", Up: func(context.Context, *sql.Tx) error {
+		applied++
+		return nil
+	}})
+	if err := other.Up(context.Background()); err != nil || applied != 3 {
+		t.Errorf("expected the migration of another component to be applied, got %v", err)
+	}
+}
+
+func TestNewerSchemaFailsMigration(t *testing.T) {
+	db, cleanup := newMigrationsTestDB(t)
+	defer cleanup()
+	if _, err := db.Exec("CREATE TABLE test (id TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	var applied int
+	newer := NewMigrator(db, "test")
+	newer.AddMigrations(addColumnMigration(1, "a", &applied), addColumnMigration(2, "b", &applied))
+	if err := newer.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	older := NewMigrator(db, "test")
+	older.AddMigrations(addColumnMigration(1, "a", &applied))
+	if err := older.Up(context.Background()); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("expected an error about the newer schema, got %v", err)
+	}
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	db, cleanup := newMigrationsTestDB(t)
+	defer cleanup()
+	if _, err := db.Exec("CREATE TABLE test (id TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("migration failed")
+	m := NewMigrator(db, "test")
+	m.AddMigrations(Migration{Version: 1, Name: "Fail", Up: func(ctx context.Context, txn *sql.Tx) error {
+		if _, err := txn.ExecContext(ctx, "ALTER TABLE test ADD COLUMN a TEXT"); err != nil {
+			return err
+		}
+		return failed
+	}})
+	if err := m.Up(context.Background()); !errors.Is(err, failed) {
+		t.Fatalf("expected the migration to fail, got %v", err)
+	}
+
+	// The schema isn't left dirty, so a fixed migration can be applied.
+	var applied int
+	m = NewMigrator(db, "test")
+	m.AddMigrations(addColumnMigration(1, "a", &applied))
+	if err := m.Up(context.Background()); err != nil || applied != 1 {
+		t.Errorf("expected the fixed migration to be applied, got %v", err)
+	}
+
+	// A migration that was interrupted leaves the schema dirty.
+	if _, err := db.Exec(upsertSchemaVersionSQL, "test", 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(context.Background()); err == nil || !strings.Contains(err.Error(), "dirty") {
+		t.Errorf("expected an error about the dirty schema, got %v", err)
+	}
+}
+
+func TestMigrationsAfterTheBaseline(t *testing.T) {
+	db, cleanup := newMigrationsTestDB(t)
+	defer cleanup()
+	// A database from before there were migrations only has its tables.
+	if _, err := db.Exec("CREATE TABLE test (id TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	baseline := NewMigrator(db, "test")
+	baseline.AddMigrations(BaselineMigration)
+	if err := baseline.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var applied int
+	m := NewMigrator(db, "test")
+	m.AddMigrations(BaselineMigration, addColumnMigration(2, "a", &applied))
+	if err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var version int64
+	if err := db.QueryRow("SELECT version FROM schema_versions WHERE component = 'test'").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if applied != 1 || version != 2 {
+		t.Errorf("expected only the migration after the baseline to be applied, got %d applied at version %d", applied, version)
+	}
+}
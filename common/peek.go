@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// CanPeekRoom returns whether a user can read the events of a room. Users who
+// are joined to the room can read it, and so can users who have left it, but
+// only up to the point that they left. For them the ID of the event that they
+// left with is returned, so that they are shown the state of the room at that
+// point. Other users, including those who are banned or only invited, can
+// only peek into rooms which are world readable.
+// https://matrix.org/docs/spec/client_server/r0.6.0#id87
+func CanPeekRoom(
+	ctx context.Context, userID, roomID string, queryAPI api.RoomserverQueryAPI,
+) (allowed bool, leaveEventID string, err error) {
+	stateRes, err := guestAccessState(ctx, roomID, userID, queryAPI)
+	if err != nil || !stateRes.RoomExists {
+		return false, "", err
+	}
+	worldReadable := false
+	for _, ev := range stateRes.StateEvents {
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomMember:
+			switch membership, _ := ev.Membership(); membership {
+			case gomatrixserverlib.Join:
+				return true, "", nil
+			case gomatrixserverlib.Leave:
+				leaveEventID = ev.EventID()
+			}
+		case gomatrixserverlib.MRoomHistoryVisibility:
+			var content HistoryVisibilityContent
+			if json.Unmarshal(ev.Content(), &content) == nil && content.HistoryVisibility == "world_readable" {
+				worldReadable = true
+			}
+		}
+	}
+	if worldReadable {
+		return true, "", nil
+	}
+	return leaveEventID != "", leaveEventID, nil
+}
+
+// CheckCanReadRoom returns an error response if the device can't read the
+// events of the room. Guests are held to the rules of CheckGuestCanRead. If
+// the user has left the room, the ID of the event they left with is returned,
+// which the state of the room they are shown should be taken from.
+func CheckCanReadRoom(
+	req *http.Request, device *authtypes.Device, roomID string,
+	queryAPI api.RoomserverQueryAPI,
+) (string, *util.JSONResponse) {
+	if device.IsGuest {
+		return "", CheckGuestCanRead(req, device, roomID, queryAPI)
+	}
+	allowed, leaveEventID, err := CanPeekRoom(req.Context(), device.UserID, roomID, queryAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("CanPeekRoom failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	if !allowed {
+		return "", &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of this room and its history isn't world readable"),
+		}
+	}
+	return leaveEventID, nil
+}
+
+// QueryRoomState returns the state of a room, or the state of the room after
+// the event that a user left it with if leaveEventID isn't empty. Only the
+// given state is returned, or all of it if stateToFetch is empty.
+func QueryRoomState(
+	ctx context.Context, queryAPI api.RoomserverQueryAPI, roomID, leaveEventID string,
+	stateToFetch []gomatrixserverlib.StateKeyTuple,
+) (bool, []gomatrixserverlib.HeaderedEvent, error) {
+	if leaveEventID == "" {
+		stateReq := api.QueryLatestEventsAndStateRequest{RoomID: roomID, StateToFetch: stateToFetch}
+		var stateRes api.QueryLatestEventsAndStateResponse
+		if err := queryAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+			return false, nil, err
+		}
+		return stateRes.RoomExists, stateRes.StateEvents, nil
+	}
+	stateReq := api.QueryStateAfterEventsRequest{
+		RoomID: roomID, PrevEventIDs: []string{leaveEventID}, StateToFetch: stateToFetch,
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err := queryAPI.QueryStateAfterEvents(ctx, &stateReq, &stateRes); err != nil {
+		return false, nil, err
+	}
+	return stateRes.RoomExists && stateRes.PrevEventsExist, stateRes.StateEvents, nil
+}
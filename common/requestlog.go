@@ -0,0 +1,205 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	commonHTTP "github.com/matrix-org/dendrite/common/http"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// requestLogging is the config of the request logging, set by
+// SetupRequestLogging.
+var requestLogging = struct {
+	sync.RWMutex
+	level         logrus.Level
+	includeBodies bool
+	maxBodyBytes  int
+}{level: logrus.InfoLevel, maxBodyBytes: 4096}
+
+// SetupRequestLogging sets the level of the line logged for each request
+// served, and whether the bodies of the requests are logged. Settings which
+// are left unset keep their defaults.
+func SetupRequestLogging(cfg *config.Dendrite) {
+	requestLogging.Lock()
+	defer requestLogging.Unlock()
+	if cfg.RequestLogging.Level != "" {
+		level, err := logrus.ParseLevel(cfg.RequestLogging.Level)
+		if err != nil {
+			logrus.WithError(err).Fatal("Invalid request logging level")
+		}
+		requestLogging.level = level
+	}
+	requestLogging.includeBodies = cfg.RequestLogging.IncludeBodies
+	if cfg.RequestLogging.MaxBodyBytes > 0 {
+		requestLogging.maxBodyBytes = cfg.RequestLogging.MaxBodyBytes
+	}
+}
+
+// requestLogInfo is what the handlers found out about who made a request,
+// which is logged once the request completes.
+type requestLogInfo struct {
+	sync.Mutex
+	userID string
+	server gomatrixserverlib.ServerName
+}
+
+type requestLogInfoKey struct{}
+
+// setRequestUser records the user that made a request.
+func setRequestUser(ctx context.Context, userID string) {
+	if info, ok := ctx.Value(requestLogInfoKey{}).(*requestLogInfo); ok {
+		info.Lock()
+		info.userID = userID
+		info.Unlock()
+	}
+}
+
+// setRequestServer records the server that made a federation request.
+func setRequestServer(ctx context.Context, server gomatrixserverlib.ServerName) {
+	if info, ok := ctx.Value(requestLogInfoKey{}).(*requestLogInfo); ok {
+		info.Lock()
+		info.server = server
+		info.Unlock()
+	}
+}
+
+// statusRecorder records the status and the start of the body of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	size     int
+	body     *bytes.Buffer
+	maxBytes int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.body != nil && r.body.Len() < r.maxBytes {
+		if left := r.maxBytes - r.body.Len(); len(b) > left {
+			r.body.Write(b[:left])
+		} else {
+			r.body.Write(b)
+		}
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// withRequestLogging wraps a handler so that each request gets an ID, which
+// is returned in the X-Request-ID header and is in the context of the
+// request, and so that a line is logged when the request completes. Internal
+// API requests keep the ID of the request they were made for.
+func withRequestLogging(h http.Handler, internal bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		requestLogging.RLock()
+		level := requestLogging.level
+		includeBodies := requestLogging.includeBodies
+		maxBodyBytes := requestLogging.maxBodyBytes
+		requestLogging.RUnlock()
+
+		requestID := ""
+		if internal {
+			requestID = req.Header.Get(commonHTTP.RequestIDHeader)
+		}
+		if requestID == "" {
+			requestID = util.RandomString(12)
+		}
+		info := &requestLogInfo{}
+		ctx := commonHTTP.ContextWithRequestID(req.Context(), requestID)
+		ctx = context.WithValue(ctx, requestLogInfoKey{}, info)
+		req = req.WithContext(ctx)
+		w.Header().Set(commonHTTP.RequestIDHeader, requestID)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		var reqBody []byte
+		if includeBodies {
+			rec.body, rec.maxBytes = &bytes.Buffer{}, maxBodyBytes
+			if req.Body != nil {
+				// Only the start of the body is read here, the rest is left
+				// to be read by the handler.
+				var err error
+				reqBody, err = ioutil.ReadAll(io.LimitReader(req.Body, int64(maxBodyBytes)))
+				if err != nil {
+					logrus.WithError(err).Warn("Failed to read the request body for logging")
+				}
+				req.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(reqBody), req.Body), req.Body}
+			}
+		}
+
+		h.ServeHTTP(rec, req)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		fields := logrus.Fields{
+			"req.id":      requestID,
+			"req.method":  req.Method,
+			"req.path":    req.URL.Path,
+			"status":      rec.status,
+			"duration_ms": time.Since(start).Nanoseconds() / int64(time.Millisecond),
+			"size":        rec.size,
+		}
+		info.Lock()
+		if info.userID != "" {
+			fields["user_id"] = info.userID
+		}
+		if info.server != "" {
+			fields["server"] = info.server
+		}
+		info.Unlock()
+		if includeBodies {
+			fields["req.body"] = string(reqBody)
+			fields["res.body"] = rec.body.String()
+		}
+		logrus.WithFields(fields).Log(level, "Request completed")
+	})
+}
+
+// withRequestIDLogger sets the request ID on the logger of the request, in
+// place of the one made up by util.MakeJSONAPI, so that the lines logged by
+// the handler have the ID returned to the client.
+func withRequestIDLogger(req *http.Request) *http.Request {
+	requestID := commonHTTP.RequestIDFromContext(req.Context())
+	if requestID == "" {
+		return req
+	}
+	logger := util.GetLogger(req.Context()).WithField("req.id", requestID)
+	return req.WithContext(util.ContextWithLogger(req.Context(), logger))
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	commonHTTP "github.com/matrix-org/dendrite/common/http"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// completionLines returns the lines logged when requests complete.
+func completionLines(hook *test.Hook) []logrus.Entry {
+	var lines []logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Request completed" {
+			lines = append(lines, *entry)
+		}
+	}
+	return lines
+}
+
+func TestRequestLoggingSetsIDAndLogsCompletion(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	var handlerRequestID string
+	h := MakeExternalAPI("test", func(req *http.Request) util.JSONResponse {
+		handlerRequestID = commonHTTP.RequestIDFromContext(req.Context())
+		setRequestUser(req.Context(), "@alice:localhost")
+		return util.JSONResponse{Code: http.StatusTeapot, JSON: struct{}{}}
+	})
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/test", nil)
+	// Requests from outside get a new ID, whatever they ask for.
+	req.Header.Set(commonHTTP.RequestIDHeader, "chosen")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	requestID := w.Header().Get(commonHTTP.RequestIDHeader)
+	if requestID == "" || requestID == "chosen" {
+		t.Fatalf("expected a new request ID in the response, got %q", requestID)
+	}
+	if handlerRequestID != requestID {
+		t.Errorf("expected the handler to get request ID %q, got %q", requestID, handlerRequestID)
+	}
+	lines := completionLines(hook)
+	if len(lines) != 1 {
+		t.Fatalf("expected one completion line, got %d", len(lines))
+	}
+	fields := lines[0].Data
+	if fields["status"] != http.StatusTeapot || fields["req.id"] != requestID {
+		t.Errorf("expected status %d and request ID %q to be logged, got %v", http.StatusTeapot, requestID, fields)
+	}
+	if fields["req.method"] != http.MethodGet || fields["req.path"] != "/_matrix/client/r0/test" || fields["user_id"] != "@alice:localhost" {
+		t.Errorf("expected the method, path and user to be logged, got %v", fields)
+	}
+	if _, ok := fields["duration_ms"]; !ok {
+		t.Errorf("expected the duration to be logged, got %v", fields)
+	}
+	if _, ok := fields["req.body"]; ok {
+		t.Errorf("expected no bodies to be logged by default, got %v", fields)
+	}
+}
+
+func TestInternalRequestsKeepRequestID(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	h := MakeInternalAPI("test", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/test", strings.NewReader("{}"))
+	req.Header.Set(commonHTTP.RequestIDHeader, "abcdef")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if requestID := w.Header().Get(commonHTTP.RequestIDHeader); requestID != "abcdef" {
+		t.Errorf("expected the request ID of the caller, got %q", requestID)
+	}
+	if lines := completionLines(hook); len(lines) != 1 || lines[0].Data["req.id"] != "abcdef" || lines[0].Data["status"] != http.StatusOK {
+		t.Errorf("expected a completion line with the request ID and status, got %v", lines)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"errors"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// ErrNotInAllowedRoom is returned when a user tries to join a restricted room
+// without being joined to any of the rooms which it allows.
+var ErrNotInAllowedRoom = errors.New("the user is not joined to any of the rooms allowed to join the room")
+
+// ErrNoJoinAuthoriser is returned when no user of this server can authorise a
+// join to a restricted room.
+var ErrNoJoinAuthoriser = errors.New("no user of this server can authorise joins to the room")
+
+// ErrRestrictedJoinsNotAllowed is returned when a user who isn't invited tries
+// to join a room with the restricted join rule whose version doesn't define it,
+// so that only invited users may join.
+var ErrRestrictedJoinsNotAllowed = errors.New("the version of the room doesn't allow restricted joins")
+
+// AuthoriseRestrictedJoin returns the user of this server who authorises the
+// user to join a restricted room, or an empty string if the join doesn't need
+// to be authorised, either because the room isn't restricted or known or
+// because the user is already invited or joined. It returns
+// ErrNotInAllowedRoom or ErrRestrictedJoinsNotAllowed if the user may not join
+// the room.
+func AuthoriseRestrictedJoin(
+	ctx context.Context, queryAPI api.RoomserverQueryAPI,
+	serverName gomatrixserverlib.ServerName, roomID, userID string,
+) (string, error) {
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{RoomID: roomID}, &stateRes); err != nil {
+		return "", err
+	}
+	if !stateRes.RoomExists {
+		return "", nil
+	}
+	stateEvents := gomatrixserverlib.UnwrapEventHeaders(stateRes.StateEvents)
+	stateEventPtrs := make([]*gomatrixserverlib.Event, len(stateEvents))
+	for i := range stateEvents {
+		stateEventPtrs[i] = &stateEvents[i]
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEventPtrs)
+	joinRules, err := provider.JoinRules()
+	if err != nil {
+		return "", err
+	}
+	allowedRoomIDs, restricted := auth.AllowedRoomIDs(joinRules)
+	if !restricted {
+		return "", nil
+	}
+
+	member, err := gomatrixserverlib.NewMemberContentFromAuthEvents(&provider, userID)
+	if err != nil {
+		return "", err
+	}
+	if member.Membership == gomatrixserverlib.Join || member.Membership == gomatrixserverlib.Invite {
+		return "", nil
+	}
+	if _, desc, verr := auth.RoomVersionOf(&provider); verr != nil || !desc.RestrictedJoins {
+		return "", ErrRestrictedJoinsNotAllowed
+	}
+
+	inAllowedRoom := false
+	for _, roomID := range allowedRoomIDs {
+		if inAllowedRoom, err = isJoinedToRoom(ctx, queryAPI, userID, roomID); err != nil {
+			return "", err
+		} else if inAllowedRoom {
+			break
+		}
+	}
+	if !inAllowedRoom {
+		return "", ErrNotInAllowedRoom
+	}
+
+	authoriser := auth.RestrictedJoinAuthoriser(serverName, stateEvents)
+	if authoriser == "" {
+		return "", ErrNoJoinAuthoriser
+	}
+	return authoriser, nil
+}
+
+// isJoinedToRoom returns whether the user is currently joined to the room, as
+// far as this server knows.
+func isJoinedToRoom(
+	ctx context.Context, queryAPI api.RoomserverQueryAPI, userID, roomID string,
+) (bool, error) {
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+		},
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return false, err
+	}
+	for _, ev := range stateRes.StateEvents {
+		if membership, err := ev.Membership(); err == nil && membership == gomatrixserverlib.Join {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// VerifyRestrictedJoinSignature checks that a join to a restricted room is
+// signed by the server of the user who authorised it, if that isn't the
+// server which sent the join.
+func VerifyRestrictedJoinSignature(
+	ctx context.Context, keyRing gomatrixserverlib.JSONVerifier, event gomatrixserverlib.Event,
+) error {
+	if event.Type() != gomatrixserverlib.MRoomMember {
+		return nil
+	}
+	authoriser := auth.JoinAuthorisedVia(event.Content())
+	if authoriser == "" {
+		return nil
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', authoriser)
+	if err != nil {
+		return err
+	}
+	if domain == event.Origin() {
+		return nil
+	}
+	redacted := event.Redact()
+	results, err := keyRing.VerifyJSONs(ctx, []gomatrixserverlib.VerifyJSONRequest{{
+		ServerName: domain,
+		Message:    redacted.JSON(),
+		AtTS:       event.OriginServerTS(),
+	}})
+	if err != nil {
+		return err
+	}
+	return results[0].Error
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// MSpaceChild is the type of the state events which add rooms to a space.
+const MSpaceChild = "m.space.child"
+
+// SpaceChildContent is the event content of m.space.child events. A room
+// is only a child of the space if the list of servers to join it through
+// isn't empty.
+type SpaceChildContent struct {
+	Via       []string `json:"via"`
+	Order     string   `json:"order,omitempty"`
+	Suggested bool     `json:"suggested,omitempty"`
+}
+
+// SpaceChildState is a stripped m.space.child event of a space, as it is
+// returned in space hierarchies.
+type SpaceChildState struct {
+	Type           string                      `json:"type"`
+	StateKey       string                      `json:"state_key"`
+	Content        json.RawMessage             `json:"content"`
+	Sender         string                      `json:"sender"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
+// ParsedContent returns the content of the m.space.child event, and false
+// if the event doesn't add a room to the space.
+func (s *SpaceChildState) ParsedContent() (SpaceChildContent, bool) {
+	var content SpaceChildContent
+	if err := json.Unmarshal(s.Content, &content); err != nil {
+		return content, false
+	}
+	return content, len(content.Via) > 0
+}
+
+// SpaceRoom is the summary of a room in a space hierarchy.
+// https://github.com/matrix-org/matrix-doc/pull/2946
+type SpaceRoom struct {
+	RoomID           string            `json:"room_id"`
+	Name             string            `json:"name,omitempty"`
+	Topic            string            `json:"topic,omitempty"`
+	CanonicalAlias   string            `json:"canonical_alias,omitempty"`
+	AvatarURL        string            `json:"avatar_url,omitempty"`
+	NumJoinedMembers int               `json:"num_joined_members"`
+	WorldReadable    bool              `json:"world_readable"`
+	GuestCanJoin     bool              `json:"guest_can_join"`
+	JoinRule         string            `json:"join_rule,omitempty"`
+	RoomType         string            `json:"room_type,omitempty"`
+	ChildrenState    []SpaceChildState `json:"children_state"`
+}
+
+// IsPublic returns whether anyone can see the room in a space hierarchy,
+// which they can if anyone can join the room or read its history.
+func (r *SpaceRoom) IsPublic() bool {
+	return r.JoinRule == gomatrixserverlib.Public || r.WorldReadable
+}
+
+// LocalSpaceRoom returns the summary of a room from its current state in the
+// roomserver, along with the IDs of the users who are joined to it. The
+// summary is nil if the roomserver doesn't know about the room.
+func LocalSpaceRoom(
+	ctx context.Context, roomID string, queryAPI api.RoomserverQueryAPI,
+) (*SpaceRoom, []string, error) {
+	// Not asking for any state tuples in particular returns the whole state
+	// of the room, as the children of a space can have any state key.
+	stateReq := api.QueryLatestEventsAndStateRequest{RoomID: roomID}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return nil, nil, err
+	}
+	if !stateRes.RoomExists {
+		return nil, nil, nil
+	}
+
+	room := SpaceRoom{RoomID: roomID, ChildrenState: []SpaceChildState{}}
+	var joined []string
+	for _, ev := range stateRes.StateEvents {
+		if !ev.StateKeyEquals("") && ev.Type() != gomatrixserverlib.MRoomMember && ev.Type() != MSpaceChild {
+			continue
+		}
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomCreate:
+			var content struct {
+				Type string `json:"type"`
+			}
+			if json.Unmarshal(ev.Content(), &content) == nil {
+				room.RoomType = content.Type
+			}
+		case "m.room.name":
+			var content NameContent
+			if json.Unmarshal(ev.Content(), &content) == nil {
+				room.Name = content.Name
+			}
+		case "m.room.topic":
+			var content TopicContent
+			if json.Unmarshal(ev.Content(), &content) == nil {
+				room.Topic = content.Topic
+			}
+		case "m.room.canonical_alias":
+			var content CanonicalAliasContent
+			if json.Unmarshal(ev.Content(), &content) == nil {
+				room.CanonicalAlias = content.Alias
+			}
+		case "m.room.avatar":
+			var content AvatarContent
+			if json.Unmarshal(ev.Content(), &content) == nil {
+				room.AvatarURL = content.URL
+			}
+		case gomatrixserverlib.MRoomJoinRules:
+			var content struct {
+				JoinRule string `json:"join_rule"`
+			}
+			if json.Unmarshal(ev.Content(), &content) == nil {
+				room.JoinRule = content.JoinRule
+			}
+		case gomatrixserverlib.MRoomHistoryVisibility:
+			var content HistoryVisibilityContent
+			if json.Unmarshal(ev.Content(), &content) == nil {
+				room.WorldReadable = content.HistoryVisibility == "world_readable"
+			}
+		case "m.room.guest_access":
+			var content GuestAccessContent
+			if json.Unmarshal(ev.Content(), &content) == nil {
+				room.GuestCanJoin = content.GuestAccess == "can_join"
+			}
+		case gomatrixserverlib.MRoomMember:
+			if membership, err := ev.Membership(); err == nil && membership == gomatrixserverlib.Join {
+				joined = append(joined, *ev.StateKey())
+			}
+		case MSpaceChild:
+			child := SpaceChildState{
+				Type:           ev.Type(),
+				StateKey:       *ev.StateKey(),
+				Content:        ev.Content(),
+				Sender:         ev.Sender(),
+				OriginServerTS: ev.OriginServerTS(),
+			}
+			if _, ok := child.ParsedContent(); ok {
+				room.ChildrenState = append(room.ChildrenState, child)
+			}
+		}
+	}
+	room.NumJoinedMembers = len(joined)
+	return &room, joined, nil
+}
+
+// RespSpaceHierarchy is the response to a federation request for the
+// hierarchy of a space.
+type RespSpaceHierarchy struct {
+	// The space itself.
+	Room SpaceRoom `json:"room"`
+	// The children of the space which the requesting server can see.
+	Children []SpaceRoom `json:"children"`
+	// The IDs of the children which the requesting server can't see.
+	InaccessibleChildren []string `json:"inaccessible_children"`
+}
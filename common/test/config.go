@@ -84,6 +84,10 @@ func MakeConfig(configDir, kafkaURI, database, host string, startPort int) (*con
 	cfg.Kafka.Topics.OutputRoomEvent = "test.room.output"
 	cfg.Kafka.Topics.OutputClientData = "test.clientapi.output"
 	cfg.Kafka.Topics.OutputTypingEvent = "test.typing.output"
+	cfg.Kafka.Topics.OutputReceiptEvent = "test.receipt.output"
+	cfg.Kafka.Topics.OutputPresenceEvent = "test.presence.output"
+	cfg.Kafka.Topics.OutputSendToDeviceEvent = "test.sendtodevice.output"
+	cfg.Kafka.Topics.OutputDeviceListUpdate = "test.devicelist.output"
 	cfg.Kafka.Topics.UserUpdates = "test.user.output"
 
 	// TODO: Use different databases for the different schemas.
@@ -96,6 +100,7 @@ func MakeConfig(configDir, kafkaURI, database, host string, startPort int) (*con
 	cfg.Database.MediaAPI = config.DataSource(database)
 	cfg.Database.RoomServer = config.DataSource(database)
 	cfg.Database.ServerKey = config.DataSource(database)
+	cfg.Database.FederationAPI = config.DataSource(database)
 	cfg.Database.SyncAPI = config.DataSource(database)
 	cfg.Database.PublicRoomsAPI = config.DataSource(database)
 
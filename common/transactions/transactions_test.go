@@ -44,8 +44,8 @@ func TestCache(t *testing.T) {
 	for i := 1; i <= 100; i++ {
 		fakeTxnCache.AddTransaction(
 			fakeAccessToken,
-			fakeTxnID+string(i),
-			&util.JSONResponse{Code: http.StatusOK, JSON: fakeType{ID: string(i)}},
+			fakeTxnID+string(rune(i)),
+			&util.JSONResponse{Code: http.StatusOK, JSON: fakeType{ID: string(rune(i))}},
 		)
 	}
 
@@ -30,6 +30,12 @@ type AccountData struct {
 	Type   string `json:"type"`
 }
 
+// DeviceListUpdate represents a change to the devices or device keys of a
+// user, sent from the client API server to the sync API server
+type DeviceListUpdate struct {
+	UserID string `json:"user_id"`
+}
+
 // ProfileResponse is a struct containing all known user profile data
 type ProfileResponse struct {
 	AvatarURL   string `json:"avatar_url"`
@@ -15,6 +15,7 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 
@@ -45,6 +46,86 @@ type InputTypingEventRequest struct {
 // InputTypingEventResponse is a response to InputTypingEvents
 type InputTypingEventResponse struct{}
 
+// InputReceiptEvent is an event for notifying the EDU server about a receipt
+// sent by a local user, or by a remote user over federation.
+type InputReceiptEvent struct {
+	// UserID of the user who sent the receipt.
+	UserID string `json:"user_id"`
+	// RoomID of the room the receipt is for.
+	RoomID string `json:"room_id"`
+	// EventID of the event the receipt is for.
+	EventID string `json:"event_id"`
+	// Type of the receipt, e.g. "m.read".
+	Type string `json:"type"`
+	// Timestamp when the server received the receipt.
+	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
+}
+
+// InputReceiptEventRequest is a request to EDUServerInputAPI
+type InputReceiptEventRequest struct {
+	InputReceiptEvent InputReceiptEvent `json:"input_receipt_event"`
+}
+
+// InputReceiptEventResponse is a response to InputReceiptEvent
+type InputReceiptEventResponse struct{}
+
+// The presence states that a user can be in.
+const (
+	PresenceOnline      = "online"
+	PresenceUnavailable = "unavailable"
+	PresenceOffline     = "offline"
+)
+
+// InputPresenceEvent is an event for notifying the EDU server about a change
+// in the presence of a user.
+type InputPresenceEvent struct {
+	// UserID of the user whose presence changed.
+	UserID string `json:"user_id"`
+	// Presence is one of "online", "unavailable" or "offline".
+	Presence string `json:"presence"`
+	// StatusMsg is the user's status message. If nil then the user's current
+	// status message is left unchanged.
+	StatusMsg *string `json:"status_msg,omitempty"`
+	// Timestamp when the server received the update. For remote users this is
+	// the time when they were last active.
+	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
+	// CurrentlyActive is whether a remote user is currently active. It is
+	// ignored for local users, whose activity is tracked by the EDU server.
+	CurrentlyActive bool `json:"currently_active"`
+}
+
+// InputPresenceEventRequest is a request to EDUServerInputAPI
+type InputPresenceEventRequest struct {
+	InputPresenceEvent InputPresenceEvent `json:"input_presence_event"`
+}
+
+// InputPresenceEventResponse is a response to InputPresenceEvent
+type InputPresenceEventResponse struct{}
+
+// InputSendToDeviceEvent is an event for notifying the EDU server about a
+// message sent by a user to a device of another user.
+type InputSendToDeviceEvent struct {
+	// UserID of the user the message is for.
+	UserID string `json:"user_id"`
+	// DeviceID of the device the message is for, or "*" for all of the
+	// devices of the user.
+	DeviceID string `json:"device_id"`
+	// Sender of the message.
+	Sender string `json:"sender"`
+	// Type of the message, e.g. "m.room_key_request".
+	Type string `json:"type"`
+	// Content of the message.
+	Content json.RawMessage `json:"content"`
+}
+
+// InputSendToDeviceEventRequest is a request to EDUServerInputAPI
+type InputSendToDeviceEventRequest struct {
+	InputSendToDeviceEvent InputSendToDeviceEvent `json:"input_send_to_device_event"`
+}
+
+// InputSendToDeviceEventResponse is a response to InputSendToDeviceEvent
+type InputSendToDeviceEventResponse struct{}
+
 // EDUServerInputAPI is used to write events to the typing server.
 type EDUServerInputAPI interface {
 	InputTypingEvent(
@@ -52,11 +133,38 @@ type EDUServerInputAPI interface {
 		request *InputTypingEventRequest,
 		response *InputTypingEventResponse,
 	) error
+
+	InputReceiptEvent(
+		ctx context.Context,
+		request *InputReceiptEventRequest,
+		response *InputReceiptEventResponse,
+	) error
+
+	InputPresenceEvent(
+		ctx context.Context,
+		request *InputPresenceEventRequest,
+		response *InputPresenceEventResponse,
+	) error
+
+	InputSendToDeviceEvent(
+		ctx context.Context,
+		request *InputSendToDeviceEventRequest,
+		response *InputSendToDeviceEventResponse,
+	) error
 }
 
 // EDUServerInputTypingEventPath is the HTTP path for the InputTypingEvent API.
 const EDUServerInputTypingEventPath = "/api/eduserver/input"
 
+// EDUServerInputReceiptEventPath is the HTTP path for the InputReceiptEvent API.
+const EDUServerInputReceiptEventPath = "/api/eduserver/inputReceipt"
+
+// EDUServerInputPresenceEventPath is the HTTP path for the InputPresenceEvent API.
+const EDUServerInputPresenceEventPath = "/api/eduserver/inputPresence"
+
+// EDUServerInputSendToDeviceEventPath is the HTTP path for the InputSendToDeviceEvent API.
+const EDUServerInputSendToDeviceEventPath = "/api/eduserver/inputSendToDevice"
+
 // NewEDUServerInputAPIHTTP creates a EDUServerInputAPI implemented by talking to a HTTP POST API.
 func NewEDUServerInputAPIHTTP(eduServerURL string, httpClient *http.Client) (EDUServerInputAPI, error) {
 	if httpClient == nil {
@@ -82,3 +190,42 @@ func (h *httpEDUServerInputAPI) InputTypingEvent(
 	apiURL := h.eduServerURL + EDUServerInputTypingEventPath
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// InputReceiptEvent implements EDUServerInputAPI
+func (h *httpEDUServerInputAPI) InputReceiptEvent(
+	ctx context.Context,
+	request *InputReceiptEventRequest,
+	response *InputReceiptEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputReceiptEvent")
+	defer span.Finish()
+
+	apiURL := h.eduServerURL + EDUServerInputReceiptEventPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// InputPresenceEvent implements EDUServerInputAPI
+func (h *httpEDUServerInputAPI) InputPresenceEvent(
+	ctx context.Context,
+	request *InputPresenceEventRequest,
+	response *InputPresenceEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputPresenceEvent")
+	defer span.Finish()
+
+	apiURL := h.eduServerURL + EDUServerInputPresenceEventPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// InputSendToDeviceEvent implements EDUServerInputAPI
+func (h *httpEDUServerInputAPI) InputSendToDeviceEvent(
+	ctx context.Context,
+	request *InputSendToDeviceEventRequest,
+	response *InputSendToDeviceEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputSendToDeviceEvent")
+	defer span.Finish()
+
+	apiURL := h.eduServerURL + EDUServerInputSendToDeviceEventPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -12,7 +12,12 @@
 
 package api
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
 
 // OutputTypingEvent is an entry in typing server output kafka log.
 // This contains the event with extra fields used to create 'm.typing' event
@@ -32,3 +37,51 @@ type TypingEvent struct {
 	UserID string `json:"user_id"`
 	Typing bool   `json:"typing"`
 }
+
+// OutputReceiptEvent is an entry in the receipt output kafka log. It contains
+// the latest receipts sent by each user in a room during a batching window,
+// so that they can be sent to other servers in a single 'm.receipt' event.
+type OutputReceiptEvent struct {
+	RoomID   string         `json:"room_id"`
+	Receipts []ReceiptEvent `json:"receipts"`
+}
+
+// ReceiptEvent represents a receipt sent by a user for an event in a room.
+type ReceiptEvent struct {
+	UserID    string                      `json:"user_id"`
+	RoomID    string                      `json:"room_id"`
+	EventID   string                      `json:"event_id"`
+	Type      string                      `json:"type"`
+	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
+}
+
+// OutputPresenceEvent is an entry in the presence output kafka log. It is
+// produced whenever the presence of a user changes.
+type OutputPresenceEvent struct {
+	Event PresenceEvent `json:"event"`
+}
+
+// PresenceEvent represents the current presence of a user.
+type PresenceEvent struct {
+	UserID          string                      `json:"user_id"`
+	Presence        string                      `json:"presence"`
+	StatusMsg       *string                     `json:"status_msg,omitempty"`
+	LastActiveTS    gomatrixserverlib.Timestamp `json:"last_active_ts"`
+	CurrentlyActive bool                        `json:"currently_active"`
+}
+
+// OutputSendToDeviceEvent is an entry in the send-to-device output kafka log.
+// It is produced for each device that a message is sent to. The device ID is
+// "*" if the message is for all of the devices of the user.
+type OutputSendToDeviceEvent struct {
+	UserID   string            `json:"user_id"`
+	DeviceID string            `json:"device_id"`
+	Event    SendToDeviceEvent `json:"event"`
+}
+
+// SendToDeviceEvent represents a message sent by a user to a device.
+type SendToDeviceEvent struct {
+	Sender  string          `json:"sender"`
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
+}
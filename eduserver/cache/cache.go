@@ -15,12 +15,24 @@ package cache
 import (
 	"sync"
 	"time"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
 )
 
 const defaultTypingTimeout = 10 * time.Second
 
-// userSet is a map of user IDs to a timer, timer fires at expiry.
-type userSet map[string]*time.Timer
+// MaxTypingTimeout is the longest that a user can be typing for without
+// refreshing their typing notification, so that users whose clients went away
+// don't stay typing for long.
+const MaxTypingTimeout = 30 * time.Second
+
+// typingUser is a user typing in a room, whose timer fires at expiry.
+type typingUser struct {
+	timer *time.Timer
+}
+
+// userSet is a map of user IDs to the users typing.
+type userSet map[string]*typingUser
 
 // TimeoutCallbackFn is a function called right after the removal of a user
 // from the typing user list due to timeout.
@@ -32,11 +44,30 @@ type roomData struct {
 	userSet      userSet
 }
 
-// EDUCache maintains a list of users typing in each room.
+type presenceData struct {
+	syncPosition int64
+	presence     api.PresenceEvent
+}
+
+type receiptData struct {
+	syncPosition int64
+	receipt      api.ReceiptEvent
+}
+
+// receiptKey identifies the latest receipt of a type sent by a user in a room.
+type receiptKey struct {
+	userID      string
+	receiptType string
+}
+
+// EDUCache maintains a list of users typing in each room, the latest
+// presence of each user and the latest receipts sent in each room.
 type EDUCache struct {
 	sync.RWMutex
 	latestSyncPosition int64
 	data               map[string]*roomData
+	presence           map[string]*presenceData
+	receipts           map[string]map[receiptKey]*receiptData
 	timeoutCallback    TimeoutCallbackFn
 }
 
@@ -51,7 +82,11 @@ func (t *EDUCache) newRoomData() *roomData {
 
 // New returns a new EDUCache initialised for use.
 func New() *EDUCache {
-	return &EDUCache{data: make(map[string]*roomData)}
+	return &EDUCache{
+		data:     make(map[string]*roomData),
+		presence: make(map[string]*presenceData),
+		receipts: make(map[string]map[receiptKey]*receiptData),
+	}
 }
 
 // SetTimeoutCallback sets a callback function that is called right after
@@ -89,7 +124,8 @@ func (t *EDUCache) GetTypingUsersIfUpdatedAfter(
 	return
 }
 
-// AddTypingUser sets an user as typing in a room.
+// AddTypingUser sets an user as typing in a room, or refreshes the timeout of
+// a user who is typing already.
 // expire is the time when the user typing should time out.
 // if expire is nil, defaultTypingTimeout is assumed.
 // Returns the latest sync position for typing after update.
@@ -98,13 +134,14 @@ func (t *EDUCache) AddTypingUser(
 ) int64 {
 	expireTime := getExpireTime(expire)
 	if until := time.Until(expireTime); until > 0 {
-		timer := time.AfterFunc(until, func() {
-			latestSyncPosition := t.RemoveUser(userID, roomID)
-			if t.timeoutCallback != nil {
+		user := &typingUser{}
+		user.timer = time.AfterFunc(until, func() {
+			latestSyncPosition, removed := t.removeExpiredUser(userID, roomID, user)
+			if removed && t.timeoutCallback != nil {
 				t.timeoutCallback(userID, roomID, latestSyncPosition)
 			}
 		})
-		return t.addUser(userID, roomID, timer)
+		return t.addUser(userID, roomID, user)
 	}
 	return t.GetLatestSyncPosition()
 }
@@ -112,7 +149,7 @@ func (t *EDUCache) AddTypingUser(
 // addUser with mutex lock & replace the previous timer.
 // Returns the latest typing sync position after update.
 func (t *EDUCache) addUser(
-	userID, roomID string, expiryTimer *time.Timer,
+	userID, roomID string, user *typingUser,
 ) int64 {
 	t.Lock()
 	defer t.Unlock()
@@ -125,18 +162,14 @@ func (t *EDUCache) addUser(
 		t.data[roomID].syncPosition = t.latestSyncPosition
 	}
 
-	// Stop the timer to cancel the call to timeoutCallback
-	if timer, ok := t.data[roomID].userSet[userID]; ok {
-		// It may happen that at this stage the timer fires, but we now have a lock on
-		// it. Hence the execution of timeoutCallback will happen after we unlock. So
-		// we may lose a typing state, though this is highly unlikely. This can be
-		// mitigated by keeping another time.Time in the map and checking against it
-		// before removing, but its occurrence is so infrequent it does not seem
-		// worthwhile.
-		timer.Stop()
+	// Stop the timer of the previous typing notification. If it has fired
+	// already then it won't remove the user, as it no longer matches the user
+	// in the set.
+	if previous, ok := t.data[roomID].userSet[userID]; ok {
+		previous.timer.Stop()
 	}
 
-	t.data[roomID].userSet[userID] = expiryTimer
+	t.data[roomID].userSet[userID] = user
 
 	return t.latestSyncPosition
 }
@@ -147,25 +180,107 @@ func (t *EDUCache) RemoveUser(userID, roomID string) int64 {
 	t.Lock()
 	defer t.Unlock()
 
+	position, _ := t.removeUser(userID, roomID, nil)
+	return position
+}
+
+// removeExpiredUser removes a user whose typing notification expired, unless
+// it was refreshed since. Returns the latest sync position for typing after
+// update, and whether the user was removed.
+func (t *EDUCache) removeExpiredUser(userID, roomID string, user *typingUser) (int64, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.removeUser(userID, roomID, user)
+}
+
+// removeUser removes a user from the typing users of a room, only if they
+// still have the given typing notification unless it is nil. Must only be
+// called after locking the cache.
+func (t *EDUCache) removeUser(userID, roomID string, user *typingUser) (int64, bool) {
 	roomData, ok := t.data[roomID]
 	if !ok {
-		return t.latestSyncPosition
+		return t.latestSyncPosition, false
 	}
 
-	timer, ok := roomData.userSet[userID]
-	if !ok {
-		return t.latestSyncPosition
+	current, ok := roomData.userSet[userID]
+	if !ok || (user != nil && current != user) {
+		return t.latestSyncPosition, false
 	}
 
-	timer.Stop()
+	current.timer.Stop()
 	delete(roomData.userSet, userID)
 
 	t.latestSyncPosition++
-	t.data[roomID].syncPosition = t.latestSyncPosition
+	roomData.syncPosition = t.latestSyncPosition
 
+	return t.latestSyncPosition, true
+}
+
+// SetPresence stores the latest presence of a user.
+// Returns the latest sync position after update.
+func (t *EDUCache) SetPresence(presence api.PresenceEvent) int64 {
+	t.Lock()
+	defer t.Unlock()
+
+	t.latestSyncPosition++
+	t.presence[presence.UserID] = &presenceData{
+		syncPosition: t.latestSyncPosition,
+		presence:     presence,
+	}
+	return t.latestSyncPosition
+}
+
+// GetPresenceUpdatedAfter returns the presence of every user whose presence
+// was updated after the given sync position.
+func (t *EDUCache) GetPresenceUpdatedAfter(position int64) []api.PresenceEvent {
+	t.RLock()
+	defer t.RUnlock()
+
+	var presence []api.PresenceEvent
+	for _, data := range t.presence {
+		if data.syncPosition > position {
+			presence = append(presence, data.presence)
+		}
+	}
+	return presence
+}
+
+// StoreReceipts stores receipts sent in a room, replacing the receipt of the
+// same type previously sent by each user.
+// Returns the latest sync position after update.
+func (t *EDUCache) StoreReceipts(roomID string, receipts []api.ReceiptEvent) int64 {
+	t.Lock()
+	defer t.Unlock()
+
+	t.latestSyncPosition++
+	if t.receipts[roomID] == nil {
+		t.receipts[roomID] = make(map[receiptKey]*receiptData)
+	}
+	for _, receipt := range receipts {
+		t.receipts[roomID][receiptKey{receipt.UserID, receipt.Type}] = &receiptData{
+			syncPosition: t.latestSyncPosition,
+			receipt:      receipt,
+		}
+	}
 	return t.latestSyncPosition
 }
 
+// GetReceiptsUpdatedAfter returns the receipts in a room which were sent
+// after the given sync position.
+func (t *EDUCache) GetReceiptsUpdatedAfter(roomID string, position int64) []api.ReceiptEvent {
+	t.RLock()
+	defer t.RUnlock()
+
+	var receipts []api.ReceiptEvent
+	for _, data := range t.receipts[roomID] {
+		if data.syncPosition > position {
+			receipts = append(receipts, data.receipt)
+		}
+	}
+	return receipts
+}
+
 func (t *EDUCache) GetLatestSyncPosition() int64 {
 	t.Lock()
 	defer t.Unlock()
@@ -97,3 +97,82 @@ func testRemoveUser(t *testing.T, tCache *EDUCache) {
 		}
 	}
 }
+
+func TestTypingUserTimesOut(t *testing.T) {
+	tCache := New()
+	timedOut := make(chan string, 1)
+	tCache.SetTimeoutCallback(func(userID, roomID string, latestSyncPosition int64) {
+		timedOut <- userID
+	})
+
+	expire := time.Now().Add(50 * time.Millisecond)
+	tCache.AddTypingUser("user1", "room1", &expire)
+	if users := tCache.GetTypingUsers("room1"); !test.UnsortedStringSliceEqual(users, []string{"user1"}) {
+		t.Fatalf("expected user1 to be typing, got %v", users)
+	}
+
+	select {
+	case userID := <-timedOut:
+		if userID != "user1" {
+			t.Errorf("expected user1 to time out, got %s", userID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the typing notification to time out")
+	}
+	if users := tCache.GetTypingUsers("room1"); len(users) != 0 {
+		t.Errorf("expected nobody to be typing after the timeout, got %v", users)
+	}
+}
+
+func TestTypingUserRefreshExtendsTimeout(t *testing.T) {
+	tCache := New()
+	timedOut := make(chan time.Time, 2)
+	tCache.SetTimeoutCallback(func(userID, roomID string, latestSyncPosition int64) {
+		timedOut <- time.Now()
+	})
+
+	expire := time.Now().Add(50 * time.Millisecond)
+	tCache.AddTypingUser("user1", "room1", &expire)
+	refreshed := time.Now().Add(200 * time.Millisecond)
+	tCache.AddTypingUser("user1", "room1", &refreshed)
+
+	time.Sleep(100 * time.Millisecond)
+	if users := tCache.GetTypingUsers("room1"); !test.UnsortedStringSliceEqual(users, []string{"user1"}) {
+		t.Errorf("expected user1 to still be typing after refreshing, got %v", users)
+	}
+
+	select {
+	case at := <-timedOut:
+		if at.Before(refreshed) {
+			t.Errorf("expected the typing notification to time out at %v, not %v", refreshed, at)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the refreshed typing notification to time out")
+	}
+	if users := tCache.GetTypingUsers("room1"); len(users) != 0 {
+		t.Errorf("expected nobody to be typing after the timeout, got %v", users)
+	}
+	select {
+	case <-timedOut:
+		t.Error("expected the user to time out only once")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRemovedTypingUserDoesNotTimeOut(t *testing.T) {
+	tCache := New()
+	timedOut := make(chan string, 1)
+	tCache.SetTimeoutCallback(func(userID, roomID string, latestSyncPosition int64) {
+		timedOut <- userID
+	})
+
+	expire := time.Now().Add(20 * time.Millisecond)
+	tCache.AddTypingUser("user1", "room1", &expire)
+	tCache.RemoveUser("user1", "room1")
+
+	select {
+	case <-timedOut:
+		t.Error("expected a user who stopped typing not to time out")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
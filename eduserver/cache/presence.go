@@ -0,0 +1,159 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// PresenceIdleFn is a function called right after a local user has been
+// marked as unavailable because they were idle for too long.
+type PresenceIdleFn func(presence api.PresenceEvent)
+
+type userPresence struct {
+	presence api.PresenceEvent
+	// idleTimer fires when a local user who is online has been idle for too
+	// long. It is nil for remote users and for users who aren't online.
+	idleTimer *time.Timer
+}
+
+// PresenceCache stores the current presence of each user.
+type PresenceCache struct {
+	sync.Mutex
+	idleTimeout  time.Duration
+	idleCallback PresenceIdleFn
+	users        map[string]*userPresence
+}
+
+// NewPresenceCache returns a new PresenceCache which marks local users who
+// are online as unavailable once they have been idle for idleTimeout, then
+// calls idleCallback. If idleTimeout is zero then users are never marked as
+// unavailable.
+func NewPresenceCache(idleTimeout time.Duration, idleCallback PresenceIdleFn) *PresenceCache {
+	return &PresenceCache{
+		idleTimeout:  idleTimeout,
+		idleCallback: idleCallback,
+		users:        make(map[string]*userPresence),
+	}
+}
+
+// GetPresence returns the current presence of a user, and false if the
+// presence of the user isn't known.
+func (c *PresenceCache) GetPresence(userID string) (api.PresenceEvent, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	data, ok := c.users[userID]
+	if !ok {
+		return api.PresenceEvent{UserID: userID, Presence: api.PresenceOffline}, false
+	}
+	return data.presence, true
+}
+
+// SetPresence updates the presence of a user. If the status message is nil
+// then the user's previous status message is kept. Local users who are set
+// online are marked as currently active until they become idle. Returns the
+// new presence of the user, and whether it changed in a way that other users
+// should be told about.
+func (c *PresenceCache) SetPresence(
+	presence api.PresenceEvent, local bool,
+) (api.PresenceEvent, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	data, ok := c.users[presence.UserID]
+	if !ok {
+		data = &userPresence{presence: api.PresenceEvent{
+			UserID:   presence.UserID,
+			Presence: api.PresenceOffline,
+		}}
+		c.users[presence.UserID] = data
+	}
+	if presence.StatusMsg == nil {
+		presence.StatusMsg = data.presence.StatusMsg
+	}
+	if data.idleTimer != nil {
+		data.idleTimer.Stop()
+		data.idleTimer = nil
+	}
+	if local {
+		presence.CurrentlyActive = presence.Presence == api.PresenceOnline
+		if presence.CurrentlyActive && c.idleTimeout > 0 {
+			data.idleTimer = c.startIdleTimer(presence.UserID)
+		}
+	}
+
+	changed := !ok ||
+		presence.Presence != data.presence.Presence ||
+		presence.CurrentlyActive != data.presence.CurrentlyActive ||
+		!equalStatusMsg(presence.StatusMsg, data.presence.StatusMsg)
+	data.presence = presence
+	return presence, changed
+}
+
+// startIdleTimer starts a timer which marks a local user as unavailable once
+// they have been idle for too long. Must only be called after locking the
+// cache, which makes sure that the timer is stored before it can fire.
+func (c *PresenceCache) startIdleTimer(userID string) (timer *time.Timer) {
+	timer = time.AfterFunc(c.idleTimeout, func() {
+		c.Lock()
+		data := c.users[userID]
+		if data.idleTimer != timer {
+			// The user was active again before the timer was stopped.
+			c.Unlock()
+			return
+		}
+		data.idleTimer = nil
+		data.presence.Presence = api.PresenceUnavailable
+		data.presence.CurrentlyActive = false
+		presence := data.presence
+		c.Unlock()
+
+		if c.idleCallback != nil {
+			c.idleCallback(presence)
+		}
+	})
+	return
+}
+
+func equalStatusMsg(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// LastActiveAgo returns the number of milliseconds since the user was last
+// active, as sent to clients and other servers.
+func LastActiveAgo(presence api.PresenceEvent, now time.Time) int64 {
+	if presence.LastActiveTS == 0 {
+		return 0
+	}
+	ago := now.Sub(presence.LastActiveTS.Time()) / time.Millisecond
+	if ago < 0 {
+		return 0
+	}
+	return int64(ago)
+}
+
+// LastActiveTS returns the time when a user was last active from the
+// number of milliseconds since they were last active.
+func LastActiveTS(lastActiveAgo int64, now time.Time) gomatrixserverlib.Timestamp {
+	return gomatrixserverlib.AsTimestamp(now.Add(-time.Duration(lastActiveAgo) * time.Millisecond))
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
+)
+
+func TestIdleUserBecomesUnavailable(t *testing.T) {
+	idle := make(chan api.PresenceEvent, 1)
+	pCache := NewPresenceCache(50*time.Millisecond, func(presence api.PresenceEvent) {
+		idle <- presence
+	})
+
+	presence, changed := pCache.SetPresence(api.PresenceEvent{
+		UserID: "@alice:localhost", Presence: api.PresenceOnline,
+	}, true)
+	if !changed || !presence.CurrentlyActive {
+		t.Fatalf("expected alice to become currently active, got %+v", presence)
+	}
+	if _, changed = pCache.SetPresence(api.PresenceEvent{
+		UserID: "@alice:localhost", Presence: api.PresenceOnline,
+	}, true); changed {
+		t.Error("expected syncing again not to change alice's presence")
+	}
+
+	select {
+	case presence = <-idle:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for alice to become idle")
+	}
+	if presence.Presence != api.PresenceUnavailable || presence.CurrentlyActive {
+		t.Errorf("expected alice to be unavailable, got %+v", presence)
+	}
+	if presence, _ = pCache.GetPresence("@alice:localhost"); presence.Presence != api.PresenceUnavailable {
+		t.Errorf("expected the cache to store alice as unavailable, got %s", presence.Presence)
+	}
+}
+
+func TestRemoteUserDoesNotBecomeIdle(t *testing.T) {
+	pCache := NewPresenceCache(10*time.Millisecond, func(presence api.PresenceEvent) {
+		t.Errorf("expected remote users never to become idle, got %+v", presence)
+	})
+	pCache.SetPresence(api.PresenceEvent{
+		UserID: "@bob:example.org", Presence: api.PresenceOnline, CurrentlyActive: true,
+	}, false)
+	time.Sleep(50 * time.Millisecond)
+	if presence, _ := pCache.GetPresence("@bob:example.org"); presence.Presence != api.PresenceOnline {
+		t.Errorf("expected bob to still be online, got %s", presence.Presence)
+	}
+}
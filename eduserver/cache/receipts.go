@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
+)
+
+// ReceiptFlushFn is a function called with the pending receipts in a room
+// once its batching window has ended.
+type ReceiptFlushFn func(roomID string, receipts []api.ReceiptEvent)
+
+// ReceiptCache batches the receipts sent in each room, so that all of the
+// receipts sent in a room within a window can be sent out together.
+type ReceiptCache struct {
+	sync.Mutex
+	window time.Duration
+	flush  ReceiptFlushFn
+	// pending maps a room ID to the receipts waiting to be flushed in that room.
+	pending map[string][]api.ReceiptEvent
+}
+
+// NewReceiptCache returns a new ReceiptCache which calls flush with the
+// receipts in a room once window has passed since the first of them was
+// added. If window is zero then every receipt is flushed straight away.
+func NewReceiptCache(window time.Duration, flush ReceiptFlushFn) *ReceiptCache {
+	return &ReceiptCache{
+		window:  window,
+		flush:   flush,
+		pending: make(map[string][]api.ReceiptEvent),
+	}
+}
+
+// AddReceipt adds a receipt to the batch for its room, replacing any pending
+// receipt of the same type from the same user.
+func (c *ReceiptCache) AddReceipt(receipt api.ReceiptEvent) {
+	if c.window <= 0 {
+		c.flush(receipt.RoomID, []api.ReceiptEvent{receipt})
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	receipts, ok := c.pending[receipt.RoomID]
+	if !ok {
+		// This is the first receipt in the batch, so start the window.
+		time.AfterFunc(c.window, func() {
+			c.flushRoom(receipt.RoomID)
+		})
+	}
+	for i := range receipts {
+		if receipts[i].UserID == receipt.UserID && receipts[i].Type == receipt.Type {
+			receipts[i] = receipt
+			return
+		}
+	}
+	c.pending[receipt.RoomID] = append(receipts, receipt)
+}
+
+// Flush flushes the pending receipts in every room straight away, without
+// waiting for their windows to end.
+func (c *ReceiptCache) Flush() {
+	c.Lock()
+	roomIDs := make([]string, 0, len(c.pending))
+	for roomID := range c.pending {
+		roomIDs = append(roomIDs, roomID)
+	}
+	c.Unlock()
+
+	for _, roomID := range roomIDs {
+		c.flushRoom(roomID)
+	}
+}
+
+// flushRoom removes the pending receipts for a room and flushes them.
+func (c *ReceiptCache) flushRoom(roomID string) {
+	c.Lock()
+	receipts := c.pending[roomID]
+	delete(c.pending, roomID)
+	c.Unlock()
+
+	if len(receipts) > 0 {
+		c.flush(roomID, receipts)
+	}
+}
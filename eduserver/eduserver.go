@@ -13,6 +13,7 @@
 package eduserver
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/common/basecomponent"
@@ -30,10 +31,27 @@ func SetupEDUServerComponent(
 	eduCache *cache.EDUCache,
 ) api.EDUServerInputAPI {
 	inputAPI := &input.EDUServerInputAPI{
-		Cache:                  eduCache,
-		Producer:               base.KafkaProducer,
-		OutputTypingEventTopic: string(base.Cfg.Kafka.Topics.OutputTypingEvent),
+		Cache:                        eduCache,
+		Producer:                     base.KafkaProducer,
+		OutputTypingEventTopic:       string(base.Cfg.Kafka.Topics.OutputTypingEvent),
+		OutputReceiptEventTopic:      string(base.Cfg.Kafka.Topics.OutputReceiptEvent),
+		OutputPresenceEventTopic:     string(base.Cfg.Kafka.Topics.OutputPresenceEvent),
+		OutputSendToDeviceEventTopic: string(base.Cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		ServerName:                   base.Cfg.Matrix.ServerName,
 	}
+	eduCache.SetTimeoutCallback(inputAPI.SendTypingTimeout)
+	inputAPI.ReceiptCache = cache.NewReceiptCache(
+		base.Cfg.Matrix.ReceiptBatchWindow, inputAPI.SendReceipts,
+	)
+	inputAPI.PresenceCache = cache.NewPresenceCache(
+		base.Cfg.Matrix.PresenceIdleTimeout, inputAPI.SendIdlePresence,
+	)
+	// Send the batches of receipts out before shutting down rather than
+	// losing them.
+	base.RegisterShutdownHook("receipt batches", func(context.Context) error {
+		inputAPI.ReceiptCache.Flush()
+		return nil
+	})
 
 	inputAPI.SetupHTTP(http.DefaultServeMux)
 	return inputAPI
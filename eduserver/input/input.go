@@ -23,6 +23,7 @@ import (
 	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/Shopify/sarama.v1"
 )
 
@@ -32,6 +33,18 @@ type EDUServerInputAPI struct {
 	Cache *cache.EDUCache
 	// The kafka topic to output new typing events to.
 	OutputTypingEventTopic string
+	// Cache to batch receipts in each room before they are output.
+	ReceiptCache *cache.ReceiptCache
+	// The kafka topic to output batches of receipts to.
+	OutputReceiptEventTopic string
+	// Cache to store the current presence of each user.
+	PresenceCache *cache.PresenceCache
+	// The kafka topic to output presence changes to.
+	OutputPresenceEventTopic string
+	// The kafka topic to output send-to-device messages to.
+	OutputSendToDeviceEventTopic string
+	// The name of this server, used to tell local users from remote ones.
+	ServerName gomatrixserverlib.ServerName
 	// kafka producer
 	Producer sarama.SyncProducer
 }
@@ -43,20 +56,41 @@ func (t *EDUServerInputAPI) InputTypingEvent(
 	response *api.InputTypingEventResponse,
 ) error {
 	ite := &request.InputTypingEvent
-	if ite.Typing {
-		// user is typing, update our current state of users typing.
-		expireTime := ite.OriginServerTS.Time().Add(
-			time.Duration(ite.TimeoutMS) * time.Millisecond,
-		)
-		t.Cache.AddTypingUser(ite.UserID, ite.RoomID, &expireTime)
-	} else {
+	if !ite.Typing {
 		t.Cache.RemoveUser(ite.UserID, ite.RoomID)
+		return t.sendEvent(ite, nil)
 	}
 
-	return t.sendEvent(ite)
+	// user is typing, update our current state of users typing.
+	timeout := time.Duration(ite.TimeoutMS) * time.Millisecond
+	if timeout > cache.MaxTypingTimeout {
+		timeout = cache.MaxTypingTimeout
+	}
+	expireTime := ite.OriginServerTS.Time().Add(timeout)
+	t.Cache.AddTypingUser(ite.UserID, ite.RoomID, &expireTime)
+	return t.sendEvent(ite, &expireTime)
+}
+
+// SendTypingTimeout outputs that a user stopped typing once their typing
+// notification timed out without being refreshed, so that other servers stop
+// showing them as typing too. It is called by the typing cache.
+func (t *EDUServerInputAPI) SendTypingTimeout(userID, roomID string, latestSyncPosition int64) {
+	err := t.sendEvent(&api.InputTypingEvent{
+		UserID: userID,
+		RoomID: roomID,
+		Typing: false,
+	}, nil)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"user_id": userID,
+			"room_id": roomID,
+		}).Error("Failed to output typing timeout")
+	}
 }
 
-func (t *EDUServerInputAPI) sendEvent(ite *api.InputTypingEvent) error {
+// sendEvent outputs a typing event, which expires at the given time if the
+// user is typing.
+func (t *EDUServerInputAPI) sendEvent(ite *api.InputTypingEvent, expireTime *time.Time) error {
 	ev := &api.TypingEvent{
 		Type:   gomatrixserverlib.MTyping,
 		RoomID: ite.RoomID,
@@ -64,14 +98,8 @@ func (t *EDUServerInputAPI) sendEvent(ite *api.InputTypingEvent) error {
 		Typing: ite.Typing,
 	}
 	ote := &api.OutputTypingEvent{
-		Event: *ev,
-	}
-
-	if ev.Typing {
-		expireTime := ite.OriginServerTS.Time().Add(
-			time.Duration(ite.TimeoutMS) * time.Millisecond,
-		)
-		ote.ExpireTime = &expireTime
+		Event:      *ev,
+		ExpireTime: expireTime,
 	}
 
 	eventJSON, err := json.Marshal(ote)
@@ -89,6 +117,131 @@ func (t *EDUServerInputAPI) sendEvent(ite *api.InputTypingEvent) error {
 	return err
 }
 
+// InputReceiptEvent implements api.EDUServerInputAPI
+func (t *EDUServerInputAPI) InputReceiptEvent(
+	ctx context.Context,
+	request *api.InputReceiptEventRequest,
+	response *api.InputReceiptEventResponse,
+) error {
+	ire := &request.InputReceiptEvent
+	t.ReceiptCache.AddReceipt(api.ReceiptEvent{
+		UserID:    ire.UserID,
+		RoomID:    ire.RoomID,
+		EventID:   ire.EventID,
+		Type:      ire.Type,
+		Timestamp: ire.Timestamp,
+	})
+	return nil
+}
+
+// SendReceipts outputs a batch of receipts in a room. It is called by the
+// receipt cache once the batching window for the room has ended.
+func (t *EDUServerInputAPI) SendReceipts(roomID string, receipts []api.ReceiptEvent) {
+	ore := &api.OutputReceiptEvent{
+		RoomID:   roomID,
+		Receipts: receipts,
+	}
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id":  roomID,
+		"receipts": len(receipts),
+	})
+
+	eventJSON, err := json.Marshal(ore)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal receipts")
+		return
+	}
+
+	m := &sarama.ProducerMessage{
+		Topic: t.OutputReceiptEventTopic,
+		Key:   sarama.StringEncoder(roomID),
+		Value: sarama.ByteEncoder(eventJSON),
+	}
+
+	if _, _, err = t.Producer.SendMessage(m); err != nil {
+		logger.WithError(err).Error("Failed to output receipts")
+	}
+}
+
+// InputPresenceEvent implements api.EDUServerInputAPI
+func (t *EDUServerInputAPI) InputPresenceEvent(
+	ctx context.Context,
+	request *api.InputPresenceEventRequest,
+	response *api.InputPresenceEventResponse,
+) error {
+	ipe := &request.InputPresenceEvent
+	_, domain, err := gomatrixserverlib.SplitID('@', ipe.UserID)
+	if err != nil {
+		return err
+	}
+	presence, changed := t.PresenceCache.SetPresence(api.PresenceEvent{
+		UserID:          ipe.UserID,
+		Presence:        ipe.Presence,
+		StatusMsg:       ipe.StatusMsg,
+		LastActiveTS:    ipe.Timestamp,
+		CurrentlyActive: ipe.CurrentlyActive,
+	}, domain == t.ServerName)
+	if !changed {
+		return nil
+	}
+	return t.sendPresence(presence)
+}
+
+// SendIdlePresence outputs the presence of a local user who has become idle.
+// It is called by the presence cache once the user has been marked as
+// unavailable.
+func (t *EDUServerInputAPI) SendIdlePresence(presence api.PresenceEvent) {
+	if err := t.sendPresence(presence); err != nil {
+		logrus.WithError(err).WithField("user_id", presence.UserID).Error("Failed to output presence")
+	}
+}
+
+func (t *EDUServerInputAPI) sendPresence(presence api.PresenceEvent) error {
+	eventJSON, err := json.Marshal(&api.OutputPresenceEvent{Event: presence})
+	if err != nil {
+		return err
+	}
+
+	m := &sarama.ProducerMessage{
+		Topic: t.OutputPresenceEventTopic,
+		Key:   sarama.StringEncoder(presence.UserID),
+		Value: sarama.ByteEncoder(eventJSON),
+	}
+
+	_, _, err = t.Producer.SendMessage(m)
+	return err
+}
+
+// InputSendToDeviceEvent implements api.EDUServerInputAPI
+func (t *EDUServerInputAPI) InputSendToDeviceEvent(
+	ctx context.Context,
+	request *api.InputSendToDeviceEventRequest,
+	response *api.InputSendToDeviceEventResponse,
+) error {
+	ise := &request.InputSendToDeviceEvent
+	eventJSON, err := json.Marshal(&api.OutputSendToDeviceEvent{
+		UserID:   ise.UserID,
+		DeviceID: ise.DeviceID,
+		Event: api.SendToDeviceEvent{
+			Sender:  ise.Sender,
+			Type:    ise.Type,
+			Content: ise.Content,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	m := &sarama.ProducerMessage{
+		Topic: t.OutputSendToDeviceEventTopic,
+		Key:   sarama.StringEncoder(ise.UserID),
+		Value: sarama.ByteEncoder(eventJSON),
+	}
+
+	_, _, err = t.Producer.SendMessage(m)
+	return err
+}
+
 // SetupHTTP adds the EDUServerInputAPI handlers to the http.ServeMux.
 func (t *EDUServerInputAPI) SetupHTTP(servMux *http.ServeMux) {
 	servMux.Handle(api.EDUServerInputTypingEventPath,
@@ -104,4 +257,43 @@ func (t *EDUServerInputAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(api.EDUServerInputReceiptEventPath,
+		common.MakeInternalAPI("inputReceiptEvents", func(req *http.Request) util.JSONResponse {
+			var request api.InputReceiptEventRequest
+			var response api.InputReceiptEventResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := t.InputReceiptEvent(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.EDUServerInputPresenceEventPath,
+		common.MakeInternalAPI("inputPresenceEvents", func(req *http.Request) util.JSONResponse {
+			var request api.InputPresenceEventRequest
+			var response api.InputPresenceEventResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := t.InputPresenceEvent(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.EDUServerInputSendToDeviceEventPath,
+		common.MakeInternalAPI("inputSendToDeviceEvents", func(req *http.Request) util.JSONResponse {
+			var request api.InputSendToDeviceEventRequest
+			var response api.InputSendToDeviceEventResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := t.InputSendToDeviceEvent(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
@@ -24,8 +24,12 @@ import (
 
 	// TODO: Are we really wanting to pull in the producer from clientapi
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/dendrite/federationapi/routing"
+	"github.com/matrix-org/dendrite/federationapi/storage"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
 // SetupFederationAPIComponent sets up and registers HTTP handlers for the
@@ -36,6 +40,7 @@ func SetupFederationAPIComponent(
 	deviceDB devices.Database,
 	federation *gomatrixserverlib.FederationClient,
 	keyRing *gomatrixserverlib.KeyRing,
+	keyDB keydb.Database,
 	aliasAPI roomserverAPI.RoomserverAliasAPI,
 	inputAPI roomserverAPI.RoomserverInputAPI,
 	queryAPI roomserverAPI.RoomserverQueryAPI,
@@ -43,11 +48,18 @@ func SetupFederationAPIComponent(
 	federationSenderAPI federationSenderAPI.FederationSenderQueryAPI,
 	eduProducer *producers.EDUServerProducer,
 ) {
+	federationAPIDB, err := storage.NewDatabase(string(base.Cfg.Database.FederationAPI), base.Cfg.DbProperties(config.DatabaseFederationAPI))
+	if err != nil {
+		logrus.WithError(err).Panic("failed to connect to federation api db")
+	}
+	base.RegisterDatabaseHealthCheck("federation api db", federationAPIDB)
+	go routing.CleanUpTransactions(federationAPIDB)
+
 	roomserverProducer := producers.NewRoomserverProducer(inputAPI, queryAPI)
 
 	routing.Setup(
 		base.APIMux, base.Cfg, queryAPI, aliasAPI, asAPI,
-		roomserverProducer, eduProducer, federationSenderAPI, *keyRing,
-		federation, accountsDB, deviceDB,
+		roomserverProducer, eduProducer, federationSenderAPI, *keyRing, keyDB,
+		federation, accountsDB, deviceDB, federationAPIDB,
 	)
 }
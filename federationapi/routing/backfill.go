@@ -28,7 +28,13 @@ import (
 	"github.com/matrix-org/util"
 )
 
+// maxBackfillLimit is the highest number of events returned by a single
+// request to /backfill, whatever limit the remote server asks for.
+const maxBackfillLimit = 100
+
 // Backfill implements the /backfill federation endpoint.
+// The roomserver only returns the events which the requesting server is
+// allowed to see by the history visibility of the room.
 // https://matrix.org/docs/spec/server_server/unstable.html#get-matrix-federation-v1-backfill-roomid
 func Backfill(
 	httpReq *http.Request,
@@ -72,13 +78,15 @@ func Backfill(
 		EarliestEventsIDs: eIDs,
 		ServerName:        request.Origin(),
 	}
-	if req.Limit, err = strconv.Atoi(limit); err != nil {
-		util.GetLogger(httpReq.Context()).WithError(err).Error("strconv.Atoi failed")
+	if req.Limit, err = strconv.Atoi(limit); err != nil || req.Limit <= 0 {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("limit %q is invalid format", limit)),
 		}
 	}
+	if req.Limit > maxBackfillLimit {
+		req.Limit = maxBackfillLimit
+	}
 
 	// Query the roomserver.
 	if err = query.QueryBackfill(httpReq.Context(), &req, &res); err != nil {
@@ -13,12 +13,15 @@
 package routing
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
@@ -51,3 +54,58 @@ func GetUserDevices(
 		JSON: userDevicesResponse{devs},
 	}
 }
+
+type claimOneTimeKeysRequest struct {
+	// The algorithm of the key to claim, keyed by user ID and then device ID.
+	OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+}
+
+type claimOneTimeKeysResponse struct {
+	// The claimed keys keyed by user ID, then device ID and then key ID.
+	OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+}
+
+// ClaimOneTimeKeys implements POST /_matrix/federation/v1/user/keys/claim
+// It hands out one one-time key for each of the requested devices of local
+// users which still has one. Each key is only ever handed out once.
+func ClaimOneTimeKeys(
+	req *http.Request, request *gomatrixserverlib.FederationRequest,
+	cfg *config.Dendrite, deviceDB devices.Database,
+) util.JSONResponse {
+	var r claimOneTimeKeysRequest
+	if err := json.Unmarshal(request.Content(), &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	res := claimOneTimeKeysResponse{
+		OneTimeKeys: map[string]map[string]map[string]json.RawMessage{},
+	}
+	for userID, algorithms := range r.OneTimeKeys {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || domain != cfg.Matrix.ServerName {
+			continue
+		}
+		for deviceID, algorithm := range algorithms {
+			key, err := deviceDB.ClaimOneTimeKey(req.Context(), userID, deviceID, algorithm)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("deviceDB.ClaimOneTimeKey failed")
+				return jsonerror.InternalServerError()
+			}
+			if key == nil {
+				continue
+			}
+			if res.OneTimeKeys[userID] == nil {
+				res.OneTimeKeys[userID] = map[string]map[string]json.RawMessage{}
+			}
+			res.OneTimeKeys[userID][deviceID] = map[string]json.RawMessage{key.KeyID: key.KeyJSON}
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
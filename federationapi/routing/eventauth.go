@@ -16,28 +16,73 @@ import (
 	"context"
 	"net/http"
 
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
-// GetEventAuth returns event auth for the roomID and eventID
+// GetEventAuth implements GET /_matrix/federation/v1/event_auth/{roomID}/{eventID}
+// It returns the auth chain of the event, with auth events before the events
+// they authorise. Only servers which are in the room can fetch it.
 func GetEventAuth(
-	ctx context.Context,
+	httpReq *http.Request,
 	request *gomatrixserverlib.FederationRequest,
 	query api.RoomserverQueryAPI,
 	roomID string,
 	eventID string,
 ) util.JSONResponse {
-	// TODO: Optimisation: we shouldn't be querying all the room state
-	// that is in state.StateEvents - we just ignore it.
-	state, err := getState(ctx, request, query, roomID, eventID)
-	if err != nil {
-		return *err
+	if resErr := checkServerInRoom(httpReq.Context(), query, request.Origin(), roomID); resErr != nil {
+		return *resErr
+	}
+
+	eventsReq := api.QueryEventsByIDRequest{EventIDs: []string{eventID}}
+	var eventsRes api.QueryEventsByIDResponse
+	if err := query.QueryEventsByID(httpReq.Context(), &eventsReq, &eventsRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("query.QueryEventsByID failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(eventsRes.Events) == 0 || eventsRes.Events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown event"),
+		}
+	}
+
+	// The auth chain of the auth events of the event is the auth chain of the
+	// event, without the event itself.
+	authReq := api.QueryAuthChainRequest{EventIDs: eventsRes.Events[0].AuthEventIDs()}
+	var authRes api.QueryAuthChainResponse
+	if err := query.QueryAuthChain(httpReq.Context(), &authReq, &authRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("query.QueryAuthChain failed")
+		return jsonerror.InternalServerError()
 	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: gomatrixserverlib.RespEventAuth{AuthEvents: state.AuthEvents},
+		JSON: gomatrixserverlib.RespEventAuth{
+			AuthEvents: gomatrixserverlib.UnwrapEventHeaders(authRes.AuthChain),
+		},
+	}
+}
+
+// checkServerInRoom returns an error response if the server doesn't have any
+// users joined to the room.
+func checkServerInRoom(
+	ctx context.Context, query api.RoomserverQueryAPI, serverName gomatrixserverlib.ServerName, roomID string,
+) *util.JSONResponse {
+	joinedReq := api.QueryServerJoinedToRoomRequest{RoomID: roomID, ServerName: serverName}
+	var joinedRes api.QueryServerJoinedToRoomResponse
+	if err := query.QueryServerJoinedToRoom(ctx, &joinedReq, &joinedRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("query.QueryServerJoinedToRoom failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !joinedRes.IsInRoom {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The server is not in the room"),
+		}
 	}
+	return nil
 }
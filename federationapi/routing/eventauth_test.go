@@ -0,0 +1,148 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+func (r *threePIDTestRoom) QueryServerJoinedToRoom(
+	ctx context.Context,
+	request *api.QueryServerJoinedToRoomRequest,
+	response *api.QueryServerJoinedToRoomResponse,
+) error {
+	response.RoomExists = request.RoomID == threePIDTestRoomID
+	for _, ev := range r.events {
+		if ev.Type() != gomatrixserverlib.MRoomMember {
+			continue
+		}
+		_, domain, err := gomatrixserverlib.SplitID('@', *ev.StateKey())
+		if err != nil {
+			return err
+		}
+		membership, err := ev.Membership()
+		if err != nil {
+			return err
+		}
+		if domain == request.ServerName && membership == gomatrixserverlib.Join {
+			response.IsInRoom = true
+		}
+	}
+	return nil
+}
+
+func (r *threePIDTestRoom) QueryEventsByID(
+	ctx context.Context,
+	request *api.QueryEventsByIDRequest,
+	response *api.QueryEventsByIDResponse,
+) error {
+	for _, eventID := range request.EventIDs {
+		for _, ev := range r.events {
+			if ev.EventID() == eventID {
+				response.Events = append(response.Events, ev.Headered(gomatrixserverlib.RoomVersionV1))
+			}
+		}
+	}
+	return nil
+}
+
+func (r *threePIDTestRoom) QueryAuthChain(
+	ctx context.Context,
+	request *api.QueryAuthChainRequest,
+	response *api.QueryAuthChainResponse,
+) error {
+	inChain := make(map[string]bool)
+	for _, eventID := range request.EventIDs {
+		inChain[eventID] = true
+	}
+	// The events of the room are authed by the events before them, so walking
+	// backwards finds the whole chain.
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if inChain[r.events[i].EventID()] {
+			for _, authID := range r.events[i].AuthEventIDs() {
+				inChain[authID] = true
+			}
+		}
+	}
+	for _, ev := range r.events {
+		if inChain[ev.EventID()] {
+			response.AuthChain = append(response.AuthChain, ev.Headered(gomatrixserverlib.RoomVersionV1))
+		}
+	}
+	return nil
+}
+
+// getEventAuth requests the auth chain of an event as a remote server.
+func getEventAuth(t *testing.T, room *threePIDTestRoom, origin gomatrixserverlib.ServerName, eventID string) util.JSONResponse {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/_matrix/federation/v1/event_auth/" + threePIDTestRoomID + "/" + eventID
+	request := gomatrixserverlib.NewFederationRequest(http.MethodGet, "localhost", path)
+	if err = request.Sign(origin, "ed25519:test", key); err != nil {
+		t.Fatal(err)
+	}
+	return GetEventAuth(httptest.NewRequest(http.MethodGet, path, nil), &request, room, threePIDTestRoomID, eventID)
+}
+
+func TestGetEventAuth(t *testing.T) {
+	room, _ := newThreePIDTestRoom(t)
+	bob := "@bob:remote.example.com"
+	room.addState(bob, "m.room.member", bob, gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join})
+	event := room.events[len(room.events)-1]
+
+	res := getEventAuth(t, room, "remote.example.com", event.EventID())
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	authChain := res.JSON.(gomatrixserverlib.RespEventAuth).AuthEvents
+	if len(authChain) != len(room.events)-1 {
+		t.Fatalf("expected the %d events before the join in the auth chain, got %d", len(room.events)-1, len(authChain))
+	}
+	seen := make(map[string]bool)
+	for _, ev := range authChain {
+		if ev.EventID() == event.EventID() {
+			t.Errorf("expected the event not to be in its own auth chain")
+		}
+		for _, authID := range ev.AuthEventIDs() {
+			if !seen[authID] {
+				t.Errorf("event %q came before its auth event %q", ev.EventID(), authID)
+			}
+		}
+		seen[ev.EventID()] = true
+	}
+	if authChain[0].Type() != gomatrixserverlib.MRoomCreate {
+		t.Errorf("expected the create event first, got %s", authChain[0].Type())
+	}
+}
+
+func TestGetEventAuthRequiresServerInRoom(t *testing.T) {
+	room, _ := newThreePIDTestRoom(t)
+	if res := getEventAuth(t, room, "other.example.com", room.events[1].EventID()); res.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a server which isn't in the room, got %d: %v", res.Code, res.JSON)
+	}
+	if res := getEventAuth(t, room, "localhost", "$unknown:localhost"); res.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown event, got %d: %v", res.Code, res.JSON)
+	}
+}
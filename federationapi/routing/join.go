@@ -24,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -37,6 +38,19 @@ func MakeJoin(
 	roomID, userID string,
 	remoteVersions []gomatrixserverlib.RoomVersion,
 ) util.JSONResponse {
+	blockedReq := api.QueryRoomBlockedRequest{RoomID: roomID}
+	var blockedRes api.QueryRoomBlockedResponse
+	if err := query.QueryRoomBlocked(httpReq.Context(), &blockedReq, &blockedRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("query.QueryRoomBlocked failed")
+		return jsonerror.InternalServerError()
+	}
+	if blockedRes.Blocked {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This room has been shut down"),
+		}
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
 	if err := query.QueryRoomVersionForRoom(httpReq.Context(), &verReq, &verRes); err != nil {
@@ -81,6 +95,17 @@ func MakeJoin(
 		}
 	}
 
+	// Joins to restricted rooms have to name a user of this server who can
+	// authorise them.
+	content := map[string]interface{}{"membership": gomatrixserverlib.Join}
+	authoriser, err := common.AuthoriseRestrictedJoin(httpReq.Context(), query, cfg.Matrix.ServerName, roomID, userID)
+	if resErr := restrictedJoinErrorResponse(httpReq, err); resErr != nil {
+		return *resErr
+	}
+	if authoriser != "" {
+		content[auth.JoinAuthorisedViaUsersServer] = authoriser
+	}
+
 	// Try building an event for the server
 	builder := gomatrixserverlib.EventBuilder{
 		Sender:   userID,
@@ -88,7 +113,7 @@ func MakeJoin(
 		Type:     "m.room.member",
 		StateKey: &userID,
 	}
-	err = builder.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Join})
+	err = builder.SetContent(content)
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("builder.SetContent failed")
 		return jsonerror.InternalServerError()
@@ -115,7 +140,7 @@ func MakeJoin(
 	}
 
 	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
-	if err = gomatrixserverlib.Allowed(*event, &provider); err != nil {
+	if err = auth.Allowed(*event, &provider); err != nil {
 		return util.JSONResponse{
 			Code: http.StatusForbidden,
 			JSON: jsonerror.Forbidden(err.Error()),
@@ -213,6 +238,22 @@ func SendJoin(
 		}
 	}
 
+	// A join to a restricted room which this server authorised is checked
+	// again, and signed by this server to show that it was authorised.
+	if authoriser := auth.JoinAuthorisedVia(event.Content()); authoriser != "" {
+		if _, domain, serr := gomatrixserverlib.SplitID('@', authoriser); serr != nil || domain != cfg.Matrix.ServerName {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The join must be authorised by a user of this server"),
+			}
+		}
+		_, err = common.AuthoriseRestrictedJoin(httpReq.Context(), query, cfg.Matrix.ServerName, roomID, *event.StateKey())
+		if resErr := restrictedJoinErrorResponse(httpReq, err); resErr != nil {
+			return *resErr
+		}
+		event = event.Sign(string(cfg.Matrix.ServerName), cfg.Matrix.KeyID, cfg.Matrix.PrivateKey)
+	}
+
 	// Fetch the state and auth chain. We do this before we send the events
 	// on, in case this fails.
 	var stateAndAuthChainResponse api.QueryStateAndAuthChainResponse
@@ -258,3 +299,31 @@ func SendJoin(
 		},
 	}
 }
+
+// restrictedJoinErrorResponse returns the error response for an error from
+// common.AuthoriseRestrictedJoin, or nil if there was no error.
+func restrictedJoinErrorResponse(httpReq *http.Request, err error) *util.JSONResponse {
+	switch err {
+	case nil:
+		return nil
+	case common.ErrNotInAllowedRoom:
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The user is not joined to any of the rooms allowed to join this room"),
+		}
+	case common.ErrRestrictedJoinsNotAllowed:
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The user must be invited to join this room, as its room version doesn't allow restricted joins"),
+		}
+	case common.ErrNoJoinAuthoriser:
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnableToAuthoriseJoin("No user of this server can authorise joins to this room"),
+		}
+	default:
+		util.GetLogger(httpReq.Context()).WithError(err).Error("common.AuthoriseRestrictedJoin failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+}
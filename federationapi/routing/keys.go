@@ -20,9 +20,9 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
-	"golang.org/x/crypto/ed25519"
 )
 
 // LocalKeys returns the local keys for the server.
@@ -40,16 +40,24 @@ func localKeys(cfg *config.Dendrite, validUntil time.Time) (*gomatrixserverlib.S
 
 	keys.ServerName = cfg.Matrix.ServerName
 
-	publicKey := cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey)
+	keys.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{}
+	keys.OldVerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{}
 
-	keys.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
-		cfg.Matrix.KeyID: {
-			Key: gomatrixserverlib.Base64String(publicKey),
-		},
+	// Keys which have been rotated out are published as old keys so that
+	// other servers can still check the events that were signed by them.
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	for request, key := range keydb.ServerKeys(cfg) {
+		if key.ExpiredTS != gomatrixserverlib.PublicKeyNotExpired && key.ExpiredTS <= now {
+			keys.OldVerifyKeys[request.KeyID] = gomatrixserverlib.OldVerifyKey{
+				VerifyKey: key.VerifyKey,
+				ExpiredTS: key.ExpiredTS,
+			}
+		} else {
+			keys.VerifyKeys[request.KeyID] = key.VerifyKey
+		}
 	}
 
 	keys.TLSFingerprints = cfg.Matrix.TLSFingerPrints
-	keys.OldVerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{}
 	keys.ValidUntilTS = gomatrixserverlib.AsTimestamp(validUntil)
 
 	toSign, err := json.Marshal(keys.ServerKeyFields)
@@ -0,0 +1,334 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const gapTestRoomID = "!gap:remote.example.com"
+
+// gapTestRoom is a room created on remote.example.com, of which the
+// roomserver only knows the events that have been sent to it.
+type gapTestRoom struct {
+	api.RoomserverQueryAPI
+	t          *testing.T
+	key        ed25519.PrivateKey
+	events     []gomatrixserverlib.Event
+	roomserver []gomatrixserverlib.Event
+}
+
+// build makes the next event of the room on remote.example.com.
+func (r *gapTestRoom) build(eventType string, stateKey *string, content interface{}) gomatrixserverlib.Event {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   "@bob:remote.example.com",
+		RoomID:   gapTestRoomID,
+		Type:     eventType,
+		StateKey: stateKey,
+		Depth:    int64(len(r.events) + 1),
+	}
+	if err := builder.SetContent(content); err != nil {
+		r.t.Fatal(err)
+	}
+	var prevEvents, authEvents []gomatrixserverlib.EventReference
+	if len(r.events) > 0 {
+		prevEvents = []gomatrixserverlib.EventReference{r.events[len(r.events)-1].EventReference()}
+	}
+	for _, ev := range r.events {
+		if ev.StateKey() != nil {
+			authEvents = append(authEvents, ev.EventReference())
+		}
+	}
+	builder.PrevEvents, builder.AuthEvents = prevEvents, authEvents
+	ev, err := builder.Build(time.Now(), "remote.example.com", "ed25519:test", r.key, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.events = append(r.events, ev)
+	return ev
+}
+
+func (r *gapTestRoom) known(eventID string) bool {
+	for _, ev := range r.roomserver {
+		if ev.EventID() == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *gapTestRoom) QueryRoomVersionForRoom(
+	ctx context.Context,
+	request *api.QueryRoomVersionForRoomRequest,
+	response *api.QueryRoomVersionForRoomResponse,
+) error {
+	response.RoomVersion = gomatrixserverlib.RoomVersionV1
+	return nil
+}
+
+func (r *gapTestRoom) QueryServerBannedFromRoom(
+	ctx context.Context,
+	request *api.QueryServerBannedFromRoomRequest,
+	response *api.QueryServerBannedFromRoomResponse,
+) error {
+	return nil
+}
+
+func (r *gapTestRoom) QueryStateAfterEvents(
+	ctx context.Context,
+	request *api.QueryStateAfterEventsRequest,
+	response *api.QueryStateAfterEventsResponse,
+) error {
+	response.RoomExists = true
+	response.RoomVersion = gomatrixserverlib.RoomVersionV1
+	response.PrevEventsExist = true
+	for _, eventID := range request.PrevEventIDs {
+		response.PrevEventsExist = response.PrevEventsExist && r.known(eventID)
+	}
+	if !response.PrevEventsExist {
+		return nil
+	}
+	for _, ev := range r.roomserver {
+		if ev.StateKey() != nil {
+			response.StateEvents = append(response.StateEvents, ev.Headered(gomatrixserverlib.RoomVersionV1))
+		}
+	}
+	return nil
+}
+
+func (r *gapTestRoom) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	response.RoomExists = true
+	response.RoomVersion = gomatrixserverlib.RoomVersionV1
+	response.LatestEvents = []gomatrixserverlib.EventReference{r.roomserver[len(r.roomserver)-1].EventReference()}
+	return nil
+}
+
+func (r *gapTestRoom) InputRoomEvents(
+	ctx context.Context,
+	request *api.InputRoomEventsRequest,
+	response *api.InputRoomEventsResponse,
+) error {
+	for _, ire := range request.InputRoomEvents {
+		r.roomserver = append(r.roomserver, ire.Event.Unwrap())
+	}
+	return nil
+}
+
+func (r *gapTestRoom) ShutdownRoom(
+	ctx context.Context,
+	request *api.ShutdownRoomRequest,
+	response *api.ShutdownRoomResponse,
+) error {
+	return nil
+}
+
+func (r *gapTestRoom) RejectInvite(
+	ctx context.Context,
+	request *api.RejectInviteRequest,
+	response *api.RejectInviteResponse,
+) error {
+	return nil
+}
+
+// testKeyDatabase knows the signing key of remote.example.com.
+type testKeyDatabase struct {
+	key ed25519.PublicKey
+}
+
+func (db *testKeyDatabase) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult)
+	for req := range requests {
+		if req.ServerName == "remote.example.com" && req.KeyID == "ed25519:test" {
+			results[req] = gomatrixserverlib.PublicKeyLookupResult{
+				VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64String(db.key)},
+				ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+				ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+			}
+		}
+	}
+	return results, nil
+}
+
+func (db *testKeyDatabase) FetcherName() string { return "testKeyDatabase" }
+
+func (db *testKeyDatabase) StoreKeys(
+	ctx context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	return nil
+}
+
+// missingEventsServer answers /get_missing_events with the events it has.
+type missingEventsServer struct {
+	events   []gomatrixserverlib.Event
+	requests []common.MissingEventsRequest
+}
+
+func (s *missingEventsServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	if req.URL.Path != "/_matrix/federation/v1/get_missing_events/"+gapTestRoomID {
+		w.WriteHeader(http.StatusNotFound)
+		return w.Result(), nil
+	}
+	var missing common.MissingEventsRequest
+	if err := json.NewDecoder(req.Body).Decode(&missing); err != nil {
+		return nil, err
+	}
+	s.requests = append(s.requests, missing)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Events []gomatrixserverlib.Event `json:"events"`
+	}{s.events})
+	return w.Result(), nil
+}
+
+func TestTransactionFillsGapWithMissingEvents(t *testing.T) {
+	remotePublicKey, remoteKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, localKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = localKey
+
+	room := &gapTestRoom{t: t, key: remoteKey}
+	bob := "@bob:remote.example.com"
+	room.build(gomatrixserverlib.MRoomCreate, new(string), map[string]interface{}{"creator": bob})
+	room.build(gomatrixserverlib.MRoomMember, &bob, gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join})
+	room.roomserver = append(room.roomserver, room.events...)
+	missing := room.build("m.room.message", nil, map[string]interface{}{"body": "missing"})
+	latest := room.build("m.room.message", nil, map[string]interface{}{"body": "latest"})
+
+	remote := &missingEventsServer{events: []gomatrixserverlib.Event{missing}}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", remote)
+	federation := gomatrixserverlib.NewFederationClientWithTransport(cfg.Matrix.ServerName, cfg.Matrix.KeyID, localKey, tr)
+	federation.Client = *gomatrixserverlib.NewClientWithTimeout(0, tr)
+
+	txn := txnReq{
+		context:    context.Background(),
+		cfg:        cfg,
+		query:      room,
+		producer:   producers.NewRoomserverProducer(room, room),
+		keys:       gomatrixserverlib.KeyRing{KeyDatabase: &testKeyDatabase{remotePublicKey}},
+		federation: federation,
+	}
+	txn.Origin = "remote.example.com"
+	txn.PDUs = []json.RawMessage{latest.JSON()}
+	res, err := txn.processTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, ok := res.PDUs[latest.EventID()]; !ok || result.Error != "" {
+		t.Fatalf("expected the event to be accepted, got %+v", res.PDUs)
+	}
+
+	if len(remote.requests) != 1 {
+		t.Fatalf("expected one request for the missing events, got %d", len(remote.requests))
+	}
+	if req := remote.requests[0]; len(req.EarliestEvents) != 1 || req.EarliestEvents[0] != room.events[1].EventID() ||
+		len(req.LatestEvents) != 1 || req.LatestEvents[0] != latest.EventID() || req.Limit != maxMissingEvents {
+		t.Errorf("expected the gap between the join and the event to be requested, got %+v", req)
+	}
+	if len(room.roomserver) != 4 || room.roomserver[2].EventID() != missing.EventID() || room.roomserver[3].EventID() != latest.EventID() {
+		t.Errorf("expected the missing event to be sent to the roomserver before the event")
+	}
+}
+
+func TestTransactionRejectsEventsWithTooManyPrevEvents(t *testing.T) {
+	remotePublicKey, remoteKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.EventLimits.MaxPrevEvents = 20
+
+	room := &gapTestRoom{t: t, key: remoteKey}
+	bob := "@bob:remote.example.com"
+	create := room.build(gomatrixserverlib.MRoomCreate, new(string), map[string]interface{}{"creator": bob})
+	join := room.build(gomatrixserverlib.MRoomMember, &bob, gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join})
+	room.roomserver = append(room.roomserver, room.events...)
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     bob,
+		RoomID:     gapTestRoomID,
+		Type:       "m.room.message",
+		Depth:      3,
+		AuthEvents: []gomatrixserverlib.EventReference{create.EventReference(), join.EventReference()},
+	}
+	prevEvents := []gomatrixserverlib.EventReference{join.EventReference()}
+	for i := 0; i < 20; i++ {
+		prevEvents = append(prevEvents, gomatrixserverlib.EventReference{
+			EventID:     fmt.Sprintf("$prev%d:remote.example.com", i),
+			EventSHA256: gomatrixserverlib.Base64String("hash"),
+		})
+	}
+	builder.PrevEvents = prevEvents
+	if err = builder.SetContent(map[string]interface{}{"body": "too many prev_events"}); err != nil {
+		t.Fatal(err)
+	}
+	tooMany, err := builder.Build(time.Now(), "remote.example.com", "ed25519:test", remoteKey, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := room.build("m.room.message", nil, map[string]interface{}{"body": "valid"})
+
+	txn := txnReq{
+		context:  context.Background(),
+		cfg:      cfg,
+		query:    room,
+		producer: producers.NewRoomserverProducer(room, room),
+		keys:     gomatrixserverlib.KeyRing{KeyDatabase: &testKeyDatabase{remotePublicKey}},
+	}
+	txn.Origin = "remote.example.com"
+	txn.PDUs = []json.RawMessage{tooMany.JSON(), valid.JSON()}
+	res, err := txn.processTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, ok := res.PDUs[tooMany.EventID()]; !ok || result.Error == "" {
+		t.Errorf("expected the event with too many prev_events to be rejected, got %+v", res.PDUs)
+	}
+	if result, ok := res.PDUs[valid.EventID()]; !ok || result.Error != "" {
+		t.Errorf("expected the rest of the transaction to be accepted, got %+v", res.PDUs)
+	}
+	if room.known(tooMany.EventID()) || !room.known(valid.EventID()) {
+		t.Errorf("expected only the valid event to be sent to the roomserver")
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/i2p"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+var errInvalidServerKeys = errors.New("the server keys failed the checks")
+
+var errServerNotAllowed = errors.New("federation with the server isn't allowed")
+
+// The most servers whose keys can be asked for in one request, as the keys of
+// each may have to be fetched from it.
+const maxNotaryServers = 100
+
+// serverKeysClient fetches the keys which a server publishes itself.
+type serverKeysClient interface {
+	GetServerKeys(ctx context.Context, matrixServer gomatrixserverlib.ServerName) (gomatrixserverlib.ServerKeys, error)
+}
+
+// Notary serves the keys of other servers, signed by this server, so that
+// servers which can't reach them, such as on I2P networks, can check their
+// signatures. The keys are fetched from the servers when they are asked for,
+// and kept in the key database until they stop being valid. The keys fetched
+// are also stored for the key ring, so that it doesn't fetch them again.
+type Notary struct {
+	cfg    *config.Dendrite
+	client serverKeysClient
+	keyDB  keydb.Database
+}
+
+// NewNotary creates a notary which fetches keys with the client and keeps
+// them in the key database.
+func NewNotary(cfg *config.Dendrite, client serverKeysClient, keyDB keydb.Database) *Notary {
+	return &Notary{
+		cfg:    cfg,
+		client: client,
+		keyDB:  keyDB,
+	}
+}
+
+type notaryKeyCriteria struct {
+	MinimumValidUntilTS gomatrixserverlib.Timestamp `json:"minimum_valid_until_ts"`
+}
+
+type notaryKeysRequest struct {
+	ServerKeys map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]notaryKeyCriteria `json:"server_keys"`
+}
+
+type notaryKeysResponse struct {
+	ServerKeys []gomatrixserverlib.ServerKeys `json:"server_keys"`
+}
+
+// QueryKeys implements POST /_matrix/key/v2/query
+// https://matrix.org/docs/spec/server_server/r0.1.4#post-matrix-key-v2-query
+// The keys of each server are returned once, however many of its key IDs are
+// asked for.
+func (n *Notary) QueryKeys(req *http.Request) util.JSONResponse {
+	var request notaryKeysRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	if len(request.ServerKeys) > maxNotaryServers {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("The keys of at most %d servers can be asked for at once", maxNotaryServers)),
+		}
+	}
+	return n.respond(req.Context(), request)
+}
+
+// QueryServerKeys implements GET /_matrix/key/v2/query/{serverName}/{keyID}
+// https://matrix.org/docs/spec/server_server/r0.1.4#get-matrix-key-v2-query-servername-keyid
+func (n *Notary) QueryServerKeys(
+	req *http.Request, serverName gomatrixserverlib.ServerName, keyID gomatrixserverlib.KeyID,
+) util.JSONResponse {
+	var criteria notaryKeyCriteria
+	if s := req.URL.Query().Get("minimum_valid_until_ts"); s != "" {
+		ts, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("minimum_valid_until_ts must be a timestamp"),
+			}
+		}
+		criteria.MinimumValidUntilTS = gomatrixserverlib.Timestamp(ts)
+	}
+	keyIDs := map[gomatrixserverlib.KeyID]notaryKeyCriteria{}
+	if keyID != "" {
+		keyIDs[keyID] = criteria
+	} else {
+		// Asking for no key ID in particular asks for all of them.
+		keyIDs[""] = criteria
+	}
+	return n.respond(req.Context(), notaryKeysRequest{
+		ServerKeys: map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]notaryKeyCriteria{serverName: keyIDs},
+	})
+}
+
+func (n *Notary) respond(ctx context.Context, request notaryKeysRequest) util.JSONResponse {
+	res := notaryKeysResponse{ServerKeys: []gomatrixserverlib.ServerKeys{}}
+	for serverName, keyIDs := range request.ServerKeys {
+		var minimumValidUntil gomatrixserverlib.Timestamp
+		for _, criteria := range keyIDs {
+			if criteria.MinimumValidUntilTS > minimumValidUntil {
+				minimumValidUntil = criteria.MinimumValidUntilTS
+			}
+		}
+		keys, err := n.serverKeys(ctx, serverName, minimumValidUntil)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("server_name", serverName).Warn("Failed to get the keys of a server")
+			continue
+		}
+		if keys == nil || !hasAnyKey(keys, keyIDs) {
+			continue
+		}
+		signed, err := gomatrixserverlib.SignJSON(
+			string(n.cfg.Matrix.ServerName), n.cfg.Matrix.KeyID, n.cfg.Matrix.PrivateKey, keys.Raw,
+		)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SignJSON failed")
+			return jsonerror.InternalServerError()
+		}
+		res.ServerKeys = append(res.ServerKeys, gomatrixserverlib.ServerKeys{
+			Raw: signed, ServerKeyFields: keys.ServerKeyFields,
+		})
+	}
+	return util.JSONResponse{Code: http.StatusOK, JSON: res}
+}
+
+// serverKeys returns the keys of a server which are valid until at least
+// minimumValidUntil, fetching them again if the ones kept aren't. If they
+// can't be fetched then the ones kept are returned, if there are any, which
+// the servers asking can decide whether to use. The keys of servers which
+// this server doesn't federate with aren't fetched.
+func (n *Notary) serverKeys(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, minimumValidUntil gomatrixserverlib.Timestamp,
+) (*gomatrixserverlib.ServerKeys, error) {
+	if serverName == n.cfg.Matrix.ServerName {
+		return localKeys(n.cfg, time.Now().Add(n.cfg.Matrix.KeyValidityPeriod))
+	}
+	if !n.cfg.IsFederationAllowed(serverName) {
+		return nil, errServerNotAllowed
+	}
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	if minimumValidUntil < now {
+		minimumValidUntil = now
+	}
+	kept, err := n.keyDB.NotaryKeys(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	if kept != nil && kept.ValidUntilTS >= minimumValidUntil {
+		return kept, nil
+	}
+
+	fetched, err := n.client.GetServerKeys(ctx, serverName)
+	if err == nil {
+		if checks, _ := gomatrixserverlib.CheckKeys(serverName, time.Now(), fetched); !checks.AllChecksOK {
+			err = errInvalidServerKeys
+		}
+	}
+	if err != nil {
+		if kept != nil {
+			logrus.WithError(err).WithField("server_name", serverName).Info("Returning the keys kept for a server which can't be fetched again")
+			return kept, nil
+		}
+		return nil, err
+	}
+	if err = n.checkPinnedKeys(ctx, fetched); err != nil {
+		return nil, err
+	}
+	if err = n.keyDB.StoreNotaryKeys(ctx, fetched); err != nil {
+		return nil, err
+	}
+	if err = n.keyDB.StoreKeys(ctx, lookupResults(fetched)); err != nil {
+		return nil, err
+	}
+	return &fetched, nil
+}
+
+// checkPinnedKeys checks the keys fetched for an .i2p server against its
+// pinned keys, as the key ring does, so that keys which it would refuse
+// aren't stored for it or served to other servers.
+func (n *Notary) checkPinnedKeys(ctx context.Context, keys gomatrixserverlib.ServerKeys) error {
+	pinning := n.cfg.Matrix.I2P.KeyPinning
+	if pinning == config.KeyPinningOff || !i2p.IsI2PHost(string(keys.ServerName)) {
+		return nil
+	}
+	verifyKeys := map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64String{}
+	for keyID, key := range keys.VerifyKeys {
+		verifyKeys[keyID] = key.Key
+	}
+	signedKeys := func() (*gomatrixserverlib.ServerKeys, error) {
+		return &keys, nil
+	}
+	changed, err := keydb.CheckPinnedKeys(ctx, n.keyDB, keys.ServerName, verifyKeys, signedKeys)
+	if err != nil {
+		return err
+	}
+	if len(changed) > 0 && pinning == config.KeyPinningEnforce {
+		return errInvalidServerKeys
+	}
+	return nil
+}
+
+// lookupResults returns the keys of a server in the form that the key ring
+// stores them in.
+func lookupResults(
+	keys gomatrixserverlib.ServerKeys,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for keyID, key := range keys.VerifyKeys {
+		results[gomatrixserverlib.PublicKeyLookupRequest{ServerName: keys.ServerName, KeyID: keyID}] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    key,
+			ValidUntilTS: keys.ValidUntilTS,
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		}
+	}
+	for keyID, key := range keys.OldVerifyKeys {
+		results[gomatrixserverlib.PublicKeyLookupRequest{ServerName: keys.ServerName, KeyID: keyID}] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    key.VerifyKey,
+			ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
+			ExpiredTS:    key.ExpiredTS,
+		}
+	}
+	return results
+}
+
+// hasAnyKey returns whether the keys have any of the key IDs, or whether no
+// key ID in particular was asked for.
+func hasAnyKey(keys *gomatrixserverlib.ServerKeys, keyIDs map[gomatrixserverlib.KeyID]notaryKeyCriteria) bool {
+	if len(keyIDs) == 0 {
+		return true
+	}
+	for keyID := range keyIDs {
+		if keyID == "" {
+			return true
+		}
+		if _, ok := keys.VerifyKeys[keyID]; ok {
+			return true
+		}
+		if _, ok := keys.OldVerifyKeys[keyID]; ok {
+			return true
+		}
+	}
+	return false
+}
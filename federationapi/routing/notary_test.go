@@ -0,0 +1,243 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// testNotaryServer is a remote server whose keys are signed by itself.
+type testNotaryServer struct {
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+	validUntil time.Time
+}
+
+// testKeysClient serves the keys of the test servers, counting how many
+// times the keys of each are fetched.
+type testKeysClient struct {
+	t       *testing.T
+	servers map[gomatrixserverlib.ServerName]*testNotaryServer
+	fetches map[gomatrixserverlib.ServerName]int
+}
+
+func (c *testKeysClient) GetServerKeys(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (gomatrixserverlib.ServerKeys, error) {
+	c.fetches[serverName]++
+	server := c.servers[serverName]
+	var keys gomatrixserverlib.ServerKeys
+	keys.ServerName = serverName
+	keys.ValidUntilTS = gomatrixserverlib.AsTimestamp(server.validUntil)
+	keys.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
+		"ed25519:auto": {Key: gomatrixserverlib.Base64String(server.publicKey)},
+	}
+	keys.OldVerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{}
+	toSign, err := json.Marshal(keys.ServerKeyFields)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	keys.Raw, err = gomatrixserverlib.SignJSON(string(serverName), "ed25519:auto", server.privateKey, toSign)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return keys, nil
+}
+
+// newTestNotary creates a notary for two remote servers whose keys it keeps in
+// a new key database, which is removed by the returned cleanup function.
+func newTestNotary(t *testing.T) (*Notary, *testKeysClient, ed25519.PublicKey, func()) {
+	client := &testKeysClient{
+		t:       t,
+		servers: map[gomatrixserverlib.ServerName]*testNotaryServer{},
+		fetches: map[gomatrixserverlib.ServerName]int{},
+	}
+	for _, serverName := range []gomatrixserverlib.ServerName{"a.example.com", "b.example.com"} {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.servers[serverName] = &testNotaryServer{publicKey, privateKey, time.Now().Add(time.Hour)}
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = privateKey
+	cfg.Matrix.KeyValidityPeriod = time.Hour
+	dir, err := ioutil.TempDir("", "notary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDB, err := keydb.NewDatabase("file:"+filepath.Join(dir, "keydb.db"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewNotary(cfg, client, keyDB), client, publicKey, func() { _ = os.RemoveAll(dir) }
+}
+
+func queryNotary(t *testing.T, n *Notary, body string) notaryKeysResponse {
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/key/v2/query", strings.NewReader(body))
+	res := n.QueryKeys(req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	// The response is decoded again, as the servers asking would.
+	encoded, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded notaryKeysResponse
+	if err = json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestNotaryBatchQuery(t *testing.T) {
+	n, client, notaryKey, cleanup := newTestNotary(t)
+	defer cleanup()
+	res := queryNotary(t, n, `{"server_keys": {
+		"a.example.com": {"ed25519:auto": {}, "ed25519:other": {"minimum_valid_until_ts": 0}},
+		"b.example.com": {"ed25519:auto": {}},
+		"localhost": {}
+	}}`)
+	if len(res.ServerKeys) != 3 {
+		t.Fatalf("expected one set of keys for each of the three servers, got %d", len(res.ServerKeys))
+	}
+	seen := map[gomatrixserverlib.ServerName]bool{}
+	for _, keys := range res.ServerKeys {
+		seen[keys.ServerName] = true
+		serverKey := notaryKey
+		if server, ok := client.servers[keys.ServerName]; ok {
+			serverKey = server.publicKey
+		}
+		keyID := gomatrixserverlib.KeyID("ed25519:auto")
+		if keys.ServerName == "localhost" {
+			keyID = "ed25519:test"
+		}
+		if err := gomatrixserverlib.VerifyJSON(string(keys.ServerName), keyID, serverKey, keys.Raw); err != nil {
+			t.Errorf("expected the keys of %s to be signed by it: %v", keys.ServerName, err)
+		}
+		if err := gomatrixserverlib.VerifyJSON("localhost", "ed25519:test", notaryKey, keys.Raw); err != nil {
+			t.Errorf("expected the keys of %s to be signed by the notary: %v", keys.ServerName, err)
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected the keys of three different servers, got %v", seen)
+	}
+	if client.fetches["a.example.com"] != 1 || client.fetches["b.example.com"] != 1 {
+		t.Errorf("expected the keys of each remote server to be fetched once, got %v", client.fetches)
+	}
+}
+
+func TestNotaryRefetchesForMinimumValidUntil(t *testing.T) {
+	n, client, _, cleanup := newTestNotary(t)
+	defer cleanup()
+	queryNotary(t, n, `{"server_keys": {"a.example.com": {}}}`)
+	// The keys are kept in the database, so a new notary uses them too.
+	n = NewNotary(n.cfg, client, n.keyDB)
+	queryNotary(t, n, `{"server_keys": {"a.example.com": {}}}`)
+	if fetches := client.fetches["a.example.com"]; fetches != 1 {
+		t.Fatalf("expected the kept keys to be used, got %d fetches", fetches)
+	}
+
+	later := gomatrixserverlib.AsTimestamp(time.Now().Add(2 * time.Hour))
+	client.servers["a.example.com"].validUntil = time.Now().Add(3 * time.Hour)
+	body, err := json.Marshal(notaryKeysRequest{
+		ServerKeys: map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]notaryKeyCriteria{
+			"a.example.com": {"ed25519:auto": {MinimumValidUntilTS: later}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := queryNotary(t, n, string(body))
+	if fetches := client.fetches["a.example.com"]; fetches != 2 {
+		t.Errorf("expected the keys to be fetched again, got %d fetches", fetches)
+	}
+	if len(res.ServerKeys) != 1 || res.ServerKeys[0].ValidUntilTS < later {
+		t.Errorf("expected keys valid until at least %d, got %v", later, res.ServerKeys)
+	}
+}
+
+func TestNotaryStoresKeysForTheKeyRing(t *testing.T) {
+	n, client, _, cleanup := newTestNotary(t)
+	defer cleanup()
+	queryNotary(t, n, `{"server_keys": {"a.example.com": {}}}`)
+
+	request := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "a.example.com", KeyID: "ed25519:auto"}
+	results, err := n.keyDB.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		request: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, ok := results[request]; !ok || !bytes.Equal(result.Key, client.servers["a.example.com"].publicKey) {
+		t.Errorf("expected the key ring to have the fetched key, got %v", results)
+	}
+}
+
+func TestNotarySkipsServersWhichAreNotAllowed(t *testing.T) {
+	n, client, _, cleanup := newTestNotary(t)
+	defer cleanup()
+	n.cfg.Matrix.FederationBlocklist = []gomatrixserverlib.ServerName{"b.example.com"}
+	res := queryNotary(t, n, `{"server_keys": {"a.example.com": {}, "b.example.com": {}}}`)
+	if len(res.ServerKeys) != 1 || res.ServerKeys[0].ServerName != "a.example.com" {
+		t.Errorf("expected only the keys of a.example.com, got %v", res.ServerKeys)
+	}
+	if client.fetches["b.example.com"] != 0 {
+		t.Errorf("expected the keys of the blocked server not to be fetched")
+	}
+}
+
+func TestNotaryLimitsTheServersPerRequest(t *testing.T) {
+	n, client, _, cleanup := newTestNotary(t)
+	defer cleanup()
+	request := notaryKeysRequest{ServerKeys: map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]notaryKeyCriteria{}}
+	for i := 0; i <= maxNotaryServers; i++ {
+		request.ServerKeys[gomatrixserverlib.ServerName(fmt.Sprintf("%d.example.com", i))] = nil
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/key/v2/query", bytes.NewReader(body))
+	if res := n.QueryKeys(req); res.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for too many servers, got %d: %v", res.Code, res.JSON)
+	}
+	if len(client.fetches) != 0 {
+		t.Errorf("expected no keys to be fetched, got %v", client.fetches)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type openIDUserInfoResponse struct {
+	Sub string `json:"sub"`
+}
+
+// GetOpenIDUserInfo implements GET /_matrix/federation/v1/openid/userinfo
+// https://matrix.org/docs/spec/server_server/r0.1.3#get-matrix-federation-v1-openid-userinfo
+// It returns the ID of the local user who was issued the OpenID token, unless
+// the token has expired. The request isn't signed, as it's made by third
+// parties as well as other homeservers.
+func GetOpenIDUserInfo(
+	httpReq *http.Request, cfg *config.Dendrite, accountDB accounts.Database,
+) util.JSONResponse {
+	token := httpReq.URL.Query().Get("access_token")
+	if token == "" {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MissingToken("The access_token parameter is required"),
+		}
+	}
+
+	openIDToken, err := accountDB.GetOpenIDToken(httpReq.Context(), token)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.UnknownToken("Unknown OpenID token"),
+		}
+	} else if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("accountDB.GetOpenIDToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if openIDToken.ExpiresAtMS < int64(gomatrixserverlib.AsTimestamp(time.Now())) {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.UnknownToken("The OpenID token has expired"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: openIDUserInfoResponse{
+			Sub: userutil.MakeUserID(openIDToken.Localpart, cfg.Matrix.ServerName),
+		},
+	}
+}
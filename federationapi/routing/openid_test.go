@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	clientRouting "github.com/matrix-org/dendrite/clientapi/routing"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+func newOpenIDTest(t *testing.T) (*config.Dendrite, accounts.Database, func()) {
+	dir, err := ioutil.TempDir("", "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountDB, err := accounts.NewDatabase("file:"+filepath.Join(dir, "account.db"), nil, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	return cfg, accountDB, func() { _ = os.RemoveAll(dir) }
+}
+
+func getOpenIDUserInfo(cfg *config.Dendrite, accountDB accounts.Database, token string) util.JSONResponse {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/federation/v1/openid/userinfo?access_token="+token, nil)
+	return GetOpenIDUserInfo(req, cfg, accountDB)
+}
+
+func TestOpenIDTokenResolvesToUser(t *testing.T) {
+	cfg, accountDB, cleanup := newOpenIDTest(t)
+	defer cleanup()
+
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/user/@alice:localhost/openid/request_token", nil)
+	res := clientRouting.CreateOpenIDToken(req, accountDB, &authtypes.Device{UserID: "@alice:localhost"}, "@alice:localhost", cfg)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	var issued struct {
+		AccessToken      string `json:"access_token"`
+		MatrixServerName string `json:"matrix_server_name"`
+		ExpiresIn        int64  `json:"expires_in"`
+	}
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(body, &issued); err != nil {
+		t.Fatal(err)
+	}
+	if issued.AccessToken == "" || issued.MatrixServerName != "localhost" || issued.ExpiresIn <= 0 {
+		t.Fatalf("expected a token for this server which expires, got %+v", issued)
+	}
+
+	res = getOpenIDUserInfo(cfg, accountDB, issued.AccessToken)
+	if res.Code != http.StatusOK || res.JSON.(openIDUserInfoResponse).Sub != "@alice:localhost" {
+		t.Errorf("expected the token to resolve to alice, got %d: %v", res.Code, res.JSON)
+	}
+	if res = getOpenIDUserInfo(cfg, accountDB, "not-a-token"); res.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown token, got %d: %v", res.Code, res.JSON)
+	}
+}
+
+func TestExpiredOpenIDTokenIsRejected(t *testing.T) {
+	cfg, accountDB, cleanup := newOpenIDTest(t)
+	defer cleanup()
+
+	if err := accountDB.CreateOpenIDToken(context.Background(), &authtypes.OpenIDToken{
+		Token:       "expired",
+		Localpart:   "alice",
+		ExpiresAtMS: int64(gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Minute))),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	res := getOpenIDUserInfo(cfg, accountDB, "expired")
+	if res.Code != http.StatusUnauthorized || res.JSON.(*jsonerror.MatrixError).ErrCode != "M_UNKNOWN_TOKEN" {
+		t.Errorf("expected 401 M_UNKNOWN_TOKEN for an expired token, got %d: %v", res.Code, res.JSON)
+	}
+}
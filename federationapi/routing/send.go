@@ -17,18 +17,59 @@ package routing
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/federationapi/storage"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 )
 
+// maxMissingEvents is the most events fetched with /get_missing_events to fill
+// in a gap before an event.
+const maxMissingEvents = 10
+
+// transactionLifetime is how long the responses to transactions are kept for,
+// after which a transaction sent again with the same ID is processed again.
+const transactionLifetime = 24 * time.Hour
+
+// inFlightTransaction is a transaction which is being processed. Requests
+// which send the same transaction again meanwhile wait for it to be done and
+// get its response.
+type inFlightTransaction struct {
+	done     chan struct{}
+	response util.JSONResponse
+}
+
+type inFlightTransactionKey struct {
+	origin gomatrixserverlib.ServerName
+	txnID  gomatrixserverlib.TransactionID
+}
+
+// inFlightTransactions are the transactions being processed, by the server
+// which sent them and their ID.
+var inFlightTransactions = struct {
+	sync.Mutex
+	txns map[inFlightTransactionKey]*inFlightTransaction
+}{txns: make(map[inFlightTransactionKey]*inFlightTransaction)}
+
 // Send implements /_matrix/federation/v1/send/{txnID}
+// A transaction which has already been processed isn't processed again, and
+// gets the same response as the first time instead. A transaction sent again
+// while it is still being processed waits for the response to the first.
 func Send(
 	httpReq *http.Request,
 	request *gomatrixserverlib.FederationRequest,
@@ -39,9 +80,65 @@ func Send(
 	eduProducer *producers.EDUServerProducer,
 	keys gomatrixserverlib.KeyRing,
 	federation *gomatrixserverlib.FederationClient,
+	federationAPIDB storage.Database,
+) util.JSONResponse {
+	key := inFlightTransactionKey{request.Origin(), txnID}
+	inFlightTransactions.Lock()
+	inFlight, ok := inFlightTransactions.txns[key]
+	if !ok {
+		inFlight = &inFlightTransaction{done: make(chan struct{})}
+		inFlightTransactions.txns[key] = inFlight
+	}
+	inFlightTransactions.Unlock()
+	if ok {
+		util.GetLogger(httpReq.Context()).Infof("Received transaction %q while it is being processed, waiting for its response", txnID)
+		select {
+		case <-inFlight.done:
+			return inFlight.response
+		case <-httpReq.Context().Done():
+			return jsonerror.InternalServerError()
+		}
+	}
+	defer func() {
+		inFlightTransactions.Lock()
+		delete(inFlightTransactions.txns, key)
+		inFlightTransactions.Unlock()
+		close(inFlight.done)
+	}()
+	inFlight.response = send(
+		httpReq, request, txnID, cfg, query, producer, eduProducer, keys, federation, federationAPIDB,
+	)
+	return inFlight.response
+}
+
+func send(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	txnID gomatrixserverlib.TransactionID,
+	cfg *config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	eduProducer *producers.EDUServerProducer,
+	keys gomatrixserverlib.KeyRing,
+	federation *gomatrixserverlib.FederationClient,
+	federationAPIDB storage.Database,
 ) util.JSONResponse {
+	cached, err := federationAPIDB.GetTransactionResponse(httpReq.Context(), request.Origin(), txnID)
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("federationAPIDB.GetTransactionResponse failed")
+		return jsonerror.InternalServerError()
+	}
+	if cached != nil {
+		util.GetLogger(httpReq.Context()).Infof("Received transaction %q again, returning the response sent before", txnID)
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: cached,
+		}
+	}
+
 	t := txnReq{
 		context:     httpReq.Context(),
+		cfg:         cfg,
 		query:       query,
 		producer:    producer,
 		eduProducer: eduProducer,
@@ -54,7 +151,7 @@ func Send(
 		EDUs []gomatrixserverlib.EDU `json:"edus"`
 	}
 
-	if err := json.Unmarshal(request.Content(), &txnEvents); err != nil {
+	if err = json.Unmarshal(request.Content(), &txnEvents); err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
@@ -70,10 +167,21 @@ func Send(
 
 	util.GetLogger(httpReq.Context()).Infof("Received transaction %q containing %d PDUs, %d EDUs", txnID, len(t.PDUs), len(t.EDUs))
 
+	start := time.Now()
 	resp, err := t.processTransaction()
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	transactionProcessingDurations.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
 	switch err.(type) {
 	// No error? Great! Send back a 200.
 	case nil:
+		// Failures to store the response only mean that the transaction will
+		// be processed again if it is sent again.
+		if err = federationAPIDB.StoreTransactionResponse(httpReq.Context(), t.Origin, txnID, resp); err != nil {
+			util.GetLogger(httpReq.Context()).WithError(err).Error("federationAPIDB.StoreTransactionResponse failed")
+		}
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: resp,
@@ -96,14 +204,48 @@ func Send(
 	}
 }
 
+var transactionProcessingDurations = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "transaction_processing_duration_seconds",
+		Help:      "How long it takes to process a transaction received over federation",
+		// Processing a transaction may involve fetching missing events and
+		// keys from other servers.
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(transactionProcessingDurations)
+}
+
+// CleanUpTransactions periodically forgets the transactions which were received
+// longer than transactionLifetime ago, so that they don't build up forever.
+func CleanUpTransactions(federationAPIDB storage.Database) {
+	ticker := time.NewTicker(time.Hour).C
+	for range ticker {
+		before := gomatrixserverlib.AsTimestamp(time.Now().Add(-transactionLifetime))
+		if err := federationAPIDB.DeleteTransactionsBefore(context.Background(), before); err != nil {
+			logrus.WithError(err).Error("Failed to delete old federation transactions")
+		}
+	}
+}
+
 type txnReq struct {
 	gomatrixserverlib.Transaction
 	context     context.Context
+	cfg         *config.Dendrite
 	query       api.RoomserverQueryAPI
 	producer    *producers.RoomserverProducer
 	eduProducer *producers.EDUServerProducer
 	keys        gomatrixserverlib.KeyRing
 	federation  *gomatrixserverlib.FederationClient
+	// Whether we are processing the events returned by /get_missing_events,
+	// in which case gaps are filled in by fetching the state rather than
+	// asking for more missing events.
+	fetchingMissingEvents bool
 }
 
 func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
@@ -129,10 +271,36 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
 			util.GetLogger(t.context).WithError(err).Warnf("Transaction: Failed to parse event JSON of event %q", event.EventID())
 			return nil, unmarshalError{err}
 		}
+		if err = common.CheckEventLimits(&event, &t.cfg.Matrix.EventLimits); err != nil {
+			// Events which break the limits are rejected, but the rest of the
+			// transaction is still processed.
+			util.GetLogger(t.context).WithError(err).WithField("event_id", event.EventID()).Warn("Transaction: Event breaks the event limits")
+			results[event.EventID()] = gomatrixserverlib.PDUResult{
+				Error: err.Error(),
+			}
+			continue
+		}
+		banned, err := t.isOriginBanned(header.RoomID)
+		if err != nil {
+			return nil, err
+		}
+		if banned {
+			// Servers denied by the room's server ACLs can't send events into
+			// it, but the rest of the transaction is still processed.
+			util.GetLogger(t.context).WithField("event_id", event.EventID()).Warn("Transaction: Origin is banned by the server ACLs of the room")
+			results[event.EventID()] = gomatrixserverlib.PDUResult{
+				Error: errServerBanned.Error(),
+			}
+			continue
+		}
 		if err := gomatrixserverlib.VerifyAllEventSignatures(t.context, []gomatrixserverlib.Event{event}, t.keys); err != nil {
 			util.GetLogger(t.context).WithError(err).Warnf("Transaction: Couldn't validate signature of event %q", event.EventID())
 			return nil, verifySigError{event.EventID(), err}
 		}
+		if err := common.VerifyRestrictedJoinSignature(t.context, t.keys, event); err != nil {
+			util.GetLogger(t.context).WithError(err).Warnf("Transaction: Couldn't validate the signature of the server which authorised the join %q", event.EventID())
+			return nil, verifySigError{event.EventID(), err}
+		}
 		pdus = append(pdus, event.Headered(verRes.RoomVersion))
 	}
 
@@ -188,6 +356,10 @@ type verifySigError struct {
 	err     error
 }
 
+// errServerBanned is the error reported for events from servers denied by
+// the server ACLs of the room.
+var errServerBanned = errors.New("server is banned from the room by the server ACLs")
+
 func (e roomNotFoundError) Error() string { return fmt.Sprintf("room %q not found", e.roomID) }
 func (e unmarshalError) Error() string    { return fmt.Sprintf("unable to parse event: %s", e.err) }
 func (e verifySigError) Error() string {
@@ -208,20 +380,136 @@ func (t *txnReq) processEDUs(edus []gomatrixserverlib.EDU) {
 				util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal typing event")
 				continue
 			}
+			if banned, err := t.isOriginBanned(typingPayload.RoomID); err != nil {
+				util.GetLogger(t.context).WithError(err).Error("Failed to check the server ACLs of the room")
+				continue
+			} else if banned {
+				util.GetLogger(t.context).WithField("room_id", typingPayload.RoomID).Warn("Ignoring typing event from server banned by the server ACLs of the room")
+				continue
+			}
 			if err := t.eduProducer.SendTyping(t.context, typingPayload.UserID, typingPayload.RoomID, typingPayload.Typing, 30*1000); err != nil {
 				util.GetLogger(t.context).WithError(err).Error("Failed to send typing event to edu server")
 			}
+		case "m.presence":
+			// https://matrix.org/docs/spec/server_server/latest#presence
+			var presencePayload struct {
+				Push []struct {
+					UserID          string  `json:"user_id"`
+					Presence        string  `json:"presence"`
+					StatusMsg       *string `json:"status_msg"`
+					LastActiveAgo   int64   `json:"last_active_ago"`
+					CurrentlyActive bool    `json:"currently_active"`
+				} `json:"push"`
+			}
+			if err := json.Unmarshal(e.Content, &presencePayload); err != nil {
+				util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal presence event")
+				continue
+			}
+			now := time.Now()
+			for _, p := range presencePayload.Push {
+				// Servers may only send the presence of their own users.
+				if _, domain, err := gomatrixserverlib.SplitID('@', p.UserID); err != nil || domain != t.Origin {
+					util.GetLogger(t.context).WithField("user_id", p.UserID).Warn("Ignoring presence for user of another server")
+					continue
+				}
+				if err := t.eduProducer.SendRemotePresence(
+					t.context, p.UserID, p.Presence, p.StatusMsg,
+					cache.LastActiveTS(p.LastActiveAgo, now), p.CurrentlyActive,
+				); err != nil {
+					util.GetLogger(t.context).WithError(err).Error("Failed to send presence event to edu server")
+				}
+			}
+		case "m.receipt":
+			// https://matrix.org/docs/spec/server_server/latest#receipts
+			var receiptPayload map[string]map[string]map[string]struct {
+				Data struct {
+					TS gomatrixserverlib.Timestamp `json:"ts"`
+				} `json:"data"`
+				EventIDs []string `json:"event_ids"`
+			}
+			if err := json.Unmarshal(e.Content, &receiptPayload); err != nil {
+				util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal receipt event")
+				continue
+			}
+			for roomID, byType := range receiptPayload {
+				if banned, err := t.isOriginBanned(roomID); err != nil {
+					util.GetLogger(t.context).WithError(err).Error("Failed to check the server ACLs of the room")
+					continue
+				} else if banned {
+					util.GetLogger(t.context).WithField("room_id", roomID).Warn("Ignoring receipts from server banned by the server ACLs of the room")
+					continue
+				}
+				for receiptType, byUser := range byType {
+					for userID, receipt := range byUser {
+						// Servers may only send the receipts of their own users.
+						if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != t.Origin {
+							util.GetLogger(t.context).WithField("user_id", userID).Warn("Ignoring receipt for user of another server")
+							continue
+						}
+						for _, eventID := range receipt.EventIDs {
+							if err := t.eduProducer.SendRemoteReceipt(
+								t.context, userID, roomID, eventID, receiptType, receipt.Data.TS,
+							); err != nil {
+								util.GetLogger(t.context).WithError(err).Error("Failed to send receipt event to edu server")
+							}
+						}
+					}
+				}
+			}
+		case "m.direct_to_device":
+			// https://matrix.org/docs/spec/server_server/latest#send-to-device-messaging
+			var directPayload struct {
+				Sender   string                                `json:"sender"`
+				Type     string                                `json:"type"`
+				Messages map[string]map[string]json.RawMessage `json:"messages"`
+			}
+			if err := json.Unmarshal(e.Content, &directPayload); err != nil {
+				util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal send-to-device event")
+				continue
+			}
+			// Servers may only send messages from their own users.
+			if _, domain, err := gomatrixserverlib.SplitID('@', directPayload.Sender); err != nil || domain != t.Origin {
+				util.GetLogger(t.context).WithField("sender", directPayload.Sender).Warn("Ignoring send-to-device message from user of another server")
+				continue
+			}
+			for userID, byDevice := range directPayload.Messages {
+				if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != t.Destination {
+					util.GetLogger(t.context).WithField("user_id", userID).Warn("Ignoring send-to-device message for user of another server")
+					continue
+				}
+				for deviceID, message := range byDevice {
+					if err := t.eduProducer.SendToDevice(
+						t.context, directPayload.Sender, userID, deviceID, directPayload.Type, message,
+					); err != nil {
+						util.GetLogger(t.context).WithError(err).Error("Failed to send send-to-device event to edu server")
+					}
+				}
+			}
 		default:
 			util.GetLogger(t.context).WithField("type", e.Type).Warn("unhandled edu")
 		}
 	}
 }
 
+// isOriginBanned returns true if the server which sent the transaction is
+// denied by the current server ACLs of the room.
+func (t *txnReq) isOriginBanned(roomID string) (bool, error) {
+	req := api.QueryServerBannedFromRoomRequest{
+		RoomID:     roomID,
+		ServerName: t.Origin,
+	}
+	var res api.QueryServerBannedFromRoomResponse
+	if err := t.query.QueryServerBannedFromRoom(t.context, &req, &res); err != nil {
+		return false, err
+	}
+	return res.Banned, nil
+}
+
 func (t *txnReq) processEvent(e gomatrixserverlib.Event) error {
 	prevEventIDs := e.PrevEventIDs()
 
 	// Fetch the state needed to authenticate the event.
-	needed := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{e})
+	needed := auth.StateNeededForAuth([]gomatrixserverlib.Event{e})
 	stateReq := api.QueryStateAfterEventsRequest{
 		RoomID:       e.RoomID(),
 		PrevEventIDs: prevEventIDs,
@@ -270,6 +558,55 @@ func (t *txnReq) processEvent(e gomatrixserverlib.Event) error {
 	return err
 }
 
+// getMissingEvents tries to fill in the gap between the latest events that we
+// have in the room and the event using /get_missing_events, and processes the
+// missing events that the origin sends back. At most maxMissingEvents are
+// fetched, so a huge gap isn't filled in this way.
+func (t *txnReq) getMissingEvents(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) error {
+	latestReq := api.QueryLatestEventsAndStateRequest{RoomID: e.RoomID()}
+	var latestRes api.QueryLatestEventsAndStateResponse
+	if err := t.query.QueryLatestEventsAndState(t.context, &latestReq, &latestRes); err != nil {
+		return err
+	}
+	earliestEvents := make([]string, 0, len(latestRes.LatestEvents))
+	for _, ref := range latestRes.LatestEvents {
+		earliestEvents = append(earliestEvents, ref.EventID)
+	}
+
+	missing, err := common.LookupMissingEvents(
+		t.context, t.federation, t.cfg, t.Origin, roomVersion, e.RoomID(),
+		common.MissingEventsRequest{
+			EarliestEvents: earliestEvents,
+			LatestEvents:   []string{e.EventID()},
+			Limit:          maxMissingEvents,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	// Process the missing events oldest first, so that each of them comes
+	// after the events it follows.
+	sort.SliceStable(missing, func(i, j int) bool {
+		return missing[i].Depth() < missing[j].Depth()
+	})
+	for _, ev := range missing {
+		if ev.RoomID() != e.RoomID() || ev.EventID() == e.EventID() {
+			continue
+		}
+		if err = gomatrixserverlib.VerifyAllEventSignatures(t.context, []gomatrixserverlib.Event{ev}, t.keys); err != nil {
+			return verifySigError{ev.EventID(), err}
+		}
+		if err = common.VerifyRestrictedJoinSignature(t.context, t.keys, ev); err != nil {
+			return verifySigError{ev.EventID(), err}
+		}
+		if err = t.processEvent(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func checkAllowedByState(e gomatrixserverlib.Event, stateEvents []gomatrixserverlib.Event) error {
 	authUsingState := gomatrixserverlib.NewAuthEvents(nil)
 	for i := range stateEvents {
@@ -278,7 +615,7 @@ func checkAllowedByState(e gomatrixserverlib.Event, stateEvents []gomatrixserver
 			return err
 		}
 	}
-	return gomatrixserverlib.Allowed(e, &authUsingState)
+	return auth.Allowed(e, &authUsingState)
 }
 
 func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) error {
@@ -296,9 +633,20 @@ func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event, roomVer
 	// event ids and then use /event to fetch the individual events.
 	// However not all version of synapse support /state_ids so you may
 	// need to fallback to /state.
-	// TODO: Attempt to fill in the gap using /get_missing_events
-	// TODO: Attempt to fetch the state using /state_ids and /events
-	state, err := t.federation.LookupState(t.context, t.Origin, e.RoomID(), e.EventID(), roomVersion)
+	if !t.fetchingMissingEvents {
+		t.fetchingMissingEvents = true
+		err := t.getMissingEvents(e, roomVersion)
+		if err == nil {
+			// If the gap was too large to be filled in then the event is still
+			// missing its prev events, and the state is fetched for it instead.
+			err = t.processEvent(e)
+			t.fetchingMissingEvents = false
+			return err
+		}
+		t.fetchingMissingEvents = false
+		util.GetLogger(t.context).WithError(err).WithField("event_id", e.EventID()).Warn("Failed to fill in the gap before event, fetching the state at it instead")
+	}
+	state, err := common.LookupStateByIDs(t.context, t.federation, t.query, t.Origin, roomVersion, e.RoomID(), e.EventID())
 	if err != nil {
 		return err
 	}
@@ -329,5 +677,5 @@ retryAllowedState:
 	}
 
 	// pass the event along with the state to the roomserver
-	return t.producer.SendEventWithState(t.context, state, e.Headered(roomVersion))
+	return t.producer.SendEventWithState(t.context, *state, e.Headered(roomVersion))
 }
@@ -0,0 +1,307 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/federationapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+// testEDUServer counts the presence updates sent to the EDU server, and
+// records the send-to-device messages. If unblock is set then presence
+// updates wait for it to be closed, after saying that they started.
+type testEDUServer struct {
+	eduAPI.EDUServerInputAPI
+	presence     int
+	sendToDevice []eduAPI.InputSendToDeviceEvent
+	started      chan struct{}
+	unblock      chan struct{}
+}
+
+func (s *testEDUServer) InputPresenceEvent(
+	ctx context.Context,
+	request *eduAPI.InputPresenceEventRequest,
+	response *eduAPI.InputPresenceEventResponse,
+) error {
+	if s.unblock != nil {
+		s.started <- struct{}{}
+		<-s.unblock
+	}
+	s.presence++
+	return nil
+}
+
+func (s *testEDUServer) InputSendToDeviceEvent(
+	ctx context.Context,
+	request *eduAPI.InputSendToDeviceEventRequest,
+	response *eduAPI.InputSendToDeviceEventResponse,
+) error {
+	s.sendToDevice = append(s.sendToDevice, request.InputSendToDeviceEvent)
+	return nil
+}
+
+// sendTransaction sends a transaction from remote.example.com containing a
+// presence update, and returns the response.
+func sendTransaction(
+	t *testing.T, txnID gomatrixserverlib.TransactionID, db storage.Database, eduServer *testEDUServer,
+) (int, interface{}) {
+	return sendTransactionWithEDUs(t, txnID, db, eduServer, map[string]interface{}{
+		"edu_type": "m.presence",
+		"content": map[string]interface{}{"push": []interface{}{map[string]interface{}{
+			"user_id": "@bob:remote.example.com", "presence": "online",
+		}}},
+	})
+}
+
+// sendTransactionWithEDUs sends a transaction from remote.example.com
+// containing the given EDUs, and returns the response.
+func sendTransactionWithEDUs(
+	t *testing.T, txnID gomatrixserverlib.TransactionID, db storage.Database, eduServer *testEDUServer,
+	edus ...interface{},
+) (int, interface{}) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := gomatrixserverlib.NewFederationRequest(http.MethodPut, "localhost", "/_matrix/federation/v1/send/"+string(txnID))
+	if err = request.SetContent(map[string]interface{}{
+		"pdus": []interface{}{},
+		"edus": edus,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = request.Sign("remote.example.com", "ed25519:test", privateKey); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	httpReq := httptest.NewRequest(http.MethodPut, "/_matrix/federation/v1/send/"+string(txnID), nil)
+	res := Send(
+		httpReq, &request, txnID, cfg, nil, nil, producers.NewEDUServerProducer(eduServer),
+		gomatrixserverlib.KeyRing{}, nil, db,
+	)
+	return res.Code, res.JSON
+}
+
+func newTransactionsTestDB(t *testing.T) (storage.Database, func()) {
+	dir, err := ioutil.TempDir("", "federationapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.NewDatabase("file:"+filepath.Join(dir, "federationapi.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestSendIgnoresRepeatedTransactions(t *testing.T) {
+	db, cleanup := newTransactionsTestDB(t)
+	defer cleanup()
+	eduServer := &testEDUServer{}
+
+	for i := 0; i < 2; i++ {
+		if code, res := sendTransaction(t, "txn1", db, eduServer); code != http.StatusOK {
+			t.Fatalf("expected 200 OK, got %d: %v", code, res)
+		}
+	}
+	if eduServer.presence != 1 {
+		t.Errorf("expected the transaction to be processed once, got %d presence updates", eduServer.presence)
+	}
+
+	// A transaction with another ID is processed.
+	if code, res := sendTransaction(t, "txn2", db, eduServer); code != http.StatusOK || eduServer.presence != 2 {
+		t.Errorf("expected a new transaction to be processed, got %d with %d presence updates: %v", code, eduServer.presence, res)
+	}
+}
+
+// forgetfulTransactionsDB never has the response to a transaction.
+type forgetfulTransactionsDB struct {
+	storage.Database
+}
+
+func (d forgetfulTransactionsDB) GetTransactionResponse(
+	ctx context.Context, origin gomatrixserverlib.ServerName, txnID gomatrixserverlib.TransactionID,
+) (*gomatrixserverlib.RespSend, error) {
+	return nil, nil
+}
+
+func TestSendProcessesConcurrentRepeatsOfTransactionOnce(t *testing.T) {
+	db, cleanup := newTransactionsTestDB(t)
+	defer cleanup()
+	// The stored responses are ignored, so that only the transactions which
+	// are in flight can be shared.
+	eduServer := &testEDUServer{started: make(chan struct{}, 3), unblock: make(chan struct{})}
+	codes := make(chan int, 3)
+	send := func() {
+		code, _ := sendTransaction(t, "txn1", forgetfulTransactionsDB{db}, eduServer)
+		codes <- code
+	}
+
+	go send()
+	<-eduServer.started
+	go send()
+	go send()
+	// Let the repeats reach the transaction in flight before it finishes.
+	time.Sleep(100 * time.Millisecond)
+	close(eduServer.unblock)
+	for i := 0; i < 3; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("expected 200 OK, got %d", code)
+		}
+	}
+	if eduServer.presence != 1 {
+		t.Errorf("expected the transaction to be processed once, got %d presence updates", eduServer.presence)
+	}
+}
+
+func TestSendReturnsResponseOfRepeatedTransaction(t *testing.T) {
+	db, cleanup := newTransactionsTestDB(t)
+	defer cleanup()
+	eduServer := &testEDUServer{}
+	sent := &gomatrixserverlib.RespSend{PDUs: map[string]gomatrixserverlib.PDUResult{
+		"$event:remote.example.com": {Error: "not allowed"},
+	}}
+	if err := db.StoreTransactionResponse(context.Background(), "remote.example.com", "txn1", sent); err != nil {
+		t.Fatal(err)
+	}
+
+	code, res := sendTransaction(t, "txn1", db, eduServer)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	if resp, ok := res.(*gomatrixserverlib.RespSend); !ok || resp.PDUs["$event:remote.example.com"].Error != "not allowed" {
+		t.Errorf("expected the response sent before, got %v", res)
+	}
+	if eduServer.presence != 0 {
+		t.Errorf("expected the transaction not to be processed again, got %d presence updates", eduServer.presence)
+	}
+
+	// Transactions are processed again once they have been forgotten.
+	if err := db.DeleteTransactionsBefore(context.Background(), gomatrixserverlib.AsTimestamp(time.Now().Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if code, res = sendTransaction(t, "txn1", db, eduServer); code != http.StatusOK || eduServer.presence != 1 {
+		t.Errorf("expected a forgotten transaction to be processed again, got %d with %d presence updates: %v", code, eduServer.presence, res)
+	}
+}
+
+func TestSendToDeviceMessagesAreReceived(t *testing.T) {
+	db, cleanup := newTransactionsTestDB(t)
+	defer cleanup()
+	eduServer := &testEDUServer{}
+
+	code, res := sendTransactionWithEDUs(t, "txn1", db, eduServer, map[string]interface{}{
+		"edu_type": "m.direct_to_device",
+		"content": map[string]interface{}{
+			"sender":     "@bob:remote.example.com",
+			"type":       "m.room_key_request",
+			"message_id": "abc",
+			"messages": map[string]interface{}{
+				"@alice:localhost":             map[string]interface{}{"ALICEDEVICE": map[string]interface{}{"action": "request"}},
+				"@carol:elsewhere.example.com": map[string]interface{}{"*": map[string]interface{}{"action": "request"}},
+			},
+		},
+	}, map[string]interface{}{
+		// Servers can't send messages from the users of other servers.
+		"edu_type": "m.direct_to_device",
+		"content": map[string]interface{}{
+			"sender":   "@mallory:elsewhere.example.com",
+			"type":     "m.room_key_request",
+			"messages": map[string]interface{}{"@alice:localhost": map[string]interface{}{"*": map[string]interface{}{}}},
+		},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, res)
+	}
+	if len(eduServer.sendToDevice) != 1 {
+		t.Fatalf("expected one send-to-device message, got %v", eduServer.sendToDevice)
+	}
+	msg := eduServer.sendToDevice[0]
+	if msg.Sender != "@bob:remote.example.com" || msg.UserID != "@alice:localhost" || msg.DeviceID != "ALICEDEVICE" ||
+		msg.Type != "m.room_key_request" || string(msg.Content) != `{"action":"request"}` {
+		t.Errorf("unexpected send-to-device message: %+v", msg)
+	}
+}
+
+func TestSendFromServersNotFederatedWithIsForbidden(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := gomatrixserverlib.KeyRing{KeyDatabase: &testKeyDatabase{publicKey}}
+	tests := []struct {
+		name                 string
+		disabled             bool
+		allowlist, blocklist []gomatrixserverlib.ServerName
+		want                 int
+	}{
+		{"no lists", false, nil, nil, http.StatusOK},
+		{"allowlisted", false, []gomatrixserverlib.ServerName{"remote.example.com"}, nil, http.StatusOK},
+		{"not allowlisted", false, []gomatrixserverlib.ServerName{"other.example.com"}, nil, http.StatusForbidden},
+		{"blocklisted", false, nil, []gomatrixserverlib.ServerName{"remote.example.com"}, http.StatusForbidden},
+		{
+			"allowlisted and blocklisted", false, []gomatrixserverlib.ServerName{"remote.example.com"},
+			[]gomatrixserverlib.ServerName{"remote.example.com"}, http.StatusForbidden,
+		},
+		{"federation disabled", true, []gomatrixserverlib.ServerName{"remote.example.com"}, nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		cfg := &config.Dendrite{}
+		cfg.Matrix.ServerName = "localhost"
+		cfg.Matrix.FederationDisabled = tt.disabled
+		cfg.Matrix.FederationAllowlist = tt.allowlist
+		cfg.Matrix.FederationBlocklist = tt.blocklist
+		received := false
+		handler := common.MakeFedAPI("federation_send", cfg, keys, func(
+			httpReq *http.Request, request *gomatrixserverlib.FederationRequest,
+		) util.JSONResponse {
+			received = true
+			return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+		})
+
+		request := gomatrixserverlib.NewFederationRequest(http.MethodPut, "localhost", "/_matrix/federation/v1/send/1")
+		if err = request.SetContent(map[string]interface{}{"pdus": []interface{}{}, "edus": []interface{}{}}); err != nil {
+			t.Fatal(err)
+		}
+		if err = request.Sign("remote.example.com", "ed25519:test", privateKey); err != nil {
+			t.Fatal(err)
+		}
+		var httpReq *http.Request
+		if httpReq, err = request.HTTPRequest(); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httpReq)
+		if w.Code != tt.want || received != (tt.want == http.StatusOK) {
+			t.Errorf("%s: expected %d, got %d with the transaction received: %v", tt.name, tt.want, w.Code, received)
+		}
+	}
+}
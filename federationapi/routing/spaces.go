@@ -0,0 +1,98 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GetSpaceHierarchy implements GET /_matrix/federation/v1/hierarchy/{roomID}
+// https://github.com/matrix-org/matrix-doc/pull/2946
+// It returns the summary of a space and of the children of the space which
+// this server knows about. Remote servers can only see rooms which are public
+// or which one of their users is joined to.
+func GetSpaceHierarchy(
+	httpReq *http.Request, request *gomatrixserverlib.FederationRequest,
+	roomID string, queryAPI roomserverAPI.RoomserverQueryAPI,
+) util.JSONResponse {
+	suggestedOnly := httpReq.URL.Query().Get("suggested_only") == "true"
+
+	room, joined, err := common.LocalSpaceRoom(httpReq.Context(), roomID, queryAPI)
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("common.LocalSpaceRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if room == nil || !serverCanSeeSpaceRoom(request.Origin(), room, joined) {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown room"),
+		}
+	}
+
+	res := common.RespSpaceHierarchy{
+		Room:                 *room,
+		Children:             []common.SpaceRoom{},
+		InaccessibleChildren: []string{},
+	}
+	for _, childState := range room.ChildrenState {
+		content, _ := childState.ParsedContent()
+		if suggestedOnly && !content.Suggested {
+			continue
+		}
+		var child *common.SpaceRoom
+		var childJoined []string
+		if child, childJoined, err = common.LocalSpaceRoom(httpReq.Context(), childState.StateKey, queryAPI); err != nil {
+			util.GetLogger(httpReq.Context()).WithError(err).Error("common.LocalSpaceRoom failed")
+			return jsonerror.InternalServerError()
+		}
+		// The requesting server has to ask someone else about the rooms that
+		// we aren't in.
+		if child == nil {
+			continue
+		}
+		if serverCanSeeSpaceRoom(request.Origin(), child, childJoined) {
+			res.Children = append(res.Children, *child)
+		} else {
+			res.InaccessibleChildren = append(res.InaccessibleChildren, child.RoomID)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// serverCanSeeSpaceRoom returns whether a remote server can see a room in a
+// space hierarchy, given the users who are joined to the room.
+func serverCanSeeSpaceRoom(
+	serverName gomatrixserverlib.ServerName, room *common.SpaceRoom, joined []string,
+) bool {
+	if room.IsPublic() {
+		return true
+	}
+	for _, userID := range joined {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && domain == serverName {
+			return true
+		}
+	}
+	return false
+}
@@ -23,7 +23,8 @@ import (
 	"github.com/matrix-org/util"
 )
 
-// GetState returns state events & auth events for the roomID, eventID
+// GetState implements GET /_matrix/federation/v1/state/{roomID}
+// It returns the state events & auth events for the roomID, eventID
 func GetState(
 	ctx context.Context,
 	request *gomatrixserverlib.FederationRequest,
@@ -43,7 +44,8 @@ func GetState(
 	return util.JSONResponse{Code: http.StatusOK, JSON: state}
 }
 
-// GetStateIDs returns state event IDs & auth event IDs for the roomID, eventID
+// GetStateIDs implements GET /_matrix/federation/v1/state_ids/{roomID}
+// It returns the state event IDs & auth event IDs for the roomID, eventID
 func GetStateIDs(
 	ctx context.Context,
 	request *gomatrixserverlib.FederationRequest,
@@ -98,6 +100,12 @@ func getState(
 	roomID string,
 	eventID string,
 ) (*gomatrixserverlib.RespState, *util.JSONResponse) {
+	// Only the servers which are in the room can ask for its state, even at
+	// events which they could see.
+	if resErr := checkServerInRoom(ctx, query, request.Origin(), roomID); resErr != nil {
+		return nil, resErr
+	}
+
 	event, resErr := getEvent(ctx, request, query, eventID)
 	if resErr != nil {
 		return nil, resErr
@@ -113,9 +121,10 @@ func getState(
 	err := query.QueryStateAndAuthChain(
 		ctx,
 		&api.QueryStateAndAuthChainRequest{
-			RoomID:       roomID,
-			PrevEventIDs: []string{eventID},
-			AuthEventIDs: authEventIDs,
+			RoomID:           roomID,
+			PrevEventIDs:     []string{eventID},
+			AuthEventIDs:     authEventIDs,
+			StateBeforeEvent: true,
 		},
 		&response,
 	)
@@ -127,6 +136,12 @@ func getState(
 	if !response.RoomExists {
 		return nil, &util.JSONResponse{Code: http.StatusNotFound, JSON: nil}
 	}
+	if !response.PrevEventsExist {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The state at the event is not known"),
+		}
+	}
 
 	return &gomatrixserverlib.RespState{
 		StateEvents: gomatrixserverlib.UnwrapEventHeaders(response.StateEvents),
@@ -0,0 +1,194 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/input"
+	"github.com/matrix-org/dendrite/roomserver/query"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// discardingProducer drops the output events of the roomserver.
+type discardingProducer struct {
+	sarama.SyncProducer
+}
+
+func (p discardingProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	return nil
+}
+
+type stateTest struct {
+	db     storage.Database
+	query  api.RoomserverQueryAPI
+	events []gomatrixserverlib.Event
+}
+
+// newStateTest stores a public room in a roomserver, which is joined by bob
+// from remote.example.com before alice names it.
+func newStateTest(t *testing.T) (*stateTest, func()) {
+	dir, err := ioutil.TempDir("", "roomserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.Open("file:"+filepath.Join(dir, "roomserver.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, _ := newThreePIDTestRoom(t)
+	room.events = nil
+	alice, bob := "@alice:localhost", "@bob:remote.example.com"
+	room.addState(alice, "m.room.create", "", map[string]interface{}{"creator": alice})
+	room.addState(alice, "m.room.member", alice, gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join})
+	room.addState(alice, "m.room.power_levels", "", map[string]interface{}{"users": map[string]int{alice: 100}})
+	room.addState(alice, "m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: gomatrixserverlib.Public})
+	room.addState(bob, "m.room.member", bob, gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join})
+	room.addState(alice, "m.room.name", "", map[string]interface{}{"name": "The room"})
+
+	inputAPI := &input.RoomserverInputAPI{DB: db, Producer: discardingProducer{}}
+	for _, ev := range room.events {
+		if err = inputAPI.InputRoomEvents(context.Background(), &api.InputRoomEventsRequest{
+			InputRoomEvents: []api.InputRoomEvent{{
+				Kind:         api.KindNew,
+				Event:        ev.Headered(gomatrixserverlib.RoomVersionV1),
+				AuthEventIDs: ev.AuthEventIDs(),
+			}},
+		}, &api.InputRoomEventsResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &stateTest{db: db, query: &query.RoomserverQueryAPI{DB: db}, events: room.events}, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// storedStateIDs returns the IDs of the events in the state snapshot which
+// the roomserver stored for the state before the event.
+func (s *stateTest) storedStateIDs(t *testing.T, eventID string) []string {
+	entries, err := state.NewStateResolution(s.db).LoadStateAtEvent(context.Background(), eventID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventNIDs := make([]types.EventNID, len(entries))
+	for i := range entries {
+		eventNIDs[i] = entries[i].EventNID
+	}
+	eventIDs, err := s.db.EventIDs(context.Background(), eventNIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	for _, id := range eventIDs {
+		result = append(result, id)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// getState requests the state at the event as a remote server, from the
+// state endpoint or the state_ids one.
+func (s *stateTest) getState(t *testing.T, origin gomatrixserverlib.ServerName, eventID string, ids bool) util.JSONResponse {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/_matrix/federation/v1/state/" + threePIDTestRoomID + "?event_id=" + eventID
+	if ids {
+		path = "/_matrix/federation/v1/state_ids/" + threePIDTestRoomID + "?event_id=" + eventID
+	}
+	request := gomatrixserverlib.NewFederationRequest(http.MethodGet, "localhost", path)
+	if err = request.Sign(origin, "ed25519:test", key); err != nil {
+		t.Fatal(err)
+	}
+	if ids {
+		return GetStateIDs(context.Background(), &request, s.query, threePIDTestRoomID)
+	}
+	return GetState(context.Background(), &request, s.query, threePIDTestRoomID)
+}
+
+func TestGetStateAtEventMatchesStoredSnapshot(t *testing.T) {
+	s, cleanup := newStateTest(t)
+	defer cleanup()
+	name := s.events[len(s.events)-1]
+	expected := s.storedStateIDs(t, name.EventID())
+	if len(expected) != len(s.events)-1 {
+		t.Fatalf("expected the %d events before the name in the snapshot, got %v", len(s.events)-1, expected)
+	}
+
+	res := s.getState(t, "remote.example.com", name.EventID(), false)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	respState := res.JSON.(*gomatrixserverlib.RespState)
+	stateIDs := getIDsFromEvent(respState.StateEvents)
+	sort.Strings(stateIDs)
+	if !equalStrings(stateIDs, expected) {
+		t.Errorf("expected the state %v, got %v", expected, stateIDs)
+	}
+	if len(respState.AuthEvents) == 0 {
+		t.Errorf("expected the auth chain of the state")
+	}
+
+	res = s.getState(t, "remote.example.com", name.EventID(), true)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	respIDs := res.JSON.(gomatrixserverlib.RespStateIDs)
+	sort.Strings(respIDs.StateEventIDs)
+	if !equalStrings(respIDs.StateEventIDs, expected) {
+		t.Errorf("expected the state IDs %v, got %v", expected, respIDs.StateEventIDs)
+	}
+	if len(respIDs.AuthEventIDs) != len(respState.AuthEvents) {
+		t.Errorf("expected the IDs of the %d auth chain events, got %v", len(respState.AuthEvents), respIDs.AuthEventIDs)
+	}
+}
+
+func TestGetStateRequiresServerInRoom(t *testing.T) {
+	s, cleanup := newStateTest(t)
+	defer cleanup()
+	for _, ids := range []bool{false, true} {
+		if res := s.getState(t, "other.example.com", s.events[1].EventID(), ids); res.Code != http.StatusForbidden {
+			t.Errorf("expected 403 for a server which isn't in the room, got %d: %v", res.Code, res.JSON)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -18,7 +18,9 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
@@ -29,6 +31,7 @@ import (
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -129,6 +132,26 @@ func ExchangeThirdPartyInvite(
 		}
 	}
 
+	// Check that the event is an invite from a third-party invite.
+	var content gomatrixserverlib.MemberContent
+	if builder.Type != gomatrixserverlib.MRoomMember || builder.StateKey == nil ||
+		json.Unmarshal(builder.Content, &content) != nil ||
+		content.Membership != gomatrixserverlib.Invite || content.ThirdPartyInvite == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The event must be an invite with a third_party_invite"),
+		}
+	}
+
+	// Check that the sender is from this server, as the event is signed by it.
+	_, senderDomain, err := gomatrixserverlib.SplitID('@', builder.Sender)
+	if err != nil || senderDomain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The event's sender isn't a user on this server"),
+		}
+	}
+
 	// Check that the state key is correct.
 	_, targetDomain, err := gomatrixserverlib.SplitID('@', *builder.StateKey)
 	if err != nil {
@@ -162,6 +185,11 @@ func ExchangeThirdPartyInvite(
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("Unknown room " + roomID),
 		}
+	} else if _, ok := err.(*gomatrixserverlib.NotAllowed); ok {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
 	} else if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("buildMembershipEvent failed")
 		return jsonerror.InternalServerError()
@@ -169,9 +197,9 @@ func ExchangeThirdPartyInvite(
 
 	// Ask the requesting server to sign the newly created event so we know it
 	// acknowledged it
-	signedEvent, err := federation.SendInvite(httpReq.Context(), request.Origin(), *event)
+	signedEvent, err := sendInvite(httpReq.Context(), federation, cfg, request.Origin(), *event, verRes.RoomVersion)
 	if err != nil {
-		util.GetLogger(httpReq.Context()).WithError(err).Error("federation.SendInvite failed")
+		util.GetLogger(httpReq.Context()).WithError(err).Error("sendInvite failed")
 		return jsonerror.InternalServerError()
 	}
 
@@ -179,7 +207,7 @@ func ExchangeThirdPartyInvite(
 	if _, err = producer.SendEvents(
 		httpReq.Context(),
 		[]gomatrixserverlib.HeaderedEvent{
-			signedEvent.Event.Headered(verRes.RoomVersion),
+			signedEvent.Headered(verRes.RoomVersion),
 		},
 		cfg.Matrix.ServerName,
 		nil,
@@ -194,6 +222,53 @@ func ExchangeThirdPartyInvite(
 	}
 }
 
+// sendInvite asks the server of the invited user to sign an invite event, and
+// returns the signed event. gomatrixserverlib's SendInvite can't decode the
+// event in the response without the room version, so the request is made here.
+// Returns an error if the server didn't sign the event that was sent to it.
+func sendInvite(
+	ctx context.Context, federation *gomatrixserverlib.FederationClient, cfg *config.Dendrite,
+	destination gomatrixserverlib.ServerName, event gomatrixserverlib.Event,
+	roomVersion gomatrixserverlib.RoomVersion,
+) (gomatrixserverlib.Event, error) {
+	path := "/_matrix/federation/v1/invite/" +
+		url.PathEscape(event.RoomID()) + "/" + url.PathEscape(event.EventID())
+	req := gomatrixserverlib.NewFederationRequest(http.MethodPut, destination, path)
+	if err := req.SetContent(event); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	if err := req.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+
+	// The response is sent as [200, {"event": ...}].
+	var res []json.RawMessage
+	if err = federation.DoRequestAndParseResponse(ctx, httpReq, &res); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	var fields struct {
+		Event json.RawMessage `json:"event"`
+	}
+	if len(res) != 2 {
+		return gomatrixserverlib.Event{}, fmt.Errorf("invalid invite response, invalid length: %d != 2", len(res))
+	}
+	if err = json.Unmarshal(res[1], &fields); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	signedEvent, err := gomatrixserverlib.NewEventFromUntrustedJSON(fields.Event, roomVersion)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	if signedEvent.EventID() != event.EventID() {
+		return gomatrixserverlib.Event{}, fmt.Errorf("%s signed %s instead of %s", destination, signedEvent.EventID(), event.EventID())
+	}
+	return signedEvent, nil
+}
+
 // createInviteFrom3PIDInvite processes an invite provided by the identity server
 // and creates a m.room.member event (with "invite" membership) from it.
 // Returns an error if there was a problem building the event or fetching the
@@ -260,13 +335,15 @@ func createInviteFrom3PIDInvite(
 // from a third-party invite to auth and build the said event. Returns the said
 // event.
 // Returns errNotInRoom if the server is not in the room the invite is for.
+// Returns a *gomatrixserverlib.NotAllowed error if the event isn't allowed by
+// the current state of the room.
 // Returns an error if something failed during the process.
 func buildMembershipEvent(
 	ctx context.Context,
 	builder *gomatrixserverlib.EventBuilder, queryAPI roomserverAPI.RoomserverQueryAPI,
 	cfg *config.Dendrite,
 ) (*gomatrixserverlib.Event, error) {
-	eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(builder)
+	eventsNeeded, err := auth.StateNeededForEventBuilder(builder)
 	if err != nil {
 		return nil, err
 	}
@@ -317,8 +394,15 @@ func buildMembershipEvent(
 		time.Now(), cfg.Matrix.ServerName, cfg.Matrix.KeyID,
 		cfg.Matrix.PrivateKey, queryRes.RoomVersion,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = auth.Allowed(event, &authEvents); err != nil {
+		return nil, err
+	}
 
-	return &event, err
+	return &event, nil
 }
 
 // sendToRemoteServer uses federation to send an invite provided by an identity
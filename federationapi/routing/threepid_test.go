@@ -0,0 +1,271 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const threePIDTestRoomID = "!room:localhost"
+
+// threePIDTestRoom answers roomserver queries about a room on this server,
+// and records the events sent into it.
+type threePIDTestRoom struct {
+	api.RoomserverQueryAPI
+	t      *testing.T
+	cfg    *config.Dendrite
+	events []gomatrixserverlib.Event
+	sent   []gomatrixserverlib.HeaderedEvent
+}
+
+func (r *threePIDTestRoom) addState(sender, eventType, stateKey string, content interface{}) {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		RoomID:   threePIDTestRoomID,
+		Type:     eventType,
+		StateKey: &stateKey,
+		Depth:    int64(len(r.events) + 1),
+	}
+	if err := builder.SetContent(content); err != nil {
+		r.t.Fatal(err)
+	}
+	var prevEvents, authEvents []gomatrixserverlib.EventReference
+	if len(r.events) > 0 {
+		prevEvents = []gomatrixserverlib.EventReference{r.events[len(r.events)-1].EventReference()}
+	}
+	for _, ev := range r.events {
+		authEvents = append(authEvents, ev.EventReference())
+	}
+	builder.PrevEvents, builder.AuthEvents = prevEvents, authEvents
+	ev, err := builder.Build(
+		time.Now(), r.cfg.Matrix.ServerName, r.cfg.Matrix.KeyID, r.cfg.Matrix.PrivateKey,
+		gomatrixserverlib.RoomVersionV1,
+	)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.events = append(r.events, ev)
+}
+
+func (r *threePIDTestRoom) QueryRoomVersionForRoom(
+	ctx context.Context,
+	request *api.QueryRoomVersionForRoomRequest,
+	response *api.QueryRoomVersionForRoomResponse,
+) error {
+	response.RoomVersion = gomatrixserverlib.RoomVersionV1
+	return nil
+}
+
+func (r *threePIDTestRoom) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	last := r.events[len(r.events)-1]
+	response.RoomExists = true
+	response.RoomVersion = gomatrixserverlib.RoomVersionV1
+	response.LatestEvents = []gomatrixserverlib.EventReference{last.EventReference()}
+	response.Depth = last.Depth() + 1
+	for _, ev := range r.events {
+		response.StateEvents = append(response.StateEvents, ev.Headered(response.RoomVersion))
+	}
+	return nil
+}
+
+func (r *threePIDTestRoom) InputRoomEvents(
+	ctx context.Context,
+	request *api.InputRoomEventsRequest,
+	response *api.InputRoomEventsResponse,
+) error {
+	for _, ire := range request.InputRoomEvents {
+		r.sent = append(r.sent, ire.Event)
+	}
+	return nil
+}
+
+func (r *threePIDTestRoom) ShutdownRoom(
+	ctx context.Context,
+	request *api.ShutdownRoomRequest,
+	response *api.ShutdownRoomResponse,
+) error {
+	return nil
+}
+
+func (r *threePIDTestRoom) RejectInvite(
+	ctx context.Context,
+	request *api.RejectInviteRequest,
+	response *api.RejectInviteResponse,
+) error {
+	return nil
+}
+
+// invitedServer signs the invites sent to it.
+type invitedServer struct {
+	privateKey ed25519.PrivateKey
+}
+
+func (s *invitedServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(body, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return w.Result(), nil
+	}
+	signed := event.Sign("example.org", "ed25519:test", s.privateKey)
+	res, err := json.Marshal(gomatrixserverlib.RespInvite{Event: signed})
+	if err != nil {
+		return nil, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(res)
+	return w.Result(), nil
+}
+
+// newThreePIDTestRoom returns a room on this server in which alice invited a
+// third party identifier, along with the key of the identity server.
+func newThreePIDTestRoom(t *testing.T) (*threePIDTestRoom, ed25519.PrivateKey) {
+	_, serverKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idServerPublicKey, idServerKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = serverKey
+
+	alice := "@alice:localhost"
+	room := &threePIDTestRoom{t: t, cfg: cfg}
+	room.addState(alice, "m.room.create", "", map[string]interface{}{"creator": alice})
+	room.addState(alice, "m.room.member", alice, gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join})
+	room.addState(alice, "m.room.power_levels", "", map[string]interface{}{"users": map[string]int{alice: 100}})
+	room.addState(alice, "m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: gomatrixserverlib.Invite})
+	room.addState(alice, "m.room.third_party_invite", "token", gomatrixserverlib.ThirdPartyInviteContent{
+		DisplayName:    "c...@example.org",
+		KeyValidityURL: "https://id.example.org/_matrix/identity/api/v1/pubkey/isvalid",
+		PublicKey:      gomatrixserverlib.Base64String(idServerPublicKey).Encode(),
+	})
+	return room, idServerKey
+}
+
+// exchangeThirdPartyInvite sends the invite example.org builds once carol has
+// bound the third party identifier, signed by the identity server key.
+func exchangeThirdPartyInvite(t *testing.T, room *threePIDTestRoom, idServerKey ed25519.PrivateKey) (int, []byte) {
+	signed, err := gomatrixserverlib.SignJSON("id.example.org", "ed25519:0", idServerKey, []byte(
+		`{"mxid":"@carol:example.org","token":"token"}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "@carol:example.org"
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   "@alice:localhost",
+		RoomID:   threePIDTestRoomID,
+		Type:     "m.room.member",
+		StateKey: &target,
+		Content: []byte(fmt.Sprintf(
+			`{"membership":"invite","third_party_invite":{"display_name":"Carol","signed":%s}}`, signed,
+		)),
+	}
+	request := gomatrixserverlib.NewFederationRequest(
+		http.MethodPut, "localhost", "/_matrix/federation/v1/exchange_third_party_invite/"+threePIDTestRoomID,
+	)
+	if err = request.SetContent(builder); err != nil {
+		t.Fatal(err)
+	}
+	_, remoteKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = request.Sign("example.org", "ed25519:test", remoteKey); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", &invitedServer{remoteKey})
+	federation := gomatrixserverlib.NewFederationClientWithTransport(
+		room.cfg.Matrix.ServerName, room.cfg.Matrix.KeyID, room.cfg.Matrix.PrivateKey, tr,
+	)
+	res := ExchangeThirdPartyInvite(
+		httptest.NewRequest(http.MethodPut, "/", bytes.NewBuffer(request.Content())), &request,
+		threePIDTestRoomID, room, room.cfg, federation, producers.NewRoomserverProducer(room, room),
+	)
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Code, body
+}
+
+func TestExchangeThirdPartyInvite(t *testing.T) {
+	room, idServerKey := newThreePIDTestRoom(t)
+	code, body := exchangeThirdPartyInvite(t, room, idServerKey)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %s", code, body)
+	}
+	if len(room.sent) != 1 {
+		t.Fatalf("expected the invite to be sent to the roomserver, got %d events", len(room.sent))
+	}
+	invite := room.sent[0].Unwrap()
+	if invite.Sender() != "@alice:localhost" || *invite.StateKey() != "@carol:example.org" {
+		t.Errorf("expected an invite from alice to carol, got %s to %s", invite.Sender(), *invite.StateKey())
+	}
+	var content gomatrixserverlib.MemberContent
+	if err := json.Unmarshal(invite.Content(), &content); err != nil {
+		t.Fatal(err)
+	}
+	if content.ThirdPartyInvite == nil || content.ThirdPartyInvite.DisplayName != "c...@example.org" {
+		t.Errorf("expected the display name of the third-party invite to be filled in, got %+v", content.ThirdPartyInvite)
+	}
+	if !bytes.Contains(invite.JSON(), []byte(`"example.org":{"ed25519:test"`)) {
+		t.Error("expected the invite to be signed by the invited server")
+	}
+}
+
+func TestExchangeThirdPartyInviteRequiresIdentityServerSignature(t *testing.T) {
+	room, _ := newThreePIDTestRoom(t)
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body := exchangeThirdPartyInvite(t, room, otherKey)
+	if code != http.StatusForbidden {
+		t.Errorf("expected 403 Forbidden, got %d: %s", code, body)
+	}
+	if len(room.sent) != 0 {
+		t.Errorf("expected no events to be sent, got %d", len(room.sent))
+	}
+}
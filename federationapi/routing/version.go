@@ -17,19 +17,15 @@ package routing
 import (
 	"net/http"
 
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
-type version struct {
-	Server server `json:"server"`
-}
-
-type server struct {
-	Version string `json:"version"`
-	Name    string `json:"name"`
-}
-
 // Version returns the server version
 func Version() util.JSONResponse {
-	return util.JSONResponse{Code: http.StatusOK, JSON: &version{server{"dev", "Dendrite"}}}
+	var version gomatrixserverlib.Version
+	version.Server.Name = common.VersionName
+	version.Server.Version = common.Version
+	return util.JSONResponse{Code: http.StatusOK, JSON: &version}
 }
@@ -0,0 +1,35 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	res := Version()
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", res.Code)
+	}
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"server":{"name":"Dendrite","version":"dev"}}`; string(body) != want {
+		t.Errorf("expected %s, got %s", want, body)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type Database interface {
+	// GetTransactionResponse returns the response that was sent for a
+	// transaction from the origin, or nil if the transaction hasn't been seen.
+	GetTransactionResponse(ctx context.Context, origin gomatrixserverlib.ServerName, txnID gomatrixserverlib.TransactionID) (*gomatrixserverlib.RespSend, error)
+	// StoreTransactionResponse stores the response that was sent for a
+	// transaction from the origin.
+	StoreTransactionResponse(ctx context.Context, origin gomatrixserverlib.ServerName, txnID gomatrixserverlib.TransactionID, res *gomatrixserverlib.RespSend) error
+	// DeleteTransactionsBefore forgets the transactions received before a time.
+	DeleteTransactionsBefore(ctx context.Context, before gomatrixserverlib.Timestamp) error
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Database stores information needed by the federation API
+type Database struct {
+	transactionsStatements
+	db *sql.DB
+}
+
+// NewDatabase opens a new database
+func NewDatabase(dataSourceName string, dbProperties sqlutil.DbProperties) (*Database, error) {
+	var result Database
+	var err error
+	if result.db, err = sqlutil.Open("postgres", dataSourceName, dbProperties); err != nil {
+		return nil, err
+	}
+	migrator := common.NewMigrator(result.db, "federationapi")
+	migrator.AddMigrations(common.BaselineMigration)
+	if err = migrator.Up(context.Background()); err != nil {
+		return nil, err
+	}
+	if err = result.transactionsStatements.prepare(result.db); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Ping checks that the database can be reached.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+// GetTransactionResponse returns the response that was sent for a transaction
+// from the origin, or nil if the transaction hasn't been seen.
+func (d *Database) GetTransactionResponse(
+	ctx context.Context,
+	origin gomatrixserverlib.ServerName, txnID gomatrixserverlib.TransactionID,
+) (*gomatrixserverlib.RespSend, error) {
+	responseJSON, err := d.selectTransaction(ctx, origin, txnID)
+	if err != nil || responseJSON == nil {
+		return nil, err
+	}
+	var res gomatrixserverlib.RespSend
+	if err = json.Unmarshal(responseJSON, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// StoreTransactionResponse stores the response that was sent for a
+// transaction from the origin.
+func (d *Database) StoreTransactionResponse(
+	ctx context.Context,
+	origin gomatrixserverlib.ServerName, txnID gomatrixserverlib.TransactionID,
+	res *gomatrixserverlib.RespSend,
+) error {
+	responseJSON, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return d.insertTransaction(ctx, nil, origin, txnID, responseJSON, gomatrixserverlib.AsTimestamp(time.Now()))
+}
+
+// DeleteTransactionsBefore forgets the transactions received before a time.
+func (d *Database) DeleteTransactionsBefore(
+	ctx context.Context, before gomatrixserverlib.Timestamp,
+) error {
+	return d.deleteTransactionsBefore(ctx, nil, before)
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const transactionsSchema = `
+-- Stores the responses sent for the transactions received from other servers,
+-- so that a transaction which is sent again gets the same response without
+-- its events being processed twice.
+CREATE TABLE IF NOT EXISTS federationapi_transactions (
+    -- The server which sent the transaction.
+    origin TEXT NOT NULL,
+    -- The ID that the server gave the transaction.
+    transaction_id TEXT NOT NULL,
+    -- The JSON of the response that was sent for the transaction.
+    response_json TEXT NOT NULL,
+    -- When the transaction was received in milliseconds, used to forget it
+    -- after a while.
+    received_ts BIGINT NOT NULL,
+    PRIMARY KEY(origin, transaction_id)
+);
+
+CREATE INDEX IF NOT EXISTS federationapi_transactions_received_ts_idx
+    ON federationapi_transactions (received_ts);
+`
+
+const insertTransactionSQL = "" +
+	"INSERT INTO federationapi_transactions (origin, transaction_id, response_json, received_ts)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (origin, transaction_id) DO NOTHING"
+
+const selectTransactionSQL = "" +
+	"SELECT response_json FROM federationapi_transactions" +
+	" WHERE origin = $1 AND transaction_id = $2"
+
+const deleteTransactionsBeforeSQL = "" +
+	"DELETE FROM federationapi_transactions WHERE received_ts < $1"
+
+type transactionsStatements struct {
+	insertTransactionStmt        *sql.Stmt
+	selectTransactionStmt        *sql.Stmt
+	deleteTransactionsBeforeStmt *sql.Stmt
+}
+
+func (s *transactionsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(transactionsSchema)
+	if err != nil {
+		return
+	}
+
+	if s.insertTransactionStmt, err = db.Prepare(insertTransactionSQL); err != nil {
+		return
+	}
+	if s.selectTransactionStmt, err = db.Prepare(selectTransactionSQL); err != nil {
+		return
+	}
+	if s.deleteTransactionsBeforeStmt, err = db.Prepare(deleteTransactionsBeforeSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *transactionsStatements) insertTransaction(
+	ctx context.Context, txn *sql.Tx,
+	origin gomatrixserverlib.ServerName, txnID gomatrixserverlib.TransactionID,
+	responseJSON []byte, receivedTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := common.TxStmt(txn, s.insertTransactionStmt).ExecContext(
+		ctx, origin, txnID, string(responseJSON), receivedTS,
+	)
+	return err
+}
+
+// selectTransaction returns the JSON of the response sent for a transaction,
+// or nil if there wasn't one.
+func (s *transactionsStatements) selectTransaction(
+	ctx context.Context,
+	origin gomatrixserverlib.ServerName, txnID gomatrixserverlib.TransactionID,
+) ([]byte, error) {
+	var responseJSON string
+	err := s.selectTransactionStmt.QueryRowContext(ctx, origin, txnID).Scan(&responseJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(responseJSON), nil
+}
+
+func (s *transactionsStatements) deleteTransactionsBefore(
+	ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp,
+) error {
+	_, err := common.TxStmt(txn, s.deleteTransactionsBeforeStmt).ExecContext(ctx, before)
+	return err
+}
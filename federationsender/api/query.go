@@ -32,6 +32,25 @@ type QueryJoinedHostServerNamesInRoomResponse struct {
 	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
 }
 
+// QueryDestinationStatusesRequest is a request to QueryDestinationStatuses
+type QueryDestinationStatusesRequest struct{}
+
+// QueryDestinationStatusesResponse is a response to QueryDestinationStatuses
+type QueryDestinationStatusesResponse struct {
+	Destinations []types.DestinationStatus `json:"destinations"`
+}
+
+// ResetDestinationBackoffRequest is a request to ResetDestinationBackoff
+type ResetDestinationBackoffRequest struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+}
+
+// ResetDestinationBackoffResponse is a response to ResetDestinationBackoff
+type ResetDestinationBackoffResponse struct {
+	// Whether the destination has ever been sent to.
+	Known bool `json:"known"`
+}
+
 // FederationSenderQueryAPI is used to query information from the federation sender.
 type FederationSenderQueryAPI interface {
 	// Query the joined hosts and the membership events accounting for their participation in a room.
@@ -50,6 +69,20 @@ type FederationSenderQueryAPI interface {
 		request *QueryJoinedHostServerNamesInRoomRequest,
 		response *QueryJoinedHostServerNamesInRoomResponse,
 	) error
+	// Query how sending to each destination is going, including whether it
+	// is being backed off from after failures.
+	QueryDestinationStatuses(
+		ctx context.Context,
+		request *QueryDestinationStatusesRequest,
+		response *QueryDestinationStatusesResponse,
+	) error
+	// Forget the failures to send to a destination so that it is tried again
+	// straight away.
+	ResetDestinationBackoff(
+		ctx context.Context,
+		request *ResetDestinationBackoffRequest,
+		response *ResetDestinationBackoffResponse,
+	) error
 }
 
 // FederationSenderQueryJoinedHostsInRoomPath is the HTTP path for the QueryJoinedHostsInRoom API.
@@ -58,6 +91,12 @@ const FederationSenderQueryJoinedHostsInRoomPath = "/api/federationsender/queryJ
 // FederationSenderQueryJoinedHostServerNamesInRoomPath is the HTTP path for the QueryJoinedHostServerNamesInRoom API.
 const FederationSenderQueryJoinedHostServerNamesInRoomPath = "/api/federationsender/queryJoinedHostServerNamesInRoom"
 
+// FederationSenderQueryDestinationStatusesPath is the HTTP path for the QueryDestinationStatuses API.
+const FederationSenderQueryDestinationStatusesPath = "/api/federationsender/queryDestinationStatuses"
+
+// FederationSenderResetDestinationBackoffPath is the HTTP path for the ResetDestinationBackoff API.
+const FederationSenderResetDestinationBackoffPath = "/api/federationsender/resetDestinationBackoff"
+
 // NewFederationSenderQueryAPIHTTP creates a FederationSenderQueryAPI implemented by talking to a HTTP POST API.
 // If httpClient is nil an error is returned
 func NewFederationSenderQueryAPIHTTP(federationSenderURL string, httpClient *http.Client) (FederationSenderQueryAPI, error) {
@@ -97,3 +136,29 @@ func (h *httpFederationSenderQueryAPI) QueryJoinedHostServerNamesInRoom(
 	apiURL := h.federationSenderURL + FederationSenderQueryJoinedHostServerNamesInRoomPath
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// QueryDestinationStatuses implements FederationSenderQueryAPI
+func (h *httpFederationSenderQueryAPI) QueryDestinationStatuses(
+	ctx context.Context,
+	request *QueryDestinationStatusesRequest,
+	response *QueryDestinationStatusesResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryDestinationStatuses")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderQueryDestinationStatusesPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// ResetDestinationBackoff implements FederationSenderQueryAPI
+func (h *httpFederationSenderQueryAPI) ResetDestinationBackoff(
+	ctx context.Context,
+	request *ResetDestinationBackoffRequest,
+	response *ResetDestinationBackoffResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ResetDestinationBackoff")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderResetDestinationBackoffPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
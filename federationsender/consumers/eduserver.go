@@ -15,13 +15,18 @@ package consumers
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/roomserver/acls"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/Shopify/sarama.v1"
 )
@@ -31,6 +36,8 @@ type OutputTypingEventConsumer struct {
 	consumer   *common.ContinualConsumer
 	db         storage.Database
 	queues     *queue.OutgoingQueues
+	rsQueryAPI roomserverAPI.RoomserverQueryAPI
+	serverACLs *acls.ServerACLs
 	ServerName gomatrixserverlib.ServerName
 }
 
@@ -40,6 +47,8 @@ func NewOutputTypingEventConsumer(
 	kafkaConsumer sarama.Consumer,
 	queues *queue.OutgoingQueues,
 	store storage.Database,
+	rsQueryAPI roomserverAPI.RoomserverQueryAPI,
+	serverACLs *acls.ServerACLs,
 ) *OutputTypingEventConsumer {
 	consumer := common.ContinualConsumer{
 		Topic:          string(cfg.Kafka.Topics.OutputTypingEvent),
@@ -50,6 +59,8 @@ func NewOutputTypingEventConsumer(
 		consumer:   &consumer,
 		queues:     queues,
 		db:         store,
+		rsQueryAPI: rsQueryAPI,
+		serverACLs: serverACLs,
 		ServerName: cfg.Matrix.ServerName,
 	}
 	consumer.ProcessMessage = c.onMessage
@@ -93,6 +104,10 @@ func (t *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error
 	for i := range joined {
 		names[i] = joined[i].ServerName
 	}
+	names, err = withoutBannedServers(context.TODO(), t.rsQueryAPI, t.serverACLs, ote.Event.RoomID, names)
+	if err != nil {
+		return err
+	}
 
 	edu := &gomatrixserverlib.EDU{Type: ote.Event.Type}
 	if edu.Content, err = json.Marshal(map[string]interface{}{
@@ -105,3 +120,314 @@ func (t *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error
 
 	return t.queues.SendEDU(edu, t.ServerName, names)
 }
+
+// OutputReceiptEventConsumer consumes batches of receipts that originate in
+// the EDU server.
+type OutputReceiptEventConsumer struct {
+	consumer   *common.ContinualConsumer
+	db         storage.Database
+	queues     *queue.OutgoingQueues
+	rsQueryAPI roomserverAPI.RoomserverQueryAPI
+	serverACLs *acls.ServerACLs
+	ServerName gomatrixserverlib.ServerName
+}
+
+// NewOutputReceiptEventConsumer creates a new OutputReceiptEventConsumer. Call Start() to begin consuming from EDU servers.
+func NewOutputReceiptEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store storage.Database,
+	rsQueryAPI roomserverAPI.RoomserverQueryAPI,
+	serverACLs *acls.ServerACLs,
+) *OutputReceiptEventConsumer {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputReceiptEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	c := &OutputReceiptEventConsumer{
+		consumer:   &consumer,
+		queues:     queues,
+		db:         store,
+		rsQueryAPI: rsQueryAPI,
+		serverACLs: serverACLs,
+		ServerName: cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = c.onMessage
+
+	return c
+}
+
+// Start consuming from EDU servers
+func (t *OutputReceiptEventConsumer) Start() error {
+	return t.consumer.Start()
+}
+
+// onMessage is called for OutputReceiptEvent received from the EDU servers.
+// Parses the msg, creates a single matrix federation EDU for all of the
+// receipts in it and sends it to joined hosts.
+func (t *OutputReceiptEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var ore api.OutputReceiptEvent
+	if err := json.Unmarshal(msg.Value, &ore); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("eduserver output log: message parse failed")
+		return nil
+	}
+
+	edu, err := receiptEDU(t.ServerName, &ore)
+	if err != nil {
+		return err
+	}
+	if edu == nil {
+		return nil
+	}
+
+	joined, err := t.db.GetJoinedHosts(context.TODO(), ore.RoomID)
+	if err != nil {
+		return err
+	}
+
+	names := make([]gomatrixserverlib.ServerName, len(joined))
+	for i := range joined {
+		names[i] = joined[i].ServerName
+	}
+	names, err = withoutBannedServers(context.TODO(), t.rsQueryAPI, t.serverACLs, ore.RoomID, names)
+	if err != nil {
+		return err
+	}
+
+	return t.queues.SendEDU(edu, t.ServerName, names)
+}
+
+// receiptEDU creates an 'm.receipt' EDU containing the receipts sent by users
+// on this server, or returns nil if there are none.
+func receiptEDU(
+	serverName gomatrixserverlib.ServerName, ore *api.OutputReceiptEvent,
+) (*gomatrixserverlib.EDU, error) {
+	type receiptData struct {
+		TS gomatrixserverlib.Timestamp `json:"ts"`
+	}
+	type userReceipt struct {
+		Data     receiptData `json:"data"`
+		EventIDs []string    `json:"event_ids"`
+	}
+	// Receipts are grouped by type and then by user.
+	receipts := make(map[string]map[string]userReceipt)
+	for _, receipt := range ore.Receipts {
+		// only send receipts which originated from us
+		_, receiptServerName, err := gomatrixserverlib.SplitID('@', receipt.UserID)
+		if err != nil {
+			log.WithError(err).WithField("user_id", receipt.UserID).Error("Failed to extract domain from receipt sender")
+			continue
+		}
+		if receiptServerName != serverName {
+			continue
+		}
+		if receipts[receipt.Type] == nil {
+			receipts[receipt.Type] = make(map[string]userReceipt)
+		}
+		receipts[receipt.Type][receipt.UserID] = userReceipt{
+			Data:     receiptData{TS: receipt.Timestamp},
+			EventIDs: []string{receipt.EventID},
+		}
+	}
+	if len(receipts) == 0 {
+		return nil, nil
+	}
+
+	edu := &gomatrixserverlib.EDU{Type: "m.receipt"}
+	var err error
+	if edu.Content, err = json.Marshal(map[string]interface{}{
+		ore.RoomID: receipts,
+	}); err != nil {
+		return nil, err
+	}
+	return edu, nil
+}
+
+// OutputPresenceEventConsumer consumes presence changes that originate in the
+// EDU server.
+type OutputPresenceEventConsumer struct {
+	consumer   *common.ContinualConsumer
+	db         storage.Database
+	queues     *queue.OutgoingQueues
+	rsQueryAPI roomserverAPI.RoomserverQueryAPI
+	ServerName gomatrixserverlib.ServerName
+}
+
+// NewOutputPresenceEventConsumer creates a new OutputPresenceEventConsumer. Call Start() to begin consuming from EDU servers.
+func NewOutputPresenceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store storage.Database,
+	rsQueryAPI roomserverAPI.RoomserverQueryAPI,
+) *OutputPresenceEventConsumer {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputPresenceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	c := &OutputPresenceEventConsumer{
+		consumer:   &consumer,
+		queues:     queues,
+		db:         store,
+		rsQueryAPI: rsQueryAPI,
+		ServerName: cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = c.onMessage
+
+	return c
+}
+
+// Start consuming from EDU servers
+func (t *OutputPresenceEventConsumer) Start() error {
+	return t.consumer.Start()
+}
+
+// onMessage is called for OutputPresenceEvent received from the EDU servers.
+// Parses the msg, creates a matrix federation EDU and sends it to every host
+// which shares a room with the user.
+func (t *OutputPresenceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var ope api.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &ope); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("eduserver output log: message parse failed")
+		return nil
+	}
+
+	// only send presence which originated from us
+	_, presenceServerName, err := gomatrixserverlib.SplitID('@', ope.Event.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", ope.Event.UserID).Error("Failed to extract domain from presence sender")
+		return nil
+	}
+	if presenceServerName != t.ServerName {
+		return nil
+	}
+
+	var roomsRes roomserverAPI.QueryRoomsForUserResponse
+	err = t.rsQueryAPI.QueryRoomsForUser(context.TODO(), &roomserverAPI.QueryRoomsForUserRequest{
+		UserID:         ope.Event.UserID,
+		WantMembership: gomatrixserverlib.Join,
+	}, &roomsRes)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[gomatrixserverlib.ServerName]bool)
+	var names []gomatrixserverlib.ServerName
+	for _, roomID := range roomsRes.RoomIDs {
+		joined, err := t.db.GetJoinedHosts(context.TODO(), roomID)
+		if err != nil {
+			return err
+		}
+		for i := range joined {
+			if !seen[joined[i].ServerName] {
+				seen[joined[i].ServerName] = true
+				names = append(names, joined[i].ServerName)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	edu := &gomatrixserverlib.EDU{Type: "m.presence"}
+	if edu.Content, err = json.Marshal(map[string]interface{}{
+		"push": []map[string]interface{}{{
+			"user_id":          ope.Event.UserID,
+			"presence":         ope.Event.Presence,
+			"status_msg":       ope.Event.StatusMsg,
+			"last_active_ago":  cache.LastActiveAgo(ope.Event, time.Now()),
+			"currently_active": ope.Event.CurrentlyActive,
+		}},
+	}); err != nil {
+		return err
+	}
+
+	return t.queues.SendEDU(edu, t.ServerName, names)
+}
+
+// OutputSendToDeviceEventConsumer consumes send-to-device messages that
+// originate in the EDU server.
+type OutputSendToDeviceEventConsumer struct {
+	consumer   *common.ContinualConsumer
+	db         storage.Database
+	queues     *queue.OutgoingQueues
+	ServerName gomatrixserverlib.ServerName
+}
+
+// NewOutputSendToDeviceEventConsumer creates a new OutputSendToDeviceEventConsumer. Call Start() to begin consuming from EDU servers.
+func NewOutputSendToDeviceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store storage.Database,
+) *OutputSendToDeviceEventConsumer {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	c := &OutputSendToDeviceEventConsumer{
+		consumer:   &consumer,
+		queues:     queues,
+		db:         store,
+		ServerName: cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = c.onMessage
+
+	return c
+}
+
+// Start consuming from EDU servers
+func (t *OutputSendToDeviceEventConsumer) Start() error {
+	return t.consumer.Start()
+}
+
+// onMessage is called for OutputSendToDeviceEvent received from the EDU
+// servers. Messages sent by local users to remote users are sent to the
+// server of the remote user as an 'm.direct_to_device' EDU.
+func (t *OutputSendToDeviceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var ose api.OutputSendToDeviceEvent
+	if err := json.Unmarshal(msg.Value, &ose); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("eduserver output log: message parse failed")
+		return nil
+	}
+
+	// only send messages which originated from us
+	_, senderServerName, err := gomatrixserverlib.SplitID('@', ose.Event.Sender)
+	if err != nil {
+		log.WithError(err).WithField("user_id", ose.Event.Sender).Error("Failed to extract domain from send-to-device sender")
+		return nil
+	}
+	if senderServerName != t.ServerName {
+		return nil
+	}
+	_, destination, err := gomatrixserverlib.SplitID('@', ose.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", ose.UserID).Error("Failed to extract domain from send-to-device target")
+		return nil
+	}
+	if destination == t.ServerName {
+		return nil
+	}
+
+	// https://matrix.org/docs/spec/server_server/latest#send-to-device-messaging
+	edu := &gomatrixserverlib.EDU{Type: "m.direct_to_device"}
+	if edu.Content, err = json.Marshal(map[string]interface{}{
+		"sender":     ose.Event.Sender,
+		"type":       ose.Event.Type,
+		"message_id": util.RandomString(32),
+		"messages": map[string]map[string]json.RawMessage{
+			ose.UserID: {ose.DeviceID: ose.Event.Content},
+		},
+	}); err != nil {
+		return err
+	}
+
+	return t.queues.SendEDU(edu, t.ServerName, []gomatrixserverlib.ServerName{destination})
+}
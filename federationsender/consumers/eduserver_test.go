@@ -0,0 +1,396 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/roomserver/acls"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+func TestRapidReceiptsAreBatched(t *testing.T) {
+	edus := make(chan *gomatrixserverlib.EDU, 10)
+	receiptCache := cache.NewReceiptCache(50*time.Millisecond, func(roomID string, receipts []api.ReceiptEvent) {
+		edu, err := receiptEDU("localhost", &api.OutputReceiptEvent{RoomID: roomID, Receipts: receipts})
+		if err != nil {
+			t.Error(err)
+		}
+		edus <- edu
+	})
+
+	for i, eventID := range []string{"$one:localhost", "$two:localhost", "$three:localhost"} {
+		receiptCache.AddReceipt(api.ReceiptEvent{
+			UserID:    "@alice:localhost",
+			RoomID:    "!room:localhost",
+			EventID:   eventID,
+			Type:      "m.read",
+			Timestamp: gomatrixserverlib.Timestamp(i),
+		})
+	}
+
+	var edu *gomatrixserverlib.EDU
+	select {
+	case edu = <-edus:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the receipts to be flushed")
+	}
+	select {
+	case <-edus:
+		t.Fatal("expected a single EDU for the batch")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if edu.Type != "m.receipt" {
+		t.Errorf("expected an m.receipt EDU, got %s", edu.Type)
+	}
+	var content map[string]map[string]map[string]struct {
+		Data struct {
+			TS gomatrixserverlib.Timestamp `json:"ts"`
+		} `json:"data"`
+		EventIDs []string `json:"event_ids"`
+	}
+	if err := json.Unmarshal(edu.Content, &content); err != nil {
+		t.Fatal(err)
+	}
+	receipt := content["!room:localhost"]["m.read"]["@alice:localhost"]
+	if len(receipt.EventIDs) != 1 || receipt.EventIDs[0] != "$three:localhost" {
+		t.Errorf("expected a receipt for the latest event, got %v", receipt.EventIDs)
+	}
+	if receipt.Data.TS != 2 {
+		t.Errorf("expected the timestamp of the latest receipt, got %d", receipt.Data.TS)
+	}
+}
+
+func TestReceiptsFromOtherServersAreNotSent(t *testing.T) {
+	edu, err := receiptEDU("localhost", &api.OutputReceiptEvent{
+		RoomID: "!room:localhost",
+		Receipts: []api.ReceiptEvent{
+			{UserID: "@bob:example.org", RoomID: "!room:localhost", EventID: "$one:localhost", Type: "m.read"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edu != nil {
+		t.Errorf("expected no EDU, got %s", edu.Content)
+	}
+}
+
+// testRoomsQueryAPI answers which rooms a user is joined to.
+type testRoomsQueryAPI struct {
+	roomserverAPI.RoomserverQueryAPI
+	rooms map[string][]string
+}
+
+func (q *testRoomsQueryAPI) QueryRoomsForUser(
+	ctx context.Context,
+	request *roomserverAPI.QueryRoomsForUserRequest,
+	response *roomserverAPI.QueryRoomsForUserResponse,
+) error {
+	response.RoomIDs = q.rooms[request.UserID]
+	return nil
+}
+
+// testJoinedHostsDB answers which hosts are joined to a room.
+type testJoinedHostsDB struct {
+	storage.Database
+	hosts map[string][]gomatrixserverlib.ServerName
+}
+
+func (d *testJoinedHostsDB) GetJoinedHosts(ctx context.Context, roomID string) ([]types.JoinedHost, error) {
+	var joined []types.JoinedHost
+	for _, serverName := range d.hosts[roomID] {
+		joined = append(joined, types.JoinedHost{ServerName: serverName})
+	}
+	return joined, nil
+}
+
+// transactionRecorder records the EDUs in the transactions sent to each
+// remote server. Other requests are answered with a 404.
+type transactionRecorder struct {
+	edus chan gomatrixserverlib.EDU
+}
+
+func (r *transactionRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPut {
+		return &http.Response{
+			StatusCode: http.StatusNotFound,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			Request:    req,
+		}, nil
+	}
+	var txn gomatrixserverlib.Transaction
+	if err := json.NewDecoder(req.Body).Decode(&txn); err != nil {
+		return nil, err
+	}
+	for _, edu := range txn.EDUs {
+		edu.Destination = req.URL.Host
+		r.edus <- edu
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"pdus":{}}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestOfflinePresenceIsSentToServersSharingARoom(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &transactionRecorder{edus: make(chan gomatrixserverlib.EDU, 10)}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", recorder)
+	client := gomatrixserverlib.NewFederationClientWithTransport(
+		"localhost", "ed25519:test", privateKey, tr,
+	)
+
+	c := &OutputPresenceEventConsumer{
+		queues: queue.NewOutgoingQueues("localhost", client, nil, nil),
+		db: &testJoinedHostsDB{hosts: map[string][]gomatrixserverlib.ServerName{
+			"!shared:localhost": {"localhost", "example.org"},
+		}},
+		rsQueryAPI: &testRoomsQueryAPI{rooms: map[string][]string{
+			"@alice:localhost": {"!shared:localhost"},
+		}},
+		ServerName: "localhost",
+	}
+
+	value, err := json.Marshal(api.OutputPresenceEvent{Event: api.PresenceEvent{
+		UserID:       "@alice:localhost",
+		Presence:     api.PresenceOffline,
+		LastActiveTS: gomatrixserverlib.AsTimestamp(time.Now()),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.onMessage(&sarama.ConsumerMessage{Value: value}); err != nil {
+		t.Fatal(err)
+	}
+
+	var edu gomatrixserverlib.EDU
+	select {
+	case edu = <-recorder.edus:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the presence to be sent")
+	}
+	if edu.Destination != "example.org" {
+		t.Errorf("expected the presence to be sent to example.org, got %s", edu.Destination)
+	}
+	if edu.Type != "m.presence" {
+		t.Errorf("expected an m.presence EDU, got %s", edu.Type)
+	}
+	var content struct {
+		Push []struct {
+			UserID          string `json:"user_id"`
+			Presence        string `json:"presence"`
+			CurrentlyActive bool   `json:"currently_active"`
+		} `json:"push"`
+	}
+	if err = json.Unmarshal(edu.Content, &content); err != nil {
+		t.Fatal(err)
+	}
+	if len(content.Push) != 1 || content.Push[0].UserID != "@alice:localhost" ||
+		content.Push[0].Presence != api.PresenceOffline || content.Push[0].CurrentlyActive {
+		t.Errorf("expected alice to be offline, got %s", edu.Content)
+	}
+}
+
+// testACLQueryAPI gives every room the same server ACL, and counts how often
+// it is fetched.
+type testACLQueryAPI struct {
+	roomserverAPI.RoomserverQueryAPI
+	aclEvent gomatrixserverlib.Event
+	fetched  int
+}
+
+func (q *testACLQueryAPI) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *roomserverAPI.QueryLatestEventsAndStateRequest,
+	response *roomserverAPI.QueryLatestEventsAndStateResponse,
+) error {
+	q.fetched++
+	response.RoomExists = true
+	for _, tuple := range request.StateToFetch {
+		if tuple.EventType == acls.MRoomServerACL {
+			response.StateEvents = append(response.StateEvents, q.aclEvent.Headered(gomatrixserverlib.RoomVersionV1))
+		}
+	}
+	return nil
+}
+
+func TestTypingIsNotSentToBannedServers(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &transactionRecorder{edus: make(chan gomatrixserverlib.EDU, 10)}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", recorder)
+	client := gomatrixserverlib.NewFederationClientWithTransport(
+		"localhost", "ed25519:test", privateKey, tr,
+	)
+
+	aclEvent, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"event_id":"$acl:localhost","room_id":"!room:localhost","sender":"@alice:localhost",
+		"type":"m.room.server_acl","state_key":"","content":{"allow":["*"],"deny":["*.evil.com"]}
+	}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryAPI := &testACLQueryAPI{aclEvent: aclEvent}
+
+	c := &OutputTypingEventConsumer{
+		queues: queue.NewOutgoingQueues("localhost", client, nil, nil),
+		db: &testJoinedHostsDB{hosts: map[string][]gomatrixserverlib.ServerName{
+			"!room:localhost": {"localhost", "matrix.evil.com", "example.org"},
+		}},
+		rsQueryAPI: queryAPI,
+		serverACLs: acls.NewServerACLs(),
+		ServerName: "localhost",
+	}
+
+	// sendTyping sends a typing notification and returns the servers that it
+	// was sent to.
+	sendTyping := func(typing bool) []string {
+		value, marshalErr := json.Marshal(api.OutputTypingEvent{Event: api.TypingEvent{
+			Type:   gomatrixserverlib.MTyping,
+			RoomID: "!room:localhost",
+			UserID: "@alice:localhost",
+			Typing: typing,
+		}})
+		if marshalErr != nil {
+			t.Fatal(marshalErr)
+		}
+		if msgErr := c.onMessage(&sarama.ConsumerMessage{Value: value}); msgErr != nil {
+			t.Fatal(msgErr)
+		}
+		var destinations []string
+		for {
+			select {
+			case edu := <-recorder.edus:
+				destinations = append(destinations, edu.Destination)
+			case <-time.After(500 * time.Millisecond):
+				return destinations
+			}
+		}
+	}
+
+	if got := sendTyping(true); len(got) != 1 || got[0] != "example.org" {
+		t.Errorf("expected the typing notification to be sent to example.org only, got %v", got)
+	}
+	if got := sendTyping(false); len(got) != 1 || got[0] != "example.org" {
+		t.Errorf("expected the typing notification to be sent to example.org only, got %v", got)
+	}
+	if queryAPI.fetched != 1 {
+		t.Errorf("expected the server ACL to be fetched once, got %d times", queryAPI.fetched)
+	}
+
+	// Once the room consumer sees a new ACL, it is used without fetching it.
+	newACLEvent, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"event_id":"$acl2:localhost","room_id":"!room:localhost","sender":"@alice:localhost",
+		"type":"m.room.server_acl","state_key":"","content":{"allow":["*"],"deny":["example.org"]}
+	}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.serverACLs.Update("!room:localhost", []gomatrixserverlib.Event{newACLEvent}, []string{"$acl:localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := sendTyping(true); len(got) != 1 || got[0] != "matrix.evil.com" {
+		t.Errorf("expected the typing notification to be sent to matrix.evil.com only, got %v", got)
+	}
+	if queryAPI.fetched != 1 {
+		t.Errorf("expected the server ACL not to be fetched again, got %d fetches", queryAPI.fetched)
+	}
+}
+
+func TestSendToDeviceMessagesAreSentToTheServerOfTheUser(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &transactionRecorder{edus: make(chan gomatrixserverlib.EDU, 10)}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", recorder)
+	client := gomatrixserverlib.NewFederationClientWithTransport(
+		"localhost", "ed25519:test", privateKey, tr,
+	)
+
+	c := &OutputSendToDeviceEventConsumer{
+		queues:     queue.NewOutgoingQueues("localhost", client, nil, nil),
+		ServerName: "localhost",
+	}
+	for _, output := range []api.OutputSendToDeviceEvent{
+		// Messages for local users and messages received over federation
+		// aren't sent.
+		{UserID: "@carol:localhost", DeviceID: "*", Event: api.SendToDeviceEvent{Sender: "@alice:localhost", Type: "m.test", Content: []byte(`{}`)}},
+		{UserID: "@carol:localhost", DeviceID: "*", Event: api.SendToDeviceEvent{Sender: "@dave:other.org", Type: "m.test", Content: []byte(`{}`)}},
+		{UserID: "@bob:example.org", DeviceID: "BOBDEVICE", Event: api.SendToDeviceEvent{Sender: "@alice:localhost", Type: "m.test", Content: []byte(`{"a":1}`)}},
+	} {
+		var value []byte
+		if value, err = json.Marshal(output); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.onMessage(&sarama.ConsumerMessage{Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var edu gomatrixserverlib.EDU
+	select {
+	case edu = <-recorder.edus:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the send-to-device message to be sent")
+	}
+	if edu.Destination != "example.org" || edu.Type != "m.direct_to_device" {
+		t.Errorf("expected an m.direct_to_device EDU for example.org, got %s for %s", edu.Type, edu.Destination)
+	}
+	var content struct {
+		Sender    string                                `json:"sender"`
+		Type      string                                `json:"type"`
+		MessageID string                                `json:"message_id"`
+		Messages  map[string]map[string]json.RawMessage `json:"messages"`
+	}
+	if err = json.Unmarshal(edu.Content, &content); err != nil {
+		t.Fatal(err)
+	}
+	if content.Sender != "@alice:localhost" || content.Type != "m.test" || content.MessageID == "" ||
+		string(content.Messages["@bob:example.org"]["BOBDEVICE"]) != `{"a":1}` {
+		t.Errorf("unexpected send-to-device EDU: %s", edu.Content)
+	}
+	select {
+	case edu = <-recorder.edus:
+		t.Errorf("expected no other EDUs, got %s for %s", edu.Type, edu.Destination)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
@@ -37,6 +38,7 @@ type OutputRoomEventConsumer struct {
 	db                 storage.Database
 	queues             *queue.OutgoingQueues
 	query              api.RoomserverQueryAPI
+	serverACLs         *acls.ServerACLs
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
@@ -46,6 +48,7 @@ func NewOutputRoomEventConsumer(
 	queues *queue.OutgoingQueues,
 	store storage.Database,
 	queryAPI api.RoomserverQueryAPI,
+	serverACLs *acls.ServerACLs,
 ) *OutputRoomEventConsumer {
 	consumer := common.ContinualConsumer{
 		Topic:          string(cfg.Kafka.Topics.OutputRoomEvent),
@@ -58,6 +61,7 @@ func NewOutputRoomEventConsumer(
 		db:                 store,
 		queues:             queues,
 		query:              queryAPI,
+		serverACLs:         serverACLs,
 	}
 	consumer.ProcessMessage = s.onMessage
 
@@ -138,6 +142,10 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent) err
 	if err != nil {
 		return err
 	}
+	// Keep the cached server ACL of the room in step with its current state.
+	if err = s.serverACLs.Update(ore.Event.RoomID(), addsStateEvents, ore.RemovesStateEventIDs); err != nil {
+		return err
+	}
 	// Update our copy of the current state.
 	// We keep a copy of the current state because the state at each event is
 	// expressed as a delta against the current state.
@@ -173,6 +181,12 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent) err
 	if err != nil {
 		return err
 	}
+	joinedHostsAtEvent, err = withoutBannedServers(
+		context.TODO(), s.query, s.serverACLs, ore.Event.RoomID(), joinedHostsAtEvent,
+	)
+	if err != nil {
+		return err
+	}
 
 	// Send the event.
 	return s.queues.SendEvent(
@@ -331,6 +345,58 @@ func joinedHostsFromEvents(evs []gomatrixserverlib.Event) ([]types.JoinedHost, e
 	return joinedHosts, nil
 }
 
+// withoutBannedServers removes the servers which are denied by the current
+// server ACLs of the room from a list of servers. The ACL is only fetched
+// from the roomserver if it isn't cached, after which the room consumer keeps
+// it up to date as the state of the room changes.
+func withoutBannedServers(
+	ctx context.Context, query api.RoomserverQueryAPI, serverACLs *acls.ServerACLs,
+	roomID string, serverNames []gomatrixserverlib.ServerName,
+) ([]gomatrixserverlib.ServerName, error) {
+	if len(serverNames) == 0 {
+		return serverNames, nil
+	}
+	acl, cached := serverACLs.Cached(roomID)
+	if !cached {
+		req := api.QueryLatestEventsAndStateRequest{
+			RoomID: roomID,
+			StateToFetch: []gomatrixserverlib.StateKeyTuple{
+				{EventType: acls.MRoomServerACL, StateKey: ""},
+			},
+		}
+		var res api.QueryLatestEventsAndStateResponse
+		if err := query.QueryLatestEventsAndState(ctx, &req, &res); err != nil {
+			return nil, err
+		}
+		var aclEvent *gomatrixserverlib.Event
+		if len(res.StateEvents) > 0 {
+			event := res.StateEvents[0].Unwrap()
+			aclEvent = &event
+		}
+		var err error
+		if acl, err = serverACLs.ForEvent(roomID, aclEvent); err != nil {
+			return nil, err
+		}
+	}
+	// Rooms without a server ACL allow every server.
+	if acl == nil {
+		return serverNames, nil
+	}
+
+	var result []gomatrixserverlib.ServerName
+	for _, serverName := range serverNames {
+		if acl.IsServerBanned(serverName) {
+			log.WithFields(log.Fields{
+				"room_id":     roomID,
+				"server_name": serverName,
+			}).Info("Not sending to server banned by the server ACLs of the room")
+			continue
+		}
+		result = append(result, serverName)
+	}
+	return result, nil
+}
+
 // combineDeltas combines two deltas into a single delta.
 // Assumes that the order of operations is add(1), remove(1), add(2), remove(2).
 // Removes duplicate entries and redundant operations from each delta.
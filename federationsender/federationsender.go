@@ -15,14 +15,17 @@
 package federationsender
 
 import (
+	"io"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/federationsender/consumers"
 	"github.com/matrix-org/dendrite/federationsender/query"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/roomserver/acls"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
@@ -35,30 +38,61 @@ func SetupFederationSenderComponent(
 	federation *gomatrixserverlib.FederationClient,
 	rsQueryAPI roomserverAPI.RoomserverQueryAPI,
 ) api.FederationSenderQueryAPI {
-	federationSenderDB, err := storage.NewDatabase(string(base.Cfg.Database.FederationSender))
+	federationSenderDB, err := storage.NewDatabase(string(base.Cfg.Database.FederationSender), base.Cfg.DbProperties(config.DatabaseFederationSender))
 	if err != nil {
 		logrus.WithError(err).Panic("failed to connect to federation sender db")
 	}
+	if c, ok := federationSenderDB.(io.Closer); ok {
+		base.CloseOnShutdown("federation sender db", c)
+	}
+	base.RegisterDatabaseHealthCheck("federation sender db", federationSenderDB)
+
+	queues := queue.NewOutgoingQueues(base.Cfg.Matrix.ServerName, federation, federationSenderDB, base.Cfg.IsFederationAllowed)
+	base.RegisterShutdownHook("federation sender queues", queues.Drain)
 
-	queues := queue.NewOutgoingQueues(base.Cfg.Matrix.ServerName, federation)
+	// The server ACLs of rooms are shared by the consumers, and kept up to
+	// date by the room server consumer.
+	serverACLs := acls.NewServerACLs()
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
 		base.Cfg, base.KafkaConsumer, queues,
-		federationSenderDB, rsQueryAPI,
+		federationSenderDB, rsQueryAPI, serverACLs,
 	)
 	if err = rsConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start room server consumer")
 	}
 
 	tsConsumer := consumers.NewOutputTypingEventConsumer(
-		base.Cfg, base.KafkaConsumer, queues, federationSenderDB,
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB, rsQueryAPI, serverACLs,
 	)
 	if err := tsConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start typing server consumer")
 	}
 
+	receiptConsumer := consumers.NewOutputReceiptEventConsumer(
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB, rsQueryAPI, serverACLs,
+	)
+	if err := receiptConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start receipt consumer")
+	}
+
+	presenceConsumer := consumers.NewOutputPresenceEventConsumer(
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB, rsQueryAPI,
+	)
+	if err := presenceConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start presence consumer")
+	}
+
+	sendToDeviceConsumer := consumers.NewOutputSendToDeviceEventConsumer(
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB,
+	)
+	if err := sendToDeviceConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start send-to-device consumer")
+	}
+
 	queryAPI := query.FederationSenderQueryAPI{
-		DB: federationSenderDB,
+		DB:     federationSenderDB,
+		Queues: queues,
 	}
 	queryAPI.SetupHTTP(http.DefaultServeMux)
 
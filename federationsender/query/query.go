@@ -7,6 +7,7 @@ import (
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -21,7 +22,8 @@ type FederationSenderQueryDatabase interface {
 
 // FederationSenderQueryAPI is an implementation of api.FederationSenderQueryAPI
 type FederationSenderQueryAPI struct {
-	DB FederationSenderQueryDatabase
+	DB     FederationSenderQueryDatabase
+	Queues *queue.OutgoingQueues
 }
 
 // QueryJoinedHostsInRoom implements api.FederationSenderQueryAPI
@@ -55,6 +57,26 @@ func (f *FederationSenderQueryAPI) QueryJoinedHostServerNamesInRoom(
 	return
 }
 
+// QueryDestinationStatuses implements api.FederationSenderQueryAPI
+func (f *FederationSenderQueryAPI) QueryDestinationStatuses(
+	ctx context.Context,
+	request *api.QueryDestinationStatusesRequest,
+	response *api.QueryDestinationStatusesResponse,
+) error {
+	response.Destinations = f.Queues.DestinationStatuses()
+	return nil
+}
+
+// ResetDestinationBackoff implements api.FederationSenderQueryAPI
+func (f *FederationSenderQueryAPI) ResetDestinationBackoff(
+	ctx context.Context,
+	request *api.ResetDestinationBackoffRequest,
+	response *api.ResetDestinationBackoffResponse,
+) error {
+	response.Known = f.Queues.ResetBackoff(request.ServerName)
+	return nil
+}
+
 // SetupHTTP adds the FederationSenderQueryAPI handlers to the http.ServeMux.
 func (f *FederationSenderQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 	servMux.Handle(
@@ -85,4 +107,32 @@ func (f *FederationSenderQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.FederationSenderQueryDestinationStatusesPath,
+		common.MakeInternalAPI("QueryDestinationStatuses", func(req *http.Request) util.JSONResponse {
+			var request api.QueryDestinationStatusesRequest
+			var response api.QueryDestinationStatusesResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := f.QueryDestinationStatuses(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.FederationSenderResetDestinationBackoffPath,
+		common.MakeInternalAPI("ResetDestinationBackoff", func(req *http.Request) util.JSONResponse {
+			var request api.ResetDestinationBackoffRequest
+			var response api.ResetDestinationBackoffResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := f.ResetDestinationBackoff(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
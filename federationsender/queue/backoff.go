@@ -0,0 +1,152 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	// How long to wait after the first failure to send to a destination.
+	// The wait doubles with each consecutive failure.
+	minBackoff = time.Second
+	// The longest we will wait between attempts to send to a destination,
+	// and how long a blacklisted destination is left alone for.
+	maxBackoff = time.Hour
+	// How many consecutive failures it takes to blacklist a destination.
+	// Each failure is only counted once the request has timed out, so slow
+	// destinations with long federation timeouts aren't treated as dead any
+	// sooner than fast ones.
+	blacklistThreshold = 16
+	// How out of date the stored time of the last success to a destination
+	// may be, so that we don't write to the database after every transaction.
+	lastSuccessPrecision = time.Minute
+)
+
+// backoff tracks consecutive failures to send to a destination.
+type backoff struct {
+	mutex    sync.Mutex
+	failures uint32
+	// Nothing is sent to the destination until this time.
+	retryAt time.Time
+	// While blacklisted, nothing is sent to the destination until this time.
+	blacklistedUntil time.Time
+	// When a request to the destination last succeeded.
+	lastSuccess time.Time
+}
+
+// success resets the backoff after a request to the destination succeeded. It
+// returns whether the state changed enough to be worth storing, which is when
+// the destination was backed off from or it has been a while since the last
+// success, so the time of the last success is only accurate to within
+// lastSuccessPrecision.
+func (b *backoff) success() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	changed := b.failures > 0 || !b.retryAt.IsZero() || now.Sub(b.lastSuccess) >= lastSuccessPrecision
+	b.failures = 0
+	b.retryAt = time.Time{}
+	b.blacklistedUntil = time.Time{}
+	if changed {
+		b.lastSuccess = now
+	}
+	return changed
+}
+
+// failure records a failed request to the destination. It returns how long
+// to wait before trying again, and whether the destination is now
+// blacklisted.
+func (b *backoff) failure() (time.Duration, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.failures < blacklistThreshold {
+		b.failures++
+	}
+	if b.failures >= blacklistThreshold {
+		b.blacklistedUntil = time.Now().Add(maxBackoff)
+		b.retryAt = b.blacklistedUntil
+		return maxBackoff, true
+	}
+	duration := minBackoff << (b.failures - 1)
+	if duration > maxBackoff {
+		duration = maxBackoff
+	}
+	b.retryAt = time.Now().Add(duration)
+	return duration, false
+}
+
+// reset forgets the failures so that the destination is tried again straight
+// away.
+func (b *backoff) reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+	b.retryAt = time.Time{}
+	b.blacklistedUntil = time.Time{}
+}
+
+// blacklisted returns whether the destination is currently blacklisted.
+func (b *backoff) blacklisted() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return time.Now().Before(b.blacklistedUntil)
+}
+
+// untilRetry returns how long is left to wait before trying the destination
+// again.
+func (b *backoff) untilRetry() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return time.Until(b.retryAt)
+}
+
+// status returns the backoff state in the form that it is stored in.
+func (b *backoff) status(destination gomatrixserverlib.ServerName) types.DestinationStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	status := types.DestinationStatus{
+		ServerName:          destination,
+		ConsecutiveFailures: b.failures,
+		Blacklisted:         time.Now().Before(b.blacklistedUntil),
+	}
+	if !b.lastSuccess.IsZero() {
+		status.LastSuccessTS = gomatrixserverlib.AsTimestamp(b.lastSuccess)
+	}
+	if time.Now().Before(b.retryAt) {
+		status.RetryTS = gomatrixserverlib.AsTimestamp(b.retryAt)
+	}
+	return status
+}
+
+// restore sets the backoff state to one which was stored before.
+func (b *backoff) restore(status types.DestinationStatus) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = status.ConsecutiveFailures
+	if status.LastSuccessTS != 0 {
+		b.lastSuccess = status.LastSuccessTS.Time()
+	}
+	if status.RetryTS != 0 {
+		b.retryAt = status.RetryTS.Time()
+		if status.Blacklisted {
+			b.blacklistedUntil = b.retryAt
+		}
+	}
+}
@@ -21,12 +21,27 @@ import (
 	"sync"
 	"time"
 
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"go.uber.org/atomic"
 )
 
+const (
+	// The most PDUs and EDUs that are allowed in one transaction.
+	// https://matrix.org/docs/spec/server_server/r0.1.4#transactions
+	maxPDUsPerTransaction = 50
+	maxEDUsPerTransaction = 100
+	// How long the queue waits after it is woken up before sending, so that
+	// the events queued in quick succession, such as the EDUs for a room
+	// which spans many servers, are sent in one transaction. Sending fewer
+	// transactions matters most over I2P, where each request is costly.
+	transactionFlushWindow = 50 * time.Millisecond
+)
+
 // destinationQueue is a queue of events for a single destination.
 // It is responsible for sending the events to the destination and
 // ensures that only one request is in flight to a given destination
@@ -36,26 +51,43 @@ type destinationQueue struct {
 	origin      gomatrixserverlib.ServerName
 	destination gomatrixserverlib.ServerName
 	running     atomic.Bool
-	// The running mutex protects sentCounter, lastTransactionIDs and
-	// pendingEvents, pendingEDUs.
+	backoff     backoff
+	// Where the backoff state is stored, or nil if it isn't.
+	db BackoffDatabase
+	// Wakes the queue up if it is waiting to retry the destination.
+	retryNow chan struct{}
+	// Makes sure the server software of the destination is only looked up
+	// once.
+	versionOnce sync.Once
+	// How long to wait for more events before sending a transaction.
+	flushWindow time.Duration
+	// Whether the queues are being drained for a shutdown, and the worker
+	// goroutines that are waited on then. Both are nil if the queue isn't
+	// part of an OutgoingQueues.
+	draining *atomic.Bool
+	workers  *sync.WaitGroup
+	// The running mutex protects sentCounter, lastTransactionIDs,
+	// retryTransaction and pendingEvents, pendingEDUs, pendingInvites.
 	runningMutex       sync.Mutex
 	sentCounter        int
 	lastTransactionIDs []gomatrixserverlib.TransactionID
-	pendingEvents      []*gomatrixserverlib.HeaderedEvent
-	pendingEDUs        []*gomatrixserverlib.EDU
-	pendingInvites     []*gomatrixserverlib.InviteV2Request
+	// A transaction that failed to send and must be retried, with the same
+	// transaction ID, before any new transaction is sent.
+	retryTransaction *gomatrixserverlib.Transaction
+	pendingEvents    []*gomatrixserverlib.HeaderedEvent
+	pendingEDUs      []*gomatrixserverlib.EDU
+	pendingInvites   []*gomatrixserverlib.InviteV2Request
 }
 
 // Send event adds the event to the pending queue for the destination.
 // If the queue is empty then it starts a background goroutine to
-// start sending events to that destination.
+// start sending events to that destination. Events for a blacklisted
+// destination are kept until it is tried again.
 func (oq *destinationQueue) sendEvent(ev *gomatrixserverlib.HeaderedEvent) {
 	oq.runningMutex.Lock()
 	defer oq.runningMutex.Unlock()
 	oq.pendingEvents = append(oq.pendingEvents, ev)
-	if !oq.running.Load() {
-		go oq.backgroundSend()
-	}
+	oq.startSending()
 }
 
 // sendEDU adds the EDU event to the pending queue for the destination.
@@ -65,9 +97,7 @@ func (oq *destinationQueue) sendEDU(e *gomatrixserverlib.EDU) {
 	oq.runningMutex.Lock()
 	defer oq.runningMutex.Unlock()
 	oq.pendingEDUs = append(oq.pendingEDUs, e)
-	if !oq.running.Load() {
-		go oq.backgroundSend()
-	}
+	oq.startSending()
 }
 
 // sendInvite adds the invite event to the pending queue for the
@@ -77,38 +107,233 @@ func (oq *destinationQueue) sendInvite(ev *gomatrixserverlib.InviteV2Request) {
 	oq.runningMutex.Lock()
 	defer oq.runningMutex.Unlock()
 	oq.pendingInvites = append(oq.pendingInvites, ev)
-	if !oq.running.Load() {
+	oq.startSending()
+}
+
+// startSending starts the worker goroutine for the destination if it isn't
+// running already. No new worker is started once the queues are being
+// drained. The running mutex must be held.
+func (oq *destinationQueue) startSending() {
+	if oq.isDraining() {
+		return
+	}
+	if oq.running.CAS(false, true) {
+		if oq.workers != nil {
+			oq.workers.Add(1)
+		}
 		go oq.backgroundSend()
 	}
 }
 
-// backgroundSend is the worker goroutine for sending events.
+// isDraining returns whether the queues are being drained for a shutdown.
+func (oq *destinationQueue) isDraining() bool {
+	return oq.draining != nil && oq.draining.Load()
+}
+
+// backgroundSend is the worker goroutine for sending events. Only one runs
+// for a destination at a time, so transactions are sent in the order that
+// their events were queued in.
 func (oq *destinationQueue) backgroundSend() {
-	oq.running.Store(true)
 	defer oq.running.Store(false)
+	if oq.workers != nil {
+		defer oq.workers.Done()
+	}
+	oq.versionOnce.Do(func() { go oq.logPeerVersion() })
+	time.Sleep(oq.flushWindow)
 
 	for {
-		transaction, invites := oq.nextTransaction(), oq.nextInvites()
+		oq.waitForRetry()
+		if oq.isDraining() && oq.backoff.untilRetry() > 0 {
+			// The destination is still being backed off from, so the pending
+			// events are left unsent rather than holding up the shutdown.
+			return
+		}
+		transaction, err := oq.nextTransaction()
+		invites, delivered, inviteErr := oq.nextInvites()
 		if !transaction && !invites {
 			// If the queue is empty then stop processing for this destination.
 			// TODO: Remove this destination from the queue map.
 			return
 		}
+		if err == nil {
+			err = inviteErr
+		}
+		if err == nil {
+			// Invites which the destination refused don't show that it is
+			// reachable, so only a request which succeeded resets the backoff.
+			if transaction || delivered {
+				oq.recordSuccess()
+			}
+			continue
+		}
 
-		// TODO: handle retries.
-		// TODO: blacklist uncooperative servers.
+		duration, blacklisted := oq.recordFailure()
+		if blacklisted {
+			// Everything queued for the destination is kept, and sent once it
+			// is tried again after the blacklist runs out or is reset.
+			log.WithFields(log.Fields{
+				"destination": oq.destination,
+				"duration":    duration,
+			}).Warn("Blacklisting destination after repeated failures")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"destination": oq.destination,
+			"duration":    duration,
+		}).Info("Backing off destination")
+	}
+}
+
+// waitForRetry waits until it is time to try the destination again, which may
+// be cut short by the backoff being reset.
+func (oq *destinationQueue) waitForRetry() {
+	duration := oq.backoff.untilRetry()
+	if duration <= 0 {
+		return
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-oq.retryNow:
 	}
 }
 
-// nextTransaction creates a new transaction from the pending event
-// queue and sends it. Returns true if a transaction was sent or
-// false otherwise.
-func (oq *destinationQueue) nextTransaction() bool {
+// recordSuccess resets the backoff after sending to the destination and
+// stores it if it changed.
+func (oq *destinationQueue) recordSuccess() {
+	if oq.backoff.success() {
+		oq.storeBackoff()
+	}
+}
+
+// recordFailure backs off from the destination after failing to send to it
+// and stores the backoff. It returns how long until the destination is tried
+// again and whether it is now blacklisted.
+func (oq *destinationQueue) recordFailure() (time.Duration, bool) {
+	duration, blacklisted := oq.backoff.failure()
+	oq.storeBackoff()
+	return duration, blacklisted
+}
+
+// resetBackoff makes the queue try the destination again straight away.
+func (oq *destinationQueue) resetBackoff() {
+	oq.backoff.reset()
+	oq.storeBackoff()
+	select {
+	case oq.retryNow <- struct{}{}:
+	default:
+	}
+}
+
+// storeBackoff stores the backoff state of the destination so that it is
+// kept across restarts. Failures to store it are only logged.
+func (oq *destinationQueue) storeBackoff() {
+	if oq.db == nil {
+		return
+	}
+	if err := oq.db.UpdateDestinationStatus(context.TODO(), oq.backoff.status(oq.destination)); err != nil {
+		log.WithField("destination", oq.destination).WithError(err).Error("Failed to store the backoff of destination")
+	}
+}
+
+// logPeerVersion logs the server software that the destination runs, which
+// helps to tell which implementation is at fault when federation breaks.
+func (oq *destinationQueue) logPeerVersion() {
+	version, err := common.GetServerVersion(context.TODO(), oq.client, oq.destination)
+	logger := log.WithField("destination", oq.destination)
+	switch {
+	case err != nil:
+		logger.WithError(err).Debug("Failed to get the server version of destination")
+	case version == nil:
+		logger.Info("Destination does not report its server version")
+	default:
+		logger.WithFields(log.Fields{
+			"server_name":    version.Server.Name,
+			"server_version": version.Server.Version,
+		}).Info("Federating with destination")
+	}
+}
+
+// nextTransaction sends the transaction that previously failed, if there is
+// one, or else creates a new transaction from the pending event queue and
+// sends it. Returns true if a transaction was sent or false otherwise, and
+// an error if it could not be sent. A transaction which could not be sent is
+// kept to be retried.
+func (oq *destinationQueue) nextTransaction() (bool, error) {
 	oq.runningMutex.Lock()
-	defer oq.runningMutex.Unlock()
+	t := oq.retryTransaction
+	oq.retryTransaction = nil
+	if t == nil {
+		t = oq.newTransaction()
+	}
+	oq.runningMutex.Unlock()
+
+	if t == nil {
+		return false, nil
+	}
+
+	util.GetLogger(context.TODO()).Infof("Sending transaction %q containing %d PDUs, %d EDUs", t.TransactionID, len(t.PDUs), len(t.EDUs))
+
+	// The federation client applies the timeout for the destination, so we
+	// don't give up on slow destinations early here.
+	start := time.Now()
+	_, err := oq.client.SendTransaction(context.TODO(), *t)
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	transactionDurations.WithLabelValues(string(oq.destination), outcome).Observe(time.Since(start).Seconds())
+	transactionsSent.WithLabelValues(string(oq.destination), outcome).Inc()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"destination": oq.destination,
+			log.ErrorKey:  err,
+		}).Info("problem sending transaction")
+
+		oq.runningMutex.Lock()
+		oq.retryTransaction = t
+		oq.runningMutex.Unlock()
+	}
+
+	return true, err
+}
 
+// transactionDurations and transactionsSent are per destination, so that the
+// destinations which are slow to answer, as I2P peers often are, stand out.
+var transactionDurations = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "transaction_duration_seconds",
+		Help:      "How long it takes to send a transaction to a destination",
+		// Transactions over I2P can take tens of seconds.
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80},
+	},
+	[]string{"destination", "outcome"},
+)
+
+var transactionsSent = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "transactions_total",
+		Help:      "The number of transactions sent to a destination",
+	},
+	[]string{"destination", "outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(transactionDurations, transactionsSent)
+}
+
+// newTransaction creates a new transaction from the pending event queue, or
+// returns nil if the queue is empty. The transaction has as many of the
+// oldest pending events as fit in it, and the rest are left for the next
+// one. The running mutex must be held.
+func (oq *destinationQueue) newTransaction() *gomatrixserverlib.Transaction {
 	if len(oq.pendingEvents) == 0 && len(oq.pendingEDUs) == 0 {
-		return false
+		return nil
 	}
 
 	t := gomatrixserverlib.Transaction{
@@ -127,60 +352,77 @@ func (oq *destinationQueue) nextTransaction() bool {
 
 	oq.lastTransactionIDs = []gomatrixserverlib.TransactionID{t.TransactionID}
 
-	for _, pdu := range oq.pendingEvents {
+	pdus := oq.pendingEvents
+	if len(pdus) > maxPDUsPerTransaction {
+		pdus = pdus[:maxPDUsPerTransaction]
+	}
+	for _, pdu := range pdus {
 		// Append the JSON of the event, since this is a json.RawMessage type in the
 		// gomatrixserverlib.Transaction struct
 		t.PDUs = append(t.PDUs, (*pdu).JSON())
 	}
-	oq.pendingEvents = nil
+	oq.pendingEvents = oq.pendingEvents[len(pdus):]
 	oq.sentCounter += len(t.PDUs)
 
-	for _, edu := range oq.pendingEDUs {
+	edus := oq.pendingEDUs
+	if len(edus) > maxEDUsPerTransaction {
+		edus = edus[:maxEDUsPerTransaction]
+	}
+	for _, edu := range edus {
 		t.EDUs = append(t.EDUs, *edu)
 	}
-	oq.pendingEDUs = nil
+	oq.pendingEDUs = oq.pendingEDUs[len(edus):]
 	oq.sentCounter += len(t.EDUs)
 
-	util.GetLogger(context.TODO()).Infof("Sending transaction %q containing %d PDUs, %d EDUs", t.TransactionID, len(t.PDUs), len(t.EDUs))
-
-	_, err := oq.client.SendTransaction(context.TODO(), t)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"destination": oq.destination,
-			log.ErrorKey:  err,
-		}).Info("problem sending transaction")
-	}
-
-	return true
+	return &t
 }
 
-// nextInvite takes pending invite events from the queue and sends
-// them. Returns true if a transaction was sent or false otherwise.
-func (oq *destinationQueue) nextInvites() bool {
+// nextInvites takes the pending invite events from the queue and sends them.
+// It returns whether there were any invites to send, whether any of them
+// were delivered, and an error if any could not be sent. Invites which the
+// destination refused are dropped, as sending them again won't help, but
+// those which could not be sent are kept to be retried.
+func (oq *destinationQueue) nextInvites() (bool, bool, error) {
 	oq.runningMutex.Lock()
-	defer oq.runningMutex.Unlock()
+	invites := oq.pendingInvites
+	oq.pendingInvites = nil
+	oq.runningMutex.Unlock()
 
-	if len(oq.pendingInvites) == 0 {
-		return false
+	if len(invites) == 0 {
+		return false, false, nil
 	}
 
-	for _, inviteReq := range oq.pendingInvites {
+	var delivered bool
+	var retry []*gomatrixserverlib.InviteV2Request
+	var err error
+	for _, inviteReq := range invites {
 		ev := inviteReq.Event()
 
-		if _, err := oq.client.SendInviteV2(
+		_, sendErr := oq.client.SendInviteV2(
 			context.TODO(),
 			oq.destination,
 			*inviteReq,
-		); err != nil {
-			log.WithFields(log.Fields{
-				"event_id":    ev.EventID(),
-				"state_key":   ev.StateKey(),
-				"destination": oq.destination,
-			}).WithError(err).Error("failed to send invite")
+		)
+		if sendErr == nil {
+			delivered = true
+			continue
+		}
+		log.WithFields(log.Fields{
+			"event_id":    ev.EventID(),
+			"state_key":   ev.StateKey(),
+			"destination": oq.destination,
+		}).WithError(sendErr).Error("failed to send invite")
+		if _, refused := sendErr.(gomatrix.HTTPError); !refused {
+			retry = append(retry, inviteReq)
+			err = sendErr
 		}
 	}
 
-	oq.pendingInvites = nil
+	if len(retry) > 0 {
+		oq.runningMutex.Lock()
+		oq.pendingInvites = append(retry, oq.pendingInvites...)
+		oq.runningMutex.Unlock()
+	}
 
-	return true
+	return true, delivered, err
 }
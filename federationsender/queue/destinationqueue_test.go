@@ -0,0 +1,502 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// slowPeer answers every federation request after a delay, unless the
+// request's context is done first.
+type slowPeer struct {
+	delay time.Duration
+}
+
+func (p *slowPeer) RoundTrip(r *http.Request) (*http.Response, error) {
+	select {
+	case <-time.After(p.delay):
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"pdus":{}}`)),
+		Request:    r,
+	}, nil
+}
+
+func newTestQueue(t *testing.T, destination gomatrixserverlib.ServerName) *destinationQueue {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeouts := &config.FederationTimeouts{
+		Default: 20 * time.Millisecond,
+		Overrides: []config.FederationTimeoutOverride{
+			{Suffix: ".i2p", Timeout: time.Second},
+		},
+	}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", common.WrapTripperInFederationTimeouts(
+		&slowPeer{delay: 100 * time.Millisecond}, timeouts,
+	))
+	client := gomatrixserverlib.NewFederationClientWithTransport(
+		"localhost", "ed25519:test", privateKey, tr,
+	)
+	client.Client = *gomatrixserverlib.NewClientWithTimeout(0, tr)
+	return &destinationQueue{
+		origin:      "localhost",
+		destination: destination,
+		client:      client,
+		pendingEDUs: []*gomatrixserverlib.EDU{{
+			Type:    "m.typing",
+			Content: gomatrixserverlib.RawJSON(`{}`),
+		}},
+	}
+}
+
+func TestSlowI2PDestinationIsNotBlacklisted(t *testing.T) {
+	oq := newTestQueue(t, "example.b32.i2p")
+	sent, err := oq.nextTransaction()
+	if !sent || err != nil {
+		t.Fatalf("expected the transaction to be sent, got sent=%v err=%v", sent, err)
+	}
+	if oq.retryTransaction != nil {
+		t.Fatalf("expected the transaction not to be kept for retrying")
+	}
+}
+
+func TestSlowClearnetDestinationTimesOut(t *testing.T) {
+	oq := newTestQueue(t, "example.org")
+	sent, err := oq.nextTransaction()
+	if !sent || err == nil {
+		t.Fatalf("expected the transaction to time out, got sent=%v err=%v", sent, err)
+	}
+	if oq.retryTransaction == nil || len(oq.retryTransaction.EDUs) != 1 {
+		t.Fatalf("expected the transaction to be kept for retrying")
+	}
+}
+
+func TestBackoffBlacklistsAfterThreshold(t *testing.T) {
+	var b backoff
+	for i := 1; i < blacklistThreshold; i++ {
+		if _, blacklisted := b.failure(); blacklisted {
+			t.Fatalf("blacklisted after only %d failures", i)
+		}
+	}
+	if duration, blacklisted := b.failure(); !blacklisted || duration != maxBackoff {
+		t.Fatalf("expected to be blacklisted for %s, got blacklisted=%v for %s", maxBackoff, blacklisted, duration)
+	}
+	if !b.blacklisted() {
+		t.Fatalf("expected the destination to be blacklisted")
+	}
+	b.success()
+	if b.blacklisted() {
+		t.Fatalf("expected a success to clear the blacklist")
+	}
+}
+
+// refusingPeer refuses every federation request.
+type refusingPeer struct{}
+
+func (refusingPeer) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_FORBIDDEN"}`)),
+		Request:    r,
+	}, nil
+}
+
+func TestRefusedInvitesDoNotResetTheBackoff(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", refusingPeer{})
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"event_id":"$1:localhost","room_id":"!room:localhost","sender":"@alice:localhost",
+		"type":"m.room.member","state_key":"@bob:example.com","content":{"membership":"invite"},"depth":1
+	}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headered := ev.Headered(gomatrixserverlib.RoomVersionV1)
+	invite, err := gomatrixserverlib.NewInviteV2Request(&headered, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oq := &destinationQueue{
+		client: gomatrixserverlib.NewFederationClientWithTransport(
+			"localhost", "ed25519:test", privateKey, tr,
+		),
+		origin:         "localhost",
+		destination:    "example.com",
+		retryNow:       make(chan struct{}, 1),
+		pendingInvites: []*gomatrixserverlib.InviteV2Request{&invite},
+	}
+	oq.backoff.failures = 3
+
+	oq.running.Store(true)
+	oq.backgroundSend()
+	if len(oq.pendingInvites) != 0 {
+		t.Errorf("expected the refused invite to be dropped, got %d pending", len(oq.pendingInvites))
+	}
+	if oq.backoff.failures != 3 {
+		t.Errorf("expected the refused invite to leave the backoff alone, got %d failures", oq.backoff.failures)
+	}
+}
+
+func TestEDUsAreKeptForBlacklistedDestinations(t *testing.T) {
+	oqs, recorder := newRecordedQueues(t)
+	oq := oqs.getQueue("example.com")
+	for i := 0; i < blacklistThreshold; i++ {
+		oq.recordFailure()
+	}
+	edu := &gomatrixserverlib.EDU{Type: "m.direct_to_device", Content: gomatrixserverlib.RawJSON(`{}`)}
+	if err := oqs.SendEDU(edu, "localhost", []gomatrixserverlib.ServerName{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	recorder.sentTransactions(t, 0)
+
+	// Once the destination is tried again, what was queued is sent.
+	oqs.ResetBackoff("example.com")
+	if txns := recorder.sentTransactions(t, 1); len(txns[0].EDUs) != 1 {
+		t.Errorf("expected the queued EDU to be sent, got %v", txns[0].EDUs)
+	}
+}
+
+// destinationStatus returns the status of the only destination of the queues.
+func destinationStatus(t *testing.T, oqs *OutgoingQueues) types.DestinationStatus {
+	statuses := oqs.DestinationStatuses()
+	if len(statuses) != 1 {
+		t.Fatalf("expected one destination, got %v", statuses)
+	}
+	return statuses[0]
+}
+
+func TestBackoffIsKeptAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "federationsender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	db, err := storage.NewDatabase("file:"+filepath.Join(dir, "federationsender.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oqs := NewOutgoingQueues("localhost", nil, db, nil)
+	oqs.getQueue("remote.example.com").recordFailure()
+	oqs.getQueue("remote.example.com").recordFailure()
+	status := destinationStatus(t, oqs)
+	if status.ConsecutiveFailures != 2 || status.RetryTS.Time().Before(time.Now()) || status.Blacklisted {
+		t.Fatalf("expected two failures and a retry in the future, got %+v", status)
+	}
+
+	// The backoff is loaded again after a restart.
+	oqs = NewOutgoingQueues("localhost", nil, db, nil)
+	if reloaded := destinationStatus(t, oqs); reloaded != status {
+		t.Fatalf("expected the backoff %+v to be reloaded, got %+v", status, reloaded)
+	}
+
+	oqs.getQueue("remote.example.com").recordSuccess()
+	status = destinationStatus(t, oqs)
+	if status.ConsecutiveFailures != 0 || status.RetryTS != 0 || status.LastSuccessTS == 0 {
+		t.Fatalf("expected a success to reset the backoff, got %+v", status)
+	}
+	oqs = NewOutgoingQueues("localhost", nil, db, nil)
+	if reloaded := destinationStatus(t, oqs); reloaded != status {
+		t.Fatalf("expected the reset backoff %+v to be reloaded, got %+v", status, reloaded)
+	}
+}
+
+func TestResetBackoff(t *testing.T) {
+	oqs := NewOutgoingQueues("localhost", nil, nil, nil)
+	if oqs.ResetBackoff("remote.example.com") {
+		t.Fatalf("expected a destination which was never sent to to be unknown")
+	}
+	oq := oqs.getQueue("remote.example.com")
+	for i := 0; i < blacklistThreshold; i++ {
+		oq.recordFailure()
+	}
+	if status := destinationStatus(t, oqs); !status.Blacklisted || status.ConsecutiveFailures != blacklistThreshold {
+		t.Fatalf("expected the destination to be blacklisted, got %+v", status)
+	}
+
+	if !oqs.ResetBackoff("remote.example.com") {
+		t.Fatalf("expected the destination to be known")
+	}
+	if status := destinationStatus(t, oqs); status.Blacklisted || status.ConsecutiveFailures != 0 || status.RetryTS != 0 {
+		t.Fatalf("expected the backoff to be reset, got %+v", status)
+	}
+	if oq.backoff.untilRetry() > 0 {
+		t.Fatalf("expected the destination to be retried straight away")
+	}
+}
+
+// transactionRecorder records the transactions sent to each destination.
+// Other requests are answered with a 404.
+type transactionRecorder struct {
+	transactions chan gomatrixserverlib.Transaction
+}
+
+func (r *transactionRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPut {
+		return &http.Response{
+			StatusCode: http.StatusNotFound,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			Request:    req,
+		}, nil
+	}
+	var txn gomatrixserverlib.Transaction
+	if err := json.NewDecoder(req.Body).Decode(&txn); err != nil {
+		return nil, err
+	}
+	txn.Destination = gomatrixserverlib.ServerName(req.URL.Host)
+	r.transactions <- txn
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"pdus":{}}`)),
+		Request:    req,
+	}, nil
+}
+
+func newRecordedQueues(t *testing.T) (*OutgoingQueues, *transactionRecorder) {
+	return newRecordedQueuesFor(t, nil)
+}
+
+// newRecordedQueuesFor is like newRecordedQueues, but only sends to the
+// destinations which isAllowed allows.
+func newRecordedQueuesFor(t *testing.T, isAllowed func(gomatrixserverlib.ServerName) bool) (*OutgoingQueues, *transactionRecorder) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &transactionRecorder{transactions: make(chan gomatrixserverlib.Transaction, 10)}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", recorder)
+	client := gomatrixserverlib.NewFederationClientWithTransport(
+		"localhost", "ed25519:test", privateKey, tr,
+	)
+	return NewOutgoingQueues("localhost", client, nil, isAllowed), recorder
+}
+
+// sentTransactions waits for the given number of transactions to be sent,
+// and checks that no more are.
+func (r *transactionRecorder) sentTransactions(t *testing.T, count int) []gomatrixserverlib.Transaction {
+	var txns []gomatrixserverlib.Transaction
+	for len(txns) < count {
+		select {
+		case txn := <-r.transactions:
+			txns = append(txns, txn)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for transaction %d", len(txns)+1)
+		}
+	}
+	select {
+	case txn := <-r.transactions:
+		t.Fatalf("expected %d transactions, got another with %d EDUs", count, len(txn.EDUs))
+	case <-time.After(2 * transactionFlushWindow):
+	}
+	return txns
+}
+
+func TestQueuedEDUsAreSentInOneTransaction(t *testing.T) {
+	oqs, recorder := newRecordedQueues(t)
+	destinations := []gomatrixserverlib.ServerName{"one.example.com", "two.example.com"}
+	for _, eduType := range []string{"m.typing", "m.direct_to_device", "m.receipt"} {
+		edu := &gomatrixserverlib.EDU{Type: eduType, Content: gomatrixserverlib.RawJSON(`{}`)}
+		if err := oqs.SendEDU(edu, "localhost", destinations); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[gomatrixserverlib.ServerName]bool)
+	for _, txn := range recorder.sentTransactions(t, 2) {
+		seen[txn.Destination] = true
+		if len(txn.EDUs) != 3 || txn.EDUs[0].Type != "m.typing" || txn.EDUs[2].Type != "m.receipt" {
+			t.Errorf("expected the three EDUs in order in one transaction to %s, got %v", txn.Destination, txn.EDUs)
+		}
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected a transaction for each destination, got %v", seen)
+	}
+}
+
+func TestTransactionsRespectTheEDULimit(t *testing.T) {
+	oqs, recorder := newRecordedQueues(t)
+	total := maxEDUsPerTransaction + 20
+	for i := 0; i < total; i++ {
+		edu := &gomatrixserverlib.EDU{
+			Type:    "m.direct_to_device",
+			Content: gomatrixserverlib.RawJSON(fmt.Sprintf(`{"message_id":"%d"}`, i)),
+		}
+		if err := oqs.SendEDU(edu, "localhost", []gomatrixserverlib.ServerName{"example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	txns := recorder.sentTransactions(t, 2)
+	if len(txns[0].EDUs) != maxEDUsPerTransaction || len(txns[1].EDUs) != total-maxEDUsPerTransaction {
+		t.Fatalf("expected %d and %d EDUs, got %d and %d", maxEDUsPerTransaction, total-maxEDUsPerTransaction, len(txns[0].EDUs), len(txns[1].EDUs))
+	}
+	// The to-device messages are sent in the order they were queued in.
+	i := 0
+	for _, txn := range txns {
+		for _, edu := range txn.EDUs {
+			if expected := fmt.Sprintf(`{"message_id":"%d"}`, i); string(edu.Content) != expected {
+				t.Fatalf("expected EDU %s, got %s", expected, edu.Content)
+			}
+			i++
+		}
+	}
+}
+
+func TestTransactionsRespectThePDULimit(t *testing.T) {
+	oq := &destinationQueue{origin: "localhost", destination: "example.com"}
+	for i := 0; i < maxPDUsPerTransaction+5; i++ {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(fmt.Sprintf(`{
+			"event_id":"$%d:localhost","room_id":"!room:localhost","sender":"@alice:localhost",
+			"type":"m.room.message","content":{},"depth":%d
+		}`, i, i)), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headered := ev.Headered(gomatrixserverlib.RoomVersionV1)
+		oq.pendingEvents = append(oq.pendingEvents, &headered)
+	}
+
+	if txn := oq.newTransaction(); txn == nil || len(txn.PDUs) != maxPDUsPerTransaction {
+		t.Fatalf("expected %d PDUs in the first transaction, got %v", maxPDUsPerTransaction, txn)
+	}
+	if txn := oq.newTransaction(); txn == nil || len(txn.PDUs) != 5 {
+		t.Fatalf("expected the other 5 PDUs in the second transaction, got %v", txn)
+	}
+	if txn := oq.newTransaction(); txn != nil {
+		t.Errorf("expected no more transactions, got %d PDUs", len(txn.PDUs))
+	}
+}
+
+func TestQueuesOnlySendToAllowedServers(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.FederationAllowlist = []gomatrixserverlib.ServerName{"friend.i2p", "foe.i2p"}
+	cfg.Matrix.FederationBlocklist = []gomatrixserverlib.ServerName{"foe.i2p"}
+	oqs, recorder := newRecordedQueuesFor(t, cfg.IsFederationAllowed)
+	destinations := []gomatrixserverlib.ServerName{"friend.i2p", "foe.i2p", "stranger.i2p"}
+	edu := &gomatrixserverlib.EDU{Type: "m.typing", Content: gomatrixserverlib.RawJSON(`{}`)}
+	if err := oqs.SendEDU(edu, "localhost", destinations); err != nil {
+		t.Fatal(err)
+	}
+	if txns := recorder.sentTransactions(t, 1); txns[0].Destination != "friend.i2p" {
+		t.Errorf("expected the only transaction to be sent to friend.i2p, got %s", txns[0].Destination)
+	}
+	// Nothing is queued for the others, so they aren't retried either.
+	for _, status := range oqs.DestinationStatuses() {
+		if status.ServerName != "friend.i2p" {
+			t.Errorf("expected no queue for %s", status.ServerName)
+		}
+	}
+}
+
+func TestQueuesSendNothingWithFederationDisabled(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.FederationDisabled = true
+	oqs, recorder := newRecordedQueuesFor(t, cfg.IsFederationAllowed)
+	edu := &gomatrixserverlib.EDU{Type: "m.typing", Content: gomatrixserverlib.RawJSON(`{}`)}
+	if err := oqs.SendEDU(edu, "localhost", []gomatrixserverlib.ServerName{"friend.i2p"}); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"event_id":"$1:localhost","room_id":"!room:localhost","sender":"@alice:localhost",
+		"type":"m.room.message","content":{},"depth":1
+	}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headered := ev.Headered(gomatrixserverlib.RoomVersionV1)
+	if err = oqs.SendEvent(&headered, "localhost", []gomatrixserverlib.ServerName{"friend.i2p"}); err != nil {
+		t.Fatal(err)
+	}
+	recorder.sentTransactions(t, 0)
+	if statuses := oqs.DestinationStatuses(); len(statuses) != 0 {
+		t.Errorf("expected nothing to be queued, got %v", statuses)
+	}
+}
+
+// transactionDurationCount returns the number of transaction durations
+// observed for a destination.
+func transactionDurationCount(t *testing.T, destination string) uint64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count uint64
+	for _, family := range families {
+		if family.GetName() != "dendrite_federationsender_transaction_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "destination" && label.GetValue() == destination {
+					count += metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return count
+}
+
+func TestSendingRecordsTransactionMetrics(t *testing.T) {
+	oqs, recorder := newRecordedQueues(t)
+	edu := &gomatrixserverlib.EDU{Type: "m.typing", Content: gomatrixserverlib.RawJSON(`{}`)}
+	if err := oqs.SendEDU(edu, "localhost", []gomatrixserverlib.ServerName{"metrics.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	recorder.sentTransactions(t, 1)
+
+	sent := transactionsSent.WithLabelValues("metrics.example.com", "success")
+	// The metrics are recorded once the response has been read, which may be
+	// just after the recorder got the transaction.
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(sent) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := testutil.ToFloat64(sent); count != 1 {
+		t.Errorf("expected one transaction to be counted, got %v", count)
+	}
+	if count := transactionDurationCount(t, "metrics.example.com"); count != 1 {
+		t.Errorf("expected the duration of one transaction to be observed, got %d", count)
+	}
+}
@@ -15,11 +15,15 @@
 package queue
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
 
+	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
 )
 
 // OutgoingQueues is a collection of queues for sending transactions to other
@@ -27,17 +31,130 @@ import (
 type OutgoingQueues struct {
 	origin gomatrixserverlib.ServerName
 	client *gomatrixserverlib.FederationClient
-	// The queuesMutex protects queues
+	db     BackoffDatabase
+	// Whether a destination may be sent to, or nil if all of them may be.
+	isAllowed func(gomatrixserverlib.ServerName) bool
+	// The queuesMutex protects queues, and is held while draining is set so
+	// that no worker is started once the workers are being waited on.
 	queuesMutex sync.Mutex
 	queues      map[gomatrixserverlib.ServerName]*destinationQueue
+	draining    atomic.Bool
+	workers     sync.WaitGroup
 }
 
-// NewOutgoingQueues makes a new OutgoingQueues
-func NewOutgoingQueues(origin gomatrixserverlib.ServerName, client *gomatrixserverlib.FederationClient) *OutgoingQueues {
-	return &OutgoingQueues{
-		origin: origin,
-		client: client,
-		queues: map[gomatrixserverlib.ServerName]*destinationQueue{},
+// BackoffDatabase has the APIs needed to keep the backoff state of
+// destinations across restarts.
+type BackoffDatabase interface {
+	UpdateDestinationStatus(ctx context.Context, status types.DestinationStatus) error
+	GetDestinationStatuses(ctx context.Context) ([]types.DestinationStatus, error)
+}
+
+// NewOutgoingQueues makes a new OutgoingQueues. The backoff state of the
+// destinations is loaded from and stored in the database, unless it is nil.
+// Nothing is sent to the destinations for which isAllowed returns false, if
+// it isn't nil.
+func NewOutgoingQueues(
+	origin gomatrixserverlib.ServerName, client *gomatrixserverlib.FederationClient,
+	db BackoffDatabase, isAllowed func(gomatrixserverlib.ServerName) bool,
+) *OutgoingQueues {
+	oqs := &OutgoingQueues{
+		origin:    origin,
+		client:    client,
+		db:        db,
+		isAllowed: isAllowed,
+		queues:    map[gomatrixserverlib.ServerName]*destinationQueue{},
+	}
+	if db == nil {
+		return oqs
+	}
+	statuses, err := db.GetDestinationStatuses(context.Background())
+	if err != nil {
+		log.WithError(err).Error("Failed to load the backoff of destinations")
+		return oqs
+	}
+	for _, status := range statuses {
+		oqs.getQueue(status.ServerName).backoff.restore(status)
+	}
+	return oqs
+}
+
+// getQueue returns the queue for a destination, making it if there isn't one
+// yet. The queuesMutex must be held by the caller, unless the OutgoingQueues
+// is still being made.
+func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *destinationQueue {
+	oq := oqs.queues[destination]
+	if oq == nil {
+		oq = &destinationQueue{
+			origin:      oqs.origin,
+			destination: destination,
+			client:      oqs.client,
+			db:          oqs.db,
+			retryNow:    make(chan struct{}, 1),
+			flushWindow: transactionFlushWindow,
+			draining:    &oqs.draining,
+			workers:     &oqs.workers,
+		}
+		oqs.queues[destination] = oq
+	}
+	return oq
+}
+
+// DestinationStatuses returns the backoff state of every destination that
+// has been sent to, ordered by server name.
+func (oqs *OutgoingQueues) DestinationStatuses() []types.DestinationStatus {
+	oqs.queuesMutex.Lock()
+	defer oqs.queuesMutex.Unlock()
+	statuses := make([]types.DestinationStatus, 0, len(oqs.queues))
+	for destination, oq := range oqs.queues {
+		statuses = append(statuses, oq.backoff.status(destination))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ServerName < statuses[j].ServerName
+	})
+	return statuses
+}
+
+// ResetBackoff forgets the failures to send to a destination so that it is
+// tried again straight away. It returns false if the destination has never
+// been sent to.
+func (oqs *OutgoingQueues) ResetBackoff(destination gomatrixserverlib.ServerName) bool {
+	oqs.queuesMutex.Lock()
+	oq := oqs.queues[destination]
+	oqs.queuesMutex.Unlock()
+	if oq == nil {
+		return false
+	}
+	oq.resetBackoff()
+	return true
+}
+
+// Drain waits for the transactions which are being sent to finish, so that
+// they aren't cut off by a shutdown. The queues keep sending what is pending
+// until a destination fails, but no queue is started once they are being
+// drained and destinations which are backed off from aren't retried. It
+// returns early with the error of ctx if ctx is done first.
+func (oqs *OutgoingQueues) Drain(ctx context.Context) error {
+	oqs.queuesMutex.Lock()
+	oqs.draining.Store(true)
+	for _, oq := range oqs.queues {
+		// Wake up the queues that are waiting to retry, so that they stop.
+		select {
+		case oq.retryNow <- struct{}{}:
+		default:
+		}
+	}
+	oqs.queuesMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		oqs.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -54,8 +171,9 @@ func (oqs *OutgoingQueues) SendEvent(
 		)
 	}
 
-	// Remove our own server from the list of destinations.
-	destinations = filterDestinations(oqs.origin, destinations)
+	// Remove our own server and the servers we don't federate with from the
+	// list of destinations.
+	destinations = oqs.filterDestinations(destinations)
 
 	log.WithFields(log.Fields{
 		"destinations": destinations, "event": ev.EventID(),
@@ -64,16 +182,7 @@ func (oqs *OutgoingQueues) SendEvent(
 	oqs.queuesMutex.Lock()
 	defer oqs.queuesMutex.Unlock()
 	for _, destination := range destinations {
-		oq := oqs.queues[destination]
-		if oq == nil {
-			oq = &destinationQueue{
-				origin:      oqs.origin,
-				destination: destination,
-				client:      oqs.client,
-			}
-			oqs.queues[destination] = oq
-		}
-
+		oq := oqs.getQueue(destination)
 		oq.sendEvent(ev)
 	}
 
@@ -102,22 +211,21 @@ func (oqs *OutgoingQueues) SendInvite(
 		return nil
 	}
 
+	if oqs.isAllowed != nil && !oqs.isAllowed(destination) {
+		log.WithFields(log.Fields{
+			"event_id":    ev.EventID(),
+			"destination": destination,
+		}).Info("not federating with the destination of the invite, dropping")
+		return nil
+	}
+
 	log.WithFields(log.Fields{
 		"event_id": ev.EventID(),
 	}).Info("Sending invite")
 
 	oqs.queuesMutex.Lock()
 	defer oqs.queuesMutex.Unlock()
-	oq := oqs.queues[destination]
-	if oq == nil {
-		oq = &destinationQueue{
-			origin:      oqs.origin,
-			destination: destination,
-			client:      oqs.client,
-		}
-		oqs.queues[destination] = oq
-	}
-
+	oq := oqs.getQueue(destination)
 	oq.sendInvite(inviteReq)
 
 	return nil
@@ -136,8 +244,9 @@ func (oqs *OutgoingQueues) SendEDU(
 		)
 	}
 
-	// Remove our own server from the list of destinations.
-	destinations = filterDestinations(oqs.origin, destinations)
+	// Remove our own server and the servers we don't federate with from the
+	// list of destinations.
+	destinations = oqs.filterDestinations(destinations)
 
 	if len(destinations) > 0 {
 		log.WithFields(log.Fields{
@@ -148,16 +257,7 @@ func (oqs *OutgoingQueues) SendEDU(
 	oqs.queuesMutex.Lock()
 	defer oqs.queuesMutex.Unlock()
 	for _, destination := range destinations {
-		oq := oqs.queues[destination]
-		if oq == nil {
-			oq = &destinationQueue{
-				origin:      oqs.origin,
-				destination: destination,
-				client:      oqs.client,
-			}
-			oqs.queues[destination] = oq
-		}
-
+		oq := oqs.getQueue(destination)
 		oq.sendEDU(e)
 	}
 
@@ -165,11 +265,12 @@ func (oqs *OutgoingQueues) SendEDU(
 }
 
 // filterDestinations removes our own server from the list of destinations.
-// Otherwise we could end up trying to talk to ourselves.
-func filterDestinations(origin gomatrixserverlib.ServerName, destinations []gomatrixserverlib.ServerName) []gomatrixserverlib.ServerName {
+// Otherwise we could end up trying to talk to ourselves. The servers which we
+// don't federate with are removed too.
+func (oqs *OutgoingQueues) filterDestinations(destinations []gomatrixserverlib.ServerName) []gomatrixserverlib.ServerName {
 	var result []gomatrixserverlib.ServerName
 	for _, destination := range destinations {
-		if destination == origin {
+		if destination == oqs.origin || (oqs.isAllowed != nil && !oqs.isAllowed(destination)) {
 			continue
 		}
 		result = append(result, destination)
@@ -25,4 +25,6 @@ type Database interface {
 	common.PartitionStorer
 	UpdateRoom(ctx context.Context, roomID, oldEventID, newEventID string, addHosts []types.JoinedHost, removeHosts []string) (joinedHosts []types.JoinedHost, err error)
 	GetJoinedHosts(ctx context.Context, roomID string) ([]types.JoinedHost, error)
+	UpdateDestinationStatus(ctx context.Context, status types.DestinationStatus) error
+	GetDestinationStatuses(ctx context.Context) ([]types.DestinationStatus, error)
 }
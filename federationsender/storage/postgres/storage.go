@@ -28,15 +28,21 @@ import (
 type Database struct {
 	joinedHostsStatements
 	roomStatements
+	destinationsStatements
 	common.PartitionOffsetStatements
 	db *sql.DB
 }
 
 // NewDatabase opens a new database
-func NewDatabase(dataSourceName string) (*Database, error) {
+func NewDatabase(dataSourceName string, dbProperties sqlutil.DbProperties) (*Database, error) {
 	var result Database
 	var err error
-	if result.db, err = sqlutil.Open("postgres", dataSourceName); err != nil {
+	if result.db, err = sqlutil.Open("postgres", dataSourceName, dbProperties); err != nil {
+		return nil, err
+	}
+	migrator := common.NewMigrator(result.db, "federationsender")
+	migrator.AddMigrations(common.BaselineMigration)
+	if err = migrator.Up(context.Background()); err != nil {
 		return nil, err
 	}
 	if err = result.prepare(); err != nil {
@@ -45,6 +51,16 @@ func NewDatabase(dataSourceName string) (*Database, error) {
 	return &result, nil
 }
 
+// Close closes the database connection.
+func (d *Database) Close() error {
+	return d.db.Close()
+}
+
+// Ping checks that the database can be reached.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
 func (d *Database) prepare() error {
 	var err error
 
@@ -56,6 +72,10 @@ func (d *Database) prepare() error {
 		return err
 	}
 
+	if err = d.destinationsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
 	return d.PartitionOffsetStatements.Prepare(d.db, "federationsender")
 }
 
@@ -121,3 +141,18 @@ func (d *Database) GetJoinedHosts(
 ) ([]types.JoinedHost, error) {
 	return d.selectJoinedHosts(ctx, roomID)
 }
+
+// UpdateDestinationStatus stores how sending to a destination is going.
+func (d *Database) UpdateDestinationStatus(
+	ctx context.Context, status types.DestinationStatus,
+) error {
+	return d.upsertDestination(ctx, nil, status)
+}
+
+// GetDestinationStatuses returns how sending to each of the destinations that
+// we have sent to before is going.
+func (d *Database) GetDestinationStatuses(
+	ctx context.Context,
+) ([]types.DestinationStatus, error) {
+	return d.selectDestinations(ctx)
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/types"
+)
+
+const destinationsSchema = `
+-- Stores how sending to each destination server is going, so that we keep
+-- backing off from destinations which are down after a restart.
+CREATE TABLE IF NOT EXISTS federationsender_destinations (
+    -- The server name of the destination.
+    server_name TEXT PRIMARY KEY,
+    -- When a transaction was last sent to the destination in milliseconds.
+    last_success_ts INTEGER NOT NULL DEFAULT 0,
+    -- How many times in a row sending to the destination has failed.
+    consecutive_failures INTEGER NOT NULL DEFAULT 0,
+    -- When we will next try to send to the destination in milliseconds.
+    retry_ts INTEGER NOT NULL DEFAULT 0,
+    -- Whether the destination is blacklisted until the retry time.
+    blacklisted BOOLEAN NOT NULL DEFAULT FALSE
+);
+`
+
+const upsertDestinationSQL = "" +
+	"INSERT INTO federationsender_destinations" +
+	" (server_name, last_success_ts, consecutive_failures, retry_ts, blacklisted)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (server_name) DO UPDATE SET" +
+	" last_success_ts = $2, consecutive_failures = $3, retry_ts = $4, blacklisted = $5"
+
+const selectDestinationsSQL = "" +
+	"SELECT server_name, last_success_ts, consecutive_failures, retry_ts, blacklisted" +
+	" FROM federationsender_destinations"
+
+type destinationsStatements struct {
+	upsertDestinationStmt  *sql.Stmt
+	selectDestinationsStmt *sql.Stmt
+}
+
+func (s *destinationsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(destinationsSchema)
+	if err != nil {
+		return
+	}
+
+	if s.upsertDestinationStmt, err = db.Prepare(upsertDestinationSQL); err != nil {
+		return
+	}
+	if s.selectDestinationsStmt, err = db.Prepare(selectDestinationsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *destinationsStatements) upsertDestination(
+	ctx context.Context, txn *sql.Tx, status types.DestinationStatus,
+) error {
+	_, err := common.TxStmt(txn, s.upsertDestinationStmt).ExecContext(
+		ctx, status.ServerName, status.LastSuccessTS, status.ConsecutiveFailures,
+		status.RetryTS, status.Blacklisted,
+	)
+	return err
+}
+
+func (s *destinationsStatements) selectDestinations(
+	ctx context.Context,
+) ([]types.DestinationStatus, error) {
+	rows, err := s.selectDestinationsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectDestinations: rows.close() failed")
+
+	var statuses []types.DestinationStatus
+	for rows.Next() {
+		var status types.DestinationStatus
+		if err = rows.Scan(
+			&status.ServerName, &status.LastSuccessTS, &status.ConsecutiveFailures,
+			&status.RetryTS, &status.Blacklisted,
+		); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, rows.Err()
+}
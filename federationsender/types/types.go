@@ -28,6 +28,22 @@ type JoinedHost struct {
 	ServerName gomatrixserverlib.ServerName
 }
 
+// DestinationStatus is how sending to a destination server is going.
+type DestinationStatus struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	// When a transaction was last sent to the destination, or 0 if one never
+	// has been.
+	LastSuccessTS gomatrixserverlib.Timestamp `json:"last_success_ts"`
+	// How many times in a row sending to the destination has failed.
+	ConsecutiveFailures uint32 `json:"consecutive_failures"`
+	// When we will next try to send to the destination, or 0 if we aren't
+	// backing off.
+	RetryTS gomatrixserverlib.Timestamp `json:"retry_ts"`
+	// Whether the destination is blacklisted, in which case nothing is queued
+	// for it until the retry time.
+	Blacklisted bool `json:"blacklisted"`
+}
+
 // A EventIDMismatchError indicates that we have got out of sync with the
 // room server.
 type EventIDMismatchError struct {
@@ -20,7 +20,9 @@ import (
 	"database/sql/driver"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -73,15 +75,73 @@ func (in *traceInterceptor) RowsNext(c context.Context, rows driver.Rows, dest [
 	return err
 }
 
+// DbProperties are the settings of the connection pool of a database, and of
+// the connections to an SQLite database.
+type DbProperties interface {
+	MaxOpenConns() int
+	MaxIdleConns() int
+	ConnMaxLifetime() time.Duration
+	SQLiteJournalMode() string
+	SQLiteBusyTimeout() time.Duration
+}
+
 // Open opens a database specified by its database driver name and a driver-specific data source name,
 // usually consisting of at least a database name and connection information. Includes tracing driver
 // if DENDRITE_TRACE_SQL=1
-func Open(driverName, dsn string) (*sql.DB, error) {
+// The connection pool of a postgres database is set up with dbProperties, if
+// they aren't nil. The pools of other databases are left as they are, but
+// every connection to an SQLite database is set up with the journal mode and
+// busy timeout in dbProperties and with foreign keys enforced.
+func Open(driverName, dsn string, dbProperties DbProperties) (*sql.DB, error) {
+	isPostgres := driverName == "postgres"
+	if driverName == "sqlite3" && dbProperties != nil {
+		dsn = sqliteDSN(dsn, dbProperties)
+	}
 	if tracingEnabled {
 		// install the wrapped driver
 		driverName += "-trace"
 	}
-	return sql.Open(driverName, dsn)
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if isPostgres && dbProperties != nil {
+		db.SetMaxOpenConns(dbProperties.MaxOpenConns())
+		db.SetMaxIdleConns(dbProperties.MaxIdleConns())
+		db.SetConnMaxLifetime(dbProperties.ConnMaxLifetime())
+	}
+	return db, nil
+}
+
+// sqliteDSN adds the parameters which go-sqlite3 uses to set up each new
+// connection to the DSN of an SQLite database. Setting them on a connection
+// after it is opened would only apply them to that connection of the pool.
+// The parameters which the DSN already has are left as they are.
+func sqliteDSN(dsn string, dbProperties DbProperties) string {
+	var query url.Values
+	if i := strings.IndexRune(dsn, '?'); i >= 0 {
+		query, _ = url.ParseQuery(dsn[i+1:])
+	}
+	var params []string
+	add := func(value string, keys ...string) {
+		for _, key := range keys {
+			if _, ok := query[key]; ok {
+				return
+			}
+		}
+		params = append(params, keys[0]+"="+value)
+	}
+	add(dbProperties.SQLiteJournalMode(), "_journal_mode", "_journal")
+	add(strconv.FormatInt(int64(dbProperties.SQLiteBusyTimeout()/time.Millisecond), 10), "_busy_timeout", "_timeout")
+	add("1", "_foreign_keys", "_fk")
+	if len(params) == 0 {
+		return dsn
+	}
+	separator := "?"
+	if strings.ContainsRune(dsn, '?') {
+		separator = "&"
+	}
+	return dsn + separator + strings.Join(params, "&")
 }
 
 func init() {
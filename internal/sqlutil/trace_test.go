@@ -0,0 +1,98 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testProperties struct{}
+
+func (testProperties) MaxOpenConns() int                { return 7 }
+func (testProperties) MaxIdleConns() int                { return 3 }
+func (testProperties) ConnMaxLifetime() time.Duration   { return time.Minute }
+func (testProperties) SQLiteJournalMode() string        { return "wal" }
+func (testProperties) SQLiteBusyTimeout() time.Duration { return 1500 * time.Millisecond }
+
+func TestOpenAppliesPoolSettings(t *testing.T) {
+	// Opening a database doesn't connect to it, so no server is needed.
+	db, err := Open("postgres", "postgres://localhost/dendrite_test?sslmode=disable", testProperties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() // nolint: errcheck
+	if open := db.Stats().MaxOpenConnections; open != 7 {
+		t.Errorf("expected at most 7 open connections, got %d", open)
+	}
+
+	// The pool of an SQLite database is left as it is.
+	if db, err = Open("sqlite3", "file::memory:", testProperties{}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() // nolint: errcheck
+	if open := db.Stats().MaxOpenConnections; open != 0 {
+		t.Errorf("expected no limit on the open SQLite connections, got %d", open)
+	}
+}
+
+func TestOpenSetsUpSQLiteConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dendrite-sqlutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	db, err := Open("sqlite3", "file:"+filepath.Join(dir, "test.db"), testProperties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() // nolint: errcheck
+
+	// Every connection of the pool is set up, not just the first one.
+	db.SetMaxIdleConns(2)
+	conns := make([]*sql.Conn, 2)
+	for i := range conns {
+		if conns[i], err = db.Conn(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		defer conns[i].Close() // nolint: errcheck
+	}
+	for i, conn := range conns {
+		var journalMode string
+		var busyTimeout, foreignKeys int
+		for pragma, dest := range map[string]interface{}{
+			"journal_mode": &journalMode,
+			"busy_timeout": &busyTimeout,
+			"foreign_keys": &foreignKeys,
+		} {
+			if err = conn.QueryRowContext(context.Background(), "PRAGMA "+pragma).Scan(dest); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if journalMode != "wal" || busyTimeout != 1500 || foreignKeys != 1 {
+			t.Errorf(
+				"expected connection %d to use wal with a 1500ms busy timeout and foreign keys, got %s, %dms and %d",
+				i, journalMode, busyTimeout, foreignKeys,
+			)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"bufio"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -104,7 +105,11 @@ func RemoveDir(dir types.Path, logger *log.Entry) {
 	}
 }
 
+// ErrFileIsTooLarge is returned by WriteTempFile if there is more data than the maximum file size
+var ErrFileIsTooLarge = errors.New("file is too large")
+
 // WriteTempFile writes to a new temporary file
+// A maxFileSizeBytes of 0 means that the size of the file is unlimited.
 func WriteTempFile(reqReader io.Reader, maxFileSizeBytes config.FileSizeBytes, absBasePath config.Path) (hash types.Base64Hash, size types.FileSizeBytes, path types.Path, err error) {
 	size = -1
 
@@ -112,10 +117,20 @@ func WriteTempFile(reqReader io.Reader, maxFileSizeBytes config.FileSizeBytes, a
 	if err != nil {
 		return
 	}
-	defer (func() { err = tmpFile.Close() })()
+	// The temporary directory is returned with any error so that the caller can remove it
+	path = tmpDir
+	defer (func() {
+		if closeErr := tmpFile.Close(); err == nil {
+			err = closeErr
+		}
+	})()
 
-	// The amount of data read is limited to maxFileSizeBytes. At this point, if there is more data it will be truncated.
-	limitedReader := io.LimitReader(reqReader, int64(maxFileSizeBytes))
+	// The amount of data read is limited to one byte more than maxFileSizeBytes. If that byte is read then the
+	// file is too large, and we stop reading rather than reading the rest of the data.
+	limitedReader := reqReader
+	if maxFileSizeBytes > 0 {
+		limitedReader = io.LimitReader(reqReader, int64(maxFileSizeBytes)+1)
+	}
 	// Hash the file data. The hash will be returned. The hash is useful as a
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
@@ -125,6 +140,10 @@ func WriteTempFile(reqReader io.Reader, maxFileSizeBytes config.FileSizeBytes, a
 	if err != nil && err != io.EOF {
 		return
 	}
+	if maxFileSizeBytes > 0 && bytesWritten > int64(maxFileSizeBytes) {
+		err = ErrFileIsTooLarge
+		return
+	}
 
 	err = tmpFileWriter.Flush()
 	if err != nil {
@@ -133,7 +152,6 @@ func WriteTempFile(reqReader io.Reader, maxFileSizeBytes config.FileSizeBytes, a
 
 	hash = types.Base64Hash(base64.RawURLEncoding.EncodeToString(hasher.Sum(nil)[:]))
 	size = types.FileSizeBytes(bytesWritten)
-	path = tmpDir
 	return
 }
 
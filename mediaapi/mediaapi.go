@@ -17,6 +17,7 @@ package mediaapi
 import (
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -29,12 +30,17 @@ func SetupMediaAPIComponent(
 	base *basecomponent.BaseDendrite,
 	deviceDB devices.Database,
 ) {
-	mediaDB, err := storage.Open(string(base.Cfg.Database.MediaAPI))
+	mediaDB, err := storage.Open(string(base.Cfg.Database.MediaAPI), base.Cfg.DbProperties(config.DatabaseMediaAPI))
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to media db")
 	}
+	base.RegisterDatabaseHealthCheck("media db", mediaDB)
 
 	routing.Setup(
 		base.APIMux, base.Cfg, mediaDB, deviceDB, gomatrixserverlib.NewClient(),
 	)
+
+	if base.Cfg.Media.Retention.Enabled() {
+		go routing.SweepExpiredMedia(base.Cfg, mediaDB)
+	}
 }
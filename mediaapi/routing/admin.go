@@ -0,0 +1,91 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type purgeMediaResponse struct {
+	Purged int `json:"purged"`
+}
+
+// PurgeMedia implements POST /_dendrite/admin/v1/purge_media, which purges the
+// media which has expired under the retention policy straight away.
+func PurgeMedia(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite, db storage.Database,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	purged, err := PurgeExpiredMedia(req.Context(), cfg, db, time.Now())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("PurgeExpiredMedia failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: purgeMediaResponse{purged},
+	}
+}
+
+type mediaRetentionRequest struct {
+	Exempt bool `json:"exempt"`
+}
+
+// SetMediaRetention implements PUT /_dendrite/admin/v1/media/{serverName}/{mediaId}/retention,
+// which exempts media from the retention policy or makes it subject to it again.
+func SetMediaRetention(
+	req *http.Request, device *authtypes.Device, cfg *config.Dendrite, db storage.Database,
+	origin gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	if resErr := common.CheckServerAdmin(device, cfg); resErr != nil {
+		return *resErr
+	}
+	var r mediaRetentionRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	mediaMetadata, err := db.GetMediaMetadata(req.Context(), mediaID, origin)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetMediaMetadata failed")
+		return jsonerror.InternalServerError()
+	}
+	if mediaMetadata == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("File not found"),
+		}
+	}
+	if err = db.SetMediaRetentionExempt(req.Context(), mediaID, origin, r.Exempt); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.SetMediaRetentionExempt failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+// configResponse defines the format of the JSON response
+// https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-media-r0-config
+type configResponse struct {
+	// Left out if the size of uploads is unlimited
+	UploadSize config.FileSizeBytes `json:"m.upload.size,omitempty"`
+}
+
+// GetConfig implements GET /config
+func GetConfig(cfg *config.Dendrite) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: configResponse{
+			UploadSize: *cfg.Media.MaxFileSizeBytes,
+		},
+	}
+}
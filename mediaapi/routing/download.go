@@ -18,7 +18,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"mime"
 	"net/http"
 	"os"
@@ -27,6 +26,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/common/config"
@@ -52,7 +52,9 @@ type downloadRequest struct {
 	MediaMetadata      *types.MediaMetadata
 	IsThumbnailRequest bool
 	ThumbnailSize      types.ThumbnailSize
-	Logger             *log.Entry
+	// Whether an animated thumbnail was asked for
+	Animated bool
+	Logger   *log.Entry
 }
 
 // Download implements GET /download and GET /thumbnail
@@ -99,10 +101,12 @@ func Download(
 			Height:       height,
 			ResizeMethod: strings.ToLower(req.FormValue("method")),
 		}
+		dReq.Animated = strings.ToLower(req.FormValue("animated")) == "true"
 		dReq.Logger.WithFields(log.Fields{
 			"RequestedWidth":        dReq.ThumbnailSize.Width,
 			"RequestedHeight":       dReq.ThumbnailSize.Height,
 			"RequestedResizeMethod": dReq.ThumbnailSize.ResizeMethod,
+			"RequestedAnimated":     dReq.Animated,
 		})
 	}
 
@@ -113,7 +117,7 @@ func Download(
 	}
 
 	metadata, err := dReq.doDownload(
-		req.Context(), w, cfg, db, client,
+		req.Context(), w, req, cfg, db, client,
 		activeRemoteRequests, activeThumbnailGeneration,
 	)
 	if err != nil {
@@ -191,6 +195,7 @@ func (r *downloadRequest) Validate() *util.JSONResponse {
 func (r *downloadRequest) doDownload(
 	ctx context.Context,
 	w http.ResponseWriter,
+	req *http.Request,
 	cfg *config.Dendrite,
 	db storage.Database,
 	client *gomatrixserverlib.Client,
@@ -219,19 +224,28 @@ func (r *downloadRequest) doDownload(
 	} else {
 		// If we have a record, we can respond from the local file
 		r.MediaMetadata = mediaMetadata
+		// Keep the media for longer under the retention policy
+		if err = db.UpdateMediaLastAccess(
+			ctx, mediaMetadata.MediaID, mediaMetadata.Origin, types.UnixMs(time.Now().UnixNano()/1000000),
+		); err != nil {
+			r.Logger.WithError(err).Warn("Failed to update when the media was last accessed")
+		}
 	}
 	return r.respondFromLocalFile(
-		ctx, w, cfg.Media.AbsBasePath, activeThumbnailGeneration,
+		ctx, w, req, cfg.Media.AbsBasePath, activeThumbnailGeneration,
 		cfg.Media.MaxThumbnailGenerators, db,
 		cfg.Media.DynamicThumbnails, cfg.Media.ThumbnailSizes,
 	)
 }
 
 // respondFromLocalFile reads a file from local storage and writes it to the http.ResponseWriter
+// Single and multiple Range requests are served with 206 Partial Content by seeking into the file, and
+// conditional requests are served using the ETag and Last-Modified of the file.
 // If no file was found then returns nil, nil
 func (r *downloadRequest) respondFromLocalFile(
 	ctx context.Context,
 	w http.ResponseWriter,
+	req *http.Request,
 	absBasePath config.Path,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
@@ -263,6 +277,8 @@ func (r *downloadRequest) respondFromLocalFile(
 
 	var responseFile *os.File
 	var responseMetadata *types.MediaMetadata
+	// Stored media never changes, so the hash of the file identifies it
+	etag := string(r.MediaMetadata.Base64Hash)
 	if r.IsThumbnailRequest {
 		thumbFile, thumbMetadata, resErr := r.getThumbnailFile(
 			ctx, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
@@ -287,6 +303,9 @@ func (r *downloadRequest) respondFromLocalFile(
 			r.Logger.Info("Responding with thumbnail")
 			responseFile = thumbFile
 			responseMetadata = thumbMetadata.MediaMetadata
+			etag = fmt.Sprintf("%s-%dx%d-%s", etag,
+				thumbMetadata.ThumbnailSize.Width, thumbMetadata.ThumbnailSize.Height, thumbMetadata.ThumbnailSize.ResizeMethod,
+			)
 		}
 	} else {
 		r.Logger.WithFields(log.Fields{
@@ -304,17 +323,20 @@ func (r *downloadRequest) respondFromLocalFile(
 	}
 
 	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
-	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
 	contentSecurityPolicy := "default-src 'none';" +
 		" script-src 'none';" +
 		" plugin-types application/pdf;" +
 		" style-src 'unsafe-inline';" +
 		" object-src 'self';"
 	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+	w.Header().Set("ETag", `"`+etag+`"`)
 
-	if _, err := io.Copy(w, responseFile); err != nil {
-		return nil, errors.Wrap(err, "failed to copy from cache")
+	responseStat, err := responseFile.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat file")
 	}
+	// ServeContent sets the Content-Length, as it depends on the range requested
+	http.ServeContent(w, req, "", responseStat.ModTime(), responseFile)
 	return responseMetadata, nil
 }
 
@@ -332,9 +354,27 @@ func (r *downloadRequest) getThumbnailFile(
 	var thumbnail *types.ThumbnailMetadata
 	var err error
 
-	if dynamicThumbnails {
+	// Animated thumbnails are generated on request, of the requested size if
+	// dynamic thumbnails are enabled or of the best pre-generated size if not.
+	// If the file isn't animated we fall back to a static thumbnail.
+	if r.Animated {
+		thumbnailSize := &r.ThumbnailSize
+		if !dynamicThumbnails {
+			_, thumbnailSize = thumbnailer.SelectThumbnail(r.ThumbnailSize, nil, thumbnailSizes)
+		}
+		if thumbnailSize != nil {
+			thumbnail, err = r.generateThumbnail(
+				ctx, filePath, *thumbnailSize, true, activeThumbnailGeneration,
+				maxThumbnailGenerators, db,
+			)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if dynamicThumbnails && thumbnail == nil {
 		thumbnail, err = r.generateThumbnail(
-			ctx, filePath, r.ThumbnailSize, activeThumbnailGeneration,
+			ctx, filePath, r.ThumbnailSize, false, activeThumbnailGeneration,
 			maxThumbnailGenerators, db,
 		)
 		if err != nil {
@@ -365,7 +405,7 @@ func (r *downloadRequest) getThumbnailFile(
 				"ResizeMethod": thumbnailSize.ResizeMethod,
 			}).Info("Pre-generating thumbnail for immediate response.")
 			thumbnail, err = r.generateThumbnail(
-				ctx, filePath, *thumbnailSize, activeThumbnailGeneration,
+				ctx, filePath, *thumbnailSize, false, activeThumbnailGeneration,
 				maxThumbnailGenerators, db,
 			)
 			if err != nil {
@@ -401,10 +441,13 @@ func (r *downloadRequest) getThumbnailFile(
 	return thumbFile, thumbnail, nil
 }
 
+// generateThumbnail generates a thumbnail of the given size, or an animated
+// thumbnail if animated is true. Returns nil if no thumbnail was generated.
 func (r *downloadRequest) generateThumbnail(
 	ctx context.Context,
 	filePath types.Path,
 	thumbnailSize types.ThumbnailSize,
+	animated bool,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
@@ -414,7 +457,13 @@ func (r *downloadRequest) generateThumbnail(
 		"Height":       thumbnailSize.Height,
 		"ResizeMethod": thumbnailSize.ResizeMethod,
 	})
-	busy, err := thumbnailer.GenerateThumbnail(
+	generate := thumbnailer.GenerateThumbnail
+	resizeMethod := thumbnailSize.ResizeMethod
+	if animated {
+		generate = thumbnailer.GenerateAnimatedThumbnail
+		resizeMethod = types.AnimatedResizeMethod(resizeMethod)
+	}
+	busy, err := generate(
 		ctx, filePath, thumbnailSize, r.MediaMetadata,
 		activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 	)
@@ -427,7 +476,7 @@ func (r *downloadRequest) generateThumbnail(
 	var thumbnail *types.ThumbnailMetadata
 	thumbnail, err = db.GetThumbnail(
 		ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
-		thumbnailSize.Width, thumbnailSize.Height, thumbnailSize.ResizeMethod,
+		thumbnailSize.Width, thumbnailSize.Height, resizeMethod,
 	)
 	if err != nil {
 		return nil, errors.Wrap(err, "error looking up thumbnail")
@@ -626,7 +675,7 @@ func (r *downloadRequest) fetchRemoteFile(
 		r.Logger.WithError(err).Warn("Failed to parse content length")
 		return "", false, errors.Wrap(err, "invalid response from remote server")
 	}
-	if contentLength > int64(maxFileSizeBytes) {
+	if maxFileSizeBytes > 0 && contentLength > int64(maxFileSizeBytes) {
 		// TODO: Bubble up this as a 413
 		return "", false, fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
 	}
@@ -642,7 +691,8 @@ func (r *downloadRequest) fetchRemoteFile(
 	// The file data is hashed but is NOT used as the MediaID, unlike in Upload. The hash is useful as a
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
-	// Data is truncated to maxFileSizeBytes. Content-Length was reported as 0 < Content-Length <= maxFileSizeBytes so this is OK.
+	// Content-Length was reported as 0 < Content-Length <= maxFileSizeBytes, but the download is stopped as soon as
+	// there is more data than maxFileSizeBytes in case the Content-Length was wrong.
 	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(resp.Body, maxFileSizeBytes, absBasePath)
 	if err != nil {
 		r.Logger.WithError(err).WithFields(log.Fields{
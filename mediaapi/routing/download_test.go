@@ -0,0 +1,145 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const rangeTestContent = "0123456789abcdefghij"
+
+func newRangeTest(t *testing.T) (*config.Dendrite, storage.Database, func()) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.Open("file:"+filepath.Join(dir, "mediaapi.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Media.AbsBasePath = config.Path(dir)
+
+	mediaMetadata := &types.MediaMetadata{
+		MediaID:       "media",
+		Origin:        "localhost",
+		ContentType:   "text/plain",
+		FileSizeBytes: types.FileSizeBytes(len(rangeTestContent)),
+		UploadName:    "media.txt",
+		Base64Hash:    "hash",
+		UserID:        "@alice:localhost",
+	}
+	if err = db.StoreMediaMetadata(context.Background(), mediaMetadata); err != nil {
+		t.Fatal(err)
+	}
+	filePath, err := fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash, cfg.Media.AbsBasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filePath, []byte(rangeTestContent), 0660); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, db, func() { os.RemoveAll(dir) } // nolint: errcheck
+}
+
+func download(cfg *config.Dendrite, db storage.Database, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/media/r0/download/localhost/media", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	Download(
+		w, req, "localhost", "media", cfg, db, nil,
+		&types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+		&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+		false,
+	)
+	return w
+}
+
+func TestDownloadRange(t *testing.T) {
+	cfg, db, cleanup := newRangeTest(t)
+	defer cleanup()
+
+	for _, test := range []struct {
+		rangeHeader  string
+		code         int
+		contentRange string
+		body         string
+	}{
+		{"", http.StatusOK, "", rangeTestContent},
+		{"bytes=5-9", http.StatusPartialContent, "bytes 5-9/20", "56789"},
+		{"bytes=-4", http.StatusPartialContent, "bytes 16-19/20", "ghij"},
+		{"bytes=15-", http.StatusPartialContent, "bytes 15-19/20", "fghij"},
+		{"bytes=20-30", http.StatusRequestedRangeNotSatisfiable, "bytes */20", ""},
+	} {
+		header := http.Header{}
+		if test.rangeHeader != "" {
+			header.Set("Range", test.rangeHeader)
+		}
+		w := download(cfg, db, header)
+		if w.Code != test.code {
+			t.Errorf("%q: expected %d, got %d", test.rangeHeader, test.code, w.Code)
+			continue
+		}
+		if contentRange := w.Header().Get("Content-Range"); contentRange != test.contentRange {
+			t.Errorf("%q: expected Content-Range %q, got %q", test.rangeHeader, test.contentRange, contentRange)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%q: expected body %q, got %q", test.rangeHeader, test.body, w.Body.String())
+		}
+		if w.Code != http.StatusRequestedRangeNotSatisfiable && w.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("%q: expected Accept-Ranges: bytes, got %q", test.rangeHeader, w.Header().Get("Accept-Ranges"))
+		}
+	}
+}
+
+func TestDownloadConditional(t *testing.T) {
+	cfg, db, cleanup := newRangeTest(t)
+	defer cleanup()
+
+	w := download(cfg, db, nil)
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if etag != `"hash"` || lastModified == "" {
+		t.Fatalf("expected an ETag and Last-Modified, got %q and %q", etag, lastModified)
+	}
+	if w = download(cfg, db, http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching ETag, got %d", w.Code)
+	}
+	// The range is only served if the file hasn't changed.
+	if w = download(cfg, db, http.Header{"Range": {"bytes=0-1"}, "If-Range": {etag}}); w.Code != http.StatusPartialContent {
+		t.Errorf("expected 206 for a matching If-Range, got %d", w.Code)
+	}
+	if w = download(cfg, db, http.Header{"Range": {"bytes=0-1"}, "If-Range": {`"other"`}}); w.Code != http.StatusOK || w.Body.String() != rangeTestContent {
+		t.Errorf("expected the whole file for a different If-Range, got %d", w.Code)
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/i2p"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// How long to wait for a URL to be fetched. Sites on I2P take much longer to
+// respond than others.
+const (
+	previewTimeout    = 30 * time.Second
+	i2pPreviewTimeout = 3 * time.Minute
+)
+
+var errI2PPreviewsDisabled = errors.New("previews of .i2p URLs need I2P to be enabled")
+
+// urlPreviewer fetches the previews of URLs and caches them for a short time.
+type urlPreviewer struct {
+	cfg                       *config.Dendrite
+	db                        storage.Database
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration
+	client                    *http.Client
+	now                       func() time.Time
+	mutex                     sync.Mutex
+	// The string key is a URL
+	cache map[string]*cachedPreview
+}
+
+type cachedPreview struct {
+	preview map[string]interface{}
+	expires time.Time
+}
+
+func newURLPreviewer(
+	cfg *config.Dendrite,
+	db storage.Database,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) *urlPreviewer {
+	p := &urlPreviewer{
+		cfg:                       cfg,
+		db:                        db,
+		activeThumbnailGeneration: activeThumbnailGeneration,
+		now:                       time.Now,
+		cache:                     map[string]*cachedPreview{},
+	}
+	p.client = &http.Client{
+		Transport:     newPreviewTransport(cfg),
+		CheckRedirect: p.checkRedirect,
+	}
+	return p
+}
+
+// PreviewURL implements GET /preview_url
+// https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-media-r0-preview-url
+func PreviewURL(req *http.Request, previewer *urlPreviewer) util.JSONResponse {
+	rawURL := req.URL.Query().Get("url")
+	if rawURL == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("url parameter is required"),
+		}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("url must be an http or https URL"),
+		}
+	}
+	if !previewer.cfg.Media.URLPreviews.AllowsHost(u.Hostname()) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Previews of URLs on this host are not allowed"),
+		}
+	}
+
+	preview, err := previewer.preview(req.Context(), u)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("url", rawURL).Warn("Failed to preview URL")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to fetch the URL"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: preview,
+	}
+}
+
+// preview returns the preview of the URL, from the cache if it was previewed
+// recently.
+func (p *urlPreviewer) preview(ctx context.Context, u *url.URL) (map[string]interface{}, error) {
+	key := u.String()
+	p.mutex.Lock()
+	cached, ok := p.cache[key]
+	p.mutex.Unlock()
+	if ok && p.now().Before(cached.expires) {
+		return cached.preview, nil
+	}
+
+	preview, err := p.fetchPreview(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := p.now()
+	for k, c := range p.cache {
+		if !now.Before(c.expires) {
+			delete(p.cache, k)
+		}
+	}
+	p.cache[key] = &cachedPreview{
+		preview: preview,
+		expires: now.Add(p.cfg.Media.URLPreviews.CacheLifetime),
+	}
+	return preview, nil
+}
+
+// fetchPreview fetches the URL and returns the OpenGraph properties of the
+// page. If the page has an image, or the URL is itself an image, then the
+// image is stored as local media and the preview refers to that.
+func (p *urlPreviewer) fetchPreview(ctx context.Context, u *url.URL) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeoutFor(u))
+	defer cancel()
+	res, err := p.fetch(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+
+	preview := map[string]interface{}{}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		if err = p.storeImage(ctx, preview, res); err != nil {
+			return nil, err
+		}
+		return preview, nil
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		preview = parseOpenGraph(io.LimitReader(res.Body, int64(p.cfg.Media.URLPreviews.MaxPageSizeBytes)))
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", mediaType)
+	}
+
+	imageURL, ok := preview["og:image"].(string)
+	if !ok {
+		return preview, nil
+	}
+	// The image is only in the preview if it could be stored as local media,
+	// as clients need an mxc:// URL.
+	delete(preview, "og:image")
+	if err = p.fetchImage(ctx, preview, res.Request.URL, imageURL); err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("url", imageURL).Warn("Failed to fetch image for URL preview")
+	}
+	return preview, nil
+}
+
+func (p *urlPreviewer) fetchImage(ctx context.Context, preview map[string]interface{}, pageURL *url.URL, imageURL string) error {
+	u, err := pageURL.Parse(imageURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported image URL scheme %q", u.Scheme)
+	}
+	if !p.cfg.Media.URLPreviews.AllowsHost(u.Hostname()) {
+		return fmt.Errorf("previews of URLs on %q are not allowed", u.Hostname())
+	}
+	res, err := p.fetch(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	return p.storeImage(ctx, preview, res)
+}
+
+func (p *urlPreviewer) fetch(ctx context.Context, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("%s responded with HTTP status %d", u.Hostname(), res.StatusCode)
+	}
+	return res, nil
+}
+
+// storeImage stores the image in the response as local media and adds it to
+// the preview.
+func (p *urlPreviewer) storeImage(ctx context.Context, preview map[string]interface{}, res *http.Response) error {
+	maxImageSizeBytes := int64(p.cfg.Media.URLPreviews.MaxImageSizeBytes)
+	if maxFileSizeBytes := int64(*p.cfg.Media.MaxFileSizeBytes); maxFileSizeBytes > 0 && maxFileSizeBytes < maxImageSizeBytes {
+		maxImageSizeBytes = maxFileSizeBytes
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxImageSizeBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > maxImageSizeBytes {
+		return fmt.Errorf("image is larger than %d bytes", maxImageSizeBytes)
+	}
+	if len(data) == 0 {
+		return errors.New("image is empty")
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:        p.cfg.Matrix.ServerName,
+			FileSizeBytes: types.FileSizeBytes(len(data)),
+			ContentType:   types.ContentType(contentType),
+			UploadName:    types.Filename(url.PathEscape(path.Base(res.Request.URL.Path))),
+		},
+		Logger: util.GetLogger(ctx).WithField("Origin", p.cfg.Matrix.ServerName),
+	}
+	if resErr := r.doUpload(ctx, bytes.NewReader(data), p.cfg, p.db, p.activeThumbnailGeneration); resErr != nil {
+		return fmt.Errorf("failed to store image: %v", resErr.JSON)
+	}
+
+	preview["og:image"] = fmt.Sprintf("mxc://%s/%s", p.cfg.Matrix.ServerName, r.MediaMetadata.MediaID)
+	preview["og:image:type"] = contentType
+	preview["matrix:image:size"] = len(data)
+	if imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		preview["og:image:width"] = imageConfig.Width
+		preview["og:image:height"] = imageConfig.Height
+	}
+	return nil
+}
+
+// checkRedirect stops redirects to hosts that previews aren't allowed from.
+func (p *urlPreviewer) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !p.cfg.Media.URLPreviews.AllowsHost(req.URL.Hostname()) {
+		return fmt.Errorf("redirected to %q, which previews are not allowed from", req.URL.Hostname())
+	}
+	return nil
+}
+
+// parseOpenGraph returns the OpenGraph properties in the head of the page. The
+// title and description of the page are used if it has no OpenGraph title or
+// description.
+func parseOpenGraph(r io.Reader) map[string]interface{} {
+	preview := map[string]interface{}{}
+	var title, description string
+	inTitle := false
+	z := html.NewTokenizer(r)
+	for done := false; !done; {
+		switch tt := z.Next(); tt {
+		case html.ErrorToken:
+			// Either the end of the page or as much as we are willing to read
+			done = true
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch atom.Lookup(name) {
+			case atom.Title:
+				inTitle = tt == html.StartTagToken
+			case atom.Meta:
+				var property, content string
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					switch string(key) {
+					case "property", "name":
+						property = string(val)
+					case "content":
+						content = string(val)
+					}
+				}
+				if _, ok := preview[property]; !ok && strings.HasPrefix(property, "og:") {
+					preview[property] = content
+				} else if property == "description" {
+					description = content
+				}
+			case atom.Body:
+				done = true
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch atom.Lookup(name) {
+			case atom.Title:
+				inTitle = false
+			case atom.Head:
+				done = true
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(z.Text())
+			}
+		}
+	}
+	if _, ok := preview["og:title"]; !ok && strings.TrimSpace(title) != "" {
+		preview["og:title"] = strings.TrimSpace(title)
+	}
+	if _, ok := preview["og:description"]; !ok && description != "" {
+		preview["og:description"] = description
+	}
+	return preview
+}
+
+// previewTransport fetches .i2p URLs through the SAM bridge, and other URLs
+// directly as long as they aren't on a private network.
+type previewTransport struct {
+	clearnet http.RoundTripper
+	// nil unless I2P is enabled
+	i2p http.RoundTripper
+}
+
+func newPreviewTransport(cfg *config.Dendrite) *previewTransport {
+	dialer := &net.Dialer{
+		Timeout: previewTimeout,
+		Control: common.RefusePrivateNetworks,
+	}
+	t := &previewTransport{
+		clearnet: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+	if cfg.Matrix.I2P.Enabled {
+		t.i2p = i2p.NewTransport(i2p.NewDialer(cfg.Matrix.I2P.SAMAddress))
+	}
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *previewTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if i2p.IsI2PHost(req.URL.Host) {
+		// Never look .i2p hosts up outside of I2P
+		if t.i2p == nil {
+			return nil, errI2PPreviewsDisabled
+		}
+		return t.i2p.RoundTrip(req)
+	}
+	return t.clearnet.RoundTrip(req)
+}
+
+func timeoutFor(u *url.URL) time.Duration {
+	if i2p.IsI2PHost(u.Host) {
+		return i2pPreviewTimeout
+	}
+	return previewTimeout
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const openGraphPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>Ignored because of og:title</title>
+<meta property="og:title" content="Dendrite &amp; I2P">
+<meta property="og:description" content="A second-generation Matrix homeserver">
+<meta property="og:image" content="/logo.png">
+<meta name="description" content="Ignored because of og:description">
+</head>
+<body><meta property="og:title" content="Ignored because it is in the body"></body>
+</html>`
+
+// testSite serves a page with OpenGraph properties and its image, and counts
+// the requests for the page.
+type testSite struct {
+	hits  int
+	image []byte
+}
+
+func (s *testSite) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/":
+		s.hits++
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, openGraphPage) // nolint: errcheck
+	case "/logo.png":
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(s.image) // nolint: errcheck
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// fakeI2P answers every request through I2P with a page titled with the host.
+type fakeI2P struct {
+	hosts []string
+}
+
+func (f *fakeI2P) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.hosts = append(f.hosts, req.URL.Host)
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(rec, "<html><head><title>%s</title></head></html>", req.URL.Host) // nolint: errcheck
+	res := rec.Result()
+	res.Request = req
+	return res, nil
+}
+
+func newPreviewTest(t *testing.T) (*urlPreviewer, storage.Database, func()) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.Open("file:"+filepath.Join(dir, "mediaapi.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Media.AbsBasePath = config.Path(dir)
+	maxFileSizeBytes := config.FileSizeBytes(10 * 1024 * 1024)
+	cfg.Media.MaxFileSizeBytes = &maxFileSizeBytes
+	cfg.Media.MaxThumbnailGenerators = 10
+	cfg.Media.URLPreviews.Enabled = true
+	cfg.Media.URLPreviews.MaxPageSizeBytes = 1024 * 1024
+	cfg.Media.URLPreviews.MaxImageSizeBytes = 1024 * 1024
+	cfg.Media.URLPreviews.CacheLifetime = 10 * time.Minute
+	cfg.Media.URLPreviews.DeniedHosts = []string{"denied.example.com"}
+	p := newURLPreviewer(cfg, db, &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	})
+	return p, db, func() { os.RemoveAll(dir) } // nolint: errcheck
+}
+
+func previewURL(t *testing.T, p *urlPreviewer, target string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/media/r0/preview_url?url="+url.QueryEscape(target), nil)
+	res := PreviewURL(req, p)
+	return res.Code, responseBody(t, res.JSON)
+}
+
+func TestPreviewURLWithOpenGraph(t *testing.T) {
+	p, db, cleanup := newPreviewTest(t)
+	defer cleanup()
+	now := time.Unix(1587340800, 0)
+	p.now = func() time.Time { return now }
+	// The test site is on the loopback address, which previews are usually
+	// never fetched from.
+	p.client.Transport = &previewTransport{clearnet: http.DefaultTransport}
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 2))); err != nil {
+		t.Fatal(err)
+	}
+	site := &testSite{image: img.Bytes()}
+	server := httptest.NewServer(site)
+	defer server.Close()
+
+	code, preview := previewURL(t, p, server.URL+"/")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", code, preview)
+	}
+	if preview["og:title"] != "Dendrite & I2P" || preview["og:description"] != "A second-generation Matrix homeserver" {
+		t.Errorf("expected the OpenGraph title and description, got %v", preview)
+	}
+	if preview["og:image:width"] != float64(4) || preview["og:image:height"] != float64(2) ||
+		preview["og:image:type"] != "image/png" || preview["matrix:image:size"] != float64(img.Len()) {
+		t.Errorf("expected the image to be described, got %v", preview)
+	}
+	mxc, _ := preview["og:image"].(string)
+	if !strings.HasPrefix(mxc, "mxc://localhost/") {
+		t.Fatalf("expected the image to be local media, got %q", mxc)
+	}
+	mediaMetadata, err := db.GetMediaMetadata(context.Background(), types.MediaID(strings.TrimPrefix(mxc, "mxc://localhost/")), "localhost")
+	if err != nil || mediaMetadata == nil || mediaMetadata.FileSizeBytes != types.FileSizeBytes(img.Len()) {
+		t.Errorf("expected the image to be stored, got %v (%v)", mediaMetadata, err)
+	}
+
+	// The preview is cached for a short time.
+	if code, _ = previewURL(t, p, server.URL+"/"); code != http.StatusOK || site.hits != 1 {
+		t.Errorf("expected the preview to be cached, got %d with %d hits", code, site.hits)
+	}
+	now = now.Add(time.Hour)
+	if code, _ = previewURL(t, p, server.URL+"/"); code != http.StatusOK || site.hits != 2 {
+		t.Errorf("expected the preview to be fetched again, got %d with %d hits", code, site.hits)
+	}
+}
+
+func TestPreviewURLOverI2P(t *testing.T) {
+	p, _, cleanup := newPreviewTest(t)
+	defer cleanup()
+	i2p := &fakeI2P{}
+	p.client.Transport = &previewTransport{clearnet: http.DefaultTransport, i2p: i2p}
+
+	code, preview := previewURL(t, p, "http://dendrite.i2p/")
+	if code != http.StatusOK || preview["og:title"] != "dendrite.i2p" {
+		t.Errorf("expected the page to be fetched over I2P, got %d: %v", code, preview)
+	}
+	if len(i2p.hosts) != 1 || i2p.hosts[0] != "dendrite.i2p" {
+		t.Errorf("expected one request over I2P, got %v", i2p.hosts)
+	}
+
+	// .i2p URLs aren't fetched at all when I2P isn't enabled.
+	p.client.Transport = &previewTransport{clearnet: http.DefaultTransport}
+	if code, _ = previewURL(t, p, "http://other.i2p/"); code != http.StatusBadGateway {
+		t.Errorf("expected 502 without I2P, got %d", code)
+	}
+}
+
+func TestPreviewURLIsRefused(t *testing.T) {
+	p, _, cleanup := newPreviewTest(t)
+	defer cleanup()
+	server := httptest.NewServer(&testSite{})
+	defer server.Close()
+
+	for _, test := range []struct {
+		url  string
+		code int
+	}{
+		{"", http.StatusBadRequest},
+		{"ftp://example.com/", http.StatusBadRequest},
+		{"https://denied.example.com/", http.StatusForbidden},
+		{"https://www.denied.example.com/", http.StatusForbidden},
+		// The test site is on the loopback address
+		{server.URL + "/", http.StatusBadGateway},
+	} {
+		if code, body := previewURL(t, p, test.url); code != test.code {
+			t.Errorf("%q: expected %d, got %d: %v", test.url, test.code, code, body)
+		}
+	}
+}
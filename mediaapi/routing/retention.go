@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// SweepExpiredMedia purges the media which has expired under the retention
+// policy once every sweep interval. It never returns.
+func SweepExpiredMedia(cfg *config.Dendrite, db storage.Database) {
+	for range time.Tick(cfg.Media.Retention.SweepInterval) {
+		purged, err := PurgeExpiredMedia(context.Background(), cfg, db, time.Now())
+		if err != nil {
+			log.WithError(err).Error("Failed to purge expired media")
+		}
+		if purged > 0 {
+			log.WithField("purged", purged).Info("Purged expired media")
+		}
+	}
+}
+
+// PurgeExpiredMedia removes the files and the metadata of the media which
+// hasn't been uploaded or downloaded within its lifetime, unless it is exempt
+// from the retention policy. Returns how many media files were purged.
+func PurgeExpiredMedia(
+	ctx context.Context, cfg *config.Dendrite, db storage.Database, now time.Time,
+) (int, error) {
+	retention := &cfg.Media.Retention
+	media, err := db.GetExpiredMedia(
+		ctx, cfg.Matrix.ServerName,
+		expiryTimestamp(now, retention.LocalMediaLifetime),
+		expiryTimestamp(now, retention.RemoteMediaLifetime),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("db.GetExpiredMedia: %w", err)
+	}
+	for i, mediaMetadata := range media {
+		if err = purgeMedia(ctx, cfg, db, mediaMetadata); err != nil {
+			return i, err
+		}
+	}
+	return len(media), nil
+}
+
+// expiryTimestamp returns the timestamp before which media with the given
+// lifetime has expired. Media with no lifetime never expires.
+func expiryTimestamp(now time.Time, lifetime time.Duration) types.UnixMs {
+	if lifetime <= 0 {
+		return 0
+	}
+	return types.UnixMs(now.Add(-lifetime).UnixNano() / 1000000)
+}
+
+// purgeMedia removes the metadata of the media and its thumbnails, then the
+// directory holding the file and the thumbnails unless other media has the
+// same file.
+func purgeMedia(
+	ctx context.Context, cfg *config.Dendrite, db storage.Database, mediaMetadata *types.MediaMetadata,
+) error {
+	if err := db.DeleteMedia(ctx, mediaMetadata.MediaID, mediaMetadata.Origin); err != nil {
+		return fmt.Errorf("db.DeleteMedia: %w", err)
+	}
+	inUse, err := db.MediaHashInUse(ctx, mediaMetadata.Base64Hash)
+	if err != nil {
+		return fmt.Errorf("db.MediaHashInUse: %w", err)
+	}
+	if inUse {
+		return nil
+	}
+	filePath, err := fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash, cfg.Media.AbsBasePath)
+	if err != nil {
+		return err
+	}
+	if err = os.RemoveAll(filepath.Dir(filePath)); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"media_id":     mediaMetadata.MediaID,
+		"media_origin": mediaMetadata.Origin,
+	}).Debug("Purged expired media")
+	return nil
+}
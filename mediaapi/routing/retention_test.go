@@ -0,0 +1,163 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type retentionTest struct {
+	t   *testing.T
+	cfg *config.Dendrite
+	db  storage.Database
+}
+
+// store stores media and its file, and returns the path to the file.
+func (r *retentionTest) store(mediaID types.MediaID, origin gomatrixserverlib.ServerName, hash types.Base64Hash) string {
+	mediaMetadata := &types.MediaMetadata{
+		MediaID:     mediaID,
+		Origin:      origin,
+		ContentType: "text/plain",
+		UploadName:  types.Filename(mediaID),
+		Base64Hash:  hash,
+		UserID:      "@alice:localhost",
+	}
+	if err := r.db.StoreMediaMetadata(context.Background(), mediaMetadata); err != nil {
+		r.t.Fatal(err)
+	}
+	filePath, err := fileutils.GetPathFromBase64Hash(hash, r.cfg.Media.AbsBasePath)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+		r.t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filePath, []byte(mediaID), 0660); err != nil {
+		r.t.Fatal(err)
+	}
+	return filePath
+}
+
+func (r *retentionTest) exists(mediaID types.MediaID, origin gomatrixserverlib.ServerName) bool {
+	mediaMetadata, err := r.db.GetMediaMetadata(context.Background(), mediaID, origin)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return mediaMetadata != nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestPurgeExpiredMedia(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	db, err := storage.Open("file:"+filepath.Join(dir, "mediaapi.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Media.AbsBasePath = config.Path(dir)
+	cfg.Media.Retention.LocalMediaLifetime = 30 * 24 * time.Hour
+	cfg.Media.Retention.RemoteMediaLifetime = 24 * time.Hour
+	r := &retentionTest{t, cfg, db}
+	ctx := context.Background()
+	remote := gomatrixserverlib.ServerName("remote.example.org")
+
+	localFile := r.store("local", "localhost", "localhash")
+	expiredFile := r.store("expired", remote, "expiredhash")
+	if err = db.StoreThumbnail(ctx, &types.ThumbnailMetadata{
+		MediaMetadata: &types.MediaMetadata{MediaID: "expired", Origin: remote, ContentType: "image/png"},
+		ThumbnailSize: types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	accessedFile := r.store("accessed", remote, "accessedhash")
+	exemptFile := r.store("exempt", remote, "exempthash")
+	// Cached remote media may have the same file as local media.
+	r.store("shared", remote, "localhash")
+
+	// Two days later, remote media which hasn't been accessed since yesterday
+	// has expired.
+	now := time.Now().Add(48 * time.Hour)
+	accessed := types.UnixMs(now.Add(-time.Hour).UnixNano() / 1000000)
+	if err = db.UpdateMediaLastAccess(ctx, "accessed", remote, accessed); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.SetMediaRetentionExempt(ctx, "exempt", remote, true); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := PurgeExpiredMedia(ctx, cfg, db, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("expected 2 media to be purged, got %d", purged)
+	}
+	if r.exists("expired", remote) || fileExists(expiredFile) {
+		t.Error("expected the expired remote media and its file to be removed")
+	}
+	if thumbnails, _ := db.GetThumbnails(ctx, "expired", remote); len(thumbnails) != 0 {
+		t.Errorf("expected the thumbnails of the expired media to be removed, got %d", len(thumbnails))
+	}
+	if r.exists("shared", remote) {
+		t.Error("expected the expired remote media with a shared file to be removed")
+	}
+	for _, survivor := range []struct {
+		mediaID types.MediaID
+		origin  gomatrixserverlib.ServerName
+		file    string
+	}{
+		{"local", "localhost", localFile},
+		{"accessed", remote, accessedFile},
+		{"exempt", remote, exemptFile},
+	} {
+		if !r.exists(survivor.mediaID, survivor.origin) || !fileExists(survivor.file) {
+			t.Errorf("expected %s/%s and its file to be kept", survivor.origin, survivor.mediaID)
+		}
+	}
+
+	// A month later, the local media and the accessed remote media have
+	// expired too.
+	if purged, err = PurgeExpiredMedia(ctx, cfg, db, now.Add(30*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 || r.exists("local", "localhost") || fileExists(localFile) {
+		t.Errorf("expected the local and accessed media to expire, purged %d", purged)
+	}
+	if !r.exists("exempt", remote) {
+		t.Error("expected the exempt media to be kept")
+	}
+}
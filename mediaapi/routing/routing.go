@@ -66,6 +66,13 @@ func Setup(
 		},
 	)).Methods(http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/config", common.MakeAuthAPI(
+		"media_config", authData,
+		func(req *http.Request, _ *authtypes.Device) util.JSONResponse {
+			return GetConfig(cfg)
+		},
+	)).Methods(http.MethodGet, http.MethodOptions)
+
 	activeRemoteRequests := &types.ActiveRemoteRequests{
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
@@ -75,6 +82,37 @@ func Setup(
 	r0mux.Handle("/thumbnail/{serverName}/{mediaId}",
 		makeDownloadAPI("thumbnail", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration),
 	).Methods(http.MethodGet, http.MethodOptions)
+
+	if cfg.Media.URLPreviews.Enabled {
+		previewer := newURLPreviewer(cfg, db, activeThumbnailGeneration)
+		r0mux.Handle("/preview_url", common.MakeAuthAPI(
+			"preview_url", authData,
+			func(req *http.Request, _ *authtypes.Device) util.JSONResponse {
+				return PreviewURL(req, previewer)
+			},
+		)).Methods(http.MethodGet, http.MethodOptions)
+	}
+
+	adminMux := apiMux.PathPrefix(common.PathPrefixAdmin).Subrouter()
+	adminMux.Handle("/purge_media", common.MakeAuthAPI(
+		"admin_purge_media", authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return PurgeMedia(req, device, cfg, db)
+		},
+	)).Methods(http.MethodPost, http.MethodOptions)
+	adminMux.Handle("/media/{serverName}/{mediaId}/retention", common.MakeAuthAPI(
+		"admin_media_retention", authData,
+		func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return SetMediaRetention(
+				req, device, cfg, db,
+				gomatrixserverlib.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]),
+			)
+		},
+	)).Methods(http.MethodPut, http.MethodOptions)
 }
 
 func makeDownloadAPI(
@@ -108,13 +108,17 @@ func (r *uploadRequest) doUpload(
 	// The file data is hashed and the hash is used as the MediaID. The hash is useful as a
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
-	// Data is truncated to maxFileSizeBytes. Content-Length was reported as 0 < Content-Length <= maxFileSizeBytes so this is OK.
+	// Content-Length was reported as 0 < Content-Length <= maxFileSizeBytes, but the upload is stopped as soon as
+	// there is more data than maxFileSizeBytes in case the Content-Length was wrong.
 	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(reqReader, *cfg.Media.MaxFileSizeBytes, cfg.Media.AbsBasePath)
 	if err != nil {
 		r.Logger.WithError(err).WithFields(log.Fields{
 			"MaxFileSizeBytes": *cfg.Media.MaxFileSizeBytes,
 		}).Warn("Error while transferring file")
 		fileutils.RemoveDir(tmpDir, r.Logger)
+		if err == fileutils.ErrFileIsTooLarge {
+			return tooLargeResponse(*cfg.Media.MaxFileSizeBytes)
+		}
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.Unknown("Failed to upload"),
@@ -170,10 +174,7 @@ func (r *uploadRequest) Validate(maxFileSizeBytes config.FileSizeBytes) *util.JS
 		}
 	}
 	if maxFileSizeBytes > 0 && r.MediaMetadata.FileSizeBytes > types.FileSizeBytes(maxFileSizeBytes) {
-		return &util.JSONResponse{
-			Code: http.StatusRequestEntityTooLarge,
-			JSON: jsonerror.Unknown(fmt.Sprintf("HTTP Content-Length is greater than the maximum allowed upload size (%v).", maxFileSizeBytes)),
-		}
+		return tooLargeResponse(maxFileSizeBytes)
 	}
 	// TODO: Check if the Content-Type is a valid type?
 	if r.MediaMetadata.ContentType == "" {
@@ -205,6 +206,13 @@ func (r *uploadRequest) Validate(maxFileSizeBytes config.FileSizeBytes) *util.JS
 	return nil
 }
 
+func tooLargeResponse(maxFileSizeBytes config.FileSizeBytes) *util.JSONResponse {
+	return &util.JSONResponse{
+		Code: http.StatusRequestEntityTooLarge,
+		JSON: jsonerror.TooLarge(fmt.Sprintf("The file is larger than the maximum allowed upload size (%v bytes).", maxFileSizeBytes)),
+	}
+}
+
 // storeFileAndMetadata moves the temporary file to its final path based on metadata and stores the metadata in the database
 // See getPathFromMediaMetadata in fileutils for details of the final path.
 // The order of operations is important as it avoids metadata entering the database before the file
@@ -0,0 +1,127 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package routing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+func newUploadTest(t *testing.T, maxFileSizeBytes config.FileSizeBytes) (*config.Dendrite, storage.Database, func()) {
+	dir, err := ioutil.TempDir("", "mediaapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.Open("file:"+filepath.Join(dir, "mediaapi.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Media.AbsBasePath = config.Path(dir)
+	cfg.Media.MaxFileSizeBytes = &maxFileSizeBytes
+	cfg.Media.MaxThumbnailGenerators = 10
+	return cfg, db, func() { os.RemoveAll(dir) } // nolint: errcheck
+}
+
+// upload uploads the content, with the Content-Length claiming that it is
+// contentLength bytes long.
+func upload(t *testing.T, cfg *config.Dendrite, db storage.Database, content string, contentLength int64) (int, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/media/r0/upload", strings.NewReader(content))
+	req.ContentLength = contentLength
+	req.Header.Set("Content-Type", "text/plain")
+	res := Upload(req, cfg, db, &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	})
+	return res.Code, responseBody(t, res.JSON)
+}
+
+func responseBody(t *testing.T, res interface{}) map[string]interface{} {
+	var body map[string]interface{}
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(resJSON, &body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestUploadIsTooLarge(t *testing.T) {
+	cfg, db, cleanup := newUploadTest(t, 10)
+	defer cleanup()
+
+	for _, test := range []struct {
+		name          string
+		content       string
+		contentLength int64
+	}{
+		{"Content-Length over the limit", "0123456789a", 11},
+		{"Content-Length under the size of the upload", "0123456789a", 5},
+	} {
+		code, body := upload(t, cfg, db, test.content, test.contentLength)
+		if code != http.StatusRequestEntityTooLarge || body["errcode"] != "M_TOO_LARGE" {
+			t.Errorf("%s: expected 413 M_TOO_LARGE, got %d: %v", test.name, code, body)
+		}
+		if !strings.Contains(body["error"].(string), "(10 bytes)") {
+			t.Errorf("%s: expected the limit to be reported, got %q", test.name, body["error"])
+		}
+	}
+	if code, body := upload(t, cfg, db, "0123456789", 10); code != http.StatusOK {
+		t.Errorf("expected an upload at the limit to succeed, got %d: %v", code, body)
+	}
+	// Nothing is left behind by the uploads which were too large.
+	tmpFiles, err := ioutil.ReadDir(filepath.Join(string(cfg.Media.AbsBasePath), "tmp"))
+	if err != nil || len(tmpFiles) != 0 {
+		t.Errorf("expected no temporary files, got %d (%v)", len(tmpFiles), err)
+	}
+}
+
+func TestUploadIsUnlimited(t *testing.T) {
+	cfg, db, cleanup := newUploadTest(t, 0)
+	defer cleanup()
+
+	content := strings.Repeat("0123456789", 1000)
+	if code, body := upload(t, cfg, db, content, int64(len(content))); code != http.StatusOK {
+		t.Errorf("expected the upload to succeed without a limit, got %d: %v", code, body)
+	}
+}
+
+func TestGetConfig(t *testing.T) {
+	cfg, _, cleanup := newUploadTest(t, 1024)
+	defer cleanup()
+	if body := responseBody(t, GetConfig(cfg).JSON); body["m.upload.size"] != float64(1024) {
+		t.Errorf("expected m.upload.size to be 1024, got %v", body)
+	}
+
+	// The limit is left out if uploads are unlimited.
+	*cfg.Media.MaxFileSizeBytes = 0
+	if body := responseBody(t, GetConfig(cfg).JSON); len(body) != 0 {
+		t.Errorf("expected no m.upload.size, got %v", body)
+	}
+}
@@ -27,4 +27,9 @@ type Database interface {
 	StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error
 	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error)
 	GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) ([]*types.ThumbnailMetadata, error)
+	UpdateMediaLastAccess(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, lastAccess types.UnixMs) error
+	SetMediaRetentionExempt(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, exempt bool) error
+	GetExpiredMedia(ctx context.Context, serverName gomatrixserverlib.ServerName, localBefore, remoteBefore types.UnixMs) ([]*types.MediaMetadata, error)
+	DeleteMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	MediaHashInUse(ctx context.Context, base64Hash types.Base64Hash) (bool, error)
 }
@@ -59,9 +59,19 @@ const selectMediaSQL = `
 SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
 `
 
+const deleteMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectMediaHashInUseSQL = `
+SELECT EXISTS(SELECT 1 FROM mediaapi_media_repository WHERE base64hash = $1)
+`
+
 type mediaStatements struct {
-	insertMediaStmt *sql.Stmt
-	selectMediaStmt *sql.Stmt
+	insertMediaStmt          *sql.Stmt
+	selectMediaStmt          *sql.Stmt
+	deleteMediaStmt          *sql.Stmt
+	selectMediaHashInUseStmt *sql.Stmt
 }
 
 func (s *mediaStatements) prepare(db *sql.DB) (err error) {
@@ -73,6 +83,8 @@ func (s *mediaStatements) prepare(db *sql.DB) (err error) {
 	return statementList{
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
+		{&s.deleteMediaStmt, deleteMediaSQL},
+		{&s.selectMediaHashInUseStmt, selectMediaHashInUseSQL},
 	}.prepare(db)
 }
 
@@ -113,3 +125,17 @@ func (s *mediaStatements) selectMedia(
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) deleteMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := s.deleteMediaStmt.ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *mediaStatements) selectMediaHashInUse(
+	ctx context.Context, base64Hash types.Base64Hash,
+) (inUse bool, err error) {
+	err = s.selectMediaHashInUseStmt.QueryRowContext(ctx, base64Hash).Scan(&inUse)
+	return
+}
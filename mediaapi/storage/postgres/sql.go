@@ -22,6 +22,7 @@ import (
 type statements struct {
 	media     mediaStatements
 	thumbnail thumbnailStatements
+	retention retentionStatements
 }
 
 func (s *statements) prepare(db *sql.DB) (err error) {
@@ -31,6 +32,9 @@ func (s *statements) prepare(db *sql.DB) (err error) {
 	if err = s.thumbnail.prepare(db); err != nil {
 		return
 	}
+	if err = s.retention.prepare(db); err != nil {
+		return
+	}
 
 	return
 }
@@ -0,0 +1,136 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const retentionSchema = `
+-- The mediaapi_media_retention table holds what the retention policy needs to know about
+-- each media file in the media_repository table. Media without a row hasn't been accessed
+-- since it was stored, and isn't exempt from the retention policy.
+CREATE TABLE IF NOT EXISTS mediaapi_media_retention (
+    media_id TEXT NOT NULL,
+    media_origin TEXT NOT NULL,
+    -- When the media was last downloaded in UNIX epoch ms.
+    last_access_ts INTEGER NOT NULL DEFAULT 0,
+    -- Whether the media is kept regardless of the retention policy.
+    exempt BOOLEAN NOT NULL DEFAULT false
+);
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_media_retention_index ON mediaapi_media_retention (media_id, media_origin);
+`
+
+const upsertLastAccessSQL = `
+INSERT INTO mediaapi_media_retention (media_id, media_origin, last_access_ts) VALUES ($1, $2, $3)
+    ON CONFLICT (media_id, media_origin) DO UPDATE SET last_access_ts = $3
+`
+
+const upsertExemptSQL = `
+INSERT INTO mediaapi_media_retention (media_id, media_origin, exempt) VALUES ($1, $2, $3)
+    ON CONFLICT (media_id, media_origin) DO UPDATE SET exempt = $3
+`
+
+const deleteRetentionSQL = `
+DELETE FROM mediaapi_media_retention WHERE media_id = $1 AND media_origin = $2
+`
+
+// Selects the media from the server $1 not accessed since $2, and the media
+// from other servers not accessed since $3.
+const selectExpiredMediaSQL = `
+SELECT m.media_id, m.media_origin, m.content_type, m.file_size_bytes, m.creation_ts, m.upload_name, m.base64hash, m.user_id
+    FROM mediaapi_media_repository m LEFT JOIN mediaapi_media_retention r
+    ON m.media_id = r.media_id AND m.media_origin = r.media_origin
+    WHERE NOT COALESCE(r.exempt, false) AND (
+        (m.media_origin = $1 AND MAX(m.creation_ts, COALESCE(r.last_access_ts, 0)) < $2) OR
+        (m.media_origin != $1 AND MAX(m.creation_ts, COALESCE(r.last_access_ts, 0)) < $3)
+    )
+`
+
+type retentionStatements struct {
+	upsertLastAccessStmt   *sql.Stmt
+	upsertExemptStmt       *sql.Stmt
+	deleteRetentionStmt    *sql.Stmt
+	selectExpiredMediaStmt *sql.Stmt
+}
+
+func (s *retentionStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(retentionSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.upsertLastAccessStmt, upsertLastAccessSQL},
+		{&s.upsertExemptStmt, upsertExemptSQL},
+		{&s.deleteRetentionStmt, deleteRetentionSQL},
+		{&s.selectExpiredMediaStmt, selectExpiredMediaSQL},
+	}.prepare(db)
+}
+
+func (s *retentionStatements) upsertLastAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, lastAccess types.UnixMs,
+) error {
+	_, err := s.upsertLastAccessStmt.ExecContext(ctx, mediaID, mediaOrigin, lastAccess)
+	return err
+}
+
+func (s *retentionStatements) upsertExempt(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, exempt bool,
+) error {
+	_, err := s.upsertExemptStmt.ExecContext(ctx, mediaID, mediaOrigin, exempt)
+	return err
+}
+
+func (s *retentionStatements) deleteRetention(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := s.deleteRetentionStmt.ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *retentionStatements) selectExpiredMedia(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, localBefore, remoteBefore types.UnixMs,
+) ([]*types.MediaMetadata, error) {
+	rows, err := s.selectExpiredMediaStmt.QueryContext(ctx, serverName, localBefore, remoteBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectExpiredMedia: rows.close() failed")
+
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		var mediaMetadata types.MediaMetadata
+		if err = rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, &mediaMetadata)
+	}
+	return media, rows.Err()
+}
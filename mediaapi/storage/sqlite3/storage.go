@@ -34,10 +34,15 @@ type Database struct {
 }
 
 // Open opens a postgres database.
-func Open(dataSourceName string) (*Database, error) {
+func Open(dataSourceName string, dbProperties sqlutil.DbProperties) (*Database, error) {
 	var d Database
 	var err error
-	if d.db, err = sqlutil.Open(common.SQLiteDriverName(), dataSourceName); err != nil {
+	if d.db, err = sqlutil.Open(common.SQLiteDriverName(), dataSourceName, dbProperties); err != nil {
+		return nil, err
+	}
+	migrator := common.NewMigrator(d.db, "mediaapi")
+	migrator.AddMigrations(common.BaselineMigration)
+	if err = migrator.Up(context.Background()); err != nil {
 		return nil, err
 	}
 	if err = d.statements.prepare(d.db); err != nil {
@@ -46,6 +51,11 @@ func Open(dataSourceName string) (*Database, error) {
 	return &d, nil
 }
 
+// Ping checks that the database can be reached.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
 // StoreMediaMetadata inserts the metadata about the uploaded media into the database.
 // Returns an error if the combination of MediaID and Origin are not unique in the table.
 func (d *Database) StoreMediaMetadata(
@@ -106,3 +116,49 @@ func (d *Database) GetThumbnails(
 	}
 	return thumbnails, err
 }
+
+// UpdateMediaLastAccess records when media stored on this server was last
+// downloaded, so that the retention policy keeps media which is still used.
+func (d *Database) UpdateMediaLastAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, lastAccess types.UnixMs,
+) error {
+	return d.statements.retention.upsertLastAccess(ctx, mediaID, mediaOrigin, lastAccess)
+}
+
+// SetMediaRetentionExempt sets whether media stored on this server is kept
+// regardless of the retention policy.
+func (d *Database) SetMediaRetentionExempt(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, exempt bool,
+) error {
+	return d.statements.retention.upsertExempt(ctx, mediaID, mediaOrigin, exempt)
+}
+
+// GetExpiredMedia returns metadata about the media which isn't exempt from the
+// retention policy and hasn't been stored or downloaded since localBefore, for
+// media uploaded to the given server, or since remoteBefore, for media cached
+// from other servers.
+func (d *Database) GetExpiredMedia(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, localBefore, remoteBefore types.UnixMs,
+) ([]*types.MediaMetadata, error) {
+	return d.statements.retention.selectExpiredMedia(ctx, serverName, localBefore, remoteBefore)
+}
+
+// DeleteMedia removes the metadata about media stored on this server and its
+// thumbnails. The files are stored separately and aren't removed.
+func (d *Database) DeleteMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	if err := d.statements.thumbnail.deleteThumbnails(ctx, mediaID, mediaOrigin); err != nil {
+		return err
+	}
+	if err := d.statements.retention.deleteRetention(ctx, mediaID, mediaOrigin); err != nil {
+		return err
+	}
+	return d.statements.media.deleteMedia(ctx, mediaID, mediaOrigin)
+}
+
+// MediaHashInUse returns whether any media stored on this server has the given
+// hash, and so is stored in the file for that hash.
+func (d *Database) MediaHashInUse(ctx context.Context, base64Hash types.Base64Hash) (bool, error) {
+	return d.statements.media.selectMediaHashInUse(ctx, base64Hash)
+}
@@ -67,6 +67,10 @@ func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailM
 		if desired.ResizeMethod == types.Scale && thumbnail.ThumbnailSize.ResizeMethod != types.Scale {
 			continue
 		}
+		// Animated thumbnails are only served when they are asked for
+		if method := thumbnail.ThumbnailSize.ResizeMethod; method == types.AnimatedCrop || method == types.AnimatedScale {
+			continue
+		}
 		fitness := calcThumbnailFitness(thumbnail.ThumbnailSize, thumbnail.MediaMetadata, desired)
 		if isBetter := fitness.betterThan(bestFit, desired.ResizeMethod == types.Crop); isBetter {
 			bestFit = fitness
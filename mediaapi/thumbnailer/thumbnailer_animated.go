@@ -0,0 +1,252 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !bimg
+
+package thumbnailer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits on the animated images which are thumbnailed, as every frame is
+// decoded into memory. Images over either limit get a static thumbnail.
+const (
+	maxAnimatedFrames = 250
+	maxAnimatedPixels = 64 * 1024 * 1024
+)
+
+// GenerateAnimatedThumbnail generates an animated GIF thumbnail of the
+// configured size for an animated source file. The thumbnail is stored under
+// types.AnimatedResizeMethod of the configured resize method. If the source
+// file isn't animated, or can't be decoded within the limits, no thumbnail is
+// generated and the caller should fall back to a static thumbnail.
+func GenerateAnimatedThumbnail(
+	ctx context.Context,
+	src types.Path,
+	config types.ThumbnailSize,
+	mediaMetadata *types.MediaMetadata,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	maxThumbnailGenerators int,
+	db storage.Database,
+	logger *log.Entry,
+) (busy bool, errorReturn error) {
+	// TODO: Animated PNGs are thumbnailed as static images, as there is no
+	// APNG decoder.
+	if mediaMetadata.ContentType != "image/gif" {
+		return false, nil
+	}
+	img, err := readAnimatedFile(string(src))
+	if err != nil {
+		logger.WithError(err).WithField("src", src).Warn("Failed to read animated src file, falling back to a static thumbnail")
+		return false, nil
+	}
+	if len(img.Image) < 2 {
+		return false, nil
+	}
+	if int64(len(img.Image))*int64(config.Width)*int64(config.Height) > maxAnimatedPixels {
+		logger.WithField("src", src).Warn("Animated thumbnail is too large, falling back to a static thumbnail")
+		return false, nil
+	}
+	crop := config.ResizeMethod == types.Crop
+	config.ResizeMethod = types.AnimatedResizeMethod(config.ResizeMethod)
+	// Note: storeThumbnail does locking based on activeThumbnailGeneration
+	busy, err = storeThumbnail(
+		ctx, src, image.Rect(0, 0, img.Config.Width, img.Config.Height), config,
+		types.ContentType("image/gif"), mediaMetadata, activeThumbnailGeneration,
+		maxThumbnailGenerators, db, logger,
+		func(dst types.Path) (int, int, error) {
+			return adjustAnimatedSize(dst, img, config.Width, config.Height, crop, logger)
+		},
+	)
+	if err != nil {
+		logger.WithError(err).WithField("src", src).Error("Failed to generate animated thumbnail")
+		return false, err
+	}
+	return busy, nil
+}
+
+// readAnimatedFile decodes every frame of a GIF, having first checked that
+// decoding it won't go over the frame and pixel limits.
+func readAnimatedFile(src string) (*gif.GIF, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // nolint: errcheck
+
+	config, err := gif.DecodeConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	frames, err := countGIFFrames(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	if frames > maxAnimatedFrames {
+		return nil, fmt.Errorf("too many frames: %d", frames)
+	}
+	if int64(frames)*int64(config.Width)*int64(config.Height) > maxAnimatedPixels {
+		return nil, fmt.Errorf("too many pixels: %d frames of %dx%d", frames, config.Width, config.Height)
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return gif.DecodeAll(file)
+}
+
+// countGIFFrames counts the frames of a GIF by walking its blocks without
+// decompressing any image data.
+func countGIFFrames(r *bufio.Reader) (int, error) {
+	var header [13]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	// The logical screen descriptor may be followed by a global colour table
+	if err := skipColorTable(r, header[10]); err != nil {
+		return 0, err
+	}
+	frames := 0
+	for {
+		introducer, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch introducer {
+		case 0x21: // extension
+			if _, err = r.ReadByte(); err != nil {
+				return 0, err
+			}
+		case 0x2C: // image descriptor
+			var descriptor [9]byte
+			if _, err = io.ReadFull(r, descriptor[:]); err != nil {
+				return 0, err
+			}
+			if err = skipColorTable(r, descriptor[8]); err != nil {
+				return 0, err
+			}
+			// LZW minimum code size
+			if _, err = r.ReadByte(); err != nil {
+				return 0, err
+			}
+			frames++
+			if frames > maxAnimatedFrames {
+				return frames, nil
+			}
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, errors.New("gif: unknown block type")
+		}
+		if err = skipSubBlocks(r); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func skipColorTable(r *bufio.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	_, err := r.Discard(3 * (1 << (flags&0x07 + 1)))
+	return err
+}
+
+func skipSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err = r.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// adjustAnimatedSize scales every frame of an animated GIF in the same way as
+// adjustSize, keeping the timing of the frames.
+func adjustAnimatedSize(dst types.Path, img *gif.GIF, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+	out := &gif.GIF{
+		LoopCount: img.LoopCount,
+	}
+	// Frames may only cover part of the image, so each frame is drawn onto
+	// the whole image before it is scaled.
+	canvas := image.NewRGBA(image.Rect(0, 0, img.Config.Width, img.Config.Height))
+	for i, frame := range img.Image {
+		var disposal byte
+		if i < len(img.Disposal) {
+			disposal = img.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		scaled := resizeImage(canvas, w, h, crop)
+		paletted := image.NewPaletted(scaled.Bounds(), frame.Palette)
+		draw.Draw(paletted, paletted.Bounds(), scaled, scaled.Bounds().Min, draw.Src)
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, img.Delay[i])
+		// Every scaled frame is the whole image so replaces the one before it
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	if err := writeAnimatedFile(out, string(dst)); err != nil {
+		logger.WithError(err).Error("Failed to encode and write animated image")
+		return -1, -1, err
+	}
+
+	bounds := out.Image[0].Bounds()
+	return bounds.Max.X, bounds.Max.Y, nil
+}
+
+func writeAnimatedFile(img *gif.GIF, dst string) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err = gif.EncodeAll(out, img); err != nil {
+		out.Close() // nolint: errcheck
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !bimg
+
+package thumbnailer
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// thumbnailRecorder records the thumbnails stored in the database.
+type thumbnailRecorder struct {
+	storage.Database
+	thumbnails []*types.ThumbnailMetadata
+}
+
+func (db *thumbnailRecorder) GetThumbnail(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+	width, height int, resizeMethod string,
+) (*types.ThumbnailMetadata, error) {
+	return nil, nil
+}
+
+func (db *thumbnailRecorder) StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error {
+	db.thumbnails = append(db.thumbnails, thumbnailMetadata)
+	return nil
+}
+
+// writeTestGIF writes a GIF of 64x32 with the given number of frames, each
+// frame being a different colour.
+func writeTestGIF(t *testing.T, path string, frames int) {
+	palette := color.Palette{color.Black, color.White, color.RGBA{0xff, 0, 0, 0xff}}
+	img := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 64, 32), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i % len(palette))
+		}
+		img.Image = append(img.Image, frame)
+		img.Delay = append(img.Delay, 10*(i+1))
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close() // nolint: errcheck
+	if err = gif.EncodeAll(file, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func generateAnimatedThumbnail(
+	t *testing.T, src string, contentType types.ContentType, size types.ThumbnailSize,
+) *thumbnailRecorder {
+	db := &thumbnailRecorder{}
+	busy, err := GenerateAnimatedThumbnail(
+		context.Background(), types.Path(src), size,
+		&types.MediaMetadata{MediaID: "test", Origin: "localhost", ContentType: contentType},
+		&types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+		10, db, log.WithField("test", t.Name()),
+	)
+	if err != nil || busy {
+		t.Fatalf("failed to generate animated thumbnail: busy %v, %v", busy, err)
+	}
+	return db
+}
+
+func TestGenerateAnimatedThumbnail(t *testing.T) {
+	for _, test := range []struct {
+		size                      types.ThumbnailSize
+		resizeMethod              string
+		expectWidth, expectHeight int
+	}{
+		{types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Scale}, types.AnimatedScale, 32, 16},
+		{types.ThumbnailSize{Width: 16, Height: 16, ResizeMethod: types.Crop}, types.AnimatedCrop, 16, 16},
+	} {
+		dir, err := ioutil.TempDir("", "thumbnailer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		src := filepath.Join(dir, "content")
+		writeTestGIF(t, src, 3)
+
+		db := generateAnimatedThumbnail(t, src, "image/gif", test.size)
+		if len(db.thumbnails) != 1 {
+			t.Fatalf("expected one thumbnail to be stored, got %d", len(db.thumbnails))
+		}
+		stored := db.thumbnails[0]
+		if stored.MediaMetadata.ContentType != "image/gif" || stored.ThumbnailSize.ResizeMethod != test.resizeMethod {
+			t.Errorf("expected an image/gif thumbnail stored as %s, got %s stored as %s",
+				test.resizeMethod, stored.MediaMetadata.ContentType, stored.ThumbnailSize.ResizeMethod)
+		}
+
+		file, err := os.Open(string(GetThumbnailPath(types.Path(src), stored.ThumbnailSize)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		thumbnail, err := gif.DecodeAll(file)
+		file.Close() // nolint: errcheck
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(thumbnail.Image) != 3 {
+			t.Fatalf("expected the thumbnail to have 3 frames, got %d", len(thumbnail.Image))
+		}
+		for i, frame := range thumbnail.Image {
+			if frame.Bounds().Dx() != test.expectWidth || frame.Bounds().Dy() != test.expectHeight {
+				t.Errorf("expected frame %d to be %dx%d, got %v", i, test.expectWidth, test.expectHeight, frame.Bounds())
+			}
+			if thumbnail.Delay[i] != 10*(i+1) {
+				t.Errorf("expected frame %d to have a delay of %d, got %d", i, 10*(i+1), thumbnail.Delay[i])
+			}
+		}
+		if r, g, b, _ := thumbnail.Image[1].At(0, 0).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff {
+			t.Errorf("expected the second frame to be white, got %v", thumbnail.Image[1].At(0, 0))
+		}
+	}
+}
+
+func TestGenerateAnimatedThumbnailFallsBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	size := types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Scale}
+
+	static := filepath.Join(dir, "static")
+	writeTestGIF(t, static, 1)
+	tooLong := filepath.Join(dir, "too-long")
+	writeTestGIF(t, tooLong, maxAnimatedFrames+1)
+	broken := filepath.Join(dir, "broken")
+	if err = ioutil.WriteFile(broken, []byte("GIF89a not really"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name        string
+		src         string
+		contentType types.ContentType
+	}{
+		{"single frame", static, "image/gif"},
+		{"not a gif", tooLong, "image/png"},
+		{"too many frames", tooLong, "image/gif"},
+		{"undecodable", broken, "image/gif"},
+	} {
+		if db := generateAnimatedThumbnail(t, test.src, test.contentType, size); len(db.thumbnails) != 0 {
+			t.Errorf("%s: expected no animated thumbnail, got %d", test.name, len(db.thumbnails))
+		}
+	}
+}
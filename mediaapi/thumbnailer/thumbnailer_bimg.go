@@ -62,6 +62,23 @@ func GenerateThumbnails(
 	return false, nil
 }
 
+// GenerateAnimatedThumbnail generates an animated thumbnail of the configured
+// size for an animated source file.
+// TODO: Animated thumbnails aren't generated with bimg, so the caller always
+// falls back to a static thumbnail.
+func GenerateAnimatedThumbnail(
+	ctx context.Context,
+	src types.Path,
+	config types.ThumbnailSize,
+	mediaMetadata *types.MediaMetadata,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	maxThumbnailGenerators int,
+	db *storage.Database,
+	logger *log.Entry,
+) (busy bool, errorReturn error) {
+	return false, nil
+}
+
 // GenerateThumbnail generates the configured thumbnail size for the source file
 func GenerateThumbnail(
 	ctx context.Context,
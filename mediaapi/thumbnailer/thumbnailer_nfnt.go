@@ -144,6 +144,31 @@ func createThumbnail(
 	maxThumbnailGenerators int,
 	db storage.Database,
 	logger *log.Entry,
+) (busy bool, errorReturn error) {
+	// Note: the code currently always creates a JPEG thumbnail
+	return storeThumbnail(
+		ctx, src, img.Bounds(), config, types.ContentType("image/jpeg"), mediaMetadata,
+		activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
+		func(dst types.Path) (int, int, error) {
+			return adjustSize(dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, logger)
+		},
+	)
+}
+
+// storeThumbnail checks if the thumbnail exists, and if not, writes it to dst
+// with the write function and stores its metadata in the database.
+func storeThumbnail(
+	ctx context.Context,
+	src types.Path,
+	bounds image.Rectangle,
+	config types.ThumbnailSize,
+	contentType types.ContentType,
+	mediaMetadata *types.MediaMetadata,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	maxThumbnailGenerators int,
+	db storage.Database,
+	logger *log.Entry,
+	write func(dst types.Path) (width, height int, err error),
 ) (busy bool, errorReturn error) {
 	logger = logger.WithFields(log.Fields{
 		"Width":        config.Width,
@@ -152,7 +177,7 @@ func createThumbnail(
 	})
 
 	// Check if request is larger than original
-	if config.Width >= img.Bounds().Dx() && config.Height >= img.Bounds().Dy() {
+	if config.Width >= bounds.Dx() && config.Height >= bounds.Dy() {
 		return false, nil
 	}
 
@@ -186,7 +211,7 @@ func createThumbnail(
 	}
 
 	start := time.Now()
-	width, height, err := adjustSize(dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, logger)
+	width, height, err := write(dst)
 	if err != nil {
 		return false, err
 	}
@@ -203,10 +228,9 @@ func createThumbnail(
 
 	thumbnailMetadata := &types.ThumbnailMetadata{
 		MediaMetadata: &types.MediaMetadata{
-			MediaID: mediaMetadata.MediaID,
-			Origin:  mediaMetadata.Origin,
-			// Note: the code currently always creates a JPEG thumbnail
-			ContentType:   types.ContentType("image/jpeg"),
+			MediaID:       mediaMetadata.MediaID,
+			Origin:        mediaMetadata.Origin,
+			ContentType:   contentType,
 			FileSizeBytes: types.FileSizeBytes(stat.Size()),
 		},
 		ThumbnailSize: types.ThumbnailSize{
@@ -232,40 +256,42 @@ func createThumbnail(
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
 func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
-	var out image.Image
-	var err error
-	if crop {
-		inAR := float64(img.Bounds().Dx()) / float64(img.Bounds().Dy())
-		outAR := float64(w) / float64(h)
-
-		var scaleW, scaleH uint
-		if inAR > outAR {
-			// input has shorter AR than requested output so use requested height and calculate width to match input AR
-			scaleW = uint(float64(h) * inAR)
-			scaleH = uint(h)
-		} else {
-			// input has taller AR than requested output so use requested width and calculate height to match input AR
-			scaleW = uint(w)
-			scaleH = uint(float64(w) / inAR)
-		}
+	out := resizeImage(img, w, h, crop)
+	if err := writeFile(out, string(dst)); err != nil {
+		logger.WithError(err).Error("Failed to encode and write image")
+		return -1, -1, err
+	}
 
-		scaled := resize.Resize(scaleW, scaleH, img, resize.Lanczos3)
+	return out.Bounds().Max.X, out.Bounds().Max.Y, nil
+}
 
-		xoff := (scaled.Bounds().Dx() - w) / 2
-		yoff := (scaled.Bounds().Dy() - h) / 2
+// resizeImage scales an image in the same way as adjustSize
+func resizeImage(img image.Image, w, h int, crop bool) image.Image {
+	if !crop {
+		return resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
+	}
 
-		tr := image.Rect(0, 0, w, h)
-		target := image.NewRGBA(tr)
-		draw.Draw(target, tr, scaled, image.Pt(xoff, yoff), draw.Src)
-		out = target
+	inAR := float64(img.Bounds().Dx()) / float64(img.Bounds().Dy())
+	outAR := float64(w) / float64(h)
+
+	var scaleW, scaleH uint
+	if inAR > outAR {
+		// input has shorter AR than requested output so use requested height and calculate width to match input AR
+		scaleW = uint(float64(h) * inAR)
+		scaleH = uint(h)
 	} else {
-		out = resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
+		// input has taller AR than requested output so use requested width and calculate height to match input AR
+		scaleW = uint(w)
+		scaleH = uint(float64(w) / inAR)
 	}
 
-	if err = writeFile(out, string(dst)); err != nil {
-		logger.WithError(err).Error("Failed to encode and write image")
-		return -1, -1, err
-	}
+	scaled := resize.Resize(scaleW, scaleH, img, resize.Lanczos3)
 
-	return out.Bounds().Max.X, out.Bounds().Max.Y, nil
+	xoff := (scaled.Bounds().Dx() - w) / 2
+	yoff := (scaled.Bounds().Dy() - h) / 2
+
+	tr := image.Rect(0, 0, w, h)
+	target := image.NewRGBA(tr)
+	draw.Draw(target, tr, scaled, image.Pt(xoff, yoff), draw.Src)
+	return target
 }
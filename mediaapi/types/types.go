@@ -108,3 +108,20 @@ const Crop = "crop"
 
 // Scale indicates we should scale the thumbnail on resize
 const Scale = "scale"
+
+// AnimatedCrop and AnimatedScale are the resize methods animated thumbnails
+// are stored under, so that they sit alongside the static thumbnails of the
+// same size rather than replacing them.
+const (
+	AnimatedCrop  = "crop-animated"
+	AnimatedScale = "scale-animated"
+)
+
+// AnimatedResizeMethod returns the resize method of an animated thumbnail
+// resized with the given method.
+func AnimatedResizeMethod(resizeMethod string) string {
+	if resizeMethod == Crop {
+		return AnimatedCrop
+	}
+	return AnimatedScale
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/publicroomsapi/storage"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GetPostPublicRoomsFromServer implements GET and POST /publicRooms?server=
+// It fetches the public rooms directory of a remote server over federation.
+// The pagination tokens belong to the remote server, so they are passed on to
+// it as they are. Requests to I2P servers go over SAM like all federation
+// requests.
+func GetPostPublicRoomsFromServer(
+	req *http.Request, cfg *config.Dendrite,
+	fedClient *gomatrixserverlib.FederationClient, serverName gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	var request PublicRoomReq
+	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
+		return *fillErr
+	}
+
+	// The GET variant of the federation API can't filter, so the POST variant
+	// is only used when there is a search term.
+	var fedReq gomatrixserverlib.FederationRequest
+	if request.Filter.SearchTerms == "" {
+		query := url.Values{}
+		if request.Limit > 0 {
+			query.Set("limit", strconv.Itoa(int(request.Limit)))
+		}
+		if request.Since != "" {
+			query.Set("since", request.Since)
+		}
+		u := url.URL{Path: "/_matrix/federation/v1/publicRooms", RawQuery: query.Encode()}
+		fedReq = gomatrixserverlib.NewFederationRequest(http.MethodGet, serverName, u.RequestURI())
+	} else {
+		fedReq = gomatrixserverlib.NewFederationRequest(http.MethodPost, serverName, "/_matrix/federation/v1/publicRooms")
+		if err := fedReq.SetContent(request); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("fedReq.SetContent failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	if err := fedReq.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fedReq.Sign failed")
+		return jsonerror.InternalServerError()
+	}
+	httpReq, err := fedReq.HTTPRequest()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fedReq.HTTPRequest failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var response gomatrixserverlib.RespPublicRooms
+	if err = fedClient.DoRequestAndParseResponse(req.Context(), httpReq, &response); err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("server", serverName).Warn(
+			"Failed to fetch the public rooms of a remote server",
+		)
+		if httpErr, ok := err.(gomatrix.HTTPError); ok && httpErr.Code == http.StatusBadRequest {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(httpErr.Message),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to fetch the public rooms of " + string(serverName)),
+		}
+	}
+	if response.Chunk == nil {
+		response.Chunk = []gomatrixserverlib.PublicRoom{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: response,
+	}
+}
+
+// GetPostPublicRoomsForFederation implements GET and POST /_matrix/federation/v1/publicRooms
+// Only the local rooms are returned, as remote servers fetch the directories of
+// other servers themselves.
+func GetPostPublicRoomsForFederation(
+	req *http.Request, fedReq *gomatrixserverlib.FederationRequest, publicRoomDatabase storage.Database,
+) util.JSONResponse {
+	var request PublicRoomReq
+	if req.Method == http.MethodPost {
+		// The body of the request has already been read to check its
+		// signature, so the content comes from the federation request.
+		if err := json.Unmarshal(fedReq.Content(), &request); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+	} else if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
+		return *fillErr
+	}
+	if resErr := checkPublicRoomsToken(request.Since); resErr != nil {
+		return *resErr
+	}
+	response, err := publicRooms(req.Context(), request, publicRoomDatabase)
+	if err != nil {
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: response,
+	}
+}
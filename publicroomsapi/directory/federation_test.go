@@ -0,0 +1,121 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// testRemoteDirectory is a remote server with a single public room, which
+// records the requests made to its directory.
+type testRemoteDirectory struct {
+	requests []*http.Request
+	bodies   []string
+}
+
+func (d *testRemoteDirectory) RoundTrip(req *http.Request) (*http.Response, error) {
+	d.requests = append(d.requests, req)
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+	d.bodies = append(d.bodies, string(body))
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body: ioutil.NopCloser(bytes.NewBufferString(`{
+			"chunk":[{"room_id":"!remote:example.org","name":"Remote","num_joined_members":4,"world_readable":false,"guest_can_join":false}],
+			"next_batch":"remote-next","total_room_count_estimate":10
+		}`)),
+		Request: req,
+	}, nil
+}
+
+func testRemotePublicRooms(t *testing.T, req *http.Request) (*testRemoteDirectory, gomatrixserverlib.RespPublicRooms) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = privateKey
+
+	remote := &testRemoteDirectory{}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", remote)
+	fedClient := gomatrixserverlib.NewFederationClientWithTransport(
+		cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, tr,
+	)
+
+	res := GetPostPublicRoomsFromServer(req, cfg, fedClient, "example.org")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	if len(remote.requests) != 1 {
+		t.Fatalf("expected one request to the remote server, got %d", len(remote.requests))
+	}
+	if remote.requests[0].URL.Host != "example.org" || remote.requests[0].Header.Get("Authorization") == "" {
+		t.Errorf("expected a signed request to example.org, got %s", remote.requests[0].URL)
+	}
+	return remote, res.JSON.(gomatrixserverlib.RespPublicRooms)
+}
+
+func TestPublicRoomsFromServerPassesThroughPagination(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/publicRooms?server=example.org&limit=5&since=remote-token", nil)
+	remote, res := testRemotePublicRooms(t, req)
+
+	fedReq := remote.requests[0]
+	if fedReq.Method != http.MethodGet || fedReq.URL.Path != "/_matrix/federation/v1/publicRooms" {
+		t.Errorf("expected GET /_matrix/federation/v1/publicRooms, got %s %s", fedReq.Method, fedReq.URL.Path)
+	}
+	if query := fedReq.URL.Query(); query.Get("limit") != "5" || query.Get("since") != "remote-token" {
+		t.Errorf("expected limit and since to be passed on, got %s", fedReq.URL.RawQuery)
+	}
+	if len(res.Chunk) != 1 || res.Chunk[0].RoomID != "!remote:example.org" || res.NextBatch != "remote-next" {
+		t.Errorf("expected the remote directory to be returned, got %+v", res)
+	}
+}
+
+func TestPublicRoomsFromServerWithSearchTerm(t *testing.T) {
+	req := httptest.NewRequest(
+		http.MethodPost, "/_matrix/client/r0/publicRooms?server=example.org",
+		bytes.NewBufferString(`{"limit":3,"since":"remote-token","filter":{"generic_search_term":"cats"}}`),
+	)
+	remote, _ := testRemotePublicRooms(t, req)
+
+	if method := remote.requests[0].Method; method != http.MethodPost {
+		t.Fatalf("expected searches to use POST, got %s", method)
+	}
+	var body PublicRoomReq
+	if err := json.Unmarshal([]byte(remote.bodies[0]), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Limit != 3 || body.Since != "remote-token" || body.Filter.SearchTerms != "cats" {
+		t.Errorf("expected the request to be passed on, got %s", remote.bodies[0])
+	}
+}
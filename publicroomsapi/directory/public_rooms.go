@@ -16,8 +16,10 @@ package directory
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -47,6 +49,9 @@ func GetPostPublicRooms(
 	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
 		return *fillErr
 	}
+	if resErr := checkPublicRoomsToken(request.Since); resErr != nil {
+		return *resErr
+	}
 	response, err := publicRooms(req.Context(), request, publicRoomDatabase)
 	if err != nil {
 		return jsonerror.InternalServerError()
@@ -66,6 +71,9 @@ func GetPostPublicRoomsWithExternal(
 	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
 		return *fillErr
 	}
+	if resErr := checkPublicRoomsToken(request.Since); resErr != nil {
+		return *resErr
+	}
 	response, err := publicRooms(req.Context(), request, publicRoomDatabase)
 	if err != nil {
 		return jsonerror.InternalServerError()
@@ -173,16 +181,54 @@ FanIn:
 	return publicRooms
 }
 
+// The pagination tokens of the public rooms directory are the position of a
+// room in it, prefixed by whether the rooms after or before it are wanted. A
+// room keeps its position when other rooms are added, so paginating doesn't
+// skip or repeat rooms while the directory changes.
+const (
+	nextBatchPrefix = "n"
+	prevBatchPrefix = "p"
+)
+
+// makePublicRoomsToken returns the token for the rooms after the given room or,
+// if backwards is true, for the rooms before it.
+func makePublicRoomsToken(room gomatrixserverlib.PublicRoom, backwards bool) string {
+	prefix := nextBatchPrefix
+	if backwards {
+		prefix = prevBatchPrefix
+	}
+	return fmt.Sprintf("%s%d_%s", prefix, room.JoinedMembersCount, room.RoomID)
+}
+
+// parsePublicRoomsToken parses a pagination token made by makePublicRoomsToken.
+// An empty token is the start of the directory, and parses as a nil position.
+func parsePublicRoomsToken(token string) (from *types.PublicRoomsPosition, backwards bool, err error) {
+	if token == "" {
+		return nil, false, nil
+	}
+	switch token[:1] {
+	case nextBatchPrefix:
+	case prevBatchPrefix:
+		backwards = true
+	default:
+		return nil, false, fmt.Errorf("invalid pagination token %q", token)
+	}
+	// Room IDs can contain underscores, but the member count can't.
+	parts := strings.SplitN(token[1:], "_", 2)
+	if len(parts) != 2 {
+		return nil, false, fmt.Errorf("invalid pagination token %q", token)
+	}
+	joinedMembers, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid pagination token %q", token)
+	}
+	return &types.PublicRoomsPosition{JoinedMembers: joinedMembers, RoomID: parts[1]}, backwards, nil
+}
+
 func publicRooms(ctx context.Context, request PublicRoomReq, publicRoomDatabase storage.Database) (*gomatrixserverlib.RespPublicRooms, error) {
 	var response gomatrixserverlib.RespPublicRooms
-	var limit int16
-	var offset int64
-	limit = request.Limit
-	offset, err := strconv.ParseInt(request.Since, 10, 64)
-	// ParseInt returns 0 and an error when trying to parse an empty string
-	// In that case, we want to assign 0 so we ignore the error
-	if err != nil && len(request.Since) > 0 {
-		util.GetLogger(ctx).WithError(err).Error("strconv.ParseInt failed")
+	from, backwards, err := parsePublicRoomsToken(request.Since)
+	if err != nil {
 		return nil, err
 	}
 
@@ -193,21 +239,50 @@ func publicRooms(ctx context.Context, request PublicRoomReq, publicRoomDatabase
 	}
 	response.TotalRoomCountEstimate = int(est)
 
-	if offset > 0 {
-		response.PrevBatch = strconv.Itoa(int(offset) - 1)
+	// One more room than the limit is fetched to find out whether there are
+	// more rooms after this batch.
+	limit := int(request.Limit)
+	fetchLimit := 0
+	if limit > 0 {
+		fetchLimit = limit + 1
 	}
-	nextIndex := int(offset) + int(limit)
-	if response.TotalRoomCountEstimate > nextIndex {
-		response.NextBatch = strconv.Itoa(nextIndex)
-	}
-
-	if response.Chunk, err = publicRoomDatabase.GetPublicRooms(
-		ctx, offset, limit, request.Filter.SearchTerms,
-	); err != nil {
+	rooms, err := publicRoomDatabase.GetPublicRooms(
+		ctx, from, backwards, fetchLimit, request.Filter.SearchTerms,
+	)
+	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("publicRoomDatabase.GetPublicRooms failed")
 		return nil, err
 	}
+	more := limit > 0 && len(rooms) > limit
+	if more {
+		if backwards {
+			// The rooms before the position are in the order of the
+			// directory, so the extra room is the first one.
+			rooms = rooms[1:]
+		} else {
+			rooms = rooms[:limit]
+		}
+	}
+	response.Chunk = rooms
+	if len(rooms) == 0 {
+		return &response, nil
+	}
 
+	first, last := rooms[0], rooms[len(rooms)-1]
+	if backwards {
+		// Paginating backwards started from a room after this batch.
+		response.NextBatch = makePublicRoomsToken(last, false)
+		if more {
+			response.PrevBatch = makePublicRoomsToken(first, true)
+		}
+	} else {
+		if from != nil {
+			response.PrevBatch = makePublicRoomsToken(first, true)
+		}
+		if more {
+			response.NextBatch = makePublicRoomsToken(last, false)
+		}
+	}
 	return &response, nil
 }
 
@@ -226,13 +301,27 @@ func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSO
 		}
 		request.Limit = int16(limit)
 		request.Since = httpReq.FormValue("since")
-		return nil
 	} else if httpReq.Method == http.MethodPost {
-		return httputil.UnmarshalJSONRequest(httpReq, request)
+		if resErr := httputil.UnmarshalJSONRequest(httpReq, request); resErr != nil {
+			return resErr
+		}
+	} else {
+		return &util.JSONResponse{
+			Code: http.StatusMethodNotAllowed,
+			JSON: jsonerror.NotFound("Bad method"),
+		}
 	}
+	return nil
+}
 
-	return &util.JSONResponse{
-		Code: http.StatusMethodNotAllowed,
-		JSON: jsonerror.NotFound("Bad method"),
+// checkPublicRoomsToken returns an error response if the since token of a
+// request for the local public rooms isn't valid.
+func checkPublicRoomsToken(since string) *util.JSONResponse {
+	if _, _, err := parsePublicRoomsToken(since); err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
 	}
+	return nil
 }
@@ -0,0 +1,179 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !wasm
+// +build !wasm
+
+package directory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/publicroomsapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func newTestDatabase(t *testing.T) (storage.Database, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-publicrooms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.NewPublicRoomsServerDatabase("file:"+filepath.Join(dir, "publicrooms.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, func() { _ = os.RemoveAll(dir) }
+}
+
+// addRoom adds a public room with the given name, topic and number of joined
+// members to the directory.
+func addRoom(t *testing.T, db storage.Database, roomID, name, topic string, members int) {
+	stateEvent := func(eventType, stateKey string, content interface{}) {
+		contentJSON, err := json.Marshal(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eventJSON := fmt.Sprintf(
+			`{"event_id":"$%s%s:localhost","room_id":%q,"sender":"@alice:localhost","type":%q,"state_key":%q,"content":%s}`,
+			eventType, stateKey, roomID, eventType, stateKey, contentJSON,
+		)
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.UpdateRoomFromEvent(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stateEvent("m.room.create", "", map[string]string{"creator": "@alice:localhost"})
+	stateEvent("m.room.name", "", map[string]string{"name": name})
+	stateEvent("m.room.topic", "", map[string]string{"topic": topic})
+	for i := 0; i < members; i++ {
+		stateEvent("m.room.member", fmt.Sprintf("@user%d:localhost", i), map[string]string{"membership": "join"})
+	}
+	if err := db.SetRoomVisibility(context.Background(), true, roomID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getPublicRooms(t *testing.T, db storage.Database, request PublicRoomReq) *gomatrixserverlib.RespPublicRooms {
+	res, err := publicRooms(context.Background(), request, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func roomIDs(rooms []gomatrixserverlib.PublicRoom) (ids []string) {
+	for _, room := range rooms {
+		ids = append(ids, room.RoomID)
+	}
+	return
+}
+
+func TestPublicRoomsPagination(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	addRoom(t, db, "!a:localhost", "A", "", 5)
+	addRoom(t, db, "!b:localhost", "B", "", 3)
+	addRoom(t, db, "!c:localhost", "C", "", 3)
+	addRoom(t, db, "!d:localhost", "D", "", 2)
+	addRoom(t, db, "!e:localhost", "E", "", 1)
+
+	first := getPublicRooms(t, db, PublicRoomReq{Limit: 2})
+	if ids := roomIDs(first.Chunk); !reflect.DeepEqual(ids, []string{"!a:localhost", "!b:localhost"}) {
+		t.Fatalf("expected the largest rooms first, got %v", ids)
+	}
+	if first.PrevBatch != "" || first.NextBatch == "" {
+		t.Fatalf("expected only a next_batch token, got prev %q next %q", first.PrevBatch, first.NextBatch)
+	}
+
+	// Rooms added between pages don't move the rooms which are already there,
+	// so the next page carries on where the first one stopped.
+	addRoom(t, db, "!big:localhost", "Big", "", 10)
+	addRoom(t, db, "!bb:localhost", "BB", "", 3)
+	second := getPublicRooms(t, db, PublicRoomReq{Limit: 2, Since: first.NextBatch})
+	if ids := roomIDs(second.Chunk); !reflect.DeepEqual(ids, []string{"!bb:localhost", "!c:localhost"}) {
+		t.Fatalf("expected the rooms after !b:localhost, got %v", ids)
+	}
+	third := getPublicRooms(t, db, PublicRoomReq{Limit: 2, Since: second.NextBatch})
+	if ids := roomIDs(third.Chunk); !reflect.DeepEqual(ids, []string{"!d:localhost", "!e:localhost"}) {
+		t.Fatalf("expected the last rooms, got %v", ids)
+	}
+	if third.NextBatch != "" {
+		t.Errorf("expected no next_batch on the last page, got %q", third.NextBatch)
+	}
+
+	// Paginating backwards returns the rooms before the page in order.
+	back := getPublicRooms(t, db, PublicRoomReq{Limit: 2, Since: third.PrevBatch})
+	if ids := roomIDs(back.Chunk); !reflect.DeepEqual(ids, []string{"!bb:localhost", "!c:localhost"}) {
+		t.Errorf("expected the previous page, got %v", ids)
+	}
+	if back.NextBatch != second.NextBatch {
+		t.Errorf("expected the previous page to lead to the same next page, got %q", back.NextBatch)
+	}
+	start := getPublicRooms(t, db, PublicRoomReq{Limit: 10, Since: back.PrevBatch})
+	if ids := roomIDs(start.Chunk); !reflect.DeepEqual(ids, []string{"!big:localhost", "!a:localhost", "!b:localhost"}) {
+		t.Errorf("expected the start of the directory, got %v", ids)
+	}
+	if start.PrevBatch != "" {
+		t.Errorf("expected no prev_batch at the start of the directory, got %q", start.PrevBatch)
+	}
+}
+
+func TestPublicRoomsSearchTerm(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	addRoom(t, db, "!cats:localhost", "Cats", "All about felines", 2)
+	addRoom(t, db, "!dogs:localhost", "Dogs", "Woof", 3)
+	addRoom(t, db, "!pets:localhost", "Pets", "Cats and dogs", 1)
+	addRoom(t, db, "!sale:localhost", "Sale", "50% off", 0)
+
+	for term, expected := range map[string][]string{
+		"cat":     {"!cats:localhost", "!pets:localhost"},
+		"FELINES": {"!cats:localhost"},
+		"dog":     {"!dogs:localhost", "!pets:localhost"},
+		"fish":    nil,
+		// Wildcards in the search term are matched literally.
+		"%": {"!sale:localhost"},
+		"_": nil,
+	} {
+		request := PublicRoomReq{}
+		request.Filter.SearchTerms = term
+		if ids := roomIDs(getPublicRooms(t, db, request).Chunk); !reflect.DeepEqual(ids, expected) {
+			t.Errorf("expected %q to match %v, got %v", term, expected, ids)
+		}
+	}
+}
+
+func TestPublicRoomsInvalidToken(t *testing.T) {
+	for _, token := range []string{"12", "x1_!a:localhost", "n_!a:localhost", "nfive_!a:localhost"} {
+		if _, _, err := parsePublicRoomsToken(token); err == nil {
+			t.Errorf("expected %q to be an invalid token", token)
+		}
+	}
+	from, backwards, err := parsePublicRoomsToken(makePublicRoomsToken(gomatrixserverlib.PublicRoom{
+		RoomID: "!with_underscores:localhost", JoinedMembersCount: 7,
+	}, true))
+	if err != nil || !backwards || from.RoomID != "!with_underscores:localhost" || from.JoinedMembers != 7 {
+		t.Errorf("expected the token to round trip, got %+v %v %v", from, backwards, err)
+	}
+}
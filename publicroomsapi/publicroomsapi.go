@@ -34,8 +34,10 @@ func SetupPublicRoomsAPIComponent(
 	publicRoomsDB storage.Database,
 	rsQueryAPI roomserverAPI.RoomserverQueryAPI,
 	fedClient *gomatrixserverlib.FederationClient,
+	keyRing *gomatrixserverlib.KeyRing,
 	extRoomsProvider types.ExternalPublicRoomsProvider,
 ) {
+	base.RegisterDatabaseHealthCheck("public rooms db", publicRoomsDB)
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
 		base.Cfg, base.KafkaConsumer, publicRoomsDB, rsQueryAPI,
 	)
@@ -43,5 +45,5 @@ func SetupPublicRoomsAPIComponent(
 		logrus.WithError(err).Panic("failed to start public rooms server consumer")
 	}
 
-	routing.Setup(base.APIMux, deviceDB, publicRoomsDB, rsQueryAPI, fedClient, extRoomsProvider)
+	routing.Setup(base.APIMux, base.Cfg, deviceDB, publicRoomsDB, rsQueryAPI, fedClient, *keyRing, extRoomsProvider)
 }
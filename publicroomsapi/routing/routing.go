@@ -24,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/publicroomsapi/directory"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
 	"github.com/matrix-org/dendrite/publicroomsapi/types"
@@ -39,8 +40,9 @@ const pathPrefixR0 = "/_matrix/client/r0"
 // applied:
 // nolint: gocyclo
 func Setup(
-	apiMux *mux.Router, deviceDB devices.Database, publicRoomsDB storage.Database, queryAPI api.RoomserverQueryAPI,
-	fedClient *gomatrixserverlib.FederationClient, extRoomsProvider types.ExternalPublicRoomsProvider,
+	apiMux *mux.Router, cfg *config.Dendrite, deviceDB devices.Database, publicRoomsDB storage.Database, queryAPI api.RoomserverQueryAPI,
+	fedClient *gomatrixserverlib.FederationClient, keyRing gomatrixserverlib.KeyRing,
+	extRoomsProvider types.ExternalPublicRoomsProvider,
 ) {
 	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
 
@@ -71,6 +73,9 @@ func Setup(
 	).Methods(http.MethodPut, http.MethodOptions)
 	r0mux.Handle("/publicRooms",
 		common.MakeExternalAPI("public_rooms", func(req *http.Request) util.JSONResponse {
+			if server := gomatrixserverlib.ServerName(req.URL.Query().Get("server")); server != "" && server != cfg.Matrix.ServerName {
+				return directory.GetPostPublicRoomsFromServer(req, cfg, fedClient, server)
+			}
 			if extRoomsProvider != nil {
 				return directory.GetPostPublicRoomsWithExternal(req, publicRoomsDB, fedClient, extRoomsProvider)
 			}
@@ -80,8 +85,8 @@ func Setup(
 
 	// Federation - TODO: should this live here or in federation API? It's sure easier if it's here so here it is.
 	apiMux.Handle("/_matrix/federation/v1/publicRooms",
-		common.MakeExternalAPI("federation_public_rooms", func(req *http.Request) util.JSONResponse {
-			return directory.GetPostPublicRooms(req, publicRoomsDB)
+		common.MakeFedAPI("federation_public_rooms", cfg, keyRing, func(req *http.Request, fedReq *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			return directory.GetPostPublicRoomsForFederation(req, fedReq, publicRoomsDB)
 		}),
-	).Methods(http.MethodGet)
+	).Methods(http.MethodGet, http.MethodPost)
 }
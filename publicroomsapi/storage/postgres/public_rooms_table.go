@@ -20,8 +20,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/lib/pq"
@@ -69,37 +71,43 @@ const countPublicRoomsSQL = "" +
 	"SELECT COUNT(*) FROM publicroomsapi_public_rooms" +
 	" WHERE visibility = true"
 
+// The public rooms are ordered by the number of joined members and then by
+// room ID, so that every room has a fixed position to paginate from. An empty
+// filter matches every room, as it becomes the pattern "%".
 const selectPublicRoomsSQL = "" +
 	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
-	" FROM publicroomsapi_public_rooms WHERE visibility = true" +
-	" ORDER BY joined_members DESC" +
-	" OFFSET $1"
-
-const selectPublicRoomsWithLimitSQL = "" +
-	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
-	" FROM publicroomsapi_public_rooms WHERE visibility = true" +
-	" ORDER BY joined_members DESC" +
-	" OFFSET $1 LIMIT $2"
-
-const selectPublicRoomsWithFilterSQL = "" +
+	" FROM publicroomsapi_public_rooms" +
+	" WHERE visibility = true" +
+	" AND (LOWER(name) LIKE LOWER($1) ESCAPE '\\'" +
+	" OR LOWER(topic) LIKE LOWER($1) ESCAPE '\\'" +
+	" OR LOWER(canonical_alias) LIKE LOWER($1) ESCAPE '\\'" +
+	" OR LOWER(ARRAY_TO_STRING(aliases, ',')) LIKE LOWER($1) ESCAPE '\\')" +
+	" ORDER BY joined_members DESC, room_id ASC" +
+	" LIMIT $2"
+
+const selectPublicRoomsAfterSQL = "" +
 	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
 	" FROM publicroomsapi_public_rooms" +
 	" WHERE visibility = true" +
-	" AND (LOWER(name) LIKE LOWER($1)" +
-	" OR LOWER(topic) LIKE LOWER($1)" +
-	" OR LOWER(ARRAY_TO_STRING(aliases, ',')) LIKE LOWER($1))" +
-	" ORDER BY joined_members DESC" +
-	" OFFSET $2"
-
-const selectPublicRoomsWithLimitAndFilterSQL = "" +
+	" AND (LOWER(name) LIKE LOWER($1) ESCAPE '\\'" +
+	" OR LOWER(topic) LIKE LOWER($1) ESCAPE '\\'" +
+	" OR LOWER(canonical_alias) LIKE LOWER($1) ESCAPE '\\'" +
+	" OR LOWER(ARRAY_TO_STRING(aliases, ',')) LIKE LOWER($1) ESCAPE '\\')" +
+	" AND (joined_members < $2 OR (joined_members = $2 AND room_id > $3))" +
+	" ORDER BY joined_members DESC, room_id ASC" +
+	" LIMIT $4"
+
+const selectPublicRoomsBeforeSQL = "" +
 	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
 	" FROM publicroomsapi_public_rooms" +
 	" WHERE visibility = true" +
-	" AND (LOWER(name) LIKE LOWER($1)" +
-	" OR LOWER(topic) LIKE LOWER($1)" +
-	" OR LOWER(ARRAY_TO_STRING(aliases, ',')) LIKE LOWER($1))" +
-	" ORDER BY joined_members DESC" +
-	" OFFSET $2 LIMIT $3"
+	" AND (LOWER(name) LIKE LOWER($1) ESCAPE '\\'" +
+	" OR LOWER(topic) LIKE LOWER($1) ESCAPE '\\'" +
+	" OR LOWER(canonical_alias) LIKE LOWER($1) ESCAPE '\\'" +
+	" OR LOWER(ARRAY_TO_STRING(aliases, ',')) LIKE LOWER($1) ESCAPE '\\')" +
+	" AND (joined_members > $2 OR (joined_members = $2 AND room_id < $3))" +
+	" ORDER BY joined_members ASC, room_id DESC" +
+	" LIMIT $4"
 
 const selectRoomVisibilitySQL = "" +
 	"SELECT visibility FROM publicroomsapi_public_rooms" +
@@ -125,16 +133,15 @@ const updateRoomAttributeSQL = "" +
 	" WHERE room_id = $2"
 
 type publicRoomsStatements struct {
-	countPublicRoomsStmt                    *sql.Stmt
-	selectPublicRoomsStmt                   *sql.Stmt
-	selectPublicRoomsWithLimitStmt          *sql.Stmt
-	selectPublicRoomsWithFilterStmt         *sql.Stmt
-	selectPublicRoomsWithLimitAndFilterStmt *sql.Stmt
-	selectRoomVisibilityStmt                *sql.Stmt
-	insertNewRoomStmt                       *sql.Stmt
-	incrementJoinedMembersInRoomStmt        *sql.Stmt
-	decrementJoinedMembersInRoomStmt        *sql.Stmt
-	updateRoomAttributeStmts                map[string]*sql.Stmt
+	countPublicRoomsStmt             *sql.Stmt
+	selectPublicRoomsStmt            *sql.Stmt
+	selectPublicRoomsAfterStmt       *sql.Stmt
+	selectPublicRoomsBeforeStmt      *sql.Stmt
+	selectRoomVisibilityStmt         *sql.Stmt
+	insertNewRoomStmt                *sql.Stmt
+	incrementJoinedMembersInRoomStmt *sql.Stmt
+	decrementJoinedMembersInRoomStmt *sql.Stmt
+	updateRoomAttributeStmts         map[string]*sql.Stmt
 }
 
 func (s *publicRoomsStatements) prepare(db *sql.DB) (err error) {
@@ -146,9 +153,8 @@ func (s *publicRoomsStatements) prepare(db *sql.DB) (err error) {
 	stmts := statementList{
 		{&s.countPublicRoomsStmt, countPublicRoomsSQL},
 		{&s.selectPublicRoomsStmt, selectPublicRoomsSQL},
-		{&s.selectPublicRoomsWithLimitStmt, selectPublicRoomsWithLimitSQL},
-		{&s.selectPublicRoomsWithFilterStmt, selectPublicRoomsWithFilterSQL},
-		{&s.selectPublicRoomsWithLimitAndFilterStmt, selectPublicRoomsWithLimitAndFilterSQL},
+		{&s.selectPublicRoomsAfterStmt, selectPublicRoomsAfterSQL},
+		{&s.selectPublicRoomsBeforeStmt, selectPublicRoomsBeforeSQL},
 		{&s.selectRoomVisibilityStmt, selectRoomVisibilitySQL},
 		{&s.insertNewRoomStmt, insertNewRoomSQL},
 		{&s.incrementJoinedMembersInRoomStmt, incrementJoinedMembersInRoomSQL},
@@ -175,35 +181,32 @@ func (s *publicRoomsStatements) countPublicRooms(ctx context.Context) (nb int64,
 	return
 }
 
+// likeEscaper escapes the characters which have a special meaning in LIKE
+// patterns, so that filters match them literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 func (s *publicRoomsStatements) selectPublicRooms(
-	ctx context.Context, offset int64, limit int16, filter string,
+	ctx context.Context, from *types.PublicRoomsPosition, backwards bool, limit int, filter string,
 ) ([]gomatrixserverlib.PublicRoom, error) {
+	pattern := "%" + likeEscaper.Replace(filter) + "%"
+	var sqlLimit interface{} = limit
+	if limit == 0 {
+		// LIMIT NULL doesn't limit the number of rows in PostgreSQL.
+		sqlLimit = nil
+	}
+
 	var rows *sql.Rows
 	var err error
-
-	if len(filter) > 0 {
-		pattern := "%" + filter + "%"
-		if limit == 0 {
-			rows, err = s.selectPublicRoomsWithFilterStmt.QueryContext(
-				ctx, pattern, offset,
-			)
-		} else {
-			rows, err = s.selectPublicRoomsWithLimitAndFilterStmt.QueryContext(
-				ctx, pattern, offset, limit,
-			)
-		}
-	} else {
-		if limit == 0 {
-			rows, err = s.selectPublicRoomsStmt.QueryContext(ctx, offset)
-		} else {
-			rows, err = s.selectPublicRoomsWithLimitStmt.QueryContext(
-				ctx, offset, limit,
-			)
-		}
+	switch {
+	case from == nil:
+		rows, err = s.selectPublicRoomsStmt.QueryContext(ctx, pattern, sqlLimit)
+	case backwards:
+		rows, err = s.selectPublicRoomsBeforeStmt.QueryContext(ctx, pattern, from.JoinedMembers, from.RoomID, sqlLimit)
+	default:
+		rows, err = s.selectPublicRoomsAfterStmt.QueryContext(ctx, pattern, from.JoinedMembers, from.RoomID, sqlLimit)
 	}
-
 	if err != nil {
-		return []gomatrixserverlib.PublicRoom{}, nil
+		return nil, err
 	}
 	defer common.CloseAndLogIfError(ctx, rows, "selectPublicRooms: rows.close() failed")
 
@@ -24,6 +24,7 @@ import (
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -38,10 +39,15 @@ type PublicRoomsServerDatabase struct {
 type attributeValue interface{}
 
 // NewPublicRoomsServerDatabase creates a new public rooms server database.
-func NewPublicRoomsServerDatabase(dataSourceName string) (*PublicRoomsServerDatabase, error) {
+func NewPublicRoomsServerDatabase(dataSourceName string, dbProperties sqlutil.DbProperties) (*PublicRoomsServerDatabase, error) {
 	var db *sql.DB
 	var err error
-	if db, err = sqlutil.Open(common.SQLiteDriverName(), dataSourceName); err != nil {
+	if db, err = sqlutil.Open(common.SQLiteDriverName(), dataSourceName, dbProperties); err != nil {
+		return nil, err
+	}
+	migrator := common.NewMigrator(db, "publicroomsapi")
+	migrator.AddMigrations(common.BaselineMigration)
+	if err = migrator.Up(context.Background()); err != nil {
 		return nil, err
 	}
 	storage := PublicRoomsServerDatabase{
@@ -56,6 +62,11 @@ func NewPublicRoomsServerDatabase(dataSourceName string) (*PublicRoomsServerData
 	return &storage, nil
 }
 
+// Ping checks that the database can be reached.
+func (d *PublicRoomsServerDatabase) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
 // GetRoomVisibility returns the room visibility as a boolean: true if the room
 // is publicly visible, false if not.
 // Returns an error if the retrieval failed.
@@ -80,15 +91,27 @@ func (d *PublicRoomsServerDatabase) CountPublicRooms(ctx context.Context) (int64
 	return d.statements.countPublicRooms(ctx)
 }
 
-// GetPublicRooms returns an array containing the local rooms set as publicly visible, ordered by their number
-// of joined members. This array can be limited by a given number of elements, and offset by a given value.
-// If the limit is 0, doesn't limit the number of results. If the offset is 0 too, the array contains all
-// the rooms set as publicly visible on the server.
+// GetPublicRooms returns the local rooms set as publicly visible whose name,
+// topic or aliases match the filter, in the order of the directory. If a
+// position is given, only the rooms after it are returned, or the rooms before
+// it if backwards is true. If the limit is 0, doesn't limit the number of
+// results.
 // Returns an error if the retrieval failed.
 func (d *PublicRoomsServerDatabase) GetPublicRooms(
-	ctx context.Context, offset int64, limit int16, filter string,
+	ctx context.Context, from *types.PublicRoomsPosition, backwards bool, limit int, filter string,
 ) ([]gomatrixserverlib.PublicRoom, error) {
-	return d.statements.selectPublicRooms(ctx, offset, limit, filter)
+	rooms, err := d.statements.selectPublicRooms(ctx, from, backwards, limit, filter)
+	if err != nil {
+		return nil, err
+	}
+	if backwards {
+		// The rooms before the position were selected closest first, so they
+		// are in the reverse of the order of the directory.
+		for i, j := 0, len(rooms)-1; i < j; i, j = i+1, j-1 {
+			rooms[i], rooms[j] = rooms[j], rooms[i]
+		}
+	}
+	return rooms, nil
 }
 
 // UpdateRoomFromEvents iterate over a slice of state events and call
@@ -22,3 +22,11 @@ type ExternalPublicRoomsProvider interface {
 	// This will be called -on demand- by clients, so cache appropriately!
 	Homeservers() []string
 }
+
+// PublicRoomsPosition is the position of a room in the public rooms directory,
+// which is ordered by the number of joined members, largest first, and then by
+// room ID.
+type PublicRoomsPosition struct {
+	JoinedMembers int64
+	RoomID        string
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acls
+
+import (
+	"encoding/json"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// MRoomServerACL is the type of the state event which controls which servers
+// may participate in a room.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-server-acl
+const MRoomServerACL = "m.room.server_acl"
+
+// A ServerACL is a compiled m.room.server_acl event.
+type ServerACL struct {
+	eventID         string
+	allowed         []*regexp.Regexp
+	denied          []*regexp.Regexp
+	allowIPLiterals bool
+}
+
+// NewServerACL compiles the globs of an m.room.server_acl event. Values of
+// the wrong type are ignored, as they cannot match any server.
+func NewServerACL(event *gomatrixserverlib.Event) (*ServerACL, error) {
+	var content struct {
+		Allow           interface{} `json:"allow"`
+		Deny            interface{} `json:"deny"`
+		AllowIPLiterals interface{} `json:"allow_ip_literals"`
+	}
+	if err := json.Unmarshal(event.Content(), &content); err != nil {
+		return nil, err
+	}
+	acl := &ServerACL{
+		eventID:         event.EventID(),
+		allowed:         compileGlobs(content.Allow),
+		denied:          compileGlobs(content.Deny),
+		allowIPLiterals: true,
+	}
+	if allowIPLiterals, ok := content.AllowIPLiterals.(bool); ok {
+		acl.allowIPLiterals = allowIPLiterals
+	}
+	return acl, nil
+}
+
+// IsServerBanned returns true if the server isn't allowed to participate in
+// the room. Servers are banned if they match a denied glob or don't match any
+// allowed glob, ignoring the port of the server name.
+func (acl *ServerACL) IsServerBanned(serverName gomatrixserverlib.ServerName) bool {
+	host, _, valid := gomatrixserverlib.ParseAndValidateServerName(serverName)
+	if !valid {
+		return true
+	}
+	if !acl.allowIPLiterals && isIPLiteral(host) {
+		return true
+	}
+	for _, glob := range acl.denied {
+		if glob.MatchString(host) {
+			return true
+		}
+	}
+	for _, glob := range acl.allowed {
+		if glob.MatchString(host) {
+			return false
+		}
+	}
+	return true
+}
+
+func isIPLiteral(host string) bool {
+	return strings.HasPrefix(host, "[") || net.ParseIP(host) != nil
+}
+
+func compileGlobs(value interface{}) []*regexp.Regexp {
+	entries, _ := value.([]interface{})
+	var globs []*regexp.Regexp
+	for _, entry := range entries {
+		glob, ok := entry.(string)
+		if !ok {
+			continue
+		}
+		// Globs may contain the wildcards * and ?, which match any number of
+		// characters and any one character.
+		pattern := regexp.QuoteMeta(glob)
+		pattern = strings.Replace(pattern, `\*`, `.*`, -1)
+		pattern = strings.Replace(pattern, `\?`, `.`, -1)
+		globs = append(globs, regexp.MustCompile(`(?i)^`+pattern+`$`))
+	}
+	return globs
+}
+
+// ServerACLs caches the compiled server ACLs of rooms, so that the globs are
+// only compiled again when the ACL of a room changes.
+type ServerACLs struct {
+	mutex sync.Mutex
+	// The compiled ACLs keyed by room ID, which are nil for the rooms known
+	// not to have an ACL.
+	acls map[string]*ServerACL
+}
+
+// NewServerACLs creates an empty ServerACLs cache.
+func NewServerACLs() *ServerACLs {
+	return &ServerACLs{acls: map[string]*ServerACL{}}
+}
+
+// ForEvent returns the compiled ACL for the current m.room.server_acl event
+// of a room, or nil if the room doesn't have one. It is only compiled if it
+// isn't the ACL event cached for the room.
+func (s *ServerACLs) ForEvent(roomID string, event *gomatrixserverlib.Event) (*ServerACL, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.forEvent(roomID, event)
+}
+
+// Cached returns the cached ACL of a room, which is nil if the room doesn't
+// have one. Returns false if the ACL of the room isn't cached.
+func (s *ServerACLs) Cached(roomID string) (*ServerACL, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	acl, ok := s.acls[roomID]
+	return acl, ok
+}
+
+// Update updates the cached ACL of a room for a change to its current state,
+// given the state events added to it and the IDs of those removed from it.
+// The state of rooms whose ACL isn't cached is ignored unless it adds an ACL.
+func (s *ServerACLs) Update(roomID string, added []gomatrixserverlib.Event, removedEventIDs []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range added {
+		if added[i].Type() == MRoomServerACL && added[i].StateKeyEquals("") {
+			_, err := s.forEvent(roomID, &added[i])
+			return err
+		}
+	}
+	acl := s.acls[roomID]
+	if acl == nil {
+		return nil
+	}
+	for _, eventID := range removedEventIDs {
+		if eventID == acl.eventID {
+			s.acls[roomID] = nil
+		}
+	}
+	return nil
+}
+
+// forEvent must only be called after locking the cache.
+func (s *ServerACLs) forEvent(roomID string, event *gomatrixserverlib.Event) (*ServerACL, error) {
+	if event == nil {
+		s.acls[roomID] = nil
+		return nil, nil
+	}
+	if acl, ok := s.acls[roomID]; ok && acl != nil && acl.eventID == event.EventID() {
+		return acl, nil
+	}
+	acl, err := NewServerACL(event)
+	if err != nil {
+		return nil, err
+	}
+	s.acls[roomID] = acl
+	return acl, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acls
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func aclEvent(t *testing.T, eventID, content string) *gomatrixserverlib.Event {
+	eventJSON := fmt.Sprintf(
+		`{"event_id":%q,"room_id":"!room:localhost","sender":"@alice:localhost","type":"m.room.server_acl","state_key":"","content":%s}`,
+		eventID, content,
+	)
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &event
+}
+
+func testBanned(t *testing.T, acl *ServerACL, want map[gomatrixserverlib.ServerName]bool) {
+	for serverName, wantBanned := range want {
+		if banned := acl.IsServerBanned(serverName); banned != wantBanned {
+			t.Errorf("expected banned to be %v for %q, got %v", wantBanned, serverName, banned)
+		}
+	}
+}
+
+func TestWildcardDeny(t *testing.T) {
+	acl, err := NewServerACL(aclEvent(t, "$acl:localhost",
+		`{"allow":["*"],"deny":["*.evil.com","evil.com"],"allow_ip_literals":false}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBanned(t, acl, map[gomatrixserverlib.ServerName]bool{
+		"example.org":         false,
+		"example.org:8448":    false,
+		"evil.com":            true,
+		"matrix.evil.com":     true,
+		"MATRIX.EVIL.COM:443": true,
+		"notevil.com":         false,
+		"1.2.3.4":             true,
+		"1.2.3.4:8448":        true,
+		"[::1]:8448":          true,
+	})
+}
+
+func TestExplicitAllow(t *testing.T) {
+	acl, err := NewServerACL(aclEvent(t, "$acl:localhost",
+		`{"allow":["example.org","matrix.?.org"]}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBanned(t, acl, map[gomatrixserverlib.ServerName]bool{
+		"example.org":      false,
+		"example.org:8448": false,
+		"matrix.a.org":     false,
+		"matrix.ab.org":    true,
+		"other.org":        true,
+		"1.2.3.4":          true,
+	})
+}
+
+func TestIPLiteralsAreAllowedByDefault(t *testing.T) {
+	acl, err := NewServerACL(aclEvent(t, "$acl:localhost", `{"allow":["*"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBanned(t, acl, map[gomatrixserverlib.ServerName]bool{
+		"1.2.3.4":    false,
+		"[::1]:8448": false,
+	})
+}
+
+func TestServerACLsAreRecompiledWhenTheEventChanges(t *testing.T) {
+	acls := NewServerACLs()
+	first, err := acls.ForEvent("!room:localhost", aclEvent(t, "$first:localhost", `{"allow":["*"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := acls.ForEvent("!room:localhost", aclEvent(t, "$first:localhost", `{"allow":["*"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != first {
+		t.Error("expected the compiled ACL to be cached")
+	}
+
+	second, err := acls.ForEvent("!room:localhost", aclEvent(t, "$second:localhost", `{"allow":["*"],"deny":["evil.com"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.IsServerBanned("evil.com") {
+		t.Error("expected the new ACL to be used")
+	}
+
+	removed, err := acls.ForEvent("!room:localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != nil {
+		t.Error("expected no ACL once the room doesn't have one")
+	}
+}
+
+func TestServerACLsAreUpdatedWhenTheStateChanges(t *testing.T) {
+	acls := NewServerACLs()
+	if _, cached := acls.Cached("!room:localhost"); cached {
+		t.Fatal("expected the ACL not to be cached to begin with")
+	}
+
+	// Adding an ACL to the state of a room caches it.
+	if err := acls.Update("!room:localhost", []gomatrixserverlib.Event{
+		*aclEvent(t, "$first:localhost", `{"allow":["*"],"deny":["evil.com"]}`),
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if acl, cached := acls.Cached("!room:localhost"); !cached || acl == nil || !acl.IsServerBanned("evil.com") {
+		t.Errorf("expected the added ACL to be cached, got %v", acl)
+	}
+
+	// Removing other state leaves the ACL alone.
+	if err := acls.Update("!room:localhost", nil, []string{"$other:localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	if acl, _ := acls.Cached("!room:localhost"); acl == nil {
+		t.Error("expected the ACL to stay cached when other state is removed")
+	}
+
+	// Removing the ACL from the state of the room caches that it has none.
+	if err := acls.Update("!room:localhost", nil, []string{"$first:localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	if acl, cached := acls.Cached("!room:localhost"); !cached || acl != nil {
+		t.Errorf("expected the room to be cached without an ACL, got %v", acl)
+	}
+}
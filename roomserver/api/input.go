@@ -109,11 +109,59 @@ type RoomserverInputAPI interface {
 		request *InputRoomEventsRequest,
 		response *InputRoomEventsResponse,
 	) error
+
+	// Block a room so that no more events are accepted for it, apart from
+	// local users leaving it, and optionally purge it.
+	ShutdownRoom(
+		ctx context.Context,
+		request *ShutdownRoomRequest,
+		response *ShutdownRoomResponse,
+	) error
+	// Reject the invite of a local user to a room which this server isn't in,
+	// marking the user as having left the room. The leave event is sent to
+	// the room by the caller if it can be.
+	RejectInvite(
+		ctx context.Context,
+		request *RejectInviteRequest,
+		response *RejectInviteResponse,
+	) error
+}
+
+// ErrRoomBlocked is returned when inputting an event for a room which has
+// been shut down, other than a user leaving it.
+var ErrRoomBlocked = errors.New("room has been shut down")
+
+// ShutdownRoomRequest is a request to ShutdownRoom
+type ShutdownRoomRequest struct {
+	RoomID string `json:"room_id"`
+	// Whether to delete everything the roomserver stores about the room.
+	Purge bool `json:"purge"`
+}
+
+// ShutdownRoomResponse is a response to ShutdownRoom
+type ShutdownRoomResponse struct{}
+
+// RejectInviteRequest is a request to RejectInvite
+type RejectInviteRequest struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	// The ID of the leave event sent to the room, or empty if it couldn't be
+	// sent to any of the servers in the room.
+	LeaveEventID string `json:"leave_event_id"`
 }
 
+// RejectInviteResponse is a response to RejectInvite
+type RejectInviteResponse struct{}
+
 // RoomserverInputRoomEventsPath is the HTTP path for the InputRoomEvents API.
 const RoomserverInputRoomEventsPath = "/api/roomserver/inputRoomEvents"
 
+// RoomserverShutdownRoomPath is the HTTP path for the ShutdownRoom API.
+const RoomserverShutdownRoomPath = "/api/roomserver/shutdownRoom"
+
+// RoomserverRejectInvitePath is the HTTP path for the RejectInvite API.
+const RoomserverRejectInvitePath = "/api/roomserver/rejectInvite"
+
 // NewRoomserverInputAPIHTTP creates a RoomserverInputAPI implemented by talking to a HTTP POST API.
 // If httpClient is nil an error is returned
 func NewRoomserverInputAPIHTTP(roomserverURL string, httpClient *http.Client) (RoomserverInputAPI, error) {
@@ -140,3 +188,29 @@ func (h *httpRoomserverInputAPI) InputRoomEvents(
 	apiURL := h.roomserverURL + RoomserverInputRoomEventsPath
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// ShutdownRoom implements RoomserverInputAPI
+func (h *httpRoomserverInputAPI) ShutdownRoom(
+	ctx context.Context,
+	request *ShutdownRoomRequest,
+	response *ShutdownRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ShutdownRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverShutdownRoomPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// RejectInvite implements RoomserverInputAPI
+func (h *httpRoomserverInputAPI) RejectInvite(
+	ctx context.Context,
+	request *RejectInviteRequest,
+	response *RejectInviteResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RejectInvite")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverRejectInvitePath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
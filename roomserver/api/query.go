@@ -66,7 +66,8 @@ type QueryStateAfterEventsRequest struct {
 	RoomID string `json:"room_id"`
 	// The list of previous events to return the events after.
 	PrevEventIDs []string `json:"prev_event_ids"`
-	// The state key tuples to fetch from the state
+	// The state key tuples to fetch from the state.
+	// If this list is empty or nil then the entire state is returned.
 	StateToFetch []gomatrixserverlib.StateKeyTuple `json:"state_to_fetch"`
 }
 
@@ -91,6 +92,9 @@ type QueryStateAfterEventsResponse struct {
 type QueryEventsByIDRequest struct {
 	// The event IDs to look up.
 	EventIDs []string `json:"event_ids"`
+	// Whether to find out which of the events have been redacted, which
+	// means looking through every event in their rooms.
+	CheckRedactions bool `json:"check_redactions,omitempty"`
 }
 
 // QueryEventsByIDResponse is a response to QueryEventsByID
@@ -105,6 +109,9 @@ type QueryEventsByIDResponse struct {
 	// the entire request.
 	// This list will be in an arbitrary order.
 	Events []gomatrixserverlib.HeaderedEvent `json:"events"`
+	// The IDs of the events in Events which an m.room.redaction event in the
+	// room has already redacted, if the request asked for them.
+	RedactedEventIDs []string `json:"redacted_event_ids,omitempty"`
 }
 
 // QueryMembershipForUserRequest is a request to QueryMembership
@@ -162,6 +169,20 @@ type QueryInvitesForUserResponse struct {
 	InviteSenderUserIDs []string `json:"invite_sender_user_ids"`
 }
 
+// QueryRoomsForUserRequest is a request to QueryRoomsForUser
+type QueryRoomsForUserRequest struct {
+	// The user ID to look up rooms for.
+	UserID string `json:"user_id"`
+	// The membership the user must have in the rooms, e.g. "join".
+	WantMembership string `json:"want_membership"`
+}
+
+// QueryRoomsForUserResponse is a response to QueryRoomsForUser
+type QueryRoomsForUserResponse struct {
+	// The IDs of the rooms in which the user has the requested membership.
+	RoomIDs []string `json:"room_ids"`
+}
+
 // QueryServerAllowedToSeeEventRequest is a request to QueryServerAllowedToSeeEvent
 type QueryServerAllowedToSeeEventRequest struct {
 	// The event ID to look up invites in.
@@ -206,6 +227,10 @@ type QueryStateAndAuthChainRequest struct {
 	// Should state resolution be ran on the result events?
 	// TODO: check call sites and remove if we always want to do state res
 	ResolveState bool `json:"resolve_state"`
+	// Return the state before the only event in PrevEventIDs, as stored for
+	// it, rather than the state after it. This is the state at the event which
+	// /state and /state_ids return.
+	StateBeforeEvent bool `json:"state_before_event"`
 }
 
 // QueryStateAndAuthChainResponse is a response to QueryStateAndAuthChain
@@ -226,6 +251,37 @@ type QueryStateAndAuthChainResponse struct {
 	AuthChainEvents []gomatrixserverlib.HeaderedEvent `json:"auth_chain_events"`
 }
 
+// QueryAuthChainRequest is a request to QueryAuthChain
+type QueryAuthChainRequest struct {
+	// The events to fetch the auth chain of.
+	EventIDs []string `json:"event_ids"`
+}
+
+// QueryAuthChainResponse is a response to QueryAuthChain
+type QueryAuthChainResponse struct {
+	// The auth chain of the events, which includes the events themselves.
+	// Auth events come before the events that they authorise, so the create
+	// event of the room comes first. Events which the roomserver doesn't know
+	// about are left out.
+	AuthChain []gomatrixserverlib.HeaderedEvent `json:"auth_chain"`
+}
+
+// QueryServerJoinedToRoomRequest is a request to QueryServerJoinedToRoom
+type QueryServerJoinedToRoomRequest struct {
+	// The room to check.
+	RoomID string `json:"room_id"`
+	// The server to check.
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+}
+
+// QueryServerJoinedToRoomResponse is a response to QueryServerJoinedToRoom
+type QueryServerJoinedToRoomResponse struct {
+	// Does the room exist on this roomserver?
+	RoomExists bool `json:"room_exists"`
+	// Does the server have any users currently joined to the room?
+	IsInRoom bool `json:"is_in_room"`
+}
+
 // QueryBackfillRequest is a request to QueryBackfill.
 type QueryBackfillRequest struct {
 	// Events to start paginating from.
@@ -275,6 +331,49 @@ type QueryRoomVersionForRoomResponse struct {
 	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
 }
 
+// QueryServerBannedFromRoomRequest is a request to QueryServerBannedFromRoom
+type QueryServerBannedFromRoomRequest struct {
+	RoomID     string                       `json:"room_id"`
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+}
+
+// QueryServerBannedFromRoomResponse is a response to QueryServerBannedFromRoom
+type QueryServerBannedFromRoomResponse struct {
+	// Whether the server is denied by the current m.room.server_acl of the room.
+	Banned bool `json:"banned"`
+}
+
+// QueryEventsBySenderRequest is a request to QueryEventsBySender
+type QueryEventsBySenderRequest struct {
+	RoomID string `json:"room_id"`
+	// The user ID of the sender whose events are wanted.
+	Sender string `json:"sender"`
+	// The largest number of events to return.
+	Limit int `json:"limit"`
+}
+
+// QueryEventsBySenderResponse is a response to QueryEventsBySender
+type QueryEventsBySenderResponse struct {
+	// Does the room exist on this roomserver?
+	// If the room doesn't exist this will be false and Events will be empty.
+	RoomExists bool `json:"room_exists"`
+	// The events sent into the room by the sender which haven't been redacted
+	// yet, in the order they were stored by the roomserver. The create event
+	// and redactions are left out, as redacting them does nothing.
+	Events []gomatrixserverlib.HeaderedEvent `json:"events"`
+}
+
+// QueryRoomBlockedRequest is a request to QueryRoomBlocked
+type QueryRoomBlockedRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// QueryRoomBlockedResponse is a response to QueryRoomBlocked
+type QueryRoomBlockedResponse struct {
+	// Whether the room has been shut down by a server admin.
+	Blocked bool `json:"blocked"`
+}
+
 // RoomserverQueryAPI is used to query information from the room server.
 type RoomserverQueryAPI interface {
 	// Query the latest events and state for a room from the room server.
@@ -319,6 +418,13 @@ type RoomserverQueryAPI interface {
 		response *QueryInvitesForUserResponse,
 	) error
 
+	// Query the rooms in which a user has a given membership.
+	QueryRoomsForUser(
+		ctx context.Context,
+		request *QueryRoomsForUserRequest,
+		response *QueryRoomsForUserResponse,
+	) error
+
 	// Query whether a server is allowed to see an event
 	QueryServerAllowedToSeeEvent(
 		ctx context.Context,
@@ -342,6 +448,21 @@ type RoomserverQueryAPI interface {
 		response *QueryStateAndAuthChainResponse,
 	) error
 
+	// Query the auth chain of some events, in the order that they need to be
+	// authed in.
+	QueryAuthChain(
+		ctx context.Context,
+		request *QueryAuthChainRequest,
+		response *QueryAuthChainResponse,
+	) error
+
+	// Query whether a server currently has users joined to a room.
+	QueryServerJoinedToRoom(
+		ctx context.Context,
+		request *QueryServerJoinedToRoomRequest,
+		response *QueryServerJoinedToRoomResponse,
+	) error
+
 	// Query a given amount (or less) of events prior to a given set of events.
 	QueryBackfill(
 		ctx context.Context,
@@ -368,6 +489,28 @@ type RoomserverQueryAPI interface {
 		request *QueryRoomVersionForRoomRequest,
 		response *QueryRoomVersionForRoomResponse,
 	) error
+
+	// Asks whether a server is banned from a room by its server ACLs.
+	QueryServerBannedFromRoom(
+		ctx context.Context,
+		request *QueryServerBannedFromRoomRequest,
+		response *QueryServerBannedFromRoomResponse,
+	) error
+
+	// Query up to a limit of the events sent into a room by a user which
+	// haven't been redacted yet.
+	QueryEventsBySender(
+		ctx context.Context,
+		request *QueryEventsBySenderRequest,
+		response *QueryEventsBySenderResponse,
+	) error
+
+	// Asks whether a room has been shut down by a server admin.
+	QueryRoomBlocked(
+		ctx context.Context,
+		request *QueryRoomBlockedRequest,
+		response *QueryRoomBlockedResponse,
+	) error
 }
 
 // RoomserverQueryLatestEventsAndStatePath is the HTTP path for the QueryLatestEventsAndState API.
@@ -388,6 +531,9 @@ const RoomserverQueryMembershipsForRoomPath = "/api/roomserver/queryMembershipsF
 // RoomserverQueryInvitesForUserPath is the HTTP path for the QueryInvitesForUser API
 const RoomserverQueryInvitesForUserPath = "/api/roomserver/queryInvitesForUser"
 
+// RoomserverQueryRoomsForUserPath is the HTTP path for the QueryRoomsForUser API
+const RoomserverQueryRoomsForUserPath = "/api/roomserver/queryRoomsForUser"
+
 // RoomserverQueryServerAllowedToSeeEventPath is the HTTP path for the QueryServerAllowedToSeeEvent API
 const RoomserverQueryServerAllowedToSeeEventPath = "/api/roomserver/queryServerAllowedToSeeEvent"
 
@@ -397,6 +543,12 @@ const RoomserverQueryMissingEventsPath = "/api/roomserver/queryMissingEvents"
 // RoomserverQueryStateAndAuthChainPath is the HTTP path for the QueryStateAndAuthChain API
 const RoomserverQueryStateAndAuthChainPath = "/api/roomserver/queryStateAndAuthChain"
 
+// RoomserverQueryAuthChainPath is the HTTP path for the QueryAuthChain API
+const RoomserverQueryAuthChainPath = "/api/roomserver/queryAuthChain"
+
+// RoomserverQueryServerJoinedToRoomPath is the HTTP path for the QueryServerJoinedToRoom API
+const RoomserverQueryServerJoinedToRoomPath = "/api/roomserver/queryServerJoinedToRoom"
+
 // RoomserverQueryBackfillPath is the HTTP path for the QueryBackfillPath API
 const RoomserverQueryBackfillPath = "/api/roomserver/queryBackfill"
 
@@ -409,6 +561,15 @@ const RoomserverQueryRoomVersionCapabilitiesPath = "/api/roomserver/queryRoomVer
 // RoomserverQueryRoomVersionCapabilitiesPath is the HTTP path for the QueryRoomVersionCapabilities API
 const RoomserverQueryRoomVersionForRoomPath = "/api/roomserver/queryRoomVersionForRoom"
 
+// RoomserverQueryServerBannedFromRoomPath is the HTTP path for the QueryServerBannedFromRoom API
+const RoomserverQueryServerBannedFromRoomPath = "/api/roomserver/queryServerBannedFromRoom"
+
+// RoomserverQueryEventsBySenderPath is the HTTP path for the QueryEventsBySender API
+const RoomserverQueryEventsBySenderPath = "/api/roomserver/queryEventsBySender"
+
+// RoomserverQueryRoomBlockedPath is the HTTP path for the QueryRoomBlocked API
+const RoomserverQueryRoomBlockedPath = "/api/roomserver/queryRoomBlocked"
+
 // NewRoomserverQueryAPIHTTP creates a RoomserverQueryAPI implemented by talking to a HTTP POST API.
 // If httpClient is nil an error is returned
 func NewRoomserverQueryAPIHTTP(roomserverURL string, httpClient *http.Client) (RoomserverQueryAPI, error) {
@@ -501,6 +662,19 @@ func (h *httpRoomserverQueryAPI) QueryInvitesForUser(
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryRoomsForUser implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryRoomsForUser(
+	ctx context.Context,
+	request *QueryRoomsForUserRequest,
+	response *QueryRoomsForUserResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomsForUser")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomsForUserPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryServerAllowedToSeeEvent implements RoomserverQueryAPI
 func (h *httpRoomserverQueryAPI) QueryServerAllowedToSeeEvent(
 	ctx context.Context,
@@ -540,6 +714,32 @@ func (h *httpRoomserverQueryAPI) QueryStateAndAuthChain(
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryAuthChain implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryAuthChain(
+	ctx context.Context,
+	request *QueryAuthChainRequest,
+	response *QueryAuthChainResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAuthChain")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryAuthChainPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryServerJoinedToRoom implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryServerJoinedToRoom(
+	ctx context.Context,
+	request *QueryServerJoinedToRoomRequest,
+	response *QueryServerJoinedToRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryServerJoinedToRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryServerJoinedToRoomPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryBackfill implements RoomServerQueryAPI
 func (h *httpRoomserverQueryAPI) QueryBackfill(
 	ctx context.Context,
@@ -591,3 +791,42 @@ func (h *httpRoomserverQueryAPI) QueryRoomVersionForRoom(
 	apiURL := h.roomserverURL + RoomserverQueryRoomVersionForRoomPath
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// QueryServerBannedFromRoom implements RoomServerQueryAPI
+func (h *httpRoomserverQueryAPI) QueryServerBannedFromRoom(
+	ctx context.Context,
+	request *QueryServerBannedFromRoomRequest,
+	response *QueryServerBannedFromRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryServerBannedFromRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryServerBannedFromRoomPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryEventsBySender implements RoomServerQueryAPI
+func (h *httpRoomserverQueryAPI) QueryEventsBySender(
+	ctx context.Context,
+	request *QueryEventsBySenderRequest,
+	response *QueryEventsBySenderResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventsBySender")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventsBySenderPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryRoomBlocked implements RoomServerQueryAPI
+func (h *httpRoomserverQueryAPI) QueryRoomBlocked(
+	ctx context.Context,
+	request *QueryRoomBlockedRequest,
+	response *QueryRoomBlockedResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomBlocked")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomBlockedPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// StateNeededForAuth returns the event types and state_keys needed to
+// authenticate the events. It is the same as gomatrixserverlib's, except that
+// it also asks for the join rules when authenticating a knock, and for the
+// membership of the user who authorised a join to a restricted room.
+func StateNeededForAuth(events []gomatrixserverlib.Event) gomatrixserverlib.StateNeeded {
+	result := gomatrixserverlib.StateNeededForAuth(events)
+	for _, event := range events {
+		if membership, err := event.Membership(); err == nil && membership == Knock {
+			result.JoinRules = true
+		}
+		if event.Type() == gomatrixserverlib.MRoomMember {
+			if authoriser := JoinAuthorisedVia(event.Content()); authoriser != "" {
+				result.Member = append(result.Member, authoriser)
+			}
+		}
+	}
+	return result
+}
+
+// StateNeededForEventBuilder returns the event types and state_keys needed to
+// authenticate the event being built. It is the same as gomatrixserverlib's,
+// except that it also asks for the join rules when building a knock, and for
+// the membership of the user who authorised a join to a restricted room.
+func StateNeededForEventBuilder(
+	builder *gomatrixserverlib.EventBuilder,
+) (gomatrixserverlib.StateNeeded, error) {
+	result, err := gomatrixserverlib.StateNeededForEventBuilder(builder)
+	if err != nil {
+		return result, err
+	}
+	if builder.Type == gomatrixserverlib.MRoomMember {
+		// gomatrixserverlib has already checked that the content is valid.
+		var content gomatrixserverlib.MemberContent
+		if err = json.Unmarshal(builder.Content, &content); err == nil && content.Membership == Knock {
+			result.JoinRules = true
+		}
+		if authoriser := JoinAuthorisedVia(builder.Content); authoriser != "" {
+			result.Member = append(result.Member, authoriser)
+		}
+	}
+	return result, nil
+}
+
+// Allowed checks whether the event is allowed by the auth events. It returns
+// a *gomatrixserverlib.NotAllowed error if the event is not allowed.
+func Allowed(event gomatrixserverlib.Event, authEvents gomatrixserverlib.AuthEventProvider) error {
+	if event.Type() != gomatrixserverlib.MRoomMember || event.StateKey() == nil {
+		return gomatrixserverlib.Allowed(event, authEvents)
+	}
+	newMember, err := gomatrixserverlib.NewMemberContentFromEvent(event)
+	if err != nil {
+		return gomatrixserverlib.Allowed(event, authEvents)
+	}
+	targetID := *event.StateKey()
+	oldMember, err := gomatrixserverlib.NewMemberContentFromAuthEvents(authEvents, targetID)
+	if err != nil {
+		return err
+	}
+	isThirdPartyInvite := newMember.Membership == gomatrixserverlib.Invite && newMember.ThirdPartyInvite != nil
+	restrictedJoin, err := isRestrictedJoin(authEvents, oldMember, newMember)
+	if err != nil {
+		return err
+	}
+	knock := newMember.Membership == Knock || oldMember.Membership == Knock
+	if !isThirdPartyInvite && !restrictedJoin && !knock {
+		return gomatrixserverlib.Allowed(event, authEvents)
+	}
+	if knock {
+		roomVersion, desc, verr := RoomVersionOf(authEvents)
+		if verr != nil {
+			return verr
+		}
+		if !desc.Knocking {
+			return notAllowed("room version %q doesn't allow knocking", roomVersion)
+		}
+	}
+
+	create, err := gomatrixserverlib.NewCreateContentFromAuthEvents(authEvents)
+	if err != nil {
+		return err
+	}
+	createEvent, _ := authEvents.Create()
+	if createEvent.RoomID() != event.RoomID() {
+		return notAllowed("create event has different roomID: %q != %q", event.RoomID(), createEvent.RoomID())
+	}
+	if err = create.UserIDAllowed(event.Sender()); err != nil {
+		return err
+	}
+	if err = create.UserIDAllowed(targetID); err != nil {
+		return err
+	}
+
+	if isThirdPartyInvite {
+		return thirdPartyInviteAllowed(event, authEvents, oldMember, newMember)
+	}
+	if restrictedJoin {
+		return restrictedJoinAllowed(event, authEvents, oldMember)
+	}
+	if newMember.Membership == Knock {
+		return knockAllowed(event, authEvents, oldMember)
+	}
+	return membershipAllowedAfterKnock(event, authEvents, create, newMember)
+}
+
+// RoomVersionOf returns the version of the room from its create event, and
+// what the version allows. This can differ from the version which the room's
+// events are stored as, see version.BaseRoomVersion.
+func RoomVersionOf(
+	authEvents gomatrixserverlib.AuthEventProvider,
+) (gomatrixserverlib.RoomVersion, version.RoomVersionDescription, error) {
+	create, err := gomatrixserverlib.NewCreateContentFromAuthEvents(authEvents)
+	if err != nil {
+		return "", version.RoomVersionDescription{}, err
+	}
+	// Rooms created without a version are version 1.
+	roomVersion := gomatrixserverlib.RoomVersionV1
+	if create.RoomVersion != nil {
+		roomVersion = *create.RoomVersion
+	}
+	desc, err := version.RoomVersion(roomVersion)
+	return roomVersion, desc, err
+}
+
+func notAllowed(message string, args ...interface{}) error {
+	return &gomatrixserverlib.NotAllowed{Message: fmt.Sprintf(message, args...)}
+}
@@ -52,6 +52,53 @@ func IsServerAllowed(
 	return false
 }
 
+// IsUserAllowed returns true if the user is allowed to see an event in the room
+// given the state at that event. This function implements https://matrix.org/docs/spec/client_server/r0.6.0#id87
+func IsUserAllowed(
+	userID string,
+	userCurrentlyInRoom bool,
+	stateAtEvent []gomatrixserverlib.Event,
+) bool {
+	historyVisibility := historyVisibilityForRoom(stateAtEvent)
+
+	// 1. If the history_visibility was set to world_readable, allow.
+	if historyVisibility == "world_readable" {
+		return true
+	}
+	// 2. If the user's membership was join, allow.
+	membership := membershipForUser(userID, stateAtEvent)
+	if membership == gomatrixserverlib.Join {
+		return true
+	}
+	// 3. If history_visibility was set to shared, and the user joined the room at any point after the event was sent, allow.
+	if historyVisibility == "shared" && userCurrentlyInRoom {
+		return true
+	}
+	// 4. If the user's membership was invite, and the history_visibility was set to invited, allow.
+	if membership == gomatrixserverlib.Invite && historyVisibility == "invited" {
+		return true
+	}
+
+	// 5. Otherwise, deny.
+	return false
+}
+
+// membershipForUser returns the membership of the user in the given state, or
+// an empty string if they have no membership event.
+func membershipForUser(userID string, stateEvents []gomatrixserverlib.Event) string {
+	for _, ev := range stateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || !ev.StateKeyEquals(userID) {
+			continue
+		}
+		membership, err := ev.Membership()
+		if err != nil {
+			return ""
+		}
+		return membership
+	}
+	return ""
+}
+
 func historyVisibilityForRoom(authEvents []gomatrixserverlib.Event) string {
 	// https://matrix.org/docs/spec/client_server/r0.6.0#id87
 	// By default if no history_visibility is set, or if the value is not understood, the visibility is assumed to be shared.
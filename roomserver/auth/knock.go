@@ -0,0 +1,128 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import "github.com/matrix-org/gomatrixserverlib"
+
+// TODO: Knocking (MSC2403) should live in gomatrixserverlib alongside the
+// other auth rules. Until it does, Allowed wraps the ones from
+// gomatrixserverlib and the checks below handle the "knock" membership and
+// join rule. Knocks are only allowed in room versions which define them, such
+// as version.RoomVersionKnock, so that this server agrees with other servers.
+
+// Knock is both the membership of a user who knocked on a room and the join
+// rule of a room which users may knock on.
+const Knock = "knock"
+
+// knockAllowed checks whether a user is allowed to knock on a room.
+func knockAllowed(
+	event gomatrixserverlib.Event, authEvents gomatrixserverlib.AuthEventProvider,
+	oldMember gomatrixserverlib.MemberContent,
+) error {
+	targetID := *event.StateKey()
+	if event.Sender() != targetID {
+		return notAllowed("%q is not allowed to knock on behalf of %q", event.Sender(), targetID)
+	}
+	joinRule, err := gomatrixserverlib.NewJoinRuleContentFromAuthEvents(authEvents)
+	if err != nil {
+		return err
+	}
+	if joinRule.JoinRule != Knock {
+		return notAllowed("%q is not allowed to knock on a room with the join rule %q", targetID, joinRule.JoinRule)
+	}
+	switch oldMember.Membership {
+	case gomatrixserverlib.Ban, gomatrixserverlib.Invite, gomatrixserverlib.Join:
+		return notAllowed(
+			"%q is not allowed to change their membership from %q to %q",
+			targetID, oldMember.Membership, Knock,
+		)
+	}
+	return nil
+}
+
+// membershipAllowedAfterKnock checks whether the membership of a user who has
+// knocked on a room is allowed to change to the one in the event.
+func membershipAllowedAfterKnock(
+	event gomatrixserverlib.Event, authEvents gomatrixserverlib.AuthEventProvider,
+	create gomatrixserverlib.CreateContent, newMember gomatrixserverlib.MemberContent,
+) error {
+	senderID, targetID := event.Sender(), *event.StateKey()
+
+	if senderID == targetID {
+		switch newMember.Membership {
+		case gomatrixserverlib.Leave:
+			// A user may rescind their knock.
+			return nil
+		case gomatrixserverlib.Join:
+			// A user who knocked may still join if anyone is allowed to.
+			joinRule, err := gomatrixserverlib.NewJoinRuleContentFromAuthEvents(authEvents)
+			if err != nil {
+				return err
+			}
+			if joinRule.JoinRule == gomatrixserverlib.Public {
+				return nil
+			}
+		}
+		return notAllowed(
+			"%q is not allowed to change their membership from %q to %q",
+			targetID, Knock, newMember.Membership,
+		)
+	}
+
+	if newMember.Membership != gomatrixserverlib.Invite {
+		// Kicking and banning a user who knocked follow the usual rules.
+		return gomatrixserverlib.Allowed(event, authEvents)
+	}
+
+	// A user may accept a knock by inviting the user who knocked, if their
+	// level is high enough.
+	senderMember, err := gomatrixserverlib.NewMemberContentFromAuthEvents(authEvents, senderID)
+	if err != nil {
+		return err
+	}
+	if senderMember.Membership != gomatrixserverlib.Join {
+		return notAllowed("sender %q is not in the room", senderID)
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(authEvents, create.Creator)
+	if err != nil {
+		return err
+	}
+	if powerLevels.UserLevel(senderID) < powerLevels.Invite {
+		return notAllowed(
+			"%q is not allowed to change the membership of %q from %q to %q",
+			senderID, targetID, Knock, newMember.Membership,
+		)
+	}
+	return nil
+}
+
+// CanSeeKnocks returns true if the user has enough power in the room to act
+// on the users who knocked on it, either by inviting or by banning them.
+func CanSeeKnocks(userID string, authEvents gomatrixserverlib.AuthEventProvider) bool {
+	create, err := gomatrixserverlib.NewCreateContentFromAuthEvents(authEvents)
+	if err != nil {
+		return false
+	}
+	member, err := gomatrixserverlib.NewMemberContentFromAuthEvents(authEvents, userID)
+	if err != nil || member.Membership != gomatrixserverlib.Join {
+		return false
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(authEvents, create.Creator)
+	if err != nil {
+		return false
+	}
+	level := powerLevels.UserLevel(userID)
+	return level >= powerLevels.Invite || level >= powerLevels.Ban
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var knockTestEventCount int
+
+// knockTestEvent returns a state event in !room:localhost.
+func knockTestEvent(t *testing.T, sender, eventType, stateKey, content string) *gomatrixserverlib.Event {
+	knockTestEventCount++
+	eventJSON := fmt.Sprintf(
+		`{"event_id":"$%d:localhost","room_id":"!room:localhost","sender":%q,"type":%q,"state_key":%q,"content":%s,"prev_events":[["$0:localhost",{}]]}`,
+		knockTestEventCount, sender, eventType, stateKey, content,
+	)
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &event
+}
+
+// knockTestRoom returns the auth events of a room which users may knock on if
+// its join rule allows it, created by alice with the given join rule, in which
+// bob is joined with no power.
+func knockTestRoom(t *testing.T, joinRule string) gomatrixserverlib.AuthEvents {
+	return gomatrixserverlib.NewAuthEvents([]*gomatrixserverlib.Event{
+		knockTestEvent(t, "@alice:localhost", "m.room.create", "",
+			fmt.Sprintf(`{"creator":"@alice:localhost","room_version":%q}`, version.RoomVersionKnock)),
+		knockTestEvent(t, "@alice:localhost", "m.room.power_levels", "", `{"users":{"@alice:localhost":100}}`),
+		knockTestEvent(t, "@alice:localhost", "m.room.join_rules", "", fmt.Sprintf(`{"join_rule":%q}`, joinRule)),
+		knockTestEvent(t, "@alice:localhost", "m.room.member", "@alice:localhost", `{"membership":"join"}`),
+		knockTestEvent(t, "@bob:localhost", "m.room.member", "@bob:localhost", `{"membership":"join"}`),
+	})
+}
+
+func TestKnockIsRejectedInRoomVersionsWithoutKnocking(t *testing.T) {
+	for roomVersion, desc := range version.RoomVersions() {
+		if desc.Knocking {
+			continue
+		}
+		authEvents := gomatrixserverlib.NewAuthEvents([]*gomatrixserverlib.Event{
+			knockTestEvent(t, "@alice:localhost", "m.room.create", "",
+				fmt.Sprintf(`{"creator":"@alice:localhost","room_version":%q}`, roomVersion)),
+			knockTestEvent(t, "@alice:localhost", "m.room.join_rules", "", `{"join_rule":"knock"}`),
+		})
+		knock := knockTestEvent(t, "@carol:example.org", "m.room.member", "@carol:example.org", `{"membership":"knock"}`)
+		err := Allowed(*knock, &authEvents)
+		if _, ok := err.(*gomatrixserverlib.NotAllowed); !ok || !strings.Contains(err.Error(), "doesn't allow knocking") {
+			t.Errorf("expected the knock to be rejected in room version %s, got %v", roomVersion, err)
+		}
+	}
+}
+
+func TestKnockIsAllowedWhenJoinRuleIsKnock(t *testing.T) {
+	authEvents := knockTestRoom(t, Knock)
+	knock := knockTestEvent(t, "@carol:example.org", "m.room.member", "@carol:example.org", `{"membership":"knock"}`)
+	if err := Allowed(*knock, &authEvents); err != nil {
+		t.Errorf("expected the knock to be allowed, got %s", err)
+	}
+}
+
+func TestKnockIsRejectedWhenRoomIsInviteOnly(t *testing.T) {
+	authEvents := knockTestRoom(t, gomatrixserverlib.Invite)
+	knock := knockTestEvent(t, "@carol:example.org", "m.room.member", "@carol:example.org", `{"membership":"knock"}`)
+	err := Allowed(*knock, &authEvents)
+	if _, ok := err.(*gomatrixserverlib.NotAllowed); !ok || !strings.Contains(err.Error(), `join rule "invite"`) {
+		t.Errorf("expected the knock to be rejected because of the join rule, got %v", err)
+	}
+}
+
+func TestAcceptingKnockRequiresInvitePower(t *testing.T) {
+	authEvents := knockTestRoom(t, Knock)
+	knock := knockTestEvent(t, "@carol:example.org", "m.room.member", "@carol:example.org", `{"membership":"knock"}`)
+	if err := authEvents.AddEvent(knock); err != nil {
+		t.Fatal(err)
+	}
+
+	invite := knockTestEvent(t, "@alice:localhost", "m.room.member", "@carol:example.org", `{"membership":"invite"}`)
+	if err := Allowed(*invite, &authEvents); err != nil {
+		t.Errorf("expected alice to be allowed to accept the knock, got %s", err)
+	}
+	if !CanSeeKnocks("@alice:localhost", &authEvents) {
+		t.Error("expected alice to see the knock")
+	}
+
+	// Bob can invite users by default, so require a higher level for invites.
+	authEvents = knockTestRoom(t, Knock)
+	powerLevels := knockTestEvent(
+		t, "@alice:localhost", "m.room.power_levels", "",
+		`{"users":{"@alice:localhost":100},"invite":50,"ban":50}`,
+	)
+	for _, ev := range []*gomatrixserverlib.Event{powerLevels, knock} {
+		if err := authEvents.AddEvent(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	invite = knockTestEvent(t, "@bob:localhost", "m.room.member", "@carol:example.org", `{"membership":"invite"}`)
+	if _, ok := Allowed(*invite, &authEvents).(*gomatrixserverlib.NotAllowed); !ok {
+		t.Error("expected bob not to be allowed to accept the knock")
+	}
+	if CanSeeKnocks("@bob:localhost", &authEvents) {
+		t.Error("expected bob not to see the knock")
+	}
+}
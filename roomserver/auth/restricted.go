@@ -0,0 +1,183 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// TODO: Restricted rooms (MSC3083) should also live in gomatrixserverlib. The
+// checks here only cover the auth rules; whether the user who joins is in one
+// of the allowed rooms can't be told from the state of the room, so it is
+// checked by the server which authorises the join. Like knocks, restricted
+// joins are only allowed in room versions which define them.
+
+const (
+	// Restricted is the join rule of a room which the members of the rooms
+	// in its allow list may join.
+	Restricted = "restricted"
+	// JoinAuthorisedViaUsersServer is the field in the content of a join to
+	// a restricted room which names the user whose server authorised it.
+	JoinAuthorisedViaUsersServer = "join_authorised_via_users_server"
+	// MRoomMembership is the type of allow condition which is met by being
+	// joined to a room.
+	MRoomMembership = "m.room_membership"
+)
+
+// JoinRuleAllowCondition is a condition under which users may join a
+// restricted room.
+type JoinRuleAllowCondition struct {
+	Type   string `json:"type"`
+	RoomID string `json:"room_id,omitempty"`
+}
+
+// RestrictedJoinRuleContent is the content of m.room.join_rules events,
+// including the allow list of restricted rooms.
+type RestrictedJoinRuleContent struct {
+	JoinRule string                   `json:"join_rule"`
+	Allow    []JoinRuleAllowCondition `json:"allow,omitempty"`
+}
+
+// AllowedRoomIDs returns the IDs of the rooms whose members may join a room
+// with the given join rules, and false if the room isn't restricted.
+func AllowedRoomIDs(joinRules *gomatrixserverlib.Event) ([]string, bool) {
+	if joinRules == nil {
+		return nil, false
+	}
+	var content RestrictedJoinRuleContent
+	if err := json.Unmarshal(joinRules.Content(), &content); err != nil || content.JoinRule != Restricted {
+		return nil, false
+	}
+	var roomIDs []string
+	for _, allow := range content.Allow {
+		if allow.Type == MRoomMembership && allow.RoomID != "" {
+			roomIDs = append(roomIDs, allow.RoomID)
+		}
+	}
+	return roomIDs, true
+}
+
+// JoinAuthorisedVia returns the user named as having authorised a join in the
+// content of a membership event, or an empty string if there is none.
+func JoinAuthorisedVia(content []byte) string {
+	var authorised struct {
+		Membership   string `json:"membership"`
+		AuthorisedBy string `json:"join_authorised_via_users_server"`
+	}
+	if err := json.Unmarshal(content, &authorised); err != nil || authorised.Membership != gomatrixserverlib.Join {
+		return ""
+	}
+	return authorised.AuthorisedBy
+}
+
+// CanAuthoriseRestrictedJoin returns true if the user may authorise joins to
+// a restricted room, which they may if they are joined to it and have enough
+// power to invite users into it.
+func CanAuthoriseRestrictedJoin(userID string, authEvents gomatrixserverlib.AuthEventProvider) bool {
+	create, err := gomatrixserverlib.NewCreateContentFromAuthEvents(authEvents)
+	if err != nil {
+		return false
+	}
+	member, err := gomatrixserverlib.NewMemberContentFromAuthEvents(authEvents, userID)
+	if err != nil || member.Membership != gomatrixserverlib.Join {
+		return false
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(authEvents, create.Creator)
+	if err != nil {
+		return false
+	}
+	return powerLevels.UserLevel(userID) >= powerLevels.Invite
+}
+
+// RestrictedJoinAuthoriser returns a user of the server who can authorise
+// joins to a restricted room with the given state, or an empty string if
+// there isn't one.
+func RestrictedJoinAuthoriser(
+	serverName gomatrixserverlib.ServerName, stateEvents []gomatrixserverlib.Event,
+) string {
+	provider := gomatrixserverlib.NewAuthEvents(nil)
+	for i := range stateEvents {
+		switch stateEvents[i].Type() {
+		case gomatrixserverlib.MRoomCreate, gomatrixserverlib.MRoomPowerLevels, gomatrixserverlib.MRoomMember:
+			if err := provider.AddEvent(&stateEvents[i]); err != nil {
+				return ""
+			}
+		}
+	}
+	for _, ev := range stateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+			continue
+		}
+		userID := *ev.StateKey()
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != serverName {
+			continue
+		}
+		if CanAuthoriseRestrictedJoin(userID, &provider) {
+			return userID
+		}
+	}
+	return ""
+}
+
+// restrictedJoinAllowed checks whether a user who isn't invited may join a
+// restricted room. The join must name a user who may authorise it.
+func restrictedJoinAllowed(
+	event gomatrixserverlib.Event, authEvents gomatrixserverlib.AuthEventProvider,
+	oldMember gomatrixserverlib.MemberContent,
+) error {
+	targetID := *event.StateKey()
+	if event.Sender() != targetID {
+		return notAllowed("%q is not allowed to join on behalf of %q", event.Sender(), targetID)
+	}
+	if oldMember.Membership == gomatrixserverlib.Ban {
+		return notAllowed("%q is banned from the room", targetID)
+	}
+	authoriser := JoinAuthorisedVia(event.Content())
+	if authoriser == "" {
+		return notAllowed("the join of %q to a restricted room was not authorised by a member of the room", targetID)
+	}
+	if !CanAuthoriseRestrictedJoin(authoriser, authEvents) {
+		return notAllowed("%q is not allowed to authorise joins to the room", authoriser)
+	}
+	return nil
+}
+
+// isRestrictedJoin returns true if the event is the join of a user who isn't
+// invited to a restricted room. In room versions without restricted joins the
+// join rule is treated like any other unknown one, which only allows invited
+// users to join.
+func isRestrictedJoin(
+	authEvents gomatrixserverlib.AuthEventProvider,
+	oldMember, newMember gomatrixserverlib.MemberContent,
+) (bool, error) {
+	if newMember.Membership != gomatrixserverlib.Join {
+		return false, nil
+	}
+	switch oldMember.Membership {
+	case gomatrixserverlib.Join, gomatrixserverlib.Invite:
+		return false, nil
+	}
+	joinRule, err := gomatrixserverlib.NewJoinRuleContentFromAuthEvents(authEvents)
+	if err != nil || joinRule.JoinRule != Restricted {
+		return false, err
+	}
+	_, desc, err := RoomVersionOf(authEvents)
+	if err != nil {
+		return false, err
+	}
+	return desc.RestrictedJoins, nil
+}
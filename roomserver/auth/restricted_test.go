@@ -0,0 +1,83 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const restrictedTestJoinRules = `{"join_rule":"restricted","allow":[{"type":"m.room_membership","room_id":"!space:localhost"}]}`
+
+func TestRestrictedJoinIsRejectedInRoomVersionsWithoutIt(t *testing.T) {
+	authEvents := knockTestRoom(t, "invite")
+	if err := authEvents.AddEvent(knockTestEvent(t, "@alice:localhost", "m.room.join_rules", "", restrictedTestJoinRules)); err != nil {
+		t.Fatal(err)
+	}
+	join := knockTestEvent(t, "@carol:example.org", "m.room.member", "@carol:example.org",
+		`{"membership":"join","join_authorised_via_users_server":"@alice:localhost"}`)
+	if _, ok := Allowed(*join, &authEvents).(*gomatrixserverlib.NotAllowed); !ok {
+		t.Error("expected the join to be rejected in a room version without restricted joins")
+	}
+}
+
+func TestRestrictedJoinNeedsAuthoriser(t *testing.T) {
+	authEvents := knockTestRoom(t, "invite")
+	create := knockTestEvent(t, "@alice:localhost", "m.room.create", "",
+		fmt.Sprintf(`{"creator":"@alice:localhost","room_version":%q}`, version.RoomVersionRestricted))
+	if err := authEvents.AddEvent(create); err != nil {
+		t.Fatal(err)
+	}
+	if err := authEvents.AddEvent(knockTestEvent(t, "@alice:localhost", "m.room.join_rules", "", restrictedTestJoinRules)); err != nil {
+		t.Fatal(err)
+	}
+
+	join := knockTestEvent(t, "@carol:example.org", "m.room.member", "@carol:example.org",
+		`{"membership":"join","join_authorised_via_users_server":"@alice:localhost"}`)
+	if err := Allowed(*join, &authEvents); err != nil {
+		t.Errorf("expected the join authorised by alice to be allowed, got %s", err)
+	}
+
+	join = knockTestEvent(t, "@carol:example.org", "m.room.member", "@carol:example.org", `{"membership":"join"}`)
+	err := Allowed(*join, &authEvents)
+	if _, ok := err.(*gomatrixserverlib.NotAllowed); !ok || !strings.Contains(err.Error(), "not authorised") {
+		t.Errorf("expected the join without an authoriser to be rejected, got %v", err)
+	}
+
+	// Bob can invite users by default, but not once invites need more power.
+	join = knockTestEvent(t, "@carol:example.org", "m.room.member", "@carol:example.org",
+		`{"membership":"join","join_authorised_via_users_server":"@bob:localhost"}`)
+	if err = Allowed(*join, &authEvents); err != nil {
+		t.Errorf("expected the join authorised by bob to be allowed, got %s", err)
+	}
+	if err = authEvents.AddEvent(knockTestEvent(t, "@alice:localhost", "m.room.power_levels", "", `{"users":{"@alice:localhost":100},"invite":50}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Allowed(*join, &authEvents).(*gomatrixserverlib.NotAllowed); !ok {
+		t.Error("expected bob not to be allowed to authorise the join")
+	}
+	if authoriser := RestrictedJoinAuthoriser("localhost", []gomatrixserverlib.Event{
+		*knockTestEvent(t, "@alice:localhost", "m.room.create", "", `{"creator":"@alice:localhost"}`),
+		*knockTestEvent(t, "@alice:localhost", "m.room.power_levels", "", `{"users":{"@alice:localhost":100},"invite":50}`),
+		*knockTestEvent(t, "@bob:localhost", "m.room.member", "@bob:localhost", `{"membership":"join"}`),
+		*knockTestEvent(t, "@alice:localhost", "m.room.member", "@alice:localhost", `{"membership":"join"}`),
+	}); authoriser != "@alice:localhost" {
+		t.Errorf("expected alice to be chosen to authorise joins, got %q", authoriser)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// TODO: The checks below should replace the ones for third-party invites in
+// gomatrixserverlib, which don't check the sender of the invite or whether the
+// target is banned, and only accept the keys in the "public_keys" field of the
+// m.room.third_party_invite event.
+
+// thirdPartyInviteAllowed checks whether an invite which follows up a
+// m.room.third_party_invite event is allowed, as described in
+// https://matrix.org/docs/spec/rooms/v1#authorization-rules
+func thirdPartyInviteAllowed(
+	event gomatrixserverlib.Event, authEvents gomatrixserverlib.AuthEventProvider,
+	oldMember, newMember gomatrixserverlib.MemberContent,
+) error {
+	targetID := *event.StateKey()
+	if oldMember.Membership == gomatrixserverlib.Ban {
+		return notAllowed("%q is banned from the room", targetID)
+	}
+	signed := newMember.ThirdPartyInvite.Signed
+	if signed.MXID != targetID {
+		return notAllowed(
+			"the invite target %q doesn't match the Matrix ID %q provided by the identity server",
+			targetID, signed.MXID,
+		)
+	}
+	inviteEvent, err := authEvents.ThirdPartyInvite(signed.Token)
+	if err != nil {
+		return err
+	}
+	if inviteEvent == nil {
+		return notAllowed("no m.room.third_party_invite event with the token %q", signed.Token)
+	}
+	if inviteEvent.Sender() != event.Sender() {
+		return notAllowed(
+			"%q is not allowed to follow up the third-party invite sent by %q",
+			event.Sender(), inviteEvent.Sender(),
+		)
+	}
+	var inviteContent gomatrixserverlib.ThirdPartyInviteContent
+	if err = json.Unmarshal(inviteEvent.Content(), &inviteContent); err != nil {
+		return err
+	}
+
+	// The "signed" object is verified as it was sent, as the identity server
+	// may have signed more keys than gomatrixserverlib knows about.
+	var content struct {
+		ThirdPartyInvite struct {
+			Signed json.RawMessage `json:"signed"`
+		} `json:"third_party_invite"`
+	}
+	if err = json.Unmarshal(event.Content(), &content); err != nil {
+		return err
+	}
+	for _, publicKey := range thirdPartyInvitePublicKeys(inviteContent) {
+		for domain, signatures := range signed.Signatures {
+			for keyID := range signatures {
+				if !strings.HasPrefix(keyID, "ed25519:") {
+					continue
+				}
+				if gomatrixserverlib.VerifyJSON(
+					domain, gomatrixserverlib.KeyID(keyID), publicKey, content.ThirdPartyInvite.Signed,
+				) == nil {
+					return nil
+				}
+			}
+		}
+	}
+	return notAllowed("couldn't verify the signature on the third-party invite for %q", targetID)
+}
+
+// thirdPartyInvitePublicKeys returns the keys which identity servers may sign
+// third-party invites with, from both the "public_key" and "public_keys"
+// fields of the m.room.third_party_invite event. Keys which aren't valid
+// ed25519 keys are skipped.
+func thirdPartyInvitePublicKeys(content gomatrixserverlib.ThirdPartyInviteContent) []ed25519.PublicKey {
+	var keys []ed25519.PublicKey
+	var publicKey gomatrixserverlib.Base64String
+	if err := publicKey.Decode(content.PublicKey); err == nil && len(publicKey) == ed25519.PublicKeySize {
+		keys = append(keys, ed25519.PublicKey(publicKey))
+	}
+	for _, key := range content.PublicKeys {
+		if len(key.PublicKey) == ed25519.PublicKeySize {
+			keys = append(keys, ed25519.PublicKey(key.PublicKey))
+		}
+	}
+	return keys
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// thirdPartyInviteTestRoom returns the auth events of a room in which alice
+// invited a third party identifier, along with the key of the identity server.
+func thirdPartyInviteTestRoom(t *testing.T) (gomatrixserverlib.AuthEvents, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authEvents := knockTestRoom(t, gomatrixserverlib.Invite)
+	thirdPartyInvite := knockTestEvent(t, "@alice:localhost", "m.room.third_party_invite", "token", fmt.Sprintf(
+		`{"display_name":"c...@example.org","key_validity_url":"https://id.example.org/_matrix/identity/api/v1/pubkey/isvalid","public_key":%q}`,
+		gomatrixserverlib.Base64String(publicKey).Encode(),
+	))
+	if err = authEvents.AddEvent(thirdPartyInvite); err != nil {
+		t.Fatal(err)
+	}
+	return authEvents, privateKey
+}
+
+// thirdPartyInviteTestEvent returns an invite for carol sent by the sender,
+// with a "signed" object signed by the identity server.
+func thirdPartyInviteTestEvent(t *testing.T, sender, mxid string, privateKey ed25519.PrivateKey) *gomatrixserverlib.Event {
+	// The identity server signs keys which aren't in the specification.
+	signed, err := gomatrixserverlib.SignJSON("id.example.org", "ed25519:0", privateKey, []byte(fmt.Sprintf(
+		`{"mxid":%q,"sender":"@alice:localhost","token":"token"}`, mxid,
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return knockTestEvent(t, sender, "m.room.member", "@carol:example.org", fmt.Sprintf(
+		`{"membership":"invite","third_party_invite":{"display_name":"c...@example.org","signed":%s}}`, signed,
+	))
+}
+
+func TestThirdPartyInviteIsAllowedWithSignatureFromIdentityServer(t *testing.T) {
+	authEvents, privateKey := thirdPartyInviteTestRoom(t)
+	invite := thirdPartyInviteTestEvent(t, "@alice:localhost", "@carol:example.org", privateKey)
+	if err := Allowed(*invite, &authEvents); err != nil {
+		t.Errorf("expected the invite to be allowed, got %s", err)
+	}
+}
+
+func TestThirdPartyInviteIsRejected(t *testing.T) {
+	authEvents, privateKey := thirdPartyInviteTestRoom(t)
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		invite *gomatrixserverlib.Event
+		reason string
+	}{
+		{"not signed by the identity server", thirdPartyInviteTestEvent(t, "@alice:localhost", "@carol:example.org", otherKey), "couldn't verify the signature"},
+		{"for another user", thirdPartyInviteTestEvent(t, "@alice:localhost", "@dave:example.org", privateKey), "doesn't match"},
+		{"not sent by the inviter", thirdPartyInviteTestEvent(t, "@bob:localhost", "@carol:example.org", privateKey), "not allowed to follow up"},
+	} {
+		err := Allowed(*test.invite, &authEvents)
+		if _, ok := err.(*gomatrixserverlib.NotAllowed); !ok || !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("expected an invite %s to be rejected with %q, got %v", test.name, test.reason, err)
+		}
+	}
+
+	ban := knockTestEvent(t, "@alice:localhost", "m.room.member", "@carol:example.org", `{"membership":"ban"}`)
+	if err = authEvents.AddEvent(ban); err != nil {
+		t.Fatal(err)
+	}
+	invite := thirdPartyInviteTestEvent(t, "@alice:localhost", "@carol:example.org", privateKey)
+	if _, ok := Allowed(*invite, &authEvents).(*gomatrixserverlib.NotAllowed); !ok {
+		t.Error("expected an invite for a banned user to be rejected")
+	}
+}
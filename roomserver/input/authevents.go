@@ -18,6 +18,7 @@ import (
 	"context"
 	"sort"
 
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -38,7 +39,7 @@ func checkAuthEvents(
 	// TODO: check for duplicate state keys here.
 
 	// Work out which of the state events we actually need.
-	stateNeeded := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{event.Unwrap()})
+	stateNeeded := auth.StateNeededForAuth([]gomatrixserverlib.Event{event.Unwrap()})
 
 	// Load the actual auth events from the database.
 	authEvents, err := loadAuthEvents(ctx, db, stateNeeded, authStateEntries)
@@ -47,7 +48,7 @@ func checkAuthEvents(
 	}
 
 	// Check if the event is allowed.
-	if err = gomatrixserverlib.Allowed(event.Event, &authEvents); err != nil {
+	if err = auth.Allowed(event.Event, &authEvents); err != nil {
 		return nil, err
 	}
 
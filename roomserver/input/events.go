@@ -78,6 +78,12 @@ type RoomEventDatabase interface {
 	GetRoomVersionForRoom(
 		ctx context.Context, roomID string,
 	) (gomatrixserverlib.RoomVersion, error)
+	// Block a room which has been shut down.
+	BlockRoom(ctx context.Context, roomID string) error
+	// Check whether a room has been shut down.
+	IsRoomBlocked(ctx context.Context, roomID string) (bool, error)
+	// Delete everything stored about a room.
+	PurgeRoom(ctx context.Context, roomID string) error
 }
 
 // OutputRoomEventWriter has the APIs needed to write an event to the output logs.
@@ -101,6 +107,16 @@ func processRoomEvent(
 	headered := input.Event
 	event := headered.Unwrap()
 
+	// Once a room has been shut down the only events accepted for it are the
+	// ones which take users out of it.
+	blocked, err := db.IsRoomBlocked(ctx, event.RoomID())
+	if err != nil {
+		return
+	}
+	if blocked && !isLeaveEvent(event) {
+		return "", api.ErrRoomBlocked
+	}
+
 	// Check that the event passes authentication checks and work out the numeric IDs for the auth events.
 	authEventNIDs, err := checkAuthEvents(ctx, db, headered, input.AuthEventIDs)
 	if err != nil {
@@ -151,6 +167,15 @@ func processRoomEvent(
 	)
 }
 
+// isLeaveEvent returns whether an event is a user leaving a room.
+func isLeaveEvent(event gomatrixserverlib.Event) bool {
+	if event.Type() != gomatrixserverlib.MRoomMember || event.StateKey() == nil {
+		return false
+	}
+	membership, err := event.Membership()
+	return err == nil && membership == gomatrixserverlib.Leave
+}
+
 func calculateAndSetState(
 	ctx context.Context,
 	db RoomEventDatabase,
@@ -195,6 +220,14 @@ func processInviteEvent(
 	roomID := input.Event.RoomID()
 	targetUserID := *input.Event.StateKey()
 
+	blocked, err := db.IsRoomBlocked(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return api.ErrRoomBlocked
+	}
+
 	log.WithFields(log.Fields{
 		"event_id":       input.Event.EventID(),
 		"room_id":        roomID,
@@ -263,3 +296,58 @@ func processInviteEvent(
 	succeeded = true
 	return nil
 }
+
+// rejectInvite marks a local user who was invited to a room which this server
+// isn't in as having left it, and tells the consumers that their invites have
+// been retired. It does nothing if the user isn't invited to the room.
+func rejectInvite(
+	ctx context.Context,
+	db RoomEventDatabase,
+	ow OutputRoomEventWriter,
+	input api.RejectInviteRequest,
+) (err error) {
+	roomVersion, err := db.GetRoomVersionForRoom(ctx, input.RoomID)
+	if err != nil {
+		return err
+	}
+	updater, err := db.MembershipUpdater(ctx, input.RoomID, input.UserID, roomVersion)
+	if err != nil {
+		return err
+	}
+	succeeded := false
+	defer func() {
+		txerr := common.EndTransaction(updater, &succeeded)
+		if err == nil && txerr != nil {
+			err = txerr
+		}
+	}()
+
+	if !updater.IsInvite() {
+		succeeded = true
+		return nil
+	}
+	retired, err := updater.SetToLeave(input.UserID, input.LeaveEventID)
+	if err != nil {
+		return err
+	}
+	var updates []api.OutputEvent
+	for _, eventID := range retired {
+		updates = append(updates, api.OutputEvent{
+			Type: api.OutputTypeRetireInviteEvent,
+			RetireInviteEvent: &api.OutputRetireInviteEvent{
+				EventID:          eventID,
+				TargetUserID:     input.UserID,
+				RetiredByEventID: input.LeaveEventID,
+				Membership:       gomatrixserverlib.Leave,
+			},
+		})
+	}
+	if len(updates) > 0 {
+		if err = ow.WriteOutputEvents(input.RoomID, updates); err != nil {
+			return err
+		}
+	}
+
+	succeeded = true
+	return nil
+}
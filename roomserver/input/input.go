@@ -22,8 +22,10 @@ import (
 	"sync"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
 	sarama "gopkg.in/Shopify/sarama.v1"
 )
 
@@ -34,6 +36,8 @@ type RoomserverInputAPI struct {
 	// The kafkaesque topic to output new room events to.
 	// This is the name used in kafka to identify the stream to write events to.
 	OutputRoomEventTopic string
+	// The limits which events must keep to be accepted.
+	EventLimits *config.EventLimits
 	// Protects calls to processRoomEvent
 	mutex sync.Mutex
 }
@@ -55,6 +59,21 @@ func (r *RoomserverInputAPI) WriteOutputEvents(roomID string, updates []api.Outp
 	return r.Producer.SendMessages(messages)
 }
 
+// inputQueueDepth is the number of requests to input room events which are
+// either waiting for the lock or being processed.
+var inputQueueDepth = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_queue_depth",
+		Help:      "The number of requests to input room events which are waiting or being processed",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(inputQueueDepth)
+}
+
 // InputRoomEvents implements api.RoomserverInputAPI
 func (r *RoomserverInputAPI) InputRoomEvents(
 	ctx context.Context,
@@ -62,9 +81,17 @@ func (r *RoomserverInputAPI) InputRoomEvents(
 	response *api.InputRoomEventsResponse,
 ) (err error) {
 	// We lock as processRoomEvent can only be called once at a time
+	inputQueueDepth.Inc()
+	defer inputQueueDepth.Dec()
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	for i := range request.InputRoomEvents {
+		if r.EventLimits != nil {
+			event := request.InputRoomEvents[i].Event.Unwrap()
+			if err = common.CheckEventLimits(&event, r.EventLimits); err != nil {
+				return err
+			}
+		}
 		if response.EventID, err = processRoomEvent(ctx, r.DB, r, request.InputRoomEvents[i]); err != nil {
 			return err
 		}
@@ -77,6 +104,44 @@ func (r *RoomserverInputAPI) InputRoomEvents(
 	return nil
 }
 
+// ShutdownRoom implements api.RoomserverInputAPI
+func (r *RoomserverInputAPI) ShutdownRoom(
+	ctx context.Context,
+	request *api.ShutdownRoomRequest,
+	response *api.ShutdownRoomResponse,
+) error {
+	// Hold the lock so that no events for the room are processed while it is
+	// being blocked and purged.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.DB.BlockRoom(ctx, request.RoomID); err != nil {
+		return err
+	}
+	if !request.Purge {
+		return nil
+	}
+	if err := r.DB.PurgeRoom(ctx, request.RoomID); err != nil {
+		return err
+	}
+	return r.WriteOutputEvents(request.RoomID, []api.OutputEvent{{
+		Type:      api.OutputTypePurgeRoom,
+		PurgeRoom: &api.OutputPurgeRoom{RoomID: request.RoomID},
+	}})
+}
+
+// RejectInvite implements api.RoomserverInputAPI
+func (r *RoomserverInputAPI) RejectInvite(
+	ctx context.Context,
+	request *api.RejectInviteRequest,
+	response *api.RejectInviteResponse,
+) error {
+	// Hold the lock so that the membership doesn't change under us if the
+	// user is invited again at the same time.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return rejectInvite(ctx, r.DB, r, *request)
+}
+
 // SetupHTTP adds the RoomserverInputAPI handlers to the http.ServeMux.
 func (r *RoomserverInputAPI) SetupHTTP(servMux *http.ServeMux) {
 	servMux.Handle(api.RoomserverInputRoomEventsPath,
@@ -92,4 +157,30 @@ func (r *RoomserverInputAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(api.RoomserverShutdownRoomPath,
+		common.MakeInternalAPI("shutdownRoom", func(req *http.Request) util.JSONResponse {
+			var request api.ShutdownRoomRequest
+			var response api.ShutdownRoomResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.ShutdownRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.RoomserverRejectInvitePath,
+		common.MakeInternalAPI("rejectInvite", func(req *http.Request) util.JSONResponse {
+			var request api.RejectInviteRequest
+			var response api.RejectInviteResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.RejectInvite(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
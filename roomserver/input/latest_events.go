@@ -22,10 +22,12 @@ import (
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
 )
 
 // updateLatestEvents updates the list of latest events for this room in the database and writes the
@@ -126,6 +128,18 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 		return nil
 	}
 
+	softFailed, err := u.isSoftFailed()
+	if err != nil {
+		return err
+	} else if softFailed {
+		log.WithFields(log.Fields{
+			"event_id": u.event.EventID(),
+			"room_id":  u.event.RoomID(),
+			"sender":   u.event.Sender(),
+		}).Info("Soft-failed event which isn't allowed by the current state of the room")
+		return nil
+	}
+
 	if err = u.updater.StorePreviousEvents(u.stateAtEvent.EventNID, prevEvents); err != nil {
 		return err
 	}
@@ -176,6 +190,30 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 	return u.updater.MarkEventAsSent(u.stateAtEvent.EventNID)
 }
 
+// isSoftFailed returns whether the event is allowed by the state before it but
+// not by the current state of the room, e.g. because the sender was banned on
+// another branch of the room. Soft-failed events are stored, but they aren't
+// added to the latest events or sent to the output log, so clients don't see
+// them and new events don't reference them.
+// See https://matrix.org/docs/spec/server_server/r0.1.3#soft-failure
+func (u *latestEventsUpdater) isSoftFailed() (bool, error) {
+	if u.oldStateNID == 0 {
+		// The room doesn't have a current state yet.
+		return false, nil
+	}
+	stateNeeded := auth.StateNeededForAuth([]gomatrixserverlib.Event{u.event})
+	roomState := state.NewStateResolution(u.db)
+	currentState, err := roomState.LoadStateAtSnapshotForStringTuples(u.ctx, u.oldStateNID, stateNeeded.Tuples())
+	if err != nil {
+		return false, err
+	}
+	authEvents, err := loadAuthEvents(u.ctx, u.db, stateNeeded, currentState)
+	if err != nil {
+		return false, err
+	}
+	return auth.Allowed(u.event, &authEvents) != nil, nil
+}
+
 func (u *latestEventsUpdater) latestState() error {
 	var err error
 	roomState := state.NewStateResolution(u.db)
@@ -0,0 +1,161 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package input
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const softFailRoomID = "!room:localhost"
+
+// testOutputWriter records the events written to the output log.
+type testOutputWriter struct {
+	events []api.OutputEvent
+}
+
+func (w *testOutputWriter) WriteOutputEvents(roomID string, updates []api.OutputEvent) error {
+	w.events = append(w.events, updates...)
+	return nil
+}
+
+func (w *testOutputWriter) sentNewRoomEvent(eventID string) bool {
+	for _, ev := range w.events {
+		if ev.Type == api.OutputTypeNewRoomEvent && ev.NewRoomEvent.Event.EventID() == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+type testEventBuilder struct {
+	t          *testing.T
+	privateKey ed25519.PrivateKey
+}
+
+func (b testEventBuilder) build(
+	sender, eventType string, stateKey *string, content interface{},
+	prevEvents, authEvents []gomatrixserverlib.Event,
+) gomatrixserverlib.Event {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		RoomID:   softFailRoomID,
+		Type:     eventType,
+		StateKey: stateKey,
+		Depth:    int64(len(prevEvents) + 1),
+	}
+	var prevRefs, authRefs []gomatrixserverlib.EventReference
+	for _, ev := range prevEvents {
+		prevRefs = append(prevRefs, ev.EventReference())
+		if ev.Depth() >= builder.Depth {
+			builder.Depth = ev.Depth() + 1
+		}
+	}
+	for _, ev := range authEvents {
+		authRefs = append(authRefs, ev.EventReference())
+	}
+	builder.PrevEvents, builder.AuthEvents = prevRefs, authRefs
+	if err := builder.SetContent(content); err != nil {
+		b.t.Fatal(err)
+	}
+	ev, err := builder.Build(time.Now(), "localhost", "ed25519:test", b.privateKey, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return ev
+}
+
+func inputEvent(t *testing.T, db RoomEventDatabase, ow OutputRoomEventWriter, ev gomatrixserverlib.Event) {
+	if _, err := processRoomEvent(context.Background(), db, ow, api.InputRoomEvent{
+		Kind:         api.KindNew,
+		Event:        ev.Headered(gomatrixserverlib.RoomVersionV1),
+		AuthEventIDs: ev.AuthEventIDs(),
+	}); err != nil {
+		t.Fatalf("failed to process %s: %s", ev.Type(), err)
+	}
+}
+
+func TestEventNotAllowedByCurrentStateIsSoftFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roomserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	db, err := storage.Open("file:"+filepath.Join(dir, "roomserver.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := testEventBuilder{t, privateKey}
+	ow := &testOutputWriter{}
+	empty, alice, bob := "", "@alice:localhost", "@bob:localhost"
+
+	create := b.build(alice, "m.room.create", &empty, map[string]interface{}{"creator": alice}, nil, nil)
+	aliceJoin := b.build(alice, "m.room.member", &alice, map[string]interface{}{"membership": "join"},
+		[]gomatrixserverlib.Event{create}, []gomatrixserverlib.Event{create})
+	powerLevels := b.build(alice, "m.room.power_levels", &empty, map[string]interface{}{"users": map[string]int{alice: 100}},
+		[]gomatrixserverlib.Event{aliceJoin}, []gomatrixserverlib.Event{create, aliceJoin})
+	joinRules := b.build(alice, "m.room.join_rules", &empty, map[string]interface{}{"join_rule": "public"},
+		[]gomatrixserverlib.Event{powerLevels}, []gomatrixserverlib.Event{create, aliceJoin, powerLevels})
+	bobJoin := b.build(bob, "m.room.member", &bob, map[string]interface{}{"membership": "join"},
+		[]gomatrixserverlib.Event{joinRules}, []gomatrixserverlib.Event{create, powerLevels, joinRules})
+	ban := b.build(alice, "m.room.member", &bob, map[string]interface{}{"membership": "ban"},
+		[]gomatrixserverlib.Event{bobJoin}, []gomatrixserverlib.Event{create, aliceJoin, powerLevels, bobJoin})
+	for _, ev := range []gomatrixserverlib.Event{create, aliceJoin, powerLevels, joinRules, bobJoin, ban} {
+		inputEvent(t, db, ow, ev)
+	}
+
+	// Bob sends a message on a branch of the room from before the ban.
+	// The message is allowed by the state before it, but not by the current
+	// state of the room.
+	message := b.build(bob, "m.room.message", nil, map[string]interface{}{"body": "hello"},
+		[]gomatrixserverlib.Event{bobJoin}, []gomatrixserverlib.Event{create, powerLevels, bobJoin})
+	inputEvent(t, db, ow, message)
+
+	if stored, err := db.EventsFromIDs(context.Background(), []string{message.EventID()}); err != nil || len(stored) != 1 {
+		t.Errorf("expected the soft-failed event to be stored, got %v (%v)", stored, err)
+	}
+	if ow.sentNewRoomEvent(message.EventID()) {
+		t.Error("expected the soft-failed event not to be sent to the output log")
+	}
+	if !ow.sentNewRoomEvent(ban.EventID()) {
+		t.Error("expected the ban to be sent to the output log")
+	}
+	roomNID, err := db.RoomNID(context.Background(), softFailRoomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, _, _, err := db.LatestEventIDs(context.Background(), roomNID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest) != 1 || latest[0].EventID != ban.EventID() {
+		t.Errorf("expected the ban to be the only latest event, got %v", latest)
+	}
+}
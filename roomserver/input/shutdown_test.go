@@ -0,0 +1,96 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !wasm
+// +build !wasm
+
+package input
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestBlockedRoomOnlyAcceptsLeavesAndCanBePurged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roomserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	db, err := storage.Open("file:"+filepath.Join(dir, "roomserver.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := testEventBuilder{t, privateKey}
+	ow := &testOutputWriter{}
+	ctx := context.Background()
+	empty, alice, bob := "", "@alice:localhost", "@bob:localhost"
+
+	create := b.build(alice, "m.room.create", &empty, map[string]interface{}{"creator": alice}, nil, nil)
+	aliceJoin := b.build(alice, "m.room.member", &alice, map[string]interface{}{"membership": "join"},
+		[]gomatrixserverlib.Event{create}, []gomatrixserverlib.Event{create})
+	powerLevels := b.build(alice, "m.room.power_levels", &empty, map[string]interface{}{"users": map[string]int{alice: 100}},
+		[]gomatrixserverlib.Event{aliceJoin}, []gomatrixserverlib.Event{create, aliceJoin})
+	joinRules := b.build(alice, "m.room.join_rules", &empty, map[string]interface{}{"join_rule": "public"},
+		[]gomatrixserverlib.Event{powerLevels}, []gomatrixserverlib.Event{create, aliceJoin, powerLevels})
+	for _, ev := range []gomatrixserverlib.Event{create, aliceJoin, powerLevels, joinRules} {
+		inputEvent(t, db, ow, ev)
+	}
+
+	// Blocking a room twice is the same as blocking it once.
+	for i := 0; i < 2; i++ {
+		if err = db.BlockRoom(ctx, softFailRoomID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bobJoin := b.build(bob, "m.room.member", &bob, map[string]interface{}{"membership": "join"},
+		[]gomatrixserverlib.Event{joinRules}, []gomatrixserverlib.Event{create, powerLevels, joinRules})
+	if _, err = processRoomEvent(ctx, db, ow, api.InputRoomEvent{
+		Kind:         api.KindNew,
+		Event:        bobJoin.Headered(gomatrixserverlib.RoomVersionV1),
+		AuthEventIDs: bobJoin.AuthEventIDs(),
+	}); err != api.ErrRoomBlocked {
+		t.Errorf("expected joining a blocked room to fail with ErrRoomBlocked, got %v", err)
+	}
+	aliceLeave := b.build(alice, "m.room.member", &alice, map[string]interface{}{"membership": "leave"},
+		[]gomatrixserverlib.Event{joinRules}, []gomatrixserverlib.Event{create, powerLevels, aliceJoin})
+	inputEvent(t, db, ow, aliceLeave)
+
+	for i := 0; i < 2; i++ {
+		if err = db.PurgeRoom(ctx, softFailRoomID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if roomNID, err := db.RoomNID(ctx, softFailRoomID); err != nil || roomNID != 0 {
+		t.Errorf("expected the room to be purged, got room NID %d (%v)", roomNID, err)
+	}
+	if stored, err := db.EventsFromIDs(ctx, []string{create.EventID(), aliceLeave.EventID()}); err != nil || len(stored) != 0 {
+		t.Errorf("expected the events of the room to be purged, got %v (%v)", stored, err)
+	}
+	if blocked, err := db.IsRoomBlocked(ctx, softFailRoomID); err != nil || !blocked {
+		t.Errorf("expected the room to stay blocked after being purged, got %v (%v)", blocked, err)
+	}
+}
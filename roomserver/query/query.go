@@ -18,10 +18,12 @@ package query
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/roomserver/state"
@@ -61,6 +63,16 @@ type RoomserverQueryAPIDatabase interface {
 	// Lookup the event IDs for a batch of event numeric IDs.
 	// Returns an error if the retrieval went wrong.
 	EventIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error)
+	// Look up the numeric IDs of all the events in a room.
+	// Returns an error if there was a problem talking to the database.
+	RoomEventNIDs(ctx context.Context, roomNID types.RoomNID) ([]types.EventNID, error)
+	// Look up the numeric IDs of the events of a type in a room.
+	// Returns an error if there was a problem talking to the database.
+	RoomEventNIDsOfType(ctx context.Context, roomNID types.RoomNID, eventTypeNID types.EventTypeNID) ([]types.EventNID, error)
+	// Look up the numeric IDs of up to limit of the events which a user sent
+	// into a room after afterNID, leaving out the create event and redactions.
+	// Returns an error if there was a problem talking to the database.
+	SenderEventNIDs(ctx context.Context, roomNID types.RoomNID, sender string, afterNID types.EventNID, limit int) ([]types.EventNID, error)
 	// Lookup the membership of a given user in a given room.
 	// Returns the numeric ID of the latest membership event sent from this user
 	// in this room, along a boolean set to true if the user is still in this room,
@@ -76,6 +88,11 @@ type RoomserverQueryAPIDatabase interface {
 	GetMembershipEventNIDsForRoom(
 		ctx context.Context, roomNID types.RoomNID, joinOnly bool,
 	) ([]types.EventNID, error)
+	// Look up the IDs of the rooms in which the user has the given membership.
+	// Returns an error if there was a problem talking to the database.
+	GetRoomsByMembership(
+		ctx context.Context, userID, membership string,
+	) ([]string, error)
 	// Look up the active invites targeting a user in a room and return the
 	// numeric state key IDs for the user IDs who sent them.
 	// Returns an error if there was a problem talking to the database.
@@ -93,11 +110,16 @@ type RoomserverQueryAPIDatabase interface {
 	GetRoomVersionForRoom(
 		ctx context.Context, roomID string,
 	) (gomatrixserverlib.RoomVersion, error)
+	// Check whether a room has been shut down.
+	IsRoomBlocked(ctx context.Context, roomID string) (bool, error)
 }
 
 // RoomserverQueryAPI is an implementation of api.RoomserverQueryAPI
 type RoomserverQueryAPI struct {
 	DB RoomserverQueryAPIDatabase
+	// The compiled server ACLs of rooms. If nil then the ACLs are compiled
+	// for every query.
+	ServerACLs *acls.ServerACLs
 }
 
 // QueryLatestEventsAndState implements api.RoomserverQueryAPI
@@ -196,10 +218,16 @@ func (r *RoomserverQueryAPI) QueryStateAfterEvents(
 	}
 	response.PrevEventsExist = true
 
-	// Look up the currrent state for the requested tuples.
-	stateEntries, err := roomState.LoadStateAfterEventsForStringTuples(
-		ctx, roomNID, prevStates, request.StateToFetch,
-	)
+	// Look up the currrent state for the requested tuples, or the entire
+	// state if no tuples were requested.
+	var stateEntries []types.StateEntry
+	if len(request.StateToFetch) == 0 {
+		stateEntries, err = roomState.LoadCombinedStateAfterEvents(ctx, prevStates)
+	} else {
+		stateEntries, err = roomState.LoadStateAfterEventsForStringTuples(
+			ctx, roomNID, prevStates, request.StateToFetch,
+		)
+	}
 	if err != nil {
 		return err
 	}
@@ -239,6 +267,8 @@ func (r *RoomserverQueryAPI) QueryEventsByID(
 		return err
 	}
 
+	// The redactions in each room are only looked for once.
+	redactedInRoom := make(map[string]map[string]bool)
 	for _, event := range events {
 		roomVersion, verr := r.DB.GetRoomVersionForRoom(ctx, event.RoomID())
 		if verr != nil {
@@ -246,11 +276,57 @@ func (r *RoomserverQueryAPI) QueryEventsByID(
 		}
 
 		response.Events = append(response.Events, event.Headered(roomVersion))
+
+		if !request.CheckRedactions {
+			continue
+		}
+		redacted, ok := redactedInRoom[event.RoomID()]
+		if !ok {
+			if redacted, err = r.redactedEventsInRoom(ctx, event.RoomID()); err != nil {
+				return err
+			}
+			redactedInRoom[event.RoomID()] = redacted
+		}
+		if redacted[event.EventID()] {
+			response.RedactedEventIDs = append(response.RedactedEventIDs, event.EventID())
+		}
 	}
 
 	return nil
 }
 
+// redactedEventsInRoom returns the IDs of the events in a room which an
+// m.room.redaction event in the room has redacted.
+func (r *RoomserverQueryAPI) redactedEventsInRoom(
+	ctx context.Context, roomID string,
+) (map[string]bool, error) {
+	roomNID, err := r.DB.RoomNID(ctx, roomID)
+	if err != nil || roomNID == 0 {
+		return nil, err
+	}
+	eventNIDs, err := r.DB.RoomEventNIDsOfType(ctx, roomNID, types.MRoomRedactionNID)
+	if err != nil {
+		return nil, err
+	}
+	redactions, err := r.loadEvents(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	return redactedEvents(redactions), nil
+}
+
+// redactedEvents returns the IDs of the events which the redactions among the
+// given events redact.
+func redactedEvents(events []gomatrixserverlib.Event) map[string]bool {
+	redacted := make(map[string]bool)
+	for _, event := range events {
+		if event.Type() == gomatrixserverlib.MRoomRedaction && event.Redacts() != "" {
+			redacted[event.Redacts()] = true
+		}
+	}
+	return redacted
+}
+
 func (r *RoomserverQueryAPI) loadStateEvents(
 	ctx context.Context, stateEntries []types.StateEntry,
 ) ([]gomatrixserverlib.Event, error) {
@@ -349,6 +425,17 @@ func (r *RoomserverQueryAPI) QueryMembershipsForRoom(
 		return err
 	}
 
+	if stillInRoom && !request.JoinedOnly {
+		// Users who knocked on the room are stored as having left it, so
+		// replace their membership events with their knocks, but only for
+		// users with enough power to act on the knocks.
+		var knocks []types.Event
+		if knocks, err = r.getKnocksVisibleTo(ctx, roomNID, request.Sender); err != nil {
+			return err
+		}
+		events = replaceMembershipEvents(events, knocks)
+	}
+
 	for _, event := range events {
 		clientEvent := gomatrixserverlib.ToClientEvent(event.Event, gomatrixserverlib.FormatAll)
 		response.JoinEvents = append(response.JoinEvents, clientEvent)
@@ -357,6 +444,67 @@ func (r *RoomserverQueryAPI) QueryMembershipsForRoom(
 	return nil
 }
 
+// getKnocksVisibleTo returns the membership events of the users who are
+// currently knocking on a room, or nothing if the given user doesn't have
+// enough power in the room to see them.
+// Returns an error if there was an issue fetching the events.
+func (r *RoomserverQueryAPI) getKnocksVisibleTo(
+	ctx context.Context, roomNID types.RoomNID, userID string,
+) ([]types.Event, error) {
+	_, currentStateSnapshotNID, _, err := r.DB.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	roomState := state.NewStateResolution(r.DB)
+	stateEntries, err := roomState.LoadStateAtSnapshot(ctx, currentStateSnapshotNID)
+	if err != nil {
+		return nil, err
+	}
+
+	var eventNIDs []types.EventNID
+	for _, entry := range stateEntries {
+		switch entry.EventTypeNID {
+		case types.MRoomCreateNID, types.MRoomPowerLevelsNID, types.MRoomMemberNID:
+			eventNIDs = append(eventNIDs, entry.EventNID)
+		}
+	}
+	stateEvents, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	var knocks []types.Event
+	for i := range stateEvents {
+		if err = authEvents.AddEvent(&stateEvents[i].Event); err != nil {
+			return nil, err
+		}
+		if membership, merr := stateEvents[i].Membership(); merr == nil && membership == auth.Knock {
+			knocks = append(knocks, stateEvents[i])
+		}
+	}
+	if !auth.CanSeeKnocks(userID, &authEvents) {
+		return nil, nil
+	}
+	return knocks, nil
+}
+
+// replaceMembershipEvents replaces the membership events in events with the
+// ones for the same users in replacements, or adds them if there are none.
+func replaceMembershipEvents(events, replacements []types.Event) []types.Event {
+	replaced := make(map[string]bool, len(replacements))
+	for _, event := range replacements {
+		replaced[*event.StateKey()] = true
+	}
+	result := make([]types.Event, 0, len(events)+len(replacements))
+	for _, event := range events {
+		if !replaced[*event.StateKey()] {
+			result = append(result, event)
+		}
+	}
+	return append(result, replacements...)
+}
+
 // getMembershipsBeforeEventNID takes the numeric ID of an event and fetches the state
 // of the event's room as it was when this event was fired, then filters the state events to
 // only keep the "m.room.member" events with a "join" membership. These events are returned.
@@ -451,6 +599,20 @@ func (r *RoomserverQueryAPI) QueryInvitesForUser(
 	return nil
 }
 
+// QueryRoomsForUser implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryRoomsForUser(
+	ctx context.Context,
+	request *api.QueryRoomsForUserRequest,
+	response *api.QueryRoomsForUserResponse,
+) error {
+	roomIDs, err := r.DB.GetRoomsByMembership(ctx, request.UserID, request.WantMembership)
+	if err != nil {
+		return err
+	}
+	response.RoomIDs = roomIDs
+	return nil
+}
+
 // QueryServerAllowedToSeeEvent implements api.RoomserverQueryAPI
 func (r *RoomserverQueryAPI) QueryServerAllowedToSeeEvent(
 	ctx context.Context,
@@ -725,8 +887,14 @@ func (r *RoomserverQueryAPI) QueryStateAndAuthChain(
 	}
 	response.RoomVersion = roomVersion
 
-	stateEvents, err := r.loadStateAtEventIDs(ctx, request.PrevEventIDs)
-	if err != nil {
+	var stateEvents []gomatrixserverlib.Event
+	if request.StateBeforeEvent && len(request.PrevEventIDs) == 1 {
+		var known bool
+		stateEvents, known, err = r.loadStateBeforeEventID(ctx, request.PrevEventIDs[0])
+		if err != nil || !known {
+			return err
+		}
+	} else if stateEvents, err = r.loadStateAtEventIDs(ctx, request.PrevEventIDs); err != nil {
 		return err
 	}
 	response.PrevEventsExist = true
@@ -763,6 +931,45 @@ func (r *RoomserverQueryAPI) QueryStateAndAuthChain(
 	return err
 }
 
+// QueryAuthChain implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryAuthChain(
+	ctx context.Context,
+	request *api.QueryAuthChainRequest,
+	response *api.QueryAuthChainResponse,
+) error {
+	authEvents, err := getOrderedAuthChain(ctx, r.DB, request.EventIDs)
+	if err != nil {
+		return err
+	}
+	roomVersions := make(map[string]gomatrixserverlib.RoomVersion)
+	for _, event := range authEvents {
+		roomVersion, ok := roomVersions[event.RoomID()]
+		if !ok {
+			if roomVersion, err = r.DB.GetRoomVersionForRoom(ctx, event.RoomID()); err != nil {
+				return err
+			}
+			roomVersions[event.RoomID()] = roomVersion
+		}
+		response.AuthChain = append(response.AuthChain, event.Headered(roomVersion))
+	}
+	return nil
+}
+
+// QueryServerJoinedToRoom implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryServerJoinedToRoom(
+	ctx context.Context,
+	request *api.QueryServerJoinedToRoomRequest,
+	response *api.QueryServerJoinedToRoomResponse,
+) (err error) {
+	roomNID, err := r.DB.RoomNID(ctx, request.RoomID)
+	if err != nil || roomNID == 0 {
+		return
+	}
+	response.RoomExists = true
+	response.IsInRoom, err = r.isServerCurrentlyInRoom(ctx, request.ServerName, request.RoomID)
+	return
+}
+
 func (r *RoomserverQueryAPI) loadStateAtEventIDs(ctx context.Context, eventIDs []string) ([]gomatrixserverlib.Event, error) {
 	roomState := state.NewStateResolution(r.DB)
 	prevStates, err := r.DB.StateAtEventIDs(ctx, eventIDs)
@@ -786,6 +993,26 @@ func (r *RoomserverQueryAPI) loadStateAtEventIDs(ctx context.Context, eventIDs [
 	return r.loadStateEvents(ctx, stateEntries)
 }
 
+// loadStateBeforeEventID loads the state snapshot stored for the state before
+// an event. It returns false if the event or the state before it isn't known,
+// such as for outliers.
+func (r *RoomserverQueryAPI) loadStateBeforeEventID(
+	ctx context.Context, eventID string,
+) ([]gomatrixserverlib.Event, bool, error) {
+	snapshotNID, err := r.DB.SnapshotNIDFromEventID(ctx, eventID)
+	if err == sql.ErrNoRows || (err == nil && snapshotNID == 0) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	stateEntries, err := state.NewStateResolution(r.DB).LoadStateAtSnapshot(ctx, snapshotNID)
+	if err != nil {
+		return nil, false, err
+	}
+	stateEvents, err := r.loadStateEvents(ctx, stateEntries)
+	return stateEvents, err == nil, err
+}
+
 // getAuthChain fetches the auth chain for the given auth events. An auth chain
 // is the list of all events that are referenced in the auth_events section, and
 // all their auth_events, recursively. The returned set of events contain the
@@ -837,6 +1064,19 @@ func getAuthChain(
 	return authEvents, nil
 }
 
+// getOrderedAuthChain fetches the auth chain for the given events like
+// getAuthChain, and orders it so that auth events come before the events that
+// they authorise.
+func getOrderedAuthChain(
+	ctx context.Context, dB RoomserverQueryAPIEventDB, eventIDs []string,
+) ([]gomatrixserverlib.Event, error) {
+	authEvents, err := getAuthChain(ctx, dB, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	return gomatrixserverlib.ReverseTopologicalOrdering(authEvents), nil
+}
+
 // QueryServersInRoomAtEvent implements api.RoomserverQueryAPI
 func (r *RoomserverQueryAPI) QueryServersInRoomAtEvent(
 	ctx context.Context,
@@ -904,6 +1144,100 @@ func (r *RoomserverQueryAPI) QueryRoomVersionForRoom(
 	return nil
 }
 
+// QueryRoomBlocked implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryRoomBlocked(
+	ctx context.Context,
+	request *api.QueryRoomBlockedRequest,
+	response *api.QueryRoomBlockedResponse,
+) (err error) {
+	response.Blocked, err = r.DB.IsRoomBlocked(ctx, request.RoomID)
+	return
+}
+
+// QueryServerBannedFromRoom implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryServerBannedFromRoom(
+	ctx context.Context,
+	request *api.QueryServerBannedFromRoomRequest,
+	response *api.QueryServerBannedFromRoomResponse,
+) error {
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: request.RoomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: acls.MRoomServerACL, StateKey: ""},
+		},
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := r.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return err
+	}
+
+	var aclEvent *gomatrixserverlib.Event
+	if len(stateRes.StateEvents) > 0 {
+		event := stateRes.StateEvents[0].Unwrap()
+		aclEvent = &event
+	}
+	var acl *acls.ServerACL
+	var err error
+	if r.ServerACLs != nil {
+		acl, err = r.ServerACLs.ForEvent(request.RoomID, aclEvent)
+	} else if aclEvent != nil {
+		acl, err = acls.NewServerACL(aclEvent)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Rooms without a server ACL allow every server.
+	response.Banned = acl != nil && acl.IsServerBanned(request.ServerName)
+	return nil
+}
+
+// QueryEventsBySender implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryEventsBySender(
+	ctx context.Context,
+	request *api.QueryEventsBySenderRequest,
+	response *api.QueryEventsBySenderResponse,
+) error {
+	roomNID, err := r.DB.RoomNID(ctx, request.RoomID)
+	if err != nil || roomNID == 0 {
+		return err
+	}
+	response.RoomExists = true
+
+	roomVersion, err := r.DB.GetRoomVersionForRoom(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+	redacted, err := r.redactedEventsInRoom(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+
+	// The events are looked up a page at a time, as the ones which were
+	// already redacted don't count towards the limit.
+	var afterNID types.EventNID
+	for len(response.Events) < request.Limit {
+		var eventNIDs []types.EventNID
+		eventNIDs, err = r.DB.SenderEventNIDs(ctx, roomNID, request.Sender, afterNID, request.Limit)
+		if err != nil || len(eventNIDs) == 0 {
+			return err
+		}
+		afterNID = eventNIDs[len(eventNIDs)-1]
+		var events []gomatrixserverlib.Event
+		events, err = r.loadEvents(ctx, eventNIDs)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if redacted[event.EventID()] || len(response.Events) == request.Limit {
+				continue
+			}
+			response.Events = append(response.Events, event.Headered(roomVersion))
+		}
+	}
+	return nil
+}
+
 // SetupHTTP adds the RoomserverQueryAPI handlers to the http.ServeMux.
 // nolint: gocyclo
 func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
@@ -991,6 +1325,20 @@ func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.RoomserverQueryRoomsForUserPath,
+		common.MakeInternalAPI("queryRoomsForUser", func(req *http.Request) util.JSONResponse {
+			var request api.QueryRoomsForUserRequest
+			var response api.QueryRoomsForUserResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryRoomsForUser(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	servMux.Handle(
 		api.RoomserverQueryServerAllowedToSeeEventPath,
 		common.MakeInternalAPI("queryServerAllowedToSeeEvent", func(req *http.Request) util.JSONResponse {
@@ -1033,6 +1381,34 @@ func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.RoomserverQueryAuthChainPath,
+		common.MakeInternalAPI("queryAuthChain", func(req *http.Request) util.JSONResponse {
+			var request api.QueryAuthChainRequest
+			var response api.QueryAuthChainResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryAuthChain(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryServerJoinedToRoomPath,
+		common.MakeInternalAPI("queryServerJoinedToRoom", func(req *http.Request) util.JSONResponse {
+			var request api.QueryServerJoinedToRoomRequest
+			var response api.QueryServerJoinedToRoomResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryServerJoinedToRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	servMux.Handle(
 		api.RoomserverQueryBackfillPath,
 		common.MakeInternalAPI("QueryBackfill", func(req *http.Request) util.JSONResponse {
@@ -1089,4 +1465,46 @@ func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.RoomserverQueryServerBannedFromRoomPath,
+		common.MakeInternalAPI("QueryServerBannedFromRoom", func(req *http.Request) util.JSONResponse {
+			var request api.QueryServerBannedFromRoomRequest
+			var response api.QueryServerBannedFromRoomResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryServerBannedFromRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryEventsBySenderPath,
+		common.MakeInternalAPI("QueryEventsBySender", func(req *http.Request) util.JSONResponse {
+			var request api.QueryEventsBySenderRequest
+			var response api.QueryEventsBySenderResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryEventsBySender(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryRoomBlockedPath,
+		common.MakeInternalAPI("QueryRoomBlocked", func(req *http.Request) util.JSONResponse {
+			var request api.QueryRoomBlockedRequest
+			var response api.QueryRoomBlockedResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryRoomBlocked(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
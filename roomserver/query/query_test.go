@@ -155,3 +155,38 @@ func TestGetAuthChainMultiple(t *testing.T) {
 		t.Fatalf("returnedIDs got '%v', expected '%v'", returnedIDs, expectedIDs)
 	}
 }
+
+func TestGetOrderedAuthChain(t *testing.T) {
+	db := createEventDB()
+
+	err := db.addFakeEvents(map[string][]string{
+		"a": {},
+		"b": {"a"},
+		"c": {"a", "b"},
+		"d": {"b", "c"},
+		"e": {"a", "d"},
+		"f": {"a", "b", "c"},
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to add events to db: %v", err)
+	}
+
+	result, err := getOrderedAuthChain(context.TODO(), db, []string{"e", "f"})
+	if err != nil {
+		t.Fatalf("getOrderedAuthChain failed: %v", err)
+	}
+
+	if len(result) != 6 {
+		t.Fatalf("expected the six events of the auth chain, got %d", len(result))
+	}
+	seen := make(map[string]bool)
+	for _, event := range result {
+		for _, authID := range event.AuthEventIDs() {
+			if !seen[authID] {
+				t.Fatalf("event %q came before its auth event %q", event.EventID(), authID)
+			}
+		}
+		seen[event.EventID()] = true
+	}
+}
@@ -21,6 +21,8 @@ import (
 
 	asQuery "github.com/matrix-org/dendrite/appservice/query"
 	"github.com/matrix-org/dendrite/common/basecomponent"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/alias"
 	"github.com/matrix-org/dendrite/roomserver/input"
 	"github.com/matrix-org/dendrite/roomserver/query"
@@ -35,20 +37,25 @@ import (
 func SetupRoomServerComponent(
 	base *basecomponent.BaseDendrite,
 ) (api.RoomserverAliasAPI, api.RoomserverInputAPI, api.RoomserverQueryAPI) {
-	roomserverDB, err := storage.Open(string(base.Cfg.Database.RoomServer))
+	roomserverDB, err := storage.Open(string(base.Cfg.Database.RoomServer), base.Cfg.DbProperties(config.DatabaseRoomServer))
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to room server db")
 	}
+	base.RegisterDatabaseHealthCheck("room server db", roomserverDB)
 
 	inputAPI := input.RoomserverInputAPI{
 		DB:                   roomserverDB,
 		Producer:             base.KafkaProducer,
 		OutputRoomEventTopic: string(base.Cfg.Kafka.Topics.OutputRoomEvent),
+		EventLimits:          &base.Cfg.Matrix.EventLimits,
 	}
 
 	inputAPI.SetupHTTP(http.DefaultServeMux)
 
-	queryAPI := query.RoomserverQueryAPI{DB: roomserverDB}
+	queryAPI := query.RoomserverQueryAPI{
+		DB:         roomserverDB,
+		ServerACLs: acls.NewServerACLs(),
+	}
 
 	queryAPI.SetupHTTP(http.DefaultServeMux)
 
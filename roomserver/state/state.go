@@ -22,6 +22,7 @@ import (
 	"sort"
 	"time"
 
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/roomserver/state/database"
 	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus"
@@ -743,11 +744,17 @@ func ResolveConflictsAdhoc(
 		// for us, like state res v2 does, so we will need to add the
 		// unconflicted events into the state ourselves.
 		// TODO: Fix state res v1 so this is handled for the caller.
-		resolved = gomatrixserverlib.ResolveStateConflicts(conflicted, authEvents)
+		// Like resolveConflictsV1, the conflicted events are authed against
+		// the unconflicted state rather than against their whole auth chain,
+		// which has every earlier version of the auth events in it.
+		resolved = gomatrixserverlib.ResolveStateConflicts(
+			conflicted, stateNeededForAuth(conflicted, notConflicted),
+		)
 		resolved = append(resolved, notConflicted...)
 	case gomatrixserverlib.StateResV2:
-		// TODO: auth difference here?
-		resolved = gomatrixserverlib.ResolveStateConflictsV2(conflicted, notConflicted, authEvents, authEvents)
+		resolved = gomatrixserverlib.ResolveStateConflictsV2(
+			conflicted, notConflicted, authEvents, authDifference(conflicted, authEvents),
+		)
 	default:
 		return nil, fmt.Errorf("unsupported state resolution algorithm %v", stateResAlgo)
 	}
@@ -757,6 +764,70 @@ func ResolveConflictsAdhoc(
 	return resolved, nil
 }
 
+// stateNeededForAuth returns the events from the state which are needed to
+// authenticate the given events.
+func stateNeededForAuth(
+	events, state []gomatrixserverlib.Event,
+) []gomatrixserverlib.Event {
+	needed := make(map[gomatrixserverlib.StateKeyTuple]bool)
+	for _, tuple := range auth.StateNeededForAuth(events).Tuples() {
+		needed[tuple] = true
+	}
+	var result []gomatrixserverlib.Event
+	for _, event := range state {
+		tuple := gomatrixserverlib.StateKeyTuple{EventType: event.Type(), StateKey: *event.StateKey()}
+		if needed[tuple] {
+			result = append(result, event)
+		}
+	}
+	return result
+}
+
+// authDifference works out the auth difference of the conflicted events for
+// state resolution v2, which is every event that is in the auth chain of some
+// but not all of the conflicted events. The auth chains are followed through
+// the auth events that were given, which should contain the full auth chain of
+// each of the conflicted events.
+func authDifference(
+	conflicted, authEvents []gomatrixserverlib.Event,
+) []gomatrixserverlib.Event {
+	authEventMap := make(map[string]gomatrixserverlib.Event, len(authEvents))
+	for _, event := range authEvents {
+		authEventMap[event.EventID()] = event
+	}
+
+	// Count how many of the conflicted events have each auth event somewhere
+	// in their auth chain.
+	chainCounts := make(map[string]int)
+	for _, event := range conflicted {
+		inChain := make(map[string]bool)
+		queue := event.AuthEventIDs()
+		for len(queue) > 0 {
+			eventID := queue[0]
+			queue = queue[1:]
+			authEvent, ok := authEventMap[eventID]
+			if !ok || inChain[eventID] {
+				continue
+			}
+			inChain[eventID] = true
+			chainCounts[eventID]++
+			queue = append(queue, authEvent.AuthEventIDs()...)
+		}
+	}
+
+	var difference []gomatrixserverlib.Event
+	for _, event := range authEvents {
+		if count, ok := chainCounts[event.EventID()]; ok && count < len(conflicted) {
+			difference = append(difference, event)
+			// Don't add the same event twice if it was given more than once.
+			delete(chainCounts, event.EventID())
+		}
+	}
+	return difference
+}
+
+// resolveConflicts resolves the conflicted state entries with the state
+// resolution algorithm of the room version.
 func (v StateResolution) resolveConflicts(
 	ctx context.Context, version gomatrixserverlib.RoomVersion,
 	notConflicted, conflicted []types.StateEntry,
@@ -793,7 +864,7 @@ func (v StateResolution) resolveConflictsV1(
 	}
 
 	// Work out which auth events we need to load.
-	needed := gomatrixserverlib.StateNeededForAuth(conflictedEvents)
+	needed := auth.StateNeededForAuth(conflictedEvents)
 
 	// Find the numeric IDs for the necessary state keys.
 	var neededStateKeys []string
@@ -879,7 +950,7 @@ func (v StateResolution) resolveConflictsV2(
 	for _, conflictedEvent := range conflictedEvents {
 		// Work out which auth events we need to load.
 		key := conflictedEvent.EventID()
-		needed := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{conflictedEvent})
+		needed := auth.StateNeededForAuth([]gomatrixserverlib.Event{conflictedEvent})
 
 		// Find the numeric IDs for the necessary state keys.
 		var neededStateKeys []string
@@ -17,9 +17,12 @@
 package state
 
 import (
+	"crypto/ed25519"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func TestFindDuplicateStateKeys(t *testing.T) {
@@ -56,3 +59,179 @@ func TestFindDuplicateStateKeys(t *testing.T) {
 		}
 	}
 }
+
+// testRoomEvents builds the events of a test room, in which @alice:localhost
+// is the room creator and @bob:localhost has a power level of 50.
+type testRoomEvents struct {
+	t      *testing.T
+	key    ed25519.PrivateKey
+	now    time.Time
+	events []gomatrixserverlib.Event
+}
+
+func newTestRoomEvents(t *testing.T) *testRoomEvents {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testRoomEvents{t: t, key: key, now: time.Unix(1500000000, 0)}
+}
+
+// add builds a state event with the given depth and auth events. Each event is
+// sent a second after the one before it.
+func (r *testRoomEvents) add(
+	sender, eventType, stateKey string, content interface{}, depth int64,
+	authEvents ...gomatrixserverlib.Event,
+) gomatrixserverlib.Event {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		RoomID:   "!test:localhost",
+		Type:     eventType,
+		StateKey: &stateKey,
+		Depth:    depth,
+	}
+	if err := builder.SetContent(content); err != nil {
+		r.t.Fatal(err)
+	}
+	refs := []gomatrixserverlib.EventReference{}
+	for _, ev := range authEvents {
+		refs = append(refs, ev.EventReference())
+	}
+	builder.AuthEvents = refs
+	if len(r.events) > 0 {
+		builder.PrevEvents = []gomatrixserverlib.EventReference{r.events[len(r.events)-1].EventReference()}
+	}
+	r.now = r.now.Add(time.Second)
+	ev, err := builder.Build(r.now, "localhost", "ed25519:test", r.key, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.events = append(r.events, ev)
+	return ev
+}
+
+// setUp adds the create event, the power levels, the join rules and the joins
+// of alice and bob, and returns them in that order.
+func (r *testRoomEvents) setUp() []gomatrixserverlib.Event {
+	create := r.add("@alice:localhost", gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+		"creator": "@alice:localhost",
+	}, 1)
+	aliceJoin := r.add("@alice:localhost", gomatrixserverlib.MRoomMember, "@alice:localhost", map[string]interface{}{
+		"membership": gomatrixserverlib.Join,
+	}, 2, create)
+	powerLevels := r.add("@alice:localhost", gomatrixserverlib.MRoomPowerLevels, "", testPowerLevels(50), 3, create, aliceJoin)
+	joinRules := r.add("@alice:localhost", gomatrixserverlib.MRoomJoinRules, "", map[string]interface{}{
+		"join_rule": gomatrixserverlib.Public,
+	}, 4, create, aliceJoin, powerLevels)
+	bobJoin := r.add("@bob:localhost", gomatrixserverlib.MRoomMember, "@bob:localhost", map[string]interface{}{
+		"membership": gomatrixserverlib.Join,
+	}, 5, create, powerLevels, joinRules)
+	return []gomatrixserverlib.Event{create, powerLevels, joinRules, aliceJoin, bobJoin}
+}
+
+// testPowerLevels returns power levels in which only alice and users with a
+// power level of 50 can change the topic, with bob given the level passed in.
+func testPowerLevels(bobLevel int64) gomatrixserverlib.PowerLevelContent {
+	var content gomatrixserverlib.PowerLevelContent
+	content.Defaults()
+	content.Users = map[string]int64{"@alice:localhost": 100, "@bob:localhost": bobLevel}
+	content.Events = map[string]int64{"m.room.topic": 50}
+	return content
+}
+
+// resolvedEventIDs returns the IDs of the resolved state events by type.
+func resolvedEventIDs(t *testing.T, resolved []gomatrixserverlib.Event) map[string]string {
+	eventIDs := make(map[string]string)
+	for _, ev := range resolved {
+		key := ev.Type() + "|" + *ev.StateKey()
+		if _, ok := eventIDs[key]; ok {
+			t.Fatalf("expected a single resolved event for %s", key)
+		}
+		eventIDs[key] = ev.EventID()
+	}
+	return eventIDs
+}
+
+func TestResolveConflictsAdhocPicksAlgorithmForRoomVersion(t *testing.T) {
+	room := newTestRoomEvents(t)
+	state := room.setUp()
+	create, powerLevels, aliceJoin := state[0], state[1], state[3]
+
+	// The deeper topic was sent first, so state resolution v1 prefers it
+	// because of its depth, whereas state resolution v2 orders the topics by
+	// their timestamps as they share the same power levels on the mainline.
+	deeper := room.add("@alice:localhost", "m.room.topic", "", map[string]interface{}{"topic": "deeper"}, 7, create, powerLevels, aliceJoin)
+	later := room.add("@alice:localhost", "m.room.topic", "", map[string]interface{}{"topic": "later"}, 6, create, powerLevels, aliceJoin)
+	events := append(append([]gomatrixserverlib.Event{}, state...), deeper, later)
+
+	for version, want := range map[gomatrixserverlib.RoomVersion]gomatrixserverlib.Event{
+		gomatrixserverlib.RoomVersionV1: deeper,
+		gomatrixserverlib.RoomVersionV2: later,
+	} {
+		resolved, err := ResolveConflictsAdhoc(version, events, room.events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eventIDs := resolvedEventIDs(t, resolved)
+		if len(eventIDs) != len(state)+1 {
+			t.Errorf("room version %s: expected %d resolved state events, got %d", version, len(state)+1, len(eventIDs))
+		}
+		if got := eventIDs["m.room.topic|"]; got != want.EventID() {
+			t.Errorf("room version %s: expected topic %s, got %s", version, want.EventID(), got)
+		}
+	}
+
+	if _, err := ResolveConflictsAdhoc("unknown", events, room.events); err == nil {
+		t.Error("expected an error for an unknown room version")
+	}
+}
+
+func TestResolveConflictsV2AppliesResolvedPowerLevels(t *testing.T) {
+	room := newTestRoomEvents(t)
+	state := room.setUp()
+	create, powerLevels, aliceJoin, bobJoin := state[0], state[1], state[3], state[4]
+
+	// One fork has alice demoting bob, the other has bob changing the topic
+	// while they still could. Power events are resolved first, and bob's topic
+	// is then rejected by the power levels that won.
+	topic := room.add("@alice:localhost", "m.room.topic", "", map[string]interface{}{"topic": "alice's"}, 6, create, powerLevels, aliceJoin)
+	demoted := room.add("@alice:localhost", gomatrixserverlib.MRoomPowerLevels, "", testPowerLevels(0), 7, create, powerLevels, aliceJoin)
+	bobsTopic := room.add("@bob:localhost", "m.room.topic", "", map[string]interface{}{"topic": "bob's"}, 7, create, powerLevels, bobJoin)
+
+	events := append(append([]gomatrixserverlib.Event{}, state...), topic, demoted, bobsTopic)
+	resolved, err := ResolveConflictsAdhoc(gomatrixserverlib.RoomVersionV2, events, room.events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventIDs := resolvedEventIDs(t, resolved)
+	if got := eventIDs["m.room.power_levels|"]; got != demoted.EventID() {
+		t.Errorf("expected the power levels demoting bob to win, got %s", got)
+	}
+	if got := eventIDs["m.room.topic|"]; got != topic.EventID() {
+		t.Errorf("expected the topic of alice to win over %s, got %s", bobsTopic.EventID(), got)
+	}
+	for _, ev := range []gomatrixserverlib.Event{create, aliceJoin, bobJoin} {
+		if eventIDs[ev.Type()+"|"+*ev.StateKey()] != ev.EventID() {
+			t.Errorf("expected the unconflicted %s event to be kept", ev.Type())
+		}
+	}
+}
+
+func TestAuthDifference(t *testing.T) {
+	room := newTestRoomEvents(t)
+	state := room.setUp()
+	create, powerLevels, joinRules, aliceJoin, bobJoin := state[0], state[1], state[2], state[3], state[4]
+	aliceTopic := room.add("@alice:localhost", "m.room.topic", "", map[string]interface{}{"topic": "alice's"}, 6, create, powerLevels, aliceJoin)
+	bobsTopic := room.add("@bob:localhost", "m.room.topic", "", map[string]interface{}{"topic": "bob's"}, 6, create, powerLevels, bobJoin)
+
+	// The join of bob and the join rules are only in the auth chain of the
+	// topic of bob, and every other auth event is in both auth chains.
+	difference := authDifference([]gomatrixserverlib.Event{aliceTopic, bobsTopic}, room.events)
+	got := make(map[string]bool)
+	for _, ev := range difference {
+		got[ev.EventID()] = true
+	}
+	if len(got) != 2 || len(difference) != 2 || !got[bobJoin.EventID()] || !got[joinRules.EventID()] {
+		t.Errorf("expected the auth difference to be the join of bob and the join rules, got %v", got)
+	}
+}
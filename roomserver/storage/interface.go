@@ -31,6 +31,9 @@ type Database interface {
 	EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
 	SetState(ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID) error
 	EventIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error)
+	RoomEventNIDs(ctx context.Context, roomNID types.RoomNID) ([]types.EventNID, error)
+	RoomEventNIDsOfType(ctx context.Context, roomNID types.RoomNID, eventTypeNID types.EventTypeNID) ([]types.EventNID, error)
+	SenderEventNIDs(ctx context.Context, roomNID types.RoomNID, sender string, afterNID types.EventNID, limit int) ([]types.EventNID, error)
 	GetLatestEventsForUpdate(ctx context.Context, roomNID types.RoomNID) (types.RoomRecentEventsUpdater, error)
 	GetTransactionEventID(ctx context.Context, transactionID string, sessionID int64, userID string) (string, error)
 	RoomNID(ctx context.Context, roomID string) (types.RoomNID, error)
@@ -44,6 +47,10 @@ type Database interface {
 	MembershipUpdater(ctx context.Context, roomID, targetUserID string, roomVersion gomatrixserverlib.RoomVersion) (types.MembershipUpdater, error)
 	GetMembership(ctx context.Context, roomNID types.RoomNID, requestSenderUserID string) (membershipEventNID types.EventNID, stillInRoom bool, err error)
 	GetMembershipEventNIDsForRoom(ctx context.Context, roomNID types.RoomNID, joinOnly bool) ([]types.EventNID, error)
+	GetRoomsByMembership(ctx context.Context, userID, membership string) ([]string, error)
 	EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error)
 	GetRoomVersionForRoom(ctx context.Context, roomID string) (gomatrixserverlib.RoomVersion, error)
+	BlockRoom(ctx context.Context, roomID string) error
+	IsRoomBlocked(ctx context.Context, roomID string) (bool, error)
+	PurgeRoom(ctx context.Context, roomID string) error
 }
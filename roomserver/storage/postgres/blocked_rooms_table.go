@@ -0,0 +1,69 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+)
+
+const blockedRoomsSchema = `
+-- The rooms which have been shut down by a server admin. No more events are
+-- accepted for them, apart from local users leaving them.
+CREATE TABLE IF NOT EXISTS roomserver_blocked_rooms (
+	-- The ID of the room.
+	room_id TEXT NOT NULL PRIMARY KEY,
+	-- When the room was blocked, in milliseconds since the epoch.
+	blocked_ts BIGINT NOT NULL
+);
+`
+
+const insertBlockedRoomSQL = "" +
+	"INSERT INTO roomserver_blocked_rooms (room_id, blocked_ts) VALUES ($1, $2)" +
+	" ON CONFLICT (room_id) DO NOTHING"
+
+const selectIsRoomBlockedSQL = "" +
+	"SELECT EXISTS(SELECT 1 FROM roomserver_blocked_rooms WHERE room_id = $1)"
+
+type blockedRoomStatements struct {
+	insertBlockedRoomStmt   *sql.Stmt
+	selectIsRoomBlockedStmt *sql.Stmt
+}
+
+func (s *blockedRoomStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(blockedRoomsSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.insertBlockedRoomStmt, insertBlockedRoomSQL},
+		{&s.selectIsRoomBlockedStmt, selectIsRoomBlockedSQL},
+	}.prepare(db)
+}
+
+func (s *blockedRoomStatements) insertBlockedRoom(
+	ctx context.Context, roomID string, blockedTS int64,
+) (err error) {
+	_, err = s.insertBlockedRoomStmt.ExecContext(ctx, roomID, blockedTS)
+	return
+}
+
+func (s *blockedRoomStatements) selectIsRoomBlocked(
+	ctx context.Context, roomID string,
+) (blocked bool, err error) {
+	err = s.selectIsRoomBlockedStmt.QueryRowContext(ctx, roomID).Scan(&blocked)
+	return
+}
@@ -82,6 +82,11 @@ const selectMembershipsFromRoomSQL = "" +
 	"SELECT event_nid FROM roomserver_membership" +
 	" WHERE room_nid = $1"
 
+const selectRoomsWithMembershipSQL = "" +
+	"SELECT room_id FROM roomserver_membership" +
+	" JOIN roomserver_rooms ON roomserver_membership.room_nid = roomserver_rooms.room_nid" +
+	" WHERE target_nid = $1 AND membership_nid = $2"
+
 const selectMembershipForUpdateSQL = "" +
 	"SELECT membership_nid FROM roomserver_membership" +
 	" WHERE room_nid = $1 AND target_nid = $2 FOR UPDATE"
@@ -96,6 +101,7 @@ type membershipStatements struct {
 	selectMembershipFromRoomAndTargetStmt      *sql.Stmt
 	selectMembershipsFromRoomAndMembershipStmt *sql.Stmt
 	selectMembershipsFromRoomStmt              *sql.Stmt
+	selectRoomsWithMembershipStmt              *sql.Stmt
 	updateMembershipStmt                       *sql.Stmt
 }
 
@@ -111,6 +117,7 @@ func (s *membershipStatements) prepare(db *sql.DB) (err error) {
 		{&s.selectMembershipFromRoomAndTargetStmt, selectMembershipFromRoomAndTargetSQL},
 		{&s.selectMembershipsFromRoomAndMembershipStmt, selectMembershipsFromRoomAndMembershipSQL},
 		{&s.selectMembershipsFromRoomStmt, selectMembershipsFromRoomSQL},
+		{&s.selectRoomsWithMembershipStmt, selectRoomsWithMembershipSQL},
 		{&s.updateMembershipStmt, updateMembershipSQL},
 	}.prepare(db)
 }
@@ -184,6 +191,26 @@ func (s *membershipStatements) selectMembershipsFromRoomAndMembership(
 	return eventNIDs, rows.Err()
 }
 
+func (s *membershipStatements) selectRoomsWithMembership(
+	ctx context.Context,
+	targetUserNID types.EventStateKeyNID, membership membershipState,
+) (roomIDs []string, err error) {
+	rows, err := s.selectRoomsWithMembershipStmt.QueryContext(ctx, targetUserNID, membership)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRoomsWithMembership: rows.close() failed")
+
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return
+}
+
 func (s *membershipStatements) updateMembership(
 	ctx context.Context,
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
@@ -0,0 +1,45 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+// addEventSendersMigration stores the sender of each event alongside it, so
+// that the events of a sender can be looked up without loading the room.
+var addEventSendersMigration = common.Migration{
+	Version: 2,
+	Name:    "Add the senders of events",
+	Up: func(ctx context.Context, txn *sql.Tx) error {
+		// A new database gets the column when the table is created.
+		var exists bool
+		err := txn.QueryRowContext(ctx, "SELECT to_regclass('roomserver_events') IS NOT NULL").Scan(&exists)
+		if err != nil || !exists {
+			return err
+		}
+		if _, err = txn.ExecContext(ctx, "ALTER TABLE roomserver_events ADD COLUMN IF NOT EXISTS sender TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		_, err = txn.ExecContext(ctx, ""+
+			"UPDATE roomserver_events SET sender = COALESCE(roomserver_event_json.event_json::json->>'sender', '')"+
+			" FROM roomserver_event_json WHERE roomserver_events.event_nid = roomserver_event_json.event_nid",
+		)
+		return err
+	},
+}
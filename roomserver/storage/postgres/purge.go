@@ -0,0 +1,99 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// The statements which purge a room span several tables, so they are
+// prepared once all of the tables exist. The rows which refer to the events
+// of the room are deleted before the events themselves.
+const deleteRoomTransactionsSQL = "" +
+	"DELETE FROM roomserver_transactions WHERE event_id IN" +
+	" (SELECT event_id FROM roomserver_events WHERE room_nid = $1)"
+
+const deleteRoomPreviousEventsSQL = "" +
+	"DELETE FROM roomserver_previous_events WHERE previous_event_id IN" +
+	" (SELECT event_id FROM roomserver_events WHERE room_nid = $1)"
+
+const deleteRoomEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid IN" +
+	" (SELECT event_nid FROM roomserver_events WHERE room_nid = $1)"
+
+const deleteRoomStateBlocksSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid IN" +
+	" (SELECT UNNEST(state_block_nids) FROM roomserver_state_snapshots WHERE room_nid = $1)"
+
+const deleteRoomStateSnapshotsSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+const deleteRoomEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE room_nid = $1"
+
+const deleteRoomInvitesSQL = "" +
+	"DELETE FROM roomserver_invites WHERE room_nid = $1"
+
+const deleteRoomMembershipsSQL = "" +
+	"DELETE FROM roomserver_membership WHERE room_nid = $1"
+
+const deleteRoomAliasesSQL = "" +
+	"DELETE FROM roomserver_room_aliases WHERE room_id IN" +
+	" (SELECT room_id FROM roomserver_rooms WHERE room_nid = $1)"
+
+const deleteRoomSQL = "" +
+	"DELETE FROM roomserver_rooms WHERE room_nid = $1"
+
+type purgeStatements struct {
+	// The statements in the order in which they are run.
+	deleteRoomStmts []*sql.Stmt
+}
+
+func (s *purgeStatements) prepare(db *sql.DB) (err error) {
+	for _, query := range []string{
+		deleteRoomTransactionsSQL,
+		deleteRoomPreviousEventsSQL,
+		deleteRoomEventJSONSQL,
+		deleteRoomStateBlocksSQL,
+		deleteRoomStateSnapshotsSQL,
+		deleteRoomEventsSQL,
+		deleteRoomInvitesSQL,
+		deleteRoomMembershipsSQL,
+		deleteRoomAliasesSQL,
+		deleteRoomSQL,
+	} {
+		var stmt *sql.Stmt
+		if stmt, err = db.Prepare(query); err != nil {
+			return
+		}
+		s.deleteRoomStmts = append(s.deleteRoomStmts, stmt)
+	}
+	return
+}
+
+// purgeRoom deletes everything that is stored about a room.
+func (s *purgeStatements) purgeRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	for _, stmt := range s.deleteRoomStmts {
+		if _, err := txn.Stmt(stmt).ExecContext(ctx, int64(roomNID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -19,13 +19,17 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 
 	// Import the postgres database driver.
 	_ "github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -36,10 +40,15 @@ type Database struct {
 }
 
 // Open a postgres database.
-func Open(dataSourceName string) (*Database, error) {
+func Open(dataSourceName string, dbProperties sqlutil.DbProperties) (*Database, error) {
 	var d Database
 	var err error
-	if d.db, err = sqlutil.Open("postgres", dataSourceName); err != nil {
+	if d.db, err = sqlutil.Open("postgres", dataSourceName, dbProperties); err != nil {
+		return nil, err
+	}
+	migrator := common.NewMigrator(d.db, "roomserver")
+	migrator.AddMigrations(common.BaselineMigration, addEventSendersMigration)
+	if err = migrator.Up(context.Background()); err != nil {
 		return nil, err
 	}
 	if err = d.statements.prepare(d.db); err != nil {
@@ -48,6 +57,11 @@ func Open(dataSourceName string) (*Database, error) {
 	return &d, nil
 }
 
+// Ping checks that the database can be reached.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
 // StoreEvent implements input.EventDatabase
 func (d *Database) StoreEvent(
 	ctx context.Context, event gomatrixserverlib.Event,
@@ -111,6 +125,7 @@ func (d *Database) StoreEvent(
 		event.EventReference().EventSHA256,
 		authEventNIDs,
 		event.Depth(),
+		event.Sender(),
 	); err != nil {
 		if err == sql.ErrNoRows {
 			// We've already inserted the event so select the numeric event ID
@@ -157,7 +172,9 @@ func extractRoomVersionFromCreateEvent(event gomatrixserverlib.Event) (
 	if createContent.RoomVersion != nil {
 		roomVersion = gomatrixserverlib.RoomVersion(*createContent.RoomVersion)
 	}
-	return roomVersion, err
+	// The events of versions which gomatrixserverlib doesn't know about are
+	// stored as those of the version they are based on.
+	return version.BaseRoomVersion(roomVersion), err
 }
 
 func (d *Database) assignRoomNID(
@@ -340,6 +357,27 @@ func (d *Database) EventIDs(
 	return d.statements.bulkSelectEventID(ctx, eventNIDs)
 }
 
+// RoomEventNIDs implements query.RoomserverQueryAPIDatabase
+func (d *Database) RoomEventNIDs(
+	ctx context.Context, roomNID types.RoomNID,
+) ([]types.EventNID, error) {
+	return d.statements.selectRoomEventNIDs(ctx, nil, roomNID)
+}
+
+// RoomEventNIDsOfType implements query.RoomserverQueryAPIDatabase
+func (d *Database) RoomEventNIDsOfType(
+	ctx context.Context, roomNID types.RoomNID, eventTypeNID types.EventTypeNID,
+) ([]types.EventNID, error) {
+	return d.statements.selectRoomEventNIDsOfType(ctx, nil, roomNID, eventTypeNID)
+}
+
+// SenderEventNIDs implements query.RoomserverQueryAPIDatabase
+func (d *Database) SenderEventNIDs(
+	ctx context.Context, roomNID types.RoomNID, sender string, afterNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	return d.statements.selectSenderEventNIDs(ctx, nil, roomNID, sender, afterNID, limit)
+}
+
 // GetLatestEventsForUpdate implements input.EventDatabase
 func (d *Database) GetLatestEventsForUpdate(
 	ctx context.Context, roomNID types.RoomNID,
@@ -741,6 +779,33 @@ func (d *Database) GetMembershipEventNIDsForRoom(
 	return d.statements.selectMembershipsFromRoom(ctx, roomNID)
 }
 
+// GetRoomsByMembership implements query.RoomserverQueryAPIDB
+func (d *Database) GetRoomsByMembership(
+	ctx context.Context, userID, membership string,
+) ([]string, error) {
+	var state membershipState
+	switch membership {
+	case gomatrixserverlib.Join:
+		state = membershipStateJoin
+	case gomatrixserverlib.Invite:
+		state = membershipStateInvite
+	case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+		state = membershipStateLeaveOrBan
+	default:
+		return nil, fmt.Errorf("GetRoomsByMembership: invalid membership %q", membership)
+	}
+	userNIDs, err := d.EventStateKeyNIDs(ctx, []string{userID})
+	if err != nil {
+		return nil, err
+	}
+	userNID, ok := userNIDs[userID]
+	if !ok {
+		// The user has never been a member of any room
+		return nil, nil
+	}
+	return d.statements.selectRoomsWithMembership(ctx, userNID, state)
+}
+
 // EventsFromIDs implements query.RoomserverQueryAPIEventDB
 func (d *Database) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
 	nidMap, err := d.EventNIDs(ctx, eventIDs)
@@ -772,6 +837,33 @@ func (d *Database) GetRoomVersionForRoomNID(
 	)
 }
 
+// BlockRoom implements input.RoomEventDatabase
+// No more events are accepted for a blocked room, apart from local users
+// leaving it. Blocking a room which is already blocked does nothing.
+func (d *Database) BlockRoom(ctx context.Context, roomID string) error {
+	return d.statements.insertBlockedRoom(ctx, roomID, int64(gomatrixserverlib.AsTimestamp(time.Now())))
+}
+
+// IsRoomBlocked implements input.RoomEventDatabase
+func (d *Database) IsRoomBlocked(ctx context.Context, roomID string) (bool, error) {
+	return d.statements.selectIsRoomBlocked(ctx, roomID)
+}
+
+// PurgeRoom implements input.RoomEventDatabase
+// It deletes the events, state, memberships, invites and aliases of a room.
+// Purging a room which isn't known does nothing.
+func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		roomNID, err := d.statements.selectRoomNID(ctx, txn, roomID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return d.statements.purgeRoom(ctx, txn, roomNID)
+	})
+}
+
 type transaction struct {
 	ctx context.Context
 	txn *sql.Tx
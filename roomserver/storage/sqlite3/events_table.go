@@ -38,13 +38,16 @@ const eventsSchema = `
     depth INTEGER NOT NULL,
     event_id TEXT NOT NULL UNIQUE,
     reference_sha256 BLOB NOT NULL,
-    auth_event_nids TEXT NOT NULL DEFAULT '[]'
+    auth_event_nids TEXT NOT NULL DEFAULT '[]',
+    sender TEXT NOT NULL DEFAULT ''
   );
+
+  CREATE INDEX IF NOT EXISTS roomserver_events_sender_idx ON roomserver_events (room_nid, sender, event_nid);
 `
 
 const insertEventSQL = `
-	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth)
-	  VALUES ($1, $2, $3, $4, $5, $6, $7)
+	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, sender)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	  ON CONFLICT DO NOTHING;
 `
 
@@ -99,6 +102,18 @@ const selectMaxEventDepthSQL = "" +
 const selectRoomNIDForEventNIDSQL = "" +
 	"SELECT room_nid FROM roomserver_events WHERE event_nid = $1"
 
+const selectRoomEventNIDsSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1 ORDER BY event_nid ASC"
+
+const selectRoomEventNIDsOfTypeSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1 AND event_type_nid = $2 ORDER BY event_nid ASC"
+
+// The create event and redactions are left out, as redacting them does nothing.
+const selectSenderEventNIDsSQL = "" +
+	"SELECT event_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND sender = $2 AND event_nid > $3 AND event_type_nid NOT IN ($4, $5)" +
+	" ORDER BY event_nid ASC LIMIT $6"
+
 type eventStatements struct {
 	db                                     *sql.DB
 	insertEventStmt                        *sql.Stmt
@@ -115,6 +130,9 @@ type eventStatements struct {
 	bulkSelectEventIDStmt                  *sql.Stmt
 	bulkSelectEventNIDStmt                 *sql.Stmt
 	selectRoomNIDForEventNIDStmt           *sql.Stmt
+	selectRoomEventNIDsStmt                *sql.Stmt
+	selectRoomEventNIDsOfTypeStmt          *sql.Stmt
+	selectSenderEventNIDsStmt              *sql.Stmt
 }
 
 func (s *eventStatements) prepare(db *sql.DB) (err error) {
@@ -139,6 +157,9 @@ func (s *eventStatements) prepare(db *sql.DB) (err error) {
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
+		{&s.selectRoomEventNIDsStmt, selectRoomEventNIDsSQL},
+		{&s.selectRoomEventNIDsOfTypeStmt, selectRoomEventNIDsOfTypeSQL},
+		{&s.selectSenderEventNIDsStmt, selectSenderEventNIDsSQL},
 	}.prepare(db)
 }
 
@@ -152,6 +173,7 @@ func (s *eventStatements) insertEvent(
 	referenceSHA256 []byte,
 	authEventNIDs []types.EventNID,
 	depth int64,
+	sender string,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	var eventNID int64
 	var stateNID int64
@@ -160,7 +182,7 @@ func (s *eventStatements) insertEvent(
 	resultStmt := common.TxStmt(txn, s.insertEventResultStmt)
 	if _, err = insertStmt.ExecContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
-		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth,
+		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, sender,
 	); err == nil {
 		err = resultStmt.QueryRowContext(ctx).Scan(&eventNID, &stateNID)
 	}
@@ -485,6 +507,77 @@ func (s *eventStatements) selectRoomNIDForEventNID(
 	return
 }
 
+// selectRoomEventNIDs returns the numeric IDs of all the events in a room,
+// in the order they were stored.
+func (s *eventStatements) selectRoomEventNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]types.EventNID, error) {
+	selectStmt := common.TxStmt(txn, s.selectRoomEventNIDsStmt)
+	rows, err := selectStmt.QueryContext(ctx, int64(roomNID))
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRoomEventNIDs: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+// selectRoomEventNIDsOfType returns the numeric IDs of the events of a type
+// in a room, in the order they were stored.
+func (s *eventStatements) selectRoomEventNIDsOfType(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventTypeNID types.EventTypeNID,
+) ([]types.EventNID, error) {
+	selectStmt := common.TxStmt(txn, s.selectRoomEventNIDsOfTypeStmt)
+	rows, err := selectStmt.QueryContext(ctx, int64(roomNID), int64(eventTypeNID))
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRoomEventNIDsOfType: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+// selectSenderEventNIDs returns the numeric IDs of up to limit of the events
+// which a user sent into a room after the event afterNID, in the order they
+// were stored.
+func (s *eventStatements) selectSenderEventNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, sender string,
+	afterNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	selectStmt := common.TxStmt(txn, s.selectSenderEventNIDsStmt)
+	rows, err := selectStmt.QueryContext(
+		ctx, int64(roomNID), sender, int64(afterNID),
+		types.MRoomCreateNID, types.MRoomRedactionNID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectSenderEventNIDs: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) string {
 	b, _ := json.Marshal(eventNIDs)
 	return string(b)
@@ -61,6 +61,11 @@ const selectMembershipsFromRoomSQL = "" +
 	"SELECT event_nid FROM roomserver_membership" +
 	" WHERE room_nid = $1"
 
+const selectRoomsWithMembershipSQL = "" +
+	"SELECT room_id FROM roomserver_membership" +
+	" JOIN roomserver_rooms ON roomserver_membership.room_nid = roomserver_rooms.room_nid" +
+	" WHERE target_nid = $1 AND membership_nid = $2"
+
 const selectMembershipForUpdateSQL = "" +
 	"SELECT membership_nid FROM roomserver_membership" +
 	" WHERE room_nid = $1 AND target_nid = $2"
@@ -75,6 +80,7 @@ type membershipStatements struct {
 	selectMembershipFromRoomAndTargetStmt      *sql.Stmt
 	selectMembershipsFromRoomAndMembershipStmt *sql.Stmt
 	selectMembershipsFromRoomStmt              *sql.Stmt
+	selectRoomsWithMembershipStmt              *sql.Stmt
 	updateMembershipStmt                       *sql.Stmt
 }
 
@@ -90,6 +96,7 @@ func (s *membershipStatements) prepare(db *sql.DB) (err error) {
 		{&s.selectMembershipFromRoomAndTargetStmt, selectMembershipFromRoomAndTargetSQL},
 		{&s.selectMembershipsFromRoomAndMembershipStmt, selectMembershipsFromRoomAndMembershipSQL},
 		{&s.selectMembershipsFromRoomStmt, selectMembershipsFromRoomSQL},
+		{&s.selectRoomsWithMembershipStmt, selectRoomsWithMembershipSQL},
 		{&s.updateMembershipStmt, updateMembershipSQL},
 	}.prepare(db)
 }
@@ -166,6 +173,27 @@ func (s *membershipStatements) selectMembershipsFromRoomAndMembership(
 	return
 }
 
+func (s *membershipStatements) selectRoomsWithMembership(
+	ctx context.Context, txn *sql.Tx,
+	targetUserNID types.EventStateKeyNID, membership membershipState,
+) (roomIDs []string, err error) {
+	stmt := common.TxStmt(txn, s.selectRoomsWithMembershipStmt)
+	rows, err := stmt.QueryContext(ctx, targetUserNID, membership)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRoomsWithMembership: rows.close() failed")
+
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return
+}
+
 func (s *membershipStatements) updateMembership(
 	ctx context.Context, txn *sql.Tx,
 	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
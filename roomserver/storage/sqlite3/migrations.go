@@ -0,0 +1,77 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+// addEventSendersMigration stores the sender of each event alongside it, so
+// that the events of a sender can be looked up without loading the room.
+var addEventSendersMigration = common.Migration{
+	Version: 2,
+	Name:    "Add the senders of events",
+	Up: func(ctx context.Context, txn *sql.Tx) error {
+		// A new database gets the column when the table is created.
+		var count int
+		err := txn.QueryRowContext(
+			ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'roomserver_events'",
+		).Scan(&count)
+		if err != nil || count == 0 {
+			return err
+		}
+		if _, err = txn.ExecContext(ctx, "ALTER TABLE roomserver_events ADD COLUMN sender TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+
+		// SQLite may be built without JSON support, so the senders are read
+		// out of the events here.
+		senders := make(map[int64]string)
+		rows, err := txn.QueryContext(ctx, "SELECT event_nid, event_json FROM roomserver_event_json")
+		if err != nil {
+			return err
+		}
+		defer common.CloseAndLogIfError(ctx, rows, "addEventSendersMigration: rows.close() failed")
+		for rows.Next() {
+			var eventNID int64
+			var eventJSON []byte
+			if err = rows.Scan(&eventNID, &eventJSON); err != nil {
+				return err
+			}
+			var event struct {
+				Sender string `json:"sender"`
+			}
+			if err = json.Unmarshal(eventJSON, &event); err != nil {
+				return err
+			}
+			senders[eventNID] = event.Sender
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for eventNID, sender := range senders {
+			if _, err = txn.ExecContext(
+				ctx, "UPDATE roomserver_events SET sender = $1 WHERE event_nid = $2", sender, eventNID,
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
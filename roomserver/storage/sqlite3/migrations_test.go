@@ -0,0 +1,78 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+func TestAddEventSendersMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roomserver-migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "roomserver.db")
+
+	// A database from before the senders of events were stored.
+	db, err := sqlutil.Open(common.SQLiteDriverName(), path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE roomserver_events (
+			event_nid INTEGER PRIMARY KEY AUTOINCREMENT, room_nid INTEGER NOT NULL,
+			event_type_nid INTEGER NOT NULL, event_state_key_nid INTEGER NOT NULL,
+			sent_to_output BOOLEAN NOT NULL DEFAULT FALSE, state_snapshot_nid INTEGER NOT NULL DEFAULT 0,
+			depth INTEGER NOT NULL, event_id TEXT NOT NULL UNIQUE, reference_sha256 BLOB NOT NULL,
+			auth_event_nids TEXT NOT NULL DEFAULT '[]'
+		)`,
+		`CREATE TABLE roomserver_event_json (event_nid INTEGER NOT NULL PRIMARY KEY, event_json TEXT NOT NULL)`,
+		`INSERT INTO roomserver_events (event_nid, room_nid, event_type_nid, event_state_key_nid, depth, event_id, reference_sha256)
+			VALUES (1, 1, 1, 1, 1, '$create', ''), (2, 1, 8, 0, 2, '$alice', ''), (3, 1, 8, 0, 3, '$bob', '')`,
+		`INSERT INTO roomserver_event_json (event_nid, event_json) VALUES
+			(1, '{"type":"m.room.create","sender":"@alice:localhost"}'),
+			(2, '{"type":"m.room.message","sender":"@alice:localhost"}'),
+			(3, '{"type":"m.room.message","sender":"@bob:localhost"}')`,
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := Open("file:"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The create event is left out, as redacting it does nothing.
+	eventNIDs, err := d.SenderEventNIDs(context.Background(), 1, "@alice:localhost", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eventNIDs) != 1 || eventNIDs[0] != types.EventNID(2) {
+		t.Errorf("expected only the message from alice, got %v", eventNIDs)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// The statements which purge a room span several tables, so they are
+// prepared once all of the tables exist. The rows which refer to the events
+// of the room are deleted before the events themselves.
+const deleteRoomTransactionsSQL = `
+	DELETE FROM roomserver_transactions WHERE event_id IN
+	  (SELECT event_id FROM roomserver_events WHERE room_nid = $1)
+`
+
+const deleteRoomPreviousEventsSQL = `
+	DELETE FROM roomserver_previous_events WHERE previous_event_id IN
+	  (SELECT event_id FROM roomserver_events WHERE room_nid = $1)
+`
+
+const deleteRoomEventJSONSQL = `
+	DELETE FROM roomserver_event_json WHERE event_nid IN
+	  (SELECT event_nid FROM roomserver_events WHERE room_nid = $1)
+`
+
+// The state block NIDs of a snapshot are stored as JSON, so the blocks are
+// deleted one at a time.
+const selectRoomStateBlockNIDsSQL = `
+	SELECT state_block_nids FROM roomserver_state_snapshots WHERE room_nid = $1
+`
+
+const deleteStateBlockSQL = `
+	DELETE FROM roomserver_state_block WHERE state_block_nid = $1
+`
+
+const deleteRoomStateSnapshotsSQL = `
+	DELETE FROM roomserver_state_snapshots WHERE room_nid = $1
+`
+
+const deleteRoomEventsSQL = `
+	DELETE FROM roomserver_events WHERE room_nid = $1
+`
+
+const deleteRoomInvitesSQL = `
+	DELETE FROM roomserver_invites WHERE room_nid = $1
+`
+
+const deleteRoomMembershipsSQL = `
+	DELETE FROM roomserver_membership WHERE room_nid = $1
+`
+
+const deleteRoomAliasesSQL = `
+	DELETE FROM roomserver_room_aliases WHERE room_id IN
+	  (SELECT room_id FROM roomserver_rooms WHERE room_nid = $1)
+`
+
+const deleteRoomSQL = `
+	DELETE FROM roomserver_rooms WHERE room_nid = $1
+`
+
+type purgeStatements struct {
+	deleteRoomTransactionsStmt   *sql.Stmt
+	deleteRoomPreviousEventsStmt *sql.Stmt
+	deleteRoomEventJSONStmt      *sql.Stmt
+	selectRoomStateBlockNIDsStmt *sql.Stmt
+	deleteStateBlockStmt         *sql.Stmt
+	deleteRoomStateSnapshotsStmt *sql.Stmt
+	deleteRoomEventsStmt         *sql.Stmt
+	deleteRoomInvitesStmt        *sql.Stmt
+	deleteRoomMembershipsStmt    *sql.Stmt
+	deleteRoomAliasesStmt        *sql.Stmt
+	deleteRoomStmt               *sql.Stmt
+}
+
+func (s *purgeStatements) prepare(db *sql.DB) (err error) {
+	return statementList{
+		{&s.deleteRoomTransactionsStmt, deleteRoomTransactionsSQL},
+		{&s.deleteRoomPreviousEventsStmt, deleteRoomPreviousEventsSQL},
+		{&s.deleteRoomEventJSONStmt, deleteRoomEventJSONSQL},
+		{&s.selectRoomStateBlockNIDsStmt, selectRoomStateBlockNIDsSQL},
+		{&s.deleteStateBlockStmt, deleteStateBlockSQL},
+		{&s.deleteRoomStateSnapshotsStmt, deleteRoomStateSnapshotsSQL},
+		{&s.deleteRoomEventsStmt, deleteRoomEventsSQL},
+		{&s.deleteRoomInvitesStmt, deleteRoomInvitesSQL},
+		{&s.deleteRoomMembershipsStmt, deleteRoomMembershipsSQL},
+		{&s.deleteRoomAliasesStmt, deleteRoomAliasesSQL},
+		{&s.deleteRoomStmt, deleteRoomSQL},
+	}.prepare(db)
+}
+
+// purgeRoom deletes everything that is stored about a room.
+func (s *purgeStatements) purgeRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	for _, stmt := range []*sql.Stmt{
+		s.deleteRoomTransactionsStmt,
+		s.deleteRoomPreviousEventsStmt,
+		s.deleteRoomEventJSONStmt,
+	} {
+		if _, err := common.TxStmt(txn, stmt).ExecContext(ctx, int64(roomNID)); err != nil {
+			return err
+		}
+	}
+
+	stateBlockNIDs, err := s.selectRoomStateBlockNIDs(ctx, txn, roomNID)
+	if err != nil {
+		return err
+	}
+	for _, stateBlockNID := range stateBlockNIDs {
+		if _, err = common.TxStmt(txn, s.deleteStateBlockStmt).ExecContext(ctx, int64(stateBlockNID)); err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range []*sql.Stmt{
+		s.deleteRoomStateSnapshotsStmt,
+		s.deleteRoomEventsStmt,
+		s.deleteRoomInvitesStmt,
+		s.deleteRoomMembershipsStmt,
+		s.deleteRoomAliasesStmt,
+		s.deleteRoomStmt,
+	} {
+		if _, err = common.TxStmt(txn, stmt).ExecContext(ctx, int64(roomNID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectRoomStateBlockNIDs returns the state blocks of every state snapshot
+// of a room.
+func (s *purgeStatements) selectRoomStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]types.StateBlockNID, error) {
+	rows, err := common.TxStmt(txn, s.selectRoomStateBlockNIDsStmt).QueryContext(ctx, int64(roomNID))
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRoomStateBlockNIDs: rows.close() failed")
+	seen := make(map[types.StateBlockNID]bool)
+	var result []types.StateBlockNID
+	for rows.Next() {
+		var stateBlockNIDsJSON string
+		if err = rows.Scan(&stateBlockNIDsJSON); err != nil {
+			return nil, err
+		}
+		var stateBlockNIDs []types.StateBlockNID
+		if err = json.Unmarshal([]byte(stateBlockNIDsJSON), &stateBlockNIDs); err != nil {
+			return nil, err
+		}
+		for _, stateBlockNID := range stateBlockNIDs {
+			if !seen[stateBlockNID] {
+				seen[stateBlockNID] = true
+				result = append(result, stateBlockNID)
+			}
+		}
+	}
+	return result, rows.Err()
+}
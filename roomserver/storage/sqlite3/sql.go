@@ -32,6 +32,8 @@ type statements struct {
 	inviteStatements
 	membershipStatements
 	transactionStatements
+	blockedRoomStatements
+	purgeStatements
 }
 
 func (s *statements) prepare(db *sql.DB) error {
@@ -50,6 +52,8 @@ func (s *statements) prepare(db *sql.DB) error {
 		s.inviteStatements.prepare,
 		s.membershipStatements.prepare,
 		s.transactionStatements.prepare,
+		s.blockedRoomStatements.prepare,
+		s.purgeStatements.prepare,
 	} {
 		if err = prepare(db); err != nil {
 			return err
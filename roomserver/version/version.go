@@ -31,8 +31,29 @@ import (
 type RoomVersionDescription struct {
 	Supported bool
 	Stable    bool
+	// The room version known to gomatrixserverlib whose events the events
+	// of this version are built and parsed as. It is only set for versions
+	// which gomatrixserverlib doesn't know about, which differ from their
+	// base only in their auth rules.
+	Base gomatrixserverlib.RoomVersion
+	// Whether users may knock on rooms of this version (MSC2403), which
+	// needs room version 7.
+	Knocking bool
+	// Whether rooms of this version may restrict joins to the members of
+	// other rooms (MSC3083), which needs room version 8.
+	RestrictedJoins bool
 }
 
+// RoomVersionKnock is the unstable room version of MSC2403, which allows
+// knocking. gomatrixserverlib doesn't know about it, so its events are those
+// of room version 4, the newest version which this server supports.
+const RoomVersionKnock gomatrixserverlib.RoomVersion = "xyz.amorgan.knock"
+
+// RoomVersionRestricted is the unstable room version of MSC3083, which allows
+// restricted joins as well as knocking. Like RoomVersionKnock, its events are
+// those of room version 4.
+const RoomVersionRestricted gomatrixserverlib.RoomVersion = "org.matrix.msc3083.v2"
+
 var roomVersions = map[gomatrixserverlib.RoomVersion]RoomVersionDescription{
 	gomatrixserverlib.RoomVersionV1: RoomVersionDescription{
 		Supported: true,
@@ -54,6 +75,19 @@ var roomVersions = map[gomatrixserverlib.RoomVersion]RoomVersionDescription{
 		Supported: false,
 		Stable:    false,
 	},
+	RoomVersionKnock: RoomVersionDescription{
+		Supported: true,
+		Stable:    false,
+		Base:      gomatrixserverlib.RoomVersionV4,
+		Knocking:  true,
+	},
+	RoomVersionRestricted: RoomVersionDescription{
+		Supported:       true,
+		Stable:          false,
+		Base:            gomatrixserverlib.RoomVersionV4,
+		Knocking:        true,
+		RestrictedJoins: true,
+	},
 }
 
 // DefaultRoomVersion contains the room version that will, by
@@ -105,6 +139,17 @@ func SupportedRoomVersion(version gomatrixserverlib.RoomVersion) (RoomVersionDes
 	return result, nil
 }
 
+// BaseRoomVersion returns the room version which gomatrixserverlib builds and
+// parses the events of rooms of the given version as. This is the version
+// that is stored for the room and passed around with its events, while the
+// version in the create event of the room decides which auth rules apply.
+func BaseRoomVersion(version gomatrixserverlib.RoomVersion) gomatrixserverlib.RoomVersion {
+	if desc, ok := roomVersions[version]; ok && desc.Base != "" {
+		return desc.Base
+	}
+	return version
+}
+
 // UnknownVersionError is caused when the room version is not known.
 type UnknownVersionError struct {
 	Version gomatrixserverlib.RoomVersion
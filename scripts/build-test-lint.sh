@@ -8,9 +8,9 @@ set -eu
 # When `go build` is given multiple packages it won't output anything, and just
 # checks that everything builds.
 echo "Checking that it builds..."
-go build ./cmd/...
+go build -tags sqlite_fts5 ./cmd/...
 
 ./scripts/find-lint.sh
 
 echo "Testing..."
-go test ./...
+go test -tags sqlite_fts5 ./...
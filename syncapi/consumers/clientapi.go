@@ -94,3 +94,66 @@ func (s *OutputClientDataConsumer) onMessage(msg *sarama.ConsumerMessage) error
 
 	return nil
 }
+
+// OutputDeviceListUpdateConsumer consumes changes to the devices of local users
+// that originated in the client API server.
+type OutputDeviceListUpdateConsumer struct {
+	deviceListConsumer *common.ContinualConsumer
+	db                 storage.Database
+	notifier           *sync.Notifier
+}
+
+// NewOutputDeviceListUpdateConsumer creates a new OutputDeviceListUpdateConsumer. Call Start() to begin consuming from the client API server.
+func NewOutputDeviceListUpdateConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+) *OutputDeviceListUpdateConsumer {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputDeviceListUpdate),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputDeviceListUpdateConsumer{
+		deviceListConsumer: &consumer,
+		db:                 store,
+		notifier:           n,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the client API server
+func (s *OutputDeviceListUpdateConsumer) Start() error {
+	return s.deviceListConsumer.Start()
+}
+
+// onMessage records the change to the devices of the user and wakes up the
+// users sharing a room with them, who may need to fetch the new device keys.
+func (s *OutputDeviceListUpdateConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output common.DeviceListUpdate
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("client API server device list output log: message parse failure")
+		return nil
+	}
+
+	log.WithField("user_id", output.UserID).Info("received device list update from client API server")
+
+	pos, err := s.db.AddDeviceListChange(context.TODO(), output.UserID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user_id":    output.UserID,
+			log.ErrorKey: err,
+		}).Panicf("could not save device list change")
+	}
+
+	s.notifier.OnNewEvent(
+		nil, "", s.notifier.UsersSharingRoomsWith(output.UserID),
+		types.PaginationToken{DeviceListPosition: pos},
+	)
+
+	return nil
+}
@@ -15,14 +15,18 @@
 package consumers
 
 import (
+	"context"
 	"encoding/json"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
 	sarama "gopkg.in/Shopify/sarama.v1"
 )
@@ -99,3 +103,232 @@ func (s *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error
 	s.notifier.OnNewEvent(nil, output.Event.RoomID, nil, types.PaginationToken{EDUTypingPosition: typingPos})
 	return nil
 }
+
+// OutputPresenceEventConsumer consumes presence changes that originated in
+// the EDU server.
+type OutputPresenceEventConsumer struct {
+	presenceConsumer *common.ContinualConsumer
+	db               storage.Database
+	notifier         *sync.Notifier
+}
+
+// NewOutputPresenceEventConsumer creates a new OutputPresenceEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputPresenceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+) *OutputPresenceEventConsumer {
+
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputPresenceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputPresenceEventConsumer{
+		presenceConsumer: &consumer,
+		db:               store,
+		notifier:         n,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from EDU api
+func (s *OutputPresenceEventConsumer) Start() error {
+	return s.presenceConsumer.Start()
+}
+
+func (s *OutputPresenceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"user_id":  output.Event.UserID,
+		"presence": output.Event.Presence,
+	}).Debug("received data from EDU server")
+
+	presencePos := s.db.SetPresence(output.Event)
+
+	s.notifier.OnNewEvent(
+		nil, "", s.notifier.UsersSharingRoomsWith(output.Event.UserID),
+		types.PaginationToken{EDUTypingPosition: presencePos},
+	)
+	return nil
+}
+
+// OutputReceiptEventConsumer consumes batches of receipts that originated in
+// the EDU server.
+type OutputReceiptEventConsumer struct {
+	receiptConsumer *common.ContinualConsumer
+	db              storage.Database
+	notifier        *sync.Notifier
+}
+
+// NewOutputReceiptEventConsumer creates a new OutputReceiptEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputReceiptEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+) *OutputReceiptEventConsumer {
+
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputReceiptEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputReceiptEventConsumer{
+		receiptConsumer: &consumer,
+		db:              store,
+		notifier:        n,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from EDU api
+func (s *OutputReceiptEventConsumer) Start() error {
+	return s.receiptConsumer.Start()
+}
+
+// onMessage stores the receipts so that they are sent to the users in the room
+// when they next sync, and wakes them up.
+func (s *OutputReceiptEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputReceiptEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"room_id":  output.RoomID,
+		"receipts": len(output.Receipts),
+	}).Debug("received receipts from EDU server")
+
+	receiptPos := s.db.StoreReceipts(output.RoomID, output.Receipts)
+
+	s.notifier.OnNewEvent(nil, output.RoomID, nil, types.PaginationToken{EDUTypingPosition: receiptPos})
+	return nil
+}
+
+// OutputSendToDeviceEventConsumer consumes send-to-device messages that
+// originated in the EDU server.
+type OutputSendToDeviceEventConsumer struct {
+	sendToDeviceConsumer *common.ContinualConsumer
+	db                   storage.Database
+	deviceDB             devices.Database
+	serverName           gomatrixserverlib.ServerName
+	notifier             *sync.Notifier
+}
+
+// NewOutputSendToDeviceEventConsumer creates a new OutputSendToDeviceEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputSendToDeviceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+	deviceDB devices.Database,
+) *OutputSendToDeviceEventConsumer {
+
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputSendToDeviceEventConsumer{
+		sendToDeviceConsumer: &consumer,
+		db:                   store,
+		deviceDB:             deviceDB,
+		serverName:           cfg.Matrix.ServerName,
+		notifier:             n,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from EDU api
+func (s *OutputSendToDeviceEventConsumer) Start() error {
+	return s.sendToDeviceConsumer.Start()
+}
+
+// onMessage stores a message for each of the local devices that it is for,
+// and wakes up the user so that the devices get it. Messages for remote users
+// are sent to their servers by the federation sender instead.
+func (s *OutputSendToDeviceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputSendToDeviceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	localpart, domain, err := gomatrixserverlib.SplitID('@', output.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", output.UserID).Error("send-to-device message for invalid user ID")
+		return nil
+	}
+	if domain != s.serverName {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"user_id":   output.UserID,
+		"device_id": output.DeviceID,
+		"type":      output.Event.Type,
+	}).Debug("received send-to-device message from EDU server")
+
+	deviceIDs := []string{output.DeviceID}
+	if output.DeviceID == "*" {
+		var devs []authtypes.Device
+		if devs, err = s.deviceDB.GetDevicesByLocalpart(context.TODO(), localpart); err != nil {
+			return err
+		}
+		deviceIDs = deviceIDs[:0]
+		for _, dev := range devs {
+			deviceIDs = append(deviceIDs, dev.ID)
+		}
+	}
+
+	var pos types.StreamPosition
+	for _, deviceID := range deviceIDs {
+		pos, err = s.db.AddSendToDeviceMessage(context.TODO(), output.UserID, deviceID, types.SendToDeviceEvent{
+			Sender:  output.Event.Sender,
+			Type:    output.Event.Type,
+			Content: output.Event.Content,
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"user_id":    output.UserID,
+				"device_id":  deviceID,
+				log.ErrorKey: err,
+			}).Panicf("could not save send-to-device message")
+		}
+	}
+	if pos == 0 {
+		return nil
+	}
+
+	s.notifier.OnNewEvent(
+		nil, "", []string{output.UserID},
+		types.PaginationToken{SendToDevicePosition: pos},
+	)
+	return nil
+}
@@ -35,6 +35,7 @@ type OutputRoomEventConsumer struct {
 	roomServerConsumer *common.ContinualConsumer
 	db                 storage.Database
 	notifier           *sync.Notifier
+	requestPool        *sync.RequestPool
 	query              api.RoomserverQueryAPI
 }
 
@@ -43,6 +44,7 @@ func NewOutputRoomEventConsumer(
 	cfg *config.Dendrite,
 	kafkaConsumer sarama.Consumer,
 	n *sync.Notifier,
+	rp *sync.RequestPool,
 	store storage.Database,
 	queryAPI api.RoomserverQueryAPI,
 ) *OutputRoomEventConsumer {
@@ -56,6 +58,7 @@ func NewOutputRoomEventConsumer(
 		roomServerConsumer: &consumer,
 		db:                 store,
 		notifier:           n,
+		requestPool:        rp,
 		query:              queryAPI,
 	}
 	consumer.ProcessMessage = s.onMessage
@@ -87,6 +90,8 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return s.onNewInviteEvent(context.TODO(), *output.NewInviteEvent)
 	case api.OutputTypeRetireInviteEvent:
 		return s.onRetireInviteEvent(context.TODO(), *output.RetireInviteEvent)
+	case api.OutputTypePurgeRoom:
+		return s.onPurgeRoom(context.TODO(), *output.PurgeRoom)
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -146,6 +151,11 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		}).Panicf("roomserver output log: write event failure")
 		return nil
 	}
+	for _, stateEvent := range append([]gomatrixserverlib.HeaderedEvent{ev}, addsStateEvents...) {
+		if stateEvent.Type() == gomatrixserverlib.MRoomMember && stateEvent.StateKey() != nil {
+			s.requestPool.OnMembershipChange(stateEvent.RoomID(), *stateEvent.StateKey())
+		}
+	}
 	s.notifier.OnNewEvent(&ev, "", nil, types.PaginationToken{PDUPosition: pduPos})
 
 	return nil
@@ -185,6 +195,19 @@ func (s *OutputRoomEventConsumer) onRetireInviteEvent(
 	return nil
 }
 
+func (s *OutputRoomEventConsumer) onPurgeRoom(
+	ctx context.Context, msg api.OutputPurgeRoom,
+) error {
+	if err := s.db.PurgeRoom(ctx, msg.RoomID); err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"room_id":    msg.RoomID,
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: purge room failure")
+	}
+	return nil
+}
+
 // lookupStateEvents looks up the state events that are added by a new event.
 func (s *OutputRoomEventConsumer) lookupStateEvents(
 	addsStateEventIDs []string, event gomatrixserverlib.HeaderedEvent,
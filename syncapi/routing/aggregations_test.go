@@ -0,0 +1,100 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// bundledRelations returns the aggregations bundled into a client event.
+func bundledRelations(t *testing.T, ev gomatrixserverlib.ClientEvent) types.BundledRelations {
+	var unsigned struct {
+		Relations types.BundledRelations `json:"m.relations"`
+	}
+	if len(ev.Unsigned) > 0 {
+		if err := json.Unmarshal(ev.Unsigned, &unsigned); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return unsigned.Relations
+}
+
+func checkBundledRelations(t *testing.T, where string, ev gomatrixserverlib.ClientEvent, editID string) {
+	relations := bundledRelations(t, ev)
+	wantCounts := []types.AnnotationCount{{Type: "m.reaction", Key: "👍", Count: 2}}
+	if relations.Annotation == nil || !reflect.DeepEqual(relations.Annotation.Chunk, wantCounts) {
+		t.Errorf("%s: expected annotations %v, got %+v", where, wantCounts, relations.Annotation)
+	}
+	if relations.Replace == nil || relations.Replace.EventID != editID {
+		t.Errorf("%s: expected to be replaced by %s, got %+v", where, editID, relations.Replace)
+	}
+}
+
+func TestAggregationsAreBundled(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, target, related := writeTestRelations(t, db)
+	// Only the sender of an event can edit it.
+	room.write(room.buildAs("@bob:localhost", "m.room.message", nil, map[string]interface{}{
+		"msgtype":       "m.text",
+		"body":          "* hijacked",
+		"m.new_content": map[string]string{"msgtype": "m.text", "body": "hijacked"},
+		"m.relates_to":  map[string]string{"rel_type": "m.replace", "event_id": target.EventID()},
+	}))
+	queryAPI := newTestQueryAPI(room, gomatrixserverlib.Join, "joined")
+	editID := related[2].EventID()
+
+	res := doContext(db, queryAPI, target.EventID(), "0")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %+v", res.Code, res.JSON)
+	}
+	checkBundledRelations(t, "context", res.JSON.(contextResponse).Event, editID)
+
+	pos, err := db.SyncPosition(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{"dir": {"b"}, "limit": {"10"}, "from": {pos.String()}}
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/"+testRoomID+"/messages?"+query.Encode(), nil)
+	res = OnIncomingMessagesRequest(req, &authtypes.Device{UserID: testUserID}, db, testRoomID, nil, nil, queryAPI, nil, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %+v", res.Code, res.JSON)
+	}
+	found := false
+	for _, ev := range res.JSON.(messagesResp).Chunk {
+		switch ev.EventID {
+		case target.EventID():
+			found = true
+			checkBundledRelations(t, "messages", ev, editID)
+		case related[0].EventID():
+			if relations := bundledRelations(t, ev); relations != (types.BundledRelations{}) {
+				t.Errorf("expected nothing to be bundled into a reaction, got %+v", relations)
+			}
+		}
+	}
+	if !found {
+		t.Error("expected the message in the messages response")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type contextResponse struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	Event        gomatrixserverlib.ClientEvent   `json:"event"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	State        []gomatrixserverlib.ClientEvent `json:"state"`
+}
+
+const defaultContextLimit = 10
+
+// Context implements GET /rooms/{roomID}/context/{eventID}
+// See: https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-rooms-roomid-context-eventid
+// The limit is split evenly between the events before and after the target
+// event, and events that the user may not see are left out.
+func Context(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	queryAPI api.RoomserverQueryAPI, roomID, eventID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	limit := defaultContextLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a non-negative integer"),
+			}
+		}
+	}
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+	}
+
+	streamEvents, err := db.StreamEvents(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.StreamEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(streamEvents) == 0 || streamEvents[0].RoomID() != roomID {
+		return notFound
+	}
+	target := db.StreamEventsToEvents(device, streamEvents)
+
+	var membershipRes api.QueryMembershipForUserResponse
+	err = queryAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &membershipRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	target, err = sync.VisibleEvents(ctx, queryAPI, device.UserID, membershipRes.IsInRoom, target)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("sync.VisibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(target) == 0 {
+		return notFound
+	}
+
+	beforeLimit := limit / 2
+	before, after, start, end, err := eventsAround(
+		ctx, db, device, roomID, streamEvents[0].StreamPosition, beforeLimit, limit-beforeLimit,
+	)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("eventsAround failed")
+		return jsonerror.InternalServerError()
+	}
+	if before, err = sync.VisibleEvents(ctx, queryAPI, device.UserID, membershipRes.IsInRoom, before); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("sync.VisibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	if after, err = sync.VisibleEvents(ctx, queryAPI, device.UserID, membershipRes.IsInRoom, after); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("sync.VisibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// The state is that of the room at the last event returned.
+	lastEvent := target[0]
+	if len(after) > 0 {
+		lastEvent = after[len(after)-1]
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	err = queryAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{lastEvent.EventID()},
+	}, &stateRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryStateAfterEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := contextResponse{
+		Start:        start.String(),
+		End:          end.String(),
+		Event:        gomatrixserverlib.HeaderedToClientEvent(target[0], gomatrixserverlib.FormatAll),
+		EventsBefore: gomatrixserverlib.HeaderedToClientEvents(before, gomatrixserverlib.FormatAll),
+		EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(after, gomatrixserverlib.FormatAll),
+		State:        gomatrixserverlib.HeaderedToClientEvents(stateRes.StateEvents, gomatrixserverlib.FormatAll),
+	}
+	event := []gomatrixserverlib.ClientEvent{res.Event}
+	for _, events := range [][]gomatrixserverlib.ClientEvent{event, res.EventsBefore, res.EventsAfter} {
+		if err = sync.BundleAggregations(ctx, db, device.UserID, roomID, events); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("sync.BundleAggregations failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	res.Event = event[0]
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// eventsAround returns up to beforeLimit events in the room before the given
+// stream position, most recent first, and up to afterLimit events from it
+// onwards, along with stream tokens for paginating further in each direction.
+func eventsAround(
+	ctx context.Context, db storage.Database, device *authtypes.Device,
+	roomID string, pos types.StreamPosition, beforeLimit, afterLimit int,
+) (before, after []gomatrixserverlib.HeaderedEvent, start, end *types.PaginationToken, err error) {
+	token := func(pos types.StreamPosition) *types.PaginationToken {
+		return types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeStream, pos, 0)
+	}
+	latest, err := db.SyncStreamPosition(ctx)
+	if err != nil {
+		return
+	}
+
+	start, end = token(pos-1), token(pos)
+	before, after = []gomatrixserverlib.HeaderedEvent{}, []gomatrixserverlib.HeaderedEvent{}
+	if beforeLimit > 0 {
+		var streamEvents []types.StreamEvent
+		streamEvents, err = db.GetEventsInRange(ctx, token(pos-1), token(0), roomID, beforeLimit, true)
+		if err != nil {
+			return
+		}
+		if len(streamEvents) > 0 {
+			start = token(streamEvents[len(streamEvents)-1].StreamPosition - 1)
+		}
+		before = db.StreamEventsToEvents(device, streamEvents)
+	}
+	if afterLimit > 0 {
+		var streamEvents []types.StreamEvent
+		streamEvents, err = db.GetEventsInRange(ctx, token(pos), token(latest), roomID, afterLimit, false)
+		if err != nil {
+			return
+		}
+		if len(streamEvents) > 0 {
+			end = token(streamEvents[len(streamEvents)-1].StreamPosition)
+		}
+		after = db.StreamEventsToEvents(device, streamEvents)
+	}
+	return
+}
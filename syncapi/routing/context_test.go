@@ -0,0 +1,219 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// testQueryAPI answers roomserver queries as if the room's state was the same
+// at every event. Only the requested state is returned if the query asks for
+// particular state.
+type testQueryAPI struct {
+	api.RoomserverQueryAPI
+	state []gomatrixserverlib.HeaderedEvent
+}
+
+// newTestQueryAPI returns a testQueryAPI where alice has the given membership
+// and the room has the given history visibility.
+func newTestQueryAPI(room *testRoom, membership, historyVisibility string) *testQueryAPI {
+	emptyStateKey, userStateKey := "", testUserID
+	return &testQueryAPI{state: []gomatrixserverlib.HeaderedEvent{
+		room.build(gomatrixserverlib.MRoomMember, &userStateKey, map[string]string{
+			"membership": membership,
+		}).Headered(gomatrixserverlib.RoomVersionV4),
+		room.build(gomatrixserverlib.MRoomHistoryVisibility, &emptyStateKey, map[string]string{
+			"history_visibility": historyVisibility,
+		}).Headered(gomatrixserverlib.RoomVersionV4),
+	}}
+}
+
+func (q *testQueryAPI) QueryStateAfterEvents(
+	ctx context.Context,
+	request *api.QueryStateAfterEventsRequest,
+	response *api.QueryStateAfterEventsResponse,
+) error {
+	response.RoomExists = true
+	response.PrevEventsExist = true
+	response.StateEvents = q.stateToFetch(request.StateToFetch)
+	// The state after an event in the state leaves out the state after it.
+	for i, ev := range q.state {
+		if len(request.PrevEventIDs) == 1 && ev.EventID() == request.PrevEventIDs[0] {
+			response.StateEvents = (&testQueryAPI{state: q.state[:i+1]}).stateToFetch(request.StateToFetch)
+		}
+	}
+	return nil
+}
+
+func (q *testQueryAPI) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	response.RoomExists = true
+	response.StateEvents = q.stateToFetch(request.StateToFetch)
+	return nil
+}
+
+// stateToFetch returns the state events matching the tuples, or all of them
+// if there are no tuples.
+func (q *testQueryAPI) stateToFetch(tuples []gomatrixserverlib.StateKeyTuple) []gomatrixserverlib.HeaderedEvent {
+	if len(tuples) == 0 {
+		return q.state
+	}
+	var events []gomatrixserverlib.HeaderedEvent
+	for _, ev := range q.state {
+		for _, tuple := range tuples {
+			if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+				events = append(events, ev)
+			}
+		}
+	}
+	return events
+}
+
+func (q *testQueryAPI) QueryMembershipForUser(
+	ctx context.Context,
+	request *api.QueryMembershipForUserRequest,
+	response *api.QueryMembershipForUserResponse,
+) error {
+	membership, err := q.state[0].Membership()
+	response.HasBeenInRoom = true
+	response.IsInRoom = membership == gomatrixserverlib.Join
+	return err
+}
+
+func doContext(db storage.Database, queryAPI api.RoomserverQueryAPI, eventID, limit string) util.JSONResponse {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/"+testRoomID+"/context/"+eventID+"?limit="+limit, nil)
+	return Context(req, &authtypes.Device{UserID: testUserID}, db, queryAPI, testRoomID, eventID)
+}
+
+func TestContextLimit(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, events := writeTestEvents(t, db, "one", "two", "three", "four", "five", "six")
+	queryAPI := newTestQueryAPI(room, gomatrixserverlib.Join, "joined")
+
+	tests := []struct {
+		limit      string
+		wantBefore []string
+		wantAfter  []string
+	}{
+		{"4", []string{"two", "one"}, []string{"four", "five"}},
+		{"3", []string{"two"}, []string{"four", "five"}},
+		{"1", []string{}, []string{"four"}},
+		{"0", []string{}, []string{}},
+		{"10", []string{"two", "one", "", ""}, []string{"four", "five", "six"}},
+	}
+	for _, tt := range tests {
+		res := doContext(db, queryAPI, events[2].EventID(), tt.limit)
+		if res.Code != http.StatusOK {
+			t.Fatalf("limit %s: expected 200 OK, got %d: %+v", tt.limit, res.Code, res.JSON)
+		}
+		cr := res.JSON.(contextResponse)
+		if got := eventBodies([]gomatrixserverlib.ClientEvent{cr.Event}); got[0] != "three" {
+			t.Errorf("limit %s: expected the target event, got %q", tt.limit, got[0])
+		}
+		if got := eventBodies(cr.EventsBefore); !equalStrings(got, tt.wantBefore) {
+			t.Errorf("limit %s: expected events before %v, got %v", tt.limit, tt.wantBefore, got)
+		}
+		if got := eventBodies(cr.EventsAfter); !equalStrings(got, tt.wantAfter) {
+			t.Errorf("limit %s: expected events after %v, got %v", tt.limit, tt.wantAfter, got)
+		}
+		if cr.Start == "" || cr.End == "" {
+			t.Errorf("limit %s: expected pagination tokens, got %q and %q", tt.limit, cr.Start, cr.End)
+		}
+		if len(cr.State) != len(queryAPI.state) {
+			t.Errorf("limit %s: expected %d state events, got %d", tt.limit, len(queryAPI.state), len(cr.State))
+		}
+	}
+
+	res := doContext(db, queryAPI, events[2].EventID(), "bogus")
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad limit, got %d", res.Code)
+	}
+}
+
+func TestContextRedactedEvent(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, _ := writeTestEvents(t, db, "before")
+	ev := room.build("m.room.message", nil, map[string]string{"msgtype": "m.text", "body": "secret"})
+	// Redact doesn't keep the room version, so reload the redacted JSON.
+	redacted := ev.Redact()
+	redacted, err := gomatrixserverlib.NewEventFromTrustedJSON(redacted.JSON(), true, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.write(redacted)
+	queryAPI := newTestQueryAPI(room, gomatrixserverlib.Join, "joined")
+
+	res := doContext(db, queryAPI, ev.EventID(), "2")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %+v", res.Code, res.JSON)
+	}
+	cr := res.JSON.(contextResponse)
+	if cr.Event.EventID != ev.EventID() {
+		t.Fatalf("expected event %s, got %s", ev.EventID(), cr.Event.EventID)
+	}
+	if string(cr.Event.Content) != "{}" {
+		t.Errorf("expected the redacted event to have no content, got %s", cr.Event.Content)
+	}
+	if got := eventBodies(cr.EventsBefore); len(got) != 1 || got[0] != "before" {
+		t.Errorf("expected one event before, got %v", got)
+	}
+}
+
+func TestContextNotFound(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, events := writeTestEvents(t, db, "hello")
+
+	res := doContext(db, newTestQueryAPI(room, gomatrixserverlib.Join, "joined"), "$unknown:localhost", "10")
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown event, got %d", res.Code)
+	}
+
+	res = doContext(db, newTestQueryAPI(room, gomatrixserverlib.Leave, "joined"), events[0].EventID(), "10")
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an event the user may not see, got %d", res.Code)
+	}
+
+	res = doContext(db, newTestQueryAPI(room, gomatrixserverlib.Leave, "world_readable"), events[0].EventID(), "10")
+	if res.Code != http.StatusOK {
+		t.Errorf("expected 200 OK for a world readable event, got %d", res.Code)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type roomInitialSyncMessages struct {
+	Start string                          `json:"start"`
+	End   string                          `json:"end"`
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+}
+
+type roomInitialSyncResponse struct {
+	RoomID      string                          `json:"room_id"`
+	Membership  string                          `json:"membership,omitempty"`
+	Visibility  string                          `json:"visibility"`
+	Messages    roomInitialSyncMessages         `json:"messages"`
+	State       []gomatrixserverlib.ClientEvent `json:"state"`
+	Presence    []gomatrixserverlib.ClientEvent `json:"presence"`
+	AccountData []gomatrixserverlib.ClientEvent `json:"account_data"`
+}
+
+// RoomInitialSync implements GET /rooms/{roomID}/initialSync
+// It returns the current state of the room and its most recent messages,
+// which lets users peek into world readable rooms without joining them.
+// Users who have left the room get the state after leaveEventID instead.
+// https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-rooms-roomid-initialsync
+func RoomInitialSync(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	federation *gomatrixserverlib.FederationClient, keyRing gomatrixserverlib.JSONVerifier,
+	queryAPI api.RoomserverQueryAPI, cfg *config.Dendrite, srp *sync.RequestPool, roomID, leaveEventID string,
+) util.JSONResponse {
+	limit := defaultMessagesLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+	}
+
+	roomExists, stateEvents, err := common.QueryRoomState(req.Context(), queryAPI, roomID, leaveEventID, nil)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("common.QueryRoomState failed")
+		return jsonerror.InternalServerError()
+	}
+	if !roomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown room"),
+		}
+	}
+	res := roomInitialSyncResponse{
+		RoomID:      roomID,
+		Visibility:  "private",
+		State:       gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatAll),
+		Presence:    []gomatrixserverlib.ClientEvent{},
+		AccountData: []gomatrixserverlib.ClientEvent{},
+	}
+	for _, ev := range stateEvents {
+		switch {
+		case ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(device.UserID):
+			res.Membership, _ = ev.Membership()
+		case ev.Type() == gomatrixserverlib.MRoomJoinRules:
+			var content gomatrixserverlib.JoinRuleContent
+			if json.Unmarshal(ev.Content(), &content) == nil && content.JoinRule == gomatrixserverlib.Public {
+				res.Visibility = "public"
+			}
+		}
+	}
+
+	// The messages are read backwards from the current position, leaving out
+	// the ones which the user may not see.
+	pos, err := db.SyncPosition(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.SyncPosition failed")
+		return jsonerror.InternalServerError()
+	}
+	to, err := setToDefault(req.Context(), db, true, roomID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("setToDefault failed")
+		return jsonerror.InternalServerError()
+	}
+	mReq := messagesReq{
+		ctx:              req.Context(),
+		device:           device,
+		db:               db,
+		queryAPI:         queryAPI,
+		federation:       federation,
+		keyRing:          keyRing,
+		cfg:              cfg,
+		roomID:           roomID,
+		from:             &pos,
+		to:               to,
+		limit:            limit,
+		backwardOrdering: true,
+	}
+	clientEvents, _, end, err := mReq.retrieveEvents()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("mReq.retrieveEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	if srp != nil {
+		var ignored map[string]bool
+		if ignored, err = srp.IgnoredUsers(req.Context(), device.UserID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("srp.IgnoredUsers failed")
+			return jsonerror.InternalServerError()
+		}
+		clientEvents = sync.FilterIgnoredEvents(clientEvents, ignored)
+	}
+	if err = sync.BundleAggregations(req.Context(), db, device.UserID, roomID, clientEvents); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sync.BundleAggregations failed")
+		return jsonerror.InternalServerError()
+	}
+	// The chunk is in chronological order, starting at the token to paginate
+	// backwards from and ending at the current position.
+	for i, j := 0, len(clientEvents)-1; i < j; i, j = i+1, j-1 {
+		clientEvents[i], clientEvents[j] = clientEvents[j], clientEvents[i]
+	}
+	res.Messages = roomInitialSyncMessages{
+		Start: end.String(),
+		End:   pos.String(),
+		Chunk: clientEvents,
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
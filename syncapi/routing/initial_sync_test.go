@@ -0,0 +1,134 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// peek makes a request as bob, who has never been in the room unless the test
+// says otherwise, after checking that bob can read the room as the router does.
+func peek(
+	t *testing.T, db storage.Database, queryAPI *testQueryAPI, isGuest bool,
+	endpoint string, query url.Values,
+) util.JSONResponse {
+	device := &authtypes.Device{UserID: "@bob:localhost", IsGuest: isGuest}
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/"+testRoomID+"/"+endpoint+"?"+query.Encode(), nil)
+	leaveEventID, resErr := common.CheckCanReadRoom(req, device, testRoomID, queryAPI)
+	if resErr != nil {
+		return *resErr
+	}
+	switch endpoint {
+	case "messages":
+		return OnIncomingMessagesRequest(req, device, db, testRoomID, nil, nil, queryAPI, nil, nil)
+	case "initialSync":
+		return RoomInitialSync(req, device, db, nil, nil, queryAPI, nil, nil, testRoomID, leaveEventID)
+	}
+	t.Fatalf("unknown endpoint %s", endpoint)
+	return util.JSONResponse{}
+}
+
+func TestPeekIntoWorldReadableRoom(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, events := writeTestEvents(t, db, "one", "two")
+	queryAPI := newTestQueryAPI(room, gomatrixserverlib.Join, "world_readable")
+	pos, err := db.SyncPosition(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, isGuest := range []bool{false, true} {
+		res := peek(t, db, queryAPI, isGuest, "messages", url.Values{"dir": {"b"}, "limit": {"2"}, "from": {pos.String()}})
+		if res.Code != http.StatusOK {
+			t.Fatalf("guest %v: expected 200 OK from /messages, got %d: %+v", isGuest, res.Code, res.JSON)
+		}
+		if chunk := res.JSON.(messagesResp).Chunk; len(chunk) != 2 || chunk[0].EventID != events[1].EventID() {
+			t.Errorf("guest %v: expected the two messages from /messages, got %+v", isGuest, chunk)
+		}
+
+		res = peek(t, db, queryAPI, isGuest, "initialSync", url.Values{"limit": {"2"}})
+		if res.Code != http.StatusOK {
+			t.Fatalf("guest %v: expected 200 OK from /initialSync, got %d: %+v", isGuest, res.Code, res.JSON)
+		}
+		body := res.JSON.(roomInitialSyncResponse)
+		chunk := body.Messages.Chunk
+		if len(chunk) != 2 || chunk[0].EventID != events[0].EventID() || chunk[1].EventID != events[1].EventID() {
+			t.Errorf("guest %v: expected the two messages in order from /initialSync, got %+v", isGuest, chunk)
+		}
+		if body.Membership != "" || len(body.State) != len(queryAPI.state) || body.Messages.Start == "" {
+			t.Errorf("guest %v: expected no membership, the state and a token to paginate from, got %+v", isGuest, body)
+		}
+	}
+}
+
+func TestPeekIntoSharedRoomIsForbidden(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, _ := writeTestEvents(t, db, "one", "two")
+	queryAPI := newTestQueryAPI(room, gomatrixserverlib.Join, "shared")
+
+	for _, isGuest := range []bool{false, true} {
+		for _, endpoint := range []string{"messages", "initialSync"} {
+			if res := peek(t, db, queryAPI, isGuest, endpoint, url.Values{"dir": {"b"}}); res.Code != http.StatusForbidden {
+				t.Errorf("guest %v: expected 403 from /%s, got %d: %+v", isGuest, endpoint, res.Code, res.JSON)
+			}
+		}
+	}
+}
+
+func TestPeekWithMembershipOtherThanJoin(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, _ := writeTestEvents(t, db, "one", "two")
+
+	// Only users who were joined and have left may read the room, as of the
+	// point they left.
+	bob := "@bob:localhost"
+	for membership, wantCode := range map[string]int{
+		gomatrixserverlib.Ban:    http.StatusForbidden,
+		gomatrixserverlib.Invite: http.StatusForbidden,
+		"knock":                  http.StatusForbidden,
+		gomatrixserverlib.Leave:  http.StatusOK,
+	} {
+		queryAPI := newTestQueryAPI(room, gomatrixserverlib.Join, "shared")
+		emptyStateKey := ""
+		queryAPI.state = append(queryAPI.state,
+			room.build(gomatrixserverlib.MRoomMember, &bob, map[string]string{
+				"membership": membership,
+			}).Headered(gomatrixserverlib.RoomVersionV4),
+			room.build(gomatrixserverlib.MRoomName, &emptyStateKey, map[string]string{
+				"name": "Renamed after bob left",
+			}).Headered(gomatrixserverlib.RoomVersionV4),
+		)
+
+		res := peek(t, db, queryAPI, false, "initialSync", url.Values{})
+		if res.Code != wantCode {
+			t.Errorf("%s: expected %d from /initialSync, got %d: %+v", membership, wantCode, res.Code, res.JSON)
+		} else if body, ok := res.JSON.(roomInitialSyncResponse); ok && (body.Membership != membership || len(body.State) != 3) {
+			t.Errorf("%s: expected the state as of when bob left, got %+v", membership, body)
+		}
+	}
+}
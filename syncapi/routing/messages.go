@@ -16,15 +16,18 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -33,9 +36,11 @@ import (
 
 type messagesReq struct {
 	ctx              context.Context
+	device           *authtypes.Device
 	db               storage.Database
 	queryAPI         api.RoomserverQueryAPI
 	federation       *gomatrixserverlib.FederationClient
+	keyRing          gomatrixserverlib.JSONVerifier
 	cfg              *config.Dendrite
 	roomID           string
 	from             *types.PaginationToken
@@ -49,6 +54,9 @@ type messagesResp struct {
 	Start string                          `json:"start"`
 	End   string                          `json:"end"`
 	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	// The member events of the senders in the chunk, if the filter asks for
+	// members to be lazy-loaded.
+	State []gomatrixserverlib.ClientEvent `json:"state,omitempty"`
 }
 
 const defaultMessagesLimit = 10
@@ -57,10 +65,11 @@ const defaultMessagesLimit = 10
 // client-server API.
 // See: https://matrix.org/docs/spec/client_server/latest.html#get-matrix-client-r0-rooms-roomid-messages
 func OnIncomingMessagesRequest(
-	req *http.Request, db storage.Database, roomID string,
+	req *http.Request, device *authtypes.Device, db storage.Database, roomID string,
 	federation *gomatrixserverlib.FederationClient,
+	keyRing gomatrixserverlib.JSONVerifier,
 	queryAPI api.RoomserverQueryAPI,
-	cfg *config.Dendrite,
+	cfg *config.Dendrite, srp *sync.RequestPool,
 ) util.JSONResponse {
 	var err error
 
@@ -110,8 +119,24 @@ func OnIncomingMessagesRequest(
 		wasToProvided = false
 	}
 
-	// Maximum number of events to return; defaults to 10.
+	// The filter to apply to the returned events, given as a RoomEventFilter
+	// in JSON.
+	var filter gomatrixserverlib.RoomEventFilter
+	if s := req.URL.Query().Get("filter"); len(s) > 0 {
+		if err = json.Unmarshal([]byte(s), &filter); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("Invalid filter: " + err.Error()),
+			}
+		}
+	}
+
+	// Maximum number of events to return; defaults to the limit of the filter
+	// or 10.
 	limit := defaultMessagesLimit
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
 	if len(req.URL.Query().Get("limit")) > 0 {
 		limit, err = strconv.Atoi(req.URL.Query().Get("limit"))
 
@@ -122,7 +147,6 @@ func OnIncomingMessagesRequest(
 			}
 		}
 	}
-	// TODO: Implement filtering (#587)
 
 	// Check the room ID's format.
 	if _, _, err = gomatrixserverlib.SplitID('!', roomID); err != nil {
@@ -134,9 +158,11 @@ func OnIncomingMessagesRequest(
 
 	mReq := messagesReq{
 		ctx:              req.Context(),
+		device:           device,
 		db:               db,
 		queryAPI:         queryAPI,
 		federation:       federation,
+		keyRing:          keyRing,
 		cfg:              cfg,
 		roomID:           roomID,
 		from:             from,
@@ -151,6 +177,29 @@ func OnIncomingMessagesRequest(
 		util.GetLogger(req.Context()).WithError(err).Error("mreq.retrieveEvents failed")
 		return jsonerror.InternalServerError()
 	}
+	// The pagination tokens still cover the events which were filtered out, so
+	// that the client doesn't get them on the next request.
+	clientEvents = sync.FilterRoomEvents(&filter, clientEvents)
+	if srp != nil {
+		var ignored map[string]bool
+		if ignored, err = srp.IgnoredUsers(req.Context(), device.UserID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("srp.IgnoredUsers failed")
+			return jsonerror.InternalServerError()
+		}
+		clientEvents = sync.FilterIgnoredEvents(clientEvents, ignored)
+	}
+	if err = sync.BundleAggregations(req.Context(), db, device.UserID, roomID, clientEvents); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sync.BundleAggregations failed")
+		return jsonerror.InternalServerError()
+	}
+	var state []gomatrixserverlib.ClientEvent
+	if filter.LazyLoadMembers && len(clientEvents) > 0 {
+		state, err = lazyLoadMembers(req.Context(), device, roomID, clientEvents, backwardOrdering, &filter, queryAPI, srp)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("lazyLoadMembers failed")
+			return jsonerror.InternalServerError()
+		}
+	}
 	util.GetLogger(req.Context()).WithFields(logrus.Fields{
 		"from":         from.String(),
 		"to":           to.String(),
@@ -167,10 +216,54 @@ func OnIncomingMessagesRequest(
 			Chunk: clientEvents,
 			Start: start.String(),
 			End:   end.String(),
+			State: state,
 		},
 	}
 }
 
+// lazyLoadMembers returns the member events of the senders of the events in
+// the chunk, as of the most recent event in it, by which point all of the
+// senders have joined the room. Members that the device already has are left
+// out unless the filter includes redundant members.
+func lazyLoadMembers(
+	ctx context.Context, device *authtypes.Device, roomID string,
+	chunk []gomatrixserverlib.ClientEvent, backwardOrdering bool,
+	filter *gomatrixserverlib.RoomEventFilter,
+	queryAPI api.RoomserverQueryAPI, srp *sync.RequestPool,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	var senders []string
+	seen := make(map[string]bool)
+	for _, ev := range chunk {
+		if !seen[ev.Sender] {
+			seen[ev.Sender] = true
+			senders = append(senders, ev.Sender)
+		}
+	}
+	members := srp.LazyLoadMembers(device, roomID, senders, filter.IncludeRedundantMembers)
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	latest := chunk[len(chunk)-1]
+	if backwardOrdering {
+		latest = chunk[0]
+	}
+	stateReq := api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{latest.EventID},
+	}
+	for _, member := range members {
+		stateReq.StateToFetch = append(stateReq.StateToFetch, gomatrixserverlib.StateKeyTuple{
+			EventType: gomatrixserverlib.MRoomMember, StateKey: member,
+		})
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err := queryAPI.QueryStateAfterEvents(ctx, &stateReq, &stateRes); err != nil {
+		return nil, err
+	}
+	return gomatrixserverlib.HeaderedToClientEvents(stateRes.StateEvents, gomatrixserverlib.FormatAll), nil
+}
+
 // retrieveEvents retrieve events from the local database for a request on
 // /messages. If there's not enough events to retrieve, it asks another
 // homeserver in the room for older events.
@@ -218,8 +311,6 @@ func (r *messagesReq) retrieveEvents() (
 		})
 	}
 
-	// Convert all of the events into client events.
-	clientEvents = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
 	// Get the position of the first and the last event in the room's topology.
 	// This position is currently determined by the event's depth, so we could
 	// also use it instead of retrieving from the database. However, if we ever
@@ -264,9 +355,37 @@ func (r *messagesReq) retrieveEvents() (
 		end.PDUPosition = types.StreamPosition(1)
 	}
 
+	// The pagination tokens cover the events that the user may not see too,
+	// so that they aren't given them again on the next request.
+	if events, err = r.visibleEvents(events); err != nil {
+		return
+	}
+
+	// Convert all of the events into client events.
+	clientEvents = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
 	return clientEvents, start, end, err
 }
 
+// visibleEvents returns the events which the user making the request may see
+// according to the history visibility of the room.
+func (r *messagesReq) visibleEvents(
+	events []gomatrixserverlib.HeaderedEvent,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	var membershipRes api.QueryMembershipForUserResponse
+	err := r.queryAPI.QueryMembershipForUser(r.ctx, &api.QueryMembershipForUserRequest{
+		RoomID: r.roomID,
+		UserID: r.device.UserID,
+	}, &membershipRes)
+	if err != nil {
+		return nil, fmt.Errorf("QueryMembershipForUser: %w", err)
+	}
+	events, err = sync.VisibleEvents(r.ctx, r.queryAPI, r.device.UserID, membershipRes.IsInRoom, events)
+	if err != nil {
+		return nil, fmt.Errorf("VisibleEvents: %w", err)
+	}
+	return events, nil
+}
+
 // handleEmptyEventsSlice handles the case where the initial request to the
 // database returned an empty slice of events. It does so by checking whether
 // the set is empty because we've reached a backward extremity, and if that is
@@ -350,8 +469,9 @@ func (r *messagesReq) handleNonEmptyEventsSlice(streamEvents []types.StreamEvent
 // homeserver in the room.
 // See: https://matrix.org/docs/spec/server_server/latest#get-matrix-federation-v1-backfill-roomid
 // It also stores the PDUs retrieved from the remote homeserver's response to
-// the database.
-// Returns with an empty string if the remote homeserver didn't return with any
+// the database, leaving out the ones which aren't in the room, which we already
+// have or whose signatures can't be verified.
+// Returns with an empty slice if the remote homeserver didn't return with any
 // event, or if there is no remote homeserver to contact.
 // Returns an error if there was an issue with retrieving the list of servers in
 // the room or sending the request.
@@ -368,6 +488,9 @@ func (r *messagesReq) backfill(fromEventIDs []string, limit int) ([]gomatrixserv
 	}
 
 	headered := make([]gomatrixserverlib.HeaderedEvent, 0)
+	if srvToBackfillFrom == "" {
+		return headered, nil
+	}
 
 	// If the roomserver responded with at least one server that isn't us,
 	// send it a request for backfill.
@@ -379,11 +502,11 @@ func (r *messagesReq) backfill(fromEventIDs []string, limit int) ([]gomatrixserv
 		return nil, err
 	}
 
-	for _, p := range txn.PDUs {
-		event, e := gomatrixserverlib.NewEventFromUntrustedJSON(p, verRes.RoomVersion)
-		if e != nil {
-			continue
-		}
+	events, err := r.newBackfilledEvents(txn.PDUs, verRes.RoomVersion, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
 		headered = append(headered, event.Headered(verRes.RoomVersion))
 	}
 	util.GetLogger(r.ctx).WithField("server", srvToBackfillFrom).WithField("new_events", len(headered)).Info("Storing new events from backfill")
@@ -406,6 +529,65 @@ func (r *messagesReq) backfill(fromEventIDs []string, limit int) ([]gomatrixserv
 	return headered, nil
 }
 
+// newBackfilledEvents parses the PDUs returned by a remote server in response
+// to a request to /backfill. The events which aren't in the room, which are
+// already in the database, or which aren't correctly signed by their servers
+// are dropped, and at most limit events are kept from the rest.
+func (r *messagesReq) newBackfilledEvents(
+	pdus []json.RawMessage, roomVersion gomatrixserverlib.RoomVersion, limit int,
+) ([]gomatrixserverlib.Event, error) {
+	var events []gomatrixserverlib.Event
+	var eventIDs []string
+	seen := make(map[string]bool, len(pdus))
+	for _, pdu := range pdus {
+		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(pdu, roomVersion)
+		if err != nil || event.RoomID() != r.roomID || seen[event.EventID()] {
+			continue
+		}
+		seen[event.EventID()] = true
+		events = append(events, event)
+		eventIDs = append(eventIDs, event.EventID())
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	knownEvents, err := r.db.Events(r.ctx, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(knownEvents))
+	for _, ev := range knownEvents {
+		known[ev.EventID()] = true
+	}
+	unknown := events[:0]
+	for _, event := range events {
+		if !known[event.EventID()] {
+			unknown = append(unknown, event)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil, nil
+	}
+
+	verifyErrs, err := gomatrixserverlib.VerifyEventSignatures(r.ctx, unknown, r.keyRing)
+	if err != nil {
+		return nil, err
+	}
+	verified := unknown[:0]
+	for i, event := range unknown {
+		if len(verified) == limit {
+			break
+		}
+		if verifyErrs[i] != nil {
+			util.GetLogger(r.ctx).WithError(verifyErrs[i]).WithField("event_id", event.EventID()).Warn("Dropping backfilled event with bad signatures")
+			continue
+		}
+		verified = append(verified, event)
+	}
+	return verified, nil
+}
+
 func (r *messagesReq) serverToBackfillFrom(fromEventIDs []string) (gomatrixserverlib.ServerName, error) {
 	// Query the list of servers in the room when one of the backward extremities
 	// was sent.
@@ -444,22 +626,18 @@ func (r *messagesReq) serverToBackfillFrom(fromEventIDs []string) (gomatrixserve
 		return "", err
 	}
 
-	// Use the first server from the response, except if that server is us.
-	// In that case, use the second one if the roomserver responded with
-	// enough servers. If not, use an empty string to prevent the backfill
-	// from happening as there's no server to direct the request towards.
+	// Use the first server from the response that isn't us. If there is none,
+	// use an empty string to prevent the backfill from happening as there's no
+	// server to direct the request towards.
 	// TODO: Be smarter at selecting the server to direct the request
 	// towards.
-	srvToBackfillFrom := serversResponse.Servers[0]
-	if srvToBackfillFrom == r.cfg.Matrix.ServerName {
-		if len(serversResponse.Servers) > 1 {
-			srvToBackfillFrom = serversResponse.Servers[1]
-		} else {
-			util.GetLogger(r.ctx).Info("Not enough servers to backfill from")
-			return "", nil
+	for _, srv := range serversResponse.Servers {
+		if srv != r.cfg.Matrix.ServerName {
+			return srv, nil
 		}
 	}
-	return srvToBackfillFrom, nil
+	util.GetLogger(r.ctx).Info("Not enough servers to backfill from")
+	return "", nil
 }
 
 // setToDefault returns the default value for the "to" query parameter of a
@@ -0,0 +1,296 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// writeBusyRoom writes a room which alice, bob, carol and dave are joined to,
+// where only alice and bob have sent the most recent messages. It returns a
+// testQueryAPI which knows about the members of the room.
+func writeBusyRoom(t *testing.T, db storage.Database) *testQueryAPI {
+	room, _ := writeTestEvents(t, db)
+	queryAPI := &testQueryAPI{}
+	for _, userID := range []string{testUserID, "@bob:localhost", "@carol:localhost", "@dave:localhost"} {
+		stateKey := userID
+		ev := room.buildAs(userID, gomatrixserverlib.MRoomMember, &stateKey, map[string]string{"membership": "join"})
+		if userID != testUserID {
+			room.write(ev)
+		}
+		queryAPI.state = append(queryAPI.state, ev.Headered(gomatrixserverlib.RoomVersionV4))
+	}
+	for _, sender := range []string{testUserID, "@bob:localhost", testUserID, "@bob:localhost"} {
+		room.write(room.buildAs(sender, "m.room.message", nil, map[string]string{"msgtype": "m.text", "body": "hello"}))
+	}
+	return queryAPI
+}
+
+// doMessages back-paginates the four most recent events of the room with the
+// given filter, and returns the state keys of the member events in the state.
+func doMessages(
+	t *testing.T, db storage.Database, queryAPI *testQueryAPI, srp *sync.RequestPool,
+	device *authtypes.Device, filter string,
+) []string {
+	pos, err := db.SyncPosition(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{"dir": {"b"}, "limit": {"4"}, "from": {pos.String()}, "filter": {filter}}
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/"+testRoomID+"/messages?"+query.Encode(), nil)
+	res := OnIncomingMessagesRequest(req, device, db, testRoomID, nil, nil, queryAPI, nil, srp)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %+v", res.Code, res.JSON)
+	}
+	mr := res.JSON.(messagesResp)
+	if len(mr.Chunk) != 4 {
+		t.Fatalf("expected 4 events, got %d", len(mr.Chunk))
+	}
+	members := []string{}
+	for _, ev := range mr.State {
+		if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil {
+			members = append(members, *ev.StateKey)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+func TestMessagesLazyLoadsMembersOfSenders(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	queryAPI := writeBusyRoom(t, db)
+	srp := sync.NewRequestPool(db, sync.NewNotifier(types.PaginationToken{}), nil, nil, nil, nil)
+	device := &authtypes.Device{UserID: testUserID, ID: "ALICE"}
+
+	senders := []string{"@alice:localhost", "@bob:localhost"}
+	if got := doMessages(t, db, queryAPI, srp, device, `{"lazy_load_members":true}`); !equalStrings(got, senders) {
+		t.Errorf("expected the member events of the two senders, got %v", got)
+	}
+
+	// The device already has the members now.
+	if got := doMessages(t, db, queryAPI, srp, device, `{"lazy_load_members":true}`); len(got) != 0 {
+		t.Errorf("expected no redundant member events, got %v", got)
+	}
+	if got := doMessages(t, db, queryAPI, srp, device, `{"lazy_load_members":true,"include_redundant_members":true}`); !equalStrings(got, senders) {
+		t.Errorf("expected redundant member events when asked for, got %v", got)
+	}
+
+	if got := doMessages(t, db, queryAPI, srp, device, `{}`); len(got) != 0 {
+		t.Errorf("expected no state without lazy-loading, got %v", got)
+	}
+}
+
+func TestMessagesRespectsHistoryVisibility(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, _ := writeTestEvents(t, db, "one", "two")
+	srp := sync.NewRequestPool(db, sync.NewNotifier(types.PaginationToken{}), nil, nil, nil, nil)
+	pos, err := db.SyncPosition(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		membership, visibility string
+		wantEvents             int
+	}{
+		{gomatrixserverlib.Join, "joined", 2},
+		{gomatrixserverlib.Leave, "joined", 0},
+		{gomatrixserverlib.Leave, "shared", 0},
+		{gomatrixserverlib.Leave, "world_readable", 2},
+	} {
+		queryAPI := newTestQueryAPI(room, tt.membership, tt.visibility)
+		query := url.Values{"dir": {"b"}, "limit": {"2"}, "from": {pos.String()}}
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/"+testRoomID+"/messages?"+query.Encode(), nil)
+		res := OnIncomingMessagesRequest(req, &authtypes.Device{UserID: testUserID}, db, testRoomID, nil, nil, queryAPI, nil, srp)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected 200 OK, got %d: %+v", res.Code, res.JSON)
+		}
+		mr := res.JSON.(messagesResp)
+		if len(mr.Chunk) != tt.wantEvents {
+			t.Errorf("membership %s with history visibility %s: expected %d events, got %d", tt.membership, tt.visibility, tt.wantEvents, len(mr.Chunk))
+		}
+		if mr.Start == "" || mr.End == "" {
+			t.Errorf("membership %s with history visibility %s: expected pagination tokens", tt.membership, tt.visibility)
+		}
+	}
+}
+
+// backfillQueryAPI is a testQueryAPI for a room which remote.example.com is
+// also in.
+type backfillQueryAPI struct {
+	*testQueryAPI
+}
+
+func (q backfillQueryAPI) QueryRoomVersionForRoom(
+	ctx context.Context,
+	request *api.QueryRoomVersionForRoomRequest,
+	response *api.QueryRoomVersionForRoomResponse,
+) error {
+	response.RoomVersion = gomatrixserverlib.RoomVersionV4
+	return nil
+}
+
+func (q backfillQueryAPI) QueryServersInRoomAtEvent(
+	ctx context.Context,
+	request *api.QueryServersInRoomAtEventRequest,
+	response *api.QueryServersInRoomAtEventResponse,
+) error {
+	response.Servers = []gomatrixserverlib.ServerName{"localhost", "remote.example.com"}
+	return nil
+}
+
+// testBackfillServer answers requests to /backfill with the given events.
+type testBackfillServer struct {
+	t        *testing.T
+	events   []gomatrixserverlib.Event
+	requests int
+}
+
+func (s *testBackfillServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	if req.URL.Host != "remote.example.com" || req.URL.Path != "/_matrix/federation/v1/backfill/"+testRoomID {
+		s.t.Errorf("unexpected request to %s", req.URL)
+		w.WriteHeader(http.StatusNotFound)
+		return w.Result(), nil
+	}
+	s.requests++
+	txn := gomatrixserverlib.Transaction{Origin: "remote.example.com", OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now())}
+	for _, ev := range s.events {
+		txn.PDUs = append(txn.PDUs, ev.JSON())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(txn); err != nil {
+		s.t.Fatal(err)
+	}
+	return w.Result(), nil
+}
+
+// testVerifier checks signatures against the key of the test room.
+type testVerifier struct {
+	publicKey ed25519.PublicKey
+}
+
+func (v testVerifier) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i, req := range requests {
+		results[i].Error = gomatrixserverlib.VerifyJSON(string(req.ServerName), "ed25519:test", v.publicKey, req.Message)
+	}
+	return results, nil
+}
+
+func TestMessagesBackfillsBeyondLocalHistory(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	// Only the two most recent messages of the room are stored locally, the
+	// earlier ones have to be backfilled from the remote server.
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := &testRoom{t: t, db: db, privateKey: privateKey}
+	var history []gomatrixserverlib.Event
+	for _, body := range []string{"one", "two"} {
+		ev := room.build("m.room.message", nil, map[string]string{"msgtype": "m.text", "body": body})
+		room.prevEvents, room.depth = []gomatrixserverlib.EventReference{ev.EventReference()}, ev.Depth()
+		history = append(history, ev)
+	}
+	three := room.build("m.room.message", nil, map[string]string{"msgtype": "m.text", "body": "three"})
+	room.write(three)
+	room.write(room.build("m.room.message", nil, map[string]string{"msgtype": "m.text", "body": "four"}))
+
+	// The remote server also returns an event we already have and one which
+	// isn't signed by the key of its server, which are both left out.
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forger := &testRoom{t: t, db: db, privateKey: otherKey}
+	forged := forger.build("m.room.message", nil, map[string]string{"msgtype": "m.text", "body": "forged"})
+	remote := &testBackfillServer{t: t, events: []gomatrixserverlib.Event{three, history[1], forged, history[0]}}
+	tr := &http.Transport{}
+	tr.RegisterProtocol("matrix", remote)
+	federation := gomatrixserverlib.NewFederationClientWithTransport("localhost", "ed25519:test", privateKey, tr)
+	federation.Client = *gomatrixserverlib.NewClientWithTimeout(0, tr)
+
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	queryAPI := backfillQueryAPI{newTestQueryAPI(room, gomatrixserverlib.Join, "joined")}
+	srp := sync.NewRequestPool(db, sync.NewNotifier(types.PaginationToken{}), nil, nil, nil, nil)
+	pos, err := db.SyncPosition(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{"dir": {"b"}, "limit": {"5"}, "from": {pos.String()}}
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/"+testRoomID+"/messages?"+query.Encode(), nil)
+	res := OnIncomingMessagesRequest(
+		req, &authtypes.Device{UserID: testUserID}, db, testRoomID, federation,
+		testVerifier{privateKey.Public().(ed25519.PublicKey)}, queryAPI, cfg, srp,
+	)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %+v", res.Code, res.JSON)
+	}
+	if remote.requests != 1 {
+		t.Errorf("expected one backfill request, got %d", remote.requests)
+	}
+
+	var bodies []string
+	for _, ev := range res.JSON.(messagesResp).Chunk {
+		var content struct {
+			Body string `json:"body"`
+		}
+		if err = json.Unmarshal(ev.Content, &content); err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, content.Body)
+	}
+	sort.Strings(bodies)
+	if expected := []string{"four", "one", "three", "two"}; !equalStrings(bodies, expected) {
+		t.Errorf("expected the messages %v, got %v", expected, bodies)
+	}
+
+	stored, err := db.Events(context.Background(), []string{history[0].EventID(), history[1].EventID(), forged.EventID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Errorf("expected the two backfilled events to be stored, got %d events", len(stored))
+	}
+	for _, ev := range stored {
+		if ev.EventID() == forged.EventID() {
+			t.Errorf("expected the forged event not to be stored")
+		}
+	}
+}
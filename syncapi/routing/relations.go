@@ -0,0 +1,147 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultRelationsLimit = 5
+	maxRelationsLimit     = 100
+)
+
+type relationsResponse struct {
+	Chunk     []gomatrixserverlib.ClientEvent `json:"chunk"`
+	NextBatch string                          `json:"next_batch,omitempty"`
+}
+
+// Relations implements GET /rooms/{roomID}/relations/{eventID}[/{relType}[/{eventType}]]
+// See: https://github.com/matrix-org/matrix-doc/pull/2675
+// The events relating to the target event are returned most recent first,
+// and can be paged through with from, to and limit. Events that the user may
+// not see are left out, as is everything if they may not see the target.
+func Relations(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	queryAPI api.RoomserverQueryAPI, roomID, eventID, relType, eventType string,
+) util.JSONResponse {
+	ctx := req.Context()
+	limit := defaultRelationsLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+	}
+	if limit > maxRelationsLimit {
+		limit = maxRelationsLimit
+	}
+	latest, err := db.SyncStreamPosition(ctx)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.SyncStreamPosition failed")
+		return jsonerror.InternalServerError()
+	}
+	// The events returned are before from and after to.
+	from, resErr := streamPositionParam(req, "from", latest+1)
+	if resErr != nil {
+		return *resErr
+	}
+	to, resErr := streamPositionParam(req, "to", 0)
+	if resErr != nil {
+		return *resErr
+	}
+
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+	}
+	streamEvents, err := db.StreamEvents(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.StreamEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(streamEvents) == 0 || streamEvents[0].RoomID() != roomID {
+		return notFound
+	}
+	var membershipRes api.QueryMembershipForUserResponse
+	err = queryAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &membershipRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	target, err := sync.VisibleEvents(ctx, queryAPI, device.UserID, membershipRes.IsInRoom, db.StreamEventsToEvents(device, streamEvents))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("sync.VisibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(target) == 0 {
+		return notFound
+	}
+
+	related, err := db.RelatedEvents(ctx, roomID, eventID, relType, eventType, from, to, limit)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.RelatedEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	res := relationsResponse{}
+	if len(related) == limit {
+		res.NextBatch = types.NewPaginationTokenFromTypeAndPosition(
+			types.PaginationTokenTypeStream, related[len(related)-1].StreamPosition, 0,
+		).String()
+	}
+	visible, err := sync.VisibleEvents(ctx, queryAPI, device.UserID, membershipRes.IsInRoom, db.StreamEventsToEvents(device, related))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("sync.VisibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	res.Chunk = gomatrixserverlib.HeaderedToClientEvents(visible, gomatrixserverlib.FormatAll)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// streamPositionParam returns the stream position of the stream token in a
+// query parameter, or def if the parameter isn't given.
+func streamPositionParam(req *http.Request, param string, def types.StreamPosition) (types.StreamPosition, *util.JSONResponse) {
+	s := req.URL.Query().Get(param)
+	if s == "" {
+		return def, nil
+	}
+	token, err := types.NewPaginationTokenFromString(s)
+	if err != nil || token.Type != types.PaginationTokenTypeStream {
+		return 0, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid " + param + " parameter"),
+		}
+	}
+	return token.PDUPosition, nil
+}
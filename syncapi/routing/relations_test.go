@@ -0,0 +1,136 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// writeTestRelations writes a message with two reactions and then an edit
+// relating to it. It returns the message and the events relating to it.
+func writeTestRelations(t *testing.T, db storage.Database) (*testRoom, gomatrixserverlib.Event, []gomatrixserverlib.Event) {
+	room, events := writeTestEvents(t, db, "hello")
+	target := events[0]
+	related := []gomatrixserverlib.Event{
+		room.build("m.reaction", nil, map[string]interface{}{
+			"m.relates_to": map[string]string{"rel_type": "m.annotation", "event_id": target.EventID(), "key": "👍"},
+		}),
+		room.buildAs("@bob:localhost", "m.reaction", nil, map[string]interface{}{
+			"m.relates_to": map[string]string{"rel_type": "m.annotation", "event_id": target.EventID(), "key": "👍"},
+		}),
+		room.build("m.room.message", nil, map[string]interface{}{
+			"msgtype":       "m.text",
+			"body":          "* hello!",
+			"m.new_content": map[string]string{"msgtype": "m.text", "body": "hello!"},
+			"m.relates_to":  map[string]string{"rel_type": "m.replace", "event_id": target.EventID()},
+		}),
+	}
+	for _, ev := range related {
+		room.write(ev)
+	}
+	// A message which isn't related to anything.
+	room.write(room.build("m.room.message", nil, map[string]string{"msgtype": "m.text", "body": "unrelated"}))
+	return room, target, related
+}
+
+func doRelations(
+	db storage.Database, queryAPI api.RoomserverQueryAPI, eventID, relType, eventType, query string,
+) util.JSONResponse {
+	path := "/_matrix/client/v1/rooms/" + testRoomID + "/relations/" + eventID
+	req := httptest.NewRequest(http.MethodGet, path+"?"+query, nil)
+	return Relations(req, &authtypes.Device{UserID: testUserID}, db, queryAPI, testRoomID, eventID, relType, eventType)
+}
+
+func relatedEventIDs(t *testing.T, res util.JSONResponse) ([]string, string) {
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %+v", res.Code, res.JSON)
+	}
+	body := res.JSON.(relationsResponse)
+	eventIDs := []string{}
+	for _, ev := range body.Chunk {
+		eventIDs = append(eventIDs, ev.EventID)
+	}
+	return eventIDs, body.NextBatch
+}
+
+func TestRelationsFilteredByRelType(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, target, related := writeTestRelations(t, db)
+	queryAPI := newTestQueryAPI(room, gomatrixserverlib.Join, "joined")
+
+	tests := []struct {
+		relType, eventType string
+		want               []gomatrixserverlib.Event
+	}{
+		{"", "", []gomatrixserverlib.Event{related[2], related[1], related[0]}},
+		{"m.annotation", "", []gomatrixserverlib.Event{related[1], related[0]}},
+		{"m.annotation", "m.reaction", []gomatrixserverlib.Event{related[1], related[0]}},
+		{"m.annotation", "m.room.message", nil},
+		{"m.replace", "", []gomatrixserverlib.Event{related[2]}},
+	}
+	for _, tt := range tests {
+		want := []string{}
+		for _, ev := range tt.want {
+			want = append(want, ev.EventID())
+		}
+		got, _ := relatedEventIDs(t, doRelations(db, queryAPI, target.EventID(), tt.relType, tt.eventType, "limit=10"))
+		if !equalStrings(got, want) {
+			t.Errorf("rel_type %q, type %q: expected %v, got %v", tt.relType, tt.eventType, want, got)
+		}
+	}
+}
+
+func TestRelationsPagination(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, target, related := writeTestRelations(t, db)
+	queryAPI := newTestQueryAPI(room, gomatrixserverlib.Join, "joined")
+
+	got, next := relatedEventIDs(t, doRelations(db, queryAPI, target.EventID(), "", "", "limit=2"))
+	if want := []string{related[2].EventID(), related[1].EventID()}; !equalStrings(got, want) || next == "" {
+		t.Fatalf("expected %v and a next batch, got %v and %q", want, got, next)
+	}
+	got, next = relatedEventIDs(t, doRelations(db, queryAPI, target.EventID(), "", "", "limit=2&from="+next))
+	if want := []string{related[0].EventID()}; !equalStrings(got, want) || next != "" {
+		t.Errorf("expected %v and no next batch, got %v and %q", want, got, next)
+	}
+
+	if res := doRelations(db, queryAPI, target.EventID(), "", "", "from=bogus"); res.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad from token, got %d", res.Code)
+	}
+}
+
+func TestRelationsRespectHistoryVisibility(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, target, _ := writeTestRelations(t, db)
+	queryAPI := newTestQueryAPI(room, gomatrixserverlib.Leave, "joined")
+
+	if res := doRelations(db, queryAPI, target.EventID(), "", "", ""); res.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an event the user may not see, got %d: %+v", res.Code, res.JSON)
+	}
+	if res := doRelations(db, queryAPI, "$unknown:localhost", "", "", ""); res.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown event, got %d: %+v", res.Code, res.JSON)
+	}
+}
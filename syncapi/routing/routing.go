@@ -30,7 +30,10 @@ import (
 	"github.com/matrix-org/util"
 )
 
-const pathPrefixR0 = "/_matrix/client/r0"
+const (
+	pathPrefixR0       = "/_matrix/client/r0"
+	pathPrefixClientV1 = "/_matrix/client/v1"
+)
 
 // Setup configures the given mux with sync-server listeners
 //
@@ -40,10 +43,11 @@ const pathPrefixR0 = "/_matrix/client/r0"
 func Setup(
 	apiMux *mux.Router, srp *sync.RequestPool, syncDB storage.Database,
 	deviceDB devices.Database, federation *gomatrixserverlib.FederationClient,
-	queryAPI api.RoomserverQueryAPI,
+	keyRing gomatrixserverlib.JSONVerifier, queryAPI api.RoomserverQueryAPI,
 	cfg *config.Dendrite,
 ) {
 	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
+	v1mux := apiMux.PathPrefix(pathPrefixClientV1).Subrouter()
 
 	authData := auth.Data{
 		AccountDB:   nil,
@@ -52,15 +56,72 @@ func Setup(
 	}
 
 	// TODO: Add AS support for all handlers below.
-	r0mux.Handle("/sync", common.MakeAuthAPI("sync", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	r0mux.Handle("/sync", common.MakeGuestAuthAPI("sync", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 		return srp.OnIncomingSyncRequest(req, device)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/messages", common.MakeAuthAPI("room_messages", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	r0mux.Handle("/rooms/{roomID}/messages", common.MakeGuestAuthAPI("room_messages", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := common.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		if _, resErr := common.CheckCanReadRoom(req, device, vars["roomID"], queryAPI); resErr != nil {
+			return *resErr
+		}
+		return OnIncomingMessagesRequest(req, device, syncDB, vars["roomID"], federation, keyRing, queryAPI, cfg, srp)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/context/{eventID}", common.MakeGuestAuthAPI("room_context", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := common.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		if _, resErr := common.CheckCanReadRoom(req, device, vars["roomID"], queryAPI); resErr != nil {
+			return *resErr
+		}
+		return Context(req, device, syncDB, queryAPI, vars["roomID"], vars["eventID"])
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/initialSync", common.MakeGuestAuthAPI("rooms_initial_sync", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 		vars, err := common.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
-		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], federation, queryAPI, cfg)
+		leaveEventID, resErr := common.CheckCanReadRoom(req, device, vars["roomID"], queryAPI)
+		if resErr != nil {
+			return *resErr
+		}
+		return RoomInitialSync(req, device, syncDB, federation, keyRing, queryAPI, cfg, srp, vars["roomID"], leaveEventID)
 	})).Methods(http.MethodGet, http.MethodOptions)
+
+	// The relation type and event type are optional, so the same handler
+	// serves all three paths.
+	relations := common.MakeGuestAuthAPI("room_relations", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := common.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		if _, resErr := common.CheckCanReadRoom(req, device, vars["roomID"], queryAPI); resErr != nil {
+			return *resErr
+		}
+		return Relations(req, device, syncDB, queryAPI, vars["roomID"], vars["eventID"], vars["relType"], vars["eventType"])
+	})
+	v1mux.Handle("/rooms/{roomID}/relations/{eventID}", relations).Methods(http.MethodGet, http.MethodOptions)
+	v1mux.Handle("/rooms/{roomID}/relations/{eventID}/{relType}", relations).Methods(http.MethodGet, http.MethodOptions)
+	v1mux.Handle("/rooms/{roomID}/relations/{eventID}/{relType}/{eventType}", relations).Methods(http.MethodGet, http.MethodOptions)
+
+	v1mux.Handle("/rooms/{roomID}/threads", common.MakeGuestAuthAPI("room_threads", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := common.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		if _, resErr := common.CheckCanReadRoom(req, device, vars["roomID"], queryAPI); resErr != nil {
+			return *resErr
+		}
+		return Threads(req, device, syncDB, queryAPI, vars["roomID"])
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/search", common.MakeAuthAPI("search", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return Search(req, device, syncDB, queryAPI)
+	})).Methods(http.MethodPost, http.MethodOptions)
 }
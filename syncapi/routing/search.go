@@ -0,0 +1,279 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultSearchLimit        = 10
+	defaultSearchContextLimit = 5
+)
+
+type searchRequest struct {
+	SearchCategories struct {
+		RoomEvents *roomEventsCriteria `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type roomEventsCriteria struct {
+	SearchTerm   string                            `json:"search_term"`
+	Keys         []string                          `json:"keys"`
+	Filter       gomatrixserverlib.RoomEventFilter `json:"filter"`
+	OrderBy      string                            `json:"order_by"`
+	EventContext *struct {
+		BeforeLimit *int `json:"before_limit"`
+		AfterLimit  *int `json:"after_limit"`
+	} `json:"event_context"`
+}
+
+type searchResponse struct {
+	SearchCategories struct {
+		RoomEvents roomEventsResults `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type roomEventsResults struct {
+	Count      int            `json:"count"`
+	Highlights []string       `json:"highlights"`
+	Results    []searchResult `json:"results"`
+	NextBatch  string         `json:"next_batch,omitempty"`
+}
+
+type searchResult struct {
+	Rank    float64                       `json:"rank"`
+	Result  gomatrixserverlib.ClientEvent `json:"result"`
+	Context *searchResultContext          `json:"context,omitempty"`
+}
+
+type searchResultContext struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+}
+
+// Search implements POST /search
+// See: https://matrix.org/docs/spec/client_server/r0.5.0.html#post-matrix-client-r0-search
+// Only the room_events category is supported, and only the rooms, not_rooms
+// and limit fields of its filter are applied. Like /messages, only the events
+// which the user may see are returned.
+func Search(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	var r searchRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	criteria := r.SearchCategories.RoomEvents
+	if criteria == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Only the room_events category is supported"),
+		}
+	}
+	if strings.TrimSpace(criteria.SearchTerm) == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'search_term' must be supplied"),
+		}
+	}
+	if criteria.OrderBy != "" && criteria.OrderBy != "rank" && criteria.OrderBy != "recent" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("'order_by' must be either 'rank' or 'recent'"),
+		}
+	}
+	keys := criteria.Keys
+	if len(keys) == 0 {
+		keys = []string{"content.body", "content.name", "content.topic"}
+	}
+
+	offset := 0
+	if nextBatch := req.URL.Query().Get("next_batch"); nextBatch != "" {
+		var err error
+		if offset, err = strconv.Atoi(nextBatch); err != nil || offset < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid next_batch parameter"),
+			}
+		}
+	}
+	limit := defaultSearchLimit
+	if criteria.Filter.Limit > 0 {
+		limit = criteria.Filter.Limit
+	}
+
+	// Only search the rooms the user is joined to.
+	// TODO: Also search rooms the user has left, up to when they left.
+	roomIDs, err := db.RoomIDsWithMembership(req.Context(), device.UserID, gomatrixserverlib.Join)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.RoomIDsWithMembership failed")
+		return jsonerror.InternalServerError()
+	}
+	roomIDs = filterSearchRooms(roomIDs, &criteria.Filter)
+
+	results, count, err := db.SearchEvents(
+		req.Context(), criteria.SearchTerm, roomIDs, keys,
+		criteria.OrderBy != "recent", limit, offset,
+	)
+	if err == types.ErrSearchUnavailable {
+		return util.JSONResponse{
+			Code: http.StatusNotImplemented,
+			JSON: jsonerror.Unknown("Search is unavailable on this server"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.SearchEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	eventIDs := make([]string, len(results))
+	for i := range results {
+		eventIDs[i] = results[i].EventID
+	}
+	events, err := db.Events(req.Context(), eventIDs)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	// Only the rooms which the user is joined to are searched.
+	events, err = sync.VisibleEvents(req.Context(), queryAPI, device.UserID, true, events)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sync.VisibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	eventsByID := make(map[string]gomatrixserverlib.HeaderedEvent, len(events))
+	for _, ev := range events {
+		eventsByID[ev.EventID()] = ev
+	}
+
+	// The next batch follows on from the results in the database, but the
+	// count leaves out the results on this page which the user may not see.
+	var res searchResponse
+	res.SearchCategories.RoomEvents.Count = count - (len(results) - len(eventsByID))
+	res.SearchCategories.RoomEvents.Highlights = searchHighlights(criteria.SearchTerm)
+	res.SearchCategories.RoomEvents.Results = []searchResult{}
+	if offset+len(results) < count {
+		res.SearchCategories.RoomEvents.NextBatch = strconv.Itoa(offset + len(results))
+	}
+
+	for _, result := range results {
+		ev, ok := eventsByID[result.EventID]
+		if !ok {
+			continue
+		}
+		sr := searchResult{
+			Rank:   result.Rank,
+			Result: gomatrixserverlib.HeaderedToClientEvent(ev, gomatrixserverlib.FormatAll),
+		}
+		if criteria.EventContext != nil {
+			before, after := defaultSearchContextLimit, defaultSearchContextLimit
+			if criteria.EventContext.BeforeLimit != nil {
+				before = *criteria.EventContext.BeforeLimit
+			}
+			if criteria.EventContext.AfterLimit != nil {
+				after = *criteria.EventContext.AfterLimit
+			}
+			sr.Context, err = searchContext(req.Context(), db, queryAPI, device, ev.RoomID(), result.StreamPosition, before, after)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("searchContext failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+		res.SearchCategories.RoomEvents.Results = append(res.SearchCategories.RoomEvents.Results, sr)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// searchContext returns up to the given number of events before and after the
+// event at the given stream position, with tokens to paginate further from
+// them using /messages. Only the events which the user may see are returned.
+func searchContext(
+	ctx context.Context, db storage.Database, queryAPI api.RoomserverQueryAPI,
+	device *authtypes.Device, roomID string, pos types.StreamPosition, beforeLimit, afterLimit int,
+) (*searchResultContext, error) {
+	before, after, start, end, err := eventsAround(ctx, db, device, roomID, pos, beforeLimit, afterLimit)
+	if err != nil {
+		return nil, err
+	}
+	if before, err = sync.VisibleEvents(ctx, queryAPI, device.UserID, true, before); err != nil {
+		return nil, err
+	}
+	if after, err = sync.VisibleEvents(ctx, queryAPI, device.UserID, true, after); err != nil {
+		return nil, err
+	}
+	return &searchResultContext{
+		Start:        start.String(),
+		End:          end.String(),
+		EventsBefore: gomatrixserverlib.HeaderedToClientEvents(before, gomatrixserverlib.FormatAll),
+		EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(after, gomatrixserverlib.FormatAll),
+	}, nil
+}
+
+// filterSearchRooms applies the rooms and not_rooms fields of a filter to a
+// list of room IDs.
+func filterSearchRooms(roomIDs []string, filter *gomatrixserverlib.RoomEventFilter) []string {
+	filtered := []string{}
+	for _, roomID := range roomIDs {
+		if filter.Rooms != nil && !containsString(filter.Rooms, roomID) {
+			continue
+		}
+		if containsString(filter.NotRooms, roomID) {
+			continue
+		}
+		filtered = append(filtered, roomID)
+	}
+	return filtered
+}
+
+// searchHighlights returns the words of the search term, which clients
+// highlight in the results.
+func searchHighlights(searchTerm string) []string {
+	highlights := []string{}
+	for _, word := range strings.Fields(strings.ToLower(searchTerm)) {
+		if !containsString(highlights, word) {
+			highlights = append(highlights, word)
+		}
+	}
+	return highlights
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	testRoomID = "!room:localhost"
+	testUserID = "@alice:localhost"
+)
+
+// testRoom writes events to a room in the database, each event following on
+// from the one written before it.
+type testRoom struct {
+	t          *testing.T
+	db         storage.Database
+	privateKey ed25519.PrivateKey
+	prevEvents []gomatrixserverlib.EventReference
+	depth      int64
+}
+
+// build builds the next event in the room, sent by alice.
+func (r *testRoom) build(eventType string, stateKey *string, content interface{}) gomatrixserverlib.Event {
+	return r.buildAs(testUserID, eventType, stateKey, content)
+}
+
+// buildAs builds the next event in the room, sent by the given user.
+func (r *testRoom) buildAs(sender, eventType string, stateKey *string, content interface{}) gomatrixserverlib.Event {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     sender,
+		RoomID:     testRoomID,
+		Type:       eventType,
+		StateKey:   stateKey,
+		PrevEvents: r.prevEvents,
+		AuthEvents: []gomatrixserverlib.EventReference{},
+		Depth:      r.depth + 1,
+	}
+	if err := builder.SetContent(content); err != nil {
+		r.t.Fatal(err)
+	}
+	ev, err := builder.Build(time.Now(), "localhost", "ed25519:test", r.privateKey, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return ev
+}
+
+// write writes the event to the database as the latest event in the room.
+func (r *testRoom) write(ev gomatrixserverlib.Event) {
+	headered := ev.Headered(gomatrixserverlib.RoomVersionV4)
+	var addState []gomatrixserverlib.HeaderedEvent
+	var addStateIDs []string
+	if ev.StateKey() != nil {
+		addState = []gomatrixserverlib.HeaderedEvent{headered}
+		addStateIDs = []string{ev.EventID()}
+	}
+	if _, err := r.db.WriteEvent(context.Background(), &headered, addState, addStateIDs, nil, nil, false); err != nil {
+		r.t.Fatal(err)
+	}
+	r.prevEvents = []gomatrixserverlib.EventReference{ev.EventReference()}
+	r.depth = ev.Depth()
+}
+
+// writeTestEvents writes a room which alice is joined to, containing the
+// given messages, to the database. It returns the room and the messages.
+func writeTestEvents(t *testing.T, db storage.Database, messages ...string) (*testRoom, []gomatrixserverlib.Event) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := &testRoom{t: t, db: db, privateKey: privateKey}
+
+	emptyStateKey, userStateKey := "", testUserID
+	room.write(room.build(gomatrixserverlib.MRoomCreate, &emptyStateKey, map[string]string{"creator": testUserID}))
+	room.write(room.build(gomatrixserverlib.MRoomMember, &userStateKey, map[string]string{"membership": "join"}))
+	var events []gomatrixserverlib.Event
+	for _, message := range messages {
+		ev := room.build("m.room.message", nil, map[string]string{"msgtype": "m.text", "body": message})
+		room.write(ev)
+		events = append(events, ev)
+	}
+	return room, events
+}
+
+func newTestDatabase(t *testing.T) (storage.Database, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-syncapi-search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.NewSyncServerDatasource("file:"+filepath.Join(dir, "syncapi.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, func() { _ = os.RemoveAll(dir) }
+}
+
+func doSearch(t *testing.T, db storage.Database, queryAPI api.RoomserverQueryAPI, body string) roomEventsResults {
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/search", bytes.NewBufferString(body))
+	res := Search(req, &authtypes.Device{UserID: testUserID}, db, queryAPI)
+	if res.Code == http.StatusNotImplemented {
+		t.Skip("SQLite was built without FTS5, build with -tags sqlite_fts5 to run this test")
+	}
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %+v", res.Code, res.JSON)
+	}
+	// Round-trip through JSON as a client would see it.
+	j, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sr searchResponse
+	if err = json.Unmarshal(j, &sr); err != nil {
+		t.Fatal(err)
+	}
+	return sr.SearchCategories.RoomEvents
+}
+
+func eventBodies(events []gomatrixserverlib.ClientEvent) []string {
+	bodies := []string{}
+	for _, ev := range events {
+		var content struct {
+			Body string `json:"body"`
+		}
+		_ = json.Unmarshal(ev.Content, &content)
+		bodies = append(bodies, content.Body)
+	}
+	return bodies
+}
+
+func TestSearchReturnsMatchWithContext(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, _ := writeTestEvents(t, db, "good morning", "hello world", "the quick brown fox", "jumps over", "the lazy dog")
+
+	results := doSearch(t, db, newTestQueryAPI(room, "join", "shared"), `{"search_categories": {"room_events": {
+		"search_term": "fox",
+		"event_context": {"before_limit": 1, "after_limit": 2}
+	}}}`)
+
+	if results.Count != 1 || len(results.Results) != 1 {
+		t.Fatalf("expected a single result, got %d: %+v", results.Count, results.Results)
+	}
+	result := results.Results[0]
+	if got := eventBodies([]gomatrixserverlib.ClientEvent{result.Result}); got[0] != "the quick brown fox" {
+		t.Errorf("expected the matching event, got %q", got[0])
+	}
+	if result.Context == nil {
+		t.Fatalf("expected context for the result")
+	}
+	if got := eventBodies(result.Context.EventsBefore); len(got) != 1 || got[0] != "hello world" {
+		t.Errorf("expected one event before, got %v", got)
+	}
+	if got := eventBodies(result.Context.EventsAfter); len(got) != 2 || got[0] != "jumps over" || got[1] != "the lazy dog" {
+		t.Errorf("expected two events after, got %v", got)
+	}
+	if len(results.Highlights) != 1 || results.Highlights[0] != "fox" {
+		t.Errorf("expected 'fox' to be highlighted, got %v", results.Highlights)
+	}
+}
+
+func TestSearchPagination(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, _ := writeTestEvents(t, db, "cat one", "dog", "cat two", "cat three")
+	queryAPI := newTestQueryAPI(room, "join", "shared")
+
+	first := doSearch(t, db, queryAPI, `{"search_categories": {"room_events": {
+		"search_term": "cat", "order_by": "recent", "filter": {"limit": 2}
+	}}}`)
+	if first.Count != 3 || first.NextBatch == "" {
+		t.Fatalf("expected 3 results and a next_batch, got %d and %q", first.Count, first.NextBatch)
+	}
+	if got := eventBodies([]gomatrixserverlib.ClientEvent{first.Results[0].Result, first.Results[1].Result}); got[0] != "cat three" || got[1] != "cat two" {
+		t.Errorf("expected the most recent results first, got %v", got)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/search?next_batch="+first.NextBatch, bytes.NewBufferString(
+		`{"search_categories": {"room_events": {"search_term": "cat", "order_by": "recent", "filter": {"limit": 2}}}}`,
+	))
+	res := Search(req, &authtypes.Device{UserID: testUserID}, db, queryAPI)
+	second := res.JSON.(searchResponse).SearchCategories.RoomEvents
+	if len(second.Results) != 1 || second.NextBatch != "" {
+		t.Fatalf("expected the last result and no next_batch, got %d and %q", len(second.Results), second.NextBatch)
+	}
+	if got := eventBodies([]gomatrixserverlib.ClientEvent{second.Results[0].Result}); got[0] != "cat one" {
+		t.Errorf("expected the oldest result on the second page, got %v", got)
+	}
+}
+
+func TestSearchLeavesOutEventsTheUserMayNotSee(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, _ := writeTestEvents(t, db, "the secret fox")
+
+	// Alice had left the room when the message was sent, and only joined
+	// members may see it.
+	results := doSearch(t, db, newTestQueryAPI(room, "leave", "joined"), `{"search_categories": {"room_events": {
+		"search_term": "fox"
+	}}}`)
+	if len(results.Results) != 0 || results.Count != 0 {
+		t.Errorf("expected no results, got %d: %+v", results.Count, results.Results)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultThreadsLimit = 5
+	maxThreadsLimit     = 100
+)
+
+type threadsResponse struct {
+	Chunk     []gomatrixserverlib.ClientEvent `json:"chunk"`
+	NextBatch string                          `json:"next_batch,omitempty"`
+}
+
+// Threads implements GET /rooms/{roomID}/threads
+// See: https://github.com/matrix-org/matrix-doc/pull/3440
+// The roots of the threads in the room are returned most recently active
+// first, with their thread summaries bundled. With include=participated only
+// the threads that the user started or replied to are returned.
+func Threads(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	queryAPI api.RoomserverQueryAPI, roomID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	query := req.URL.Query()
+	var participant string
+	switch query.Get("include") {
+	case "", "all":
+	case "participated":
+		participant = device.UserID
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("include must be all or participated"),
+		}
+	}
+	limit := defaultThreadsLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+	}
+	if limit > maxThreadsLimit {
+		limit = maxThreadsLimit
+	}
+	latest, err := db.SyncStreamPosition(ctx)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.SyncStreamPosition failed")
+		return jsonerror.InternalServerError()
+	}
+	// The threads returned were last active before from.
+	from, resErr := streamPositionParam(req, "from", latest+1)
+	if resErr != nil {
+		return *resErr
+	}
+
+	threads, err := db.Threads(ctx, roomID, participant, from, limit)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.Threads failed")
+		return jsonerror.InternalServerError()
+	}
+	res := threadsResponse{Chunk: []gomatrixserverlib.ClientEvent{}}
+	if len(threads) == limit {
+		res.NextBatch = types.NewPaginationTokenFromTypeAndPosition(
+			types.PaginationTokenTypeStream, threads[len(threads)-1].LatestPosition, 0,
+		).String()
+	}
+	if len(threads) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+	rootIDs := make([]string, len(threads))
+	for i, thread := range threads {
+		rootIDs[i] = thread.RootID
+	}
+	// The roots are looked up by ID, which loses the order of the threads.
+	roots, err := db.StreamEvents(ctx, rootIDs)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.StreamEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	var membershipRes api.QueryMembershipForUserResponse
+	err = queryAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &membershipRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	visible, err := sync.VisibleEvents(ctx, queryAPI, device.UserID, membershipRes.IsInRoom, db.StreamEventsToEvents(device, roots))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("sync.VisibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	visibleByID := make(map[string]gomatrixserverlib.HeaderedEvent, len(visible))
+	for _, ev := range visible {
+		visibleByID[ev.EventID()] = ev
+	}
+	for _, rootID := range rootIDs {
+		// Roots which haven't been received yet are left out.
+		if ev, ok := visibleByID[rootID]; ok && ev.RoomID() == roomID {
+			res.Chunk = append(res.Chunk, gomatrixserverlib.HeaderedToClientEvent(ev, gomatrixserverlib.FormatAll))
+		}
+	}
+	if err = sync.BundleAggregations(ctx, db, device.UserID, roomID, res.Chunk); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("sync.BundleAggregations failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// writeTestThreads writes a message by bob with three threaded replies, and
+// then a message by alice with one reply, which makes her thread the most
+// recently active. It returns the two roots and the replies to bob.
+func writeTestThreads(t *testing.T, db storage.Database) (*testRoom, []gomatrixserverlib.Event, []gomatrixserverlib.Event) {
+	room, events := writeTestEvents(t, db, "alice's thread")
+	bobsRoot := room.buildAs("@bob:localhost", "m.room.message", nil, map[string]string{"msgtype": "m.text", "body": "bob's thread"})
+	room.write(bobsRoot)
+	reply := func(sender string, root gomatrixserverlib.Event) gomatrixserverlib.Event {
+		ev := room.buildAs(sender, "m.room.message", nil, map[string]interface{}{
+			"msgtype":      "m.text",
+			"body":         "reply",
+			"m.relates_to": map[string]string{"rel_type": "m.thread", "event_id": root.EventID()},
+		})
+		room.write(ev)
+		return ev
+	}
+	replies := []gomatrixserverlib.Event{
+		reply("@bob:localhost", bobsRoot),
+		reply("@carol:localhost", bobsRoot),
+		reply("@bob:localhost", bobsRoot),
+	}
+	reply("@bob:localhost", events[0])
+	return room, []gomatrixserverlib.Event{events[0], bobsRoot}, replies
+}
+
+func doThreads(t *testing.T, db storage.Database, queryAPI api.RoomserverQueryAPI, userID, query string) threadsResponse {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/v1/rooms/"+testRoomID+"/threads?"+query, nil)
+	res := Threads(req, &authtypes.Device{UserID: userID}, db, queryAPI, testRoomID)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %+v", res.Code, res.JSON)
+	}
+	return res.JSON.(threadsResponse)
+}
+
+func threadRootIDs(res threadsResponse) []string {
+	eventIDs := []string{}
+	for _, ev := range res.Chunk {
+		eventIDs = append(eventIDs, ev.EventID)
+	}
+	return eventIDs
+}
+
+func TestThreadsList(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, roots, _ := writeTestThreads(t, db)
+	// Only alice has a membership in the test state, so the history is made
+	// readable by everyone for the other users.
+	queryAPI := newTestQueryAPI(room, gomatrixserverlib.Join, "world_readable")
+
+	res := doThreads(t, db, queryAPI, testUserID, "")
+	if got, want := threadRootIDs(res), []string{roots[0].EventID(), roots[1].EventID()}; !equalStrings(got, want) {
+		t.Errorf("expected threads %v, got %v", want, got)
+	}
+
+	res = doThreads(t, db, queryAPI, testUserID, "limit=1")
+	if got, want := threadRootIDs(res), []string{roots[0].EventID()}; !equalStrings(got, want) || res.NextBatch == "" {
+		t.Fatalf("expected threads %v and a next batch, got %v and %q", want, got, res.NextBatch)
+	}
+	res = doThreads(t, db, queryAPI, testUserID, "limit=1&from="+res.NextBatch)
+	if got, want := threadRootIDs(res), []string{roots[1].EventID()}; !equalStrings(got, want) {
+		t.Errorf("expected threads %v on the second page, got %v", want, got)
+	}
+
+	// Alice started one thread and didn't reply to the other, while carol
+	// only replied to bob's.
+	for userID, want := range map[string][]string{
+		testUserID:         {roots[0].EventID()},
+		"@carol:localhost": {roots[1].EventID()},
+		"@bob:localhost":   {roots[0].EventID(), roots[1].EventID()},
+		"@dave:localhost":  {},
+	} {
+		res = doThreads(t, db, queryAPI, userID, "include=participated")
+		if got := threadRootIDs(res); !equalStrings(got, want) {
+			t.Errorf("expected %s to have participated in %v, got %v", userID, want, got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/v1/rooms/"+testRoomID+"/threads?include=some", nil)
+	if res := Threads(req, &authtypes.Device{UserID: testUserID}, db, queryAPI, testRoomID); res.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad include, got %d", res.Code)
+	}
+}
+
+func TestThreadsAreBundled(t *testing.T) {
+	db, cleanup := newTestDatabase(t)
+	defer cleanup()
+	room, roots, replies := writeTestThreads(t, db)
+	queryAPI := newTestQueryAPI(room, gomatrixserverlib.Join, "world_readable")
+
+	for userID, participated := range map[string]bool{testUserID: false, "@carol:localhost": true} {
+		var root *gomatrixserverlib.ClientEvent
+		res := doThreads(t, db, queryAPI, userID, "")
+		for i := range res.Chunk {
+			if res.Chunk[i].EventID == roots[1].EventID() {
+				root = &res.Chunk[i]
+			}
+		}
+		if root == nil {
+			t.Fatalf("expected bob's thread in the threads of %s, got %v", userID, threadRootIDs(res))
+		}
+		thread := bundledRelations(t, *root).Thread
+		if thread == nil {
+			t.Fatalf("expected a thread summary for %s", userID)
+		}
+		if thread.Count != 3 || thread.LatestEvent.EventID != replies[2].EventID() {
+			t.Errorf("expected three replies and the latest to be %s, got %d and %s", replies[2].EventID(), thread.Count, thread.LatestEvent.EventID)
+		}
+		if thread.CurrentUserParticipated != participated {
+			t.Errorf("expected %s to have participated: %v, got %v", userID, participated, thread.CurrentUserParticipated)
+		}
+	}
+
+	// The summary is bundled into the timeline too.
+	res := doContext(db, queryAPI, roots[1].EventID(), "0")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %+v", res.Code, res.JSON)
+	}
+	if thread := bundledRelations(t, res.JSON.(contextResponse).Event).Thread; thread == nil || thread.Count != 3 {
+		t.Errorf("expected a summary of three replies in the context, got %+v", thread)
+	}
+}
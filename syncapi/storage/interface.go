@@ -20,6 +20,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/common"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -30,19 +31,23 @@ type Database interface {
 	common.PartitionStorer
 	AllJoinedUsersInRooms(ctx context.Context) (map[string][]string, error)
 	Events(ctx context.Context, eventIDs []string) ([]gomatrixserverlib.HeaderedEvent, error)
+	StreamEvents(ctx context.Context, eventIDs []string) ([]types.StreamEvent, error)
 	WriteEvent(context.Context, *gomatrixserverlib.HeaderedEvent, []gomatrixserverlib.HeaderedEvent, []string, []string, *api.TransactionID, bool) (types.StreamPosition, error)
 	GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error)
 	GetStateEventsForRoom(ctx context.Context, roomID string, stateFilterPart *gomatrixserverlib.StateFilter) (stateEvents []gomatrixserverlib.HeaderedEvent, err error)
 	SyncPosition(ctx context.Context) (types.PaginationToken, error)
 	IncrementalSync(ctx context.Context, device authtypes.Device, fromPos, toPos types.PaginationToken, numRecentEventsPerRoom int, wantFullState bool) (*types.Response, error)
 	CompleteSync(ctx context.Context, userID string, numRecentEventsPerRoom int) (*types.Response, error)
-	GetAccountDataInRange(ctx context.Context, userID string, oldPos, newPos types.StreamPosition, accountDataFilterPart *gomatrixserverlib.EventFilter) (map[string][]string, error)
+	GetAccountDataInRange(ctx context.Context, userID string, oldPos, newPos types.StreamPosition) (map[string][]string, error)
 	UpsertAccountData(ctx context.Context, userID, roomID, dataType string) (types.StreamPosition, error)
 	AddInviteEvent(ctx context.Context, inviteEvent gomatrixserverlib.HeaderedEvent) (types.StreamPosition, error)
 	RetireInviteEvent(ctx context.Context, inviteEventID string) error
 	SetTypingTimeoutCallback(fn cache.TimeoutCallbackFn)
 	AddTypingUser(userID, roomID string, expireTime *time.Time) types.StreamPosition
 	RemoveTypingUser(userID, roomID string) types.StreamPosition
+	SetPresence(presence eduAPI.PresenceEvent) types.StreamPosition
+	GetPresenceUpdatedAfter(pos types.StreamPosition) []eduAPI.PresenceEvent
+	StoreReceipts(roomID string, receipts []eduAPI.ReceiptEvent) types.StreamPosition
 	GetEventsInRange(ctx context.Context, from, to *types.PaginationToken, roomID string, limit int, backwardOrdering bool) (events []types.StreamEvent, err error)
 	EventPositionInTopology(ctx context.Context, eventID string) (types.StreamPosition, error)
 	EventsAtTopologicalPosition(ctx context.Context, roomID string, pos types.StreamPosition) ([]types.StreamEvent, error)
@@ -50,4 +55,17 @@ type Database interface {
 	MaxTopologicalPosition(ctx context.Context, roomID string) (types.StreamPosition, error)
 	StreamEventsToEvents(device *authtypes.Device, in []types.StreamEvent) []gomatrixserverlib.HeaderedEvent
 	SyncStreamPosition(ctx context.Context) (types.StreamPosition, error)
+	RoomIDsWithMembership(ctx context.Context, userID, membership string) ([]string, error)
+	AddDeviceListChange(ctx context.Context, userID string) (types.StreamPosition, error)
+	DeviceListChangesInRange(ctx context.Context, oldPos, newPos types.StreamPosition) ([]string, error)
+	AddSendToDeviceMessage(ctx context.Context, userID, deviceID string, event types.SendToDeviceEvent) (types.StreamPosition, error)
+	SendToDeviceMessagesInRange(ctx context.Context, userID, deviceID string, oldPos, newPos types.StreamPosition, limit int) ([]types.SendToDeviceEvent, types.StreamPosition, error)
+	RemoveSendToDeviceMessages(ctx context.Context, userID, deviceID string, pos types.StreamPosition) error
+	SearchEvents(ctx context.Context, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int) ([]types.SearchResult, int, error)
+	RelatedEvents(ctx context.Context, roomID, eventID, relType, eventType string, from, to types.StreamPosition, limit int) ([]types.StreamEvent, error)
+	AnnotationCounts(ctx context.Context, roomID, eventID string) ([]types.AnnotationCount, error)
+	LatestReplacement(ctx context.Context, roomID, eventID, sender string) (*gomatrixserverlib.HeaderedEvent, error)
+	ThreadSummary(ctx context.Context, roomID, eventID, userID string) (latest *gomatrixserverlib.HeaderedEvent, count int, participated bool, err error)
+	Threads(ctx context.Context, roomID, participant string, from types.StreamPosition, limit int) ([]types.ThreadActivity, error)
+	PurgeRoom(ctx context.Context, roomID string) error
 }
@@ -0,0 +1,226 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const relationsSchema = `
+-- Stores the relations of events to other events, from their m.relates_to.
+CREATE TABLE IF NOT EXISTS syncapi_relations (
+	-- The event ID of the event with the relation.
+	event_id TEXT PRIMARY KEY,
+	-- The stream position of the event.
+	stream_pos BIGINT NOT NULL,
+	-- The room the events are in.
+	room_id TEXT NOT NULL,
+	-- The event ID of the event being related to.
+	relates_to_id TEXT NOT NULL,
+	-- The rel_type of the relation, e.g. "m.annotation".
+	rel_type TEXT NOT NULL,
+	-- The key of an m.annotation, or empty.
+	rel_key TEXT NOT NULL,
+	-- The type and sender of the event with the relation.
+	type TEXT NOT NULL,
+	sender TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_relations_relates_to_idx
+	ON syncapi_relations (room_id, relates_to_id, stream_pos);
+`
+
+const insertRelationSQL = "" +
+	"INSERT INTO syncapi_relations (event_id, stream_pos, room_id, relates_to_id, rel_type, rel_key, type, sender)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	" ON CONFLICT (event_id) DO NOTHING"
+
+const selectRelatedEventsSQL = "" +
+	"SELECT event_id FROM syncapi_relations" +
+	" WHERE room_id = $1 AND relates_to_id = $2" +
+	" AND ($3::TEXT = '' OR rel_type = $3) AND ($4::TEXT = '' OR type = $4)" +
+	" AND stream_pos < $5 AND stream_pos > $6" +
+	" ORDER BY stream_pos DESC LIMIT $7"
+
+const selectAnnotationCountsSQL = "" +
+	"SELECT type, rel_key, COUNT(*) FROM syncapi_relations" +
+	" WHERE room_id = $1 AND relates_to_id = $2 AND rel_type = 'm.annotation'" +
+	" GROUP BY type, rel_key ORDER BY COUNT(*) DESC, MIN(stream_pos) ASC"
+
+const selectLatestReplacementSQL = "" +
+	"SELECT event_id FROM syncapi_relations" +
+	" WHERE room_id = $1 AND relates_to_id = $2 AND rel_type = 'm.replace' AND sender = $3" +
+	" ORDER BY stream_pos DESC LIMIT 1"
+
+const selectThreadSummarySQL = "" +
+	"SELECT COALESCE((SELECT event_id FROM syncapi_relations" +
+	" WHERE room_id = $1 AND relates_to_id = $2 AND rel_type = 'm.thread'" +
+	" ORDER BY stream_pos DESC LIMIT 1), ''), COUNT(*)," +
+	" COALESCE(SUM(CASE WHEN sender = $3 THEN 1 ELSE 0 END), 0)" +
+	" FROM syncapi_relations WHERE room_id = $1 AND relates_to_id = $2 AND rel_type = 'm.thread'"
+
+// The threads that a user participated in are the ones they replied to or
+// started, so the senders of the roots are looked up in the events table.
+const selectThreadsSQL = "" +
+	"SELECT relates_to_id, MAX(stream_pos) FROM syncapi_relations" +
+	" WHERE room_id = $1 AND rel_type = 'm.thread'" +
+	" AND ($2::TEXT = '' OR relates_to_id IN (" +
+	"  SELECT relates_to_id FROM syncapi_relations WHERE room_id = $1 AND rel_type = 'm.thread' AND sender = $2" +
+	" ) OR relates_to_id IN (" +
+	"  SELECT event_id FROM syncapi_output_room_events WHERE room_id = $1 AND sender = $2" +
+	" ))" +
+	" GROUP BY relates_to_id HAVING MAX(stream_pos) < $3" +
+	" ORDER BY MAX(stream_pos) DESC LIMIT $4"
+
+type relationsStatements struct {
+	insertRelationStmt          *sql.Stmt
+	selectRelatedEventsStmt     *sql.Stmt
+	selectAnnotationCountsStmt  *sql.Stmt
+	selectLatestReplacementStmt *sql.Stmt
+	selectThreadSummaryStmt     *sql.Stmt
+	selectThreadsStmt           *sql.Stmt
+}
+
+func (s *relationsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(relationsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertRelationStmt, err = db.Prepare(insertRelationSQL); err != nil {
+		return
+	}
+	if s.selectRelatedEventsStmt, err = db.Prepare(selectRelatedEventsSQL); err != nil {
+		return
+	}
+	if s.selectAnnotationCountsStmt, err = db.Prepare(selectAnnotationCountsSQL); err != nil {
+		return
+	}
+	if s.selectLatestReplacementStmt, err = db.Prepare(selectLatestReplacementSQL); err != nil {
+		return
+	}
+	if s.selectThreadSummaryStmt, err = db.Prepare(selectThreadSummarySQL); err != nil {
+		return
+	}
+	if s.selectThreadsStmt, err = db.Prepare(selectThreadsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *relationsStatements) insertRelation(
+	ctx context.Context, txn *sql.Tx, ev *gomatrixserverlib.HeaderedEvent,
+	relation *types.Relation, pos types.StreamPosition,
+) error {
+	stmt := common.TxStmt(txn, s.insertRelationStmt)
+	_, err := stmt.ExecContext(
+		ctx, ev.EventID(), pos, ev.RoomID(), relation.EventID,
+		relation.RelType, relation.Key, ev.Type(), ev.Sender(),
+	)
+	return err
+}
+
+// selectRelatedEvents returns the IDs of up to limit events which relate to
+// an event, most recent first, between the given stream positions.
+func (s *relationsStatements) selectRelatedEvents(
+	ctx context.Context, roomID, eventID, relType, eventType string,
+	from, to types.StreamPosition, limit int,
+) ([]string, error) {
+	rows, err := s.selectRelatedEventsStmt.QueryContext(ctx, roomID, eventID, relType, eventType, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRelatedEvents: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var relatedID string
+		if err = rows.Scan(&relatedID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, relatedID)
+	}
+	return eventIDs, rows.Err()
+}
+
+// selectAnnotationCounts returns how many times an event has been annotated
+// with each type and key, most common first.
+func (s *relationsStatements) selectAnnotationCounts(
+	ctx context.Context, roomID, eventID string,
+) ([]types.AnnotationCount, error) {
+	rows, err := s.selectAnnotationCountsStmt.QueryContext(ctx, roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectAnnotationCounts: rows.close() failed")
+	var counts []types.AnnotationCount
+	for rows.Next() {
+		var count types.AnnotationCount
+		if err = rows.Scan(&count.Type, &count.Key, &count.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// selectLatestReplacement returns the ID of the latest event by the given
+// sender which replaces an event, or an empty string if there isn't one.
+func (s *relationsStatements) selectLatestReplacement(
+	ctx context.Context, roomID, eventID, sender string,
+) (string, error) {
+	var replacementID string
+	err := s.selectLatestReplacementStmt.QueryRowContext(ctx, roomID, eventID, sender).Scan(&replacementID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return replacementID, err
+}
+
+// selectThreadSummary returns the number of replies in the thread started by
+// an event, how many of them were sent by the given user and the ID of the
+// latest one, which is empty if there aren't any.
+func (s *relationsStatements) selectThreadSummary(
+	ctx context.Context, roomID, eventID, userID string,
+) (count, sentByUser int, latestID string, err error) {
+	err = s.selectThreadSummaryStmt.QueryRowContext(ctx, roomID, eventID, userID).Scan(&latestID, &count, &sentByUser)
+	return
+}
+
+// selectThreads returns the roots of up to limit threads in a room, with the
+// stream position of the latest reply in each, most recently active first.
+// Only the threads with activity before from are returned, and only the ones
+// that the participant took part in if it isn't empty.
+func (s *relationsStatements) selectThreads(
+	ctx context.Context, roomID, participant string, from types.StreamPosition, limit int,
+) ([]types.ThreadActivity, error) {
+	rows, err := s.selectThreadsStmt.QueryContext(ctx, roomID, participant, from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectThreads: rows.close() failed")
+	var threads []types.ThreadActivity
+	for rows.Next() {
+		var thread types.ThreadActivity
+		if err = rows.Scan(&thread.RootID, &thread.LatestPosition); err != nil {
+			return nil, err
+		}
+		threads = append(threads, thread)
+	}
+	return threads, rows.Err()
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const searchSchema = `
+-- Stores a full text index of the searchable text of room events.
+CREATE TABLE IF NOT EXISTS syncapi_search_events (
+	-- The event ID of the event.
+	event_id TEXT PRIMARY KEY,
+	-- The stream position of the event.
+	stream_pos BIGINT NOT NULL,
+	-- The room the event is in.
+	room_id TEXT NOT NULL,
+	-- The key the text was taken from, e.g. "content.body".
+	key TEXT NOT NULL,
+	-- The searchable text of the event.
+	vector TSVECTOR NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_search_events_vector_idx
+	ON syncapi_search_events USING GIN (vector);
+`
+
+const insertSearchEventSQL = "" +
+	"INSERT INTO syncapi_search_events (event_id, stream_pos, room_id, key, vector)" +
+	" VALUES ($1, $2, $3, $4, to_tsvector('english', $5))" +
+	" ON CONFLICT DO NOTHING"
+
+const searchEventsByRankSQL = "" +
+	"SELECT event_id, stream_pos, ts_rank_cd(vector, query) AS rank" +
+	" FROM syncapi_search_events, plainto_tsquery('english', $1) query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" ORDER BY rank DESC, stream_pos DESC LIMIT $4 OFFSET $5"
+
+const searchEventsByRecentSQL = "" +
+	"SELECT event_id, stream_pos, ts_rank_cd(vector, query) AS rank" +
+	" FROM syncapi_search_events, plainto_tsquery('english', $1) query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" ORDER BY stream_pos DESC LIMIT $4 OFFSET $5"
+
+const countSearchEventsSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_search_events, plainto_tsquery('english', $1) query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)"
+
+type searchStatements struct {
+	insertSearchEventStmt    *sql.Stmt
+	searchEventsByRankStmt   *sql.Stmt
+	searchEventsByRecentStmt *sql.Stmt
+	countSearchEventsStmt    *sql.Stmt
+}
+
+func (s *searchStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(searchSchema)
+	if err != nil {
+		return
+	}
+	if s.insertSearchEventStmt, err = db.Prepare(insertSearchEventSQL); err != nil {
+		return
+	}
+	if s.searchEventsByRankStmt, err = db.Prepare(searchEventsByRankSQL); err != nil {
+		return
+	}
+	if s.searchEventsByRecentStmt, err = db.Prepare(searchEventsByRecentSQL); err != nil {
+		return
+	}
+	if s.countSearchEventsStmt, err = db.Prepare(countSearchEventsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *searchStatements) insertSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string, pos types.StreamPosition,
+	roomID, key, text string,
+) error {
+	stmt := common.TxStmt(txn, s.insertSearchEventStmt)
+	_, err := stmt.ExecContext(ctx, eventID, pos, roomID, key, text)
+	return err
+}
+
+func (s *searchStatements) searchEvents(
+	ctx context.Context, searchTerm string, roomIDs, keys []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	var count int
+	err := s.countSearchEventsStmt.QueryRowContext(
+		ctx, searchTerm, pq.StringArray(roomIDs), pq.StringArray(keys),
+	).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stmt := s.searchEventsByRecentStmt
+	if orderByRank {
+		stmt = s.searchEventsByRankStmt
+	}
+	rows, err := stmt.QueryContext(
+		ctx, searchTerm, pq.StringArray(roomIDs), pq.StringArray(keys), limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "searchEvents: rows.close() failed")
+
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.StreamPosition, &result.Rank); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const sendToDeviceSchema = `
+-- Stores the messages sent to devices which haven't been acknowledged by the
+-- devices yet. The ID is the send-to-device position of the message.
+CREATE TABLE IF NOT EXISTS syncapi_send_to_device (
+	id BIGSERIAL PRIMARY KEY,
+	-- The Matrix user ID of the user the message is for
+	user_id TEXT NOT NULL,
+	-- The ID of the device the message is for
+	device_id TEXT NOT NULL,
+	-- The JSON of the message, with its sender, type and content
+	content TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_send_to_device_user_id_device_id_idx ON syncapi_send_to_device(user_id, device_id);
+`
+
+const insertSendToDeviceMessageSQL = "" +
+	"INSERT INTO syncapi_send_to_device (user_id, device_id, content) VALUES ($1, $2, $3) RETURNING id"
+
+const selectSendToDeviceMessagesInRangeSQL = "" +
+	"SELECT id, content FROM syncapi_send_to_device" +
+	" WHERE user_id = $1 AND device_id = $2 AND id > $3 AND id <= $4" +
+	" ORDER BY id ASC LIMIT $5"
+
+const deleteSendToDeviceMessagesSQL = "" +
+	"DELETE FROM syncapi_send_to_device WHERE user_id = $1 AND device_id = $2 AND id <= $3"
+
+// The highest position that has been given to a message, even if the message
+// has been deleted since, so that the position never goes backwards.
+const selectMaxSendToDeviceIDSQL = "" +
+	"SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM syncapi_send_to_device_id_seq"
+
+type sendToDeviceStatements struct {
+	insertSendToDeviceMessageStmt         *sql.Stmt
+	selectSendToDeviceMessagesInRangeStmt *sql.Stmt
+	deleteSendToDeviceMessagesStmt        *sql.Stmt
+	selectMaxSendToDeviceIDStmt           *sql.Stmt
+}
+
+func (s *sendToDeviceStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(sendToDeviceSchema)
+	if err != nil {
+		return
+	}
+	if s.insertSendToDeviceMessageStmt, err = db.Prepare(insertSendToDeviceMessageSQL); err != nil {
+		return
+	}
+	if s.selectSendToDeviceMessagesInRangeStmt, err = db.Prepare(selectSendToDeviceMessagesInRangeSQL); err != nil {
+		return
+	}
+	if s.deleteSendToDeviceMessagesStmt, err = db.Prepare(deleteSendToDeviceMessagesSQL); err != nil {
+		return
+	}
+	if s.selectMaxSendToDeviceIDStmt, err = db.Prepare(selectMaxSendToDeviceIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *sendToDeviceStatements) insertSendToDeviceMessage(
+	ctx context.Context, userID, deviceID string, event types.SendToDeviceEvent,
+) (pos types.StreamPosition, err error) {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	err = s.insertSendToDeviceMessageStmt.QueryRowContext(ctx, userID, deviceID, string(content)).Scan(&pos)
+	return
+}
+
+// selectSendToDeviceMessagesInRange returns up to limit of the messages for a
+// device after the old position and up to and including the new position, in
+// the order that they were sent in. The position of the last message is
+// returned with them.
+func (s *sendToDeviceStatements) selectSendToDeviceMessagesInRange(
+	ctx context.Context, userID, deviceID string, oldPos, newPos types.StreamPosition, limit int,
+) (events []types.SendToDeviceEvent, lastPos types.StreamPosition, err error) {
+	rows, err := s.selectSendToDeviceMessagesInRangeStmt.QueryContext(ctx, userID, deviceID, oldPos, newPos, limit)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectSendToDeviceMessagesInRange: rows.close() failed")
+
+	for rows.Next() {
+		var content string
+		var event types.SendToDeviceEvent
+		if err = rows.Scan(&lastPos, &content); err != nil {
+			return
+		}
+		if err = json.Unmarshal([]byte(content), &event); err != nil {
+			return
+		}
+		events = append(events, event)
+	}
+	return events, lastPos, rows.Err()
+}
+
+// deleteSendToDeviceMessages deletes the messages for a device up to and
+// including the given position.
+func (s *sendToDeviceStatements) deleteSendToDeviceMessages(
+	ctx context.Context, userID, deviceID string, pos types.StreamPosition,
+) error {
+	_, err := s.deleteSendToDeviceMessagesStmt.ExecContext(ctx, userID, deviceID, pos)
+	return err
+}
+
+func (s *sendToDeviceStatements) selectMaxSendToDeviceID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	stmt := common.TxStmt(txn, s.selectMaxSendToDeviceIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&id)
+	if err == sql.ErrNoRows {
+		// No message has been sent yet.
+		return 0, nil
+	}
+	return
+}
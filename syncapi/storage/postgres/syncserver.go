@@ -20,6 +20,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -31,6 +32,7 @@ import (
 	// Import the postgres database driver.
 	_ "github.com/lib/pq"
 	"github.com/matrix-org/dendrite/common"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -57,13 +59,23 @@ type SyncServerDatasource struct {
 	eduCache            *cache.EDUCache
 	topology            outputRoomEventsTopologyStatements
 	backwardExtremities backwardExtremitiesStatements
+	search              searchStatements
+	relations           relationsStatements
+	deviceListChanges   deviceListChangesStatements
+	sendToDevice        sendToDeviceStatements
+	purge               purgeStatements
 }
 
 // NewSyncServerDatasource creates a new sync server database
-func NewSyncServerDatasource(dbDataSourceName string) (*SyncServerDatasource, error) {
+func NewSyncServerDatasource(dbDataSourceName string, dbProperties sqlutil.DbProperties) (*SyncServerDatasource, error) {
 	var d SyncServerDatasource
 	var err error
-	if d.db, err = sqlutil.Open("postgres", dbDataSourceName); err != nil {
+	if d.db, err = sqlutil.Open("postgres", dbDataSourceName, dbProperties); err != nil {
+		return nil, err
+	}
+	migrator := common.NewMigrator(d.db, "syncapi")
+	migrator.AddMigrations(common.BaselineMigration)
+	if err = migrator.Up(context.Background()); err != nil {
 		return nil, err
 	}
 	if err = d.PartitionOffsetStatements.Prepare(d.db, "syncapi"); err != nil {
@@ -87,10 +99,161 @@ func NewSyncServerDatasource(dbDataSourceName string) (*SyncServerDatasource, er
 	if err := d.backwardExtremities.prepare(d.db); err != nil {
 		return nil, err
 	}
+	if err := d.search.prepare(d.db); err != nil {
+		return nil, err
+	}
+	if err := d.relations.prepare(d.db); err != nil {
+		return nil, err
+	}
+	if err := d.deviceListChanges.prepare(d.db); err != nil {
+		return nil, err
+	}
+	if err := d.sendToDevice.prepare(d.db); err != nil {
+		return nil, err
+	}
+	if err := d.purge.prepare(d.db); err != nil {
+		return nil, err
+	}
 	d.eduCache = cache.New()
 	return &d, nil
 }
 
+// Ping checks that the database can be reached.
+func (d *SyncServerDatasource) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+// RoomIDsWithMembership returns the IDs of the rooms in which the user has
+// the given membership.
+func (d *SyncServerDatasource) RoomIDsWithMembership(
+	ctx context.Context, userID, membership string,
+) ([]string, error) {
+	return d.roomstate.selectRoomIDsWithMembership(ctx, nil, userID, membership)
+}
+
+// AddDeviceListChange records that the devices of the user changed, and
+// returns the device list position of the change.
+func (d *SyncServerDatasource) AddDeviceListChange(
+	ctx context.Context, userID string,
+) (types.StreamPosition, error) {
+	return d.deviceListChanges.insertDeviceListChange(ctx, userID)
+}
+
+// AddSendToDeviceMessage stores a message for a device until the device
+// acknowledges it, and returns the send-to-device position of the message.
+func (d *SyncServerDatasource) AddSendToDeviceMessage(
+	ctx context.Context, userID, deviceID string, event types.SendToDeviceEvent,
+) (types.StreamPosition, error) {
+	return d.sendToDevice.insertSendToDeviceMessage(ctx, userID, deviceID, event)
+}
+
+// SendToDeviceMessagesInRange returns up to limit of the messages for a device
+// after the old position and up to and including the new position, with the
+// position of the last message returned.
+func (d *SyncServerDatasource) SendToDeviceMessagesInRange(
+	ctx context.Context, userID, deviceID string, oldPos, newPos types.StreamPosition, limit int,
+) ([]types.SendToDeviceEvent, types.StreamPosition, error) {
+	return d.sendToDevice.selectSendToDeviceMessagesInRange(ctx, userID, deviceID, oldPos, newPos, limit)
+}
+
+// RemoveSendToDeviceMessages deletes the messages for a device up to and
+// including the given position, once the device has acknowledged them.
+func (d *SyncServerDatasource) RemoveSendToDeviceMessages(
+	ctx context.Context, userID, deviceID string, pos types.StreamPosition,
+) error {
+	return d.sendToDevice.deleteSendToDeviceMessages(ctx, userID, deviceID, pos)
+}
+
+// DeviceListChangesInRange returns the users whose devices changed after the
+// old device list position and up to and including the new one.
+func (d *SyncServerDatasource) DeviceListChangesInRange(
+	ctx context.Context, oldPos, newPos types.StreamPosition,
+) ([]string, error) {
+	return d.deviceListChanges.selectDeviceListChangesInRange(ctx, oldPos, newPos)
+}
+
+// SearchEvents returns the events in the given rooms whose text under one of
+// the given keys matches the search term, along with the total number of
+// matching events. Results are ordered by rank if orderByRank is true, and
+// by recency otherwise.
+func (d *SyncServerDatasource) SearchEvents(
+	ctx context.Context, searchTerm string, roomIDs, keys []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	return d.search.searchEvents(ctx, searchTerm, roomIDs, keys, orderByRank, limit, offset)
+}
+
+// RelatedEvents returns up to limit events which relate to the given event,
+// most recent first, with stream positions before from and after to. The
+// relation type and the event type are only matched if they aren't empty.
+func (d *SyncServerDatasource) RelatedEvents(
+	ctx context.Context, roomID, eventID, relType, eventType string,
+	from, to types.StreamPosition, limit int,
+) ([]types.StreamEvent, error) {
+	eventIDs, err := d.relations.selectRelatedEvents(ctx, roomID, eventID, relType, eventType, from, to, limit)
+	if err != nil || len(eventIDs) == 0 {
+		return nil, err
+	}
+	events, err := d.events.selectEvents(ctx, nil, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].StreamPosition > events[j].StreamPosition
+	})
+	return events, nil
+}
+
+// AnnotationCounts returns how many times an event has been annotated with
+// each type and key, most common first.
+func (d *SyncServerDatasource) AnnotationCounts(
+	ctx context.Context, roomID, eventID string,
+) ([]types.AnnotationCount, error) {
+	return d.relations.selectAnnotationCounts(ctx, roomID, eventID)
+}
+
+// LatestReplacement returns the latest event by the given sender which
+// replaces an event, or nil if they haven't replaced it.
+func (d *SyncServerDatasource) LatestReplacement(
+	ctx context.Context, roomID, eventID, sender string,
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	replacementID, err := d.relations.selectLatestReplacement(ctx, roomID, eventID, sender)
+	if err != nil || replacementID == "" {
+		return nil, err
+	}
+	events, err := d.events.selectEvents(ctx, nil, []string{replacementID})
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return &events[0].HeaderedEvent, nil
+}
+
+// ThreadSummary returns the latest reply in the thread started by an event
+// and the number of replies in it, and whether the given user replied to it.
+// The latest reply is nil if there aren't any.
+func (d *SyncServerDatasource) ThreadSummary(
+	ctx context.Context, roomID, eventID, userID string,
+) (*gomatrixserverlib.HeaderedEvent, int, bool, error) {
+	count, sentByUser, latestID, err := d.relations.selectThreadSummary(ctx, roomID, eventID, userID)
+	if err != nil || latestID == "" {
+		return nil, 0, false, err
+	}
+	events, err := d.events.selectEvents(ctx, nil, []string{latestID})
+	if err != nil || len(events) == 0 {
+		return nil, 0, false, err
+	}
+	return &events[0].HeaderedEvent, count, sentByUser > 0, nil
+}
+
+// Threads returns the roots of up to limit threads in a room, most recently
+// active first, whose latest replies are before from. If participant isn't
+// empty, only the threads they started or replied to are returned.
+func (d *SyncServerDatasource) Threads(
+	ctx context.Context, roomID, participant string, from types.StreamPosition, limit int,
+) ([]types.ThreadActivity, error) {
+	return d.relations.selectThreads(ctx, roomID, participant, from, limit)
+}
+
 // AllJoinedUsersInRooms returns a map of room ID to a list of all joined user IDs.
 func (d *SyncServerDatasource) AllJoinedUsersInRooms(ctx context.Context) (map[string][]string, error) {
 	return d.roomstate.selectJoinedUsers(ctx)
@@ -112,6 +275,12 @@ func (d *SyncServerDatasource) Events(ctx context.Context, eventIDs []string) ([
 	return d.StreamEventsToEvents(nil, streamEvents), nil
 }
 
+// StreamEvents returns the events with the given IDs along with their
+// positions in the stream. Events that aren't found are left out.
+func (d *SyncServerDatasource) StreamEvents(ctx context.Context, eventIDs []string) ([]types.StreamEvent, error) {
+	return d.events.selectEvents(ctx, nil, eventIDs)
+}
+
 // handleBackwardExtremities adds this event as a backwards extremity if and only if we do not have all of
 // the events listed in the event's 'prev_events'. This function also updates the backwards extremities table
 // to account for the fact that the given event is no longer a backwards extremity, but may be marked as such.
@@ -174,6 +343,18 @@ func (d *SyncServerDatasource) WriteEvent(
 			return err
 		}
 
+		if key, text := types.SearchableText(ev); key != "" {
+			if err = d.search.insertSearchEvent(ctx, txn, ev.EventID(), pos, ev.RoomID(), key, text); err != nil {
+				return err
+			}
+		}
+
+		if relation := types.EventRelation(ev); relation != nil {
+			if err = d.relations.insertRelation(ctx, txn, ev, relation, pos); err != nil {
+				return err
+			}
+		}
+
 		if len(addStateEvents) == 0 && len(removeStateEventIDs) == 0 {
 			// Nothing to do, the event may have just been a message event.
 			return nil
@@ -397,6 +578,16 @@ func (d *SyncServerDatasource) syncPositionTx(
 	}
 	sp.PDUPosition = types.StreamPosition(maxEventID)
 	sp.EDUTypingPosition = types.StreamPosition(d.eduCache.GetLatestSyncPosition())
+	maxDeviceListChangeID, err := d.deviceListChanges.selectMaxDeviceListChangeID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	sp.DeviceListPosition = types.StreamPosition(maxDeviceListChangeID)
+	maxSendToDeviceID, err := d.sendToDevice.selectMaxSendToDeviceID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	sp.SendToDevicePosition = types.StreamPosition(maxSendToDeviceID)
 	return
 }
 
@@ -492,6 +683,50 @@ func (d *SyncServerDatasource) addTypingDeltaToResponse(
 	return nil
 }
 
+// addReceiptDeltaToResponse adds the receipts sent in the joined rooms since
+// the specified position to a sync response.
+func (d *SyncServerDatasource) addReceiptDeltaToResponse(
+	since types.PaginationToken,
+	joinedRoomIDs []string,
+	res *types.Response,
+) error {
+	type receiptTS struct {
+		TS gomatrixserverlib.Timestamp `json:"ts"`
+	}
+	for _, roomID := range joinedRoomIDs {
+		receipts := d.eduCache.GetReceiptsUpdatedAfter(roomID, int64(since.EDUTypingPosition))
+		if len(receipts) == 0 {
+			continue
+		}
+		// Receipts are grouped by event ID, then by type and then by user.
+		content := make(map[string]map[string]map[string]receiptTS)
+		for _, receipt := range receipts {
+			if content[receipt.EventID] == nil {
+				content[receipt.EventID] = make(map[string]map[string]receiptTS)
+			}
+			if content[receipt.EventID][receipt.Type] == nil {
+				content[receipt.EventID][receipt.Type] = make(map[string]receiptTS)
+			}
+			content[receipt.EventID][receipt.Type][receipt.UserID] = receiptTS{TS: receipt.Timestamp}
+		}
+		ev := gomatrixserverlib.ClientEvent{
+			Type: "m.receipt",
+		}
+		var err error
+		if ev.Content, err = json.Marshal(content); err != nil {
+			return err
+		}
+
+		jr, ok := res.Rooms.Join[roomID]
+		if !ok {
+			jr = *types.NewJoinResponse()
+		}
+		jr.Ephemeral.Events = append(jr.Ephemeral.Events, ev)
+		res.Rooms.Join[roomID] = jr
+	}
+	return nil
+}
+
 // addEDUDeltaToResponse adds updates for EDUs of each type since fromPos if
 // the positions of that type are not equal in fromPos and toPos.
 func (d *SyncServerDatasource) addEDUDeltaToResponse(
@@ -504,6 +739,12 @@ func (d *SyncServerDatasource) addEDUDeltaToResponse(
 		err = d.addTypingDeltaToResponse(
 			fromPos, joinedRoomIDs, res,
 		)
+		if err != nil {
+			return
+		}
+		err = d.addReceiptDeltaToResponse(
+			fromPos, joinedRoomIDs, res,
+		)
 	}
 
 	return
@@ -682,9 +923,8 @@ var txReadOnlySnapshot = sql.TxOptions{
 // If there was an issue with the retrieval, returns an error
 func (d *SyncServerDatasource) GetAccountDataInRange(
 	ctx context.Context, userID string, oldPos, newPos types.StreamPosition,
-	accountDataFilterPart *gomatrixserverlib.EventFilter,
 ) (map[string][]string, error) {
-	return d.accountData.selectAccountDataInRange(ctx, userID, oldPos, newPos, accountDataFilterPart)
+	return d.accountData.selectAccountDataInRange(ctx, userID, oldPos, newPos)
 }
 
 // UpsertAccountData keeps track of new or updated account data, by saving the type
@@ -719,6 +959,16 @@ func (d *SyncServerDatasource) RetireInviteEvent(
 	return err
 }
 
+// PurgeRoom deletes the events, state, invites, search index and relations
+// of a room which has been purged from the roomserver. The membership events
+// of the room are kept so that the users who were in it are told that they
+// left.
+func (d *SyncServerDatasource) PurgeRoom(ctx context.Context, roomID string) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.purge.purgeRoom(ctx, txn, roomID)
+	})
+}
+
 func (d *SyncServerDatasource) SetTypingTimeoutCallback(fn cache.TimeoutCallbackFn) {
 	d.eduCache.SetTimeoutCallback(fn)
 }
@@ -739,6 +989,30 @@ func (d *SyncServerDatasource) RemoveTypingUser(
 	return types.StreamPosition(d.eduCache.RemoveUser(userID, roomID))
 }
 
+// SetPresence stores the latest presence of a user in the EDU cache.
+// Returns the newly calculated sync position for EDUs.
+func (d *SyncServerDatasource) SetPresence(
+	presence eduAPI.PresenceEvent,
+) types.StreamPosition {
+	return types.StreamPosition(d.eduCache.SetPresence(presence))
+}
+
+// StoreReceipts stores the latest receipts sent in a room in the EDU cache.
+// Returns the newly calculated sync position for EDUs.
+func (d *SyncServerDatasource) StoreReceipts(
+	roomID string, receipts []eduAPI.ReceiptEvent,
+) types.StreamPosition {
+	return types.StreamPosition(d.eduCache.StoreReceipts(roomID, receipts))
+}
+
+// GetPresenceUpdatedAfter returns the presence of every user whose presence
+// was updated after the given EDU sync position.
+func (d *SyncServerDatasource) GetPresenceUpdatedAfter(
+	pos types.StreamPosition,
+) []eduAPI.PresenceEvent {
+	return d.eduCache.GetPresenceUpdatedAfter(int64(pos))
+}
+
 func (d *SyncServerDatasource) addInvitesToResponse(
 	ctx context.Context, txn *sql.Tx,
 	userID string,
@@ -22,7 +22,6 @@ import (
 	"github.com/matrix-org/dendrite/common"
 
 	"github.com/matrix-org/dendrite/syncapi/types"
-	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const accountDataSchema = `
@@ -89,7 +88,6 @@ func (s *accountDataStatements) selectAccountDataInRange(
 	ctx context.Context,
 	userID string,
 	oldPos, newPos types.StreamPosition,
-	accountDataFilterPart *gomatrixserverlib.EventFilter,
 ) (data map[string][]string, err error) {
 	data = make(map[string][]string)
 
@@ -106,8 +104,6 @@ func (s *accountDataStatements) selectAccountDataInRange(
 	}
 	defer common.CloseAndLogIfError(ctx, rows, "selectAccountDataInRange: rows.close() failed")
 
-	var entries int
-
 	for rows.Next() {
 		var dataType string
 		var roomID string
@@ -116,31 +112,11 @@ func (s *accountDataStatements) selectAccountDataInRange(
 			return
 		}
 
-		// check if we should add this by looking at the filter.
-		// It would be nice if we could do this in SQL-land, but the mix of variadic
-		// and positional parameters makes the query annoyingly hard to do, it's easier
-		// and clearer to do it in Go-land. If there are no filters for [not]types then
-		// this gets skipped.
-		for _, includeType := range accountDataFilterPart.Types {
-			if includeType != dataType { // TODO: wildcard support
-				continue
-			}
-		}
-		for _, excludeType := range accountDataFilterPart.NotTypes {
-			if excludeType == dataType { // TODO: wildcard support
-				continue
-			}
-		}
-
 		if len(data[roomID]) > 0 {
 			data[roomID] = append(data[roomID], dataType)
 		} else {
 			data[roomID] = []string{dataType}
 		}
-		entries++
-		if entries >= accountDataFilterPart.Limit {
-			break
-		}
 	}
 
 	return data, nil
@@ -0,0 +1,109 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const deviceListChangesSchema = `
+-- Stores the users whose devices or device keys changed, in the order that
+-- they changed in. The ID is the device list position of the change.
+CREATE TABLE IF NOT EXISTS syncapi_device_list_changes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- The Matrix user ID of the user whose devices changed
+	user_id TEXT NOT NULL
+);
+`
+
+const insertDeviceListChangeSQL = "" +
+	"INSERT INTO syncapi_device_list_changes (user_id) VALUES ($1)"
+
+const selectDeviceListChangesInRangeSQL = "" +
+	"SELECT DISTINCT user_id FROM syncapi_device_list_changes WHERE id > $1 AND id <= $2"
+
+const selectMaxDeviceListChangeIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_device_list_changes"
+
+type deviceListChangesStatements struct {
+	insertDeviceListChangeStmt         *sql.Stmt
+	selectDeviceListChangesInRangeStmt *sql.Stmt
+	selectMaxDeviceListChangeIDStmt    *sql.Stmt
+}
+
+func (s *deviceListChangesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(deviceListChangesSchema)
+	if err != nil {
+		return
+	}
+	if s.insertDeviceListChangeStmt, err = db.Prepare(insertDeviceListChangeSQL); err != nil {
+		return
+	}
+	if s.selectDeviceListChangesInRangeStmt, err = db.Prepare(selectDeviceListChangesInRangeSQL); err != nil {
+		return
+	}
+	if s.selectMaxDeviceListChangeIDStmt, err = db.Prepare(selectMaxDeviceListChangeIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *deviceListChangesStatements) insertDeviceListChange(
+	ctx context.Context, userID string,
+) (pos types.StreamPosition, err error) {
+	res, err := s.insertDeviceListChangeStmt.ExecContext(ctx, userID)
+	if err != nil {
+		return
+	}
+	id, err := res.LastInsertId()
+	return types.StreamPosition(id), err
+}
+
+// selectDeviceListChangesInRange returns the users whose devices changed after
+// the old position and up to and including the new position.
+func (s *deviceListChangesStatements) selectDeviceListChangesInRange(
+	ctx context.Context, oldPos, newPos types.StreamPosition,
+) (userIDs []string, err error) {
+	rows, err := s.selectDeviceListChangesInRangeStmt.QueryContext(ctx, oldPos, newPos)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectDeviceListChangesInRange: rows.close() failed")
+
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			return
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+func (s *deviceListChangesStatements) selectMaxDeviceListChangeID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := common.TxStmt(txn, s.selectMaxDeviceListChangeIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+// The membership events of a purged room are kept, so that the clients of
+// the users who were removed from it still learn that they have left.
+const deleteRoomEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE room_id = $1 AND type != 'm.room.member'"
+
+const deleteRoomStateSQL = "" +
+	"DELETE FROM syncapi_current_room_state WHERE room_id = $1 AND type != 'm.room.member'"
+
+const deleteRoomTopologySQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
+
+const deleteRoomBackwardExtremitiesSQL = "" +
+	"DELETE FROM syncapi_backward_extremities WHERE room_id = $1"
+
+const deleteRoomInvitesSQL = "" +
+	"DELETE FROM syncapi_invite_events WHERE room_id = $1"
+
+const deleteRoomRelationsSQL = "" +
+	"DELETE FROM syncapi_relations WHERE room_id = $1"
+
+type purgeStatements struct {
+	deleteRoomStmts []*sql.Stmt
+}
+
+func (s *purgeStatements) prepare(db *sql.DB) error {
+	for _, query := range []string{
+		deleteRoomEventsSQL,
+		deleteRoomStateSQL,
+		deleteRoomTopologySQL,
+		deleteRoomBackwardExtremitiesSQL,
+		deleteRoomInvitesSQL,
+		deleteRoomRelationsSQL,
+	} {
+		stmt, err := db.Prepare(query)
+		if err != nil {
+			return err
+		}
+		s.deleteRoomStmts = append(s.deleteRoomStmts, stmt)
+	}
+	return nil
+}
+
+// purgeRoom deletes what is stored about a room, apart from its membership
+// events.
+func (s *purgeStatements) purgeRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	for _, stmt := range s.deleteRoomStmts {
+		if _, err := common.TxStmt(txn, stmt).ExecContext(ctx, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
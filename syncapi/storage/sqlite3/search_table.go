@@ -0,0 +1,194 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/sirupsen/logrus"
+)
+
+// The search index is an FTS5 table. FTS5 is only available when go-sqlite3
+// is built with the sqlite_fts5 tag, so without it nothing is indexed and
+// searching fails with types.ErrSearchUnavailable.
+const searchSchema = `
+-- Stores a full text index of the searchable text of room events.
+CREATE VIRTUAL TABLE IF NOT EXISTS syncapi_search_events USING fts5(
+	event_id UNINDEXED, stream_pos UNINDEXED, room_id UNINDEXED, key UNINDEXED, value
+);
+`
+
+const selectFTS5AvailableSQL = "" +
+	"SELECT sqlite_compileoption_used('ENABLE_FTS5')"
+
+// FTS tables have no unique constraints, so an event which is written again
+// is only indexed if it isn't already.
+const insertSearchEventSQL = "" +
+	"INSERT INTO syncapi_search_events (event_id, stream_pos, room_id, key, value)" +
+	" SELECT $1, $2, $3, $4, $5" +
+	" WHERE NOT EXISTS (SELECT 1 FROM syncapi_search_events WHERE event_id = $1)"
+
+// The room IDs and keys are expanded into as many parameters as are needed
+// when searching, and the limit and offset are numbered after them.
+// bm25() is lower for better matches.
+const searchEventsByRankSQL = "" +
+	"SELECT event_id, stream_pos, -bm25(syncapi_search_events) AS rank" +
+	" FROM syncapi_search_events WHERE syncapi_search_events MATCH $1" +
+	" AND room_id IN ($2) AND key IN ($3)" +
+	" ORDER BY rank DESC, stream_pos DESC LIMIT %s OFFSET %s"
+
+const searchEventsByRecentSQL = "" +
+	"SELECT event_id, stream_pos, -bm25(syncapi_search_events) AS rank" +
+	" FROM syncapi_search_events WHERE syncapi_search_events MATCH $1" +
+	" AND room_id IN ($2) AND key IN ($3)" +
+	" ORDER BY stream_pos DESC LIMIT %s OFFSET %s"
+
+const countSearchEventsSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_search_events WHERE syncapi_search_events MATCH $1" +
+	" AND room_id IN ($2) AND key IN ($3)"
+
+const deleteRoomSearchEventsSQL = "" +
+	"DELETE FROM syncapi_search_events WHERE room_id = $1"
+
+type searchStatements struct {
+	// Whether go-sqlite3 was built with FTS5. If not then the statements
+	// aren't prepared.
+	available bool
+	// The search queries have a variable number of parameters, so they
+	// are built and run on the database when searching.
+	db                         *sql.DB
+	insertSearchEventStmt      *sql.Stmt
+	deleteRoomSearchEventsStmt *sql.Stmt
+}
+
+func (s *searchStatements) prepare(db *sql.DB) (err error) {
+	if err = db.QueryRow(selectFTS5AvailableSQL).Scan(&s.available); err != nil {
+		return
+	}
+	if !s.available {
+		logrus.Warn("Full text search is unavailable, as dendrite was built without the sqlite_fts5 tag")
+		return
+	}
+	if _, err = db.Exec(searchSchema); err != nil {
+		return
+	}
+	s.db = db
+	if s.insertSearchEventStmt, err = db.Prepare(insertSearchEventSQL); err != nil {
+		return
+	}
+	if s.deleteRoomSearchEventsStmt, err = db.Prepare(deleteRoomSearchEventsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *searchStatements) insertSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string, pos types.StreamPosition,
+	roomID, key, text string,
+) error {
+	if !s.available {
+		return nil
+	}
+	stmt := common.TxStmt(txn, s.insertSearchEventStmt)
+	_, err := stmt.ExecContext(ctx, eventID, pos, roomID, key, text)
+	return err
+}
+
+// searchEvents returns the events matching all of the words in the search
+// term, ranked by how well they match it.
+func (s *searchStatements) searchEvents(
+	ctx context.Context, searchTerm string, roomIDs, keys []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	if !s.available {
+		return nil, 0, types.ErrSearchUnavailable
+	}
+	query := ftsQuery(searchTerm)
+	if query == "" || len(roomIDs) == 0 || len(keys) == 0 {
+		return nil, 0, nil
+	}
+	params := make([]interface{}, 0, 1+len(roomIDs)+len(keys)+2)
+	params = append(params, query)
+	for _, roomID := range roomIDs {
+		params = append(params, roomID)
+	}
+	for _, key := range keys {
+		params = append(params, key)
+	}
+
+	var count int
+	countSQL := expandSearchSQL(countSearchEventsSQL, len(roomIDs), len(keys))
+	if err := s.db.QueryRowContext(ctx, countSQL, params...).Scan(&count); err != nil {
+		return nil, 0, err
+	}
+
+	searchSQL := searchEventsByRecentSQL
+	if orderByRank {
+		searchSQL = searchEventsByRankSQL
+	}
+	n := len(params)
+	searchSQL = fmt.Sprintf(
+		expandSearchSQL(searchSQL, len(roomIDs), len(keys)),
+		fmt.Sprintf("$%d", n+1), fmt.Sprintf("$%d", n+2),
+	)
+	rows, err := s.db.QueryContext(ctx, searchSQL, append(params, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "searchEvents: rows.close() failed")
+
+	var results []types.SearchResult
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.StreamPosition, &result.Rank); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
+
+// expandSearchSQL expands the room ID and key parameters of a search query
+// into the given number of parameters each.
+func expandSearchSQL(query string, roomCount, keyCount int) string {
+	query = strings.Replace(query, "($2)", common.QueryVariadicOffset(roomCount, 1), 1)
+	return strings.Replace(query, "($3)", common.QueryVariadicOffset(keyCount, 1+roomCount), 1)
+}
+
+// deleteRoomSearchEvents removes the events of a room from the index.
+func (s *searchStatements) deleteRoomSearchEvents(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	if !s.available {
+		return nil
+	}
+	_, err := common.TxStmt(txn, s.deleteRoomSearchEventsStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+// ftsQuery turns a search term into an FTS query matching every word in it,
+// so that FTS operators in the search term are treated as normal words.
+func ftsQuery(searchTerm string) string {
+	words := strings.Fields(searchTerm)
+	for i, word := range words {
+		words[i] = `"` + strings.Replace(word, `"`, "", -1) + `"`
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// bundledRelationsKey is the key in the unsigned data of an event that the
+// aggregations of its relations are bundled under.
+const bundledRelationsKey = "m.relations"
+
+// BundleAggregations adds the aggregations of the events relating to each of
+// the events, which are in the given room, to their unsigned data for the
+// given user. Only edits by the sender of an event replace it.
+// https://github.com/matrix-org/matrix-doc/pull/2675
+func BundleAggregations(
+	ctx context.Context, db storage.Database, userID, roomID string, events []gomatrixserverlib.ClientEvent,
+) error {
+	for i := range events {
+		ev := &events[i]
+		if ev.StateKey != nil {
+			continue
+		}
+		var relations types.BundledRelations
+		counts, err := db.AnnotationCounts(ctx, roomID, ev.EventID)
+		if err != nil {
+			return err
+		}
+		if len(counts) > 0 {
+			relations.Annotation = &types.AnnotationChunk{Chunk: counts}
+		}
+		replacement, err := db.LatestReplacement(ctx, roomID, ev.EventID, ev.Sender)
+		if err != nil {
+			return err
+		}
+		if replacement != nil {
+			clientEv := gomatrixserverlib.HeaderedToClientEvent(*replacement, gomatrixserverlib.FormatAll)
+			relations.Replace = &clientEv
+		}
+		latest, count, participated, err := db.ThreadSummary(ctx, roomID, ev.EventID, userID)
+		if err != nil {
+			return err
+		}
+		if latest != nil {
+			relations.Thread = &types.ThreadSummary{
+				LatestEvent:             gomatrixserverlib.HeaderedToClientEvent(*latest, gomatrixserverlib.FormatAll),
+				Count:                   count,
+				CurrentUserParticipated: participated || ev.Sender == userID,
+			}
+		}
+		if relations == (types.BundledRelations{}) {
+			continue
+		}
+		if err = setUnsignedField(ev, bundledRelationsKey, relations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundleResponseAggregations bundles the aggregations into the timelines of
+// the rooms in the sync response of a user.
+func bundleResponseAggregations(ctx context.Context, db storage.Database, userID string, res *types.Response) error {
+	for roomID, jr := range res.Rooms.Join {
+		if err := BundleAggregations(ctx, db, userID, roomID, jr.Timeline.Events); err != nil {
+			return err
+		}
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		if err := BundleAggregations(ctx, db, userID, roomID, lr.Timeline.Events); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setUnsignedField sets a field in the unsigned data of a client event,
+// keeping the fields which are already there.
+func setUnsignedField(ev *gomatrixserverlib.ClientEvent, key string, value interface{}) error {
+	unsigned := map[string]json.RawMessage{}
+	if len(ev.Unsigned) > 0 {
+		if err := json.Unmarshal(ev.Unsigned, &unsigned); err != nil {
+			return err
+		}
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	unsigned[key] = encoded
+	if ev.Unsigned, err = json.Marshal(unsigned); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const deviceListsRoomID = "!encrypted:localhost"
+
+// deviceListsTest is a sync API with a room which alice and bob are joined to.
+type deviceListsTest struct {
+	t          *testing.T
+	db         storage.Database
+	notifier   *Notifier
+	rp         *RequestPool
+	privateKey ed25519.PrivateKey
+	prevEvents []gomatrixserverlib.EventReference
+	state      map[gomatrixserverlib.StateKeyTuple]string
+}
+
+func newDeviceListsTest(t *testing.T, encrypted bool) (*deviceListsTest, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-syncapi-devicelists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.NewSyncServerDatasource("file:"+filepath.Join(dir, "syncapi.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &deviceListsTest{
+		t: t, db: db, privateKey: privateKey,
+		state: make(map[gomatrixserverlib.StateKeyTuple]string),
+	}
+
+	d.writeState("@alice:localhost", gomatrixserverlib.MRoomCreate, "", map[string]string{"creator": "@alice:localhost"})
+	d.writeState("@alice:localhost", gomatrixserverlib.MRoomMember, "@alice:localhost", map[string]string{"membership": "join"})
+	d.writeState("@bob:localhost", gomatrixserverlib.MRoomMember, "@bob:localhost", map[string]string{"membership": "join"})
+	if encrypted {
+		d.writeState("@alice:localhost", "m.room.encryption", "", map[string]string{"algorithm": "m.megolm.v1.aes-sha2"})
+	}
+
+	pos, err := db.SyncPosition(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.notifier = NewNotifier(pos)
+	if err = d.notifier.Load(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	deviceDB, err := devices.NewDatabase("file:"+filepath.Join(dir, "device.db"), nil, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.rp = NewRequestPool(db, d.notifier, nil, deviceDB, nil, nil)
+	return d, func() { _ = os.RemoveAll(dir) }
+}
+
+// writeState writes a state event to the room and tells the notifier about it.
+func (d *deviceListsTest) writeState(sender, eventType, stateKey string, content interface{}) {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     sender,
+		RoomID:     deviceListsRoomID,
+		Type:       eventType,
+		StateKey:   &stateKey,
+		PrevEvents: d.prevEvents,
+		AuthEvents: []gomatrixserverlib.EventReference{},
+		Depth:      int64(len(d.prevEvents) + 1),
+	}
+	if err := builder.SetContent(content); err != nil {
+		d.t.Fatal(err)
+	}
+	ev, err := builder.Build(time.Now(), "localhost", "ed25519:test", d.privateKey, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	headered := ev.Headered(gomatrixserverlib.RoomVersionV4)
+	tuple := gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: stateKey}
+	var removed []string
+	if replaced, ok := d.state[tuple]; ok {
+		removed = []string{replaced}
+	}
+	d.state[tuple] = ev.EventID()
+	pos, err := d.db.WriteEvent(
+		context.Background(), &headered, []gomatrixserverlib.HeaderedEvent{headered}, []string{ev.EventID()}, removed, nil, false,
+	)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	d.prevEvents = []gomatrixserverlib.EventReference{ev.EventReference()}
+	if d.notifier != nil {
+		d.notifier.OnNewEvent(&headered, "", nil, types.PaginationToken{PDUPosition: pos})
+	}
+}
+
+// changeDevices records that the devices of the user changed, as the device
+// list consumer does.
+func (d *deviceListsTest) changeDevices(userID string) {
+	pos, err := d.db.AddDeviceListChange(context.Background(), userID)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	d.notifier.OnNewEvent(nil, "", d.notifier.UsersSharingRoomsWith(userID), types.PaginationToken{DeviceListPosition: pos})
+}
+
+// sync returns the device lists of an incremental sync for alice, and the
+// next batch token.
+func (d *deviceListsTest) sync(since string) (changed, left map[string]bool, next string) {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/sync?timeout=0&since="+since, nil)
+	res := d.rp.OnIncomingSyncRequest(req, &authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"})
+	if res.Code != http.StatusOK {
+		d.t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	resJSON, err := json.Marshal(res.JSON)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	var body struct {
+		NextBatch   string `json:"next_batch"`
+		DeviceLists struct {
+			Changed []string `json:"changed"`
+			Left    []string `json:"left"`
+		} `json:"device_lists"`
+	}
+	if err = json.Unmarshal(resJSON, &body); err != nil {
+		d.t.Fatal(err)
+	}
+	changed, left = make(map[string]bool), make(map[string]bool)
+	for _, userID := range body.DeviceLists.Changed {
+		changed[userID] = true
+	}
+	for _, userID := range body.DeviceLists.Left {
+		left[userID] = true
+	}
+	return changed, left, body.NextBatch
+}
+
+func (d *deviceListsTest) currentToken() string {
+	pos := d.notifier.CurrentPosition()
+	return pos.String()
+}
+
+func TestDeviceListChangedForUserInSharedEncryptedRoom(t *testing.T) {
+	d, cleanup := newDeviceListsTest(t, true)
+	defer cleanup()
+	since := d.currentToken()
+
+	d.changeDevices("@bob:localhost")
+	d.changeDevices("@carol:localhost")
+	changed, _, next := d.sync(since)
+	if !changed["@bob:localhost"] {
+		t.Errorf("expected bob to be in device_lists.changed, got %v", changed)
+	}
+	if changed["@carol:localhost"] {
+		t.Errorf("expected carol, who doesn't share a room with alice, not to be in device_lists.changed")
+	}
+
+	// The change is only sent once.
+	if changed, _, _ = d.sync(next); len(changed) != 0 {
+		t.Errorf("expected no device list changes since the last sync, got %v", changed)
+	}
+}
+
+func TestDeviceListNotChangedForUnencryptedRoom(t *testing.T) {
+	d, cleanup := newDeviceListsTest(t, false)
+	defer cleanup()
+	since := d.currentToken()
+
+	d.changeDevices("@bob:localhost")
+	if changed, _, _ := d.sync(since); len(changed) != 0 {
+		t.Errorf("expected no device list changes for a room which isn't encrypted, got %v", changed)
+	}
+}
+
+func TestDeviceListLeftWhenNoLongerSharingRoom(t *testing.T) {
+	d, cleanup := newDeviceListsTest(t, true)
+	defer cleanup()
+	since := d.currentToken()
+
+	d.writeState("@bob:localhost", gomatrixserverlib.MRoomMember, "@bob:localhost", map[string]string{"membership": "leave"})
+	if _, left, _ := d.sync(since); !left["@bob:localhost"] {
+		t.Errorf("expected bob to be in device_lists.left, got %v", left)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// typeFilter is the part of an event filter that selects events by type.
+type typeFilter struct {
+	types    []string
+	notTypes []string
+	limit    int
+}
+
+func accountDataTypeFilter(filter *gomatrixserverlib.EventFilter) typeFilter {
+	return typeFilter{filter.Types, filter.NotTypes, filter.Limit}
+}
+
+func roomAccountDataTypeFilter(filter *gomatrixserverlib.RoomEventFilter) typeFilter {
+	return typeFilter{filter.Types, filter.NotTypes, filter.Limit}
+}
+
+// allows returns whether events of the given type pass the filter. Types
+// listed in not_types are excluded even if they are also listed in types.
+func (f typeFilter) allows(eventType string) bool {
+	for _, notType := range f.notTypes {
+		if filterTypeMatches(notType, eventType) {
+			return false
+		}
+	}
+	if f.types == nil {
+		return true
+	}
+	for _, t := range f.types {
+		if filterTypeMatches(t, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTypes returns the types which pass the filter, up to its limit. A
+// limit of zero or less means there is no limit.
+func (f typeFilter) filterTypes(eventTypes []string) []string {
+	filtered := []string{}
+	for _, eventType := range eventTypes {
+		if f.limit > 0 && len(filtered) >= f.limit {
+			break
+		}
+		if f.allows(eventType) {
+			filtered = append(filtered, eventType)
+		}
+	}
+	return filtered
+}
+
+// filterEvents returns the events which pass the filter, up to its limit.
+func (f typeFilter) filterEvents(events []gomatrixserverlib.ClientEvent) []gomatrixserverlib.ClientEvent {
+	filtered := []gomatrixserverlib.ClientEvent{}
+	for _, event := range events {
+		if f.limit > 0 && len(filtered) >= f.limit {
+			break
+		}
+		if f.allows(event.Type) {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
+}
+
+// senderFilter is an event filter which also selects events by their sender,
+// such as the filters for presence and timeline events.
+type senderFilter struct {
+	typeFilter
+	senders    []string
+	notSenders []string
+}
+
+func newPresenceFilter(filter *gomatrixserverlib.EventFilter) senderFilter {
+	return senderFilter{accountDataTypeFilter(filter), filter.Senders, filter.NotSenders}
+}
+
+// FilterRoomEvents returns the events which pass the types and senders of a
+// room event filter, up to its limit.
+func FilterRoomEvents(
+	filter *gomatrixserverlib.RoomEventFilter, events []gomatrixserverlib.ClientEvent,
+) []gomatrixserverlib.ClientEvent {
+	return senderFilter{roomAccountDataTypeFilter(filter), filter.Senders, filter.NotSenders}.filterEvents(events)
+}
+
+// allowsSender returns whether events from the given sender pass the filter.
+func (f senderFilter) allowsSender(sender string) bool {
+	for _, notSender := range f.notSenders {
+		if notSender == sender {
+			return false
+		}
+	}
+	if f.senders == nil {
+		return true
+	}
+	for _, s := range f.senders {
+		if s == sender {
+			return true
+		}
+	}
+	return false
+}
+
+// filterEvents returns the events which pass the filter, up to its limit.
+func (f senderFilter) filterEvents(events []gomatrixserverlib.ClientEvent) []gomatrixserverlib.ClientEvent {
+	fromSenders := []gomatrixserverlib.ClientEvent{}
+	for _, event := range events {
+		if f.allowsSender(event.Sender) {
+			fromSenders = append(fromSenders, event)
+		}
+	}
+	return f.typeFilter.filterEvents(fromSenders)
+}
+
+// filterTypeMatches returns whether an event type matches a type from a
+// filter, where a '*' matches any sequence of characters as defined in
+// https://matrix.org/docs/spec/client_server/r0.5.0.html#post-matrix-client-r0-user-userid-filter
+func filterTypeMatches(pattern, eventType string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == eventType
+	}
+	if !strings.HasPrefix(eventType, parts[0]) {
+		return false
+	}
+	eventType = eventType[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(eventType, part)
+		if i < 0 {
+			return false
+		}
+		eventType = eventType[i+len(part):]
+	}
+	return strings.HasSuffix(eventType, last)
+}
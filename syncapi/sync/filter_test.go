@@ -0,0 +1,91 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var accountDataEvents = []gomatrixserverlib.ClientEvent{
+	{Type: "m.push_rules"},
+	{Type: "m.direct"},
+	{Type: "im.vector.setting.breadcrumbs"},
+	{Type: "im.vector.web.settings"},
+}
+
+func eventTypes(events []gomatrixserverlib.ClientEvent) []string {
+	types := []string{}
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	return types
+}
+
+func TestAccountDataFilterTypes(t *testing.T) {
+	filter := accountDataTypeFilter(&gomatrixserverlib.EventFilter{
+		Types: []string{"m.push_rules"},
+	})
+	got := eventTypes(filter.filterEvents(accountDataEvents))
+	if want := []string{"m.push_rules"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected only %v, got %v", want, got)
+	}
+}
+
+func TestAccountDataFilterNotTypesWildcard(t *testing.T) {
+	filter := roomAccountDataTypeFilter(&gomatrixserverlib.RoomEventFilter{
+		NotTypes: []string{"im.vector.*"},
+	})
+	got := filter.filterTypes([]string{
+		"m.push_rules", "m.direct", "im.vector.setting.breadcrumbs", "im.vector.web.settings",
+	})
+	if want := []string{"m.push_rules", "m.direct"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestAccountDataFilterLimit(t *testing.T) {
+	filter := accountDataTypeFilter(&gomatrixserverlib.EventFilter{
+		Types: []string{"im.*"},
+		Limit: 1,
+	})
+	got := eventTypes(filter.filterEvents(accountDataEvents))
+	if want := []string{"im.vector.setting.breadcrumbs"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestFilterTypeMatches(t *testing.T) {
+	tests := []struct {
+		pattern, eventType string
+		want               bool
+	}{
+		{"m.room.message", "m.room.message", true},
+		{"m.room.message", "m.room.messages", false},
+		{"*", "anything", true},
+		{"m.*", "m.room.member", true},
+		{"m.*", "im.vector", false},
+		{"*.settings", "im.vector.web.settings", true},
+		{"im.*.settings", "im.vector.web.settings", true},
+		{"a*a", "a", false},
+	}
+	for _, tt := range tests {
+		if got := filterTypeMatches(tt.pattern, tt.eventType); got != tt.want {
+			t.Errorf("filterTypeMatches(%q, %q) = %v, want %v", tt.pattern, tt.eventType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// ignoredUserListType is the type of the global account data which lists
+// the users that a user ignores.
+// https://matrix.org/docs/spec/client_server/r0.6.0#ignoring-users
+const ignoredUserListType = "m.ignored_user_list"
+
+type ignoredUserListContent struct {
+	IgnoredUsers map[string]json.RawMessage `json:"ignored_users"`
+}
+
+// IgnoredUsers returns the users that a local user ignores. The list is read
+// again for every request, so that changes to it apply from the next one.
+func (rp *RequestPool) IgnoredUsers(ctx context.Context, userID string) (map[string]bool, error) {
+	if rp.accountDB == nil {
+		return nil, nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := rp.accountDB.GetAccountDataByType(ctx, localpart, "", ignoredUserListType)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var content ignoredUserListContent
+	if err = json.Unmarshal(data.Content, &content); err != nil {
+		// The account data is only checked to be JSON when it is saved, so
+		// a list that isn't understood is treated as empty.
+		return nil, nil
+	}
+	ignored := make(map[string]bool, len(content.IgnoredUsers))
+	for ignoredUserID := range content.IgnoredUsers {
+		ignored[ignoredUserID] = true
+	}
+	return ignored, nil
+}
+
+// FilterIgnoredEvents removes the events sent by ignored users. State events
+// are kept, as the state of the room doesn't make sense without them.
+func FilterIgnoredEvents(
+	events []gomatrixserverlib.ClientEvent, ignored map[string]bool,
+) []gomatrixserverlib.ClientEvent {
+	if len(ignored) == 0 {
+		return events
+	}
+	result := []gomatrixserverlib.ClientEvent{}
+	for _, ev := range events {
+		if ev.StateKey != nil || !ignored[ev.Sender] {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
+
+// removeIgnoredEvents removes the timeline events, typing notifications and
+// invites from ignored users from the sync response of a user.
+func removeIgnoredEvents(res *types.Response, userID string, ignored map[string]bool) error {
+	if len(ignored) == 0 {
+		return nil
+	}
+	for roomID, jr := range res.Rooms.Join {
+		jr.Timeline.Events = FilterIgnoredEvents(jr.Timeline.Events, ignored)
+		if err := filterTypingUsers(jr.Ephemeral.Events, func(typingUserID string) bool {
+			return !ignored[typingUserID]
+		}); err != nil {
+			return err
+		}
+		res.Rooms.Join[roomID] = jr
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		lr.Timeline.Events = FilterIgnoredEvents(lr.Timeline.Events, ignored)
+		res.Rooms.Leave[roomID] = lr
+	}
+	for roomID, ir := range res.Rooms.Invite {
+		for _, ev := range ir.InviteState.Events {
+			if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil && *ev.StateKey == userID && ignored[ev.Sender] {
+				delete(res.Rooms.Invite, roomID)
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestSyncOmitsMessagesFromIgnoredUsers(t *testing.T) {
+	h, cleanup := newHistoryTest(t)
+	defer cleanup()
+	create := h.writeState("@alice:localhost", gomatrixserverlib.MRoomCreate, "", map[string]string{"creator": "@alice:localhost"})
+	aliceJoin := h.writeState("@alice:localhost", gomatrixserverlib.MRoomMember, "@alice:localhost", map[string]string{"membership": "join"})
+	shared := h.writeState("@alice:localhost", gomatrixserverlib.MRoomHistoryVisibility, "", map[string]string{"history_visibility": "shared"})
+	bobJoin := h.writeState("@bob:localhost", gomatrixserverlib.MRoomMember, "@bob:localhost", map[string]string{"membership": "join"})
+	malloryJoin := h.writeState("@mallory:localhost", gomatrixserverlib.MRoomMember, "@mallory:localhost", map[string]string{"membership": "join"})
+	aliceMessage := h.writeMessage("@alice:localhost", "hello")
+	malloryMessage := h.writeMessage("@mallory:localhost", "spam")
+
+	ignore := func(content string) {
+		if err := h.accountDB.SaveAccountData(context.Background(), "bob", "", ignoredUserListType, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ignore(`{"ignored_users":{"@mallory:localhost":{}}}`)
+	// The member event of mallory is kept, as it is part of the state.
+	want := []string{create, aliceJoin, shared, bobJoin, malloryJoin, aliceMessage}
+	if got := h.timeline("@bob:localhost"); !equalEventIDs(got, want) {
+		t.Errorf("expected bob to see %v, got %v", want, got)
+	}
+	want = append(want, malloryMessage)
+	if got := h.timeline("@alice:localhost"); !equalEventIDs(got, want) {
+		t.Errorf("expected alice to see %v, got %v", want, got)
+	}
+
+	// Unignoring mallory applies from the next sync.
+	ignore(`{"ignored_users":{}}`)
+	if got := h.timeline("@bob:localhost"); !equalEventIDs(got, want) {
+		t.Errorf("expected bob to see %v after unignoring mallory, got %v", want, got)
+	}
+}
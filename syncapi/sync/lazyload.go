@@ -0,0 +1,200 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// lazyLoadCache remembers which members each device has already been sent
+// in each room, so that lazy-loading syncs don't send them again. Devices
+// are forgotten on their next initial or full state sync, when the client
+// has to be sent everything again anyway, or once they haven't synced for
+// lazyLoadCacheTTL. A forgotten device is sent its members again.
+type lazyLoadCache struct {
+	mutex           sync.Mutex
+	devices         map[lazyLoadDeviceKey]*lazyLoadDevice
+	lastCleanUpTime time.Time
+}
+
+// lazyLoadCacheTTL is how long a device which has stopped syncing is
+// remembered for.
+const lazyLoadCacheTTL = time.Hour
+
+type lazyLoadDeviceKey struct {
+	userID   string
+	deviceID string
+}
+
+type lazyLoadDevice struct {
+	// A map of room ID -> set of member user IDs.
+	rooms    map[string]map[string]struct{}
+	lastUsed time.Time
+}
+
+func newLazyLoadCache() *lazyLoadCache {
+	return &lazyLoadCache{
+		devices:         make(map[lazyLoadDeviceKey]*lazyLoadDevice),
+		lastCleanUpTime: time.Now(),
+	}
+}
+
+// forget clears the members that have been sent to a device.
+func (c *lazyLoadCache) forget(userID, deviceID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.devices, lazyLoadDeviceKey{userID, deviceID})
+}
+
+// forgetMember clears a member of a room from the members that have been sent
+// to every device, so that the devices are sent the member's new event.
+func (c *lazyLoadCache) forgetMember(roomID, member string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, device := range c.devices {
+		delete(device.rooms[roomID], member)
+	}
+}
+
+// removeExpiredDevices forgets the devices which haven't synced for
+// lazyLoadCacheTTL. It only iterates through the devices now and again.
+// NB: Callers should have locked the mutex before calling this function.
+func (c *lazyLoadCache) removeExpiredDevices(now time.Time) {
+	if c.lastCleanUpTime.Add(time.Minute).After(now) {
+		return
+	}
+	c.lastCleanUpTime = now
+
+	deleteBefore := now.Add(-lazyLoadCacheTTL)
+	for key, device := range c.devices {
+		if device.lastUsed.Before(deleteBefore) {
+			delete(c.devices, key)
+		}
+	}
+}
+
+// sentMembers returns the members that have been sent to a device in a room.
+// The returned set must only be used while holding the mutex.
+func (c *lazyLoadCache) sentMembers(userID, deviceID, roomID string) map[string]struct{} {
+	now := time.Now()
+	c.removeExpiredDevices(now)
+
+	key := lazyLoadDeviceKey{userID, deviceID}
+	device, ok := c.devices[key]
+	if !ok {
+		device = &lazyLoadDevice{rooms: make(map[string]map[string]struct{})}
+		c.devices[key] = device
+	}
+	device.lastUsed = now
+	rooms := device.rooms
+	members, ok := rooms[roomID]
+	if !ok {
+		members = make(map[string]struct{})
+		rooms[roomID] = members
+	}
+	return members
+}
+
+// lazyLoadMembers removes the m.room.member events from the state block of
+// each joined room in the response, except for those of the senders of events
+// in the timeline. Members that the device has been sent before are only sent
+// again if the filter includes redundant members. Member events for senders
+// which aren't in the state block already are fetched with getMember.
+func (c *lazyLoadCache) lazyLoadMembers(
+	res *types.Response, userID, deviceID string,
+	stateFilter *gomatrixserverlib.StateFilter,
+	getMember func(roomID, userID string) (*gomatrixserverlib.ClientEvent, error),
+) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for roomID, jr := range res.Rooms.Join {
+		sent := c.sentMembers(userID, deviceID, roomID)
+		wanted := func(member string) bool {
+			_, alreadySent := sent[member]
+			return stateFilter.IncludeRedundantMembers || !alreadySent
+		}
+
+		senders := make(map[string]struct{})
+		included := make(map[string]struct{})
+		for _, ev := range jr.Timeline.Events {
+			senders[ev.Sender] = struct{}{}
+			if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil {
+				// The client learns about members from the timeline too.
+				included[*ev.StateKey] = struct{}{}
+			}
+		}
+
+		state := make([]gomatrixserverlib.ClientEvent, 0, len(jr.State.Events))
+		for _, ev := range jr.State.Events {
+			if ev.Type != gomatrixserverlib.MRoomMember || ev.StateKey == nil {
+				state = append(state, ev)
+				continue
+			}
+			member := *ev.StateKey
+			if _, isSender := senders[member]; isSender && wanted(member) {
+				state = append(state, ev)
+				included[member] = struct{}{}
+			}
+		}
+
+		for sender := range senders {
+			if _, ok := included[sender]; ok || !wanted(sender) {
+				continue
+			}
+			ev, err := getMember(roomID, sender)
+			if err != nil {
+				return err
+			}
+			if ev != nil {
+				state = append(state, *ev)
+			}
+			included[sender] = struct{}{}
+		}
+
+		for member := range included {
+			sent[member] = struct{}{}
+		}
+		jr.State.Events = state
+		res.Rooms.Join[roomID] = jr
+	}
+	return nil
+}
+
+// membersToSend returns which of the members should be sent to a device in a
+// room, and remembers that the device has been sent them. Members that the
+// device has been sent before are only returned again if redundant members
+// are included.
+func (c *lazyLoadCache) membersToSend(
+	userID, deviceID, roomID string, members []string, includeRedundant bool,
+) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	sent := c.sentMembers(userID, deviceID, roomID)
+	toSend := []string{}
+	for _, member := range members {
+		if _, alreadySent := sent[member]; alreadySent && !includeRedundant {
+			continue
+		}
+		sent[member] = struct{}{}
+		toSend = append(toSend, member)
+	}
+	return toSend
+}
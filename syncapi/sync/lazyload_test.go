@@ -0,0 +1,189 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const lazyLoadRoomID = "!big:localhost"
+
+func memberEvent(userID string) gomatrixserverlib.ClientEvent {
+	stateKey := userID
+	return gomatrixserverlib.ClientEvent{
+		Type:     gomatrixserverlib.MRoomMember,
+		Sender:   userID,
+		StateKey: &stateKey,
+		Content:  gomatrixserverlib.RawJSON(`{"membership":"join"}`),
+	}
+}
+
+// newBigRoomResponse returns a sync response for a room with 500 members,
+// all of whom are in the state block, and a timeline of messages from the
+// given senders.
+func newBigRoomResponse(senders ...string) *types.Response {
+	jr := types.NewJoinResponse()
+	jr.State.Events = append(jr.State.Events, gomatrixserverlib.ClientEvent{
+		Type:     "m.room.create",
+		StateKey: new(string),
+	})
+	for i := 0; i < 500; i++ {
+		jr.State.Events = append(jr.State.Events, memberEvent(fmt.Sprintf("@user%d:localhost", i)))
+	}
+	for _, sender := range senders {
+		jr.Timeline.Events = append(jr.Timeline.Events, gomatrixserverlib.ClientEvent{
+			Type:   "m.room.message",
+			Sender: sender,
+		})
+	}
+	res := types.NewResponse(types.PaginationToken{})
+	res.Rooms.Join[lazyLoadRoomID] = *jr
+	return res
+}
+
+// stateMembers returns the members in the state block of the response.
+func stateMembers(res *types.Response) []string {
+	var members []string
+	for _, ev := range res.Rooms.Join[lazyLoadRoomID].State.Events {
+		if ev.Type == gomatrixserverlib.MRoomMember {
+			members = append(members, *ev.StateKey)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+func getMemberFromStateBlock(roomID, userID string) (*gomatrixserverlib.ClientEvent, error) {
+	ev := memberEvent(userID)
+	return &ev, nil
+}
+
+func TestLazyLoadMembersOnlyIncludesSenders(t *testing.T) {
+	cache := newLazyLoadCache()
+	stateFilter := &gomatrixserverlib.StateFilter{LazyLoadMembers: true}
+	res := newBigRoomResponse("@user1:localhost", "@user42:localhost", "@user1:localhost")
+
+	err := cache.lazyLoadMembers(res, "@alice:localhost", "DEVICE", stateFilter, getMemberFromStateBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := stateMembers(res)
+	if len(members) != 2 || members[0] != "@user1:localhost" || members[1] != "@user42:localhost" {
+		t.Fatalf("expected only the two senders' member events, got %d: %v", len(members), members)
+	}
+	if n := len(res.Rooms.Join[lazyLoadRoomID].State.Events); n != 3 {
+		t.Fatalf("expected other state events to be kept, got %d state events", n)
+	}
+}
+
+func TestLazyLoadMembersSkipsRedundantMembers(t *testing.T) {
+	cache := newLazyLoadCache()
+	stateFilter := &gomatrixserverlib.StateFilter{LazyLoadMembers: true}
+	first := newBigRoomResponse("@user1:localhost")
+	if err := cache.lazyLoadMembers(first, "@alice:localhost", "DEVICE", stateFilter, getMemberFromStateBlock); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next sync has a timeline from a new sender and a sender the
+	// device has already been sent, and no member events in the state.
+	second := types.NewResponse(types.PaginationToken{})
+	jr := types.NewJoinResponse()
+	jr.Timeline.Events = []gomatrixserverlib.ClientEvent{
+		{Type: "m.room.message", Sender: "@user1:localhost"},
+		{Type: "m.room.message", Sender: "@user2:localhost"},
+	}
+	second.Rooms.Join[lazyLoadRoomID] = *jr
+	if err := cache.lazyLoadMembers(second, "@alice:localhost", "DEVICE", stateFilter, getMemberFromStateBlock); err != nil {
+		t.Fatal(err)
+	}
+	if members := stateMembers(second); len(members) != 1 || members[0] != "@user2:localhost" {
+		t.Fatalf("expected only the new sender to be sent, got %v", members)
+	}
+
+	// Another device hasn't been sent anything yet.
+	third := newBigRoomResponse("@user1:localhost")
+	if err := cache.lazyLoadMembers(third, "@alice:localhost", "OTHER", stateFilter, getMemberFromStateBlock); err != nil {
+		t.Fatal(err)
+	}
+	if members := stateMembers(third); len(members) != 1 {
+		t.Fatalf("expected the sender to be sent to another device, got %v", members)
+	}
+
+	// Redundant members are sent again if the filter asks for them.
+	stateFilter.IncludeRedundantMembers = true
+	fourth := newBigRoomResponse("@user1:localhost", "@user2:localhost")
+	if err := cache.lazyLoadMembers(fourth, "@alice:localhost", "DEVICE", stateFilter, getMemberFromStateBlock); err != nil {
+		t.Fatal(err)
+	}
+	if members := stateMembers(fourth); len(members) != 2 {
+		t.Fatalf("expected redundant members to be sent, got %v", members)
+	}
+}
+
+func TestLazyLoadCacheForgetsDevicesWhichStopSyncing(t *testing.T) {
+	cache := newLazyLoadCache()
+	stateFilter := &gomatrixserverlib.StateFilter{LazyLoadMembers: true}
+	if err := cache.lazyLoadMembers(newBigRoomResponse("@user1:localhost"), "@alice:localhost", "DEVICE", stateFilter, getMemberFromStateBlock); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.lazyLoadMembers(newBigRoomResponse("@user1:localhost"), "@bob:localhost", "DEVICE", stateFilter, getMemberFromStateBlock); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice's device stopped syncing a while ago.
+	cache.devices[lazyLoadDeviceKey{"@alice:localhost", "DEVICE"}].lastUsed = time.Now().Add(-2 * lazyLoadCacheTTL)
+	cache.removeExpiredDevices(time.Now().Add(2 * time.Minute))
+
+	if _, ok := cache.devices[lazyLoadDeviceKey{"@alice:localhost", "DEVICE"}]; ok {
+		t.Errorf("expected the device which stopped syncing to be forgotten")
+	}
+	if _, ok := cache.devices[lazyLoadDeviceKey{"@bob:localhost", "DEVICE"}]; !ok {
+		t.Errorf("expected the device which is still syncing to be remembered")
+	}
+
+	// The forgotten device is sent its members again.
+	res := newBigRoomResponse("@user1:localhost")
+	if err := cache.lazyLoadMembers(res, "@alice:localhost", "DEVICE", stateFilter, getMemberFromStateBlock); err != nil {
+		t.Fatal(err)
+	}
+	if members := stateMembers(res); len(members) != 1 {
+		t.Fatalf("expected the sender to be sent again, got %v", members)
+	}
+}
+
+func TestLazyLoadCacheForgetsMembersWhoseMembershipChanges(t *testing.T) {
+	cache := newLazyLoadCache()
+	stateFilter := &gomatrixserverlib.StateFilter{LazyLoadMembers: true}
+	if err := cache.lazyLoadMembers(newBigRoomResponse("@user1:localhost", "@user2:localhost"), "@alice:localhost", "DEVICE", stateFilter, getMemberFromStateBlock); err != nil {
+		t.Fatal(err)
+	}
+
+	// user1 changes their display name, but user2 doesn't.
+	cache.forgetMember(lazyLoadRoomID, "@user1:localhost")
+
+	res := newBigRoomResponse("@user1:localhost", "@user2:localhost")
+	if err := cache.lazyLoadMembers(res, "@alice:localhost", "DEVICE", stateFilter, getMemberFromStateBlock); err != nil {
+		t.Fatal(err)
+	}
+	if members := stateMembers(res); len(members) != 1 || members[0] != "@user1:localhost" {
+		t.Fatalf("expected only the member whose membership changed to be sent again, got %v", members)
+	}
+}
@@ -120,6 +120,38 @@ func (n *Notifier) OnNewEvent(
 	}
 }
 
+// UsersSharingRoomsWith returns the users who are joined to at least one of
+// the rooms that the given user is joined to, including the user themselves.
+func (n *Notifier) UsersSharingRoomsWith(userID string) []string {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	users := userIDSet{userID: true}
+	for _, joinedUsers := range n.roomIDToJoinedUsers {
+		if joinedUsers[userID] {
+			for joinedUserID := range joinedUsers {
+				users.add(joinedUserID)
+			}
+		}
+	}
+	return users.values()
+}
+
+// joinedUsersInRoomsWith returns the users joined to each of the rooms which
+// the given user is joined to.
+func (n *Notifier) joinedUsersInRoomsWith(userID string) map[string][]string {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	rooms := make(map[string][]string)
+	for roomID, joinedUsers := range n.roomIDToJoinedUsers {
+		if joinedUsers[userID] {
+			rooms[roomID] = joinedUsers.values()
+		}
+	}
+	return rooms
+}
+
 // GetListener returns a UserStreamListener that can be used to wait for
 // updates for a user. Must be closed.
 // notify for anything before sincePos
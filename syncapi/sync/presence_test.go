@@ -0,0 +1,152 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	carol = "@carol:localhost"
+	dave  = "@dave:localhost"
+)
+
+// newPresenceTest returns a request pool for a server where alice shares the
+// test room with bob and dave, and carol is in a room of her own. Everyone
+// but alice is online.
+func newPresenceTest(t *testing.T) (*RequestPool, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-syncapi-presence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.NewSyncServerDatasource("file:"+filepath.Join(dir, "syncapi.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNotifier(syncPositionBefore)
+	n.setUsersJoinedToRooms(map[string][]string{
+		roomID:             {alice, bob, dave},
+		"!carol:localhost": {carol},
+	})
+	for _, userID := range []string{bob, carol, dave} {
+		db.SetPresence(eduAPI.PresenceEvent{UserID: userID, Presence: eduAPI.PresenceOnline})
+	}
+	return &RequestPool{db: db, notifier: n}, func() { _ = os.RemoveAll(dir) }
+}
+
+// presenceSenders returns the users whose presence is in a sync of alice.
+func presenceSenders(t *testing.T, rp *RequestPool, req syncRequest, res *types.Response) []string {
+	res, err := rp.appendPresence(res, alice, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	senders := []string{}
+	for _, ev := range res.Presence.Events {
+		senders = append(senders, ev.Sender)
+	}
+	sort.Strings(senders)
+	return senders
+}
+
+func initialSyncRequest() syncRequest {
+	req := newTestSyncRequest(alice, types.PaginationToken{})
+	req.since = nil
+	return req
+}
+
+func TestPresenceOnlyFromUsersSharingRooms(t *testing.T) {
+	rp, cleanup := newPresenceTest(t)
+	defer cleanup()
+	want := []string{bob, dave}
+	if got := presenceSenders(t, rp, initialSyncRequest(), types.NewResponse(syncPositionAfter)); !equalStrings(got, want) {
+		t.Errorf("expected presence from %v, got %v", want, got)
+	}
+
+	// Once bob has left the only room he shared with alice, she no longer
+	// gets his presence.
+	rp.notifier.OnNewEvent(&bobLeaveEvent, "", nil, syncPositionAfter)
+	want = []string{dave}
+	if got := presenceSenders(t, rp, initialSyncRequest(), types.NewResponse(syncPositionAfter)); !equalStrings(got, want) {
+		t.Errorf("expected presence from %v after bob left, got %v", want, got)
+	}
+}
+
+func TestPresenceFilterSenders(t *testing.T) {
+	rp, cleanup := newPresenceTest(t)
+	defer cleanup()
+	req := initialSyncRequest()
+	req.filter.Presence.Senders = []string{dave, carol}
+	want := []string{dave}
+	if got := presenceSenders(t, rp, req, types.NewResponse(syncPositionAfter)); !equalStrings(got, want) {
+		t.Errorf("expected presence from %v with a senders filter, got %v", want, got)
+	}
+
+	req = initialSyncRequest()
+	req.filter.Presence.NotSenders = []string{dave}
+	want = []string{bob}
+	if got := presenceSenders(t, rp, req, types.NewResponse(syncPositionAfter)); !equalStrings(got, want) {
+		t.Errorf("expected presence from %v with a not_senders filter, got %v", want, got)
+	}
+
+	req = initialSyncRequest()
+	req.filter.Presence.Limit = 1
+	if got := presenceSenders(t, rp, req, types.NewResponse(syncPositionAfter)); len(got) != 1 {
+		t.Errorf("expected presence from one user with a limit, got %v", got)
+	}
+}
+
+func TestPresenceOfNewlyJoinedUsers(t *testing.T) {
+	rp, cleanup := newPresenceTest(t)
+	defer cleanup()
+	// Nobody's presence has changed since the last sync, but dave joined the
+	// room in it.
+	req := newTestSyncRequest(alice, types.PaginationToken{EDUTypingPosition: 3})
+	res := types.NewResponse(syncPositionAfter)
+	jr := types.NewJoinResponse()
+	daveJoin := gomatrixserverlib.ClientEvent{
+		Type: gomatrixserverlib.MRoomMember, Sender: dave, StateKey: &[]string{dave}[0],
+		Content: []byte(`{"membership":"join"}`),
+	}
+	jr.Timeline.Events = []gomatrixserverlib.ClientEvent{daveJoin}
+	res.Rooms.Join[roomID] = *jr
+	want := []string{dave}
+	if got := presenceSenders(t, rp, req, res); !equalStrings(got, want) {
+		t.Errorf("expected presence from %v, got %v", want, got)
+	}
+	if got := presenceSenders(t, rp, req, types.NewResponse(syncPositionAfter)); len(got) != 0 {
+		t.Errorf("expected no presence without any changes, got %v", got)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"encoding/json"
+	"testing"
+
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestSyncIncludesReceipts(t *testing.T) {
+	h, cleanup := newHistoryTest(t)
+	defer cleanup()
+	h.writeState("@alice:localhost", gomatrixserverlib.MRoomCreate, "", map[string]string{"creator": "@alice:localhost"})
+	h.writeState("@alice:localhost", gomatrixserverlib.MRoomMember, "@alice:localhost", map[string]string{"membership": "join"})
+	h.writeState("@bob:remote.example.com", gomatrixserverlib.MRoomMember, "@bob:remote.example.com", map[string]string{"membership": "join"})
+	eventID := h.writeMessage("@alice:localhost", "hello")
+	h.db.StoreReceipts(historyRoomID, []eduAPI.ReceiptEvent{{
+		UserID:    "@bob:remote.example.com",
+		RoomID:    historyRoomID,
+		EventID:   eventID,
+		Type:      "m.read",
+		Timestamp: 1234,
+	}})
+
+	var got map[string]map[string]map[string]struct {
+		TS gomatrixserverlib.Timestamp `json:"ts"`
+	}
+	for _, ev := range h.sync("@alice:localhost").Ephemeral.Events {
+		if ev.Type != "m.receipt" {
+			continue
+		}
+		if err := json.Unmarshal(ev.Content, &got); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if receipt, ok := got[eventID]["m.read"]["@bob:remote.example.com"]; !ok || receipt.TS != 1234 {
+		t.Errorf("expected alice to see bob's read receipt for %s, got %v", eventID, got)
+	}
+}
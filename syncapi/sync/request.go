@@ -16,13 +16,21 @@ package sync
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
@@ -38,10 +46,16 @@ type syncRequest struct {
 	timeout       time.Duration
 	since         *types.PaginationToken // nil means that no since token was supplied
 	wantFullState bool
+	filter        gomatrixserverlib.Filter
+	setPresence   string
 	log           *log.Entry
+	// The users that the user ignores, whose events are left out.
+	ignoredUsers map[string]bool
 }
 
-func newSyncRequest(req *http.Request, device authtypes.Device) (*syncRequest, error) {
+func newSyncRequest(
+	req *http.Request, device authtypes.Device, accountDB accounts.Database,
+) (*syncRequest, error) {
 	timeout := getTimeout(req.URL.Query().Get("timeout"))
 	fullState := req.URL.Query().Get("full_state")
 	wantFullState := fullState != "" && fullState != "false"
@@ -49,14 +63,27 @@ func newSyncRequest(req *http.Request, device authtypes.Device) (*syncRequest, e
 	if err != nil {
 		return nil, err
 	}
-	// TODO: Additional query params: set_presence, filter
+	filter, err := getFilter(req.Context(), accountDB, device.UserID, req.URL.Query().Get("filter"))
+	if err != nil {
+		return nil, err
+	}
+	limit := defaultTimelineLimit
+	if filter.Room.Timeline.Limit > 0 {
+		limit = filter.Room.Timeline.Limit
+	}
+	setPresence, err := getSetPresence(req.URL.Query().Get("set_presence"))
+	if err != nil {
+		return nil, err
+	}
 	return &syncRequest{
 		ctx:           req.Context(),
 		device:        device,
 		timeout:       timeout,
 		since:         since,
 		wantFullState: wantFullState,
-		limit:         defaultTimelineLimit, // TODO: read from filter
+		filter:        *filter,
+		setPresence:   setPresence,
+		limit:         limit,
 		log:           util.GetLogger(req.Context()),
 	}, nil
 }
@@ -72,6 +99,64 @@ func getTimeout(timeoutMS string) time.Duration {
 	return time.Duration(i) * time.Millisecond
 }
 
+// getSetPresence returns the presence given in the 'set_presence' query
+// parameter, which the user is marked as by syncing. Users are marked as
+// online by default.
+func getSetPresence(setPresence string) (string, error) {
+	switch setPresence {
+	case "":
+		return eduAPI.PresenceOnline, nil
+	case eduAPI.PresenceOnline, eduAPI.PresenceUnavailable, eduAPI.PresenceOffline:
+		return setPresence, nil
+	default:
+		return "", fmt.Errorf("invalid set_presence %q", setPresence)
+	}
+}
+
+// A filterError is returned by newSyncRequest if the 'filter' query parameter
+// is malformed or refers to a filter which doesn't exist.
+type filterError struct {
+	code int
+	err  *jsonerror.MatrixError
+}
+
+func (e *filterError) Error() string {
+	return e.err.Err
+}
+
+// getFilter returns the filter given in the 'filter' query parameter, which is
+// either a filter definition in JSON or the ID of a filter that the user has
+// uploaded. If there is no filter then the empty filter, which lets everything
+// through, is returned.
+func getFilter(
+	ctx context.Context, accountDB accounts.Database, userID, filterParam string,
+) (*gomatrixserverlib.Filter, error) {
+	if filterParam == "" {
+		return &gomatrixserverlib.Filter{}, nil
+	}
+	if strings.HasPrefix(filterParam, "{") {
+		var filter gomatrixserverlib.Filter
+		if err := json.Unmarshal([]byte(filterParam), &filter); err != nil {
+			return nil, &filterError{http.StatusBadRequest, jsonerror.BadJSON("Invalid filter: " + err.Error())}
+		}
+		if err := filter.Validate(); err != nil {
+			return nil, &filterError{http.StatusBadRequest, jsonerror.BadJSON("Invalid filter: " + err.Error())}
+		}
+		return &filter, nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := accountDB.GetFilter(ctx, localpart, filterParam)
+	if err == sql.ErrNoRows {
+		return nil, &filterError{http.StatusNotFound, jsonerror.NotFound(fmt.Sprintf("No such filter %q", filterParam))}
+	} else if err != nil {
+		return nil, fmt.Errorf("accountDB.GetFilter: %w", err)
+	}
+	return filter, nil
+}
+
 // getSyncStreamPosition tries to parse a 'since' token taken from the API to a
 // types.PaginationToken. If the string is empty then (nil, nil) is returned.
 // There are two forms of tokens: The full length form containing all PDU and EDU
@@ -0,0 +1,88 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testFilterJSON = `{"account_data":{"types":["m.push_rules"]},"room":{"timeline":{"limit":5,"not_types":["m.room.member"]}}}`
+
+func newSyncRequestWithFilter(t *testing.T, accountDB accounts.Database, filterParam string) (*syncRequest, error) {
+	req := httptest.NewRequest(http.MethodGet, "/sync?filter="+url.QueryEscape(filterParam), nil)
+	return newSyncRequest(req, authtypes.Device{UserID: "@alice:localhost", ID: "DEVICE"}, accountDB)
+}
+
+func TestStoredFilterMatchesInlineFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	accountDB, err := accounts.NewDatabase("file:"+filepath.Join(dir, "account.db"), nil, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var filter gomatrixserverlib.Filter
+	if err = json.Unmarshal([]byte(testFilterJSON), &filter); err != nil {
+		t.Fatal(err)
+	}
+	filterID, err := accountDB.PutFilter(context.Background(), "alice", &filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inline, err := newSyncRequestWithFilter(t, accountDB, testFilterJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := newSyncRequestWithFilter(t, accountDB, filterID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inline.filter, stored.filter) {
+		t.Errorf("expected the stored filter %+v to match the inline filter %+v", stored.filter, inline.filter)
+	}
+	if inline.limit != 5 || stored.limit != 5 {
+		t.Errorf("expected the timeline limit of the filter to be used, got %d and %d", inline.limit, stored.limit)
+	}
+
+	if _, err = newSyncRequestWithFilter(t, accountDB, "12345"); err == nil {
+		t.Error("expected an unknown filter ID to be rejected")
+	} else if fErr, ok := err.(*filterError); !ok || fErr.code != http.StatusNotFound {
+		t.Errorf("expected a 404 for an unknown filter ID, got %v", err)
+	}
+	if _, err = newSyncRequestWithFilter(t, accountDB, `{"room":`); err == nil {
+		t.Error("expected a malformed filter to be rejected")
+	} else if fErr, ok := err.(*filterError); !ok || fErr.err.ErrCode != "M_BAD_JSON" {
+		t.Errorf("expected M_BAD_JSON for a malformed filter, got %v", err)
+	}
+}
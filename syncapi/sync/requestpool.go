@@ -15,16 +15,22 @@
 package sync
 
 import (
+	"encoding/json"
 	"net/http"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -32,12 +38,19 @@ import (
 type RequestPool struct {
 	db        storage.Database
 	accountDB accounts.Database
+	deviceDB  devices.Database
 	notifier  *Notifier
+	lazyLoad  *lazyLoadCache
+	eduAPI    eduAPI.EDUServerInputAPI
+	queryAPI  api.RoomserverQueryAPI
 }
 
 // NewRequestPool makes a new RequestPool
-func NewRequestPool(db storage.Database, n *Notifier, adb accounts.Database) *RequestPool {
-	return &RequestPool{db, adb, n}
+func NewRequestPool(
+	db storage.Database, n *Notifier, adb accounts.Database, ddb devices.Database,
+	eduInputAPI eduAPI.EDUServerInputAPI, queryAPI api.RoomserverQueryAPI,
+) *RequestPool {
+	return &RequestPool{db, adb, ddb, n, newLazyLoadCache(), eduInputAPI, queryAPI}
 }
 
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
@@ -48,8 +61,13 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 
 	// Extract values from request
 	userID := device.UserID
-	syncReq, err := newSyncRequest(req, *device)
-	if err != nil {
+	syncReq, err := newSyncRequest(req, *device, rp.accountDB)
+	if fErr, ok := err.(*filterError); ok {
+		return util.JSONResponse{
+			Code: fErr.code,
+			JSON: fErr.err,
+		}
+	} else if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.Unknown(err.Error()),
@@ -61,6 +79,14 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 		"timeout": syncReq.timeout,
 	})
 
+	start := time.Now()
+	outcome := "failure"
+	defer func() {
+		syncDurations.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+	}()
+
+	rp.updatePresence(syncReq)
+
 	currPos := rp.notifier.CurrentPosition()
 
 	if shouldReturnImmediately(syncReq) {
@@ -70,6 +96,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 			return jsonerror.InternalServerError()
 		}
 		logger.WithField("next", syncData.NextBatch).Info("Responding immediately")
+		outcome = "immediate"
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: syncData,
@@ -124,6 +151,10 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 
 		if !syncData.IsEmpty() || hasTimedOut {
 			logger.WithField("next", syncData.NextBatch).WithField("timed_out", hasTimedOut).Info("Responding")
+			outcome = "notified"
+			if hasTimedOut {
+				outcome = "timed_out"
+			}
 			return util.JSONResponse{
 				Code: http.StatusOK,
 				JSON: syncData,
@@ -132,8 +163,45 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 	}
 }
 
+// syncDurations is labelled with how the sync was answered, as syncs which
+// waited for new data or timed out take as long as the client let them.
+var syncDurations = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "sync_duration_seconds",
+		Help:      "How long it takes to respond to /sync",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	},
+	// outcome is one of immediate, notified, timed_out or failure.
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(syncDurations)
+}
+
+// LazyLoadMembers returns which of the members of a room a device should be
+// sent the member events of when it is lazy-loading members outside of /sync,
+// e.g. when paginating through /messages. The device won't be sent these
+// members again in its incremental syncs unless it asks for redundant members.
+func (rp *RequestPool) LazyLoadMembers(
+	device *authtypes.Device, roomID string, members []string, includeRedundant bool,
+) []string {
+	return rp.lazyLoad.membersToSend(device.UserID, device.ID, roomID, members, includeRedundant)
+}
+
+// OnMembershipChange is called when the membership of a user in a room
+// changes, so that devices lazy-loading members are sent the user's new
+// member event even if they have been sent an older one.
+func (rp *RequestPool) OnMembershipChange(roomID, userID string) {
+	rp.lazyLoad.forgetMember(roomID, userID)
+}
+
 func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.PaginationToken) (res *types.Response, err error) {
-	// TODO: handle ignored users
+	if req.ignoredUsers, err = rp.IgnoredUsers(req.ctx, req.device.UserID); err != nil {
+		return
+	}
 	if req.since == nil {
 		res, err = rp.db.CompleteSync(req.ctx, req.device.UserID, req.limit)
 	} else {
@@ -144,14 +212,373 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Pagin
 		return
 	}
 
-	accountDataFilter := gomatrixserverlib.DefaultEventFilter() // TODO: use filter provided in req instead
-	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.PDUPosition, &accountDataFilter)
+	// The members to lazy-load depend on the timeline, so events that the user
+	// may not see are removed from it first.
+	if err = rp.removeInvisibleEvents(req, res); err != nil {
+		return
+	}
+	if err = removeIgnoredEvents(res, req.device.UserID, req.ignoredUsers); err != nil {
+		return
+	}
+	if err = removeOwnTyping(res, req.device.UserID); err != nil {
+		return
+	}
+	if err = bundleResponseAggregations(req.ctx, rp.db, req.device.UserID, res); err != nil {
+		return
+	}
+
+	if stateFilter := &req.filter.Room.State; stateFilter.LazyLoadMembers {
+		if req.since == nil || req.wantFullState {
+			rp.lazyLoad.forget(req.device.UserID, req.device.ID)
+		}
+		err = rp.lazyLoad.lazyLoadMembers(
+			res, req.device.UserID, req.device.ID, stateFilter,
+			func(roomID, userID string) (*gomatrixserverlib.ClientEvent, error) {
+				ev, err := rp.db.GetStateEvent(req.ctx, roomID, gomatrixserverlib.MRoomMember, userID)
+				if err != nil || ev == nil {
+					return nil, err
+				}
+				clientEv := gomatrixserverlib.HeaderedToClientEvent(*ev, gomatrixserverlib.FormatSync)
+				return &clientEv, nil
+			},
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.PDUPosition)
+	if err != nil {
+		return
+	}
+
+	res, err = rp.appendPresence(res, req.device.UserID, req)
+	if err != nil {
+		return
+	}
+
+	res, err = rp.appendDeviceLists(res, req.device.UserID, req, latestPos.DeviceListPosition)
+	if err != nil {
+		return
+	}
+
+	res, err = rp.appendSendToDeviceMessages(res, req, latestPos.SendToDevicePosition)
+	if err != nil {
+		return
+	}
+
+	// The counts aren't part of the sync stream, so they are always sent so
+	// that the device knows when to upload more one-time keys.
+	res.DeviceOneTimeKeysCount, err = rp.deviceDB.OneTimeKeyCounts(req.ctx, req.device.UserID, req.device.ID)
 	return
 }
 
+// removeInvisibleEvents removes the events that the user may not see from the
+// timelines of the joined and left rooms in the response, according to the
+// history visibility of each room at the time of the events.
+func (rp *RequestPool) removeInvisibleEvents(req syncRequest, res *types.Response) error {
+	if rp.queryAPI == nil {
+		return nil
+	}
+	for roomID, jr := range res.Rooms.Join {
+		events, err := rp.visibleTimeline(req, jr.Timeline.Events, true)
+		if err != nil {
+			return err
+		}
+		jr.Timeline.Events = events
+		res.Rooms.Join[roomID] = jr
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		events, err := rp.visibleTimeline(req, lr.Timeline.Events, false)
+		if err != nil {
+			return err
+		}
+		lr.Timeline.Events = events
+		res.Rooms.Leave[roomID] = lr
+	}
+	return nil
+}
+
+// visibleTimeline returns the events of a timeline that the user may see.
+func (rp *RequestPool) visibleTimeline(
+	req syncRequest, timeline []gomatrixserverlib.ClientEvent, userCurrentlyInRoom bool,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	if len(timeline) == 0 {
+		return timeline, nil
+	}
+	eventIDs := make([]string, len(timeline))
+	for i := range timeline {
+		eventIDs[i] = timeline[i].EventID
+	}
+	events, err := rp.db.Events(req.ctx, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	events, err = VisibleEvents(req.ctx, rp.queryAPI, req.device.UserID, userCurrentlyInRoom, events)
+	if err != nil {
+		return nil, err
+	}
+	visible := make(map[string]bool, len(events))
+	for _, ev := range events {
+		visible[ev.EventID()] = true
+	}
+	result := []gomatrixserverlib.ClientEvent{}
+	for _, ev := range timeline {
+		if visible[ev.EventID] {
+			result = append(result, ev)
+		}
+	}
+	return result, nil
+}
+
+// updatePresence marks the user as having the presence given in the sync
+// request, unless they asked to stay offline.
+func (rp *RequestPool) updatePresence(req *syncRequest) {
+	if rp.eduAPI == nil || req.setPresence == eduAPI.PresenceOffline {
+		return
+	}
+	err := rp.eduAPI.InputPresenceEvent(req.ctx, &eduAPI.InputPresenceEventRequest{
+		InputPresenceEvent: eduAPI.InputPresenceEvent{
+			UserID:    req.device.UserID,
+			Presence:  req.setPresence,
+			Timestamp: gomatrixserverlib.AsTimestamp(time.Now()),
+		},
+	}, &eduAPI.InputPresenceEventResponse{})
+	if err != nil {
+		// Failing to update the presence shouldn't stop the user syncing.
+		req.log.WithError(err).Error("rp.eduAPI.InputPresenceEvent failed")
+	}
+}
+
+// appendPresence adds the presence of the users sharing a room with the user
+// which changed since the last sync, or all of them for an initial sync. The
+// presence of users who only started sharing a room with the user since the
+// last sync is added even if it hasn't changed, as the user won't have it.
+func (rp *RequestPool) appendPresence(
+	data *types.Response, userID string, req syncRequest,
+) (*types.Response, error) {
+	var since types.StreamPosition
+	if req.since != nil {
+		since = req.since.EDUTypingPosition
+	}
+	updated := rp.db.GetPresenceUpdatedAfter(since)
+	if req.since != nil {
+		if newlyShared := rp.newlySharedUsers(data, userID); len(newlyShared) > 0 {
+			for _, presence := range updated {
+				delete(newlyShared, presence.UserID)
+			}
+			for _, presence := range rp.db.GetPresenceUpdatedAfter(0) {
+				if newlyShared[presence.UserID] {
+					updated = append(updated, presence)
+				}
+			}
+		}
+	}
+	if len(updated) == 0 {
+		return data, nil
+	}
+
+	sharedUsers := make(map[string]bool)
+	for _, sharedUserID := range rp.notifier.UsersSharingRoomsWith(userID) {
+		sharedUsers[sharedUserID] = true
+	}
+	now := time.Now()
+	events := []gomatrixserverlib.ClientEvent{}
+	for _, presence := range updated {
+		if !sharedUsers[presence.UserID] || req.ignoredUsers[presence.UserID] {
+			continue
+		}
+		content, err := json.Marshal(map[string]interface{}{
+			"presence":         presence.Presence,
+			"status_msg":       presence.StatusMsg,
+			"last_active_ago":  cache.LastActiveAgo(presence, now),
+			"currently_active": presence.CurrentlyActive,
+		})
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, gomatrixserverlib.ClientEvent{
+			Type:    "m.presence",
+			Sender:  presence.UserID,
+			Content: content,
+		})
+	}
+	data.Presence.Events = newPresenceFilter(&req.filter.Presence).filterEvents(events)
+	return data, nil
+}
+
+// newlySharedUsers returns the users who joined the rooms in the response
+// since the last sync, along with everyone in the rooms which the user joined
+// since then.
+func (rp *RequestPool) newlySharedUsers(data *types.Response, userID string) map[string]bool {
+	users := make(map[string]bool)
+	var joinedRooms map[string][]string
+	for roomID, jr := range data.Rooms.Join {
+		for _, events := range [][]gomatrixserverlib.ClientEvent{jr.State.Events, jr.Timeline.Events} {
+			for _, ev := range events {
+				if ev.Type != gomatrixserverlib.MRoomMember || ev.StateKey == nil {
+					continue
+				}
+				var content gomatrixserverlib.MemberContent
+				if err := json.Unmarshal(ev.Content, &content); err != nil || content.Membership != gomatrixserverlib.Join {
+					continue
+				}
+				if *ev.StateKey != userID {
+					users[*ev.StateKey] = true
+					continue
+				}
+				if joinedRooms == nil {
+					joinedRooms = rp.notifier.joinedUsersInRoomsWith(userID)
+				}
+				for _, joinedUserID := range joinedRooms[roomID] {
+					users[joinedUserID] = true
+				}
+			}
+		}
+	}
+	return users
+}
+
+// appendDeviceLists adds the users whose devices changed since the last sync,
+// and who share an encrypted room with the user, to device_lists.changed. The
+// users who joined an encrypted room with the user are added too, as the user
+// won't have their devices yet. The users who no longer share an encrypted
+// room with the user after leaving one are added to device_lists.left.
+// https://matrix.org/docs/spec/client_server/r0.6.0#id84
+func (rp *RequestPool) appendDeviceLists(
+	data *types.Response, userID string, req syncRequest, currentPos types.StreamPosition,
+) (*types.Response, error) {
+	// Device lists are only tracked from an initial sync onwards.
+	if req.since == nil {
+		return data, nil
+	}
+
+	encryptedRooms := make(map[string][]string)
+	sharedUsers := make(map[string]bool)
+	for roomID, joinedUsers := range rp.notifier.joinedUsersInRoomsWith(userID) {
+		ev, err := rp.db.GetStateEvent(req.ctx, roomID, "m.room.encryption", "")
+		if err != nil {
+			return nil, err
+		}
+		if ev == nil {
+			continue
+		}
+		encryptedRooms[roomID] = joinedUsers
+		for _, joinedUserID := range joinedUsers {
+			sharedUsers[joinedUserID] = true
+		}
+	}
+
+	changed := make(map[string]bool)
+	updated, err := rp.db.DeviceListChangesInRange(req.ctx, req.since.DeviceListPosition, currentPos)
+	if err != nil {
+		return nil, err
+	}
+	for _, updatedUserID := range updated {
+		if updatedUserID == userID || sharedUsers[updatedUserID] {
+			changed[updatedUserID] = true
+		}
+	}
+
+	left := make(map[string]bool)
+	for roomID, jr := range data.Rooms.Join {
+		for _, events := range [][]gomatrixserverlib.ClientEvent{jr.State.Events, jr.Timeline.Events} {
+			for _, ev := range events {
+				membership, targetUserID, ok := clientMembership(ev)
+				switch {
+				case !ok:
+				case membership == gomatrixserverlib.Join && targetUserID == userID:
+					// The user joined the room, so all of its members are new.
+					for _, joinedUserID := range encryptedRooms[roomID] {
+						if joinedUserID != userID {
+							changed[joinedUserID] = true
+						}
+					}
+				case membership == gomatrixserverlib.Join && sharedUsers[targetUserID]:
+					changed[targetUserID] = true
+				case membership == gomatrixserverlib.Leave || membership == gomatrixserverlib.Ban:
+					if !sharedUsers[targetUserID] {
+						left[targetUserID] = true
+					}
+				}
+			}
+		}
+	}
+	for _, lr := range data.Rooms.Leave {
+		for _, events := range [][]gomatrixserverlib.ClientEvent{lr.State.Events, lr.Timeline.Events} {
+			for _, ev := range events {
+				if _, targetUserID, ok := clientMembership(ev); ok && !sharedUsers[targetUserID] {
+					left[targetUserID] = true
+				}
+			}
+		}
+	}
+	delete(left, userID)
+
+	for changedUserID := range changed {
+		data.DeviceLists.Changed = append(data.DeviceLists.Changed, changedUserID)
+	}
+	for leftUserID := range left {
+		data.DeviceLists.Left = append(data.DeviceLists.Left, leftUserID)
+	}
+	return data, nil
+}
+
+// maxSendToDeviceMessages is the most send-to-device messages that are sent
+// to a device in one sync.
+const maxSendToDeviceMessages = 100
+
+// appendSendToDeviceMessages adds the messages sent to the device since the
+// last sync to to_device. The device has received the messages up to the
+// position in its since token, so they are deleted first. If there are more
+// messages than are sent in one sync then next_batch has the position of the
+// last message that was sent, so that the rest are sent in the next sync.
+func (rp *RequestPool) appendSendToDeviceMessages(
+	data *types.Response, req syncRequest, currentPos types.StreamPosition,
+) (*types.Response, error) {
+	var sincePos types.StreamPosition
+	if req.since != nil {
+		sincePos = req.since.SendToDevicePosition
+		if err := rp.db.RemoveSendToDeviceMessages(req.ctx, req.device.UserID, req.device.ID, sincePos); err != nil {
+			return nil, err
+		}
+	}
+
+	events, lastPos, err := rp.db.SendToDeviceMessagesInRange(
+		req.ctx, req.device.UserID, req.device.ID, sincePos, currentPos, maxSendToDeviceMessages,
+	)
+	if err != nil {
+		return nil, err
+	}
+	data.ToDevice.Events = append(data.ToDevice.Events, events...)
+	if len(events) == maxSendToDeviceMessages {
+		var next *types.PaginationToken
+		if next, err = types.NewPaginationTokenFromString(data.NextBatch); err != nil {
+			return nil, err
+		}
+		next.SendToDevicePosition = lastPos
+		data.NextBatch = next.String()
+	}
+	return data, nil
+}
+
+// clientMembership returns the membership and the target user of a member
+// event, or false if the event isn't a member event.
+func clientMembership(ev gomatrixserverlib.ClientEvent) (string, string, bool) {
+	if ev.Type != gomatrixserverlib.MRoomMember || ev.StateKey == nil {
+		return "", "", false
+	}
+	var content struct {
+		Membership string `json:"membership"`
+	}
+	if err := json.Unmarshal(ev.Content, &content); err != nil {
+		return "", "", false
+	}
+	return content.Membership, *ev.StateKey, true
+}
+
 func (rp *RequestPool) appendAccountData(
 	data *types.Response, userID string, req syncRequest, currentPos types.StreamPosition,
-	accountDataFilter *gomatrixserverlib.EventFilter,
 ) (*types.Response, error) {
 	// TODO: Account data doesn't have a sync position of its own, meaning that
 	// account data might be sent multiple time to the client if multiple account
@@ -162,6 +589,8 @@ func (rp *RequestPool) appendAccountData(
 	if err != nil {
 		return nil, err
 	}
+	globalFilter := accountDataTypeFilter(&req.filter.AccountData)
+	roomFilter := roomAccountDataTypeFilter(&req.filter.Room.AccountData)
 
 	if req.since == nil {
 		// If this is the initial sync, we don't need to check if a data has
@@ -172,11 +601,11 @@ func (rp *RequestPool) appendAccountData(
 		if err != nil {
 			return nil, err
 		}
-		data.AccountData.Events = global
+		data.AccountData.Events = globalFilter.filterEvents(global)
 
 		for r, j := range data.Rooms.Join {
 			if len(rooms[r]) > 0 {
-				j.AccountData.Events = rooms[r]
+				j.AccountData.Events = roomFilter.filterEvents(rooms[r])
 				data.Rooms.Join[r] = j
 			}
 		}
@@ -188,7 +617,6 @@ func (rp *RequestPool) appendAccountData(
 	dataTypes, err := rp.db.GetAccountDataInRange(
 		req.ctx, userID,
 		types.StreamPosition(req.since.PDUPosition), types.StreamPosition(currentPos),
-		accountDataFilter,
 	)
 	if err != nil {
 		return nil, err
@@ -200,6 +628,14 @@ func (rp *RequestPool) appendAccountData(
 
 	// Iterate over the rooms
 	for roomID, dataTypes := range dataTypes {
+		if len(roomID) > 0 {
+			dataTypes = roomFilter.filterTypes(dataTypes)
+		} else {
+			dataTypes = globalFilter.filterTypes(dataTypes)
+		}
+		if len(dataTypes) == 0 {
+			continue
+		}
 		events := []gomatrixserverlib.ClientEvent{}
 		// Request the missing data from the database
 		for _, dataType := range dataTypes {
@@ -0,0 +1,98 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// sendToDevice stores messages for a device of alice, as the send-to-device
+// consumer does.
+func (d *deviceListsTest) sendToDevice(deviceID string, count int) {
+	var pos types.StreamPosition
+	for i := 0; i < count; i++ {
+		var err error
+		pos, err = d.db.AddSendToDeviceMessage(context.Background(), "@alice:localhost", deviceID, types.SendToDeviceEvent{
+			Sender:  "@bob:localhost",
+			Type:    "m.test",
+			Content: json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)),
+		})
+		if err != nil {
+			d.t.Fatal(err)
+		}
+	}
+	d.notifier.OnNewEvent(nil, "", []string{"@alice:localhost"}, types.PaginationToken{SendToDevicePosition: pos})
+}
+
+// syncToDevice returns the send-to-device messages of an incremental sync
+// for the ALICE device, and the next batch token.
+func (d *deviceListsTest) syncToDevice(since string) ([]types.SendToDeviceEvent, string) {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/sync?timeout=0&since="+since, nil)
+	res := d.rp.OnIncomingSyncRequest(req, &authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"})
+	if res.Code != http.StatusOK {
+		d.t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	body := res.JSON.(*types.Response)
+	return body.ToDevice.Events, body.NextBatch
+}
+
+func TestSendToDeviceMessagesAreDeletedOnceAcknowledged(t *testing.T) {
+	d, cleanup := newDeviceListsTest(t, false)
+	defer cleanup()
+	since := d.currentToken()
+	d.sendToDevice("ALICE", 2)
+	d.sendToDevice("OTHER", 1)
+
+	events, next := d.syncToDevice(since)
+	if len(events) != 2 || string(events[0].Content) != `{"n":0}` || events[1].Sender != "@bob:localhost" {
+		t.Fatalf("expected the two messages for the device, got %+v", events)
+	}
+	// The messages are sent again until the next batch token is used.
+	if events, _ = d.syncToDevice(since); len(events) != 2 {
+		t.Errorf("expected the two messages to be sent again, got %+v", events)
+	}
+	if events, _ = d.syncToDevice(next); len(events) != 0 {
+		t.Errorf("expected no messages after they were acknowledged, got %+v", events)
+	}
+	if events, _ = d.syncToDevice(since); len(events) != 0 {
+		t.Errorf("expected acknowledged messages to be deleted, got %+v", events)
+	}
+}
+
+func TestSendToDeviceMessagesAreSentInBatches(t *testing.T) {
+	d, cleanup := newDeviceListsTest(t, false)
+	defer cleanup()
+	since := d.currentToken()
+	d.sendToDevice("ALICE", maxSendToDeviceMessages+10)
+
+	events, next := d.syncToDevice(since)
+	if len(events) != maxSendToDeviceMessages {
+		t.Fatalf("expected %d messages in the first batch, got %d", maxSendToDeviceMessages, len(events))
+	}
+	if events, next = d.syncToDevice(next); len(events) != 10 || string(events[0].Content) != fmt.Sprintf(`{"n":%d}`, maxSendToDeviceMessages) {
+		t.Fatalf("expected the last 10 messages in the second batch, got %d", len(events))
+	}
+	if events, _ = d.syncToDevice(next); len(events) != 0 {
+		t.Errorf("expected no more messages, got %d", len(events))
+	}
+}
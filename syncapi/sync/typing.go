@@ -0,0 +1,66 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// removeOwnTyping removes a user from the typing notifications in their own
+// sync response. Their clients already know that they are typing, and are
+// confused by hearing it back. Other users still see them typing, as the
+// notifications are only changed in this response.
+func removeOwnTyping(res *types.Response, userID string) error {
+	for _, jr := range res.Rooms.Join {
+		if err := filterTypingUsers(jr.Ephemeral.Events, func(typingUserID string) bool {
+			return typingUserID != userID
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterTypingUsers keeps only the users for which keep returns true in the
+// typing notifications among the given ephemeral events.
+func filterTypingUsers(events []gomatrixserverlib.ClientEvent, keep func(userID string) bool) error {
+	for i, ev := range events {
+		if ev.Type != gomatrixserverlib.MTyping {
+			continue
+		}
+		var content struct {
+			UserIDs []string `json:"user_ids"`
+		}
+		if err := json.Unmarshal(ev.Content, &content); err != nil {
+			return err
+		}
+		typing := []string{}
+		for _, typingUserID := range content.UserIDs {
+			if keep(typingUserID) {
+				typing = append(typing, typingUserID)
+			}
+		}
+		content.UserIDs = typing
+		updated, err := json.Marshal(content)
+		if err != nil {
+			return err
+		}
+		events[i].Content = updated
+	}
+	return nil
+}
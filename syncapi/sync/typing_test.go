@@ -0,0 +1,66 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// typingUsers returns the users that a user is told are typing in the test
+// room, or nil if they aren't told about typing at all.
+func (h *historyTest) typingUsers(userID string) []string {
+	for _, ev := range h.sync(userID).Ephemeral.Events {
+		if ev.Type != gomatrixserverlib.MTyping {
+			continue
+		}
+		var content struct {
+			UserIDs []string `json:"user_ids"`
+		}
+		if err := json.Unmarshal(ev.Content, &content); err != nil {
+			h.t.Fatal(err)
+		}
+		return content.UserIDs
+	}
+	return nil
+}
+
+func TestSyncOmitsOwnTyping(t *testing.T) {
+	h, cleanup := newHistoryTest(t)
+	defer cleanup()
+	h.writeState("@alice:localhost", gomatrixserverlib.MRoomCreate, "", map[string]string{"creator": "@alice:localhost"})
+	h.writeState("@alice:localhost", gomatrixserverlib.MRoomMember, "@alice:localhost", map[string]string{"membership": "join"})
+	h.writeState("@bob:localhost", gomatrixserverlib.MRoomMember, "@bob:localhost", map[string]string{"membership": "join"})
+	h.db.AddTypingUser("@alice:localhost", historyRoomID, nil)
+	h.db.AddTypingUser("@bob:localhost", historyRoomID, nil)
+
+	for userID, want := range map[string][]string{
+		"@alice:localhost": {"@bob:localhost"},
+		"@bob:localhost":   {"@alice:localhost"},
+	} {
+		if got := h.typingUsers(userID); !equalEventIDs(got, want) {
+			t.Errorf("expected %s to see %v typing, got %v", userID, want, got)
+		}
+	}
+	h.db.RemoveTypingUser("@bob:localhost", historyRoomID)
+	if got := h.typingUsers("@alice:localhost"); got == nil || len(got) != 0 {
+		t.Errorf("expected alice to see nobody typing, got %v", got)
+	}
+	if got, want := h.typingUsers("@bob:localhost"), []string{"@alice:localhost"}; !equalEventIDs(got, want) {
+		t.Errorf("expected bob to still see alice typing, got %v", got)
+	}
+}
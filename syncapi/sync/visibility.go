@@ -0,0 +1,144 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// VisibleEvents returns the events that the user may see, according to the
+// history visibility of the room and the user's membership at each event.
+// Events whose state the roomserver doesn't know are left out.
+// https://matrix.org/docs/spec/client_server/r0.6.0#id87
+func VisibleEvents(
+	ctx context.Context, queryAPI api.RoomserverQueryAPI,
+	userID string, userCurrentlyInRoom bool, events []gomatrixserverlib.HeaderedEvent,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	states, err := stateBeforeEvents(ctx, queryAPI, userID, events)
+	if err != nil {
+		return nil, err
+	}
+	visible := []gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range events {
+		stateAtEvent, ok := states[ev.EventID()]
+		if !ok {
+			continue
+		}
+		// Users can always see the events changing their own membership.
+		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(userID) {
+			stateAtEvent = append([]gomatrixserverlib.Event{ev.Unwrap()}, stateAtEvent...)
+		}
+		if auth.IsUserAllowed(userID, userCurrentlyInRoom, stateAtEvent) {
+			visible = append(visible, ev)
+		}
+	}
+	return visible, nil
+}
+
+// stateBeforeEvents returns the history visibility and the membership of the
+// user in the room before each of the events, leaving out the events whose
+// state the roomserver doesn't know. The roomserver is asked once for each
+// distinct set of prev events; an event whose only prev event is also in the
+// list gets its state from that event instead, so a run of events in a
+// timeline needs a single query.
+func stateBeforeEvents(
+	ctx context.Context, queryAPI api.RoomserverQueryAPI,
+	userID string, events []gomatrixserverlib.HeaderedEvent,
+) (map[string][]gomatrixserverlib.Event, error) {
+	sorted := make([]*gomatrixserverlib.HeaderedEvent, len(events))
+	byID := make(map[string]*gomatrixserverlib.HeaderedEvent, len(events))
+	for i := range events {
+		sorted[i] = &events[i]
+		byID[events[i].EventID()] = &events[i]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Depth() < sorted[j].Depth()
+	})
+
+	stateToFetch := []gomatrixserverlib.StateKeyTuple{
+		{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+		{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+	}
+	states := make(map[string][]gomatrixserverlib.Event, len(events))
+	queried := make(map[string][]gomatrixserverlib.Event)
+	unknown := make(map[string]bool)
+	for _, ev := range sorted {
+		prevEventIDs := ev.PrevEventIDs()
+		if len(prevEventIDs) == 1 {
+			if prev, ok := byID[prevEventIDs[0]]; ok && prev.RoomID() == ev.RoomID() {
+				if stateBefore, known := states[prev.EventID()]; known {
+					states[ev.EventID()] = stateAfterEvent(stateBefore, prev.Unwrap(), stateToFetch)
+					continue
+				}
+			}
+		}
+
+		key := ev.RoomID() + "\x00" + strings.Join(prevEventIDs, "\x00")
+		if unknown[key] {
+			continue
+		}
+		if stateBefore, ok := queried[key]; ok {
+			states[ev.EventID()] = stateBefore
+			continue
+		}
+		var stateRes api.QueryStateAfterEventsResponse
+		queryErr := queryAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+			RoomID:       ev.RoomID(),
+			PrevEventIDs: prevEventIDs,
+			StateToFetch: stateToFetch,
+		}, &stateRes)
+		if queryErr != nil {
+			return nil, queryErr
+		}
+		if !stateRes.PrevEventsExist {
+			unknown[key] = true
+			continue
+		}
+		queried[key] = gomatrixserverlib.UnwrapEventHeaders(stateRes.StateEvents)
+		states[ev.EventID()] = queried[key]
+	}
+	return states, nil
+}
+
+// stateAfterEvent returns the given state with the event applied to it, if
+// it is one of the state events being tracked.
+func stateAfterEvent(
+	stateBefore []gomatrixserverlib.Event, ev gomatrixserverlib.Event,
+	stateToFetch []gomatrixserverlib.StateKeyTuple,
+) []gomatrixserverlib.Event {
+	tracked := false
+	for _, tuple := range stateToFetch {
+		if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+			tracked = true
+			break
+		}
+	}
+	if !tracked {
+		return stateBefore
+	}
+	stateAfter := make([]gomatrixserverlib.Event, 0, len(stateBefore)+1)
+	for _, stateEvent := range stateBefore {
+		if stateEvent.Type() != ev.Type() || !stateEvent.StateKeyEquals(*ev.StateKey()) {
+			stateAfter = append(stateAfter, stateEvent)
+		}
+	}
+	return append(stateAfter, ev)
+}
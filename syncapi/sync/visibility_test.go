@@ -0,0 +1,311 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const historyRoomID = "!history:localhost"
+
+// historyQueryAPI answers state queries with the state of the room after each
+// of the events that were written to it.
+type historyQueryAPI struct {
+	api.RoomserverQueryAPI
+	stateAfter map[string][]gomatrixserverlib.HeaderedEvent
+	queries    int
+}
+
+func (q *historyQueryAPI) QueryStateAfterEvents(
+	ctx context.Context,
+	request *api.QueryStateAfterEventsRequest,
+	response *api.QueryStateAfterEventsResponse,
+) error {
+	q.queries++
+	response.RoomExists = true
+	var state []gomatrixserverlib.HeaderedEvent
+	if len(request.PrevEventIDs) > 0 {
+		if state, response.PrevEventsExist = q.stateAfter[request.PrevEventIDs[0]]; !response.PrevEventsExist {
+			return nil
+		}
+	}
+	response.PrevEventsExist = true
+	for _, ev := range state {
+		for _, tuple := range request.StateToFetch {
+			if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+				response.StateEvents = append(response.StateEvents, ev)
+			}
+		}
+	}
+	return nil
+}
+
+// historyTest is a sync API with a room whose history visibility changes.
+type historyTest struct {
+	t          *testing.T
+	db         storage.Database
+	queryAPI   *historyQueryAPI
+	accountDB  accounts.Database
+	deviceDB   devices.Database
+	privateKey ed25519.PrivateKey
+	prevEvents []gomatrixserverlib.EventReference
+	state      []gomatrixserverlib.HeaderedEvent
+}
+
+func newHistoryTest(t *testing.T) (*historyTest, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-syncapi-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := storage.NewSyncServerDatasource("file:"+filepath.Join(dir, "syncapi.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &historyTest{
+		t: t, db: db, privateKey: privateKey,
+		queryAPI: &historyQueryAPI{stateAfter: make(map[string][]gomatrixserverlib.HeaderedEvent)},
+	}
+	if h.accountDB, err = accounts.NewDatabase("file:"+filepath.Join(dir, "account.db"), nil, "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if h.deviceDB, err = devices.NewDatabase("file:"+filepath.Join(dir, "device.db"), nil, "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	return h, func() { _ = os.RemoveAll(dir) }
+}
+
+// write writes an event to the room, which is a state event if a state key is
+// given, and returns its event ID.
+func (h *historyTest) write(sender, eventType string, stateKey *string, content interface{}) string {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     sender,
+		RoomID:     historyRoomID,
+		Type:       eventType,
+		StateKey:   stateKey,
+		PrevEvents: h.prevEvents,
+		AuthEvents: []gomatrixserverlib.EventReference{},
+		Depth:      int64(len(h.state) + 1),
+	}
+	if err := builder.SetContent(content); err != nil {
+		h.t.Fatal(err)
+	}
+	ev, err := builder.Build(time.Now(), "localhost", "ed25519:test", h.privateKey, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	headered := ev.Headered(gomatrixserverlib.RoomVersionV4)
+	var added, removed []string
+	if stateKey != nil {
+		added = []string{ev.EventID()}
+		state := []gomatrixserverlib.HeaderedEvent{headered}
+		for _, old := range h.state {
+			if old.Type() == eventType && old.StateKeyEquals(*stateKey) {
+				removed = append(removed, old.EventID())
+			} else {
+				state = append(state, old)
+			}
+		}
+		h.state = state
+	}
+	h.queryAPI.stateAfter[ev.EventID()] = h.state
+	if _, err = h.db.WriteEvent(
+		context.Background(), &headered, []gomatrixserverlib.HeaderedEvent{headered}, added, removed, nil, false,
+	); err != nil {
+		h.t.Fatal(err)
+	}
+	h.prevEvents = []gomatrixserverlib.EventReference{ev.EventReference()}
+	return ev.EventID()
+}
+
+func (h *historyTest) writeState(sender, eventType, stateKey string, content interface{}) string {
+	return h.write(sender, eventType, &stateKey, content)
+}
+
+func (h *historyTest) writeMessage(sender, body string) string {
+	return h.write(sender, "m.room.message", nil, map[string]string{"msgtype": "m.text", "body": body})
+}
+
+// syncedRoom is the part of a sync response about the test room.
+type syncedRoom struct {
+	Timeline struct {
+		Events []gomatrixserverlib.ClientEvent `json:"events"`
+	} `json:"timeline"`
+	Ephemeral struct {
+		Events []gomatrixserverlib.ClientEvent `json:"events"`
+	} `json:"ephemeral"`
+}
+
+// sync returns the room in a sync for the user since before the room was
+// created.
+func (h *historyTest) sync(userID string) syncedRoom {
+	pos, err := h.db.SyncPosition(context.Background())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	rp := NewRequestPool(h.db, NewNotifier(pos), h.accountDB, h.deviceDB, nil, h.queryAPI)
+	since := types.PaginationToken{}
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/sync?timeout=0&since="+since.String(), nil)
+	res := rp.OnIncomingSyncRequest(req, &authtypes.Device{UserID: userID, ID: "DEVICE"})
+	if res.Code != http.StatusOK {
+		h.t.Fatalf("expected 200 OK, got %d: %v", res.Code, res.JSON)
+	}
+	resJSON, err := json.Marshal(res.JSON)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	var body struct {
+		Rooms struct {
+			Join map[string]syncedRoom `json:"join"`
+		} `json:"rooms"`
+	}
+	if err = json.Unmarshal(resJSON, &body); err != nil {
+		h.t.Fatal(err)
+	}
+	return body.Rooms.Join[historyRoomID]
+}
+
+// timeline returns the IDs of the events in the timeline of the room in a
+// sync for the user since before the room was created.
+func (h *historyTest) timeline(userID string) []string {
+	eventIDs := []string{}
+	for _, ev := range h.sync(userID).Timeline.Events {
+		eventIDs = append(eventIDs, ev.EventID)
+	}
+	return eventIDs
+}
+
+func TestSyncHidesHistoryBeforeJoinWhenVisibilityIsJoined(t *testing.T) {
+	h, cleanup := newHistoryTest(t)
+	defer cleanup()
+	create := h.writeState("@alice:localhost", gomatrixserverlib.MRoomCreate, "", map[string]string{"creator": "@alice:localhost"})
+	aliceJoin := h.writeState("@alice:localhost", gomatrixserverlib.MRoomMember, "@alice:localhost", map[string]string{"membership": "join"})
+	shared := h.writeState("@alice:localhost", gomatrixserverlib.MRoomHistoryVisibility, "", map[string]string{"history_visibility": "shared"})
+	sharedMessage := h.writeMessage("@alice:localhost", "while shared")
+	// The change of history visibility is itself sent while the room is shared.
+	joined := h.writeState("@alice:localhost", gomatrixserverlib.MRoomHistoryVisibility, "", map[string]string{"history_visibility": "joined"})
+	joinedMessage := h.writeMessage("@alice:localhost", "while joined")
+	bobJoin := h.writeState("@bob:localhost", gomatrixserverlib.MRoomMember, "@bob:localhost", map[string]string{"membership": "join"})
+	afterJoin := h.writeMessage("@alice:localhost", "after bob joined")
+
+	want := []string{create, aliceJoin, shared, sharedMessage, joined, bobJoin, afterJoin}
+	if got := h.timeline("@bob:localhost"); !equalEventIDs(got, want) {
+		t.Errorf("expected bob to see %v, got %v", want, got)
+	}
+
+	want = []string{create, aliceJoin, shared, sharedMessage, joined, joinedMessage, bobJoin, afterJoin}
+	if got := h.timeline("@alice:localhost"); !equalEventIDs(got, want) {
+		t.Errorf("expected alice to see %v, got %v", want, got)
+	}
+}
+
+func TestVisibleEvents(t *testing.T) {
+	h, cleanup := newHistoryTest(t)
+	defer cleanup()
+	h.writeState("@alice:localhost", gomatrixserverlib.MRoomCreate, "", map[string]string{"creator": "@alice:localhost"})
+	h.writeState("@alice:localhost", gomatrixserverlib.MRoomMember, "@alice:localhost", map[string]string{"membership": "join"})
+	h.writeState("@alice:localhost", gomatrixserverlib.MRoomMember, "@bob:localhost", map[string]string{"membership": "invite"})
+
+	for _, tt := range []struct {
+		visibility  string
+		inRoom      bool
+		wantVisible bool
+	}{
+		{"world_readable", false, true},
+		{"shared", true, true},
+		{"shared", false, false},
+		{"invited", false, true},
+		{"joined", true, false},
+	} {
+		h.writeState("@alice:localhost", gomatrixserverlib.MRoomHistoryVisibility, "", map[string]string{"history_visibility": tt.visibility})
+		messageID := h.writeMessage("@alice:localhost", tt.visibility)
+		events, err := h.db.Events(context.Background(), []string{messageID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		visible, err := VisibleEvents(context.Background(), h.queryAPI, "@bob:localhost", tt.inRoom, events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(visible) == 1; got != tt.wantVisible {
+			t.Errorf("history visibility %s with bob invited and in room %v: expected visible %v, got %v", tt.visibility, tt.inRoom, tt.wantVisible, got)
+		}
+	}
+}
+
+func TestVisibleEventsQueriesTheStateOfATimelineOnce(t *testing.T) {
+	h, cleanup := newHistoryTest(t)
+	defer cleanup()
+	h.writeState("@alice:localhost", gomatrixserverlib.MRoomCreate, "", map[string]string{"creator": "@alice:localhost"})
+	h.writeState("@alice:localhost", gomatrixserverlib.MRoomMember, "@alice:localhost", map[string]string{"membership": "join"})
+	h.writeState("@alice:localhost", gomatrixserverlib.MRoomHistoryVisibility, "", map[string]string{"history_visibility": "shared"})
+	before := h.writeMessage("@alice:localhost", "before")
+	joined := h.writeState("@alice:localhost", gomatrixserverlib.MRoomHistoryVisibility, "", map[string]string{"history_visibility": "joined"})
+	hidden := h.writeMessage("@alice:localhost", "hidden")
+	bobJoin := h.writeState("@bob:localhost", gomatrixserverlib.MRoomMember, "@bob:localhost", map[string]string{"membership": "join"})
+	after := h.writeMessage("@alice:localhost", "after")
+
+	events, err := h.db.Events(context.Background(), []string{before, joined, hidden, bobJoin, after})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.queryAPI.queries = 0
+	visible, err := VisibleEvents(context.Background(), h.queryAPI, "@bob:localhost", true, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, ev := range visible {
+		got = append(got, ev.EventID())
+	}
+	if want := []string{before, joined, bobJoin, after}; !equalEventIDs(got, want) {
+		t.Errorf("expected bob to see %v, got %v", want, got)
+	}
+	if h.queryAPI.queries != 1 {
+		t.Errorf("expected the state of the timeline to be queried once, got %d queries", h.queryAPI.queries)
+	}
+}
+
+func equalEventIDs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
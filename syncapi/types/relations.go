@@ -0,0 +1,93 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	// RelationAnnotation annotates an event, e.g. with a reaction.
+	RelationAnnotation = "m.annotation"
+	// RelationReplace replaces the content of an event, i.e. edits it.
+	RelationReplace = "m.replace"
+	// RelationThread replies to the root event of a thread.
+	RelationThread = "m.thread"
+)
+
+// Relation is the m.relates_to of an event, which relates it to another
+// event in the same room.
+type Relation struct {
+	RelType string `json:"rel_type"`
+	EventID string `json:"event_id"`
+	// The key of an m.annotation, such as the emoji of a reaction.
+	Key string `json:"key,omitempty"`
+}
+
+// EventRelation returns the relation of an event to another event, or nil
+// if it doesn't have one. Replies without a rel_type aren't relations.
+func EventRelation(ev *gomatrixserverlib.HeaderedEvent) *Relation {
+	var content struct {
+		RelatesTo *Relation `json:"m.relates_to"`
+	}
+	if err := json.Unmarshal(ev.Content(), &content); err != nil || content.RelatesTo == nil {
+		return nil
+	}
+	if content.RelatesTo.RelType == "" || content.RelatesTo.EventID == "" {
+		return nil
+	}
+	return content.RelatesTo
+}
+
+// AnnotationCount is the number of times that an event has been annotated
+// with the same type and key.
+type AnnotationCount struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// AnnotationChunk is the bundled aggregation of the annotations of an event.
+type AnnotationChunk struct {
+	Chunk []AnnotationCount `json:"chunk"`
+}
+
+// BundledRelations is the aggregation of the events relating to an event,
+// which is bundled into its unsigned m.relations.
+type BundledRelations struct {
+	Annotation *AnnotationChunk `json:"m.annotation,omitempty"`
+	// The latest edit of the event by its sender.
+	Replace *gomatrixserverlib.ClientEvent `json:"m.replace,omitempty"`
+	Thread  *ThreadSummary                 `json:"m.thread,omitempty"`
+}
+
+// ThreadSummary is the bundled aggregation of the thread started by an
+// event, as seen by the user it is sent to.
+// https://github.com/matrix-org/matrix-doc/pull/3440
+type ThreadSummary struct {
+	LatestEvent gomatrixserverlib.ClientEvent `json:"latest_event"`
+	Count       int                           `json:"count"`
+	// Whether the user sent the root or one of the replies of the thread.
+	CurrentUserParticipated bool `json:"current_user_participated"`
+}
+
+// ThreadActivity is the root of a thread, with the stream position of the
+// latest reply in it.
+type ThreadActivity struct {
+	RootID         string
+	LatestPosition StreamPosition
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// ErrSearchUnavailable is returned when searching a database which can't
+// index events for searching.
+var ErrSearchUnavailable = errors.New("full text search is unavailable")
+
+// SearchKeys maps the event types that are indexed for searching to the key
+// in the search API that their text is found under.
+var SearchKeys = map[string]string{
+	"m.room.message": "content.body",
+	"m.room.name":    "content.name",
+	"m.room.topic":   "content.topic",
+}
+
+// SearchResult is an event that matched a search.
+type SearchResult struct {
+	EventID        string
+	StreamPosition StreamPosition
+	// How well the event matched. Higher is better.
+	Rank float64
+}
+
+// SearchableText returns the key and text of an event that should be indexed
+// for searching. Returns an empty key if the event shouldn't be indexed.
+func SearchableText(ev *gomatrixserverlib.HeaderedEvent) (key, text string) {
+	key, ok := SearchKeys[ev.Type()]
+	if !ok {
+		return "", ""
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal(ev.Content(), &content); err != nil {
+		return "", ""
+	}
+	// The key is of the form "content.<field>".
+	text, ok = content[key[len("content."):]].(string)
+	if !ok || text == "" {
+		return "", ""
+	}
+	return key, text
+}
@@ -63,9 +63,11 @@ const (
 // /sync or /messages, for example.
 type PaginationToken struct {
 	//Position StreamPosition
-	Type              PaginationTokenType
-	PDUPosition       StreamPosition
-	EDUTypingPosition StreamPosition
+	Type                 PaginationTokenType
+	PDUPosition          StreamPosition
+	EDUTypingPosition    StreamPosition
+	DeviceListPosition   StreamPosition
+	SendToDevicePosition StreamPosition
 }
 
 // NewPaginationTokenFromString takes a string of the form "xyyyy..." where "x"
@@ -113,6 +115,28 @@ func NewPaginationTokenFromString(s string) (token *PaginationToken, err error)
 		}
 	}
 
+	// Try to get the device list position.
+	if len(positions) >= 3 {
+		if devPos, err := strconv.ParseInt(positions[2], 10, 64); err != nil {
+			return nil, err
+		} else if devPos < 0 {
+			return nil, errors.New("negative device list position not allowed")
+		} else {
+			token.DeviceListPosition = StreamPosition(devPos)
+		}
+	}
+
+	// Try to get the send-to-device position.
+	if len(positions) >= 4 {
+		if sendPos, err := strconv.ParseInt(positions[3], 10, 64); err != nil {
+			return nil, err
+		} else if sendPos < 0 {
+			return nil, errors.New("negative send-to-device position not allowed")
+		} else {
+			token.SendToDevicePosition = StreamPosition(sendPos)
+		}
+	}
+
 	return
 }
 
@@ -131,7 +155,9 @@ func NewPaginationTokenFromTypeAndPosition(
 // String translates a PaginationToken to a string of the "xyyyy..." (see
 // NewPaginationToken to know what it represents).
 func (p *PaginationToken) String() string {
-	return fmt.Sprintf("%s%d_%d", p.Type, p.PDUPosition, p.EDUTypingPosition)
+	return fmt.Sprintf(
+		"%s%d_%d_%d_%d", p.Type, p.PDUPosition, p.EDUTypingPosition, p.DeviceListPosition, p.SendToDevicePosition,
+	)
 }
 
 // WithUpdates returns a copy of the PaginationToken with updates applied from another PaginationToken.
@@ -145,13 +171,21 @@ func (pt *PaginationToken) WithUpdates(other PaginationToken) PaginationToken {
 	if other.EDUTypingPosition != 0 {
 		ret.EDUTypingPosition = other.EDUTypingPosition
 	}
+	if other.DeviceListPosition != 0 {
+		ret.DeviceListPosition = other.DeviceListPosition
+	}
+	if other.SendToDevicePosition != 0 {
+		ret.SendToDevicePosition = other.SendToDevicePosition
+	}
 	return ret
 }
 
 // IsAfter returns whether one PaginationToken refers to states newer than another PaginationToken.
 func (sp *PaginationToken) IsAfter(other PaginationToken) bool {
 	return sp.PDUPosition > other.PDUPosition ||
-		sp.EDUTypingPosition > other.EDUTypingPosition
+		sp.EDUTypingPosition > other.EDUTypingPosition ||
+		sp.DeviceListPosition > other.DeviceListPosition ||
+		sp.SendToDevicePosition > other.SendToDevicePosition
 }
 
 // PrevEventRef represents a reference to a previous event in a state event upgrade
@@ -170,11 +204,20 @@ type Response struct {
 	Presence struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"presence"`
+	DeviceLists struct {
+		Changed []string `json:"changed"`
+		Left    []string `json:"left"`
+	} `json:"device_lists"`
+	ToDevice struct {
+		Events []SendToDeviceEvent `json:"events"`
+	} `json:"to_device"`
 	Rooms struct {
 		Join   map[string]JoinResponse   `json:"join"`
 		Invite map[string]InviteResponse `json:"invite"`
 		Leave  map[string]LeaveResponse  `json:"leave"`
 	} `json:"rooms"`
+	// The number of unclaimed one-time keys of the device keyed by algorithm.
+	DeviceOneTimeKeysCount map[string]int `json:"device_one_time_keys_count"`
 }
 
 // NewResponse creates an empty response with initialised maps.
@@ -194,14 +237,15 @@ func NewResponse(token PaginationToken) *Response {
 	//       This also applies to NewJoinResponse, NewInviteResponse and NewLeaveResponse.
 	res.AccountData.Events = make([]gomatrixserverlib.ClientEvent, 0)
 	res.Presence.Events = make([]gomatrixserverlib.ClientEvent, 0)
+	res.DeviceLists.Changed = make([]string, 0)
+	res.DeviceLists.Left = make([]string, 0)
+	res.ToDevice.Events = make([]SendToDeviceEvent, 0)
+	res.DeviceOneTimeKeysCount = make(map[string]int)
 
 	// Fill next_batch with a pagination token. Since this is a response to a sync request, we can assume
 	// we'll always return a stream token.
-	res.NextBatch = NewPaginationTokenFromTypeAndPosition(
-		PaginationTokenTypeStream,
-		StreamPosition(token.PDUPosition),
-		StreamPosition(token.EDUTypingPosition),
-	).String()
+	token.Type = PaginationTokenTypeStream
+	res.NextBatch = token.String()
 
 	return &res
 }
@@ -213,7 +257,18 @@ func (r *Response) IsEmpty() bool {
 		len(r.Rooms.Invite) == 0 &&
 		len(r.Rooms.Leave) == 0 &&
 		len(r.AccountData.Events) == 0 &&
-		len(r.Presence.Events) == 0
+		len(r.Presence.Events) == 0 &&
+		len(r.DeviceLists.Changed) == 0 &&
+		len(r.DeviceLists.Left) == 0 &&
+		len(r.ToDevice.Events) == 0
+}
+
+// SendToDeviceEvent is a message sent by a user to a device, which is sent
+// to the device in the to_device section of its syncs.
+type SendToDeviceEvent struct {
+	Sender  string          `json:"sender"`
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
 }
 
 // JoinResponse represents a /sync response for a room which is under the 'join' key.
@@ -18,9 +18,10 @@ func TestNewPaginationTokenFromString(t *testing.T) {
 			EDUTypingPosition: 1,
 		},
 		"t3_1_4": PaginationToken{
-			Type:              PaginationTokenTypeTopology,
-			PDUPosition:       3,
-			EDUTypingPosition: 1,
+			Type:               PaginationTokenTypeTopology,
+			PDUPosition:        3,
+			EDUTypingPosition:  1,
+			DeviceListPosition: 4,
 		},
 	}
 